@@ -23,15 +23,23 @@
 package agent
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	fprobes "github.com/redhat-cip/skydive/flow/probes"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
 	"github.com/redhat-cip/skydive/storage/etcd"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/downtime"
+	"github.com/redhat-cip/skydive/topology/flapping"
 	"github.com/redhat-cip/skydive/topology/graph"
 	tprobes "github.com/redhat-cip/skydive/topology/probes"
 )
@@ -47,23 +55,49 @@ type Agent struct {
 	OnDemandProbeListener *fprobes.OnDemandProbeListener
 	HTTPServer            *shttp.Server
 	EtcdClient            *etcd.EtcdClient
+	Watchdog              *common.Watchdog
+	GraphDumper           *graph.GraphDumper
+	SelfMonitor           *common.SelfMonitor
+	RawCaptureHandler     *fprobes.RawCaptureHandler
+	CaptureStatsPublisher *fprobes.CaptureStatsPublisher
+	FlapDetector          *flapping.FlapDetector
+	DowntimeTracker       *downtime.DowntimeTracker
+	// hostname watched as the Name of the host node
+	hostname string
+	quit     chan bool
 }
 
+// hostnameRefreshInterval is the period of the checks of the hostname, which
+// may change at runtime without re-keying the graph
+const hostnameRefreshInterval = 30 * time.Second
+
 func (a *Agent) Start() {
 	var err error
 
 	go a.WSServer.ListenAndServe()
 
-	addr, port, err := config.GetAnalyzerClientAddr()
+	// discovery failures are retried by the analyzer client
+	analyzers, err := config.GetAnalyzerServiceAddresses()
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to parse analyzer client %s", err.Error())
-		os.Exit(1)
+		if !config.AnalyzerDiscoveryEnabled() {
+			logging.GetLogger().Errorf("Unable to parse analyzer client %s", err.Error())
+			os.Exit(1)
+		}
+		logging.GetLogger().Warningf("Unable to discover analyzers, will retry: %s", err.Error())
 	}
+	useAnalyzer := len(analyzers) > 0 || config.AnalyzerDiscoveryEnabled()
+
+	if useAnalyzer {
+		var addr string
+		var port int
+		if len(analyzers) > 0 {
+			addr, port = analyzers[0].Addr, analyzers[0].Port
+		}
 
-	if addr != "" {
 		authOptions := &shttp.AuthenticationOpts{
-			Username: config.GetConfig().GetString("agent.analyzer_username"),
-			Password: config.GetConfig().GetString("agent.analyzer_password"),
+			Username:  config.GetConfig().GetString("agent.analyzer_username"),
+			Password:  config.GetConfig().GetString("agent.analyzer_password"),
+			LongLived: true,
 		}
 		authClient := shttp.NewAuthenticationClient(addr, port, authOptions)
 		a.WSClient, err = shttp.NewWSAsyncClient(addr, port, "/ws", authClient)
@@ -71,21 +105,66 @@ func (a *Agent) Start() {
 			logging.GetLogger().Errorf("Unable to instantiate analyzer client %s", err.Error())
 			os.Exit(1)
 		}
+		// announced so that the analyzers don't target the agent with
+		// captures requiring host changes
+		a.WSClient.Capabilities = map[string]interface{}{
+			"ReadOnly": common.IsReadOnly(),
+			// the analyzers reject the connections of a previous process
+			"Incarnation": time.Now().UnixNano() / int64(time.Millisecond),
+			// the analyzers migrate the nodes keyed by the hostname, as
+			// by the former versions, onto the identity
+			"Hostname": a.hostname,
+		}
+		a.WSClient.SetFailover(analyzers, config.GetAnalyzerServiceAddresses)
 
-		graph.NewForwarder(a.WSClient, a.Graph)
+		forwarder := graph.NewForwarder(a.WSClient, a.Graph)
+		forwarder.Filter = graph.NewMetadataFilterFromConfig("agent", "analyzer")
 		a.WSClient.Connect()
 
 		// send a first reset event to the analyzers
 		a.Graph.DelSubGraph(a.Root)
 	}
 
+	if a.FlapDetector = flapping.NewFlapDetectorFromConfig(a.Graph); a.FlapDetector != nil {
+		a.FlapDetector.Start()
+	}
+
+	if a.DowntimeTracker = downtime.NewDowntimeTrackerFromConfig(a.Graph); a.DowntimeTracker != nil {
+		a.DowntimeTracker.Start()
+	}
+
+	go a.watchHostname()
+
 	a.TopologyProbeBundle = tprobes.NewTopologyProbeBundleFromConfig(a.Graph, a.Root)
+	// the results are reported in the status of the probes
+	for name, checks := range a.TopologyProbeBundle.SelfTest() {
+		for _, c := range checks {
+			if !c.Passed() {
+				logging.GetLogger().Errorf("Probe %s, %s check failed: %s, %s", name, c.Name, c.Error, c.Hint)
+			}
+		}
+	}
 	a.TopologyProbeBundle.Start()
 
+	if a.SelfMonitor = common.NewSelfMonitorFromConfig("agent", config.GetConfig().GetString("agent.data_dir")); a.SelfMonitor != nil {
+		a.SelfMonitor.Snapshot = a.writeSnapshot
+		a.SelfMonitor.Start()
+		api.RegisterSelfMonitorApi("agent", a.SelfMonitor, a.HTTPServer)
+	}
+	api.RegisterProbeApi("agent", &a.TopologyProbeBundle.ProbeBundle, a.Graph, a.SelfMonitor, a.HTTPServer)
+	api.RegisterDrainApi("agent", a.Drain, a.HTTPServer)
+
+	a.Watchdog = common.NewWatchdogFromConfig("agent")
+	a.Watchdog.Start()
+
+	if a.GraphDumper = graph.NewGraphDumperFromConfig(a.Graph, "agent"); a.GraphDumper != nil {
+		a.GraphDumper.Start()
+	}
+
 	a.FlowProbeBundle = fprobes.NewFlowProbeBundleFromConfig(a.TopologyProbeBundle, a.Graph)
 	a.FlowProbeBundle.Start()
 
-	if addr != "" {
+	if useAnalyzer {
 		a.EtcdClient, err = etcd.NewEtcdClientFromConfig()
 		if err != nil {
 			logging.GetLogger().Errorf("Unable to start etcd client %s", err.Error())
@@ -104,22 +183,110 @@ func (a *Agent) Start() {
 		}
 		a.OnDemandProbeListener = l
 		a.OnDemandProbeListener.Start()
+		api.RegisterCaptureStatusApi("agent", l.Status, a.HTTPServer)
+
+		a.RawCaptureHandler = fprobes.NewRawCaptureHandlerFromConfig(a.Graph, a.WSClient)
+
+		if a.CaptureStatsPublisher = fprobes.NewCaptureStatsPublisherFromConfig(l, a.WSClient); a.CaptureStatsPublisher != nil {
+			a.CaptureStatsPublisher.Start()
+		}
 	}
 
 	go a.HTTPServer.ListenAndServe()
 }
 
+// watchHostname updates the Name of the host node when the hostname changes,
+// the node keeping its identity.
+func (a *Agent) watchHostname() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(hostnameRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			hostname, err := os.Hostname()
+			if err != nil || hostname == a.hostname {
+				continue
+			}
+			logging.GetLogger().Infof("Hostname changed from %s to %s", a.hostname, hostname)
+
+			// unless named by the configuration
+			a.Graph.Lock()
+			if a.Root.Metadata()["Name"] == a.hostname {
+				a.Graph.AddMetadata(a.Root, "Name", hostname)
+			}
+			a.Graph.Unlock()
+
+			a.hostname = hostname
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// Drain prepares the agent to be restarted, ie. for an upgrade. Its host
+// node is flagged with Draining so that the analyzers don't alert on the
+// churn of the restart and the probes which can be paused stop publishing.
+func (a *Agent) Drain() {
+	logging.GetLogger().Notice("Draining the agent")
+
+	a.Graph.Lock()
+	a.Graph.AddMetadata(a.Root, "Draining", true)
+	a.Graph.Unlock()
+
+	bundle := &a.TopologyProbeBundle.ProbeBundle
+	for name, p := range bundle.Probes {
+		if pausable, ok := p.(probe.Pausable); ok && !pausable.IsPaused() {
+			if err := bundle.Pause(name); err != nil {
+				logging.GetLogger().Errorf("Unable to pause the probe %s: %s", name, err.Error())
+			}
+		}
+	}
+}
+
+// Stop stops the probes first so that the graph doesn't change anymore, then
+// flushes the pending graph events to the websocket connections, closed with
+// a close frame, and finally closes the graph backend.
 func (a *Agent) Stop() {
+	close(a.quit)
 	a.FlowProbeBundle.UnregisterAllProbes()
 	a.FlowProbeBundle.Stop()
+	if a.RawCaptureHandler != nil {
+		a.RawCaptureHandler.Stop()
+	}
+	if a.CaptureStatsPublisher != nil {
+		a.CaptureStatsPublisher.Stop()
+	}
+	if a.OnDemandProbeListener != nil {
+		a.OnDemandProbeListener.Stop()
+	}
+	if a.Watchdog != nil {
+		a.Watchdog.Stop()
+	}
 	a.TopologyProbeBundle.Stop()
-	a.HTTPServer.Stop()
-	a.WSServer.Stop()
+	if a.FlapDetector != nil {
+		a.FlapDetector.Stop()
+	}
+
+	if a.DowntimeTracker != nil {
+		a.DowntimeTracker.Stop()
+	}
+	if a.GraphDumper != nil {
+		a.GraphDumper.Stop()
+	}
+	if a.SelfMonitor != nil {
+		a.SelfMonitor.Stop()
+	}
+	a.GraphServer.Stop()
 	if a.WSClient != nil {
 		a.WSClient.Disconnect()
 	}
-	if a.OnDemandProbeListener != nil {
-		a.OnDemandProbeListener.Stop()
+	a.WSServer.Stop()
+	a.HTTPServer.Stop()
+	if err := a.Graph.Close(); err != nil {
+		logging.GetLogger().Errorf("Error while closing the graph backend: %s", err.Error())
 	}
 	if a.EtcdClient != nil {
 		a.EtcdClient.Stop()
@@ -131,21 +298,58 @@ func (a *Agent) Stop() {
 	}
 }
 
+// writeSnapshot writes the snapshot of the graph captured with the profiles
+func (a *Agent) writeSnapshot(w io.Writer) error {
+	a.Graph.RLock()
+	defer a.Graph.RUnlock()
+
+	return json.NewEncoder(w).Encode(a.Graph.Snapshot())
+}
+
+// hostIdentity returns the identity of the agent, generated on its first
+// start and stored in its data directory. The hostname is used when there
+// is no data directory or when the identity can't be stored.
+func hostIdentity(hostname string) string {
+	dir := config.GetConfig().GetString("agent.data_dir")
+	if dir == "" {
+		return hostname
+	}
+
+	id, created, err := common.LoadOrCreateHostID(dir)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to load the agent identity from %s, using the hostname %s: %s", dir, hostname, err.Error())
+		return hostname
+	}
+	if created {
+		logging.GetLogger().Infof("Generated the agent identity %s, stored in %s", id, dir)
+	}
+
+	return id
+}
+
 func NewAgent() *Agent {
-	backend, err := graph.NewMemoryBackend()
+	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
 
-	g, err := graph.NewGraph(backend)
+	// the graph and the analyzer client are keyed by the identity
+	id := hostIdentity(hostname)
+	common.SetHostID(id)
+
+	backend, err := graph.NewMemoryBackend()
 	if err != nil {
 		panic(err)
 	}
 
-	hostname, err := os.Hostname()
+	g, err := graph.NewGraph(backend)
 	if err != nil {
 		panic(err)
 	}
+	g.SetTombstoneGracePeriod(time.Duration(config.GetConfig().GetInt("agent.topology.tombstone_grace_period")) * time.Second)
+	if rate := config.GetConfig().GetFloat64("agent.trace.sample_rate"); rate > 0 {
+		g.SetTracer(common.NewTracer("agent", id, rate))
+	}
 
 	hserver, err := shttp.NewServerFromConfig("agent")
 	if err != nil {
@@ -159,18 +363,46 @@ func NewAgent() *Agent {
 
 	wsServer := shttp.NewWSServerFromConfig(hserver, "/ws")
 
-	m := graph.Metadata{"Name": hostname, "Type": "host"}
+	readOnly := config.GetConfig().GetBool("agent.read_only")
+	if readOnly {
+		logging.GetLogger().Info("Running in read-only mode, host changes will be refused")
+	}
+	common.SetReadOnly(readOnly)
+
+	// location of the agent, given to all its nodes
+	location := graph.Metadata{}
+	for key, name := range map[string]string{"site": "Site", "region": "Region", "rack": "Rack"} {
+		if value := config.GetConfig().GetString("agent.location." + key); value != "" {
+			location[name] = value
+		}
+	}
+	g.SetInheritedMetadata(location)
+
+	m := graph.Metadata{"Name": hostname, "Type": topology.HostType}
 	if config.GetConfig().IsSet("agent.metadata") {
 		subtree := config.GetConfig().Sub("agent.metadata")
 		for key, value := range subtree.AllSettings() {
 			m[key] = value
 		}
 	}
-	root := g.NewNode(graph.Identifier(hostname), m)
+	root := g.NewNode(graph.Identifier(id), m)
 
-	api.RegisterTopologyApi("agent", g, hserver)
+	if limits := graph.NewSizeLimitsFromConfig(); limits != nil {
+		limits.Priority = topology.NodePriority
+		limits.Root = root.ID
+		g.SetSizeLimits(limits)
+	}
 
 	gserver := graph.NewServer(g, wsServer)
+	gserver.Filter = graph.NewMetadataFilterFromConfig("agent", "api")
+
+	api.RegisterTopologyApi("agent", g, hserver, wsServer, gserver.Statistics)
+	api.RegisterCacheApi("agent", hserver)
+	api.RegisterQuarantineApi("agent", hserver)
+	api.RegisterFaultsApi("agent", hserver)
+	api.RegisterSchemaApi("agent", hserver)
+	api.RegisterMetricsApi("agent", hserver)
+	common.RegisterMetrics("graph", g.Metrics)
 
 	return &Agent{
 		Graph:       g,
@@ -178,5 +410,30 @@ func NewAgent() *Agent {
 		GraphServer: gserver,
 		Root:        root,
 		HTTPServer:  hserver,
+		hostname:    hostname,
+		quit:        make(chan bool),
 	}
 }
+
+// CheckProbes runs the checks of the configured topology probes without
+// starting the agent, the probes being given a graph of their own.
+func CheckProbes() (map[string][]probe.CheckResult, error) {
+	backend, err := graph.NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := graph.NewGraph(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	root := g.NewNode(graph.Identifier(hostname), graph.Metadata{"Name": hostname, "Type": topology.HostType})
+
+	return tprobes.CheckTopologyProbesFromConfig(g, root), nil
+}
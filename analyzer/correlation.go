@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// flowGroup is the set of flows sharing a tracking ID, the correlation ID is
+// only set once two of them have been captured on a same path.
+type flowGroup struct {
+	id     string
+	probes map[string]string
+	last   time.Time
+}
+
+// FlowCorrelator links the flows of a same connection captured at several
+// capture points, ie. the veth in a namespace and the bridge port, so that
+// the aggregations can count the connection once. Flows having the same
+// tracking ID, thus the same first packet and endpoints, are correlated
+// when their capture points are on the same path, linked through at most
+// MaxHops layer2 links. Other flows are left untouched.
+type FlowCorrelator struct {
+	sync.Mutex
+	Graph     *graph.Graph
+	FlowTable *flow.Table
+	MaxHops   int
+	MaxAge    time.Duration
+	groups    map[string]*flowGroup
+	paths     *common.BoundedCache
+	cleaned   time.Time
+}
+
+// onSamePath returns whether two capture points are on the same path, the
+// result being cached as the lookup goes through the graph.
+func (c *FlowCorrelator) onSamePath(probe1, probe2 string) bool {
+	if probe2 < probe1 {
+		probe1, probe2 = probe2, probe1
+	}
+
+	key := probe1 + " " + probe2
+	if v, ok := c.paths.Get(key); ok {
+		return v.(bool)
+	}
+
+	c.Graph.RLock()
+	defer c.Graph.RUnlock()
+
+	linked := false
+
+	n1 := topology.LookupNodeFromNodePathString(c.Graph, probe1)
+	n2 := topology.LookupNodeFromNodePathString(c.Graph, probe2)
+	if n1 != nil && n2 != nil {
+		m := graph.Metadata{}
+		for _, k := range []string{"Name", "Type", "UUID", "MAC"} {
+			if v, ok := n2.Metadata()[k]; ok {
+				m[k] = v
+			}
+		}
+
+		path := c.Graph.LookupShortestPath(n1, m, graph.Metadata{"RelationType": topology.Layer2Relation})
+		if len(path) > 0 && len(path)-1 <= c.MaxHops && path[len(path)-1].ID == n2.ID {
+			linked = true
+		}
+	}
+	c.paths.Set(key, linked)
+
+	return linked
+}
+
+// expire forgets the groups without flows received for MaxAge
+func (c *FlowCorrelator) expire(now time.Time) {
+	if now.Sub(c.cleaned) < c.MaxAge/2 {
+		return
+	}
+	c.cleaned = now
+
+	for id, group := range c.groups {
+		if now.Sub(group.last) > c.MaxAge {
+			delete(c.groups, id)
+		}
+	}
+}
+
+// Correlate links the flows to the flows already received, the flows have
+// to be in the flow table.
+func (c *FlowCorrelator) Correlate(flows []*flow.Flow) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	for _, f := range flows {
+		if f.TrackingID == "" || f.ProbeGraphPath == "" {
+			continue
+		}
+
+		group, ok := c.groups[f.TrackingID]
+		if !ok {
+			group = &flowGroup{probes: make(map[string]string)}
+			c.groups[f.TrackingID] = group
+		}
+		group.last = now
+
+		if _, ok := group.probes[f.UUID]; ok {
+			continue
+		}
+
+		for uuid, probe := range group.probes {
+			if probe == f.ProbeGraphPath || !c.onSamePath(probe, f.ProbeGraphPath) {
+				continue
+			}
+
+			if group.id == "" {
+				group.id = uuid
+			}
+			c.FlowTable.SetCorrelationID(uuid, group.id)
+			c.FlowTable.SetCorrelationID(f.UUID, group.id)
+		}
+		group.probes[f.UUID] = f.ProbeGraphPath
+	}
+}
+
+func NewFlowCorrelator(g *graph.Graph, ft *flow.Table, maxHops int, maxAge time.Duration) *FlowCorrelator {
+	return &FlowCorrelator{
+		Graph:     g,
+		FlowTable: ft,
+		MaxHops:   maxHops,
+		MaxAge:    maxAge,
+		groups:    make(map[string]*flowGroup),
+		paths:     common.NewBoundedCache("analyzer/flow_paths", 10000, time.Minute),
+	}
+}
+
+// NewFlowCorrelatorFromConfig returns nil if the correlation is disabled
+func NewFlowCorrelatorFromConfig(g *graph.Graph, ft *flow.Table) *FlowCorrelator {
+	maxHops := config.GetConfig().GetInt("analyzer.flow_correlation.max_hops")
+	if maxHops <= 0 {
+		return nil
+	}
+
+	return NewFlowCorrelator(g, ft, maxHops, config.GetAnalyerExpire())
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newTestCorrelationGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// host1: vm1 netns veth <-> veth peer <-> bridge, host2: bridge alone
+	host1 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	ns := g.NewNode(graph.GenID(), graph.Metadata{"Name": "vm1", "Type": "netns"})
+	g.Link(host1, ns, graph.Metadata{"RelationType": "ownership"})
+
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "veth"})
+	g.Link(ns, eth0, graph.Metadata{"RelationType": "ownership"})
+
+	peer := g.NewNode(graph.GenID(), graph.Metadata{"Name": "veth1", "Type": "veth"})
+	g.Link(host1, peer, graph.Metadata{"RelationType": "ownership"})
+	g.Link(eth0, peer, graph.Metadata{"RelationType": "layer2"})
+
+	br := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br0", "Type": "bridge"})
+	g.Link(host1, br, graph.Metadata{"RelationType": "ownership"})
+	g.Link(br, peer, graph.Metadata{"RelationType": "layer2"})
+
+	host2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host2", "Type": "host"})
+	br2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br1", "Type": "bridge"})
+	g.Link(host2, br2, graph.Metadata{"RelationType": "ownership"})
+
+	return g
+}
+
+func TestFlowCorrelation(t *testing.T) {
+	g := newTestCorrelationGraph(t)
+	ft := flow.NewTable()
+
+	c := NewFlowCorrelator(g, ft, 4, time.Minute)
+
+	flows := []*flow.Flow{
+		{UUID: "1", TrackingID: "a", ProbeGraphPath: "host1[Type=host]/vm1[Type=netns]/eth0[Type=veth]"},
+		{UUID: "2", TrackingID: "b", ProbeGraphPath: "host1[Type=host]/br0[Type=bridge]"},
+		{UUID: "3", TrackingID: "a", ProbeGraphPath: "host2[Type=host]/br1[Type=bridge]"},
+	}
+	ft.Update(flows)
+	c.Correlate(flows)
+
+	for _, f := range ft.GetFlows() {
+		if f.CorrelationID != "" {
+			t.Errorf("Flows with different tracking IDs or not on the same path shouldn't be correlated: %v", f)
+		}
+	}
+
+	// same connection seen on the bridge
+	flows = []*flow.Flow{
+		{UUID: "4", TrackingID: "a", ProbeGraphPath: "host1[Type=host]/br0[Type=bridge]"},
+	}
+	ft.Update(flows)
+	c.Correlate(flows)
+
+	for _, uuid := range []string{"1", "4"} {
+		if f := ft.GetFlow(uuid); f.CorrelationID != "1" {
+			t.Errorf("Flow %s should have been correlated: %v", uuid, f)
+		}
+	}
+
+	if f := ft.GetFlow("3"); f.CorrelationID != "" {
+		t.Errorf("Flow on another host shouldn't have been correlated: %v", f)
+	}
+
+	// no path within the maximum number of hops
+	c = NewFlowCorrelator(g, flow.NewTable(), 1, time.Minute)
+	if c.onSamePath("host1[Type=host]/vm1[Type=netns]/eth0[Type=veth]", "host1[Type=host]/br0[Type=bridge]") {
+		t.Error("Capture points too far shouldn't be on the same path")
+	}
+}
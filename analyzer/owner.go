@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// node types shared by the interfaces of several owners, the lookup doesn't
+// go through them so that a bridge uplink isn't attributed to one of the
+// containers plugged into the bridge.
+var sharedNodeTypes = map[string]bool{
+	topology.HostType:        true,
+	topology.BridgeType:      true,
+	topology.OvsBridgeType:   true,
+	topology.OvsPortType:     true,
+	topology.OpenvswitchType: true,
+}
+
+type flowOwner struct {
+	id       string
+	nodeType string
+}
+
+// FlowOwnerResolver attributes the flows to the nearest containers, VMs or
+// pods owning their source and destination interfaces. The owners are
+// resolved again on each update of a flow during Window after its start,
+// so that a flow captured before its container was fully discovered gets
+// its owner, then they are kept.
+type FlowOwnerResolver struct {
+	Graph      *graph.Graph
+	FlowTable  *flow.Table
+	OwnerTypes map[string]bool
+	MaxHops    int
+	Window     time.Duration
+	owners     *common.BoundedCache
+}
+
+// neighbors returns the nodes the lookup goes to from the node: the peers
+// through the layer2 links, the owner of the node and the members of a
+// namespace, ie. its container.
+func (r *FlowOwnerResolver) neighbors(n *graph.Node) []*graph.Node {
+	var nodes []*graph.Node
+	for _, e := range r.Graph.GetNodeEdges(n) {
+		parent, child := r.Graph.GetEdgeNodes(e)
+		if parent == nil || child == nil {
+			continue
+		}
+
+		switch e.Metadata()["RelationType"] {
+		case topology.Layer2Relation:
+			if parent.ID == n.ID {
+				nodes = append(nodes, child)
+			} else {
+				nodes = append(nodes, parent)
+			}
+		case topology.OwnershipRelation:
+			if child.ID == n.ID {
+				nodes = append(nodes, parent)
+			}
+		case topology.MembershipRelation:
+			if parent.ID == n.ID {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	return nodes
+}
+
+// lookupOwner returns the nearest owner of the interface, none if several
+// owners are at the same distance.
+func (r *FlowOwnerResolver) lookupOwner(n *graph.Node) flowOwner {
+	visited := map[graph.Identifier]bool{n.ID: true}
+	current := []*graph.Node{n}
+
+	for hop := 0; hop <= r.MaxHops && len(current) > 0; hop++ {
+		owners := make(map[graph.Identifier]flowOwner)
+
+		var next []*graph.Node
+		for _, node := range current {
+			t, _ := node.Metadata()["Type"].(string)
+			if r.OwnerTypes[t] {
+				owners[node.ID] = flowOwner{id: string(node.ID), nodeType: t}
+				continue
+			}
+			if sharedNodeTypes[t] {
+				continue
+			}
+
+			for _, neighbor := range r.neighbors(node) {
+				if !visited[neighbor.ID] {
+					visited[neighbor.ID] = true
+					next = append(next, neighbor)
+				}
+			}
+		}
+
+		switch len(owners) {
+		case 0:
+			current = next
+		case 1:
+			for _, owner := range owners {
+				return owner
+			}
+		default:
+			return flowOwner{}
+		}
+	}
+
+	return flowOwner{}
+}
+
+// owner returns the owner of the interface of the graph path, cached for a
+// short time as the lookup goes through the graph.
+func (r *FlowOwnerResolver) owner(path string) flowOwner {
+	if path == "" || path == "*" {
+		return flowOwner{}
+	}
+
+	if v, ok := r.owners.Get(path); ok {
+		return v.(flowOwner)
+	}
+
+	r.Graph.RLock()
+	var owner flowOwner
+	if n := topology.LookupNodeFromNodePathString(r.Graph, path); n != nil {
+		owner = r.lookupOwner(n)
+	}
+	r.Graph.RUnlock()
+
+	r.owners.Set(path, owner)
+
+	return owner
+}
+
+// Resolve sets the owners of the flows, the flows have to be in the flow
+// table.
+func (r *FlowOwnerResolver) Resolve(flows []*flow.Flow) {
+	now := time.Now()
+
+	for _, f := range flows {
+		if stats := f.GetStatistics(); stats != nil && now.Sub(time.Unix(stats.Start, 0)) > r.Window {
+			continue
+		}
+
+		src, dst := r.owner(f.IfSrcGraphPath), r.owner(f.IfDstGraphPath)
+		r.FlowTable.SetOwners(f.UUID, src.id, src.nodeType, dst.id, dst.nodeType)
+	}
+}
+
+func NewFlowOwnerResolver(g *graph.Graph, ft *flow.Table, ownerTypes []string, maxHops int, window time.Duration) *FlowOwnerResolver {
+	types := make(map[string]bool)
+	for _, t := range ownerTypes {
+		types[t] = true
+	}
+
+	// topology changes are taken into account after a few seconds
+	cacheAge := window / 4
+	if cacheAge > 10*time.Second {
+		cacheAge = 10 * time.Second
+	} else if cacheAge < time.Second {
+		cacheAge = time.Second
+	}
+
+	return &FlowOwnerResolver{
+		Graph:      g,
+		FlowTable:  ft,
+		OwnerTypes: types,
+		MaxHops:    maxHops,
+		Window:     window,
+		owners:     common.NewBoundedCache("analyzer/flow_owners", 10000, cacheAge),
+	}
+}
+
+// NewFlowOwnerResolverFromConfig returns nil if the attribution is disabled
+func NewFlowOwnerResolverFromConfig(g *graph.Graph, ft *flow.Table) *FlowOwnerResolver {
+	cfg := config.GetConfig()
+
+	types := cfg.GetStringSlice("analyzer.flow_owners.types")
+	if len(types) == 0 {
+		return nil
+	}
+
+	window := time.Duration(cfg.GetInt("analyzer.flow_owners.window")) * time.Second
+	return NewFlowOwnerResolver(g, ft, types, cfg.GetInt("analyzer.flow_owners.max_hops"), window)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// addContainer adds a container whose veth is plugged into the bridge,
+// returning the container node and its interfaces
+func addContainer(g *graph.Graph, host *graph.Node, br *graph.Node, name string) (*graph.Node, *graph.Node, *graph.Node) {
+	ns := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "netns"})
+	g.Link(host, ns, graph.Metadata{"RelationType": "ownership"})
+
+	c := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "container"})
+	g.Link(ns, c, graph.Metadata{"RelationType": "membership"})
+
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "veth"})
+	g.Link(ns, eth0, graph.Metadata{"RelationType": "ownership"})
+
+	peer := g.NewNode(graph.GenID(), graph.Metadata{"Name": "veth-" + name, "Type": "veth"})
+	g.Link(host, peer, graph.Metadata{"RelationType": "ownership"})
+	g.Link(eth0, peer, graph.Metadata{"RelationType": "layer2"})
+	g.Link(br, peer, graph.Metadata{"RelationType": "layer2"})
+
+	return c, eth0, peer
+}
+
+func TestFlowOwners(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	br := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br0", "Type": "bridge"})
+	g.Link(host, br, graph.Metadata{"RelationType": "ownership"})
+
+	uplink := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Type": "device"})
+	g.Link(host, uplink, graph.Metadata{"RelationType": "ownership"})
+	g.Link(br, uplink, graph.Metadata{"RelationType": "layer2"})
+
+	c1, eth0, peer := addContainer(g, host, br, "c1")
+
+	ft := flow.NewTable()
+	r := NewFlowOwnerResolver(g, ft, []string{"container", "vm"}, 4, time.Minute)
+
+	clock := common.NewFakeClock(time.Now())
+	r.owners.Clock = clock
+
+	now := time.Now().Unix()
+	flows := []*flow.Flow{
+		// from the container to its host side veth
+		{UUID: "1", IfSrcGraphPath: topology.GraphPath(g, eth0), IfDstGraphPath: topology.GraphPath(g, peer), Statistics: &flow.FlowStatistics{Start: now}},
+		// from the uplink to the broadcast address
+		{UUID: "2", IfSrcGraphPath: topology.GraphPath(g, uplink), IfDstGraphPath: "*", Statistics: &flow.FlowStatistics{Start: now}},
+		// too old to be attributed
+		{UUID: "3", IfSrcGraphPath: topology.GraphPath(g, eth0), Statistics: &flow.FlowStatistics{Start: now - 3600}},
+	}
+	ft.Update(flows)
+	r.Resolve(flows)
+
+	if f := ft.GetFlow("1"); f.SrcOwnerID != string(c1.ID) || f.SrcOwnerType != "container" || f.DstOwnerID != string(c1.ID) {
+		t.Errorf("Flow should be attributed to the container: %v", f)
+	}
+	if f := ft.GetFlow("2"); f.SrcOwnerID != "" || f.DstOwnerID != "" {
+		t.Errorf("Flow of the uplink shouldn't be attributed: %v", f)
+	}
+	if f := ft.GetFlow("3"); f.SrcOwnerID != "" {
+		t.Errorf("Flow older than the window shouldn't be attributed: %v", f)
+	}
+
+	// a flow captured before the discovery of its container gets the
+	// container once the cached lookup expired
+	ns2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "c2", "Type": "netns"})
+	g.Link(host, ns2, graph.Metadata{"RelationType": "ownership"})
+	eth2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "veth"})
+	g.Link(ns2, eth2, graph.Metadata{"RelationType": "ownership"})
+
+	flows = []*flow.Flow{
+		{UUID: "4", IfSrcGraphPath: topology.GraphPath(g, eth2), Statistics: &flow.FlowStatistics{Start: now}},
+	}
+	ft.Update(flows)
+	r.Resolve(flows)
+
+	if f := ft.GetFlow("4"); f.SrcOwnerID != "" {
+		t.Errorf("Flow shouldn't be attributed before the discovery of the container: %v", f)
+	}
+
+	c2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "c2", "Type": "container"})
+	g.Link(ns2, c2, graph.Metadata{"RelationType": "membership"})
+
+	clock.Advance(time.Minute)
+	r.Resolve(flows)
+
+	if f := ft.GetFlow("4"); f.SrcOwnerID != string(c2.ID) {
+		t.Errorf("Flow should be attributed to the discovered container: %v", f)
+	}
+}
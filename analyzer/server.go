@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
@@ -40,23 +41,53 @@ import (
 	"github.com/redhat-cip/skydive/storage"
 	"github.com/redhat-cip/skydive/storage/elasticsearch"
 	"github.com/redhat-cip/skydive/storage/etcd"
+	"github.com/redhat-cip/skydive/storage/kafka"
 	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/churn"
+	"github.com/redhat-cip/skydive/topology/drift"
+	"github.com/redhat-cip/skydive/topology/enrichment"
 	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/history"
+	"github.com/redhat-cip/skydive/topology/linker"
+	"github.com/redhat-cip/skydive/topology/servicepath"
+	"github.com/redhat-cip/skydive/topology/whatif"
 )
 
 type Server struct {
 	HTTPServer          *shttp.Server
+	GRPCServer          *api.GRPCServer
 	WSServer            *shttp.WSServer
 	GraphServer         *graph.GraphServer
 	AlertServer         *alert.AlertServer
+	EnrichmentManager   *enrichment.EnrichmentManager
+	DriftDetector       *drift.DriftDetector
+	ChurnTracker        *churn.ChurnTracker
+	History             *history.Recorder
+	LinkerManager       *linker.LinkerManager
+	BroadcastDomains    *linker.BroadcastDomainManager
+	Layer3              *linker.Layer3Manager
+	MTUChecker          *linker.MTUChecker
+	LinkStateChecker    *linker.LinkStateChecker
+	ClockSkewChecker    *linker.ClockSkewChecker
+	CaptureStats        *api.CaptureStatsApi
+	PathServer          *servicepath.PathServer
 	FlowMappingPipeline *mappings.FlowMappingPipeline
+	FlowCorrelator      *FlowCorrelator
+	FlowOwnerResolver   *FlowOwnerResolver
 	Storage             storage.Storage
 	FlowTable           *flow.Table
 	conn                *net.UDPConn
 	EmbeddedEtcd        *etcd.EmbeddedEtcd
 	EtcdClient          *etcd.EtcdClient
-	running             atomic.Value
-	wgServers           sync.WaitGroup
+	Replicator          *graph.Replicator
+	AgentQuotaHandler   api.ApiHandler
+	agentQuotaWatcher   api.StoppableWatcher
+	// revocations of the sessions, if the sessions are enabled
+	RevokedSessionHandler api.ApiHandler
+	revokedSessionWatcher api.StoppableWatcher
+	replicaClient         *shttp.WSAsyncClient
+	running               atomic.Value
+	wgServers             sync.WaitGroup
 }
 
 func (s *Server) flowExpireUpdate(flows []*flow.Flow) {
@@ -69,10 +100,47 @@ func (s *Server) flowExpireUpdate(flows []*flow.Flow) {
 func (s *Server) AnalyzeFlows(flows []*flow.Flow) {
 	s.FlowTable.Update(flows)
 	s.FlowMappingPipeline.Enhance(flows)
+	if s.FlowCorrelator != nil {
+		s.FlowCorrelator.Correlate(flows)
+	}
+	if s.FlowOwnerResolver != nil {
+		s.FlowOwnerResolver.Resolve(flows)
+	}
 
 	logging.GetLogger().Debugf("%d flows received", len(flows))
 }
 
+// onAgentQuotaEvent applies the quotas of the hosts stored in etcd
+func (s *Server) onAgentQuotaEvent(action string, id string, resource api.ApiResource) {
+	switch action {
+	case "init", "create", "set", "update":
+		s.GraphServer.Quotas.SetOverride(id, resource.(*api.AgentQuota).AgentQuota)
+	case "expire", "delete":
+		s.GraphServer.Quotas.DelOverride(id)
+	}
+}
+
+// onRevokedSessionEvent refuses the sessions revoked, the revocations of
+// the sessions expired since being removed from etcd
+func (s *Server) onRevokedSessionEvent(action string, id string, resource api.ApiResource) {
+	sb, ok := s.HTTPServer.Auth.(*shttp.SessionAuthenticationBackend)
+	if !ok {
+		return
+	}
+
+	switch action {
+	case "init", "create", "set", "update":
+		revoked := resource.(*api.RevokedSession)
+		if action == "init" && revoked.Expires != 0 && revoked.Expires <= time.Now().Unix() {
+			s.RevokedSessionHandler.Delete(id)
+			return
+		}
+		sb.SetRevoked(id, revoked.Expires)
+	case "expire", "delete":
+		sb.Forget(id)
+	}
+}
+
 func (s *Server) handleUDPFlowPacket() {
 	s.conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
 	data := make([]byte, 4096)
@@ -119,8 +187,59 @@ func (s *Server) ListenAndServe() {
 		s.Storage.Start()
 	}
 
+	// registered first so that the alerts see the rates including the
+	// event being evaluated
+	if s.ChurnTracker != nil {
+		s.ChurnTracker.Start()
+	}
+
 	s.AlertServer.AlertManager.Start()
 
+	if s.EnrichmentManager != nil {
+		s.EnrichmentManager.Start()
+	}
+
+	if s.DriftDetector != nil {
+		s.DriftDetector.Start()
+	}
+
+	if s.History != nil {
+		s.History.Start()
+	}
+
+	if s.LinkerManager != nil {
+		s.LinkerManager.Start()
+	}
+	if s.BroadcastDomains != nil {
+		s.BroadcastDomains.Start()
+	}
+	if s.Layer3 != nil {
+		s.Layer3.Start()
+	}
+	if s.MTUChecker != nil {
+		s.MTUChecker.Start()
+	}
+	if s.LinkStateChecker != nil {
+		s.LinkStateChecker.Start()
+	}
+	if s.ClockSkewChecker != nil {
+		s.ClockSkewChecker.Start()
+	}
+
+	s.PathServer.PathTracker.Start()
+
+	if !s.GraphServer.ReadOnly && s.GraphServer.Quotas != nil {
+		s.agentQuotaWatcher = s.AgentQuotaHandler.AsyncWatch(s.onAgentQuotaEvent)
+	}
+
+	if s.RevokedSessionHandler != nil {
+		s.revokedSessionWatcher = s.RevokedSessionHandler.AsyncWatch(s.onRevokedSessionEvent)
+	}
+
+	if s.replicaClient != nil {
+		s.replicaClient.Connect()
+	}
+
 	s.wgServers.Add(4)
 	go func() {
 		defer s.wgServers.Done()
@@ -150,22 +269,83 @@ func (s *Server) ListenAndServe() {
 		defer s.wgServers.Done()
 		s.asyncFlowTableExpireUpdated()
 	}()
+
+	if s.GRPCServer != nil {
+		s.wgServers.Add(1)
+		go func() {
+			defer s.wgServers.Done()
+			s.GRPCServer.ListenAndServe()
+		}()
+	}
 }
 
+// Stop stops the writers of the graph first, then flushes the pending graph
+// events to the websocket connections, closed with a close frame, before
+// flushing the flow storage and closing the graph backend.
 func (s *Server) Stop() {
 	s.running.Store(false)
-	s.FlowTable.UnregisterAll()
+	if s.replicaClient != nil {
+		s.replicaClient.Disconnect()
+	}
+	if s.EnrichmentManager != nil {
+		s.EnrichmentManager.Stop()
+	}
+	if s.DriftDetector != nil {
+		s.DriftDetector.Stop()
+	}
+	if s.LinkerManager != nil {
+		s.LinkerManager.Stop()
+	}
+	if s.BroadcastDomains != nil {
+		s.BroadcastDomains.Stop()
+	}
+	if s.Layer3 != nil {
+		s.Layer3.Stop()
+	}
+	if s.MTUChecker != nil {
+		s.MTUChecker.Stop()
+	}
+	if s.LinkStateChecker != nil {
+		s.LinkStateChecker.Stop()
+	}
+	if s.ClockSkewChecker != nil {
+		s.ClockSkewChecker.Stop()
+	}
+	if s.CaptureStats != nil {
+		s.CaptureStats.Stop()
+	}
+	s.PathServer.PathTracker.Stop()
+	if s.agentQuotaWatcher != nil {
+		s.agentQuotaWatcher.Stop()
+	}
+	if s.revokedSessionWatcher != nil {
+		s.revokedSessionWatcher.Stop()
+	}
+	s.GraphServer.Stop()
 	s.WSServer.Stop()
 	s.HTTPServer.Stop()
-	if s.EmbeddedEtcd != nil {
-		s.EmbeddedEtcd.Stop()
+	if s.GRPCServer != nil {
+		s.GRPCServer.Stop()
 	}
+	s.wgServers.Wait()
+	s.FlowTable.UnregisterAll()
 	if s.Storage != nil {
 		s.Storage.Stop()
 	}
 	s.AlertServer.AlertManager.Stop()
+	if s.ChurnTracker != nil {
+		s.ChurnTracker.Stop()
+	}
+	if s.History != nil {
+		s.History.Stop()
+	}
+	if err := s.GraphServer.Graph.Close(); err != nil {
+		logging.GetLogger().Errorf("Error while closing the graph backend: %s", err.Error())
+	}
 	s.EtcdClient.Stop()
-	s.wgServers.Wait()
+	if s.EmbeddedEtcd != nil {
+		s.EmbeddedEtcd.Stop()
+	}
 	if tr, ok := http.DefaultTransport.(interface {
 		CloseIdleConnections()
 	}); ok {
@@ -183,20 +363,56 @@ func (s *Server) SetStorage(storage storage.Storage) {
 }
 
 func (s *Server) SetStorageFromConfig() {
-	if t := config.GetConfig().GetString("analyzer.storage"); t != "" {
+	var storages []storage.Storage
+
+	// several storages can be given, ie. elasticsearch and kafka
+	for _, t := range config.GetConfig().GetStringSlice("analyzer.storage") {
 		switch t {
 		case "elasticsearch":
 			storage, err := elasticsearch.New()
 			if err != nil {
 				logging.GetLogger().Fatalf("Can't connect to ElasticSearch server: %v", err)
 			}
-			s.SetStorage(storage)
+			storages = append(storages, storage)
+		case "kafka":
+			storage, err := kafka.New()
+			if err != nil {
+				logging.GetLogger().Fatalf("Can't initialize Kafka storage: %v", err)
+			}
+			storages = append(storages, storage)
 		default:
 			logging.GetLogger().Fatalf("Storage type unknown: %s", t)
 			os.Exit(1)
 		}
 		logging.GetLogger().Infof("Using %s as storage", t)
 	}
+
+	switch len(storages) {
+	case 0:
+	case 1:
+		s.SetStorage(storages[0])
+	default:
+		s.SetStorage(storage.NewMultiStorage(storages...))
+	}
+}
+
+// newReplicaClient returns the client of the primary analyzer of a replica
+func newReplicaClient() (*shttp.WSAsyncClient, error) {
+	addr, port, err := config.GetHostPortAttributes("analyzer.replica", "primary")
+	if err != nil {
+		return nil, err
+	}
+
+	authOptions := &shttp.AuthenticationOpts{
+		Username:  config.GetConfig().GetString("analyzer.replica.username"),
+		Password:  config.GetConfig().GetString("analyzer.replica.password"),
+		LongLived: true,
+	}
+	authClient := shttp.NewAuthenticationClient(addr, port, authOptions)
+
+	logging.GetLogger().Infof("Serving a read-only replica of the analyzer %s:%d", addr, port)
+
+	return shttp.NewWSAsyncClient(addr, port, "/ws", authClient)
 }
 
 func NewServerFromConfig() (*Server, error) {
@@ -219,7 +435,8 @@ func NewServerFromConfig() (*Server, error) {
 
 	wsServer := shttp.NewWSServerFromConfig(httpServer, "/ws")
 
-	api.RegisterTopologyApi("analyzer", g, httpServer)
+	api.RegisterMetricsApi("analyzer", httpServer)
+	common.RegisterMetrics("graph", g.Metrics)
 
 	var etcdServer *etcd.EmbeddedEtcd
 	if embedEtcd {
@@ -238,9 +455,15 @@ func NewServerFromConfig() (*Server, error) {
 		return nil, err
 	}
 
-	captureHandler := &api.BasicApiHandler{
-		ResourceHandler: &api.CaptureHandler{},
-		EtcdKeyAPI:      etcdClient.KeysApi,
+	captureHandler := &api.CaptureApiHandler{
+		BasicApiHandler: api.BasicApiHandler{
+			ResourceHandler: &api.CaptureHandler{},
+			EtcdKeyAPI:      etcdClient.KeysApi,
+		},
+		IsReadOnly: func(host string) bool {
+			readOnly, _ := wsServer.GetCapabilities(host)["ReadOnly"].(bool)
+			return readOnly
+		},
 	}
 	err = apiServer.RegisterApiHandler(captureHandler)
 	if err != nil {
@@ -256,10 +479,125 @@ func NewServerFromConfig() (*Server, error) {
 		return nil, err
 	}
 
+	baselineHandler := &api.BasicApiHandler{
+		ResourceHandler: &api.BaselineHandler{},
+		EtcdKeyAPI:      etcdClient.KeysApi,
+	}
+	err = apiServer.RegisterApiHandler(baselineHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	agentQuotaHandler := &api.BasicApiHandler{
+		ResourceHandler: &api.AgentQuotaHandler{},
+		EtcdKeyAPI:      etcdClient.KeysApi,
+	}
+	err = apiServer.RegisterApiHandler(agentQuotaHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	var revokedSessionHandler api.ApiHandler
+	if sb, ok := httpServer.Auth.(*shttp.SessionAuthenticationBackend); ok {
+		handler := &api.BasicApiHandler{
+			ResourceHandler: &api.RevokedSessionHandler{},
+			EtcdKeyAPI:      etcdClient.KeysApi,
+		}
+		if err = apiServer.RegisterApiHandler(handler); err != nil {
+			return nil, err
+		}
+
+		sb.OnRevoke = func(s *shttp.Session) error {
+			return handler.Create(&api.RevokedSession{Session: s.ID, User: s.User, Expires: s.Expires})
+		}
+		revokedSessionHandler = handler
+	}
+
+	pathHandler := &api.BasicApiHandler{
+		ResourceHandler: &api.TrackedPathHandler{},
+		EtcdKeyAPI:      etcdClient.KeysApi,
+	}
+	err = apiServer.RegisterApiHandler(pathHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	api.RegisterApplyApi("analyzer", apiServer, httpServer)
+
+	// a replica only serves the graph of its primary, the features changing
+	// the graph are disabled
+	replica := config.GetConfig().GetString("analyzer.replica.primary") != ""
+
+	var driftDetector *drift.DriftDetector
+	if !replica {
+		if driftDetector, err = drift.NewDriftDetectorFromConfig(g, baselineHandler); err != nil {
+			return nil, err
+		}
+	}
+	if driftDetector != nil {
+		api.RegisterDriftApi("analyzer", g, driftDetector, httpServer)
+	}
+
+	var linkerManager *linker.LinkerManager
+	var broadcastDomains *linker.BroadcastDomainManager
+	var layer3 *linker.Layer3Manager
+	var mtuChecker *linker.MTUChecker
+	var linkStateChecker *linker.LinkStateChecker
+	var clockSkewChecker *linker.ClockSkewChecker
+	if !replica {
+		linkerManager = linker.NewLinkerManagerFromConfig(g)
+		broadcastDomains = linker.NewBroadcastDomainManagerFromConfig(g)
+		layer3 = linker.NewLayer3ManagerFromConfig(g)
+		mtuChecker = linker.NewMTUCheckerFromConfig(g)
+		linkStateChecker = linker.NewLinkStateCheckerFromConfig(g)
+		clockSkewChecker = linker.NewClockSkewCheckerFromConfig(g)
+	}
+	if mtuChecker != nil {
+		api.RegisterMTUApi("analyzer", g, mtuChecker, httpServer)
+	}
+	if linkStateChecker != nil {
+		api.RegisterLinkStateApi("analyzer", g, linkStateChecker, httpServer)
+	}
+
 	alertManager := alert.NewAlertManager(g, alertHandler)
 
+	churnTracker := churn.NewChurnTrackerFromConfig(g)
+	if churnTracker != nil {
+		alertManager.AddNodeVariables(churnTracker)
+	}
+
 	aserver := alert.NewServer(alertManager, wsServer)
+
+	if !replica {
+		if simulator := whatif.NewSimulatorFromConfig(g, alertManager); simulator != nil {
+			api.RegisterWhatIfApi("analyzer", simulator, httpServer)
+		}
+		if migrator := graph.NewMigratorFromConfig(g); migrator != nil {
+			api.RegisterBackendApi("analyzer", migrator, httpServer)
+		}
+	}
+
+	pathTracker := servicepath.NewPathTrackerFromConfig(g, pathHandler)
+	pserver := servicepath.NewServer(pathTracker, wsServer)
+	api.RegisterPathStateApi("analyzer", g, pathTracker, httpServer)
+
 	gserver := graph.NewServer(g, wsServer)
+	gserver.ReadOnly = replica
+	if !replica && gserver.Quotas != nil {
+		api.RegisterAgentQuarantineApi("analyzer", gserver.Quotas, httpServer)
+	}
+	if gserver.Traces != nil {
+		api.RegisterTraceApi("analyzer", g, gserver.Traces, httpServer)
+	}
+	api.RegisterTopologyApi("analyzer", g, httpServer, wsServer, gserver.Statistics)
+	api.RegisterSchemaApi("analyzer", httpServer)
+	api.RegisterConnectionsApi("analyzer", wsServer, httpServer)
+	api.RegisterFaultsApi("analyzer", httpServer)
+	var captureStats *api.CaptureStatsApi
+	if !replica {
+		api.RegisterPcapApi(g, wsServer, httpServer)
+		captureStats = api.RegisterCaptureStatsApi(g, wsServer)
+	}
 
 	gfe := mappings.NewGraphFlowEnhancer(g)
 	ofe := mappings.NewOvsFlowEnhancer(g)
@@ -269,19 +607,57 @@ func NewServerFromConfig() (*Server, error) {
 	flowtable := flow.NewTable()
 
 	server := &Server{
-		HTTPServer:          httpServer,
-		WSServer:            wsServer,
-		GraphServer:         gserver,
-		AlertServer:         aserver,
-		FlowMappingPipeline: pipeline,
-		FlowTable:           flowtable,
-		EmbeddedEtcd:        etcdServer,
-		EtcdClient:          etcdClient,
+		HTTPServer:            httpServer,
+		WSServer:              wsServer,
+		GraphServer:           gserver,
+		AlertServer:           aserver,
+		DriftDetector:         driftDetector,
+		ChurnTracker:          churnTracker,
+		LinkerManager:         linkerManager,
+		BroadcastDomains:      broadcastDomains,
+		Layer3:                layer3,
+		MTUChecker:            mtuChecker,
+		LinkStateChecker:      linkStateChecker,
+		ClockSkewChecker:      clockSkewChecker,
+		CaptureStats:          captureStats,
+		PathServer:            pserver,
+		FlowMappingPipeline:   pipeline,
+		FlowCorrelator:        NewFlowCorrelatorFromConfig(g, flowtable),
+		FlowOwnerResolver:     NewFlowOwnerResolverFromConfig(g, flowtable),
+		FlowTable:             flowtable,
+		EmbeddedEtcd:          etcdServer,
+		EtcdClient:            etcdClient,
+		AgentQuotaHandler:     agentQuotaHandler,
+		RevokedSessionHandler: revokedSessionHandler,
 	}
 	server.SetStorageFromConfig()
 
+	historyStorage, err := history.NewStorageFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	if historyStorage != nil {
+		server.History = history.NewRecorder(g, historyStorage)
+	}
+
+	if replica {
+		if server.replicaClient, err = newReplicaClient(); err != nil {
+			return nil, err
+		}
+		server.Replicator = graph.NewReplicator(server.replicaClient, g)
+		common.RegisterMetrics("graph_replica", func() interface{} { return server.Replicator.Stats() })
+	} else {
+		if server.EnrichmentManager, err = enrichment.NewEnrichmentManagerFromConfig(g); err != nil {
+			return nil, err
+		}
+	}
+
 	api.RegisterFlowApi("analyzer", flowtable, server.Storage, httpServer)
 
+	if server.GRPCServer, err = api.NewGRPCServerFromConfig("analyzer", g, server.Storage, httpServer.Auth); err != nil {
+		return nil, err
+	}
+
 	analyzerExpire := config.GetAnalyerExpire()
 	agentExpire := config.GetAgentExpire()
 	flowtable.RegisterExpire(server.flowExpireUpdate, analyzerExpire, agentExpire)
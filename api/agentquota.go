@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// AgentQuota overrides the default quota of the connections of a host
+type AgentQuota struct {
+	Host string
+	graph.AgentQuota
+}
+
+type AgentQuotaHandler struct {
+}
+
+func (a *AgentQuotaHandler) New() ApiResource {
+	return &AgentQuota{}
+}
+
+func (a *AgentQuotaHandler) Name() string {
+	return "agentquota"
+}
+
+func (a *AgentQuota) ID() string {
+	return a.Host
+}
+
+// AgentQuarantineApi lists the quarantined agents with
+// GET /api/agent/quarantine and lifts a quarantine with
+// DELETE /api/agent/quarantine/<host>
+type AgentQuarantineApi struct {
+	Service string
+	Quotas  *graph.QuotaEnforcer
+}
+
+func (a *AgentQuarantineApi) quarantineIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(a.Quotas.Quarantines()); err != nil {
+		logging.GetLogger().Criticalf("Failed to list the quarantined agents: %s", err.Error())
+	}
+}
+
+func (a *AgentQuarantineApi) quarantineLift(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	host := r.URL.Path[len("/api/agent/quarantine/"):]
+
+	if !a.Quotas.Lift(host) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logging.GetLogger().Infof("Quarantine of %s lifted by %s from %s", host, r.Username, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *AgentQuarantineApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"AgentQuarantineIndex",
+			"GET",
+			"/api/agent/quarantine",
+			a.quarantineIndex,
+		},
+		{
+			"AgentQuarantineLift",
+			"DELETE",
+			shttp.PathPrefix("/api/agent/quarantine/"),
+			a.quarantineLift,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterAgentQuarantineApi(s string, quotas *graph.QuotaEnforcer, r *shttp.Server) {
+	a := &AgentQuarantineApi{
+		Service: s,
+		Quotas:  quotas,
+	}
+
+	a.registerEndpoints(r)
+}
@@ -23,6 +23,7 @@
 package api
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/nu7hatch/gouuid"
@@ -43,6 +44,10 @@ type Alert struct {
 	Type        int
 	Count       int
 	CreateTime  time.Time
+	ManagedBy   string `json:"ManagedBy,omitempty"`
+	// the test of a node has to pass for this duration, ie. 5m, for the
+	// alert to fire, once until the test fails again
+	For string `json:"For,omitempty"`
 }
 
 type AlertHandler struct {
@@ -58,6 +63,19 @@ func NewAlert() *Alert {
 	}
 }
 
+// Duration returns the duration of For, 0 if not given
+func (a *Alert) Duration() (time.Duration, error) {
+	if a.For == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(a.For)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %s", a.For)
+	}
+	return d, err
+}
+
 func (a *AlertHandler) New() ApiResource {
 	return &Alert{}
 }
@@ -69,3 +87,26 @@ func (a *AlertHandler) Name() string {
 func (a *Alert) ID() string {
 	return a.UUID
 }
+
+func (a *Alert) applyKey() string {
+	return a.Name
+}
+
+func (a *Alert) owner() string {
+	return a.ManagedBy
+}
+
+// adopt keeps the identity of the alert replaced, the type defaulting to
+// FIXED as for the alerts created by the API
+func (a *Alert) adopt(owner string, existing ApiResource) {
+	if e, ok := existing.(*Alert); ok {
+		a.UUID, a.CreateTime = e.UUID, e.CreateTime
+	} else {
+		n := NewAlert()
+		a.UUID, a.CreateTime = n.UUID, n.CreateTime
+	}
+	if a.Type == 0 {
+		a.Type = FIXED
+	}
+	a.ManagedBy = owner
+}
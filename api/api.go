@@ -28,6 +28,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/abbot/go-http-auth"
 	etcd "github.com/coreos/etcd/client"
@@ -42,6 +43,7 @@ type ApiServer struct {
 	HTTPServer *shttp.Server
 	EtcdKeyAPI etcd.KeysAPI
 	handlers   map[string]ApiHandler
+	applyLock  sync.Mutex
 }
 
 type HandlerFunc func(w http.ResponseWriter, r *http.Request)
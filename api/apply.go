@@ -0,0 +1,438 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/abbot/go-http-auth"
+	"gopkg.in/yaml.v2"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// DefaultApplyOwner owns the resources of the documents without owner
+const DefaultApplyOwner = "apply"
+
+// ApplyDocument is the desired state of the resources of an owner, kept in
+// version control as YAML. The captures are identified by their probe path,
+// the alerts and the tracked paths by their name. The resources of the
+// owner missing from the document are deleted, the ones of other owners or
+// created by the API are never touched.
+type ApplyDocument struct {
+	Owner    string         `json:"Owner,omitempty"`
+	Captures []*Capture     `json:"Captures,omitempty"`
+	Alerts   []*Alert       `json:"Alerts,omitempty"`
+	Paths    []*TrackedPath `json:"Paths,omitempty"`
+}
+
+// ApplyChange is a change made, or planned on dry run, by an apply. The
+// conflicts are the resources of the document having the identity of a
+// resource not owned, left untouched.
+type ApplyChange struct {
+	Kind   string
+	Key    string
+	ID     string
+	Action string
+	Error  string `json:"Error,omitempty"`
+}
+
+type ApplyReport struct {
+	Owner   string
+	DryRun  bool
+	Changes []ApplyChange
+}
+
+// managedResource is a resource which can be applied
+type managedResource interface {
+	ApiResource
+	applyKey() string
+	owner() string
+	// adopt prepares a resource of a document to replace the existing one,
+	// nil if the resource is created, by giving it its identity and owner
+	adopt(owner string, existing ApiResource)
+}
+
+type applyKind struct {
+	name      string
+	section   string
+	key       string
+	resources []managedResource
+}
+
+type resourcesByKey []managedResource
+
+func (s resourcesByKey) Len() int      { return len(s) }
+func (s resourcesByKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s resourcesByKey) Less(i, j int) bool {
+	if s[i].applyKey() != s[j].applyKey() {
+		return s[i].applyKey() < s[j].applyKey()
+	}
+	return s[i].ID() < s[j].ID()
+}
+
+type applyStep struct {
+	ApplyChange
+	resource ApiResource
+}
+
+func (d *ApplyDocument) kinds() []applyKind {
+	kinds := []applyKind{
+		{name: "capture", section: "Captures", key: "ProbePath"},
+		{name: "alert", section: "Alerts", key: "Name"},
+		{name: "path", section: "Paths", key: "Name"},
+	}
+	for _, c := range d.Captures {
+		kinds[0].resources = append(kinds[0].resources, c)
+	}
+	for _, a := range d.Alerts {
+		kinds[1].resources = append(kinds[1].resources, a)
+	}
+	for _, p := range d.Paths {
+		kinds[2].resources = append(kinds[2].resources, p)
+	}
+	return kinds
+}
+
+// yamlToJSON converts the maps decoded by YAML to JSON objects
+func yamlToJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, value := range v {
+			var err error
+			if m[fmt.Sprintf("%v", k)], err = yamlToJSON(value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			var err error
+			if v[i], err = yamlToJSON(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// ParseApplyDocument parses a YAML, or JSON, document. The fields are the
+// ones of the API resources, the unknown ones are refused so that a typo
+// doesn't delete the resources of a section.
+func ParseApplyDocument(data []byte) (*ApplyDocument, error) {
+	doc := &ApplyDocument{}
+	if err := decodeDocument(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decodeDocument decodes a YAML, or JSON, document, refusing the unknown
+// fields
+func decodeDocument(data []byte, doc interface{}) error {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	v, err := yamlToJSON(v)
+	if err != nil {
+		return err
+	}
+
+	if data, err = json.Marshal(v); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(doc); err != nil {
+		return fmt.Errorf("Invalid document: %s", err.Error())
+	}
+
+	return nil
+}
+
+func sameResource(r1, r2 ApiResource) bool {
+	d1, err1 := json.Marshal(r1)
+	d2, err2 := json.Marshal(r2)
+	return err1 == nil && err2 == nil && string(d1) == string(d2)
+}
+
+// plan diffs the resources of a kind of the document against the existing
+// ones
+func (k *applyKind) plan(owner string, handler ApiHandler) ([]applyStep, error) {
+	owned := make(map[string]managedResource)
+	others := make(map[string]managedResource)
+	var stale []managedResource
+
+	existing := handler.Index()
+	ids := make([]string, 0, len(existing))
+	for id := range existing {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		r, ok := existing[id].(managedResource)
+		if !ok {
+			continue
+		}
+
+		switch key := r.applyKey(); {
+		case r.owner() != owner:
+			others[key] = r
+		case owned[key] != nil:
+			stale = append(stale, r)
+		default:
+			owned[key] = r
+		}
+	}
+
+	var steps []applyStep
+	seen := make(map[string]bool)
+	for i, r := range k.resources {
+		key := r.applyKey()
+		if key == "" {
+			return nil, fmt.Errorf("%s %d of the document has no %s", k.name, i+1, k.key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s %s defined twice in the document", k.name, key)
+		}
+		seen[key] = true
+
+		change := ApplyChange{Kind: k.name, Key: key}
+
+		if e := owned[key]; e != nil {
+			delete(owned, key)
+
+			if r.adopt(owner, e); sameResource(e, r) {
+				continue
+			}
+			change.ID, change.Action = r.ID(), "update"
+		} else if o := others[key]; o != nil {
+			change.ID, change.Action = o.ID(), "conflict"
+			if by := o.owner(); by != "" {
+				change.Error = fmt.Sprintf("%s %s is owned by %s", k.name, key, by)
+			} else {
+				change.Error = fmt.Sprintf("%s %s was created by the API", k.name, key)
+			}
+			steps = append(steps, applyStep{ApplyChange: change})
+			continue
+		} else {
+			r.adopt(owner, nil)
+			change.ID, change.Action = r.ID(), "create"
+		}
+
+		steps = append(steps, applyStep{ApplyChange: change, resource: r})
+	}
+
+	for _, r := range owned {
+		stale = append(stale, r)
+	}
+	sort.Sort(resourcesByKey(stale))
+
+	for _, r := range stale {
+		steps = append(steps, applyStep{ApplyChange: ApplyChange{Kind: k.name, Key: r.applyKey(), ID: r.ID(), Action: "delete"}})
+	}
+
+	return steps, nil
+}
+
+// Apply makes the resources of the owner of the document match it, only
+// reporting the changes to make on dry run. The document is refused as a
+// whole if invalid, the errors of the changes are reported in the changes.
+func (a *ApiServer) Apply(doc *ApplyDocument, dryRun bool) (*ApplyReport, error) {
+	a.applyLock.Lock()
+	defer a.applyLock.Unlock()
+
+	owner := doc.Owner
+	if owner == "" {
+		owner = DefaultApplyOwner
+	}
+
+	var steps []applyStep
+	for _, kind := range doc.kinds() {
+		handler := a.handlers[kind.name]
+		if handler == nil {
+			if len(kind.resources) > 0 {
+				return nil, fmt.Errorf("The %s resources aren't supported by this analyzer", kind.name)
+			}
+			continue
+		}
+
+		s, err := kind.plan(owner, handler)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s...)
+	}
+
+	report := &ApplyReport{Owner: owner, DryRun: dryRun, Changes: []ApplyChange{}}
+	for _, step := range steps {
+		if !dryRun {
+			var err error
+			switch step.Action {
+			case "create", "update":
+				err = a.handlers[step.Kind].Create(step.resource)
+			case "delete":
+				err = a.handlers[step.Kind].Delete(step.ID)
+			}
+			if err != nil {
+				step.Error = err.Error()
+				logging.GetLogger().Errorf("Failed to %s %s %s of %s: %s", step.Action, step.Kind, step.Key, owner, step.Error)
+			}
+		}
+		report.Changes = append(report.Changes, step.ApplyChange)
+	}
+
+	return report, nil
+}
+
+// Export returns the resources of an owner, all of them if not given, as a
+// document which can be applied
+func (a *ApiServer) Export(owner string) map[string]interface{} {
+	doc := make(map[string]interface{})
+	if owner != "" {
+		doc["Owner"] = owner
+	}
+
+	for _, kind := range (&ApplyDocument{}).kinds() {
+		handler := a.handlers[kind.name]
+		if handler == nil {
+			continue
+		}
+
+		var resources []managedResource
+		for _, r := range handler.Index() {
+			if r, ok := r.(managedResource); ok && (owner == "" || r.owner() == owner) {
+				resources = append(resources, r)
+			}
+		}
+		if len(resources) == 0 {
+			continue
+		}
+		sort.Sort(resourcesByKey(resources))
+
+		var values []interface{}
+		for _, r := range resources {
+			var m map[string]interface{}
+			data, _ := json.Marshal(r)
+			if err := json.Unmarshal(data, &m); err != nil {
+				continue
+			}
+
+			// the identity is given by the analyzer applying the document
+			delete(m, "UUID")
+			delete(m, "CreateTime")
+			delete(m, "ManagedBy")
+
+			values = append(values, m)
+		}
+		doc[kind.section] = values
+	}
+
+	return doc
+}
+
+// ApplyApi exposes POST /api/apply, applying the YAML document of the body,
+// only planning the changes with ?dryrun=true, and GET /api/apply?owner=,
+// exporting the resources of an owner
+type ApplyApi struct {
+	Service   string
+	ApiServer *ApiServer
+}
+
+func (a *ApplyApi) apply(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	doc, err := ParseApplyDocument(data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryrun"))
+
+	report, err := a.ApiServer.Apply(doc, dryRun)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logging.GetLogger().Criticalf("Failed to display apply report: %s", err.Error())
+	}
+}
+
+func (a *ApplyApi) export(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(a.ApiServer.Export(r.URL.Query().Get("owner"))); err != nil {
+		logging.GetLogger().Criticalf("Failed to display export: %s", err.Error())
+	}
+}
+
+func (a *ApplyApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"Apply",
+			"POST",
+			"/api/apply",
+			a.apply,
+		},
+		{
+			"Export",
+			"GET",
+			"/api/apply",
+			a.export,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterApplyApi(s string, apiServer *ApiServer, r *shttp.Server) {
+	a := &ApplyApi{
+		Service:   s,
+		ApiServer: apiServer,
+	}
+
+	a.registerEndpoints(r)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// memoryApiHandler keeps the resources in memory instead of etcd
+type memoryApiHandler struct {
+	BasicApiHandler
+	resources map[string]ApiResource
+}
+
+func (h *memoryApiHandler) Index() map[string]ApiResource {
+	resources := make(map[string]ApiResource)
+	for id, r := range h.resources {
+		resources[id] = r
+	}
+	return resources
+}
+
+func (h *memoryApiHandler) Create(resource ApiResource) error {
+	h.resources[resource.ID()] = resource
+	return nil
+}
+
+func (h *memoryApiHandler) Delete(id string) error {
+	delete(h.resources, id)
+	return nil
+}
+
+func newMemoryApiHandler(rh ResourceHandler) *memoryApiHandler {
+	return &memoryApiHandler{
+		BasicApiHandler: BasicApiHandler{ResourceHandler: rh},
+		resources:       make(map[string]ApiResource),
+	}
+}
+
+func applyActions(report *ApplyReport) map[string]string {
+	actions := make(map[string]string)
+	for _, c := range report.Changes {
+		actions[c.Kind+" "+c.Key] = c.Action
+	}
+	return actions
+}
+
+func TestApply(t *testing.T) {
+	captures := newMemoryApiHandler(&CaptureHandler{})
+	alerts := newMemoryApiHandler(&AlertHandler{})
+	a := &ApiServer{handlers: map[string]ApiHandler{"capture": captures, "alert": alerts}}
+
+	// created by the API, never touched by apply
+	manual := NewCapture("host1[Type=host]/eth0[Type=device]", "")
+	captures.Create(manual)
+
+	doc, err := ParseApplyDocument([]byte(`
+owner: netops
+captures:
+  - probepath: host1[Type=host]/eth0[Type=device]
+  - probepath: host1[Type=host]/br-int[Type=ovsbridge]
+    bpffilter: port 80
+alerts:
+  - name: down
+    select: G.V().Has('State', 'DOWN')
+    action: http://alerts/down
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := a.Apply(doc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"capture host1[Type=host]/eth0[Type=device]":      "conflict",
+		"capture host1[Type=host]/br-int[Type=ovsbridge]": "create",
+		"alert down": "create",
+	}
+	if actions := applyActions(report); !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("Wrong plan, expected %v, got %v", expected, actions)
+	}
+	if len(captures.resources) != 1 || len(alerts.resources) != 0 {
+		t.Fatal("Nothing should be changed on dry run")
+	}
+
+	if _, err := a.Apply(doc, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(captures.resources) != 2 || len(alerts.resources) != 1 || manual.ManagedBy != "" {
+		t.Fatalf("Resources not applied: %v %v", captures.resources, alerts.resources)
+	}
+
+	var alert *Alert
+	for _, r := range alerts.resources {
+		alert = r.(*Alert)
+	}
+	if alert.ManagedBy != "netops" || alert.Type != FIXED || alert.UUID == "" {
+		t.Errorf("Wrong applied alert: %+v", alert)
+	}
+
+	// applying again changes nothing
+	doc, _ = ParseApplyDocument([]byte(`
+owner: netops
+captures:
+  - probepath: host1[Type=host]/br-int[Type=ovsbridge]
+    bpffilter: port 80
+alerts:
+  - name: down
+    select: G.V().Has('State', 'DOWN')
+    action: http://alerts/down
+`))
+	if report, _ = a.Apply(doc, false); len(report.Changes) != 0 {
+		t.Errorf("Expected no change, got %v", report.Changes)
+	}
+
+	// update keeping the identity, delete of the resources of the owner
+	// missing from the document
+	doc, _ = ParseApplyDocument([]byte(`{"Owner": "netops", "Alerts": [{"Name": "down", "Select": "G.V().Has('State', 'DOWN')", "Action": "http://alerts/v2"}]}`))
+	report, _ = a.Apply(doc, false)
+	if actions := applyActions(report); len(actions) != 2 || actions["alert down"] != "update" || actions["capture host1[Type=host]/br-int[Type=ovsbridge]"] != "delete" {
+		t.Fatalf("Wrong changes: %v", actions)
+	}
+	if updated := alerts.resources[alert.UUID].(*Alert); updated.Action != "http://alerts/v2" || !updated.CreateTime.Equal(alert.CreateTime) {
+		t.Errorf("Alert should be updated in place: %+v", updated)
+	}
+	if len(captures.resources) != 1 || captures.resources[manual.ID()] != manual {
+		t.Errorf("Only the capture created by the API should be left: %v", captures.resources)
+	}
+
+	exported := a.Export("netops")
+	if values, ok := exported["Alerts"].([]interface{}); !ok || len(values) != 1 || exported["Captures"] != nil {
+		t.Errorf("Wrong export: %v", exported)
+	} else if _, ok := values[0].(map[string]interface{})["UUID"]; ok {
+		t.Errorf("The identity shouldn't be exported: %v", values[0])
+	}
+
+	// invalid documents
+	if _, err := ParseApplyDocument([]byte("fabrics:\n  - name: spine\n")); err == nil {
+		t.Error("Unknown sections should be refused")
+	}
+	doc, _ = ParseApplyDocument([]byte("alerts:\n  - name: a\n  - name: a\n"))
+	if _, err := a.Apply(doc, true); err == nil {
+		t.Error("Duplicated resources should be refused")
+	}
+	doc, _ = ParseApplyDocument([]byte("paths:\n  - name: p\n"))
+	if _, err := a.Apply(doc, true); err == nil {
+		t.Error("Resources without handler should be refused")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// BackendMigration is a request to move the graph to another backend,
+// Endpoint being the one of the gremlin backends
+type BackendMigration struct {
+	Backend  string
+	Endpoint string `json:",omitempty"`
+}
+
+// BackendMigrator moves the graph of a running analyzer to another backend
+type BackendMigrator interface {
+	Migrate(backend string, endpoint string) (*graph.MigrationStatus, error)
+	Status() *graph.MigrationStatus
+}
+
+// BackendApi starts the migrations of the graph backend with
+// POST /api/topology/backend, their progress being given by
+// GET /api/topology/backend. Only the admins may start a migration.
+type BackendApi struct {
+	Service  string
+	Migrator BackendMigrator
+	Admins   []string
+}
+
+func (b *BackendApi) isAdmin(user string) bool {
+	for _, admin := range b.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BackendApi) writeStatus(w http.ResponseWriter, code int, status *graph.MigrationStatus) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logging.GetLogger().Criticalf("Failed to display backend migration status: %s", err.Error())
+	}
+}
+
+func (b *BackendApi) migrationStatus(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	status := b.Migrator.Status()
+	if status == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b.writeStatus(w, http.StatusOK, status)
+}
+
+func (b *BackendApi) migrate(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !b.isAdmin(r.Username) {
+		logging.GetLogger().Warningf("%s graph migration refused to %s from %s", b.Service, r.Username, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var migration BackendMigration
+	if err := json.NewDecoder(r.Body).Decode(&migration); err != nil || migration.Backend == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logging.GetLogger().Infof("%s graph migration to the %s backend requested by %s from %s", b.Service, migration.Backend, r.Username, r.RemoteAddr)
+
+	status, err := b.Migrator.Migrate(migration.Backend, migration.Endpoint)
+	if err == graph.ErrEndpointNotAllowed {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b.writeStatus(w, http.StatusAccepted, status)
+}
+
+func (b *BackendApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"BackendMigrationStatus",
+			"GET",
+			"/api/topology/backend",
+			b.migrationStatus,
+		},
+		{
+			"BackendMigration",
+			"POST",
+			"/api/topology/backend",
+			b.migrate,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterBackendApi(s string, migrator BackendMigrator, r *shttp.Server) {
+	b := &BackendApi{
+		Service:  s,
+		Migrator: migrator,
+		Admins:   config.GetConfig().GetStringSlice("analyzer.backend_migration.admins"),
+	}
+
+	b.registerEndpoints(r)
+}
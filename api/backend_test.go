@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type testMigrator struct {
+	migrations int
+}
+
+func (m *testMigrator) Migrate(backend string, endpoint string) (*graph.MigrationStatus, error) {
+	if endpoint != "" {
+		return nil, graph.ErrEndpointNotAllowed
+	}
+	m.migrations++
+	return &graph.MigrationStatus{Backend: backend}, nil
+}
+
+func (m *testMigrator) Status() *graph.MigrationStatus {
+	return nil
+}
+
+func TestBackendMigrationAdmins(t *testing.T) {
+	m := &testMigrator{}
+	b := &BackendApi{Service: "analyzer", Migrator: m, Admins: []string{"admin"}}
+
+	post := func(user string, body string) int {
+		r, _ := http.NewRequest("POST", "/api/topology/backend", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		b.migrate(w, &auth.AuthenticatedRequest{Request: *r, Username: user})
+		return w.Code
+	}
+
+	if code := post("tenant", `{"Backend": "memory"}`); code != http.StatusForbidden || m.migrations != 0 {
+		t.Errorf("Migration expected to be refused to a user not admin, got %d", code)
+	}
+	if code := post("admin", `{"Backend": "titangraph", "Endpoint": "ws://10.0.0.1:8182"}`); code != http.StatusForbidden || m.migrations != 0 {
+		t.Errorf("Migration expected to be refused to an endpoint not configured, got %d", code)
+	}
+	if code := post("admin", `{"Backend": "memory"}`); code != http.StatusAccepted || m.migrations != 1 {
+		t.Errorf("Migration expected to be started by an admin, got %d", code)
+	}
+}
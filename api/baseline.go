@@ -0,0 +1,49 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Baseline is the expected topology of the hosts of a role, as exported by
+// the topology API, the role being given by the host node metadata.
+type Baseline struct {
+	Role string
+	graph.Snapshot
+}
+
+type BaselineHandler struct {
+}
+
+func (b *BaselineHandler) New() ApiResource {
+	return &Baseline{}
+}
+
+func (b *BaselineHandler) Name() string {
+	return "baseline"
+}
+
+func (b *Baseline) ID() string {
+	return b.Role
+}
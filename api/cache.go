@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+type CacheApi struct {
+	Service string
+}
+
+func (c *CacheApi) cacheDump(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	probe := r.URL.Path[len("/api/debug/caches/"):]
+	if probe == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	caches := common.GetCaches(probe + "/")
+	if len(caches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	dump := make(map[string]map[string]common.BoundedCacheEntry)
+	for _, cache := range caches {
+		dump[cache.Name] = cache.Dump()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		logging.GetLogger().Criticalf("Failed to dump caches of %s: %s", probe, err.Error())
+	}
+}
+
+func (c *CacheApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"CacheDump",
+			"GET",
+			shttp.PathPrefix("/api/debug/caches/"),
+			c.cacheDump,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterCacheApi(s string, r *shttp.Server) {
+	c := &CacheApi{
+		Service: s,
+	}
+
+	c.registerEndpoints(r)
+}
@@ -22,14 +22,43 @@
 
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Capture of the interfaces matching the probe path. With the per-flow
+// Fairness, the samples of a flow beyond FlowBudget per update interval are
+// only counted, TotalBudget samples per interval being decoded for all the
+// flows, the budgets of the agent being used when 0.
 type Capture struct {
-	ProbePath string `json:"ProbePath,omitempty"`
-	BPFFilter string `json:"BPFFilter,omitempty"`
+	ProbePath   string `json:"ProbePath,omitempty"`
+	BPFFilter   string `json:"BPFFilter,omitempty"`
+	ManagedBy   string `json:"ManagedBy,omitempty"`
+	Fairness    string `json:"Fairness,omitempty"`
+	FlowBudget  int    `json:"FlowBudget,omitempty"`
+	TotalBudget int    `json:"TotalBudget,omitempty"`
 }
 
 type CaptureHandler struct {
 }
 
+// CaptureApiHandler refuses the captures which would change the hosts of
+// read-only agents. The captures of a wildcard path are accepted, the
+// read-only agents refusing them on their side.
+type CaptureApiHandler struct {
+	BasicApiHandler
+	IsReadOnly func(host string) bool
+}
+
 func NewCapture(probePath string, bpfFilter string) *Capture {
 	return &Capture{
 		ProbePath: probePath,
@@ -48,3 +77,98 @@ func (c *CaptureHandler) Name() string {
 func (c *Capture) ID() string {
 	return c.ProbePath
 }
+
+func (c *Capture) applyKey() string {
+	return c.ProbePath
+}
+
+func (c *Capture) owner() string {
+	return c.ManagedBy
+}
+
+func (c *Capture) adopt(owner string, existing ApiResource) {
+	c.ManagedBy = owner
+}
+
+// changesHost returns whether the capture requires host changes, ie. the
+// sFlow configuration of OVS bridges, and the host it targets.
+func (c *Capture) changesHost() (string, bool) {
+	parts := strings.Split(c.ProbePath, "/")
+	if !strings.HasSuffix(parts[len(parts)-1], "[Type=ovsbridge]") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(parts[0], "[Type=host]"), true
+}
+
+func (h *CaptureApiHandler) Create(resource ApiResource) error {
+	capture := resource.(*Capture)
+	if capture.Fairness != flow.FairnessNone && capture.Fairness != flow.FairnessPerFlow {
+		return fmt.Errorf("Unknown fairness %s of capture %s", capture.Fairness, resource.ID())
+	}
+	if capture.FlowBudget < 0 || capture.TotalBudget < 0 {
+		return fmt.Errorf("Negative budget of capture %s", resource.ID())
+	}
+
+	if host, ok := capture.changesHost(); ok && h.IsReadOnly != nil && h.IsReadOnly(host) {
+		return fmt.Errorf("Capture %s requires host changes, refused by read-only agent %s", resource.ID(), host)
+	}
+
+	return h.BasicApiHandler.Create(resource)
+}
+
+// CaptureBinding is a node a capture was bound to, from Start until Stop,
+// in seconds since the epoch, Stop being 0 while bound
+type CaptureBinding struct {
+	NodeID string
+	Start  int64
+	Stop   int64 `json:",omitempty"`
+}
+
+// CaptureStatus is the state of a capture on an agent: the node it is
+// bound to, if any, the last nodes it was bound to and the effect of its
+// fairness
+type CaptureStatus struct {
+	ProbePath string
+	NodeID    string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+	Bindings  []CaptureBinding
+	Sampling  *flow.SamplingStats `json:",omitempty"`
+}
+
+// CaptureStatusApi gives the status of the captures of an agent with
+// GET /api/agent/captures
+type CaptureStatusApi struct {
+	Service string
+	Status  func() []*CaptureStatus
+}
+
+func (c *CaptureStatusApi) captureStatus(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(c.Status()); err != nil {
+		logging.GetLogger().Criticalf("Failed to display captures: %s", err.Error())
+	}
+}
+
+func (c *CaptureStatusApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"AgentCaptures",
+			"GET",
+			"/api/agent/captures",
+			c.captureStatus,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterCaptureStatusApi(s string, status func() []*CaptureStatus, r *shttp.Server) {
+	c := &CaptureStatusApi{
+		Service: s,
+		Status:  status,
+	}
+
+	c.registerEndpoints(r)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"testing"
+)
+
+func TestCaptureReadOnlyAgent(t *testing.T) {
+	h := &CaptureApiHandler{
+		IsReadOnly: func(host string) bool { return host == "ro-host" },
+	}
+
+	capture := NewCapture("ro-host[Type=host]/br-int[Type=ovsbridge]", "")
+	if err := h.Create(capture); err == nil {
+		t.Error("sFlow capture of a read-only agent should be refused")
+	}
+
+	if _, ok := NewCapture("ro-host[Type=host]/eth0[Type=device]", "").changesHost(); ok {
+		t.Error("pcap capture shouldn't require host changes")
+	}
+
+	if host, ok := NewCapture("*/br-int[Type=ovsbridge]", "").changesHost(); !ok || h.IsReadOnly(host) {
+		t.Errorf("Wildcard capture should be left to the agents, got host %s", host)
+	}
+}
+
+func TestCaptureFairness(t *testing.T) {
+	h := &CaptureApiHandler{}
+
+	capture := NewCapture("host[Type=host]/eth0[Type=device]", "")
+	capture.Fairness = "round-robin"
+	if err := h.Create(capture); err == nil {
+		t.Error("Capture with an unknown fairness should be refused")
+	}
+
+	capture.Fairness, capture.FlowBudget = "per-flow", -1
+	if err := h.Create(capture); err == nil {
+		t.Error("Capture with a negative budget should be refused")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// StatsNamespace is the websocket namespace of the counters of the
+// captures, published by the agents. The clients get them once they sent
+// a StatsSubscribe message, until a StatsUnsubscribe one.
+const StatsNamespace = "Stats"
+
+// CaptureCounters are the counters of the capture of a node, only sent
+// live, never stored. Host is set by the analyzer.
+type CaptureCounters struct {
+	ProbePath string
+	NodeID    graph.Identifier
+	Host      string `json:",omitempty"`
+	flow.CaptureStats
+}
+
+// hostCounters are the last counters published by the agent of a host
+type hostCounters struct {
+	client   *shttp.WSClient
+	counters []*CaptureCounters
+	updated  time.Time
+}
+
+// CaptureStatsApi aggregates the counters of the captures published by the
+// agents and sends them every Interval to the subscribed clients, each of
+// them getting the counters of the nodes it can read, as for the graph
+// events. The counters of an agent are dropped once it disconnects or
+// stops publishing for 3 intervals.
+type CaptureStatsApi struct {
+	shttp.DefaultWSServerEventHandler
+	Graph       *graph.Graph
+	WSServer    *shttp.WSServer
+	Authorizer  graph.Authorizer
+	Interval    time.Duration
+	lock        sync.Mutex
+	hosts       map[string]*hostCounters
+	subscribers map[*shttp.WSClient]bool
+	quit        chan bool
+}
+
+func (s *CaptureStatsApi) OnMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	if m.Namespace != StatsNamespace {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch m.Type {
+	case "StatsSubscribe":
+		s.subscribers[c] = true
+	case "StatsUnsubscribe":
+		delete(s.subscribers, c)
+	case "CaptureStats":
+		var counters []*CaptureCounters
+		if err := m.DecodeObj(&counters); err != nil {
+			logging.GetLogger().Errorf("Unable to decode capture counters from %s: %s", c.GetHost(), err.Error())
+			return
+		}
+		for _, cc := range counters {
+			cc.Host = c.GetHost()
+		}
+		s.hosts[c.GetHost()] = &hostCounters{client: c, counters: counters, updated: time.Now()}
+	}
+}
+
+func (s *CaptureStatsApi) OnUnregisterClient(c *shttp.WSClient) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.subscribers, c)
+	if h, ok := s.hosts[c.GetHost()]; ok && h.client == c {
+		delete(s.hosts, c.GetHost())
+	}
+}
+
+// snapshot returns the counters of all the hosts sorted by host and probe
+// path, and the subscribers, the unrestricted ones apart from the ones of
+// each restricted user
+func (s *CaptureStatsApi) snapshot(now time.Time) ([]*CaptureCounters, map[*shttp.WSClient]bool, map[string]map[*shttp.WSClient]bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.subscribers) == 0 {
+		return nil, nil, nil
+	}
+
+	var counters []*CaptureCounters
+	for host, h := range s.hosts {
+		if now.Sub(h.updated) > 3*s.Interval {
+			delete(s.hosts, host)
+			continue
+		}
+		counters = append(counters, h.counters...)
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Host != counters[j].Host {
+			return counters[i].Host < counters[j].Host
+		}
+		return counters[i].ProbePath < counters[j].ProbePath
+	})
+
+	all := make(map[*shttp.WSClient]bool)
+	restricted := make(map[string]map[*shttp.WSClient]bool)
+	for c := range s.subscribers {
+		user := c.GetUsername()
+		if !graph.Restricted(s.Authorizer, user) {
+			all[c] = true
+			continue
+		}
+		if _, ok := restricted[user]; !ok {
+			restricted[user] = make(map[*shttp.WSClient]bool)
+		}
+		restricted[user][c] = true
+	}
+
+	return counters, all, restricted
+}
+
+// readable returns the counters of the nodes a restricted user can read,
+// the ones of the missing nodes being left out
+func (s *CaptureStatsApi) readable(user string, counters []*CaptureCounters) []*CaptureCounters {
+	s.Graph.RLock()
+	defer s.Graph.RUnlock()
+
+	readable := []*CaptureCounters{}
+	for _, cc := range counters {
+		if n := s.Graph.GetNode(cc.NodeID); n != nil && s.Authorizer.CanReadNode(user, n) {
+			readable = append(readable, cc)
+		}
+	}
+	return readable
+}
+
+func (s *CaptureStatsApi) send(counters []*CaptureCounters, clients map[*shttp.WSClient]bool) {
+	msg := shttp.WSMessage{Namespace: StatsNamespace, Type: "CaptureStats", Obj: counters}
+	s.WSServer.BroadcastFilteredWSMessage(msg, false, func(c *shttp.WSClient) bool { return clients[c] })
+}
+
+// broadcast sends the counters to the subscribed clients
+func (s *CaptureStatsApi) broadcast(now time.Time) {
+	counters, all, restricted := s.snapshot(now)
+	if counters == nil {
+		counters = []*CaptureCounters{}
+	}
+
+	if len(all) > 0 {
+		s.send(counters, all)
+	}
+	for user, clients := range restricted {
+		s.send(s.readable(user, counters), clients)
+	}
+}
+
+func (s *CaptureStatsApi) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.broadcast(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *CaptureStatsApi) Stop() {
+	close(s.quit)
+}
+
+func NewCaptureStatsApi(g *graph.Graph, server *shttp.WSServer, interval time.Duration) *CaptureStatsApi {
+	return &CaptureStatsApi{
+		Graph:       g,
+		WSServer:    server,
+		Authorizer:  graph.NewAuthorizerFromConfig(),
+		Interval:    interval,
+		hosts:       make(map[string]*hostCounters),
+		subscribers: make(map[*shttp.WSClient]bool),
+		quit:        make(chan bool),
+	}
+}
+
+// RegisterCaptureStatsApi returns nil if the counters aren't sent to the
+// clients, ie. a 0 interval
+func RegisterCaptureStatsApi(g *graph.Graph, server *shttp.WSServer) *CaptureStatsApi {
+	interval := time.Duration(config.GetConfig().GetInt("analyzer.capture.stats_interval")) * time.Second
+	if interval <= 0 {
+		return nil
+	}
+
+	s := NewCaptureStatsApi(g, server, interval)
+	server.AddEventHandler(s)
+	go s.run()
+
+	return s
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func statsMessage(typ string, obj interface{}) shttp.WSMessage {
+	// as received from the websocket, decoded as generic maps
+	msg, _ := shttp.UnmarshalWSMessage(shttp.WSMessage{Namespace: StatsNamespace, Type: typ, Obj: obj}.Marshal())
+	return msg
+}
+
+func newTestCaptureStatsApi(t *testing.T) *CaptureStatsApi {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewCaptureStatsApi(g, nil, time.Second)
+	s.Authorizer = nil
+	return s
+}
+
+func TestCaptureStatsSubscription(t *testing.T) {
+	s := newTestCaptureStatsApi(t)
+	agent, dashboard := &shttp.WSClient{}, &shttp.WSClient{}
+	now := time.Now()
+
+	counters := []*CaptureCounters{{ProbePath: "*/eth0[Type=device]", NodeID: "n1", CaptureStats: flow.CaptureStats{Packets: 10, Bytes: 1500, Flows: 2}}}
+	s.OnMessage(agent, statsMessage("CaptureStats", counters))
+
+	if all, _, _ := s.snapshot(now); all != nil {
+		t.Fatal("Counters shouldn't be sent without subscriber")
+	}
+
+	s.OnMessage(dashboard, statsMessage("StatsSubscribe", nil))
+	all, unrestricted, restricted := s.snapshot(now)
+	if len(all) != 1 || all[0].NodeID != "n1" || all[0].Packets != 10 || all[0].Bytes != 1500 || all[0].Flows != 2 {
+		t.Fatalf("Wrong counters: %+v", all)
+	}
+	if !unrestricted[dashboard] || unrestricted[agent] || len(restricted) != 0 {
+		t.Errorf("Only the subscribed client should get the counters: %v, %v", unrestricted, restricted)
+	}
+
+	if all, _, _ := s.snapshot(now.Add(4 * time.Second)); len(all) != 0 {
+		t.Errorf("Counters of an agent not publishing anymore should be dropped: %+v", all)
+	}
+
+	s.OnMessage(agent, statsMessage("CaptureStats", counters))
+	s.OnUnregisterClient(agent)
+	if all, _, _ := s.snapshot(now); len(all) != 0 {
+		t.Errorf("Counters of a disconnected agent should be dropped: %+v", all)
+	}
+
+	s.OnMessage(dashboard, statsMessage("StatsUnsubscribe", nil))
+	if len(s.subscribers) != 0 {
+		t.Error("Client should be unsubscribed")
+	}
+}
+
+func TestCaptureStatsReadable(t *testing.T) {
+	s := newTestCaptureStatsApi(t)
+	s.Authorizer = &graph.ScopeAuthorizer{Scopes: map[string]graph.ReadScope{"tenant": {Types: []string{"veth"}}}}
+
+	s.Graph.Lock()
+	veth := s.Graph.NewNode(graph.GenID(), graph.Metadata{"Type": "veth"})
+	device := s.Graph.NewNode(graph.GenID(), graph.Metadata{"Type": "device"})
+	s.Graph.Unlock()
+
+	counters := []*CaptureCounters{{NodeID: veth.ID}, {NodeID: device.ID}, {NodeID: "gone"}}
+	if readable := s.readable("tenant", counters); len(readable) != 1 || readable[0].NodeID != veth.ID {
+		t.Errorf("Only the counters of the veth should be readable: %+v", readable)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package client is a client of the analyzer API for the programs
+// integrating with Skydive. It only depends on the graph and flow types so
+// that it can be imported without the agent and analyzer dependencies.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Options are the address of an analyzer and the credentials of the client
+type Options struct {
+	Addr     string
+	Port     int
+	Username string
+	Password string
+	// TLS configuration, HTTPS and wss being used if set
+	TLSConfig *tls.Config
+}
+
+// Error is returned when the analyzer refused a request, ie. a 404 for an
+// unknown resource or a 408 when waiting for a node timed out
+type Error struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// ListOptions are the pagination, sorting and field selection of the list
+// endpoints, Sort being prefixed by '-' for a descending order
+type ListOptions struct {
+	Limit        int
+	Offset       int
+	Sort         string
+	Fields       []string
+	MaxValueSize int
+}
+
+func (o *ListOptions) values() url.Values {
+	query := url.Values{}
+	if o == nil {
+		return query
+	}
+
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		query.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Sort != "" {
+		query.Set("sort", o.Sort)
+	}
+	if len(o.Fields) > 0 {
+		query.Set("fields", strings.Join(o.Fields, ","))
+	}
+	if o.MaxValueSize > 0 {
+		query.Set("max_value_size", strconv.Itoa(o.MaxValueSize))
+	}
+	return query
+}
+
+// TopologyClient queries the topology. The totals are the numbers of
+// results before pagination, -1 if the result isn't a list.
+type TopologyClient interface {
+	Graph() (*graph.Snapshot, error)
+	Query(gremlin string, opts *ListOptions, result interface{}) (int, error)
+	LookupNodes(filter graph.Metadata, opts *ListOptions) ([]*graph.SnapshotElement, error)
+	WaitNodes(filter graph.Metadata, timeout time.Duration) ([]*graph.SnapshotElement, error)
+}
+
+// CaptureClient manages the captures
+type CaptureClient interface {
+	ListCaptures() (map[string]*Capture, error)
+	GetCapture(id string) (*Capture, error)
+	CreateCapture(capture *Capture) error
+	DeleteCapture(id string) error
+	DownloadPcap(pcap *Pcap, w io.Writer) (int64, error)
+}
+
+// AlertClient manages the alerts
+type AlertClient interface {
+	ListAlerts() (map[string]*Alert, error)
+	GetAlert(id string) (*Alert, error)
+	CreateAlert(alert *Alert) error
+	DeleteAlert(id string) error
+}
+
+// PathClient manages the tracked paths
+type PathClient interface {
+	TrackPath(path *TrackedPath) error
+	DeletePath(id string) error
+	ListPathStates() (map[string]*PathState, error)
+	GetPathState(id string) (*PathState, error)
+}
+
+// FlowClient searches the flows of the storage
+type FlowClient interface {
+	SearchFlows(filters map[string]string, opts *ListOptions) ([]*flow.Flow, int, error)
+}
+
+// ApplyClient applies and exports the YAML documents of resources
+type ApplyClient interface {
+	Apply(document []byte, dryRun bool) (*ApplyReport, error)
+	Export(owner string) (map[string]interface{}, error)
+}
+
+// API is the whole API, the consumers should depend on the narrower
+// interfaces they use so that they are easy to mock
+type API interface {
+	TopologyClient
+	CaptureClient
+	AlertClient
+	PathClient
+	FlowClient
+	ApplyClient
+}
+
+// Client is a client of the REST API of an analyzer, authenticating on the
+// first request
+type Client struct {
+	opts Options
+	rest *shttp.RestClient
+}
+
+// request sends a request, the body being sent as is if given as bytes,
+// as JSON otherwise. The response is checked and its body left open.
+func (c *Client) request(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	resp, err := c.rest.Request(method, path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &Error{StatusCode: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(data))}
+	}
+
+	return resp, nil
+}
+
+// do sends a request and decodes its JSON response into result, if not
+// nil, the total of the paginated results being returned, -1 if not given
+func (c *Client) do(method string, path string, body interface{}, result interface{}) (int, error) {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return 0, fmt.Errorf("Unable to decode response: %s", err.Error())
+		}
+	}
+
+	total := -1
+	if t := resp.Header.Get("X-Total-Count"); t != "" {
+		if n, err := strconv.Atoi(t); err == nil {
+			total = n
+		}
+	}
+
+	return total, nil
+}
+
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+func NewClient(opts Options) *Client {
+	rest := shttp.NewRestClient(opts.Addr, opts.Port, &shttp.AuthenticationOpts{Username: opts.Username, Password: opts.Password})
+	if opts.TLSConfig != nil {
+		rest.SetTLSConfig(opts.TLSConfig)
+	}
+
+	return &Client{opts: opts, rest: rest}
+}
+
+// NewClientFromConfig returns a client of the first analyzer of the
+// configuration
+func NewClientFromConfig(opts Options) (*Client, error) {
+	addr, port, err := config.GetAnalyzerClientAddr()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse analyzer client %s", err.Error())
+	}
+	opts.Addr, opts.Port = addr, port
+
+	return NewClient(opts), nil
+}
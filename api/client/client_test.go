@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// newTestClient returns a client of a server requiring the authtok cookie
+// set by its login page
+func newTestClient(t *testing.T, mux *http.ServeMux) (*Client, *httptest.Server) {
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("username") != "admin" || r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "authtok", Value: "token"})
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("authtok"); r.URL.Path != "/login" && (err != nil || cookie.Value != "token") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p, _ := strconv.Atoi(port)
+
+	return NewClient(Options{Addr: host, Port: p, Username: "admin", Password: "secret"}), server
+}
+
+func TestTopologyClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/topology", func(w http.ResponseWriter, r *http.Request) {
+		var query Topology
+		json.NewDecoder(r.Body).Decode(&query)
+		if query.GremlinQuery != "G.V().Has('Type', 'veth')" || r.URL.Query().Get("limit") != "1" || r.URL.Query().Get("fields") != "Name,MTU" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Total-Count", "2")
+		w.Write([]byte(`[{"ID":"veth0","Host":"host1","Metadata":{"Name":"veth0"}}]`))
+	})
+	mux.HandleFunc("/api/topology/nodes", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("Name") != "eth0" || r.URL.Query().Get("timeout") != "1s" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusRequestTimeout)
+		w.Write([]byte("No node matching within 1s"))
+	})
+
+	var c TopologyClient
+	c, server := newTestClient(t, mux)
+	defer server.Close()
+
+	var nodes []*graph.SnapshotElement
+	total, err := c.Query("G.V().Has('Type', 'veth')", &ListOptions{Limit: 1, Fields: []string{"Name", "MTU"}}, &nodes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []*graph.SnapshotElement{{ID: "veth0", Host: "host1", Metadata: graph.Metadata{"Name": "veth0"}}}
+	if total != 2 || !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("Wrong result: %d %+v", total, nodes)
+	}
+
+	_, err = c.WaitNodes(graph.Metadata{"Name": "eth0"}, time.Second)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusRequestTimeout || e.Message != "No node matching within 1s" {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+}
+
+func TestResourceClients(t *testing.T) {
+	alerts := map[string]*Alert{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/alert", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var alert Alert
+			json.NewDecoder(r.Body).Decode(&alert)
+			alert.Count = 1
+			alerts[alert.UUID] = &alert
+			json.NewEncoder(w).Encode(&alert)
+			return
+		}
+		json.NewEncoder(w).Encode(alerts)
+	})
+	mux.HandleFunc("/api/capture/pcap", func(w http.ResponseWriter, r *http.Request) {
+		var pcap Pcap
+		json.NewDecoder(r.Body).Decode(&pcap)
+		if pcap.GremlinQuery == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("pcap data"))
+	})
+
+	c, server := newTestClient(t, mux)
+	defer server.Close()
+
+	var alertClient AlertClient = c
+	alert := NewAlert()
+	alert.Name = "mtu"
+	if err := alertClient.CreateAlert(alert); err != nil {
+		t.Fatal(err.Error())
+	}
+	if alert.Count != 1 {
+		t.Errorf("The alert should be updated with the one created: %+v", alert)
+	}
+
+	list, err := alertClient.ListAlerts()
+	if err != nil || len(list) != 1 || list[alert.UUID].Name != "mtu" {
+		t.Errorf("Wrong alerts: %+v, %v", list, err)
+	}
+
+	var captureClient CaptureClient = c
+	var buffer bytes.Buffer
+	if n, err := captureClient.DownloadPcap(&Pcap{GremlinQuery: "G.V().Has('Name', 'eth0')"}, &buffer); err != nil || n != 9 || buffer.String() != "pcap data" {
+		t.Errorf("Wrong pcap: %d %q %v", n, buffer.String(), err)
+	}
+	if _, err := captureClient.DownloadPcap(&Pcap{}, &buffer); err == nil {
+		t.Error("Expected an error for a pcap without query")
+	}
+
+	// wrong credentials
+	c = NewClient(Options{Addr: c.opts.Addr, Port: c.opts.Port, Username: "admin", Password: "wrong"})
+	if _, err := c.ListAlerts(); err == nil {
+		t.Error("Expected an authentication error")
+	}
+}
+
+func streamMessage(typ string, chunk *pcapStreamChunk) shttp.WSMessage {
+	// as received from the websocket, decoded as generic maps
+	msg, _ := shttp.UnmarshalWSMessage(shttp.WSMessage{Namespace: pcapStreamNamespace, Type: typ, Obj: chunk}.Marshal())
+	return msg
+}
+
+func TestPcapStream(t *testing.T) {
+	wsClient, err := shttp.NewWSAsyncClient("127.0.0.1", 0, "/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	s := &PcapStream{ID: "s1", pcap: &Pcap{}, wsClient: wsClient, w: &buffer, done: make(chan error, 1)}
+
+	// a pcap file made of the records sent by the agent
+	var records bytes.Buffer
+	w := pcapgo.NewWriter(&records)
+	for i := 0; i < 3; i++ {
+		w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 4, Length: 4}, []byte{1, 2, 3, 4})
+	}
+
+	s.OnMessage(streamMessage("PcapStreamStarted", &pcapStreamChunk{ID: "s1", LinkType: 1, Snaplen: 65535}))
+	s.OnMessage(streamMessage("PcapStreamRecords", &pcapStreamChunk{ID: "other", Seq: 1, Data: []byte{1}}))
+	s.OnMessage(streamMessage("PcapStreamRecords", &pcapStreamChunk{ID: "s1", Seq: 1, Data: records.Bytes(), Dropped: 2}))
+	s.OnMessage(streamMessage("PcapStreamEnd", &pcapStreamChunk{ID: "s1", Dropped: 5}))
+
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dropped() != 5 || s.Written() != int64(buffer.Len()) {
+		t.Errorf("Wrong counters: %d dropped, %d written", s.Dropped(), s.Written())
+	}
+
+	reader, err := pcapgo.NewReader(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if data, _, err := reader.ReadPacketData(); err != nil || !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+			t.Fatalf("Packet %d expected: %v %v", i, data, err)
+		}
+	}
+
+	// the error of the agent is returned
+	s = &PcapStream{ID: "s2", pcap: &Pcap{}, wsClient: wsClient, w: &buffer, done: make(chan error, 1)}
+	s.OnMessage(streamMessage("PcapStreamEnd", &pcapStreamChunk{ID: "s2", Error: "Too many raw captures running"}))
+	if err := s.Wait(); err == nil || err.Error() != "Too many raw captures running" {
+		t.Errorf("Expected the error of the agent, got: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+)
+
+func (c *Client) ListCaptures() (map[string]*Capture, error) {
+	var captures map[string]*Capture
+	if _, err := c.do("GET", "api/capture", nil, &captures); err != nil {
+		return nil, err
+	}
+	return captures, nil
+}
+
+func (c *Client) GetCapture(id string) (*Capture, error) {
+	var capture Capture
+	if _, err := c.do("GET", "api/capture/"+id, nil, &capture); err != nil {
+		return nil, err
+	}
+	return &capture, nil
+}
+
+// CreateCapture creates a capture, updated with the one created
+func (c *Client) CreateCapture(capture *Capture) error {
+	_, err := c.do("POST", "api/capture", capture, capture)
+	return err
+}
+
+func (c *Client) DeleteCapture(id string) error {
+	_, err := c.do("DELETE", "api/capture/"+id, nil, nil)
+	return err
+}
+
+// DownloadPcap writes the packets captured on the interface returned by
+// the query as a pcap file and returns its size. The agent ends the
+// capture after the duration or the size requested, its maximums if not
+// given.
+func (c *Client) DownloadPcap(pcap *Pcap, w io.Writer) (int64, error) {
+	resp, err := c.request("POST", "api/capture/pcap", pcap)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("Download interrupted: %s", err.Error())
+	}
+	return n, nil
+}
+
+func (c *Client) ListAlerts() (map[string]*Alert, error) {
+	var alerts map[string]*Alert
+	if _, err := c.do("GET", "api/alert", nil, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+func (c *Client) GetAlert(id string) (*Alert, error) {
+	var alert Alert
+	if _, err := c.do("GET", "api/alert/"+id, nil, &alert); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// CreateAlert creates an alert, updated with the one created
+func (c *Client) CreateAlert(alert *Alert) error {
+	_, err := c.do("POST", "api/alert", alert, alert)
+	return err
+}
+
+func (c *Client) DeleteAlert(id string) error {
+	_, err := c.do("DELETE", "api/alert/"+id, nil, nil)
+	return err
+}
+
+// TrackPath starts tracking a path, updated with the one created
+func (c *Client) TrackPath(path *TrackedPath) error {
+	_, err := c.do("POST", "api/path", path, path)
+	return err
+}
+
+// DeletePath stops tracking a path
+func (c *Client) DeletePath(id string) error {
+	_, err := c.do("DELETE", "api/path/"+id, nil, nil)
+	return err
+}
+
+// ListPathStates returns the current state and hops of the tracked paths
+func (c *Client) ListPathStates() (map[string]*PathState, error) {
+	var states map[string]*PathState
+	if _, err := c.do("GET", "api/pathstate", nil, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (c *Client) GetPathState(id string) (*PathState, error) {
+	var state PathState
+	if _, err := c.do("GET", "api/pathstate/"+id, nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Apply makes the resources of the owner of a YAML document match it, only
+// reporting the changes to make on dry run. A change failing doesn't fail
+// the apply, see ApplyReport.Failed.
+func (c *Client) Apply(document []byte, dryRun bool) (*ApplyReport, error) {
+	path := "api/apply"
+	if dryRun {
+		path += "?dryrun=true"
+	}
+
+	var report ApplyReport
+	if _, err := c.do("POST", path, document, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// WhatIf simulates the mutations of a YAML document on a view of the graph
+// of the analyzer, the graph being left untouched
+func (c *Client) WhatIf(document []byte) (*WhatIfReport, error) {
+	var report WhatIfReport
+	if _, err := c.do("POST", "api/whatif", document, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Export returns the resources of an owner, all of them if not given, as
+// a document which can be applied once marshaled as YAML
+func (c *Client) Export(owner string) (map[string]interface{}, error) {
+	path := "api/apply"
+	if owner != "" {
+		path += "?owner=" + url.QueryEscape(owner)
+	}
+
+	var doc map[string]interface{}
+	if _, err := c.do("GET", path, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/nu7hatch/gouuid"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// GraphSubscriber keeps a local graph in sync with the one of the analyzer
+// for the listeners added to Graph. The graph is received on connection,
+// then its events. After a disconnection the client reconnects, the
+// missed events or the hosts changed meanwhile being sent by the analyzer
+// if possible, the whole graph otherwise. The connection is closed on the
+// messages of an incompatible version.
+type GraphSubscriber struct {
+	Graph      *graph.Graph
+	wsClient   *shttp.WSAsyncClient
+	replicator *graph.Replicator
+}
+
+// Start connects to the analyzer
+func (s *GraphSubscriber) Start() {
+	s.wsClient.Connect()
+}
+
+func (s *GraphSubscriber) Stop() {
+	s.wsClient.Disconnect()
+	if s.replicator.Digests != nil {
+		s.replicator.Digests.Stop()
+	}
+}
+
+// Synced returns whether the graph was received
+func (s *GraphSubscriber) Synced() bool {
+	return s.replicator.Stats().Synced
+}
+
+// newWSClient returns a websocket client of the analyzer of the client,
+// authenticated as the client
+func (c *Client) newWSClient() (*shttp.WSAsyncClient, error) {
+	authClient := shttp.NewAuthenticationClient(c.opts.Addr, c.opts.Port, &shttp.AuthenticationOpts{Username: c.opts.Username, Password: c.opts.Password})
+	authClient.TLSConfig = c.opts.TLSConfig
+
+	wsClient, err := shttp.NewWSAsyncClient(c.opts.Addr, c.opts.Port, "/ws", authClient)
+	if err != nil {
+		return nil, err
+	}
+	wsClient.TLSConfig = c.opts.TLSConfig
+
+	return wsClient, nil
+}
+
+// NewGraphSubscriber returns a subscriber to the graph of the analyzer of
+// the client
+func (c *Client) NewGraphSubscriber() (*GraphSubscriber, error) {
+	backend, err := graph.NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := graph.NewGraph(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	wsClient, err := c.newWSClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GraphSubscriber{
+		Graph:      g,
+		wsClient:   wsClient,
+		replicator: graph.NewReplicator(wsClient, g),
+	}, nil
+}
+
+// statsNamespace is the websocket namespace of the counters of the
+// captures, as the one of the api package
+const statsNamespace = "Stats"
+
+// CaptureStatsSubscriber receives the counters of the captures sent by the
+// analyzer every few seconds, the subscription being sent again on each
+// connection.
+type CaptureStatsSubscriber struct {
+	shttp.DefaultWSClientEventHandler
+	wsClient *shttp.WSAsyncClient
+	onStats  func(counters []*CaptureCounters)
+}
+
+func (s *CaptureStatsSubscriber) OnConnected() {
+	s.wsClient.SendWSMessage(shttp.WSMessage{Namespace: statsNamespace, Type: "StatsSubscribe"})
+}
+
+func (s *CaptureStatsSubscriber) OnMessage(m shttp.WSMessage) {
+	if m.Namespace != statsNamespace || m.Type != "CaptureStats" {
+		return
+	}
+
+	var counters []*CaptureCounters
+	if err := m.DecodeObj(&counters); err != nil {
+		logging.GetLogger().Errorf("Unable to decode the capture counters: %s", err.Error())
+		return
+	}
+	s.onStats(counters)
+}
+
+// Start connects to the analyzer
+func (s *CaptureStatsSubscriber) Start() {
+	s.wsClient.Connect()
+}
+
+func (s *CaptureStatsSubscriber) Stop() {
+	s.wsClient.Disconnect()
+}
+
+// NewCaptureStatsSubscriber returns a subscriber to the counters of the
+// captures, onStats being called from the websocket loop
+func (c *Client) NewCaptureStatsSubscriber(onStats func(counters []*CaptureCounters)) (*CaptureStatsSubscriber, error) {
+	wsClient, err := c.newWSClient()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CaptureStatsSubscriber{wsClient: wsClient, onStats: onStats}
+	wsClient.AddEventHandler(s)
+
+	return s, nil
+}
+
+// pcapStreamNamespace is the websocket namespace of the live raw captures,
+// as the one of the api package
+const pcapStreamNamespace = "PcapStream"
+
+// pcapStreamStart and pcapStreamChunk are the PcapStream and the
+// PcapStreamChunk of the api package
+type pcapStreamStart struct {
+	ID string
+	Pcap
+}
+
+type pcapStreamChunk struct {
+	ID       string
+	Seq      uint64
+	LinkType int
+	Snaplen  int
+	Data     []byte
+	Dropped  int64
+	Error    string
+}
+
+type pcapStreamControl struct {
+	ID  string
+	Seq uint64 `json:",omitempty"`
+}
+
+// PcapStream writes a live raw capture of the interface returned by the
+// query as a pcap file: the pcap header once the agent started the
+// capture, then the packets as they arrive. Each chunk of packets is
+// acknowledged once written, the agent dropping the packets rather than
+// sending more when the writer doesn't keep up. The stream ends when
+// stopped, on the maximum duration or size, or if the connection to the
+// analyzer is lost.
+type PcapStream struct {
+	shttp.DefaultWSClientEventHandler
+	ID        string
+	pcap      *Pcap
+	wsClient  *shttp.WSAsyncClient
+	w         io.Writer
+	lock      sync.Mutex
+	requested bool
+	written   int64
+	dropped   int64
+	done      chan error
+	ended     sync.Once
+}
+
+func (s *PcapStream) send(msgType string, obj interface{}) {
+	s.wsClient.SendWSMessage(shttp.WSMessage{Namespace: pcapStreamNamespace, Type: msgType, Obj: obj})
+}
+
+func (s *PcapStream) end(err error) {
+	s.ended.Do(func() { s.done <- err })
+}
+
+func (s *PcapStream) OnConnected() {
+	if s.requested {
+		s.end(errors.New("Connection to the analyzer lost"))
+		return
+	}
+	s.requested = true
+
+	s.send("PcapStreamStart", &pcapStreamStart{ID: s.ID, Pcap: *s.pcap})
+}
+
+func (s *PcapStream) OnDisconnected() {
+	s.end(errors.New("Connection to the analyzer lost"))
+}
+
+// write writes a chunk, returning the sequence number to acknowledge, 0
+// if none
+func (s *PcapStream) write(msgType string, chunk *pcapStreamChunk) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dropped = chunk.Dropped
+
+	switch msgType {
+	case "PcapStreamStarted":
+		if err := pcapgo.NewWriter(s.w).WriteFileHeader(uint32(chunk.Snaplen), layers.LinkType(chunk.LinkType)); err != nil {
+			return 0, err
+		}
+		s.written += 24
+	case "PcapStreamRecords":
+		n, err := s.w.Write(chunk.Data)
+		s.written += int64(n)
+		if err != nil {
+			return 0, err
+		}
+		return chunk.Seq, nil
+	}
+
+	return 0, nil
+}
+
+func (s *PcapStream) OnMessage(m shttp.WSMessage) {
+	if m.Namespace != pcapStreamNamespace {
+		return
+	}
+
+	var chunk pcapStreamChunk
+	if err := m.DecodeObj(&chunk); err != nil {
+		logging.GetLogger().Errorf("Unable to decode the raw capture stream: %s", err.Error())
+		return
+	}
+	if chunk.ID != s.ID {
+		return
+	}
+
+	if m.Type == "PcapStreamEnd" {
+		s.lock.Lock()
+		s.dropped = chunk.Dropped
+		s.lock.Unlock()
+
+		if chunk.Error != "" {
+			s.end(errors.New(chunk.Error))
+		} else {
+			s.end(nil)
+		}
+		return
+	}
+
+	seq, err := s.write(m.Type, &chunk)
+	if err != nil {
+		s.send("PcapStreamStop", &pcapStreamControl{ID: s.ID})
+		s.end(err)
+		return
+	}
+	if seq != 0 {
+		s.send("PcapStreamAck", &pcapStreamControl{ID: s.ID, Seq: seq})
+	}
+}
+
+// Stop asks the agent to end the capture, the packets sent meanwhile being
+// still written until Wait returns
+func (s *PcapStream) Stop() {
+	s.send("PcapStreamStop", &pcapStreamControl{ID: s.ID})
+}
+
+// Wait waits for the end of the stream and returns its error, if any
+func (s *PcapStream) Wait() error {
+	err := <-s.done
+	s.wsClient.Disconnect()
+	return err
+}
+
+// Written returns the size of the pcap file written so far
+func (s *PcapStream) Written() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.written
+}
+
+// Dropped returns the number of packets the agent dropped so far
+func (s *PcapStream) Dropped() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// StreamPcap starts a live raw capture written to w as a pcap file
+func (c *Client) StreamPcap(pcap *Pcap, w io.Writer) (*PcapStream, error) {
+	wsClient, err := c.newWSClient()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PcapStream{
+		ID:       id.String(),
+		pcap:     pcap,
+		wsClient: wsClient,
+		w:        w,
+		done:     make(chan error, 1),
+	}
+	wsClient.AddEventHandler(s)
+	wsClient.Connect()
+
+	return s, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Graph returns the whole topology the user may read
+func (c *Client) Graph() (*graph.Snapshot, error) {
+	var snapshot graph.Snapshot
+	if _, err := c.do("GET", "api/topology", nil, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Query executes a Gremlin query and decodes its result, ie. a list of
+// nodes for g.V().Has('Type', 'veth'), returning the total of the results
+// if paginated
+func (c *Client) Query(gremlin string, opts *ListOptions, result interface{}) (int, error) {
+	return c.do("GET", withQuery("api/topology", opts.values()), &Topology{GremlinQuery: gremlin}, result)
+}
+
+func filterQuery(filter graph.Metadata, query url.Values) url.Values {
+	for k, v := range filter {
+		query.Set(k, fmt.Sprintf("%v", v))
+	}
+	return query
+}
+
+// LookupNodes returns the nodes matching a metadata filter
+func (c *Client) LookupNodes(filter graph.Metadata, opts *ListOptions) ([]*graph.SnapshotElement, error) {
+	var nodes []*graph.SnapshotElement
+	if _, err := c.do("GET", withQuery("api/topology/nodes", filterQuery(filter, opts.values())), nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// WaitNodes waits for a node matching a metadata filter then returns the
+// matching nodes, an Error of status 408 being returned on timeout
+func (c *Client) WaitNodes(filter graph.Metadata, timeout time.Duration) ([]*graph.SnapshotElement, error) {
+	query := filterQuery(filter, url.Values{})
+	query.Set("watch", "true")
+	query.Set("timeout", timeout.String())
+
+	var nodes []*graph.SnapshotElement
+	if _, err := c.do("GET", withQuery("api/topology/nodes", query), nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// SearchFlows returns the flows of the storage matching the filters, ie.
+// {"ProbeGraphPath": "host1[Type=host]/eth0[Type=device]"}, and their total
+func (c *Client) SearchFlows(filters map[string]string, opts *ListOptions) ([]*flow.Flow, int, error) {
+	query := opts.values()
+	for k, v := range filters {
+		query.Set(k, v)
+	}
+
+	var flows []*flow.Flow
+	total, err := c.do("GET", withQuery("api/flow/search", query), nil, &flows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return flows, total, nil
+}
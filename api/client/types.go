@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// The resources of the API as sent and received by the analyzer, kept
+// identical to the ones of the api package, which can't be imported
+// without pulling in the probes and the storages.
+
+// FIXED is the type of the alerts raised once per matching change
+const FIXED = 1
+
+// Capture of the interfaces matching the probe path
+type Capture struct {
+	ProbePath   string `json:"ProbePath,omitempty"`
+	BPFFilter   string `json:"BPFFilter,omitempty"`
+	ManagedBy   string `json:"ManagedBy,omitempty"`
+	Fairness    string `json:"Fairness,omitempty"`
+	FlowBudget  int    `json:"FlowBudget,omitempty"`
+	TotalBudget int    `json:"TotalBudget,omitempty"`
+}
+
+// CaptureCounters are the counters of the capture of a node, sent live by
+// the analyzer to the clients which subscribed to them
+type CaptureCounters struct {
+	ProbePath string
+	NodeID    graph.Identifier
+	Host      string `json:",omitempty"`
+	flow.CaptureStats
+}
+
+// Alert evaluated on each change of the nodes returned by Select
+type Alert struct {
+	UUID        string
+	Name        string
+	Description string
+	Select      string
+	Test        string
+	Action      string
+	Type        int
+	Count       int
+	CreateTime  time.Time
+	ManagedBy   string `json:"ManagedBy,omitempty"`
+	For         string `json:"For,omitempty"`
+}
+
+// TrackedPath is the shortest path kept between the nodes returned by two
+// Gremlin queries, along the edges of the given relation types
+type TrackedPath struct {
+	UUID       string
+	Name       string
+	Src        string
+	Dst        string
+	Relations  []string `json:",omitempty"`
+	CreateTime time.Time
+	ManagedBy  string `json:"ManagedBy,omitempty"`
+}
+
+// Hop is a node of a tracked path
+type Hop struct {
+	ID   graph.Identifier
+	Host string
+	Name string `json:",omitempty"`
+	Type string `json:",omitempty"`
+}
+
+// PathState is the current state of a tracked path, Since being the time of
+// its last change
+type PathState struct {
+	UUID    string
+	Name    string
+	State   string
+	Reason  string `json:",omitempty"`
+	Hops    []Hop
+	Since   time.Time
+	Changes int
+}
+
+// Topology is a Gremlin query of the topology
+type Topology struct {
+	GremlinQuery string `json:"GremlinQuery,omitempty"`
+}
+
+// Pcap is a raw capture of the single interface returned by the query,
+// Duration being a Go duration, ie. 30s
+type Pcap struct {
+	GremlinQuery string `json:"GremlinQuery,omitempty"`
+	BPFFilter    string `json:"BPFFilter,omitempty"`
+	Duration     string `json:"Duration,omitempty"`
+	MaxSize      int64  `json:"MaxSize,omitempty"`
+}
+
+// ApplyChange is a change made, or planned on dry run, by an apply
+type ApplyChange struct {
+	Kind   string
+	Key    string
+	ID     string
+	Action string
+	Error  string `json:"Error,omitempty"`
+}
+
+// ApplyReport lists the changes of an apply
+type ApplyReport struct {
+	Owner   string
+	DryRun  bool
+	Changes []ApplyChange
+}
+
+// Failed returns whether a change of the apply failed or conflicted
+func (r *ApplyReport) Failed() bool {
+	for _, change := range r.Changes {
+		if change.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertChange is an alert starting, or stopping, to pass its test on a
+// node once the simulated mutations applied, State being firing or cleared
+type AlertChange struct {
+	UUID  string
+	Name  string
+	Node  graph.Identifier
+	State string
+}
+
+// WhatIfReport is the outcome of mutations simulated by the analyzer, the
+// violations of the checkers before and after them being kept as sent
+type WhatIfReport struct {
+	Mutations    int
+	NodesChanged int
+	EdgesChanged int
+	Baseline     map[string]interface{}
+	Violations   map[string]interface{}
+	Alerts       []AlertChange `json:",omitempty"`
+}
+
+// Firing returns whether an alert would start to pass its test
+func (r *WhatIfReport) Firing() bool {
+	for _, change := range r.Alerts {
+		if change.State == "firing" {
+			return true
+		}
+	}
+	return false
+}
+
+func NewCapture(probePath string, bpfFilter string) *Capture {
+	return &Capture{
+		ProbePath: probePath,
+		BPFFilter: bpfFilter,
+	}
+}
+
+func NewAlert() *Alert {
+	id, _ := uuid.NewV4()
+
+	return &Alert{
+		UUID:       id.String(),
+		CreateTime: time.Now(),
+		Type:       FIXED,
+	}
+}
+
+func NewTrackedPath() *TrackedPath {
+	id, _ := uuid.NewV4()
+
+	return &TrackedPath{
+		UUID:       id.String(),
+		CreateTime: time.Now(),
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	apiclient "github.com/redhat-cip/skydive/api/client"
+)
+
+// TestClientTypes checks that the resources of the client package, kept
+// apart so that it doesn't depend on this package, give the same JSON
+func TestClientTypes(t *testing.T) {
+	alert := NewAlert()
+	alert.Name, alert.Description, alert.Select, alert.Test, alert.Action, alert.Count, alert.ManagedBy = "name", "description", "G.V()", "true", "echo", 2, "owner"
+
+	path := NewTrackedPath()
+	path.Name, path.Src, path.Dst, path.Relations, path.ManagedBy = "name", "G.V('a')", "G.V('b')", []string{"layer2"}, "owner"
+
+	resources := []struct {
+		resource interface{}
+		client   interface{}
+	}{
+		{&Capture{ProbePath: "host1/eth0", BPFFilter: "port 80", ManagedBy: "owner", Fairness: "per-flow", FlowBudget: 5, TotalBudget: 100}, &apiclient.Capture{}},
+		{alert, &apiclient.Alert{}},
+		{path, &apiclient.TrackedPath{}},
+		{&Pcap{GremlinQuery: "G.V()", BPFFilter: "port 80", Duration: "30s", MaxSize: 1024}, &apiclient.Pcap{}},
+		{&Topology{GremlinQuery: "G.V()"}, &apiclient.Topology{}},
+		{&ApplyReport{Owner: "owner", DryRun: true, Changes: []ApplyChange{{Kind: "alert", Key: "name", ID: "id", Action: "create", Error: "conflict"}}}, &apiclient.ApplyReport{}},
+	}
+
+	for _, r := range resources {
+		data, err := json.Marshal(r.resource)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := json.Unmarshal(data, r.client); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var expected, got map[string]interface{}
+		json.Unmarshal(data, &expected)
+		data, _ = json.Marshal(r.client)
+		json.Unmarshal(data, &got)
+
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("%T of the client should be the same as %T: %v, expected %v", r.client, r.resource, got, expected)
+		}
+	}
+}
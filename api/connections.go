@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ConnectionsApi lists the websocket connections with GET /api/connections,
+// along with the user each one authenticated with and its session. The
+// users whose reads are restricted only get their own connections.
+type ConnectionsApi struct {
+	Service    string
+	WSServer   *shttp.WSServer
+	Authorizer graph.Authorizer
+}
+
+func (c *ConnectionsApi) clients(user string) []shttp.WSClientStatus {
+	clients := c.WSServer.Clients()
+	if !graph.Restricted(c.Authorizer, user) {
+		return clients
+	}
+
+	own := []shttp.WSClientStatus{}
+	for _, client := range clients {
+		if client.Username == user {
+			own = append(own, client)
+		}
+	}
+	return own
+}
+
+func (c *ConnectionsApi) connectionsIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(c.clients(r.Username)); err != nil {
+		logging.GetLogger().Criticalf("Failed to list the connections: %s", err.Error())
+	}
+}
+
+func (c *ConnectionsApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"ConnectionsIndex",
+			"GET",
+			"/api/connections",
+			c.connectionsIndex,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterConnectionsApi(s string, ws *shttp.WSServer, r *shttp.Server) {
+	c := &ConnectionsApi{
+		Service:    s,
+		WSServer:   ws,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	c.registerEndpoints(r)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// CytoscapeElement is a node or an edge in the Cytoscape.js format, the
+// metadata being part of the data along with the id, and the source and
+// target of the edges.
+type CytoscapeElement struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+type CytoscapeElements struct {
+	Nodes []CytoscapeElement `json:"nodes"`
+	Edges []CytoscapeElement `json:"edges"`
+}
+
+// CytoscapeTopology is the topology as expected by Cytoscape.js
+type CytoscapeTopology struct {
+	Elements CytoscapeElements `json:"elements"`
+}
+
+func cytoscapeData(element map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{})
+	if metadata, ok := element["Metadata"].(map[string]interface{}); ok {
+		for k, v := range metadata {
+			data[k] = v
+		}
+	}
+	data["id"] = element["ID"]
+	data["host"] = element["Host"]
+
+	return data
+}
+
+// collect walks the JSON serialization of a graph, of nodes, edges or of
+// lists of them, ie. paths, gathering the nodes and the edges.
+func (c *CytoscapeTopology) collect(v interface{}, seen map[interface{}]bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, i := range v {
+			c.collect(i, seen)
+		}
+	case map[string]interface{}:
+		_, hasNodes := v["Nodes"]
+		_, hasEdges := v["Edges"]
+		_, hasParent := v["Parent"]
+
+		switch {
+		case hasNodes || hasEdges:
+			c.collect(v["Nodes"], seen)
+			c.collect(v["Edges"], seen)
+		case hasParent:
+			data := cytoscapeData(v)
+			data["source"] = v["Parent"]
+			data["target"] = v["Child"]
+			c.Elements.Edges = append(c.Elements.Edges, CytoscapeElement{Data: data})
+		case v["ID"] != nil:
+			if !seen[v["ID"]] {
+				seen[v["ID"]] = true
+				c.Elements.Nodes = append(c.Elements.Nodes, CytoscapeElement{Data: cytoscapeData(v)})
+			}
+		}
+	}
+}
+
+// NewCytoscapeTopology converts the JSON serialization of a graph, or of
+// the nodes and edges returned by a Gremlin query to the Cytoscape.js
+// format. The edges whose nodes are not part of the result are dropped as
+// Cytoscape.js refuses them.
+func NewCytoscapeTopology(v interface{}) (*CytoscapeTopology, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var values interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	c := &CytoscapeTopology{
+		Elements: CytoscapeElements{
+			Nodes: []CytoscapeElement{},
+			Edges: []CytoscapeElement{},
+		},
+	}
+
+	seen := make(map[interface{}]bool)
+	c.collect(values, seen)
+
+	edges := []CytoscapeElement{}
+	for _, e := range c.Elements.Edges {
+		if seen[e.Data["source"]] && seen[e.Data["target"]] && !seen[e.Data["id"]] {
+			seen[e.Data["id"]] = true
+			edges = append(edges, e)
+		}
+	}
+	c.Elements.Edges = edges
+
+	return c, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abbot/go-http-auth"
+)
+
+// cytoscapeElements returns the data of the nodes and of the edges by id
+func cytoscapeElements(v interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}) {
+	elements := v.(map[string]interface{})["elements"].(map[string]interface{})
+
+	byID := func(list interface{}) map[string]map[string]interface{} {
+		m := make(map[string]map[string]interface{})
+		for _, e := range list.([]interface{}) {
+			data := e.(map[string]interface{})["data"].(map[string]interface{})
+			m[data["id"].(string)] = data
+		}
+		return m
+	}
+
+	return byID(elements["nodes"]), byID(elements["edges"])
+}
+
+func TestCytoscapeTopology(t *testing.T) {
+	ta := &TopologyApi{Graph: newTestGraph(t)}
+
+	nodes, edges := cytoscapeElements(restValues(t, ta, "", "format=cytoscape"))
+	if len(nodes) != 3 || len(edges) != 2 {
+		t.Fatalf("Expected 3 nodes and 2 edges, got: %v %v", nodes, edges)
+	}
+	if n := nodes["n1"]; n["Name"] != "eth0" || n["MTU"] != 1500.0 {
+		t.Errorf("Wrong node data: %v", n)
+	}
+	for _, e := range edges {
+		if e["source"] != "n2" || (e["target"] != "n1" && e["target"] != "n3") {
+			t.Errorf("Wrong edge data: %v", e)
+		}
+	}
+
+	// the edges of the nodes not returned by the query are dropped
+	nodes, edges = cytoscapeElements(restValues(t, ta, `G.V().Has("Type", "device")`, "format=cytoscape"))
+	if len(nodes) != 2 || len(edges) != 0 {
+		t.Errorf("Expected 2 nodes and no edge, got: %v %v", nodes, edges)
+	}
+
+	nodes, edges = cytoscapeElements(restValues(t, ta, `G.V().Has("Name", "eth0").ShortestPathTo(Metadata("Name", "lo"))`, "format=cytoscape"))
+	if len(nodes) != 3 || len(edges) != 0 {
+		t.Errorf("Expected the 3 nodes of the paths, got: %v %v", nodes, edges)
+	}
+}
+
+func TestTopologyFormat(t *testing.T) {
+	ta := &TopologyApi{Graph: newTestGraph(t)}
+
+	// no body
+	r, _ := http.NewRequest("GET", "/api/topology?format=cytoscape", http.NoBody)
+	w := httptest.NewRecorder()
+	ta.topologyIndex(w, &auth.AuthenticatedRequest{Request: *r})
+	if w.Code != http.StatusOK {
+		t.Errorf("Request without body failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/api/topology?format=dot", http.NoBody)
+	w = httptest.NewRecorder()
+	ta.topologyIndex(w, &auth.AuthenticatedRequest{Request: *r})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unknown format should be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// DrainApi allows to drain an agent before restarting it, ie. for an
+// upgrade, with POST /api/agent/drain
+type DrainApi struct {
+	Service string
+	Drain   func()
+}
+
+func (d *DrainApi) drain(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	logging.GetLogger().Infof("%s drained by %s from %s", d.Service, r.Username, r.RemoteAddr)
+
+	d.Drain()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *DrainApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"AgentDrain",
+			"POST",
+			"/api/agent/drain",
+			d.drain,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterDrainApi(s string, drain func(), r *shttp.Server) {
+	d := &DrainApi{
+		Service: s,
+		Drain:   drain,
+	}
+
+	d.registerEndpoints(r)
+}
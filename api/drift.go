@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// DriftReporter gives the last drift report of each host
+type DriftReporter interface {
+	DriftReports() map[string]interface{}
+}
+
+type DriftApi struct {
+	Service    string
+	Graph      *graph.Graph
+	Reporter   DriftReporter
+	Authorizer graph.Authorizer
+}
+
+// reports returns the reports of the hosts the user may read
+func (d *DriftApi) reports(user string) map[string]interface{} {
+	return authorizedReports(d.Authorizer, user, d.Graph, d.Reporter.DriftReports())
+}
+
+func (d *DriftApi) driftIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(d.reports(r.Username)); err != nil {
+		logging.GetLogger().Criticalf("Failed to display drift reports: %s", err.Error())
+	}
+}
+
+func (d *DriftApi) driftShow(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	host := r.URL.Path[len("/api/drift/"):]
+	if host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	report, ok := d.reports(r.Username)[host]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logging.GetLogger().Criticalf("Failed to display drift report of %s: %s", host, err.Error())
+	}
+}
+
+func (d *DriftApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"DriftIndex",
+			"GET",
+			"/api/drift",
+			d.driftIndex,
+		},
+		{
+			"DriftShow",
+			"GET",
+			shttp.PathPrefix("/api/drift/"),
+			d.driftShow,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterDriftApi(s string, g *graph.Graph, reporter DriftReporter, r *shttp.Server) {
+	d := &DriftApi{
+		Service:    s,
+		Graph:      g,
+		Reporter:   reporter,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	d.registerEndpoints(r)
+}
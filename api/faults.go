@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/faults"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// FaultRequest arms a fault, Delay being a duration, ie. "200ms"
+type FaultRequest struct {
+	Point string
+	Count int64
+	Delay string
+}
+
+type FaultsApi struct {
+	Service string
+}
+
+func (f *FaultsApi) faultsIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(faults.Faults()); err != nil {
+		logging.GetLogger().Criticalf("Failed to display faults: %s", err.Error())
+	}
+}
+
+// faultArm arms a fault, ie. POST /api/debug/faults
+// {"Point": "ws.server.drop", "Count": 10}
+func (f *FaultsApi) faultArm(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	var req FaultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	fault := faults.Fault{Point: req.Point, Count: req.Count}
+	if req.Delay != "" {
+		d, err := time.ParseDuration(req.Delay)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		fault.Delay = d
+	}
+
+	if err := faults.Arm(fault); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *FaultsApi) faultDisarm(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	faults.Disarm(r.URL.Path[len("/api/debug/faults/"):])
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *FaultsApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"FaultsIndex",
+			"GET",
+			"/api/debug/faults",
+			f.faultsIndex,
+		},
+		{
+			"FaultArm",
+			"POST",
+			"/api/debug/faults",
+			f.faultArm,
+		},
+		{
+			"FaultDisarm",
+			"DELETE",
+			shttp.PathPrefix("/api/debug/faults/"),
+			f.faultDisarm,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+// RegisterFaultsApi registers the endpoints controlling the faults, only
+// if their injection is compiled in
+func RegisterFaultsApi(s string, r *shttp.Server) {
+	if !faults.Enabled {
+		return
+	}
+
+	f := &FaultsApi{
+		Service: s,
+	}
+
+	f.registerEndpoints(r)
+}
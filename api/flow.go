@@ -26,6 +26,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 
 	"github.com/abbot/go-http-auth"
@@ -43,10 +44,83 @@ type FlowApi struct {
 	Storage   storage.Storage
 }
 
+// flowSortKey only allows sorting on the fields indexed by the storages
+func flowSortKey(item interface{}, key string) (interface{}, error) {
+	f := item.(*flow.Flow)
+
+	switch key {
+	case "UUID":
+		return f.UUID, nil
+	case "LayersPath":
+		return f.LayersPath, nil
+	case "TrackingID":
+		return f.TrackingID, nil
+	case "ProbeGraphPath":
+		return f.ProbeGraphPath, nil
+	case "ProbeNodeID":
+		return f.ProbeNodeID, nil
+	case "SrcOwnerID":
+		return f.SrcOwnerID, nil
+	case "DstOwnerID":
+		return f.DstOwnerID, nil
+	case "Client":
+		return f.Client, nil
+	case "Start", "Last":
+		stats := f.GetStatistics()
+		if stats == nil {
+			return nil, nil
+		}
+		if key == "Start" {
+			return stats.Start, nil
+		}
+		return stats.Last, nil
+	}
+
+	return nil, fmt.Errorf("Flows can't be sorted by %s", key)
+}
+
+// paginateFlows returns the requested page of flows, with only the selected
+// fields if any, along with the total number of flows.
+func paginateFlows(flows []*flow.Flow, opts *ListOptions) ([]interface{}, int, error) {
+	items := make([]interface{}, len(flows))
+	for i, fl := range flows {
+		items[i] = fl
+	}
+
+	items, total, err := opts.Apply(items, flowSortKey)
+	if err != nil || len(opts.Fields) == 0 {
+		return items, total, err
+	}
+
+	for i, item := range items {
+		items[i] = selectFlowFields(item.(*flow.Flow), opts.Fields)
+	}
+
+	return items, total, nil
+}
+
+// selectFlowFields returns a copy of a flow with only the given fields, the
+// UUID identifying the flow being always kept as the ID of the nodes and
+// edges is with their selected metadata keys.
+func selectFlowFields(f *flow.Flow, fields []string) *flow.Flow {
+	selected := &flow.Flow{UUID: f.UUID}
+
+	src, dst := reflect.ValueOf(f).Elem(), reflect.ValueOf(selected).Elem()
+	for _, field := range fields {
+		if v := src.FieldByName(field); v.IsValid() && dst.FieldByName(field).CanSet() {
+			dst.FieldByName(field).Set(v)
+		}
+	}
+
+	return selected
+}
+
 func (f *FlowApi) flowSearch(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	filters := make(storage.Filters)
 	for k, v := range r.URL.Query() {
-		filters[k] = v[0]
+		if !isListParam(k) {
+			filters[k] = v[0]
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -55,15 +129,30 @@ func (f *FlowApi) flowSearch(w http.ResponseWriter, r *auth.AuthenticatedRequest
 		return
 	}
 
+	opts, err := ParseListOptions(&r.Request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	flows, err := f.Storage.SearchFlows(filters)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	items, total, err := paginateFlows(flows, opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	opts.setHeaders(w, total)
 	w.WriteHeader(http.StatusOK)
 
-	if err := json.NewEncoder(w).Encode(flows); err != nil {
+	if err := json.NewEncoder(w).Encode(items); err != nil {
 		panic(err)
 	}
 }
@@ -74,7 +163,21 @@ func (f *FlowApi) serveDataIndex(w http.ResponseWriter, r *auth.AuthenticatedReq
 	w.Write([]byte(message))
 }
 
-func (f *FlowApi) jsonFlowConversationEthernetPath(EndpointType flow.FlowEndpointType) string {
+// aggregatedFlows returns the flows of the table, with only one flow per
+// connection captured at several points if dedup is set.
+func (f *FlowApi) aggregatedFlows(dedup bool) []*flow.Flow {
+	flows := f.FlowTable.GetFlows()
+	if dedup {
+		flows = flow.DedupFlows(flows)
+	}
+	return flows
+}
+
+func isDedup(r *auth.AuthenticatedRequest) bool {
+	return r.URL.Query().Get("dedup") == "true"
+}
+
+func (f *FlowApi) jsonFlowConversationEthernetPath(EndpointType flow.FlowEndpointType, dedup bool) string {
 	//	{"nodes":[{"name":"Myriel","group":1}, ... ],"links":[{"source":1,"target":0,"value":1},...]}
 
 	nodes := []string{}
@@ -83,7 +186,7 @@ func (f *FlowApi) jsonFlowConversationEthernetPath(EndpointType flow.FlowEndpoin
 	pathMap := make(map[string]int)
 	layerMap := make(map[string]int)
 
-	for _, f := range f.FlowTable.GetFlows() {
+	for _, f := range f.aggregatedFlows(dedup) {
 		layerFlow := f.GetStatistics().GetEndpointsType(EndpointType)
 		if layerFlow == nil {
 			continue
@@ -129,7 +232,7 @@ func (f *FlowApi) conversationLayer(w http.ResponseWriter, r *auth.Authenticated
 	case "sctp":
 		ltype = flow.FlowEndpointType_SCTPPORT
 	}
-	f.serveDataIndex(w, r, f.jsonFlowConversationEthernetPath(ltype))
+	f.serveDataIndex(w, r, f.jsonFlowConversationEthernetPath(ltype, isDedup(r)))
 }
 
 type discoType int
@@ -175,14 +278,14 @@ func newDiscoNode() *discoNode {
 	}
 }
 
-func (f *FlowApi) jsonFlowDiscovery(DiscoType discoType) string {
+func (f *FlowApi) jsonFlowDiscovery(DiscoType discoType, dedup bool) string {
 	// {"name":"root","children":[{"name":"Ethernet","children":[{"name":"IPv4","children":
 	//		[{"name":"UDP","children":[{"name":"Payload","size":360,"children":[]}]},
 	//     {"name":"TCP","children":[{"name":"Payload","size":240,"children":[]}]}]}]}]}
 
 	pathMap := make(map[string]flow.FlowEndpointStatistics)
 
-	for _, f := range f.FlowTable.GetFlows() {
+	for _, f := range f.aggregatedFlows(dedup) {
 		eth := f.GetStatistics().GetEndpointsType(flow.FlowEndpointType_ETHERNET)
 		if eth == nil {
 			continue
@@ -237,8 +340,62 @@ func (f *FlowApi) discoveryType(w http.ResponseWriter, r *auth.AuthenticatedRequ
 	case "packets":
 		dtype = packets
 	}
-	f.serveDataIndex(w, r, f.jsonFlowDiscovery(dtype))
+	f.serveDataIndex(w, r, f.jsonFlowDiscovery(dtype, isDedup(r)))
 }
+// serviceSortKey sorts the services by their statistics
+func serviceSortKey(item interface{}, key string) (interface{}, error) {
+	s := item.(*flow.ServiceStatistics)
+
+	switch key {
+	case "Service":
+		return s.Service, nil
+	case "Flows":
+		return s.Flows, nil
+	case "Clients":
+		return s.Clients, nil
+	case "Packets":
+		return s.Packets, nil
+	case "Bytes":
+		return s.Bytes, nil
+	}
+
+	return nil, fmt.Errorf("Services can't be sorted by %s", key)
+}
+
+// services returns the top destination services, the flows of the table
+// grouped by server endpoint, the flows whose client is unknown being left
+// out
+func (f *FlowApi) services(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	opts, err := ParseListOptions(&r.Request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	services := flow.TopServices(f.aggregatedFlows(isDedup(r)))
+	items := make([]interface{}, len(services))
+	for i, s := range services {
+		items[i] = s
+	}
+
+	items, total, err := opts.Apply(items, serviceSortKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	opts.setHeaders(w, total)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		panic(err)
+	}
+}
+
 func (f *FlowApi) registerEndpoints(r *shttp.Server) {
 	routes := []shttp.Route{
 		{
@@ -259,6 +416,12 @@ func (f *FlowApi) registerEndpoints(r *shttp.Server) {
 			"/api/flow/discovery/{type}",
 			f.discoveryType,
 		},
+		{
+			"Services",
+			"GET",
+			"/api/flow/services",
+			f.services,
+		},
 	}
 
 	r.RegisterRoutes(routes)
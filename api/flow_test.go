@@ -37,7 +37,7 @@ func TestFlowTable_jsonFlowConversationEthernetPath(t *testing.T) {
 		FlowTable: ft,
 	}
 
-	statStr := fa.jsonFlowConversationEthernetPath(flow.FlowEndpointType_ETHERNET)
+	statStr := fa.jsonFlowConversationEthernetPath(flow.FlowEndpointType_ETHERNET, false)
 	if statStr == `{"nodes":[],"links":[]}` {
 		t.Error("stat should not be empty")
 	}
@@ -69,7 +69,7 @@ func test_jsonFlowDiscovery(t *testing.T, DiscoType discoType) {
 	fa := &FlowApi{
 		FlowTable: ft,
 	}
-	disco := fa.jsonFlowDiscovery(DiscoType)
+	disco := fa.jsonFlowDiscovery(DiscoType, false)
 
 	if disco == `{"name":"root","children":[]}` {
 		t.Error("disco should not be empty")
@@ -0,0 +1,549 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/redhat-cip/skydive/api/rpc"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/storage"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// TokenMetadataKey is the gRPC metadata key holding the token returned by
+// the login page, the same token as the one of the authtok cookie.
+const TokenMetadataKey = "authtok"
+
+// GRPCServer exposes the topology and the flows over gRPC, with the same
+// semantics as the REST API.
+type GRPCServer struct {
+	Addr           string
+	Port           int
+	Auth           shttp.AuthenticationBackend
+	topology       *TopologyApi
+	storage        storage.Storage
+	watchQueueSize int
+	server         *grpc.Server
+}
+
+// graphWatcher forwards the graph events to a WatchTopology stream. Events
+// are sent by the graph with the lock held so they are queued, a watcher
+// too slow to keep up is closed. The elements matching the filters, and
+// readable by the user, are tracked so that the ones starting or stopping
+// to match are sent as added or deleted.
+type graphWatcher struct {
+	filter     *graph.MetadataFilter
+	filters    graph.Metadata
+	authorizer graph.Authorizer
+	user       string
+	graph      *graph.Graph
+	matched    map[graph.Identifier]bool
+	events     chan *rpc.GraphEvent
+	overflow   chan struct{}
+	closed     bool
+}
+
+// element is the JSON representation of the nodes and edges, used to build
+// the gRPC messages so that they carry exactly what the REST API returns.
+type element struct {
+	ID       string
+	Host     string
+	Parent   string
+	Child    string
+	Metadata json.RawMessage
+}
+
+func toElement(v interface{}) (*element, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var e element
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func toRPCNode(n *graph.Node) (*rpc.Node, error) {
+	e, err := toElement(n)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &rpc.Node{ID: e.ID, Host: e.Host}
+	if len(e.Metadata) > 0 {
+		if node.Metadata, err = rpc.NewMetadata(e.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+func toRPCEdge(ed *graph.Edge) (*rpc.Edge, error) {
+	e, err := toElement(ed)
+	if err != nil {
+		return nil, err
+	}
+
+	edge := &rpc.Edge{ID: e.ID, Host: e.Host, Parent: e.Parent, Child: e.Child}
+	if len(e.Metadata) > 0 {
+		if edge.Metadata, err = rpc.NewMetadata(e.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return edge, nil
+}
+
+func toRPCValue(v interface{}) (value *rpc.Value, err error) {
+	value = &rpc.Value{}
+
+	switch v.(type) {
+	case *graph.Node:
+		value.Node, err = toRPCNode(v.(*graph.Node))
+	case *graph.Edge:
+		value.Edge, err = toRPCEdge(v.(*graph.Edge))
+	default:
+		value.JSON, err = json.Marshal(v)
+	}
+
+	return
+}
+
+// listOptions converts the gRPC list options to the REST ones, going
+// through the query parameters so that the defaults and checks are the same.
+func listOptions(o *rpc.ListOptions) (*ListOptions, error) {
+	query := url.Values{}
+	if o != nil {
+		if o.Limit != 0 {
+			query.Set("limit", strconv.Itoa(int(o.Limit)))
+		}
+		if o.Offset != 0 {
+			query.Set("offset", strconv.Itoa(int(o.Offset)))
+		}
+		if o.Sort != "" {
+			query.Set("sort", o.Sort)
+		}
+		if len(o.Fields) > 0 {
+			query.Set("fields", strings.Join(o.Fields, ","))
+		}
+	}
+
+	return parseListQuery(query)
+}
+
+// watchFilters converts the filters of a watch request to the metadata the
+// elements have to match.
+func watchFilters(filters map[string]*rpc.MetadataValue) (graph.Metadata, error) {
+	m := graph.Metadata{}
+	for k, v := range filters {
+		if v != nil && (v.Kind == rpc.MetadataValue_LIST || v.Kind == rpc.MetadataValue_MAP) {
+			return nil, fmt.Errorf("Invalid filter %s: lists and maps are not supported", k)
+		}
+		m[k] = v.Interface()
+	}
+	return m, nil
+}
+
+// match returns whether the node or the edge is watched, called from the
+// graph listeners, the graph being locked.
+func (w *graphWatcher) match(n *graph.Node, e *graph.Edge) bool {
+	if n != nil {
+		return (!graph.Restricted(w.authorizer, w.user) || w.authorizer.CanReadNode(w.user, n)) && n.MatchMetadata(w.filters)
+	}
+	return graph.CanReadEdge(w.authorizer, w.user, w.graph, e) && e.MatchMetadata(w.filters)
+}
+
+// event returns the event to send for an operation, Added, Updated or
+// Deleted, on a node or an edge, nil if the client hasn't to know about it.
+func (w *graphWatcher) event(op string, n *graph.Node, e *graph.Edge) (*rpc.GraphEvent, error) {
+	var id graph.Identifier
+	var kind string
+	if n != nil {
+		id, kind = n.ID, "Node"
+	} else {
+		id, kind = e.ID, "Edge"
+	}
+
+	matched := w.matched[id]
+	if op == "Deleted" {
+		if !matched {
+			return nil, nil
+		}
+		delete(w.matched, id)
+	} else if w.match(n, e) {
+		if !matched {
+			w.matched[id] = true
+			op = "Added"
+		}
+	} else {
+		if !matched {
+			return nil, nil
+		}
+		delete(w.matched, id)
+		op = "Deleted"
+	}
+
+	ev := &rpc.GraphEvent{Type: kind + op}
+
+	var err error
+	if n != nil {
+		ev.Node, err = toRPCNode(w.filter.FilterNode(n))
+	} else {
+		ev.Edge, err = toRPCEdge(w.filter.FilterEdge(e))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+func (w *graphWatcher) send(op string, n *graph.Node, e *graph.Edge) {
+	if w.closed {
+		return
+	}
+
+	ev, err := w.event(op, n, e)
+	if err != nil {
+		logging.GetLogger().Errorf("gRPC: unable to convert a graph event: %s", err.Error())
+		return
+	}
+	if ev == nil {
+		return
+	}
+
+	select {
+	case w.events <- ev:
+	default:
+		w.closed = true
+		close(w.overflow)
+	}
+}
+
+// sync records the elements currently matching, returning them as added
+// events if the client asked for them.
+func (w *graphWatcher) sync(events bool) ([]*rpc.GraphEvent, error) {
+	var added []*rpc.GraphEvent
+
+	for _, n := range w.graph.GetNodes() {
+		ev, err := w.event("Added", n, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil && events {
+			added = append(added, ev)
+		}
+	}
+	for _, e := range w.graph.GetEdges() {
+		ev, err := w.event("Added", nil, e)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil && events {
+			added = append(added, ev)
+		}
+	}
+
+	return added, nil
+}
+
+func (w *graphWatcher) OnNodeUpdated(n *graph.Node) {
+	w.send("Updated", n, nil)
+}
+
+func (w *graphWatcher) OnNodeAdded(n *graph.Node) {
+	w.send("Added", n, nil)
+}
+
+func (w *graphWatcher) OnNodeDeleted(n *graph.Node) {
+	w.send("Deleted", n, nil)
+}
+
+func (w *graphWatcher) OnEdgeUpdated(e *graph.Edge) {
+	w.send("Updated", nil, e)
+}
+
+func (w *graphWatcher) OnEdgeAdded(e *graph.Edge) {
+	w.send("Added", nil, e)
+}
+
+func (w *graphWatcher) OnEdgeDeleted(e *graph.Edge) {
+	w.send("Deleted", nil, e)
+}
+
+// authenticate returns the user of the token given in the call metadata
+func (s *GRPCServer) authenticate(ctx context.Context) (string, error) {
+	var token string
+	if md, ok := metadata.FromContext(ctx); ok {
+		if values := md[TokenMetadataKey]; len(values) > 0 {
+			token = values[0]
+		}
+	}
+
+	user, err := shttp.CheckToken(s.Auth, token)
+	if err != nil {
+		return "", grpc.Errorf(codes.Unauthenticated, "%s", err.Error())
+	}
+
+	return user, nil
+}
+
+func (s *GRPCServer) GetTopology(ctx context.Context, req *rpc.TopologyRequest) (*rpc.TopologyReply, error) {
+	user, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := listOptions(req.GetOptions())
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+
+	g := s.topology.Graph
+	g.RLock()
+	defer g.RUnlock()
+
+	reply := &rpc.TopologyReply{}
+
+	if req.GremlinQuery == "" {
+		authorizer := s.topology.Authorizer
+
+		var items []interface{}
+		for _, n := range g.GetNodes() {
+			if !graph.Restricted(authorizer, user) || authorizer.CanReadNode(user, n) {
+				items = append(items, n)
+			}
+		}
+		for _, e := range g.GetEdges() {
+			if graph.CanReadEdge(authorizer, user, g, e) {
+				items = append(items, e)
+			}
+		}
+
+		items, total, err := opts.Apply(items, graphSortKey)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+		}
+		reply.Total = int64(total)
+
+		filter := s.topology.Filter.Select(opts.Fields)
+		for _, item := range items {
+			switch item := item.(type) {
+			case *graph.Node:
+				node, err := toRPCNode(filter.FilterNode(item))
+				if err != nil {
+					return nil, grpc.Errorf(codes.Internal, "%s", err.Error())
+				}
+				reply.Nodes = append(reply.Nodes, node)
+			case *graph.Edge:
+				edge, err := toRPCEdge(filter.FilterEdge(item))
+				if err != nil {
+					return nil, grpc.Errorf(codes.Internal, "%s", err.Error())
+				}
+				reply.Edges = append(reply.Edges, edge)
+			}
+		}
+		return reply, nil
+	}
+
+	values, total, err := s.topology.query(req.GremlinQuery, opts, user)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+
+	for _, v := range values {
+		value, err := toRPCValue(v)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "%s", err.Error())
+		}
+		reply.Values = append(reply.Values, value)
+	}
+	reply.Total = int64(total)
+
+	return reply, nil
+}
+
+// WatchTopology streams the graph events. With Sync the current nodes and
+// edges are sent first as added events, the snapshot being taken with the
+// graph locked while the watcher is registered so that the following events
+// are exactly the ones happening after.
+func (s *GRPCServer) WatchTopology(req *rpc.WatchRequest, stream rpc.Topology_WatchTopologyServer) error {
+	user, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	filters, err := watchFilters(req.GetFilters())
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+
+	g := s.topology.Graph
+	w := &graphWatcher{
+		filter:     s.topology.Filter,
+		filters:    filters,
+		authorizer: s.topology.Authorizer,
+		user:       user,
+		graph:      g,
+		matched:    make(map[graph.Identifier]bool),
+		events:     make(chan *rpc.GraphEvent, s.watchQueueSize),
+		overflow:   make(chan struct{}),
+	}
+
+	var events []*rpc.GraphEvent
+	g.AddEventListenerSync(w, func() {
+		events, err = w.sync(req.Sync)
+	})
+	defer g.RemoveEventListener(w)
+
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "%s", err.Error())
+	}
+
+	for _, ev := range events {
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev := <-w.events:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-w.overflow:
+			return grpc.Errorf(codes.ResourceExhausted, "Too many pending graph events")
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *GRPCServer) QueryFlows(ctx context.Context, req *rpc.FlowRequest) (*rpc.FlowReply, error) {
+	if _, err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	if s.storage == nil {
+		return nil, grpc.Errorf(codes.NotFound, "No storage configured")
+	}
+
+	opts, err := listOptions(req.GetOptions())
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+	filters := make(storage.Filters)
+	for k, v := range req.GetFilters() {
+		filters[k] = v
+	}
+
+	flows, err := s.storage.SearchFlows(filters)
+	if err != nil {
+		return nil, grpc.Errorf(codes.NotFound, "%s", err.Error())
+	}
+
+	items, total, err := paginateFlows(flows, opts)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+
+	reply := &rpc.FlowReply{Total: int64(total)}
+	for _, item := range items {
+		reply.Flows = append(reply.Flows, item.(*flow.Flow))
+	}
+
+	return reply, nil
+}
+
+func (s *GRPCServer) ListenAndServe() {
+	listener, err := net.Listen("tcp", s.Addr+":"+strconv.Itoa(s.Port))
+	if err != nil {
+		logging.GetLogger().Errorf("gRPC: unable to listen on %s:%d: %s", s.Addr, s.Port, err.Error())
+		return
+	}
+
+	if err := s.server.Serve(listener); err != nil {
+		logging.GetLogger().Debugf("gRPC: server stopped: %s", err.Error())
+	}
+}
+
+func (s *GRPCServer) Stop() {
+	s.server.Stop()
+}
+
+func NewGRPCServer(service string, addr string, port int, g *graph.Graph, st storage.Storage, auth shttp.AuthenticationBackend) *GRPCServer {
+	s := &GRPCServer{
+		Addr: addr,
+		Port: port,
+		Auth: auth,
+		topology: &TopologyApi{
+			Service:    service,
+			Graph:      g,
+			Filter:     graph.NewMetadataFilterFromConfig(service, "api"),
+			Authorizer: graph.NewAuthorizerFromConfig(),
+		},
+		storage:        st,
+		watchQueueSize: config.GetConfig().GetInt(service + ".grpc.watch_queue_size"),
+		server:         grpc.NewServer(),
+	}
+
+	rpc.RegisterTopologyServer(s.server, s)
+	rpc.RegisterFlowsServer(s.server, s)
+
+	return s
+}
+
+// NewGRPCServerFromConfig returns nil if no gRPC listen address is set for
+// the service.
+func NewGRPCServerFromConfig(service string, g *graph.Graph, st storage.Storage, auth shttp.AuthenticationBackend) (*GRPCServer, error) {
+	if config.GetConfig().GetString(service+".grpc.listen") == "" {
+		return nil, nil
+	}
+
+	addr, port, err := config.GetHostPortAttributes(service, "grpc.listen")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGRPCServer(service, addr, port, g, st, auth), nil
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/abbot/go-http-auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/redhat-cip/skydive/api/rpc"
+	"github.com/redhat-cip/skydive/flow"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/storage"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type fakeStorage struct {
+	flows []*flow.Flow
+}
+
+func (s *fakeStorage) Start() {}
+func (s *fakeStorage) Stop()  {}
+
+func (s *fakeStorage) StoreFlows(flows []*flow.Flow) error {
+	return nil
+}
+
+func (s *fakeStorage) SearchFlows(filters storage.Filters) ([]*flow.Flow, error) {
+	return s.flows, nil
+}
+
+func newTestGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	n1 := g.NewNode(graph.Identifier("n1"), graph.Metadata{"Name": "eth0", "Type": "device", "MTU": 1500})
+	n2 := g.NewNode(graph.Identifier("n2"), graph.Metadata{"Name": "br0", "Type": "bridge", "MTU": 9000})
+	n3 := g.NewNode(graph.Identifier("n3"), graph.Metadata{"Name": "lo", "Type": "device", "MTU": 65536})
+	g.Link(n2, n1, graph.Metadata{"RelationType": "layer2"})
+	g.Link(n2, n3)
+
+	return g
+}
+
+// newTestGRPCServer starts a gRPC server on a random port and returns a
+// connection to it.
+func newTestGRPCServer(t *testing.T, g *graph.Graph, st storage.Storage, backend shttp.AuthenticationBackend) (*GRPCServer, *grpc.ClientConn) {
+	s := NewGRPCServer("analyzer", "127.0.0.1", 0, g, st, backend)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go s.server.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return s, conn
+}
+
+func decodeJSON(t *testing.T, data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: %s", err.Error(), string(data))
+	}
+	return v
+}
+
+// restValues returns the decoded body of a REST topology query
+func restValues(t *testing.T, ta *TopologyApi, query string, params string) interface{} {
+	body, _ := json.Marshal(Topology{GremlinQuery: query})
+	r, _ := http.NewRequest("GET", "/api/topology?"+params, strings.NewReader(string(body)))
+
+	w := httptest.NewRecorder()
+	ta.topologyIndex(w, &auth.AuthenticatedRequest{Request: *r})
+	if w.Code != http.StatusOK {
+		t.Fatalf("REST query failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	return decodeJSON(t, w.Body.Bytes())
+}
+
+// rpcValues rebuilds the REST representation of the gRPC values
+func rpcValues(t *testing.T, values []*rpc.Value) interface{} {
+	result := []interface{}{}
+	for _, v := range values {
+		var data []byte
+		switch {
+		case v.Node != nil:
+			data, _ = json.Marshal(&struct {
+				ID       string
+				Metadata map[string]interface{} `json:",omitempty"`
+				Host     string
+			}{v.Node.ID, rpc.MetadataMap(v.Node.Metadata), v.Node.Host})
+		case v.Edge != nil:
+			data, _ = json.Marshal(&struct {
+				ID       string
+				Metadata map[string]interface{} `json:",omitempty"`
+				Parent   string
+				Child    string
+				Host     string
+			}{v.Edge.ID, rpc.MetadataMap(v.Edge.Metadata), v.Edge.Parent, v.Edge.Child, v.Edge.Host})
+		default:
+			data = v.JSON
+		}
+		result = append(result, decodeJSON(t, data))
+	}
+	return result
+}
+
+func TestGRPCTopologyConformance(t *testing.T) {
+	g := newTestGraph(t)
+	ta := &TopologyApi{Graph: g}
+
+	_, conn := newTestGRPCServer(t, g, nil, shttp.NewNoAuthenticationBackend())
+	defer conn.Close()
+	client := rpc.NewTopologyClient(conn)
+
+	tests := []struct {
+		query   string
+		params  string
+		options *rpc.ListOptions
+	}{
+		// node order is random without sort
+		{query: `G.V().Has("Type", "device")`, params: "sort=Name", options: &rpc.ListOptions{Sort: "Name"}},
+		{query: `G.V()`, params: "sort=-MTU&limit=2&offset=1", options: &rpc.ListOptions{Sort: "-MTU", Limit: 2, Offset: 1}},
+		{query: `G.V().Has("Name", "br0").OutE()`, params: "sort=ID", options: &rpc.ListOptions{Sort: "ID"}},
+		{query: `G.V()`, params: "sort=Name&fields=Name", options: &rpc.ListOptions{Sort: "Name", Fields: []string{"Name"}}},
+		{query: `G.V().Has("Name", "eth0").ShortestPathTo(Metadata("Name", "lo"))`},
+	}
+
+	for _, test := range tests {
+		reply, err := client.GetTopology(context.Background(), &rpc.TopologyRequest{GremlinQuery: test.query, Options: test.options})
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err.Error())
+		}
+
+		expected := restValues(t, ta, test.query, test.params)
+		if got := rpcValues(t, reply.Values); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s %s: gRPC and REST results differ:\n%v\n%v", test.query, test.params, expected, got)
+		}
+	}
+
+	reply, err := client.GetTopology(context.Background(), &rpc.TopologyRequest{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.Nodes) != 3 || len(reply.Edges) != 2 || reply.Total != 5 {
+		t.Errorf("Whole graph expected: %v", reply)
+	}
+
+	mtu := reply.Nodes[0].Metadata["MTU"]
+	if mtu == nil || mtu.Kind != rpc.MetadataValue_INTEGER {
+		t.Errorf("MTU should be an integer: %v", reply.Nodes[0])
+	}
+
+	reply, err = client.GetTopology(context.Background(), &rpc.TopologyRequest{Options: &rpc.ListOptions{Sort: "-Name", Limit: 2}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.Nodes) != 2 || len(reply.Edges) != 0 || reply.Total != 5 {
+		t.Fatalf("Whole graph should be paginated: %v", reply)
+	}
+	if reply.Nodes[0].ID != "n3" || reply.Nodes[1].ID != "n1" {
+		t.Errorf("Whole graph should be sorted: %v", reply)
+	}
+
+	if _, err = client.GetTopology(context.Background(), &rpc.TopologyRequest{GremlinQuery: "G.Foo("}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Invalid query should be refused: %v", err)
+	}
+}
+
+func TestGRPCWatchTopology(t *testing.T) {
+	g := newTestGraph(t)
+
+	_, conn := newTestGRPCServer(t, g, nil, shttp.NewNoAuthenticationBackend())
+	defer conn.Close()
+
+	stream, err := rpc.NewTopologyClient(conn).WatchTopology(context.Background(), &rpc.WatchRequest{Sync: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if (i < 3 && ev.Type != "NodeAdded") || (i >= 3 && ev.Type != "EdgeAdded") {
+			t.Errorf("Wrong sync event: %v", ev)
+		}
+	}
+
+	g.Lock()
+	g.NewNode(graph.Identifier("n4"), graph.Metadata{"Name": "eth1"})
+	g.Unlock()
+
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ev.Type != "NodeAdded" || ev.Node.ID != "n4" {
+		t.Errorf("NodeAdded event expected: %v", ev)
+	}
+}
+
+func TestGRPCWatchFilters(t *testing.T) {
+	g := newTestGraph(t)
+
+	_, conn := newTestGRPCServer(t, g, nil, shttp.NewNoAuthenticationBackend())
+	defer conn.Close()
+
+	device, _ := rpc.NewMetadataValue("device")
+	req := &rpc.WatchRequest{Sync: true, Filters: map[string]*rpc.MetadataValue{"Type": device}}
+	stream, err := rpc.NewTopologyClient(conn).WatchTopology(context.Background(), req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	recv := func() string {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if ev.Node == nil {
+			t.Fatalf("Only nodes should match: %v", ev)
+		}
+		return ev.Type + " " + ev.Node.ID
+	}
+
+	synced := map[string]bool{recv(): true, recv(): true}
+	if !synced["NodeAdded n1"] || !synced["NodeAdded n3"] {
+		t.Fatalf("Only the devices should be synced: %v", synced)
+	}
+
+	g.Lock()
+	g.AddMetadata(g.GetNode("n1"), "Type", "bridge")
+	g.AddMetadata(g.GetNode("n2"), "Type", "device")
+	g.AddMetadata(g.GetNode("n3"), "MTU", 1400)
+	g.NewNode(graph.Identifier("n4"), graph.Metadata{"Name": "eth1", "Type": "bridge"})
+	g.DelNode(g.GetNode("n3"))
+	g.Unlock()
+
+	for _, expected := range []string{"NodeDeleted n1", "NodeAdded n2", "NodeUpdated n3", "NodeDeleted n3"} {
+		if got := recv(); got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+	}
+
+	list, _ := rpc.NewMetadataValue([]interface{}{"device"})
+	req = &rpc.WatchRequest{Filters: map[string]*rpc.MetadataValue{"Type": list}}
+	stream, err = rpc.NewTopologyClient(conn).WatchTopology(context.Background(), req)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("List filters should be refused: %v", err)
+	}
+}
+
+// TestGRPCWatchSyncSequence checks that nodes added while a watcher syncs
+// are sent exactly once, either by the sync or as events.
+func TestGRPCWatchSyncSequence(t *testing.T) {
+	g := newTestGraph(t)
+
+	_, conn := newTestGRPCServer(t, g, nil, shttp.NewNoAuthenticationBackend())
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			g.Lock()
+			g.NewNode(graph.GenID(), graph.Metadata{"Type": "device"})
+			g.Unlock()
+		}
+		close(done)
+	}()
+
+	stream, err := rpc.NewTopologyClient(conn).WatchTopology(context.Background(), &rpc.WatchRequest{Sync: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	added := make(map[string]int)
+	recv := func(until func() bool) {
+		for !until() {
+			ev, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if ev.Type == "NodeAdded" {
+				added[ev.Node.ID]++
+			}
+		}
+	}
+
+	// the sync sends the nodes in any order, the last one is only added
+	// once all the others got received
+	<-done
+	recv(func() bool { return len(added) == 53 })
+
+	g.Lock()
+	g.NewNode(graph.Identifier("last"), graph.Metadata{"Type": "device"})
+	g.Unlock()
+
+	recv(func() bool { return added["last"] > 0 })
+
+	for id, count := range added {
+		if count != 1 {
+			t.Errorf("Node %s sent %d times", id, count)
+		}
+	}
+}
+
+func TestGRPCFlowsConformance(t *testing.T) {
+	st := &fakeStorage{flows: []*flow.Flow{
+		{UUID: "flow1", LayersPath: "Ethernet/IPv4/TCP", TrackingID: "b"},
+		{UUID: "flow2", LayersPath: "Ethernet/IPv4/UDP", TrackingID: "a"},
+		{UUID: "flow3", LayersPath: "Ethernet/ARP", TrackingID: "c"},
+	}}
+	fa := &FlowApi{Storage: st}
+
+	_, conn := newTestGRPCServer(t, nil, st, shttp.NewNoAuthenticationBackend())
+	defer conn.Close()
+	client := rpc.NewFlowsClient(conn)
+
+	for _, test := range []struct {
+		params  string
+		options *rpc.ListOptions
+	}{
+		{params: "sort=-TrackingID&limit=2", options: &rpc.ListOptions{Sort: "-TrackingID", Limit: 2}},
+		{params: "sort=UUID&fields=LayersPath", options: &rpc.ListOptions{Sort: "UUID", Fields: []string{"LayersPath"}}},
+	} {
+		r, _ := http.NewRequest("GET", "/api/flow/search?"+test.params, nil)
+		w := httptest.NewRecorder()
+		fa.flowSearch(w, &auth.AuthenticatedRequest{Request: *r})
+		expected := decodeJSON(t, w.Body.Bytes())
+
+		reply, err := client.QueryFlows(context.Background(), &rpc.FlowRequest{Options: test.options})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		data, _ := json.Marshal(reply.Flows)
+		if got := decodeJSON(t, data); !reflect.DeepEqual(expected, got) {
+			t.Errorf("gRPC and REST results differ for %s:\n%v\n%v", test.params, expected, got)
+		}
+
+		if reply.Total != 3 || w.Header().Get("X-Total-Count") != "3" {
+			t.Errorf("Wrong total for %s: %d", test.params, reply.Total)
+		}
+		if hasMore := w.Header().Get("X-Has-More"); hasMore != strconv.FormatBool(test.options.Limit == 2) {
+			t.Errorf("Wrong X-Has-More for %s: %s", test.params, hasMore)
+		}
+	}
+
+	reply, _ := client.QueryFlows(context.Background(), &rpc.FlowRequest{Options: &rpc.ListOptions{Fields: []string{"TrackingID"}}})
+	if len(reply.Flows) != 3 || reply.Flows[0].UUID == "" || reply.Flows[0].TrackingID == "" || reply.Flows[0].LayersPath != "" {
+		t.Errorf("Only the UUID and the selected fields expected: %v", reply.Flows)
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha1.Sum([]byte("password"))
+	f.WriteString("admin:{SHA}" + base64.StdEncoding.EncodeToString(hash[:]) + "\n")
+	f.Close()
+
+	backend, err := shttp.NewBasicAuthenticationBackend(f.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	token, err := backend.Authenticate("admin", "password")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, conn := newTestGRPCServer(t, newTestGraph(t), nil, backend)
+	defer conn.Close()
+	client := rpc.NewTopologyClient(conn)
+
+	if _, err := client.GetTopology(context.Background(), &rpc.TopologyRequest{}); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Call without token should be refused: %v", err)
+	}
+
+	ctx := metadata.NewContext(context.Background(), metadata.Pairs(TokenMetadataKey, "wrong"))
+	if _, err := client.GetTopology(ctx, &rpc.TopologyRequest{}); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Call with a wrong token should be refused: %v", err)
+	}
+
+	ctx = metadata.NewContext(context.Background(), metadata.Pairs(TokenMetadataKey, token))
+	if _, err := client.GetTopology(ctx, &rpc.TopologyRequest{}); err != nil {
+		t.Errorf("Call with a valid token should be accepted: %v", err)
+	}
+}
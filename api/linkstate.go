@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// LinkMismatchReporter gives the layer2 edges whose interfaces disagree on
+// their state, their speed or their duplex
+type LinkMismatchReporter interface {
+	LinkMismatches() []interface{}
+}
+
+type LinkStateApi struct {
+	Service    string
+	Graph      *graph.Graph
+	Reporter   LinkMismatchReporter
+	Authorizer graph.Authorizer
+}
+
+func (l *LinkStateApi) mismatchIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(authorizedList(l.Authorizer, r.Username, l.Graph, l.Reporter.LinkMismatches())); err != nil {
+		logging.GetLogger().Criticalf("Failed to display link mismatches: %s", err.Error())
+	}
+}
+
+func (l *LinkStateApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"LinkMismatchIndex",
+			"GET",
+			"/api/linkmismatch",
+			l.mismatchIndex,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterLinkStateApi(s string, g *graph.Graph, reporter LinkMismatchReporter, r *shttp.Server) {
+	l := &LinkStateApi{
+		Service:    s,
+		Graph:      g,
+		Reporter:   reporter,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	l.registerEndpoints(r)
+}
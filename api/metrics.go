@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+type MetricsApi struct {
+	Service string
+}
+
+func (m *MetricsApi) metricsIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(common.GetMetrics()); err != nil {
+		logging.GetLogger().Criticalf("Failed to display metrics: %s", err.Error())
+	}
+}
+
+func (m *MetricsApi) metricsShow(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	name := r.URL.Path[len("/api/metrics/"):]
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	metric, ok := common.GetMetric(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(metric); err != nil {
+		logging.GetLogger().Criticalf("Failed to display metrics %s: %s", name, err.Error())
+	}
+}
+
+func (m *MetricsApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"MetricsIndex",
+			"GET",
+			"/api/metrics",
+			m.metricsIndex,
+		},
+		{
+			"MetricsShow",
+			"GET",
+			shttp.PathPrefix("/api/metrics/"),
+			m.metricsShow,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterMetricsApi(s string, r *shttp.Server) {
+	m := &MetricsApi{
+		Service: s,
+	}
+
+	m.registerEndpoints(r)
+}
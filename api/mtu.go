@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// MTUReporter gives the MTU reports of the layer2 segments having
+// violations, per segment
+type MTUReporter interface {
+	MTUReports() map[string]interface{}
+}
+
+type MTUApi struct {
+	Service    string
+	Graph      *graph.Graph
+	Reporter   MTUReporter
+	Authorizer graph.Authorizer
+}
+
+// reports returns the reports of the segments the user may read
+func (m *MTUApi) reports(user string) map[string]interface{} {
+	return authorizedReports(m.Authorizer, user, m.Graph, m.Reporter.MTUReports())
+}
+
+func (m *MTUApi) mtuIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(m.reports(r.Username)); err != nil {
+		logging.GetLogger().Criticalf("Failed to display MTU reports: %s", err.Error())
+	}
+}
+
+func (m *MTUApi) mtuShow(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	segment := r.URL.Path[len("/api/mtu/"):]
+	if segment == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	report, ok := m.reports(r.Username)[segment]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logging.GetLogger().Criticalf("Failed to display MTU report of %s: %s", segment, err.Error())
+	}
+}
+
+func (m *MTUApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"MTUIndex",
+			"GET",
+			"/api/mtu",
+			m.mtuIndex,
+		},
+		{
+			"MTUShow",
+			"GET",
+			shttp.PathPrefix("/api/mtu/"),
+			m.mtuShow,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterMTUApi(s string, g *graph.Graph, reporter MTUReporter, r *shttp.Server) {
+	m := &MTUApi{
+		Service:    s,
+		Graph:      g,
+		Reporter:   reporter,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	m.registerEndpoints(r)
+}
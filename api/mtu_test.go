@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type testReport []graph.Identifier
+
+func (r testReport) ReferredNodes() []graph.Identifier {
+	return r
+}
+
+type testMTUReporter map[string]interface{}
+
+func (r testMTUReporter) MTUReports() map[string]interface{} {
+	return r
+}
+
+func TestMTUReportsReadable(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	veth0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth"})
+	veth1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth"})
+	device := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device"})
+	g.Unlock()
+
+	m := &MTUApi{
+		Graph: g,
+		Reporter: testMTUReporter{
+			"veths":   testReport{veth0.ID, veth1.ID},
+			"devices": testReport{veth0.ID, device.ID},
+			"gone":    testReport{veth0.ID, "gone"},
+			"empty":   testReport{},
+		},
+		Authorizer: &graph.ScopeAuthorizer{Scopes: map[string]graph.ReadScope{"tenant": {Types: []string{"veth"}}}},
+	}
+
+	if reports := m.reports("admin"); len(reports) != 4 {
+		t.Errorf("All the reports should be readable by an unrestricted user: %+v", reports)
+	}
+	if reports := m.reports("tenant"); len(reports) != 1 || reports["veths"] == nil {
+		t.Errorf("Only the report of the veths should be readable: %+v", reports)
+	}
+}
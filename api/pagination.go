@@ -0,0 +1,218 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ListOptions are the pagination, sorting and field selection parameters of
+// the list endpoints. The total number of items, before pagination, is
+// returned in the X-Total-Count header so that the body stays unchanged,
+// X-Has-More telling whether the page left items out. Fields selects the
+// attributes of the items, the metadata keys of the nodes and edges and the
+// fields of the flows, their identifiers being always returned.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Sort   string
+	Desc   bool
+	Fields []string
+	// metadata values bigger than this size, as JSON, are left out
+	MaxValueSize int
+}
+
+// sortKeyFunc returns the value of the given sort key for an item
+type sortKeyFunc func(item interface{}, key string) (interface{}, error)
+
+type sortedItems struct {
+	items  []interface{}
+	values []interface{}
+	desc   bool
+}
+
+var listParams = map[string]bool{
+	"limit":  true,
+	"offset": true,
+	"sort":   true,
+	"fields": true,
+
+	"max_value_size": true,
+}
+
+func (s *sortedItems) Len() int {
+	return len(s.items)
+}
+
+func (s *sortedItems) Less(i, j int) bool {
+	if s.desc {
+		return common.CrossTypeCompare(s.values[i], s.values[j]) > 0
+	}
+	return common.CrossTypeCompare(s.values[i], s.values[j]) < 0
+}
+
+func (s *sortedItems) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+func isListParam(key string) bool {
+	return listParams[key]
+}
+
+// ParseListOptions reads the limit, offset, sort, fields and max_value_size
+// query parameters. The limit defaults to api.pagination.default_limit and
+// can't exceed api.pagination.max_limit, both unlimited when zero, a sort
+// key prefixed by '-' gives a descending order and fields is a comma
+// separated list of keys.
+func ParseListOptions(r *http.Request) (*ListOptions, error) {
+	return parseListQuery(r.URL.Query())
+}
+
+func parseListQuery(query url.Values) (*ListOptions, error) {
+	cfg := config.GetConfig()
+	maxLimit := cfg.GetInt("api.pagination.max_limit")
+
+	opts := &ListOptions{Limit: cfg.GetInt("api.pagination.default_limit")}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit: %s", l)
+		}
+		opts.Limit = limit
+	}
+	if maxLimit > 0 && (opts.Limit <= 0 || opts.Limit > maxLimit) {
+		opts.Limit = maxLimit
+	}
+
+	if o := query.Get("offset"); o != "" {
+		offset, err := strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid offset: %s", o)
+		}
+		opts.Offset = offset
+	}
+
+	if s := query.Get("sort"); s != "" {
+		opts.Desc = strings.HasPrefix(s, "-")
+		opts.Sort = strings.TrimPrefix(s, "-")
+	}
+
+	if f := query.Get("fields"); f != "" {
+		for _, field := range strings.Split(f, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				opts.Fields = append(opts.Fields, field)
+			}
+		}
+	}
+
+	if m := query.Get("max_value_size"); m != "" {
+		size, err := strconv.Atoi(m)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Invalid max_value_size: %s", m)
+		}
+		opts.MaxValueSize = size
+	}
+
+	return opts, nil
+}
+
+// Apply sorts the items and returns the requested page along with the total
+// number of items.
+func (o *ListOptions) Apply(items []interface{}, sortKey sortKeyFunc) ([]interface{}, int, error) {
+	total := len(items)
+
+	if o.Sort != "" {
+		s := &sortedItems{items: items, values: make([]interface{}, len(items)), desc: o.Desc}
+		for i, item := range items {
+			v, err := sortKey(item, o.Sort)
+			if err != nil {
+				return nil, total, err
+			}
+			s.values[i] = v
+		}
+		sort.Stable(s)
+	}
+
+	if o.Offset >= total {
+		return []interface{}{}, total, nil
+	}
+
+	end := total
+	if o.Limit > 0 && o.Offset+o.Limit < total {
+		end = o.Offset + o.Limit
+	}
+
+	return items[o.Offset:end], total, nil
+}
+
+// setHeaders returns the total number of items and the page returned, the
+// X-Has-More header telling whether items were left out past the page.
+func (o *ListOptions) setHeaders(w http.ResponseWriter, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("X-Offset", strconv.Itoa(o.Offset))
+	w.Header().Set("X-Limit", strconv.Itoa(o.Limit))
+	w.Header().Set("X-Has-More", strconv.FormatBool(o.HasMore(total)))
+}
+
+// HasMore returns whether items are left out past the page
+func (o *ListOptions) HasMore(total int) bool {
+	return o.Limit > 0 && o.Offset+o.Limit < total
+}
+
+// graphSortKey sorts nodes and edges by ID or by any of their metadata,
+// other values are sorted by themselves.
+func graphSortKey(item interface{}, key string) (interface{}, error) {
+	var e interface {
+		Metadata() graph.Metadata
+	}
+
+	switch item.(type) {
+	case *graph.Node:
+		n := item.(*graph.Node)
+		if key == "ID" {
+			return string(n.ID), nil
+		}
+		e = n
+	case *graph.Edge:
+		ed := item.(*graph.Edge)
+		if key == "ID" {
+			return string(ed.ID), nil
+		}
+		e = ed
+	default:
+		return item, nil
+	}
+
+	return e.Metadata()[key], nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+)
+
+func newListOptions(t *testing.T, query string) *ListOptions {
+	r, err := http.NewRequest("GET", "/api/flow/search?"+query, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	opts, err := ParseListOptions(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return opts
+}
+
+func TestParseListOptions(t *testing.T) {
+	opts := newListOptions(t, "")
+	if opts.Limit != 0 || opts.Offset != 0 || opts.Sort != "" || opts.Fields != nil {
+		t.Errorf("Unlimited default options expected: %+v", opts)
+	}
+
+	cfg := config.GetConfig()
+	cfg.Set("api.pagination.max_limit", 10000)
+	defer cfg.Set("api.pagination.max_limit", 0)
+
+	opts = newListOptions(t, "limit=50000&offset=10&sort=-Start&fields=UUID,%20LayersPath")
+	if opts.Limit != 10000 {
+		t.Errorf("Limit should be capped: %d", opts.Limit)
+	}
+	if opts.Offset != 10 || opts.Sort != "Start" || !opts.Desc {
+		t.Errorf("Wrong options: %+v", opts)
+	}
+	if len(opts.Fields) != 2 || opts.Fields[0] != "UUID" || opts.Fields[1] != "LayersPath" {
+		t.Errorf("Wrong fields: %v", opts.Fields)
+	}
+
+	r, _ := http.NewRequest("GET", "/api/flow/search?limit=-1", nil)
+	if _, err := ParseListOptions(r); err == nil {
+		t.Error("Negative limit should be refused")
+	}
+}
+
+func TestListOptionsApply(t *testing.T) {
+	items := []interface{}{3, 1, 5, 2, 4}
+
+	opts := &ListOptions{Limit: 2, Offset: 1, Sort: "value", Desc: true}
+	page, total, err := opts.Apply(items, graphSortKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if total != 5 || len(page) != 2 || page[0] != 4 || page[1] != 3 {
+		t.Errorf("Wrong page %v, total %d", page, total)
+	}
+	if !opts.HasMore(total) {
+		t.Error("Items left out past the page should be reported")
+	}
+
+	opts = &ListOptions{Offset: 3}
+	if page, total, _ = opts.Apply(items, graphSortKey); len(page) != 2 || opts.HasMore(total) {
+		t.Errorf("Last page expected: %v", page)
+	}
+
+	opts = &ListOptions{Offset: 10}
+	if page, total, _ = opts.Apply(items, graphSortKey); len(page) != 0 || total != 5 {
+		t.Errorf("Empty page expected: %v, total %d", page, total)
+	}
+
+	if _, _, err := (&ListOptions{Sort: "Hash"}).Apply([]interface{}{&flow.Flow{}}, flowSortKey); err == nil {
+		t.Error("Flows shouldn't be sortable by a non indexed field")
+	}
+}
+
+func TestSelectFlowFields(t *testing.T) {
+	f := &flow.Flow{UUID: "flow1", LayersPath: "Ethernet/IPv4/TCP", TrackingID: "a", Statistics: &flow.FlowStatistics{Start: 1}}
+
+	selected := selectFlowFields(f, []string{"LayersPath", "Statistics", "Unknown"})
+	if selected.UUID != "flow1" || selected.LayersPath != f.LayersPath || selected.Statistics != f.Statistics {
+		t.Errorf("UUID and selected fields expected: %+v", selected)
+	}
+	if selected.TrackingID != "" {
+		t.Errorf("Fields not selected shouldn't be returned: %+v", selected)
+	}
+}
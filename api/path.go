@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/nu7hatch/gouuid"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// TrackedPath asks the analyzer to keep the shortest path between the nodes
+// returned by two Gremlin queries up to date. The edges followed are the
+// ones of the given relation types, the configured ones if not given.
+type TrackedPath struct {
+	UUID       string
+	Name       string
+	Src        string
+	Dst        string
+	Relations  []string `json:",omitempty"`
+	CreateTime time.Time
+	ManagedBy  string `json:"ManagedBy,omitempty"`
+}
+
+type TrackedPathHandler struct {
+}
+
+func NewTrackedPath() *TrackedPath {
+	id, _ := uuid.NewV4()
+
+	return &TrackedPath{
+		UUID:       id.String(),
+		CreateTime: time.Now(),
+	}
+}
+
+func (p *TrackedPathHandler) New() ApiResource {
+	return &TrackedPath{}
+}
+
+func (p *TrackedPathHandler) Name() string {
+	return "path"
+}
+
+func (p *TrackedPath) ID() string {
+	return p.UUID
+}
+
+func (p *TrackedPath) applyKey() string {
+	return p.Name
+}
+
+func (p *TrackedPath) owner() string {
+	return p.ManagedBy
+}
+
+func (p *TrackedPath) adopt(owner string, existing ApiResource) {
+	if e, ok := existing.(*TrackedPath); ok {
+		p.UUID, p.CreateTime = e.UUID, e.CreateTime
+	} else {
+		n := NewTrackedPath()
+		p.UUID, p.CreateTime = n.UUID, n.CreateTime
+	}
+	p.ManagedBy = owner
+}
+
+// PathReporter gives the current state of each tracked path
+type PathReporter interface {
+	PathStates() map[string]interface{}
+}
+
+// PathStateApi exposes the current hops of the tracked paths with
+// GET /api/pathstate and GET /api/pathstate/<uuid>
+type PathStateApi struct {
+	Service    string
+	Graph      *graph.Graph
+	Reporter   PathReporter
+	Authorizer graph.Authorizer
+}
+
+// states returns the states of the paths whose hops the user may read
+func (p *PathStateApi) states(user string) map[string]interface{} {
+	return authorizedReports(p.Authorizer, user, p.Graph, p.Reporter.PathStates())
+}
+
+func (p *PathStateApi) pathStateIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(p.states(r.Username)); err != nil {
+		logging.GetLogger().Criticalf("Failed to display path states: %s", err.Error())
+	}
+}
+
+func (p *PathStateApi) pathStateShow(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	id := r.URL.Path[len("/api/pathstate/"):]
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	state, ok := p.states(r.Username)[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		logging.GetLogger().Criticalf("Failed to display state of path %s: %s", id, err.Error())
+	}
+}
+
+func (p *PathStateApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"PathStateIndex",
+			"GET",
+			"/api/pathstate",
+			p.pathStateIndex,
+		},
+		{
+			"PathStateShow",
+			"GET",
+			shttp.PathPrefix("/api/pathstate/"),
+			p.pathStateShow,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterPathStateApi(s string, g *graph.Graph, reporter PathReporter, r *shttp.Server) {
+	p := &PathStateApi{
+		Service:    s,
+		Graph:      g,
+		Reporter:   reporter,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	p.registerEndpoints(r)
+}
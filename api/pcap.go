@@ -0,0 +1,296 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// PcapNamespace is the websocket namespace of the raw capture messages
+// exchanged between the analyzers and the agents.
+const PcapNamespace = "Pcap"
+
+// chunks queued per download, about 16MB
+const pcapQueueSize = 64
+
+// Pcap is a raw capture request, the query has to return a single
+// interface node, Duration is parsed as a Go duration, ie. 30s.
+type Pcap struct {
+	GremlinQuery string `json:"GremlinQuery,omitempty"`
+	BPFFilter    string `json:"BPFFilter,omitempty"`
+	Duration     string `json:"Duration,omitempty"`
+	MaxSize      int64  `json:"MaxSize,omitempty"`
+}
+
+// PcapRequest is sent by an analyzer to the agent of the captured node
+type PcapRequest struct {
+	ID        string
+	NodeID    graph.Identifier
+	BPFFilter string        `json:",omitempty"`
+	Duration  time.Duration `json:",omitempty"`
+	MaxSize   int64         `json:",omitempty"`
+	User      string        `json:",omitempty"`
+}
+
+// PcapChunk is a part of the pcap file sent back by the agent, the last
+// one having EOF set. Error is set when the capture failed.
+type PcapChunk struct {
+	ID    string
+	Data  []byte `json:",omitempty"`
+	EOF   bool   `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// PcapApi forwards the raw capture requests to the agents and streams the
+// pcap files they send back to the requesting clients, or relays the live
+// captures between the websocket clients and the agents.
+type PcapApi struct {
+	shttp.DefaultWSServerEventHandler
+	Graph      *graph.Graph
+	WSServer   *shttp.WSServer
+	Authorizer graph.Authorizer
+	Timeout    time.Duration
+	lock       sync.Mutex
+	downloads  map[string]chan *PcapChunk
+	streams    map[string]*pcapStream
+}
+
+// lookupNode returns the single node returned by the query and its host
+func (p *PcapApi) lookupNode(gremlinQuery string, user string) (graph.Identifier, string, error) {
+	p.Graph.RLock()
+	defer p.Graph.RUnlock()
+
+	tr := graph.NewGremlinTraversalParser(strings.NewReader(gremlinQuery), p.Graph)
+	tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
+
+	ts, err := tr.Parse()
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		return "", "", err
+	}
+
+	var nodes []*graph.Node
+	for _, v := range res.Values() {
+		if n, ok := v.(*graph.Node); ok && (!graph.Restricted(p.Authorizer, user) || p.Authorizer.CanReadNode(user, n)) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) != 1 {
+		return "", "", fmt.Errorf("The query has to return a single node, got %d", len(nodes))
+	}
+
+	return nodes[0].ID, nodes[0].Host(), nil
+}
+
+func (p *PcapApi) register(id string) chan *PcapChunk {
+	ch := make(chan *PcapChunk, pcapQueueSize)
+
+	p.lock.Lock()
+	p.downloads[id] = ch
+	p.lock.Unlock()
+
+	return ch
+}
+
+func (p *PcapApi) unregister(id string) {
+	p.lock.Lock()
+	delete(p.downloads, id)
+	p.lock.Unlock()
+}
+
+// OnMessage queues the chunks sent by the agents, the download being
+// aborted when the client doesn't keep up rather than blocking the
+// messages of the agent.
+func (p *PcapApi) OnMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	if m.Namespace == PcapStreamNamespace {
+		p.onStreamMessage(c, m)
+		return
+	}
+
+	if m.Namespace != PcapNamespace || m.Type != "PcapChunk" {
+		return
+	}
+
+	var chunk PcapChunk
+	if err := m.DecodeObj(&chunk); err != nil {
+		logging.GetLogger().Errorf("Unable to decode raw capture chunk from %s: %s", c.GetHost(), err.Error())
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch, ok := p.downloads[chunk.ID]
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- &chunk:
+	default:
+		logging.GetLogger().Errorf("Raw capture %s download too slow, aborted", chunk.ID)
+		delete(p.downloads, chunk.ID)
+		close(ch)
+	}
+}
+
+func (p *PcapApi) next(ch chan *PcapChunk, timeout time.Duration) (*PcapChunk, error) {
+	select {
+	case chunk, ok := <-ch:
+		if !ok {
+			return nil, errors.New("Download aborted")
+		}
+		if chunk.Error != "" {
+			return nil, errors.New(chunk.Error)
+		}
+		return chunk, nil
+	case <-time.After(timeout):
+		return nil, errors.New("Timeout while waiting for the agent")
+	}
+}
+
+func (p *PcapApi) pcapDownload(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	var resource Pcap
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var duration time.Duration
+	if resource.Duration != "" {
+		d, err := time.ParseDuration(resource.Duration)
+		if err != nil || d < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid duration: %s", resource.Duration)))
+			return
+		}
+		duration = d
+	}
+
+	nodeID, host, err := p.lookupNode(resource.GremlinQuery, r.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	req := &PcapRequest{
+		ID:        string(graph.GenID()),
+		NodeID:    nodeID,
+		BPFFilter: resource.BPFFilter,
+		Duration:  duration,
+		MaxSize:   resource.MaxSize,
+		User:      r.Username,
+	}
+
+	logging.GetLogger().Infof("Raw capture %s of node %s on %s requested by %s from %s, filter %q, duration %s, size %d",
+		req.ID, nodeID, host, r.Username, r.RemoteAddr, req.BPFFilter, duration, req.MaxSize)
+
+	ch := p.register(req.ID)
+	defer p.unregister(req.ID)
+
+	msg := shttp.WSMessage{Namespace: PcapNamespace, Type: "PcapRequest", Obj: req}
+	if !p.WSServer.SendWSMessageTo(msg, host) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Agent %s not connected", host)))
+		return
+	}
+
+	// the agent sends the file once the capture is done
+	chunk, err := p.next(ch, duration+p.Timeout)
+	if err != nil {
+		logging.GetLogger().Errorf("Raw capture %s failed: %s", req.ID, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pcap", req.ID))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	for !chunk.EOF {
+		if _, err := w.Write(chunk.Data); err != nil {
+			logging.GetLogger().Errorf("Raw capture %s download interrupted: %s", req.ID, err.Error())
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// the response being started, a failure truncates the file
+		if chunk, err = p.next(ch, p.Timeout); err != nil {
+			logging.GetLogger().Errorf("Raw capture %s failed: %s", req.ID, err.Error())
+			return
+		}
+	}
+}
+
+func (p *PcapApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"PcapDownload",
+			"POST",
+			"/api/capture/pcap",
+			p.pcapDownload,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterPcapApi(g *graph.Graph, server *shttp.WSServer, r *shttp.Server) *PcapApi {
+	p := &PcapApi{
+		Graph:      g,
+		WSServer:   server,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+		Timeout:    time.Duration(config.GetConfig().GetInt("analyzer.capture.raw.timeout")) * time.Second,
+		downloads:  make(map[string]chan *PcapChunk),
+		streams:    make(map[string]*pcapStream),
+	}
+	server.AddEventHandler(p)
+
+	p.registerEndpoints(r)
+
+	return p
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+func chunkMessage(chunk *PcapChunk) shttp.WSMessage {
+	// as received from the websocket, decoded as generic maps
+	msg, _ := shttp.UnmarshalWSMessage(shttp.WSMessage{Namespace: PcapNamespace, Type: "PcapChunk", Obj: chunk}.Marshal())
+	return msg
+}
+
+func TestPcapChunks(t *testing.T) {
+	p := &PcapApi{downloads: make(map[string]chan *PcapChunk)}
+	c := &shttp.WSClient{}
+
+	ch := p.register("c1")
+	p.OnMessage(c, chunkMessage(&PcapChunk{ID: "c1", Data: []byte{0xd4, 0xc3, 0xb2, 0xa1}}))
+	p.OnMessage(c, chunkMessage(&PcapChunk{ID: "other", Data: []byte{1}}))
+	p.OnMessage(c, chunkMessage(&PcapChunk{ID: "c1", EOF: true}))
+
+	chunk, err := p.next(ch, time.Second)
+	if err != nil || string(chunk.Data) != "\xd4\xc3\xb2\xa1" {
+		t.Fatalf("Expected the pcap header, got: %+v, %v", chunk, err)
+	}
+	if chunk, err = p.next(ch, time.Second); err != nil || !chunk.EOF {
+		t.Fatalf("Expected the end of file, got: %+v, %v", chunk, err)
+	}
+
+	p.unregister("c1")
+	if _, err := p.next(ch, 10*time.Millisecond); err == nil {
+		t.Error("Expected a timeout once no chunk is left")
+	}
+}
+
+func TestPcapChunkError(t *testing.T) {
+	p := &PcapApi{downloads: make(map[string]chan *PcapChunk)}
+
+	ch := p.register("c1")
+	p.OnMessage(&shttp.WSClient{}, chunkMessage(&PcapChunk{ID: "c1", Error: "Too many raw captures running"}))
+
+	if _, err := p.next(ch, time.Second); err == nil || err.Error() != "Too many raw captures running" {
+		t.Errorf("Expected the agent error, got: %v", err)
+	}
+}
+
+func TestPcapSlowDownload(t *testing.T) {
+	p := &PcapApi{downloads: make(map[string]chan *PcapChunk)}
+	c := &shttp.WSClient{}
+
+	ch := p.register("c1")
+	for i := 0; i <= pcapQueueSize; i++ {
+		p.OnMessage(c, chunkMessage(&PcapChunk{ID: "c1", Data: []byte{1}}))
+	}
+
+	if _, ok := p.downloads["c1"]; ok {
+		t.Error("Download should be aborted when the queue is full")
+	}
+
+	for i := 0; i < pcapQueueSize; i++ {
+		<-ch
+	}
+	if _, err := p.next(ch, time.Second); err == nil {
+		t.Error("Expected the download to be aborted")
+	}
+}
+
+func streamMessage(typ string, obj interface{}) shttp.WSMessage {
+	msg, _ := shttp.UnmarshalWSMessage(shttp.WSMessage{Namespace: PcapStreamNamespace, Type: typ, Obj: obj}.Marshal())
+	return msg
+}
+
+func TestPcapStreamRelay(t *testing.T) {
+	p := &PcapApi{
+		WSServer: shttp.NewWSServer(shttp.NewServer("test", "127.0.0.1", 0, shttp.NewNoAuthenticationBackend()), time.Second, "/ws"),
+		Timeout:  time.Second,
+		streams:  make(map[string]*pcapStream),
+	}
+	client, other, agent := &shttp.WSClient{}, &shttp.WSClient{}, &shttp.WSClient{}
+
+	p.streams["a1"] = &pcapStream{client: client, clientID: "c1", timer: time.NewTimer(time.Hour)}
+	p.streams["a2"] = &pcapStream{client: other, clientID: "c1", timer: time.NewTimer(time.Hour)}
+
+	// the clients only see their own streams
+	if id, _ := p.clientStream(client, "c1"); id != "a1" {
+		t.Errorf("Stream a1 expected, got %s", id)
+	}
+	if id, _ := p.clientStream(other, "c1"); id != "a2" {
+		t.Errorf("Stream a2 expected, got %s", id)
+	}
+
+	p.OnMessage(agent, streamMessage("PcapStreamRecords", &PcapStreamChunk{ID: "a1", Seq: 1, Data: make([]byte, 100), Dropped: 3}))
+	if s := p.streams["a1"]; s.agent != agent || s.bytes != 100 || s.dropped != 3 {
+		t.Errorf("Stream a1 expected to be relayed from the agent: %+v", s)
+	}
+
+	p.OnMessage(agent, streamMessage("PcapStreamEnd", &PcapStreamChunk{ID: "a1", Dropped: 4}))
+	if _, ok := p.streams["a1"]; ok {
+		t.Error("Stream a1 expected to be gone once ended by the agent")
+	}
+
+	p.OnUnregisterClient(other)
+	if len(p.streams) != 0 {
+		t.Errorf("The streams of a client gone should be torn down: %v", p.streams)
+	}
+
+	// refused when the stream already runs, even before querying the graph
+	p.streams["a3"] = &pcapStream{client: client, clientID: "c3", timer: time.NewTimer(time.Hour)}
+	if err := p.startStream(client, &PcapStream{ID: "c3"}); err == nil {
+		t.Error("Expected an error for a stream already running")
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// PcapStreamNamespace is the websocket namespace of the live raw captures.
+// A client sends a PcapStreamStart message with a PcapStream, the analyzer
+// forwards it to the agent of the interface as a PcapStreamRequest then
+// relays the PcapStreamStarted, PcapStreamRecords and PcapStreamEnd
+// messages of the agent to the client, and the PcapStreamAck and
+// PcapStreamStop messages of the client to the agent.
+const PcapStreamNamespace = "PcapStream"
+
+// PcapStream is a live raw capture requested by a client, ID being chosen
+// by the client to tell its streams apart. The capture runs until the
+// client stops it or disconnects, or the maximum duration or size of the
+// agent is reached, Duration and MaxSize lowering them.
+type PcapStream struct {
+	ID string
+	Pcap
+}
+
+// PcapStreamChunk is a message of a live capture sent by the agent. The
+// first one gives the link type and the snapshot length of the capture,
+// the next ones batches of pcap records numbered by Seq, the last one the
+// error ending the stream, if any. Dropped counts the packets dropped so
+// far because the client didn't keep up.
+type PcapStreamChunk struct {
+	ID       string
+	Seq      uint64 `json:",omitempty"`
+	LinkType int    `json:",omitempty"`
+	Snaplen  int    `json:",omitempty"`
+	Data     []byte `json:",omitempty"`
+	Dropped  int64  `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// PcapStreamControl acknowledges the chunks of a stream up to Seq, or
+// stops it
+type PcapStreamControl struct {
+	ID  string
+	Seq uint64 `json:",omitempty"`
+}
+
+// pcapStream is a stream relayed by the analyzer, known by the agent with
+// its own ID so that the clients can't interfere with each other
+type pcapStream struct {
+	client   *shttp.WSClient
+	clientID string
+	host     string
+	agent    *shttp.WSClient
+	user     string
+	started  time.Time
+	bytes    int64
+	dropped  int64
+	timer    *time.Timer
+}
+
+// sendToClient sends a message through the server loop, the client may be
+// gone meanwhile
+func (p *PcapApi) sendToClient(c *shttp.WSClient, msgType string, obj interface{}) {
+	msg := shttp.WSMessage{Namespace: PcapStreamNamespace, Type: msgType, Obj: obj}
+	p.WSServer.BroadcastFilteredWSMessage(msg, false, func(client *shttp.WSClient) bool { return client == c })
+}
+
+func (p *PcapApi) sendToAgent(host string, msgType string, obj interface{}) bool {
+	msg := shttp.WSMessage{Namespace: PcapStreamNamespace, Type: msgType, Obj: obj}
+	return p.WSServer.SendWSMessageTo(msg, host)
+}
+
+// clientStream returns the ID of the stream of a client
+func (p *PcapApi) clientStream(c *shttp.WSClient, clientID string) (string, *pcapStream) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for id, s := range p.streams {
+		if s.client == c && s.clientID == clientID {
+			return id, s
+		}
+	}
+	return "", nil
+}
+
+// endStream forgets a stream, returning it if it was still running
+func (p *PcapApi) endStream(id string) *pcapStream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.streams[id]
+	if !ok {
+		return nil
+	}
+	delete(p.streams, id)
+	s.timer.Stop()
+
+	return s
+}
+
+func (p *PcapApi) logStreamEnd(id string, s *pcapStream, err error) {
+	if err != nil {
+		logging.GetLogger().Errorf("Raw capture stream %s of %s failed after %s, %d bytes sent, %d packets dropped: %s",
+			id, s.user, time.Since(s.started), s.bytes, s.dropped, err.Error())
+		return
+	}
+	logging.GetLogger().Infof("Raw capture stream %s of %s done after %s, %d bytes sent, %d packets dropped",
+		id, s.user, time.Since(s.started), s.bytes, s.dropped)
+}
+
+func (p *PcapApi) startStream(c *shttp.WSClient, resource *PcapStream) error {
+	if resource.ID == "" {
+		return errors.New("Missing stream ID")
+	}
+	if id, _ := p.clientStream(c, resource.ID); id != "" {
+		return fmt.Errorf("Stream %s already running", resource.ID)
+	}
+
+	var duration time.Duration
+	if resource.Duration != "" {
+		d, err := time.ParseDuration(resource.Duration)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid duration: %s", resource.Duration)
+		}
+		duration = d
+	}
+
+	nodeID, host, err := p.lookupNode(resource.GremlinQuery, c.GetUsername())
+	if err != nil {
+		return err
+	}
+
+	req := &PcapRequest{
+		ID:        string(graph.GenID()),
+		NodeID:    nodeID,
+		BPFFilter: resource.BPFFilter,
+		Duration:  duration,
+		MaxSize:   resource.MaxSize,
+		User:      c.GetUsername(),
+	}
+
+	logging.GetLogger().Infof("Raw capture stream %s of node %s on %s requested by %s from %s, filter %q, duration %s, size %d",
+		req.ID, nodeID, host, req.User, c.GetHost(), req.BPFFilter, duration, req.MaxSize)
+
+	s := &pcapStream{
+		client:   c,
+		clientID: resource.ID,
+		host:     host,
+		user:     req.User,
+		started:  time.Now(),
+	}
+
+	// the agent has to start the capture within the timeout
+	s.timer = time.AfterFunc(p.Timeout, func() {
+		p.lock.Lock()
+		started := s.agent != nil
+		p.lock.Unlock()
+
+		if !started {
+			p.abortStream(req.ID, errors.New("Timeout while waiting for the agent"))
+		}
+	})
+
+	p.lock.Lock()
+	p.streams[req.ID] = s
+	p.lock.Unlock()
+
+	if !p.sendToAgent(host, "PcapStreamRequest", req) {
+		p.endStream(req.ID)
+		return fmt.Errorf("Agent %s not connected", host)
+	}
+
+	return nil
+}
+
+// abortStream ends a stream on the analyzer side, the agent being told to
+// stop and the client getting the error
+func (p *PcapApi) abortStream(id string, err error) {
+	s := p.endStream(id)
+	if s == nil {
+		return
+	}
+
+	p.sendToAgent(s.host, "PcapStreamStop", &PcapStreamControl{ID: id})
+	p.sendToClient(s.client, "PcapStreamEnd", &PcapStreamChunk{ID: s.clientID, Dropped: s.dropped, Error: err.Error()})
+	p.logStreamEnd(id, s, err)
+}
+
+// onClientMessage handles the messages of the clients
+func (p *PcapApi) onClientMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	switch m.Type {
+	case "PcapStreamStart":
+		var resource PcapStream
+		if err := m.DecodeObj(&resource); err != nil {
+			logging.GetLogger().Errorf("Unable to decode raw capture stream from %s: %s", c.GetHost(), err.Error())
+			return
+		}
+		if err := p.startStream(c, &resource); err != nil {
+			logging.GetLogger().Errorf("Raw capture stream %s of %s refused: %s", resource.ID, c.GetUsername(), err.Error())
+			p.sendToClient(c, "PcapStreamEnd", &PcapStreamChunk{ID: resource.ID, Error: err.Error()})
+		}
+	case "PcapStreamAck", "PcapStreamStop":
+		var ctrl PcapStreamControl
+		if err := m.DecodeObj(&ctrl); err != nil {
+			logging.GetLogger().Errorf("Unable to decode raw capture stream control from %s: %s", c.GetHost(), err.Error())
+			return
+		}
+
+		id, s := p.clientStream(c, ctrl.ID)
+		if s == nil {
+			return
+		}
+		ctrl.ID = id
+		p.sendToAgent(s.host, m.Type, &ctrl)
+	}
+}
+
+// onAgentMessage relays the messages of the agents to the clients
+func (p *PcapApi) onAgentMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	var chunk PcapStreamChunk
+	if err := m.DecodeObj(&chunk); err != nil {
+		logging.GetLogger().Errorf("Unable to decode raw capture stream chunk from %s: %s", c.GetHost(), err.Error())
+		return
+	}
+
+	id := chunk.ID
+	if m.Type == "PcapStreamEnd" {
+		s := p.endStream(id)
+		if s == nil {
+			return
+		}
+		s.dropped = chunk.Dropped
+
+		var err error
+		if chunk.Error != "" {
+			err = errors.New(chunk.Error)
+		}
+		p.logStreamEnd(id, s, err)
+
+		chunk.ID = s.clientID
+		p.sendToClient(s.client, m.Type, &chunk)
+		return
+	}
+
+	p.lock.Lock()
+	s, ok := p.streams[id]
+	if !ok || s.host != c.GetHost() {
+		p.lock.Unlock()
+		return
+	}
+	s.agent = c
+	s.bytes += int64(len(chunk.Data))
+	s.dropped = chunk.Dropped
+	client := s.client
+	chunk.ID = s.clientID
+	p.lock.Unlock()
+
+	p.sendToClient(client, m.Type, &chunk)
+}
+
+func (p *PcapApi) onStreamMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	switch m.Type {
+	case "PcapStreamStart", "PcapStreamAck", "PcapStreamStop":
+		p.onClientMessage(c, m)
+	case "PcapStreamStarted", "PcapStreamRecords", "PcapStreamEnd":
+		p.onAgentMessage(c, m)
+	}
+}
+
+// OnUnregisterClient tears down the streams of a client gone, or the ones
+// relayed from an agent gone. Called from the server loop, the clients
+// are told asynchronously.
+func (p *PcapApi) OnUnregisterClient(c *shttp.WSClient) {
+	p.lock.Lock()
+	var stopped, lost []string
+	for id, s := range p.streams {
+		switch {
+		case s.client == c:
+			stopped = append(stopped, id)
+		case s.agent == c || (s.agent == nil && s.host == c.GetHost()):
+			lost = append(lost, id)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, id := range stopped {
+		if s := p.endStream(id); s != nil {
+			p.sendToAgent(s.host, "PcapStreamStop", &PcapStreamControl{ID: id})
+			p.logStreamEnd(id, s, errors.New("Client disconnected"))
+		}
+	}
+	for _, id := range lost {
+		go p.abortStream(id, errors.New("Agent disconnected"))
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ProbeApi exposes the state of the probes of a bundle and allows to pause
+// them for maintenance, ie. POST /api/probes/netlink/pause. The checks of
+// the prerequisites of the probes are run with GET /api/probes/selftest,
+// their health being given by GET /api/status along with the size limits
+// of the graph and the self monitoring of the process.
+type ProbeApi struct {
+	Service string
+	Bundle  *probe.ProbeBundle
+	Graph   *graph.Graph
+	Monitor *common.SelfMonitor
+}
+
+func (p *ProbeApi) probeIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	p.writeJSON(w, p.Bundle.States())
+}
+
+// Status is the status of a service, the health of its probes given by the
+// results of their checks, the counts of its graph against its limits and
+// its memory and goroutines against their thresholds, if any
+type Status struct {
+	Service     string
+	Probes      map[string]probe.ProbeStatus
+	GraphLimits *graph.SizeLimitsMetrics  `json:",omitempty"`
+	SelfMonitor *common.SelfMonitorStatus `json:",omitempty"`
+}
+
+func (p *ProbeApi) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.GetLogger().Criticalf("Failed to display probes: %s", err.Error())
+	}
+}
+
+// probeSelfTest runs the checks of the probes, the status of the probes
+// being updated with their results
+func (p *ProbeApi) probeSelfTest(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	p.writeJSON(w, p.Bundle.SelfTest())
+}
+
+func (p *ProbeApi) status(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	status := &Status{Service: p.Service, Probes: p.Bundle.Status()}
+	if p.Graph != nil {
+		status.GraphLimits = p.Graph.SizeLimitsMetrics()
+	}
+	if p.Monitor != nil {
+		monitor := p.Monitor.Status()
+		status.SelfMonitor = &monitor
+	}
+	p.writeJSON(w, status)
+}
+
+func (p *ProbeApi) probeAction(action string, f func(name string) error) auth.AuthenticatedHandlerFunc {
+	return func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+		name := mux.Vars(&r.Request)["name"]
+		if _, ok := p.Bundle.Probes[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := f(name); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		logging.GetLogger().Infof("Probe %s %s by %s from %s", name, action, r.Username, r.RemoteAddr)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (p *ProbeApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"ProbeIndex",
+			"GET",
+			"/api/probes",
+			p.probeIndex,
+		},
+		{
+			"ProbeSelfTest",
+			"GET",
+			"/api/probes/selftest",
+			p.probeSelfTest,
+		},
+		{
+			"Status",
+			"GET",
+			"/api/status",
+			p.status,
+		},
+		{
+			"ProbePause",
+			"POST",
+			"/api/probes/{name}/pause",
+			p.probeAction("paused", p.Bundle.Pause),
+		},
+		{
+			"ProbeResume",
+			"POST",
+			"/api/probes/{name}/resume",
+			p.probeAction("resumed", p.Bundle.Resume),
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterProbeApi(s string, b *probe.ProbeBundle, g *graph.Graph, m *common.SelfMonitor, r *shttp.Server) {
+	p := &ProbeApi{
+		Service: s,
+		Bundle:  b,
+		Graph:   g,
+		Monitor: m,
+	}
+
+	p.registerEndpoints(r)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+type QuarantineApi struct {
+	Service string
+}
+
+// quarantineDump returns the inputs rejected by the decoders whose name
+// starts with the given one, all of them if none is given, ie.
+// GET /api/debug/quarantine/sflow
+func (q *QuarantineApi) quarantineDump(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	name := r.URL.Path[len("/api/debug/quarantine/"):]
+
+	quarantines := common.GetQuarantines(name)
+	if len(quarantines) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	dump := make(map[string][]common.QuarantineEntry)
+	for _, quarantine := range quarantines {
+		dump[quarantine.Name] = quarantine.Dump()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=quarantine.json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		logging.GetLogger().Criticalf("Failed to dump quarantine %s: %s", name, err.Error())
+	}
+}
+
+func (q *QuarantineApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"QuarantineDump",
+			"GET",
+			shttp.PathPrefix("/api/debug/quarantine/"),
+			q.quarantineDump,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterQuarantineApi(s string, r *shttp.Server) {
+	q := &QuarantineApi{
+		Service: s,
+	}
+
+	q.registerEndpoints(r)
+}
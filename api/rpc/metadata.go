@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// NewMetadata returns the metadata of a JSON object, as returned by the REST
+// API for the nodes and edges.
+func NewMetadata(data []byte) (map[string]*MetadataValue, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var m map[string]interface{}
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]*MetadataValue, len(m))
+	for k, v := range m {
+		value, err := NewMetadataValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+		metadata[k] = value
+	}
+
+	return metadata, nil
+}
+
+// NewMetadataValue returns the metadata value of a JSON decoded value, or of
+// a string, a boolean or a number.
+func NewMetadataValue(v interface{}) (*MetadataValue, error) {
+	switch v := v.(type) {
+	case nil:
+		return &MetadataValue{Kind: MetadataValue_NULL}, nil
+	case string:
+		return &MetadataValue{Kind: MetadataValue_STRING, String_: v}, nil
+	case bool:
+		return &MetadataValue{Kind: MetadataValue_BOOL, Bool: v}, nil
+	case int:
+		return &MetadataValue{Kind: MetadataValue_INTEGER, Integer: int64(v)}, nil
+	case int32:
+		return &MetadataValue{Kind: MetadataValue_INTEGER, Integer: int64(v)}, nil
+	case int64:
+		return &MetadataValue{Kind: MetadataValue_INTEGER, Integer: v}, nil
+	case uint32:
+		return &MetadataValue{Kind: MetadataValue_INTEGER, Integer: int64(v)}, nil
+	case float32:
+		return &MetadataValue{Kind: MetadataValue_NUMBER, Number: float64(v)}, nil
+	case float64:
+		return &MetadataValue{Kind: MetadataValue_NUMBER, Number: v}, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return &MetadataValue{Kind: MetadataValue_INTEGER, Integer: i}, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return &MetadataValue{Kind: MetadataValue_NUMBER, Number: f}, nil
+	case []interface{}:
+		value := &MetadataValue{Kind: MetadataValue_LIST, List: make([]*MetadataValue, len(v))}
+		for i, item := range v {
+			var err error
+			if value.List[i], err = NewMetadataValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
+	case map[string]interface{}:
+		value := &MetadataValue{Kind: MetadataValue_MAP, Map: make(map[string]*MetadataValue, len(v))}
+		for k, item := range v {
+			var err error
+			if value.Map[k], err = NewMetadataValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported metadata value type: %T", v)
+}
+
+// Interface returns the value as decoded from JSON, except for the integers
+// returned as int64.
+func (m *MetadataValue) Interface() interface{} {
+	if m == nil {
+		return nil
+	}
+
+	switch m.Kind {
+	case MetadataValue_STRING:
+		return m.String_
+	case MetadataValue_INTEGER:
+		return m.Integer
+	case MetadataValue_NUMBER:
+		return m.Number
+	case MetadataValue_BOOL:
+		return m.Bool
+	case MetadataValue_LIST:
+		list := make([]interface{}, len(m.List))
+		for i, item := range m.List {
+			list[i] = item.Interface()
+		}
+		return list
+	case MetadataValue_MAP:
+		return MetadataMap(m.Map)
+	}
+
+	return nil
+}
+
+// MetadataMap returns the metadata as a map of the values as decoded from
+// JSON, integers being int64.
+func MetadataMap(metadata map[string]*MetadataValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		m[k] = v.Interface()
+	}
+	return m
+}
@@ -0,0 +1,514 @@
+// Code generated by protoc-gen-go.
+// source: api/rpc/skydive.proto
+// DO NOT EDIT!
+
+/*
+Package rpc is a generated protocol buffer package.
+
+It is generated from these files:
+	api/rpc/skydive.proto
+
+It has these top-level messages:
+	MetadataValue
+	Node
+	Edge
+	Value
+	ListOptions
+	TopologyRequest
+	TopologyReply
+	WatchRequest
+	GraphEvent
+	FlowRequest
+	FlowReply
+*/
+package rpc
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import flow "github.com/redhat-cip/skydive/flow"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+const _ = proto.ProtoPackageIsVersion1
+
+type MetadataValue_Kind int32
+
+const (
+	MetadataValue_NULL    MetadataValue_Kind = 0
+	MetadataValue_STRING  MetadataValue_Kind = 1
+	MetadataValue_INTEGER MetadataValue_Kind = 2
+	MetadataValue_NUMBER  MetadataValue_Kind = 3
+	MetadataValue_BOOL    MetadataValue_Kind = 4
+	MetadataValue_LIST    MetadataValue_Kind = 5
+	MetadataValue_MAP     MetadataValue_Kind = 6
+)
+
+var MetadataValue_Kind_name = map[int32]string{
+	0: "NULL",
+	1: "STRING",
+	2: "INTEGER",
+	3: "NUMBER",
+	4: "BOOL",
+	5: "LIST",
+	6: "MAP",
+}
+var MetadataValue_Kind_value = map[string]int32{
+	"NULL":    0,
+	"STRING":  1,
+	"INTEGER": 2,
+	"NUMBER":  3,
+	"BOOL":    4,
+	"LIST":    5,
+	"MAP":     6,
+}
+
+func (x MetadataValue_Kind) String() string {
+	return proto.EnumName(MetadataValue_Kind_name, int32(x))
+}
+
+// A metadata value, Kind telling which of the other fields is set. Integers
+// are kept apart from the other numbers so that they don't lose precision.
+type MetadataValue struct {
+	Kind    MetadataValue_Kind        `protobuf:"varint,1,opt,name=Kind,enum=rpc.MetadataValue_Kind" json:"Kind,omitempty"`
+	String_ string                    `protobuf:"bytes,2,opt,name=String" json:"String,omitempty"`
+	Integer int64                     `protobuf:"varint,3,opt,name=Integer" json:"Integer,omitempty"`
+	Number  float64                   `protobuf:"fixed64,4,opt,name=Number" json:"Number,omitempty"`
+	Bool    bool                      `protobuf:"varint,5,opt,name=Bool" json:"Bool,omitempty"`
+	List    []*MetadataValue          `protobuf:"bytes,6,rep,name=List" json:"List,omitempty"`
+	Map     map[string]*MetadataValue `protobuf:"bytes,7,rep,name=Map" json:"Map,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *MetadataValue) Reset()         { *m = MetadataValue{} }
+func (m *MetadataValue) String() string { return proto.CompactTextString(m) }
+func (*MetadataValue) ProtoMessage()    {}
+
+func (m *MetadataValue) GetList() []*MetadataValue {
+	if m != nil {
+		return m.List
+	}
+	return nil
+}
+
+func (m *MetadataValue) GetMap() map[string]*MetadataValue {
+	if m != nil {
+		return m.Map
+	}
+	return nil
+}
+
+type Node struct {
+	ID       string                    `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Host     string                    `protobuf:"bytes,2,opt,name=Host" json:"Host,omitempty"`
+	Metadata map[string]*MetadataValue `protobuf:"bytes,4,rep,name=Metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *Node) Reset()         { *m = Node{} }
+func (m *Node) String() string { return proto.CompactTextString(m) }
+func (*Node) ProtoMessage()    {}
+
+func (m *Node) GetMetadata() map[string]*MetadataValue {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+type Edge struct {
+	ID       string                    `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Host     string                    `protobuf:"bytes,2,opt,name=Host" json:"Host,omitempty"`
+	Parent   string                    `protobuf:"bytes,3,opt,name=Parent" json:"Parent,omitempty"`
+	Child    string                    `protobuf:"bytes,4,opt,name=Child" json:"Child,omitempty"`
+	Metadata map[string]*MetadataValue `protobuf:"bytes,6,rep,name=Metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *Edge) Reset()         { *m = Edge{} }
+func (m *Edge) String() string { return proto.CompactTextString(m) }
+func (*Edge) ProtoMessage()    {}
+
+func (m *Edge) GetMetadata() map[string]*MetadataValue {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+// A result of a Gremlin query, a node, an edge or any other value, ie. a
+// count or a path, serialized as JSON.
+type Value struct {
+	Node *Node  `protobuf:"bytes,1,opt,name=Node" json:"Node,omitempty"`
+	Edge *Edge  `protobuf:"bytes,2,opt,name=Edge" json:"Edge,omitempty"`
+	JSON []byte `protobuf:"bytes,3,opt,name=JSON,proto3" json:"JSON,omitempty"`
+}
+
+func (m *Value) Reset()         { *m = Value{} }
+func (m *Value) String() string { return proto.CompactTextString(m) }
+func (*Value) ProtoMessage()    {}
+
+func (m *Value) GetNode() *Node {
+	if m != nil {
+		return m.Node
+	}
+	return nil
+}
+
+func (m *Value) GetEdge() *Edge {
+	if m != nil {
+		return m.Edge
+	}
+	return nil
+}
+
+// Same semantics as the limit, offset, sort and fields query parameters of
+// the REST API, a sort key prefixed by - means a descending order.
+type ListOptions struct {
+	Limit  int32    `protobuf:"varint,1,opt,name=Limit" json:"Limit,omitempty"`
+	Offset int32    `protobuf:"varint,2,opt,name=Offset" json:"Offset,omitempty"`
+	Sort   string   `protobuf:"bytes,3,opt,name=Sort" json:"Sort,omitempty"`
+	Fields []string `protobuf:"bytes,4,rep,name=Fields" json:"Fields,omitempty"`
+}
+
+func (m *ListOptions) Reset()         { *m = ListOptions{} }
+func (m *ListOptions) String() string { return proto.CompactTextString(m) }
+func (*ListOptions) ProtoMessage()    {}
+
+type TopologyRequest struct {
+	GremlinQuery string       `protobuf:"bytes,1,opt,name=GremlinQuery" json:"GremlinQuery,omitempty"`
+	Options      *ListOptions `protobuf:"bytes,2,opt,name=Options" json:"Options,omitempty"`
+}
+
+func (m *TopologyRequest) Reset()         { *m = TopologyRequest{} }
+func (m *TopologyRequest) String() string { return proto.CompactTextString(m) }
+func (*TopologyRequest) ProtoMessage()    {}
+
+func (m *TopologyRequest) GetOptions() *ListOptions {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+// Without Gremlin query the whole graph is returned in Nodes and Edges,
+// paginated as a single list of the nodes followed by the edges, otherwise
+// the results are returned in Values.
+type TopologyReply struct {
+	Nodes  []*Node  `protobuf:"bytes,1,rep,name=Nodes" json:"Nodes,omitempty"`
+	Edges  []*Edge  `protobuf:"bytes,2,rep,name=Edges" json:"Edges,omitempty"`
+	Values []*Value `protobuf:"bytes,3,rep,name=Values" json:"Values,omitempty"`
+	Total  int64    `protobuf:"varint,4,opt,name=Total" json:"Total,omitempty"`
+}
+
+func (m *TopologyReply) Reset()         { *m = TopologyReply{} }
+func (m *TopologyReply) String() string { return proto.CompactTextString(m) }
+func (*TopologyReply) ProtoMessage()    {}
+
+func (m *TopologyReply) GetNodes() []*Node {
+	if m != nil {
+		return m.Nodes
+	}
+	return nil
+}
+
+func (m *TopologyReply) GetEdges() []*Edge {
+	if m != nil {
+		return m.Edges
+	}
+	return nil
+}
+
+func (m *TopologyReply) GetValues() []*Value {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+// Only the nodes and edges having all the Filters metadata are watched, an
+// element updated so that it doesn't match anymore is sent as deleted, one
+// starting to match as added. Filters values can't be lists or maps.
+type WatchRequest struct {
+	// send the current nodes and edges as added events first, the events
+	// following being the ones happening after
+	Sync    bool                      `protobuf:"varint,1,opt,name=Sync" json:"Sync,omitempty"`
+	Filters map[string]*MetadataValue `protobuf:"bytes,2,rep,name=Filters" json:"Filters,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+
+func (m *WatchRequest) GetFilters() map[string]*MetadataValue {
+	if m != nil {
+		return m.Filters
+	}
+	return nil
+}
+
+// Type is one of NodeAdded, NodeUpdated, NodeDeleted, EdgeAdded,
+// EdgeUpdated or EdgeDeleted, as for the WebSocket messages.
+type GraphEvent struct {
+	Type string `protobuf:"bytes,1,opt,name=Type" json:"Type,omitempty"`
+	Node *Node  `protobuf:"bytes,2,opt,name=Node" json:"Node,omitempty"`
+	Edge *Edge  `protobuf:"bytes,3,opt,name=Edge" json:"Edge,omitempty"`
+}
+
+func (m *GraphEvent) Reset()         { *m = GraphEvent{} }
+func (m *GraphEvent) String() string { return proto.CompactTextString(m) }
+func (*GraphEvent) ProtoMessage()    {}
+
+func (m *GraphEvent) GetNode() *Node {
+	if m != nil {
+		return m.Node
+	}
+	return nil
+}
+
+func (m *GraphEvent) GetEdge() *Edge {
+	if m != nil {
+		return m.Edge
+	}
+	return nil
+}
+
+type FlowRequest struct {
+	Filters map[string]string `protobuf:"bytes,1,rep,name=Filters" json:"Filters,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Options *ListOptions      `protobuf:"bytes,2,opt,name=Options" json:"Options,omitempty"`
+}
+
+func (m *FlowRequest) Reset()         { *m = FlowRequest{} }
+func (m *FlowRequest) String() string { return proto.CompactTextString(m) }
+func (*FlowRequest) ProtoMessage()    {}
+
+func (m *FlowRequest) GetFilters() map[string]string {
+	if m != nil {
+		return m.Filters
+	}
+	return nil
+}
+
+func (m *FlowRequest) GetOptions() *ListOptions {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+type FlowReply struct {
+	Flows []*flow.Flow `protobuf:"bytes,1,rep,name=Flows" json:"Flows,omitempty"`
+	Total int64        `protobuf:"varint,2,opt,name=Total" json:"Total,omitempty"`
+}
+
+func (m *FlowReply) Reset()         { *m = FlowReply{} }
+func (m *FlowReply) String() string { return proto.CompactTextString(m) }
+func (*FlowReply) ProtoMessage()    {}
+
+func (m *FlowReply) GetFlows() []*flow.Flow {
+	if m != nil {
+		return m.Flows
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*MetadataValue)(nil), "rpc.MetadataValue")
+	proto.RegisterType((*Node)(nil), "rpc.Node")
+	proto.RegisterType((*Edge)(nil), "rpc.Edge")
+	proto.RegisterType((*Value)(nil), "rpc.Value")
+	proto.RegisterType((*ListOptions)(nil), "rpc.ListOptions")
+	proto.RegisterType((*TopologyRequest)(nil), "rpc.TopologyRequest")
+	proto.RegisterType((*TopologyReply)(nil), "rpc.TopologyReply")
+	proto.RegisterType((*WatchRequest)(nil), "rpc.WatchRequest")
+	proto.RegisterType((*GraphEvent)(nil), "rpc.GraphEvent")
+	proto.RegisterType((*FlowRequest)(nil), "rpc.FlowRequest")
+	proto.RegisterType((*FlowReply)(nil), "rpc.FlowReply")
+	proto.RegisterEnum("rpc.MetadataValue_Kind", MetadataValue_Kind_name, MetadataValue_Kind_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for Topology service
+
+type TopologyClient interface {
+	GetTopology(ctx context.Context, in *TopologyRequest, opts ...grpc.CallOption) (*TopologyReply, error)
+	WatchTopology(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Topology_WatchTopologyClient, error)
+}
+
+type topologyClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewTopologyClient(cc *grpc.ClientConn) TopologyClient {
+	return &topologyClient{cc}
+}
+
+func (c *topologyClient) GetTopology(ctx context.Context, in *TopologyRequest, opts ...grpc.CallOption) (*TopologyReply, error) {
+	out := new(TopologyReply)
+	err := grpc.Invoke(ctx, "/rpc.Topology/GetTopology", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *topologyClient) WatchTopology(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Topology_WatchTopologyClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Topology_serviceDesc.Streams[0], c.cc, "/rpc.Topology/WatchTopology", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &topologyWatchTopologyClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Topology_WatchTopologyClient interface {
+	Recv() (*GraphEvent, error)
+	grpc.ClientStream
+}
+
+type topologyWatchTopologyClient struct {
+	grpc.ClientStream
+}
+
+func (x *topologyWatchTopologyClient) Recv() (*GraphEvent, error) {
+	m := new(GraphEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Topology service
+
+type TopologyServer interface {
+	GetTopology(context.Context, *TopologyRequest) (*TopologyReply, error)
+	WatchTopology(*WatchRequest, Topology_WatchTopologyServer) error
+}
+
+func RegisterTopologyServer(s *grpc.Server, srv TopologyServer) {
+	s.RegisterService(&_Topology_serviceDesc, srv)
+}
+
+func _Topology_GetTopology_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(TopologyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(TopologyServer).GetTopology(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Topology_WatchTopology_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TopologyServer).WatchTopology(m, &topologyWatchTopologyServer{stream})
+}
+
+type Topology_WatchTopologyServer interface {
+	Send(*GraphEvent) error
+	grpc.ServerStream
+}
+
+type topologyWatchTopologyServer struct {
+	grpc.ServerStream
+}
+
+func (x *topologyWatchTopologyServer) Send(m *GraphEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Topology_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "rpc.Topology",
+	HandlerType: (*TopologyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetTopology",
+			Handler:    _Topology_GetTopology_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTopology",
+			Handler:       _Topology_WatchTopology_Handler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// Client API for Flows service
+
+type FlowsClient interface {
+	QueryFlows(ctx context.Context, in *FlowRequest, opts ...grpc.CallOption) (*FlowReply, error)
+}
+
+type flowsClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewFlowsClient(cc *grpc.ClientConn) FlowsClient {
+	return &flowsClient{cc}
+}
+
+func (c *flowsClient) QueryFlows(ctx context.Context, in *FlowRequest, opts ...grpc.CallOption) (*FlowReply, error) {
+	out := new(FlowReply)
+	err := grpc.Invoke(ctx, "/rpc.Flows/QueryFlows", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Flows service
+
+type FlowsServer interface {
+	QueryFlows(context.Context, *FlowRequest) (*FlowReply, error)
+}
+
+func RegisterFlowsServer(s *grpc.Server, srv FlowsServer) {
+	s.RegisterService(&_Flows_serviceDesc, srv)
+}
+
+func _Flows_QueryFlows_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(FlowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(FlowsServer).QueryFlows(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Flows_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "rpc.Flows",
+	HandlerType: (*FlowsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "QueryFlows",
+			Handler:    _Flows_QueryFlows_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Schema lists the legal values of the Type and RelationType metadata,
+// ie. for the filters of the UIs, and the constraints of the relation types.
+type Schema struct {
+	NodeTypes           []string
+	RelationTypes       []string
+	RelationConstraints map[string]graph.RelationConstraints
+}
+
+type SchemaApi struct {
+	Service string
+}
+
+func (s *SchemaApi) schema(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	schema := &Schema{
+		NodeTypes:           graph.NodeTypes(),
+		RelationTypes:       graph.RelationTypes(),
+		RelationConstraints: graph.RelationTypeConstraints(),
+	}
+	if err := json.NewEncoder(w).Encode(schema); err != nil {
+		logging.GetLogger().Criticalf("Failed to display the graph schema: %s", err.Error())
+	}
+}
+
+func (s *SchemaApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"Schema",
+			"GET",
+			"/api/schema",
+			s.schema,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterSchemaApi(s string, r *shttp.Server) {
+	a := &SchemaApi{
+		Service: s,
+	}
+
+	a.registerEndpoints(r)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// SelfMonitorApi lists the sets of profiles written by the self monitoring
+// with GET /api/debug/profiles and writes a set on demand with POST
+// /api/debug/profiles, at most one set being written per capture interval
+type SelfMonitorApi struct {
+	Service string
+	Monitor *common.SelfMonitor
+}
+
+// SelfMonitorCaptures is the status of the self monitoring and the
+// directories of the sets of profiles, the oldest first
+type SelfMonitorCaptures struct {
+	Status   common.SelfMonitorStatus
+	Captures []string
+}
+
+func (s *SelfMonitorApi) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.GetLogger().Criticalf("Failed to display profiles: %s", err.Error())
+	}
+}
+
+func (s *SelfMonitorApi) captureIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	captures, err := s.Monitor.Captures()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, &SelfMonitorCaptures{Status: s.Monitor.Status(), Captures: captures})
+}
+
+func (s *SelfMonitorApi) capture(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	dir, err := s.Monitor.Capture("requested by " + r.Username + " from " + r.RemoteAddr)
+	switch err {
+	case nil:
+		s.writeJSON(w, http.StatusOK, map[string]string{"Capture": dir})
+	case common.ErrCaptureRateLimited:
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+	default:
+		logging.GetLogger().Errorf("Unable to capture the profiles requested by %s: %s", r.Username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func (s *SelfMonitorApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"ProfileIndex",
+			"GET",
+			"/api/debug/profiles",
+			s.captureIndex,
+		},
+		{
+			"ProfileCapture",
+			"POST",
+			"/api/debug/profiles",
+			s.capture,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterSelfMonitorApi(s string, m *common.SelfMonitor, r *shttp.Server) {
+	a := &SelfMonitorApi{
+		Service: s,
+		Monitor: m,
+	}
+
+	a.registerEndpoints(r)
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+// RevokedSession is a session revoked before its expiry, stored until then
+// so that all the analyzers refuse it. Posting one to /api/revokedsession
+// revokes the session of the given ID.
+type RevokedSession struct {
+	Session string
+	User    string `json:",omitempty"`
+	Expires int64  `json:",omitempty"`
+}
+
+type RevokedSessionHandler struct {
+}
+
+func (h *RevokedSessionHandler) New() ApiResource {
+	return &RevokedSession{}
+}
+
+func (h *RevokedSessionHandler) Name() string {
+	return "revokedsession"
+}
+
+func (r *RevokedSession) ID() string {
+	return r.Session
+}
@@ -24,61 +24,257 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
+// RevisionHeader gives the revision of the graph returned by the topology
+// endpoints, the websocket clients syncing from this revision, with the
+// FromRevision field of their SyncRequest, getting the events which
+// followed it
+const RevisionHeader = "X-Graph-Revision"
+
 type TopologyApi struct {
-	Service string
-	Graph   *graph.Graph
+	Service    string
+	Graph      *graph.Graph
+	Filter     *graph.MetadataFilter
+	Statistics *graph.StatisticsStore
+	Authorizer graph.Authorizer
+	Watcher    *graph.NodeWatcher
+}
+
+// NodeMetrics is the statistics series of a node
+type NodeMetrics struct {
+	ID     graph.Identifier
+	Points []graph.StatisticsPoint
 }
 
 type Topology struct {
 	GremlinQuery string `json:"GremlinQuery,omitempty"`
 }
 
+// authorizedReports returns the reports the user may read, the ones of the
+// restricted users being checked against the nodes they refer to
+func authorizedReports(a graph.Authorizer, user string, g *graph.Graph, reports map[string]interface{}) map[string]interface{} {
+	if !graph.Restricted(a, user) {
+		return reports
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	readable := make(map[string]interface{})
+	for id, r := range reports {
+		if _, ok := graph.AuthorizeValue(a, user, g, r); ok {
+			readable[id] = r
+		}
+	}
+	return readable
+}
+
+// authorizedList is authorizedReports for a list of reports
+func authorizedList(a graph.Authorizer, user string, g *graph.Graph, reports []interface{}) []interface{} {
+	if !graph.Restricted(a, user) {
+		return reports
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	readable := []interface{}{}
+	for _, r := range reports {
+		if _, ok := graph.AuthorizeValue(a, user, g, r); ok {
+			readable = append(readable, r)
+		}
+	}
+	return readable
+}
+
+// query executes a Gremlin query and returns the requested page of filtered
+// results the user may read along with the total number of them.
+func (t *TopologyApi) query(gremlinQuery string, opts *ListOptions, user string) ([]interface{}, int, error) {
+	tr := graph.NewGremlinTraversalParser(strings.NewReader(gremlinQuery), t.Graph)
+	tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
+
+	ts, err := tr.Parse()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values := res.Values()
+	if graph.Restricted(t.Authorizer, user) {
+		readable := []interface{}{}
+		for _, v := range values {
+			if v, ok := graph.AuthorizeValue(t.Authorizer, user, t.Graph, v); ok {
+				readable = append(readable, v)
+			}
+		}
+		values = readable
+	}
+
+	values, total, err := opts.Apply(values, graphSortKey)
+	if err != nil {
+		return nil, total, err
+	}
+
+	filter := t.Filter.Select(opts.Fields).WithMaxValueSize(opts.MaxValueSize)
+	for i, v := range values {
+		values[i] = filter.FilterValue(v)
+	}
+
+	return values, total, nil
+}
+
 func (t *TopologyApi) topologyIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
+	opts, err := ParseListOptions(&r.Request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	filter := t.Filter.Select(opts.Fields).WithMaxValueSize(opts.MaxValueSize)
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "cytoscape" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Unknown format: %s", format)))
+		return
+	}
+
+	// the body is optional, ie. GET /api/topology?format=cytoscape
 	resource := Topology{}
-	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil && err != io.EOF {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if resource.GremlinQuery != "" {
-		tr := graph.NewGremlinTraversalParser(strings.NewReader(resource.GremlinQuery), t.Graph)
-		tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
+	reply, status, err := t.topologyReply(&resource, opts, filter, format, r.Username)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-		ts, err := tr.Parse()
+	if reply.total >= 0 {
+		opts.setHeaders(w, reply.total)
+	}
+	setRevisionHeader(w, reply.revision)
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply.data)
+}
+
+func setRevisionHeader(w http.ResponseWriter, revision uint64) {
+	w.Header().Set(RevisionHeader, strconv.FormatUint(revision, 10))
+}
+
+// topologyReply is the serialized result of a topology request, the graph
+// being at the given revision
+type topologyReply struct {
+	data     []byte
+	total    int
+	revision uint64
+}
+
+// topologyReply executes a topology request, the graph being read locked
+// until the result is serialized so that it's the graph at the revision
+// returned. The total is -1 if the result is not paginated.
+func (t *TopologyApi) topologyReply(resource *Topology, opts *ListOptions, filter *graph.MetadataFilter, format string, user string) (*topologyReply, int, error) {
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	reply := &topologyReply{total: -1, revision: t.Graph.Revision()}
+
+	var result interface{}
+	if resource.GremlinQuery != "" {
+		values, total, err := t.query(resource.GremlinQuery, opts, user)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+			return nil, http.StatusBadRequest, err
 		}
 
-		res, err := ts.Exec()
+		reply.total = total
+		result = values
+	} else {
+		result = graph.AuthorizeGraph(t.Authorizer, user, t.Graph, filter)
+	}
+
+	if format == "cytoscape" {
+		cytoscape, err := NewCytoscapeTopology(result)
 		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		result = cytoscape
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	reply.data = append(data, '\n')
+
+	return reply, http.StatusOK, nil
+}
+
+// nodeMetrics returns the statistics of a node within the window, one hour
+// by default, ie. GET /api/topology/nodes/<id>/metrics?window=30m
+func (t *TopologyApi) nodeMetrics(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if t.Statistics == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Statistics series disabled"))
+		return
+	}
+
+	window := time.Hour
+	if param := r.URL.Query().Get("window"); param != "" {
+		d, err := time.ParseDuration(param)
+		if err != nil || d <= 0 {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			w.Write([]byte(fmt.Sprintf("Invalid window: %s", param)))
 			return
 		}
+		window = d
+	}
 
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(res.Values()); err != nil {
-			panic(err)
-		}
-	} else {
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(t.Graph); err != nil {
-			panic(err)
+	id := graph.Identifier(mux.Vars(&r.Request)["id"])
+	if graph.Restricted(t.Authorizer, r.Username) {
+		t.Graph.RLock()
+		n := t.Graph.GetNode(id)
+		readable := n != nil && t.Authorizer.CanReadNode(r.Username, n)
+		t.Graph.RUnlock()
+
+		if !readable {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
 	}
+
+	points, ok := t.Statistics.Series(id, window)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(&NodeMetrics{ID: id, Points: points}); err != nil {
+		panic(err)
+	}
 }
 
 func (t *TopologyApi) registerEndpoints(r *shttp.Server) {
@@ -89,16 +285,36 @@ func (t *TopologyApi) registerEndpoints(r *shttp.Server) {
 			"/api/topology",
 			t.topologyIndex,
 		},
+		{
+			"NodesIndex",
+			"GET",
+			"/api/topology/nodes",
+			t.nodesIndex,
+		},
+		{
+			"NodeMetrics",
+			"GET",
+			"/api/topology/nodes/{id}/metrics",
+			t.nodeMetrics,
+		},
 	}
 
 	r.RegisterRoutes(routes)
 }
 
-func RegisterTopologyApi(s string, g *graph.Graph, r *shttp.Server) {
+// RegisterTopologyApi registers the REST endpoints of the topology and
+// the node watches of the websocket clients
+func RegisterTopologyApi(s string, g *graph.Graph, r *shttp.Server, ws *shttp.WSServer, statistics *graph.StatisticsStore) {
 	t := &TopologyApi{
-		Service: s,
-		Graph:   g,
+		Service:    s,
+		Graph:      g,
+		Filter:     graph.NewMetadataFilterFromConfig(s, "api"),
+		Statistics: statistics,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+		Watcher:    graph.NewNodeWatcher(g),
 	}
+	t.Watcher.Start()
 
 	t.registerEndpoints(r)
+	newNodeWatchServer(t, ws)
 }
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type TraceApi struct {
+	Service    string
+	Graph      *graph.Graph
+	Recorder   *common.TraceRecorder
+	Authorizer graph.Authorizer
+}
+
+// readable returns whether the user may read the trace, ie. the nodes and
+// the edges whose mutations it traced
+func (t *TraceApi) readable(user string, trace *common.Trace) bool {
+	traced := false
+	for _, s := range trace.Spans {
+		id, ok := s.Tags["id"]
+		if !ok {
+			continue
+		}
+		traced = true
+
+		if n := t.Graph.GetNode(graph.Identifier(id)); n != nil {
+			if !t.Authorizer.CanReadNode(user, n) {
+				return false
+			}
+		} else if e := t.Graph.GetEdge(graph.Identifier(id)); e == nil || !graph.CanReadEdge(t.Authorizer, user, t.Graph, e) {
+			return false
+		}
+	}
+	return traced
+}
+
+// traces returns the recorded traces the user may read, the most recent
+// first
+func (t *TraceApi) traces(user string) []*common.Trace {
+	traces := t.Recorder.Traces()
+	if !graph.Restricted(t.Authorizer, user) {
+		return traces
+	}
+
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	readable := []*common.Trace{}
+	for _, trace := range traces {
+		if t.readable(user, trace) {
+			readable = append(readable, trace)
+		}
+	}
+	return readable
+}
+
+func (t *TraceApi) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.GetLogger().Criticalf("Failed to display traces: %s", err.Error())
+	}
+}
+
+func (t *TraceApi) traceIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	t.writeJSON(w, t.traces(r.Username))
+}
+
+func (t *TraceApi) traceShow(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	id := mux.Vars(&r.Request)["id"]
+	for _, trace := range t.traces(r.Username) {
+		if trace.ID == id {
+			t.writeJSON(w, trace)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (t *TraceApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"TraceIndex",
+			"GET",
+			"/api/traces",
+			t.traceIndex,
+		},
+		{
+			"TraceShow",
+			"GET",
+			"/api/traces/{id}",
+			t.traceShow,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+// RegisterTraceApi registers the endpoints giving the last traces of the
+// graph mutations, the most recent first, the restricted users only
+// getting the traces of the elements they may read
+func RegisterTraceApi(s string, g *graph.Graph, recorder *common.TraceRecorder, r *shttp.Server) {
+	t := &TraceApi{
+		Service:    s,
+		Graph:      g,
+		Recorder:   recorder,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	t.registerEndpoints(r)
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// NodeWatchNamespace is the websocket namespace of the node watches
+const NodeWatchNamespace = "NodeWatch"
+
+const (
+	// nodes a watch may have pending
+	watchQueueSize = 1000
+	// timeout of a request without timeout parameter
+	defaultWatchTimeout = time.Minute
+)
+
+// parameters of GET /api/topology/nodes not being part of the filter
+var nodeQueryParams = map[string]bool{
+	"watch": true, "timeout": true, "limit": true, "offset": true, "sort": true, "fields": true,
+	"max_value_size": true,
+}
+
+// NodeWatch is a websocket watch of the nodes matching Filter, the matches
+// being sent as NodeWatchMatch messages until the watch is stopped with an
+// Unwatch message of the same ID
+type NodeWatch struct {
+	ID     string
+	Filter graph.Metadata `json:",omitempty"`
+}
+
+// NodeWatchMatch is a node matching the filter of a watch
+type NodeWatchMatch struct {
+	ID   string
+	Node *graph.Node
+}
+
+// parseNodeFilter returns the metadata filter of the query parameters, the
+// integers being compared as numbers, ie. ?Type=veth&MTU=1500
+func parseNodeFilter(query url.Values) (graph.Metadata, error) {
+	filter := graph.Metadata{}
+	for k, values := range query {
+		if nodeQueryParams[k] {
+			continue
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("Only one value allowed for %s", k)
+		}
+		if i, err := strconv.ParseInt(values[0], 10, 64); err == nil {
+			filter[k] = i
+		} else {
+			filter[k] = values[0]
+		}
+	}
+	return filter, nil
+}
+
+// lookupNodes returns the nodes matching the filter the user may read and
+// the revision of the graph they were looked up at
+func (t *TopologyApi) lookupNodes(filter graph.Metadata, user string) ([]interface{}, uint64) {
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	values := []interface{}{}
+	for _, n := range t.Graph.LookupNodes(filter) {
+		if !graph.Restricted(t.Authorizer, user) || t.Authorizer.CanReadNode(user, n) {
+			values = append(values, n)
+		}
+	}
+	return values, t.Graph.Revision()
+}
+
+// waitNodes waits for a node matching the filter the user may read, the
+// nodes matching once one appeared being returned along with the revision
+// of the graph
+func (t *TopologyApi) waitNodes(filter graph.Metadata, user string, timeout time.Duration) ([]interface{}, uint64, error) {
+	if values, revision := t.lookupNodes(filter, user); len(values) > 0 {
+		return values, revision, nil
+	}
+
+	waiter := t.Watcher.Watch(filter, watchQueueSize)
+	defer t.Watcher.Unwatch(waiter)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-waiter.C:
+			if !ok {
+				return nil, 0, errors.New("Watch aborted")
+			}
+			// the node may have been deleted or not be readable
+			if values, revision := t.lookupNodes(filter, user); len(values) > 0 {
+				return values, revision, nil
+			}
+		case <-deadline:
+			return nil, 0, nil
+		}
+	}
+}
+
+// nodesIndex returns the nodes matching the metadata filter of the query
+// parameters, ie. GET /api/topology/nodes?Type=veth&Name=eth0. With watch
+// the request blocks until a node matches, up to timeout, ie.
+// GET /api/topology/nodes?watch=true&timeout=60s&Name=eth0
+func (t *TopologyApi) nodesIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	query := r.URL.Query()
+
+	opts, err := parseListQuery(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	filter, err := parseNodeFilter(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var values []interface{}
+	var revision uint64
+	if watch, _ := strconv.ParseBool(query.Get("watch")); watch {
+		if len(filter) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("A metadata filter is required to watch"))
+			return
+		}
+
+		timeout := defaultWatchTimeout
+		if param := query.Get("timeout"); param != "" {
+			d, err := time.ParseDuration(param)
+			if err != nil || d <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid timeout: %s", param)))
+				return
+			}
+			timeout = d
+		}
+
+		if values, revision, err = t.waitNodes(filter, r.Username, timeout); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(values) == 0 {
+			w.WriteHeader(http.StatusRequestTimeout)
+			w.Write([]byte(fmt.Sprintf("No node matching within %s", timeout)))
+			return
+		}
+	} else {
+		values, revision = t.lookupNodes(filter, r.Username)
+	}
+
+	values, total, err := opts.Apply(values, graphSortKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	f := t.Filter.Select(opts.Fields).WithMaxValueSize(opts.MaxValueSize)
+	for i, v := range values {
+		values[i] = f.FilterValue(v)
+	}
+
+	opts.setHeaders(w, total)
+	setRevisionHeader(w, revision)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		panic(err)
+	}
+}
+
+// nodeWatchServer streams the nodes matching the filters of the watches of
+// the websocket clients
+type nodeWatchServer struct {
+	shttp.DefaultWSServerEventHandler
+	sync.Mutex
+	api     *TopologyApi
+	watches map[*shttp.WSClient]map[string]*graph.NodeWaiter
+}
+
+// forward sends the matches of a watch to the client until it's stopped
+func (s *nodeWatchServer) forward(c *shttp.WSClient, id string, waiter *graph.NodeWaiter) {
+	user := c.GetUsername()
+	for n := range waiter.C {
+		if graph.Restricted(s.api.Authorizer, user) {
+			s.api.Graph.RLock()
+			readable := s.api.Authorizer.CanReadNode(user, n)
+			s.api.Graph.RUnlock()
+
+			if !readable {
+				continue
+			}
+		}
+
+		c.SendWSMessage(shttp.WSMessage{
+			Namespace: NodeWatchNamespace,
+			Type:      "NodeWatchMatch",
+			Obj:       &NodeWatchMatch{ID: id, Node: s.api.Filter.FilterNode(n)},
+		})
+	}
+
+	// still registered, the watch was dropped as the client didn't keep up
+	s.Lock()
+	dropped := s.watches[c][id] == waiter
+	if dropped {
+		delete(s.watches[c], id)
+	}
+	s.Unlock()
+
+	if dropped {
+		c.SendWSMessage(shttp.WSMessage{Namespace: NodeWatchNamespace, Type: "WatchError", Obj: &NodeWatch{ID: id}, Error: "Watch dropped, too many pending nodes"})
+	}
+}
+
+func (s *nodeWatchServer) unwatch(c *shttp.WSClient, id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if waiter, ok := s.watches[c][id]; ok {
+		s.api.Watcher.Unwatch(waiter)
+		delete(s.watches[c], id)
+	}
+}
+
+func (s *nodeWatchServer) OnMessage(c *shttp.WSClient, m shttp.WSMessage) {
+	if m.Namespace != NodeWatchNamespace {
+		return
+	}
+
+	var watch NodeWatch
+	if err := m.DecodeObj(&watch); err != nil || watch.ID == "" {
+		logging.GetLogger().Errorf("Invalid node watch from %s: %v", c.GetHost(), m.Obj)
+		return
+	}
+
+	switch m.Type {
+	case "Watch":
+		if len(watch.Filter) == 0 {
+			c.SendWSMessage(shttp.WSMessage{Namespace: NodeWatchNamespace, Type: "WatchError", Obj: &watch, Error: "A metadata filter is required to watch"})
+			return
+		}
+
+		s.unwatch(c, watch.ID)
+		waiter := s.api.Watcher.Watch(watch.Filter, watchQueueSize)
+
+		s.Lock()
+		if _, ok := s.watches[c]; !ok {
+			s.watches[c] = make(map[string]*graph.NodeWaiter)
+		}
+		s.watches[c][watch.ID] = waiter
+		s.Unlock()
+
+		go s.forward(c, watch.ID, waiter)
+	case "Unwatch":
+		s.unwatch(c, watch.ID)
+	}
+}
+
+func (s *nodeWatchServer) OnUnregisterClient(c *shttp.WSClient) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, waiter := range s.watches[c] {
+		s.api.Watcher.Unwatch(waiter)
+	}
+	delete(s.watches, c)
+}
+
+func newNodeWatchServer(t *TopologyApi, server *shttp.WSServer) *nodeWatchServer {
+	s := &nodeWatchServer{
+		api:     t,
+		watches: make(map[*shttp.WSClient]map[string]*graph.NodeWaiter),
+	}
+	server.AddEventHandler(s)
+
+	return s
+}
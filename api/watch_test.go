@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func nodesRequest(ta *TopologyApi, query string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/api/topology/nodes?"+query, http.NoBody)
+	w := httptest.NewRecorder()
+	ta.nodesIndex(w, &auth.AuthenticatedRequest{Request: *r})
+	return w
+}
+
+func TestNodesIndex(t *testing.T) {
+	ta := &TopologyApi{Graph: newTestGraph(t)}
+
+	w := nodesRequest(ta, "Type=device&MTU=1500")
+	var nodes []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&nodes); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Request failed with %d: %v", w.Code, err)
+	}
+	if len(nodes) != 1 || nodes[0]["ID"] != "n1" {
+		t.Errorf("Expected n1, got %v", nodes)
+	}
+	if revision := w.Header().Get(RevisionHeader); revision != strconv.FormatUint(ta.Graph.Revision(), 10) {
+		t.Errorf("Wrong revision of the graph: %s", revision)
+	}
+
+	if w := nodesRequest(ta, "watch=true&timeout=10ms"); w.Code != http.StatusBadRequest {
+		t.Errorf("A watch without filter should be refused, got %d", w.Code)
+	}
+}
+
+func TestNodesWatch(t *testing.T) {
+	g := newTestGraph(t)
+	ta := &TopologyApi{Graph: g, Watcher: graph.NewNodeWatcher(g)}
+	ta.Watcher.Start()
+	defer ta.Watcher.Stop()
+
+	if w := nodesRequest(ta, "watch=true&timeout=10ms&Name=eth1"); w.Code != http.StatusRequestTimeout {
+		t.Errorf("Expected a timeout, got %d", w.Code)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		g.Lock()
+		g.NewNode(graph.Identifier("n4"), graph.Metadata{"Name": "eth1", "Type": "veth"})
+		g.Unlock()
+	}()
+
+	w := nodesRequest(ta, "watch=true&timeout=5s&Name=eth1")
+	var nodes []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&nodes); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Request failed with %d: %v", w.Code, err)
+	}
+	if len(nodes) != 1 || nodes[0]["ID"] != "n4" {
+		t.Errorf("Expected n4, got %v", nodes)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// WhatIfMutation is a change of the graph to simulate, the node or the edge
+// changed being given by its ID, the ID of the ones added being generated
+// if not given:
+//
+//	AddNode      Metadata, ID
+//	DelNode      ID
+//	AddEdge      Parent, Child, Metadata, ID
+//	DelEdge      ID
+//	SetMetadata  ID, Metadata
+//	AddMetadata  ID, Key, Value
+//	DelMetadata  ID, Key
+type WhatIfMutation struct {
+	Op       string
+	ID       string                 `json:",omitempty"`
+	Parent   string                 `json:",omitempty"`
+	Child    string                 `json:",omitempty"`
+	Key      string                 `json:",omitempty"`
+	Value    interface{}            `json:",omitempty"`
+	Metadata map[string]interface{} `json:",omitempty"`
+}
+
+// WhatIfDocument is the list of mutations to simulate, applied in order
+type WhatIfDocument struct {
+	Mutations []WhatIfMutation
+}
+
+func (m *WhatIfMutation) Validate() error {
+	missing := func(field string) error {
+		return fmt.Errorf("%s needs %s", m.Op, field)
+	}
+
+	switch m.Op {
+	case "AddNode":
+		if len(m.Metadata) == 0 {
+			return missing("Metadata")
+		}
+	case "AddEdge":
+		if m.Parent == "" || m.Child == "" {
+			return missing("Parent and Child")
+		}
+	case "DelNode", "DelEdge", "SetMetadata", "AddMetadata", "DelMetadata":
+		if m.ID == "" {
+			return missing("ID")
+		}
+		if m.Op == "SetMetadata" && m.Metadata == nil {
+			return missing("Metadata")
+		}
+		if (m.Op == "AddMetadata" || m.Op == "DelMetadata") && m.Key == "" {
+			return missing("Key")
+		}
+	default:
+		return fmt.Errorf("Unknown mutation: %s", m.Op)
+	}
+
+	return nil
+}
+
+// ParseWhatIfDocument parses a YAML, or JSON, list of mutations
+func ParseWhatIfDocument(data []byte) (*WhatIfDocument, error) {
+	doc := &WhatIfDocument{}
+	if err := decodeDocument(data, doc); err != nil {
+		return nil, err
+	}
+
+	if len(doc.Mutations) == 0 {
+		return nil, errors.New("No mutation to simulate")
+	}
+	for i := range doc.Mutations {
+		if err := doc.Mutations[i].Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid mutation %d: %s", i, err.Error())
+		}
+	}
+
+	return doc, nil
+}
+
+// WhatIfSimulator simulates mutations on a view of the graph, returning the
+// violations and the alerts resulting from them which the user may read
+type WhatIfSimulator interface {
+	WhatIf(mutations []WhatIfMutation, a graph.Authorizer, user string) (interface{}, error)
+}
+
+type WhatIfApi struct {
+	Service    string
+	Simulator  WhatIfSimulator
+	Authorizer graph.Authorizer
+}
+
+func (wi *WhatIfApi) whatIf(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	doc, err := ParseWhatIfDocument(data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	report, err := wi.Simulator.WhatIf(doc.Mutations, wi.Authorizer, r.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logging.GetLogger().Criticalf("Failed to display what-if report: %s", err.Error())
+	}
+}
+
+func (wi *WhatIfApi) registerEndpoints(r *shttp.Server) {
+	routes := []shttp.Route{
+		{
+			"WhatIf",
+			"POST",
+			"/api/whatif",
+			wi.whatIf,
+		},
+	}
+
+	r.RegisterRoutes(routes)
+}
+
+func RegisterWhatIfApi(s string, simulator WhatIfSimulator, r *shttp.Server) {
+	wi := &WhatIfApi{
+		Service:    s,
+		Simulator:  simulator,
+		Authorizer: graph.NewAuthorizerFromConfig(),
+	}
+
+	wi.registerEndpoints(r)
+}
@@ -23,31 +23,92 @@
 package agent
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 
 	"github.com/redhat-cip/skydive/agent"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
 
 	"github.com/spf13/cobra"
 )
 
+var checkProbes bool
+
+// runSelfTest reports whether the prerequisites of the configured probes
+// are met on the host, with a hint for the ones which are not, and returns
+// the exit status, 1 if one of them is not.
+func runSelfTest() int {
+	results, err := agent.CheckProbes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to check the probes: %s\n", err.Error())
+		return 1
+	}
+
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s:\n", name)
+		if len(results[name]) == 0 {
+			fmt.Println("  no prerequisite")
+		}
+		for _, c := range results[name] {
+			if c.Passed() {
+				fmt.Printf("  PASS %s\n", c.Name)
+			} else {
+				fmt.Printf("  FAIL %s: %s\n", c.Name, c.Error)
+				fmt.Printf("       hint: %s\n", c.Hint)
+			}
+		}
+	}
+
+	if probe.Failed(results) {
+		return 1
+	}
+	return 0
+}
+
+// SelfTest checks the prerequisites of the configured probes, then exits
+var SelfTest = &cobra.Command{
+	Use:          "self-test",
+	Short:        "Check the prerequisites of the probes on the host",
+	Long:         "Check the prerequisites of the configured probes on the host, exiting with 1 if one of them is not met",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(runSelfTest())
+	},
+}
+
 var Agent = &cobra.Command{
 	Use:          "agent",
 	Short:        "Skydive agent",
 	Long:         "Skydive agent",
 	SilenceUsage: true,
 	Run: func(cmd *cobra.Command, args []string) {
+		if checkProbes {
+			os.Exit(runSelfTest())
+		}
+
 		logging.GetLogger().Notice("Skydive Agent starting...")
 		agent := agent.NewAgent()
 		agent.Start()
 
 		logging.GetLogger().Notice("Skydive Agent started")
 		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-		<-ch
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+
+		// SIGUSR1 drains the agent before it gets restarted
+		for sig := <-ch; sig == syscall.SIGUSR1; sig = <-ch {
+			agent.Drain()
+		}
 
 		agent.Stop()
 
@@ -59,9 +120,14 @@ func init() {
 	Agent.Flags().String("listen", "127.0.0.1:8081", "address and port for the agent API")
 	config.GetConfig().BindPFlag("agent.listen", Agent.Flags().Lookup("listen"))
 
-	Agent.Flags().String("ovsdb", "127.0.0.1:6400", "ovsdb connection")
-	config.GetConfig().BindPFlag("ovs.ovsdb", Agent.Flags().Lookup("ovsdb"))
+	// the self-test checks the connection too
+	Agent.PersistentFlags().String("ovsdb", "127.0.0.1:6400", "ovsdb connection")
+	config.GetConfig().BindPFlag("ovs.ovsdb", Agent.PersistentFlags().Lookup("ovsdb"))
 
 	Agent.Flags().String("sflow-listen", "127.0.0.1:6345", "listen parameter for the sflow agent")
 	config.GetConfig().BindPFlag("sflow.listen", Agent.Flags().Lookup("sflow-listen"))
+
+	Agent.Flags().BoolVar(&checkProbes, "check", false, "check that the configured probes can run on the host, then exit, as the self-test command")
+
+	Agent.AddCommand(SelfTest)
 }
@@ -25,7 +25,7 @@ package client
 import (
 	"os"
 
-	"github.com/redhat-cip/skydive/api"
+	apiclient "github.com/redhat-cip/skydive/api/client"
 	"github.com/redhat-cip/skydive/logging"
 
 	"github.com/spf13/cobra"
@@ -37,6 +37,7 @@ var (
 	alertSelect      string
 	alertTest        string
 	alertAction      string
+	alertFor         string
 )
 
 var AlertCmd = &cobra.Command{
@@ -51,21 +52,19 @@ var AlertCreate = &cobra.Command{
 	Short: "Create alert",
 	Long:  "Create alert",
 	Run: func(cmd *cobra.Command, args []string) {
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
-			os.Exit(1)
-		}
-		alert := api.NewAlert()
+		client := newAPIClient()
+		alert := apiclient.NewAlert()
 		setFromFlag(cmd, "name", &alert.Name)
 		setFromFlag(cmd, "description", &alert.Description)
 		setFromFlag(cmd, "select", &alert.Select)
 		setFromFlag(cmd, "action", &alert.Action)
 		setFromFlag(cmd, "test", &alert.Test)
-		if err := client.Create("alert", &alert); err != nil {
+		setFromFlag(cmd, "for", &alert.For)
+		if err := client.CreateAlert(alert); err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		printJSON(&alert)
+		printJSON(alert)
 	},
 }
 
@@ -74,12 +73,8 @@ var AlertList = &cobra.Command{
 	Short: "List alerts",
 	Long:  "List alerts",
 	Run: func(cmd *cobra.Command, args []string) {
-		var alerts map[string]api.Alert
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
-			os.Exit(1)
-		}
-		if err := client.List("alert", &alerts); err != nil {
+		alerts, err := newAPIClient().ListAlerts()
+		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
@@ -98,13 +93,12 @@ var AlertGet = &cobra.Command{
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		var alert api.Alert
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if err := client.Get("alert", args[0], &alert); err != nil {
+		alert, err := newAPIClient().GetAlert(args[0])
+		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		printJSON(&alert)
+		printJSON(alert)
 	},
 }
 
@@ -119,11 +113,7 @@ var AlertDelete = &cobra.Command{
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
-			os.Exit(1)
-		}
-		if err := client.Delete("alert", args[0]); err != nil {
+		if err := newAPIClient().DeleteAlert(args[0]); err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
@@ -136,6 +126,7 @@ func addAlertFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&alertSelect, "select", "", "", "alert select criteria")
 	cmd.Flags().StringVarP(&alertTest, "test", "", "", "alert test")
 	cmd.Flags().StringVarP(&alertAction, "action", "", "", "alert action")
+	cmd.Flags().StringVarP(&alertFor, "for", "", "", "duration the test has to pass for, ie. 5m")
 }
 
 func init() {
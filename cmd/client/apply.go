@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+var (
+	applyFile   string
+	applyDryRun bool
+	exportOwner string
+)
+
+// ApplyCmd makes the captures, alerts and tracked paths of the owner of a
+// YAML document match it, exiting with an error if a change failed or
+// conflicted with a resource not owned.
+var ApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Apply a document of resources",
+	Long:  "Create, update and delete the resources of the owner of a YAML document so that they match it",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if applyFile == "" {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := ioutil.ReadFile(applyFile)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		report, err := newAPIClient().Apply(data, applyDryRun)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		printJSON(report)
+
+		if report.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+// ExportCmd prints the resources of an owner, all of them if not given, as
+// a YAML document which can be applied
+var ExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export resources as a document",
+	Long:  "Print the captures, alerts and tracked paths as a YAML document which can be applied",
+	Run: func(cmd *cobra.Command, args []string) {
+		doc, err := newAPIClient().Export(exportOwner)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		fmt.Print(string(data))
+	},
+}
+
+func init() {
+	ApplyCmd.Flags().StringVarP(&applyFile, "file", "f", "", "YAML document to apply")
+	ApplyCmd.Flags().BoolVarP(&applyDryRun, "dry-run", "", false, "only report the changes to make")
+
+	ExportCmd.Flags().StringVarP(&exportOwner, "owner", "", "", "owner of the exported resources, all the resources if not given")
+}
@@ -24,17 +24,29 @@ package client
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
 
-	"github.com/redhat-cip/skydive/api"
+	apiclient "github.com/redhat-cip/skydive/api/client"
 	"github.com/redhat-cip/skydive/logging"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	probePath string
-	bpfFilter string
+	probePath    string
+	bpfFilter    string
+	pcapDuration string
+	pcapMaxSize  int64
+	pcapOutput   string
+	fairness     string
+	flowBudget   int
+	totalBudget  int
+	watch        bool
 )
 
 var CaptureCmd = &cobra.Command{
@@ -55,16 +67,13 @@ var CaptureCreate = &cobra.Command{
 			os.Exit(1)
 		}
 
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
-			os.Exit(1)
-		}
-		capture := api.NewCapture(probePath, bpfFilter)
-		if err := client.Create("capture", &capture); err != nil {
+		capture := apiclient.NewCapture(probePath, bpfFilter)
+		capture.Fairness, capture.FlowBudget, capture.TotalBudget = fairness, flowBudget, totalBudget
+		if err := newAPIClient().CreateCapture(capture); err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		printJSON(&capture)
+		printJSON(capture)
 	},
 }
 
@@ -73,19 +82,72 @@ var CaptureList = &cobra.Command{
 	Short: "List captures",
 	Long:  "List captures",
 	Run: func(cmd *cobra.Command, args []string) {
-		var captures map[string]api.Capture
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
+		client := newAPIClient()
+
+		captures, err := client.ListCaptures()
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		if err := client.List("capture", &captures); err != nil {
+
+		if !watch {
+			printJSON(captures)
+			return
+		}
+
+		subscriber, err := client.NewCaptureStatsSubscriber(func(counters []*apiclient.CaptureCounters) {
+			// clear the screen
+			fmt.Print("\033[H\033[2J")
+			printCaptureCounters(os.Stdout, captures, counters)
+		})
+		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		printJSON(captures)
+		subscriber.Start()
+
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+
+		subscriber.Stop()
 	},
 }
 
+// printCaptureCounters renders the counters of the captures, a line per
+// host capturing, the captures without counters being shown with dashes
+func printCaptureCounters(w io.Writer, captures map[string]*apiclient.Capture, counters []*apiclient.CaptureCounters) {
+	byPath := make(map[string][]*apiclient.CaptureCounters)
+	for _, c := range counters {
+		byPath[c.ProbePath] = append(byPath[c.ProbePath], c)
+	}
+
+	paths := make([]string, 0, len(captures))
+	for path := range captures {
+		paths = append(paths, path)
+	}
+	// the captures created since the listing
+	for path := range byPath {
+		if _, ok := captures[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CAPTURE\tHOST\tNODE\tPACKETS\tBYTES\tFLOWS\tDROPS")
+	for _, path := range paths {
+		if len(byPath[path]) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\n", path)
+			continue
+		}
+		for _, c := range byPath[path] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", path, c.Host, c.NodeID, c.Packets, c.Bytes, c.Flows, c.Drops)
+		}
+	}
+	tw.Flush()
+}
+
 var CaptureGet = &cobra.Command{
 	Use:   "get [capture]",
 	Short: "Display capture",
@@ -97,13 +159,12 @@ var CaptureGet = &cobra.Command{
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		var capture api.Capture
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if err := client.Get("capture", args[0], &capture); err != nil {
+		capture, err := newAPIClient().GetCapture(args[0])
+		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
-		printJSON(&capture)
+		printJSON(capture)
 	},
 }
 
@@ -118,20 +179,101 @@ var CaptureDelete = &cobra.Command{
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		client := api.NewCrudClientFromConfig(&authenticationOpts)
-		if client == nil {
+		if err := newAPIClient().DeleteCapture(args[0]); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+// CaptureStream writes the packets captured live by the agent of the
+// interface returned by the query to the standard output as a pcap file,
+// until interrupted or the maximum duration or size of the agent reached.
+var CaptureStream = &cobra.Command{
+	Use:   "stream",
+	Short: "Stream a live raw pcap capture",
+	Long:  "Stream a live raw pcap capture to the standard output, ie. skydive client capture stream --query ... | wireshark -k -i -",
+	Run: func(cmd *cobra.Command, args []string) {
+		if gremlinQuery == "" {
+			fmt.Fprintln(os.Stderr, "You need to specify a query")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		pcap := &apiclient.Pcap{
+			GremlinQuery: gremlinQuery,
+			BPFFilter:    bpfFilter,
+			Duration:     pcapDuration,
+			MaxSize:      pcapMaxSize,
+		}
+		stream, err := newAPIClient().StreamPcap(pcap, os.Stdout)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		// the reader of the output going away ends the stream as well
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE)
+		go func() {
+			<-ch
+			stream.Stop()
+		}()
+
+		err = stream.Wait()
+		if dropped := stream.Dropped(); dropped > 0 {
+			logging.GetLogger().Warningf("%d packets dropped by the agent", dropped)
+		}
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+// CapturePcap downloads the packets captured by the agent of the interface
+// returned by the query, for at most the given duration and size.
+var CapturePcap = &cobra.Command{
+	Use:   "pcap",
+	Short: "Download a raw pcap capture",
+	Long:  "Download a raw pcap capture",
+	Run: func(cmd *cobra.Command, args []string) {
+		if gremlinQuery == "" || pcapOutput == "" {
+			fmt.Println("You need to specify a query and an output file")
+			cmd.Usage()
 			os.Exit(1)
 		}
-		if err := client.Delete("capture", args[0]); err != nil {
+
+		client := newAPIClient()
+
+		f, err := os.Create(pcapOutput)
+		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
+		defer f.Close()
+
+		pcap := &apiclient.Pcap{
+			GremlinQuery: gremlinQuery,
+			BPFFilter:    bpfFilter,
+			Duration:     pcapDuration,
+			MaxSize:      pcapMaxSize,
+		}
+		if _, err := client.DownloadPcap(pcap, f); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			f.Close()
+			os.Remove(pcapOutput)
+			os.Exit(1)
+		}
 	},
 }
 
 func addCaptureFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&probePath, "probepath", "", "", "probe path")
 	cmd.Flags().StringVarP(&bpfFilter, "bpf", "", "", "BPF filter")
+	cmd.Flags().StringVarP(&fairness, "fairness", "", "", "sampling fairness, per-flow to only count the samples of a flow beyond its budget")
+	cmd.Flags().IntVarP(&flowBudget, "flow-budget", "", 0, "samples decoded per flow and per update interval with fairness, budget of the agent by default")
+	cmd.Flags().IntVarP(&totalBudget, "total-budget", "", 0, "samples decoded for all the flows per update interval with fairness, budget of the agent by default")
 }
 
 func init() {
@@ -139,6 +281,21 @@ func init() {
 	CaptureCmd.AddCommand(CaptureCreate)
 	CaptureCmd.AddCommand(CaptureGet)
 	CaptureCmd.AddCommand(CaptureDelete)
+	CaptureCmd.AddCommand(CapturePcap)
+	CaptureCmd.AddCommand(CaptureStream)
 
 	addCaptureFlags(CaptureCreate)
+
+	CaptureList.Flags().BoolVarP(&watch, "watch", "w", false, "render the live counters of the captures, until interrupted")
+
+	CapturePcap.Flags().StringVarP(&gremlinQuery, "query", "", "", "Gremlin query returning the captured interface")
+	CapturePcap.Flags().StringVarP(&bpfFilter, "bpf", "", "", "BPF filter")
+	CapturePcap.Flags().StringVarP(&pcapDuration, "duration", "", "", "capture duration, ie. 30s, maximum of the agent by default")
+	CapturePcap.Flags().Int64VarP(&pcapMaxSize, "max-size", "", 0, "maximum size in bytes, maximum of the agent by default")
+	CapturePcap.Flags().StringVarP(&pcapOutput, "output", "o", "", "output pcap file")
+
+	CaptureStream.Flags().StringVarP(&gremlinQuery, "query", "", "", "Gremlin query returning the captured interface")
+	CaptureStream.Flags().StringVarP(&bpfFilter, "bpf", "", "", "BPF filter")
+	CaptureStream.Flags().StringVarP(&pcapDuration, "duration", "", "", "maximum capture duration, ie. 30s, maximum of the agent by default")
+	CaptureStream.Flags().Int64VarP(&pcapMaxSize, "max-size", "", 0, "maximum size in bytes, maximum of the agent by default")
 }
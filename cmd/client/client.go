@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"os"
 
+	apiclient "github.com/redhat-cip/skydive/api/client"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/spf13/cobra"
@@ -52,6 +53,19 @@ func printJSON(obj interface{}) {
 	fmt.Println(string(s))
 }
 
+// newAPIClient returns the client of the analyzer of the configuration
+func newAPIClient() *apiclient.Client {
+	client, err := apiclient.NewClientFromConfig(apiclient.Options{
+		Username: authenticationOpts.Username,
+		Password: authenticationOpts.Password,
+	})
+	if err != nil {
+		logging.GetLogger().Errorf(err.Error())
+		os.Exit(1)
+	}
+	return client
+}
+
 func setFromFlag(cmd *cobra.Command, flag string, value *string) {
 	if flag := cmd.LocalFlags().Lookup(flag); flag.Changed {
 		*value = flag.Value.String()
@@ -63,6 +77,10 @@ func init() {
 	Client.PersistentFlags().StringVarP(&authenticationOpts.Password, "password", "", os.Getenv("SKYDIVE_PASSWORD"), "password auth parameter")
 
 	Client.AddCommand(AlertCmd)
+	Client.AddCommand(ApplyCmd)
 	Client.AddCommand(CaptureCmd)
+	Client.AddCommand(ExportCmd)
+	Client.AddCommand(PathCmd)
 	Client.AddCommand(TopologyCmd)
+	Client.AddCommand(WhatIfCmd)
 }
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"os"
+
+	apiclient "github.com/redhat-cip/skydive/api/client"
+	"github.com/redhat-cip/skydive/logging"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pathName      string
+	pathSrc       string
+	pathDst       string
+	pathRelations []string
+)
+
+var PathCmd = &cobra.Command{
+	Use:          "path",
+	Short:        "Manage tracked paths",
+	Long:         "Manage tracked paths",
+	SilenceUsage: false,
+}
+
+var PathTrack = &cobra.Command{
+	Use:   "track",
+	Short: "Track the path between two nodes",
+	Long:  "Track the shortest path between the nodes returned by two Gremlin queries",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if pathSrc == "" || pathDst == "" {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		path := apiclient.NewTrackedPath()
+		path.Name = pathName
+		path.Src = pathSrc
+		path.Dst = pathDst
+		path.Relations = pathRelations
+		if err := newAPIClient().TrackPath(path); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		printJSON(path)
+	},
+}
+
+var PathList = &cobra.Command{
+	Use:   "list",
+	Short: "List tracked paths",
+	Long:  "List the current state and hops of the tracked paths",
+	Run: func(cmd *cobra.Command, args []string) {
+		states, err := newAPIClient().ListPathStates()
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		printJSON(states)
+	},
+}
+
+var PathGet = &cobra.Command{
+	Use:   "get [path]",
+	Short: "Display tracked path",
+	Long:  "Display the current state and hops of a tracked path",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		state, err := newAPIClient().GetPathState(args[0])
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+		printJSON(state)
+	},
+}
+
+var PathDelete = &cobra.Command{
+	Use:   "delete [path]",
+	Short: "Stop tracking path",
+	Long:  "Stop tracking path",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := newAPIClient().DeletePath(args[0]); err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	PathCmd.AddCommand(PathTrack)
+	PathCmd.AddCommand(PathList)
+	PathCmd.AddCommand(PathGet)
+	PathCmd.AddCommand(PathDelete)
+
+	PathTrack.Flags().StringVarP(&pathName, "name", "", "", "path name")
+	PathTrack.Flags().StringVarP(&pathSrc, "src", "", "", "Gremlin query returning the source node")
+	PathTrack.Flags().StringVarP(&pathDst, "dst", "", "", "Gremlin query returning the destination node")
+	PathTrack.Flags().StringSliceVarP(&pathRelations, "relations", "", nil, "relation types of the edges followed, the configured ones if not given")
+}
@@ -23,20 +23,28 @@
 package client
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"github.com/redhat-cip/skydive/api"
-	shttp "github.com/redhat-cip/skydive/http"
+	apiclient "github.com/redhat-cip/skydive/api/client"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
 )
 
 var (
 	gremlinQuery string
+	listLimit    int
+	listOffset   int
+	listSort     string
+	listFields   string
+	waitTimeout  string
 )
 
 var TopologyCmd = &cobra.Command{
@@ -51,46 +59,172 @@ var TopologyRequest = &cobra.Command{
 	Short: "query topology",
 	Long:  "query topology",
 	Run: func(cmd *cobra.Command, args []string) {
-		client := shttp.NewRestClientFromConfig(&authenticationOpts)
-
-		gq := api.Topology{GremlinQuery: gremlinQuery}
-		s, err := json.Marshal(gq)
+		var values interface{}
+		total, err := newAPIClient().Query(gremlinQuery, listOptions(), &values)
 		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
 
-		contentReader := bytes.NewReader(s)
+		printJSON(&values)
+		printTotal(total, values)
+	},
+}
 
-		resp, err := client.Request("GET", "api/topology", contentReader)
+// TopologyWait waits for a node matching a metadata filter, ie. an
+// interface being provisioned, the command failing on timeout.
+var TopologyWait = &cobra.Command{
+	Use:   "wait",
+	Short: "wait for a node",
+	Long:  "wait for a node matching a metadata filter, ie. --query Name=eth0,Type=veth",
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := graph.Metadata{}
+		for _, kv := range strings.Split(gremlinQuery, ",") {
+			if kv = strings.TrimSpace(kv); kv == "" {
+				continue
+			}
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				logging.GetLogger().Errorf("Invalid filter %s, expected Key=Value", kv)
+				os.Exit(1)
+			}
+			filter[parts[0]] = parts[1]
+		}
+		if len(filter) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		timeout, err := time.ParseDuration(waitTimeout)
+		if err != nil {
+			logging.GetLogger().Errorf("Invalid timeout %s: %s", waitTimeout, err.Error())
+			os.Exit(1)
+		}
+
+		nodes, err := newAPIClient().WaitNodes(filter, timeout)
 		if err != nil {
 			logging.GetLogger().Errorf(err.Error())
 			os.Exit(1)
 		}
 
-		if resp.StatusCode != 200 {
-			data, _ := ioutil.ReadAll(resp.Body)
-			logging.GetLogger().Errorf("%s: %s", resp.Status, string(data))
+		printJSON(nodes)
+	},
+}
+
+// TopologyLoad queries a graph dumped by an agent, loaded in a local memory
+// graph, the whole graph being printed without query.
+var TopologyLoad = &cobra.Command{
+	Use:   "load <file>",
+	Short: "query a topology dump",
+	Long:  "query a topology dump",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
 			os.Exit(1)
 		}
 
-		var values interface{}
-		err = json.NewDecoder(resp.Body).Decode(&values)
+		g, err := loadGraph(args[0])
 		if err != nil {
-			logging.GetLogger().Errorf("Unable to decode response: %s", err.Error())
+			logging.GetLogger().Errorf("Unable to load %s: %s", args[0], err.Error())
 			os.Exit(1)
 		}
 
-		printJSON(&values)
+		if gremlinQuery == "" {
+			printJSON(g)
+			return
+		}
+
+		tr := graph.NewGremlinTraversalParser(strings.NewReader(gremlinQuery), g)
+		tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
+
+		ts, err := tr.Parse()
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		res, err := ts.Exec()
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		printJSON(res.Values())
 	},
 }
 
+func loadGraph(path string) (*graph.Graph, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot graph.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+
+	backend, err := graph.NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := graph.NewGraph(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	g.Lock()
+	g.MergeSnapshot(&snapshot)
+	g.Unlock()
+
+	return g, nil
+}
+
+// listOptions returns the pagination, sorting and field selection options
+func listOptions() *apiclient.ListOptions {
+	opts := &apiclient.ListOptions{
+		Limit:  listLimit,
+		Offset: listOffset,
+		Sort:   listSort,
+	}
+	for _, field := range strings.Split(listFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			opts.Fields = append(opts.Fields, field)
+		}
+	}
+	return opts
+}
+
+// printTotal reports on stderr when only a page of the results was returned
+func printTotal(total int, values interface{}) {
+	items, ok := values.([]interface{})
+	if ok && total > len(items) {
+		fmt.Fprintf(os.Stderr, "%d results out of %d, offset %d\n", len(items), total, listOffset)
+	}
+}
+
+func addListFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&listLimit, "limit", "", 0, "maximum number of results, server default if not set")
+	cmd.Flags().IntVarP(&listOffset, "offset", "", 0, "number of results to skip")
+	cmd.Flags().StringVarP(&listSort, "sort", "", "", "sort key, prefixed by '-' for a descending order")
+	cmd.Flags().StringVarP(&listFields, "fields", "", "", "comma separated list of metadata keys to return")
+}
+
 func addTopologyFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&gremlinQuery, "query", "", "", "Gremlin Query")
+	addListFlags(cmd)
 }
 
 func init() {
 	TopologyCmd.AddCommand(TopologyRequest)
 
 	addTopologyFlags(TopologyRequest)
+
+	TopologyCmd.AddCommand(TopologyWait)
+	TopologyWait.Flags().StringVarP(&gremlinQuery, "query", "", "", "metadata filter, ie. Name=eth0,Type=veth")
+	TopologyWait.Flags().StringVarP(&waitTimeout, "timeout", "", "60s", "maximum time to wait for the node")
+
+	TopologyCmd.AddCommand(TopologyLoad)
+	TopologyLoad.Flags().StringVarP(&gremlinQuery, "query", "", "", "Gremlin Query")
 }
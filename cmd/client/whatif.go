@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+var whatIfFile string
+
+// WhatIfCmd simulates the mutations of a YAML document on a view of the
+// graph, exiting with an error if an alert would start to fire
+var WhatIfCmd = &cobra.Command{
+	Use:   "whatif",
+	Short: "Simulate topology changes",
+	Long:  "Report the violations and the alerts resulting from the mutations of a YAML document, without touching the topology",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if whatIfFile == "" {
+			cmd.Usage()
+			os.Exit(1)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := ioutil.ReadFile(whatIfFile)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		report, err := newAPIClient().WhatIf(data)
+		if err != nil {
+			logging.GetLogger().Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		printJSON(report)
+
+		if report.Firing() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	WhatIfCmd.Flags().StringVarP(&whatIfFile, "file", "f", "", "YAML document of the mutations to simulate")
+}
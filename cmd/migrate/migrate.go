@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/history"
+	"github.com/redhat-cip/skydive/topology/migration"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	dryRun     bool
+	reportPath string
+	identities []string
+)
+
+// Migrate migrates the graph and the history of the configured backends
+// from the hostname keyed nodes to the IDs derived by the agents
+var Migrate = &cobra.Command{
+	Use:          "migrate",
+	Short:        "Migrate the topology to the deterministic node IDs",
+	Long:         "Migrate the nodes of the configured graph backend and history keyed by the hostnames of the agents to the IDs derived from their identity and their metadata",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		ids := make(map[string]string)
+		for _, identity := range identities {
+			kv := strings.SplitN(identity, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				logging.GetLogger().Fatalf("Wrong identity %s, expected hostname=identity", identity)
+			}
+			ids[kv[0]] = kv[1]
+		}
+
+		if backend := config.GetConfig().GetString("graph.backend"); backend == "" || backend == "memory" {
+			logging.GetLogger().Warning("The memory graph backend isn't persisted, only the history will be migrated")
+		}
+
+		backend, err := graph.BackendFromConfig()
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't open the graph backend: %s", err.Error())
+		}
+
+		g, err := graph.NewGraph(backend)
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't open the graph: %s", err.Error())
+		}
+		defer g.Close()
+
+		storage, err := history.NewStorageFromConfig()
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't open the history: %s", err.Error())
+		}
+
+		previous, err := migration.ReadReport(reportPath)
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't read the report of the previous migration: %s", err.Error())
+		}
+
+		m := &migration.Migrator{Graph: g, Identities: ids, Previous: previous, DryRun: dryRun}
+		if storage != nil {
+			m.History = storage
+			defer storage.Close()
+		}
+
+		report, migrateErr := m.Migrate()
+		if report == nil {
+			logging.GetLogger().Fatalf("Migration failed: %s", migrateErr.Error())
+		}
+
+		for _, u := range report.Unmigrated {
+			fmt.Printf("Not migrated: %s %s %s on %s: %s\n", u.ID, u.Type, u.Name, u.Host, u.Reason)
+		}
+		fmt.Printf("%d nodes, %d edges and %d history elements migrated, %d nodes to be handled manually\n",
+			len(report.Nodes), len(report.Edges), report.Changes, len(report.Unmigrated))
+
+		if !dryRun {
+			if previous != nil {
+				report.Merge(previous)
+			}
+			if err := migration.WriteReport(reportPath, report); err != nil {
+				logging.GetLogger().Fatalf("Can't write the migration report: %s", err.Error())
+			}
+		}
+
+		if migrateErr != nil {
+			logging.GetLogger().Errorf("Migration failed, to be run again: %s", migrateErr.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	Migrate.Flags().BoolVarP(&dryRun, "dry-run", "", false, "only report the IDs to be migrated")
+	Migrate.Flags().StringVarP(&reportPath, "report", "", "skydive-migration.json", "mapping report, the one of a previous run being kept")
+	Migrate.Flags().StringSliceVarP(&identities, "identity", "", nil, "identity of the agent of a hostname, as hostname=identity, its hostname by default")
+}
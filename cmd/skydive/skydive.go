@@ -29,6 +29,7 @@ import (
 	"github.com/redhat-cip/skydive/cmd/agent"
 	"github.com/redhat-cip/skydive/cmd/analyzer"
 	"github.com/redhat-cip/skydive/cmd/client"
+	"github.com/redhat-cip/skydive/cmd/migrate"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/version"
 
@@ -75,5 +76,6 @@ func main() {
 	rootCmd.AddCommand(agent.Agent)
 	rootCmd.AddCommand(analyzer.Analyzer)
 	rootCmd.AddCommand(client.Client)
+	rootCmd.AddCommand(migrate.Migrate)
 	rootCmd.Execute()
 }
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Topics of the events published on the bus
+const (
+	GraphTopic   = "graph"
+	FlowTopic    = "flow"
+	CaptureTopic = "capture"
+	ProbeTopic   = "probe"
+	AgentTopic   = "agent"
+	PathTopic    = "path"
+)
+
+// BusEvent is an event published on a topic of the bus, its object is
+// shared by all the subscribers which must not modify it.
+type BusEvent struct {
+	Topic string
+	Type  string
+	Obj   interface{}
+}
+
+// BusSubscriber consumes the events of the topics it subscribed to
+type BusSubscriber interface {
+	OnBusEvent(e *BusEvent)
+}
+
+// BusDropListener is implemented by the subscribers wanting to know that
+// they missed events, it is called before the next delivered event.
+type BusDropListener interface {
+	OnBusEventsDropped(count int64)
+}
+
+// BusSubscription delivers the events to a subscriber from its own
+// goroutine, through a bounded queue.
+type BusSubscription struct {
+	Name       string
+	topics     []string
+	subscriber BusSubscriber
+	queue      chan *BusEvent
+	lock       sync.Mutex
+	drained    *sync.Cond
+	pending    int
+	missed     int64
+	delivered  int64
+	dropped    int64
+	quit       chan struct{}
+	wg         sync.WaitGroup
+}
+
+type BusStats struct {
+	Topics    []string
+	Queued    int
+	Delivered int64
+	Dropped   int64
+}
+
+// Bus is a publish/subscribe bus between the components, ie. the graph
+// events consumed by the websocket servers and the alerts.
+//
+// Ordering: the publications are serialized, each subscriber gets the
+// events of all its topics in the order they were published.
+//
+// Back-pressure: publishing never blocks. Each subscriber has a bounded
+// queue, when it is full the oldest queued event is dropped so that the
+// subscriber catches up with the latest events. Drops are counted in the
+// metrics and reported to the subscribers implementing BusDropListener,
+// which have to recover from the loss, ie. the graph server asking its
+// clients to sync again.
+type Bus struct {
+	sync.RWMutex
+	subscriptions map[string][]*BusSubscription
+}
+
+// DefaultBus is the bus of the process
+var DefaultBus = NewBus()
+
+func init() {
+	RegisterMetrics("bus", DefaultBus.Metrics)
+}
+
+// push queues the event, dropping the oldest queued event when full
+func (s *BusSubscription) push(e *BusEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending++
+	for {
+		select {
+		case s.queue <- e:
+			return
+		default:
+		}
+
+		select {
+		case <-s.queue:
+			s.pending--
+			atomic.AddInt64(&s.missed, 1)
+			atomic.AddInt64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+func (s *BusSubscription) done() {
+	s.lock.Lock()
+	s.pending--
+	if s.pending == 0 {
+		s.drained.Broadcast()
+	}
+	s.lock.Unlock()
+}
+
+func (s *BusSubscription) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case e := <-s.queue:
+			if n := atomic.SwapInt64(&s.missed, 0); n > 0 {
+				if l, ok := s.subscriber.(BusDropListener); ok {
+					l.OnBusEventsDropped(n)
+				}
+			}
+
+			s.subscriber.OnBusEvent(e)
+			atomic.AddInt64(&s.delivered, 1)
+			s.done()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Flush waits for the queued events to be delivered, it must not be called
+// by the subscriber itself.
+func (s *BusSubscription) Flush() {
+	s.lock.Lock()
+	for s.pending > 0 {
+		s.drained.Wait()
+	}
+	s.lock.Unlock()
+}
+
+func (s *BusSubscription) Stats() BusStats {
+	s.lock.Lock()
+	queued := s.pending
+	s.lock.Unlock()
+
+	topics := make([]string, len(s.topics))
+	copy(topics, s.topics)
+	sort.Strings(topics)
+
+	return BusStats{
+		Topics:    topics,
+		Queued:    queued,
+		Delivered: atomic.LoadInt64(&s.delivered),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// Subscribe delivers the events of the topics to the subscriber, at most
+// size events being queued.
+func (b *Bus) Subscribe(name string, size int, subscriber BusSubscriber, topics ...string) *BusSubscription {
+	if size < 1 {
+		size = 1
+	}
+
+	s := &BusSubscription{
+		Name:       name,
+		topics:     topics,
+		subscriber: subscriber,
+		queue:      make(chan *BusEvent, size),
+		quit:       make(chan struct{}),
+	}
+	s.drained = sync.NewCond(&s.lock)
+
+	s.wg.Add(1)
+	go s.run()
+
+	b.Lock()
+	for _, topic := range topics {
+		b.subscriptions[topic] = append(b.subscriptions[topic], s)
+	}
+	b.Unlock()
+
+	return s
+}
+
+// Unsubscribe stops the deliveries, the queued events are discarded
+func (b *Bus) Unsubscribe(s *BusSubscription) {
+	b.Lock()
+	for _, topic := range s.topics {
+		subscriptions := b.subscriptions[topic]
+		for i, sub := range subscriptions {
+			if sub == s {
+				b.subscriptions[topic] = append(subscriptions[:i], subscriptions[i+1:]...)
+				break
+			}
+		}
+		if len(b.subscriptions[topic]) == 0 {
+			delete(b.subscriptions, topic)
+		}
+	}
+	b.Unlock()
+
+	close(s.quit)
+	s.wg.Wait()
+
+	s.lock.Lock()
+	s.pending = 0
+	s.drained.Broadcast()
+	s.lock.Unlock()
+}
+
+// HasSubscribers returns whether events of the topic would be delivered,
+// so that publishers can avoid building them.
+func (b *Bus) HasSubscribers(topic string) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.subscriptions[topic]) > 0
+}
+
+func (b *Bus) Publish(topic string, eventType string, obj interface{}) {
+	e := &BusEvent{Topic: topic, Type: eventType, Obj: obj}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for _, s := range b.subscriptions[topic] {
+		s.push(e)
+	}
+}
+
+// Metrics returns the statistics of the subscriptions by name
+func (b *Bus) Metrics() interface{} {
+	b.RLock()
+	defer b.RUnlock()
+
+	metrics := make(map[string]BusStats)
+	for _, subscriptions := range b.subscriptions {
+		for _, s := range subscriptions {
+			metrics[s.Name] = s.Stats()
+		}
+	}
+
+	return metrics
+}
+
+func NewBus() *Bus {
+	return &Bus{subscriptions: make(map[string][]*BusSubscription)}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type busRecorder struct {
+	sync.Mutex
+	events  []*BusEvent
+	dropped int64
+	block   chan struct{}
+}
+
+func (r *busRecorder) OnBusEvent(e *BusEvent) {
+	if r.block != nil {
+		<-r.block
+	}
+
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+func (r *busRecorder) OnBusEventsDropped(count int64) {
+	r.Lock()
+	r.dropped += count
+	r.Unlock()
+}
+
+func (r *busRecorder) objs() []interface{} {
+	r.Lock()
+	defer r.Unlock()
+
+	var objs []interface{}
+	for _, e := range r.events {
+		objs = append(objs, e.Obj)
+	}
+	return objs
+}
+
+func TestBusOrdering(t *testing.T) {
+	bus := NewBus()
+
+	r := &busRecorder{}
+	s := bus.Subscribe("test", 1000, r, GraphTopic, FlowTopic)
+	defer bus.Unsubscribe(s)
+
+	var wg sync.WaitGroup
+	for _, topic := range []string{GraphTopic, FlowTopic} {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				bus.Publish(topic, "Event", i)
+			}
+		}(topic)
+	}
+	wg.Wait()
+
+	bus.Publish(CaptureTopic, "Event", -1)
+	s.Flush()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.events) != 200 {
+		t.Fatalf("Expected 200 events, got %d", len(r.events))
+	}
+
+	last := map[string]int{GraphTopic: -1, FlowTopic: -1}
+	for _, e := range r.events {
+		if e.Obj.(int) != last[e.Topic]+1 {
+			t.Fatalf("Event %d of %s delivered after %d", e.Obj, e.Topic, last[e.Topic])
+		}
+		last[e.Topic] = e.Obj.(int)
+	}
+}
+
+func TestBusBackPressure(t *testing.T) {
+	bus := NewBus()
+
+	r := &busRecorder{block: make(chan struct{})}
+	s := bus.Subscribe("test", 2, r, GraphTopic)
+	defer bus.Unsubscribe(s)
+
+	// the first event is taken by the subscriber, which blocks, the
+	// following ones fill the queue
+	bus.Publish(GraphTopic, "Event", 0)
+	for len(s.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= 5; i++ {
+		bus.Publish(GraphTopic, "Event", i)
+	}
+
+	if stats := s.Stats(); stats.Dropped != 3 || stats.Queued != 3 {
+		t.Errorf("Expected 3 dropped and 3 queued events, got %+v", stats)
+	}
+
+	close(r.block)
+	s.Flush()
+
+	objs := r.objs()
+	if len(objs) != 3 || objs[0] != 0 || objs[1] != 4 || objs[2] != 5 {
+		t.Errorf("Expected the oldest events to be dropped, got %v", objs)
+	}
+
+	if r.dropped != 3 {
+		t.Errorf("Expected the subscriber to be notified of 3 drops, got %d", r.dropped)
+	}
+
+	stats := bus.Metrics().(map[string]BusStats)["test"]
+	if stats.Delivered != 3 || stats.Dropped != 3 || stats.Queued != 0 {
+		t.Errorf("Wrong metrics: %+v", stats)
+	}
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	bus := NewBus()
+
+	r := &busRecorder{}
+	s := bus.Subscribe("test", 10, r, ProbeTopic)
+
+	if !bus.HasSubscribers(ProbeTopic) || bus.HasSubscribers(GraphTopic) {
+		t.Fatal("Wrong subscribers")
+	}
+
+	bus.Publish(ProbeTopic, "Event", 1)
+	s.Flush()
+
+	bus.Unsubscribe(s)
+	bus.Publish(ProbeTopic, "Event", 2)
+
+	if bus.HasSubscribers(ProbeTopic) {
+		t.Error("Subscription should have been removed")
+	}
+
+	if objs := r.objs(); len(objs) != 1 || objs[0] != 1 {
+		t.Errorf("Expected only the event published before unsubscribing, got %v", objs)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EvictedSize = "size"
+	EvictedAge  = "age"
+)
+
+type boundedCacheEntry struct {
+	value interface{}
+	time  time.Time
+}
+
+// BoundedCache is a map bounded in size and in age, used by the probes to keep
+// pending data, ie. relationships waiting for a node to show up.
+type BoundedCache struct {
+	sync.RWMutex
+	Name      string
+	MaxSize   int
+	MaxAge    time.Duration
+	OnEvict   func(key interface{}, value interface{}, reason string)
+	Formatter func(value interface{}) interface{}
+	Clock     Clock
+	entries   map[interface{}]*boundedCacheEntry
+	evictions int64
+}
+
+type BoundedCacheStats struct {
+	Size      int
+	MaxSize   int
+	MaxAge    int64
+	Evictions int64
+}
+
+type BoundedCacheEntry struct {
+	Value interface{}
+	Age   int64
+}
+
+var caches = struct {
+	sync.RWMutex
+	m map[string]*BoundedCache
+}{m: make(map[string]*BoundedCache)}
+
+func (c *BoundedCache) evict(key interface{}, e *boundedCacheEntry, reason string) {
+	delete(c.entries, key)
+	c.evictions++
+
+	if c.OnEvict != nil {
+		c.OnEvict(key, e.value, reason)
+	}
+}
+
+func (c *BoundedCache) expire(now time.Time) {
+	if c.MaxAge <= 0 {
+		return
+	}
+
+	for k, e := range c.entries {
+		if now.Sub(e.time) > c.MaxAge {
+			c.evict(k, e, EvictedAge)
+		}
+	}
+}
+
+func (c *BoundedCache) evictOldest() {
+	var oldestKey interface{}
+	var oldest *boundedCacheEntry
+
+	for k, e := range c.entries {
+		if oldest == nil || e.time.Before(oldest.time) {
+			oldestKey, oldest = k, e
+		}
+	}
+
+	if oldest != nil {
+		c.evict(oldestKey, oldest, EvictedSize)
+	}
+}
+
+// Set adds or replaces an entry. Expired entries are evicted first then the
+// oldest one if the cache is still full. OnEvict is called with the cache
+// locked so it must not call back the cache.
+func (c *BoundedCache) Set(key interface{}, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.Clock.Now()
+	c.expire(now)
+
+	if _, ok := c.entries[key]; !ok && c.MaxSize > 0 {
+		for len(c.entries) >= c.MaxSize {
+			c.evictOldest()
+		}
+	}
+
+	c.entries[key] = &boundedCacheEntry{value: value, time: now}
+}
+
+// Get returns the value of an entry, the expired entries being ignored even
+// if not evicted yet.
+func (c *BoundedCache) Get(key interface{}) (interface{}, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if e, ok := c.entries[key]; ok && (c.MaxAge <= 0 || c.Clock.Now().Sub(e.time) <= c.MaxAge) {
+		return e.value, true
+	}
+	return nil, false
+}
+
+func (c *BoundedCache) Del(key interface{}) {
+	c.Lock()
+	delete(c.entries, key)
+	c.Unlock()
+}
+
+func (c *BoundedCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.entries)
+}
+
+func (c *BoundedCache) Evictions() int64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.evictions
+}
+
+func (c *BoundedCache) Stats() BoundedCacheStats {
+	c.RLock()
+	defer c.RUnlock()
+
+	return BoundedCacheStats{
+		Size:      len(c.entries),
+		MaxSize:   c.MaxSize,
+		MaxAge:    int64(c.MaxAge.Seconds()),
+		Evictions: c.evictions,
+	}
+}
+
+// Dump returns the content of the cache, values are passed through the
+// Formatter if any.
+func (c *BoundedCache) Dump() map[string]BoundedCacheEntry {
+	c.RLock()
+	defer c.RUnlock()
+
+	now := c.Clock.Now()
+
+	dump := make(map[string]BoundedCacheEntry)
+	for k, e := range c.entries {
+		v := e.value
+		if c.Formatter != nil {
+			v = c.Formatter(v)
+		}
+		dump[fmt.Sprintf("%v", k)] = BoundedCacheEntry{Value: v, Age: int64(now.Sub(e.time).Seconds())}
+	}
+
+	return dump
+}
+
+func NewBoundedCache(name string, maxSize int, maxAge time.Duration) *BoundedCache {
+	return &BoundedCache{
+		Name:    name,
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		Clock:   RealClock{},
+		entries: make(map[interface{}]*boundedCacheEntry),
+	}
+}
+
+func cacheMetrics() interface{} {
+	stats := make(map[string]BoundedCacheStats)
+	for _, c := range GetCaches("") {
+		stats[c.Name] = c.Stats()
+	}
+	return stats
+}
+
+func init() {
+	RegisterMetrics("caches", cacheMetrics)
+}
+
+// RegisterCache makes the cache visible through the cache metrics and debug API.
+func RegisterCache(c *BoundedCache) {
+	caches.Lock()
+	caches.m[c.Name] = c
+	caches.Unlock()
+}
+
+func UnregisterCache(c *BoundedCache) {
+	caches.Lock()
+	if caches.m[c.Name] == c {
+		delete(caches.m, c.Name)
+	}
+	caches.Unlock()
+}
+
+// GetCaches returns the registered caches whose name starts with the
+// given prefix, all of them if the prefix is empty.
+func GetCaches(prefix string) []*BoundedCache {
+	caches.RLock()
+	defer caches.RUnlock()
+
+	var result []*BoundedCache
+	for name, c := range caches.m {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
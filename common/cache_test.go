@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBoundedCacheSize(t *testing.T) {
+	var evicted []interface{}
+
+	clock := NewFakeClock(time.Now())
+
+	c := NewBoundedCache("test/size", 2, 0)
+	c.Clock = clock
+	c.OnEvict = func(key interface{}, value interface{}, reason string) {
+		if reason != EvictedSize {
+			t.Errorf("Wrong eviction reason: %s", reason)
+		}
+		evicted = append(evicted, key)
+	}
+
+	c.Set(1, "a")
+	clock.Advance(time.Millisecond)
+	c.Set(2, "b")
+	c.Set(2, "c")
+	c.Set(3, "d")
+
+	if c.Len() != 2 || c.Evictions() != 1 {
+		t.Errorf("Wrong stats: %+v", c.Stats())
+	}
+
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Errorf("Oldest entry should have been evicted: %v", evicted)
+	}
+
+	if v, ok := c.Get(2); !ok || v != "c" {
+		t.Errorf("Entry not updated: %v", v)
+	}
+}
+
+func TestBoundedCacheAge(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	c := NewBoundedCache("test/age", 0, time.Minute)
+	c.Clock = clock
+
+	c.Set(1, "a")
+	clock.Advance(30 * time.Second)
+	c.Set(2, "b")
+
+	if _, ok := c.Get(1); !ok {
+		t.Error("Entry shouldn't have been evicted yet")
+	}
+
+	clock.Advance(31 * time.Second)
+	c.Set(3, "c")
+
+	if _, ok := c.Get(1); ok {
+		t.Error("Expired entry should have been evicted")
+	}
+
+	RegisterCache(c)
+	if len(GetCaches("test/")) != 1 {
+		t.Error("Cache not registered")
+	}
+
+	UnregisterCache(c)
+	if len(GetCaches("test/")) != 0 {
+		t.Error("Cache not unregistered")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock gives the current time, features depending on the time use it so
+// that tests can control the time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type RealClock struct{}
+
+// FakeClock is a clock only moving when asked to, to be used in tests.
+type FakeClock struct {
+	sync.RWMutex
+	now time.Time
+}
+
+func (c RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+func (c *FakeClock) Set(t time.Time) {
+	c.Lock()
+	c.now = t
+	c.Unlock()
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
@@ -107,3 +107,37 @@ func CrossTypeEqual(a interface{}, b interface{}) bool {
 		return a == b
 	}
 }
+
+// CrossTypeCompare orders numbers of any type by value, other values by their
+// string representation, nil being lower than everything else.
+func CrossTypeCompare(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	f1, err1 := toFloat64(a)
+	f2, err2 := toFloat64(b)
+	if err1 == nil && err2 == nil {
+		switch {
+		case f1 < f2:
+			return -1
+		case f1 > f2:
+			return 1
+		}
+		return 0
+	}
+
+	s1, s2 := fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)
+	switch {
+	case s1 < s2:
+		return -1
+	case s1 > s2:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// HostIDFile is the file of the data directory of the agent holding its
+// identity
+const HostIDFile = "agent-id"
+
+var hostID atomic.Value
+
+// SetHostID sets the identity of the process, the key of its host node and
+// of its connections to the analyzers.
+func SetHostID(id string) {
+	hostID.Store(id)
+}
+
+// HostID returns the identity of the process, its hostname if none was set,
+// ie. for the analyzers and the agents without data directory.
+func HostID() (string, error) {
+	if id, ok := hostID.Load().(string); ok && id != "" {
+		return id, nil
+	}
+	return os.Hostname()
+}
+
+// LoadOrCreateHostID returns the identity stored in the data directory,
+// generated and stored on the first start, created telling whether it was
+// generated by this call.
+func LoadOrCreateHostID(dir string) (id string, created bool, err error) {
+	path := filepath.Join(dir, HostIDFile)
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if id = strings.TrimSpace(string(data)); id != "" {
+			return id, false, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", false, err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", false, err
+	}
+	id = u.String()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", false, err
+	}
+
+	// written aside then renamed so that a crash doesn't leave a partial
+	// identity behind
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(id+"\n"), 0644); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", false, fmt.Errorf("unable to store the identity in %s: %s", path, err.Error())
+	}
+
+	return id, true, nil
+}
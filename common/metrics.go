@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+)
+
+// MetricsProvider returns the current values of a set of metrics, the result
+// has to be JSON serializable.
+type MetricsProvider func() interface{}
+
+var metrics = struct {
+	sync.RWMutex
+	m map[string]MetricsProvider
+}{m: make(map[string]MetricsProvider)}
+
+func RegisterMetrics(name string, p MetricsProvider) {
+	metrics.Lock()
+	metrics.m[name] = p
+	metrics.Unlock()
+}
+
+func UnregisterMetrics(name string) {
+	metrics.Lock()
+	delete(metrics.m, name)
+	metrics.Unlock()
+}
+
+func GetMetric(name string) (interface{}, bool) {
+	metrics.RLock()
+	p, ok := metrics.m[name]
+	metrics.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	return p(), true
+}
+
+func GetMetrics() map[string]interface{} {
+	metrics.RLock()
+	providers := make(map[string]MetricsProvider, len(metrics.m))
+	for name, p := range metrics.m {
+		providers[name] = p
+	}
+	metrics.RUnlock()
+
+	values := make(map[string]interface{}, len(providers))
+	for name, p := range providers {
+		values[name] = p()
+	}
+
+	return values
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+var panicHooks = struct {
+	sync.RWMutex
+	m map[string]func(r interface{})
+}{m: make(map[string]func(r interface{}))}
+
+// RegisterPanicHook registers a function called when a goroutine protected
+// by RecoverAndPanic panics, ie. to save some state for a post-mortem.
+func RegisterPanicHook(name string, hook func(r interface{})) {
+	panicHooks.Lock()
+	panicHooks.m[name] = hook
+	panicHooks.Unlock()
+}
+
+func UnregisterPanicHook(name string) {
+	panicHooks.Lock()
+	delete(panicHooks.m, name)
+	panicHooks.Unlock()
+}
+
+// RunPanicHooks calls the registered panic hooks, a panicking hook doesn't
+// prevent the other ones from being called.
+func RunPanicHooks(r interface{}) {
+	panicHooks.RLock()
+	defer panicHooks.RUnlock()
+
+	for name, hook := range panicHooks.m {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					logging.GetLogger().Errorf("Panic hook %s failed: %v", name, err)
+				}
+			}()
+			hook(r)
+		}()
+	}
+}
+
+// RecoverAndPanic has to be deferred at the top of the long running
+// goroutines, it runs the panic hooks and then panics again so that the
+// process still crashes with the original stack trace.
+func RecoverAndPanic() {
+	if r := recover(); r != nil {
+		logging.GetLogger().Criticalf("Panic: %v", r)
+		RunPanicHooks(r)
+		panic(r)
+	}
+}
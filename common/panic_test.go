@@ -0,0 +1,49 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestRecoverAndPanic(t *testing.T) {
+	var hooked interface{}
+	RegisterPanicHook("test", func(r interface{}) { hooked = r })
+	RegisterPanicHook("failing", func(r interface{}) { panic("hook") })
+	defer UnregisterPanicHook("test")
+	defer UnregisterPanicHook("failing")
+
+	var repanicked interface{}
+	func() {
+		defer func() { repanicked = recover() }()
+		defer RecoverAndPanic()
+		panic("boom")
+	}()
+
+	if hooked != "boom" {
+		t.Errorf("Panic hook not called, got: %v", hooked)
+	}
+	if repanicked != "boom" {
+		t.Errorf("Original panic not raised again, got: %v", repanicked)
+	}
+}
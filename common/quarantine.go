@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"strings"
+	"sync"
+)
+
+// QuarantineEntry is an input rejected by a decoder, the raw data being
+// serialized in base64.
+type QuarantineEntry struct {
+	Source    string
+	Reason    string
+	Timestamp int64
+	Data      []byte
+}
+
+// Quarantine keeps the last inputs rejected by a decoder, ie. malformed
+// datagrams, to diagnose the misconfigured senders.
+type Quarantine struct {
+	sync.RWMutex
+	Name    string
+	MaxSize int
+	Clock   Clock
+	entries []QuarantineEntry
+	next    int
+}
+
+var quarantines = struct {
+	sync.RWMutex
+	m map[string]*Quarantine
+}{m: make(map[string]*Quarantine)}
+
+// Add keeps a copy of the rejected data, the oldest entry being replaced
+// when full.
+func (q *Quarantine) Add(source string, reason string, data []byte) {
+	if q.MaxSize <= 0 {
+		return
+	}
+
+	e := QuarantineEntry{
+		Source:    source,
+		Reason:    reason,
+		Timestamp: q.Clock.Now().UTC().Unix(),
+		Data:      append([]byte(nil), data...),
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.entries) < q.MaxSize {
+		q.entries = append(q.entries, e)
+		return
+	}
+	q.entries[q.next] = e
+	q.next = (q.next + 1) % q.MaxSize
+}
+
+// Dump returns the entries from the oldest to the newest
+func (q *Quarantine) Dump() []QuarantineEntry {
+	q.RLock()
+	defer q.RUnlock()
+
+	dump := make([]QuarantineEntry, 0, len(q.entries))
+	dump = append(dump, q.entries[q.next:]...)
+	return append(dump, q.entries[:q.next]...)
+}
+
+func NewQuarantine(name string, maxSize int) *Quarantine {
+	return &Quarantine{
+		Name:    name,
+		MaxSize: maxSize,
+		Clock:   RealClock{},
+	}
+}
+
+// RegisterQuarantine makes the quarantine visible through the debug API.
+func RegisterQuarantine(q *Quarantine) {
+	quarantines.Lock()
+	quarantines.m[q.Name] = q
+	quarantines.Unlock()
+}
+
+func UnregisterQuarantine(q *Quarantine) {
+	quarantines.Lock()
+	if quarantines.m[q.Name] == q {
+		delete(quarantines.m, q.Name)
+	}
+	quarantines.Unlock()
+}
+
+// GetQuarantines returns the registered quarantines whose name starts with
+// the given prefix, all of them if the prefix is empty.
+func GetQuarantines(prefix string) []*Quarantine {
+	quarantines.RLock()
+	defer quarantines.RUnlock()
+
+	var result []*Quarantine
+	for name, q := range quarantines.m {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, q)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"time"
+)
+
+// RateWindow counts events over a rolling window split in a fixed number of
+// buckets, its size doesn't depend on the rate. It is not thread safe.
+type RateWindow struct {
+	Window time.Duration
+	bucket int64
+	counts []int64
+	slots  []int64
+	last   int64
+}
+
+func (r *RateWindow) slot(now time.Time) int64 {
+	return now.UnixNano() / r.bucket
+}
+
+// Add records n events at the given time.
+func (r *RateWindow) Add(now time.Time, n int64) {
+	slot := r.slot(now)
+	i := slot % int64(len(r.slots))
+
+	if r.slots[i] != slot {
+		r.slots[i] = slot
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+	r.last = slot
+}
+
+// Count returns the number of events of the window ending at the given time.
+func (r *RateWindow) Count(now time.Time) int64 {
+	slot := r.slot(now)
+
+	var count int64
+	for i, s := range r.slots {
+		if s > slot-int64(len(r.slots)) && s <= slot {
+			count += r.counts[i]
+		}
+	}
+	return count
+}
+
+// Rate returns the number of events per minute over the window.
+func (r *RateWindow) Rate(now time.Time) float64 {
+	return float64(r.Count(now)) * float64(time.Minute) / float64(r.Window)
+}
+
+// Expired returns whether no event was recorded during the window.
+func (r *RateWindow) Expired(now time.Time) bool {
+	return r.last <= r.slot(now)-int64(len(r.slots))
+}
+
+func NewRateWindow(window time.Duration, buckets int) *RateWindow {
+	if buckets <= 0 {
+		buckets = 1
+	}
+	bucket := int64(window) / int64(buckets)
+	if bucket <= 0 {
+		bucket = 1
+	}
+
+	r := &RateWindow{
+		Window: window,
+		bucket: bucket,
+		counts: make([]int64, buckets),
+		slots:  make([]int64, buckets),
+	}
+	// no slot recorded yet
+	for i := range r.slots {
+		r.slots[i] = -1
+	}
+	r.last = -int64(buckets)
+
+	return r
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// ErrReadOnly is returned by the operations which would change the host
+// while the agent runs in read-only mode.
+var ErrReadOnly = errors.New("host changes refused, agent running in read-only mode")
+
+var readOnly int32
+
+// SetReadOnly enables or disables the read-only mode of the agent.
+func SetReadOnly(ro bool) {
+	var v int32
+	if ro {
+		v = 1
+	}
+	atomic.StoreInt32(&readOnly, v)
+}
+
+// IsReadOnly returns whether the agent runs in read-only mode.
+func IsReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// CheckHostChange has to be called before any operation changing the
+// host, ie. OVSDB writes, it logs and returns ErrReadOnly when the agent
+// runs in read-only mode.
+func CheckHostChange(op string) error {
+	if IsReadOnly() {
+		logging.GetLogger().Warningf("Refusing to %s: %s", op, ErrReadOnly.Error())
+		return ErrReadOnly
+	}
+	return nil
+}
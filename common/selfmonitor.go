@@ -0,0 +1,371 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// ErrCaptureRateLimited is returned when a capture is requested less than
+// the capture interval after the previous one
+var ErrCaptureRateLimited = errors.New("a capture was already taken less than the capture interval ago")
+
+// capture directories are named after their time so that they sort by age
+const captureTimeFormat = "20060102T150405.000"
+
+// SelfMonitorStatus gives the last sample of the process, whether one of
+// the thresholds is breached, and the last capture, if any
+type SelfMonitorStatus struct {
+	RSS           int64
+	Goroutines    int
+	Breached      bool
+	Reason        string `json:",omitempty"`
+	LastCapture   string `json:",omitempty"`
+	LastCaptureAt int64  `json:",omitempty"`
+	Captures      int64
+	RateLimited   int64
+}
+
+// CaptureInfo describes a set of profiles, written along them in info.json
+type CaptureInfo struct {
+	Time       int64
+	Reason     string
+	RSS        int64
+	Goroutines int
+}
+
+// SelfMonitor samples the resident memory and the goroutines of the process.
+// When MaxRSS or MaxGoroutines is exceeded, it writes a heap and a goroutine
+// profile, with a snapshot of the graph, to a directory under Dir. At most
+// one set is written per CaptureInterval, and only the last Keep sets are
+// kept.
+type SelfMonitor struct {
+	sync.RWMutex
+	Dir             string
+	Interval        time.Duration
+	CaptureInterval time.Duration
+	Keep            int
+	MaxRSS          int64
+	MaxGoroutines   int
+	// Snapshot writes the snapshot of the graph
+	Snapshot func(w io.Writer) error
+	// Sample returns the resident memory, in bytes, and the goroutines
+	Sample      func() (int64, int)
+	Clock       Clock
+	status      SelfMonitorStatus
+	lastCapture time.Time
+	captureLock sync.Mutex
+	quit        chan bool
+	wg          sync.WaitGroup
+}
+
+// processRSS returns the resident memory of the process, 0 if unknown
+func processRSS() int64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * int64(os.Getpagesize())
+}
+
+func sampleProcess() (int64, int) {
+	return processRSS(), runtime.NumGoroutine()
+}
+
+// breach returns the reason of a breach of the thresholds, empty if none
+func (m *SelfMonitor) breach(rss int64, goroutines int) string {
+	var reasons []string
+	if m.MaxRSS > 0 && rss > m.MaxRSS {
+		reasons = append(reasons, fmt.Sprintf("RSS of %d bytes exceeding %d", rss, m.MaxRSS))
+	}
+	if m.MaxGoroutines > 0 && goroutines > m.MaxGoroutines {
+		reasons = append(reasons, fmt.Sprintf("%d goroutines exceeding %d", goroutines, m.MaxGoroutines))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Check samples the process and captures the profiles when a threshold is
+// breached, unless captured less than CaptureInterval ago
+func (m *SelfMonitor) Check() {
+	rss, goroutines := m.Sample()
+	reason := m.breach(rss, goroutines)
+
+	m.Lock()
+	breached := m.status.Breached
+	m.status.RSS, m.status.Goroutines = rss, goroutines
+	m.status.Breached, m.status.Reason = reason != "", reason
+	m.Unlock()
+
+	if reason == "" {
+		if breached {
+			logging.GetLogger().Infof("Self monitoring: back under the thresholds, RSS of %d bytes and %d goroutines", rss, goroutines)
+		}
+		return
+	}
+
+	if !breached {
+		logging.GetLogger().Warningf("Self monitoring: %s", reason)
+	}
+
+	if _, err := m.Capture(reason); err != nil && err != ErrCaptureRateLimited {
+		logging.GetLogger().Errorf("Self monitoring: unable to capture the profiles: %s", err.Error())
+	}
+}
+
+// Capture writes a set of profiles, returning its directory, or
+// ErrCaptureRateLimited if the previous set was written less than
+// CaptureInterval ago
+func (m *SelfMonitor) Capture(reason string) (string, error) {
+	m.captureLock.Lock()
+	defer m.captureLock.Unlock()
+
+	now := m.Clock.Now()
+
+	m.Lock()
+	if !m.lastCapture.IsZero() && now.Sub(m.lastCapture) < m.CaptureInterval {
+		m.status.RateLimited++
+		m.Unlock()
+		return "", ErrCaptureRateLimited
+	}
+	m.lastCapture = now
+	m.Unlock()
+
+	rss, goroutines := m.Sample()
+	dir := filepath.Join(m.Dir, now.UTC().Format(captureTimeFormat))
+	info := CaptureInfo{Time: now.UnixNano(), Reason: reason, RSS: rss, Goroutines: goroutines}
+	if err := m.write(dir, info); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	m.Lock()
+	m.status.LastCapture, m.status.LastCaptureAt = dir, now.Unix()
+	m.status.Captures++
+	m.Unlock()
+
+	logging.GetLogger().Warningf("Self monitoring: profiles written to %s, %s", dir, reason)
+
+	if err := m.prune(); err != nil {
+		logging.GetLogger().Errorf("Self monitoring: unable to remove the oldest profiles: %s", err.Error())
+	}
+
+	return dir, nil
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write writes the profiles, the snapshot of the graph and the description
+// of the capture
+func (m *SelfMonitor) write(dir string, info CaptureInfo) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	files := map[string]func(w io.Writer) error{
+		"heap.pprof": func(w io.Writer) error {
+			runtime.GC()
+			return pprof.Lookup("heap").WriteTo(w, 0)
+		},
+		"goroutine.pprof": func(w io.Writer) error {
+			return pprof.Lookup("goroutine").WriteTo(w, 0)
+		},
+		"info.json": func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(info)
+		},
+	}
+	if m.Snapshot != nil {
+		files["graph.json"] = m.Snapshot
+	}
+
+	for name, write := range files {
+		if err := writeFile(filepath.Join(dir, name), write); err != nil {
+			return fmt.Errorf("unable to write %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Captures returns the directories of the sets of profiles, the oldest
+// first
+func (m *SelfMonitor) Captures() ([]string, error) {
+	entries, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if _, err := time.Parse(captureTimeFormat, e.Name()); e.IsDir() && err == nil {
+			dirs = append(dirs, filepath.Join(m.Dir, e.Name()))
+		}
+	}
+	sort.Strings(dirs)
+
+	return dirs, nil
+}
+
+// prune removes the oldest sets of profiles beyond Keep
+func (m *SelfMonitor) prune() error {
+	dirs, err := m.Captures()
+	if err != nil || m.Keep <= 0 || len(dirs) <= m.Keep {
+		return err
+	}
+
+	for _, dir := range dirs[:len(dirs)-m.Keep] {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status returns the last sample and capture
+func (m *SelfMonitor) Status() SelfMonitorStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.status
+}
+
+func (m *SelfMonitor) Metrics() interface{} {
+	return m.Status()
+}
+
+func (m *SelfMonitor) run() {
+	defer m.wg.Done()
+	defer RecoverAndPanic()
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// Start starts sampling the process, the thresholds being only checked
+// if one of them is set
+func (m *SelfMonitor) Start() {
+	RegisterMetrics("self_monitor", m.Metrics)
+
+	if m.MaxRSS <= 0 && m.MaxGoroutines <= 0 {
+		return
+	}
+
+	m.wg.Add(1)
+	go m.run()
+}
+
+func (m *SelfMonitor) Stop() {
+	if m.MaxRSS > 0 || m.MaxGoroutines > 0 {
+		m.quit <- true
+		m.wg.Wait()
+	}
+
+	UnregisterMetrics("self_monitor")
+}
+
+func NewSelfMonitor(dir string, interval, captureInterval time.Duration, keep int) *SelfMonitor {
+	return &SelfMonitor{
+		Dir:             dir,
+		Interval:        interval,
+		CaptureInterval: captureInterval,
+		Keep:            keep,
+		Sample:          sampleProcess,
+		Clock:           RealClock{},
+		quit:            make(chan bool),
+	}
+}
+
+// NewSelfMonitorFromConfig returns a monitor writing the profiles to
+// the profiles directory of dir, nil if dir is empty
+func NewSelfMonitorFromConfig(service string, dir string) *SelfMonitor {
+	if dir == "" {
+		return nil
+	}
+
+	cfg := config.GetConfig()
+
+	interval := time.Duration(cfg.GetInt(service+".self_monitor.interval")) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	m := NewSelfMonitor(
+		filepath.Join(dir, "profiles"),
+		interval,
+		time.Duration(cfg.GetInt(service+".self_monitor.capture_interval"))*time.Second,
+		cfg.GetInt(service+".self_monitor.keep"),
+	)
+	m.MaxRSS = int64(cfg.GetInt(service+".self_monitor.max_rss")) * 1024 * 1024
+	m.MaxGoroutines = cfg.GetInt(service + ".self_monitor.max_goroutines")
+
+	return m
+}
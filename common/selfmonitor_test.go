@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfMonitorCaptures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selfmonitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewFakeClock(time.Unix(1468400000, 0))
+	rss, goroutines := int64(100), 10
+
+	m := NewSelfMonitor(dir, time.Second, time.Minute, 2)
+	m.Clock = clock
+	m.MaxRSS, m.MaxGoroutines = 200, 20
+	m.Sample = func() (int64, int) { return rss, goroutines }
+	m.Snapshot = func(w io.Writer) error {
+		_, err := w.Write([]byte(`{"Nodes":[],"Edges":[]}`))
+		return err
+	}
+
+	m.Check()
+	if captures, _ := m.Captures(); m.Status().Breached || len(captures) != 0 {
+		t.Fatal("Nothing should be captured under the thresholds")
+	}
+
+	rss = 300
+	m.Check()
+	status := m.Status()
+	captures, _ := m.Captures()
+	if !status.Breached || status.Captures != 1 || len(captures) != 1 || status.LastCapture != captures[0] {
+		t.Fatalf("Breach should be captured: %+v %v", status, captures)
+	}
+	for _, name := range []string{"heap.pprof", "goroutine.pprof", "graph.json", "info.json"} {
+		if fi, err := os.Stat(filepath.Join(captures[0], name)); err != nil || fi.Size() == 0 {
+			t.Errorf("%s should have been written: %v", name, err)
+		}
+	}
+
+	// sustained breach, at most one set per capture interval
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		m.Check()
+	}
+	if status = m.Status(); status.Captures != 1 || status.RateLimited != 10 {
+		t.Errorf("Captures should be rate limited: %+v", status)
+	}
+	if _, err := m.Capture("on demand"); err != ErrCaptureRateLimited {
+		t.Errorf("On demand capture should be rate limited too: %v", err)
+	}
+
+	// only the last sets are kept
+	goroutines = 30
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute)
+		m.Check()
+	}
+	captures, _ = m.Captures()
+	if status = m.Status(); status.Captures != 4 || len(captures) != 2 || status.LastCapture != captures[1] {
+		t.Errorf("Only the last 2 sets should be kept: %+v %v", status, captures)
+	}
+
+	rss, goroutines = 100, 10
+	m.Check()
+	if status = m.Status(); status.Breached || status.Reason != "" {
+		t.Errorf("Breach should be over: %+v", status)
+	}
+}
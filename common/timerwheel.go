@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+type wheelTimer struct {
+	key      string
+	deadline time.Time
+	slot     int
+	fn       func()
+}
+
+// TimerWheel runs callbacks at given times, with the precision of its tick.
+// The timers are hashed by their deadline in a ring of slots, each advance
+// only looking at the slots of the ticks elapsed. A timer has a key, the
+// one scheduled with the key of a pending timer replacing it, so that the
+// timers of an element changing all the time don't pile up.
+type TimerWheel struct {
+	sync.Mutex
+	Tick   time.Duration
+	Clock  Clock
+	slots  []map[string]*wheelTimer
+	timers map[string]*wheelTimer
+	last   int64
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// ticks returns the first tick at or after the time
+func (w *TimerWheel) ticks(t time.Time) int64 {
+	return (t.UnixNano() + int64(w.Tick) - 1) / int64(w.Tick)
+}
+
+func (w *TimerWheel) cancel(key string) bool {
+	t, ok := w.timers[key]
+	if !ok {
+		return false
+	}
+	delete(w.slots[t.slot], key)
+	delete(w.timers, key)
+	return true
+}
+
+// Schedule runs the callback at the given time, a time already past being
+// run on the next advance
+func (w *TimerWheel) Schedule(key string, at time.Time, fn func()) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.cancel(key)
+
+	tick := w.ticks(at)
+	// the slots looked at are the ones from the last advance
+	if tick < w.last {
+		tick = w.last
+	}
+	t := &wheelTimer{key: key, deadline: at, slot: int(tick % int64(len(w.slots))), fn: fn}
+	w.slots[t.slot][key] = t
+	w.timers[key] = t
+}
+
+// Cancel removes the pending timer of the key, returning whether there was
+// one
+func (w *TimerWheel) Cancel(key string) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.cancel(key)
+}
+
+// CancelIf removes the pending timers whose key matches, returning their
+// number
+func (w *TimerWheel) CancelIf(match func(key string) bool) int {
+	w.Lock()
+	defer w.Unlock()
+
+	count := 0
+	for key := range w.timers {
+		if match(key) && w.cancel(key) {
+			count++
+		}
+	}
+	return count
+}
+
+// Pending returns the number of timers not run yet
+func (w *TimerWheel) Pending() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return len(w.timers)
+}
+
+// Advance runs the callbacks of the timers due at the given time, outside
+// of the lock of the wheel so that they can schedule timers
+func (w *TimerWheel) Advance(now time.Time) {
+	w.Lock()
+
+	tick := w.ticks(now)
+	from := w.last
+	if tick < from {
+		// the clock went backward
+		from = tick
+	}
+	// a full turn looks at all the slots
+	if tick-from >= int64(len(w.slots)) {
+		from = tick - int64(len(w.slots)) + 1
+	}
+
+	var due []*wheelTimer
+	for i := from; i <= tick; i++ {
+		for key, t := range w.slots[int(i%int64(len(w.slots)))] {
+			if !t.deadline.After(now) {
+				due = append(due, t)
+				w.cancel(key)
+			}
+		}
+	}
+	w.last = tick
+	w.Unlock()
+
+	for _, t := range due {
+		t.fn()
+	}
+}
+
+func (w *TimerWheel) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.Tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.Advance(w.Clock.Now())
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *TimerWheel) Start() {
+	w.wg.Add(1)
+	go w.run()
+}
+
+func (w *TimerWheel) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// NewTimerWheel returns a wheel of the given number of slots of a tick
+// each, the timers further than a turn being looked at once per turn
+func NewTimerWheel(tick time.Duration, slots int, clock Clock) *TimerWheel {
+	w := &TimerWheel{
+		Tick:   tick,
+		Clock:  clock,
+		slots:  make([]map[string]*wheelTimer, slots),
+		timers: make(map[string]*wheelTimer),
+		quit:   make(chan struct{}),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[string]*wheelTimer)
+	}
+	w.last = w.ticks(clock.Now())
+	return w
+}
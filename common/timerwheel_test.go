@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	w := NewTimerWheel(100*time.Millisecond, 8, clock)
+
+	var fired []string
+	record := func(key string) func() {
+		return func() { fired = append(fired, key) }
+	}
+
+	now := clock.Now()
+	w.Schedule("a", now.Add(250*time.Millisecond), record("a"))
+	// further than a turn of the wheel
+	w.Schedule("b", now.Add(2*time.Second), record("b"))
+	w.Schedule("c", now.Add(300*time.Millisecond), record("c"))
+	w.Cancel("c")
+
+	// rescheduling replaces the pending timer
+	for i := 0; i < 100; i++ {
+		w.Schedule("flap", now.Add(time.Second), record("flap"))
+	}
+	if w.Pending() != 3 {
+		t.Errorf("Expected 3 pending timers, got %d", w.Pending())
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	w.Advance(clock.Now())
+	if len(fired) != 0 {
+		t.Errorf("No timer should be due yet: %v", fired)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	w.Advance(clock.Now())
+	if len(fired) != 1 || fired[0] != "a" {
+		t.Errorf("Expected a to fire: %v", fired)
+	}
+
+	// a late advance runs all the timers due
+	clock.Advance(5 * time.Second)
+	w.Advance(clock.Now())
+	if len(fired) != 3 || w.Pending() != 0 {
+		t.Errorf("Expected all the timers to fire once: %v, %d pending", fired, w.Pending())
+	}
+
+	// a deadline already past runs on the next advance
+	w.Schedule("late", clock.Now().Add(-time.Second), record("late"))
+	w.Advance(clock.Now())
+	if len(fired) != 4 || fired[3] != "late" {
+		t.Errorf("Expected late to fire: %v", fired)
+	}
+
+	w.Schedule("x/1", clock.Now().Add(time.Second), record("x/1"))
+	w.Schedule("x/2", clock.Now().Add(time.Second), record("x/2"))
+	w.Schedule("y/1", clock.Now().Add(time.Second), record("y/1"))
+	if n := w.CancelIf(func(key string) bool { return key[0] == 'x' }); n != 2 || w.Pending() != 1 {
+		t.Errorf("Expected 2 timers canceled, got %d, %d pending", n, w.Pending())
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Span is a timed step of a trace, its fields following the OpenTracing
+// and OTLP spans so that the traces can be exported to a collector. Start
+// and End are in nanoseconds since the epoch, on the clock of Host.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string `json:",omitempty"`
+	Name     string
+	Service  string
+	Host     string
+	Start    int64
+	End      int64
+	Tags     map[string]string `json:",omitempty"`
+}
+
+// Trace is the spans of a graph mutation, from the probe of the agent to
+// the backend of the analyzer, each hop being the child of the previous one.
+type Trace struct {
+	ID    string
+	Spans []*Span
+}
+
+// Tracer starts the traces of a sample of the mutations and opens the spans
+// of a service on a host.
+type Tracer struct {
+	Service    string
+	Host       string
+	SampleRate float64
+	clock      Clock
+}
+
+// TraceRecorder keeps the last completed traces and optionally logs them
+type TraceRecorder struct {
+	sync.RWMutex
+	traces []*Trace
+	next   int
+	count  int
+	log    bool
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Duration returns the time spent in the span
+func (s *Span) Duration() time.Duration {
+	return time.Duration(s.End - s.Start)
+}
+
+// Finish sets the end of the span
+func (s *Span) Finish(end time.Time) {
+	s.End = end.UnixNano()
+}
+
+// SetTag sets a tag of the span
+func (s *Span) SetTag(key, value string) {
+	if s.Tags == nil {
+		s.Tags = make(map[string]string)
+	}
+	s.Tags[key] = value
+}
+
+// Last returns the last span of the trace, nil if none
+func (t *Trace) Last() *Span {
+	if len(t.Spans) == 0 {
+		return nil
+	}
+	return t.Spans[len(t.Spans)-1]
+}
+
+// AddSpan appends a span, child of the last one, which started at start
+// and ended at end
+func (t *Trace) AddSpan(service, host, name string, start, end time.Time) *Span {
+	return t.AddChildSpan(t.Last(), service, host, name, start, end)
+}
+
+// AddChildSpan appends a span, child of the given parent if any
+func (t *Trace) AddChildSpan(parent *Span, service, host, name string, start, end time.Time) *Span {
+	s := &Span{
+		TraceID: t.ID,
+		SpanID:  randomHex(8),
+		Name:    name,
+		Service: service,
+		Host:    host,
+		Start:   start.UnixNano(),
+		End:     end.UnixNano(),
+	}
+	if parent != nil {
+		s.ParentID = parent.SpanID
+	}
+	t.Spans = append(t.Spans, s)
+	return s
+}
+
+// Copy returns a copy of the trace, sharing the spans already recorded,
+// so that the copy can be completed independently of the original
+func (t *Trace) Copy() *Trace {
+	return &Trace{ID: t.ID, Spans: append([]*Span{}, t.Spans...)}
+}
+
+// Duration returns the time between the start of the first span and the
+// end of the last one, the clocks of the hosts being possibly skewed
+func (t *Trace) Duration() time.Duration {
+	if len(t.Spans) == 0 {
+		return 0
+	}
+	return time.Duration(t.Last().End - t.Spans[0].Start)
+}
+
+// Sample returns a new trace for a sample of SampleRate of the calls, nil
+// otherwise
+func (t *Tracer) Sample() *Trace {
+	if t == nil || t.SampleRate <= 0 || (t.SampleRate < 1 && mrand.Float64() >= t.SampleRate) {
+		return nil
+	}
+	return &Trace{ID: randomHex(16)}
+}
+
+// Now returns the current time of the clock of the tracer
+func (t *Tracer) Now() time.Time {
+	return t.clock.Now()
+}
+
+// AddSpan appends a span of the service of the tracer to the trace
+func (t *Tracer) AddSpan(trace *Trace, name string, start, end time.Time) *Span {
+	return trace.AddSpan(t.Service, t.Host, name, start, end)
+}
+
+// AddChildSpan appends a span of the service of the tracer, child of the
+// given parent
+func (t *Tracer) AddChildSpan(trace *Trace, parent *Span, name string, start, end time.Time) *Span {
+	return trace.AddChildSpan(parent, t.Service, t.Host, name, start, end)
+}
+
+// SetClock sets the clock giving the time of the spans, used by the tests
+func (t *Tracer) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// Record adds a completed trace, the oldest being forgotten once the
+// recorder is full
+func (r *TraceRecorder) Record(t *Trace) {
+	if r.log {
+		if j, err := json.Marshal(t); err == nil {
+			logging.GetLogger().Infof("Trace %s", string(j))
+		}
+	}
+
+	if len(r.traces) == 0 {
+		return
+	}
+
+	r.Lock()
+	r.traces[r.next] = t
+	r.next = (r.next + 1) % len(r.traces)
+	if r.count < len(r.traces) {
+		r.count++
+	}
+	r.Unlock()
+}
+
+// Traces returns the traces recorded, the most recent first
+func (r *TraceRecorder) Traces() []*Trace {
+	r.RLock()
+	defer r.RUnlock()
+
+	traces := make([]*Trace, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		traces = append(traces, r.traces[(r.next-i+len(r.traces))%len(r.traces)])
+	}
+	return traces
+}
+
+// Get returns the recorded trace of the given ID, nil if unknown
+func (r *TraceRecorder) Get(id string) *Trace {
+	for _, t := range r.Traces() {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// NewTracer returns a tracer sampling the given rate of the mutations, 0
+// disabling the tracing and 1 tracing all of them
+func NewTracer(service, host string, sampleRate float64) *Tracer {
+	return &Tracer{Service: service, Host: host, SampleRate: sampleRate, clock: RealClock{}}
+}
+
+// NewTraceRecorder returns a recorder keeping the last keep traces, logging
+// them as JSON if log is set
+func NewTraceRecorder(keep int, log bool) *TraceRecorder {
+	return &TraceRecorder{traces: make([]*Trace, keep), log: log}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTraceSampling(t *testing.T) {
+	var tracer *Tracer
+	if tracer.Sample() != nil {
+		t.Error("A nil tracer shouldn't sample")
+	}
+
+	if NewTracer("agent", "host1", 0).Sample() != nil {
+		t.Error("A zero rate shouldn't sample")
+	}
+
+	tracer = NewTracer("agent", "host1", 1)
+	t1, t2 := tracer.Sample(), tracer.Sample()
+	if t1 == nil || t2 == nil || len(t1.ID) != 32 || t1.ID == t2.ID {
+		t.Errorf("Every call should be sampled with distinct IDs: %+v %+v", t1, t2)
+	}
+
+	sampled := 0
+	tracer = NewTracer("agent", "host1", 0.5)
+	for i := 0; i < 1000; i++ {
+		if tracer.Sample() != nil {
+			sampled++
+		}
+	}
+	if sampled < 350 || sampled > 650 {
+		t.Errorf("Half of the calls should be sampled, got %d", sampled)
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1468400000, 0))
+	tracer := NewTracer("agent", "host1", 1)
+	tracer.SetClock(clock)
+
+	trace := tracer.Sample()
+	start := tracer.Now()
+	clock.Advance(time.Second)
+	first := tracer.AddSpan(trace, "first", start, tracer.Now())
+	second := tracer.AddSpan(trace, "second", tracer.Now(), tracer.Now().Add(time.Second))
+	child := tracer.AddChildSpan(trace, first, "child", start, tracer.Now())
+
+	if first.ParentID != "" || second.ParentID != first.SpanID || child.ParentID != first.SpanID {
+		t.Errorf("Wrong parents: %+v %+v %+v", first, second, child)
+	}
+	if first.TraceID != trace.ID || len(first.SpanID) != 16 || first.Duration() != time.Second {
+		t.Errorf("Wrong span: %+v", first)
+	}
+
+	// the copy is completed independently
+	copy := trace.Copy()
+	copy.AddSpan("analyzer", "analyzer1", "apply", tracer.Now(), tracer.Now())
+	if len(trace.Spans) != 3 || len(copy.Spans) != 4 {
+		t.Errorf("Copy shouldn't change the original: %d %d", len(trace.Spans), len(copy.Spans))
+	}
+}
+
+func TestTraceRecorder(t *testing.T) {
+	r := NewTraceRecorder(3, false)
+	for i := 0; i < 5; i++ {
+		r.Record(&Trace{ID: fmt.Sprintf("t%d", i)})
+	}
+
+	traces := r.Traces()
+	if len(traces) != 3 || traces[0].ID != "t4" || traces[2].ID != "t2" {
+		t.Errorf("The last traces should be kept, most recent first: %+v", traces)
+	}
+	if r.Get("t1") != nil || r.Get("t3") == nil {
+		t.Error("Only the traces kept should be found")
+	}
+}
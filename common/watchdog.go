@@ -0,0 +1,295 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Heartbeat is touched by the main loop of a probe so that the watchdog can
+// detect a loop that stopped processing. A loop waiting for events marks its
+// heartbeat idle, an idle heartbeat is never considered as stalled. The
+// probe also records its last update of the graph, a loop beating while
+// its events don't come anymore, ie. wedged on a socket, not updating the
+// graph for long on an active host.
+type Heartbeat struct {
+	Name       string
+	Clock      Clock
+	last       int64
+	lastUpdate int64
+	idle       int32
+}
+
+// HeartbeatStatus gives the times, in seconds, of the last beat and of the
+// last update of the graph, LastUpdate being 0 and UpdateAge -1 if the probe
+// never updated the graph.
+type HeartbeatStatus struct {
+	Last       int64
+	Age        int64
+	LastUpdate int64
+	UpdateAge  int64
+	Idle       bool
+	Stalled    bool
+}
+
+// Watchdog periodically checks the registered heartbeats, a stalled
+// heartbeat is reported in the logs, in the "watchdog" metrics and can make
+// the process panic so that it gets restarted by its supervisor.
+type Watchdog struct {
+	sync.Mutex
+	Threshold time.Duration
+	Interval  time.Duration
+	Panic     bool
+	OnStall   func(name string, age time.Duration)
+	Clock     Clock
+	stalled   map[string]bool
+	quit      chan bool
+	wg        sync.WaitGroup
+	running   int32
+}
+
+var heartbeats = struct {
+	sync.RWMutex
+	m map[string]*Heartbeat
+}{m: make(map[string]*Heartbeat)}
+
+// Beat marks the loop as alive and processing, nil safe.
+func (h *Heartbeat) Beat() {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt64(&h.last, h.Clock.Now().UnixNano())
+	atomic.StoreInt32(&h.idle, 0)
+}
+
+// Idle marks the loop as waiting for events, nil safe.
+func (h *Heartbeat) Idle() {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt32(&h.idle, 1)
+}
+
+// Updated marks the graph as updated by the probe, nil safe.
+func (h *Heartbeat) Updated() {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt64(&h.lastUpdate, h.Clock.Now().UnixNano())
+}
+
+func (h *Heartbeat) Last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&h.last))
+}
+
+// LastUpdate returns the time of the last update of the graph, the zero time
+// if none
+func (h *Heartbeat) LastUpdate() time.Time {
+	if last := atomic.LoadInt64(&h.lastUpdate); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
+func (h *Heartbeat) IsIdle() bool {
+	return atomic.LoadInt32(&h.idle) == 1
+}
+
+func NewHeartbeat(name string) *Heartbeat {
+	h := &Heartbeat{Name: name, Clock: RealClock{}}
+	h.Beat()
+	return h
+}
+
+func RegisterHeartbeat(h *Heartbeat) {
+	heartbeats.Lock()
+	heartbeats.m[h.Name] = h
+	heartbeats.Unlock()
+}
+
+func UnregisterHeartbeat(h *Heartbeat) {
+	heartbeats.Lock()
+	if heartbeats.m[h.Name] == h {
+		delete(heartbeats.m, h.Name)
+	}
+	heartbeats.Unlock()
+}
+
+func GetHeartbeats() []*Heartbeat {
+	heartbeats.RLock()
+	defer heartbeats.RUnlock()
+
+	var result []*Heartbeat
+	for _, h := range heartbeats.m {
+		result = append(result, h)
+	}
+
+	return result
+}
+
+func (w *Watchdog) status(h *Heartbeat, now time.Time) HeartbeatStatus {
+	last := h.Last()
+	age := now.Sub(last)
+	idle := h.IsIdle()
+
+	status := HeartbeatStatus{
+		Last:      last.Unix(),
+		Age:       int64(age.Seconds()),
+		UpdateAge: -1,
+		Idle:      idle,
+		Stalled:   !idle && age > w.Threshold,
+	}
+	if update := h.LastUpdate(); !update.IsZero() {
+		status.LastUpdate = update.Unix()
+		status.UpdateAge = int64(now.Sub(update).Seconds())
+	}
+
+	return status
+}
+
+// Check returns the status of all the heartbeats, the ones which just
+// stalled or recovered are reported.
+func (w *Watchdog) Check() map[string]HeartbeatStatus {
+	w.Lock()
+	defer w.Unlock()
+
+	now := w.Clock.Now()
+
+	statuses := make(map[string]HeartbeatStatus)
+	for _, h := range GetHeartbeats() {
+		s := w.status(h, now)
+		statuses[h.Name] = s
+
+		switch {
+		case s.Stalled && !w.stalled[h.Name]:
+			w.stalled[h.Name] = true
+			publishProbeHealth("ProbeStalled", h.Name, s)
+			w.onStall(h.Name, now.Sub(h.Last()))
+		case !s.Stalled && w.stalled[h.Name]:
+			delete(w.stalled, h.Name)
+			logging.GetLogger().Infof("Probe %s recovered", h.Name)
+			publishProbeHealth("ProbeRecovered", h.Name, s)
+		}
+	}
+
+	return statuses
+}
+
+// ProbeHealthEvent is published on the bus when a probe stalls or recovers
+type ProbeHealthEvent struct {
+	Name   string
+	Status HeartbeatStatus
+}
+
+func publishProbeHealth(eventType string, name string, s HeartbeatStatus) {
+	DefaultBus.Publish(ProbeTopic, eventType, &ProbeHealthEvent{Name: name, Status: s})
+}
+
+func (w *Watchdog) onStall(name string, age time.Duration) {
+	logging.GetLogger().Criticalf("Probe %s stalled, no heartbeat since %s", name, age)
+
+	if w.OnStall != nil {
+		w.OnStall(name, age)
+	}
+
+	if w.Panic {
+		panic(fmt.Sprintf("probe %s stalled for %s", name, age))
+	}
+}
+
+func (w *Watchdog) Metrics() interface{} {
+	now := w.Clock.Now()
+
+	statuses := make(map[string]HeartbeatStatus)
+	for _, h := range GetHeartbeats() {
+		statuses[h.Name] = w.status(h, now)
+	}
+
+	return statuses
+}
+
+func (w *Watchdog) run() {
+	defer w.wg.Done()
+	defer RecoverAndPanic()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+func (w *Watchdog) Start() {
+	if !atomic.CompareAndSwapInt32(&w.running, 0, 1) {
+		return
+	}
+	RegisterMetrics("watchdog", w.Metrics)
+
+	w.wg.Add(1)
+	go w.run()
+}
+
+// Stop stops the watchdog, a watchdog not started being left as is.
+func (w *Watchdog) Stop() {
+	if !atomic.CompareAndSwapInt32(&w.running, 1, 0) {
+		return
+	}
+
+	w.quit <- true
+	w.wg.Wait()
+
+	UnregisterMetrics("watchdog")
+}
+
+func NewWatchdog(threshold time.Duration, interval time.Duration, panicOnStall bool) *Watchdog {
+	return &Watchdog{
+		Threshold: threshold,
+		Interval:  interval,
+		Panic:     panicOnStall,
+		Clock:     RealClock{},
+		stalled:   make(map[string]bool),
+		quit:      make(chan bool),
+	}
+}
+
+func NewWatchdogFromConfig(service string) *Watchdog {
+	cfg := config.GetConfig()
+
+	return NewWatchdog(
+		time.Duration(cfg.GetInt(service+".watchdog.threshold"))*time.Second,
+		time.Duration(cfg.GetInt(service+".watchdog.interval"))*time.Second,
+		cfg.GetBool(service+".watchdog.panic"),
+	)
+}
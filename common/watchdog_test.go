@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeProbe beats until asked to stall
+type fakeProbe struct {
+	heartbeat *Heartbeat
+	clock     *FakeClock
+}
+
+func (p *fakeProbe) iterate(n int) {
+	for i := 0; i < n; i++ {
+		p.heartbeat.Beat()
+		p.clock.Advance(time.Second)
+	}
+}
+
+func TestWatchdogStalledProbe(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	probe := &fakeProbe{heartbeat: NewHeartbeat("test/stalled"), clock: clock}
+	probe.heartbeat.Clock = clock
+	RegisterHeartbeat(probe.heartbeat)
+	defer UnregisterHeartbeat(probe.heartbeat)
+
+	var stalled []string
+	w := NewWatchdog(10*time.Second, time.Second, false)
+	w.Clock = clock
+	w.OnStall = func(name string, age time.Duration) {
+		stalled = append(stalled, name)
+	}
+
+	probe.iterate(30)
+	if w.Check()["test/stalled"].Stalled || len(stalled) != 0 {
+		t.Fatal("A beating probe shouldn't be stalled")
+	}
+
+	// the probe stops beating, checked every interval
+	var latency time.Duration
+	for latency = 0; latency < time.Minute && len(stalled) == 0; latency += w.Interval {
+		clock.Advance(w.Interval)
+		w.Check()
+	}
+
+	if len(stalled) != 1 || stalled[0] != "test/stalled" {
+		t.Fatalf("Stalled probe not detected: %v", stalled)
+	}
+
+	if latency > w.Threshold+w.Interval {
+		t.Errorf("Stalled probe detected too late: %s", latency)
+	}
+
+	// reported only once
+	clock.Advance(time.Minute)
+	w.Check()
+	if len(stalled) != 1 {
+		t.Errorf("Stalled probe should be reported once: %v", stalled)
+	}
+
+	probe.iterate(1)
+	if w.Check()["test/stalled"].Stalled {
+		t.Error("Probe should have recovered")
+	}
+}
+
+func TestWatchdogIdleProbe(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	h := NewHeartbeat("test/idle")
+	h.Clock = clock
+	h.Idle()
+	RegisterHeartbeat(h)
+	defer UnregisterHeartbeat(h)
+
+	w := NewWatchdog(10*time.Second, time.Second, false)
+	w.Clock = clock
+
+	clock.Advance(time.Hour)
+	if s := w.Check()["test/idle"]; s.Stalled || !s.Idle {
+		t.Errorf("An idle probe waiting for events shouldn't be stalled: %+v", s)
+	}
+
+	// stuck while processing an event
+	h.Beat()
+	clock.Advance(time.Minute)
+	if !w.Check()["test/idle"].Stalled {
+		t.Error("A probe stuck in an event should be stalled")
+	}
+}
+
+func TestWatchdogLastUpdate(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	h := NewHeartbeat("test/update")
+	h.Clock = clock
+	RegisterHeartbeat(h)
+	defer UnregisterHeartbeat(h)
+
+	w := NewWatchdog(10*time.Second, time.Second, false)
+	w.Clock = clock
+
+	if s := w.Check()["test/update"]; s.LastUpdate != 0 || s.UpdateAge != -1 {
+		t.Errorf("No update expected: %+v", s)
+	}
+
+	h.Updated()
+	clock.Advance(time.Hour)
+
+	// still beating but not updating the graph anymore
+	h.Beat()
+	s := w.Check()["test/update"]
+	if s.Stalled || s.Age != 0 || s.UpdateAge != 3600 || s.LastUpdate != clock.Now().Add(-time.Hour).Unix() {
+		t.Errorf("Wrong last update: %+v", s)
+	}
+}
+
+func TestWatchdogStopNotStarted(t *testing.T) {
+	w := NewWatchdog(10*time.Second, time.Second, false)
+
+	done := make(chan bool)
+	go func() {
+		w.Stop()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stopping a watchdog not started shouldn't block")
+	}
+
+	w.Start()
+	w.Stop()
+}
@@ -40,28 +40,181 @@ var cfg *viper.Viper
 
 func init() {
 	cfg = viper.New()
-	cfg.SetDefault("agent.analyzers", "127.0.0.1:8082")
+	cfg.SetDefault("agent.discovery.timeout", 5)
 	cfg.SetDefault("agent.listen", "127.0.0.1:8081")
+	cfg.SetDefault("agent.read_only", false)
+	cfg.SetDefault("agent.data_dir", "/var/lib/skydive")
+	cfg.SetDefault("agent.capture.raw.max_duration", 60)
+	cfg.SetDefault("agent.capture.raw.max_size", 100)
+	cfg.SetDefault("agent.capture.raw.max_concurrent", 2)
+	cfg.SetDefault("agent.capture.raw.stream_window", 16)
+	cfg.SetDefault("agent.capture.rebind_interval", 5)
+	cfg.SetDefault("agent.capture.fairness.flow_budget", 10)
+	cfg.SetDefault("agent.capture.fairness.total_budget", 1000)
+	cfg.SetDefault("agent.capture.fairness.low_confidence", 2)
+	cfg.SetDefault("agent.capture.stats_interval", 5)
+	cfg.SetDefault("agent.topology.netlink.neighbor_interval", 1000)
+	cfg.SetDefault("agent.topology.cache.max_size", 1000)
+	cfg.SetDefault("agent.topology.cache.max_age", 600)
+	cfg.SetDefault("agent.topology.netlink.veth_resolver_interval", 200)
+	cfg.SetDefault("agent.topology.netlink.initial_scan_delay", 0)
+	cfg.SetDefault("agent.topology.netlink.veth_resolver_retries", 10)
+	cfg.SetDefault("agent.topology.netlink.rename_window", 5000)
+	cfg.SetDefault("agent.topology.tombstone_grace_period", 0)
+	cfg.SetDefault("agent.topology.limits.max_nodes", 0)
+	cfg.SetDefault("agent.topology.limits.max_edges", 0)
+	cfg.SetDefault("agent.topology.statistics.interval", 0)
+	cfg.SetDefault("agent.topology.statistics.errors_window", 300)
+	cfg.SetDefault("agent.topology.statistics.errors_threshold", 10)
+	cfg.SetDefault("agent.topology.flapping.window", 60)
+	cfg.SetDefault("agent.topology.flapping.threshold", 6)
+	cfg.SetDefault("agent.topology.flapping.stable_period", 300)
+	cfg.SetDefault("agent.topology.downtime.interval", 10)
+	cfg.SetDefault("agent.topology.start_order", []string{"ovsdb", "netlink"})
+	cfg.SetDefault("agent.topology.dump.path", "")
+	cfg.SetDefault("agent.topology.dump.interval", 30)
+	cfg.SetDefault("agent.topology.dump.keep", 3)
+	cfg.SetDefault("agent.topology.dhcp.dhclient_leases", []string{"/var/lib/dhcp/dhclient*.leases", "/var/lib/dhclient/*.lease*", "/var/lib/NetworkManager/dhclient-*.lease"})
+	cfg.SetDefault("agent.topology.dhcp.networkd_leases", "/run/systemd/netif/leases")
+	cfg.SetDefault("agent.topology.dhcp.interval", 30)
+	cfg.SetDefault("agent.topology.sysctl.keys", []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding", "net.ipv4.conf.all.rp_filter", "net.ipv4.conf.default.rp_filter", "net.bridge.bridge-nf-call-iptables", "net.bridge.bridge-nf-call-ip6tables"})
+	cfg.SetDefault("agent.topology.sysctl.interval", 30)
+	cfg.SetDefault("agent.topology.multicast.interval", 60)
+	cfg.SetDefault("agent.topology.multicast.max_entries", 100)
+	cfg.SetDefault("agent.topology.listening.interval", 30)
+	cfg.SetDefault("agent.topology.clock.interval", 60)
+	cfg.SetDefault("agent.trace.sample_rate", 0)
+	cfg.SetDefault("agent.self_monitor.interval", 10)
+	cfg.SetDefault("agent.self_monitor.capture_interval", 600)
+	cfg.SetDefault("agent.self_monitor.keep", 3)
+	cfg.SetDefault("agent.self_monitor.max_rss", 0)
+	cfg.SetDefault("agent.self_monitor.max_goroutines", 0)
+	cfg.SetDefault("agent.watchdog.threshold", 60)
+	cfg.SetDefault("agent.watchdog.interval", 5)
+	cfg.SetDefault("agent.watchdog.panic", false)
 	cfg.SetDefault("ovs.ovsdb", "127.0.0.1:6400")
+	cfg.SetDefault("ovs.flow_rules_interval", 0)
+	cfg.SetDefault("ovs.echo_interval", 10)
+	cfg.SetDefault("ovs.vhostuser_socket_dir", "/var/run/openvswitch")
 	cfg.SetDefault("graph.backend", "memory")
 	cfg.SetDefault("graph.gremlin", "ws://127.0.0.1:8182")
+	cfg.SetDefault("graph.deferred_max", 1000)
+	cfg.SetDefault("graph.deferred_timeout", 10)
+	cfg.SetDefault("graph.journal.size", 0)
+	cfg.SetDefault("graph.journal.max_age", 60)
+	cfg.SetDefault("graph.sync_digests", true)
+	cfg.SetDefault("graph.trace.keep", 100)
+	cfg.SetDefault("graph.trace.log", false)
+	cfg.SetDefault("graph.bus.queue_size", 10000)
+	cfg.SetDefault("graph.bulk_threshold", 1000)
+	cfg.SetDefault("graph.schema.strict", false)
+	cfg.SetDefault("graph.statistics.keys", []string{"Statistics"})
+	cfg.SetDefault("graph.statistics.raw_retention", 3600)
+	cfg.SetDefault("graph.statistics.downsampling", 300)
+	cfg.SetDefault("graph.statistics.retention", 86400)
+	cfg.SetDefault("graph.metadata.max_value_size", 0)
+	cfg.SetDefault("graph.metadata.max_size", 0)
+	cfg.SetDefault("graph.metadata.truncate", true)
+	cfg.SetDefault("graph.metadata.persistence", map[string][]string{})
+	cfg.SetDefault("graph.metadata.durable_retention", 86400)
 	cfg.SetDefault("sflow.bind_address", "127.0.0.1:6345")
 	cfg.SetDefault("sflow.port_min", 6345)
 	cfg.SetDefault("sflow.port_max", 6355)
+	cfg.SetDefault("sflow.validation.checksums", false)
+	cfg.SetDefault("sflow.validation.max_malformed", 100)
+	cfg.SetDefault("sflow.validation.block_duration", 300)
+	cfg.SetDefault("sflow.validation.quarantine_size", 100)
+	cfg.SetDefault("api.pagination.default_limit", 0)
+	cfg.SetDefault("api.pagination.max_limit", 0)
 	cfg.SetDefault("analyzer.listen", "127.0.0.1:8082")
 	cfg.SetDefault("analyzer.flowtable_expire", 600)
 	cfg.SetDefault("analyzer.flowtable_update", 60)
 	cfg.SetDefault("analyzer.flowtable_agent_ratio", 0.5)
+	cfg.SetDefault("analyzer.enrichment.cache_expire", 300)
+	cfg.SetDefault("analyzer.enrichment.rate", 10)
+	cfg.SetDefault("analyzer.enrichment.retry", 2)
+	cfg.SetDefault("analyzer.enrichment.timeout", 10)
+	cfg.SetDefault("analyzer.grpc.listen", "")
+	cfg.SetDefault("analyzer.grpc.watch_queue_size", 1000)
+	cfg.SetDefault("analyzer.churn.window", 60)
+	cfg.SetDefault("analyzer.path.relations", []string{"layer2", "ownership"})
+	cfg.SetDefault("analyzer.path.max_hops", 32)
+	cfg.SetDefault("analyzer.path.interval", 60)
+	cfg.SetDefault("analyzer.drain.window", 300)
+	cfg.SetDefault("analyzer.linkers", []string{"lag", "sriov"})
+	cfg.SetDefault("analyzer.broadcast_domains.enabled", true)
+	cfg.SetDefault("analyzer.broadcast_domains.delay", 1)
+	cfg.SetDefault("analyzer.layer3.enabled", true)
+	cfg.SetDefault("analyzer.layer3.delay", 1)
+	cfg.SetDefault("analyzer.mtu.enabled", false)
+	cfg.SetDefault("analyzer.mtu.delay", 1)
+	cfg.SetDefault("analyzer.link_state.enabled", false)
+	cfg.SetDefault("analyzer.link_state.delay", 1)
+	cfg.SetDefault("analyzer.clock_skew.max_offset", 500)
+	cfg.SetDefault("analyzer.whatif.enabled", true)
+	cfg.SetDefault("analyzer.whatif.max_mutations", 1000)
+	cfg.SetDefault("analyzer.backend_migration.enabled", false)
+	cfg.SetDefault("analyzer.backend_migration.batch_size", 1000)
+	cfg.SetDefault("analyzer.backend_migration.admins", []string{})
+	cfg.SetDefault("analyzer.backend_migration.endpoints", []string{})
+	cfg.SetDefault("analyzer.agent_quota.window", 10)
+	cfg.SetDefault("analyzer.agent_quota.messages", 2000)
+	cfg.SetDefault("analyzer.agent_quota.bytes", 16777216)
+	cfg.SetDefault("analyzer.agent_quota.mutations", 1000)
+	cfg.SetDefault("analyzer.agent_quota.grace_messages", 50000)
+	cfg.SetDefault("analyzer.replica.primary", "")
+	cfg.SetDefault("analyzer.capture.raw.timeout", 30)
+	cfg.SetDefault("analyzer.capture.stats_interval", 5)
+	cfg.SetDefault("analyzer.drift.interval", 0)
+	cfg.SetDefault("analyzer.drift.role_key", "Role")
+	cfg.SetDefault("analyzer.drift.ignore_fields", []string{"Statistics", "IfIndex", "TombstoneTime", "Site", "Region", "Rack"})
+	cfg.SetDefault("analyzer.drift.ignore_names", []string{"^veth"})
+	cfg.SetDefault("analyzer.flow_correlation.max_hops", 4)
+	cfg.SetDefault("analyzer.flow_owners.types", []string{"container", "vm", "pod"})
+	cfg.SetDefault("analyzer.flow_owners.max_hops", 4)
+	cfg.SetDefault("analyzer.flow_owners.window", 30)
+	cfg.SetDefault("analyzer.history.backend", "")
+	cfg.SetDefault("analyzer.history.file.path", "/var/lib/skydive/history")
+	cfg.SetDefault("analyzer.history.file.segment_size", 64)
+	cfg.SetDefault("analyzer.history.file.fsync", "interval")
+	cfg.SetDefault("analyzer.history.file.fsync_interval", 1)
+	cfg.SetDefault("analyzer.history.file.max_age", 0)
+	cfg.SetDefault("analyzer.history.file.max_size", 0)
 	cfg.SetDefault("storage.elasticsearch", "127.0.0.1:9200")
+	cfg.SetDefault("storage.kafka.topic", "skydive-flows")
+	cfg.SetDefault("storage.kafka.partitioner", "flow")
+	cfg.SetDefault("storage.kafka.format", "json")
+	cfg.SetDefault("storage.kafka.compression", "none")
+	cfg.SetDefault("storage.kafka.batch_size", 100)
+	cfg.SetDefault("storage.kafka.batch_timeout", 1000)
+	cfg.SetDefault("storage.kafka.buffer_size", 10000)
+	cfg.SetDefault("storage.kafka.required_acks", 1)
 	cfg.SetDefault("ws_pong_timeout", 5)
+	cfg.SetDefault("ws_ack_timeout", 5)
+	cfg.SetDefault("ws_ack_max_pending", 10000)
+	cfg.SetDefault("ws_ack_retention", 300)
+	cfg.SetDefault("ws_max_message_size", 1024*1024)
+	cfg.SetDefault("ws_shutdown_timeout", 5)
+	cfg.SetDefault("ws_reconnect_delay", 10)
 	cfg.SetDefault("docker.url", "unix:///var/run/docker.sock")
+	cfg.SetDefault("docker.cgroup.interval", 0)
+	cfg.SetDefault("docker.cgroup.root", "/sys/fs/cgroup")
 	cfg.SetDefault("netns.run_path", "/var/run/netns")
+	cfg.SetDefault("netns.workers", 4)
+	cfg.SetDefault("netns.rate_limit", 0)
+	cfg.SetDefault("netns.rate_burst", 0)
 	cfg.SetDefault("etcd.data_dir", "/tmp/skydive-etcd")
 	cfg.SetDefault("etcd.embedded", true)
 	cfg.SetDefault("etcd.port", 2379)
 	cfg.SetDefault("etcd.servers", []string{"http://127.0.0.1:2379"})
 	cfg.SetDefault("auth.type", "noauth")
 	cfg.SetDefault("auth.keystone.tenant", "admin")
+	cfg.SetDefault("auth.session.enabled", false)
+	cfg.SetDefault("auth.session.secret", "")
+	cfg.SetDefault("auth.session.command", "")
+	cfg.SetDefault("auth.session.lifetime", 3600)
+	cfg.SetDefault("auth.session.max_lifetime", 86400)
+	cfg.SetDefault("auth.session.check_interval", 60)
 }
 
 func checkStrictPositiveInt(key string) error {
@@ -179,19 +332,21 @@ func GetHostPortAttributes(s string, p string) (string, int, error) {
 	}
 }
 
+// GetAnalyzerClientAddr returns the first analyzer, none if the discovery
+// failed
 func GetAnalyzerClientAddr() (string, int, error) {
-	analyzers := GetConfig().GetStringSlice("agent.analyzers")
-	// TODO(safchain) HA Connection ???
-	if len(analyzers) > 0 {
-		addr := strings.Split(analyzers[0], ":")[0]
-		port, err := strconv.Atoi(strings.Split(analyzers[0], ":")[1])
-		if err != nil {
-			return "", 0, err
+	addrs, err := GetAnalyzerServiceAddresses()
+	if err != nil {
+		if AnalyzerDiscoveryEnabled() {
+			return "", 0, nil
 		}
+		return "", 0, err
+	}
 
-		return addr, port, nil
+	if len(addrs) == 0 {
+		return "", 0, nil
 	}
-	return "", 0, nil
+	return addrs[0].Addr, addrs[0].Port, nil
 }
 
 func GetAnalyerExpire() time.Duration {
@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAnalyzer = "127.0.0.1:8082"
+
+// ServiceAddress is the address of a server, ie. of an analyzer
+type ServiceAddress struct {
+	Addr string
+	Port int
+}
+
+func (s ServiceAddress) String() string {
+	return net.JoinHostPort(s.Addr, strconv.Itoa(s.Port))
+}
+
+// replaced by the tests
+var lookupSRV = net.LookupSRV
+
+func parseServiceAddress(s string) (ServiceAddress, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(s))
+	if err != nil {
+		return ServiceAddress{}, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return ServiceAddress{}, fmt.Errorf("Malformed port of %s: %s", s, err.Error())
+	}
+
+	return ServiceAddress{Addr: host, Port: p}, nil
+}
+
+// AnalyzerDiscoveryEnabled returns whether the analyzers are discovered
+// when none is configured
+func AnalyzerDiscoveryEnabled() bool {
+	return cfg.GetString("agent.discovery.srv_domain") != "" || cfg.GetString("agent.discovery.metadata_url") != ""
+}
+
+// discoverSRV looks up _skydive-analyzer._tcp.<domain>, the records being
+// sorted by priority and randomized by weight
+func discoverSRV(domain string) ([]ServiceAddress, error) {
+	_, srvs, err := lookupSRV("skydive-analyzer", "tcp", domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []ServiceAddress
+	for _, srv := range srvs {
+		addrs = append(addrs, ServiceAddress{Addr: strings.TrimSuffix(srv.Target, "."), Port: int(srv.Port)})
+	}
+	return addrs, nil
+}
+
+// parseMetadataAnalyzers parses either a JSON list of addr:port or a text
+// of addr:port separated by commas or white spaces, # starting comments.
+func parseMetadataAnalyzers(data []byte) ([]ServiceAddress, error) {
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		list = nil
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			list = append(list, strings.FieldsFunc(line, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\r'
+			})...)
+		}
+	}
+
+	var addrs []ServiceAddress
+	for _, s := range list {
+		addr, err := parseServiceAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func discoverMetadata(url string) ([]ServiceAddress, error) {
+	client := &http.Client{Timeout: time.Duration(cfg.GetInt("agent.discovery.timeout")) * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status from %s: %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMetadataAnalyzers(data)
+}
+
+// DiscoverAnalyzers returns the analyzers found through DNS SRV records
+// then through the metadata URL, an error if none was found.
+func DiscoverAnalyzers() ([]ServiceAddress, error) {
+	var addrs []ServiceAddress
+	var errs []string
+
+	seen := make(map[ServiceAddress]bool)
+	add := func(found []ServiceAddress) {
+		for _, addr := range found {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if domain := cfg.GetString("agent.discovery.srv_domain"); domain != "" {
+		found, err := discoverSRV(domain)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("SRV lookup in %s: %s", domain, err.Error()))
+		}
+		add(found)
+	}
+
+	if url := cfg.GetString("agent.discovery.metadata_url"); url != "" {
+		found, err := discoverMetadata(url)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("metadata %s: %s", url, err.Error()))
+		}
+		add(found)
+	}
+
+	if len(addrs) == 0 {
+		if len(errs) == 0 {
+			return nil, errors.New("No analyzer discovered")
+		}
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	return addrs, nil
+}
+
+// GetAnalyzerServiceAddresses returns the analyzers the agent connects to,
+// in failover order: the configured ones, which always win, otherwise the
+// discovered ones. The local analyzer is used when none is configured and
+// the discovery is disabled, none when an empty list is configured.
+func GetAnalyzerServiceAddresses() ([]ServiceAddress, error) {
+	var addrs []ServiceAddress
+	for _, s := range cfg.GetStringSlice("agent.analyzers") {
+		addr, err := parseServiceAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	if len(addrs) > 0 || (cfg.IsSet("agent.analyzers") && !AnalyzerDiscoveryEnabled()) {
+		return addrs, nil
+	}
+
+	if AnalyzerDiscoveryEnabled() {
+		return DiscoverAnalyzers()
+	}
+
+	addr, _ := parseServiceAddress(defaultAnalyzer)
+	return []ServiceAddress{addr}, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func setDiscovery(analyzers interface{}, domain string, url string) {
+	cfg.Set("agent.analyzers", analyzers)
+	cfg.Set("agent.discovery.srv_domain", domain)
+	cfg.Set("agent.discovery.metadata_url", url)
+}
+
+func fakeSRV(records map[string][]*net.SRV) func() {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		srvs, ok := records[fmt.Sprintf("_%s._%s.%s", service, proto, name)]
+		if !ok {
+			return "", nil, errors.New("no such host")
+		}
+		return "", srvs, nil
+	}
+	return func() { lookupSRV = net.LookupSRV }
+}
+
+func TestParseMetadataAnalyzers(t *testing.T) {
+	expected := []ServiceAddress{{"10.0.0.1", 8082}, {"10.0.0.2", 8083}}
+
+	for _, data := range []string{
+		`["10.0.0.1:8082", "10.0.0.2:8083"]`,
+		"10.0.0.1:8082,10.0.0.2:8083",
+		"# analyzers\n10.0.0.1:8082\n10.0.0.2:8083 # backup\n",
+	} {
+		addrs, err := parseMetadataAnalyzers([]byte(data))
+		if err != nil {
+			t.Fatalf("Unable to parse %q: %s", data, err.Error())
+		}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Errorf("Expected %v for %q, got %v", expected, data, addrs)
+		}
+	}
+
+	if _, err := parseMetadataAnalyzers([]byte("10.0.0.1")); err == nil {
+		t.Error("Expected an error on a missing port")
+	}
+}
+
+func TestDiscoverAnalyzers(t *testing.T) {
+	defer fakeSRV(map[string][]*net.SRV{
+		"_skydive-analyzer._tcp.example.com": {
+			{Target: "analyzer1.example.com.", Port: 8082},
+			{Target: "analyzer2.example.com.", Port: 8082},
+		},
+	})()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["analyzer2.example.com:8082", "10.0.0.3:8082"]`))
+	}))
+	defer ts.Close()
+
+	setDiscovery(nil, "example.com", ts.URL)
+	defer setDiscovery(nil, "", "")
+
+	addrs, err := GetAnalyzerServiceAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ServiceAddress{
+		{"analyzer1.example.com", 8082},
+		{"analyzer2.example.com", 8082},
+		{"10.0.0.3", 8082},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, addrs)
+	}
+
+	// explicit configuration always wins over the discovery
+	setDiscovery([]string{"10.0.0.4:8082"}, "example.com", ts.URL)
+	if addrs, _ = GetAnalyzerServiceAddresses(); !reflect.DeepEqual(addrs, []ServiceAddress{{"10.0.0.4", 8082}}) {
+		t.Errorf("Expected the configured analyzer, got %v", addrs)
+	}
+}
+
+func TestDiscoveryFailure(t *testing.T) {
+	defer fakeSRV(nil)()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	setDiscovery(nil, "example.com", ts.URL)
+	defer setDiscovery(nil, "", "")
+
+	if _, err := GetAnalyzerServiceAddresses(); err == nil {
+		t.Error("Expected a discovery error")
+	}
+
+	// the agent keeps retrying with no analyzer instead of exiting
+	addr, _, err := GetAnalyzerClientAddr()
+	if err != nil || addr != "" {
+		t.Errorf("Expected no analyzer and no error, got %s, %v", addr, err)
+	}
+}
+
+func TestDefaultAnalyzer(t *testing.T) {
+	setDiscovery(nil, "", "")
+
+	addrs, err := GetAnalyzerServiceAddresses()
+	if err != nil || !reflect.DeepEqual(addrs, []ServiceAddress{{"127.0.0.1", 8082}}) {
+		t.Errorf("Expected the local analyzer, got %v, %v", addrs, err)
+	}
+
+	// an empty list makes the agent standalone
+	setDiscovery([]string{}, "", "")
+	defer setDiscovery(nil, "", "")
+
+	if addrs, _ = GetAnalyzerServiceAddresses(); len(addrs) != 0 {
+		t.Errorf("Expected no analyzer, got %v", addrs)
+	}
+}
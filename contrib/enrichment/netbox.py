@@ -0,0 +1,67 @@
+#!/usr/bin/env python
+#
+# Copyright (C) 2016 Red Hat, Inc.
+#
+# Licensed to the Apache Software Foundation (ASF) under one
+# or more contributor license agreements.  See the NOTICE file
+# distributed with this work for additional information
+# regarding copyright ownership.  The ASF licenses this file
+# to you under the Apache License, Version 2.0 (the
+# "License"); you may not use this file except in compliance
+# with the License.  You may obtain a copy of the License at
+#
+#  http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing,
+# software distributed under the License is distributed on an
+# "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+# KIND, either express or implied.  See the License for the
+# specific language governing permissions and limitations
+# under the License.
+#
+
+# Example of enrichment command for the Skydive analyzer using NetBox.
+#
+# The node is read as JSON from the standard input, the interface is looked up
+# in NetBox by its MAC address and the metadata are printed as a JSON object.
+#
+# NETBOX_URL and NETBOX_TOKEN environment variables have to be set.
+
+import json
+import os
+import sys
+import urllib2
+
+
+def netbox_get(path):
+    req = urllib2.Request(os.environ["NETBOX_URL"].rstrip("/") + path)
+    req.add_header("Accept", "application/json")
+    req.add_header("Authorization", "Token " + os.environ["NETBOX_TOKEN"])
+    return json.load(urllib2.urlopen(req, timeout=5))
+
+
+def main():
+    node = json.load(sys.stdin)
+    mac = node.get("Metadata", {}).get("MAC")
+    if not mac:
+        print("{}")
+        return
+
+    result = netbox_get("/api/dcim/interfaces/?mac_address=" + mac)
+    if not result.get("results"):
+        print("{}")
+        return
+
+    intf = result["results"][0]
+    metadata = {
+        "Source": "netbox",
+        "Description": intf.get("description") or "",
+    }
+    if intf.get("device"):
+        metadata["Device"] = intf["device"].get("name") or ""
+
+    print(json.dumps(metadata))
+
+
+if __name__ == "__main__":
+    main()
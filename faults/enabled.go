@@ -0,0 +1,118 @@
+// +build faults
+
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package faults
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Enabled tells whether the injection points are compiled in
+const Enabled = true
+
+var (
+	lock  sync.Mutex
+	armed = make(map[string]*Fault)
+)
+
+// Arm arms a fault, replacing the one of its point
+func Arm(f Fault) error {
+	if !validPoint(f.Point) {
+		return ErrUnknownPoint
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	f.Fired = 0
+	armed[f.Point] = &f
+	logging.GetLogger().Warningf("Fault armed at %s, count %d, delay %s", f.Point, f.Count, f.Delay)
+
+	return nil
+}
+
+// Disarm disarms the fault of a point
+func Disarm(point string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	delete(armed, point)
+}
+
+// Faults returns the armed faults
+func Faults() []Fault {
+	lock.Lock()
+	defer lock.Unlock()
+
+	faults := []Fault{}
+	for _, f := range armed {
+		faults = append(faults, *f)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Point < faults[j].Point })
+
+	return faults
+}
+
+func fire(point string) (Fault, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	f, ok := armed[point]
+	if !ok {
+		return Fault{}, false
+	}
+
+	f.Fired++
+	if f.Count > 0 && f.Fired >= f.Count {
+		delete(armed, point)
+	}
+	logging.GetLogger().Debugf("Fault fired at %s, %d times", point, f.Fired)
+
+	return *f, true
+}
+
+// Fire returns whether the fault of the point fires
+func Fire(point string) bool {
+	_, ok := fire(point)
+	return ok
+}
+
+// Sleep waits for the delay of the fault of the point if it fires
+func Sleep(point string) {
+	if f, ok := fire(point); ok && f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+}
+
+// Error returns ErrInjected if the fault of the point fires
+func Error(point string) error {
+	if Fire(point) {
+		return ErrInjected
+	}
+	return nil
+}
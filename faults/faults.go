@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package faults injects faults at named points of the code, ie. dropping
+// the messages of the websockets, to check that the system converges back
+// to a correct graph. The points are only compiled in with the faults
+// build tag, they are no-ops otherwise:
+//
+//	go test -tags faults ./tests/ -run Fault
+//
+// The faults are armed at runtime with the debug endpoint
+// /api/debug/faults of the agents and of the analyzers.
+package faults
+
+import (
+	"errors"
+	"time"
+)
+
+// Injection points
+const (
+	// drops the next messages sent by the websocket server to its clients
+	WSServerDrop = "ws.server.drop"
+	// drops the next messages sent by the websocket clients, ie. the agents
+	WSClientDrop = "ws.client.drop"
+	// delays the writes of the graph to its backend
+	BackendDelay = "backend.delay"
+	// fails the next reconnections to OVSDB
+	OvsdbReconnect = "ovsdb.reconnect"
+	// drops the next netlink messages received, the reception returning
+	// ENOBUFS as when the socket overflows
+	NetlinkENOBUFS = "netlink.enobufs"
+)
+
+// Points are the injection points
+var Points = []string{WSServerDrop, WSClientDrop, BackendDelay, OvsdbReconnect, NetlinkENOBUFS}
+
+var (
+	ErrDisabled     = errors.New("Faults injection not compiled in, build with the faults tag")
+	ErrUnknownPoint = errors.New("Unknown injection point")
+	// ErrInjected is the error returned by the failing points
+	ErrInjected = errors.New("Injected fault")
+)
+
+// Fault armed at an injection point, firing Count times then disarmed, 0
+// meaning until disarmed. Delay is the delay of the delaying points. Fired
+// counts the times the fault fired.
+type Fault struct {
+	Point string
+	Count int64         `json:",omitempty"`
+	Delay time.Duration `json:",omitempty"`
+	Fired int64
+}
+
+func validPoint(point string) bool {
+	for _, p := range Points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// +build faults
+
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package faults
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	if err := Arm(Fault{Point: "unknown"}); err != ErrUnknownPoint {
+		t.Errorf("Unknown point should be refused, got %v", err)
+	}
+
+	if err := Arm(Fault{Point: WSServerDrop, Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !Fire(WSServerDrop) || !Fire(WSServerDrop) {
+		t.Error("Fault should fire twice")
+	}
+	if Fire(WSServerDrop) || len(Faults()) != 0 {
+		t.Errorf("Fault should be disarmed after firing twice: %v", Faults())
+	}
+
+	// until disarmed
+	Arm(Fault{Point: OvsdbReconnect})
+	for i := 0; i < 10; i++ {
+		if Error(OvsdbReconnect) != ErrInjected {
+			t.Fatal("Fault without count should fire until disarmed")
+		}
+	}
+	if f := Faults(); len(f) != 1 || f[0].Fired != 10 {
+		t.Errorf("Wrong armed faults: %v", f)
+	}
+	Disarm(OvsdbReconnect)
+	if Error(OvsdbReconnect) != nil {
+		t.Error("Disarmed fault shouldn't fire")
+	}
+
+	Arm(Fault{Point: BackendDelay, Count: 1, Delay: 50 * time.Millisecond})
+	start := time.Now()
+	Sleep(BackendDelay)
+	Sleep(BackendDelay)
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("Expected a single delay of 50ms, waited %s", d)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"sync/atomic"
+)
+
+// CaptureStats are the counters of a capture since it started: the packets
+// and the bytes captured, or sampled by sFlow, the packets dropped before
+// reaching the capture and the flows of its table
+type CaptureStats struct {
+	Packets int64 `json:",omitempty"`
+	Bytes   int64 `json:",omitempty"`
+	Flows   int64 `json:",omitempty"`
+	Drops   int64 `json:",omitempty"`
+}
+
+// CaptureCounters counts the packets of a capture from its loop, the
+// counters being read at any time
+type CaptureCounters struct {
+	packets int64
+	bytes   int64
+	drops   int64
+}
+
+// Add counts a packet of the given size
+func (c *CaptureCounters) Add(size int) {
+	atomic.AddInt64(&c.packets, 1)
+	atomic.AddInt64(&c.bytes, int64(size))
+}
+
+// SetDrops sets the packets dropped, as reported by the kernel or by the
+// sFlow agent
+func (c *CaptureCounters) SetDrops(drops int64) {
+	atomic.StoreInt64(&c.drops, drops)
+}
+
+// Stats returns the counters along with the flows of the table
+func (c *CaptureCounters) Stats(ft *Table) *CaptureStats {
+	stats := &CaptureStats{
+		Packets: atomic.LoadInt64(&c.packets),
+		Bytes:   atomic.LoadInt64(&c.bytes),
+		Drops:   atomic.LoadInt64(&c.drops),
+	}
+	if ft != nil {
+		stats.Flows = int64(ft.FlowCount())
+	}
+	return stats
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+func (flow *Flow) start() int64 {
+	if flow.Statistics == nil {
+		return 0
+	}
+	return flow.Statistics.Start
+}
+
+// isCanonical returns whether the flow is the canonical observation of the
+// connection rather than the other one, the first one captured, the UUID
+// breaking the ties, so that the choice doesn't change between queries as
+// the counters grow, whatever the order of the flows.
+func (flow *Flow) isCanonical(other *Flow) bool {
+	s1, s2 := flow.start(), other.start()
+	if s1 != s2 {
+		return s1 < s2
+	}
+	return flow.UUID < other.UUID
+}
+
+// DedupFlows keeps only one flow, the canonical observation, of the flows
+// sharing a correlation ID, ie. the same connection seen at several
+// capture points. Flows not correlated are kept.
+func DedupFlows(flows []*Flow) []*Flow {
+	canonical := make(map[string]*Flow)
+	for _, f := range flows {
+		if f.CorrelationID == "" {
+			continue
+		}
+
+		if c, ok := canonical[f.CorrelationID]; !ok || f.isCanonical(c) {
+			canonical[f.CorrelationID] = f
+		}
+	}
+
+	var result []*Flow
+	for _, f := range flows {
+		if f.CorrelationID == "" || canonical[f.CorrelationID] == f {
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
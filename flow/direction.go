@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Client of the flows, the endpoint which initiated the connection
+const (
+	ClientA       = "A"
+	ClientB       = "B"
+	ClientUnknown = "Unknown"
+)
+
+// Confidences of the client inferred
+const (
+	ConfidenceHigh   = "high"
+	ConfidenceMedium = "medium"
+	ConfidenceLow    = "low"
+)
+
+// servicePorts are the registered ports of the common services above the
+// well-known ones, taken as the ports of servers
+var servicePorts = map[int]bool{
+	1433: true, 1521: true, 2049: true, 2379: true, 3306: true, 3389: true,
+	4789: true, 5060: true, 5432: true, 5672: true, 6379: true, 6443: true,
+	6653: true, 8080: true, 8443: true, 9092: true, 9200: true, 11211: true,
+	27017: true,
+}
+
+// portRank ranks a port by its likelihood of being the port of a server,
+// the well-known ports first and the ephemeral ones last
+func portRank(port int) int {
+	switch {
+	case port < 1024:
+		return 0
+	case servicePorts[port]:
+		return 1
+	case port < 49152:
+		return 2
+	}
+	return 3
+}
+
+// packetSide returns whether the packet goes from A to B, its source
+// being compared with the A endpoints of the flow
+func (flow *Flow) packetSide(packet *gopacket.Packet, srcPort int) bool {
+	fs := flow.GetStatistics()
+	if ipv4, ok := (*packet).Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		if ep := fs.GetEndpointsType(FlowEndpointType_IPV4); ep != nil && ep.AB.Value != ep.BA.Value {
+			return ep.AB.Value == ipv4.SrcIP.String()
+		}
+	}
+	for _, ep := range fs.GetEndpoints() {
+		if ep.Type == FlowEndpointType_TCPPORT || ep.Type == FlowEndpointType_UDPPORT || ep.Type == FlowEndpointType_SCTPPORT {
+			return ep.AB.Value == strconv.Itoa(srcPort)
+		}
+	}
+	return true
+}
+
+// setClient sets the client of the flow, the source of the packet if
+// fromSource, its destination otherwise
+func (flow *Flow) setClient(packet *gopacket.Packet, srcPort int, fromSource bool, confidence string) {
+	if flow.packetSide(packet, srcPort) == fromSource {
+		flow.Client = ClientA
+	} else {
+		flow.Client = ClientB
+	}
+	flow.DirectionConfidence = confidence
+}
+
+// inferDirection infers the client of the flow from a packet. The client
+// of a TCP or SCTP flow is given by its establishing packets, the SYN or
+// the INIT, with a high confidence, the flows whose establishing packets
+// weren't seen, ie. captured from the middle of the connection, being
+// unknown. The client of a UDP flow is inferred from its first packet and
+// the ports, the port of a server being likely well-known, with a medium
+// confidence when both agree, a low one otherwise.
+func (flow *Flow) inferDirection(packet *gopacket.Packet, first bool) {
+	switch transport := (*packet).TransportLayer().(type) {
+	case *layers.TCP:
+		switch {
+		case transport.SYN && !transport.ACK:
+			flow.setClient(packet, int(transport.SrcPort), true, ConfidenceHigh)
+		case transport.SYN && transport.ACK:
+			flow.setClient(packet, int(transport.SrcPort), false, ConfidenceHigh)
+		case first:
+			flow.Client, flow.DirectionConfidence = ClientUnknown, ""
+		}
+	case *layers.SCTP:
+		switch {
+		case (*packet).Layer(layers.LayerTypeSCTPInit) != nil:
+			flow.setClient(packet, int(transport.SrcPort), true, ConfidenceHigh)
+		case (*packet).Layer(layers.LayerTypeSCTPInitAck) != nil:
+			flow.setClient(packet, int(transport.SrcPort), false, ConfidenceHigh)
+		case first:
+			flow.Client, flow.DirectionConfidence = ClientUnknown, ""
+		}
+	case *layers.UDP:
+		if !first {
+			return
+		}
+
+		src, dst := portRank(int(transport.SrcPort)), portRank(int(transport.DstPort))
+		switch {
+		case src > dst:
+			flow.setClient(packet, int(transport.SrcPort), true, ConfidenceMedium)
+		case src < dst:
+			flow.setClient(packet, int(transport.SrcPort), false, ConfidenceLow)
+		default:
+			flow.setClient(packet, int(transport.SrcPort), true, ConfidenceLow)
+		}
+	default:
+		if first {
+			flow.Client, flow.DirectionConfidence = ClientUnknown, ""
+		}
+	}
+}
+
+// ServerEndpoint returns the statistics of the server endpoint of the
+// given type, nil if the client is unknown
+func (flow *Flow) ServerEndpoint(t FlowEndpointType) *FlowEndpointStatistics {
+	ep := flow.GetStatistics().GetEndpointsType(t)
+	if ep == nil {
+		return nil
+	}
+
+	switch flow.Client {
+	case ClientA:
+		return ep.BA
+	case ClientB:
+		return ep.AB
+	}
+	return nil
+}
+
+// ClientEndpoint returns the statistics of the client endpoint of the given
+// type, nil if the client is unknown
+func (flow *Flow) ClientEndpoint(t FlowEndpointType) *FlowEndpointStatistics {
+	ep := flow.GetStatistics().GetEndpointsType(t)
+	if ep == nil {
+		return nil
+	}
+
+	switch flow.Client {
+	case ClientA:
+		return ep.AB
+	case ClientB:
+		return ep.BA
+	}
+	return nil
+}
+
+// ServiceStatistics are the statistics of the flows of a server endpoint,
+// its address and port along with its transport
+type ServiceStatistics struct {
+	Service   string
+	Address   string
+	Port      string
+	Transport string
+	Flows     int
+	Clients   int
+	Packets   uint64
+	Bytes     uint64
+	clients   map[string]bool
+}
+
+// Service returns the address, the port and the transport of the server
+// endpoint of the flow, empty if its client is unknown or it has no
+// transport
+func (flow *Flow) Service() (string, string, string) {
+	for _, t := range []FlowEndpointType{FlowEndpointType_TCPPORT, FlowEndpointType_UDPPORT, FlowEndpointType_SCTPPORT} {
+		if port := flow.ServerEndpoint(t); port != nil {
+			address := flow.ServerEndpoint(FlowEndpointType_IPV4)
+			if address == nil {
+				return "", "", ""
+			}
+			return address.Value, port.Value, strings.TrimSuffix(t.String(), "PORT")
+		}
+	}
+	return "", "", ""
+}
+
+// TopServices groups the flows whose client is known by server endpoint,
+// the services being sorted by bytes exchanged
+func TopServices(flows []*Flow) []*ServiceStatistics {
+	services := make(map[string]*ServiceStatistics)
+	for _, f := range flows {
+		address, port, transport := f.Service()
+		if address == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%s/%s", address, port, transport)
+		s, ok := services[key]
+		if !ok {
+			s = &ServiceStatistics{Service: key, Address: address, Port: port, Transport: transport, clients: make(map[string]bool)}
+			services[key] = s
+		}
+
+		s.Flows++
+		if client := f.ClientEndpoint(FlowEndpointType_IPV4); client != nil {
+			s.clients[client.Value] = true
+		}
+		if eth := f.GetStatistics().GetEndpointsType(FlowEndpointType_ETHERNET); eth != nil {
+			s.Packets += eth.AB.Packets + eth.BA.Packets
+			s.Bytes += eth.AB.Bytes + eth.BA.Bytes
+		}
+	}
+
+	result := make([]*ServiceStatistics, 0, len(services))
+	for _, s := range services {
+		s.Clients = len(s.clients)
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Service < result[j].Service
+	})
+
+	return result
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	clientMAC = net.HardwareAddr{0x00, 0x0F, 0xAA, 0xFA, 0xAA, 0x01}
+	serverMAC = net.HardwareAddr{0x00, 0x0D, 0xBD, 0xBD, 0xBD, 0x02}
+	clientIP  = net.IP{10, 0, 0, 1}
+	serverIP  = net.IP{10, 0, 0, 2}
+)
+
+// directionPacket forges a packet of the connection of the client to the
+// server, from the server if reply
+func directionPacket(t *testing.T, reply bool, transport gopacket.SerializableLayer) *gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: clientMAC, DstMAC: serverMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: clientIP, DstIP: serverIP}
+	if reply {
+		eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	}
+
+	switch transport.(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, eth, ip, transport, gopacket.Payload([]byte{1, 2, 3})); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	return &packet
+}
+
+func tcpPacket(t *testing.T, reply bool, syn bool, ack bool) *gopacket.Packet {
+	tcp := &layers.TCP{SrcPort: 43512, DstPort: 80, SYN: syn, ACK: ack}
+	if reply {
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	return directionPacket(t, reply, tcp)
+}
+
+func udpPacket(t *testing.T, reply bool, clientPort layers.UDPPort, serverPort layers.UDPPort) *gopacket.Packet {
+	udp := &layers.UDP{SrcPort: clientPort, DstPort: serverPort}
+	if reply {
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	return directionPacket(t, reply, udp)
+}
+
+func checkDirection(t *testing.T, name string, packets []*gopacket.Packet, client string, confidence string) *Flow {
+	ft := NewTable()
+
+	var f *Flow
+	for _, packet := range packets {
+		f = FlowFromGoPacket(ft, packet, nil)
+	}
+
+	if f.Client != client || f.DirectionConfidence != confidence {
+		t.Errorf("%s: wrong client %s with confidence %s, expected %s with %s", name, f.Client, f.DirectionConfidence, client, confidence)
+	}
+	return f
+}
+
+func TestTCPDirection(t *testing.T) {
+	f := checkDirection(t, "handshake", []*gopacket.Packet{
+		tcpPacket(t, false, true, false),
+		tcpPacket(t, true, true, true),
+		tcpPacket(t, false, false, true),
+	}, ClientA, ConfidenceHigh)
+
+	if server := f.ServerEndpoint(FlowEndpointType_IPV4); server == nil || server.Value != serverIP.String() {
+		t.Errorf("Wrong server endpoint: %v", server)
+	}
+	if client := f.ClientEndpoint(FlowEndpointType_TCPPORT); client == nil || client.Value != "43512" {
+		t.Errorf("Wrong client endpoint: %v", client)
+	}
+
+	// captured after the SYN, the SYN-ACK telling the client
+	checkDirection(t, "SYN-ACK", []*gopacket.Packet{
+		tcpPacket(t, true, true, true),
+		tcpPacket(t, false, false, true),
+	}, ClientB, ConfidenceHigh)
+
+	// captured from the middle of the connection, from the server, not
+	// guessed from the ports
+	f = checkDirection(t, "mid-connection", []*gopacket.Packet{
+		tcpPacket(t, true, false, true),
+		tcpPacket(t, false, false, true),
+	}, ClientUnknown, "")
+
+	if f.ServerEndpoint(FlowEndpointType_IPV4) != nil {
+		t.Error("Flow with an unknown client shouldn't have a server endpoint")
+	}
+}
+
+func TestUDPDirection(t *testing.T) {
+	// the first packet and the well-known port agree
+	checkDirection(t, "query", []*gopacket.Packet{
+		udpPacket(t, false, 51234, 53),
+		udpPacket(t, true, 51234, 53),
+	}, ClientA, ConfidenceMedium)
+
+	// captured from the reply, the port telling the client
+	checkDirection(t, "reply first", []*gopacket.Packet{
+		udpPacket(t, true, 51234, 53),
+		udpPacket(t, false, 51234, 53),
+	}, ClientB, ConfidenceLow)
+
+	// both ports ephemeral, only the first packet
+	checkDirection(t, "ephemeral", []*gopacket.Packet{
+		udpPacket(t, false, 51234, 51235),
+	}, ClientA, ConfidenceLow)
+}
+
+func TestTopServices(t *testing.T) {
+	ft := NewTable()
+
+	for _, packet := range []*gopacket.Packet{
+		tcpPacket(t, false, true, false),
+		tcpPacket(t, true, true, true),
+		udpPacket(t, false, 51234, 53),
+		udpPacket(t, false, 51235, 53),
+		udpPacket(t, true, 51235, 53),
+	} {
+		FlowFromGoPacket(ft, packet, nil)
+	}
+
+	// the client of this one is unknown
+	FlowFromGoPacket(ft, udpPacket(t, false, 51236, 8081), nil).Client = ClientUnknown
+
+	services := TopServices(ft.GetFlows())
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(services))
+	}
+
+	dns := services[0]
+	if dns.Service != "10.0.0.2:53/UDP" || dns.Flows != 2 || dns.Clients != 1 || dns.Packets != 3 {
+		t.Errorf("Wrong DNS service: %+v", dns)
+	}
+	if services[1].Service != "10.0.0.2:80/TCP" || services[1].Flows != 1 {
+		t.Errorf("Wrong HTTP service: %+v", services[1])
+	}
+}
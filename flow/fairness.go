@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"sync"
+	"time"
+)
+
+// Sampling fairness modes of the captures
+const (
+	// all the samples are decoded
+	FairnessNone = ""
+	// the samples of a flow beyond its budget are only counted
+	FairnessPerFlow = "per-flow"
+)
+
+// SamplingStats gives the budgets of a capture with fairness and their
+// effect, the samples decoded and the ones only counted, the flows reported
+// at expiry and the ones of them flagged as low confidence
+type SamplingStats struct {
+	Fairness           string
+	FlowBudget         int
+	TotalBudget        int
+	ProcessedSamples   int64
+	SuppressedSamples  int64
+	FlowsReported      int64
+	LowConfidenceFlows int64
+}
+
+// SampleBudget keeps a few elephant flows from starving the others. The
+// samples are decoded up to FlowBudget per flow key and per Interval, the
+// next ones being only counted, so that the budget of all the keys,
+// TotalBudget per Interval, is left for the new keys. Once exhausted only
+// the first sample of the keys not seen during the interval is decoded. A 0
+// budget is unlimited.
+type SampleBudget struct {
+	sync.Mutex
+	FlowBudget  int
+	TotalBudget int
+	Interval    time.Duration
+	// flows reported at expiry with less samples are low confidence
+	LowConfidence int
+	start         time.Time
+	total         int
+	keys          map[FlowKey]int
+	stats         SamplingStats
+}
+
+// NewSampleBudget returns the budget of a capture with fairness
+func NewSampleBudget(flowBudget int, totalBudget int, interval time.Duration, lowConfidence int) *SampleBudget {
+	return &SampleBudget{
+		FlowBudget:    flowBudget,
+		TotalBudget:   totalBudget,
+		Interval:      interval,
+		LowConfidence: lowConfidence,
+		keys:          make(map[FlowKey]int),
+	}
+}
+
+// Allow returns whether a sample of the flow key is to be decoded, the
+// samples refused being counted as suppressed
+func (b *SampleBudget) Allow(key FlowKey, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if now.Sub(b.start) >= b.Interval {
+		b.start = now
+		b.total = 0
+		b.keys = make(map[FlowKey]int)
+	}
+
+	n := b.keys[key]
+	if (b.FlowBudget > 0 && n >= b.FlowBudget) || (b.TotalBudget > 0 && b.total >= b.TotalBudget && n > 0) {
+		b.stats.SuppressedSamples++
+		return false
+	}
+
+	b.keys[key] = n + 1
+	b.total++
+	b.stats.ProcessedSamples++
+
+	return true
+}
+
+// samples returns the samples of a flow, the decoded ones and the ones
+// only counted
+func samples(f *Flow) int64 {
+	n := f.SuppressedSamples
+	if fs := f.GetStatistics(); fs != nil {
+		if eth := fs.GetEndpointsType(FlowEndpointType_ETHERNET); eth != nil {
+			n += int64(eth.AB.Packets + eth.BA.Packets)
+		}
+	}
+	return n
+}
+
+// report accounts a flow reported at expiry, flagging it as low confidence
+// if it got too few samples
+func (b *SampleBudget) report(f *Flow) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.stats.FlowsReported++
+	if samples(f) < int64(b.LowConfidence) {
+		f.LowConfidence = true
+		b.stats.LowConfidenceFlows++
+	}
+}
+
+// Stats returns the budgets and their effect
+func (b *SampleBudget) Stats() *SamplingStats {
+	b.Lock()
+	defer b.Unlock()
+
+	stats := b.stats
+	stats.Fairness = FairnessPerFlow
+	stats.FlowBudget = b.FlowBudget
+	stats.TotalBudget = b.TotalBudget
+
+	return &stats
+}
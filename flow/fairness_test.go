@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	elephants       = 3
+	elephantPackets = 1000
+	mice            = 300
+)
+
+// heavyTailedPackets returns the packets of a few elephant flows, the
+// packets of the mice flows, one each, being interleaved
+func heavyTailedPackets(t *testing.T) []*gopacket.Packet {
+	var packets []*gopacket.Packet
+	mouse := 0
+	for i := 0; i < elephantPackets; i++ {
+		for e := int64(0); e < elephants; e++ {
+			packets = append(packets, forgeTestPacket(t, e, false, ETH, IPv4, TCP))
+		}
+		if i%(elephantPackets/mice) == 0 && mouse < mice {
+			packets = append(packets, forgeTestPacket(t, int64(1000+mouse), false, ETH, IPv4, UDP))
+			mouse++
+		}
+	}
+	return packets
+}
+
+func TestSampleBudget(t *testing.T) {
+	b := NewSampleBudget(2, 5, time.Hour, 2)
+	now := time.Now()
+	a, c := FlowKey{net: 1}, FlowKey{net: 3}
+
+	if !b.Allow(a, now) || !b.Allow(a, now) || b.Allow(a, now) {
+		t.Error("Only 2 samples of a flow should be allowed")
+	}
+
+	for _, key := range []FlowKey{{net: 2}, {net: 2}, c} {
+		if !b.Allow(key, now) {
+			t.Errorf("Sample of %s should be allowed", key)
+		}
+	}
+
+	// the total budget is used, only the new keys are allowed
+	if !b.Allow(FlowKey{net: 4}, now) {
+		t.Error("First sample of a new key should be allowed")
+	}
+	if b.Allow(c, now) {
+		t.Error("Sample of a key seen should be suppressed once the total budget used")
+	}
+
+	if !b.Allow(a, now.Add(time.Hour)) {
+		t.Error("Budget should be renewed for the next interval")
+	}
+
+	if stats := b.Stats(); stats.ProcessedSamples != 7 || stats.SuppressedSamples != 2 {
+		t.Errorf("Wrong sampling stats: %+v", stats)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	ft := NewTable()
+	ft.SetSampleBudget(NewSampleBudget(10, 100, time.Hour, 2))
+
+	for _, packet := range heavyTailedPackets(t) {
+		FlowFromGoPacket(ft, packet, nil)
+	}
+
+	flows := ft.GetFlows()
+	if len(flows) != elephants+mice {
+		t.Fatalf("All the flows should be visible, got %d", len(flows))
+	}
+
+	for _, f := range flows {
+		switch samples(f) {
+		case elephantPackets:
+			if f.SuppressedSamples != elephantPackets-10 {
+				t.Errorf("Only 10 samples of an elephant flow should be decoded, %d suppressed", f.SuppressedSamples)
+			}
+		case 1:
+			if f.SuppressedSamples != 0 {
+				t.Error("Sample of a mouse flow shouldn't be suppressed")
+			}
+		default:
+			t.Errorf("Wrong samples of flow %s: %d", f.UUID, samples(f))
+		}
+	}
+
+	const MaxInt64 = int64(^uint64(0) >> 1)
+	fc := MyTestFlowCounter{}
+	ft.expire(fc.countFlowsCallback, MaxInt64)
+
+	for _, f := range flows {
+		if f.LowConfidence != (samples(f) == 1) {
+			t.Errorf("Only the single sample flows should be low confidence: %d samples", samples(f))
+		}
+	}
+
+	stats := ft.SampleBudget().Stats()
+	if stats.FlowsReported != elephants+mice || stats.LowConfidenceFlows != mice {
+		t.Errorf("Wrong reported flows: %+v", stats)
+	}
+	if stats.ProcessedSamples != elephants*10+mice || stats.SuppressedSamples != elephants*(elephantPackets-10) {
+		t.Errorf("Wrong samples: %+v", stats)
+	}
+}
+
+func benchmarkHeavyTailed(b *testing.B, budget func() *SampleBudget) {
+	packets := heavyTailedPackets(&testing.T{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ft := NewTable()
+		if budget != nil {
+			ft.SetSampleBudget(budget())
+		}
+		for _, packet := range packets {
+			FlowFromGoPacket(ft, packet, nil)
+		}
+	}
+}
+
+func BenchmarkHeavyTailed(b *testing.B) {
+	benchmarkHeavyTailed(b, nil)
+}
+
+func BenchmarkHeavyTailedFairness(b *testing.B) {
+	benchmarkHeavyTailed(b, func() *SampleBudget {
+		return NewSampleBudget(10, 100, time.Hour, 2)
+	})
+}
@@ -43,6 +43,12 @@ type FlowProbePathSetter interface {
 	SetProbePath(flow *Flow) bool
 }
 
+// SFlowPortResolver gives the graph paths of the interfaces matching the
+// input and output ports of a sFlow sample, empty when unknown.
+type SFlowPortResolver interface {
+	ResolvePorts(input uint32, output uint32) (string, string)
+}
+
 func (s *FlowEndpointsStatistics) MarshalJSON() ([]byte, error) {
 	obj := &struct {
 		Type string
@@ -178,6 +184,7 @@ func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet) error {
 	}
 	fs.Last = now
 	fs.Update(packet)
+	flow.inferDirection(packet, newFlow)
 
 	if newFlow {
 		hasher := sha1.New()
@@ -201,6 +208,7 @@ func (flow *Flow) fillFromGoPacket(packet *gopacket.Packet) error {
 		binary.BigEndian.PutUint64(bfStart, uint64(fs.Start))
 		hasher.Write(bfStart)
 		hasher.Write([]byte(flow.ProbeGraphPath))
+		hasher.Write([]byte(flow.ProbeNodeID))
 		flow.UUID = hex.EncodeToString(hasher.Sum(nil))
 	}
 	return nil
@@ -226,9 +234,24 @@ func (flow *Flow) GetData() ([]byte, error) {
 	return data, nil
 }
 
+// FlowFromGoPacket returns the flow of the packet, updated with it. With a
+// sample budget, the packets of a flow beyond its budget are only counted,
+// the flow being left as is.
 func FlowFromGoPacket(ft *Table, packet *gopacket.Packet, setter FlowProbePathSetter) *Flow {
 	key := NewFlowKeyFromGoPacket(packet)
-	flow, _ := ft.GetOrCreateFlow(key.String())
+	k := key.String()
+	if budget := ft.SampleBudget(); budget != nil {
+		now := time.Now()
+		if !budget.Allow(*key, now) {
+			if flow := ft.GetFlow(k); flow != nil && flow.GetStatistics() != nil {
+				flow.SuppressedSamples++
+				flow.Statistics.Last = now.Unix()
+				return flow
+			}
+		}
+	}
+
+	flow, _ := ft.GetOrCreateFlow(k)
 	if setter != nil {
 		setter.SetProbePath(flow)
 	}
@@ -243,8 +266,44 @@ func FlowFromGoPacket(ft *Table, packet *gopacket.Packet, setter FlowProbePathSe
 }
 
 func FlowsFromSFlowSample(ft *Table, sample *layers.SFlowFlowSample, setter FlowProbePathSetter) []*Flow {
+	return FlowsFromSFlowSampleWithPorts(ft, sample, setter, nil)
+}
+
+// setInterfacesFromPorts sets the interface paths of the flow, if not set
+// yet, from the ports of a sample of the packet. The input port is the one
+// of the source of the packet which is the B endpoint for the packets going
+// from B to A.
+func (flow *Flow) setInterfacesFromPorts(packet *gopacket.Packet, input string, output string) {
+	if input == "" && output == "" {
+		return
+	}
+
+	eth := flow.GetStatistics().GetEndpointsType(FlowEndpointType_ETHERNET)
+	if ethernet, ok := (*packet).Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok && eth != nil {
+		if ethernet.SrcMAC.String() != eth.AB.Value {
+			input, output = output, input
+		}
+	}
+
+	if flow.IfSrcGraphPath == "" {
+		flow.IfSrcGraphPath = input
+	}
+	if flow.IfDstGraphPath == "" {
+		flow.IfDstGraphPath = output
+	}
+}
+
+// FlowsFromSFlowSampleWithPorts returns the flows of the sample, the
+// interfaces of the flows being resolved from the input and output ports of
+// the sample if a resolver is given.
+func FlowsFromSFlowSampleWithPorts(ft *Table, sample *layers.SFlowFlowSample, setter FlowProbePathSetter, resolver SFlowPortResolver) []*Flow {
 	flows := []*Flow{}
 
+	var input, output string
+	if resolver != nil {
+		input, output = resolver.ResolvePorts(sample.InputInterface, sample.OutputInterface)
+	}
+
 	for _, rec := range sample.Records {
 
 		/* FIX(safchain): just keeping the raw packet for now */
@@ -263,6 +322,7 @@ func FlowsFromSFlowSample(ft *Table, sample *layers.SFlowFlowSample, setter Flow
 
 		flow := FlowFromGoPacket(ft, &record.Header, setter)
 		if flow != nil {
+			flow.setInterfacesFromPorts(&record.Header, input, output)
 			flows = append(flows, flow)
 		}
 	}
@@ -159,6 +159,42 @@ type Flow struct {
 	ProbeGraphPath string `protobuf:"bytes,11,opt,name=ProbeGraphPath" json:"ProbeGraphPath,omitempty"`
 	IfSrcGraphPath string `protobuf:"bytes,14,opt,name=IfSrcGraphPath" json:"IfSrcGraphPath,omitempty"`
 	IfDstGraphPath string `protobuf:"bytes,19,opt,name=IfDstGraphPath" json:"IfDstGraphPath,omitempty"`
+	// Flow Correlation IDentifier
+	//
+	// flow.CorrelationID is shared by the flows of a same connection captured
+	// at several capture points on the same path, set by the analyzer.
+	CorrelationID string `protobuf:"bytes,20,opt,name=CorrelationID" json:"CorrelationID,omitempty"`
+	// Owners of the interfaces
+	//
+	// the IDs and types of the nearest container, VM or pod nodes owning the
+	// source and destination interfaces, set by the analyzer. They are left
+	// empty for the interfaces shared by several owners, ie. bridge uplinks.
+	SrcOwnerID   string `protobuf:"bytes,21,opt,name=SrcOwnerID" json:"SrcOwnerID,omitempty"`
+	SrcOwnerType string `protobuf:"bytes,22,opt,name=SrcOwnerType" json:"SrcOwnerType,omitempty"`
+	DstOwnerID   string `protobuf:"bytes,23,opt,name=DstOwnerID" json:"DstOwnerID,omitempty"`
+	DstOwnerType string `protobuf:"bytes,24,opt,name=DstOwnerType" json:"DstOwnerType,omitempty"`
+	// Node of the probe
+	//
+	// the ID of the node the flow was captured on, the captures following
+	// their interface when it's recreated, the flows captured before and
+	// after carrying the IDs of the respective nodes.
+	ProbeNodeID string `protobuf:"bytes,25,opt,name=ProbeNodeID" json:"ProbeNodeID,omitempty"`
+	// Sampling fairness
+	//
+	// the samples of the flow only counted, not decoded, the flow having used
+	// its budget of samples with the fairness of its capture. A flow reported
+	// at expiry with less samples than the confidence threshold is flagged as
+	// low confidence, its statistics being approximate.
+	SuppressedSamples int64 `protobuf:"varint,26,opt,name=SuppressedSamples" json:"SuppressedSamples,omitempty"`
+	LowConfidence     bool  `protobuf:"varint,27,opt,name=LowConfidence" json:"LowConfidence,omitempty"`
+	// Direction
+	//
+	// the endpoint which initiated the connection, the client, "A" or "B",
+	// the other one being the server, "Unknown" when the establishing packets
+	// weren't seen. The confidence is high when they were seen, ie. the TCP
+	// SYN, medium or low when inferred from the first packet and the ports.
+	Client              string `protobuf:"bytes,28,opt,name=Client" json:"Client,omitempty"`
+	DirectionConfidence string `protobuf:"bytes,29,opt,name=DirectionConfidence" json:"DirectionConfidence,omitempty"`
 }
 
 func (m *Flow) Reset()                    { *m = Flow{} }
@@ -183,34 +219,44 @@ func init() {
 }
 
 var fileDescriptor0 = []byte{
-	// 462 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x53, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0x25, 0xf6, 0xba, 0xa9, 0x27, 0xc5, 0x84, 0xa5, 0x2a, 0x3e, 0x00, 0x42, 0x39, 0x20, 0x14,
-	0xa1, 0x22, 0x95, 0x5e, 0x10, 0xa7, 0xa4, 0x31, 0xd4, 0x6a, 0x95, 0x5a, 0xeb, 0x4d, 0xb9, 0x21,
-	0xad, 0x83, 0x8b, 0x2d, 0xac, 0xd8, 0xf2, 0x6e, 0xa9, 0xf2, 0x07, 0xfc, 0x10, 0xff, 0xc7, 0xec,
-	0xba, 0x8d, 0x1d, 0x72, 0xe1, 0xe2, 0xcc, 0x7b, 0x7e, 0x6f, 0xde, 0xec, 0x6c, 0x0c, 0x4f, 0x6e,
-	0x8a, 0xf2, 0xee, 0xbd, 0x7e, 0x1c, 0x57, 0x75, 0xa9, 0x4a, 0x4a, 0x74, 0x3d, 0xfa, 0x06, 0x47,
-	0x9f, 0xf1, 0x37, 0x58, 0x7d, 0xaf, 0xca, 0x7c, 0xa5, 0x62, 0x25, 0x54, 0x2e, 0x55, 0xbe, 0x94,
-	0xf4, 0x10, 0x9c, 0x6b, 0x51, 0xdc, 0xa6, 0xbe, 0xf5, 0xba, 0xf7, 0xd6, 0x65, 0xce, 0x2f, 0x0d,
-	0xa8, 0x0f, 0xfd, 0x48, 0x2c, 0x7f, 0xa6, 0x4a, 0xfa, 0x0e, 0xf2, 0x84, 0xf5, 0xab, 0x06, 0x6a,
-	0xfd, 0x74, 0xad, 0x52, 0xe9, 0xef, 0x19, 0xde, 0x49, 0x34, 0x18, 0xfd, 0xe9, 0xc1, 0xf3, 0x6e,
-	0x80, 0xec, 0x24, 0x8c, 0x81, 0xf0, 0x75, 0x95, 0xfa, 0x3d, 0x34, 0x78, 0x27, 0x47, 0xc7, 0x66,
-	0xb8, 0xae, 0x58, 0xbf, 0x65, 0x44, 0xe1, 0x93, 0x52, 0x20, 0xe7, 0x42, 0x66, 0x66, 0x98, 0x03,
-	0x46, 0x32, 0xac, 0xe9, 0x3b, 0xb0, 0x26, 0x53, 0xdf, 0x46, 0x66, 0x70, 0xf2, 0x62, 0xd7, 0xdd,
-	0x26, 0x31, 0x4b, 0x4c, 0xb5, 0x7a, 0x3a, 0xf1, 0xc9, 0xff, 0xa8, 0x93, 0xc9, 0xe8, 0x0e, 0x3c,
-	0xfd, 0x76, 0x7b, 0x1f, 0x88, 0x6a, 0x65, 0xc6, 0xb5, 0x99, 0x23, 0x35, 0xd0, 0x73, 0x5d, 0x0a,
-	0xa9, 0xcc, 0x5c, 0x36, 0x23, 0x05, 0xd6, 0xf4, 0x13, 0xb8, 0x9b, 0xe3, 0xe2, 0x78, 0x36, 0x06,
-	0xbe, 0xdc, 0x0d, 0xec, 0x6c, 0x82, 0xb9, 0xe9, 0x03, 0x39, 0xfa, 0x6d, 0x01, 0xd1, 0x32, 0xdd,
-	0x79, 0xb1, 0x08, 0x67, 0x26, 0xce, 0x65, 0xe4, 0x16, 0x6b, 0xfa, 0x0a, 0xe0, 0x52, 0xac, 0xd3,
-	0x5a, 0x46, 0x42, 0x65, 0xf7, 0x17, 0x03, 0xc5, 0x86, 0xa1, 0xa7, 0x00, 0x6d, 0xd7, 0xfb, 0xcd,
-	0x1c, 0xb6, 0xd1, 0x9d, 0x44, 0x90, 0xed, 0xc9, 0xb0, 0x2b, 0xaf, 0xf1, 0x16, 0xf3, 0xd5, 0x0f,
-	0xcc, 0x73, 0x9a, 0xae, 0x6a, 0xc3, 0xd0, 0x37, 0xe0, 0x45, 0x75, 0x99, 0xa4, 0x5f, 0x6a, 0x51,
-	0x65, 0x26, 0x79, 0x60, 0x34, 0x5e, 0xb5, 0xc5, 0x6a, 0x5d, 0x78, 0x13, 0xd7, 0xcb, 0x56, 0xe7,
-	0x35, 0xba, 0x7c, 0x8b, 0x6d, 0x74, 0x33, 0xa9, 0x5a, 0xdd, 0xb3, 0x07, 0x5d, 0x97, 0x1d, 0x7f,
-	0x84, 0xa7, 0xdd, 0x85, 0x99, 0x93, 0xd3, 0x7d, 0x5c, 0x78, 0x38, 0xbf, 0x18, 0x3e, 0xa2, 0x03,
-	0xe8, 0xcf, 0x03, 0xfe, 0xf5, 0x8a, 0x5d, 0x0c, 0x7b, 0xf4, 0x31, 0xb8, 0x9c, 0x4d, 0xe6, 0x71,
-	0x74, 0xc5, 0xf8, 0xd0, 0x1a, 0x33, 0x18, 0xfe, 0xfb, 0x47, 0xa2, 0x07, 0xb0, 0x1f, 0xf0, 0xf3,
-	0x80, 0xa1, 0x09, 0xdd, 0xd8, 0x27, 0x8c, 0xae, 0x4f, 0xd1, 0x8a, 0x7d, 0xf8, 0x59, 0xd4, 0x18,
-	0x35, 0x58, 0xcc, 0x1a, 0x60, 0x6b, 0x47, 0x7c, 0xc6, 0x1b, 0x44, 0x92, 0x3d, 0xf3, 0xdd, 0x7c,
-	0xf8, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x52, 0x0b, 0xe1, 0x20, 0x4a, 0x03, 0x00, 0x00,
+	// 615 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8d, 0x54, 0x5d, 0x8f, 0xd2, 0x40,
+	0x14, 0x15, 0x28, 0x5f, 0x97, 0x0f, 0x61, 0x40, 0xb6, 0xea, 0xae, 0xd9, 0x10, 0x63, 0x0c, 0x31,
+	0xab, 0x59, 0xf7, 0xc5, 0xf8, 0xc4, 0x97, 0x2e, 0x59, 0x02, 0x64, 0x28, 0xeb, 0x9b, 0x49, 0x69,
+	0x07, 0x69, 0xac, 0x6d, 0xd3, 0x19, 0x24, 0xfc, 0x30, 0xff, 0x9a, 0xcf, 0xde, 0x99, 0x2e, 0xb4,
+	0x2c, 0x2f, 0xbe, 0x94, 0xb9, 0xe7, 0x9e, 0x7b, 0xce, 0x9d, 0xdb, 0x5b, 0xe0, 0xe9, 0xca, 0xf5,
+	0xb7, 0xef, 0xe5, 0xe3, 0x2a, 0x08, 0x7d, 0xe1, 0x13, 0x4d, 0x9e, 0xdb, 0xdf, 0xa1, 0xf5, 0x05,
+	0x7f, 0x87, 0x9e, 0x1d, 0xf8, 0x8e, 0x27, 0xe6, 0xc2, 0x14, 0x0e, 0x17, 0x8e, 0xc5, 0x49, 0x13,
+	0xb2, 0xf7, 0xa6, 0xbb, 0x61, 0x7a, 0xfa, 0x32, 0xf5, 0xb6, 0x48, 0xb3, 0xbf, 0x65, 0x40, 0x74,
+	0xc8, 0xcf, 0x4c, 0xeb, 0x27, 0x13, 0x5c, 0xcf, 0x22, 0xae, 0xd1, 0x7c, 0x10, 0x85, 0x92, 0xdf,
+	0xdb, 0x09, 0xc6, 0xf5, 0x9c, 0xc2, 0xb3, 0x4b, 0x19, 0xb4, 0xff, 0xa4, 0xe0, 0x2c, 0x69, 0xc0,
+	0x13, 0x0e, 0x1d, 0xd0, 0x8c, 0x5d, 0xc0, 0xf4, 0x14, 0x16, 0x54, 0xaf, 0x5b, 0x57, 0xaa, 0xb9,
+	0x24, 0x59, 0x66, 0xa9, 0x26, 0xf0, 0x49, 0x08, 0x68, 0xb7, 0x26, 0x5f, 0xab, 0x66, 0xca, 0x54,
+	0x5b, 0xe3, 0x99, 0xbc, 0x83, 0x74, 0xb7, 0xa7, 0x67, 0x10, 0x29, 0x5d, 0x9f, 0x9f, 0x56, 0xc7,
+	0x4e, 0x34, 0x6d, 0xf6, 0x24, 0xbb, 0xd7, 0xd5, 0xb5, 0xff, 0x61, 0x2f, 0xbb, 0xed, 0x2d, 0x54,
+	0x65, 0xf6, 0x78, 0x1e, 0x18, 0x85, 0x42, 0xb5, 0x9b, 0xa1, 0x59, 0x2e, 0x03, 0xd9, 0xd7, 0xd8,
+	0xe4, 0x42, 0xf5, 0x95, 0xa1, 0x9a, 0x8b, 0x67, 0xf2, 0x19, 0x8a, 0x87, 0xeb, 0x62, 0x7b, 0x19,
+	0x34, 0xbc, 0x38, 0x35, 0x4c, 0x4c, 0x82, 0x16, 0xd9, 0x1e, 0x6c, 0xff, 0xd5, 0x40, 0x93, 0x34,
+	0xa9, 0xbc, 0x58, 0x8c, 0x06, 0xca, 0xae, 0x48, 0xb5, 0x0d, 0x9e, 0xc9, 0x2b, 0x80, 0xb1, 0xb9,
+	0x63, 0x21, 0x9f, 0x99, 0x62, 0xfd, 0xf0, 0x62, 0xc0, 0x3d, 0x20, 0xe4, 0x06, 0x20, 0x56, 0x7d,
+	0x98, 0x4c, 0x33, 0xb6, 0x4e, 0x38, 0x02, 0x8f, 0x6f, 0x86, 0xaa, 0x46, 0x88, 0x6f, 0xd1, 0xf1,
+	0x7e, 0xa0, 0x5f, 0x36, 0x52, 0x15, 0x07, 0x84, 0xbc, 0x81, 0xea, 0x2c, 0xf4, 0x97, 0xec, 0x6b,
+	0x68, 0x06, 0x6b, 0xe5, 0x5c, 0x52, 0x9c, 0x6a, 0x70, 0x84, 0x4a, 0xde, 0x68, 0x35, 0x0f, 0xad,
+	0x98, 0x57, 0x8d, 0x78, 0xce, 0x11, 0x1a, 0xf1, 0x06, 0x5c, 0xc4, 0xbc, 0xc6, 0x9e, 0x97, 0x44,
+	0xc9, 0x6b, 0xa8, 0xf4, 0xfd, 0x30, 0x64, 0x2e, 0x76, 0xea, 0x7b, 0xd8, 0x5a, 0x53, 0xd1, 0x2a,
+	0x56, 0x12, 0x94, 0xdd, 0xa3, 0xfa, 0x74, 0xeb, 0xb1, 0x10, 0x29, 0xcf, 0xa2, 0xee, 0xf9, 0x01,
+	0x21, 0x6d, 0x28, 0xef, 0xf3, 0x6a, 0xdb, 0x5a, 0x8a, 0x51, 0xe6, 0x09, 0x4c, 0x6a, 0xa0, 0xf3,
+	0x5e, 0xe3, 0x2c, 0xd2, 0xb0, 0x0f, 0x88, 0xd4, 0xd8, 0xe7, 0x95, 0x86, 0x1e, 0x69, 0xd8, 0x09,
+	0x8c, 0x5c, 0x42, 0x49, 0x4d, 0x69, 0xe2, 0xdb, 0x0c, 0x45, 0x9e, 0x2b, 0x4a, 0x29, 0x88, 0x21,
+	0xdc, 0xc0, 0xfa, 0x7c, 0x13, 0x04, 0x21, 0xe3, 0x9c, 0xd9, 0x73, 0xf3, 0x57, 0xe0, 0xe2, 0xd7,
+	0xf2, 0x42, 0x2d, 0x4e, 0x9d, 0x3f, 0x4e, 0xc8, 0xdb, 0x8f, 0xfd, 0x6d, 0xdf, 0xf7, 0x56, 0x8e,
+	0xcd, 0x3c, 0x8b, 0xe9, 0x2f, 0x91, 0x59, 0xa0, 0x15, 0x37, 0x09, 0x92, 0x16, 0xe4, 0xfa, 0xae,
+	0xc3, 0x3c, 0xa1, 0x9f, 0x2b, 0xc3, 0x9c, 0xa5, 0x22, 0xf2, 0x01, 0x1a, 0x03, 0x27, 0x64, 0x96,
+	0x1c, 0x52, 0x42, 0xe3, 0x42, 0x91, 0x1a, 0xf6, 0x69, 0xaa, 0xf3, 0x09, 0xea, 0xc9, 0xf5, 0x54,
+	0x7b, 0x46, 0x0a, 0xb8, 0xde, 0xa3, 0xc9, 0x5d, 0xed, 0x09, 0x29, 0x41, 0x7e, 0x32, 0x34, 0xbe,
+	0x4d, 0xe9, 0x5d, 0x2d, 0x45, 0x2a, 0x50, 0x34, 0x68, 0x77, 0x32, 0x9f, 0x4d, 0xa9, 0x51, 0x4b,
+	0x77, 0x28, 0xd4, 0x1e, 0x7f, 0xb6, 0xa4, 0x0c, 0x85, 0xa1, 0x71, 0x3b, 0xa4, 0x58, 0x84, 0xd5,
+	0xa8, 0x33, 0x9a, 0xdd, 0xdf, 0x60, 0x29, 0xea, 0x18, 0xfd, 0x59, 0x54, 0x28, 0x83, 0xc5, 0x20,
+	0x0a, 0x32, 0xb2, 0x62, 0xde, 0x37, 0xa2, 0x48, 0x5b, 0xe6, 0xd4, 0xbf, 0xd4, 0xc7, 0x7f, 0xd7,
+	0x74, 0xd7, 0x3e, 0xb8, 0x04, 0x00, 0x00,
 }
@@ -106,3 +106,47 @@ func TestFlowJSON(t *testing.T) {
 		t.Fatal("Unmarshalled flow not equal to the original")
 	}
 }
+
+func TestDedupFlows(t *testing.T) {
+	newFlow := func(uuid string, correlationID string, start int64, packets uint64) *Flow {
+		return &Flow{
+			UUID:           uuid,
+			CorrelationID:  correlationID,
+			ProbeGraphPath: "host[Type=host]/veth" + uuid + "[Type=veth]",
+			Statistics: &FlowStatistics{
+				Start: start,
+				Endpoints: []*FlowEndpointsStatistics{{
+					Type: FlowEndpointType_ETHERNET,
+					AB:   &FlowEndpointStatistics{Packets: packets},
+					BA:   &FlowEndpointStatistics{},
+				}},
+			},
+		}
+	}
+
+	flows := []*Flow{
+		newFlow("1", "1", 1000, 10),
+		newFlow("2", "1", 1001, 12),
+		newFlow("3", "", 1000, 5),
+		newFlow("5", "4", 1000, 7),
+		newFlow("4", "4", 1000, 6),
+	}
+
+	dedup := func(flows []*Flow) (uuids []string) {
+		for _, f := range DedupFlows(flows) {
+			uuids = append(uuids, f.UUID)
+		}
+		return
+	}
+
+	if uuids := dedup(flows); !reflect.DeepEqual(uuids, []string{"1", "3", "4"}) {
+		t.Errorf("Wrong deduplicated flows: %v", uuids)
+	}
+
+	// the same flows whatever their order and their counters
+	flows[0].Statistics.Endpoints[0].AB.Packets = 1
+	flows[0], flows[1], flows[3], flows[4] = flows[1], flows[0], flows[4], flows[3]
+	if uuids := dedup(flows); !reflect.DeepEqual(uuids, []string{"1", "3", "4"}) {
+		t.Errorf("Canonical flows should not change: %v", uuids)
+	}
+}
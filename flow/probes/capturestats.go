@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// CaptureStatsPublisher publishes the counters of the captures to the
+// analyzer every Interval, on the Stats namespace of the websocket. An
+// empty list is sent once the last capture stopped so that the analyzer
+// drops the counters of the agent.
+type CaptureStatsPublisher struct {
+	Listener  *OnDemandProbeListener
+	Client    *shttp.WSAsyncClient
+	Interval  time.Duration
+	published bool
+	quit      chan bool
+}
+
+// message returns the message of the counters of the captures, false if
+// there is nothing to publish
+func (p *CaptureStatsPublisher) message() (shttp.WSMessage, bool) {
+	counters := p.Listener.CaptureCounters()
+	if len(counters) == 0 && !p.published {
+		return shttp.WSMessage{}, false
+	}
+	p.published = len(counters) > 0
+
+	return shttp.WSMessage{Namespace: api.StatsNamespace, Type: "CaptureStats", Obj: counters}, true
+}
+
+func (p *CaptureStatsPublisher) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !p.Client.IsConnected() {
+				continue
+			}
+			if msg, ok := p.message(); ok {
+				p.Client.SendWSMessage(msg)
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *CaptureStatsPublisher) Start() {
+	go p.run()
+}
+
+func (p *CaptureStatsPublisher) Stop() {
+	close(p.quit)
+}
+
+func NewCaptureStatsPublisher(l *OnDemandProbeListener, c *shttp.WSAsyncClient, interval time.Duration) *CaptureStatsPublisher {
+	return &CaptureStatsPublisher{
+		Listener: l,
+		Client:   c,
+		Interval: interval,
+		quit:     make(chan bool),
+	}
+}
+
+// NewCaptureStatsPublisherFromConfig returns nil when the counters aren't
+// published, ie. a 0 interval
+func NewCaptureStatsPublisherFromConfig(l *OnDemandProbeListener, c *shttp.WSAsyncClient) *CaptureStatsPublisher {
+	interval := time.Duration(config.GetConfig().GetInt("agent.capture.stats_interval")) * time.Second
+	if interval <= 0 {
+		return nil
+	}
+	return NewCaptureStatsPublisher(l, c, interval)
+}
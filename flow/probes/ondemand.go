@@ -23,22 +23,58 @@
 package probes
 
 import (
-	"os"
+	"errors"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
+// bindings kept per capture
+const maxCaptureBindings = 10
+
+// OnDemandProbeListener starts the captures on the nodes matching their
+// path. A capture is bound to the ID of its node once started, the path
+// being resolved again when the node is gone, ie. an interface recreated
+// with the same name, so that the capture follows it, the delay being
+// bounded by RebindInterval.
 type OnDemandProbeListener struct {
 	graph.DefaultGraphListener
 	Graph          *graph.Graph
 	Probes         *FlowProbeBundle
 	CaptureHandler api.ApiHandler
+	RebindInterval time.Duration
 	watcher        api.StoppableWatcher
 	host           string
+	// the captures by ID and by node bound, protected by the graph lock
+	captures map[string]*boundCapture
+	nodes    map[graph.Identifier]*boundCapture
+	quit     chan bool
+}
+
+// boundCapture is a capture and the node it's bound to, if any, the path
+// of a capture of all the hosts being resolved for this host
+type boundCapture struct {
+	id        string
+	probePath string
+	capture   *api.Capture
+	node      graph.Identifier
+	err       string
+	bindings  []api.CaptureBinding
+}
+
+// CaptureStateEvent is published on the bus when a capture starts or stops
+// on a node
+type CaptureStateEvent struct {
+	NodeID string
+	State  string
+	Error  string
 }
 
 type FlowProbe interface {
@@ -65,21 +101,50 @@ func (o *OnDemandProbeListener) probeFromType(n *graph.Node) FlowProbe {
 	return probe.(FlowProbe)
 }
 
-func (o *OnDemandProbeListener) registerProbe(n *graph.Node, capture *api.Capture) {
+func (o *OnDemandProbeListener) registerProbe(n *graph.Node, capture *api.Capture) error {
 	fprobe := o.probeFromType(n)
 	if fprobe == nil {
 		logging.GetLogger().Errorf("Failed to register flow probe, unknown type %v", n)
-		return
+		return errors.New("unknown probe type")
 	}
 
 	if err := fprobe.RegisterProbe(n, capture); err != nil {
+		// the capture would have changed the host, report it on the node
+		if err == common.ErrReadOnly {
+			logging.GetLogger().Errorf("Failed to register flow probe on %s: %s", n.ID, err.Error())
+			o.Graph.AddMetadata(n, "State.FlowCaptureError", err.Error())
+			publishCaptureState(n, "ERROR", err.Error())
+			return err
+		}
 		logging.GetLogger().Debugf("Failed to register flow probe: %s", err.Error())
+		return err
 	}
 
+	o.clearCaptureError(n)
 	o.Graph.AddMetadata(n, "State.FlowCapture", "ON")
+	publishCaptureState(n, "ON", "")
+	return nil
 }
 
-func (o *OnDemandProbeListener) unregisterProbe(n *graph.Node) {
+// clearCaptureError removes the error of a capture formerly refused on the
+// node once a capture started on it
+func (o *OnDemandProbeListener) clearCaptureError(n *graph.Node) {
+	if _, ok := n.Metadata()["State.FlowCaptureError"]; !ok {
+		return
+	}
+
+	m := make(graph.Metadata)
+	for k, v := range n.Metadata() {
+		if k != "State.FlowCaptureError" {
+			m[k] = v
+		}
+	}
+	o.Graph.SetMetadata(n, m)
+}
+
+// unregisterProbe stops the capture of a node, its state being left as is
+// for a deleted node
+func (o *OnDemandProbeListener) unregisterProbe(n *graph.Node, deleted bool) {
 	fprobe := o.probeFromType(n)
 	if fprobe == nil {
 		return
@@ -89,71 +154,252 @@ func (o *OnDemandProbeListener) unregisterProbe(n *graph.Node) {
 		logging.GetLogger().Debugf("Failed to unregister flow probe: %s", err.Error())
 	}
 
-	o.Graph.AddMetadata(n, "State.FlowCapture", "OFF")
+	if !deleted {
+		o.Graph.AddMetadata(n, "State.FlowCapture", "OFF")
+	}
+	publishCaptureState(n, "OFF", "")
 }
 
-func (o *OnDemandProbeListener) OnNodeAdded(n *graph.Node) {
-	nodes := o.Graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, graph.Metadata{"RelationType": "ownership"})
-	if len(nodes) == 0 {
+// bind starts the capture on a node, the capture refused by a read-only
+// agent not being bound again. The capture is bound before being started,
+// the node being updated with its state.
+func (o *OnDemandProbeListener) bind(c *boundCapture, n *graph.Node) {
+	c.node = n.ID
+	o.nodes[n.ID] = c
+
+	if err := o.registerProbe(n, c.capture); err != nil {
+		delete(o.nodes, n.ID)
+		c.node = ""
+		if err == common.ErrReadOnly {
+			c.err = err.Error()
+		}
 		return
 	}
 
-	path := topology.NodePath(nodes).Marshal()
+	if len(c.bindings) > 0 {
+		logging.GetLogger().Infof("Capture %s bound to %s, previously to %s", c.probePath, n.ID, c.bindings[len(c.bindings)-1].NodeID)
+	}
 
-	var capture api.ApiResource
-	var ok bool
-	if capture, ok = o.CaptureHandler.Get(path); !ok {
-		// try using the wildcard instead of the host
-		wildcard := "*/" + topology.NodePath(nodes[:len(nodes)-1]).Marshal()
-		if capture, ok = o.CaptureHandler.Get(wildcard); !ok {
-			return
+	c.bindings = append(c.bindings, api.CaptureBinding{NodeID: string(n.ID), Start: time.Now().Unix()})
+	if len(c.bindings) > maxCaptureBindings {
+		c.bindings = append([]api.CaptureBinding{}, c.bindings[len(c.bindings)-maxCaptureBindings:]...)
+	}
+}
+
+// unbind stops the capture on its node, the capture being unbound first
+func (o *OnDemandProbeListener) unbind(c *boundCapture, n *graph.Node, deleted bool) {
+	delete(o.nodes, c.node)
+	c.node = ""
+	c.bindings[len(c.bindings)-1].Stop = time.Now().Unix()
+
+	o.unregisterProbe(n, deleted)
+}
+
+// resolve binds an unbound capture to the node matching its path
+func (o *OnDemandProbeListener) resolve(c *boundCapture) {
+	if c.node != "" || c.err != "" {
+		return
+	}
+
+	if n := topology.LookupNodeFromNodePathString(o.Graph, c.probePath); n != nil && !graph.IsTombstone(n) {
+		if _, bound := o.nodes[n.ID]; !bound {
+			o.bind(c, n)
+		}
+	}
+}
+
+func publishCaptureState(n *graph.Node, state string, err string) {
+	common.DefaultBus.Publish(common.CaptureTopic, "CaptureState", &CaptureStateEvent{NodeID: string(n.ID), State: state, Error: err})
+}
+
+// nodePath returns the path of a node from its host
+func (o *OnDemandProbeListener) nodePath(n *graph.Node) string {
+	nodes := o.Graph.LookupShortestPath(n, graph.Metadata{"Type": topology.HostType}, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	if len(nodes) == 0 {
+		return ""
+	}
+	return topology.NodePath(nodes).Marshal()
+}
+
+// captureOf returns the capture of a node path, the capture of the path on
+// all the hosts otherwise
+func (o *OnDemandProbeListener) captureOf(path string) *boundCapture {
+	if c, ok := o.captures[path]; ok {
+		return c
+	}
+
+	if i := strings.Index(path, "/"); i >= 0 {
+		return o.captures["*"+path[i:]]
+	}
+	return nil
+}
+
+// matches returns whether the node still matches the path of the capture,
+// by name or by alias, another node matching it as well
+func (o *OnDemandProbeListener) matches(c *boundCapture, n *graph.Node) bool {
+	return o.captureOf(o.nodePath(n)) == c || topology.LookupNodeFromNodePathString(o.Graph, c.probePath) == n
+}
+
+// OnNodeAdded binds the capture of the path of the node if not bound yet,
+// the capture of a node no longer matching its path, ie. renamed, being
+// bound again.
+func (o *OnDemandProbeListener) OnNodeAdded(n *graph.Node) {
+	if len(o.captures) == 0 {
+		return
+	}
+
+	if c, ok := o.nodes[n.ID]; ok {
+		if graph.IsTombstone(n) {
+			o.unbind(c, n, true)
+			o.resolve(c)
+		} else if !o.matches(c, n) {
+			o.unbind(c, n, false)
+			o.resolve(c)
 		}
+		return
 	}
 
-	o.registerProbe(n, capture.(*api.Capture))
+	if graph.IsTombstone(n) {
+		return
+	}
+
+	if c := o.captureOf(o.nodePath(n)); c != nil && c.node == "" && c.err == "" {
+		o.bind(c, n)
+	}
 }
 
 func (o *OnDemandProbeListener) OnNodeUpdated(n *graph.Node) {
 	o.OnNodeAdded(n)
 }
 
+// OnEdgeAdded looks for the capture of a node once linked to its owner, its
+// path being known, and of the bridges getting ports
 func (o *OnDemandProbeListener) OnEdgeAdded(e *graph.Edge) {
 	parent, child := o.Graph.GetEdgeNodes(e)
 	if parent == nil || child == nil {
 		return
 	}
 
-	if parent.Metadata()["Type"] == "ovsbridge" {
+	if e.Metadata()["RelationType"] == topology.OwnershipRelation {
+		o.OnNodeAdded(child)
+	}
+
+	if parent.Metadata()["Type"] == topology.OvsBridgeType {
 		o.OnNodeAdded(parent)
 		return
 	}
 
-	if child.Metadata()["Type"] == "ovsbridge" {
+	if child.Metadata()["Type"] == topology.OvsBridgeType {
 		o.OnNodeAdded(child)
 		return
 	}
 }
 
+// OnNodeDeleted binds the capture of the node to the node now matching its
+// path, if any, otherwise once one shows up
 func (o *OnDemandProbeListener) OnNodeDeleted(n *graph.Node) {
-	o.unregisterProbe(n)
+	if c, ok := o.nodes[n.ID]; ok {
+		o.unbind(c, n, true)
+		o.resolve(c)
+	}
 }
 
-func (o *OnDemandProbeListener) onCaptureAdded(probePath string, capture *api.Capture) {
+func (o *OnDemandProbeListener) onCaptureAdded(id string, capture *api.Capture) {
 	o.Graph.Lock()
 	defer o.Graph.Unlock()
 
-	if node := topology.LookupNodeFromNodePathString(o.Graph, probePath); node != nil {
-		o.registerProbe(node, capture)
+	c, ok := o.captures[id]
+	if !ok {
+		c = &boundCapture{id: id, probePath: o.probePathFromID(id)}
+		o.captures[id] = c
+	} else if n := o.Graph.GetNode(c.node); c.node != "" && n != nil {
+		// the capture changed, started again
+		o.unbind(c, n, false)
 	}
+	c.capture, c.err = capture, ""
+
+	o.resolve(c)
 }
 
-func (o *OnDemandProbeListener) onCaptureDeleted(probePath string) {
+func (o *OnDemandProbeListener) onCaptureDeleted(id string) {
 	o.Graph.Lock()
 	defer o.Graph.Unlock()
 
-	if node := topology.LookupNodeFromNodePathString(o.Graph, probePath); node != nil {
-		o.unregisterProbe(node)
+	if c, ok := o.captures[id]; ok {
+		if n := o.Graph.GetNode(c.node); c.node != "" && n != nil {
+			o.unbind(c, n, false)
+		}
+		delete(o.captures, id)
+	}
+}
+
+// rebind binds again the captures whose node is gone, in case no node event
+// did, ie. an interface not ready to be captured yet
+func (o *OnDemandProbeListener) rebind() {
+	ticker := time.NewTicker(o.RebindInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			o.Graph.Lock()
+			for _, c := range o.captures {
+				o.resolve(c)
+			}
+			o.Graph.Unlock()
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+// Status returns the state of the captures, the node they are bound to,
+// the last nodes they were bound to and the effect of their fairness
+func (o *OnDemandProbeListener) Status() []*api.CaptureStatus {
+	o.Graph.RLock()
+	defer o.Graph.RUnlock()
+
+	status := []*api.CaptureStatus{}
+	for _, c := range o.captures {
+		s := &api.CaptureStatus{
+			ProbePath: c.id,
+			NodeID:    string(c.node),
+			Error:     c.err,
+			Bindings:  append([]api.CaptureBinding{}, c.bindings...),
+		}
+		if n := o.Graph.GetNode(c.node); c.node != "" && n != nil {
+			if provider, ok := o.probeFromType(n).(samplingStatsProvider); ok {
+				s.Sampling = provider.SamplingStats(n)
+			}
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ProbePath < status[j].ProbePath })
+
+	return status
+}
+
+// CaptureCounters returns the counters of the captures bound to a node,
+// sorted by probe path
+func (o *OnDemandProbeListener) CaptureCounters() []*api.CaptureCounters {
+	o.Graph.RLock()
+	defer o.Graph.RUnlock()
+
+	counters := []*api.CaptureCounters{}
+	for _, c := range o.captures {
+		n := o.Graph.GetNode(c.node)
+		if c.node == "" || n == nil {
+			continue
+		}
+		if provider, ok := o.probeFromType(n).(captureStatsProvider); ok {
+			if stats := provider.CaptureStats(n); stats != nil {
+				counters = append(counters, &api.CaptureCounters{ProbePath: c.id, NodeID: n.ID, CaptureStats: *stats})
+			}
+		}
 	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].ProbePath < counters[j].ProbePath })
+
+	return counters
 }
 
 func (o *OnDemandProbeListener) probePathFromID(id string) string {
@@ -165,9 +411,9 @@ func (o *OnDemandProbeListener) onApiWatcherEvent(action string, id string, reso
 	capture := resource.(*api.Capture)
 	switch action {
 	case "init", "create", "set", "update":
-		o.onCaptureAdded(o.probePathFromID(id), capture)
+		o.onCaptureAdded(id, capture)
 	case "expire", "delete":
-		o.onCaptureDeleted(o.probePathFromID(id))
+		o.onCaptureDeleted(id)
 	}
 }
 
@@ -176,15 +422,21 @@ func (o *OnDemandProbeListener) Start() error {
 
 	o.Graph.AddEventListener(o)
 
+	if o.RebindInterval > 0 {
+		go o.rebind()
+	}
+
 	return nil
 }
 
 func (o *OnDemandProbeListener) Stop() {
 	o.watcher.Stop()
+	o.Graph.RemoveEventListener(o)
+	close(o.quit)
 }
 
 func NewOnDemandProbeListener(fb *FlowProbeBundle, g *graph.Graph, ch api.ApiHandler) (*OnDemandProbeListener, error) {
-	h, err := os.Hostname()
+	h, err := common.HostID()
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +445,10 @@ func NewOnDemandProbeListener(fb *FlowProbeBundle, g *graph.Graph, ch api.ApiHan
 		Graph:          g,
 		Probes:         fb,
 		CaptureHandler: ch,
+		RebindInterval: time.Duration(config.GetConfig().GetInt("agent.capture.rebind_interval")) * time.Second,
 		host:           h,
+		captures:       make(map[string]*boundCapture),
+		nodes:          make(map[graph.Identifier]*boundCapture),
+		quit:           make(chan bool),
 	}, nil
 }
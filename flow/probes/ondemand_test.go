@@ -0,0 +1,268 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// fakePcapProbes captures the nodes the way the pcap probes do, the packets
+// being given by the test
+type fakePcapProbes struct {
+	probes []*PcapProbe
+	active map[graph.Identifier]*PcapProbe
+	err    error
+}
+
+func (f *fakePcapProbes) RegisterProbe(n *graph.Node, capture *api.Capture) error {
+	if f.err != nil {
+		return f.err
+	}
+	p := &PcapProbe{probePath: "host1[Type=host]/veth0[Type=veth]", nodeID: n.ID, flowTable: flow.NewTable()}
+	f.probes = append(f.probes, p)
+	f.active[n.ID] = p
+	return nil
+}
+
+func (f *fakePcapProbes) UnregisterProbe(n *graph.Node) error {
+	delete(f.active, n.ID)
+	return nil
+}
+
+func (f *fakePcapProbes) CaptureStats(n *graph.Node) *flow.CaptureStats {
+	if p, ok := f.active[n.ID]; ok {
+		return p.counters.Stats(p.flowTable)
+	}
+	return nil
+}
+
+func (f *fakePcapProbes) Flush() {}
+func (f *fakePcapProbes) Start() {}
+func (f *fakePcapProbes) Stop()  {}
+
+func newTestGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return g
+}
+
+func newVeth(g *graph.Graph, host *graph.Node) *graph.Node {
+	g.Lock()
+	defer g.Unlock()
+
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Name": "veth0", "Type": "veth"})
+	g.Link(host, n, graph.Metadata{"RelationType": "ownership"})
+	return n
+}
+
+func udpPacket(t *testing.T) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{192, 168, 0, 1},
+		DstIP:    net.IP{192, 168, 0, 2},
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload([]byte("skydive"))); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// TestCaptureRebind starts a capture on a veth then deletes the veth and
+// creates it again with the same name, the capture following it.
+func TestCaptureRebind(t *testing.T) {
+	g := newTestGraph(t)
+
+	pcap := &fakePcapProbes{active: make(map[graph.Identifier]*PcapProbe)}
+	o := &OnDemandProbeListener{
+		Graph:    g,
+		Probes:   &FlowProbeBundle{ProbeBundle: *probe.NewProbeBundle(map[string]probe.Probe{"pcap": pcap}), Graph: g},
+		host:     "host1",
+		captures: make(map[string]*boundCapture),
+		nodes:    make(map[graph.Identifier]*boundCapture),
+		quit:     make(chan bool),
+	}
+	g.AddEventListener(o)
+	defer g.RemoveEventListener(o)
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	g.Unlock()
+	first := newVeth(g, host)
+
+	o.onCaptureAdded("*/veth0[Type=veth]", &api.Capture{ProbePath: "*/veth0[Type=veth]"})
+	if _, ok := pcap.active[first.ID]; !ok || len(pcap.probes) != 1 {
+		t.Fatalf("Capture should be started on %s: %v", first.ID, pcap.active)
+	}
+
+	var flows []*flow.Flow
+	capture := func() {
+		for _, p := range pcap.active {
+			packet := udpPacket(t)
+			flows = append(flows, flow.FlowFromGoPacket(p.flowTable, &packet, p))
+		}
+	}
+	capture()
+
+	g.Lock()
+	g.DelNode(first)
+	g.Unlock()
+	if len(pcap.active) != 0 {
+		t.Fatalf("Capture should be stopped once the veth is gone: %v", pcap.active)
+	}
+
+	second := newVeth(g, host)
+	if _, ok := pcap.active[second.ID]; !ok || len(pcap.probes) != 2 {
+		t.Fatalf("Capture should be resumed on %s: %v", second.ID, pcap.active)
+	}
+	capture()
+
+	status := o.Status()
+	if len(status) != 1 || status[0].NodeID != string(second.ID) || len(status[0].Bindings) != 2 {
+		t.Fatalf("Wrong capture status: %+v", status)
+	}
+	if b := status[0].Bindings; b[0].NodeID != string(first.ID) || b[0].Stop == 0 || b[1].NodeID != string(second.ID) || b[1].Stop != 0 {
+		t.Errorf("Wrong re-bind history: %+v", b)
+	}
+
+	if len(flows) != 2 || flows[0].ProbeNodeID != string(first.ID) || flows[1].ProbeNodeID != string(second.ID) {
+		t.Fatalf("Flows should carry the node of their capture: %v", flows)
+	}
+	if flows[0].UUID == flows[1].UUID {
+		t.Errorf("Flows of both nodes shouldn't have the same UUID: %s", flows[0].UUID)
+	}
+}
+
+// TestCaptureErrorCleared refuses a capture as a read-only agent does, then
+// starts it once the capture is updated, the error being removed
+func TestCaptureErrorCleared(t *testing.T) {
+	g := newTestGraph(t)
+
+	pcap := &fakePcapProbes{active: make(map[graph.Identifier]*PcapProbe), err: common.ErrReadOnly}
+	o := &OnDemandProbeListener{
+		Graph:    g,
+		Probes:   &FlowProbeBundle{ProbeBundle: *probe.NewProbeBundle(map[string]probe.Probe{"pcap": pcap}), Graph: g},
+		host:     "host1",
+		captures: make(map[string]*boundCapture),
+		nodes:    make(map[graph.Identifier]*boundCapture),
+		quit:     make(chan bool),
+	}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	g.Unlock()
+	veth := newVeth(g, host)
+
+	capture := &api.Capture{ProbePath: "*/veth0[Type=veth]"}
+	o.onCaptureAdded("*/veth0[Type=veth]", capture)
+	if veth.Metadata()["State.FlowCaptureError"] != common.ErrReadOnly.Error() {
+		t.Fatalf("The refused capture should be reported on the node: %v", veth.Metadata())
+	}
+
+	pcap.err = nil
+	o.onCaptureAdded("*/veth0[Type=veth]", capture)
+	if _, ok := veth.Metadata()["State.FlowCaptureError"]; ok || veth.Metadata()["State.FlowCapture"] != "ON" {
+		t.Errorf("The error should be removed once the capture started: %v", veth.Metadata())
+	}
+}
+
+// TestCaptureCounters publishes the counters of a capture, then an empty
+// list once the capture stopped
+func TestCaptureCounters(t *testing.T) {
+	g := newTestGraph(t)
+
+	pcap := &fakePcapProbes{active: make(map[graph.Identifier]*PcapProbe)}
+	o := &OnDemandProbeListener{
+		Graph:    g,
+		Probes:   &FlowProbeBundle{ProbeBundle: *probe.NewProbeBundle(map[string]probe.Probe{"pcap": pcap}), Graph: g},
+		host:     "host1",
+		captures: make(map[string]*boundCapture),
+		nodes:    make(map[graph.Identifier]*boundCapture),
+		quit:     make(chan bool),
+	}
+	publisher := NewCaptureStatsPublisher(o, nil, time.Second)
+
+	if _, ok := publisher.message(); ok {
+		t.Fatal("Nothing should be published without capture")
+	}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	g.Unlock()
+	veth := newVeth(g, host)
+
+	o.onCaptureAdded("*/veth0[Type=veth]", &api.Capture{ProbePath: "*/veth0[Type=veth]"})
+	p := pcap.active[veth.ID]
+	for i := 0; i < 3; i++ {
+		packet := udpPacket(t)
+		packet.Metadata().Length = len(packet.Data())
+		p.counters.Add(packet.Metadata().Length)
+		p.flowTable.Update([]*flow.Flow{flow.FlowFromGoPacket(p.flowTable, &packet, p)})
+	}
+
+	msg, ok := publisher.message()
+	counters, _ := msg.Obj.([]*api.CaptureCounters)
+	if !ok || msg.Namespace != api.StatsNamespace || len(counters) != 1 {
+		t.Fatalf("Counters of the capture should be published: %+v", msg)
+	}
+	if c := counters[0]; c.NodeID != veth.ID || c.ProbePath != "*/veth0[Type=veth]" || c.Packets != 3 || c.Flows != 1 || c.Bytes != 3*int64(len(udpPacket(t).Data())) {
+		t.Errorf("Wrong counters: %+v", c)
+	}
+
+	o.onCaptureDeleted("*/veth0[Type=veth]")
+	if msg, ok := publisher.message(); !ok || len(msg.Obj.([]*api.CaptureCounters)) != 0 {
+		t.Errorf("An empty list should be published once the capture stopped: %+v", msg)
+	}
+	if _, ok := publisher.message(); ok {
+		t.Error("The empty list should be published once")
+	}
+}
@@ -32,6 +32,7 @@ import (
 
 	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
@@ -50,6 +51,7 @@ type OvsSFlowProbe struct {
 	Sampling       uint32
 	Polling        uint32
 	ProbeGraphPath string
+	ProbeNodeID    graph.Identifier
 }
 
 type OvsSFlowProbesHandler struct {
@@ -65,6 +67,7 @@ func probeID(i string) string {
 
 func (p *OvsSFlowProbe) SetProbePath(flow *flow.Flow) bool {
 	flow.ProbeGraphPath = p.ProbeGraphPath
+	flow.ProbeNodeID = string(p.ProbeNodeID)
 	return true
 }
 
@@ -225,7 +228,7 @@ func (o *OvsSFlowProbesHandler) UnregisterSFlowProbeFromBridge(bridgeUUID string
 	return nil
 }
 
-func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, path string) error {
+func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, path string, nodeID graph.Identifier, budget *flow.SampleBudget) error {
 	probe := OvsSFlowProbe{
 		ID:             probeID(bridgeUUID),
 		Interface:      "lo",
@@ -233,9 +236,10 @@ func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, path st
 		Sampling:       1,
 		Polling:        0,
 		ProbeGraphPath: path,
+		ProbeNodeID:    nodeID,
 	}
 
-	agent, err := o.allocator.Alloc(bridgeUUID, &probe)
+	agent, err := o.allocator.Alloc(bridgeUUID, &probe, budget)
 	if err != nil && err != sflow.AgentAlreadyAllocated {
 		return err
 	}
@@ -250,19 +254,24 @@ func (o *OvsSFlowProbesHandler) RegisterProbeOnBridge(bridgeUUID string, path st
 }
 
 func isOvsBridge(n *graph.Node) bool {
-	return n.Metadata()["UUID"] != "" && n.Metadata()["Type"] == "ovsbridge"
+	return n.Metadata()["UUID"] != "" && n.Metadata()["Type"] == topology.OvsBridgeType
 }
 
 func (o *OvsSFlowProbesHandler) RegisterProbe(n *graph.Node, capture *api.Capture) error {
 	if isOvsBridge(n) {
-		nodes := o.Graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, graph.Metadata{"RelationType": "ownership"})
+		// refuse before allocating a sFlow agent, the bridge would be updated
+		if err := common.CheckHostChange("configure sFlow on bridge " + n.Metadata()["UUID"].(string)); err != nil {
+			return err
+		}
+
+		nodes := o.Graph.LookupShortestPath(n, graph.Metadata{"Type": topology.HostType}, graph.Metadata{"RelationType": topology.OwnershipRelation})
 		if len(nodes) == 0 {
 			return errors.New(fmt.Sprintf("Failed to determine probePath for %v", n))
 		}
 
 		probePath := topology.NodePath(nodes).Marshal()
 
-		err := o.RegisterProbeOnBridge(n.Metadata()["UUID"].(string), probePath)
+		err := o.RegisterProbeOnBridge(n.Metadata()["UUID"].(string), probePath, n.ID, sampleBudget(capture))
 		if err != nil {
 			return err
 		}
@@ -270,6 +279,32 @@ func (o *OvsSFlowProbesHandler) RegisterProbe(n *graph.Node, capture *api.Captur
 	return nil
 }
 
+// SamplingStats returns the effect of the fairness of the capture of a
+// bridge, nil without fairness
+func (o *OvsSFlowProbesHandler) SamplingStats(n *graph.Node) *flow.SamplingStats {
+	if !isOvsBridge(n) {
+		return nil
+	}
+
+	if agent := o.allocator.Agent(n.Metadata()["UUID"].(string)); agent != nil {
+		return agent.SamplingStats()
+	}
+	return nil
+}
+
+// CaptureStats returns the counters of the capture of a bridge, nil if not
+// captured
+func (o *OvsSFlowProbesHandler) CaptureStats(n *graph.Node) *flow.CaptureStats {
+	if !isOvsBridge(n) {
+		return nil
+	}
+
+	if agent := o.allocator.Agent(n.Metadata()["UUID"].(string)); agent != nil {
+		return agent.CaptureStats()
+	}
+	return nil
+}
+
 func (o *OvsSFlowProbesHandler) unregisterProbe(bridgeUUID string) error {
 	err := o.UnregisterSFlowProbeFromBridge(bridgeUUID)
 	if err != nil {
@@ -312,7 +347,7 @@ func NewOvsSFlowProbesHandler(tb *probes.TopologyProbeBundle, g *graph.Graph, m
 	o := &OvsSFlowProbesHandler{
 		Graph:     g,
 		ovsClient: p.OvsMon.OvsClient,
-		allocator: sflow.NewSFlowAgentAllocator(a, m),
+		allocator: sflow.NewSFlowAgentAllocator(a, m, g),
 	}
 
 	return o
@@ -32,6 +32,8 @@ import (
 	"github.com/google/gopacket/pcap"
 	"github.com/redhat-cip/skydive/analyzer"
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
@@ -40,19 +42,27 @@ import (
 	"github.com/redhat-cip/skydive/topology/probes"
 )
 
+// PcapProbe is a capture on the interface of a node, the flows being kept
+// apart from the ones of the previous captures of the interface so that
+// they carry the ID of their node.
 type PcapProbe struct {
 	handle    *pcap.Handle
 	channel   chan gopacket.Packet
 	probePath string
+	nodeID    graph.Identifier
+	flowTable *flow.Table
+	counters  flow.CaptureCounters
 }
 
+// PcapProbesHandler captures the interfaces of the nodes, by node so that
+// an interface recreated with the same name is captured while the capture
+// of the previous one is stopped.
 type PcapProbesHandler struct {
 	graph               *graph.Graph
 	analyzerClient      *analyzer.Client
-	flowTable           *flow.Table
 	flowMappingPipeline *mappings.FlowMappingPipeline
 	wg                  sync.WaitGroup
-	probes              map[string]*PcapProbe
+	probes              map[graph.Identifier]*PcapProbe
 	probesLock          sync.RWMutex
 }
 
@@ -62,12 +72,27 @@ const (
 
 func (p *PcapProbe) SetProbePath(flow *flow.Flow) bool {
 	flow.ProbeGraphPath = p.probePath
+	flow.ProbeNodeID = string(p.nodeID)
 	return true
 }
 
 func (p *PcapProbesHandler) handlePacket(pcapProbe *PcapProbe, packet gopacket.Packet) {
-	flows := []*flow.Flow{flow.FlowFromGoPacket(p.flowTable, &packet, pcapProbe)}
-	p.flowTable.Update(flows)
+	pcapProbe.counters.Add(packet.Metadata().Length)
+
+	f := flow.FlowFromGoPacket(pcapProbe.flowTable, &packet, pcapProbe)
+
+	// the flows of a capture with fairness are sent by the table, once
+	// updated or expired, not on each packet
+	if pcapProbe.flowTable.SampleBudget() != nil {
+		return
+	}
+
+	flows := []*flow.Flow{f}
+	pcapProbe.flowTable.Update(flows)
+	p.sendFlows(flows)
+}
+
+func (p *PcapProbesHandler) sendFlows(flows []*flow.Flow) {
 	p.flowMappingPipeline.Enhance(flows)
 
 	if p.analyzerClient != nil {
@@ -77,22 +102,59 @@ func (p *PcapProbesHandler) handlePacket(pcapProbe *PcapProbe, packet gopacket.P
 	}
 }
 
+// capture handles the packets of a probe, the flows of a capture with
+// fairness being sent when updated and expired
+func (p *PcapProbesHandler) capture(probe *PcapProbe) {
+	if probe.flowTable.SampleBudget() == nil {
+		for packet := range probe.channel {
+			p.handlePacket(probe, packet)
+		}
+		return
+	}
+
+	defer probe.flowTable.UnregisterAll()
+
+	agentExpire := config.GetAgentExpire()
+	probe.flowTable.RegisterExpire(p.sendFlows, agentExpire, agentExpire)
+
+	agentUpdate := config.GetAgentUpdate()
+	probe.flowTable.RegisterUpdated(p.sendFlows, agentUpdate, agentUpdate)
+
+	for {
+		select {
+		case packet, ok := <-probe.channel:
+			if !ok {
+				return
+			}
+			p.handlePacket(probe, packet)
+		case now := <-probe.flowTable.GetExpireTicker():
+			probe.flowTable.Expire(now)
+		case now := <-probe.flowTable.GetUpdatedTicker():
+			probe.flowTable.Updated(now)
+		}
+	}
+}
+
 func (p *PcapProbesHandler) RegisterProbe(n *graph.Node, capture *api.Capture) error {
 	logging.GetLogger().Debugf("Starting pcap capture on %s", n.Metadata()["Name"])
 
 	if name, ok := n.Metadata()["Name"]; ok && name != "" {
 		ifName := name.(string)
 
-		if _, ok := p.probes[ifName]; ok {
+		p.probesLock.RLock()
+		_, ok := p.probes[n.ID]
+		p.probesLock.RUnlock()
+		if ok {
 			return errors.New(fmt.Sprintf("A pcap probe already exists for %s", ifName))
 		}
 
-		nodes := p.graph.LookupShortestPath(n, graph.Metadata{"Type": "host"}, graph.Metadata{"RelationType": "ownership"})
+		nodes := p.graph.LookupShortestPath(n, graph.Metadata{"Type": topology.HostType}, graph.Metadata{"RelationType": topology.OwnershipRelation})
 		if len(nodes) == 0 {
 			return errors.New(fmt.Sprintf("Failed to determine probePath for %s", ifName))
 		}
 
-		handle, err := pcap.OpenLive(ifName, snaplen, true, time.Second)
+		// promiscuous mode changes the interface flags, not allowed in read-only
+		handle, err := pcap.OpenLive(ifName, snaplen, !common.IsReadOnly(), time.Second)
 		if err != nil {
 			return err
 		}
@@ -103,54 +165,86 @@ func (p *PcapProbesHandler) RegisterProbe(n *graph.Node, capture *api.Capture) e
 
 		probePath := topology.NodePath(nodes).Marshal()
 
+		flowTable := flow.NewTable()
 		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		if budget := sampleBudget(capture); budget != nil {
+			// the layers are decoded on demand, up to the transport layer
+			// only for the samples suppressed
+			flowTable.SetSampleBudget(budget)
+			packetSource.DecodeOptions = gopacket.Lazy
+		}
 		packetChannel := packetSource.Packets()
 
 		probe := &PcapProbe{
 			handle:    handle,
 			channel:   packetChannel,
 			probePath: probePath,
+			nodeID:    n.ID,
+			flowTable: flowTable,
 		}
 
 		p.probesLock.Lock()
-		p.probes[ifName] = probe
+		p.probes[n.ID] = probe
 		p.probesLock.Unlock()
 
 		p.wg.Add(1)
 		go func() {
 			defer p.wg.Done()
+			defer common.RecoverAndPanic()
 
-			for packet := range probe.channel {
-				p.handlePacket(probe, packet)
-			}
+			p.capture(probe)
 		}()
 	}
 	return nil
 }
 
-func (p *PcapProbesHandler) unregisterProbe(ifName string) error {
-	if probe, ok := p.probes[ifName]; ok {
+func (p *PcapProbesHandler) unregisterProbe(id graph.Identifier) error {
+	if probe, ok := p.probes[id]; ok {
 		probe.handle.Close()
-		delete(p.probes, ifName)
+		delete(p.probes, id)
 	}
 
 	return nil
 }
 
-func (p *PcapProbesHandler) UnregisterProbe(n *graph.Node) error {
-	p.probesLock.Lock()
-	defer p.probesLock.Unlock()
+// SamplingStats returns the effect of the fairness of the capture of a
+// node, nil without fairness
+func (p *PcapProbesHandler) SamplingStats(n *graph.Node) *flow.SamplingStats {
+	p.probesLock.RLock()
+	defer p.probesLock.RUnlock()
 
-	if name, ok := n.Metadata()["Name"]; ok && name != "" {
-		ifName := name.(string)
-		err := p.unregisterProbe(ifName)
-		if err != nil {
-			return err
+	if probe, ok := p.probes[n.ID]; ok {
+		if budget := probe.flowTable.SampleBudget(); budget != nil {
+			return budget.Stats()
 		}
 	}
 	return nil
 }
 
+// CaptureStats returns the counters of the capture of a node, the drops
+// being the ones of the kernel and of the interface, nil if not captured
+func (p *PcapProbesHandler) CaptureStats(n *graph.Node) *flow.CaptureStats {
+	p.probesLock.RLock()
+	defer p.probesLock.RUnlock()
+
+	probe, ok := p.probes[n.ID]
+	if !ok {
+		return nil
+	}
+
+	if stats, err := probe.handle.Stats(); err == nil {
+		probe.counters.SetDrops(int64(stats.PacketsDropped + stats.PacketsIfDropped))
+	}
+	return probe.counters.Stats(probe.flowTable)
+}
+
+func (p *PcapProbesHandler) UnregisterProbe(n *graph.Node) error {
+	p.probesLock.Lock()
+	defer p.probesLock.Unlock()
+
+	return p.unregisterProbe(n.ID)
+}
+
 func (p *PcapProbesHandler) Start() {
 }
 
@@ -158,8 +252,8 @@ func (p *PcapProbesHandler) Stop() {
 	p.probesLock.Lock()
 	defer p.probesLock.Unlock()
 
-	for name := range p.probes {
-		p.unregisterProbe(name)
+	for id := range p.probes {
+		p.unregisterProbe(id)
 	}
 	p.wg.Wait()
 }
@@ -172,8 +266,7 @@ func NewPcapProbesHandler(tb *probes.TopologyProbeBundle, g *graph.Graph, p *map
 		graph:               g,
 		analyzerClient:      a,
 		flowMappingPipeline: p,
-		flowTable:           flow.NewTable(),
-		probes:              make(map[string]*PcapProbe),
+		probes:              make(map[graph.Identifier]*PcapProbe),
 	}
 	return handler
 }
@@ -24,7 +24,9 @@ package probes
 
 import (
 	"github.com/redhat-cip/skydive/analyzer"
+	"github.com/redhat-cip/skydive/api"
 	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/probe"
@@ -37,6 +39,41 @@ type FlowProbeBundle struct {
 	Graph *graph.Graph
 }
 
+// samplingStatsProvider is implemented by the flow probes giving the effect
+// of the fairness of the capture of a node
+type samplingStatsProvider interface {
+	SamplingStats(n *graph.Node) *flow.SamplingStats
+}
+
+// captureStatsProvider is implemented by the flow probes counting the
+// packets of the capture of a node
+type captureStatsProvider interface {
+	CaptureStats(n *graph.Node) *flow.CaptureStats
+}
+
+// sampleBudget returns the budget of the samples of a capture with
+// fairness, the budgets of the agent being used when not given, nil
+// without fairness
+func sampleBudget(capture *api.Capture) *flow.SampleBudget {
+	if capture.Fairness != flow.FairnessPerFlow {
+		return nil
+	}
+
+	cfg := config.GetConfig()
+
+	flowBudget := capture.FlowBudget
+	if flowBudget == 0 {
+		flowBudget = cfg.GetInt("agent.capture.fairness.flow_budget")
+	}
+
+	totalBudget := capture.TotalBudget
+	if totalBudget == 0 {
+		totalBudget = cfg.GetInt("agent.capture.fairness.total_budget")
+	}
+
+	return flow.NewSampleBudget(flowBudget, totalBudget, config.GetAgentUpdate(), cfg.GetInt("agent.capture.fairness.low_confidence"))
+}
+
 func (fpb *FlowProbeBundle) Flush() {
 	for _, p := range fpb.ProbeBundle.Probes {
 		fprobe := p.(FlowProbe)
@@ -0,0 +1,384 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/vishvananda/netns"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const (
+	rawSnaplen   int32 = 65535
+	rawChunkSize       = 256 * 1024
+	// size of the pcap record header preceding each packet
+	rawRecordHeaderSize = 16
+)
+
+// RawCaptureHandler captures the packets of an interface into a temporary
+// pcap file on request of an analyzer, then streams the file back to it,
+// or streams them live to a client through the analyzer. The duration, the
+// size and the number of concurrent captures are bounded by the agent
+// configuration whatever the request, the live captures having at most
+// StreamWindow chunks not acknowledged by the client.
+type RawCaptureHandler struct {
+	shttp.DefaultWSClientEventHandler
+	Graph         *graph.Graph
+	Client        *shttp.WSAsyncClient
+	MaxDuration   time.Duration
+	MaxSize       int64
+	MaxConcurrent int
+	StreamWindow  int
+	running       int
+	streams       map[string]*rawStream
+	lock          sync.Mutex
+	wg            sync.WaitGroup
+	quit          chan struct{}
+}
+
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+func (r *RawCaptureHandler) OnMessage(m shttp.WSMessage) {
+	if m.Namespace == api.PcapStreamNamespace {
+		r.onStreamMessage(m)
+		return
+	}
+
+	if m.Namespace != api.PcapNamespace || m.Type != "PcapRequest" {
+		return
+	}
+
+	var req api.PcapRequest
+	if err := m.DecodeObj(&req); err != nil {
+		logging.GetLogger().Errorf("Unable to decode raw capture request: %s", err.Error())
+		return
+	}
+
+	// don't block the websocket loop for the time of the capture
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer common.RecoverAndPanic()
+
+		r.capture(&req)
+	}()
+}
+
+func (r *RawCaptureHandler) acquire() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.running >= r.MaxConcurrent {
+		return fmt.Errorf("Too many raw captures running, maximum is %d", r.MaxConcurrent)
+	}
+	r.running++
+
+	return nil
+}
+
+func (r *RawCaptureHandler) release() {
+	r.lock.Lock()
+	r.running--
+	r.lock.Unlock()
+}
+
+// bounds returns the duration and the size of a capture, the maximums when
+// not requested, requests exceeding them are refused.
+func (r *RawCaptureHandler) bounds(req *api.PcapRequest) (time.Duration, int64, error) {
+	duration, size := req.Duration, req.MaxSize
+	if duration <= 0 {
+		duration = r.MaxDuration
+	}
+	if size <= 0 {
+		size = r.MaxSize
+	}
+
+	if duration > r.MaxDuration {
+		return 0, 0, fmt.Errorf("Requested duration %s exceeds the maximum of %s", duration, r.MaxDuration)
+	}
+	if size > r.MaxSize {
+		return 0, 0, fmt.Errorf("Requested size %d exceeds the maximum of %d bytes", size, r.MaxSize)
+	}
+
+	return duration, size, nil
+}
+
+// lookupInterface returns the name of the interface of a node and the path
+// of the namespace it belongs to, empty for the root namespace.
+func (r *RawCaptureHandler) lookupInterface(id graph.Identifier) (string, string, error) {
+	r.Graph.RLock()
+	defer r.Graph.RUnlock()
+
+	n := r.Graph.GetNode(id)
+	if n == nil {
+		return "", "", fmt.Errorf("Unknown node %s", id)
+	}
+
+	ifName, _ := n.Metadata()["Name"].(string)
+	if ifName == "" {
+		return "", "", fmt.Errorf("Node %s has no interface name", id)
+	}
+
+	nodes := r.Graph.LookupShortestPath(n, graph.Metadata{"Type": topology.HostType}, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	for _, node := range nodes {
+		if node.Metadata()["Type"] == topology.NetNSType {
+			path, _ := node.Metadata()["Path"].(string)
+			if path == "" {
+				return "", "", fmt.Errorf("Unknown path of the namespace of %s", ifName)
+			}
+			return ifName, path, nil
+		}
+	}
+
+	return ifName, "", nil
+}
+
+// openLive opens the capture inside the namespace, the socket staying bound
+// to it once back in the original namespace.
+func openLive(ifName string, nsPath string) (*pcap.Handle, error) {
+	if nsPath == "" {
+		return pcap.OpenLive(ifName, rawSnaplen, !common.IsReadOnly(), time.Second)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origns.Close()
+
+	newns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer newns.Close()
+
+	if err := netns.Set(newns); err != nil {
+		return nil, err
+	}
+	defer netns.Set(origns)
+
+	return pcap.OpenLive(ifName, rawSnaplen, !common.IsReadOnly(), time.Second)
+}
+
+// write writes the packets read until the deadline in the pcap format,
+// stopping before exceeding the maximum size. It returns the size written.
+func (r *RawCaptureHandler) write(w io.Writer, src packetReader, linkType layers.LinkType, deadline time.Time, maxSize int64) (int64, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(uint32(rawSnaplen), linkType); err != nil {
+		return 0, err
+	}
+	written := int64(24)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-r.quit:
+			return written, errors.New("Agent stopping")
+		default:
+		}
+
+		data, ci, err := src.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+
+		record := int64(rawRecordHeaderSize + len(data))
+		if written+record > maxSize {
+			break
+		}
+
+		ci.CaptureLength = len(data)
+		if err := pw.WritePacket(ci, data); err != nil {
+			return written, err
+		}
+		written += record
+	}
+
+	return written, nil
+}
+
+// record captures the packets of the interface for the given duration
+func (r *RawCaptureHandler) record(w io.Writer, ifName, nsPath, filter string, duration time.Duration, size int64) (int64, error) {
+	handle, err := openLive(ifName, nsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.write(w, handle, handle.LinkType(), time.Now().Add(duration), size)
+}
+
+func (r *RawCaptureHandler) send(chunk *api.PcapChunk) {
+	r.Client.SendWSMessage(shttp.WSMessage{
+		Namespace: api.PcapNamespace,
+		Type:      "PcapChunk",
+		Obj:       chunk,
+	})
+}
+
+func (r *RawCaptureHandler) sendError(id string, err error) {
+	logging.GetLogger().Errorf("Raw capture %s failed: %s", id, err.Error())
+	r.send(&api.PcapChunk{ID: id, Error: err.Error()})
+}
+
+func (r *RawCaptureHandler) stream(id string, src io.Reader) error {
+	buf := make([]byte, rawChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			r.send(&api.PcapChunk{ID: id, Data: data})
+		}
+		if err == io.EOF {
+			r.send(&api.PcapChunk{ID: id, EOF: true})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *RawCaptureHandler) capture(req *api.PcapRequest) {
+	logging.GetLogger().Infof("Raw capture %s requested by %s on node %s, filter %q, duration %s, size %d",
+		req.ID, req.User, req.NodeID, req.BPFFilter, req.Duration, req.MaxSize)
+
+	if err := r.acquire(); err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+	defer r.release()
+
+	duration, size, err := r.bounds(req)
+	if err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+
+	ifName, nsPath, err := r.lookupInterface(req.NodeID)
+	if err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+
+	f, err := ioutil.TempFile("", "skydive-pcap-")
+	if err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	written, err := r.record(f, ifName, nsPath, req.BPFFilter, duration, size)
+	if err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+
+	if err := r.stream(req.ID, f); err != nil {
+		r.sendError(req.ID, err)
+		return
+	}
+
+	logging.GetLogger().Infof("Raw capture %s of %s done, %d bytes sent", req.ID, ifName, written)
+}
+
+func (r *RawCaptureHandler) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+func NewRawCaptureHandler(g *graph.Graph, c *shttp.WSAsyncClient, maxDuration time.Duration, maxSize int64, maxConcurrent int, streamWindow int) *RawCaptureHandler {
+	r := &RawCaptureHandler{
+		Graph:         g,
+		Client:        c,
+		MaxDuration:   maxDuration,
+		MaxSize:       maxSize,
+		MaxConcurrent: maxConcurrent,
+		StreamWindow:  streamWindow,
+		streams:       make(map[string]*rawStream),
+		quit:          make(chan struct{}),
+	}
+	c.AddEventHandler(r)
+
+	return r
+}
+
+// NewRawCaptureHandlerFromConfig returns nil when the raw captures are
+// disabled, ie. no concurrent capture allowed.
+func NewRawCaptureHandlerFromConfig(g *graph.Graph, c *shttp.WSAsyncClient) *RawCaptureHandler {
+	cfg := config.GetConfig()
+
+	maxConcurrent := cfg.GetInt("agent.capture.raw.max_concurrent")
+	if maxConcurrent <= 0 {
+		return nil
+	}
+
+	maxDuration := time.Duration(cfg.GetInt("agent.capture.raw.max_duration")) * time.Second
+	maxSize := int64(cfg.GetInt("agent.capture.raw.max_size")) * 1024 * 1024
+
+	streamWindow := cfg.GetInt("agent.capture.raw.stream_window")
+	if streamWindow <= 0 {
+		streamWindow = 1
+	}
+
+	return NewRawCaptureHandler(g, c, maxDuration, maxSize, maxConcurrent, streamWindow)
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+const (
+	// records batched in a chunk of a live capture, a partial chunk being
+	// sent after rawStreamFlushInterval
+	rawStreamChunkSize     = 64 * 1024
+	rawStreamFlushInterval = 200 * time.Millisecond
+)
+
+// rawStream is a live capture streamed to a client through the analyzer.
+// The packets are batched as pcap records in chunks acknowledged by the
+// client, at most window chunks being in flight. When the client doesn't
+// keep up, the packets are dropped and counted rather than queued.
+type rawStream struct {
+	sync.Mutex
+	id      string
+	window  uint64
+	maxSize int64
+	// size of the capture, pcap header included
+	size    int64
+	seq     uint64
+	acked   uint64
+	dropped int64
+	pending bytes.Buffer
+	writer  *pcapgo.Writer
+	kick    chan struct{}
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+func (s *rawStream) signal() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// add queues the record of a packet for the next chunk, the packet being
+// dropped while the chunk is full. It returns false once the maximum size
+// of the capture is reached.
+func (s *rawStream) add(ci gopacket.CaptureInfo, data []byte) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record := int64(rawRecordHeaderSize + len(data))
+	if s.size+record > s.maxSize {
+		return false, nil
+	}
+
+	if s.pending.Len() >= rawStreamChunkSize {
+		s.dropped++
+		return true, nil
+	}
+
+	ci.CaptureLength = len(data)
+	if err := s.writer.WritePacket(ci, data); err != nil {
+		return false, err
+	}
+	s.size += record
+
+	if s.pending.Len() >= rawStreamChunkSize {
+		s.signal()
+	}
+
+	return true, nil
+}
+
+// next cuts the pending records as the next chunk, nil if there are none
+// or if the window is full, unless force is set
+func (s *rawStream) next(force bool) *api.PcapStreamChunk {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending.Len() == 0 || (!force && s.seq-s.acked >= s.window) {
+		return nil
+	}
+	s.seq++
+
+	data := make([]byte, s.pending.Len())
+	copy(data, s.pending.Bytes())
+	s.pending.Reset()
+
+	return &api.PcapStreamChunk{ID: s.id, Seq: s.seq, Data: data, Dropped: s.dropped}
+}
+
+// ack acknowledges the chunks up to seq, opening the window
+func (s *rawStream) ack(seq uint64) {
+	s.Lock()
+	if seq > s.acked && seq <= s.seq {
+		s.acked = seq
+	}
+	s.Unlock()
+
+	s.signal()
+}
+
+func (s *rawStream) getDropped() int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.dropped
+}
+
+func (s *rawStream) close() {
+	s.stopped.Do(func() { close(s.stop) })
+}
+
+func newRawStream(id string, window int, maxSize int64) *rawStream {
+	s := &rawStream{
+		id:      id,
+		window:  uint64(window),
+		maxSize: maxSize,
+		size:    24,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	s.writer = pcapgo.NewWriter(&s.pending)
+
+	return s
+}
+
+func (r *RawCaptureHandler) sendStream(msgType string, chunk *api.PcapStreamChunk) {
+	r.Client.SendWSMessage(shttp.WSMessage{
+		Namespace: api.PcapStreamNamespace,
+		Type:      msgType,
+		Obj:       chunk,
+	})
+}
+
+func (r *RawCaptureHandler) addStream(s *rawStream) {
+	r.lock.Lock()
+	r.streams[s.id] = s
+	r.lock.Unlock()
+}
+
+func (r *RawCaptureHandler) removeStream(id string) {
+	r.lock.Lock()
+	delete(r.streams, id)
+	r.lock.Unlock()
+}
+
+func (r *RawCaptureHandler) getStream(id string) *rawStream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.streams[id]
+}
+
+// pump reads the packets until the deadline, the maximum size or the stop
+// of the stream
+func (r *RawCaptureHandler) pump(s *rawStream, src packetReader, deadline time.Time) error {
+	for time.Now().Before(deadline) {
+		select {
+		case <-r.quit:
+			return errors.New("Agent stopping")
+		case <-s.stop:
+			return nil
+		default:
+		}
+
+		data, ci, err := src.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		more, err := s.add(ci, data)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// flush sends the chunks the window allows, periodically and once a chunk
+// is full or acknowledged, until done is closed
+func (r *RawCaptureHandler) flush(s *rawStream, done chan struct{}) {
+	ticker := time.NewTicker(rawStreamFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		case <-done:
+			return
+		}
+
+		if chunk := s.next(false); chunk != nil {
+			r.sendStream("PcapStreamRecords", chunk)
+		}
+	}
+}
+
+func (r *RawCaptureHandler) live(s *rawStream, req *api.PcapRequest) error {
+	duration, size, err := r.bounds(req)
+	if err != nil {
+		return err
+	}
+	s.maxSize = size
+
+	ifName, nsPath, err := r.lookupInterface(req.NodeID)
+	if err != nil {
+		return err
+	}
+
+	handle, err := openLive(ifName, nsPath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	if req.BPFFilter != "" {
+		if err := handle.SetBPFFilter(req.BPFFilter); err != nil {
+			return err
+		}
+	}
+
+	r.sendStream("PcapStreamStarted", &api.PcapStreamChunk{ID: s.id, LinkType: int(handle.LinkType()), Snaplen: int(rawSnaplen)})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.flush(s, done)
+	}()
+
+	err = r.pump(s, handle, time.Now().Add(duration))
+
+	close(done)
+	wg.Wait()
+
+	// the last records are sent whatever the window
+	if chunk := s.next(true); chunk != nil {
+		r.sendStream("PcapStreamRecords", chunk)
+	}
+
+	return err
+}
+
+func (r *RawCaptureHandler) streamCapture(req *api.PcapRequest) {
+	logging.GetLogger().Infof("Raw capture stream %s requested by %s on node %s, filter %q, duration %s, size %d",
+		req.ID, req.User, req.NodeID, req.BPFFilter, req.Duration, req.MaxSize)
+
+	s := newRawStream(req.ID, r.StreamWindow, r.MaxSize)
+
+	end := &api.PcapStreamChunk{ID: req.ID}
+	if err := r.acquire(); err != nil {
+		end.Error = err.Error()
+	} else {
+		r.addStream(s)
+		err = r.live(s, req)
+		r.removeStream(req.ID)
+		r.release()
+
+		end.Dropped = s.getDropped()
+		if err != nil {
+			end.Error = err.Error()
+		}
+	}
+
+	if end.Error != "" {
+		logging.GetLogger().Errorf("Raw capture stream %s failed: %s", req.ID, end.Error)
+	} else {
+		logging.GetLogger().Infof("Raw capture stream %s done, %d bytes captured, %d packets dropped", req.ID, s.size, end.Dropped)
+	}
+
+	r.sendStream("PcapStreamEnd", end)
+}
+
+func (r *RawCaptureHandler) onStreamMessage(m shttp.WSMessage) {
+	switch m.Type {
+	case "PcapStreamRequest":
+		var req api.PcapRequest
+		if err := m.DecodeObj(&req); err != nil {
+			logging.GetLogger().Errorf("Unable to decode raw capture stream request: %s", err.Error())
+			return
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer common.RecoverAndPanic()
+
+			r.streamCapture(&req)
+		}()
+	case "PcapStreamAck", "PcapStreamStop":
+		var ctrl api.PcapStreamControl
+		if err := m.DecodeObj(&ctrl); err != nil {
+			logging.GetLogger().Errorf("Unable to decode raw capture stream control: %s", err.Error())
+			return
+		}
+
+		s := r.getStream(ctrl.ID)
+		if s == nil {
+			return
+		}
+		if m.Type == "PcapStreamAck" {
+			s.ack(ctrl.Seq)
+		} else {
+			s.close()
+		}
+	}
+}
+
+// OnDisconnected stops the live captures, the clients they were streamed
+// to being gone with the analyzer
+func (r *RawCaptureHandler) OnDisconnected() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, s := range r.streams {
+		s.close()
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// packetSource returns the packets given, then io.EOF
+type packetSource struct {
+	packets [][]byte
+}
+
+func (p *packetSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(p.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := p.packets[0]
+	p.packets = p.packets[1:]
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data)}, nil
+}
+
+func TestRawStreamWindow(t *testing.T) {
+	s := newRawStream("s1", 2, 1024*1024)
+	packet := make([]byte, 1000)
+
+	// the client acknowledges nothing, the third chunk waits for the window
+	for i := 0; i < 3; i++ {
+		if more, err := s.add(gopacket.CaptureInfo{Length: len(packet)}, packet); !more || err != nil {
+			t.Fatalf("Packet refused: %v", err)
+		}
+		if chunk := s.next(false); i < 2 && (chunk == nil || chunk.Seq != uint64(i+1)) {
+			t.Fatalf("Chunk %d expected, got: %+v", i+1, chunk)
+		} else if i == 2 && chunk != nil {
+			t.Fatalf("Window full, no chunk expected: %+v", chunk)
+		}
+	}
+
+	// the packets are dropped rather than queued once the chunk is full
+	for i := 0; i < 2*rawStreamChunkSize/len(packet); i++ {
+		s.add(gopacket.CaptureInfo{Length: len(packet)}, packet)
+	}
+	if s.getDropped() == 0 || s.pending.Len() > rawStreamChunkSize+rawRecordHeaderSize+len(packet) {
+		t.Fatalf("Packets expected to be dropped, %d dropped, %d pending", s.getDropped(), s.pending.Len())
+	}
+
+	s.ack(1)
+	chunk := s.next(false)
+	if chunk == nil || chunk.Seq != 3 || chunk.Dropped != s.getDropped() {
+		t.Fatalf("Chunk 3 expected once acknowledged, got: %+v", chunk)
+	}
+}
+
+func TestRawStreamPump(t *testing.T) {
+	r := &RawCaptureHandler{quit: make(chan struct{})}
+	packet := make([]byte, 100)
+
+	// the size of the capture is bounded, pcap header included
+	s := newRawStream("s1", 1, 24+2*int64(rawRecordHeaderSize+len(packet)))
+	src := &packetSource{packets: [][]byte{packet, packet, packet}}
+	if err := r.pump(s, src, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.packets) != 0 {
+		t.Errorf("The packet beyond the maximum size should have ended the capture")
+	}
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	w.WriteFileHeader(uint32(rawSnaplen), 1)
+	buf.Write(s.next(false).Data)
+
+	reader, err := pcapgo.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if data, _, err := reader.ReadPacketData(); err != nil || len(data) != len(packet) {
+			t.Fatalf("Packet %d expected: %v", i, err)
+		}
+	}
+	if _, _, err := reader.ReadPacketData(); err != io.EOF {
+		t.Errorf("Only 2 packets expected: %v", err)
+	}
+
+	// stopped by the client
+	s = newRawStream("s2", 1, 1024*1024)
+	s.close()
+	if err := r.pump(s, &packetSource{}, time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("A stopped stream should end without error: %v", err)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/logging"
 )
 
@@ -34,6 +35,7 @@ type Table struct {
 	lock    sync.RWMutex
 	table   map[string]*Flow
 	manager tableManager
+	budget  *SampleBudget
 }
 
 func NewTable() *Table {
@@ -46,12 +48,40 @@ func NewTableFromFlows(flows []*Flow) *Table {
 	return nft
 }
 
+// SetSampleBudget sets the budget of the samples decoded per flow, nil
+// decoding all of them
+func (ft *Table) SetSampleBudget(b *SampleBudget) {
+	ft.lock.Lock()
+	ft.budget = b
+	ft.lock.Unlock()
+}
+
+// SampleBudget returns the budget of the samples, if any
+func (ft *Table) SampleBudget() *SampleBudget {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.budget
+}
+
 func (ft *Table) String() string {
 	ft.lock.RLock()
 	defer ft.lock.RUnlock()
 	return fmt.Sprintf("%d flows", len(ft.table))
 }
 
+// FlowCount returns the number of flows of the table, the flows updated
+// by UUID being possibly indexed by their key as well
+func (ft *Table) FlowCount() int {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+
+	flows := make(map[*Flow]bool, len(ft.table))
+	for _, f := range ft.table {
+		flows[f] = true
+	}
+	return len(flows)
+}
+
 func (ft *Table) Update(flows []*Flow) {
 	ft.lock.Lock()
 	for _, f := range flows {
@@ -64,6 +94,25 @@ func (ft *Table) Update(flows []*Flow) {
 	ft.lock.Unlock()
 }
 
+// SetCorrelationID sets the correlation ID of a flow of the table
+func (ft *Table) SetCorrelationID(uuid string, id string) {
+	ft.lock.Lock()
+	if f, ok := ft.table[uuid]; ok {
+		f.CorrelationID = id
+	}
+	ft.lock.Unlock()
+}
+
+// SetOwners sets the owners of the interfaces of a flow of the table
+func (ft *Table) SetOwners(uuid string, srcID, srcType, dstID, dstType string) {
+	ft.lock.Lock()
+	if f, ok := ft.table[uuid]; ok {
+		f.SrcOwnerID, f.SrcOwnerType = srcID, srcType
+		f.DstOwnerID, f.DstOwnerType = dstID, dstType
+	}
+	ft.lock.Unlock()
+}
+
 func (ft *Table) LookupFlowsByProbePath(p string) []*Flow {
 	ft.lock.RLock()
 	defer ft.lock.RUnlock()
@@ -173,11 +222,15 @@ func (ft *Table) expire(fn ExpireUpdateFunc, expireBefore int64) {
 		if fs.Last < expireBefore {
 			duration := time.Duration(fs.Last - fs.Start)
 			logging.GetLogger().Debugf("Expire flow %s Duration %v", f.UUID, duration)
+			if ft.budget != nil {
+				ft.budget.report(f)
+			}
 			expiredFlows = append(expiredFlows, f)
 		}
 	}
 	/* Advise Clients */
 	fn(expiredFlows)
+	publish("FlowsExpired", expiredFlows)
 	for _, f := range expiredFlows {
 		delete(ft.table, f.UUID)
 	}
@@ -203,9 +256,18 @@ func (ft *Table) updated(fn ExpireUpdateFunc, updateFrom int64) {
 	}
 	/* Advise Clients */
 	fn(updatedFlows)
+	publish("FlowsUpdated", updatedFlows)
 	logging.GetLogger().Debugf("Send updated Flow %d", len(updatedFlows))
 }
 
+// publish gives the flows to the bus subscribers, they are shared with the
+// table and must not be modified.
+func publish(eventType string, flows []*Flow) {
+	if len(flows) > 0 && common.DefaultBus.HasSubscribers(common.FlowTopic) {
+		common.DefaultBus.Publish(common.FlowTopic, eventType, flows)
+	}
+}
+
 func (ft *Table) ExpireNow() {
 	const Now = int64(^uint64(0) >> 1)
 	ft.lock.Lock()
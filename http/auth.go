@@ -23,9 +23,11 @@
 package http
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 
@@ -40,6 +42,9 @@ var (
 type AuthenticationOpts struct {
 	Username string
 	Password string
+	// LongLived requests a token of the authentication backend, not
+	// expiring, rather than a session token, ie. for the agents
+	LongLived bool
 }
 
 type AuthenticationClient struct {
@@ -48,12 +53,25 @@ type AuthenticationClient struct {
 	Addr          string
 	Port          int
 	AuthToken     string
+	// TLS configuration of the connections to the server, HTTPS being used
+	// if set
+	TLSConfig *tls.Config
 }
 
 func (c *AuthenticationClient) getPrefix() string {
+	if c.TLSConfig != nil {
+		return fmt.Sprintf("https://%s:%d", c.Addr, c.Port)
+	}
 	return fmt.Sprintf("http://%s:%d", c.Addr, c.Port)
 }
 
+func (c *AuthenticationClient) transport() http.RoundTripper {
+	if c.TLSConfig != nil {
+		return &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: c.TLSConfig}
+	}
+	return http.DefaultTransport
+}
+
 func (c *AuthenticationClient) Authenticated() bool {
 	return c.authenticated
 }
@@ -70,6 +88,9 @@ func (c *AuthenticationClient) Cookie() *http.Cookie {
 
 func (c *AuthenticationClient) Authenticate() error {
 	values := url.Values{"username": {c.authOptions.Username}, "password": {c.authOptions.Password}}
+	if c.authOptions.LongLived {
+		values.Set("long_lived", "true")
+	}
 
 	req, err := http.NewRequest("POST", c.getPrefix()+"/login", strings.NewReader(values.Encode()))
 	if err != nil {
@@ -77,7 +98,7 @@ func (c *AuthenticationClient) Authenticate() error {
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := c.transport().RoundTrip(req)
 	if err != nil {
 		return fmt.Errorf("Authentication failed: %s", err.Error())
 	}
@@ -111,15 +132,39 @@ type AuthenticationBackend interface {
 	Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc
 }
 
+// CheckToken validates a token returned by the login page, ie. for non HTTP
+// APIs, by passing it through the backend the same way as the authtok cookie.
+func CheckToken(b AuthenticationBackend, token string) (string, error) {
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: make(http.Header)}
+	r.AddCookie(&http.Cookie{Name: "authtok", Value: token})
+
+	username, ok := "", false
+	b.Wrap(func(w http.ResponseWriter, ar *auth.AuthenticatedRequest) {
+		username, ok = ar.Username, true
+	})(httptest.NewRecorder(), r)
+
+	if !ok {
+		return "", WrongCredentials
+	}
+	return username, nil
+}
+
 func NewAuthenticationBackendFromConfig() (AuthenticationBackend, error) {
 	t := config.GetConfig().GetString("auth.type")
 
+	var backend AuthenticationBackend
 	switch t {
 	case "basic":
-		return NewBasicAuthenticationBackendFromConfig()
+		b, err := NewBasicAuthenticationBackendFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		backend = b
 	case "keystone":
-		return NewKeystoneAuthenticationBackendFromConfig(), nil
+		backend = NewKeystoneAuthenticationBackendFromConfig()
 	default:
-		return NewNoAuthenticationBackend(), nil
+		backend = NewNoAuthenticationBackend()
 	}
+
+	return NewSessionAuthenticationBackendFromConfig(backend), nil
 }
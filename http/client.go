@@ -24,6 +24,7 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -53,6 +54,12 @@ func NewRestClient(addr string, port int, authOptions *AuthenticationOpts) *Rest
 	}
 }
 
+// SetTLSConfig makes the client use HTTPS with the given configuration
+func (c *RestClient) SetTLSConfig(tlsConfig *tls.Config) {
+	c.authClient.TLSConfig = tlsConfig
+	c.client.Transport = c.authClient.transport()
+}
+
 func NewRestClientFromConfig(authOptions *AuthenticationOpts) *RestClient {
 	addr, port, err := config.GetAnalyzerClientAddr()
 	if err != nil {
@@ -136,7 +136,14 @@ func (s *Server) serveLogin(w http.ResponseWriter, r *http.Request) {
 		loginForm, passwordForm := r.Form["username"], r.Form["password"]
 		if len(loginForm) != 0 && len(passwordForm) != 0 {
 			login, password := loginForm[0], passwordForm[0]
-			if token, err := s.Auth.Authenticate(login, password); err == nil {
+
+			// the agents get the long lived token of the backend
+			backend := s.Auth
+			if sb, ok := backend.(*SessionAuthenticationBackend); ok && r.Form.Get("long_lived") == "true" {
+				backend = sb.Backend
+			}
+
+			if token, err := backend.Authenticate(login, password); err == nil {
 				if token != "" {
 					cookie := &http.Cookie{
 						Name:  "authtok",
@@ -213,6 +220,9 @@ func NewServer(s string, a string, p int, auth AuthenticationBackend) *Server {
 	}
 
 	router.HandleFunc("/login", server.serveLogin)
+	if sb, ok := auth.(*SessionAuthenticationBackend); ok {
+		sb.registerEndpoints(server)
+	}
 	router.HandleFunc("/", auth.Wrap(server.serveIndex))
 
 	return server
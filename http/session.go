@@ -0,0 +1,404 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// prefix of the session tokens, the other tokens being the ones of the
+// wrapped backend
+const sessionTokenPrefix = "session."
+
+// time given to the authentication command
+const authCommandTimeout = 10 * time.Second
+
+var (
+	ErrSessionExpired = errors.New("Session expired")
+	ErrSessionRevoked = errors.New("Session revoked")
+	ErrSessionTooOld  = errors.New("Session too old to be refreshed, login again")
+)
+
+// Session is the signed content of a session token. The refreshed tokens
+// of a session keep its ID and the time of the login, Issued.
+type Session struct {
+	ID      string
+	User    string
+	Issued  int64
+	Expires int64
+}
+
+// SessionAuthenticationBackend exchanges the credentials of the users for
+// signed and expiring session tokens, checked without any lookup besides
+// the revocation list. The credentials are checked by the wrapped backend,
+// or by an external command given the username as argument and the
+// password on its standard input, success being exit status 0. The tokens
+// of the wrapped backend are still accepted, the agents keeping their long
+// lived credentials.
+type SessionAuthenticationBackend struct {
+	Backend AuthenticationBackend
+	Command string
+	// lifetime of a token, and of a session refreshed, 0 for no limit
+	Lifetime    time.Duration
+	MaxLifetime time.Duration
+	// OnRevoke stores a revocation, ie. for the other analyzers
+	OnRevoke    func(s *Session) error
+	secret      []byte
+	revokedLock sync.RWMutex
+	revoked     map[string]int64
+}
+
+// IsSessionToken returns whether the token is a session token
+func IsSessionToken(token string) bool {
+	return strings.HasPrefix(token, sessionTokenPrefix)
+}
+
+func (b *SessionAuthenticationBackend) sign(payload string) string {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token returns the token of the session, the session as JSON followed by
+// its HMAC-SHA256
+func (b *SessionAuthenticationBackend) token(s *Session) string {
+	data, _ := json.Marshal(s)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return sessionTokenPrefix + payload + "." + b.sign(payload)
+}
+
+// Validate returns the session of a token once its signature, its expiry
+// and the revocations checked
+func (b *SessionAuthenticationBackend) Validate(token string) (*Session, error) {
+	parts := strings.Split(strings.TrimPrefix(token, sessionTokenPrefix), ".")
+	if !IsSessionToken(token) || len(parts) != 2 || !hmac.Equal([]byte(b.sign(parts[0])), []byte(parts[1])) {
+		return nil, WrongCredentials
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, WrongCredentials
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, WrongCredentials
+	}
+
+	if err := b.check(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// check checks that a session validated before is still valid
+func (b *SessionAuthenticationBackend) check(s *Session) error {
+	if s.Expires != 0 && time.Now().Unix() >= s.Expires {
+		return ErrSessionExpired
+	}
+
+	b.revokedLock.RLock()
+	_, revoked := b.revoked[s.ID]
+	b.revokedLock.RUnlock()
+
+	if revoked {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+func (b *SessionAuthenticationBackend) expires(issued time.Time, now time.Time) int64 {
+	if b.Lifetime <= 0 {
+		return 0
+	}
+
+	expires := now.Add(b.Lifetime)
+	if b.MaxLifetime > 0 && expires.After(issued.Add(b.MaxLifetime)) {
+		expires = issued.Add(b.MaxLifetime)
+	}
+	return expires.Unix()
+}
+
+// NewSession returns a token of a new session of the user
+func (b *SessionAuthenticationBackend) NewSession(user string) (string, *Session) {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	now := time.Now()
+	s := &Session{ID: hex.EncodeToString(id), User: user, Issued: now.Unix(), Expires: b.expires(now, now)}
+
+	return b.token(s), s
+}
+
+// Refresh returns a token of the session of the given token expiring later,
+// up to MaxLifetime after the login
+func (b *SessionAuthenticationBackend) Refresh(token string) (string, *Session, error) {
+	s, err := b.Validate(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	issued, now := time.Unix(s.Issued, 0), time.Now()
+	if b.MaxLifetime > 0 && !now.Before(issued.Add(b.MaxLifetime)) {
+		return "", nil, ErrSessionTooOld
+	}
+
+	refreshed := &Session{ID: s.ID, User: s.User, Issued: s.Issued, Expires: b.expires(issued, now)}
+	return b.token(refreshed), refreshed, nil
+}
+
+// Revoke revokes a session, the revocation being stored with OnRevoke
+func (b *SessionAuthenticationBackend) Revoke(s *Session) error {
+	b.SetRevoked(s.ID, s.Expires)
+
+	if b.OnRevoke != nil {
+		return b.OnRevoke(s)
+	}
+	return nil
+}
+
+// SetRevoked adds a session to the revocation list until it expires, the
+// sessions expired being dropped from the list
+func (b *SessionAuthenticationBackend) SetRevoked(id string, expires int64) {
+	b.revokedLock.Lock()
+	defer b.revokedLock.Unlock()
+
+	now := time.Now().Unix()
+	for revoked, e := range b.revoked {
+		if e != 0 && e <= now {
+			delete(b.revoked, revoked)
+		}
+	}
+
+	b.revoked[id] = expires
+}
+
+// Forget removes a session from the revocation list
+func (b *SessionAuthenticationBackend) Forget(id string) {
+	b.revokedLock.Lock()
+	delete(b.revoked, id)
+	b.revokedLock.Unlock()
+}
+
+func (b *SessionAuthenticationBackend) runCommand(username string, password string) error {
+	cmd := exec.Command(b.Command, username)
+	cmd.Stdin = strings.NewReader(password)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logging.GetLogger().Warningf("Authentication of %s refused by %s: %s %s", username, b.Command, err.Error(), strings.TrimSpace(stderr.String()))
+			return WrongCredentials
+		}
+		return nil
+	case <-time.After(authCommandTimeout):
+		cmd.Process.Kill()
+		return errors.New("Authentication command timed out")
+	}
+}
+
+// Authenticate checks the credentials and returns the token of a new
+// session
+func (b *SessionAuthenticationBackend) Authenticate(username string, password string) (string, error) {
+	if b.Command != "" {
+		if err := b.runCommand(username, password); err != nil {
+			return "", err
+		}
+	} else if _, err := b.Backend.Authenticate(username, password); err != nil {
+		return "", err
+	}
+
+	token, _ := b.NewSession(username)
+	return token, nil
+}
+
+// Wrap checks the session tokens, the other ones being checked by the
+// wrapped backend
+func (b *SessionAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	backend := b.Backend.Wrap(wrapped)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("authtok")
+		if err != nil || !IsSessionToken(cookie.Value) {
+			backend(w, r)
+			return
+		}
+
+		s, err := b.Validate(cookie.Value)
+		if err != nil {
+			logging.GetLogger().Debugf("Session refused from %s: %s", r.RemoteAddr, err.Error())
+			unauthorized(w, r)
+			return
+		}
+
+		wrapped(w, &auth.AuthenticatedRequest{Request: *r, Username: s.User})
+	}
+}
+
+// SessionReply is the reply of the login and refresh endpoints
+type SessionReply struct {
+	Token   string
+	ID      string
+	User    string
+	Expires int64 `json:",omitempty"`
+}
+
+func (b *SessionAuthenticationBackend) reply(w http.ResponseWriter, token string, s *Session) {
+	cookie := &http.Cookie{Name: "authtok", Value: token, Path: "/", HttpOnly: true}
+	if s.Expires != 0 {
+		cookie.Expires = time.Unix(s.Expires, 0)
+	}
+	http.SetCookie(w, cookie)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&SessionReply{Token: token, ID: s.ID, User: s.User, Expires: s.Expires})
+}
+
+// serveLogin exchanges credentials, as form values or as JSON, for a
+// session token
+func (b *SessionAuthenticationBackend) serveLogin(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string
+		Password string
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.NewDecoder(r.Body).Decode(&creds)
+	} else {
+		r.ParseForm()
+		creds.Username, creds.Password = r.Form.Get("username"), r.Form.Get("password")
+	}
+
+	token, err := b.Authenticate(creds.Username, creds.Password)
+	if creds.Username == "" || err != nil {
+		logging.GetLogger().Warningf("Login of %s refused from %s", creds.Username, r.RemoteAddr)
+		unauthorized(w, r)
+		return
+	}
+
+	s, _ := b.Validate(token)
+	b.reply(w, token, s)
+}
+
+func sessionToken(r *http.Request) string {
+	if cookie, err := r.Cookie("authtok"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (b *SessionAuthenticationBackend) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	token, s, err := b.Refresh(sessionToken(r))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	b.reply(w, token, s)
+}
+
+// serveLogout revokes the session of the request
+func (b *SessionAuthenticationBackend) serveLogout(w http.ResponseWriter, r *http.Request) {
+	s, err := b.Validate(sessionToken(r))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := b.Revoke(s); err != nil {
+		logging.GetLogger().Errorf("Unable to store the revocation of the session %s: %s", s.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "authtok", Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (b *SessionAuthenticationBackend) registerEndpoints(s *Server) {
+	s.Router.HandleFunc("/api/login", b.serveLogin).Methods("POST")
+	s.Router.HandleFunc("/api/login/refresh", b.serveRefresh).Methods("POST")
+	s.Router.HandleFunc("/api/logout", b.serveLogout).Methods("POST")
+}
+
+func NewSessionAuthenticationBackend(backend AuthenticationBackend, secret []byte) *SessionAuthenticationBackend {
+	return &SessionAuthenticationBackend{
+		Backend: backend,
+		secret:  secret,
+		revoked: make(map[string]int64),
+	}
+}
+
+// NewSessionAuthenticationBackendFromConfig wraps the backend with the
+// sessions if enabled, the tokens being signed with the configured secret,
+// shared by the analyzers, otherwise with a random one, the sessions not
+// surviving a restart.
+func NewSessionAuthenticationBackendFromConfig(backend AuthenticationBackend) AuthenticationBackend {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("auth.session.enabled") {
+		return backend
+	}
+
+	secret := []byte(cfg.GetString("auth.session.secret"))
+	if len(secret) == 0 {
+		logging.GetLogger().Warning("No auth.session.secret, the sessions won't survive a restart nor be shared by the analyzers")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	b := NewSessionAuthenticationBackend(backend, secret)
+	b.Command = cfg.GetString("auth.session.command")
+	b.Lifetime = time.Duration(cfg.GetInt("auth.session.lifetime")) * time.Second
+	b.MaxLifetime = time.Duration(cfg.GetInt("auth.session.max_lifetime")) * time.Second
+
+	return b
+}
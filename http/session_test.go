@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+)
+
+// fakeBackend accepts the password "secret", its tokens being the username
+type fakeBackend struct{}
+
+func (b *fakeBackend) Authenticate(username string, password string) (string, error) {
+	if password != "secret" {
+		return "", WrongCredentials
+	}
+	return username, nil
+}
+
+func (b *fakeBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("authtok")
+		if err != nil || IsSessionToken(cookie.Value) {
+			unauthorized(w, r)
+			return
+		}
+		wrapped(w, &auth.AuthenticatedRequest{Request: *r, Username: cookie.Value})
+	}
+}
+
+func newTestSessions() *SessionAuthenticationBackend {
+	b := NewSessionAuthenticationBackend(&fakeBackend{}, []byte("key"))
+	b.Lifetime = time.Hour
+	b.MaxLifetime = 24 * time.Hour
+	return b
+}
+
+func TestSessionToken(t *testing.T) {
+	b := newTestSessions()
+
+	if _, err := b.Authenticate("user1", "wrong"); err != WrongCredentials {
+		t.Fatalf("Wrong credentials should be refused, got %v", err)
+	}
+
+	token, err := b.Authenticate("user1", "secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s, err := b.Validate(token)
+	if err != nil || s.User != "user1" || s.Expires != s.Issued+3600 {
+		t.Fatalf("Wrong session %+v: %v", s, err)
+	}
+
+	// signed with another secret or altered
+	other := NewSessionAuthenticationBackend(&fakeBackend{}, []byte("other"))
+	if _, err := other.Validate(token); err != WrongCredentials {
+		t.Errorf("Token of another secret should be refused, got %v", err)
+	}
+
+	forged := *s
+	forged.User = "admin"
+	data, _ := json.Marshal(&forged)
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(data)
+	if _, err := b.Validate(strings.Join(parts, ".")); err != WrongCredentials {
+		t.Errorf("Altered token should be refused, got %v", err)
+	}
+
+	expired := b.token(&Session{ID: "expired", User: "user1", Issued: time.Now().Unix() - 7200, Expires: time.Now().Unix() - 1})
+	if _, err := b.Validate(expired); err != ErrSessionExpired {
+		t.Errorf("Expired token should be refused, got %v", err)
+	}
+
+	if err := b.Revoke(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := b.Validate(token); err != ErrSessionRevoked {
+		t.Errorf("Revoked token should be refused, got %v", err)
+	}
+
+	b.Forget(s.ID)
+	if _, err := b.Validate(token); err != nil {
+		t.Errorf("Token should be accepted once the revocation is forgotten, got %v", err)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	b := newTestSessions()
+
+	issued := time.Now().Add(-23*time.Hour - 30*time.Minute).Unix()
+	token := b.token(&Session{ID: "s1", User: "user1", Issued: issued, Expires: time.Now().Add(time.Minute).Unix()})
+
+	// capped to the max lifetime of the session
+	refreshed, s, err := b.Refresh(token)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.ID != "s1" || s.Issued != issued || s.Expires != issued+24*3600 {
+		t.Errorf("Wrong refreshed session: %+v", s)
+	}
+	if _, err := b.Validate(refreshed); err != nil {
+		t.Errorf("Refreshed token should be valid: %v", err)
+	}
+
+	b.MaxLifetime = time.Hour
+	if _, _, err := b.Refresh(token); err != ErrSessionTooOld {
+		t.Errorf("Session older than its max lifetime shouldn't be refreshed, got %v", err)
+	}
+}
+
+func TestSessionCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-session")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	command := filepath.Join(dir, "check")
+	script := "#!/bin/sh\nread password\n[ \"$1\" = user2 ] && [ \"$password\" = pass2 ]\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := newTestSessions()
+	b.Command = command
+
+	if _, err := b.Authenticate("user2", "pass2"); err != nil {
+		t.Errorf("Credentials accepted by the command should be accepted: %v", err)
+	}
+	for _, creds := range [][2]string{{"user2", "wrong"}, {"user1", "secret"}} {
+		if _, err := b.Authenticate(creds[0], creds[1]); err != WrongCredentials {
+			t.Errorf("Credentials %v refused by the command should be refused, got %v", creds, err)
+		}
+	}
+}
+
+func TestSessionWrap(t *testing.T) {
+	b := newTestSessions()
+
+	var user string
+	handler := b.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+		user = r.Username
+	})
+
+	get := func(token string) int {
+		user = ""
+		r := httptest.NewRequest("GET", "/api/topology", nil)
+		r.AddCookie(&http.Cookie{Name: "authtok", Value: token})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	token, s := b.NewSession("user1")
+	if get(token); user != "user1" {
+		t.Errorf("Session token should be accepted, got %q", user)
+	}
+
+	// the long-lived credentials of the agents
+	if get("agent1"); user != "agent1" {
+		t.Errorf("Token of the backend should be accepted, got %q", user)
+	}
+
+	b.Revoke(s)
+	if code := get(token); code != http.StatusUnauthorized || user != "" {
+		t.Errorf("Revoked session should be refused, got %d", code)
+	}
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	b := newTestSessions()
+
+	var revoked *Session
+	b.OnRevoke = func(s *Session) error {
+		revoked = s
+		return nil
+	}
+
+	form := url.Values{"username": {"user1"}, "password": {"secret"}}
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	b.serveLogin(w, r)
+
+	var reply SessionReply
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %v", w.Code, err)
+	}
+	if reply.User != "user1" || !IsSessionToken(reply.Token) {
+		t.Errorf("Wrong login reply: %+v", reply)
+	}
+
+	r = httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"Username":"user1","Password":"wrong"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	if b.serveLogin(w, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("Login with wrong credentials should be refused, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/api/logout", nil)
+	r.AddCookie(&http.Cookie{Name: "authtok", Value: reply.Token})
+	w = httptest.NewRecorder()
+	if b.serveLogout(w, r); w.Code != http.StatusOK || revoked == nil || revoked.ID != reply.ID {
+		t.Errorf("Logout should revoke the session: %d %+v", w.Code, revoked)
+	}
+}
+
+func TestSessionRecheck(t *testing.T) {
+	b := newTestSessions()
+	s := &WSServer{Server: &Server{Auth: b}, clients: make(map[*WSClient]bool)}
+
+	_, session := b.NewSession("user1")
+	user := &WSClient{host: "cli", remote: "10.0.0.1:1234", username: "user1", session: session, connected: time.Now()}
+	agent := &WSClient{host: "agent1", remote: "10.0.0.2:1234", username: "agent1", connected: time.Now().Add(-time.Hour)}
+	s.clients[user], s.clients[agent] = true, true
+
+	clients := s.Clients()
+	if len(clients) != 2 || clients[0].Username != "agent1" || clients[1].Username != "user1" || clients[1].Session != session.ID {
+		t.Errorf("Wrong clients: %+v", clients)
+	}
+
+	s.checkSessions()
+	if user.rejected != 0 {
+		t.Fatal("Valid session shouldn't be closed")
+	}
+
+	b.SetRevoked(session.ID, session.Expires)
+	s.checkSessions()
+	if user.rejected != 1 || agent.rejected != 0 {
+		t.Error("Only the connection of the revoked session should be closed")
+	}
+}
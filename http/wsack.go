@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// wsAckQueue keeps the messages requiring an acknowledgment sent to a client
+// until they are acknowledged. Queues are identified by the consumer ID
+// given by the client in its AckSubscribe message, scoped by its user, so
+// that a client reconnecting gets the pending messages again, whatever its
+// address, and that consumers on the same host have their own queues.
+type wsAckQueue struct {
+	key          string
+	client       *WSClient
+	nextID       uint64
+	pending      []*wsAckMessage
+	dropped      int64
+	disconnected time.Time
+}
+
+type wsAckMessage struct {
+	id   uint64
+	data []byte
+	sent time.Time
+}
+
+type WSAckStats struct {
+	Connected bool
+	Pending   int
+	Dropped   int64
+}
+
+type wsBroadcast struct {
+	msg    WSMessage
+	data   []byte
+	ack    bool
+	filter func(c *WSClient) bool
+	// sequence number of the message, if journaled by the emitter
+	seq uint64
+	// messages sent to a single client in order with the broadcasts
+	to       *WSClient
+	messages []WSMessage
+}
+
+type wsAcks struct {
+	sync.Mutex
+	queues     map[string]*wsAckQueue
+	timeout    time.Duration
+	maxPending int
+	retention  time.Duration
+}
+
+func ackKey(c *WSClient, consumer string) string {
+	if c.username != "" {
+		return c.username + "/" + consumer
+	}
+	return consumer
+}
+
+// push assigns an ID to the message and keeps it until acknowledged, the
+// oldest message is dropped when the queue is full.
+func (a *wsAcks) push(q *wsAckQueue, msg WSMessage) []byte {
+	q.nextID++
+	msg.ID = q.nextID
+	data := msg.Marshal()
+
+	if a.maxPending > 0 && len(q.pending) >= a.maxPending {
+		logging.GetLogger().Errorf("Too many unacknowledged messages for %s, dropping message %d", q.key, q.pending[0].id)
+		q.pending = q.pending[1:]
+		q.dropped++
+	}
+	q.pending = append(q.pending, &wsAckMessage{id: msg.ID, data: data, sent: time.Now()})
+
+	return data
+}
+
+// prepare returns the data of a broadcasted message for the given client
+func (a *wsAcks) prepare(c *WSClient, b *wsBroadcast) []byte {
+	if !b.ack {
+		return b.data
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if q := c.ackQueue; q != nil {
+		return a.push(q, b.msg)
+	}
+	return b.data
+}
+
+// subscribe attaches the client to the queue of the consumer, sending it
+// the messages not acknowledged before a reconnection, outside of the lock.
+// The ones not fitting in the send queue of the client are sent again by
+// retry.
+func (a *wsAcks) subscribe(c *WSClient, consumer string) {
+	if consumer == "" {
+		logging.GetLogger().Warningf("WSClient %s subscribed to acknowledged messages without consumer ID, ignored", c.host)
+		return
+	}
+
+	a.Lock()
+	key := ackKey(c, consumer)
+	q, ok := a.queues[key]
+	if !ok {
+		q = &wsAckQueue{key: key}
+		a.queues[key] = q
+	}
+	q.client = c
+	c.ackQueue = q
+
+	logging.GetLogger().Infof("WSClient %s subscribed to acknowledged messages as %s, %d pending", c.host, key, len(q.pending))
+
+	pending := make([]*wsAckMessage, len(q.pending))
+	copy(pending, q.pending)
+	a.Unlock()
+
+	for _, m := range pending {
+		select {
+		case c.send <- m.data:
+			a.Lock()
+			m.sent = time.Now()
+			a.Unlock()
+		default:
+		}
+	}
+}
+
+func (a *wsAcks) unsubscribe(c *WSClient) {
+	a.Lock()
+	defer a.Unlock()
+
+	if q := c.ackQueue; q != nil && q.client == c {
+		q.client = nil
+		q.disconnected = time.Now()
+	}
+	c.ackQueue = nil
+}
+
+func (a *wsAcks) ack(c *WSClient, id uint64) {
+	a.Lock()
+	defer a.Unlock()
+
+	q := c.ackQueue
+	if q == nil {
+		return
+	}
+
+	for i, m := range q.pending {
+		if m.id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// retry sends again the messages not acknowledged in time and forgets the
+// queues of the clients gone for longer than the retention.
+func (a *wsAcks) retry() {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	for key, q := range a.queues {
+		if q.client == nil {
+			if now.Sub(q.disconnected) > a.retention {
+				logging.GetLogger().Warningf("WSClient %s gone, dropping %d unacknowledged messages", key, len(q.pending))
+				delete(a.queues, key)
+			}
+			continue
+		}
+
+		for _, m := range q.pending {
+			if now.Sub(m.sent) < a.timeout {
+				continue
+			}
+			select {
+			case q.client.send <- m.data:
+				m.sent = now
+			default:
+			}
+		}
+	}
+}
+
+func (a *wsAcks) metrics() interface{} {
+	a.Lock()
+	defer a.Unlock()
+
+	stats := make(map[string]WSAckStats)
+	for key, q := range a.queues {
+		stats[key] = WSAckStats{
+			Connected: q.client != nil,
+			Pending:   len(q.pending),
+			Dropped:   q.dropped,
+		}
+	}
+
+	return stats
+}
+
+func newWSBroadcast(msg WSMessage, ack bool) *wsBroadcast {
+	b := &wsBroadcast{ack: ack, seq: msg.Seq}
+	if ack {
+		// serialized by the caller as the object could be modified later,
+		// unless already serialized
+		if _, ok := msg.Obj.(json.RawMessage); !ok {
+			obj, _ := json.Marshal(msg.Obj)
+			msg.Obj = json.RawMessage(obj)
+		}
+		b.msg = msg
+	}
+	b.data = msg.Marshal()
+
+	return b
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestAckClient(host string) *WSClient {
+	return &WSClient{host: host, send: make(chan []byte, 10)}
+}
+
+func TestWSAcks(t *testing.T) {
+	acks := &wsAcks{
+		queues:     make(map[string]*wsAckQueue),
+		timeout:    time.Millisecond,
+		maxPending: 2,
+		retention:  time.Hour,
+	}
+
+	plain := newTestAckClient("plain")
+	c := newTestAckClient("host1")
+	acks.subscribe(c, "audit")
+
+	b := newWSBroadcast(WSMessage{Namespace: "Graph", Type: "NodeDeleted", Obj: map[string]string{"ID": "1"}}, true)
+	if data := acks.prepare(plain, b); string(data) != string(b.data) {
+		t.Errorf("Clients not subscribed should get the message as is: %s", string(data))
+	}
+
+	msg, err := UnmarshalWSMessage(acks.prepare(c, b))
+	if err != nil || msg.ID != 1 || msg.Type != "NodeDeleted" {
+		t.Fatalf("Message with an ID expected: %+v (%v)", msg, err)
+	}
+
+	// not acknowledged, sent again
+	time.Sleep(10 * time.Millisecond)
+	acks.retry()
+	if len(c.send) != 1 {
+		t.Errorf("Unacknowledged message should have been sent again")
+	}
+
+	acks.ack(c, 1)
+	if stats := acks.metrics().(map[string]WSAckStats)["audit"]; stats.Pending != 0 {
+		t.Errorf("Message should have been acknowledged: %+v", stats)
+	}
+
+	// pending messages are sent again after a reconnection
+	acks.prepare(c, b)
+	acks.unsubscribe(c)
+
+	// from another host
+	c = newTestAckClient("host2")
+	acks.subscribe(c, "audit")
+	if len(c.send) != 1 {
+		t.Errorf("Pending message should have been sent after reconnection")
+	}
+
+	acks.prepare(c, b)
+	acks.prepare(c, b)
+	if stats := acks.metrics().(map[string]WSAckStats)["audit"]; stats.Pending != 2 || stats.Dropped != 1 {
+		t.Errorf("Oldest message should have been dropped: %+v", stats)
+	}
+}
+
+func TestWSAckConsumers(t *testing.T) {
+	acks := &wsAcks{
+		queues:     make(map[string]*wsAckQueue),
+		timeout:    time.Hour,
+		maxPending: 10,
+		retention:  time.Hour,
+	}
+
+	b := newWSBroadcast(WSMessage{Namespace: "Graph", Type: "NodeDeleted", Obj: map[string]string{"ID": "1"}}, true)
+
+	// two consumers on the same host, the second one of another user
+	audit, other := newTestAckClient("host1"), newTestAckClient("host1")
+	other.username = "user1"
+	acks.subscribe(audit, "audit")
+	acks.subscribe(other, "audit")
+
+	acks.prepare(audit, b)
+	acks.prepare(audit, b)
+	acks.prepare(other, b)
+
+	stats := acks.metrics().(map[string]WSAckStats)
+	if stats["audit"].Pending != 2 || stats["user1/audit"].Pending != 1 {
+		t.Errorf("Consumers should have their own queues: %+v", stats)
+	}
+
+	// no consumer ID, no queue
+	anonymous := newTestAckClient("host1")
+	acks.subscribe(anonymous, "")
+	if anonymous.ackQueue != nil || len(acks.queues) != 2 {
+		t.Errorf("Subscription without consumer ID should be ignored")
+	}
+
+	// the pending messages not fitting in the send queue don't block
+	acks.unsubscribe(audit)
+	full := &WSClient{host: "host1", send: make(chan []byte, 1)}
+	acks.subscribe(full, "audit")
+	if len(full.send) != 1 || full.ackQueue == nil {
+		t.Errorf("Only the first pending message should have been sent: %d", len(full.send))
+	}
+}
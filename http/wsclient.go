@@ -23,11 +23,11 @@
 package http
 
 import (
-	"io"
+	"crypto/tls"
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -35,9 +35,14 @@ import (
 
 	"github.com/gorilla/websocket"
 
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/faults"
 	"github.com/redhat-cip/skydive/logging"
 )
 
+const resolveInterval = 10 * time.Second
+
 type WSClientEventHandler interface {
 	OnMessage(m WSMessage)
 	OnConnected()
@@ -48,12 +53,15 @@ type DefaultWSClientEventHandler struct {
 }
 
 type WSAsyncClient struct {
-	Addr          string
-	Port          int
-	Path          string
-	AuthClient    *AuthenticationClient
+	Addr         string
+	Port         int
+	Path         string
+	AuthClient   *AuthenticationClient
+	Capabilities map[string]interface{}
+	// TLS configuration, wss being used if set
+	TLSConfig     *tls.Config
 	host          string
-	messages      chan string
+	messages      chan wsQueued
 	read          chan []byte
 	quit          chan bool
 	wg            sync.WaitGroup
@@ -61,6 +69,16 @@ type WSAsyncClient struct {
 	eventHandlers []WSClientEventHandler
 	connected     atomic.Value
 	running       atomic.Value
+	// servers tried in turn, resolved again once all of them failed
+	servers  []config.ServiceAddress
+	current  int
+	resolver func() ([]config.ServiceAddress, error)
+	resolved time.Time
+	// delay before reconnecting requested by a server going away
+	reconnectDelay int64
+	// the messages bigger than this size are split, see splitWSMessage
+	maxMessageSize int
+	parts          wsReassembler
 }
 
 func (d *DefaultWSClientEventHandler) OnMessage(m WSMessage) {
@@ -72,7 +90,16 @@ func (d *DefaultWSClientEventHandler) OnConnected() {
 func (d *DefaultWSClientEventHandler) OnDisconnected() {
 }
 
-func (c *WSAsyncClient) sendMessage(m string) {
+// wsQueued is a message waiting to be written, the traced messages being
+// marshaled once dequeued so that their trace includes the time spent in
+// the queue
+type wsQueued struct {
+	data   string
+	msg    *WSMessage
+	queued time.Time
+}
+
+func (c *WSAsyncClient) sendMessage(m wsQueued) {
 	if !c.IsConnected() {
 		return
 	}
@@ -81,46 +108,86 @@ func (c *WSAsyncClient) sendMessage(m string) {
 }
 
 func (c *WSAsyncClient) SendWSMessage(m WSMessage) {
-	c.sendMessage(m.String())
-}
+	if m.Tracing == nil {
+		c.sendMessage(wsQueued{data: m.String()})
+		return
+	}
 
-func (c *WSAsyncClient) IsConnected() bool {
-	return c.connected.Load() == true
+	// the object may change while queued, only the trace is completed
+	obj, err := json.Marshal(m.Obj)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to marshal the %s message: %s", m.Type, err.Error())
+		return
+	}
+	m.Obj, m.Tracing = json.RawMessage(obj), m.Tracing.Copy()
+	c.sendMessage(wsQueued{msg: &m, queued: time.Now()})
 }
 
-func (c *WSAsyncClient) send(msg string) error {
-	w, err := c.wsConn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return err
+// marshal returns the message to be written, adding the time spent in the
+// queue to its trace
+func (q wsQueued) marshal() string {
+	if q.msg == nil {
+		return q.data
 	}
 
-	_, err = io.WriteString(w, msg)
-	if err != nil {
-		return err
+	service, host := "", ""
+	if last := q.msg.Tracing.Last(); last != nil {
+		service, host = last.Service, last.Host
 	}
+	q.msg.Tracing.AddSpan(service, host, "ws_queue", q.queued, time.Now())
 
-	return w.Close()
+	return q.msg.String()
 }
 
+func (c *WSAsyncClient) IsConnected() bool {
+	return c.connected.Load() == true
+}
+
+func (c *WSAsyncClient) send(msg wsQueued) error {
+	for _, part := range splitWSMessage([]byte(msg.marshal()), c.maxMessageSize) {
+		if err := c.wsConn.WriteMessage(websocket.TextMessage, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendHello announces the host and the capabilities of the client,
+// including the version of its messages. The capabilities are given aside
+// of the host, the former analyzers expecting it as the object.
 func (c *WSAsyncClient) sendHello() {
+	caps := map[string]interface{}{"SchemaVersion": WSMessageVersion}
+	for k, v := range c.Capabilities {
+		caps[k] = v
+	}
+
 	m := WSMessage{
-		Namespace: Namespace,
-		Type:      "Hello",
-		Obj:       c.host,
+		Namespace:    Namespace,
+		Type:         "Hello",
+		Obj:          c.host,
+		Capabilities: caps,
 	}
-	c.sendMessage(m.String())
+	c.sendMessage(wsQueued{data: m.String()})
 }
 
 func (c *WSAsyncClient) connect() {
 	host := c.Addr + ":" + strconv.FormatInt(int64(c.Port), 10)
 
-	conn, err := net.Dial("tcp", host)
+	scheme := "ws://"
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		scheme = "wss://"
+		conn, err = tls.Dial("tcp", host, c.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
 	if err != nil {
 		logging.GetLogger().Errorf("Connection to the WebSocket server failed: %s", err.Error())
 		return
 	}
 
-	endpoint := "ws://" + host + c.Path
+	endpoint := scheme + host + c.Path
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		logging.GetLogger().Errorf("Unable to parse the WebSocket Endpoint %s: %s", endpoint, err.Error())
@@ -164,6 +231,9 @@ func (c *WSAsyncClient) connect() {
 		for c.running.Load() == true {
 			_, m, err := c.wsConn.ReadMessage()
 			if err != nil {
+				if ce, ok := err.(*websocket.CloseError); ok && ce.Code == websocket.CloseProtocolError {
+					logging.GetLogger().Errorf("Connection rejected by %s: %s", endpoint, ce.Text)
+				}
 				break
 			}
 
@@ -175,25 +245,139 @@ func (c *WSAsyncClient) connect() {
 	for c.running.Load() == true {
 		select {
 		case msg := <-c.messages:
+			if faults.Fire(faults.WSClientDrop) {
+				break
+			}
 			err := c.send(msg)
 			if err != nil {
 				logging.GetLogger().Errorf("Error while writing to the WebSocket: %s", err.Error())
 			}
 		case m := <-c.read:
+			m, complete := c.parts.add(m)
+			if !complete {
+				break
+			}
+
 			msg, err := UnmarshalWSMessage(m)
-			if err != nil {
+			if _, ok := err.(*WSVersionError); ok {
+				// the reader stops and notifies the disconnection
+				logging.GetLogger().Errorf("Disconnecting from %s: %s", endpoint, err.Error())
+				c.wsConn.Close()
+			} else if err != nil {
 				logging.GetLogger().Errorf("Error while decoding WSMessage %s", err.Error())
+			} else if msg.Namespace == Namespace && msg.Type == "GoingAway" {
+				c.goingAway(msg)
 			} else {
+				if msg.Error != "" {
+					logging.GetLogger().Warningf("%s %s message: %s", msg.Namespace, msg.Type, msg.Error)
+				}
 				for _, e := range c.eventHandlers {
 					e.OnMessage(msg)
 				}
 			}
 		case <-c.quit:
+			if c.running.Load() == false {
+				c.close()
+			}
 			return
 		}
 	}
 }
 
+// close sends the queued messages then a close frame, the client being
+// disconnected, so that the server doesn't wait for the connection to time
+// out.
+func (c *WSAsyncClient) close() {
+	for {
+		select {
+		case msg := <-c.messages:
+			if err := c.send(msg); err != nil {
+				return
+			}
+		default:
+			c.wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// SetFailover makes the client connect to the servers in turn, the
+// resolver giving them again once all of them failed so that relocated
+// servers are picked up.
+func (c *WSAsyncClient) SetFailover(servers []config.ServiceAddress, resolver func() ([]config.ServiceAddress, error)) {
+	c.servers, c.current, c.resolver = servers, 0, resolver
+	c.resolved = time.Now()
+	if len(servers) > 0 {
+		c.setServer(servers[0])
+	}
+}
+
+func (c *WSAsyncClient) setServer(server config.ServiceAddress) {
+	c.Addr, c.Port = server.Addr, server.Port
+	if c.AuthClient != nil {
+		c.AuthClient.Addr, c.AuthClient.Port = server.Addr, server.Port
+		c.AuthClient.authenticated = false
+	}
+}
+
+// nextServer switches to the next server after a connection failure. The
+// servers are resolved again at most every resolveInterval, a resolution
+// failure being retried the same way.
+func (c *WSAsyncClient) nextServer() {
+	if c.resolver == nil {
+		return
+	}
+
+	c.current++
+	if c.current >= len(c.servers) {
+		c.current = 0
+
+		if time.Since(c.resolved) >= resolveInterval || len(c.servers) == 0 {
+			c.resolved = time.Now()
+
+			servers, err := c.resolver()
+			if err != nil {
+				logging.GetLogger().Errorf("Unable to resolve the servers: %s", err.Error())
+			}
+			if len(servers) > 0 {
+				c.servers = servers
+			}
+		}
+	}
+
+	if len(c.servers) > 0 {
+		server := c.servers[c.current]
+		if server.Addr != c.Addr || server.Port != c.Port {
+			logging.GetLogger().Infof("Failing over to %s", server.String())
+		}
+		c.setServer(server)
+	}
+}
+
+// goingAway records the delay after which the server going away asked to
+// reconnect, the servers spreading the reconnections of their clients.
+func (c *WSAsyncClient) goingAway(msg WSMessage) {
+	var obj struct {
+		ReconnectDelay int64
+	}
+	if err := msg.DecodeObj(&obj); err != nil || obj.ReconnectDelay < 0 {
+		return
+	}
+
+	delay := time.Duration(obj.ReconnectDelay) * time.Millisecond
+	logging.GetLogger().Infof("Server going away, reconnecting in %s", delay)
+	atomic.StoreInt64(&c.reconnectDelay, int64(delay))
+}
+
+// nextReconnectDelay returns the delay before the next connection attempt,
+// the one requested by the server going away if any.
+func (c *WSAsyncClient) nextReconnectDelay() time.Duration {
+	if delay := atomic.SwapInt64(&c.reconnectDelay, -1); delay >= 0 {
+		return time.Duration(delay)
+	}
+	return time.Second
+}
+
 func (c *WSAsyncClient) Connect() {
 	go func() {
 		for c.running.Load() == true {
@@ -206,10 +390,12 @@ func (c *WSAsyncClient) Connect() {
 				for _, l := range c.eventHandlers {
 					l.OnDisconnected()
 				}
+			} else {
+				c.nextServer()
 			}
 
 			if c.running.Load() == true {
-				time.Sleep(1 * time.Second)
+				time.Sleep(c.nextReconnectDelay())
 			}
 		}
 	}()
@@ -228,7 +414,7 @@ func (c *WSAsyncClient) Disconnect() {
 }
 
 func NewWSAsyncClient(addr string, port int, path string, authClient *AuthenticationClient) (*WSAsyncClient, error) {
-	host, err := os.Hostname()
+	host, err := common.HostID()
 	if err != nil {
 		return nil, err
 	}
@@ -239,11 +425,14 @@ func NewWSAsyncClient(addr string, port int, path string, authClient *Authentica
 		Path:       path,
 		AuthClient: authClient,
 		host:       host,
-		messages:   make(chan string, 500),
+		messages:   make(chan wsQueued, 500),
 		read:       make(chan []byte, 500),
 		quit:       make(chan bool),
+		// split by the analyzer, the messages are at most that big
+		maxMessageSize: config.GetConfig().GetInt("ws_max_message_size"),
 	}
 	c.connected.Store(false)
+	c.reconnectDelay = -1
 	c.running.Store(true)
 	return c, nil
 }
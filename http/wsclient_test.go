@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+func TestQueuedTrace(t *testing.T) {
+	c := &WSAsyncClient{messages: make(chan wsQueued, 2)}
+	c.connected.Store(true)
+
+	trace := &common.Trace{ID: "t1"}
+	trace.AddSpan("agent", "host1", "notify", time.Now(), time.Now())
+
+	obj := map[string]interface{}{"Name": "eth0"}
+	c.SendWSMessage(WSMessage{Namespace: "Graph", Type: "NodeUpdated", Obj: obj, Tracing: trace})
+	c.SendWSMessage(WSMessage{Namespace: "Graph", Type: "NodeUpdated", Obj: obj})
+
+	// changed while queued
+	obj["Name"] = "eth1"
+
+	msg := mustUnmarshal(t, (<-c.messages).marshal())
+	if msg.Obj.(map[string]interface{})["Name"] != "eth0" {
+		t.Errorf("Traced message should be sent as queued: %v", msg.Obj)
+	}
+
+	if msg.Tracing == nil || len(msg.Tracing.Spans) != 2 {
+		t.Fatalf("Queue span expected: %+v", msg.Tracing)
+	}
+	if span := msg.Tracing.Spans[1]; span.Name != "ws_queue" || span.Host != "host1" || span.ParentID != trace.Spans[0].SpanID {
+		t.Errorf("Wrong queue span: %+v", span)
+	}
+	if len(trace.Spans) != 1 {
+		t.Error("Trace of the sender shouldn't be changed")
+	}
+
+	if msg = mustUnmarshal(t, (<-c.messages).marshal()); msg.Tracing != nil {
+		t.Errorf("Message shouldn't be traced: %+v", msg.Tracing)
+	}
+}
@@ -24,7 +24,11 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,7 +36,9 @@ import (
 	"github.com/abbot/go-http-auth"
 	"github.com/gorilla/websocket"
 
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/faults"
 	"github.com/redhat-cip/skydive/logging"
 )
 
@@ -43,17 +49,67 @@ const (
 )
 
 type WSClient struct {
-	conn   *websocket.Conn
-	read   chan []byte
-	send   chan []byte
-	server *WSServer
-	host   string
+	// identifier of the connection, unique among the ones of the server
+	id       uint64
+	conn     *websocket.Conn
+	read     chan []byte
+	send     chan []byte
+	server   *WSServer
+	host     string
+	username string
+	ackQueue *wsAckQueue
+	// address the client connects from, without port
+	remote string
+	// incarnation of the process of the client, set if announced
+	incarnation int64
+	rejected    int32
+	// closed when the server shuts down, the client being told to
+	// reconnect after goingAway
+	closing   chan struct{}
+	goingAway time.Duration
+	connected time.Time
+	// session the client authenticated with, if any, checked again every
+	// sessionCheck
+	session *Session
+	// journaled messages broadcasted while replies are being prepared for
+	// the client, held by the server loop until they are queued
+	holding int32
+	held    []*wsBroadcast
+	// parts of the split message being received
+	parts wsReassembler
 }
 
+// WSClientStatus describes a connection, the user it authenticated with and
+// its session, if any
+type WSClientStatus struct {
+	Host           string
+	Remote         string
+	Username       string `json:",omitempty"`
+	Session        string `json:",omitempty"`
+	SessionExpires int64  `json:",omitempty"`
+	Connected      int64
+}
+
+// WSMessage is the message exchanged over the websockets, ID is only set
+// for the messages to be acknowledged by the clients which subscribed to
+// acknowledged messages. Seq is the sequence number given by the emitters
+// keeping a journal of the messages they broadcast, Revision the revision
+// of the state the message brings the receiver to. Error is set when the
+// message had to be truncated to fit in the maximum message size. Version is
+// set to WSMessageVersion when marshaled. Tracing is the trace of the sampled
+// graph mutations, completed by each hop.
 type WSMessage struct {
 	Namespace string
 	Type      string
 	Obj       interface{}
+	ID        uint64        `json:",omitempty"`
+	Seq       uint64        `json:",omitempty"`
+	Revision  uint64        `json:",omitempty"`
+	Error     string        `json:",omitempty"`
+	Version   string        `json:",omitempty"`
+	Tracing   *common.Trace `json:",omitempty"`
+	// only set on the Hello messages, their object being the host
+	Capabilities map[string]interface{} `json:",omitempty"`
 }
 
 type WSServerEventHandler interface {
@@ -69,18 +125,39 @@ type WSServer struct {
 	DefaultWSServerEventHandler
 	Server        *Server
 	eventHandlers []WSServerEventHandler
-	clients       map[*WSClient]bool
-	broadcast     chan string
-	quit          chan bool
-	register      chan *WSClient
-	unregister    chan *WSClient
-	pongWait      time.Duration
-	pingPeriod    time.Duration
-	wg            sync.WaitGroup
-	listening     atomic.Value
+	// the clients, written by the server loop only, the writes locked for
+	// the other readers
+	clients      map[*WSClient]bool
+	clientsLock  sync.RWMutex
+	lastClientID uint64
+	sessionCheck time.Duration
+	broadcast    chan *wsBroadcast
+	acks         *wsAcks
+	quit         chan bool
+	register     chan *WSClient
+	unregister   chan *WSClient
+	pongWait     time.Duration
+	pingPeriod   time.Duration
+	wg           sync.WaitGroup
+	listening    atomic.Value
+	capsLock     sync.RWMutex
+	capabilities map[string]map[string]interface{}
+	// last incarnation and client of the hosts
+	incarnations map[string]int64
+	incarnated   map[string]*WSClient
+	// on shutdown, the queued messages are flushed for at most
+	// shutdownTimeout and the clients reconnect within reconnectDelay
+	stopping        int32
+	shutdownTimeout time.Duration
+	reconnectDelay  time.Duration
+	// the messages bigger than this size are split, see splitWSMessage
+	maxMessageSize int
 }
 
 func (g WSMessage) Marshal() []byte {
+	if g.Version == "" {
+		g.Version = WSMessageVersion
+	}
 	j, _ := json.Marshal(g)
 	return j
 }
@@ -89,12 +166,29 @@ func (g WSMessage) String() string {
 	return string(g.Marshal())
 }
 
+// DecodeObj decodes the object of a received message, unmarshaled as generic
+// maps, into the given value.
+func (g WSMessage) DecodeObj(v interface{}) error {
+	data, err := json.Marshal(g.Obj)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// UnmarshalWSMessage decodes a message, a WSVersionError being returned for
+// the messages of another major version.
 func UnmarshalWSMessage(b []byte) (WSMessage, error) {
 	msg := WSMessage{}
 	if err := json.Unmarshal(b, &msg); err != nil {
 		return msg, err
 	}
 
+	if err := msg.CheckVersion(); err != nil {
+		return msg, err
+	}
+
 	return msg, nil
 }
 
@@ -107,23 +201,81 @@ func (d *DefaultWSServerEventHandler) OnRegisterClient(c *WSClient) {
 func (d *DefaultWSServerEventHandler) OnUnregisterClient(c *WSClient) {
 }
 
+func (c *WSClient) GetHost() string {
+	return c.host
+}
+
+// GetID returns the identifier of the connection, telling apart the
+// connections of a host
+func (c *WSClient) GetID() uint64 {
+	return c.id
+}
+
+// GetUsername returns the user the client authenticated with, if any
+func (c *WSClient) GetUsername() string {
+	return c.username
+}
+
+// NewFakeWSClient returns a client without connection, queuing up to size
+// messages sent to it, to be used in tests.
+func NewFakeWSClient(host string, size int) *WSClient {
+	return &WSClient{host: host, send: make(chan []byte, size), closing: make(chan struct{}), connected: time.Now()}
+}
+
 func (c *WSClient) SendWSMessage(msg WSMessage) {
 	c.send <- []byte(msg.String())
 }
 
 func (c *WSClient) processMessage(m []byte) {
+	if atomic.LoadInt32(&c.rejected) == 1 {
+		return
+	}
+
+	m, complete := c.parts.add(m)
+	if !complete {
+		return
+	}
+
 	msg, err := UnmarshalWSMessage(m)
 	if err != nil {
+		if _, ok := err.(*WSVersionError); ok {
+			logging.GetLogger().Errorf("WSServer: rejecting the connection of %s: %s", c.conn.RemoteAddr().String(), err.Error())
+			c.rejectWith(err.Error())
+			return
+		}
 		logging.GetLogger().Errorf("WSServer: Unable to parse the event %s: %s", msg, err.Error())
 		return
 	}
 
+	if msg.Error != "" {
+		logging.GetLogger().Warningf("WSServer: %s %s message from %s: %s", msg.Namespace, msg.Type, c.host, msg.Error)
+	}
+
 	if msg.Namespace == Namespace {
 		switch msg.Type {
 		case "Hello":
-			c.host = msg.Obj.(string)
-
-			logging.GetLogger().Infof("Hello received from WSClient: %s", c.host)
+			var caps map[string]interface{}
+			c.host, caps = parseHello(msg)
+			if version, ok := caps["SchemaVersion"].(string); ok {
+				if err := (WSMessage{Version: version}).CheckVersion(); err != nil {
+					logging.GetLogger().Errorf("WSServer: rejecting the connection of %s: %s", c.host, err.Error())
+					c.rejectWith(err.Error())
+					return
+				}
+			}
+			if !c.server.admit(c, caps) {
+				return
+			}
+			c.server.setCapabilities(c.host, caps)
+
+			logging.GetLogger().Infof("Hello received from WSClient: %s, capabilities: %v", c.host, caps)
+		case "AckSubscribe":
+			consumer, _ := msg.Obj.(string)
+			c.server.acks.subscribe(c, consumer)
+		case "Ack":
+			if id, ok := msg.Obj.(float64); ok {
+				c.server.acks.ack(c, uint64(id))
+			}
 		}
 	} else {
 		for _, e := range c.server.eventHandlers {
@@ -154,7 +306,13 @@ func (c *WSClient) readPump() {
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	// the parts of the split messages are at most as big as the ones of the
+	// server
+	limit := int64(maxMessageSize)
+	if size := int64(c.server.maxMessageSize); size > limit {
+		limit = size
+	}
+	c.conn.SetReadLimit(limit)
 	c.conn.SetReadDeadline(time.Now().Add(c.server.pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(c.server.pongWait))
@@ -187,7 +345,10 @@ func (c *WSClient) writePump(wg *sync.WaitGroup, quit chan struct{}) {
 				wg.Done()
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
+			if faults.Fire(faults.WSServerDrop) {
+				break
+			}
+			if err := c.writeMessage(message); err != nil {
 				logging.GetLogger().Warningf("Error while writing to the websocket: %s", err.Error())
 				wg.Done()
 				return
@@ -197,6 +358,10 @@ func (c *WSClient) writePump(wg *sync.WaitGroup, quit chan struct{}) {
 				wg.Done()
 				return
 			}
+		case <-c.closing:
+			c.flush()
+			wg.Done()
+			return
 		case <-quit:
 			wg.Done()
 			return
@@ -204,14 +369,167 @@ func (c *WSClient) writePump(wg *sync.WaitGroup, quit chan struct{}) {
 	}
 }
 
+// flush writes the queued messages until the shutdown deadline, then a
+// GoingAway message with the delay after which the client should reconnect
+// and a close frame, the client closing the connection in turn.
+func (c *WSClient) flush() {
+	deadline := time.Now().Add(c.server.shutdownTimeout)
+
+queued:
+	for time.Now().Before(deadline) {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+		default:
+			break queued
+		}
+	}
+
+	msg := WSMessage{
+		Namespace: Namespace,
+		Type:      "GoingAway",
+		Obj:       map[string]interface{}{"ReconnectDelay": int64(c.goingAway / time.Millisecond)},
+	}
+	if err := c.write(websocket.TextMessage, msg.Marshal()); err != nil {
+		return
+	}
+	c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
+}
+
+// writeMessage writes a message, split in several ones if bigger than the
+// maximum message size
+func (c *WSClient) writeMessage(message []byte) error {
+	for _, part := range splitWSMessage(message, c.server.maxMessageSize) {
+		if err := c.write(websocket.TextMessage, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *WSClient) write(mt int, message []byte) error {
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return c.conn.WriteMessage(mt, message)
 }
 
+// parseHello returns the host and the capabilities announced by a client,
+// the host being the object of the message so that the analyzers not
+// knowing about the capabilities still get it. The capabilities of the
+// agents sending them within the object are read too.
+func parseHello(msg WSMessage) (string, map[string]interface{}) {
+	switch obj := msg.Obj.(type) {
+	case string:
+		return obj, msg.Capabilities
+	case map[string]interface{}:
+		host, _ := obj["Host"].(string)
+		caps, _ := obj["Capabilities"].(map[string]interface{})
+		return host, caps
+	}
+	return "", nil
+}
+
+// reject closes the connection of the client, its messages being ignored
+func (c *WSClient) reject() {
+	atomic.StoreInt32(&c.rejected, 1)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// rejectWith closes the connection of the client with a close frame carrying
+// the reason, ie. an incompatible message version, logged by the client.
+func (c *WSClient) rejectWith(reason string) {
+	if c.conn != nil {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, reason), time.Now().Add(writeWait))
+	}
+	c.reject()
+}
+
+// admit checks the identity and the incarnation announced by a client. An
+// identity already connected from another address is claimed by two
+// agents, ie. cloned with their data directory, the newer connection being
+// rejected. The incarnation increases with the restarts of the process of a
+// client, a client older than the last one of its host is a stale
+// connection of a previous process and is rejected, the connection of a
+// previous process still open being closed when a newer one arrives.
+func (s *WSServer) admit(c *WSClient, caps map[string]interface{}) bool {
+	s.capsLock.Lock()
+	defer s.capsLock.Unlock()
+
+	if previous, ok := s.incarnated[c.host]; ok && previous != c && previous.remote != c.remote && atomic.LoadInt32(&previous.rejected) == 0 {
+		reason := fmt.Sprintf("identity %s already connected from %s", c.host, previous.remote)
+		logging.GetLogger().Errorf("WSServer: rejecting the connection of %s from %s: %s", c.host, c.remote, reason)
+		c.rejectWith(reason)
+		return false
+	}
+
+	incarnation, ok := caps["Incarnation"].(float64)
+	if !ok {
+		if _, ok := s.incarnated[c.host]; !ok {
+			s.incarnated[c.host] = c
+		}
+		return true
+	}
+	c.incarnation = int64(incarnation)
+
+	if last, ok := s.incarnations[c.host]; ok && c.incarnation < last {
+		logging.GetLogger().Warningf("WSServer: rejecting the connection of %s, incarnation %d older than %d", c.host, c.incarnation, last)
+		c.reject()
+		return false
+	}
+
+	if previous, ok := s.incarnated[c.host]; ok && previous != c && previous.incarnation < c.incarnation {
+		logging.GetLogger().Infof("WSServer: closing the connection of %s from the incarnation %d", c.host, previous.incarnation)
+		previous.reject()
+	}
+
+	s.incarnations[c.host] = c.incarnation
+	s.incarnated[c.host] = c
+
+	return true
+}
+
+// forget removes the client from the connections of the incarnations
+func (s *WSServer) forget(c *WSClient) {
+	s.capsLock.Lock()
+	if s.incarnated[c.host] == c {
+		delete(s.incarnated, c.host)
+	}
+	s.capsLock.Unlock()
+}
+
+func (s *WSServer) setCapabilities(host string, caps map[string]interface{}) {
+	s.capsLock.Lock()
+	s.capabilities[host] = caps
+	s.capsLock.Unlock()
+}
+
+// GetCapabilities returns the capabilities announced by the last client
+// of the given host, they are kept after its disconnection.
+func (s *WSServer) GetCapabilities(host string) map[string]interface{} {
+	s.capsLock.RLock()
+	defer s.capsLock.RUnlock()
+
+	return s.capabilities[host]
+}
+
+// IsConnected returns whether a client of the given host is connected
+func (s *WSServer) IsConnected(host string) bool {
+	s.capsLock.RLock()
+	defer s.capsLock.RUnlock()
+
+	c, ok := s.incarnated[host]
+	return ok && atomic.LoadInt32(&c.rejected) == 0
+}
+
 func (s *WSServer) SendWSMessageTo(msg WSMessage, host string) bool {
 	for c := range s.clients {
-		if c.host == host {
+		if c.host == host && atomic.LoadInt32(&c.rejected) == 0 {
 			c.SendWSMessage(msg)
 			return true
 		}
@@ -223,21 +541,41 @@ func (s *WSServer) SendWSMessageTo(msg WSMessage, host string) bool {
 func (s *WSServer) listenAndServe() {
 	quit := false
 
+	ackTicker := time.NewTicker(s.acks.timeout)
+	defer ackTicker.Stop()
+
+	var sessionTicker <-chan time.Time
+	if s.sessions() != nil && s.sessionCheck > 0 {
+		ticker := time.NewTicker(s.sessionCheck)
+		defer ticker.Stop()
+		sessionTicker = ticker.C
+	}
+
 	for {
 		select {
 		case <-s.quit:
+			// the pending broadcasts are queued before closing
+			for len(s.broadcast) > 0 {
+				s.broadcastMessage(<-s.broadcast)
+			}
+
 			if len(s.clients) == 0 {
 				return
 			}
 
-			// close all the client so that they will call unregister
+			// close all the client so that they will call unregister, once
+			// their queued messages are written, each of them reconnecting
+			// at a different time
 			for c := range s.clients {
-				c.conn.Close()
+				c.goingAway = s.jitter()
+				close(c.closing)
 			}
 
 			quit = true
 		case c := <-s.register:
+			s.clientsLock.Lock()
 			s.clients[c] = true
+			s.clientsLock.Unlock()
 			for _, e := range s.eventHandlers {
 				e.OnRegisterClient(c)
 			}
@@ -245,7 +583,11 @@ func (s *WSServer) listenAndServe() {
 			for _, e := range s.eventHandlers {
 				e.OnUnregisterClient(c)
 			}
+			s.acks.unsubscribe(c)
+			s.forget(c)
+			s.clientsLock.Lock()
 			delete(s.clients, c)
+			s.clientsLock.Unlock()
 
 			// if quit has been requested and there is no more clients then leave
 			if quit && len(s.clients) == 0 {
@@ -253,36 +595,186 @@ func (s *WSServer) listenAndServe() {
 			}
 		case m := <-s.broadcast:
 			s.broadcastMessage(m)
+		case <-ackTicker.C:
+			s.acks.retry()
+		case <-sessionTicker:
+			s.checkSessions()
+		}
+	}
+}
+
+// sessions returns the session backend of the server, if any
+func (s *WSServer) sessions() *SessionAuthenticationBackend {
+	if s.Server == nil {
+		return nil
+	}
+	sb, _ := s.Server.Auth.(*SessionAuthenticationBackend)
+	return sb
+}
+
+// checkSessions closes the connections whose session expired or was
+// revoked, the sessions being checked at the upgrade then periodically
+// rather than on every message
+func (s *WSServer) checkSessions() {
+	sb := s.sessions()
+	if sb == nil {
+		return
+	}
+
+	for c := range s.clients {
+		if c.session == nil || atomic.LoadInt32(&c.rejected) == 1 {
+			continue
 		}
+
+		if err := sb.check(c.session); err != nil {
+			logging.GetLogger().Infof("WSServer: closing the connection of %s from %s: %s", c.session.User, c.remote, err.Error())
+			c.rejectWith(err.Error())
+		}
+	}
+}
+
+// Clients returns the status of the connections
+func (s *WSServer) Clients() []WSClientStatus {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+
+	clients := []WSClientStatus{}
+	for c := range s.clients {
+		status := WSClientStatus{Host: c.host, Remote: c.remote, Username: c.username, Connected: c.connected.Unix()}
+		if c.session != nil {
+			status.Session, status.SessionExpires = c.session.ID, c.session.Expires
+		}
+		clients = append(clients, status)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Connected < clients[j].Connected })
+
+	return clients
+}
+
+// jitter returns the delay after which a client should reconnect, spread
+// over the reconnection window so that the clients don't all reconnect at
+// once when the server comes back.
+func (s *WSServer) jitter() time.Duration {
+	if s.reconnectDelay <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(s.reconnectDelay)))
 }
 
-func (s *WSServer) broadcastMessage(m string) {
+func (s *WSServer) broadcastMessage(b *wsBroadcast) {
+	if b.to != nil {
+		s.sendMessages(b)
+		return
+	}
+
 	for c := range s.clients {
+		if atomic.LoadInt32(&c.rejected) == 1 || b.filter != nil && !b.filter(c) {
+			continue
+		}
+
+		if b.seq != 0 && atomic.LoadInt32(&c.holding) > 0 {
+			if len(c.held) >= cap(c.send) {
+				s.dropClient(c)
+				continue
+			}
+			c.held = append(c.held, b)
+			continue
+		}
+
 		select {
-		case c.send <- []byte(m):
+		case c.send <- s.acks.prepare(c, b):
 		default:
-			delete(s.clients, c)
+			s.dropClient(c)
 		}
 	}
 }
 
+// sendMessages sends the messages queued for a client then, once no other
+// replies are prepared, the messages held meanwhile which follow them.
+func (s *WSServer) sendMessages(b *wsBroadcast) {
+	c := b.to
+	if !s.clients[c] || atomic.LoadInt32(&c.rejected) == 1 {
+		return
+	}
+
+	var last uint64
+	for _, msg := range b.messages {
+		if msg.Seq > last {
+			last = msg.Seq
+		}
+
+		select {
+		case c.send <- msg.Marshal():
+		default:
+			s.dropClient(c)
+			return
+		}
+	}
+
+	if atomic.AddInt32(&c.holding, -1) > 0 {
+		return
+	}
+
+	held := c.held
+	c.held = nil
+	for _, h := range held {
+		if h.seq <= last {
+			continue
+		}
+
+		select {
+		case c.send <- s.acks.prepare(c, h):
+		default:
+			s.dropClient(c)
+			return
+		}
+	}
+}
+
+// dropClient closes the connection of a client whose send queue is full,
+// nothing being sent to it anymore. The client reconnects and resyncs, it is
+// unregistered as usual once its connection is closed.
+func (s *WSServer) dropClient(c *WSClient) {
+	logging.GetLogger().Warningf("WSServer: send queue of %s from %s full, closing its connection", c.host, c.remote)
+	c.reject()
+}
+
 func (s *WSServer) serveMessages(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
 
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, &r.Request, nil)
 	if err != nil {
 		return
 	}
 
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
 	c := &WSClient{
-		read:   make(chan []byte, maxMessageSize),
-		send:   make(chan []byte, maxMessageSize),
-		conn:   conn,
-		server: s,
+		id:        atomic.AddUint64(&s.lastClientID, 1),
+		remote:    remote,
+		read:      make(chan []byte, maxMessageSize),
+		send:      make(chan []byte, maxMessageSize),
+		conn:      conn,
+		server:    s,
+		username:  r.Username,
+		closing:   make(chan struct{}),
+		connected: time.Now(),
+	}
+	if sb := s.sessions(); sb != nil {
+		if cookie, err := r.Cookie("authtok"); err == nil && IsSessionToken(cookie.Value) {
+			c.session, _ = sb.Validate(cookie.Value)
+		}
 	}
 	logging.GetLogger().Infof("New WebSocket Connection from %s : URI path %s", conn.RemoteAddr().String(), r.URL.Path)
 
@@ -291,7 +783,8 @@ func (s *WSServer) serveMessages(w http.ResponseWriter, r *auth.AuthenticatedReq
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	quit := make(chan struct{})
+	// buffered, the write pump may have returned already
+	quit := make(chan struct{}, 2)
 
 	go c.writePump(&wg, quit)
 	go c.processMessages(&wg, quit)
@@ -308,7 +801,43 @@ func (s *WSServer) serveMessages(w http.ResponseWriter, r *auth.AuthenticatedReq
 }
 
 func (s *WSServer) BroadcastWSMessage(msg WSMessage) {
-	s.broadcast <- msg.String()
+	s.broadcast <- newWSBroadcast(msg, false)
+}
+
+// BroadcastAckedWSMessage broadcasts a message which has to be acknowledged
+// by the clients which subscribed to acknowledged messages, sending an
+// AckSubscribe message with their consumer ID. Those clients get the message with an ID to be sent
+// back in an Ack message, otherwise the message is sent again, including
+// after a reconnection. Other clients get the message as usual.
+func (s *WSServer) BroadcastAckedWSMessage(msg WSMessage) {
+	s.broadcast <- newWSBroadcast(msg, true)
+}
+
+// BroadcastFilteredWSMessage broadcasts a message, acknowledged or not, to
+// the clients accepted by the filter. The filter is called from the server
+// loop, it must not depend on state changing after the call.
+func (s *WSServer) BroadcastFilteredWSMessage(msg WSMessage, acked bool, filter func(c *WSClient) bool) {
+	b := newWSBroadcast(msg, acked)
+	b.filter = filter
+	s.broadcast <- b
+}
+
+// HoldWSMessages holds the journaled messages, numbered by Seq, broadcasted
+// to a client until the replies being prepared for it are queued with
+// QueueWSMessages, so that they follow the replies.
+func (s *WSServer) HoldWSMessages(c *WSClient) {
+	atomic.AddInt32(&c.holding, 1)
+}
+
+// QueueWSMessages sends replies to a client through the server loop, after
+// the broadcasts already queued, then the messages held with HoldWSMessages
+// numbered after the replies, the other ones being already replied.
+func (s *WSServer) QueueWSMessages(c *WSClient, msgs []WSMessage) {
+	s.broadcast <- &wsBroadcast{to: c, messages: msgs}
+}
+
+func (s *WSServer) AckMetrics() interface{} {
+	return s.acks.metrics()
 }
 
 func (s *WSServer) ListenAndServe() {
@@ -319,7 +848,10 @@ func (s *WSServer) ListenAndServe() {
 	s.listenAndServe()
 }
 
+// Stop refuses the new connections, flushes the messages queued for the
+// clients and closes their connection, telling them when to reconnect.
 func (s *WSServer) Stop() {
+	atomic.StoreInt32(&s.stopping, 1)
 	s.quit <- true
 	if s.listening.Load() == true {
 		s.wg.Wait()
@@ -332,18 +864,37 @@ func (s *WSServer) AddEventHandler(h WSServerEventHandler) {
 }
 
 func NewWSServer(server *Server, pongWait time.Duration, endpoint string) *WSServer {
+	cfg := config.GetConfig()
+
 	s := &WSServer{
-		Server:     server,
-		broadcast:  make(chan string, 500),
-		quit:       make(chan bool, 1),
-		register:   make(chan *WSClient),
-		unregister: make(chan *WSClient),
-		clients:    make(map[*WSClient]bool),
-		pongWait:   pongWait,
-		pingPeriod: (pongWait * 8) / 10,
+		Server:          server,
+		broadcast:       make(chan *wsBroadcast, 500),
+		quit:            make(chan bool, 1),
+		register:        make(chan *WSClient),
+		unregister:      make(chan *WSClient),
+		clients:         make(map[*WSClient]bool),
+		capabilities:    make(map[string]map[string]interface{}),
+		incarnations:    make(map[string]int64),
+		incarnated:      make(map[string]*WSClient),
+		pongWait:        pongWait,
+		pingPeriod:      (pongWait * 8) / 10,
+		shutdownTimeout: time.Duration(cfg.GetInt("ws_shutdown_timeout")) * time.Second,
+		reconnectDelay:  time.Duration(cfg.GetInt("ws_reconnect_delay")) * time.Second,
+		maxMessageSize:  cfg.GetInt("ws_max_message_size"),
+		sessionCheck:    time.Duration(cfg.GetInt("auth.session.check_interval")) * time.Second,
+		acks: &wsAcks{
+			queues:     make(map[string]*wsAckQueue),
+			timeout:    time.Duration(cfg.GetInt("ws_ack_timeout")) * time.Second,
+			maxPending: cfg.GetInt("ws_ack_max_pending"),
+			retention:  time.Duration(cfg.GetInt("ws_ack_retention")) * time.Second,
+		},
+	}
+	if s.acks.timeout <= 0 {
+		s.acks.timeout = 5 * time.Second
 	}
 
 	server.HandleFunc(endpoint, s.serveMessages)
+	common.RegisterMetrics("ws_acks", s.AckMetrics)
 
 	return s
 }
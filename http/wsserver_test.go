@@ -0,0 +1,323 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/websocket"
+)
+
+func TestParseHello(t *testing.T) {
+	if host, caps := parseHello(WSMessage{Obj: "host1"}); host != "host1" || caps != nil {
+		t.Errorf("Wrong legacy hello: %s %v", host, caps)
+	}
+
+	// the former analyzers only read the host, the object of the message
+	hello := WSMessage{Namespace: Namespace, Type: "Hello", Obj: "host2", Capabilities: map[string]interface{}{"ReadOnly": true}}
+	msg, err := UnmarshalWSMessage([]byte(hello.String()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := msg.Obj.(string); !ok {
+		t.Errorf("The host should be the object of the hello: %v", msg.Obj)
+	}
+
+	host, caps := parseHello(msg)
+	if host != "host2" || caps["ReadOnly"] != true {
+		t.Errorf("Wrong hello: %s %v", host, caps)
+	}
+
+	msg, err = UnmarshalWSMessage([]byte(`{"Namespace":"WSServer","Type":"Hello","Obj":{"Host":"host3","Capabilities":{"ReadOnly":true}}}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if host, caps := parseHello(msg); host != "host3" || caps["ReadOnly"] != true {
+		t.Errorf("Wrong hello with the capabilities in its object: %s %v", host, caps)
+	}
+}
+
+func TestQueueWSMessages(t *testing.T) {
+	s := &WSServer{
+		clients:   make(map[*WSClient]bool),
+		broadcast: make(chan *wsBroadcast, 10),
+		acks:      &wsAcks{queues: make(map[string]*wsAckQueue)},
+	}
+	c := NewFakeWSClient("host1", 10)
+	s.clients[c] = true
+
+	event := func(seq uint64) WSMessage {
+		return WSMessage{Namespace: "Graph", Type: "NodeUpdated", Seq: seq, Obj: map[string]string{"ID": "1"}}
+	}
+
+	// events broadcasted while the replies up to 5 are prepared
+	s.HoldWSMessages(c)
+	s.BroadcastWSMessage(event(4))
+	s.BroadcastWSMessage(event(5))
+	s.BroadcastWSMessage(WSMessage{Namespace: "Graph", Type: "Statistics"})
+	s.BroadcastWSMessage(event(6))
+	s.QueueWSMessages(c, []WSMessage{event(3), event(4), event(5)})
+	s.BroadcastWSMessage(event(7))
+
+	for len(s.broadcast) > 0 {
+		s.broadcastMessage(<-s.broadcast)
+	}
+
+	var seqs []uint64
+	for len(c.send) > 0 {
+		msg, err := UnmarshalWSMessage(<-c.send)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		seqs = append(seqs, msg.Seq)
+	}
+	if len(seqs) != 6 || seqs[0] != 0 || seqs[1] != 3 || seqs[2] != 4 || seqs[3] != 5 || seqs[4] != 6 || seqs[5] != 7 {
+		t.Errorf("Events should follow the replies without duplicates: %v", seqs)
+	}
+
+	// the client gone meanwhile
+	delete(s.clients, c)
+	s.QueueWSMessages(c, []WSMessage{event(8)})
+	s.broadcastMessage(<-s.broadcast)
+	if len(c.send) != 0 {
+		t.Errorf("Nothing should be sent to a client gone: %d", len(c.send))
+	}
+}
+
+func TestDropClient(t *testing.T) {
+	s := &WSServer{
+		clients:      make(map[*WSClient]bool),
+		incarnations: make(map[string]int64),
+		incarnated:   make(map[string]*WSClient),
+		acks:         &wsAcks{queues: make(map[string]*wsAckQueue)},
+	}
+	c := NewFakeWSClient("host1", 1)
+	s.clients[c] = true
+	s.admit(c, map[string]interface{}{"Incarnation": float64(1)})
+
+	s.broadcastMessage(newWSBroadcast(WSMessage{Namespace: "Graph", Type: "NodeDeleted", Obj: map[string]string{"ID": "1"}}, false))
+	s.broadcastMessage(newWSBroadcast(WSMessage{Namespace: "Graph", Type: "NodeDeleted", Obj: map[string]string{"ID": "2"}}, false))
+
+	// the connection closed so that the client reconnects and resyncs
+	if c.rejected != 1 {
+		t.Error("Client with a full send queue should be disconnected")
+	}
+
+	<-c.send
+	s.broadcastMessage(newWSBroadcast(WSMessage{Namespace: "Graph", Type: "NodeDeleted", Obj: map[string]string{"ID": "3"}}, false))
+	if len(c.send) != 0 {
+		t.Errorf("Nothing should be sent to a dropped client: %d", len(c.send))
+	}
+}
+
+func TestIncarnations(t *testing.T) {
+	s := &WSServer{
+		incarnations: make(map[string]int64),
+		incarnated:   make(map[string]*WSClient),
+	}
+
+	old := &WSClient{host: "agent1"}
+	if !s.admit(old, map[string]interface{}{"Incarnation": float64(1)}) {
+		t.Fatal("First incarnation should be admitted")
+	}
+
+	restarted := &WSClient{host: "agent1"}
+	if !s.admit(restarted, map[string]interface{}{"Incarnation": float64(2)}) {
+		t.Fatal("Newer incarnation should be admitted")
+	}
+	if old.rejected != 1 {
+		t.Error("Connection of the previous incarnation should have been closed")
+	}
+
+	// the old process reconnecting is stale, even once the new one left
+	s.forget(restarted)
+	stale := &WSClient{host: "agent1"}
+	if s.admit(stale, map[string]interface{}{"Incarnation": float64(1)}) || stale.rejected != 1 {
+		t.Error("Older incarnation should be rejected")
+	}
+
+	if !s.admit(&WSClient{host: "agent1"}, map[string]interface{}{"Incarnation": float64(2)}) {
+		t.Error("Reconnection of the same incarnation should be admitted")
+	}
+
+	if !s.admit(&WSClient{host: "agent1"}, nil) {
+		t.Error("Clients without incarnation should be admitted")
+	}
+}
+
+func TestDuplicateIdentity(t *testing.T) {
+	s := &WSServer{
+		incarnations: make(map[string]int64),
+		incarnated:   make(map[string]*WSClient),
+	}
+
+	first := &WSClient{host: "agent1", remote: "10.0.0.1"}
+	if !s.admit(first, map[string]interface{}{"Incarnation": float64(1)}) {
+		t.Fatal("First connection should be admitted")
+	}
+
+	// a clone claiming the same identity, whatever its incarnation
+	clone := &WSClient{host: "agent1", remote: "10.0.0.2"}
+	if s.admit(clone, map[string]interface{}{"Incarnation": float64(2)}) || clone.rejected != 1 {
+		t.Error("Second connection of the identity should be rejected")
+	}
+	if first.rejected != 0 {
+		t.Error("First connection should be kept")
+	}
+
+	// the identity is free again once the first connection left
+	s.forget(first)
+	moved := &WSClient{host: "agent1", remote: "10.0.0.2"}
+	if !s.admit(moved, map[string]interface{}{"Incarnation": float64(2)}) {
+		t.Error("Connection from another address should be admitted once the first one left")
+	}
+
+	legacy := &WSClient{host: "agent2", remote: "10.0.0.3"}
+	if !s.admit(legacy, nil) {
+		t.Fatal("Clients without incarnation should be admitted")
+	}
+	if other := (&WSClient{host: "agent2", remote: "10.0.0.4"}); s.admit(other, nil) {
+		t.Error("Second connection of an identity without incarnation should be rejected")
+	}
+}
+
+type testRegisterHandler struct {
+	DefaultWSServerEventHandler
+	registered chan *WSClient
+}
+
+func (h *testRegisterHandler) OnRegisterClient(c *WSClient) {
+	h.registered <- c
+}
+
+func TestGoingAway(t *testing.T) {
+	window := 10 * time.Second
+
+	s := &WSServer{
+		broadcast:       make(chan *wsBroadcast, 500),
+		quit:            make(chan bool, 1),
+		register:        make(chan *WSClient),
+		unregister:      make(chan *WSClient),
+		clients:         make(map[*WSClient]bool),
+		capabilities:    make(map[string]map[string]interface{}),
+		incarnations:    make(map[string]int64),
+		incarnated:      make(map[string]*WSClient),
+		pongWait:        5 * time.Second,
+		pingPeriod:      4 * time.Second,
+		shutdownTimeout: time.Second,
+		reconnectDelay:  window,
+		acks: &wsAcks{
+			queues:  make(map[string]*wsAckQueue),
+			timeout: 5 * time.Second,
+		},
+	}
+	registered := make(chan *WSClient, 20)
+	s.AddEventHandler(&testRegisterHandler{registered: registered})
+	go s.ListenAndServe()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMessages(w, &auth.AuthenticatedRequest{Request: *r})
+	}))
+	defer ts.Close()
+
+	endpoint := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	var conns []*websocket.Conn
+	for i := 0; i != 20; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(endpoint, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	for range conns {
+		select {
+		case <-registered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Clients not registered")
+		}
+	}
+
+	// queued before the shutdown, the message has to be flushed
+	s.BroadcastWSMessage(WSMessage{Namespace: "Test", Type: "Last"})
+	s.Stop()
+
+	if _, _, err := websocket.DefaultDialer.Dial(endpoint, nil); err == nil {
+		t.Error("New connections should be refused during the shutdown")
+	}
+
+	min, max := window, time.Duration(0)
+	for _, conn := range conns {
+		client := &WSAsyncClient{reconnectDelay: -1}
+
+		var last bool
+		for client.reconnectDelay < 0 {
+			_, m, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("GoingAway message expected: %s", err.Error())
+			}
+
+			msg, err := UnmarshalWSMessage(m)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			switch msg.Type {
+			case "Last":
+				last = true
+			case "GoingAway":
+				client.goingAway(msg)
+			}
+		}
+
+		if !last {
+			t.Error("Queued message not flushed before going away")
+		}
+
+		delay := client.nextReconnectDelay()
+		if delay < 0 || delay >= window {
+			t.Errorf("Reconnection delay %s out of the window %s", delay, window)
+		}
+		if delay < min {
+			min = delay
+		}
+		if delay > max {
+			max = delay
+		}
+
+		if client.nextReconnectDelay() != time.Second {
+			t.Error("Reconnection delay should only be used once")
+		}
+	}
+
+	if max-min < window/2 {
+		t.Errorf("Reconnections not spread over the window: %s - %s", min, max)
+	}
+}
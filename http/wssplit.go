@@ -0,0 +1,345 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// room kept in each part of a split message for the continuation marker
+// and the error of the truncated elements
+const wsPartOverhead = 256
+
+// truncateElement drops the biggest metadata of an element, ie. a node or an
+// edge, until it fits in maxSize bytes, returns the dropped keys. The
+// elements without metadata are left as is.
+func truncateElement(raw json.RawMessage, maxSize int) (json.RawMessage, []string) {
+	var element map[string]json.RawMessage
+	var metadata map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &element); err != nil {
+		return raw, nil
+	}
+	if err := json.Unmarshal(element["Metadata"], &metadata); err != nil {
+		return raw, nil
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(metadata[keys[i]]) == len(metadata[keys[j]]) {
+			return keys[i] < keys[j]
+		}
+		return len(metadata[keys[i]]) > len(metadata[keys[j]])
+	})
+
+	var dropped []string
+	excess := len(raw) - maxSize
+	for _, k := range keys {
+		if excess <= 0 {
+			break
+		}
+		// key, quotes, colon and comma
+		excess -= len(metadata[k]) + len(k) + 4
+		delete(metadata, k)
+		dropped = append(dropped, k)
+	}
+
+	element["Metadata"], _ = json.Marshal(metadata)
+	truncated, err := json.Marshal(element)
+	if err != nil {
+		return raw, nil
+	}
+
+	return truncated, dropped
+}
+
+// truncationError describes the metadata dropped from an element
+func truncationError(kind string, raw json.RawMessage, maxSize int, dropped []string) string {
+	var element struct{ ID string }
+	json.Unmarshal(raw, &element)
+	return fmt.Sprintf("%s %s truncated to fit in %d bytes, dropped: %s", kind, element.ID, maxSize, strings.Join(dropped, ", "))
+}
+
+// wsPart is a part of a split message, Part is set on all the parts but the
+// first one, More on all of them but the last one.
+type wsPart struct {
+	fields map[string]json.RawMessage
+	lists  map[string][]json.RawMessage
+	size   int
+	errors []string
+}
+
+func (p *wsPart) marshal(envelope map[string]json.RawMessage, index int, last bool) []byte {
+	obj := make(map[string]json.RawMessage, len(p.fields)+len(p.lists)+2)
+	for k, v := range p.fields {
+		obj[k] = v
+	}
+	for k, l := range p.lists {
+		obj[k], _ = json.Marshal(l)
+	}
+	if index > 0 {
+		obj["Part"] = json.RawMessage(fmt.Sprint(index))
+	}
+	if !last {
+		obj["More"] = json.RawMessage("true")
+	}
+
+	msg := make(map[string]json.RawMessage, len(envelope))
+	for k, v := range envelope {
+		msg[k] = v
+	}
+	msg["Obj"], _ = json.Marshal(obj)
+	if len(p.errors) > 0 {
+		msg["Error"], _ = json.Marshal(strings.Join(p.errors, "; "))
+	}
+
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// splitWSMessage splits a marshaled message bigger than maxSize bytes in
+// several messages. Its object is split between the elements of its lists,
+// ie. the nodes and the edges of a SyncReply, its other fields being sent
+// with the first part. An element too big by itself, ie. a node with
+// pathological metadata, has its biggest metadata dropped, the Error of its
+// message telling which ones. The messages are reassembled by the receiver
+// before being decoded, see wsReassembler.
+func splitWSMessage(data []byte, maxSize int) [][]byte {
+	if maxSize <= 0 || len(data) <= maxSize {
+		return [][]byte{data}
+	}
+
+	var envelope map[string]json.RawMessage
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return [][]byte{data}
+	}
+	if err := json.Unmarshal(envelope["Obj"], &fields); err != nil {
+		return [][]byte{data}
+	}
+
+	var msgType string
+	json.Unmarshal(envelope["Type"], &msgType)
+
+	// the error of the message, if any, is kept with the first part
+	var errors []string
+	if envelope["Error"] != nil {
+		var err string
+		json.Unmarshal(envelope["Error"], &err)
+		errors = append(errors, err)
+		delete(envelope, "Error")
+	}
+
+	room := maxSize - wsPartOverhead
+	for k, v := range envelope {
+		if k != "Obj" {
+			room -= len(k) + len(v) + 4
+		}
+	}
+
+	lists := make(map[string][]json.RawMessage)
+	var keys []string
+	for k, v := range fields {
+		if trimmed := bytes.TrimSpace(v); len(trimmed) > 0 && trimmed[0] == '[' {
+			var l []json.RawMessage
+			if err := json.Unmarshal(v, &l); err == nil {
+				lists[k] = l
+				keys = append(keys, k)
+				delete(fields, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	// nothing to split, the object is an element by itself, ie. the node
+	// of a NodeUpdated message
+	if len(keys) == 0 {
+		obj, dropped := truncateElement(envelope["Obj"], room)
+		if len(dropped) == 0 {
+			return [][]byte{data}
+		}
+
+		err := truncationError(msgType, envelope["Obj"], maxSize, dropped)
+		logging.GetLogger().Warningf("WebSocket: %s", err)
+
+		part := &wsPart{errors: append(errors, err)}
+		json.Unmarshal(obj, &part.fields)
+		return [][]byte{part.marshal(envelope, 0, true)}
+	}
+
+	newPart := func() *wsPart {
+		p := &wsPart{lists: make(map[string][]json.RawMessage, len(keys))}
+		for _, k := range keys {
+			p.lists[k] = []json.RawMessage{}
+			p.size += len(k) + 6
+		}
+		return p
+	}
+
+	first := newPart()
+	first.fields, first.errors = fields, errors
+	for k, v := range fields {
+		first.size += len(k) + len(v) + 4
+	}
+	parts := []*wsPart{first}
+	count := 0
+
+	for _, k := range keys {
+		for _, raw := range lists[k] {
+			var dropped []string
+			if len(raw) > room {
+				raw, dropped = truncateElement(raw, room)
+			}
+
+			part := parts[len(parts)-1]
+			if part.size+len(raw)+1 > room && count > 0 {
+				part = newPart()
+				parts = append(parts, part)
+				count = 0
+			}
+
+			if len(dropped) > 0 {
+				err := truncationError(strings.TrimSuffix(k, "s"), raw, maxSize, dropped)
+				logging.GetLogger().Warningf("WebSocket: %s %s", msgType, err)
+				part.errors = append(part.errors, err)
+				part.size += len(err) + 2
+			}
+
+			part.lists[k] = append(part.lists[k], raw)
+			part.size += len(raw) + 1
+			count++
+		}
+	}
+
+	msgs := make([][]byte, len(parts))
+	for i, part := range parts {
+		msgs[i] = part.marshal(envelope, i, i == len(parts)-1)
+	}
+
+	return msgs
+}
+
+// wsSplitMarkers are looked for before decoding a message, only the
+// messages carrying one of them possibly being parts of a split message
+var wsSplitMarkers = [][]byte{[]byte(`"More":true`), []byte(`"Part":`)}
+
+// wsReassembler reassembles the parts of the messages split by the sender,
+// see splitWSMessage, so that they are decoded as a whole. The parts of a
+// message are sent in a row over a connection.
+type wsReassembler struct {
+	envelope map[string]json.RawMessage
+	fields   map[string]json.RawMessage
+	lists    map[string][]json.RawMessage
+	errors   []string
+	next     int
+}
+
+func (r *wsReassembler) reset() {
+	r.envelope, r.fields, r.lists, r.errors, r.next = nil, nil, nil, nil, 0
+}
+
+// add returns the whole message once its last part is received, the
+// messages not split being returned as is.
+func (r *wsReassembler) add(data []byte) ([]byte, bool) {
+	if r.envelope == nil && !bytes.Contains(data, wsSplitMarkers[0]) && !bytes.Contains(data, wsSplitMarkers[1]) {
+		return data, true
+	}
+
+	var envelope map[string]json.RawMessage
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return data, true
+	}
+	if err := json.Unmarshal(envelope["Obj"], &fields); err != nil {
+		return data, true
+	}
+
+	var part int
+	var more bool
+	json.Unmarshal(fields["Part"], &part)
+	json.Unmarshal(fields["More"], &more)
+	delete(fields, "Part")
+	delete(fields, "More")
+
+	if part == 0 && !more {
+		if r.envelope != nil {
+			logging.GetLogger().Warningf("WebSocket: incomplete split message dropped")
+			r.reset()
+		}
+		return data, true
+	}
+
+	if part == 0 {
+		r.reset()
+		r.envelope, r.fields, r.lists = envelope, make(map[string]json.RawMessage), make(map[string][]json.RawMessage)
+	} else if r.envelope == nil || part != r.next || !bytes.Equal(envelope["Type"], r.envelope["Type"]) {
+		logging.GetLogger().Warningf("WebSocket: unexpected part %d of a %s message, dropped", part, envelope["Type"])
+		r.reset()
+		return nil, false
+	}
+	r.next++
+
+	for k, v := range fields {
+		var l []json.RawMessage
+		if trimmed := bytes.TrimSpace(v); len(trimmed) > 0 && trimmed[0] == '[' && json.Unmarshal(v, &l) == nil {
+			r.lists[k] = append(r.lists[k], l...)
+		} else if part == 0 {
+			r.fields[k] = v
+		}
+	}
+
+	if envelope["Error"] != nil {
+		var err string
+		json.Unmarshal(envelope["Error"], &err)
+		r.errors = append(r.errors, err)
+	}
+
+	if more {
+		return nil, false
+	}
+
+	for k, l := range r.lists {
+		r.fields[k], _ = json.Marshal(l)
+	}
+	r.envelope["Obj"], _ = json.Marshal(r.fields)
+	delete(r.envelope, "Error")
+	if len(r.errors) > 0 {
+		r.envelope["Error"], _ = json.Marshal(strings.Join(r.errors, "; "))
+	}
+
+	whole, err := json.Marshal(r.envelope)
+	r.reset()
+	if err != nil {
+		return nil, false
+	}
+
+	return whole, true
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/websocket"
+)
+
+type testElement struct {
+	ID       string
+	Metadata map[string]interface{}
+}
+
+type testGraph struct {
+	Host  string
+	Nodes []testElement
+	Edges []testElement
+}
+
+func newTestGraphMessage() WSMessage {
+	g := testGraph{Host: "host1"}
+	for i := 0; i < 50; i++ {
+		g.Nodes = append(g.Nodes, testElement{ID: fmt.Sprintf("node%d", i), Metadata: map[string]interface{}{"Name": fmt.Sprintf("eth%d", i), "MTU": 1500}})
+		if i > 0 {
+			g.Edges = append(g.Edges, testElement{ID: fmt.Sprintf("edge%d", i), Metadata: map[string]interface{}{"RelationType": "layer2"}})
+		}
+	}
+	g.Nodes = append(g.Nodes, testElement{ID: "big", Metadata: map[string]interface{}{"Name": "big", "Routes": strings.Repeat("x", 4096)}})
+
+	return WSMessage{Namespace: "Graph", Type: "SyncReply", Obj: g, Seq: 12}
+}
+
+func checkTestGraph(t *testing.T, msg WSMessage) {
+	if msg.Type != "SyncReply" || msg.Seq != 12 {
+		t.Errorf("Wrong envelope of the reassembled message: %+v", msg)
+	}
+
+	if !strings.Contains(msg.Error, "big") || !strings.Contains(msg.Error, "Routes") {
+		t.Errorf("Truncation of the big node expected: %s", msg.Error)
+	}
+
+	var g testGraph
+	if err := msg.DecodeObj(&g); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if g.Host != "host1" || len(g.Nodes) != 51 || len(g.Edges) != 49 {
+		t.Fatalf("All the fields, nodes and edges expected: %s, %d nodes, %d edges", g.Host, len(g.Nodes), len(g.Edges))
+	}
+
+	if big := g.Nodes[50]; big.ID != "big" || big.Metadata["Name"] != "big" || big.Metadata["Routes"] != nil {
+		t.Errorf("Only the biggest metadata of the big node should be dropped: %+v", big)
+	}
+}
+
+func TestWSSplitReassemble(t *testing.T) {
+	parts := splitWSMessage(newTestGraphMessage().Marshal(), 2048)
+	if len(parts) < 3 {
+		t.Fatalf("Message should have been split: %d parts", len(parts))
+	}
+
+	var r wsReassembler
+	for i, part := range parts {
+		if len(part) > 2048 {
+			t.Errorf("Part %d of %d bytes exceeds the maximum size", i, len(part))
+		}
+
+		// the message is only decoded as a whole
+		m, complete := r.add(part)
+		if complete != (i == len(parts)-1) {
+			t.Fatalf("Message completed after the part %d of %d: %v", i, len(parts), complete)
+		}
+
+		if complete {
+			msg, err := UnmarshalWSMessage(m)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			checkTestGraph(t, msg)
+		}
+	}
+
+	// a missing part interrupts the reassembly
+	r.add(parts[0])
+	if _, complete := r.add(parts[2]); complete {
+		t.Error("Out of order part should have been dropped")
+	}
+	if _, complete := r.add(parts[len(parts)-1]); complete {
+		t.Error("Parts of an interrupted message should be dropped")
+	}
+}
+
+func TestWSSplitNotSplit(t *testing.T) {
+	data := WSMessage{Namespace: "Graph", Type: "NodeAdded", Obj: testElement{ID: "node1"}}.Marshal()
+
+	parts := splitWSMessage(data, 2048)
+	if len(parts) != 1 || string(parts[0]) != string(data) {
+		t.Fatalf("Message shouldn't be split: %d parts", len(parts))
+	}
+
+	var r wsReassembler
+	if m, complete := r.add(parts[0]); !complete || string(m) != string(data) {
+		t.Errorf("Message not split should be returned as is: %s", string(m))
+	}
+
+	// an element by itself is truncated
+	big := WSMessage{Namespace: "Graph", Type: "NodeUpdated", Obj: testElement{ID: "node1", Metadata: map[string]interface{}{"Name": "eth0", "Routes": strings.Repeat("x", 4096)}}}
+	parts = splitWSMessage(big.Marshal(), 2048)
+	if len(parts) != 1 || len(parts[0]) > 2048 {
+		t.Fatalf("Element should have been truncated: %d parts", len(parts))
+	}
+
+	msg, err := UnmarshalWSMessage(parts[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var n testElement
+	if err := msg.DecodeObj(&n); err != nil || n.Metadata["Name"] != "eth0" || n.Metadata["Routes"] != nil || !strings.Contains(msg.Error, "Routes") {
+		t.Errorf("Only the biggest metadata should be dropped: %+v, %s", n, msg.Error)
+	}
+}
+
+type testMessageHandler struct {
+	DefaultWSServerEventHandler
+	messages chan WSMessage
+}
+
+func (h *testMessageHandler) OnMessage(c *WSClient, m WSMessage) {
+	h.messages <- m
+}
+
+func TestWSSplitConnection(t *testing.T) {
+	s := &WSServer{
+		broadcast:      make(chan *wsBroadcast, 500),
+		quit:           make(chan bool, 1),
+		register:       make(chan *WSClient),
+		unregister:     make(chan *WSClient),
+		clients:        make(map[*WSClient]bool),
+		capabilities:   make(map[string]map[string]interface{}),
+		incarnations:   make(map[string]int64),
+		incarnated:     make(map[string]*WSClient),
+		pongWait:       5 * time.Second,
+		pingPeriod:     4 * time.Second,
+		maxMessageSize: 2048,
+		acks: &wsAcks{
+			queues:  make(map[string]*wsAckQueue),
+			timeout: 5 * time.Second,
+		},
+	}
+	handler := &testMessageHandler{messages: make(chan WSMessage, 1)}
+	s.AddEventHandler(handler)
+	go s.ListenAndServe()
+	defer s.Stop()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMessages(w, &auth.AuthenticatedRequest{Request: *r})
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// the parts sent by the client are reassembled by the server before
+	// being handled
+	for _, part := range splitWSMessage(newTestGraphMessage().Marshal(), 2048) {
+		if err := conn.WriteMessage(websocket.TextMessage, part); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	select {
+	case msg := <-handler.messages:
+		checkTestGraph(t, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reassembled message expected")
+	}
+
+	// the messages broadcasted by the server are split
+	s.BroadcastWSMessage(newTestGraphMessage())
+
+	var r wsReassembler
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(m) > 2048 {
+			t.Errorf("Part of %d bytes exceeds the maximum size", len(m))
+		}
+
+		if m, complete := r.add(m); complete {
+			msg, err := UnmarshalWSMessage(m)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			checkTestGraph(t, msg)
+			break
+		}
+	}
+}
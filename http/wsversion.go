@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version of the WSMessage envelope and of the objects it carries. The
+// readers accept the messages of their major version, ignoring the fields
+// they don't know, and reject the ones of another major version. A new field
+// bumps the minor version, a field changing or removed the major version.
+// The messages without version come from before the versioning, 1.0. The
+// version 1.1 adds the Revision of the graph events.
+const (
+	WSMessageMajorVersion = 1
+	WSMessageMinorVersion = 1
+)
+
+// WSMessageVersion is the version set on the emitted messages
+var WSMessageVersion = fmt.Sprintf("%d.%d", WSMessageMajorVersion, WSMessageMinorVersion)
+
+// WSVersionError is returned for the messages of an incompatible version
+type WSVersionError struct {
+	Version string
+}
+
+func (e *WSVersionError) Error() string {
+	return fmt.Sprintf("message version %s incompatible with the version %s, only the messages of major version %d are supported", e.Version, WSMessageVersion, WSMessageMajorVersion)
+}
+
+func parseWSMessageVersion(version string) (major int, minor int, err error) {
+	if version == "" {
+		return 1, 0, nil
+	}
+
+	fields := strings.Split(version, ".")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("malformed message version %s", version)
+	}
+
+	if major, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, 0, fmt.Errorf("malformed message version %s", version)
+	}
+	if minor, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, 0, fmt.Errorf("malformed message version %s", version)
+	}
+
+	return major, minor, nil
+}
+
+// CheckVersion returns a WSVersionError if the message is of another major
+// version, the messages of a newer minor version being accepted.
+func (g WSMessage) CheckVersion() error {
+	major, _, err := parseWSMessageVersion(g.Version)
+	if err != nil || major != WSMessageMajorVersion {
+		return &WSVersionError{Version: g.Version}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+)
+
+// messages of the WSServer namespace as emitted by the version 1.0, they
+// have to be parsed by the later versions
+var wsMessageFixtures = []struct {
+	namespace string
+	msgType   string
+	data      string
+}{
+	{"WSServer", "Hello", `{"Namespace":"WSServer","Type":"Hello","Obj":"host1"}`},
+	{"WSServer", "Hello", `{"Namespace":"WSServer","Type":"Hello","Obj":"host1","Version":"1.0","Capabilities":{"Incarnation":1476595200000000000,"ReadOnly":true,"SchemaVersion":"1.0"}}`},
+	{"WSServer", "AckSubscribe", `{"Namespace":"WSServer","Type":"AckSubscribe","Obj":null,"Version":"1.0"}`},
+	{"WSServer", "Ack", `{"Namespace":"WSServer","Type":"Ack","Obj":12,"Version":"1.0"}`},
+	{"WSServer", "GoingAway", `{"Namespace":"WSServer","Type":"GoingAway","Obj":{"ReconnectDelay":2500},"Version":"1.0"}`},
+	{"Graph", "NodeDeleted", `{"Namespace":"Graph","Type":"NodeDeleted","Obj":{"ID":"n1","Host":"host1"},"ID":3,"Seq":42,"Version":"1.0"}`},
+	{"Graph", "NodeUpdated", `{"Namespace":"Graph","Type":"NodeUpdated","Obj":{"ID":"n1","Host":"host1"},"Error":"truncated, fields dropped: Metadata.Routes","Version":"1.0"}`},
+}
+
+func TestWSMessageFixtures(t *testing.T) {
+	for _, f := range wsMessageFixtures {
+		msg, err := UnmarshalWSMessage([]byte(f.data))
+		if err != nil {
+			t.Errorf("Unable to parse the fixture %s: %s", f.data, err.Error())
+			continue
+		}
+
+		if msg.Namespace != f.namespace || msg.Type != f.msgType {
+			t.Errorf("Wrong namespace or type parsed from %s: %s %s", f.data, msg.Namespace, msg.Type)
+		}
+	}
+
+	if msg := mustUnmarshal(t, wsMessageFixtures[5].data); msg.ID != 3 || msg.Seq != 42 {
+		t.Errorf("Wrong acked fixture: %+v", msg)
+	}
+
+	if msg := mustUnmarshal(t, wsMessageFixtures[6].data); msg.Error == "" {
+		t.Errorf("Wrong truncated fixture: %+v", msg)
+	}
+
+	host, caps := parseHello(mustUnmarshal(t, wsMessageFixtures[1].data))
+	if host != "host1" || caps["ReadOnly"] != true || caps["SchemaVersion"] != "1.0" {
+		t.Errorf("Wrong Hello fixture: %s %v", host, caps)
+	}
+
+	var obj struct {
+		ReconnectDelay int64
+	}
+	if err := mustUnmarshal(t, wsMessageFixtures[4].data).DecodeObj(&obj); err != nil || obj.ReconnectDelay != 2500 {
+		t.Errorf("Wrong GoingAway fixture: %+v", obj)
+	}
+}
+
+func mustUnmarshal(t *testing.T, data string) WSMessage {
+	msg, err := UnmarshalWSMessage([]byte(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return msg
+}
+
+func TestWSMessageVersion(t *testing.T) {
+	if msg := mustUnmarshal(t, WSMessage{Namespace: "Test", Type: "Test"}.String()); msg.Version != WSMessageVersion {
+		t.Errorf("Messages should be emitted with the version %s, got: %s", WSMessageVersion, msg.Version)
+	}
+
+	// a newer minor version may add fields, ignored
+	msg := mustUnmarshal(t, `{"Namespace":"Test","Type":"Test","Obj":1,"Priority":3,"Version":"1.7"}`)
+	if msg.Obj != float64(1) {
+		t.Errorf("Wrong object of a newer minor version: %v", msg.Obj)
+	}
+
+	for _, version := range []string{"2.0", "0.9", "one", "1"} {
+		_, err := UnmarshalWSMessage([]byte(`{"Namespace":"Test","Type":"Test","Version":"` + version + `"}`))
+		if _, ok := err.(*WSVersionError); !ok {
+			t.Errorf("Version %s should be rejected with a version error, got: %v", version, err)
+		}
+	}
+}
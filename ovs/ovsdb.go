@@ -24,11 +24,16 @@ package ovsdb
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/socketplane/libovsdb"
 
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/faults"
 	"github.com/redhat-cip/skydive/logging"
 )
 
@@ -46,6 +51,9 @@ type OvsMonitorHandler interface {
 	OnOvsPortAdd(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
 	OnOvsPortDel(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
 	OnOvsPortUpdate(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
+	OnOvsControllerAdd(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
+	OnOvsControllerDel(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
+	OnOvsControllerUpdate(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate)
 }
 
 type OvsMonitor struct {
@@ -54,17 +62,38 @@ type OvsMonitor struct {
 	Port            int
 	OvsClient       *OvsClient
 	MonitorHandlers []OvsMonitorHandler
-	bridgeCache     map[string]string
-	interfaceCache  map[string]string
-	portCache       map[string]string
+	Heartbeat       *common.Heartbeat
+	// OnConnected is called each time the monitoring is (re)started
+	OnConnected       func()
+	ReconnectInterval time.Duration
+	// the server is probed every EchoInterval, not probed when zero, a
+	// request waiting for its reply keeping EchoHeartbeat busy, so that a
+	// stalled connection is detected even without update
+	EchoInterval  time.Duration
+	EchoHeartbeat *common.Heartbeat
+	// last rows received, by UUID
+	bridgeCache     map[string]libovsdb.Row
+	interfaceCache  map[string]libovsdb.Row
+	portCache       map[string]libovsdb.Row
+	controllerCache map[string]libovsdb.Row
+	stopped         int32
+	quit            chan bool
 }
 
 type Notifier struct {
 	monitor *OvsMonitor
+	// closed when the connection is lost
+	disconnected chan struct{}
 }
 
 func (n Notifier) Update(context interface{}, tableUpdates libovsdb.TableUpdates) {
+	defer common.RecoverAndPanic()
+
+	n.monitor.Heartbeat.Beat()
+	defer n.monitor.Heartbeat.Idle()
+
 	n.monitor.updateHandler(&tableUpdates)
+	n.monitor.Heartbeat.Updated()
 }
 
 func (n Notifier) Locked([]interface{}) {
@@ -77,10 +106,29 @@ func (n Notifier) Echo([]interface{}) {
 }
 
 func (n Notifier) Disconnected(*libovsdb.OvsdbClient) {
-	/* TODO(safchain) handle connection lost */
+	close(n.disconnected)
+	n.monitor.onDisconnected()
+}
+
+// isMutation returns whether one of the operations changes the database
+func isMutation(operations []libovsdb.Operation) bool {
+	for _, op := range operations {
+		switch op.Op {
+		case "select", "wait", "comment", "assert":
+		default:
+			return true
+		}
+	}
+	return false
 }
 
 func (o *OvsClient) Exec(operations ...libovsdb.Operation) ([]libovsdb.OperationResult, error) {
+	if isMutation(operations) {
+		if err := common.CheckHostChange("write to OVSDB"); err != nil {
+			return nil, err
+		}
+	}
+
 	result, err := o.ovsdb.Transact("Open_vSwitch", operations...)
 	if err != nil {
 		return nil, errors.New(
@@ -107,6 +155,8 @@ func (o *OvsClient) Exec(operations ...libovsdb.Operation) ([]libovsdb.Operation
 }
 
 func (o *OvsMonitor) bridgeUpdated(bridgeUUID string, row *libovsdb.RowUpdate) {
+	o.bridgeCache[bridgeUUID] = row.New
+
 	logging.GetLogger().Infof("Bridge \"%s(%s)\" updated",
 		row.New.Fields["name"], bridgeUUID)
 
@@ -116,7 +166,7 @@ func (o *OvsMonitor) bridgeUpdated(bridgeUUID string, row *libovsdb.RowUpdate) {
 }
 
 func (o *OvsMonitor) bridgeAdded(bridgeUUID string, row *libovsdb.RowUpdate) {
-	o.bridgeCache[bridgeUUID] = bridgeUUID
+	o.bridgeCache[bridgeUUID] = row.New
 
 	logging.GetLogger().Infof("New bridge \"%s(%s)\" added",
 		row.New.Fields["name"], bridgeUUID)
@@ -158,6 +208,8 @@ func (o *OvsMonitor) bridgeUpdateHandler(updates *libovsdb.TableUpdate) {
 }
 
 func (o *OvsMonitor) interfaceUpdated(interfaceUUID string, row *libovsdb.RowUpdate) {
+	o.interfaceCache[interfaceUUID] = row.New
+
 	logging.GetLogger().Infof("Interface \"%s(%s)\" updated",
 		row.New.Fields["name"], interfaceUUID)
 
@@ -167,7 +219,7 @@ func (o *OvsMonitor) interfaceUpdated(interfaceUUID string, row *libovsdb.RowUpd
 }
 
 func (o *OvsMonitor) interfaceAdded(interfaceUUID string, row *libovsdb.RowUpdate) {
-	o.interfaceCache[interfaceUUID] = interfaceUUID
+	o.interfaceCache[interfaceUUID] = row.New
 
 	logging.GetLogger().Infof("New interface \"%s(%s)\" added",
 		row.New.Fields["name"], interfaceUUID)
@@ -208,6 +260,8 @@ func (o *OvsMonitor) interfaceUpdateHandler(updates *libovsdb.TableUpdate) {
 }
 
 func (o *OvsMonitor) portUpdated(portUUID string, row *libovsdb.RowUpdate) {
+	o.portCache[portUUID] = row.New
+
 	logging.GetLogger().Infof("Port \"%s(%s)\" updated",
 		row.New.Fields["name"], portUUID)
 
@@ -217,7 +271,7 @@ func (o *OvsMonitor) portUpdated(portUUID string, row *libovsdb.RowUpdate) {
 }
 
 func (o *OvsMonitor) portAdded(portUUID string, row *libovsdb.RowUpdate) {
-	o.portCache[portUUID] = portUUID
+	o.portCache[portUUID] = row.New
 
 	logging.GetLogger().Infof("New port \"%s(%s)\" added",
 		row.New.Fields["name"], portUUID)
@@ -257,6 +311,58 @@ func (o *OvsMonitor) portUpdateHandler(updates *libovsdb.TableUpdate) {
 	}
 }
 
+func (o *OvsMonitor) controllerUpdated(controllerUUID string, row *libovsdb.RowUpdate) {
+	o.controllerCache[controllerUUID] = row.New
+
+	logging.GetLogger().Infof("Controller \"%s(%s)\" updated",
+		row.New.Fields["target"], controllerUUID)
+
+	for _, handler := range o.MonitorHandlers {
+		handler.OnOvsControllerUpdate(o, controllerUUID, row)
+	}
+}
+
+func (o *OvsMonitor) controllerAdded(controllerUUID string, row *libovsdb.RowUpdate) {
+	o.controllerCache[controllerUUID] = row.New
+
+	logging.GetLogger().Infof("New controller \"%s(%s)\" added",
+		row.New.Fields["target"], controllerUUID)
+
+	for _, handler := range o.MonitorHandlers {
+		handler.OnOvsControllerAdd(o, controllerUUID, row)
+	}
+}
+
+func (o *OvsMonitor) controllerDeleted(controllerUUID string, row *libovsdb.RowUpdate) {
+	delete(o.controllerCache, controllerUUID)
+
+	logging.GetLogger().Infof("Controller \"%s(%s)\" got deleted",
+		row.Old.Fields["target"], controllerUUID)
+
+	for _, handler := range o.MonitorHandlers {
+		handler.OnOvsControllerDel(o, controllerUUID, row)
+	}
+}
+
+func (o *OvsMonitor) controllerUpdateHandler(updates *libovsdb.TableUpdate) {
+	empty := libovsdb.Row{}
+
+	o.Lock()
+	defer o.Unlock()
+
+	for controllerUUID, row := range updates.Rows {
+		if !reflect.DeepEqual(row.New, empty) {
+			if _, ok := o.controllerCache[controllerUUID]; ok {
+				o.controllerUpdated(controllerUUID, &row)
+			} else {
+				o.controllerAdded(controllerUUID, &row)
+			}
+		} else {
+			o.controllerDeleted(controllerUUID, &row)
+		}
+	}
+}
+
 func (o *OvsMonitor) updateHandler(updates *libovsdb.TableUpdates) {
 	for name, tableUpdate := range updates.Updates {
 		switch name {
@@ -266,33 +372,75 @@ func (o *OvsMonitor) updateHandler(updates *libovsdb.TableUpdates) {
 			o.bridgeUpdateHandler(&tableUpdate)
 		case "Port":
 			o.portUpdateHandler(&tableUpdate)
+		case "Controller":
+			o.controllerUpdateHandler(&tableUpdate)
 		}
 	}
 }
 
-func (o *OvsMonitor) setMonitorRequests(table string, r *map[string]libovsdb.MonitorRequest) error {
-	schema, ok := o.OvsClient.ovsdb.Schema["Open_vSwitch"]
-	if !ok {
-		return errors.New("invalid Database Schema")
+// reconcile handles the initial dump of a monitoring, the rows cached but
+// not part of the dump, ie. deleted while disconnected, being reported as
+// deleted so that the caches only hold the rows of the dump afterwards.
+func (o *OvsMonitor) reconcile(updates *libovsdb.TableUpdates) {
+	o.Lock()
+	tables := []struct {
+		name    string
+		cache   map[string]libovsdb.Row
+		deleted func(uuid string, row *libovsdb.RowUpdate)
+	}{
+		{"Interface", o.interfaceCache, o.interfaceDeleted},
+		{"Port", o.portCache, o.portDeleted},
+		{"Bridge", o.bridgeCache, o.bridgeDeleted},
+		{"Controller", o.controllerCache, o.controllerDeleted},
+	}
+	for _, table := range tables {
+		rows := updates.Updates[table.name].Rows
+		for uuid, row := range table.cache {
+			if _, ok := rows[uuid]; !ok {
+				table.deleted(uuid, &libovsdb.RowUpdate{Uuid: libovsdb.UUID{GoUuid: uuid}, Old: row})
+			}
+		}
 	}
+	o.Unlock()
+
+	o.updateHandler(updates)
+}
+
+// monitoredTables are the tables of the Open_vSwitch database monitored
+var monitoredTables = []string{"Bridge", "Interface", "Port", "Controller"}
 
-	var columns []string
-	for column := range schema.Tables[table].Columns {
-		columns = append(columns, column)
+// monitorRequests returns the requests monitoring all the columns of the
+// monitored tables, the tables being looked up in the schema of the server
+func monitorRequests(ovsdb *libovsdb.OvsdbClient) (map[string]libovsdb.MonitorRequest, error) {
+	schema, ok := ovsdb.Schema["Open_vSwitch"]
+	if !ok {
+		return nil, errors.New("invalid Database Schema")
 	}
 
-	requests := *r
-	requests[table] = libovsdb.MonitorRequest{
-		Columns: columns,
-		Select: libovsdb.MonitorSelect{
-			Initial: true,
-			Insert:  true,
-			Delete:  true,
-			Modify:  true,
-		},
+	requests := make(map[string]libovsdb.MonitorRequest)
+	for _, table := range monitoredTables {
+		tableSchema, ok := schema.Tables[table]
+		if !ok {
+			return nil, fmt.Errorf("no %s table in the Open_vSwitch database", table)
+		}
+
+		var columns []string
+		for column := range tableSchema.Columns {
+			columns = append(columns, column)
+		}
+
+		requests[table] = libovsdb.MonitorRequest{
+			Columns: columns,
+			Select: libovsdb.MonitorSelect{
+				Initial: true,
+				Insert:  true,
+				Delete:  true,
+				Modify:  true,
+			},
+		}
 	}
 
-	return nil
+	return requests, nil
 }
 
 func (o *OvsMonitor) AddMonitorHandler(handler OvsMonitorHandler) {
@@ -309,36 +457,114 @@ func (o *OvsMonitor) StartMonitoring() error {
 	}
 	o.OvsClient = &OvsClient{ovsdb: ovsdb}
 
-	notifier := Notifier{monitor: o}
+	notifier := Notifier{monitor: o, disconnected: make(chan struct{})}
 	ovsdb.Register(notifier)
 
-	requests := make(map[string]libovsdb.MonitorRequest)
-	err = o.setMonitorRequests("Bridge", &requests)
+	requests, err := monitorRequests(ovsdb)
 	if err != nil {
 		return err
 	}
 
-	err = o.setMonitorRequests("Interface", &requests)
+	updates, err := ovsdb.Monitor("Open_vSwitch", "", requests)
 	if err != nil {
 		return err
 	}
 
-	err = o.setMonitorRequests("Port", &requests)
-	if err != nil {
-		return err
+	o.Heartbeat.Beat()
+	o.reconcile(updates)
+	o.Heartbeat.Updated()
+	o.Heartbeat.Idle()
+
+	if o.OnConnected != nil {
+		o.OnConnected()
 	}
 
-	updates, err := ovsdb.Monitor("Open_vSwitch", "", requests)
+	if o.EchoInterval > 0 {
+		go o.echo(func() error {
+			_, err := ovsdb.ListDbs()
+			return err
+		}, notifier.disconnected)
+	}
+
+	return nil
+}
+
+// echo sends a request to the server every EchoInterval until disconnected,
+// the heartbeat being busy until the reply comes.
+func (o *OvsMonitor) echo(request func() error, disconnected chan struct{}) {
+	ticker := time.NewTicker(o.EchoInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-disconnected:
+			return
+		case <-ticker.C:
+		}
+
+		o.EchoHeartbeat.Beat()
+		if err := request(); err != nil {
+			logging.GetLogger().Debugf("OVSDB %s:%d echo failed: %s", o.Addr, o.Port, err.Error())
+		}
+		o.EchoHeartbeat.Idle()
+	}
+}
+
+// Check connects to the OVSDB server and builds the monitor requests as the
+// monitoring does, so that an unreachable server or a missing table shows
+// up, the connection being closed right away.
+func (o *OvsMonitor) Check() error {
+	ovsdb, err := libovsdb.Connect(o.Addr, o.Port)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to connect to the OVSDB server %s:%d: %s", o.Addr, o.Port, err.Error())
 	}
+	defer ovsdb.Disconnect()
 
-	o.updateHandler(updates)
+	_, err = monitorRequests(ovsdb)
+	return err
+}
 
-	return nil
+// onDisconnected starts reconnecting unless the monitoring was stopped.
+// The current rows are sent again as updates on reconnection, the ones
+// deleted in the meantime as deletions.
+func (o *OvsMonitor) onDisconnected() {
+	if atomic.LoadInt32(&o.stopped) == 1 {
+		return
+	}
+
+	logging.GetLogger().Warningf("Disconnected from OVSDB %s:%d, reconnecting", o.Addr, o.Port)
+	go o.reconnect()
+}
+
+func (o *OvsMonitor) reconnect() {
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-time.After(o.ReconnectInterval):
+		}
+
+		err := faults.Error(faults.OvsdbReconnect)
+		if err == nil {
+			err = o.StartMonitoring()
+		}
+		if err != nil {
+			logging.GetLogger().Debugf("Unable to reconnect to OVSDB %s:%d: %s", o.Addr, o.Port, err.Error())
+			continue
+		}
+
+		logging.GetLogger().Infof("Reconnected to OVSDB %s:%d", o.Addr, o.Port)
+		return
+	}
 }
 
 func (o *OvsMonitor) StopMonitoring() {
+	if atomic.CompareAndSwapInt32(&o.stopped, 0, 1) {
+		close(o.quit)
+	}
+
 	if o.OvsClient != nil {
 		o.OvsClient.ovsdb.Disconnect()
 	}
@@ -346,10 +572,13 @@ func (o *OvsMonitor) StopMonitoring() {
 
 func NewOvsMonitor(addr string, port int) *OvsMonitor {
 	return &OvsMonitor{
-		Addr:           addr,
-		Port:           port,
-		bridgeCache:    make(map[string]string),
-		interfaceCache: make(map[string]string),
-		portCache:      make(map[string]string),
+		Addr:              addr,
+		Port:              port,
+		bridgeCache:       make(map[string]libovsdb.Row),
+		interfaceCache:    make(map[string]libovsdb.Row),
+		portCache:         make(map[string]libovsdb.Row),
+		controllerCache:   make(map[string]libovsdb.Row),
+		ReconnectInterval: 5 * time.Second,
+		quit:              make(chan bool),
 	}
 }
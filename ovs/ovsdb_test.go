@@ -23,9 +23,13 @@
 package ovsdb
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/common"
 )
 
 type FakeBridgeHandler struct {
@@ -65,6 +69,15 @@ func (b *FakeBridgeHandler) OnOvsPortAdd(monitor *OvsMonitor, uuid string, row *
 func (b *FakeBridgeHandler) OnOvsPortDel(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
 }
 
+func (b *FakeBridgeHandler) OnOvsControllerUpdate(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+}
+
+func (b *FakeBridgeHandler) OnOvsControllerAdd(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+}
+
+func (b *FakeBridgeHandler) OnOvsControllerDel(monitor *OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+}
+
 func NewFakeBridgeHandler() FakeBridgeHandler {
 	return FakeBridgeHandler{Added: false, Deleted: false}
 }
@@ -127,4 +140,113 @@ func TestBridgeDeleted(t *testing.T) {
 	}
 }
 
+func TestReconcileInitialDump(t *testing.T) {
+	monitor := NewOvsMonitor("127.0.0.1", 8888)
+
+	handler := NewFakeBridgeHandler()
+	monitor.AddMonitorHandler(&handler)
+
+	monitor.reconcile(getTableUpdates("bridge1", "add"))
+	if !handler.Added || handler.Deleted {
+		t.Fatal("Bridge of the initial dump should have been added")
+	}
+
+	// bridge1 deleted while disconnected, the dump after the reconnection
+	// only has bridge2
+	monitor.reconcile(getTableUpdates("bridge2", "add"))
+	if !handler.Deleted || handler.BridgeUUID != "bridge2-uuid" {
+		t.Errorf("Bridge missing from the new dump should have been deleted: %+v", handler)
+	}
+
+	if _, ok := monitor.bridgeCache["bridge1-uuid"]; ok || len(monitor.bridgeCache) != 1 {
+		t.Errorf("Cache should only hold the rows of the new dump: %v", monitor.bridgeCache)
+	}
+}
+
 /* TODO(safchain) Add UT for interface adding */
+
+func TestReadOnlyExec(t *testing.T) {
+	common.SetReadOnly(true)
+	defer common.SetReadOnly(false)
+
+	// no connection, the write has to be refused before any transaction
+	client := &OvsClient{}
+
+	update := libovsdb.Operation{Op: "update", Table: "Bridge", Row: map[string]interface{}{"sflow": ""}}
+	if _, err := client.Exec(update); err != common.ErrReadOnly {
+		t.Errorf("OVSDB write should be refused in read-only mode, got: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listening anymore, all the reconnection attempts fail
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	monitor := NewOvsMonitor("127.0.0.1", port)
+	monitor.ReconnectInterval = 10 * time.Millisecond
+
+	done := make(chan bool)
+	go func() {
+		monitor.reconnect()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Reconnection stopped while the monitoring is running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	monitor.StopMonitoring()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Reconnection should stop with the monitoring")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	monitor := NewOvsMonitor("127.0.0.1", 8888)
+	monitor.EchoInterval = time.Millisecond
+	monitor.EchoHeartbeat = common.NewHeartbeat("test/echo")
+	monitor.EchoHeartbeat.Idle()
+
+	requested, reply := make(chan bool), make(chan bool)
+	disconnected := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		monitor.echo(func() error {
+			requested <- true
+			<-reply
+			return nil
+		}, disconnected)
+		done <- true
+	}()
+
+	// the server not replying, the heartbeat stays busy
+	<-requested
+	time.Sleep(10 * time.Millisecond)
+	if monitor.EchoHeartbeat.IsIdle() {
+		t.Error("Heartbeat should be busy while waiting for the reply")
+	}
+
+	reply <- true
+	<-requested
+	close(disconnected)
+	reply <- true
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Echo should stop on disconnection")
+	}
+	if !monitor.EchoHeartbeat.IsIdle() {
+		t.Error("Heartbeat should be idle once replied")
+	}
+}
@@ -22,24 +22,113 @@
 
 package probe
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
 type Probe interface {
 	Start()
 	Stop()
 }
 
+// Pausable is implemented by the probes able to stop updating the graph for
+// a while, keeping their nodes, then to catch up with the missed changes
+// once resumed.
+type Pausable interface {
+	Pause()
+	Resume()
+	IsPaused() bool
+}
+
+// CheckResult is the result of the check of a prerequisite of a probe, the
+// hint telling how to fix the host when the check failed.
+type CheckResult struct {
+	Name  string
+	Error string `json:",omitempty"`
+	Hint  string `json:",omitempty"`
+}
+
+// Passed returns whether the prerequisite is met
+func (c CheckResult) Passed() bool {
+	return c.Error == ""
+}
+
+// NewCheckResult returns the result of the check of a prerequisite, the
+// hint being kept only if the check failed.
+func NewCheckResult(name string, err error, hint string) CheckResult {
+	if err == nil {
+		return CheckResult{Name: name}
+	}
+	return CheckResult{Name: name, Error: err.Error(), Hint: hint}
+}
+
+// Checker is implemented by the probes able to check, without changing
+// anything, that the host provides what they rely on, ie. a reachable
+// daemon, so that a misconfiguration shows up before the agent starts.
+// The checks use the code the probes connect with.
+type Checker interface {
+	Check() []CheckResult
+}
+
+// ProbeStatus is the state of a probe and the results of its last checks,
+// the probe being healthy if all of them passed.
+type ProbeStatus struct {
+	State   string
+	Healthy bool
+	Checks  []CheckResult `json:",omitempty"`
+}
+
 type ProbeBundle struct {
 	Probes map[string]Probe
+	// StartOrder lists the probes to be started first, in this order, the
+	// other ones being started afterwards by name.
+	StartOrder []string
+	checks     *checkResults
+}
+
+// checkResults are the results of the last self-test, shared by the copies
+// of the bundle
+type checkResults struct {
+	sync.RWMutex
+	results map[string][]CheckResult
+}
+
+// names returns the names of the probes in their start order.
+func (p *ProbeBundle) names() []string {
+	var names, others []string
+
+	ordered := make(map[string]bool)
+	for _, name := range p.StartOrder {
+		if _, ok := p.Probes[name]; ok && !ordered[name] {
+			ordered[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for name := range p.Probes {
+		if !ordered[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+
+	return append(names, others...)
 }
 
 func (p *ProbeBundle) Start() {
-	for _, p := range p.Probes {
-		p.Start()
+	for _, name := range p.names() {
+		p.Probes[name].Start()
 	}
 }
 
+// Stop stops the probes in the reverse of their start order, each probe
+// being stopped before the ones it relies on.
 func (p *ProbeBundle) Stop() {
-	for _, p := range p.Probes {
-		p.Stop()
+	names := p.names()
+	for i := len(names) - 1; i >= 0; i-- {
+		p.Probes[names[i]].Stop()
 	}
 }
 
@@ -50,8 +139,114 @@ func (p *ProbeBundle) GetProbe(k string) Probe {
 	return nil
 }
 
+func (p *ProbeBundle) pausable(name string) (Pausable, error) {
+	probe, ok := p.Probes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown probe %s", name)
+	}
+
+	pausable, ok := probe.(Pausable)
+	if !ok {
+		return nil, fmt.Errorf("Probe %s can't be paused", name)
+	}
+
+	return pausable, nil
+}
+
+func (p *ProbeBundle) Pause(name string) error {
+	pausable, err := p.pausable(name)
+	if err != nil {
+		return err
+	}
+
+	pausable.Pause()
+	return nil
+}
+
+func (p *ProbeBundle) Resume(name string) error {
+	pausable, err := p.pausable(name)
+	if err != nil {
+		return err
+	}
+
+	pausable.Resume()
+	return nil
+}
+
+// States returns the state of each probe, running or paused
+func (p *ProbeBundle) States() map[string]string {
+	states := make(map[string]string)
+	for name, probe := range p.Probes {
+		states[name] = "running"
+		if pausable, ok := probe.(Pausable); ok && pausable.IsPaused() {
+			states[name] = "paused"
+		}
+	}
+
+	return states
+}
+
+// Check runs the checks of each probe, the probes not implementing Checker
+// having no prerequisite.
+func (p *ProbeBundle) Check() map[string][]CheckResult {
+	results := make(map[string][]CheckResult)
+	for name, probe := range p.Probes {
+		results[name] = nil
+		if checker, ok := probe.(Checker); ok {
+			results[name] = checker.Check()
+		}
+	}
+
+	return results
+}
+
+// SelfTest runs the checks of each probe and keeps their results for the
+// status of the probes.
+func (p *ProbeBundle) SelfTest() map[string][]CheckResult {
+	results := p.Check()
+
+	p.checks.Lock()
+	p.checks.results = results
+	p.checks.Unlock()
+
+	return results
+}
+
+// Status returns the state of each probe along with the results of the
+// last self-test.
+func (p *ProbeBundle) Status() map[string]ProbeStatus {
+	p.checks.RLock()
+	defer p.checks.RUnlock()
+
+	status := make(map[string]ProbeStatus)
+	for name, state := range p.States() {
+		s := ProbeStatus{State: state, Healthy: true, Checks: p.checks.results[name]}
+		for _, c := range s.Checks {
+			if !c.Passed() {
+				s.Healthy = false
+			}
+		}
+		status[name] = s
+	}
+
+	return status
+}
+
+// Failed returns whether one of the checks failed
+func Failed(results map[string][]CheckResult) bool {
+	for _, checks := range results {
+		for _, c := range checks {
+			if !c.Passed() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func NewProbeBundle(p map[string]Probe) *ProbeBundle {
 	return &ProbeBundle{
 		Probes: p,
+		checks: &checkResults{},
 	}
 }
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probe
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type fakeProbe struct {
+	name    string
+	started *[]string
+	stopped *[]string
+}
+
+func (f *fakeProbe) Start() {
+	*f.started = append(*f.started, f.name)
+}
+
+func (f *fakeProbe) Stop() {
+	if f.stopped != nil {
+		*f.stopped = append(*f.stopped, f.name)
+	}
+}
+
+func TestProbeBundleStartOrder(t *testing.T) {
+	var started, stopped []string
+
+	probes := make(map[string]Probe)
+	for _, name := range []string{"docker", "netlink", "netns", "ovsdb"} {
+		probes[name] = &fakeProbe{name: name, started: &started, stopped: &stopped}
+	}
+
+	b := NewProbeBundle(probes)
+	b.StartOrder = []string{"ovsdb", "neutron", "netlink", "ovsdb"}
+	b.Start()
+
+	expected := []string{"ovsdb", "netlink", "docker", "netns"}
+	if !reflect.DeepEqual(started, expected) {
+		t.Errorf("Expected start order %v, got: %v", expected, started)
+	}
+
+	b.Stop()
+
+	expected = []string{"netns", "docker", "netlink", "ovsdb"}
+	if !reflect.DeepEqual(stopped, expected) {
+		t.Errorf("Expected stop order %v, got: %v", expected, stopped)
+	}
+}
+
+type fakePausableProbe struct {
+	fakeProbe
+	paused bool
+}
+
+func (f *fakePausableProbe) Pause() {
+	f.paused = true
+}
+
+func (f *fakePausableProbe) Resume() {
+	f.paused = false
+}
+
+func (f *fakePausableProbe) IsPaused() bool {
+	return f.paused
+}
+
+func TestProbeBundlePause(t *testing.T) {
+	b := NewProbeBundle(map[string]Probe{
+		"netlink": &fakePausableProbe{},
+		"docker":  &fakeProbe{},
+	})
+
+	if err := b.Pause("netlink"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Pause("docker"); err == nil {
+		t.Error("Expected an error for a probe which can't be paused")
+	}
+	if err := b.Pause("ovsdb"); err == nil {
+		t.Error("Expected an error for an unknown probe")
+	}
+
+	expected := map[string]string{"netlink": "paused", "docker": "running"}
+	if states := b.States(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected states %v, got: %v", expected, states)
+	}
+
+	b.Resume("netlink")
+	if b.States()["netlink"] != "running" {
+		t.Error("Probe should be running once resumed")
+	}
+}
+
+type fakeCheckedProbe struct {
+	fakeProbe
+	err error
+}
+
+func (f *fakeCheckedProbe) Check() []CheckResult {
+	return []CheckResult{NewCheckResult("socket", f.err, "start the daemon")}
+}
+
+func TestProbeBundleCheck(t *testing.T) {
+	err := errors.New("socket unreachable")
+
+	b := NewProbeBundle(map[string]Probe{
+		"netlink": &fakeCheckedProbe{},
+		"docker":  &fakeCheckedProbe{err: err},
+		"netns":   &fakeProbe{},
+	})
+
+	expected := map[string][]CheckResult{
+		"netlink": {{Name: "socket"}},
+		"docker":  {{Name: "socket", Error: "socket unreachable", Hint: "start the daemon"}},
+		"netns":   nil,
+	}
+	results := b.Check()
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected checks %v, got: %v", expected, results)
+	}
+	if !Failed(results) {
+		t.Error("Expected a failed check")
+	}
+}
+
+func TestProbeBundleStatus(t *testing.T) {
+	b := NewProbeBundle(map[string]Probe{
+		"netlink": &fakeCheckedProbe{},
+		"docker":  &fakeCheckedProbe{err: errors.New("socket unreachable")},
+	})
+
+	// no check run yet
+	if s := b.Status()["docker"]; !s.Healthy || s.State != "running" || len(s.Checks) != 0 {
+		t.Errorf("Wrong status before the self-test: %+v", s)
+	}
+
+	b.SelfTest()
+
+	status := b.Status()
+	if s := status["netlink"]; !s.Healthy || len(s.Checks) != 1 {
+		t.Errorf("Expected netlink healthy: %+v", s)
+	}
+	if s := status["docker"]; s.Healthy || len(s.Checks) != 1 || s.Checks[0].Passed() {
+		t.Errorf("Expected docker unhealthy: %+v", s)
+	}
+}
@@ -0,0 +1,103 @@
+#!/bin/bash
+#
+# Simulates the churn of the pods of a node: creates namespaces with a veth
+# pair each, then deletes them, while sampling the CPU usage of the agent.
+# Exits with an error if the average CPU usage exceeds the budget.
+#
+#   sudo scripts/netns-churn.sh -n 100 -b 50 -p $(pidof skydive)
+
+COUNT=100
+BUDGET=50
+PID=
+PREFIX=churn
+INTERVAL=1
+
+function usage() {
+    echo "Usage: $0 [-n namespaces] [-b cpu budget in %] [-p agent pid] [-i sampling interval]"
+    exit 1
+}
+
+while getopts "n:b:p:i:h" opt; do
+    case $opt in
+        n) COUNT=$OPTARG ;;
+        b) BUDGET=$OPTARG ;;
+        p) PID=$OPTARG ;;
+        i) INTERVAL=$OPTARG ;;
+        *) usage ;;
+    esac
+done
+
+if [ -z "$PID" ]; then
+    PID=$( pidof skydive | awk '{print $1}' )
+fi
+if [ -z "$PID" ] || [ ! -d /proc/$PID ]; then
+    echo "Agent not running, give its pid with -p"
+    exit 1
+fi
+
+TICKS=$( getconf CLK_TCK )
+
+# utime + stime of the agent in clock ticks
+function cpu_ticks() {
+    awk '{print $14 + $15}' /proc/$PID/stat
+}
+
+function sample() {
+    local prev=$( cpu_ticks )
+    while true; do
+        sleep $INTERVAL
+        local cur=$( cpu_ticks ) || break
+        echo $(( (cur - prev) * 100 / (TICKS * INTERVAL) ))
+        prev=$cur
+    done
+}
+
+function create() {
+    for i in $( seq 1 $COUNT ); do
+        ip netns add $PREFIX-$i
+        ip link add $PREFIX-$i-h type veth peer name eth0 netns $PREFIX-$i
+        ip link set $PREFIX-$i-h up
+        ip netns exec $PREFIX-$i ip link set eth0 up
+        ip netns exec $PREFIX-$i ip link set lo up
+    done
+}
+
+function delete() {
+    for i in $( seq 1 $COUNT ); do
+        ip netns del $PREFIX-$i 2>/dev/null
+    done
+}
+
+trap delete EXIT
+
+SAMPLES=$( mktemp )
+sample > $SAMPLES &
+SAMPLER=$!
+
+START=$( cpu_ticks )
+BEGIN=$( date +%s )
+
+echo "Creating $COUNT namespaces"
+create
+sleep 10
+
+echo "Deleting $COUNT namespaces"
+delete
+sleep 10
+
+END=$( cpu_ticks )
+ELAPSED=$(( $( date +%s ) - BEGIN ))
+
+kill $SAMPLER
+wait $SAMPLER 2>/dev/null
+
+PEAK=$( sort -n $SAMPLES | tail -1 )
+AVERAGE=$(( (END - START) * 100 / (TICKS * ELAPSED) ))
+rm -f $SAMPLES
+
+echo "Agent CPU usage over ${ELAPSED}s: average ${AVERAGE}%, peak ${PEAK}%, budget ${BUDGET}%"
+
+if [ $AVERAGE -gt $BUDGET ]; then
+    echo "CPU budget exceeded"
+    exit 1
+fi
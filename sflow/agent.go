@@ -31,14 +31,15 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
 	"github.com/redhat-cip/skydive/analyzer"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/flow/mappings"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
 )
 
 const (
@@ -57,10 +58,16 @@ type SFlowAgent struct {
 	flowTable           *flow.Table
 	FlowMappingPipeline *mappings.FlowMappingPipeline
 	FlowProbePathSetter flow.FlowProbePathSetter
+	PortMapper          *OvsPortMapper
 	running             atomic.Value
 	wg                  sync.WaitGroup
 	flush               chan bool
 	flushDone           chan bool
+	checksums           bool
+	sources             *sourceGuard
+	quarantine          *common.Quarantine
+	sampleBudget        *flow.SampleBudget
+	counters            flow.CaptureCounters
 }
 
 type SFlowAgentAllocator struct {
@@ -68,6 +75,7 @@ type SFlowAgentAllocator struct {
 	AnalyzerClient      *analyzer.Client
 	FlowMappingPipeline *mappings.FlowMappingPipeline
 	FlowProbePathSetter flow.FlowProbePathSetter
+	Graph               *graph.Graph
 	Addr                string
 	MinPort             int
 	MaxPort             int
@@ -81,27 +89,58 @@ func (sfa *SFlowAgent) GetTarget() string {
 
 func (sfa *SFlowAgent) feedFlowTable(conn *net.UDPConn) {
 	var buf [maxDgramSize]byte
-	_, _, err := conn.ReadFromUDP(buf[:])
+	n, addr, err := conn.ReadFromUDP(buf[:])
 	if err != nil {
 		conn.SetDeadline(time.Now().Add(1 * time.Second))
 		return
 	}
 
-	p := gopacket.NewPacket(buf[:], layers.LayerTypeSFlow, gopacket.Default)
-	sflowLayer := p.Layer(layers.LayerTypeSFlow)
-	sflowPacket, ok := sflowLayer.(*layers.SFlowDatagram)
-	if !ok {
+	source := addr.IP.String()
+	if !sfa.sources.allowed(source) {
 		return
 	}
 
+	sflowPacket, err := decodeDatagram(buf[:n], sfa.checksums)
+	if err != nil {
+		logging.GetLogger().Debugf("Malformed sFlow datagram from %s: %s", source, err.Error())
+
+		sfa.quarantine.Add(source, err.Error(), buf[:n])
+		if sfa.sources.rejected(source, err) {
+			logging.GetLogger().Warningf("Too many malformed sFlow datagrams from %s, blocked for %s", source, sfa.sources.BlockDuration)
+		}
+		return
+	}
+	sfa.sources.accepted(source)
+
 	if sflowPacket.SampleCount > 0 {
 		for _, sample := range sflowPacket.FlowSamples {
-			flows := flow.FlowsFromSFlowSample(sfa.flowTable, &sample, sfa.FlowProbePathSetter)
+			sfa.count(&sample)
+
+			var resolver flow.SFlowPortResolver
+			if sfa.PortMapper != nil {
+				resolver = sfa.PortMapper
+			}
+
+			flows := flow.FlowsFromSFlowSampleWithPorts(sfa.flowTable, &sample, sfa.FlowProbePathSetter, resolver)
 			logging.GetLogger().Debugf("%d flows captured", len(flows))
 		}
 	}
 }
 
+// count counts a sample, with the length of the frame it was taken from,
+// the drops being the counter of the sFlow agent of the bridge
+func (sfa *SFlowAgent) count(sample *layers.SFlowFlowSample) {
+	var length uint32
+	for _, record := range sample.Records {
+		if raw, ok := record.(layers.SFlowRawPacketFlowRecord); ok {
+			length = raw.FrameLength
+			break
+		}
+	}
+	sfa.counters.Add(int(length))
+	sfa.counters.SetDrops(int64(sample.Dropped))
+}
+
 func (sfa *SFlowAgent) asyncFlowPipeline(flows []*flow.Flow) {
 	if sfa.FlowMappingPipeline != nil {
 		sfa.FlowMappingPipeline.Enhance(flows)
@@ -112,6 +151,8 @@ func (sfa *SFlowAgent) asyncFlowPipeline(flows []*flow.Flow) {
 }
 
 func (sfa *SFlowAgent) start() error {
+	defer common.RecoverAndPanic()
+
 	addr := net.UDPAddr{
 		Port: sfa.Port,
 		IP:   net.ParseIP(sfa.Addr),
@@ -129,7 +170,11 @@ func (sfa *SFlowAgent) start() error {
 
 	sfa.running.Store(true)
 
+	common.RegisterQuarantine(sfa.quarantine)
+	defer common.UnregisterQuarantine(sfa.quarantine)
+
 	sfa.flowTable = flow.NewTable()
+	sfa.flowTable.SetSampleBudget(sfa.sampleBudget)
 	defer sfa.flowTable.UnregisterAll()
 
 	agentExpire := config.GetAgentExpire()
@@ -176,7 +221,30 @@ func (sfa *SFlowAgent) SetFlowProbePathSetter(p flow.FlowProbePathSetter) {
 	sfa.FlowProbePathSetter = p
 }
 
+// SetSampleBudget sets the budget of the samples decoded per flow, to be
+// called before the agent starts
+func (sfa *SFlowAgent) SetSampleBudget(b *flow.SampleBudget) {
+	sfa.sampleBudget = b
+}
+
+// SamplingStats returns the effect of the fairness of the agent, nil
+// without fairness
+func (sfa *SFlowAgent) SamplingStats() *flow.SamplingStats {
+	if sfa.sampleBudget == nil {
+		return nil
+	}
+	return sfa.sampleBudget.Stats()
+}
+
+// CaptureStats returns the samples counted by the agent and the flows of
+// its table
+func (sfa *SFlowAgent) CaptureStats() *flow.CaptureStats {
+	return sfa.counters.Stats(sfa.flowTable)
+}
+
 func NewSFlowAgent(u string, a string, p int, c *analyzer.Client, m *mappings.FlowMappingPipeline) *SFlowAgent {
+	cfg := config.GetConfig()
+
 	return &SFlowAgent{
 		UUID:                u,
 		Addr:                a,
@@ -185,6 +253,12 @@ func NewSFlowAgent(u string, a string, p int, c *analyzer.Client, m *mappings.Fl
 		FlowMappingPipeline: m,
 		flush:               make(chan bool),
 		flushDone:           make(chan bool),
+		checksums:           cfg.GetBool("sflow.validation.checksums"),
+		sources: newSourceGuard(
+			cfg.GetInt("sflow.validation.max_malformed"),
+			time.Duration(cfg.GetInt("sflow.validation.block_duration"))*time.Second,
+		),
+		quarantine: common.NewQuarantine("sflow/"+u, cfg.GetInt("sflow.validation.quarantine_size")),
 	}
 }
 
@@ -210,6 +284,19 @@ func (a *SFlowAgentAllocator) Agents() []*SFlowAgent {
 	return agents
 }
 
+// Agent returns the agent allocated for a bridge, nil if none
+func (a *SFlowAgentAllocator) Agent(uuid string) *SFlowAgent {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, agent := range a.allocated {
+		if uuid == agent.UUID {
+			return agent
+		}
+	}
+	return nil
+}
+
 func (a *SFlowAgentAllocator) Release(uuid string) {
 	a.Lock()
 	defer a.Unlock()
@@ -234,7 +321,9 @@ func (a *SFlowAgentAllocator) ReleaseAll() {
 	}
 }
 
-func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter) (*SFlowAgent, error) {
+// Alloc allocates an agent for a bridge, its samples being decoded within
+// the budget if given, the agent already allocated being returned as is
+func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter, b *flow.SampleBudget) (*SFlowAgent, error) {
 	address := config.GetConfig().GetString("sflow.bind_address")
 	if address == "" {
 		address = "127.0.0.1"
@@ -264,6 +353,10 @@ func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter) (*S
 		if _, ok := a.allocated[i]; !ok {
 			s := NewSFlowAgent(uuid, address, i, a.AnalyzerClient, a.FlowMappingPipeline)
 			s.SetFlowProbePathSetter(p)
+			s.SetSampleBudget(b)
+			if a.Graph != nil {
+				s.PortMapper = NewOvsPortMapper(a.Graph, uuid)
+			}
 
 			a.allocated[i] = s
 
@@ -276,10 +369,37 @@ func (a *SFlowAgentAllocator) Alloc(uuid string, p flow.FlowProbePathSetter) (*S
 	return nil, errors.New("sflow port exhausted")
 }
 
-func NewSFlowAgentAllocator(a *analyzer.Client, m *mappings.FlowMappingPipeline) *SFlowAgentAllocator {
-	return &SFlowAgentAllocator{
+// PortMetrics returns the number of samples attributed to an interface
+// through their ports, per agent.
+func (a *SFlowAgentAllocator) PortMetrics() interface{} {
+	stats := make(map[string]SFlowPortStats)
+	for _, agent := range a.Agents() {
+		if agent.PortMapper != nil {
+			stats[agent.UUID] = agent.PortMapper.Stats()
+		}
+	}
+	return stats
+}
+
+// SourceMetrics returns the number of accepted and malformed datagrams per
+// source address, per agent.
+func (a *SFlowAgentAllocator) SourceMetrics() interface{} {
+	stats := make(map[string]map[string]SFlowSourceStats)
+	for _, agent := range a.Agents() {
+		stats[agent.UUID] = agent.sources.Stats()
+	}
+	return stats
+}
+
+func NewSFlowAgentAllocator(a *analyzer.Client, m *mappings.FlowMappingPipeline, g *graph.Graph) *SFlowAgentAllocator {
+	allocator := &SFlowAgentAllocator{
 		AnalyzerClient:      a,
 		FlowMappingPipeline: m,
+		Graph:               g,
 		allocated:           make(map[int]*SFlowAgent),
 	}
+	common.RegisterMetrics("sflow_ports", allocator.PortMetrics)
+	common.RegisterMetrics("sflow_sources", allocator.SourceMetrics)
+
+	return allocator
 }
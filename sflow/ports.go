@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"bufio"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const (
+	// sFlow interface values not being a port, ie. internal, discarded or
+	// sent to multiple ports
+	sflowInternalPort = 0x3FFFFFFF
+	sflowPortFormat   = 0xC0000000
+
+	portsRefreshInterval = 5 * time.Second
+	portsMaxAge          = time.Minute
+)
+
+type SFlowPortStats struct {
+	Attributed   int64
+	Unattributed int64
+}
+
+// OvsPortMapper resolves the ports of the sFlow samples sent by OVS, which
+// are datapath port numbers, to the interfaces of the bridge. Datapath ports
+// are mapped to OpenFlow ports through the datapath listing, then to the
+// interfaces through the OfPort metadata set from the ovsdb Interface table.
+// Without datapath listing the ports are taken as OpenFlow ports.
+type OvsPortMapper struct {
+	sync.Mutex
+	Graph      *graph.Graph
+	BridgeUUID string
+	// DatapathPorts returns the OpenFlow port of the datapath ports, per
+	// bridge name
+	DatapathPorts func() (map[string]map[int64]int64, error)
+	Clock         common.Clock
+	paths         map[uint32]string
+	refreshed     time.Time
+	stats         SFlowPortStats
+}
+
+// parseDpifShow parses the output of ovs-appctl dpif/show, ie.
+//
+//	system@ovs-system: hit:12 missed:4
+//	  br0:
+//	    br0 65534/1: (internal)
+//	    eth1 1/2: (system)
+func parseDpifShow(output string) map[string]map[int64]int64 {
+	bridges := make(map[string]map[int64]int64)
+
+	var ports map[int64]int64
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+
+		switch {
+		case strings.HasPrefix(line, "    ") && len(fields) >= 2 && ports != nil:
+			numbers := strings.SplitN(strings.TrimSuffix(fields[1], ":"), "/", 2)
+			if len(numbers) != 2 {
+				continue
+			}
+
+			ofport, err1 := strconv.ParseInt(numbers[0], 10, 64)
+			dpport, err2 := strconv.ParseInt(numbers[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			ports[dpport] = ofport
+		case strings.HasPrefix(line, "  ") && len(fields) == 1 && strings.HasSuffix(fields[0], ":"):
+			ports = make(map[int64]int64)
+			bridges[strings.TrimSuffix(fields[0], ":")] = ports
+		}
+	}
+
+	return bridges
+}
+
+func ovsDatapathPorts() (map[string]map[int64]int64, error) {
+	output, err := exec.Command("ovs-appctl", "dpif/show").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseDpifShow(string(output)), nil
+}
+
+// interfacePath returns the path of the interface, the one of the interface
+// having the same MAC if the OVS interface is not owned by the host, ie.
+// moved to a namespace.
+func (m *OvsPortMapper) interfacePath(intf *graph.Node) string {
+	if path := topology.GraphPath(m.Graph, intf); path != "" {
+		return path
+	}
+
+	if mac, ok := intf.Metadata()["MAC"]; ok {
+		for _, n := range m.Graph.LookupNodes(graph.Metadata{"MAC": mac}) {
+			if path := topology.GraphPath(m.Graph, n); path != "" {
+				return path
+			}
+		}
+	}
+
+	return ""
+}
+
+func (m *OvsPortMapper) refresh() {
+	m.refreshed = m.Clock.Now()
+	m.paths = make(map[uint32]string)
+
+	var dpports map[string]map[int64]int64
+	if m.DatapathPorts != nil {
+		var err error
+		if dpports, err = m.DatapathPorts(); err != nil {
+			logging.GetLogger().Debugf("Unable to list the datapath ports, using OpenFlow ports: %s", err.Error())
+		}
+	}
+
+	m.Graph.RLock()
+	defer m.Graph.RUnlock()
+
+	bridge := m.Graph.LookupFirstNode(graph.Metadata{"UUID": m.BridgeUUID, "Type": topology.OvsBridgeType})
+	if bridge == nil {
+		return
+	}
+	name, _ := bridge.Metadata()["Name"].(string)
+
+	ofpaths := make(map[int64]string)
+	for _, port := range m.Graph.LookupChildren(bridge, graph.Metadata{"Type": topology.OvsPortType}) {
+		for _, intf := range m.Graph.LookupChildren(port, graph.Metadata{}) {
+			// set by the ovsdb probe of the agent
+			if ofport, ok := intf.Metadata()["OfPort"].(int64); ok {
+				if path := m.interfacePath(intf); path != "" {
+					ofpaths[ofport] = path
+				}
+			}
+		}
+	}
+
+	if ports, ok := dpports[name]; ok {
+		for dpport, ofport := range ports {
+			if path, ok := ofpaths[ofport]; ok {
+				m.paths[uint32(dpport)] = path
+			}
+		}
+		return
+	}
+
+	for ofport, path := range ofpaths {
+		m.paths[uint32(ofport)] = path
+	}
+}
+
+// resolve returns the path of the port, the mapping being refreshed when
+// too old or when the port is unknown, at most every refresh interval.
+func (m *OvsPortMapper) resolve(port uint32) string {
+	if port == sflowInternalPort || port&sflowPortFormat != 0 {
+		return ""
+	}
+
+	now := m.Clock.Now()
+	if m.paths == nil || now.Sub(m.refreshed) > portsMaxAge {
+		m.refresh()
+	}
+
+	path, ok := m.paths[port]
+	if !ok && now.Sub(m.refreshed) > portsRefreshInterval {
+		m.refresh()
+		path = m.paths[port]
+	}
+
+	return path
+}
+
+// ResolvePorts implements flow.SFlowPortResolver, samples whose ports can't
+// be resolved are counted as unattributed, their flows being attributed to
+// the interfaces through their MAC addresses.
+func (m *OvsPortMapper) ResolvePorts(input uint32, output uint32) (string, string) {
+	m.Lock()
+	defer m.Unlock()
+
+	in, out := m.resolve(input), m.resolve(output)
+	if in == "" && out == "" {
+		m.stats.Unattributed++
+	} else {
+		m.stats.Attributed++
+	}
+
+	return in, out
+}
+
+func (m *OvsPortMapper) Stats() SFlowPortStats {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.stats
+}
+
+func NewOvsPortMapper(g *graph.Graph, bridgeUUID string) *OvsPortMapper {
+	return &OvsPortMapper{
+		Graph:         g,
+		BridgeUUID:    bridgeUUID,
+		DatapathPorts: ovsDatapathPorts,
+		Clock:         common.RealClock{},
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const dpifShow = `system@ovs-system: hit:12 missed:4
+  br-sflow:
+    br-sflow 65534/1: (internal)
+    sflow-intf1 1/3: (internal)
+    sflow-intf2 2/4: (internal)
+  br-int:
+    br-int 65534/2: (internal)
+`
+
+func TestParseDpifShow(t *testing.T) {
+	bridges := parseDpifShow(dpifShow)
+
+	if len(bridges) != 2 || len(bridges["br-sflow"]) != 3 || len(bridges["br-int"]) != 1 {
+		t.Fatalf("Wrong bridges: %v", bridges)
+	}
+
+	if bridges["br-sflow"][3] != 1 || bridges["br-sflow"][1] != 65534 {
+		t.Errorf("Wrong datapath ports: %v", bridges["br-sflow"])
+	}
+}
+
+func newTestBridgeGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	bridge := g.NewNode(graph.GenID(), graph.Metadata{"Name": "br-sflow", "UUID": "br-uuid", "Type": "ovsbridge"})
+	g.Link(host, bridge, graph.Metadata{"RelationType": "ownership"})
+
+	for i, name := range []string{"sflow-intf1", "sflow-intf2"} {
+		port := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "ovsport"})
+		g.Link(bridge, port, graph.Metadata{"RelationType": "layer2"})
+
+		intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "internal", "OfPort": int64(i + 1)})
+		g.Link(port, intf, graph.Metadata{"RelationType": "layer2"})
+		g.Link(host, intf, graph.Metadata{"RelationType": "ownership"})
+	}
+
+	return g
+}
+
+func TestOvsPortMapper(t *testing.T) {
+	g := newTestBridgeGraph(t)
+
+	m := NewOvsPortMapper(g, "br-uuid")
+	m.Clock = common.NewFakeClock(time.Now())
+	m.DatapathPorts = func() (map[string]map[int64]int64, error) {
+		return parseDpifShow(dpifShow), nil
+	}
+
+	// datapath ports 3 and 4 are the OpenFlow ports 1 and 2
+	in, out := m.ResolvePorts(3, 4)
+	if in != "host1[Type=host]/sflow-intf1[Type=internal]" || out != "host1[Type=host]/sflow-intf2[Type=internal]" {
+		t.Errorf("Wrong interfaces: %s, %s", in, out)
+	}
+
+	// multiple output ports
+	if in, out = m.ResolvePorts(4, 0x80000002); in != "host1[Type=host]/sflow-intf2[Type=internal]" || out != "" {
+		t.Errorf("Wrong interfaces: %s, %s", in, out)
+	}
+
+	if in, out = m.ResolvePorts(7, sflowInternalPort); in != "" || out != "" {
+		t.Errorf("Unknown ports shouldn't be resolved: %s, %s", in, out)
+	}
+
+	if stats := m.Stats(); stats.Attributed != 2 || stats.Unattributed != 1 {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+
+	// without datapath listing the ports are OpenFlow ports
+	m = NewOvsPortMapper(g, "br-uuid")
+	m.DatapathPorts = func() (map[string]map[int64]int64, error) {
+		return nil, errors.New("ovs-appctl not found")
+	}
+
+	if in, _ = m.ResolvePorts(1, 0); in != "host1[Type=host]/sflow-intf1[Type=internal]" {
+		t.Errorf("Wrong interface: %s", in)
+	}
+}
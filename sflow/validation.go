@@ -0,0 +1,449 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+// sFlow version 5 layout, see http://sflow.org/sflow_version_5.txt
+const (
+	sflowVersion5         = 5
+	sflowAddressIPv4      = 1
+	sflowAddressIPv6      = 2
+	sflowRawPacketHeader  = 1
+	maxTrackedSources     = 1024
+	malformedCountsWindow = time.Minute
+)
+
+// sample header words preceding the record count, per sample type
+var sflowSampleHeaderWords = map[uint32]int{
+	uint32(layers.SFlowTypeFlowSample):            7,
+	uint32(layers.SFlowTypeCounterSample):         2,
+	uint32(layers.SFlowTypeExpandedFlowSample):    10,
+	uint32(layers.SFlowTypeExpandedCounterSample): 3,
+}
+
+type xdrReader struct {
+	data []byte
+}
+
+func (r *xdrReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errors.New("truncated")
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *xdrReader) skip(n uint32) error {
+	if uint64(n) > uint64(len(r.data)) {
+		return errors.New("truncated")
+	}
+	r.data = r.data[n:]
+	return nil
+}
+
+// next returns the next block of the given length, the blocks being
+// padded to 4 bytes
+func (r *xdrReader) next(what string) (uint32, *xdrReader, error) {
+	format, err := r.uint32()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s header truncated", what)
+	}
+	length, err := r.uint32()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s header truncated", what)
+	}
+	if length%4 != 0 {
+		return 0, nil, fmt.Errorf("%s length %d not aligned", what, length)
+	}
+	if uint64(length) > uint64(len(r.data)) {
+		return 0, nil, fmt.Errorf("%s length %d exceeds the %d remaining bytes", what, length, len(r.data))
+	}
+
+	block := &xdrReader{data: r.data[:length]}
+	r.data = r.data[length:]
+	return format, block, nil
+}
+
+// count reads a number of elements, each one taking at least size bytes
+func (r *xdrReader) count(what string, size int) (uint32, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return 0, fmt.Errorf("%s count truncated", what)
+	}
+	if uint64(n)*uint64(size) > uint64(len(r.data)) {
+		return 0, fmt.Errorf("%d %s exceed the %d remaining bytes", n, what, len(r.data))
+	}
+	return n, nil
+}
+
+func validateRawPacketHeader(r *xdrReader) error {
+	length := uint32(len(r.data))
+	if length < 16 {
+		return fmt.Errorf("raw packet header record too short: %d", length)
+	}
+
+	r.skip(12)
+	headerLength, _ := r.uint32()
+	if padded := uint64(headerLength+3) &^ 3; padded != uint64(length-16) {
+		return fmt.Errorf("raw packet header length %d doesn't match the record length %d", headerLength, length)
+	}
+	return nil
+}
+
+func validateSample(format uint32, r *xdrReader) error {
+	words, ok := sflowSampleHeaderWords[format]
+	if !ok {
+		// unknown samples are skipped by the decoder
+		return nil
+	}
+
+	if err := r.skip(uint32(words * 4)); err != nil {
+		return fmt.Errorf("sample type %d header truncated", format)
+	}
+
+	flowSample := format == uint32(layers.SFlowTypeFlowSample) || format == uint32(layers.SFlowTypeExpandedFlowSample)
+
+	records, err := r.count("records", 8)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < records; i++ {
+		recordFormat, record, err := r.next("record")
+		if err != nil {
+			return err
+		}
+
+		if flowSample && recordFormat == sflowRawPacketHeader {
+			if err := validateRawPacketHeader(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(r.data) != 0 {
+		return fmt.Errorf("%d bytes left after the records of a sample type %d", len(r.data), format)
+	}
+	return nil
+}
+
+// validateDatagram checks the sFlow datagram header and the bounds of every
+// sample and record before handing it to the decoder.
+func validateDatagram(data []byte) error {
+	r := &xdrReader{data: data}
+
+	version, err := r.uint32()
+	if err != nil {
+		return errors.New("datagram header truncated")
+	}
+	if version != sflowVersion5 {
+		return fmt.Errorf("unsupported sFlow version %d", version)
+	}
+
+	addressType, err := r.uint32()
+	if err != nil {
+		return errors.New("datagram header truncated")
+	}
+	switch addressType {
+	case sflowAddressIPv4:
+		err = r.skip(4)
+	case sflowAddressIPv6:
+		err = r.skip(16)
+	default:
+		return fmt.Errorf("unknown agent address type %d", addressType)
+	}
+	// sub agent, sequence number and uptime
+	if err == nil {
+		err = r.skip(12)
+	}
+	if err != nil {
+		return errors.New("datagram header truncated")
+	}
+
+	samples, err := r.count("samples", 8)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < samples; i++ {
+		format, sample, err := r.next("sample")
+		if err != nil {
+			return err
+		}
+
+		// enterprise samples are skipped by the decoder
+		if format>>12 == 0 {
+			if err := validateSample(format&0xfff, sample); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(r.data) != 0 {
+		return fmt.Errorf("%d trailing bytes after the samples", len(r.data))
+	}
+	return nil
+}
+
+func checksum(data []byte, sum uint32) uint16 {
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeaderSum(src []byte, dst []byte, proto layers.IPProtocol, length int) uint32 {
+	var sum uint32
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(addr); i += 2 {
+			sum += uint32(addr[i])<<8 | uint32(addr[i+1])
+		}
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+func verifyTransportChecksum(proto layers.IPProtocol, segment []byte, pseudo uint32) error {
+	switch proto {
+	case layers.IPProtocolTCP:
+		if len(segment) < 20 {
+			return nil
+		}
+	case layers.IPProtocolUDP:
+		if len(segment) < 8 || binary.BigEndian.Uint16(segment[6:8]) == 0 {
+			// no checksum
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if checksum(segment, pseudo) != 0 {
+		return fmt.Errorf("bad %s checksum", proto)
+	}
+	return nil
+}
+
+// verifyChecksums checks the IPv4 header checksum of a sampled packet and
+// its TCP or UDP checksum when the whole packet was sampled.
+func verifyChecksums(record *layers.SFlowRawPacketFlowRecord) error {
+	if record.Header == nil {
+		return nil
+	}
+	complete := uint64(record.HeaderLength)+uint64(record.PayloadRemoved) >= uint64(record.FrameLength)
+
+	if layer := record.Header.Layer(layers.LayerTypeIPv4); layer != nil {
+		ip := layer.(*layers.IPv4)
+		if checksum(ip.Contents, 0) != 0 {
+			return errors.New("bad IPv4 header checksum")
+		}
+
+		fragment := ip.FragOffset != 0 || ip.Flags&layers.IPv4MoreFragments != 0
+		if complete && !fragment && len(ip.Payload) == int(ip.Length)-len(ip.Contents) {
+			pseudo := pseudoHeaderSum(ip.SrcIP, ip.DstIP, ip.Protocol, len(ip.Payload))
+			return verifyTransportChecksum(ip.Protocol, ip.Payload, pseudo)
+		}
+	} else if layer := record.Header.Layer(layers.LayerTypeIPv6); layer != nil {
+		ip := layer.(*layers.IPv6)
+		if complete && len(ip.Payload) == int(ip.Length) {
+			pseudo := pseudoHeaderSum(ip.SrcIP, ip.DstIP, ip.NextHeader, len(ip.Payload))
+			return verifyTransportChecksum(ip.NextHeader, ip.Payload, pseudo)
+		}
+	}
+
+	return nil
+}
+
+// SFlowSourceStats are the datagrams received from an address
+type SFlowSourceStats struct {
+	Accepted     int64
+	Malformed    int64
+	Dropped      int64
+	LastError    string `json:",omitempty"`
+	BlockedUntil int64  `json:",omitempty"`
+}
+
+type sflowSource struct {
+	stats        SFlowSourceStats
+	lastSeen     time.Time
+	window       time.Time
+	windowCount  int
+	blockedUntil time.Time
+}
+
+// sourceGuard counts the malformed datagrams per source address, the
+// sources sending more than MaxMalformed of them within a minute being
+// blocked for BlockDuration, their datagrams being dropped unprocessed.
+type sourceGuard struct {
+	sync.RWMutex
+	MaxMalformed  int
+	BlockDuration time.Duration
+	Clock         common.Clock
+	sources       map[string]*sflowSource
+}
+
+func (g *sourceGuard) source(addr string, now time.Time) *sflowSource {
+	s, ok := g.sources[addr]
+	if !ok {
+		if len(g.sources) >= maxTrackedSources {
+			g.evict(now)
+		}
+		s = &sflowSource{window: now}
+		g.sources[addr] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// evict forgets the least recently seen source not blocked
+func (g *sourceGuard) evict(now time.Time) {
+	var oldest string
+	for addr, s := range g.sources {
+		if now.Before(s.blockedUntil) {
+			continue
+		}
+		if oldest == "" || s.lastSeen.Before(g.sources[oldest].lastSeen) {
+			oldest = addr
+		}
+	}
+	delete(g.sources, oldest)
+}
+
+// allowed returns whether the datagrams of the source are processed
+func (g *sourceGuard) allowed(addr string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	s := g.source(addr, now)
+	if now.Before(s.blockedUntil) {
+		s.stats.Dropped++
+		return false
+	}
+	return true
+}
+
+func (g *sourceGuard) accepted(addr string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.source(addr, g.Clock.Now()).stats.Accepted++
+}
+
+// rejected counts a malformed datagram, returns true if the source just
+// got blocked
+func (g *sourceGuard) rejected(addr string, err error) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	s := g.source(addr, now)
+	s.stats.Malformed++
+	s.stats.LastError = err.Error()
+
+	if now.Sub(s.window) >= malformedCountsWindow {
+		s.window, s.windowCount = now, 0
+	}
+	s.windowCount++
+
+	if g.MaxMalformed > 0 && s.windowCount > g.MaxMalformed {
+		s.blockedUntil = now.Add(g.BlockDuration)
+		s.window, s.windowCount = now, 0
+		return true
+	}
+	return false
+}
+
+func (g *sourceGuard) Stats() map[string]SFlowSourceStats {
+	g.RLock()
+	defer g.RUnlock()
+
+	now := g.Clock.Now()
+
+	stats := make(map[string]SFlowSourceStats, len(g.sources))
+	for addr, s := range g.sources {
+		st := s.stats
+		if now.Before(s.blockedUntil) {
+			st.BlockedUntil = s.blockedUntil.UTC().Unix()
+		}
+		stats[addr] = st
+	}
+	return stats
+}
+
+func newSourceGuard(maxMalformed int, blockDuration time.Duration) *sourceGuard {
+	return &sourceGuard{
+		MaxMalformed:  maxMalformed,
+		BlockDuration: blockDuration,
+		Clock:         common.RealClock{},
+		sources:       make(map[string]*sflowSource),
+	}
+}
+
+// decodeDatagram validates and decodes a datagram, the flow samples whose
+// sampled packet have a bad checksum being an error if checked.
+func decodeDatagram(data []byte, checksums bool) (*layers.SFlowDatagram, error) {
+	if err := validateDatagram(data); err != nil {
+		return nil, err
+	}
+
+	p := gopacket.NewPacket(data, layers.LayerTypeSFlow, gopacket.Default)
+	if e := p.ErrorLayer(); e != nil {
+		return nil, fmt.Errorf("decoding failed: %s", e.Error().Error())
+	}
+
+	datagram, ok := p.Layer(layers.LayerTypeSFlow).(*layers.SFlowDatagram)
+	if !ok {
+		return nil, errors.New("not an sFlow datagram")
+	}
+
+	if checksums {
+		for _, sample := range datagram.FlowSamples {
+			for _, rec := range sample.Records {
+				if record, ok := rec.(layers.SFlowRawPacketFlowRecord); ok {
+					if err := verifyChecksums(&record); err != nil {
+						return nil, fmt.Errorf("sample %d: %s", sample.SequenceNumber, err.Error())
+					}
+				}
+			}
+		}
+	}
+
+	return datagram, nil
+}
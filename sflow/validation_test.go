@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+func udpFrame(t *testing.T) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{192, 168, 0, 1},
+		DstIP:    net.IP{192, 168, 0, 2},
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload([]byte("skydive"))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func appendUint32(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		var word [4]byte
+		binary.BigEndian.PutUint32(word[:], v)
+		b = append(b, word[:]...)
+	}
+	return b
+}
+
+// sflowDatagram returns a datagram with a flow sample of the frame and a
+// counter sample without record
+func sflowDatagram(frame []byte) []byte {
+	header := append([]byte(nil), frame...)
+	for len(header)%4 != 0 {
+		header = append(header, 0)
+	}
+
+	record := appendUint32(nil, uint32(layers.SFlowProtoEthernet), uint32(len(frame)), 0, uint32(len(frame)))
+	record = append(record, header...)
+
+	sample := appendUint32(nil, 1, 47, 300, 0x12345, 0, 48, 47, 1)
+	sample = appendUint32(sample, sflowRawPacketHeader, uint32(len(record)))
+	sample = append(sample, record...)
+
+	d := appendUint32(nil, 5, sflowAddressIPv4, 0x7f000003, 0, 1, 2294190, 2)
+	d = appendUint32(d, uint32(layers.SFlowTypeFlowSample), uint32(len(sample)))
+	d = append(d, sample...)
+	return appendUint32(d, uint32(layers.SFlowTypeCounterSample), 12, 1, 47, 0)
+}
+
+func TestValidateDatagram(t *testing.T) {
+	valid := sflowDatagram(udpFrame(t))
+	if err := validateDatagram(valid); err != nil {
+		t.Fatalf("Valid datagram rejected: %s", err.Error())
+	}
+	if _, err := decodeDatagram(valid, true); err != nil {
+		t.Fatalf("Valid datagram not decoded: %s", err.Error())
+	}
+
+	corrupt := func(offset int, v uint32) []byte {
+		d := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(d[offset:], v)
+		return d
+	}
+
+	for name, data := range map[string][]byte{
+		"version":        corrupt(0, 4),
+		"address type":   corrupt(4, 3),
+		"sample count":   corrupt(24, 1000),
+		"sample length":  corrupt(32, 4096),
+		"unaligned":      corrupt(32, 13),
+		"record count":   corrupt(64, 2),
+		"record length":  corrupt(72, 12),
+		"header length":  corrupt(88, 1000),
+		"trailing bytes": append(append([]byte(nil), valid...), 0, 0, 0, 0),
+		"empty":          nil,
+	} {
+		if err := validateDatagram(data); err == nil {
+			t.Errorf("Malformed %s not detected", name)
+		}
+	}
+
+	// every truncation of a valid datagram is detected
+	for i := 0; i < len(valid); i++ {
+		if err := validateDatagram(valid[:i]); err == nil {
+			t.Fatalf("Datagram truncated to %d bytes not detected", i)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	frame := udpFrame(t)
+
+	// IPv4 header checksum, UDP checksum
+	for _, offset := range []int{24, 40} {
+		bad := append([]byte(nil), frame...)
+		bad[offset] ^= 0xff
+
+		if _, err := decodeDatagram(sflowDatagram(bad), true); err == nil {
+			t.Errorf("Bad checksum at %d not detected", offset)
+		}
+		if _, err := decodeDatagram(sflowDatagram(bad), false); err != nil {
+			t.Errorf("Checksums shouldn't be verified when disabled: %s", err.Error())
+		}
+	}
+
+	// the UDP checksum of a truncated sample can't be verified
+	bad := append([]byte(nil), frame...)
+	bad[40] ^= 0xff
+	record := &layers.SFlowRawPacketFlowRecord{
+		FrameLength:  uint32(len(bad)),
+		HeaderLength: uint32(len(bad) - 4),
+		Header:       gopacket.NewPacket(bad[:len(bad)-4], layers.LayerTypeEthernet, gopacket.Default),
+	}
+	if err := verifyChecksums(record); err != nil {
+		t.Errorf("Truncated sample shouldn't be rejected: %s", err.Error())
+	}
+}
+
+func TestSourceGuard(t *testing.T) {
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+
+	g := newSourceGuard(2, time.Minute)
+	g.Clock = clock
+
+	for i := 0; i < 2; i++ {
+		if g.rejected("10.0.0.1", errors.New("bad")) {
+			t.Fatal("Source blocked too early")
+		}
+	}
+	if !g.rejected("10.0.0.1", errors.New("bad")) {
+		t.Fatal("Source should be blocked")
+	}
+	if g.allowed("10.0.0.1") || !g.allowed("10.0.0.2") {
+		t.Error("Only the offending source should be blocked")
+	}
+
+	stats := g.Stats()["10.0.0.1"]
+	if stats.Malformed != 3 || stats.Dropped != 1 || stats.BlockedUntil != 1060 {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+
+	clock.Advance(time.Minute)
+	if !g.allowed("10.0.0.1") {
+		t.Error("Source should be unblocked")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	q := common.NewQuarantine("sflow/test", 2)
+	for _, reason := range []string{"a", "b", "c"} {
+		q.Add("10.0.0.1", reason, []byte(reason))
+	}
+
+	dump := q.Dump()
+	if len(dump) != 2 || dump[0].Reason != "b" || dump[1].Reason != "c" {
+		t.Errorf("Expected the last 2 entries, got %+v", dump)
+	}
+}
+
+// TestFuzzDecoders mutates a valid datagram, the validation and the decoding
+// must never panic and the decoder must get bounded datagrams only.
+func TestFuzzDecoders(t *testing.T) {
+	valid := sflowDatagram(udpFrame(t))
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 20000; i++ {
+		data := append([]byte(nil), valid...)
+
+		switch r.Intn(4) {
+		case 0:
+			for n := r.Intn(8) + 1; n > 0; n-- {
+				data[r.Intn(len(data))] ^= byte(1 << uint(r.Intn(8)))
+			}
+		case 1:
+			// a length or count word replaced by a random value
+			binary.BigEndian.PutUint32(data[4*r.Intn(len(data)/4):], r.Uint32()>>uint(r.Intn(32)))
+		case 2:
+			data = data[:r.Intn(len(data))]
+		case 3:
+			data = make([]byte, r.Intn(maxDgramSize))
+			r.Read(data)
+		}
+
+		decodeDatagram(data, true)
+	}
+}
@@ -53,6 +53,11 @@ Node.prototype.Name = function() {
   return "";
 }
 
+// the OVS datapath device, ie. ovs-system, is not displayed
+Node.prototype.IsHidden = function() {
+  return this.Metadata["OvsDatapath"] === true;
+}
+
 Node.prototype.IsCaptureOn = function() {
   return "State.FlowCapture" in this.Metadata && this.Metadata["State.FlowCapture"] == "ON";
 }
@@ -330,7 +335,7 @@ HostLayout.prototype.AddNode = function(node) {
     return;
   this.elements[node.ID] = node;
 
-  if (node.Type() == "host")
+  if (node.Type() == "host" || node.IsHidden())
     return;
 
   this.nodes.push(node);
@@ -984,7 +989,11 @@ Layout.prototype.StartLiveUpdate = function() {
 
   var _this = this;
   this.updatesocket.onopen = function() {
-    var msg = {"Namespace": "Graph", "Type": "SyncRequest"};
+    // the statistics are volatile metadata, only sent if requested
+    var msg = {"Namespace": "Graph", "Type": "SyncRequest", "Obj": {"Volatile": true}};
+    // only the events missed since the last one are sent if still available
+    if (typeof _this.lastSeq != "undefined")
+      msg.Obj.From = _this.lastSeq;
     _this.updatesocket.send(JSON.stringify(msg));
   }
 
@@ -992,10 +1001,55 @@ Layout.prototype.StartLiveUpdate = function() {
     setTimeout(function() { _this.StartLiveUpdate(); }, 1000);
   }
 
+  // a message bigger than the maximum message size comes in several parts,
+  // its lists being split between them, More being set on all of them but
+  // the last one
+  var parts = null;
+
   this.updatesocket.onmessage = function(e) {
     var msg = jQuery.parseJSON(e.data);
+    if (msg.Obj && (msg.Obj.More || msg.Obj.Part)) {
+      if (!msg.Obj.Part)
+        parts = {Obj: {}, Errors: []};
+      else if (parts === null)
+        return;
+      for (var key in msg.Obj) {
+        if (key == "More" || key == "Part")
+          continue;
+        if (Array.isArray(msg.Obj[key]))
+          parts.Obj[key] = (parts.Obj[key] || []).concat(msg.Obj[key]);
+        else if (!msg.Obj.Part)
+          parts.Obj[key] = msg.Obj[key];
+      }
+      if ("Error" in msg)
+        parts.Errors.push(msg.Error);
+      if (msg.Obj.More)
+        return;
+
+      msg.Obj = parts.Obj;
+      delete msg.Error;
+      if (parts.Errors.length > 0)
+        msg.Error = parts.Errors.join("; ");
+      parts = null;
+    }
+
+    if ("Error" in msg)
+      console.log("Message " + msg.Type + ": " + msg.Error);
+
     switch(msg.Namespace) {
       case "Graph":
+        // events missed by the server, the whole graph is requested again
+        if (msg.Type == "ResyncRequired") {
+          delete _this.lastSeq;
+          _this.updatesocket.send(JSON.stringify({"Namespace": "Graph", "Type": "SyncRequest", "Obj": {"Volatile": true}}));
+          break;
+        }
+        if ("Seq" in msg) {
+          // events already applied or included in the last SyncReply
+          if (msg.Type != "SyncReply" && msg.Seq <= _this.lastSeq)
+            break;
+          _this.lastSeq = msg.Seq;
+        }
         _this.ProcessGraphMessage(msg);
         break;
       case "Alert":
@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	clientID    = "skydive"
+	dialTimeout = 10 * time.Second
+)
+
+type SASLConfig struct {
+	Username string
+	Password string
+}
+
+type brokerConn struct {
+	conn          net.Conn
+	correlationID int32
+	timeout       time.Duration
+}
+
+// producer sends messages to the leaders of the partitions of a topic,
+// it is not safe for concurrent use.
+type producer struct {
+	brokers    []string
+	topic      string
+	acks       int16
+	codec      int16
+	timeout    time.Duration
+	tlsConfig  *tls.Config
+	sasl       *SASLConfig
+	conns      map[string]*brokerConn
+	leaders    map[int32]string
+	partitions []int32
+}
+
+func (b *brokerConn) roundTrip(apiKey int16, apiVersion int16, body []byte, expectResponse bool) ([]byte, error) {
+	b.correlationID++
+
+	b.conn.SetDeadline(time.Now().Add(b.timeout))
+	if _, err := b.conn.Write(encodeRequest(apiKey, apiVersion, b.correlationID, clientID, body)); err != nil {
+		return nil, err
+	}
+
+	if !expectResponse {
+		return nil, nil
+	}
+
+	resp, err := b.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: resp}
+	if id := d.int32(); id != b.correlationID {
+		return nil, fmt.Errorf("Kafka correlation id mismatch: %d != %d", id, b.correlationID)
+	}
+
+	return d.buf, d.err
+}
+
+func (b *brokerConn) readFrame() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(b.conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(b.conn, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// authenticate uses the SASL PLAIN mechanism, the token being sent in a
+// SaslAuthenticate request
+func (b *brokerConn) authenticate(sasl *SASLConfig) error {
+	e := &encoder{}
+	e.putString("PLAIN")
+
+	resp, err := b.roundTrip(apiSaslHandshake, saslHandshakeVersion, e.Bytes(), true)
+	if err != nil {
+		return err
+	}
+
+	d := &decoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("SASL handshake failed: %s", kafkaError(code))
+	}
+
+	token := &encoder{}
+	token.putBytes([]byte("\x00" + sasl.Username + "\x00" + sasl.Password))
+
+	if resp, err = b.roundTrip(apiSaslAuthenticate, saslAuthenticateVersion, token.Bytes(), true); err != nil {
+		return fmt.Errorf("SASL authentication failed: %s", err.Error())
+	}
+
+	d = &decoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("SASL authentication failed: %s %s", kafkaError(code), d.string())
+	}
+
+	return d.err
+}
+
+func (b *brokerConn) close() {
+	b.conn.Close()
+}
+
+func (p *producer) connect(addr string) (*brokerConn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if p.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, p.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &brokerConn{conn: conn, timeout: p.timeout}
+	if p.sasl != nil {
+		if err := c.authenticate(p.sasl); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	p.conns[addr] = c
+	return c, nil
+}
+
+func (p *producer) disconnect(addr string) {
+	if c, ok := p.conns[addr]; ok {
+		c.close()
+		delete(p.conns, addr)
+	}
+}
+
+func (p *producer) close() {
+	for addr := range p.conns {
+		p.disconnect(addr)
+	}
+}
+
+func (p *producer) refreshMetadata() error {
+	err := errors.New("No Kafka broker available")
+
+	for _, addr := range p.brokers {
+		var c *brokerConn
+		if c, err = p.connect(addr); err != nil {
+			continue
+		}
+
+		var resp []byte
+		if resp, err = c.roundTrip(apiMetadata, metadataVersion, encodeMetadataRequest([]string{p.topic}), true); err != nil {
+			p.disconnect(addr)
+			continue
+		}
+
+		var md *metadataResponse
+		if md, err = decodeMetadataResponse(resp); err != nil {
+			continue
+		}
+
+		p.leaders = make(map[int32]string)
+		p.partitions = nil
+		for _, pm := range md.partitions[p.topic] {
+			if pm.err != 0 || pm.leader < 0 {
+				continue
+			}
+			p.leaders[pm.id] = md.brokers[pm.leader]
+			p.partitions = append(p.partitions, pm.id)
+		}
+
+		if len(p.partitions) == 0 {
+			return fmt.Errorf("No partition available for topic %s", p.topic)
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// produce sends the messages grouped by partition, the metadata are refreshed
+// on the first call and after each failure.
+func (p *producer) produce(sets map[int32][]*message) error {
+	byLeader := make(map[string]map[int32][]*message)
+	for partition, messages := range sets {
+		leader, ok := p.leaders[partition]
+		if !ok {
+			p.leaders = nil
+			return fmt.Errorf("No leader for partition %d", partition)
+		}
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]*message)
+		}
+		byLeader[leader][partition] = messages
+	}
+
+	for leader, s := range byLeader {
+		c, err := p.connect(leader)
+		if err != nil {
+			p.leaders = nil
+			return err
+		}
+
+		timeout := int32(p.timeout / time.Millisecond)
+		req, err := encodeProduceRequest(p.acks, timeout, p.topic, s, p.codec)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.roundTrip(apiProduce, produceVersion, req, p.acks != 0)
+		if err != nil {
+			p.disconnect(leader)
+			p.leaders = nil
+			return err
+		}
+
+		if p.acks != 0 {
+			if err := decodeProduceResponse(resp); err != nil {
+				p.leaders = nil
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *producer) ensureMetadata() error {
+	if p.leaders != nil {
+		return nil
+	}
+	return p.refreshMetadata()
+}
+
+func newProducer(brokers []string, topic string, acks int16, codec int16, timeout time.Duration, tlsConfig *tls.Config, sasl *SASLConfig) *producer {
+	return &producer{
+		brokers:   brokers,
+		topic:     topic,
+		acks:      acks,
+		codec:     codec,
+		timeout:   timeout,
+		tlsConfig: tlsConfig,
+		sasl:      sasl,
+		conns:     make(map[string]*brokerConn),
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ugorji/go/codec"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/flow"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/storage"
+)
+
+var ErrBadConfig = errors.New("kafka : Config file is misconfigured, check kafka brokers and topic")
+
+// KafkaStorage publishes the flows to a Kafka topic, it can't be searched.
+// Flows are buffered in memory, the oldest ones being dropped when the buffer
+// is full, ie. during a broker outage.
+type KafkaStorage struct {
+	producer     *producer
+	partitioner  string
+	format       string
+	batchSize    int
+	batchTimeout time.Duration
+	buffer       chan *message
+	quit         chan bool
+	wg           sync.WaitGroup
+	started      atomic.Value
+	metrics      KafkaMetrics
+}
+
+type KafkaMetrics struct {
+	Buffered int
+	Sent     int64
+	Dropped  int64
+	Failed   int64
+	Batches  int64
+}
+
+func (c *KafkaStorage) encode(f *flow.Flow) ([]byte, error) {
+	if c.format == "msgpack" {
+		var b []byte
+		err := codec.NewEncoderBytes(&b, &codec.MsgpackHandle{}).Encode(f)
+		return b, err
+	}
+	return json.Marshal(f)
+}
+
+func (c *KafkaStorage) partition(key []byte, partitions []int32) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return partitions[h.Sum32()%uint32(len(partitions))]
+}
+
+func (c *KafkaStorage) StoreFlows(flows []*flow.Flow) error {
+	if c.started.Load() != true {
+		return errors.New("KafkaStorage is not yet started")
+	}
+
+	for _, f := range flows {
+		value, err := c.encode(f)
+		if err != nil {
+			logging.GetLogger().Errorf("Error while encoding flow %s: %s", f.UUID, err.Error())
+			continue
+		}
+
+		key := f.UUID
+		if c.partitioner == "node" {
+			key = f.ProbeGraphPath
+		}
+		msg := &message{key: []byte(key), value: value}
+
+		for {
+			select {
+			case c.buffer <- msg:
+			default:
+				// drop the oldest one to make room
+				select {
+				case <-c.buffer:
+					atomic.AddInt64(&c.metrics.Dropped, 1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func (c *KafkaStorage) SearchFlows(filters storage.Filters) ([]*flow.Flow, error) {
+	return nil, storage.ErrSearchNotSupported
+}
+
+func (c *KafkaStorage) send(batch []*message) error {
+	if err := c.producer.ensureMetadata(); err != nil {
+		return err
+	}
+
+	sets := make(map[int32][]*message)
+	for _, m := range batch {
+		p := c.partition(m.key, c.producer.partitions)
+		sets[p] = append(sets[p], m)
+	}
+
+	return c.producer.produce(sets)
+}
+
+func (c *KafkaStorage) run() {
+	defer c.wg.Done()
+	defer c.producer.close()
+
+	ticker := time.NewTicker(c.batchTimeout)
+	defer ticker.Stop()
+
+	var batch []*message
+	failing := false
+	for {
+		flush := false
+
+		// stop reading the buffer while the batch can't be sent so that
+		// the oldest flows get dropped
+		in := c.buffer
+		if failing {
+			in = nil
+		}
+
+		select {
+		case <-c.quit:
+			if len(batch) > 0 {
+				if err := c.send(batch); err != nil {
+					logging.GetLogger().Errorf("Unable to send %d flows to Kafka while stopping: %s", len(batch), err.Error())
+				}
+			}
+			return
+		case m := <-in:
+			batch = append(batch, m)
+			flush = len(batch) >= c.batchSize
+		case <-ticker.C:
+			flush = len(batch) > 0
+		}
+
+		if !flush {
+			continue
+		}
+
+		atomic.AddInt64(&c.metrics.Batches, 1)
+		if err := c.send(batch); err != nil {
+			// keep the batch, retried on the next tick
+			logging.GetLogger().Errorf("Unable to send %d flows to Kafka: %s", len(batch), err.Error())
+			atomic.AddInt64(&c.metrics.Failed, 1)
+			failing = true
+			continue
+		}
+
+		atomic.AddInt64(&c.metrics.Sent, int64(len(batch)))
+		batch = nil
+		failing = false
+	}
+}
+
+func (c *KafkaStorage) Metrics() interface{} {
+	return KafkaMetrics{
+		Buffered: len(c.buffer),
+		Sent:     atomic.LoadInt64(&c.metrics.Sent),
+		Dropped:  atomic.LoadInt64(&c.metrics.Dropped),
+		Failed:   atomic.LoadInt64(&c.metrics.Failed),
+		Batches:  atomic.LoadInt64(&c.metrics.Batches),
+	}
+}
+
+func (c *KafkaStorage) Start() {
+	c.wg.Add(1)
+	go c.run()
+
+	common.RegisterMetrics("kafka", c.Metrics)
+	c.started.Store(true)
+}
+
+func (c *KafkaStorage) Stop() {
+	if c.started.Load() != true {
+		return
+	}
+	c.started.Store(false)
+
+	common.UnregisterMetrics("kafka")
+	c.quit <- true
+	c.wg.Wait()
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	cfg := config.GetConfig()
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.GetBool("storage.kafka.tls.insecure_skip_verify"),
+	}
+
+	if caFile := cfg.GetString("storage.kafka.tls.ca_file"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Unable to load the CA from %s", caFile)
+		}
+	}
+
+	certFile, keyFile := cfg.GetString("storage.kafka.tls.cert_file"), cfg.GetString("storage.kafka.tls.key_file")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func NewKafkaStorage(brokers []string, topic string, partitioner string, format string, compression string, batchSize int, batchTimeout time.Duration, bufferSize int, acks int16, tlsConfig *tls.Config, sasl *SASLConfig) (*KafkaStorage, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, ErrBadConfig
+	}
+
+	switch partitioner {
+	case "flow", "node":
+	default:
+		return nil, fmt.Errorf("Kafka partitioner unknown: %s", partitioner)
+	}
+
+	switch format {
+	case "json", "msgpack":
+	default:
+		return nil, fmt.Errorf("Kafka format unknown: %s", format)
+	}
+
+	var codec int16
+	switch compression {
+	case "", "none":
+		codec = compressionNone
+	case "gzip":
+		codec = compressionGzip
+	default:
+		return nil, fmt.Errorf("Kafka compression unknown: %s", compression)
+	}
+
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if batchTimeout <= 0 {
+		batchTimeout = time.Second
+	}
+	if bufferSize <= 0 {
+		bufferSize = batchSize
+	}
+
+	storage := &KafkaStorage{
+		producer:     newProducer(brokers, topic, acks, codec, 10*time.Second, tlsConfig, sasl),
+		partitioner:  partitioner,
+		format:       format,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		buffer:       make(chan *message, bufferSize),
+		quit:         make(chan bool),
+	}
+	storage.started.Store(false)
+
+	return storage, nil
+}
+
+func New() (*KafkaStorage, error) {
+	cfg := config.GetConfig()
+
+	var tlsConfig *tls.Config
+	if cfg.GetBool("storage.kafka.tls.enabled") {
+		var err error
+		if tlsConfig, err = newTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	var sasl *SASLConfig
+	if username := cfg.GetString("storage.kafka.sasl.username"); username != "" {
+		sasl = &SASLConfig{
+			Username: username,
+			Password: cfg.GetString("storage.kafka.sasl.password"),
+		}
+	}
+
+	return NewKafkaStorage(
+		cfg.GetStringSlice("storage.kafka.brokers"),
+		cfg.GetString("storage.kafka.topic"),
+		cfg.GetString("storage.kafka.partitioner"),
+		cfg.GetString("storage.kafka.format"),
+		cfg.GetString("storage.kafka.compression"),
+		cfg.GetInt("storage.kafka.batch_size"),
+		time.Duration(cfg.GetInt("storage.kafka.batch_timeout"))*time.Millisecond,
+		cfg.GetInt("storage.kafka.buffer_size"),
+		int16(cfg.GetInt("storage.kafka.required_acks")),
+		tlsConfig,
+		sasl,
+	)
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/flow"
+)
+
+type fakeBroker struct {
+	sync.Mutex
+	listener      net.Listener
+	topic         string
+	values        [][]byte
+	codecs        []int16
+	authenticated []string
+}
+
+// decodeRecordBatch returns the values of the records of a batch
+func (b *fakeBroker) decodeRecordBatch(t *testing.T, d *decoder) {
+	d.int64() // base offset
+	batch := &decoder{buf: d.next(int(d.int32()))}
+	batch.int32() // partition leader epoch
+	if magic := batch.int8(); magic != 2 {
+		t.Errorf("Wrong magic %d", magic)
+	}
+	if crc := uint32(batch.int32()); crc != crc32.Checksum(batch.buf, castagnoli) {
+		t.Errorf("Wrong record batch CRC")
+	}
+
+	codec := batch.int16()
+	batch.next(4 + 8 + 8 + 8 + 2 + 4)
+	count := batch.int32()
+
+	records := batch
+	if codec == compressionGzip {
+		r, err := gzip.NewReader(bytes.NewReader(batch.buf))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		payload, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		records = &decoder{buf: payload}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.codecs = append(b.codecs, codec)
+	for ; count > 0 && records.err == nil; count-- {
+		r := &decoder{buf: records.next(int(records.varint()))}
+		r.int8()   // attributes
+		r.varint() // timestamp delta
+		r.varint() // offset delta
+		r.varBytes()
+		b.values = append(b.values, r.varBytes())
+	}
+	if records.err != nil || len(records.buf) > 0 {
+		t.Errorf("Wrong records: %v", records.err)
+	}
+}
+
+func (b *fakeBroker) handleProduce(t *testing.T, d *decoder) []byte {
+	d.string() // transactional id
+	d.int16()  // acks
+	d.int32()  // timeout
+
+	resp := &encoder{}
+	resp.putInt32(d.int32())
+	topic := d.string()
+	resp.putString(topic)
+
+	n := d.int32()
+	resp.putInt32(n)
+	for ; n > 0; n-- {
+		partition := d.int32()
+		b.decodeRecordBatch(t, &decoder{buf: d.bytes()})
+
+		resp.putInt32(partition)
+		resp.putInt16(0)
+		resp.putInt64(0)
+		resp.putInt64(-1)
+	}
+	resp.putInt32(0) // throttle time
+
+	return resp.Bytes()
+}
+
+func (b *fakeBroker) handleSaslHandshake(d *decoder) []byte {
+	resp := &encoder{}
+	if d.string() != "PLAIN" {
+		resp.putInt16(33) // unsupported mechanism
+	} else {
+		resp.putInt16(0)
+	}
+	resp.putInt32(1)
+	resp.putString("PLAIN")
+	return resp.Bytes()
+}
+
+func (b *fakeBroker) handleSaslAuthenticate(d *decoder) []byte {
+	b.Lock()
+	b.authenticated = append(b.authenticated, string(d.bytes()))
+	b.Unlock()
+
+	resp := &encoder{}
+	resp.putInt16(0)
+	resp.putNullString()
+	resp.putBytes([]byte{})
+	return resp.Bytes()
+}
+
+func (b *fakeBroker) handleMetadata() []byte {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	resp := &encoder{}
+	resp.putInt32(0) // throttle time
+	resp.putInt32(1)
+	resp.putInt32(0)
+	resp.putString(host)
+	resp.putInt32(int32(p))
+	resp.putNullString() // rack
+
+	resp.putString("cluster")
+	resp.putInt32(0) // controller
+
+	resp.putInt32(1)
+	resp.putInt16(0)
+	resp.putString(b.topic)
+	resp.putInt8(0) // internal
+	resp.putInt32(2)
+	for i := int32(0); i < 2; i++ {
+		resp.putInt16(0)
+		resp.putInt32(i)
+		resp.putInt32(0)
+		resp.putInt32(1)
+		resp.putInt32(0)
+		resp.putInt32(1)
+		resp.putInt32(0)
+	}
+
+	return resp.Bytes()
+}
+
+func (b *fakeBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+
+		d := &decoder{buf: frame}
+		apiKey := d.int16()
+		apiVersion := d.int16()
+		correlationID := d.int32()
+		d.string()
+
+		// the oldest versions accepted by Kafka 4.0
+		versions := map[int16]int16{apiMetadata: 4, apiProduce: 3, apiSaslHandshake: 1, apiSaslAuthenticate: 0}
+		if apiVersion < versions[apiKey] {
+			t.Errorf("Version %d of the request %d not supported", apiVersion, apiKey)
+			return
+		}
+
+		var body []byte
+		switch apiKey {
+		case apiMetadata:
+			body = b.handleMetadata()
+		case apiProduce:
+			body = b.handleProduce(t, d)
+		case apiSaslHandshake:
+			body = b.handleSaslHandshake(d)
+		case apiSaslAuthenticate:
+			body = b.handleSaslAuthenticate(d)
+		default:
+			t.Errorf("Unexpected request %d", apiKey)
+			return
+		}
+
+		resp := &encoder{}
+		resp.putInt32(int32(len(body) + 4))
+		resp.putInt32(correlationID)
+		resp.Write(body)
+		conn.Write(resp.Bytes())
+	}
+}
+
+func newFakeBroker(t *testing.T, topic string) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := &fakeBroker{listener: l, topic: topic}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeBroker) received() [][]byte {
+	b.Lock()
+	defer b.Unlock()
+	return b.values
+}
+
+func TestKafkaStorage(t *testing.T) {
+	testKafkaStorage(t, "none", nil)
+}
+
+func TestKafkaStorageGzip(t *testing.T) {
+	testKafkaStorage(t, "gzip", nil)
+}
+
+func TestKafkaStorageSASL(t *testing.T) {
+	testKafkaStorage(t, "none", &SASLConfig{Username: "skydive", Password: "secret"})
+}
+
+func testKafkaStorage(t *testing.T, compression string, sasl *SASLConfig) {
+	broker := newFakeBroker(t, "flows")
+	defer broker.listener.Close()
+
+	s, err := NewKafkaStorage([]string{broker.listener.Addr().String()}, "flows", "flow", "json", compression, 2, 50*time.Millisecond, 10, 1, nil, sasl)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Start()
+
+	flows := []*flow.Flow{{UUID: "aaa"}, {UUID: "bbb"}, {UUID: "ccc"}}
+	if err := s.StoreFlows(flows); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 100 && len(broker.received()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+
+	values := broker.received()
+	if len(values) != 3 {
+		t.Fatalf("Expected 3 flows, got %d", len(values))
+	}
+
+	uuids := make(map[string]bool)
+	for _, v := range values {
+		var f flow.Flow
+		if err := json.Unmarshal(v, &f); err != nil {
+			t.Fatal(err.Error())
+		}
+		uuids[f.UUID] = true
+	}
+
+	for _, f := range flows {
+		if !uuids[f.UUID] {
+			t.Errorf("Flow %s not received", f.UUID)
+		}
+	}
+
+	if m := s.Metrics().(KafkaMetrics); m.Sent != 3 || m.Dropped != 0 {
+		t.Errorf("Wrong metrics: %+v", m)
+	}
+
+	broker.Lock()
+	defer broker.Unlock()
+
+	codec := compressionNone
+	if compression == "gzip" {
+		codec = compressionGzip
+	}
+	for _, c := range broker.codecs {
+		if c != codec {
+			t.Errorf("Expected the codec %d, got %d", codec, c)
+		}
+	}
+
+	if sasl != nil {
+		if len(broker.authenticated) == 0 || broker.authenticated[0] != "\x00skydive\x00secret" {
+			t.Errorf("Expected a SASL PLAIN authentication, got %q", broker.authenticated)
+		}
+	} else if len(broker.authenticated) != 0 {
+		t.Errorf("No authentication expected, got %q", broker.authenticated)
+	}
+}
+
+func TestKafkaStorageBuffer(t *testing.T) {
+	// no broker listening, flows are kept in the buffer then dropped
+	s, err := NewKafkaStorage([]string{"127.0.0.1:1"}, "flows", "node", "msgpack", "none", 100, time.Hour, 2, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.started.Store(true)
+
+	s.StoreFlows([]*flow.Flow{{UUID: "aaa"}, {UUID: "bbb"}, {UUID: "ccc"}})
+
+	if m := s.Metrics().(KafkaMetrics); m.Buffered != 2 || m.Dropped != 1 {
+		t.Errorf("Wrong metrics: %+v", m)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Only the subset of the Kafka protocol needed to produce messages is
+// implemented, see https://kafka.apache.org/protocol. The versions are the
+// oldest ones still accepted by the brokers since Kafka 4.0 (KIP-896), the
+// maintained clients depending on compression libraries not vendored. The
+// messages are sent as record batches, the message format v2.
+const (
+	apiProduce          int16 = 0
+	apiMetadata         int16 = 3
+	apiSaslHandshake    int16 = 17
+	apiSaslAuthenticate int16 = 36
+
+	produceVersion          int16 = 3
+	metadataVersion         int16 = 4
+	saslHandshakeVersion    int16 = 1
+	saslAuthenticateVersion int16 = 0
+)
+
+// compression codecs of the record batches
+const (
+	compressionNone int16 = 0
+	compressionGzip int16 = 1
+)
+
+var errShortBuffer = errors.New("Kafka response too short")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("Kafka error code %d", int16(e))
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) putInt8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) putInt16(v int16) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *encoder) putInt32(v int32) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *encoder) putInt64(v int64) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *encoder) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *encoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) putNullString() {
+	e.putInt16(-1)
+}
+
+func (e *encoder) putBytes(b []byte) {
+	if b == nil {
+		e.putInt32(-1)
+		return
+	}
+	e.putInt32(int32(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) putVarBytes(b []byte) {
+	if b == nil {
+		e.putVarint(-1)
+		return
+	}
+	e.putVarint(int64(len(b)))
+	e.Write(b)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortBuffer
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShortBuffer
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *decoder) varBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+type message struct {
+	key   []byte
+	value []byte
+}
+
+// encodeRecordBatch encodes messages as a record batch, the message format
+// v2, the records being compressed with the given codec
+func encodeRecordBatch(messages []*message, codec int16, now time.Time) ([]byte, error) {
+	records := &encoder{}
+	for i, m := range messages {
+		r := &encoder{}
+		r.putInt8(0)          // attributes
+		r.putVarint(0)        // timestamp delta
+		r.putVarint(int64(i)) // offset delta
+		r.putVarBytes(m.key)
+		r.putVarBytes(m.value)
+		r.putVarint(0) // headers
+
+		records.putVarint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	payload := records.Bytes()
+	if codec == compressionGzip {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = b.Bytes()
+	}
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	// the part of the batch covered by the CRC
+	body := &encoder{}
+	body.putInt16(codec)
+	body.putInt32(int32(len(messages) - 1)) // last offset delta
+	body.putInt64(timestamp)
+	body.putInt64(timestamp)
+	body.putInt64(-1) // producer id
+	body.putInt16(-1) // producer epoch
+	body.putInt32(-1) // base sequence
+	body.putInt32(int32(len(messages)))
+	body.Write(payload)
+
+	batch := &encoder{}
+	batch.putInt64(0) // base offset, set by the broker
+	batch.putInt32(int32(4 + 1 + 4 + body.Len()))
+	batch.putInt32(-1) // partition leader epoch
+	batch.putInt8(2)   // magic
+	batch.putInt32(int32(crc32.Checksum(body.Bytes(), castagnoli)))
+	batch.Write(body.Bytes())
+
+	return batch.Bytes(), nil
+}
+
+func encodeRequest(apiKey int16, apiVersion int16, correlationID int32, clientID string, body []byte) []byte {
+	header := &encoder{}
+	header.putInt16(apiKey)
+	header.putInt16(apiVersion)
+	header.putInt32(correlationID)
+	header.putString(clientID)
+
+	req := &encoder{}
+	req.putInt32(int32(header.Len() + len(body)))
+	req.Write(header.Bytes())
+	req.Write(body)
+
+	return req.Bytes()
+}
+
+type partitionMetadata struct {
+	id     int32
+	leader int32
+	err    int16
+}
+
+type metadataResponse struct {
+	brokers    map[int32]string
+	partitions map[string][]partitionMetadata
+}
+
+func encodeMetadataRequest(topics []string) []byte {
+	e := &encoder{}
+	e.putInt32(int32(len(topics)))
+	for _, t := range topics {
+		e.putString(t)
+	}
+	e.putInt8(1) // allow the auto creation of the topics
+	return e.Bytes()
+}
+
+func decodeMetadataResponse(b []byte) (*metadataResponse, error) {
+	d := &decoder{buf: b}
+	resp := &metadataResponse{
+		brokers:    make(map[int32]string),
+		partitions: make(map[string][]partitionMetadata),
+	}
+
+	d.int32() // throttle time
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		resp.brokers[id] = fmt.Sprintf("%s:%d", host, port)
+	}
+
+	d.string() // cluster id
+	d.int32()  // controller id
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topicErr := d.int16()
+		topic := d.string()
+		d.int8() // internal
+		if topicErr != 0 {
+			return nil, fmt.Errorf("Metadata error for topic %s: %s", topic, kafkaError(topicErr))
+		}
+
+		var partitions []partitionMetadata
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			pm := partitionMetadata{err: d.int16(), id: d.int32(), leader: d.int32()}
+			for r := d.int32(); r > 0 && d.err == nil; r-- {
+				d.int32()
+			}
+			for i := d.int32(); i > 0 && d.err == nil; i-- {
+				d.int32()
+			}
+			partitions = append(partitions, pm)
+		}
+		resp.partitions[topic] = partitions
+	}
+
+	return resp, d.err
+}
+
+func encodeProduceRequest(acks int16, timeout int32, topic string, sets map[int32][]*message, codec int16) ([]byte, error) {
+	e := &encoder{}
+	e.putNullString() // transactional id
+	e.putInt16(acks)
+	e.putInt32(timeout)
+	e.putInt32(1)
+	e.putString(topic)
+	e.putInt32(int32(len(sets)))
+
+	now := time.Now()
+	for partition, messages := range sets {
+		batch, err := encodeRecordBatch(messages, codec, now)
+		if err != nil {
+			return nil, err
+		}
+		e.putInt32(partition)
+		e.putBytes(batch)
+	}
+	return e.Bytes(), nil
+}
+
+// decodeProduceResponse returns the first error reported for a partition
+func decodeProduceResponse(b []byte) error {
+	d := &decoder{buf: b}
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topic := d.string()
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 {
+				return fmt.Errorf("Produce error for %s/%d: %s", topic, partition, kafkaError(code))
+			}
+		}
+	}
+	d.int32() // throttle time
+
+	return d.err
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/redhat-cip/skydive/flow"
+)
+
+// MultiStorage stores the flows in all its storages, searches are done in the
+// first one supporting it.
+type MultiStorage struct {
+	Storages []Storage
+}
+
+func (m *MultiStorage) Start() {
+	for _, s := range m.Storages {
+		s.Start()
+	}
+}
+
+func (m *MultiStorage) StoreFlows(flows []*flow.Flow) error {
+	var err error
+	for _, s := range m.Storages {
+		if e := s.StoreFlows(flows); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *MultiStorage) SearchFlows(filters Filters) ([]*flow.Flow, error) {
+	for _, s := range m.Storages {
+		flows, err := s.SearchFlows(filters)
+		if err != ErrSearchNotSupported {
+			return flows, err
+		}
+	}
+	return nil, ErrSearchNotSupported
+}
+
+func (m *MultiStorage) Stop() {
+	for _, s := range m.Storages {
+		s.Stop()
+	}
+}
+
+func NewMultiStorage(storages ...Storage) *MultiStorage {
+	return &MultiStorage{Storages: storages}
+}
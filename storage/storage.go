@@ -23,6 +23,8 @@
 package storage
 
 import (
+	"errors"
+
 	"github.com/redhat-cip/skydive/flow"
 )
 
@@ -34,3 +36,5 @@ type Storage interface {
 	SearchFlows(filters Filters) ([]*flow.Flow, error)
 	Stop()
 }
+
+var ErrSearchNotSupported = errors.New("Storage doesn't support search")
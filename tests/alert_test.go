@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/tests/helper"
+	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type alertListener struct {
+	msgs chan *alert.AlertMessage
+}
+
+func (l *alertListener) OnAlert(msg *alert.AlertMessage) {
+	l.msgs <- msg
+}
+
+func TestAlertFor(t *testing.T) {
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	setupCmds := []helper.Cmd{
+		{"ip link add alert-vm1-eth0 type veth peer name alert-eth-src", true},
+		{"ip link set alert-vm1-eth0 up", true},
+		{"ip link set alert-eth-src up", true},
+		{"sleep 2", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ip link del alert-eth-src", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	listener := &alertListener{msgs: make(chan *alert.AlertMessage, 10)}
+	aa.Analyzer.AlertServer.AlertManager.AddEventListener(listener)
+
+	al := api.NewAlert()
+	al.Select = "Name"
+	al.Test = `Name == "alert-vm1-eth0" && State == "DOWN"`
+	al.For = "3s"
+
+	client := shttp.NewCrudClient(aa.Analyzer.HTTPServer.Addr, aa.Analyzer.HTTPServer.Port, &shttp.AuthenticationOpts{}, "api")
+	if err := client.Create("alert", al); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Delete("alert", al.UUID)
+
+	// let the alert reach the alert manager
+	time.Sleep(2 * time.Second)
+
+	helper.ExecCmds(t, helper.Cmd{"ip link set alert-vm1-eth0 down", true})
+	down := time.Now()
+
+	select {
+	case msg := <-listener.msgs:
+		if msg.UUID != al.UUID {
+			t.Fatalf("Unexpected alert: %+v", msg)
+		}
+		if elapsed := time.Since(down); elapsed < 3*time.Second {
+			t.Fatalf("Alert fired after %s, before its duration", elapsed)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("Alert not fired")
+	}
+
+	g := aa.Analyzer.GraphServer.Graph
+	g.RLock()
+	defer g.RUnlock()
+
+	node := g.LookupFirstNode(graph.Metadata{"Name": "alert-vm1-eth0"})
+	if node == nil {
+		t.Fatal("Interface alert-vm1-eth0 not found")
+	}
+	if _, ok := node.Metadata()["Downtime"]; !ok {
+		t.Errorf("Downtime expected on the interface down: %v", node.Metadata())
+	}
+}
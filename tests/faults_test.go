@@ -0,0 +1,251 @@
+// +build faults
+
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/faults"
+	"github.com/redhat-cip/skydive/tests/helper"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// the faults are armed through the API of the agent, both the agent and
+// the analyzer of the tests run in the same process and share them.
+func armFault(t *testing.T, point string, count int64, delay string) {
+	req := api.FaultRequest{Point: point, Count: count, Delay: delay}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post("http://localhost:58081/api/debug/faults", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unable to arm the fault %s: %s", point, resp.Status)
+	}
+}
+
+func disarmFault(t *testing.T, point string) {
+	req, err := http.NewRequest("DELETE", "http://localhost:58081/api/debug/faults/"+point, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// graphDiff returns the difference between the nodes of the agent and
+// their copy in the analyzer, the counters excluded.
+func graphDiff(aa *helper.HelperAgentAnalyzer) (*graph.GraphDiff, error) {
+	host, err := common.HostID()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := graph.NewDiffRules(graph.MetadataPersistenceKeys(graph.VolatilePersistence), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ag := aa.Agent.Graph
+	ag.RLock()
+	from := ag.HostSnapshot(host)
+	ag.RUnlock()
+
+	an := aa.Analyzer.GraphServer.Graph
+	an.RLock()
+	to := an.HostSnapshot(host)
+	an.RUnlock()
+
+	return graph.DiffSnapshots(from, to, rules), nil
+}
+
+func waitConverged(t *testing.T, aa *helper.HelperAgentAnalyzer, timeout time.Duration) {
+	var diff *graph.GraphDiff
+	var err error
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if diff, err = graphDiff(aa); err != nil {
+			t.Fatal(err)
+		}
+		if diff.Empty() {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	t.Fatalf("The analyzer did not converge with the agent: %+v", diff)
+}
+
+func waitNode(t *testing.T, g *graph.Graph, m graph.Metadata, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		g.RLock()
+		n := g.LookupFirstNode(m)
+		g.RUnlock()
+		if n != nil {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	t.Fatalf("Node %v not found", m)
+}
+
+func TestFaultWSClientDrop(t *testing.T) {
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	waitConverged(t, aa, 10*time.Second)
+
+	// the connection to the analyzer breaks on the next message
+	armFault(t, faults.WSClientDrop, 1, "")
+
+	setupCmds := []helper.Cmd{
+		{"ip link add fault-vm1-eth0 type veth peer name fault-eth-src", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ip link del fault-eth-src", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	waitNode(t, aa.Analyzer.GraphServer.Graph, graph.Metadata{"Name": "fault-vm1-eth0"}, 15*time.Second)
+	waitConverged(t, aa, 15*time.Second)
+}
+
+func TestFaultBackendDelay(t *testing.T) {
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	armFault(t, faults.BackendDelay, 0, "100ms")
+
+	setupCmds := []helper.Cmd{
+		{"ip link add fault-vm1-eth0 type veth peer name fault-eth-src", true},
+		{"ip link add fault-vm2-eth0 type veth peer name fault-eth-dst", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ip link del fault-eth-src", true},
+		{"ip link del fault-eth-dst", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	time.Sleep(2 * time.Second)
+	disarmFault(t, faults.BackendDelay)
+
+	waitNode(t, aa.Analyzer.GraphServer.Graph, graph.Metadata{"Name": "fault-vm2-eth0"}, 15*time.Second)
+	waitConverged(t, aa, 15*time.Second)
+}
+
+func TestFaultOvsdbReconnect(t *testing.T) {
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	// the first attempt to reconnect fails, the bridge is created while
+	// the agent is disconnected
+	armFault(t, faults.OvsdbReconnect, 1, "")
+
+	setupCmds := []helper.Cmd{
+		{"ovs-appctl -t ovsdb-server ovsdb-server/remove-remote ptcp:6400", true},
+		{"ovs-vsctl add-br br-fault", true},
+		{"sleep 2", true},
+		{"ovs-appctl -t ovsdb-server ovsdb-server/add-remote ptcp:6400", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ovs-appctl -t ovsdb-server ovsdb-server/add-remote ptcp:6400", false},
+		{"ovs-vsctl del-br br-fault", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	waitNode(t, aa.Analyzer.GraphServer.Graph, graph.Metadata{"Name": "br-fault", "Type": "ovsbridge"}, 30*time.Second)
+	waitConverged(t, aa, 15*time.Second)
+}
+
+func TestFaultNetlinkENOBUFS(t *testing.T) {
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	waitConverged(t, aa, 10*time.Second)
+
+	// the notifications of the veth are lost, the reconciliation of the
+	// interfaces has to catch up
+	armFault(t, faults.NetlinkENOBUFS, 1, "")
+
+	setupCmds := []helper.Cmd{
+		{"ip link add fault-vm1-eth0 type veth peer name fault-eth-src", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ip link del fault-eth-src", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	waitNode(t, aa.Agent.Graph, graph.Metadata{"Name": "fault-eth-src"}, 15*time.Second)
+	waitConverged(t, aa, 15*time.Second)
+
+	for _, f := range faults.Faults() {
+		if f.Point == faults.NetlinkENOBUFS {
+			t.Fatalf("The fault %s has not been fired", f.Point)
+		}
+	}
+}
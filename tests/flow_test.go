@@ -24,14 +24,18 @@ package tests
 
 import (
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/flow"
 	"github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/sflow"
 	"github.com/redhat-cip/skydive/storage"
 	"github.com/redhat-cip/skydive/tests/helper"
 	"github.com/redhat-cip/skydive/tools"
@@ -40,7 +44,8 @@ import (
 const confAgentAnalyzer = `---
 agent:
   listen: 58081
-  analyzers: localhost:{{.AnalyzerPort}}
+{{if .ReadOnly}}  read_only: true
+{{end}}  analyzers: localhost:{{.AnalyzerPort}}
   topology:
     probes:
       - netlink
@@ -68,6 +73,10 @@ analyzer:
   flowtable_update: 10
   flowtable_agent_ratio: 0.5
 
+graph:
+  schema:
+    strict: true
+
 etcd:
   embedded: true
   port: 2374
@@ -434,6 +443,89 @@ func TestSFlowTwoProbePath(t *testing.T) {
 	client.Delete("capture", "*/br-sflow2[Type=ovsbridge]")
 }
 
+func TestSFlowPortAttribution(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts)
+	aa.Start()
+	defer aa.Stop()
+
+	client := api.NewCrudClientFromConfig(&http.AuthenticationOpts{})
+	capture := &api.Capture{ProbePath: "*/br-sflow[Type=ovsbridge]"}
+	if err := client.Create("capture", &capture); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	time.Sleep(1 * time.Second)
+	setupCmds := []helper.Cmd{
+		{"ovs-vsctl add-br br-sflow", true},
+
+		// OpenFlow ports not matching the datapath ports nor the ifindexes
+		{"ovs-vsctl add-port br-sflow sflow-intf1 -- set interface sflow-intf1 type=internal ofport_request=101", true},
+		{"ip netns add sflow-vm1", true},
+		{"ip link set sflow-intf1 netns sflow-vm1", true},
+		{"ip netns exec sflow-vm1 ip address add 169.254.33.33/24 dev sflow-intf1", true},
+		{"ip netns exec sflow-vm1 ip link set sflow-intf1 up", true},
+
+		{"ovs-vsctl add-port br-sflow sflow-intf2 -- set interface sflow-intf2 type=internal ofport_request=102", true},
+		{"ip netns add sflow-vm2", true},
+		{"ip link set sflow-intf2 netns sflow-vm2", true},
+		{"ip netns exec sflow-vm2 ip address add 169.254.33.34/24 dev sflow-intf2", true},
+		{"ip netns exec sflow-vm2 ip link set sflow-intf2 up", true},
+
+		{"ip netns exec sflow-vm1 ping -c 25 -I sflow-intf1 169.254.33.34", false},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ip netns del sflow-vm1", true},
+		{"ip netns del sflow-vm2", true},
+		{"ovs-vsctl del-br br-sflow", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	aa.Flush()
+
+	intf1 := hostname + "[Type=host]/sflow-vm1[Type=netns]/sflow-intf1[Type=internal]"
+	intf2 := hostname + "[Type=host]/sflow-vm2[Type=netns]/sflow-intf2[Type=internal]"
+
+	ok := false
+	for _, f := range ts.GetFlows() {
+		if f.LayersPath != "Ethernet/IPv4/ICMPv4/Payload" {
+			continue
+		}
+
+		if (f.IfSrcGraphPath == intf1 && f.IfDstGraphPath == intf2) || (f.IfSrcGraphPath == intf2 && f.IfDstGraphPath == intf1) {
+			ok = true
+			break
+		}
+	}
+
+	if !ok {
+		t.Errorf("Unable to find flows with the expected interfaces: %v\n %s", ts.GetFlows(), aa.Agent.Graph.String())
+	}
+
+	stats, _ := common.GetMetric("sflow_ports")
+	attributed := false
+	for _, s := range stats.(map[string]sflow.SFlowPortStats) {
+		if s.Attributed > 0 {
+			attributed = true
+		}
+	}
+
+	if !attributed {
+		t.Errorf("Samples should have been attributed through their ports: %v", stats)
+	}
+
+	client.Delete("capture", "*/br-sflow[Type=ovsbridge]")
+}
+
 func TestPCAPProbe(t *testing.T) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -552,3 +644,54 @@ func TestSFlowSrcDstPath(t *testing.T) {
 
 	client.Delete("capture", "*/br-sflow[Type=ovsbridge]")
 }
+
+func TestSFlowReadOnlyAgent(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ts := NewTestStorage()
+
+	aa := helper.NewAgentAnalyzerWithConfig(t, confAgentAnalyzer, ts, helper.HelperParams{"ReadOnly": true})
+	aa.Start()
+	defer aa.Stop()
+
+	setupCmds := []helper.Cmd{
+		{"ovs-vsctl add-br br-ro", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ovs-vsctl del-br br-ro", true},
+	}
+
+	helper.ExecCmds(t, setupCmds...)
+	defer helper.ExecCmds(t, tearDownCmds...)
+
+	time.Sleep(1 * time.Second)
+
+	// the analyzer knows the agent is read-only
+	client := api.NewCrudClientFromConfig(&http.AuthenticationOpts{})
+	capture := &api.Capture{ProbePath: hostname + "[Type=host]/br-ro[Type=ovsbridge]"}
+	if err := client.Create("capture", &capture); err == nil {
+		client.Delete("capture", capture.ProbePath)
+		t.Fatal("sFlow capture of a read-only agent should be refused by the analyzer")
+	}
+
+	// wildcard captures reach the agent which refuses to configure the bridge
+	capture = &api.Capture{ProbePath: "*/br-ro[Type=ovsbridge]"}
+	if err := client.Create("capture", &capture); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Delete("capture", capture.ProbePath)
+
+	time.Sleep(2 * time.Second)
+
+	output, err := exec.Command("ovs-vsctl", "get", "bridge", "br-ro", "sflow").Output()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conf := strings.TrimSpace(string(output)); conf != "[]" {
+		t.Errorf("sFlow shouldn't be configured by a read-only agent, got: %s", conf)
+	}
+}
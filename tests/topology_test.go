@@ -62,6 +62,10 @@ sflow:
 ovs:
   ovsdb: 6400
 
+graph:
+  schema:
+    strict: true
+
 etcd:
   embedded: true
   port: 2374
@@ -472,6 +476,56 @@ func TestInterfaceOVS(t *testing.T) {
 	testCleanup(t, g, tearDownCmds, []string{"br-test1", "intf1"})
 }
 
+func TestUserspaceOVS(t *testing.T) {
+	g := newGraph(t)
+
+	agent := helper.StartAgentWithConfig(t, confTopology)
+	defer agent.Stop()
+
+	// the netdev datapath with a dummy port, never reported by netlink as
+	// the DPDK ports
+	setupCmds := []helper.Cmd{
+		{"ovs-vsctl add-br br-test1 -- set bridge br-test1 datapath_type=netdev", true},
+		{"ovs-vsctl add-port br-test1 dummy1 -- set interface dummy1 type=dummy options:n_rxq=2", true},
+	}
+
+	tearDownCmds := []helper.Cmd{
+		{"ovs-vsctl del-br br-test1", true},
+	}
+
+	testPassed := false
+	onChange := func(ws *websocket.Conn) {
+		g.Lock()
+		defer g.Unlock()
+
+		if !testPassed && len(g.GetNodes()) >= 5 && len(g.GetEdges()) >= 4 {
+			if g.LookupFirstNode(graph.Metadata{"Name": "br-test1", "Type": "ovsbridge", "DatapathType": "netdev"}) == nil {
+				return
+			}
+
+			intf := g.LookupFirstNode(graph.Metadata{"Type": "dummy", "Name": "dummy1", "Driver": "openvswitch"})
+			if intf == nil || intf.Metadata()["RxQueues"] != float64(2) {
+				return
+			}
+
+			if len(g.LookupParentNodes(intf, graph.Metadata{"Type": "host"})) != 1 {
+				return
+			}
+
+			testPassed = true
+
+			ws.Close()
+		}
+	}
+
+	testTopology(t, g, setupCmds, onChange)
+	if !testPassed {
+		t.Error("test not executed or failed")
+	}
+
+	testCleanup(t, g, tearDownCmds, []string{"br-test1", "dummy1"})
+}
+
 func TestBondOVS(t *testing.T) {
 	g := newGraph(t)
 
@@ -504,6 +558,12 @@ func TestBondOVS(t *testing.T) {
 					return
 				}
 
+				// defaults of ovs-vsctl add-bond
+				m := bond.Metadata()
+				if m["BondMode"] != "active-backup" || m["LACP"] != "off" {
+					return
+				}
+
 				testPassed = true
 
 				ws.Close()
@@ -26,12 +26,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"go/token"
+	"strings"
 	"sync"
 	"time"
 
 	eval "github.com/sbinet/go-eval"
 
 	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
@@ -49,6 +52,35 @@ type AlertManager struct {
 	alerts         map[string]*api.Alert
 	alertsLock     sync.RWMutex
 	eventListeners map[AlertEventListener]AlertEventListener
+	variables      []NodeVariables
+	subscription   *common.BusSubscription
+	// hosts draining, ie. restarted for an upgrade, whose alerts are
+	// suppressed until the end of the drain window
+	drains      map[string]time.Time
+	DrainWindow time.Duration
+	Clock       common.Clock
+	// durations of the alerts having a For, the nodes passing their tests
+	// being held until they passed them for the duration
+	durations map[string]time.Duration
+	held      map[string]*heldNode
+	heldLock  sync.Mutex
+	wheel     *common.TimerWheel
+}
+
+// heldNode is a node passing the test of an alert having a For duration,
+// the alert firing once the node passed it for the duration
+type heldNode struct {
+	since time.Time
+	fired bool
+}
+
+// resolution of the For durations
+const wheelTick = 100 * time.Millisecond
+
+// NodeVariables gives variables, other than the metadata, to the alert
+// tests of a node, ie. the churn rates of its host.
+type NodeVariables interface {
+	NodeVariables(n *graph.Node) map[string]interface{}
 }
 
 type AlertMessage struct {
@@ -87,79 +119,356 @@ func (a *AlertManager) DelEventListener(l AlertEventListener) {
 	delete(a.eventListeners, l)
 }
 
-func (a *AlertManager) EvalNodes() {
-	a.alertsLock.RLock()
-	defer a.alertsLock.RUnlock()
+// AddNodeVariables adds variables to the alert tests, the metadata of the
+// node take precedence.
+func (a *AlertManager) AddNodeVariables(v NodeVariables) {
+	a.alertsLock.Lock()
+	defer a.alertsLock.Unlock()
+
+	a.variables = append(a.variables, v)
+}
+
+// EventVariables gives the variables of the events published on the bus,
+// other than the graph ones, to the tests of the alerts selecting their
+// type, ie. the PathBroken events.
+type EventVariables interface {
+	EventVariables() map[string]interface{}
+}
+
+// test evaluates the test of the alert with the given variables, the
+// values of the nested metadata being given as Parent_Child, ie.
+// Downtime_Current
+func (a *AlertManager) test(al *api.Alert, variables ...map[string]interface{}) bool {
+	w := eval.NewWorld()
+	defined := make(map[string]bool)
+
+	var define func(k string, v interface{})
+	define = func(k string, v interface{}) {
+		if defined[k] {
+			return
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range nested {
+				define(k+"_"+nk, nv)
+			}
+		}
+		t, val := toTypeValue(v)
+		w.DefineConst(k, t, val)
+		defined[k] = true
+	}
+
+	for _, vars := range variables {
+		for k, v := range vars {
+			define(k, v)
+		}
+	}
+
+	fs := token.NewFileSet()
+	toEval := "(" + al.Test + ") == true"
+	expr, err := w.Compile(fs, toEval)
+	if err != nil {
+		logging.GetLogger().Error("Can't compile expression : " + toEval)
+		return false
+	}
+	ret, err := expr.Run()
+	if err != nil {
+		logging.GetLogger().Error("Can't evaluate expression : " + toEval)
+		return false
+	}
+
+	return ret.String() == "true"
+}
+
+// fire sends the alert message to the listeners, has to be called with the
+// alerts lock held
+func (a *AlertManager) fire(al *api.Alert, data interface{}) {
+	al.Count++
+
+	msg := AlertMessage{
+		UUID:       al.UUID,
+		Type:       FIXED,
+		Timestamp:  time.Now(),
+		Count:      al.Count,
+		Reason:     al.Action,
+		ReasonData: data,
+	}
+
+	logging.GetLogger().Debugf("AlertMessage to WS : " + al.UUID + " " + msg.String())
+	for _, l := range a.eventListeners {
+		l.OnAlert(&msg)
+	}
+}
+
+// evalNodes calls the callback with the nodes of the graph passing the
+// tests of the alerts, has to be called with the alerts lock held
+func (a *AlertManager) evalNodes(g *graph.Graph, cb func(al *api.Alert, n *graph.Node)) {
+	now := a.Clock.Now()
 
 	for _, al := range a.alerts {
-		nodes := a.Graph.LookupNodesFromKey(al.Select)
+		nodes := g.LookupNodesFromKey(al.Select)
 		for _, n := range nodes {
-			w := eval.NewWorld()
-			defConst := func(name string, val interface{}) {
-				t, v := toTypeValue(val)
-				w.DefineConst(name, t, v)
-			}
-			for k, v := range n.Metadata() {
-				defConst(k, v)
-			}
-			fs := token.NewFileSet()
-			toEval := "(" + al.Test + ") == true"
-			expr, err := w.Compile(fs, toEval)
-			if err != nil {
-				logging.GetLogger().Error("Can't compile expression : " + toEval)
+			if a.draining(n.Host(), now) {
 				continue
 			}
-			ret, err := expr.Run()
-			if err != nil {
-				logging.GetLogger().Error("Can't evaluate expression : " + toEval)
-				continue
+
+			// the metadata of the node take precedence
+			variables := []map[string]interface{}{n.Metadata()}
+			for _, v := range a.variables {
+				variables = append(variables, v.NodeVariables(n))
 			}
 
-			if ret.String() == "true" {
-				al.Count++
-
-				msg := AlertMessage{
-					UUID:       al.UUID,
-					Type:       FIXED,
-					Timestamp:  time.Now(),
-					Count:      al.Count,
-					Reason:     al.Action,
-					ReasonData: n,
-				}
-
-				logging.GetLogger().Debugf("AlertMessage to WS : " + al.UUID + " " + msg.String())
-				for _, l := range a.eventListeners {
-					l.OnAlert(&msg)
-				}
+			if a.test(al, variables...) {
+				cb(al, n)
 			}
 		}
 	}
 }
 
+func heldKey(uuid string, id graph.Identifier) string {
+	return uuid + "/" + string(id)
+}
+
+// hold starts the duration of a node passing the test of an alert, the
+// alert firing at its end unless the test failed in between
+func (a *AlertManager) hold(al *api.Alert, n *graph.Node, d time.Duration) {
+	key := heldKey(al.UUID, n.ID)
+
+	a.heldLock.Lock()
+	defer a.heldLock.Unlock()
+
+	if _, ok := a.held[key]; ok {
+		return
+	}
+
+	now := a.Clock.Now()
+	a.held[key] = &heldNode{since: now}
+
+	uuid, id := al.UUID, n.ID
+	a.wheel.Schedule(key, now.Add(d), func() {
+		a.fireHeld(uuid, id)
+	})
+}
+
+// fireHeld fires an alert whose node passed the test for its duration,
+// called by the timer wheel
+func (a *AlertManager) fireHeld(uuid string, id graph.Identifier) {
+	a.Graph.RLock()
+	defer a.Graph.RUnlock()
+
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	a.heldLock.Lock()
+	h, ok := a.held[heldKey(uuid, id)]
+	if !ok || h.fired {
+		a.heldLock.Unlock()
+		return
+	}
+	h.fired = true
+	a.heldLock.Unlock()
+
+	al, ok := a.alerts[uuid]
+	n := a.Graph.GetNode(id)
+	if !ok || n == nil {
+		return
+	}
+
+	logging.GetLogger().Debugf("Alert %s passed on %s since %s", uuid, id, h.since)
+	a.fire(al, n)
+}
+
+// release forgets the held nodes whose key matches, their pending
+// timers being canceled
+func (a *AlertManager) release(match func(key string) bool) {
+	a.heldLock.Lock()
+	defer a.heldLock.Unlock()
+
+	for key := range a.held {
+		if match(key) {
+			a.wheel.Cancel(key)
+			delete(a.held, key)
+		}
+	}
+}
+
+func (a *AlertManager) EvalNodes() {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	passing := make(map[string]bool)
+	a.evalNodes(a.Graph, func(al *api.Alert, n *graph.Node) {
+		if d := a.durations[al.UUID]; d > 0 {
+			a.hold(al, n, d)
+			passing[heldKey(al.UUID, n.ID)] = true
+			return
+		}
+		a.fire(al, n)
+	})
+
+	// the nodes not passing anymore, or not selected anymore
+	a.release(func(key string) bool {
+		return !passing[key]
+	})
+}
+
+// AlertMatch is a node passing the test of an alert
+type AlertMatch struct {
+	UUID string
+	Name string
+	Node graph.Identifier
+}
+
+// Matches evaluates the alerts on the nodes of a graph, ie. a view of the
+// graph of the manager, returning the nodes passing their tests without
+// firing the alerts. The graph has to be locked.
+func (a *AlertManager) Matches(g *graph.Graph) []AlertMatch {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	var matches []AlertMatch
+	a.evalNodes(g, func(al *api.Alert, n *graph.Node) {
+		matches = append(matches, AlertMatch{UUID: al.UUID, Name: al.Name, Node: n.ID})
+	})
+	return matches
+}
+
+// EvalEvent evaluates the alerts selecting the type of the event
+func (a *AlertManager) EvalEvent(eventType string, e EventVariables) {
+	a.alertsLock.RLock()
+	defer a.alertsLock.RUnlock()
+
+	for _, al := range a.alerts {
+		if al.Select == eventType && a.test(al, e.EventVariables()) {
+			a.fire(al, e)
+		}
+	}
+}
+
 func (a *AlertManager) OnNodeUpdated(n *graph.Node) {
+	a.trackDrain(n)
 	a.EvalNodes()
 }
 
 func (a *AlertManager) OnNodeAdded(n *graph.Node) {
+	a.trackDrain(n)
 	a.EvalNodes()
 }
 
+// OnNodeDeleted evaluates the alerts as the deletion rates are part of the
+// variables of the tests.
+func (a *AlertManager) OnNodeDeleted(n *graph.Node) {
+	suffix := "/" + string(n.ID)
+	a.release(func(key string) bool {
+		return strings.HasSuffix(key, suffix)
+	})
+
+	a.alertsLock.RLock()
+	withVariables := len(a.variables) > 0
+	a.alertsLock.RUnlock()
+
+	if withVariables {
+		a.EvalNodes()
+	}
+}
+
+// draining returns whether the alerts of the host are suppressed, has to be
+// called with the alerts lock held
+func (a *AlertManager) draining(host string, now time.Time) bool {
+	end, ok := a.drains[host]
+	return ok && now.Before(end)
+}
+
+// trackDrain starts the drain window of a host when its node gets flagged
+// with Draining by its agent
+func (a *AlertManager) trackDrain(n *graph.Node) {
+	if draining, _ := n.Metadata()["Draining"].(bool); !draining {
+		return
+	}
+
+	a.alertsLock.Lock()
+	defer a.alertsLock.Unlock()
+
+	now := a.Clock.Now()
+	if !a.draining(n.Host(), now) {
+		logging.GetLogger().Infof("Host %s draining, alerts suppressed for %s", n.Host(), a.DrainWindow)
+		a.drains[n.Host()] = now.Add(a.DrainWindow)
+	}
+
+	// forget the windows which ended
+	for host, end := range a.drains {
+		if !now.Before(end) {
+			delete(a.drains, host)
+		}
+	}
+}
+
+// OnBusEvent evaluates the alerts on the graph and path events taken from
+// the bus, outside of the graph listeners so that the graph updates aren't
+// slowed down by the tests.
+func (a *AlertManager) OnBusEvent(e *common.BusEvent) {
+	if ev, ok := e.Obj.(EventVariables); ok {
+		a.EvalEvent(e.Type, ev)
+		return
+	}
+
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != a.Graph {
+		return
+	}
+
+	a.Graph.RLock()
+	defer a.Graph.RUnlock()
+
+	switch e.Type {
+	case "NodeUpdated":
+		a.OnNodeUpdated(ev.Node)
+	case "NodeAdded":
+		a.OnNodeAdded(ev.Node)
+	case "NodeDeleted":
+		a.OnNodeDeleted(ev.Node)
+	}
+}
+
 func (a *AlertManager) SetAlert(at *api.Alert) {
 	logging.GetLogger().Debugf("New alert added: %v", at)
 
+	d, err := at.Duration()
+	if err != nil {
+		logging.GetLogger().Errorf("Alert %s left aside, invalid For: %s", at.UUID, err.Error())
+		a.DeleteAlert(at.UUID)
+		return
+	}
+
+	// the nodes held with the previous definition start again
+	a.releaseAlert(at.UUID)
+
 	a.alertsLock.Lock()
 	defer a.alertsLock.Unlock()
 
 	a.alerts[at.UUID] = at
+	if d > 0 {
+		a.durations[at.UUID] = d
+	} else {
+		delete(a.durations, at.UUID)
+	}
+}
+
+func (a *AlertManager) releaseAlert(uuid string) {
+	a.release(func(key string) bool {
+		return strings.HasPrefix(key, uuid+"/")
+	})
 }
 
 func (a *AlertManager) DeleteAlert(id string) {
 	logging.GetLogger().Debugf("Alert deleted: %s", id)
 
+	a.releaseAlert(id)
+
 	a.alertsLock.Lock()
 	defer a.alertsLock.Unlock()
 
 	delete(a.alerts, id)
+	delete(a.durations, id)
 }
 
 func (a *AlertManager) onApiWatcherEvent(action string, id string, resource api.ApiResource) {
@@ -174,11 +483,18 @@ func (a *AlertManager) onApiWatcherEvent(action string, id string, resource api.
 func (a *AlertManager) Start() {
 	a.watcher = a.AlertHandler.AsyncWatch(a.onApiWatcherEvent)
 
-	a.Graph.AddEventListener(a)
+	a.subscription = common.DefaultBus.Subscribe("alerts", config.GetConfig().GetInt("graph.bus.queue_size"), a, common.GraphTopic, common.PathTopic)
+
+	a.wheel.Clock = a.Clock
+	a.wheel.Start()
 }
 
 func (a *AlertManager) Stop() {
+	if a.subscription != nil {
+		common.DefaultBus.Unsubscribe(a.subscription)
+	}
 
+	a.wheel.Stop()
 }
 
 func NewAlertManager(g *graph.Graph, ah api.ApiHandler) *AlertManager {
@@ -187,6 +503,14 @@ func NewAlertManager(g *graph.Graph, ah api.ApiHandler) *AlertManager {
 		AlertHandler:   ah,
 		alerts:         make(map[string]*api.Alert),
 		eventListeners: make(map[AlertEventListener]AlertEventListener),
+		drains:         make(map[string]time.Time),
+		DrainWindow:    time.Duration(config.GetConfig().GetInt("analyzer.drain.window")) * time.Second,
+		Clock:          common.RealClock{},
+		durations:      make(map[string]time.Duration),
+		held:           make(map[string]*heldNode),
+		// a turn of a minute, the longer durations being looked at once
+		// per turn
+		wheel: common.NewTimerWheel(wheelTick, 600, common.RealClock{}),
 	}
 }
 
@@ -328,6 +652,9 @@ func toTypeValue(val interface{}) (eval.Type, eval.Value) {
 	case int:
 		r := intV(val)
 		return eval.Int64Type, &r
+	case int64:
+		r := int64V(val)
+		return eval.Int64Type, &r
 	case float64:
 		r := float64V(val)
 		return eval.Float64Type, &r
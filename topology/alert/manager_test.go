@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type alertRecorder struct {
+	msgs []*AlertMessage
+}
+
+func (r *alertRecorder) OnAlert(msg *AlertMessage) {
+	r.msgs = append(r.msgs, msg)
+}
+
+func TestAlertDuration(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := common.NewFakeClock(time.Now())
+	a := NewAlertManager(g, nil)
+	a.Clock = clock
+	recorder := &alertRecorder{}
+	a.AddEventListener(recorder)
+
+	a.SetAlert(&api.Alert{UUID: "down", Select: "State", Test: `State == "DOWN"`, For: "5m"})
+	a.SetAlert(&api.Alert{UUID: "total", Select: "Downtime", Test: `Downtime_Total24h > 600`})
+
+	setState := func(n *graph.Node, state string) {
+		g.Lock()
+		g.AddMetadata(n, "State", state)
+		a.EvalNodes()
+		g.Unlock()
+	}
+	advance := func(d time.Duration) {
+		clock.Advance(d)
+		a.wheel.Advance(clock.Now())
+	}
+
+	g.Lock()
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "State": "UP"})
+	g.Unlock()
+
+	// a flapping interface doesn't pile up timers
+	for i := 0; i < 100; i++ {
+		setState(n, "DOWN")
+		advance(time.Minute)
+		setState(n, "UP")
+	}
+	if len(recorder.msgs) != 0 || a.wheel.Pending() != 0 || len(a.held) != 0 {
+		t.Fatalf("No alert nor timer expected, got %d alerts and %d timers", len(recorder.msgs), a.wheel.Pending())
+	}
+
+	// fires when the threshold is crossed, without graph event
+	setState(n, "DOWN")
+	advance(5*time.Minute - time.Second)
+	if len(recorder.msgs) != 0 {
+		t.Fatal("Alert fired before its duration")
+	}
+	advance(time.Second)
+	if len(recorder.msgs) != 1 || recorder.msgs[0].UUID != "down" {
+		t.Fatalf("Alert expected to fire once the duration passed: %v", recorder.msgs)
+	}
+
+	// only once while the test passes
+	setState(n, "DOWN")
+	g.Lock()
+	g.AddMetadata(n, "MTU", 1500)
+	a.EvalNodes()
+	g.Unlock()
+	advance(10 * time.Minute)
+	if len(recorder.msgs) != 1 {
+		t.Fatalf("Alert expected to fire once: %v", recorder.msgs)
+	}
+
+	// the nested metadata are given to the tests
+	g.Lock()
+	g.AddMetadata(n, "Downtime", map[string]interface{}{"Current": int64(900), "Total24h": int64(900)})
+	a.EvalNodes()
+	g.Unlock()
+	if len(recorder.msgs) != 2 || recorder.msgs[1].UUID != "total" {
+		t.Fatalf("Alert on the total downtime expected: %v", recorder.msgs)
+	}
+
+	// deleting the node forgets it
+	setState(n, "UP")
+	setState(n, "DOWN")
+	g.Lock()
+	g.DelNode(n)
+	a.OnNodeDeleted(n)
+	g.Unlock()
+	if a.wheel.Pending() != 0 {
+		t.Errorf("No timer expected once the node deleted, got %d", a.wheel.Pending())
+	}
+}
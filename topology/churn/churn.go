@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package churn
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const (
+	Adds    = "Adds"
+	Deletes = "Deletes"
+	Updates = "Updates"
+
+	// the probes of a host beyond this number are accounted as "other"
+	maxProbesPerHost = 16
+	otherProbe       = "other"
+	// number of buckets of a rolling window
+	windowBuckets = 12
+)
+
+var operations = []string{Adds, Deletes, Updates}
+
+// probe names usable in the alert test variable names
+var variableSuffix = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// node types created by another probe than the netlink ones, the nodes of
+// a probe managing namespaces, ie. docker, are flagged by the Manager key
+var typeProbes = map[string]string{
+	topology.HostType:      "agent",
+	topology.NetNSType:     "netns",
+	topology.OvsBridgeType: "ovsdb",
+	topology.OvsPortType:   "ovsdb",
+}
+
+// probeOf returns the name of the probe that most likely created the node,
+// the graph doesn't record it.
+func probeOf(n *graph.Node) string {
+	m := n.Metadata()
+	if manager, ok := m["Manager"].(string); ok && manager != "" {
+		return manager
+	}
+	if t, ok := m["Type"].(string); ok {
+		if probe, ok := typeProbes[t]; ok {
+			return probe
+		}
+	}
+	return "netlink"
+}
+
+type rates map[string]*common.RateWindow
+
+type hostRates struct {
+	total  rates
+	probes map[string]rates
+}
+
+// ChurnRates are the rates, in events per minute, of the node additions,
+// deletions and updates of a host.
+type ChurnRates struct {
+	Adds    float64
+	Deletes float64
+	Updates float64
+	Probes  map[string]*ChurnRates `json:",omitempty"`
+}
+
+// ChurnTracker keeps rolling windows of the node events per host and per
+// probe, the memory used per host being bounded. Hosts without any event
+// during the window are forgotten.
+type ChurnTracker struct {
+	sync.RWMutex
+	graph.DefaultGraphListener
+	Graph  *graph.Graph
+	Window time.Duration
+	Clock  common.Clock
+	hosts  map[string]*hostRates
+}
+
+func (c *ChurnTracker) newRates() rates {
+	r := make(rates)
+	for _, op := range operations {
+		r[op] = common.NewRateWindow(c.Window, windowBuckets)
+	}
+	return r
+}
+
+func (r rates) expired(now time.Time) bool {
+	for _, w := range r {
+		if !w.Expired(now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r rates) churnRates(now time.Time) *ChurnRates {
+	return &ChurnRates{
+		Adds:    r[Adds].Rate(now),
+		Deletes: r[Deletes].Rate(now),
+		Updates: r[Updates].Rate(now),
+	}
+}
+
+// sweep forgets the hosts and probes without events during the window
+func (c *ChurnTracker) sweep(now time.Time) {
+	for host, h := range c.hosts {
+		if h.total.expired(now) {
+			delete(c.hosts, host)
+			continue
+		}
+		for probe, r := range h.probes {
+			if r.expired(now) {
+				delete(h.probes, probe)
+			}
+		}
+	}
+}
+
+func (c *ChurnTracker) record(n *graph.Node, op string) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.Clock.Now()
+
+	h, ok := c.hosts[n.Host()]
+	if !ok {
+		c.sweep(now)
+
+		h = &hostRates{total: c.newRates(), probes: make(map[string]rates)}
+		c.hosts[n.Host()] = h
+	}
+
+	probe := probeOf(n)
+	r, ok := h.probes[probe]
+	if !ok {
+		if len(h.probes) >= maxProbesPerHost-1 {
+			probe = otherProbe
+		}
+		if r, ok = h.probes[probe]; !ok {
+			r = c.newRates()
+			h.probes[probe] = r
+		}
+	}
+
+	h.total[op].Add(now, 1)
+	r[op].Add(now, 1)
+}
+
+func (c *ChurnTracker) OnNodeAdded(n *graph.Node) {
+	c.record(n, Adds)
+}
+
+func (c *ChurnTracker) OnNodeDeleted(n *graph.Node) {
+	c.record(n, Deletes)
+}
+
+func (c *ChurnTracker) OnNodeUpdated(n *graph.Node) {
+	c.record(n, Updates)
+}
+
+// HostRates returns the rates of the given host, nil if the host had no
+// event during the window.
+func (c *ChurnTracker) HostRates(host string) *ChurnRates {
+	c.RLock()
+	defer c.RUnlock()
+
+	h, ok := c.hosts[host]
+	if !ok {
+		return nil
+	}
+
+	now := c.Clock.Now()
+
+	cr := h.total.churnRates(now)
+	cr.Probes = make(map[string]*ChurnRates)
+	for probe, r := range h.probes {
+		cr.Probes[probe] = r.churnRates(now)
+	}
+	return cr
+}
+
+// NodeVariables gives the rates of the host of the node to the alert tests,
+// ie. ChurnDeletes for the host and ChurnDeletes_netlink for a probe.
+func (c *ChurnTracker) NodeVariables(n *graph.Node) map[string]interface{} {
+	vars := make(map[string]interface{})
+
+	cr := c.HostRates(n.Host())
+	if cr == nil {
+		cr = &ChurnRates{}
+	}
+
+	set := func(suffix string, r *ChurnRates) {
+		vars["ChurnAdds"+suffix] = r.Adds
+		vars["ChurnDeletes"+suffix] = r.Deletes
+		vars["ChurnUpdates"+suffix] = r.Updates
+	}
+	set("", cr)
+	for probe, r := range cr.Probes {
+		if variableSuffix.MatchString(probe) {
+			set("_"+probe, r)
+		}
+	}
+
+	return vars
+}
+
+func (c *ChurnTracker) Metrics() interface{} {
+	c.Lock()
+	c.sweep(c.Clock.Now())
+	hosts := make([]string, 0, len(c.hosts))
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	c.Unlock()
+
+	metrics := make(map[string]*ChurnRates)
+	for _, host := range hosts {
+		if cr := c.HostRates(host); cr != nil {
+			metrics[host] = cr
+		}
+	}
+	return metrics
+}
+
+func (c *ChurnTracker) Start() {
+	c.Graph.AddEventListener(c)
+	common.RegisterMetrics("churn", c.Metrics)
+}
+
+func (c *ChurnTracker) Stop() {
+	common.UnregisterMetrics("churn")
+	c.Graph.RemoveEventListener(c)
+}
+
+func NewChurnTracker(g *graph.Graph, window time.Duration) *ChurnTracker {
+	return &ChurnTracker{
+		Graph:  g,
+		Window: window,
+		Clock:  common.RealClock{},
+		hosts:  make(map[string]*hostRates),
+	}
+}
+
+// NewChurnTrackerFromConfig returns nil if the tracking is disabled
+func NewChurnTrackerFromConfig(g *graph.Graph) *ChurnTracker {
+	window := time.Duration(config.GetConfig().GetInt("analyzer.churn.window")) * time.Second
+	if window <= 0 {
+		return nil
+	}
+	return NewChurnTracker(g, window)
+}
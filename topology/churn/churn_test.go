@@ -0,0 +1,266 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package churn
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type alertRecorder struct {
+	messages []*alert.AlertMessage
+}
+
+func (r *alertRecorder) OnAlert(msg *alert.AlertMessage) {
+	r.messages = append(r.messages, msg)
+}
+
+// generateChurn adds and deletes interfaces of the host, as a crash looping
+// CNI would, and flaps the given number of OVS ports
+func generateChurn(g *graph.Graph, host *graph.Node, interfaces int, ports int) {
+	g.Lock()
+	defer g.Unlock()
+
+	for i := 0; i < interfaces; i++ {
+		n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "Name": fmt.Sprintf("veth%d", i)})
+		g.Link(host, n, graph.Metadata{"RelationType": "ownership"})
+		g.DelNode(n)
+	}
+
+	for i := 0; i < ports; i++ {
+		n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "ovsport", "Name": fmt.Sprintf("port%d", i)})
+		g.AddMetadata(n, "State", "DOWN")
+	}
+}
+
+type busRecorder struct {
+	events []string
+}
+
+func (r *busRecorder) OnBusEvent(e *common.BusEvent) {
+	r.events = append(r.events, e.Type)
+}
+
+func TestChurnAlert(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+
+	tracker := NewChurnTracker(g, time.Minute)
+	tracker.Clock = clock
+	tracker.Start()
+	defer tracker.Stop()
+
+	am := alert.NewAlertManager(g, nil)
+	am.AddNodeVariables(tracker)
+	g.AddEventListener(am)
+
+	recorder := &alertRecorder{}
+	am.AddEventListener(recorder)
+
+	al := api.NewAlert()
+	al.Select = "Type"
+	al.Test = `Type == "host" && ChurnDeletes_netlink > 100`
+	am.SetAlert(al)
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1"})
+	g.Unlock()
+
+	generateChurn(g, host, 50, 10)
+	if len(recorder.messages) != 0 {
+		t.Fatalf("Alert fired below the threshold: %+v", recorder.messages)
+	}
+
+	rates := tracker.HostRates(host.Host())
+	if rates == nil || rates.Adds != 61 || rates.Deletes != 50 || rates.Updates != 10 {
+		t.Fatalf("Wrong host rates: %+v", rates)
+	}
+	if r := rates.Probes["netlink"]; r == nil || r.Adds != 50 || r.Deletes != 50 {
+		t.Errorf("Wrong netlink rates: %+v", r)
+	}
+	if r := rates.Probes["ovsdb"]; r == nil || r.Adds != 10 || r.Updates != 10 || r.Deletes != 0 {
+		t.Errorf("Wrong ovsdb rates: %+v", r)
+	}
+	if r := rates.Probes["agent"]; r == nil || r.Adds != 1 {
+		t.Errorf("Wrong agent rates: %+v", r)
+	}
+
+	// half a window later, the deletions add up
+	clock.Advance(30 * time.Second)
+	generateChurn(g, host, 60, 0)
+
+	if len(recorder.messages) == 0 {
+		t.Fatal("Alert not fired with more than 100 deletions per minute")
+	}
+	if msg := recorder.messages[0]; msg.UUID != al.UUID || msg.ReasonData.(*graph.Node).ID != host.ID {
+		t.Errorf("Wrong alert message: %+v", msg)
+	}
+
+	// the first burst left the window
+	clock.Advance(45 * time.Second)
+	if rates = tracker.HostRates(host.Host()); rates == nil || rates.Deletes != 60 {
+		t.Errorf("Expected only the second burst in the window: %+v", rates)
+	}
+
+	clock.Advance(time.Minute)
+	if metrics := tracker.Metrics().(map[string]*ChurnRates); len(metrics) != 0 {
+		t.Errorf("Idle host not forgotten: %+v", metrics)
+	}
+}
+
+func TestChurnAlertDraining(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+
+	tracker := NewChurnTracker(g, time.Minute)
+	tracker.Clock = clock
+	tracker.Start()
+	defer tracker.Stop()
+
+	am := alert.NewAlertManager(g, nil)
+	am.Clock = clock
+	am.DrainWindow = 5 * time.Minute
+	am.AddNodeVariables(tracker)
+	g.AddEventListener(am)
+
+	recorder := &alertRecorder{}
+	am.AddEventListener(recorder)
+
+	al := api.NewAlert()
+	al.Select = "Type"
+	al.Test = `Type == "host" && ChurnDeletes > 100`
+	am.SetAlert(al)
+
+	// the agent is restarted after having been drained
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1"})
+	g.AddMetadata(host, "Draining", true)
+	g.Unlock()
+
+	generateChurn(g, host, 150, 0)
+	if len(recorder.messages) != 0 {
+		t.Fatalf("Alert fired while the host was draining: %+v", recorder.messages)
+	}
+
+	clock.Advance(5 * time.Minute)
+	generateChurn(g, host, 150, 0)
+	if len(recorder.messages) == 0 {
+		t.Error("Alert not fired after the drain window")
+	}
+}
+
+func TestChurnGraphLimits(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	recorder := &busRecorder{}
+	subscription := common.DefaultBus.Subscribe("limits_test", 100, recorder, common.AgentTopic)
+	defer common.DefaultBus.Unsubscribe(subscription)
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1"})
+	g.SetSizeLimits(&graph.SizeLimits{MaxNodes: 100, MaxEdges: 200, Priority: topology.NodePriority, Root: host.ID})
+
+	// a runaway probe creating interfaces without ever deleting them
+	var created []*graph.Node
+	for i := 0; i < 500; i++ {
+		if n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "Name": fmt.Sprintf("veth%d", i)}); n != nil {
+			g.Link(host, n, graph.Metadata{"RelationType": "ownership"})
+			created = append(created, n)
+		}
+	}
+	g.Unlock()
+
+	// the graph plateaus at the limit of the interfaces, keeping room for
+	// the structure of the host
+	m := g.Metrics().(graph.GraphMetrics)
+	if m.Nodes != 95 || m.SizeLimits == nil || m.SizeLimits.Nodes != 95 || m.SizeLimits.RefusedNodes != 500-94 || !m.SizeLimits.Reached {
+		t.Fatalf("Graph should plateau at the limit: %+v, %+v", m, m.SizeLimits)
+	}
+	if reached, _ := host.Metadata()[graph.GraphLimitReachedKey].(bool); !reached {
+		t.Error("Host should be flagged with GraphLimitReached")
+	}
+
+	g.Lock()
+	if g.NewNode(graph.GenID(), graph.Metadata{"Name": "stats-only"}) != nil {
+		t.Error("Node of the lowest priority should be refused")
+	}
+	if g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "Name": "ns1"}) == nil {
+		t.Error("Node of the highest priority should be created up to the maximum")
+	}
+
+	// the cause clears, the deletions always proceeding
+	for _, n := range created {
+		g.DelNode(n)
+	}
+
+	if g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "Name": "veth-new"}) == nil {
+		t.Error("Nodes should be created again once back under the limits")
+	}
+	g.Unlock()
+
+	m = g.Metrics().(graph.GraphMetrics)
+	if m.Nodes != 3 || m.Edges != 0 || m.SizeLimits.Reached {
+		t.Errorf("Graph should recover once the nodes are deleted: %+v, %+v", m, m.SizeLimits)
+	}
+	if _, ok := host.Metadata()[graph.GraphLimitReachedKey]; ok {
+		t.Error("GraphLimitReached flag should be cleared")
+	}
+
+	subscription.Flush()
+	if len(recorder.events) != 2 || recorder.events[0] != "GraphLimitReached" || recorder.events[1] != "GraphLimitCleared" {
+		t.Errorf("Expected GraphLimitReached then GraphLimitCleared events, got %v", recorder.events)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package downtime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// window of the cumulative downtime
+const window = 24 * time.Hour
+
+// maxPeriods bounds the downtimes kept per interface, the oldest ones
+// being merged, the time the interface was UP in between being counted,
+// so that a flapping interface doesn't grow without bound
+const maxPeriods = 256
+
+type period struct {
+	start time.Time
+	end   time.Time
+}
+
+type nodeDowntime struct {
+	down  bool
+	since time.Time
+	// downtimes ended during the window
+	periods []period
+	// whether the node holds the downtime metadata
+	written bool
+}
+
+func (d *nodeDowntime) setDown(down bool, now time.Time) {
+	if down == d.down {
+		return
+	}
+
+	d.down = down
+	if down {
+		d.since = now
+		return
+	}
+
+	d.periods = append(d.periods, period{start: d.since, end: now})
+	if len(d.periods) > maxPeriods {
+		d.periods[1].start = d.periods[0].start
+		d.periods = d.periods[1:]
+	}
+}
+
+// current returns the time since the interface went DOWN
+func (d *nodeDowntime) current(now time.Time) time.Duration {
+	if !d.down {
+		return 0
+	}
+	return now.Sub(d.since)
+}
+
+// total returns the time the interface was DOWN during the window,
+// forgetting the downtimes ended before
+func (d *nodeDowntime) total(now time.Time) time.Duration {
+	from := now.Add(-window)
+
+	var kept []period
+	var total time.Duration
+	for _, p := range d.periods {
+		if !p.end.After(from) {
+			continue
+		}
+		kept = append(kept, p)
+
+		if p.start.Before(from) {
+			total += p.end.Sub(from)
+		} else {
+			total += p.end.Sub(p.start)
+		}
+	}
+	d.periods = kept
+
+	if d.down {
+		if d.since.Before(from) {
+			total += now.Sub(from)
+		} else {
+			total += now.Sub(d.since)
+		}
+	}
+
+	return total
+}
+
+// DowntimeTracker accounts the time the interfaces are DOWN, from the
+// transitions of their State. The interfaces DOWN, or which were DOWN
+// during the last 24 hours, hold the seconds since they went DOWN as
+// Downtime.Current and the seconds they were DOWN during the last 24 hours
+// as Downtime.Total24h, refreshed every interval. The alert tests get them
+// as Downtime_Current and Downtime_Total24h.
+type DowntimeTracker struct {
+	sync.Mutex
+	Graph        *graph.Graph
+	Interval     time.Duration
+	Clock        common.Clock
+	nodes        map[graph.Identifier]*nodeDowntime
+	subscription *common.BusSubscription
+	quit         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// write sets the downtime metadata of a node, removed once the node is UP
+// and wasn't DOWN during the window, has to be called with the lock of the
+// tracker held
+func (d *DowntimeTracker) write(id graph.Identifier, nd *nodeDowntime, now time.Time) {
+	total := nd.total(now)
+
+	d.Graph.Lock()
+	defer d.Graph.Unlock()
+
+	n := d.Graph.GetNode(id)
+	if n == nil {
+		return
+	}
+
+	if !nd.down && total == 0 {
+		nd.written = false
+		if _, ok := n.Metadata()[topology.DowntimeKey]; ok {
+			m := make(graph.Metadata)
+			for k, v := range n.Metadata() {
+				if k != topology.DowntimeKey {
+					m[k] = v
+				}
+			}
+			d.Graph.SetMetadata(n, m)
+		}
+		return
+	}
+
+	nd.written = true
+	d.Graph.AddMetadata(n, topology.DowntimeKey, map[string]interface{}{
+		"Current":  int64(nd.current(now) / time.Second),
+		"Total24h": int64(total / time.Second),
+	})
+}
+
+// OnBusEvent tracks the states from the graph events, the metadata being
+// written again if replaced, ie. by a probe
+func (d *DowntimeTracker) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != d.Graph || ev.Node == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	switch e.Type {
+	case "NodeAdded", "NodeUpdated":
+		state, ok := ev.Node.Metadata()["State"].(string)
+		if !ok {
+			return
+		}
+		down := state == "DOWN"
+		now := d.Clock.Now()
+
+		nd, ok := d.nodes[ev.Node.ID]
+		if !ok {
+			nd = &nodeDowntime{}
+			d.nodes[ev.Node.ID] = nd
+		}
+
+		if nd.down != down {
+			nd.setDown(down, now)
+			d.write(ev.Node.ID, nd, now)
+			return
+		}
+
+		if _, ok := ev.Node.Metadata()[topology.DowntimeKey]; nd.written && !ok {
+			d.write(ev.Node.ID, nd, now)
+		}
+	case "NodeDeleted":
+		delete(d.nodes, ev.Node.ID)
+	}
+}
+
+// OnBusEventsDropped keeps the states, the next events of the nodes
+// catching up
+func (d *DowntimeTracker) OnBusEventsDropped(count int64) {
+}
+
+// refresh writes the downtimes of the nodes DOWN or which were DOWN during
+// the window
+func (d *DowntimeTracker) refresh() {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.Clock.Now()
+	for id, nd := range d.nodes {
+		if nd.down || nd.written {
+			d.write(id, nd, now)
+		}
+	}
+}
+
+func (d *DowntimeTracker) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.refresh()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *DowntimeTracker) Start() {
+	d.subscription = common.DefaultBus.Subscribe("downtime", config.GetConfig().GetInt("graph.bus.queue_size"), d, common.GraphTopic)
+
+	d.wg.Add(1)
+	go d.run()
+}
+
+func (d *DowntimeTracker) Stop() {
+	common.DefaultBus.Unsubscribe(d.subscription)
+
+	close(d.quit)
+	d.wg.Wait()
+}
+
+func NewDowntimeTracker(g *graph.Graph, interval time.Duration) *DowntimeTracker {
+	return &DowntimeTracker{
+		Graph:    g,
+		Interval: interval,
+		Clock:    common.RealClock{},
+		nodes:    make(map[graph.Identifier]*nodeDowntime),
+		quit:     make(chan struct{}),
+	}
+}
+
+// NewDowntimeTrackerFromConfig returns nil if the tracking is disabled
+func NewDowntimeTrackerFromConfig(g *graph.Graph) *DowntimeTracker {
+	interval := time.Duration(config.GetConfig().GetInt("agent.topology.downtime.interval")) * time.Second
+	if interval <= 0 {
+		return nil
+	}
+	return NewDowntimeTracker(g, interval)
+}
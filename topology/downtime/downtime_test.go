@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package downtime
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func setState(d *DowntimeTracker, n *graph.Node, state string) {
+	d.Graph.Lock()
+	d.Graph.AddMetadata(n, "State", state)
+	d.Graph.Unlock()
+
+	d.subscription.Flush()
+}
+
+func downtime(d *DowntimeTracker, n *graph.Node) interface{} {
+	d.Graph.RLock()
+	defer d.Graph.RUnlock()
+
+	return n.Metadata()[topology.DowntimeKey]
+}
+
+func TestDowntimeTracker(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := common.NewFakeClock(time.Now())
+	d := NewDowntimeTracker(g, time.Hour)
+	d.Clock = clock
+	d.Start()
+	defer d.Stop()
+
+	g.Lock()
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "State": "UP"})
+	g.Unlock()
+	d.subscription.Flush()
+
+	if downtime(d, n) != nil {
+		t.Errorf("No downtime expected: %v", downtime(d, n))
+	}
+
+	setState(d, n, "DOWN")
+	clock.Advance(90 * time.Second)
+	d.refresh()
+	if dt := downtime(d, n); !reflect.DeepEqual(dt, map[string]interface{}{"Current": int64(90), "Total24h": int64(90)}) {
+		t.Errorf("Wrong downtime: %v", dt)
+	}
+
+	setState(d, n, "UP")
+	clock.Advance(time.Hour)
+	setState(d, n, "DOWN")
+	clock.Advance(30 * time.Second)
+	d.refresh()
+	if dt := downtime(d, n); !reflect.DeepEqual(dt, map[string]interface{}{"Current": int64(30), "Total24h": int64(120)}) {
+		t.Errorf("Wrong downtime: %v", dt)
+	}
+
+	// the metadata replaced are written again
+	g.Lock()
+	g.SetMetadata(n, graph.Metadata{"Type": "veth", "State": "DOWN"})
+	g.Unlock()
+	d.subscription.Flush()
+	if downtime(d, n) == nil {
+		t.Error("Downtime expected to be written again")
+	}
+
+	// the first downtime leaves the window
+	setState(d, n, "UP")
+	clock.Advance(window - 30*time.Second)
+	d.refresh()
+	if dt := downtime(d, n); !reflect.DeepEqual(dt, map[string]interface{}{"Current": int64(0), "Total24h": int64(30)}) {
+		t.Errorf("Wrong downtime: %v", dt)
+	}
+
+	clock.Advance(time.Hour)
+	d.refresh()
+	if downtime(d, n) != nil {
+		t.Errorf("Downtime expected to be removed: %v", downtime(d, n))
+	}
+
+	// a flapping interface keeps a bounded number of downtimes
+	for i := 0; i < 2*maxPeriods; i++ {
+		setState(d, n, "DOWN")
+		clock.Advance(time.Second)
+		setState(d, n, "UP")
+	}
+	d.Lock()
+	if periods := len(d.nodes[n.ID].periods); periods != maxPeriods {
+		t.Errorf("Expected %d downtimes kept, got %d", maxPeriods, periods)
+	}
+	d.Unlock()
+}
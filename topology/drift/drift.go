@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package drift
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Drift of the live nodes differing from the baseline
+const (
+	DriftExtra   = "extra"
+	DriftChanged = "changed"
+)
+
+// NodeDrift is the drift of a live node, extra for the nodes not in the
+// baseline, changed along with the fields changed
+type NodeDrift struct {
+	Drift  string
+	Fields []string `json:",omitempty"`
+}
+
+type DriftReport struct {
+	Host    string
+	Role    string
+	Time    time.Time
+	Diff    *graph.GraphDiff
+	Summary DriftSummary
+	Nodes   map[graph.Identifier]*NodeDrift `json:",omitempty"`
+	root    graph.Identifier
+}
+
+// ReferredNodes returns the host node and its nodes having drifted, the
+// missing ones not being part of the graph
+func (r *DriftReport) ReferredNodes() []graph.Identifier {
+	ids := []graph.Identifier{r.root}
+	for _, n := range r.Diff.AddedNodes {
+		ids = append(ids, n.ID)
+	}
+	for _, n := range r.Diff.ChangedNodes {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+type DriftSummary struct {
+	Extra        int
+	Missing      int
+	Changed      int
+	AddedEdges   int
+	RemovedEdges int
+}
+
+// DriftDetector periodically compares the topology of each host having a
+// role with the baseline of the role.
+type DriftDetector struct {
+	Graph           *graph.Graph
+	BaselineHandler api.ApiHandler
+	RoleKey         string
+	Rules           *graph.DiffRules
+	Interval        time.Duration
+	reports         map[string]*DriftReport
+	reportsLock     sync.RWMutex
+	quit            chan bool
+	wg              sync.WaitGroup
+}
+
+// baselineSnapshot only keeps the host of the baseline, in case the export
+// contains several hosts.
+func baselineSnapshot(b *api.Baseline) *graph.Snapshot {
+	var host string
+	for _, n := range b.Nodes {
+		if n.Metadata["Type"] == topology.HostType {
+			host = n.Host
+			break
+		}
+	}
+
+	s := &graph.Snapshot{}
+	for _, n := range b.Nodes {
+		if n.Host == host {
+			s.Nodes = append(s.Nodes, n)
+		}
+	}
+	for _, e := range b.Edges {
+		if e.Host == host {
+			s.Edges = append(s.Edges, e)
+		}
+	}
+
+	return s
+}
+
+// nodeDrifts returns the drift of the live nodes
+func nodeDrifts(d *graph.GraphDiff) map[graph.Identifier]*NodeDrift {
+	drifts := make(map[graph.Identifier]*NodeDrift)
+
+	for _, n := range d.AddedNodes {
+		drifts[n.ID] = &NodeDrift{Drift: DriftExtra}
+	}
+
+	for _, n := range d.ChangedNodes {
+		var fields []string
+		for k := range n.Changes {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+
+		drifts[n.ID] = &NodeDrift{Drift: DriftChanged, Fields: fields}
+	}
+
+	return drifts
+}
+
+// Detect compares each host with its baseline and updates the reports. The
+// drift is kept by the detector rather than set on the nodes, the metadata
+// of the nodes being replaced by the updates of their agents.
+func (d *DriftDetector) Detect() {
+	baselines := make(map[string]*api.Baseline)
+	for _, r := range d.BaselineHandler.Index() {
+		b := r.(*api.Baseline)
+		baselines[b.Role] = b
+	}
+
+	d.Graph.RLock()
+	defer d.Graph.RUnlock()
+
+	reports := make(map[string]*DriftReport)
+
+	for _, root := range d.Graph.LookupNodes(graph.Metadata{"Type": topology.HostType}) {
+		role, _ := root.Metadata()[d.RoleKey].(string)
+		b, ok := baselines[role]
+		if role == "" || !ok {
+			continue
+		}
+
+		diff := graph.DiffSnapshots(baselineSnapshot(b), d.Graph.HostSnapshot(root.Host()), d.Rules)
+		reports[root.Host()] = &DriftReport{
+			Host: root.Host(),
+			Role: role,
+			Time: d.Graph.Now(),
+			Diff: diff,
+			Summary: DriftSummary{
+				Extra:        len(diff.AddedNodes),
+				Missing:      len(diff.RemovedNodes),
+				Changed:      len(diff.ChangedNodes),
+				AddedEdges:   len(diff.AddedEdges),
+				RemovedEdges: len(diff.RemovedEdges),
+			},
+			Nodes: nodeDrifts(diff),
+			root:  root.ID,
+		}
+
+		if !diff.Empty() {
+			logging.GetLogger().Debugf("Topology of %s drifted from the %s baseline", root.Host(), role)
+		}
+	}
+
+	d.reportsLock.Lock()
+	d.reports = reports
+	d.reportsLock.Unlock()
+}
+
+func (d *DriftDetector) DriftReports() map[string]interface{} {
+	d.reportsLock.RLock()
+	defer d.reportsLock.RUnlock()
+
+	reports := make(map[string]interface{})
+	for host, r := range d.reports {
+		reports[host] = r
+	}
+	return reports
+}
+
+func (d *DriftDetector) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Detect()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *DriftDetector) Start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+func (d *DriftDetector) Stop() {
+	close(d.quit)
+	d.wg.Wait()
+}
+
+func NewDriftDetector(g *graph.Graph, bh api.ApiHandler, roleKey string, rules *graph.DiffRules, interval time.Duration) *DriftDetector {
+	return &DriftDetector{
+		Graph:           g,
+		BaselineHandler: bh,
+		RoleKey:         roleKey,
+		Rules:           rules,
+		Interval:        interval,
+		reports:         make(map[string]*DriftReport),
+		quit:            make(chan bool),
+	}
+}
+
+// NewDriftDetectorFromConfig returns nil if the detection is disabled
+func NewDriftDetectorFromConfig(g *graph.Graph, bh api.ApiHandler) (*DriftDetector, error) {
+	cfg := config.GetConfig()
+
+	interval := time.Duration(cfg.GetInt("analyzer.drift.interval")) * time.Second
+	if interval <= 0 {
+		return nil, nil
+	}
+
+	// volatile metadata, ie. the statistics, change all the time, they are
+	// not part of the topology
+	fields := append(cfg.GetStringSlice("analyzer.drift.ignore_fields"), graph.MetadataPersistenceKeys(graph.VolatilePersistence)...)
+
+	rules, err := graph.NewDiffRules(fields, cfg.GetStringSlice("analyzer.drift.ignore_names"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDriftDetector(g, bh, cfg.GetString("analyzer.drift.role_key"), rules, interval), nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package drift
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type fakeBaselineHandler struct {
+	api.BasicApiHandler
+	baselines map[string]api.ApiResource
+}
+
+func (h *fakeBaselineHandler) Index() map[string]api.ApiResource {
+	return h.baselines
+}
+
+func TestDriftDetector(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	h := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1", "Role": "compute"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth0", "MTU": 9000})
+	g.Link(h, eth0, graph.Metadata{"RelationType": "ownership"})
+
+	baseline := &api.Baseline{
+		Role: "compute",
+		Snapshot: graph.Snapshot{
+			Nodes: []*graph.SnapshotElement{
+				{ID: "h", Metadata: graph.Metadata{"Type": "host", "Name": "compute-0", "Role": "compute"}, Host: "compute-0"},
+				{ID: "eth0", Metadata: graph.Metadata{"Type": "device", "Name": "eth0", "MTU": 1500}, Host: "compute-0"},
+			},
+			Edges: []*graph.SnapshotElement{
+				{ID: "e", Parent: "h", Child: "eth0", Metadata: graph.Metadata{"RelationType": "ownership"}, Host: "compute-0"},
+			},
+		},
+	}
+
+	handler := &fakeBaselineHandler{baselines: map[string]api.ApiResource{"compute": baseline}}
+	d := NewDriftDetector(g, handler, "Role", nil, time.Minute)
+
+	d.Detect()
+
+	reports := d.DriftReports()
+	r, ok := reports[h.Host()].(*DriftReport)
+	if !ok || r.Role != "compute" || len(r.Diff.ChangedNodes) != 1 || r.Summary.Changed != 1 {
+		t.Fatalf("Wrong report: %+v", reports)
+	}
+	if drift := r.Nodes[eth0.ID]; drift == nil || drift.Drift != DriftChanged || len(drift.Fields) != 1 || drift.Fields[0] != "MTU" {
+		t.Errorf("Interface should have drifted: %+v", r.Nodes)
+	}
+	if len(eth0.Metadata()) != 3 {
+		t.Errorf("The metadata of the interface should be left untouched: %v", eth0.Metadata())
+	}
+
+	// back to the baseline
+	g.Lock()
+	g.AddMetadata(eth0, "MTU", 1500)
+	g.Unlock()
+
+	d.Detect()
+
+	if r := d.DriftReports()[h.Host()].(*DriftReport); len(r.Nodes) != 0 || r.Summary.Changed != 0 {
+		t.Errorf("No drift expected: %+v", r)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package enrichment
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pmylund/go-cache"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const (
+	// all the metadata returned by an enricher are merged under this prefix
+	MetadataPrefix = "External."
+)
+
+// Enricher is the hook called for each node matching the selector, it returns
+// the metadata to be merged into the node. Keys must not include the prefix.
+type Enricher interface {
+	Enrich(id graph.Identifier, m graph.Metadata) (graph.Metadata, error)
+}
+
+// EnricherFactory builds an in-process Enricher when the analyzer starts.
+type EnricherFactory func() (Enricher, error)
+
+var enrichers = struct {
+	sync.RWMutex
+	m map[string]EnricherFactory
+}{m: make(map[string]EnricherFactory)}
+
+// RegisterEnricher registers an in-process Enricher, selected by its name
+// through the analyzer.enrichment.enricher configuration key.
+func RegisterEnricher(name string, factory EnricherFactory) {
+	enrichers.Lock()
+	enrichers.m[name] = factory
+	enrichers.Unlock()
+}
+
+func UnregisterEnricher(name string) {
+	enrichers.Lock()
+	delete(enrichers.m, name)
+	enrichers.Unlock()
+}
+
+func newRegisteredEnricher(name string) (Enricher, error) {
+	enrichers.RLock()
+	factory, ok := enrichers.m[name]
+	enrichers.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Enricher %s not registered", name)
+	}
+	return factory()
+}
+
+type enrichRequest struct {
+	id       graph.Identifier
+	key      string
+	metadata graph.Metadata
+}
+
+type EnrichmentManager struct {
+	graph.DefaultGraphListener
+	Graph      *graph.Graph
+	Enricher   Enricher
+	Selector   graph.Metadata
+	KeyFields  []string
+	Retry      int
+	cache      *cache.Cache
+	rate       time.Duration
+	requests   chan enrichRequest
+	quit       chan struct{}
+	nodeKeys   map[graph.Identifier]string
+	nodeKeysMu sync.Mutex
+	running    atomic.Value
+	wg         sync.WaitGroup
+}
+
+// nodeKey returns a string representation of the key fields of a node, used
+// as cache key and to detect whether the enrichment has to be triggered again.
+func (e *EnrichmentManager) nodeKey(m graph.Metadata) string {
+	fields := make(map[string]interface{})
+	for _, k := range e.KeyFields {
+		if v, ok := m[k]; ok {
+			fields[k] = v
+		}
+	}
+
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// json.Marshal sorts map keys so the key is stable
+	j, _ := json.Marshal(fields)
+	return string(j)
+}
+
+func (e *EnrichmentManager) match(n *graph.Node) bool {
+	return n.MatchMetadata(e.Selector)
+}
+
+func (e *EnrichmentManager) enqueue(n *graph.Node) {
+	if e.running.Load() != true || !e.match(n) {
+		return
+	}
+
+	key := e.nodeKey(n.Metadata())
+	if key == "" {
+		return
+	}
+
+	e.nodeKeysMu.Lock()
+	if e.nodeKeys[n.ID] == key {
+		e.nodeKeysMu.Unlock()
+		return
+	}
+	e.nodeKeys[n.ID] = key
+	e.nodeKeysMu.Unlock()
+
+	// copy the metadata as the enricher runs outside of the graph lock
+	m := make(graph.Metadata)
+	for k, v := range n.Metadata() {
+		m[k] = v
+	}
+
+	select {
+	case e.requests <- enrichRequest{id: n.ID, key: key, metadata: m}:
+	default:
+		logging.GetLogger().Warningf("Enrichment queue full, dropping request for node %s", n.ID)
+
+		// forget the key so that the next update will retry
+		e.nodeKeysMu.Lock()
+		delete(e.nodeKeys, n.ID)
+		e.nodeKeysMu.Unlock()
+	}
+}
+
+func (e *EnrichmentManager) enrich(req enrichRequest) (graph.Metadata, error) {
+	if m, f := e.cache.Get(req.key); f {
+		return m.(graph.Metadata), nil
+	}
+
+	var m graph.Metadata
+	var err error
+
+	delay := 500 * time.Millisecond
+	for i := 0; i <= e.Retry; i++ {
+		if m, err = e.Enricher.Enrich(req.id, req.metadata); err == nil {
+			e.cache.Set(req.key, m, cache.DefaultExpiration)
+			return m, nil
+		}
+
+		logging.GetLogger().Debugf("Enrichment of node %s failed (%d/%d): %s", req.id, i+1, e.Retry+1, err.Error())
+
+		if i < e.Retry {
+			select {
+			case <-time.After(delay):
+			case <-e.quit:
+				return nil, err
+			}
+			delay *= 2
+		}
+	}
+
+	return nil, err
+}
+
+func (e *EnrichmentManager) apply(req enrichRequest, m graph.Metadata) {
+	e.Graph.Lock()
+	defer e.Graph.Unlock()
+
+	node := e.Graph.GetNode(req.id)
+	if node == nil {
+		return
+	}
+
+	// key fields changed meanwhile, a new request has been queued
+	if e.nodeKey(node.Metadata()) != req.key {
+		return
+	}
+
+	tr := e.Graph.StartMetadataTransaction(node)
+	for k, v := range m {
+		tr.AddMetadata(MetadataPrefix+k, v)
+	}
+	tr.Commit()
+}
+
+func (e *EnrichmentManager) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.rate)
+	defer ticker.Stop()
+
+	for {
+		var req enrichRequest
+		select {
+		case req = <-e.requests:
+		case <-e.quit:
+			return
+		}
+
+		if _, f := e.cache.Get(req.key); !f {
+			// rate limit only the requests going to the external system
+			select {
+			case <-ticker.C:
+			case <-e.quit:
+				return
+			}
+		}
+
+		m, err := e.enrich(req)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to enrich node %s: %s", req.id, err.Error())
+
+			e.nodeKeysMu.Lock()
+			delete(e.nodeKeys, req.id)
+			e.nodeKeysMu.Unlock()
+			continue
+		}
+
+		if len(m) > 0 {
+			e.apply(req, m)
+		}
+	}
+}
+
+func (e *EnrichmentManager) OnNodeAdded(n *graph.Node) {
+	e.enqueue(n)
+}
+
+func (e *EnrichmentManager) OnNodeUpdated(n *graph.Node) {
+	e.enqueue(n)
+}
+
+func (e *EnrichmentManager) OnNodeDeleted(n *graph.Node) {
+	e.nodeKeysMu.Lock()
+	delete(e.nodeKeys, n.ID)
+	e.nodeKeysMu.Unlock()
+}
+
+func (e *EnrichmentManager) Start() {
+	e.running.Store(true)
+	e.quit = make(chan struct{})
+
+	e.wg.Add(1)
+	go e.run()
+
+	e.Graph.AddEventListener(e)
+}
+
+func (e *EnrichmentManager) Stop() {
+	e.Graph.RemoveEventListener(e)
+
+	// the requests channel is never closed, a listener can still be
+	// enqueuing, the requests left are dropped
+	e.running.Store(false)
+	close(e.quit)
+	e.wg.Wait()
+}
+
+func NewEnrichmentManager(g *graph.Graph, en Enricher, selector graph.Metadata, fields []string, expire time.Duration, rate time.Duration, retry int) *EnrichmentManager {
+	if rate <= 0 {
+		rate = time.Second
+	}
+	sort.Strings(fields)
+
+	return &EnrichmentManager{
+		Graph:     g,
+		Enricher:  en,
+		Selector:  selector,
+		KeyFields: fields,
+		Retry:     retry,
+		cache:     cache.New(expire, expire),
+		rate:      rate,
+		requests:  make(chan enrichRequest, 1000),
+		nodeKeys:  make(map[graph.Identifier]string),
+	}
+}
+
+func NewEnrichmentManagerFromConfig(g *graph.Graph) (*EnrichmentManager, error) {
+	cfg := config.GetConfig()
+
+	timeout := time.Duration(cfg.GetInt("analyzer.enrichment.timeout")) * time.Second
+
+	var en Enricher
+	if name := cfg.GetString("analyzer.enrichment.enricher"); name != "" {
+		var err error
+		if en, err = newRegisteredEnricher(name); err != nil {
+			return nil, err
+		}
+	} else if cmd := cfg.GetStringSlice("analyzer.enrichment.exec"); len(cmd) > 0 {
+		en = NewExecEnricher(timeout, cmd[0], cmd[1:]...)
+	} else if url := cfg.GetString("analyzer.enrichment.webhook"); url != "" {
+		en = NewWebhookEnricher(url, timeout)
+	} else {
+		return nil, nil
+	}
+
+	selector := graph.Metadata{}
+	if cfg.IsSet("analyzer.enrichment.selector") {
+		for k, v := range cfg.GetStringMap("analyzer.enrichment.selector") {
+			selector[k] = v
+		}
+	}
+
+	fields := cfg.GetStringSlice("analyzer.enrichment.key_fields")
+	if len(fields) == 0 {
+		fields = []string{"MAC"}
+	}
+
+	expire := time.Duration(cfg.GetInt("analyzer.enrichment.cache_expire")) * time.Second
+	var rate time.Duration
+	if r := cfg.GetInt("analyzer.enrichment.rate"); r > 0 {
+		rate = time.Second / time.Duration(r)
+	}
+	retry := cfg.GetInt("analyzer.enrichment.retry")
+
+	return NewEnrichmentManager(g, en, selector, fields, expire, rate, retry), nil
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package enrichment
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type fakeEnricher struct {
+	sync.Mutex
+	calls int
+}
+
+func (f *fakeEnricher) Enrich(id graph.Identifier, m graph.Metadata) (graph.Metadata, error) {
+	f.Lock()
+	f.calls++
+	f.Unlock()
+
+	return graph.Metadata{"Owner": "team-" + m["MAC"].(string)}, nil
+}
+
+func (f *fakeEnricher) Calls() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls
+}
+
+func newGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	return g
+}
+
+func waitMetadata(g *graph.Graph, n *graph.Node, k string, v interface{}) bool {
+	for i := 0; i < 100; i++ {
+		g.Lock()
+		nv := n.Metadata()[k]
+		g.Unlock()
+		if nv == v {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestEnrichment(t *testing.T) {
+	g := newGraph(t)
+	f := &fakeEnricher{}
+
+	em := NewEnrichmentManager(g, f, graph.Metadata{"Type": "device"}, []string{"MAC"}, time.Minute, time.Millisecond, 0)
+	em.Start()
+	defer em.Stop()
+
+	g.Lock()
+	n1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "MAC": "aa"})
+	n2 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "MAC": "aa"})
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "veth", "MAC": "bb"})
+	g.Unlock()
+
+	if !waitMetadata(g, n1, "External.Owner", "team-aa") {
+		t.Fatalf("External metadata not merged: %v", n1.Metadata())
+	}
+
+	if !waitMetadata(g, n2, "External.Owner", "team-aa") {
+		t.Fatalf("External metadata not merged: %v", n2.Metadata())
+	}
+
+	// second node served by the cache, non matching node ignored
+	if f.Calls() != 1 {
+		t.Errorf("Expected one call to the enricher, got %d", f.Calls())
+	}
+
+	g.Lock()
+	g.AddMetadata(n1, "MAC", "cc")
+	g.Unlock()
+
+	if !waitMetadata(g, n1, "External.Owner", "team-cc") {
+		t.Errorf("External metadata not updated: %v", n1.Metadata())
+	}
+
+	g.Lock()
+	g.DelNode(n2)
+	g.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	if f.Calls() != 2 {
+		t.Errorf("Expected two calls to the enricher, got %d", f.Calls())
+	}
+}
+
+func TestEnrichmentStopWhileEnqueuing(t *testing.T) {
+	g := newGraph(t)
+
+	var nodes []*graph.Node
+	g.Lock()
+	for i := 0; i < 2000; i++ {
+		nodes = append(nodes, g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "MAC": fmt.Sprintf("%d", i)}))
+	}
+	g.Unlock()
+
+	em := NewEnrichmentManager(g, &fakeEnricher{}, graph.Metadata{"Type": "device"}, []string{"MAC"}, time.Minute, time.Hour, 0)
+	em.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(nodes []*graph.Node) {
+			defer wg.Done()
+			for _, n := range nodes {
+				em.OnNodeUpdated(n)
+			}
+		}(nodes[i*500 : (i+1)*500])
+	}
+
+	// enqueuing while stopping shouldn't send on a closed channel
+	em.Stop()
+	wg.Wait()
+}
+
+func TestRegisteredEnricher(t *testing.T) {
+	config.GetConfig().Set("analyzer.enrichment.enricher", "fake")
+	defer config.GetConfig().Set("analyzer.enrichment.enricher", "")
+
+	if _, err := NewEnrichmentManagerFromConfig(newGraph(t)); err == nil {
+		t.Error("Expected an error for an enricher not registered")
+	}
+
+	f := &fakeEnricher{}
+	RegisterEnricher("fake", func() (Enricher, error) { return f, nil })
+	defer UnregisterEnricher("fake")
+
+	em, err := NewEnrichmentManagerFromConfig(newGraph(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if em.Enricher != f {
+		t.Errorf("Expected the registered enricher, got %v", em.Enricher)
+	}
+}
+
+func TestExecEnricherTimeout(t *testing.T) {
+	en := NewExecEnricher(100*time.Millisecond, "sleep", "5")
+
+	start := time.Now()
+	if _, err := en.Enrich(graph.GenID(), graph.Metadata{}); err == nil {
+		t.Error("Expected a timeout error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Hook not killed after its timeout: %s", elapsed)
+	}
+}
+
+type failingEnricher struct{}
+
+func (f *failingEnricher) Enrich(id graph.Identifier, m graph.Metadata) (graph.Metadata, error) {
+	return nil, errors.New("unreachable")
+}
+
+func TestEnrichmentStopDuringRetry(t *testing.T) {
+	g := newGraph(t)
+
+	em := NewEnrichmentManager(g, &failingEnricher{}, graph.Metadata{"Type": "device"}, []string{"MAC"}, time.Minute, time.Millisecond, 10)
+	em.Start()
+
+	g.Lock()
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "MAC": "aa"})
+	g.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// the backoff of the ten retries lasts minutes, the stop must not wait for it
+	done := make(chan struct{})
+	go func() {
+		em.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Stop blocked by the retries")
+	}
+}
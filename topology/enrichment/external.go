@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package enrichment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type enrichNode struct {
+	ID       graph.Identifier
+	Metadata graph.Metadata
+}
+
+// ExecEnricher runs an external command for each node. The node is written as
+// JSON on the standard input, the metadata are read as a JSON object from the
+// standard output. The command is killed when it runs longer than Timeout.
+type ExecEnricher struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// WebhookEnricher POSTs the node as JSON to an URL and expects a JSON object
+// of metadata as response.
+type WebhookEnricher struct {
+	URL    string
+	client *http.Client
+}
+
+func (e *ExecEnricher) Enrich(id graph.Identifier, m graph.Metadata) (graph.Metadata, error) {
+	in, err := json.Marshal(&enrichNode{ID: id, Metadata: m})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %s", e.Command, e.Timeout)
+		}
+		return nil, fmt.Errorf("%s failed: %s", e.Command, err.Error())
+	}
+
+	metadata := make(graph.Metadata)
+	if out.Len() == 0 {
+		return metadata, nil
+	}
+
+	if err := json.Unmarshal(out.Bytes(), &metadata); err != nil {
+		return nil, fmt.Errorf("Unable to decode %s output: %s", e.Command, err.Error())
+	}
+
+	return metadata, nil
+}
+
+func (e *WebhookEnricher) Enrich(id graph.Identifier, m graph.Metadata) (graph.Metadata, error) {
+	in, err := json.Marshal(&enrichNode{ID: id, Metadata: m})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client.Post(e.URL, "application/json", bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return graph.Metadata{}, nil
+	default:
+		return nil, fmt.Errorf("Webhook %s returned %s", e.URL, resp.Status)
+	}
+
+	metadata := make(graph.Metadata)
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("Unable to decode webhook response: %s", err.Error())
+	}
+
+	return metadata, nil
+}
+
+func NewExecEnricher(timeout time.Duration, command string, args ...string) *ExecEnricher {
+	return &ExecEnricher{
+		Command: command,
+		Args:    args,
+		Timeout: timeout,
+	}
+}
+
+func NewWebhookEnricher(url string, timeout time.Duration) *WebhookEnricher {
+	return &WebhookEnricher{
+		URL:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flapping
+
+import (
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// number of buckets of the transitions window
+const windowBuckets = 12
+
+type nodeState struct {
+	state          string
+	transitions    *common.RateWindow
+	lastTransition time.Time
+	flapping       bool
+	count          int64
+}
+
+// FlapDetector counts the State transitions of the nodes, ie. UP/DOWN of
+// the interfaces, over a rolling window. The nodes having at least
+// Threshold transitions during the window are flagged with Flapping and
+// the number of transitions as FlapTransitions, the flag is cleared once
+// the node didn't change of state during StablePeriod.
+type FlapDetector struct {
+	sync.Mutex
+	Graph        *graph.Graph
+	Window       time.Duration
+	Threshold    int64
+	StablePeriod time.Duration
+	Clock        common.Clock
+	nodes        map[graph.Identifier]*nodeState
+	subscription *common.BusSubscription
+	quit         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// OnBusEvent tracks the states from the graph events, the flags being set
+// by the detector itself don't change the states.
+func (d *FlapDetector) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != d.Graph || ev.Node == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	switch e.Type {
+	case "NodeAdded", "NodeUpdated":
+		state, ok := ev.Node.Metadata()["State"].(string)
+		if !ok {
+			return
+		}
+
+		ns, ok := d.nodes[ev.Node.ID]
+		if !ok {
+			d.nodes[ev.Node.ID] = &nodeState{state: state, transitions: common.NewRateWindow(d.Window, windowBuckets)}
+			return
+		}
+
+		if ns.state != state {
+			ns.state = state
+			d.transition(ev.Node.ID, ns)
+		}
+	case "NodeDeleted":
+		delete(d.nodes, ev.Node.ID)
+	}
+}
+
+// transition records a state change, flagging the node if it crosses the
+// threshold or updating the count of a flapping node
+func (d *FlapDetector) transition(id graph.Identifier, ns *nodeState) {
+	now := d.Clock.Now()
+
+	ns.transitions.Add(now, 1)
+	ns.lastTransition = now
+
+	count := ns.transitions.Count(now)
+	if !ns.flapping && count < d.Threshold {
+		return
+	}
+
+	if !ns.flapping {
+		logging.GetLogger().Warningf("Node %s is flapping, %d state changes in %s", id, count, d.Window)
+	}
+	ns.flapping = true
+	ns.count = count
+
+	d.Graph.Lock()
+	defer d.Graph.Unlock()
+
+	if n := d.Graph.GetNode(id); n != nil {
+		m := n.Metadata()
+		if m["Flapping"] != true || m["FlapTransitions"] != count {
+			m["Flapping"] = true
+			m["FlapTransitions"] = count
+			d.Graph.SetMetadata(n, m)
+		}
+	}
+}
+
+// clearStable removes the flag of the nodes which have been stable long
+// enough
+func (d *FlapDetector) clearStable() {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.Clock.Now()
+
+	var stable []graph.Identifier
+	for id, ns := range d.nodes {
+		if ns.flapping && now.Sub(ns.lastTransition) >= d.StablePeriod {
+			ns.flapping = false
+			ns.count = 0
+			stable = append(stable, id)
+		}
+	}
+
+	if len(stable) == 0 {
+		return
+	}
+
+	d.Graph.Lock()
+	defer d.Graph.Unlock()
+
+	for _, id := range stable {
+		logging.GetLogger().Infof("Node %s is stable again", id)
+
+		if n := d.Graph.GetNode(id); n != nil {
+			m := n.Metadata()
+			delete(m, "Flapping")
+			delete(m, "FlapTransitions")
+			d.Graph.SetMetadata(n, m)
+		}
+	}
+}
+
+func (d *FlapDetector) run() {
+	defer d.wg.Done()
+
+	interval := d.StablePeriod / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.clearStable()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *FlapDetector) Start() {
+	d.subscription = common.DefaultBus.Subscribe("flapping", config.GetConfig().GetInt("graph.bus.queue_size"), d, common.GraphTopic)
+
+	d.wg.Add(1)
+	go d.run()
+}
+
+func (d *FlapDetector) Stop() {
+	common.DefaultBus.Unsubscribe(d.subscription)
+
+	close(d.quit)
+	d.wg.Wait()
+}
+
+func NewFlapDetector(g *graph.Graph, window time.Duration, threshold int64, stablePeriod time.Duration) *FlapDetector {
+	return &FlapDetector{
+		Graph:        g,
+		Window:       window,
+		Threshold:    threshold,
+		StablePeriod: stablePeriod,
+		Clock:        common.RealClock{},
+		nodes:        make(map[graph.Identifier]*nodeState),
+		quit:         make(chan struct{}),
+	}
+}
+
+// NewFlapDetectorFromConfig returns nil if the detection is disabled
+func NewFlapDetectorFromConfig(g *graph.Graph) *FlapDetector {
+	cfg := config.GetConfig()
+
+	window := time.Duration(cfg.GetInt("agent.topology.flapping.window")) * time.Second
+	threshold := int64(cfg.GetInt("agent.topology.flapping.threshold"))
+	if window <= 0 || threshold <= 0 {
+		return nil
+	}
+
+	stablePeriod := time.Duration(cfg.GetInt("agent.topology.flapping.stable_period")) * time.Second
+	return NewFlapDetector(g, window, threshold, stablePeriod)
+}
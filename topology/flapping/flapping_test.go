@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flapping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func setState(d *FlapDetector, n *graph.Node, state string) {
+	d.Graph.Lock()
+	d.Graph.AddMetadata(n, "State", state)
+	d.Graph.Unlock()
+
+	d.subscription.Flush()
+}
+
+func flapping(d *FlapDetector, n *graph.Node) (interface{}, interface{}) {
+	d.Graph.RLock()
+	defer d.Graph.RUnlock()
+
+	m := d.Graph.GetNode(n.ID).Metadata()
+	return m["Flapping"], m["FlapTransitions"]
+}
+
+func TestFlapDetector(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+
+	d := NewFlapDetector(g, time.Minute, 4, 5*time.Minute)
+	d.Clock = clock
+	d.Start()
+	defer d.Stop()
+
+	g.Lock()
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth0", "State": "UP"})
+	other := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth1", "State": "UP"})
+	g.Unlock()
+
+	// a few transitions spread over more than the window are fine
+	for i := 0; i < 6; i++ {
+		clock.Advance(40 * time.Second)
+		setState(d, n, []string{"DOWN", "UP"}[i%2])
+	}
+	if f, _ := flapping(d, n); f != nil {
+		t.Fatalf("Node shouldn't be flapping: %v", g.GetNode(n.ID).Metadata())
+	}
+
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Second)
+		setState(d, n, []string{"DOWN", "UP"}[i%2])
+	}
+	if f, c := flapping(d, n); f != true || c != int64(4) {
+		t.Fatalf("Node should be flapping with 4 transitions, got %v", g.GetNode(n.ID).Metadata())
+	}
+
+	clock.Advance(time.Second)
+	setState(d, n, "DOWN")
+	if _, c := flapping(d, n); c != int64(5) {
+		t.Errorf("Transitions should have been updated, got %v", g.GetNode(n.ID).Metadata())
+	}
+
+	// updates of other keys are not transitions
+	g.Lock()
+	g.AddMetadata(other, "MTU", 1500)
+	g.Unlock()
+	d.subscription.Flush()
+	if f, _ := flapping(d, other); f != nil {
+		t.Error("Node without transition shouldn't be flapping")
+	}
+
+	clock.Advance(4 * time.Minute)
+	d.clearStable()
+	if f, _ := flapping(d, n); f != true {
+		t.Error("Flag shouldn't be cleared before the stable period")
+	}
+
+	clock.Advance(time.Minute)
+	d.clearStable()
+	if f, c := flapping(d, n); f != nil || c != nil {
+		t.Errorf("Flag should have been cleared, got %v", g.GetNode(n.ID).Metadata())
+	}
+	if state := g.GetNode(n.ID).Metadata()["State"]; state != "DOWN" {
+		t.Errorf("State should have been kept, got %v", state)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"strings"
+
+	"github.com/redhat-cip/skydive/config"
+)
+
+// Authorizer tells which nodes a user may read, the edges being readable
+// when both of their nodes are. The users it doesn't restrict read the
+// whole graph.
+type Authorizer interface {
+	Restricted(user string) bool
+	CanReadNode(user string, n *Node) bool
+}
+
+// ReadScope is the part of the graph a user may read, the nodes of the
+// given hosts and of the given types, an empty list matching everything.
+type ReadScope struct {
+	Hosts []string
+	Types []string
+}
+
+// ScopeAuthorizer restricts the users listed to their scope, the other
+// users being unrestricted.
+type ScopeAuthorizer struct {
+	Scopes map[string]ReadScope
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ScopeAuthorizer) scope(user string) (ReadScope, bool) {
+	// the users are read from the configuration where keys are lowercased
+	s, ok := a.Scopes[strings.ToLower(user)]
+	return s, ok
+}
+
+func (a *ScopeAuthorizer) Restricted(user string) bool {
+	_, ok := a.scope(user)
+	return ok
+}
+
+func (a *ScopeAuthorizer) CanReadNode(user string, n *Node) bool {
+	s, ok := a.scope(user)
+	if !ok {
+		return true
+	}
+
+	if len(s.Hosts) > 0 && !contains(s.Hosts, n.host) {
+		return false
+	}
+	if len(s.Types) > 0 {
+		t, _ := n.metadata["Type"].(string)
+		if !contains(s.Types, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// NodeReferrer is a value referring to nodes of the graph, ie. the report
+// of a checker, which may only be read by the users who may read all of
+// them.
+type NodeReferrer interface {
+	ReferredNodes() []Identifier
+}
+
+// Restricted returns whether the reads of the user are restricted by the
+// authorizer, a nil one letting everything through.
+func Restricted(a Authorizer, user string) bool {
+	return a != nil && a.Restricted(user)
+}
+
+// CanReadEdge returns whether the user may read both nodes of the edge
+func CanReadEdge(a Authorizer, user string, g *Graph, e *Edge) bool {
+	if !Restricted(a, user) {
+		return true
+	}
+
+	parent, child := g.GetNode(e.parent), g.GetNode(e.child)
+	return parent != nil && child != nil && a.CanReadNode(user, parent) && a.CanReadNode(user, child)
+}
+
+// AuthorizeGraph returns the part of the graph the user may read, the nodes
+// and edges filtered by f, serialized the same way as the graph.
+func AuthorizeGraph(a Authorizer, user string, g *Graph, f *MetadataFilter) interface{} {
+	if !Restricted(a, user) {
+		return f.FilterGraph(g)
+	}
+
+	ag := &filteredGraph{Nodes: []*Node{}, Edges: []*Edge{}}
+	for _, n := range g.GetNodes() {
+		if a.CanReadNode(user, n) {
+			ag.Nodes = append(ag.Nodes, f.FilterNode(n))
+		}
+	}
+	for _, e := range g.GetEdges() {
+		if CanReadEdge(a, user, g, e) {
+			ag.Edges = append(ag.Edges, f.FilterEdge(e))
+		}
+	}
+
+	return ag
+}
+
+// AuthorizeValue returns whether the user may read a value returned by a
+// traversal, or a report referring to nodes, and the value with the
+// elements out of the user scope removed.
+// The other values, ie. counts, are refused to the restricted users as they
+// could disclose the elements out of their scope.
+func AuthorizeValue(a Authorizer, user string, g *Graph, v interface{}) (interface{}, bool) {
+	if !Restricted(a, user) {
+		return v, true
+	}
+
+	switch v := v.(type) {
+	case *Node:
+		return v, a.CanReadNode(user, v)
+	case *Edge:
+		return v, CanReadEdge(a, user, g, v)
+	case *Graph:
+		return AuthorizeGraph(a, user, v, nil), true
+	case []*Node:
+		for _, n := range v {
+			if !a.CanReadNode(user, n) {
+				return v, false
+			}
+		}
+		return v, true
+	case NodeReferrer:
+		ids := v.ReferredNodes()
+		for _, id := range ids {
+			if n := g.GetNode(id); n == nil || !a.CanReadNode(user, n) {
+				return v, false
+			}
+		}
+		return v, len(ids) > 0
+	}
+	return v, false
+}
+
+// NewScopeAuthorizerFromConfig returns the authorizer of the auth.scopes
+// users, nil if none.
+func NewScopeAuthorizerFromConfig() *ScopeAuthorizer {
+	cfg := config.GetConfig()
+
+	users := cfg.GetStringMap("auth.scopes")
+	if len(users) == 0 {
+		return nil
+	}
+
+	a := &ScopeAuthorizer{Scopes: make(map[string]ReadScope)}
+	for user := range users {
+		a.Scopes[user] = ReadScope{
+			Hosts: cfg.GetStringSlice("auth.scopes." + user + ".hosts"),
+			Types: cfg.GetStringSlice("auth.scopes." + user + ".types"),
+		}
+	}
+	return a
+}
+
+// NewAuthorizerFromConfig returns the authorizer of the read scopes, nil if
+// the reads are not restricted.
+func NewAuthorizerFromConfig() Authorizer {
+	if a := NewScopeAuthorizerFromConfig(); a != nil {
+		return a
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+func newTenantGraph(t *testing.T) (*Graph, *Node, *Node, *Node) {
+	g := newGraph(t)
+
+	host := g.NewNode(GenID(), Metadata{"Name": "host", "Type": "host"})
+	c1 := g.NewNode(GenID(), Metadata{"Name": "c1", "Type": "container"})
+	c2 := g.NewNode(GenID(), Metadata{"Name": "c2", "Type": "container"})
+	g.Link(host, c1)
+	g.Link(c1, c2)
+
+	return g, host, c1, c2
+}
+
+func TestScopeAuthorizer(t *testing.T) {
+	g, host, c1, c2 := newTenantGraph(t)
+
+	a := &ScopeAuthorizer{Scopes: map[string]ReadScope{
+		"tenant":  {Types: []string{"container"}},
+		"nowhere": {Hosts: []string{"unknown-host"}},
+	}}
+
+	if !a.CanReadNode("admin", host) || a.Restricted("admin") {
+		t.Error("Users not listed should be unrestricted")
+	}
+	if a.CanReadNode("tenant", host) || !a.CanReadNode("Tenant", c1) {
+		t.Error("Only the containers should be readable by the tenant")
+	}
+	if a.CanReadNode("nowhere", c1) {
+		t.Error("Nodes of other hosts shouldn't be readable")
+	}
+
+	edges := g.backend.GetNodeEdges(c1)
+	readable := 0
+	for _, e := range edges {
+		if CanReadEdge(a, "tenant", g, e) {
+			readable++
+		}
+	}
+	if readable != 1 {
+		t.Errorf("Only the edge between the containers should be readable, got %d", readable)
+	}
+
+	ag := AuthorizeGraph(a, "tenant", g, nil).(*filteredGraph)
+	if len(ag.Nodes) != 2 || len(ag.Edges) != 1 {
+		t.Errorf("Expected the 2 containers and their edge, got %+v", ag)
+	}
+
+	if _, ok := AuthorizeValue(a, "tenant", g, []*Node{c1, c2}); !ok {
+		t.Error("A path of containers should be readable")
+	}
+	if _, ok := AuthorizeValue(a, "tenant", g, []*Node{host, c1}); ok {
+		t.Error("A path through the host shouldn't be readable")
+	}
+	if _, ok := AuthorizeValue(a, "tenant", g, 3); ok {
+		t.Error("Scalar values shouldn't be readable by restricted users")
+	}
+	if _, ok := AuthorizeValue(nil, "tenant", g, 3); !ok {
+		t.Error("Everything should be readable without authorizer")
+	}
+}
+
+func TestSyncReplyAuthorized(t *testing.T) {
+	g, host, c1, _ := newTenantGraph(t)
+
+	s := &GraphServer{
+		Graph:      g,
+		journal:    NewJournal(10, time.Minute),
+		Authorizer: &ScopeAuthorizer{Scopes: map[string]ReadScope{"tenant": {Types: []string{"container"}}}},
+	}
+
+	replies := s.syncReply("tenant", wsMessage(t, "SyncRequest", nil))
+	if ag, ok := replies[0].Obj.(*filteredGraph); !ok || len(ag.Nodes) != 2 {
+		t.Fatalf("Only the containers expected: %+v", replies[0].Obj)
+	}
+	last := replies[0].Seq
+
+	g.AddMetadata(host, "State", "UP")
+	s.journal.AppendFiltered(shttp.WSMessage{Namespace: Namespace, Type: "NodeUpdated", Obj: host}, s.readers(host))
+	g.AddMetadata(c1, "State", "UP")
+	s.journal.AppendFiltered(shttp.WSMessage{Namespace: Namespace, Type: "NodeUpdated", Obj: c1}, s.readers(c1))
+
+	replies = s.syncReply("tenant", wsMessage(t, "SyncRequest", map[string]interface{}{"From": last}))
+	if len(replies) != 1 || replies[0].Seq != last+2 {
+		t.Errorf("Only the container event expected: %+v", replies)
+	}
+
+	replies = s.syncReply("admin", wsMessage(t, "SyncRequest", map[string]interface{}{"From": last}))
+	if len(replies) != 2 {
+		t.Errorf("All the events expected for an unrestricted user: %+v", replies)
+	}
+
+	// the scope is evaluated against the node when the event happened
+	g.AddMetadata(c1, "Type", "host")
+	if replies = s.syncReply("tenant", wsMessage(t, "SyncRequest", map[string]interface{}{"From": last})); len(replies) != 1 {
+		t.Errorf("The container event should still be replayed: %+v", replies)
+	}
+}
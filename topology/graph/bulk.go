@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+// GraphBulkListener is implemented by the listeners able to resync on their
+// own, notified once instead of getting the events of a bulk change
+// exceeding the threshold of the graph.
+type GraphBulkListener interface {
+	OnBulkChange()
+}
+
+const (
+	bufferedAdded = iota + 1
+	bufferedUpdated
+	bufferedDeleted
+)
+
+type bufferedNode struct {
+	event int
+	node  *Node
+}
+
+type bufferedEdge struct {
+	event int
+	edge  *Edge
+}
+
+// eventBuffer keeps the last event of each element changed while the events
+// are suspended, in the order the elements were first changed
+type eventBuffer struct {
+	nodes     map[Identifier]*bufferedNode
+	edges     map[Identifier]*bufferedEdge
+	nodeOrder []Identifier
+	edgeOrder []Identifier
+}
+
+// coalesce returns the event summing up two events of an element, 0 when
+// the element was added then deleted
+func coalesce(previous, event int) int {
+	switch {
+	case previous == bufferedAdded && event == bufferedDeleted:
+		return 0
+	case previous == bufferedAdded:
+		return bufferedAdded
+	case previous == bufferedDeleted && event != bufferedDeleted:
+		return bufferedUpdated
+	}
+	return event
+}
+
+func (b *eventBuffer) addNode(event int, n *Node) {
+	bn, ok := b.nodes[n.ID]
+	if !ok {
+		b.nodes[n.ID] = &bufferedNode{event: event, node: n}
+		b.nodeOrder = append(b.nodeOrder, n.ID)
+		return
+	}
+
+	if bn.event = coalesce(bn.event, event); bn.event == 0 {
+		delete(b.nodes, n.ID)
+	}
+	bn.node = n
+}
+
+func (b *eventBuffer) addEdge(event int, e *Edge) {
+	be, ok := b.edges[e.ID]
+	if !ok {
+		b.edges[e.ID] = &bufferedEdge{event: event, edge: e}
+		b.edgeOrder = append(b.edgeOrder, e.ID)
+		return
+	}
+
+	if be.event = coalesce(be.event, event); be.event == 0 {
+		delete(b.edges, e.ID)
+	}
+	be.edge = e
+}
+
+func (b *eventBuffer) len() int {
+	return len(b.nodes) + len(b.edges)
+}
+
+// SuspendEvents buffers the events of the graph until ResumeEvents, so that
+// a bulk operation, ie. a full rescan, releasing the graph lock from time to
+// time, doesn't overwhelm the listeners with thousands of events. The
+// suspensions can be nested, the graph lock has to be held.
+func (g *Graph) SuspendEvents() {
+	if g.suspended == 0 {
+		g.buffer = &eventBuffer{
+			nodes: make(map[Identifier]*bufferedNode),
+			edges: make(map[Identifier]*bufferedEdge),
+		}
+	}
+	g.suspended++
+}
+
+// ResumeEvents ends a suspension, the last one notifying the listeners of
+// one event per element changed, ie. a node added then updated is only
+// added. When more elements than the bulk threshold changed, the listeners
+// able to resync get a single bulk change instead. The graph lock has to be
+// held.
+func (g *Graph) ResumeEvents() {
+	if g.suspended == 0 {
+		return
+	}
+	if g.suspended--; g.suspended > 0 {
+		return
+	}
+
+	b := g.buffer
+	g.buffer = nil
+
+	if b.len() == 0 {
+		return
+	}
+
+	// the elements changed while suspended may have been read meanwhile,
+	// their events come after the revisions read
+	g.nextRevision()
+
+	listeners := g.eventListeners
+	if g.bulkThreshold > 0 && b.len() > g.bulkThreshold {
+		listeners = nil
+		for _, l := range g.eventListeners {
+			if bl, ok := l.(GraphBulkListener); ok {
+				bl.OnBulkChange()
+			} else {
+				listeners = append(listeners, l)
+			}
+		}
+	}
+
+	// the nodes before the edges referencing them, the edges deleted before
+	// their nodes
+	for _, id := range b.nodeOrder {
+		if bn, ok := b.nodes[id]; ok && bn.event != bufferedDeleted {
+			for _, l := range listeners {
+				if bn.event == bufferedAdded {
+					l.OnNodeAdded(bn.node)
+				} else {
+					l.OnNodeUpdated(bn.node)
+				}
+			}
+		}
+	}
+
+	for _, id := range b.edgeOrder {
+		if be, ok := b.edges[id]; ok {
+			for _, l := range listeners {
+				switch be.event {
+				case bufferedAdded:
+					l.OnEdgeAdded(be.edge)
+				case bufferedUpdated:
+					l.OnEdgeUpdated(be.edge)
+				case bufferedDeleted:
+					l.OnEdgeDeleted(be.edge)
+				}
+			}
+		}
+	}
+
+	for _, id := range b.nodeOrder {
+		if bn, ok := b.nodes[id]; ok && bn.event == bufferedDeleted {
+			for _, l := range listeners {
+				l.OnNodeDeleted(bn.node)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+)
+
+// recordingListener records the events in the order they are notified
+type recordingListener struct {
+	events []string
+	bulks  int
+}
+
+func (r *recordingListener) record(event string, e *graphElement) {
+	name, _ := e.metadata["Name"].(string)
+	r.events = append(r.events, event+" "+name)
+}
+
+func (r *recordingListener) OnNodeUpdated(n *Node) { r.record("NodeUpdated", &n.graphElement) }
+func (r *recordingListener) OnNodeAdded(n *Node)   { r.record("NodeAdded", &n.graphElement) }
+func (r *recordingListener) OnNodeDeleted(n *Node) { r.record("NodeDeleted", &n.graphElement) }
+func (r *recordingListener) OnEdgeUpdated(e *Edge) { r.record("EdgeUpdated", &e.graphElement) }
+func (r *recordingListener) OnEdgeAdded(e *Edge)   { r.record("EdgeAdded", &e.graphElement) }
+func (r *recordingListener) OnEdgeDeleted(e *Edge) { r.record("EdgeDeleted", &e.graphElement) }
+
+type recordingBulkListener struct {
+	recordingListener
+}
+
+func (r *recordingBulkListener) OnBulkChange() {
+	r.bulks++
+}
+
+func TestSuspendEvents(t *testing.T) {
+	g := newGraph(t)
+	g.bulkThreshold = 0
+
+	l := &recordingListener{}
+	g.AddEventListener(l)
+
+	n1 := g.NewNode(GenID(), Metadata{"Name": "n1", "Type": "intf"})
+	gone := g.NewNode(GenID(), Metadata{"Name": "gone", "Type": "intf"})
+	l.events = nil
+
+	g.SuspendEvents()
+	n2 := g.NewNode(GenID(), Metadata{"Name": "n2", "Type": "intf"})
+	g.AddMetadata(n2, "MTU", 1500)
+	g.NewEdge(GenID(), n1, n2, Metadata{"Name": "e12"})
+
+	// nested suspension
+	g.SuspendEvents()
+	g.AddMetadata(n1, "MTU", 1500)
+	g.AddMetadata(n1, "MTU", 9000)
+	tmp := g.NewNode(GenID(), Metadata{"Name": "tmp", "Type": "intf"})
+	g.DelNode(tmp)
+	g.ResumeEvents()
+
+	g.NewEdge(GenID(), n1, gone, Metadata{"Name": "e1gone"})
+	g.DelNode(gone)
+
+	if len(l.events) != 0 {
+		t.Fatalf("No event expected while suspended, got %v", l.events)
+	}
+	g.ResumeEvents()
+
+	expected := []string{"NodeAdded n2", "NodeUpdated n1", "EdgeAdded e12", "NodeDeleted gone"}
+	if !reflect.DeepEqual(l.events, expected) {
+		t.Errorf("Expected coalesced events %v, got %v", expected, l.events)
+	}
+	if mtu := n1.Metadata()["MTU"]; mtu != 9000 {
+		t.Errorf("Wrong metadata: %v", mtu)
+	}
+
+	// resumed
+	l.events = nil
+	g.AddMetadata(n2, "MTU", 9000)
+	if !reflect.DeepEqual(l.events, []string{"NodeUpdated n2"}) {
+		t.Errorf("Events should be notified again, got %v", l.events)
+	}
+}
+
+func TestBulkChange(t *testing.T) {
+	g := newGraph(t)
+	g.bulkThreshold = 2
+
+	l := &recordingListener{}
+	bl := &recordingBulkListener{}
+	g.AddEventListener(l)
+	g.AddEventListener(bl)
+
+	g.SuspendEvents()
+	for _, name := range []string{"n1", "n2", "n3"} {
+		g.NewNode(GenID(), Metadata{"Name": name, "Type": "intf"})
+	}
+	g.ResumeEvents()
+
+	if bl.bulks != 1 || len(bl.events) != 0 {
+		t.Errorf("Expected a single bulk change, got %d and %v", bl.bulks, bl.events)
+	}
+	if len(l.events) != 3 {
+		t.Errorf("The listeners unable to resync should get the coalesced events, got %v", l.events)
+	}
+
+	// below the threshold
+	g.SuspendEvents()
+	g.NewNode(GenID(), Metadata{"Name": "n4", "Type": "intf"})
+	g.ResumeEvents()
+
+	if bl.bulks != 1 || !reflect.DeepEqual(bl.events, []string{"NodeAdded n4"}) {
+		t.Errorf("Expected the events below the threshold, got %d and %v", bl.bulks, bl.events)
+	}
+}
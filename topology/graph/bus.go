@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"github.com/redhat-cip/skydive/common"
+)
+
+// GraphEvent is published on the graph topic of the bus for each event of
+// a graph, ie. NodeAdded. The elements are copies taken when the event
+// occurred, along with the nodes of an edge, so that the subscribers don't
+// need the graph lock to handle them. Revision is the revision of the graph
+// once the event occurred.
+type GraphEvent struct {
+	Graph    *Graph
+	Node     *Node
+	Edge     *Edge
+	Parent   *Node
+	Child    *Node
+	Revision uint64
+}
+
+// busPublisher publishes the events of a graph on the bus, the graph lock
+// being held the events of a graph are published in order.
+type busPublisher struct {
+	graph *Graph
+	bus   *common.Bus
+}
+
+func copyNode(n *Node) *Node {
+	if n == nil {
+		return nil
+	}
+	return &Node{graphElement: graphElement{ID: n.ID, host: n.host, metadata: copyMetadata(n.metadata)}}
+}
+
+func copyEdge(e *Edge) *Edge {
+	return &Edge{graphElement: graphElement{ID: e.ID, host: e.host, metadata: copyMetadata(e.metadata)}, parent: e.parent, child: e.child}
+}
+
+func (p *busPublisher) publishNode(eventType string, n *Node) {
+	if !p.bus.HasSubscribers(common.GraphTopic) {
+		return
+	}
+
+	p.bus.Publish(common.GraphTopic, eventType, &GraphEvent{Graph: p.graph, Node: copyNode(n), Revision: p.graph.Revision()})
+}
+
+func (p *busPublisher) publishEdge(eventType string, e *Edge) {
+	if !p.bus.HasSubscribers(common.GraphTopic) {
+		return
+	}
+
+	// the nodes are looked up by ID as a deleted edge isn't in the backend
+	// anymore
+	parent, child := p.graph.GetNode(e.parent), p.graph.GetNode(e.child)
+	p.bus.Publish(common.GraphTopic, eventType, &GraphEvent{
+		Graph:    p.graph,
+		Edge:     copyEdge(e),
+		Parent:   copyNode(parent),
+		Child:    copyNode(child),
+		Revision: p.graph.Revision(),
+	})
+}
+
+func (p *busPublisher) OnNodeUpdated(n *Node) {
+	p.publishNode("NodeUpdated", n)
+}
+
+func (p *busPublisher) OnNodeAdded(n *Node) {
+	p.publishNode("NodeAdded", n)
+}
+
+func (p *busPublisher) OnNodeDeleted(n *Node) {
+	p.publishNode("NodeDeleted", n)
+}
+
+func (p *busPublisher) OnEdgeUpdated(e *Edge) {
+	p.publishEdge("EdgeUpdated", e)
+}
+
+func (p *busPublisher) OnEdgeAdded(e *Edge) {
+	p.publishEdge("EdgeAdded", e)
+}
+
+func (p *busPublisher) OnEdgeDeleted(e *Edge) {
+	p.publishEdge("EdgeDeleted", e)
+}
+
+// OnBulkChange publishes a single event for a bulk change, the subscribers
+// having to resync
+func (p *busPublisher) OnBulkChange() {
+	if !p.bus.HasSubscribers(common.GraphTopic) {
+		return
+	}
+
+	p.bus.Publish(common.GraphTopic, "BulkChange", &GraphEvent{Graph: p.graph, Revision: p.graph.Revision()})
+}
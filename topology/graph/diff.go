@@ -0,0 +1,333 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SnapshotElement is a node or an edge as serialized by the topology API.
+type SnapshotElement struct {
+	ID       Identifier
+	Metadata Metadata   `json:",omitempty"`
+	Parent   Identifier `json:",omitempty"`
+	Child    Identifier `json:",omitempty"`
+	Host     string
+}
+
+// Snapshot is a set of nodes and edges in the format of the topology API
+// export, so that an exported topology can be compared with the live one.
+type Snapshot struct {
+	Nodes []*SnapshotElement
+	Edges []*SnapshotElement
+}
+
+// DiffRules are the differences to be ignored by the diff, metadata keys,
+// dotted for nested keys, and patterns of node names, ie. ephemeral veths.
+type DiffRules struct {
+	IgnoreFields []string
+	IgnoreNames  []*regexp.Regexp
+}
+
+type FieldChange struct {
+	Old interface{}
+	New interface{}
+}
+
+type NodeDiff struct {
+	Key     string
+	ID      Identifier
+	Changes map[string]FieldChange `json:",omitempty"`
+}
+
+// GraphDiff lists the differences between two snapshots, added elements are
+// the ones only found in the second snapshot.
+type GraphDiff struct {
+	AddedNodes   []NodeDiff `json:",omitempty"`
+	RemovedNodes []NodeDiff `json:",omitempty"`
+	ChangedNodes []NodeDiff `json:",omitempty"`
+	AddedEdges   []string   `json:",omitempty"`
+	RemovedEdges []string   `json:",omitempty"`
+}
+
+type byNodeKey []NodeDiff
+
+func (b byNodeKey) Len() int {
+	return len(b)
+}
+
+func (b byNodeKey) Less(i, j int) bool {
+	return b[i].Key < b[j].Key
+}
+
+func (b byNodeKey) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func NewDiffRules(fields []string, names []string) (*DiffRules, error) {
+	r := &DiffRules{IgnoreFields: fields}
+	for _, name := range names {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid name pattern %s: %s", name, err.Error())
+		}
+		r.IgnoreNames = append(r.IgnoreNames, re)
+	}
+	return r, nil
+}
+
+func (r *DiffRules) ignoreField(key string) bool {
+	if r == nil {
+		return false
+	}
+	for _, f := range r.IgnoreFields {
+		if key == f || strings.HasPrefix(key, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *DiffRules) ignoreNode(e *SnapshotElement) bool {
+	if r == nil {
+		return false
+	}
+	name, _ := e.Metadata["Name"].(string)
+	for _, re := range r.IgnoreNames {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *GraphDiff) Empty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedNodes) == 0 &&
+		len(d.AddedEdges) == 0 && len(d.RemovedEdges) == 0
+}
+
+// HostSnapshot returns the nodes and edges of the given host, tombstones
+// excluded. The graph has to be locked.
+func (g *Graph) HostSnapshot(host string) *Snapshot {
+	return g.snapshot(func(n *Node) bool { return n.host == host })
+}
+
+// Snapshot returns all the nodes and edges of the graph, tombstones
+// excluded. The graph has to be locked.
+func (g *Graph) Snapshot() *Snapshot {
+	return g.snapshot(func(n *Node) bool { return true })
+}
+
+func (g *Graph) snapshot(match func(n *Node) bool) *Snapshot {
+	s := &Snapshot{}
+
+	nodes := make(map[Identifier]bool)
+	for _, n := range g.backend.GetNodes() {
+		if match(n) && !IsTombstone(n) {
+			nodes[n.ID] = true
+			s.Nodes = append(s.Nodes, &SnapshotElement{ID: n.ID, Metadata: n.metadata, Host: n.host})
+		}
+	}
+
+	for _, e := range g.backend.GetEdges() {
+		if nodes[e.parent] && nodes[e.child] {
+			s.Edges = append(s.Edges, &SnapshotElement{ID: e.ID, Metadata: e.metadata, Parent: e.parent, Child: e.child, Host: e.host})
+		}
+	}
+
+	return s
+}
+
+// flattenMetadata flattens nested metadata using dotted keys, values are
+// normalized through JSON so that numbers compare the same way whether they
+// come from a probe or from an exported snapshot.
+func flattenMetadata(m Metadata) map[string]interface{} {
+	var normalized map[string]interface{}
+	if data, err := json.Marshal(m); err == nil {
+		json.Unmarshal(data, &normalized)
+	}
+
+	flat := make(map[string]interface{})
+
+	var flatten func(prefix string, m map[string]interface{})
+	flatten = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok {
+				flatten(prefix+k+".", sub)
+			} else {
+				flat[prefix+k] = v
+			}
+		}
+	}
+	flatten("", normalized)
+
+	return flat
+}
+
+// snapshotKeys gives to each node a key independent of its ID, made of its
+// type and of the names of its owners, ie. device:ns1/eth0, so that nodes of
+// different hosts can be matched. The host node itself is keyed as host.
+func snapshotKeys(s *Snapshot, rules *DiffRules) map[string]*SnapshotElement {
+	nodes := make(map[Identifier]*SnapshotElement)
+	for _, n := range s.Nodes {
+		if !rules.ignoreNode(n) {
+			nodes[n.ID] = n
+		}
+	}
+
+	owners := make(map[Identifier]Identifier)
+	for _, e := range s.Edges {
+		if e.Metadata["RelationType"] == "ownership" {
+			owners[e.Child] = e.Parent
+		}
+	}
+
+	var path func(n *SnapshotElement, depth int) string
+	path = func(n *SnapshotElement, depth int) string {
+		name, _ := n.Metadata["Name"].(string)
+		if owner, ok := nodes[owners[n.ID]]; ok && owner.Metadata["Type"] != "host" && depth < 32 {
+			return path(owner, depth+1) + "/" + name
+		}
+		return name
+	}
+
+	// sort by ID so that duplicated keys are numbered the same way each time
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+
+	keys := make(map[string]*SnapshotElement)
+	for _, id := range ids {
+		n := nodes[Identifier(id)]
+
+		var key string
+		if n.Metadata["Type"] == "host" {
+			key = "host"
+		} else {
+			key = fmt.Sprintf("%v:%s", n.Metadata["Type"], path(n, 0))
+		}
+
+		k := key
+		for i := 2; keys[k] != nil; i++ {
+			k = fmt.Sprintf("%s#%d", key, i)
+		}
+		keys[k] = n
+	}
+
+	return keys
+}
+
+func edgeKeys(s *Snapshot, keys map[string]*SnapshotElement) map[string]*SnapshotElement {
+	nodeKeys := make(map[Identifier]string)
+	for k, n := range keys {
+		nodeKeys[n.ID] = k
+	}
+
+	edges := make(map[string]*SnapshotElement)
+	for _, e := range s.Edges {
+		parent, ok1 := nodeKeys[e.Parent]
+		child, ok2 := nodeKeys[e.Child]
+		if ok1 && ok2 {
+			edges[fmt.Sprintf("%s -[%v]-> %s", parent, e.Metadata["RelationType"], child)] = e
+		}
+	}
+
+	return edges
+}
+
+func diffMetadata(from, to *SnapshotElement, rules *DiffRules) map[string]FieldChange {
+	old, new := flattenMetadata(from.Metadata), flattenMetadata(to.Metadata)
+
+	changes := make(map[string]FieldChange)
+	for k, v := range old {
+		if rules.ignoreField(k) {
+			continue
+		}
+		if nv, ok := new[k]; !ok || !reflect.DeepEqual(v, nv) {
+			changes[k] = FieldChange{Old: v, New: nv}
+		}
+	}
+	for k, nv := range new {
+		if _, ok := old[k]; !ok && !rules.ignoreField(k) {
+			changes[k] = FieldChange{New: nv}
+		}
+	}
+
+	// the host name is the one thing expected to differ between hosts
+	if from.Metadata["Type"] == "host" {
+		delete(changes, "Name")
+	}
+
+	return changes
+}
+
+// DiffSnapshots compares two snapshots, nodes are matched by their type and
+// the names of their owners rather than by ID.
+func DiffSnapshots(from, to *Snapshot, rules *DiffRules) *GraphDiff {
+	d := &GraphDiff{}
+
+	fromKeys, toKeys := snapshotKeys(from, rules), snapshotKeys(to, rules)
+
+	for k, n := range fromKeys {
+		if _, ok := toKeys[k]; !ok {
+			d.RemovedNodes = append(d.RemovedNodes, NodeDiff{Key: k, ID: n.ID})
+		}
+	}
+	for k, n := range toKeys {
+		o, ok := fromKeys[k]
+		if !ok {
+			d.AddedNodes = append(d.AddedNodes, NodeDiff{Key: k, ID: n.ID})
+			continue
+		}
+		if changes := diffMetadata(o, n, rules); len(changes) > 0 {
+			d.ChangedNodes = append(d.ChangedNodes, NodeDiff{Key: k, ID: n.ID, Changes: changes})
+		}
+	}
+
+	fromEdges, toEdges := edgeKeys(from, fromKeys), edgeKeys(to, toKeys)
+	for k := range fromEdges {
+		if _, ok := toEdges[k]; !ok {
+			d.RemovedEdges = append(d.RemovedEdges, k)
+		}
+	}
+	for k := range toEdges {
+		if _, ok := fromEdges[k]; !ok {
+			d.AddedEdges = append(d.AddedEdges, k)
+		}
+	}
+
+	sort.Sort(byNodeKey(d.AddedNodes))
+	sort.Sort(byNodeKey(d.RemovedNodes))
+	sort.Sort(byNodeKey(d.ChangedNodes))
+	sort.Strings(d.AddedEdges)
+	sort.Strings(d.RemovedEdges)
+
+	return d
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+)
+
+func baselineSnapshot() *Snapshot {
+	owner := Metadata{"RelationType": "ownership"}
+
+	return &Snapshot{
+		Nodes: []*SnapshotElement{
+			{ID: "h", Metadata: Metadata{"Type": "host", "Name": "baseline"}, Host: "baseline"},
+			{ID: "ns", Metadata: Metadata{"Type": "netns", "Name": "ns1"}, Host: "baseline"},
+			{ID: "eth0", Metadata: Metadata{"Type": "device", "Name": "eth0", "MTU": 1500, "IfIndex": 2}, Host: "baseline"},
+			{ID: "vlan", Metadata: Metadata{"Type": "vlan", "Name": "eth0.100"}, Host: "baseline"},
+			{ID: "veth", Metadata: Metadata{"Type": "veth", "Name": "veth1234"}, Host: "baseline"},
+		},
+		Edges: []*SnapshotElement{
+			{ID: "e1", Parent: "h", Child: "ns", Metadata: owner, Host: "baseline"},
+			{ID: "e2", Parent: "ns", Child: "eth0", Metadata: owner, Host: "baseline"},
+			{ID: "e3", Parent: "ns", Child: "vlan", Metadata: owner, Host: "baseline"},
+			{ID: "e4", Parent: "ns", Child: "veth", Metadata: owner, Host: "baseline"},
+		},
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	g := newGraph(t)
+
+	owner := Metadata{"RelationType": "ownership"}
+	h := g.NewNode(GenID(), Metadata{"Type": "host", "Name": "live"})
+	ns := g.NewNode(GenID(), Metadata{"Type": "netns", "Name": "ns1"})
+	eth0 := g.NewNode(GenID(), Metadata{"Type": "device", "Name": "eth0", "MTU": 9000, "IfIndex": 3})
+	br := g.NewNode(GenID(), Metadata{"Type": "bridge", "Name": "br0"})
+	g.NewNode(GenID(), Metadata{"Type": "veth", "Name": "veth5678"})
+	g.Link(h, ns, owner)
+	g.Link(ns, eth0, owner)
+	g.Link(ns, br, owner)
+
+	rules, err := NewDiffRules([]string{"IfIndex"}, []string{"^veth"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	d := DiffSnapshots(baselineSnapshot(), g.HostSnapshot(g.host), rules)
+
+	if len(d.AddedNodes) != 1 || d.AddedNodes[0].Key != "bridge:ns1/br0" || d.AddedNodes[0].ID != br.ID {
+		t.Errorf("Extra bridge expected: %+v", d.AddedNodes)
+	}
+
+	if len(d.RemovedNodes) != 1 || d.RemovedNodes[0].Key != "vlan:ns1/eth0.100" {
+		t.Errorf("Missing vlan expected: %+v", d.RemovedNodes)
+	}
+
+	if len(d.ChangedNodes) != 1 || d.ChangedNodes[0].ID != eth0.ID {
+		t.Fatalf("Changed MTU expected: %+v", d.ChangedNodes)
+	}
+	if c := d.ChangedNodes[0].Changes; len(c) != 1 || c["MTU"].Old != float64(1500) || c["MTU"].New != float64(9000) {
+		t.Errorf("Only the MTU should have changed: %+v", c)
+	}
+
+	if len(d.AddedEdges) != 1 || len(d.RemovedEdges) != 1 {
+		t.Errorf("Wrong edges diff: %+v %+v", d.AddedEdges, d.RemovedEdges)
+	}
+
+	if d = DiffSnapshots(baselineSnapshot(), baselineSnapshot(), rules); !d.Empty() {
+		t.Errorf("No difference expected: %+v", d)
+	}
+}
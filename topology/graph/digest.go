@@ -0,0 +1,297 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// version of the digests, the digests of another version are ignored and
+// the whole graph is sent
+const digestVersion = 1
+
+// ScopeDigest sums up the nodes or the edges of a host: Hash is the xor of
+// the hashes of the elements, in hexadecimal, and Count their number.
+type ScopeDigest struct {
+	Hash  string
+	Count int
+}
+
+// HostDigest are the digests of the nodes and the edges of a host
+type HostDigest struct {
+	Nodes ScopeDigest
+	Edges ScopeDigest
+}
+
+// SyncDigests are the digests of the graph of a client, sent in its
+// SyncRequest so that it only gets the hosts it's missing.
+type SyncDigests struct {
+	Version int
+	Hosts   map[string]*HostDigest
+}
+
+// SyncDelta answers a SyncRequest with digests: the nodes of the NodeHosts
+// and the edges of the EdgeHosts, the digests of the client being
+// different for them, the ones of these hosts not sent being gone.
+type SyncDelta struct {
+	NodeHosts []string
+	EdgeHosts []string
+	Snapshot
+}
+
+type scopeDigest struct {
+	hash uint64
+	ids  map[Identifier]bool
+}
+
+type elementDigest struct {
+	host string
+	hash uint64
+}
+
+// scopeDigests are the digests of the nodes or the edges per host, with
+// the hash of every element to remove it when it changes
+type scopeDigests struct {
+	hosts    map[string]*scopeDigest
+	elements map[Identifier]elementDigest
+}
+
+// HostDigests maintains the digests of the nodes and the edges of every
+// host on each change of the graph, so that the digests of the whole graph
+// are given without walking it. The hash of an element covers its ID, its
+// host, its metadata as JSON and the nodes of an edge, the content acting
+// as the revision of the element so that two graphs, ie. a replica and its
+// primary, give the same digests for the same elements. The volatile
+// metadata are left out, the clients get them with the next updates.
+type HostDigests struct {
+	DefaultGraphListener
+	Graph *Graph
+	nodes *scopeDigests
+	edges *scopeDigests
+}
+
+func newScopeDigests() *scopeDigests {
+	return &scopeDigests{
+		hosts:    make(map[string]*scopeDigest),
+		elements: make(map[Identifier]elementDigest),
+	}
+}
+
+func (s *scopeDigests) remove(id Identifier) {
+	e, ok := s.elements[id]
+	if !ok {
+		return
+	}
+	delete(s.elements, id)
+
+	d := s.hosts[e.host]
+	d.hash ^= e.hash
+	if delete(d.ids, id); len(d.ids) == 0 {
+		delete(s.hosts, e.host)
+	}
+}
+
+func (s *scopeDigests) set(id Identifier, host string, hash uint64) {
+	s.remove(id)
+
+	d, ok := s.hosts[host]
+	if !ok {
+		d = &scopeDigest{ids: make(map[Identifier]bool)}
+		s.hosts[host] = d
+	}
+	d.hash ^= hash
+	d.ids[id] = true
+
+	s.elements[id] = elementDigest{host: host, hash: hash}
+}
+
+func (s *scopeDigests) digest(host string) ScopeDigest {
+	d, ok := s.hosts[host]
+	if !ok {
+		return ScopeDigest{Hash: "0"}
+	}
+	return ScopeDigest{Hash: strconv.FormatUint(d.hash, 16), Count: len(d.ids)}
+}
+
+func elementHash(e graphElement, parent, child Identifier) uint64 {
+	h := fnv.New64a()
+	for _, s := range []string{string(e.ID), e.host, string(parent), string(child)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	// no metadata and empty metadata are the same once received
+	if m := withoutVolatile(e.metadata); len(m) > 0 {
+		data, _ := json.Marshal(m)
+		h.Write(data)
+	}
+
+	return h.Sum64()
+}
+
+func (d *HostDigests) OnNodeAdded(n *Node) {
+	d.nodes.set(n.ID, n.host, elementHash(n.graphElement, "", ""))
+}
+
+func (d *HostDigests) OnNodeUpdated(n *Node) {
+	d.OnNodeAdded(n)
+}
+
+func (d *HostDigests) OnNodeDeleted(n *Node) {
+	d.nodes.remove(n.ID)
+}
+
+func (d *HostDigests) OnEdgeAdded(e *Edge) {
+	d.edges.set(e.ID, e.host, elementHash(e.graphElement, e.parent, e.child))
+}
+
+func (d *HostDigests) OnEdgeUpdated(e *Edge) {
+	d.OnEdgeAdded(e)
+}
+
+func (d *HostDigests) OnEdgeDeleted(e *Edge) {
+	d.edges.remove(e.ID)
+}
+
+// OnBulkChange computes the digests again, the events of the bulk change
+// not being notified. The graph lock is held.
+func (d *HostDigests) OnBulkChange() {
+	d.nodes, d.edges = newScopeDigests(), newScopeDigests()
+	for _, n := range d.Graph.GetNodes() {
+		d.OnNodeAdded(n)
+	}
+	for _, e := range d.Graph.GetEdges() {
+		d.OnEdgeAdded(e)
+	}
+}
+
+// Digests returns the digests of all the hosts, the graph lock has to be
+// held.
+func (d *HostDigests) Digests() *SyncDigests {
+	digests := &SyncDigests{Version: digestVersion, Hosts: make(map[string]*HostDigest)}
+	for _, s := range []*scopeDigests{d.nodes, d.edges} {
+		for host := range s.hosts {
+			digests.Hosts[host] = &HostDigest{Nodes: d.nodes.digest(host), Edges: d.edges.digest(host)}
+		}
+	}
+
+	return digests
+}
+
+// Diff returns the hosts whose nodes and whose edges differ from the given
+// digests, false if the digests are of another version. The graph lock has
+// to be held.
+func (d *HostDigests) Diff(other *SyncDigests) (nodeHosts []string, edgeHosts []string, ok bool) {
+	if other == nil || other.Version != digestVersion {
+		return nil, nil, false
+	}
+
+	local := d.Digests()
+
+	hosts := make(map[string]bool)
+	for host := range local.Hosts {
+		hosts[host] = true
+	}
+	for host := range other.Hosts {
+		hosts[host] = true
+	}
+
+	empty := &HostDigest{Nodes: ScopeDigest{Hash: "0"}, Edges: ScopeDigest{Hash: "0"}}
+	for host := range hosts {
+		l, o := local.Hosts[host], other.Hosts[host]
+		if l == nil {
+			l = empty
+		}
+		if o == nil {
+			o = empty
+		}
+
+		if l.Nodes != o.Nodes {
+			nodeHosts = append(nodeHosts, host)
+		}
+		if l.Edges != o.Edges {
+			edgeHosts = append(edgeHosts, host)
+		}
+	}
+	sort.Strings(nodeHosts)
+	sort.Strings(edgeHosts)
+
+	return nodeHosts, edgeHosts, true
+}
+
+// Delta returns the nodes and the edges of the hosts whose digests differ
+// from the given ones, looked up from the digests rather than by walking
+// the graph, false if the digests are of another version. The graph lock
+// has to be held.
+func (d *HostDigests) Delta(other *SyncDigests) (*SyncDelta, bool) {
+	nodeHosts, edgeHosts, ok := d.Diff(other)
+	if !ok {
+		return nil, false
+	}
+
+	delta := &SyncDelta{NodeHosts: nodeHosts, EdgeHosts: edgeHosts}
+	for _, host := range nodeHosts {
+		if s, ok := d.nodes.hosts[host]; ok {
+			for id := range s.ids {
+				if n := d.Graph.GetNode(id); n != nil {
+					delta.Nodes = append(delta.Nodes, &SnapshotElement{ID: n.ID, Metadata: n.metadata, Host: n.host})
+				}
+			}
+		}
+	}
+	for _, host := range edgeHosts {
+		if s, ok := d.edges.hosts[host]; ok {
+			for id := range s.ids {
+				if e := d.Graph.GetEdge(id); e != nil {
+					delta.Edges = append(delta.Edges, &SnapshotElement{ID: e.ID, Metadata: e.metadata, Parent: e.parent, Child: e.child, Host: e.host})
+				}
+			}
+		}
+	}
+
+	return delta, true
+}
+
+// Start computes the digests of the graph then maintains them
+func (d *HostDigests) Start() {
+	d.Graph.AddEventListener(d)
+
+	d.Graph.Lock()
+	d.OnBulkChange()
+	d.Graph.Unlock()
+}
+
+func (d *HostDigests) Stop() {
+	d.Graph.RemoveEventListener(d)
+}
+
+func NewHostDigests(g *Graph) *HostDigests {
+	return &HostDigests{
+		Graph: g,
+		nodes: newScopeDigests(),
+		edges: newScopeDigests(),
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// addHostNode adds a node received from an agent
+func addHostNode(g *Graph, id Identifier, m Metadata, host string) *Node {
+	n := hostNode(id, host, m)
+	g.AddNode(n)
+	return n
+}
+
+// addHostEdge adds an edge received from an agent
+func addHostEdge(g *Graph, id Identifier, parent *Node, child *Node, m Metadata, host string) *Edge {
+	e := &Edge{parent: parent.ID, child: child.ID, graphElement: graphElement{ID: id, host: host, metadata: m}}
+	g.AddEdge(e)
+	return e
+}
+
+// addHost adds the graph of an agent, a host node owning its interfaces
+func addHost(g *Graph, host string, interfaces int) *Node {
+	root := addHostNode(g, Identifier(host), Metadata{"Name": host, "Type": "host"}, host)
+	for i := 0; i < interfaces; i++ {
+		n := addHostNode(g, Identifier(fmt.Sprintf("%s-eth%d", host, i)), Metadata{"Name": fmt.Sprintf("eth%d", i), "Type": "device", "MTU": 1500, "MAC": fmt.Sprintf("fa:16:3e:00:00:%02x", i)}, host)
+		addHostEdge(g, Identifier(fmt.Sprintf("%s-owns-%d", host, i)), root, n, Metadata{"RelationType": "ownership"}, host)
+	}
+	return root
+}
+
+func messageSize(t *testing.T, msg shttp.WSMessage) int {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return len(data)
+}
+
+func TestHostDigests(t *testing.T) {
+	g := newGraph(t)
+	d := NewHostDigests(g)
+	d.Start()
+	defer d.Stop()
+
+	addHost(g, "host1", 3)
+	addHost(g, "host2", 3)
+
+	g.AddMetadata(g.GetNode("host1-eth0"), "MTU", 9000)
+	g.DelNode(g.GetNode("host1-eth1"))
+	addHostNode(g, GenID(), Metadata{"Name": "eth9"}, "host1")
+
+	// the digests maintained are the ones of the graph
+	computed := NewHostDigests(g)
+	computed.OnBulkChange()
+	if !reflect.DeepEqual(d.Digests(), computed.Digests()) {
+		t.Errorf("Wrong digests: %+v, expected %+v", d.Digests(), computed.Digests())
+	}
+
+	other := newGraph(t)
+	od := NewHostDigests(other)
+	od.Start()
+	defer od.Stop()
+
+	addHost(other, "host2", 3)
+	addHost(other, "host3", 1)
+
+	nodeHosts, edgeHosts, ok := d.Diff(od.Digests())
+	if !ok || !reflect.DeepEqual(nodeHosts, []string{"host1", "host3"}) || !reflect.DeepEqual(edgeHosts, []string{"host1", "host3"}) {
+		t.Errorf("Wrong hosts differing: %v, %v", nodeHosts, edgeHosts)
+	}
+
+	if _, _, ok := d.Diff(&SyncDigests{Version: digestVersion + 1}); ok {
+		t.Error("Digests of another version shouldn't be compared")
+	}
+}
+
+// TestDeltaSync syncs a replica of the graph of 500 agents, then the
+// primary is unreachable while a few agents change, the events being gone
+// from the journal the replica gets only these agents.
+func TestDeltaSync(t *testing.T) {
+	primary := &GraphServer{Graph: newGraph(t)}
+	primary.HostDigests = NewHostDigests(primary.Graph)
+	primary.HostDigests.Start()
+
+	for i := 0; i < 500; i++ {
+		addHost(primary.Graph, fmt.Sprintf("host%d", i), 20)
+	}
+
+	sent := &sentMessages{}
+	replica := &Replicator{Client: sent, Graph: newGraph(t)}
+	replica.Digests = NewHostDigests(replica.Graph)
+	replica.Digests.Start()
+
+	replica.OnConnected()
+	replies := primary.syncReply("", sent.messages[0])
+	if len(replies) != 1 || replies[0].Type != "SyncReply" {
+		t.Fatalf("Expected the whole graph, got %v", replies)
+	}
+	full := messageSize(t, replies[0])
+	replica.OnMessage(roundTrip(t, replies[0]))
+
+	// the outage, 5 agents change
+	for i := 0; i < 5; i++ {
+		host := fmt.Sprintf("host%d", i*100)
+		primary.Graph.AddMetadata(primary.Graph.GetNode(Identifier(host+"-eth0")), "MTU", 9000)
+		primary.Graph.DelNode(primary.Graph.GetNode(Identifier(host + "-eth1")))
+		n := addHostNode(primary.Graph, Identifier(host+"-tap0"), Metadata{"Name": "tap0", "Type": "tap"}, host)
+		addHostEdge(primary.Graph, Identifier(host+"-owns-tap0"), primary.Graph.GetNode(Identifier(host)), n, Metadata{"RelationType": "ownership"}, host)
+	}
+	// as well as the volatile metadata of all of them
+	primary.Graph.AddMetadata(primary.Graph.GetNode("host499-eth0"), "Statistics", map[string]interface{}{"RxBytes": 42})
+
+	replica.OnConnected()
+	replies = primary.syncReply("", sent.messages[1])
+	if len(replies) != 1 || replies[0].Type != "SyncDeltaReply" {
+		t.Fatalf("Expected the hosts changed, got %v", replies)
+	}
+	// the digests sent by the replica included
+	delta := messageSize(t, sent.messages[1]) + messageSize(t, replies[0])
+	replica.OnMessage(roundTrip(t, replies[0]))
+
+	if d := DiffSnapshots(primary.Graph.Snapshot(), replica.Graph.Snapshot(), &DiffRules{IgnoreFields: []string{"Statistics"}}); !d.Empty() {
+		t.Errorf("Replica should be the graph of the primary: %+v", d)
+	}
+	if nodeHosts, edgeHosts, _ := primary.HostDigests.Diff(replica.Digests.Digests()); len(nodeHosts) != 0 || len(edgeHosts) != 0 {
+		t.Errorf("Replica should have the digests of the primary: %v, %v", nodeHosts, edgeHosts)
+	}
+
+	t.Logf("Sync after the outage: %d bytes instead of %d, %.1f%% of the whole graph", delta, full, float64(delta)*100/float64(full))
+	if delta*20 > full {
+		t.Errorf("Expected the delta to be less than 5%% of the whole graph: %d bytes instead of %d", delta, full)
+	}
+
+	// the clients not getting the graph as it is get the whole graph
+	primary.Filter = NewMetadataFilter([]string{"MAC"}, nil, "")
+	replica.OnConnected()
+	if replies = primary.syncReply("", sent.messages[2]); replies[0].Type != "SyncReply" {
+		t.Errorf("Expected the whole graph for a filtered graph, got %s", replies[0].Type)
+	}
+}
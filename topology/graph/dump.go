@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// time given to a dump on panic, the panicking goroutine may hold the
+// graph lock in which case the dump is given up
+const panicDumpTimeout = 5 * time.Second
+
+// GraphDumper periodically saves a snapshot of the graph, in the topology
+// API export format, to a file for a post-mortem analysis. The file is
+// replaced atomically and the previous snapshots are kept as <path>.1 to
+// <path>.<keep>. The graph is only read locked while being serialized, the
+// file operations happen in the dumper goroutine, outside of the lock.
+type GraphDumper struct {
+	DefaultGraphListener
+	Graph    *Graph
+	Path     string
+	Interval time.Duration
+	Keep     int
+	changed  int32
+	dumpLock sync.Mutex
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+func (d *GraphDumper) setChanged() {
+	atomic.StoreInt32(&d.changed, 1)
+}
+
+func (d *GraphDumper) OnNodeUpdated(n *Node) {
+	d.setChanged()
+}
+
+func (d *GraphDumper) OnNodeAdded(n *Node) {
+	d.setChanged()
+}
+
+func (d *GraphDumper) OnNodeDeleted(n *Node) {
+	d.setChanged()
+}
+
+func (d *GraphDumper) OnEdgeUpdated(e *Edge) {
+	d.setChanged()
+}
+
+func (d *GraphDumper) OnEdgeAdded(e *Edge) {
+	d.setChanged()
+}
+
+func (d *GraphDumper) OnEdgeDeleted(e *Edge) {
+	d.setChanged()
+}
+
+// Dump writes a snapshot of the graph unless it didn't change since the
+// last dump.
+func (d *GraphDumper) Dump() error {
+	d.dumpLock.Lock()
+	defer d.dumpLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&d.changed, 1, 0) {
+		return nil
+	}
+
+	d.Graph.RLock()
+	data, err := json.Marshal(d.Graph.Snapshot())
+	d.Graph.RUnlock()
+
+	if err == nil {
+		err = d.write(data)
+	}
+	if err != nil {
+		d.setChanged()
+	}
+
+	return err
+}
+
+// write replaces the dump file atomically after having shifted the ring of
+// the previous ones.
+func (d *GraphDumper) write(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(d.Path), filepath.Base(d.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.Keep > 0 {
+		for i := d.Keep; i > 1; i-- {
+			from := fmt.Sprintf("%s.%d", d.Path, i-1)
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", d.Path, i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		// linked rather than renamed so that the path always exists
+		previous := d.Path + ".1"
+		os.Remove(previous)
+		if err := os.Link(d.Path, previous); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), d.Path)
+}
+
+// dumpOnPanic is the panic hook of the dumper, the graph is dumped even if
+// unchanged so that the last snapshot is known to match the crash.
+func (d *GraphDumper) dumpOnPanic(r interface{}) {
+	d.setChanged()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Dump()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to dump the graph on panic: %s", err.Error())
+			return
+		}
+		logging.GetLogger().Infof("Graph dumped to %s on panic", d.Path)
+	case <-time.After(panicDumpTimeout):
+		logging.GetLogger().Errorf("Unable to dump the graph on panic, timed out")
+	}
+}
+
+func (d *GraphDumper) run() {
+	defer d.wg.Done()
+
+	// without interval the graph is only dumped on panic
+	var tick <-chan time.Time
+	if d.Interval > 0 {
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := d.Dump(); err != nil {
+				logging.GetLogger().Errorf("Unable to dump the graph to %s: %s", d.Path, err.Error())
+			}
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *GraphDumper) Start() {
+	d.Graph.AddEventListener(d)
+	common.RegisterPanicHook("graph-dump", d.dumpOnPanic)
+
+	d.wg.Add(1)
+	go d.run()
+}
+
+func (d *GraphDumper) Stop() {
+	common.UnregisterPanicHook("graph-dump")
+	d.Graph.RemoveEventListener(d)
+
+	d.quit <- true
+	d.wg.Wait()
+}
+
+func NewGraphDumper(g *Graph, path string, interval time.Duration, keep int) *GraphDumper {
+	return &GraphDumper{
+		Graph:    g,
+		Path:     path,
+		Interval: interval,
+		Keep:     keep,
+		changed:  1,
+		quit:     make(chan bool),
+	}
+}
+
+// NewGraphDumperFromConfig returns nil when no dump path is configured.
+func NewGraphDumperFromConfig(g *Graph, service string) *GraphDumper {
+	cfg := config.GetConfig()
+
+	path := cfg.GetString(service + ".topology.dump.path")
+	if path == "" {
+		return nil
+	}
+
+	interval := time.Duration(cfg.GetInt(service+".topology.dump.interval")) * time.Second
+	return NewGraphDumper(g, path, interval, cfg.GetInt(service+".topology.dump.keep"))
+}
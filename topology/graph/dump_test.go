@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readDump(t *testing.T, path string) *Snapshot {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func TestGraphDumper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := newGraph(t)
+	path := filepath.Join(dir, "graph.json")
+	d := NewGraphDumper(g, path, 0, 2)
+	g.AddEventListener(d)
+
+	g.Lock()
+	n1 := g.NewNode("n1", Metadata{"Name": "eth0"})
+	n2 := g.NewNode("n2", Metadata{"Name": "eth1"})
+	g.Link(n1, n2)
+	g.Unlock()
+
+	if err := d.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	if s := readDump(t, path); len(s.Nodes) != 2 || len(s.Edges) != 1 {
+		t.Fatalf("Expected 2 nodes and 1 edge, got: %+v", s)
+	}
+
+	// unchanged graph, nothing written
+	os.Remove(path)
+	if err := d.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Dump of an unchanged graph not skipped")
+	}
+
+	for i, name := range []string{"n3", "n4", "n5"} {
+		g.Lock()
+		g.NewNode(Identifier(name), nil)
+		g.Unlock()
+
+		if err := d.Dump(); err != nil {
+			t.Fatal(err)
+		}
+		if s := readDump(t, path); len(s.Nodes) != 3+i {
+			t.Fatalf("Expected %d nodes, got: %+v", 3+i, s)
+		}
+	}
+
+	if s := readDump(t, path+".1"); len(s.Nodes) != 4 {
+		t.Errorf("Expected 4 nodes in the previous dump, got: %+v", s)
+	}
+	if s := readDump(t, path+".2"); len(s.Nodes) != 3 {
+		t.Errorf("Expected 3 nodes in the oldest dump, got: %+v", s)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 previous dumps")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 {
+		t.Errorf("Expected no temporary file left, got: %d files", len(files))
+	}
+
+	loaded := newGraph(t)
+	loaded.Lock()
+	loaded.MergeSnapshot(readDump(t, path))
+	loaded.Unlock()
+
+	if n := loaded.GetNode("n1"); n == nil || n.Metadata()["Name"] != "eth0" || n.Host() != g.host {
+		t.Errorf("Node not loaded back: %+v", n)
+	}
+	if !loaded.AreLinked(loaded.GetNode("n1"), loaded.GetNode("n2")) {
+		t.Error("Edge not loaded back")
+	}
+}
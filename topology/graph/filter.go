@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// MetadataFilter drops or hashes metadata keys of the nodes and edges sent
+// outside of the local graph, the local graph itself is never modified. Keys
+// are matched at any level of nested metadata. Hashes are keyed so that the
+// same value always gives the same hash for a given key, allowing correlation.
+// A nil filter lets everything through.
+type MetadataFilter struct {
+	drop map[string]bool
+	hash map[string]bool
+	keep map[string]bool
+	key  []byte
+	// drops the top level volatile keys
+	omitVolatile bool
+	// drops the top level values bigger than this size, as JSON
+	maxValueSize int
+}
+
+type filteredGraph struct {
+	Nodes []*Node
+	Edges []*Edge
+}
+
+func (f *MetadataFilter) HashValue(v interface{}) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(fmt.Sprintf("%v", v)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *MetadataFilter) filterMap(m map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		switch {
+		case f.drop[k]:
+			continue
+		case f.hash[k]:
+			filtered[k] = f.HashValue(v)
+		default:
+			filtered[k] = f.filterNested(v)
+		}
+	}
+
+	return filtered
+}
+
+// filterNested filters the maps of a value, whatever their nesting level
+// in the maps and the lists of the value.
+func (f *MetadataFilter) filterNested(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return f.filterMap(v)
+	case Metadata:
+		return Metadata(f.filterMap(v))
+	case []interface{}:
+		filtered := make([]interface{}, len(v))
+		for i, item := range v {
+			filtered[i] = f.filterNested(item)
+		}
+		return filtered
+	}
+
+	return v
+}
+
+// FilterMetadata returns a filtered copy of the metadata.
+func (f *MetadataFilter) FilterMetadata(m Metadata) Metadata {
+	if f == nil || m == nil {
+		return m
+	}
+
+	filtered := f.filterMap(m)
+	if f.keep != nil {
+		for k := range filtered {
+			if !f.keep[k] {
+				delete(filtered, k)
+			}
+		}
+	}
+	if f.maxValueSize > 0 {
+		for k, v := range filtered {
+			if valueSize(v) > f.maxValueSize {
+				delete(filtered, k)
+			}
+		}
+	}
+	if f.omitVolatile {
+		return withoutVolatile(Metadata(filtered))
+	}
+
+	return Metadata(filtered)
+}
+
+// Select returns a filter applying the same rules and only letting through
+// the given top level keys, the filter itself if no key is given.
+func (f *MetadataFilter) Select(keys []string) *MetadataFilter {
+	if len(keys) == 0 {
+		return f
+	}
+
+	s := &MetadataFilter{keep: make(map[string]bool)}
+	if f != nil {
+		s.drop, s.hash, s.key, s.omitVolatile, s.maxValueSize = f.drop, f.hash, f.key, f.omitVolatile, f.maxValueSize
+	}
+	for _, k := range keys {
+		s.keep[k] = true
+	}
+
+	return s
+}
+
+// WithoutVolatile returns a filter applying the same rules and dropping the
+// volatile metadata.
+func (f *MetadataFilter) WithoutVolatile() *MetadataFilter {
+	s := &MetadataFilter{omitVolatile: true}
+	if f != nil {
+		s.drop, s.hash, s.keep, s.key, s.maxValueSize = f.drop, f.hash, f.keep, f.key, f.maxValueSize
+	}
+
+	return s
+}
+
+// WithMaxValueSize returns a filter applying the same rules and dropping
+// the top level values bigger than the given size as JSON, the filter
+// itself for a zero size.
+func (f *MetadataFilter) WithMaxValueSize(size int) *MetadataFilter {
+	if size <= 0 {
+		return f
+	}
+
+	s := &MetadataFilter{maxValueSize: size}
+	if f != nil {
+		s.drop, s.hash, s.keep, s.key, s.omitVolatile = f.drop, f.hash, f.keep, f.key, f.omitVolatile
+	}
+
+	return s
+}
+
+func (f *MetadataFilter) FilterNode(n *Node) *Node {
+	if f == nil {
+		return n
+	}
+
+	return &Node{
+		graphElement: graphElement{
+			ID:       n.ID,
+			metadata: f.FilterMetadata(n.metadata),
+			host:     n.host,
+		},
+	}
+}
+
+func (f *MetadataFilter) FilterEdge(e *Edge) *Edge {
+	if f == nil {
+		return e
+	}
+
+	return &Edge{
+		graphElement: graphElement{
+			ID:       e.ID,
+			metadata: f.FilterMetadata(e.metadata),
+			host:     e.host,
+		},
+		parent: e.parent,
+		child:  e.child,
+	}
+}
+
+// FilterGraph returns an object serialized the same way as the graph with all
+// the nodes and edges filtered.
+func (f *MetadataFilter) FilterGraph(g *Graph) interface{} {
+	if f == nil {
+		return g
+	}
+
+	fg := &filteredGraph{}
+	for _, n := range g.GetNodes() {
+		fg.Nodes = append(fg.Nodes, f.FilterNode(n))
+	}
+	for _, e := range g.GetEdges() {
+		fg.Edges = append(fg.Edges, f.FilterEdge(e))
+	}
+
+	return fg
+}
+
+// FilterValue filters nodes and edges, other values are returned untouched.
+func (f *MetadataFilter) FilterValue(v interface{}) interface{} {
+	switch v.(type) {
+	case *Node:
+		return f.FilterNode(v.(*Node))
+	case *Edge:
+		return f.FilterEdge(v.(*Edge))
+	case *Graph:
+		return f.FilterGraph(v.(*Graph))
+	case *filteredGraph:
+		if f == nil {
+			return v
+		}
+		fg := &filteredGraph{}
+		for _, n := range v.(*filteredGraph).Nodes {
+			fg.Nodes = append(fg.Nodes, f.FilterNode(n))
+		}
+		for _, e := range v.(*filteredGraph).Edges {
+			fg.Edges = append(fg.Edges, f.FilterEdge(e))
+		}
+		return fg
+	case []*Node:
+		if f == nil {
+			return v
+		}
+		path := make([]*Node, len(v.([]*Node)))
+		for i, n := range v.([]*Node) {
+			path[i] = f.FilterNode(n)
+		}
+		return path
+	}
+	return v
+}
+
+func NewMetadataFilter(drop []string, hash []string, key string) *MetadataFilter {
+	f := &MetadataFilter{
+		drop: make(map[string]bool),
+		hash: make(map[string]bool),
+		key:  []byte(key),
+	}
+
+	for _, k := range drop {
+		f.drop[k] = true
+	}
+	for _, k := range hash {
+		f.hash[k] = true
+	}
+
+	return f
+}
+
+// NewMetadataFilterFromConfig returns the filter of the given destination
+// class, ie. analyzer or api, of a service, nil if nothing has to be filtered.
+func NewMetadataFilterFromConfig(service string, class string) *MetadataFilter {
+	cfg := config.GetConfig()
+
+	prefix := service + ".export." + class
+	drop := cfg.GetStringSlice(prefix + ".drop")
+	hash := cfg.GetStringSlice(prefix + ".hash")
+	if len(drop) == 0 && len(hash) == 0 {
+		return nil
+	}
+
+	key := cfg.GetString(service + ".export.hash_key")
+	if len(hash) > 0 && key == "" {
+		logging.GetLogger().Warningf("No %s.export.hash_key set, hashed metadata could be easily reversed", service)
+	}
+
+	return NewMetadataFilter(drop, hash, key)
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"testing"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// forward mimics the agent forwarder, the message is serialized as it
+// would be on the websocket
+func forward(t *testing.T, g *Graph, f *MetadataFilter, msgType string, obj interface{}) {
+	data, err := json.Marshal(shttp.WSMessage{Namespace: Namespace, Type: msgType, Obj: f.FilterValue(obj)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var msg shttp.WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if msg, err = UnmarshalWSMessage(msg); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	switch msg.Type {
+	case "NodeAdded":
+		g.AddNode(msg.Obj.(*Node))
+	case "EdgeAdded":
+		g.AddEdge(msg.Obj.(*Edge))
+	}
+}
+
+func TestMetadataFilter(t *testing.T) {
+	agent := newGraph(t)
+	analyzer := newGraph(t)
+
+	f := NewMetadataFilter([]string{"ContainerName"}, []string{"MAC"}, "secret")
+
+	n1 := agent.NewNode(GenID(), Metadata{
+		"Name":          "eth0",
+		"MAC":           "00:11:22:33:44:55",
+		"ContainerName": "db",
+		"Neighbors": map[string]interface{}{
+			"IPv4/10.0.0.1": map[string]interface{}{"MAC": "66:77:88:99:aa:bb"},
+		},
+	})
+	n2 := agent.NewNode(GenID(), Metadata{"Name": "eth1", "MAC": "00:11:22:33:44:55"})
+	e := agent.NewEdge(GenID(), n1, n2, Metadata{"RelationType": "layer2"})
+
+	forward(t, analyzer, f, "NodeAdded", n1)
+	forward(t, analyzer, f, "NodeAdded", n2)
+	forward(t, analyzer, f, "EdgeAdded", e)
+
+	if n1.Metadata()["MAC"] != "00:11:22:33:44:55" || n1.Metadata()["ContainerName"] != "db" {
+		t.Errorf("Local graph shouldn't be filtered: %v", n1.Metadata())
+	}
+
+	a1 := analyzer.GetNode(n1.ID)
+	if a1 == nil {
+		t.Fatal("Node not forwarded")
+	}
+
+	m := a1.Metadata()
+	if _, ok := m["ContainerName"]; ok {
+		t.Errorf("ContainerName should have been dropped: %v", m)
+	}
+
+	if m["MAC"] == "00:11:22:33:44:55" || m["MAC"] != f.HashValue("00:11:22:33:44:55") {
+		t.Errorf("MAC should have been hashed: %v", m)
+	}
+
+	neighbor := m["Neighbors"].(map[string]interface{})["IPv4/10.0.0.1"].(map[string]interface{})
+	if neighbor["MAC"] != f.HashValue("66:77:88:99:aa:bb") {
+		t.Errorf("Nested MAC should have been hashed: %v", neighbor)
+	}
+
+	// same value, same key, same hash so that nodes can still be correlated
+	a2 := analyzer.GetNode(n2.ID)
+	if a2 == nil || a2.Metadata()["MAC"] != m["MAC"] {
+		t.Errorf("Hashes should be stable: %v", a2)
+	}
+
+	if NewMetadataFilter(nil, []string{"MAC"}, "secret").HashValue("a") != f.HashValue("a") {
+		t.Error("Hashes should be stable across filters using the same key")
+	}
+
+	if !analyzer.AreLinked(a1, a2) {
+		t.Error("Edge not forwarded")
+	}
+}
+
+func TestMetadataFilterNested(t *testing.T) {
+	f := NewMetadataFilter([]string{"ContainerName"}, []string{"MAC"}, "secret")
+
+	m := f.FilterMetadata(Metadata{
+		"Name": "br0",
+		"Docker": Metadata{
+			"ContainerName": "db",
+			"Interface":     Metadata{"MAC": "00:11:22:33:44:55"},
+		},
+		"FDB": []interface{}{
+			map[string]interface{}{"MAC": "66:77:88:99:aa:bb", "Port": "eth0"},
+			[]interface{}{Metadata{"MAC": "66:77:88:99:aa:cc"}},
+			"eth1",
+		},
+	})
+
+	docker := m["Docker"].(Metadata)
+	if _, ok := docker["ContainerName"]; ok {
+		t.Errorf("Key nested in a metadata value should have been dropped: %v", docker)
+	}
+	if mac := docker["Interface"].(Metadata)["MAC"]; mac != f.HashValue("00:11:22:33:44:55") {
+		t.Errorf("MAC nested in metadata values should have been hashed: %v", mac)
+	}
+
+	fdb := m["FDB"].([]interface{})
+	if entry := fdb[0].(map[string]interface{}); entry["MAC"] != f.HashValue("66:77:88:99:aa:bb") || entry["Port"] != "eth0" {
+		t.Errorf("MAC of a list item should have been hashed: %v", entry)
+	}
+	if entry := fdb[1].([]interface{})[0].(Metadata); entry["MAC"] != f.HashValue("66:77:88:99:aa:cc") {
+		t.Errorf("MAC of a nested list item should have been hashed: %v", entry)
+	}
+	if fdb[2] != "eth1" {
+		t.Errorf("Scalar list items should be kept: %v", fdb)
+	}
+}
+
+func TestMetadataFilterSelect(t *testing.T) {
+	m := Metadata{"Name": "eth0", "MAC": "00:11:22:33:44:55", "MTU": 1500}
+
+	var f *MetadataFilter
+	if s := f.Select(nil); s != nil {
+		t.Error("Selecting nothing should return the filter itself")
+	}
+
+	s := f.Select([]string{"Name", "MAC"}).FilterMetadata(m)
+	if len(s) != 2 || s["Name"] != "eth0" || s["MAC"] != "00:11:22:33:44:55" {
+		t.Errorf("Only Name and MAC expected: %v", s)
+	}
+
+	f = NewMetadataFilter(nil, []string{"MAC"}, "secret")
+	s = f.Select([]string{"MAC"}).FilterMetadata(m)
+	if len(s) != 1 || s["MAC"] != f.HashValue("00:11:22:33:44:55") {
+		t.Errorf("Selected keys should still be filtered: %v", s)
+	}
+}
@@ -23,8 +23,7 @@
 package graph
 
 import (
-	"os"
-
+	"github.com/redhat-cip/skydive/common"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/logging"
 )
@@ -33,60 +32,100 @@ type Forwarder struct {
 	shttp.DefaultWSClientEventHandler
 	Client *shttp.WSAsyncClient
 	Graph  *Graph
+	Filter *MetadataFilter
+}
+
+// syncMessages returns the messages sending the whole graph of the host,
+// between a HostSyncBegin and a HostSyncEnd so that the analyzers
+// reconcile their copy in place, only deleting what is gone.
+func (c *Forwarder) syncMessages(root *Node) []shttp.WSMessage {
+	msgs := []shttp.WSMessage{{
+		Namespace: Namespace,
+		Type:      "HostSyncBegin",
+		Obj:       c.Filter.FilterNode(root),
+	}}
+
+	// tombstones included, the analyzers got them as updated nodes
+	for _, n := range c.Graph.backend.GetNodes() {
+		msgs = append(msgs, shttp.WSMessage{
+			Namespace: Namespace,
+			Type:      "NodeAdded",
+			Obj:       c.Filter.FilterNode(n),
+		})
+	}
+
+	for _, e := range c.Graph.GetEdges() {
+		msgs = append(msgs, shttp.WSMessage{
+			Namespace: Namespace,
+			Type:      "EdgeAdded",
+			Obj:       c.Filter.FilterEdge(e),
+		})
+	}
+
+	return append(msgs, shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      "HostSyncEnd",
+		Obj:       c.Filter.FilterNode(root),
+	})
 }
 
 func (c *Forwarder) triggerResync() {
 	logging.GetLogger().Infof("Start a resync of the graph")
 
-	hostname, err := os.Hostname()
+	host, err := common.HostID()
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to retrieve the hostname: %s", err.Error())
+		logging.GetLogger().Errorf("Unable to retrieve the host identity: %s", err.Error())
 		return
 	}
 
 	c.Graph.Lock()
 	defer c.Graph.Unlock()
 
-	// request for deletion of everythin belonging to host node
-	root := c.Graph.GetNode(Identifier(hostname))
+	c.sendGraph(Identifier(host))
+}
+
+// sendGraph sends the whole graph of the host, the graph lock being held
+func (c *Forwarder) sendGraph(host Identifier) {
+	root := c.Graph.GetNode(host)
 	if root == nil {
 		return
 	}
-	c.Client.SendWSMessage(shttp.WSMessage{
-		Namespace: Namespace,
-		Type:      "SubGraphDeleted",
-		Obj:       root,
-	})
 
-	// re-added all the nodes and edges
-	nodes := c.Graph.GetNodes()
-	for _, n := range nodes {
-		c.Client.SendWSMessage(shttp.WSMessage{
-			Namespace: Namespace,
-			Type:      "NodeAdded",
-			Obj:       n,
-		})
+	for _, msg := range c.syncMessages(root) {
+		c.Client.SendWSMessage(msg)
 	}
+}
 
-	edges := c.Graph.GetEdges()
-	for _, e := range edges {
-		c.Client.SendWSMessage(shttp.WSMessage{
-			Namespace: Namespace,
-			Type:      "EdgeAdded",
-			Obj:       e,
-		})
+// OnBulkChange sends the whole graph instead of the events of a bulk
+// change, the analyzers reconciling their copy in place
+func (c *Forwarder) OnBulkChange() {
+	host, err := common.HostID()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to retrieve the host identity: %s", err.Error())
+		return
 	}
+
+	logging.GetLogger().Infof("Bulk change of the graph, sending the whole graph")
+	c.sendGraph(Identifier(host))
 }
 
 func (c *Forwarder) OnConnected() {
 	c.triggerResync()
 }
 
+func (c *Forwarder) OnMessage(m shttp.WSMessage) {
+	if m.Namespace == Namespace && m.Type == "ResyncRequest" {
+		// don't block the websocket loop while sending the whole graph
+		go c.triggerResync()
+	}
+}
+
 func (c *Forwarder) OnNodeUpdated(n *Node) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "NodeUpdated",
-		Obj:       n,
+		Obj:       c.Filter.FilterNode(n),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -94,7 +133,8 @@ func (c *Forwarder) OnNodeAdded(n *Node) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "NodeAdded",
-		Obj:       n,
+		Obj:       c.Filter.FilterNode(n),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -102,7 +142,8 @@ func (c *Forwarder) OnNodeDeleted(n *Node) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "NodeDeleted",
-		Obj:       n,
+		Obj:       c.Filter.FilterNode(n),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -110,7 +151,8 @@ func (c *Forwarder) OnEdgeUpdated(e *Edge) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "EdgeUpdated",
-		Obj:       e,
+		Obj:       c.Filter.FilterEdge(e),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -118,7 +160,8 @@ func (c *Forwarder) OnEdgeAdded(e *Edge) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "EdgeAdded",
-		Obj:       e,
+		Obj:       c.Filter.FilterEdge(e),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -126,7 +169,8 @@ func (c *Forwarder) OnEdgeDeleted(e *Edge) {
 	c.Client.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
 		Type:      "EdgeDeleted",
-		Obj:       e,
+		Obj:       c.Filter.FilterEdge(e),
+		Tracing:   c.Graph.CurrentTrace(),
 	})
 }
 
@@ -25,13 +25,17 @@ package graph
 import (
 	"encoding/json"
 	"errors"
-	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/nu7hatch/gouuid"
 
 	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/faults"
 )
 
 type Identifier string
@@ -47,6 +51,19 @@ type GraphEventListener interface {
 
 type Metadata map[string]interface{}
 
+// metadataValueEqual compares two metadata values, the comparable ones, ie.
+// strings and numbers, with == and only the others, ie. maps and lists that
+// can't be compared with ==, by their content.
+func metadataValueEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if reflect.TypeOf(a).Comparable() && reflect.TypeOf(b).Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
 type MetadataTransaction struct {
 	graph        *Graph
 	graphElement interface{}
@@ -85,13 +102,46 @@ type GraphBackend interface {
 
 	GetNodes() []*Node
 	GetEdges() []*Edge
+
+	// GetNodesBatch returns the nodes matching each of the filters, grouped
+	// by filter, in one call so that the remote backends save round trips.
+	GetNodesBatch(filters []Metadata) [][]*Node
+}
+
+// GraphBackendCloser is implemented by the backends holding connections or
+// buffered writes, closed with the graph.
+type GraphBackendCloser interface {
+	Close() error
 }
 
 type Graph struct {
+	// first for the 64-bit alignment of the atomic operations
+	revision uint64
 	sync.RWMutex
 	backend        GraphBackend
 	host           string
+	clock          common.Clock
+	limits         *MetadataLimits
+	sizes          *SizeLimits
+	tombstones     *tombstones
+	durables       *durables
+	inherited      Metadata
 	eventListeners []GraphEventListener
+	strictSchema   bool
+	// nodes looked up ahead by Prefetch, per filter
+	prefetched map[string][]*Node
+	// events buffered while suspended
+	suspended     int
+	buffer        *eventBuffer
+	bulkThreshold int
+	// backend storing the revisions reserved, nil if not persistent
+	revisioner       GraphBackendRevisioner
+	reservedRevision uint64
+	// tracer of the mutations, the one being notified and the message
+	// being applied, if traced
+	tracer   *common.Tracer
+	mutation *mutationTrace
+	applying *applyTrace
 }
 
 type MetadataMatcher interface {
@@ -127,6 +177,25 @@ func GenID() Identifier {
 	return Identifier(u.String())
 }
 
+// GenIDFrom returns an identifier derived from the given parts, the same
+// parts always giving the same identifier, so that the nodes of an agent
+// keep their IDs across its restarts.
+func GenIDFrom(parts ...string) Identifier {
+	u, _ := uuid.NewV5(uuid.NamespaceURL, []byte(strings.Join(parts, "/")))
+
+	return Identifier(u.String())
+}
+
+// NewIDFrom returns the identifier derived from the parts, a random one if
+// already used by another node or edge, ie. a tombstone.
+func (g *Graph) NewIDFrom(parts ...string) Identifier {
+	id := GenIDFrom(parts...)
+	if g.backend.GetNode(id) != nil || g.backend.GetEdge(id) != nil {
+		return GenID()
+	}
+	return id
+}
+
 func (m *Metadata) String() string {
 	j, _ := json.Marshal(m)
 	return string(j)
@@ -136,6 +205,10 @@ func (e *graphElement) Metadata() Metadata {
 	return e.metadata
 }
 
+func (e *graphElement) Host() string {
+	return e.host
+}
+
 func (e *graphElement) matchMetadata(f Metadata) bool {
 	for k, v := range f {
 		switch v.(type) {
@@ -156,44 +229,52 @@ func (e *graphElement) matchMetadata(f Metadata) bool {
 	return true
 }
 
+func (e *graphElement) MatchMetadata(f Metadata) bool {
+	return e.matchMetadata(f)
+}
+
 func (e *graphElement) String() string {
 	j, _ := json.Marshal(&struct {
+		Host     string
 		ID       Identifier
 		Metadata Metadata `json:",omitempty"`
-		Host     string
 	}{
+		Host:     e.host,
 		ID:       e.ID,
 		Metadata: e.metadata,
-		Host:     e.host,
 	})
 	return string(j)
 }
 
+// MarshalJSON sorts the fields by name, as encoding/json does for the keys
+// of the metadata and of the decoded objects, so that a node gives the same
+// bytes whether marshaled by its emitter or by a relay having decoded it.
 func (n *Node) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
+		Host     string
 		ID       Identifier
 		Metadata Metadata `json:",omitempty"`
-		Host     string
 	}{
+		Host:     n.host,
 		ID:       n.ID,
 		Metadata: n.metadata,
-		Host:     n.host,
 	})
 }
 
+// MarshalJSON sorts the fields by name, as for the nodes
 func (e *Edge) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
+		Child    Identifier
+		Host     string
 		ID       Identifier
 		Metadata Metadata `json:",omitempty"`
 		Parent   Identifier
-		Child    Identifier
-		Host     string
 	}{
+		Child:    e.child,
+		Host:     e.host,
 		ID:       e.ID,
 		Metadata: e.metadata,
 		Parent:   e.parent,
-		Child:    e.child,
-		Host:     e.host,
 	})
 }
 
@@ -206,18 +287,102 @@ func (g *Graph) notifyMetadataUpdated(e interface{}) {
 	}
 }
 
+// SetInheritedMetadata sets metadata given to all the nodes created by this
+// graph, ie. the location of an agent, so that the nodes can be looked up
+// by these metadata once aggregated by the analyzer. Metadata already set
+// on a node are kept.
+func (g *Graph) SetInheritedMetadata(m Metadata) {
+	g.inherited = m
+}
+
+func (g *Graph) inheritMetadata(e interface{}, m Metadata) Metadata {
+	if len(g.inherited) == 0 {
+		return m
+	}
+
+	if n, ok := e.(*Node); !ok || n.host != g.host {
+		return m
+	}
+
+	if m == nil {
+		m = make(Metadata)
+	}
+	for k, v := range g.inherited {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
 func (g *Graph) SetMetadata(e interface{}, m Metadata) {
-	if !g.backend.SetMetadata(e, m) {
+	m = g.inheritMetadata(e, m)
+	m = g.limits.limitMetadata(elementID(e), m)
+	faults.Sleep(faults.BackendDelay)
+	start := g.traceStart()
+	updated := g.backend.SetMetadata(e, m)
+	g.traceBackend("SetMetadata", start)
+	if !updated {
 		return
 	}
 	g.notifyMetadataUpdated(e)
 }
 
+// markTruncated adds the key to the Truncated marker of the element or
+// removes it, returning whether the metadata changed.
+func (g *Graph) markTruncated(e interface{}, k string, truncated bool) bool {
+	if k == TruncatedKey {
+		return false
+	}
+
+	m := elementMetadata(e)
+	keys := truncatedKeys(m)
+
+	i := sort.SearchStrings(keys, k)
+	if marked := i < len(keys) && keys[i] == k; marked == truncated {
+		return false
+	}
+
+	if truncated {
+		return g.backend.AddMetadata(e, TruncatedKey, mergeKeys(keys, k))
+	}
+
+	if keys = append(keys[:i], keys[i+1:]...); len(keys) > 0 {
+		return g.backend.AddMetadata(e, TruncatedKey, keys)
+	}
+
+	unmarked := make(Metadata, len(m))
+	for key, value := range m {
+		if key != TruncatedKey {
+			unmarked[key] = value
+		}
+	}
+	return g.backend.SetMetadata(e, unmarked)
+}
+
+// addMetadata adds a value within the limits, returning whether the
+// metadata changed.
+func (g *Graph) addMetadata(e interface{}, k string, v interface{}) bool {
+	v, truncated, ok := g.limits.limitAddedValue(e, k, v)
+	if !ok {
+		return g.markTruncated(e, k, true)
+	}
+
+	start := g.traceStart()
+	updated := g.backend.AddMetadata(e, k, v)
+	g.traceBackend("AddMetadata", start)
+	if g.limits != nil && g.markTruncated(e, k, truncated) {
+		updated = true
+	}
+	return updated
+}
+
 func (g *Graph) AddMetadata(e interface{}, k string, v interface{}) {
-	if !g.backend.AddMetadata(e, k, v) {
-		return
+	faults.Sleep(faults.BackendDelay)
+	if g.addMetadata(e, k, v) {
+		g.notifyMetadataUpdated(e)
 	}
-	g.notifyMetadataUpdated(e)
 }
 
 func (t *MetadataTransaction) AddMetadata(k string, v interface{}) {
@@ -236,10 +401,7 @@ func (t *MetadataTransaction) Commit() {
 
 	updated := false
 	for k, v := range t.metadata {
-		if e.metadata[k] != v {
-			if !t.graph.backend.AddMetadata(t.graphElement, k, v) {
-				return
-			}
+		if !metadataValueEqual(e.metadata[k], v) && t.graph.addMetadata(t.graphElement, k, v) {
 			updated = true
 		}
 	}
@@ -375,11 +537,16 @@ func (g *Graph) AreLinked(n1 *Node, n2 *Node) bool {
 	return false
 }
 
+// Link links the nodes, the ID of the edge being derived from the nodes and
+// the relation type, the edge being checked against the constraints of its
+// relation type.
 func (g *Graph) Link(n1 *Node, n2 *Node, m ...Metadata) {
 	if len(m) > 0 {
-		g.NewEdge(GenID(), n1, n2, m[0])
+		relationType, _ := m[0]["RelationType"].(string)
+		g.validateRelation(n1, n2, relationType)
+		g.NewEdge(g.NewIDFrom(string(n1.ID), string(n2.ID), relationType), n1, n2, m[0])
 	} else {
-		g.NewEdge(GenID(), n1, n2, nil)
+		g.NewEdge(g.NewIDFrom(string(n1.ID), string(n2.ID)), n1, n2, nil)
 	}
 }
 
@@ -428,11 +595,111 @@ func (g *Graph) LookupFirstNode(m Metadata) *Node {
 	return nil
 }
 
+// groupNodes returns the nodes matching each of the filters
+func groupNodes(nodes []*Node, filters []Metadata) [][]*Node {
+	groups := make([][]*Node, len(filters))
+	for _, n := range nodes {
+		for i, f := range filters {
+			if n.matchMetadata(f) {
+				groups[i] = append(groups[i], n)
+			}
+		}
+	}
+	return groups
+}
+
+// LookupNodesBatch returns the nodes matching each of the filters, grouped
+// by filter, with a single call to the backend.
+func (g *Graph) LookupNodesBatch(filters ...Metadata) [][]*Node {
+	groups := g.backend.GetNodesBatch(filters)
+
+	results := make([][]*Node, len(filters))
+	for i := range results {
+		results[i] = []*Node{}
+		if i < len(groups) {
+			for _, n := range groups[i] {
+				if !IsTombstone(n) {
+					results[i] = append(results[i], n)
+				}
+			}
+		}
+	}
+
+	return results
+}
+
+// prefetchKey returns the key of a filter in the prefetched nodes, false
+// for the filters using matchers which can't be compared.
+func prefetchKey(m Metadata) (string, bool) {
+	for _, v := range m {
+		if _, ok := v.(MetadataMatcher); ok {
+			return "", false
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Prefetch is a hint given at the beginning of the handling of an event: the
+// nodes matching the filters are looked up with a single call to the
+// backend, the following LookupNodes and LookupFirstNode with the same
+// filters being answered from them until EndPrefetch is called or a node is
+// changed.
+func (g *Graph) Prefetch(filters ...Metadata) {
+	var keys []string
+	var keyed []Metadata
+	for _, f := range filters {
+		if key, ok := prefetchKey(f); ok {
+			keys = append(keys, key)
+			keyed = append(keyed, f)
+		}
+	}
+
+	g.prefetched = make(map[string][]*Node, len(keys))
+	if len(keys) == 0 {
+		return
+	}
+
+	for i, nodes := range g.LookupNodesBatch(keyed...) {
+		g.prefetched[keys[i]] = nodes
+	}
+}
+
+// EndPrefetch drops the nodes looked up by Prefetch
+func (g *Graph) EndPrefetch() {
+	g.prefetched = nil
+}
+
+func (g *Graph) lookupPrefetched(m Metadata) ([]*Node, bool) {
+	if g.prefetched == nil {
+		return nil, false
+	}
+
+	key, ok := prefetchKey(m)
+	if !ok {
+		return nil, false
+	}
+
+	nodes, ok := g.prefetched[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]*Node{}, nodes...), true
+}
+
 func (g *Graph) LookupNodes(m Metadata) []*Node {
+	if nodes, ok := g.lookupPrefetched(m); ok {
+		return nodes
+	}
+
 	nodes := []*Node{}
 
 	for _, n := range g.backend.GetNodes() {
-		if n.matchMetadata(m) {
+		if !IsTombstone(n) && n.matchMetadata(m) {
 			nodes = append(nodes, n)
 		}
 	}
@@ -440,12 +707,24 @@ func (g *Graph) LookupNodes(m Metadata) []*Node {
 	return nodes
 }
 
+func (g *Graph) LookupEdges(m Metadata) []*Edge {
+	edges := []*Edge{}
+
+	for _, e := range g.backend.GetEdges() {
+		if e.matchMetadata(m) {
+			edges = append(edges, e)
+		}
+	}
+
+	return edges
+}
+
 func (g *Graph) LookupNodesFromKey(key string) []*Node {
 	nodes := []*Node{}
 
 	for _, n := range g.backend.GetNodes() {
 		_, ok := n.metadata[key]
-		if ok {
+		if ok && !IsTombstone(n) {
 			nodes = append(nodes, n)
 		}
 	}
@@ -454,9 +733,15 @@ func (g *Graph) LookupNodesFromKey(key string) []*Node {
 }
 
 func (g *Graph) AddEdge(e *Edge) bool {
-	if !g.backend.AddEdge(e) {
+	e.metadata = g.limits.limitMetadata(e.ID, e.metadata)
+	faults.Sleep(faults.BackendDelay)
+	start := g.traceStart()
+	added := g.backend.AddEdge(e)
+	g.traceBackend("AddEdge", start)
+	if !added {
 		return false
 	}
+	g.sizes.countEdges(1)
 	g.NotifyEdgeAdded(e)
 
 	return true
@@ -467,9 +752,18 @@ func (g *Graph) GetEdge(i Identifier) *Edge {
 }
 
 func (g *Graph) AddNode(n *Node) bool {
-	if !g.backend.AddNode(n) {
+	if g.durables != nil {
+		g.durables.reattach(n, g.Now())
+	}
+	n.metadata = g.limits.limitMetadata(n.ID, n.metadata)
+	faults.Sleep(faults.BackendDelay)
+	start := g.traceStart()
+	added := g.backend.AddNode(n)
+	g.traceBackend("AddNode", start)
+	if !added {
 		return false
 	}
+	g.sizes.countNodes(1)
 	g.NotifyNodeAdded(n)
 
 	return true
@@ -492,8 +786,10 @@ func (g *Graph) NewNode(i Identifier, m Metadata) *Node {
 	} else {
 		n.metadata = make(Metadata)
 	}
+	n.metadata = g.inheritMetadata(n, n.metadata)
+	g.validateType(n.metadata, "Type", schema.nodeTypes)
 
-	if !g.AddNode(n) {
+	if g.refuseNode(i, n.metadata) || !g.AddNode(n) {
 		return nil
 	}
 
@@ -515,8 +811,9 @@ func (g *Graph) NewEdge(i Identifier, p *Node, c *Node, m Metadata) *Edge {
 	} else {
 		e.metadata = make(Metadata)
 	}
+	g.validateType(e.metadata, "RelationType", schema.relationTypes)
 
-	if !g.AddEdge(e) {
+	if g.refuseEdge(i) || !g.AddEdge(e) {
 		return nil
 	}
 
@@ -524,18 +821,40 @@ func (g *Graph) NewEdge(i Identifier, p *Node, c *Node, m Metadata) *Edge {
 }
 
 func (g *Graph) DelEdge(e *Edge) {
-	if g.backend.DelEdge(e) {
+	faults.Sleep(faults.BackendDelay)
+	start := g.traceStart()
+	deleted := g.backend.DelEdge(e)
+	g.traceBackend("DelEdge", start)
+	if deleted {
+		g.sizes.countEdges(-1)
 		g.NotifyEdgeDeleted(e)
+		g.checkLimitCleared()
 	}
 }
 
 func (g *Graph) DelNode(n *Node) {
+	g.forgetTombstone(n.ID)
+
 	for _, e := range g.backend.GetNodeEdges(n) {
 		g.DelEdge(e)
 	}
 
-	if g.backend.DelNode(n) {
+	faults.Sleep(faults.BackendDelay)
+	start := g.traceStart()
+	deleted := g.backend.DelNode(n)
+	g.traceBackend("DelNode", start)
+	if deleted {
+		g.sizes.countNodes(-1)
+		g.keepDurables(n)
 		g.NotifyNodeDeleted(n)
+		g.checkLimitCleared()
+	}
+}
+
+// keepDurables keeps the durable metadata of a deleted node
+func (g *Graph) keepDurables(n *Node) {
+	if g.durables != nil {
+		g.durables.keep(n, g.Now())
 	}
 }
 
@@ -561,14 +880,20 @@ func (g *Graph) DelSubGraph(n *Node) {
 	g.delSubGraph(n, make(map[Identifier]bool))
 }
 
+// GetNodes returns the nodes of the graph, the tombstones excluded
 func (g *Graph) GetNodes() []*Node {
-	return g.backend.GetNodes()
+	return g.withoutTombstones(g.backend.GetNodes())
 }
 
 func (g *Graph) GetEdges() []*Edge {
 	return g.backend.GetEdges()
 }
 
+// GetNodeEdges returns the edges from and to the node
+func (g *Graph) GetNodeEdges(n *Node) []*Edge {
+	return g.backend.GetNodeEdges(n)
+}
+
 func (g *Graph) GetEdgeNodes(e *Edge) (*Node, *Node) {
 	return g.backend.GetEdgeNodes(e)
 }
@@ -588,40 +913,92 @@ func (g *Graph) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// the nodes changing, the prefetched ones may not match their filters anymore
 func (g *Graph) NotifyNodeUpdated(n *Node) {
+	g.nextRevision()
+	g.prefetched = nil
+	if g.buffer != nil {
+		g.buffer.addNode(bufferedUpdated, n)
+		return
+	}
+
+	prev := g.traceMutation("NodeUpdated", n.ID)
 	for _, l := range g.eventListeners {
 		l.OnNodeUpdated(n)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) NotifyNodeDeleted(n *Node) {
+	g.nextRevision()
+	g.prefetched = nil
+	if g.buffer != nil {
+		g.buffer.addNode(bufferedDeleted, n)
+		return
+	}
+
+	prev := g.traceMutation("NodeDeleted", n.ID)
 	for _, l := range g.eventListeners {
 		l.OnNodeDeleted(n)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) NotifyNodeAdded(n *Node) {
+	g.nextRevision()
+	g.prefetched = nil
+	if g.buffer != nil {
+		g.buffer.addNode(bufferedAdded, n)
+		return
+	}
+
+	prev := g.traceMutation("NodeAdded", n.ID)
 	for _, l := range g.eventListeners {
 		l.OnNodeAdded(n)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) NotifyEdgeUpdated(e *Edge) {
+	g.nextRevision()
+	if g.buffer != nil {
+		g.buffer.addEdge(bufferedUpdated, e)
+		return
+	}
+
+	prev := g.traceMutation("EdgeUpdated", e.ID)
 	for _, l := range g.eventListeners {
 		l.OnEdgeUpdated(e)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) NotifyEdgeDeleted(e *Edge) {
+	g.nextRevision()
+	if g.buffer != nil {
+		g.buffer.addEdge(bufferedDeleted, e)
+		return
+	}
+
+	prev := g.traceMutation("EdgeDeleted", e.ID)
 	for _, l := range g.eventListeners {
 		l.OnEdgeDeleted(e)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) NotifyEdgeAdded(e *Edge) {
+	g.nextRevision()
+	if g.buffer != nil {
+		g.buffer.addEdge(bufferedAdded, e)
+		return
+	}
+
+	prev := g.traceMutation("EdgeAdded", e.ID)
 	for _, l := range g.eventListeners {
 		l.OnEdgeAdded(e)
 	}
+	g.mutation = prev
 }
 
 func (g *Graph) AddEventListener(l GraphEventListener) {
@@ -631,6 +1008,17 @@ func (g *Graph) AddEventListener(l GraphEventListener) {
 	g.eventListeners = append(g.eventListeners, l)
 }
 
+// AddEventListenerSync registers the listener, calling sync with the graph
+// locked beforehand, so that the listener gets exactly the events following
+// the state of the graph seen by sync.
+func (g *Graph) AddEventListenerSync(l GraphEventListener, sync func()) {
+	g.Lock()
+	defer g.Unlock()
+
+	sync()
+	g.eventListeners = append(g.eventListeners, l)
+}
+
 func (g *Graph) RemoveEventListener(l GraphEventListener) {
 	g.Lock()
 	defer g.Unlock()
@@ -643,16 +1031,100 @@ func (g *Graph) RemoveEventListener(l GraphEventListener) {
 	}
 }
 
+// SetClock replaces the clock used by the graph and its sweepers, tests use
+// it to control the time.
+func (g *Graph) SetClock(c common.Clock) {
+	g.clock = c
+}
+
+// Close closes the backend, the writers of the graph having to be stopped
+// first, the graph can't be used afterwards. The tombstones are not purged
+// anymore.
+func (g *Graph) Close() error {
+	// outside of the lock, the purges taking it
+	if g.tombstones != nil {
+		g.tombstones.wheel.Stop()
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	if closer, ok := g.backend.(GraphBackendCloser); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (g *Graph) SetMetadataLimits(l *MetadataLimits) {
+	g.limits = l
+}
+
+func (g *Graph) Now() time.Time {
+	return g.clock.Now()
+}
+
+// GraphOptions configures a graph, the zero value of a field giving its
+// default behaviour.
+type GraphOptions struct {
+	// Limits bounds the size of the metadata, not limited when nil.
+	Limits *MetadataLimits
+	// StrictSchema makes the nodes and edges of unknown types panic instead
+	// of being reported in the logs.
+	StrictSchema bool
+	// BulkThreshold is the number of elements changed by a bulk operation
+	// above which the whole graph is sent again, no threshold when zero.
+	BulkThreshold int
+	// DurableRetention is the time the durable metadata of a deleted node
+	// are kept, not kept when zero.
+	DurableRetention time.Duration
+}
+
+// GraphOptionsFromConfig returns the options of the graph section of the
+// configuration.
+func GraphOptionsFromConfig() GraphOptions {
+	cfg := config.GetConfig()
+
+	return GraphOptions{
+		Limits:           NewMetadataLimitsFromConfig(),
+		StrictSchema:     cfg.GetBool("graph.schema.strict"),
+		BulkThreshold:    cfg.GetInt("graph.bulk_threshold"),
+		DurableRetention: time.Duration(cfg.GetInt("graph.metadata.durable_retention")) * time.Second,
+	}
+}
+
+// NewGraph returns a graph configured by the configuration, the persistence
+// classes of the metadata keys being registered.
 func NewGraph(b GraphBackend) (*Graph, error) {
-	h, err := os.Hostname()
+	if err := registerMetadataPersistenceFromConfig(); err != nil {
+		return nil, err
+	}
+
+	return NewGraphWithOptions(b, GraphOptionsFromConfig())
+}
+
+// NewGraphWithOptions returns a graph configured by the given options only.
+func NewGraphWithOptions(b GraphBackend, opts GraphOptions) (*Graph, error) {
+	h, err := common.HostID()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Graph{
-		backend: b,
-		host:    h,
-	}, nil
+	g := &Graph{
+		backend:       b,
+		host:          h,
+		clock:         common.RealClock{},
+		limits:        opts.Limits,
+		strictSchema:  opts.StrictSchema,
+		bulkThreshold: opts.BulkThreshold,
+	}
+	g.eventListeners = []GraphEventListener{&busPublisher{graph: g, bus: common.DefaultBus}}
+	g.initRevision()
+
+	if opts.DurableRetention > 0 {
+		g.durables = newDurables(opts.DurableRetention)
+	}
+
+	return g, nil
 }
 
 func BackendFromConfig() (GraphBackend, error) {
@@ -661,16 +1133,27 @@ func BackendFromConfig() (GraphBackend, error) {
 		backend = "memory"
 	}
 
+	b, err := NewBackend(backend, config.GetConfig().GetString("graph.gremlin"))
+	if err == ErrUnknownBackend {
+		return nil, errors.New("Config file is misconfigured, graph backend unknown: " + backend)
+	}
+	return b, err
+}
+
+// ErrUnknownBackend is returned by NewBackend for an unknown type
+var ErrUnknownBackend = errors.New("Graph backend unknown")
+
+// NewBackend returns a backend of the given type, the endpoint being the
+// one of the gremlin backends
+func NewBackend(backend string, endpoint string) (GraphBackend, error) {
 	switch backend {
 	case "memory":
 		return NewMemoryBackend()
 	case "gremlin":
-		endpoint := config.GetConfig().GetString("graph.gremlin")
 		return NewGremlinBackend(endpoint)
 	case "titangraph":
-		endpoint := config.GetConfig().GetString("graph.gremlin")
 		return NewTitangraphBackend(endpoint)
 	default:
-		return nil, errors.New("Config file is misconfigured, graph backend unknown: " + backend)
+		return nil, ErrUnknownBackend
 	}
 }
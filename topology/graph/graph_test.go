@@ -26,6 +26,8 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/redhat-cip/skydive/config"
 )
 
 func newGraph(t *testing.T) *Graph {
@@ -112,6 +114,31 @@ func TestBasicLookup(t *testing.T) {
 	}
 }
 
+func TestLookupEdges(t *testing.T) {
+	g := newGraph(t)
+
+	n1 := g.NewNode(GenID(), Metadata{"Value": 1})
+	n2 := g.NewNode(GenID(), Metadata{"Value": 2})
+	n3 := g.NewNode(GenID(), Metadata{"Value": 3})
+
+	e1 := g.NewEdge(GenID(), n1, n2, Metadata{"RelationType": "layer2", "Type": "veth"})
+	g.NewEdge(GenID(), n2, n3, Metadata{"RelationType": "layer2"})
+	g.NewEdge(GenID(), n1, n3, Metadata{"RelationType": "ownership"})
+
+	r := g.LookupEdges(Metadata{"RelationType": "layer2", "Type": "veth"})
+	if len(r) != 1 || r[0].ID != e1.ID {
+		t.Errorf("Only the veth edge expected: %v", r)
+	}
+
+	if r = g.LookupEdges(Metadata{"RelationType": "layer2"}); len(r) != 2 {
+		t.Errorf("Wrong number of edges returned: %v", r)
+	}
+
+	if r = g.LookupEdges(Metadata{"RelationType": "mount"}); len(r) != 0 {
+		t.Errorf("No edge expected: %v", r)
+	}
+}
+
 func TestBasicLookupMultipleTypes(t *testing.T) {
 	g := newGraph(t)
 
@@ -268,6 +295,13 @@ func TestMetadata(t *testing.T) {
 	if !ok || v != 35 {
 		t.Error("Metadata not updated")
 	}
+
+	g.AddMetadata(n, "Neighbors", map[string]interface{}{"IPv6/fe80::1": "aa"})
+	g.AddMetadata(n, "Neighbors", map[string]interface{}{"IPv6/fe80::1": "bb"})
+	v, ok = n.Metadata()["Neighbors"]
+	if !ok || v.(map[string]interface{})["IPv6/fe80::1"] != "bb" {
+		t.Error("Metadata not updated")
+	}
 }
 
 type FakeListener struct {
@@ -339,3 +373,166 @@ func TestEvents(t *testing.T) {
 		t.Error("Didn't get the notification")
 	}
 }
+
+func TestGraphOptions(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("graph.bulk_threshold", 2)
+	cfg.Set("graph.metadata.max_value_size", 10)
+	defer cfg.Set("graph.bulk_threshold", 1000)
+	defer cfg.Set("graph.metadata.max_value_size", 0)
+
+	b, err := NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the configuration is only read by NewGraph
+	g, err := NewGraphWithOptions(b, GraphOptions{StrictSchema: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if g.bulkThreshold != 0 || g.limits != nil || g.durables != nil || !g.strictSchema {
+		t.Errorf("Graph should only be configured by its options: %d %v %v", g.bulkThreshold, g.limits, g.strictSchema)
+	}
+
+	if g = newGraph(t); g.bulkThreshold != 2 || g.limits == nil || g.limits.MaxValueSize != 10 {
+		t.Errorf("Graph should be configured by the configuration: %d %v", g.bulkThreshold, g.limits)
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	g := newGraph(t)
+	g.SetMetadataLimits(&MetadataLimits{MaxValueSize: 10, MaxSize: 20})
+
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0", "Label": "a very long label"})
+	if _, ok := n.Metadata()["Label"]; ok || n.Metadata()["Name"] != "eth0" {
+		t.Errorf("Oversized value should have been rejected: %v", n.Metadata())
+	}
+
+	g.AddMetadata(n, "Label", "another very long label")
+	if _, ok := n.Metadata()["Label"]; ok {
+		t.Errorf("Oversized value should have been rejected: %v", n.Metadata())
+	}
+
+	// the maximum size of all the metadata is enforced when set as a whole
+	g.AddMetadata(n, "A", "1234")
+	g.AddMetadata(n, "B", "12345678")
+	if n.Metadata()["B"] != "12345678" {
+		t.Errorf("Value within the limit should have been added: %v", n.Metadata())
+	}
+
+	g.SetMetadata(n, n.Metadata())
+	if _, ok := n.Metadata()["B"]; ok || n.Metadata()["A"] != "1234" {
+		t.Errorf("Biggest value exceeding the node maximum size should have been dropped: %v", n.Metadata())
+	}
+
+	g.SetMetadataLimits(&MetadataLimits{MaxValueSize: 10, Truncate: true})
+	g.AddMetadata(n, "Label", "a very long label")
+	if keys := truncatedKeys(n.Metadata()); len(keys) != 2 || keys[0] != "B" || keys[1] != "Label" {
+		t.Errorf("Truncated keys expected: %v", keys)
+	}
+	if n.Metadata()["Label"] != "a very l" {
+		t.Errorf("Oversized string should have been truncated: %v", n.Metadata())
+	}
+
+	g.SetMetadata(n, Metadata{"Name": "eth0", "Map": map[string]interface{}{"key": "a very long value"}})
+	if _, ok := n.Metadata()["Map"]; ok || n.Metadata()["Name"] != "eth0" {
+		t.Errorf("Oversized non string value should have been rejected: %v", n.Metadata())
+	}
+}
+
+func TestInheritedMetadata(t *testing.T) {
+	g := newGraph(t)
+	g.SetInheritedMetadata(Metadata{"Site": "dc1", "Rack": "r12"})
+
+	host := g.NewNode(GenID(), Metadata{"Name": "host1", "Type": "host"})
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0", "Rack": "r13"})
+	g.Link(host, n, Metadata{"RelationType": "ownership"})
+
+	if nodes := g.LookupNodes(Metadata{"Site": "dc1"}); len(nodes) != 2 {
+		t.Errorf("All the nodes should have the site: %v", nodes)
+	}
+
+	if n.Metadata()["Rack"] != "r13" {
+		t.Errorf("Metadata of the node should be kept: %v", n.Metadata())
+	}
+
+	g.SetMetadata(n, Metadata{"Name": "eth0"})
+	if n.Metadata()["Site"] != "dc1" {
+		t.Errorf("Site should be kept after an update: %v", n.Metadata())
+	}
+
+	// nodes of other hosts, ie. received by the analyzer, are left untouched
+	remote := &Node{graphElement: graphElement{ID: GenID(), host: "host2", metadata: Metadata{"Name": "eth1"}}}
+	g.AddNode(remote)
+	g.SetMetadata(remote, Metadata{"Name": "eth1"})
+	if _, ok := remote.Metadata()["Site"]; ok {
+		t.Errorf("Remote node shouldn't inherit the site: %v", remote.Metadata())
+	}
+}
+
+// countingBackend counts the node lookups reaching the backend, each being
+// a round trip for a remote backend
+type countingBackend struct {
+	*MemoryBackend
+	lookups int
+}
+
+func (c *countingBackend) GetNodes() []*Node {
+	c.lookups++
+	return c.MemoryBackend.GetNodes()
+}
+
+func (c *countingBackend) GetNodesBatch(filters []Metadata) [][]*Node {
+	c.lookups++
+	return c.MemoryBackend.GetNodesBatch(filters)
+}
+
+func TestPrefetch(t *testing.T) {
+	m, _ := NewMemoryBackend()
+	b := &countingBackend{MemoryBackend: m}
+	g, err := NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.NewNode(GenID(), Metadata{"Name": "eth0", "IfIndex": 2})
+	g.NewNode(GenID(), Metadata{"Name": "br-int", "Driver": "openvswitch"})
+
+	byIndex := Metadata{"Name": "eth0", "IfIndex": int64(2)}
+	byDriver := Metadata{"Name": "br-int", "Driver": "openvswitch"}
+
+	groups := g.LookupNodesBatch(byIndex, byDriver, Metadata{"Name": "eth1"})
+	if len(groups) != 3 || len(groups[0]) != 1 || len(groups[1]) != 1 || len(groups[2]) != 0 {
+		t.Fatalf("Wrong batch lookup: %v", groups)
+	}
+
+	b.lookups = 0
+	g.Prefetch(byIndex, byDriver)
+
+	if len(g.LookupNodes(byIndex)) != 1 || g.LookupFirstNode(byDriver) == nil || g.LookupFirstNode(byIndex) == nil {
+		t.Error("Prefetched nodes should be found")
+	}
+	if b.lookups != 1 {
+		t.Errorf("Expected one backend lookup for the event, got %d", b.lookups)
+	}
+
+	// not prefetched
+	g.LookupNodes(Metadata{"Name": "eth1"})
+	if b.lookups != 2 {
+		t.Errorf("Expected a backend lookup for a filter not prefetched, got %d", b.lookups)
+	}
+
+	// a change of the nodes drops the prefetched ones
+	g.NewNode(GenID(), Metadata{"Name": "eth0", "IfIndex": 2})
+	if nodes := g.LookupNodes(byIndex); len(nodes) != 2 || b.lookups != 3 {
+		t.Errorf("Expected a backend lookup after a change, got %d lookups and nodes %v", b.lookups, nodes)
+	}
+
+	g.Prefetch(byIndex)
+	g.EndPrefetch()
+	g.LookupNodes(byIndex)
+	if b.lookups != 5 {
+		t.Errorf("Expected a backend lookup once the prefetch ended, got %d", b.lookups)
+	}
+}
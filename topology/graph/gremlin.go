@@ -24,6 +24,8 @@ package graph
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/topology/graph/gremlin"
@@ -53,7 +55,8 @@ func toPropertiesString(e graphElement) ([]byte, error) {
 		"_ID":   string(e.ID),
 		"_host": e.host,
 	}
-	for k, v := range e.metadata {
+	// volatile metadata are not worth a write to the database
+	for k, v := range withoutVolatile(e.metadata) {
 		if k[0] == '_' {
 			return nil, errors.New("Properties starting with _ are reserved")
 		}
@@ -149,12 +152,16 @@ func (g GremlinBackend) SetMetadata(i interface{}, meta Metadata) bool {
 		return false
 	}
 
+	meta = withoutVolatile(meta)
 	j := meta.String()
 
 	query = "g." + elType + "(" + string(el.ID) + ")"
 	query += `.sideEffect{v = it; ["_ID": "` + string(e.ID) + `"`
 	query += `, "_host": "` + string(e.host) + `"`
-	query += `,` + j[1:len(j)-1] + `]`
+	if len(j) > 2 {
+		query += `,` + j[1:len(j)-1]
+	}
+	query += `]`
 	query += `.each{v.get().property(it.key, it.value)}}`
 
 	_, err = g.client.Query(query)
@@ -179,6 +186,10 @@ func (g GremlinBackend) AddMetadata(i interface{}, k string, v interface{}) bool
 		elType = "V"
 	}
 
+	if MetadataPersistence(k) == VolatilePersistence {
+		return true
+	}
+
 	properties, err := idToPropertiesString(e.ID)
 	if err != nil {
 		logging.GetLogger().Errorf("Error while retrieving a Node: %s", err.Error())
@@ -405,6 +416,53 @@ func (g GremlinBackend) GetNodes() []*Node {
 	return nodes
 }
 
+// filterToHasSteps returns the has steps selecting the nodes matching the
+// filter, false if the filter can't be expressed with has steps.
+func filterToHasSteps(f Metadata) (string, bool) {
+	steps := "__"
+	for k, v := range f {
+		encoder := gremlin.GremlinPropertiesEncoder{}
+		if err := encoder.EncodeKVPair(k, v); err != nil {
+			return "", false
+		}
+		steps += ".has(" + encoder.String() + ")"
+	}
+	return steps + ".has('_ID')", true
+}
+
+// GetNodesBatch selects the nodes matching any of the filters with a single
+// query, the nodes being grouped by filter afterwards. Filters which can't be
+// expressed as has steps, ie. with matchers, make it query all the nodes.
+func (g GremlinBackend) GetNodesBatch(filters []Metadata) [][]*Node {
+	var steps []string
+	for _, f := range filters {
+		s, ok := filterToHasSteps(f)
+		if !ok || len(f) == 0 {
+			return groupNodes(g.GetNodes(), filters)
+		}
+		steps = append(steps, s)
+	}
+
+	if len(steps) == 0 {
+		return make([][]*Node, len(filters))
+	}
+
+	query := "g.V().or(" + strings.Join(steps, ", ") + ")"
+
+	els, err := g.client.QueryElements(query)
+	if err != nil {
+		logging.GetLogger().Errorf("Gremlin query error: %s, %s", query, err.Error())
+		return make([][]*Node, len(filters))
+	}
+
+	nodes := make([]*Node, len(els))
+	for i, e := range els {
+		nodes[i] = gremElementToNode(e)
+	}
+
+	return groupNodes(nodes, filters)
+}
+
 func (g GremlinBackend) GetEdges() []*Edge {
 	var edges []*Edge
 
@@ -431,6 +489,37 @@ func (g GremlinBackend) GetEdges() []*Edge {
 	return edges
 }
 
+// GetRevision returns the revision of the graph stored on a vertex of its
+// own, without _ID so that it's not taken for a node, 0 if none
+func (g GremlinBackend) GetRevision() (uint64, error) {
+	els, err := g.client.QueryElements("g.V().has('_revision')")
+	if err != nil || len(els) == 0 {
+		return 0, err
+	}
+
+	if v, ok := els[0].Properties["_revision"]; ok && len(v) > 0 {
+		if revision, ok := v[0].Value.(float64); ok {
+			return uint64(revision), nil
+		}
+	}
+	return 0, errors.New("Malformed graph revision")
+}
+
+// SetRevision stores the revision of the graph
+func (g GremlinBackend) SetRevision(revision uint64) error {
+	query := fmt.Sprintf("g.V().has('_revision').drop().iterate(); graph.addVertex('_revision', %d)", revision)
+	if _, err := g.client.Query(query); err != nil {
+		return fmt.Errorf("Gremlin query error: %s, %s", query, err.Error())
+	}
+	return nil
+}
+
+// Close closes the connection to the gremlin server
+func (g GremlinBackend) Close() error {
+	g.client.Close()
+	return nil
+}
+
 func NewGremlinBackend(endpoint string) (*GremlinBackend, error) {
 	c, err := gremlin.NewClient(endpoint)
 	if err != nil {
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// The agents are keyed by an identity generated on their first start, their
+// hostname being the Name of their host node only. The host nodes of the
+// agents sharing a hostname, ie. cloned VMs, are told apart by their
+// DisplayName.
+
+// hostName returns the Name of a host node
+func hostName(n *Node) (string, bool) {
+	if n.metadata["Type"] != "host" {
+		return "", false
+	}
+	name, ok := n.metadata["Name"].(string)
+	return name, ok
+}
+
+// shortIdentity returns the beginning of an identity, enough to tell the
+// hosts of the same name apart
+func shortIdentity(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// disambiguateHosts sets the DisplayName of the host nodes of the given
+// names, suffixed with their identity when several hosts share the name,
+// removed otherwise.
+func (s *GraphServer) disambiguateHosts(names ...string) {
+	done := make(map[string]bool)
+	for _, name := range names {
+		if done[name] {
+			continue
+		}
+		done[name] = true
+
+		hosts := s.Graph.LookupNodes(Metadata{"Type": "host", "Name": name})
+		for _, n := range hosts {
+			if len(hosts) > 1 {
+				if display := fmt.Sprintf("%s (%s)", name, shortIdentity(n.host)); n.metadata["DisplayName"] != display {
+					s.Graph.AddMetadata(n, "DisplayName", display)
+				}
+				continue
+			}
+
+			if _, ok := n.metadata["DisplayName"]; ok {
+				m := make(Metadata)
+				for k, v := range n.metadata {
+					if k != "DisplayName" {
+						m[k] = v
+					}
+				}
+				s.Graph.SetMetadata(n, m)
+			}
+		}
+	}
+}
+
+// hostNames returns the names of the host nodes a message is about, before
+// it is applied, the name of an updated host possibly changing.
+func (s *GraphServer) hostNames(msg shttp.WSMessage) []string {
+	n, ok := msg.Obj.(*Node)
+	if !ok {
+		return nil
+	}
+	name, ok := hostName(n)
+	if !ok {
+		return nil
+	}
+
+	names := []string{name}
+	if node := s.Graph.GetNode(n.ID); node != nil {
+		if previous, ok := hostName(node); ok && previous != name {
+			names = append(names, previous)
+		}
+	}
+	return names
+}
+
+// migrateHost moves onto the identity of an agent what the analyzer knows
+// of its host under its hostname, the key of the former versions, once the
+// agent has sent its graph. The metadata of the publishers, ie. the CMDB
+// annotations, are copied onto the node of the identity of the same Type
+// and Name, the root onto the root, then the nodes of the hostname are
+// deleted.
+func (s *GraphServer) migrateHost(id, hostname string) {
+	if id == hostname {
+		return
+	}
+
+	root := s.Graph.GetNode(Identifier(hostname))
+	if root == nil || root.host != hostname || root.metadata["Type"] != "host" {
+		return
+	}
+
+	logging.GetLogger().Infof("Graph: migrating the nodes of the host %s onto the identity %s", hostname, id)
+
+	type key struct {
+		nodeType interface{}
+		name     interface{}
+	}
+
+	// the nodes of the identity, the ambiguous ones being left aside
+	targets := make(map[key]*Node)
+	ambiguous := make(map[key]bool)
+	for _, n := range s.Graph.GetNodes() {
+		if n.host != id || n.ID == Identifier(id) {
+			continue
+		}
+		k := key{n.metadata["Type"], n.metadata["Name"]}
+		if _, ok := targets[k]; ok {
+			ambiguous[k] = true
+		}
+		targets[k] = n
+	}
+
+	var olds []*Node
+	for _, n := range s.Graph.GetNodes() {
+		if n.host != hostname {
+			continue
+		}
+		olds = append(olds, n)
+
+		var target *Node
+		if n.ID == root.ID {
+			target = s.Graph.GetNode(Identifier(id))
+		} else if k := (key{n.metadata["Type"], n.metadata["Name"]}); !ambiguous[k] {
+			target = targets[k]
+		}
+		if target == nil {
+			continue
+		}
+
+		var m Metadata
+		for k, v := range n.metadata {
+			if _, ok := target.metadata[k]; ok || s.Origins == nil || s.Origins.origin(k) == "" {
+				continue
+			}
+			if m == nil {
+				m = make(Metadata)
+				for k, v := range target.metadata {
+					m[k] = v
+				}
+			}
+			m[k] = v
+		}
+		if m != nil {
+			s.Graph.SetMetadata(target, m)
+		}
+	}
+
+	for _, n := range olds {
+		s.Graph.DelNode(n)
+	}
+
+	if name, ok := hostName(root); ok {
+		s.disambiguateHosts(name)
+	}
+}
+
+// onIdentitySync migrates the nodes of the hostname of a client once it has
+// sent its graph, unless an agent of the former versions is still connected
+// with this hostname.
+func (s *GraphServer) onIdentitySync(c *shttp.WSClient) {
+	if s.WSServer == nil {
+		return
+	}
+
+	hostname, _ := s.WSServer.GetCapabilities(c.GetHost())["Hostname"].(string)
+	if hostname == "" || hostname == c.GetHost() || s.WSServer.IsConnected(hostname) {
+		return
+	}
+
+	s.migrateHost(c.GetHost(), hostname)
+}
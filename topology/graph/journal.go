@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+type journalEntry struct {
+	msg    shttp.WSMessage
+	time   time.Time
+	filter func(user string) bool
+}
+
+type JournalStats struct {
+	Seq     uint64
+	Size    int
+	Replays int64
+	Resyncs int64
+}
+
+// Journal keeps the last graph events broadcasted, numbered by a sequence
+// number, so that a client reconnecting shortly after a disconnection only
+// gets the events it missed instead of the whole graph. The events are
+// also looked up by the revision of the graph they carry, for the clients
+// which read the graph through the API. The journal is bounded in number of
+// events and in age.
+type Journal struct {
+	sync.RWMutex
+	MaxSize int
+	MaxAge  time.Duration
+	Clock   common.Clock
+	seq     uint64
+	entries []journalEntry
+	replays int64
+	resyncs int64
+	// the events up to this revision may be missing
+	lostRevision uint64
+}
+
+func (j *Journal) expire(now time.Time) {
+	i := 0
+	if j.MaxSize > 0 && len(j.entries) > j.MaxSize {
+		i = len(j.entries) - j.MaxSize
+	}
+
+	if j.MaxAge > 0 {
+		for i < len(j.entries) && now.Sub(j.entries[i].time) > j.MaxAge {
+			i++
+		}
+	}
+
+	if i > 0 {
+		j.lose(j.entries[i-1].msg.Revision)
+		j.entries = append(j.entries[:0], j.entries[i:]...)
+	}
+}
+
+func (j *Journal) lose(revision uint64) {
+	if revision > j.lostRevision {
+		j.lostRevision = revision
+	}
+}
+
+// Append numbers the message and keeps it, the object of the message is
+// serialized as it could be modified later, unless it already is.
+func (j *Journal) Append(msg shttp.WSMessage) shttp.WSMessage {
+	return j.AppendFiltered(msg, nil)
+}
+
+// AppendFiltered appends a message only replayed to the users accepted by
+// the filter.
+func (j *Journal) AppendFiltered(msg shttp.WSMessage, filter func(user string) bool) shttp.WSMessage {
+	j.Lock()
+	defer j.Unlock()
+
+	if _, ok := msg.Obj.(json.RawMessage); !ok {
+		obj, _ := json.Marshal(msg.Obj)
+		msg.Obj = json.RawMessage(obj)
+	}
+
+	j.seq++
+	msg.Seq = j.seq
+
+	now := j.Clock.Now()
+	j.entries = append(j.entries, journalEntry{msg: msg, time: now, filter: filter})
+	j.expire(now)
+
+	return msg
+}
+
+// Since returns the events following the given sequence number, false if
+// some of them are not in the journal anymore, then a full resync is needed.
+func (j *Journal) Since(seq uint64) ([]shttp.WSMessage, bool) {
+	return j.since(seq, nil)
+}
+
+// SinceFor returns the events following the given sequence number the user
+// may get.
+func (j *Journal) SinceFor(seq uint64, user string) ([]shttp.WSMessage, bool) {
+	return j.since(seq, &user)
+}
+
+func (j *Journal) since(seq uint64, user *string) ([]shttp.WSMessage, bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.expire(j.Clock.Now())
+
+	if seq > j.seq {
+		// sequence of another analyzer or of a previous run
+		j.resyncs++
+		return nil, false
+	}
+
+	first := j.seq + 1
+	if len(j.entries) > 0 {
+		first = j.entries[0].msg.Seq
+	}
+
+	if seq+1 < first {
+		j.resyncs++
+		return nil, false
+	}
+
+	var msgs []shttp.WSMessage
+	for _, e := range j.entries {
+		if e.msg.Seq > seq && (user == nil || e.filter == nil || e.filter(*user)) {
+			msgs = append(msgs, e.msg)
+		}
+	}
+	j.replays++
+
+	return msgs, true
+}
+
+// SinceRevisionFor returns the events following the given revision of the
+// graph the user may get, false if some of them are not in the journal
+// anymore.
+func (j *Journal) SinceRevisionFor(revision uint64, user string) ([]shttp.WSMessage, bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.expire(j.Clock.Now())
+
+	if revision < j.lostRevision {
+		j.resyncs++
+		return nil, false
+	}
+
+	var msgs []shttp.WSMessage
+	for _, e := range j.entries {
+		if e.msg.Revision > revision && (e.filter == nil || e.filter(user)) {
+			msgs = append(msgs, e.msg)
+		}
+	}
+	j.replays++
+
+	return msgs, true
+}
+
+// Skip records that the events up to the given revision were lost, the
+// clients which got the events preceding them get the whole graph when
+// syncing.
+func (j *Journal) Skip(revision uint64) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.seq++
+	j.entries = j.entries[:0]
+	j.lose(revision)
+}
+
+// Seq returns the sequence number of the last event
+func (j *Journal) Seq() uint64 {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.seq
+}
+
+func (j *Journal) Stats() JournalStats {
+	j.RLock()
+	defer j.RUnlock()
+
+	return JournalStats{
+		Seq:     j.seq,
+		Size:    len(j.entries),
+		Replays: j.replays,
+		Resyncs: j.resyncs,
+	}
+}
+
+func NewJournal(maxSize int, maxAge time.Duration) *Journal {
+	return &Journal{
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		Clock:   common.RealClock{},
+		// sequence numbers start at the creation time, in microseconds, so
+		// that the ones of a previous run are not mistaken for the current
+		// ones while staying usable as javascript numbers
+		seq: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+func TestJournal(t *testing.T) {
+	clock := common.NewFakeClock(time.Now())
+
+	j := NewJournal(3, time.Minute)
+	j.Clock = clock
+
+	start := j.Seq()
+	for _, name := range []string{"n1", "n2", "n3", "n4"} {
+		clock.Advance(time.Second)
+		msg := j.Append(shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: Metadata{"Name": name}})
+		if msg.Seq != j.Seq() {
+			t.Errorf("Wrong sequence number: %d", msg.Seq)
+		}
+	}
+
+	msgs, ok := j.Since(start + 2)
+	if !ok || len(msgs) != 2 || msgs[0].Seq != start+3 {
+		t.Errorf("Missed events expected: %+v", msgs)
+	}
+
+	if msgs, ok := j.Since(j.Seq()); !ok || len(msgs) != 0 {
+		t.Errorf("No event expected: %+v", msgs)
+	}
+
+	// first event dropped as the journal is full
+	if _, ok := j.Since(start); ok {
+		t.Error("Resync expected for events not in the journal anymore")
+	}
+
+	// sequence unknown, ie. from a previous run
+	if _, ok := j.Since(j.Seq() + 10); ok {
+		t.Error("Resync expected for an unknown sequence")
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, ok := j.Since(start + 3); ok {
+		t.Error("Resync expected for expired events")
+	}
+
+	if stats := j.Stats(); stats.Size != 0 || stats.Replays != 2 || stats.Resyncs != 3 {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+}
+
+func TestSyncReplyFromJournal(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode(GenID(), Metadata{"Name": "n1"})
+
+	s := &GraphServer{Graph: g, journal: NewJournal(10, time.Minute)}
+
+	replies := s.syncReply("", wsMessage(t, "SyncRequest", nil))
+	if len(replies) != 1 || replies[0].Type != "SyncReply" || replies[0].Seq != s.journal.Seq() {
+		t.Fatalf("Full sync expected: %+v", replies)
+	}
+	last := replies[0].Seq
+
+	n2 := g.NewNode(GenID(), Metadata{"Name": "n2"})
+	s.journal.Append(shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: n2})
+
+	replies = s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"From": last}))
+	if len(replies) != 1 || replies[0].Type != "NodeAdded" || replies[0].Seq != last+1 {
+		t.Errorf("Only the missed event expected: %+v", replies)
+	}
+
+	replies = s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"From": last + 5}))
+	if len(replies) != 1 || replies[0].Type != "SyncReply" {
+		t.Errorf("Full sync expected for an unknown sequence: %+v", replies)
+	}
+}
+
+func TestJournalRevisions(t *testing.T) {
+	clock := common.NewFakeClock(time.Now())
+
+	j := NewJournal(3, time.Minute)
+	j.Clock = clock
+
+	for i, name := range []string{"n1", "n2", "n3", "n4"} {
+		clock.Advance(time.Second)
+		j.Append(shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: Metadata{"Name": name}, Revision: uint64(10 + i)})
+	}
+
+	msgs, ok := j.SinceRevisionFor(11, "")
+	if !ok || len(msgs) != 2 || msgs[0].Revision != 12 || msgs[1].Revision != 13 {
+		t.Errorf("Missed events expected: %+v", msgs)
+	}
+
+	// the event of the revision 10 dropped as the journal is full
+	if _, ok := j.SinceRevisionFor(9, ""); ok {
+		t.Error("Resync expected for events not in the journal anymore")
+	}
+	if _, ok := j.SinceRevisionFor(10, ""); !ok {
+		t.Error("No resync expected, no event after the revision is missing")
+	}
+
+	j.Skip(20)
+	if _, ok := j.SinceRevisionFor(13, ""); ok {
+		t.Error("Resync expected for skipped events")
+	}
+	if msgs, ok := j.SinceRevisionFor(20, ""); !ok || len(msgs) != 0 {
+		t.Errorf("No event expected: %+v", msgs)
+	}
+}
+
+// TestSyncFromRevision lists the graph as the API does then gets the events
+// which followed from the revision it was listed at
+func TestSyncFromRevision(t *testing.T) {
+	g := newGraph(t)
+	s := &GraphServer{Graph: g, journal: NewJournal(10, time.Minute)}
+	s.journal.Skip(g.Revision())
+
+	g.NewNode(GenID(), Metadata{"Name": "n1"})
+	listed := g.Revision()
+
+	n2 := g.NewNode(GenID(), Metadata{"Name": "n2"})
+	s.journal.Append(shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: n2, Revision: g.Revision()})
+	if g.Revision() <= listed {
+		t.Fatalf("Revision expected to be incremented: %d", g.Revision())
+	}
+
+	replies := s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"FromRevision": listed}))
+	if len(replies) != 1 || replies[0].Type != "NodeAdded" || replies[0].Revision != g.Revision() {
+		t.Errorf("Only the event following the revision expected: %+v", replies)
+	}
+
+	for _, revision := range []uint64{listed - 2, g.Revision() + 1} {
+		replies = s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"FromRevision": revision}))
+		if len(replies) != 1 || replies[0].Type != "ResyncRequired" || replies[0].Revision != g.Revision() {
+			t.Errorf("Resync expected from revision %d: %+v", revision, replies)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// TruncatedKey is the metadata listing the keys of an element whose value
+// was truncated or dropped to stay within the limits, it isn't accounted in
+// the size of the metadata.
+const TruncatedKey = "Truncated"
+
+// MetadataLimits bounds the size of the metadata of the nodes and edges, a
+// size being the length of the JSON representation. Oversized string values
+// can be truncated, other oversized values are rejected. When all the
+// metadata of an element, set as a whole, exceed the maximum size the
+// biggest values are dropped. A zero size means no limit.
+type MetadataLimits struct {
+	// violations counters, first for the 64 bits alignment
+	truncated    int64
+	dropped      int64
+	rejected     int64
+	MaxValueSize int
+	MaxSize      int
+	Truncate     bool
+}
+
+// MetadataLimitsMetrics are the limits and the number of values truncated
+// or dropped by the graph and of the writes rejected.
+type MetadataLimitsMetrics struct {
+	MaxValueSize int
+	MaxSize      int
+	Truncate     bool
+	Truncated    int64
+	Dropped      int64
+	Rejected     int64
+}
+
+type metadataValueSize struct {
+	key  string
+	size int
+}
+
+type bySizeDesc []metadataValueSize
+
+func (s bySizeDesc) Len() int           { return len(s) }
+func (s bySizeDesc) Less(i, j int) bool { return s[i].size > s[j].size }
+func (s bySizeDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func valueSize(v interface{}) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+func truncateString(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+
+	s = s[:size]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func elementID(e interface{}) Identifier {
+	switch e.(type) {
+	case *Node:
+		return e.(*Node).ID
+	case *Edge:
+		return e.(*Edge).ID
+	}
+	return ""
+}
+
+func elementMetadata(e interface{}) Metadata {
+	switch e.(type) {
+	case *Node:
+		return e.(*Node).metadata
+	case *Edge:
+		return e.(*Edge).metadata
+	}
+	return nil
+}
+
+// truncatedKeys returns a copy of the keys listed by the Truncated marker,
+// a list of interfaces once decoded from JSON.
+func truncatedKeys(m Metadata) []string {
+	switch keys := m[TruncatedKey].(type) {
+	case []string:
+		return append([]string{}, keys...)
+	case []interface{}:
+		var l []string
+		for _, k := range keys {
+			if s, ok := k.(string); ok {
+				l = append(l, s)
+			}
+		}
+		return l
+	}
+	return nil
+}
+
+// mergeKeys returns the sorted union of the keys without duplicate
+func mergeKeys(keys []string, others ...string) []string {
+	set := make(map[string]bool)
+	for _, k := range append(keys, others...) {
+		set[k] = true
+	}
+
+	merged := make([]string, 0, len(set))
+	for k := range set {
+		merged = append(merged, k)
+	}
+	sort.Strings(merged)
+
+	return merged
+}
+
+// limitValue returns the value, truncated if needed, its size and whether
+// it was truncated, false if the value has to be rejected.
+func (l *MetadataLimits) limitValue(id Identifier, k string, v interface{}) (interface{}, int, bool, bool) {
+	if l == nil || k == TruncatedKey {
+		return v, 0, false, true
+	}
+
+	size := valueSize(v)
+	if l.MaxValueSize <= 0 || size <= l.MaxValueSize {
+		return v, size, false, true
+	}
+
+	if s, ok := v.(string); ok && l.Truncate {
+		// keep room for the quotes and the escaped characters
+		for n := l.MaxValueSize - 2; n > 0 && valueSize(s) > l.MaxValueSize; n -= valueSize(s) - l.MaxValueSize {
+			s = truncateString(s, n)
+		}
+		v = s
+		atomic.AddInt64(&l.truncated, 1)
+		logging.GetLogger().Warningf("Metadata %s of %s truncated, %d bytes exceeding the maximum of %d", k, id, size, l.MaxValueSize)
+		return v, valueSize(v), true, true
+	}
+
+	atomic.AddInt64(&l.dropped, 1)
+	logging.GetLogger().Warningf("Metadata %s of %s rejected, %d bytes exceeding the maximum of %d", k, id, size, l.MaxValueSize)
+	return nil, 0, false, false
+}
+
+// limitMetadata returns the metadata within the limits, the given ones if
+// nothing had to be changed. The keys truncated or dropped are added to the
+// Truncated marker.
+func (l *MetadataLimits) limitMetadata(id Identifier, m Metadata) Metadata {
+	if l == nil || (l.MaxValueSize <= 0 && l.MaxSize <= 0) || m == nil {
+		return m
+	}
+
+	limited := make(Metadata, len(m))
+	var marked []string
+
+	var sizes []metadataValueSize
+	total := 0
+	for k, v := range m {
+		if k == TruncatedKey {
+			limited[k] = v
+			continue
+		}
+
+		nv, size, truncated, ok := l.limitValue(id, k, v)
+		if !ok || truncated {
+			marked = append(marked, k)
+		}
+		if !ok {
+			continue
+		}
+		limited[k] = nv
+		sizes = append(sizes, metadataValueSize{key: k, size: size})
+		total += size
+	}
+
+	if l.MaxSize > 0 && total > l.MaxSize {
+		sort.Sort(bySizeDesc(sizes))
+		for _, s := range sizes {
+			if total <= l.MaxSize {
+				break
+			}
+			delete(limited, s.key)
+			total -= s.size
+			marked = append(marked, s.key)
+			atomic.AddInt64(&l.dropped, 1)
+			logging.GetLogger().Warningf("Metadata %s of %s dropped, %d bytes exceeding the maximum of %d for all the metadata", s.key, id, s.size, l.MaxSize)
+		}
+	}
+
+	if len(marked) == 0 {
+		return m
+	}
+	limited[TruncatedKey] = mergeKeys(truncatedKeys(m), marked...)
+
+	return limited
+}
+
+// limitAddedValue checks a value added to the metadata of an element,
+// returning the value, truncated if needed, whether it was truncated and
+// false if the value has to be rejected. Only the size of the value is
+// checked, the maximum size of all the metadata being enforced when they
+// are set as a whole so that the other values aren't marshalled on each
+// addition.
+func (l *MetadataLimits) limitAddedValue(e interface{}, k string, v interface{}) (interface{}, bool, bool) {
+	if l == nil || l.MaxValueSize <= 0 {
+		return v, false, true
+	}
+
+	nv, _, truncated, ok := l.limitValue(elementID(e), k, v)
+	return nv, truncated, ok
+}
+
+// Check returns an error if a value or all the metadata exceed the limits,
+// the writes of the users being rejected as a whole rather than truncated.
+func (l *MetadataLimits) Check(m Metadata) error {
+	if l == nil || (l.MaxValueSize <= 0 && l.MaxSize <= 0) {
+		return nil
+	}
+
+	total := 0
+	for k, v := range m {
+		size := valueSize(v)
+		if l.MaxValueSize > 0 && size > l.MaxValueSize {
+			atomic.AddInt64(&l.rejected, 1)
+			return fmt.Errorf("Metadata %s of %d bytes exceeding the maximum of %d", k, size, l.MaxValueSize)
+		}
+		total += size
+	}
+
+	if l.MaxSize > 0 && total > l.MaxSize {
+		atomic.AddInt64(&l.rejected, 1)
+		return fmt.Errorf("Metadata of %d bytes exceeding the maximum of %d", total, l.MaxSize)
+	}
+
+	return nil
+}
+
+// Metrics returns the limits and the violations counters, nil without
+// limits.
+func (l *MetadataLimits) Metrics() *MetadataLimitsMetrics {
+	if l == nil {
+		return nil
+	}
+
+	return &MetadataLimitsMetrics{
+		MaxValueSize: l.MaxValueSize,
+		MaxSize:      l.MaxSize,
+		Truncate:     l.Truncate,
+		Truncated:    atomic.LoadInt64(&l.truncated),
+		Dropped:      atomic.LoadInt64(&l.dropped),
+		Rejected:     atomic.LoadInt64(&l.rejected),
+	}
+}
+
+// NewMetadataLimitsFromConfig returns the configured limits, nil if the
+// metadata are not limited.
+func NewMetadataLimitsFromConfig() *MetadataLimits {
+	cfg := config.GetConfig()
+
+	l := &MetadataLimits{
+		MaxValueSize: cfg.GetInt("graph.metadata.max_value_size"),
+		MaxSize:      cfg.GetInt("graph.metadata.max_size"),
+		Truncate:     cfg.GetBool("graph.metadata.truncate"),
+	}
+	if l.MaxValueSize <= 0 && l.MaxSize <= 0 {
+		return nil
+	}
+
+	return l
+}
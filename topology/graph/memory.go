@@ -57,7 +57,7 @@ func (m MemoryBackend) AddMetadata(i interface{}, k string, v interface{}) bool
 		e = i.(*Edge).graphElement
 	}
 
-	if o, ok := e.metadata[k]; ok && o == v {
+	if o, ok := e.metadata[k]; ok && metadataValueEqual(o, v) {
 		return false
 	}
 	e.metadata[k] = v
@@ -178,6 +178,10 @@ func (m MemoryBackend) GetNodes() []*Node {
 	return nodes
 }
 
+func (m MemoryBackend) GetNodesBatch(filters []Metadata) [][]*Node {
+	return groupNodes(m.GetNodes(), filters)
+}
+
 func (m MemoryBackend) GetEdges() []*Edge {
 	edges := []*Edge{}
 
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Merge imports the nodes and edges of another graph, keeping their IDs and
+// hosts. On an ID collision the metadata are unioned, the values of the other
+// graph taking precedence over the existing ones. Events are emitted for each
+// added or updated element so that the connected clients converge. The graph
+// has to be locked, the other graph is read locked by Merge.
+func (g *Graph) Merge(other *Graph) {
+	other.RLock()
+	s := other.Snapshot()
+	other.RUnlock()
+
+	g.MergeSnapshot(s)
+}
+
+// MergeSnapshot adds the nodes and edges of a snapshot to the graph, with the
+// same collision rules as Merge. Edges whose nodes are unknown are skipped.
+// The graph has to be locked.
+func (g *Graph) MergeSnapshot(s *Snapshot) {
+	for _, e := range s.Nodes {
+		if n := g.GetNode(e.ID); n != nil {
+			g.mergeMetadata(n, e)
+			continue
+		}
+
+		n := &Node{graphElement: graphElement{ID: e.ID, metadata: copyMetadata(e.Metadata), host: e.Host}}
+		g.AddNode(n)
+	}
+
+	for _, e := range s.Edges {
+		if edge := g.GetEdge(e.ID); edge != nil {
+			if edge.parent != e.Parent || edge.child != e.Child {
+				logging.GetLogger().Warningf("Unable to merge edge %s, %s -> %s conflicts with %s -> %s", e.ID, e.Parent, e.Child, edge.parent, edge.child)
+				continue
+			}
+			g.mergeMetadata(edge, e)
+			continue
+		}
+
+		edge := &Edge{graphElement: graphElement{ID: e.ID, metadata: copyMetadata(e.Metadata), host: e.Host}, parent: e.Parent, child: e.Child}
+		if !g.AddEdge(edge) {
+			logging.GetLogger().Warningf("Unable to merge edge %s, missing node %s or %s", e.ID, e.Parent, e.Child)
+		}
+	}
+}
+
+func (g *Graph) mergeMetadata(i interface{}, e *SnapshotElement) {
+	var current Metadata
+	switch i := i.(type) {
+	case *Node:
+		current = i.metadata
+	case *Edge:
+		current = i.metadata
+	}
+
+	merged := copyMetadata(current)
+	var updated bool
+	var conflicts []string
+	for k, v := range e.Metadata {
+		old, ok := current[k]
+		if ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		if ok {
+			conflicts = append(conflicts, k)
+		}
+		merged[k] = v
+		updated = true
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		logging.GetLogger().Warningf("Conflicting metadata %v while merging %s, keeping the merged values", conflicts, e.ID)
+	}
+
+	if updated {
+		g.SetMetadata(i, merged)
+	}
+}
+
+func copyMetadata(m Metadata) Metadata {
+	c := make(Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode("n1", Metadata{"Name": "eth0", "MTU": 1500, "State": "UP"})
+
+	other := newGraph(t)
+	o1 := other.NewNode("n1", Metadata{"Name": "eth0", "MTU": 9000, "Driver": "veth"})
+	o2 := other.NewNode("n2", Metadata{"Name": "br0"})
+	other.NewEdge("e1", o1, o2, Metadata{"RelationType": "layer2"})
+
+	l := &FakeListener{}
+	g.AddEventListener(l)
+
+	g.Lock()
+	g.Merge(other)
+	g.Unlock()
+
+	m := n1.Metadata()
+	if m["MTU"] != 9000 || m["Driver"] != "veth" || m["State"] != "UP" {
+		t.Errorf("Metadata not unioned, got: %v", m)
+	}
+	if l.lastNodeUpdated == nil || l.lastNodeUpdated.ID != "n1" {
+		t.Error("Expected an update event for the colliding node")
+	}
+	if l.lastNodeAdded == nil || l.lastNodeAdded.ID != "n2" {
+		t.Error("Expected an add event for the merged node")
+	}
+	if l.lastEdgeAdded == nil || l.lastEdgeAdded.ID != "e1" {
+		t.Error("Expected an add event for the merged edge")
+	}
+	if !g.AreLinked(n1, g.GetNode("n2")) {
+		t.Error("Merged nodes should be linked")
+	}
+
+	// merging again is a no-op
+	l.lastNodeUpdated = nil
+	g.Lock()
+	g.Merge(other)
+	g.Unlock()
+
+	if l.lastNodeUpdated != nil {
+		t.Error("Expected no update event when merging the same graph twice")
+	}
+}
+
+func TestMergeSnapshotMissingNode(t *testing.T) {
+	g := newGraph(t)
+	g.NewNode("n1", Metadata{})
+
+	g.Lock()
+	g.MergeSnapshot(&Snapshot{
+		Edges: []*SnapshotElement{{ID: "e1", Parent: "n1", Child: "n2"}},
+	})
+	g.Unlock()
+
+	if g.GetEdge("e1") != nil {
+		t.Error("Edge with an unknown node should be skipped")
+	}
+}
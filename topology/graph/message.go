@@ -28,7 +28,14 @@ import (
 	shttp "github.com/redhat-cip/skydive/http"
 )
 
+// UnmarshalWSMessage decodes the node or the edge of a graph message, the
+// messages of another major version being rejected and the unknown fields
+// ignored.
 func UnmarshalWSMessage(msg shttp.WSMessage) (shttp.WSMessage, error) {
+	if err := msg.CheckVersion(); err != nil {
+		return msg, err
+	}
+
 	if msg.Type == "SyncRequest" {
 		return msg, nil
 	}
@@ -50,11 +57,17 @@ func UnmarshalWSMessage(msg shttp.WSMessage) (shttp.WSMessage, error) {
 	/* Graph Section */
 	case "SubGraphDeleted":
 		fallthrough
+	case "HostSyncBegin":
+		fallthrough
+	case "HostSyncEnd":
+		fallthrough
 	case "NodeUpdated":
 		fallthrough
 	case "NodeDeleted":
 		fallthrough
 	case "NodeAdded":
+		fallthrough
+	case "NodeUpserted":
 		if m, ok := objMap["Metadata"]; ok {
 			metadata = Metadata(m.(map[string]interface{}))
 		}
@@ -71,6 +84,8 @@ func UnmarshalWSMessage(msg shttp.WSMessage) (shttp.WSMessage, error) {
 	case "EdgeDeleted":
 		fallthrough
 	case "EdgeAdded":
+		fallthrough
+	case "EdgeUpserted":
 		parent := Identifier(objMap["Parent"].(string))
 		child := Identifier(objMap["Child"].(string))
 
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// messages of the Graph namespace as emitted by the version 1.0, they have
+// to be parsed by the later versions
+var graphMessageFixtures = []string{
+	`{"Namespace":"Graph","Type":"SyncRequest","Obj":{"From":42,"Volatile":true},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"SyncReply","Obj":{"Nodes":[{"ID":"n1","Metadata":{"Name":"eth0","Type":"device"},"Host":"host1"},{"ID":"n2","Metadata":{"Name":"br0","Type":"bridge"},"Host":"host1"}],"Edges":[{"ID":"e1","Metadata":{"RelationType":"layer2"},"Parent":"n2","Child":"n1","Host":"host1"}]},"Seq":42,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"ResyncRequest","Obj":null,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"HostSyncBegin","Obj":{"ID":"root","Metadata":{"Name":"host1","Type":"host"},"Host":"host1"},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"HostSyncEnd","Obj":{"ID":"root","Metadata":{"Name":"host1","Type":"host"},"Host":"host1"},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"NodeAdded","Obj":{"ID":"n1","Metadata":{"MTU":1500,"Name":"eth0","Type":"device"},"Host":"host1"},"Seq":43,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"NodeUpdated","Obj":{"ID":"n1","Metadata":{"MTU":9000,"Name":"eth0","Type":"device"},"Host":"host1"},"Seq":44,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"NodeUpserted","Obj":{"ID":"n1","Metadata":{"MTU":9000,"Name":"eth0","Type":"device"},"Host":"host1"},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"NodeDeleted","Obj":{"ID":"n1","Host":"host1"},"ID":3,"Seq":45,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"SubGraphDeleted","Obj":{"ID":"n2","Host":"host1"},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"EdgeAdded","Obj":{"ID":"e1","Metadata":{"RelationType":"layer2"},"Parent":"n2","Child":"n1","Host":"host1"},"Seq":46,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"EdgeUpdated","Obj":{"ID":"e1","Metadata":{"RelationType":"layer2","Type":"veth"},"Parent":"n2","Child":"n1","Host":"host1"},"Seq":47,"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"EdgeUpserted","Obj":{"ID":"e1","Metadata":{"RelationType":"layer2"},"Parent":"n2","Child":"n1","Host":"host1"},"Version":"1.0"}`,
+	`{"Namespace":"Graph","Type":"EdgeDeleted","Obj":{"ID":"e1","Parent":"n2","Child":"n1","Host":"host1"},"ID":4,"Seq":48,"Version":"1.0"}`,
+}
+
+func TestGraphMessageFixtures(t *testing.T) {
+	for _, data := range graphMessageFixtures {
+		msg, err := shttp.UnmarshalWSMessage([]byte(data))
+		if err != nil {
+			t.Errorf("Unable to parse the fixture %s: %s", data, err.Error())
+			continue
+		}
+
+		if msg.Type == "SyncReply" {
+			var s Snapshot
+			if err := msg.DecodeObj(&s); err != nil || len(s.Nodes) != 2 || len(s.Edges) != 1 || s.Edges[0].Parent != "n2" {
+				t.Errorf("Wrong snapshot decoded from %s: %v", data, err)
+			}
+			continue
+		}
+
+		if msg.Type == "ResyncRequest" {
+			continue
+		}
+
+		if msg, err = UnmarshalWSMessage(msg); err != nil {
+			t.Errorf("Unable to decode the object of the fixture %s: %s", data, err.Error())
+			continue
+		}
+
+		switch obj := msg.Obj.(type) {
+		case *Node:
+			if obj.ID == "" || obj.host != "host1" {
+				t.Errorf("Wrong node decoded from %s: %+v", data, obj)
+			}
+		case *Edge:
+			if obj.ID != "e1" || obj.parent != "n2" || obj.child != "n1" || obj.host != "host1" {
+				t.Errorf("Wrong edge decoded from %s: %+v", data, obj)
+			}
+		case map[string]interface{}:
+			if obj["From"] != float64(42) {
+				t.Errorf("Wrong SyncRequest decoded from %s: %v", data, obj)
+			}
+		default:
+			t.Errorf("Unexpected object decoded from %s: %v", data, obj)
+		}
+	}
+}
+
+func TestGraphMessageVersion(t *testing.T) {
+	// a newer minor version may add fields, ignored
+	data := `{"Namespace":"Graph","Type":"NodeAdded","Obj":{"ID":"n1","Metadata":{"Name":"eth0"},"Host":"host1","Revision":7},"Trace":"abc","Version":"1.3"}`
+	msg, err := shttp.UnmarshalWSMessage([]byte(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg, err = UnmarshalWSMessage(msg); err != nil || msg.Obj.(*Node).metadata["Name"] != "eth0" {
+		t.Errorf("Message of a newer minor version not decoded: %v", err)
+	}
+
+	// the messages of a newer major version may not be decodable
+	msg = shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: map[string]interface{}{"Id": 1}, Version: "2.0"}
+	if _, err := UnmarshalWSMessage(msg); err == nil {
+		t.Error("Message of a newer major version should be rejected")
+	} else if _, ok := err.(*shttp.WSVersionError); !ok {
+		t.Errorf("Version error expected, got: %s", err.Error())
+	}
+}
+
+// a message relayed by an analyzer, decoded as generic maps, has to give
+// the same bytes as the message of the emitter
+func TestMarshalStableOrder(t *testing.T) {
+	b, err := NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Metadata{"Type": "device", "Name": "eth0", "MTU": 1500, "State": "UP", "MAC": "00:11:22:33:44:55", "IfIndex": 2}
+	n1 := g.NewNode(GenID(), m)
+	n2 := g.NewNode(GenID(), m)
+	e := g.NewEdge(GenID(), n1, n2, Metadata{"RelationType": "layer2", "Type": "veth"})
+
+	for msgType, obj := range map[string]interface{}{"NodeAdded": n1, "EdgeAdded": e} {
+		data := shttp.WSMessage{Namespace: Namespace, Type: msgType, Obj: obj}.Marshal()
+		for i := 0; i < 10; i++ {
+			if again := (shttp.WSMessage{Namespace: Namespace, Type: msgType, Obj: obj}).Marshal(); string(again) != string(data) {
+				t.Fatalf("Marshaling isn't stable: %s != %s", string(again), string(data))
+			}
+		}
+
+		msg, err := shttp.UnmarshalWSMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if relayed := msg.Marshal(); string(relayed) != string(data) {
+			t.Errorf("Relayed message differs: %s != %s", string(relayed), string(data))
+		}
+	}
+}
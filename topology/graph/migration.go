@@ -0,0 +1,416 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// stages of a backend migration
+const (
+	MigrationCopying   = "copying"
+	MigrationVerifying = "verifying"
+	MigrationDone      = "done"
+	MigrationFailed    = "failed"
+)
+
+// MigrationStatus is the progress of a backend migration, the totals being
+// the numbers of elements when the copy started. Times are in milliseconds.
+type MigrationStatus struct {
+	Backend     string
+	From        string
+	State       string
+	Nodes       int
+	Edges       int
+	NodesCopied int
+	EdgesCopied int
+	Started     int64
+	Ended       int64  `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// mirrorBackend writes through to the target of a migration while the
+// graph is copied into it, the reads being served by the source. The
+// writes of the elements not copied yet may fail on the target, they are
+// copied later with their current state.
+type mirrorBackend struct {
+	GraphBackend
+	target GraphBackend
+}
+
+func (m *mirrorBackend) AddNode(n *Node) bool {
+	added := m.GraphBackend.AddNode(n)
+	m.target.AddNode(n)
+	return added
+}
+
+func (m *mirrorBackend) DelNode(n *Node) bool {
+	deleted := m.GraphBackend.DelNode(n)
+	if m.target.GetNode(n.ID) != nil {
+		m.target.DelNode(n)
+	}
+	return deleted
+}
+
+func (m *mirrorBackend) AddEdge(e *Edge) bool {
+	added := m.GraphBackend.AddEdge(e)
+	m.target.AddEdge(e)
+	return added
+}
+
+func (m *mirrorBackend) DelEdge(e *Edge) bool {
+	deleted := m.GraphBackend.DelEdge(e)
+	if m.target.GetEdge(e.ID) != nil {
+		m.target.DelEdge(e)
+	}
+	return deleted
+}
+
+func (m *mirrorBackend) AddMetadata(e interface{}, k string, v interface{}) bool {
+	updated := m.GraphBackend.AddMetadata(e, k, v)
+	m.target.AddMetadata(e, k, v)
+	return updated
+}
+
+func (m *mirrorBackend) SetMetadata(e interface{}, meta Metadata) bool {
+	updated := m.GraphBackend.SetMetadata(e, meta)
+	m.target.SetMetadata(e, meta)
+	return updated
+}
+
+// Close closes both backends, the graph being closed while migrating
+func (m *mirrorBackend) Close() error {
+	var err error
+	for _, b := range []GraphBackend{m.target, m.GraphBackend} {
+		if closer, ok := b.(GraphBackendCloser); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// backendDigest returns the number of elements of a backend and a digest
+// of them, independent of their order. The volatile metadata are left out
+// as they are not stored by the persistent backends.
+func backendDigest(b GraphBackend) (int, int, uint64) {
+	var digest uint64
+
+	nodes := b.GetNodes()
+	for _, n := range nodes {
+		digest += elementHash(n.graphElement, "", "")
+	}
+
+	edges := b.GetEdges()
+	for _, e := range edges {
+		digest += elementHash(e.graphElement, e.parent, e.child)
+	}
+
+	return len(nodes), len(edges), digest
+}
+
+// ErrEndpointNotAllowed is returned when migrating to an endpoint which is
+// not one of the configured ones
+var ErrEndpointNotAllowed = errors.New("Graph backend endpoint not allowed")
+
+// Migrator moves the graph of a running analyzer to another backend. The
+// target is attached in write-through mode behind the current backend, the
+// graph is copied into it by batches, the ones of the target are checked
+// against the ones of the current backend, then the reads are switched to
+// the target and the former backend is closed. The copy doesn't go through
+// the graph, no event is sent to the listeners and the clients. On failure
+// the graph is left on its backend and the target is closed. Only the
+// configured endpoints may be migrated to, the first one being the default.
+type Migrator struct {
+	sync.RWMutex
+	Graph     *Graph
+	Backend   string
+	BatchSize int
+	Endpoints []string
+	// returns the backend of the given type
+	NewBackend func(backend string, endpoint string) (GraphBackend, error)
+	status     *MigrationStatus
+	starting   bool
+}
+
+// endpoint returns the endpoint to migrate to, the default one if not
+// given, the memory backend having none
+func (m *Migrator) endpoint(backend string, endpoint string) (string, error) {
+	if backend == "memory" {
+		return "", nil
+	}
+	if endpoint == "" && len(m.Endpoints) > 0 {
+		return m.Endpoints[0], nil
+	}
+	for _, e := range m.Endpoints {
+		if e == endpoint {
+			return endpoint, nil
+		}
+	}
+	return "", ErrEndpointNotAllowed
+}
+
+// Status returns the status of the running or last migration, nil if none
+func (m *Migrator) Status() *MigrationStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.status == nil {
+		return nil
+	}
+	status := *m.status
+	return &status
+}
+
+func (m *Migrator) update(fn func(status *MigrationStatus)) {
+	m.Lock()
+	fn(m.status)
+	m.Unlock()
+}
+
+// Migrate starts the migration to the given backend, returning its status
+func (m *Migrator) Migrate(backend string, endpoint string) (*MigrationStatus, error) {
+	endpoint, err := m.endpoint(backend, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	if m.starting || m.status != nil && m.status.Ended == 0 {
+		m.Unlock()
+		return nil, errors.New("A migration is already running")
+	}
+	if backend == m.Backend {
+		m.Unlock()
+		return nil, fmt.Errorf("The graph is already stored by the %s backend", backend)
+	}
+	m.starting = true
+	m.Unlock()
+
+	// connecting to the target may take a while, the status being still
+	// readable meanwhile
+	target, err := m.NewBackend(backend, endpoint)
+	if err == ErrUnknownBackend {
+		err = fmt.Errorf("Graph backend unknown: %s", backend)
+	}
+
+	m.Lock()
+	m.starting = false
+	if err != nil {
+		m.Unlock()
+		return nil, err
+	}
+
+	m.status = &MigrationStatus{
+		Backend: backend,
+		From:    m.Backend,
+		State:   MigrationCopying,
+		Started: time.Now().UTC().UnixNano() / int64(time.Millisecond),
+	}
+	m.Unlock()
+
+	go m.run(backend, target)
+
+	return m.Status(), nil
+}
+
+func (m *Migrator) run(backend string, target GraphBackend) {
+	g := m.Graph
+
+	g.Lock()
+	source := g.backend
+	g.backend = &mirrorBackend{GraphBackend: source, target: target}
+	g.Unlock()
+
+	logging.GetLogger().Infof("Migrating the graph from the %s backend to the %s backend", m.Backend, backend)
+
+	err := m.migrate(source, target)
+
+	g.Lock()
+	if err == nil {
+		g.backend = target
+		g.revisioner = nil
+		if r, ok := target.(GraphBackendRevisioner); ok {
+			g.revisioner = r
+			if err := r.SetRevision(g.reservedRevision); err != nil {
+				logging.GetLogger().Errorf("Unable to store the graph revision %d: %s", g.reservedRevision, err.Error())
+			}
+		}
+	} else {
+		g.backend = source
+	}
+	g.Unlock()
+
+	// the backend left is closed once the graph doesn't use it anymore
+	left := target
+	if err == nil {
+		left = source
+	}
+	if closer, ok := left.(GraphBackendCloser); ok {
+		if err := closer.Close(); err != nil {
+			logging.GetLogger().Errorf("Error while closing the graph backend: %s", err.Error())
+		}
+	}
+
+	m.Lock()
+	m.status.Ended = time.Now().UTC().UnixNano() / int64(time.Millisecond)
+	if err == nil {
+		m.status.State = MigrationDone
+		m.Backend = backend
+	} else {
+		m.status.State = MigrationFailed
+		m.status.Error = err.Error()
+	}
+	m.Unlock()
+
+	if err != nil {
+		logging.GetLogger().Errorf("Migration of the graph to the %s backend failed, %s backend kept: %s", backend, m.Backend, err.Error())
+		return
+	}
+	logging.GetLogger().Infof("Graph migrated to the %s backend", backend)
+}
+
+// migrate copies the elements of the source into the target and checks
+// the copy, the target being written through meanwhile
+func (m *Migrator) migrate(source GraphBackend, target GraphBackend) error {
+	g := m.Graph
+
+	g.RLock()
+	var nodes, edges []Identifier
+	for _, n := range source.GetNodes() {
+		nodes = append(nodes, n.ID)
+	}
+	for _, e := range source.GetEdges() {
+		edges = append(edges, e.ID)
+	}
+	g.RUnlock()
+
+	m.update(func(status *MigrationStatus) {
+		status.Nodes, status.Edges = len(nodes), len(edges)
+	})
+
+	// the graph lock is taken per batch, the writers going on in between,
+	// each element being copied with its state at that time
+	for i := 0; i < len(nodes); i += m.BatchSize {
+		end := i + m.BatchSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		batch := nodes[i:end]
+
+		g.RLock()
+		for _, id := range batch {
+			if n := source.GetNode(id); n != nil && target.GetNode(id) == nil {
+				if !target.AddNode(n) {
+					g.RUnlock()
+					return fmt.Errorf("Unable to copy the node %s", id)
+				}
+			}
+		}
+		g.RUnlock()
+
+		m.update(func(status *MigrationStatus) { status.NodesCopied += len(batch) })
+	}
+
+	for i := 0; i < len(edges); i += m.BatchSize {
+		end := i + m.BatchSize
+		if end > len(edges) {
+			end = len(edges)
+		}
+		batch := edges[i:end]
+
+		g.RLock()
+		for _, id := range batch {
+			if e := source.GetEdge(id); e != nil && target.GetEdge(id) == nil {
+				if !target.AddEdge(e) {
+					g.RUnlock()
+					return fmt.Errorf("Unable to copy the edge %s", id)
+				}
+			}
+		}
+		g.RUnlock()
+
+		m.update(func(status *MigrationStatus) { status.EdgesCopied += len(batch) })
+	}
+
+	m.update(func(status *MigrationStatus) { status.State = MigrationVerifying })
+
+	g.RLock()
+	defer g.RUnlock()
+
+	sn, se, sd := backendDigest(source)
+	tn, te, td := backendDigest(target)
+	if sn != tn || se != te {
+		return fmt.Errorf("%d nodes and %d edges copied instead of %d and %d", tn, te, sn, se)
+	}
+	if sd != td {
+		return errors.New("The elements copied differ from the ones of the graph")
+	}
+
+	return nil
+}
+
+func NewMigrator(g *Graph, backend string, batchSize int, endpoints []string) *Migrator {
+	return &Migrator{
+		Graph:      g,
+		Backend:    backend,
+		BatchSize:  batchSize,
+		Endpoints:  endpoints,
+		NewBackend: NewBackend,
+	}
+}
+
+// NewMigratorFromConfig returns nil if the migrations are disabled
+func NewMigratorFromConfig(g *Graph) *Migrator {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("analyzer.backend_migration.enabled") {
+		return nil
+	}
+
+	backend := cfg.GetString("graph.backend")
+	if backend == "" {
+		backend = "memory"
+	}
+
+	batchSize := cfg.GetInt("analyzer.backend_migration.batch_size")
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	// the endpoint of the graph first, the default one of the migrations
+	endpoints := []string{cfg.GetString("graph.gremlin")}
+	for _, e := range cfg.GetStringSlice("analyzer.backend_migration.endpoints") {
+		if e != endpoints[0] {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	return NewMigrator(g, backend, batchSize, endpoints)
+}
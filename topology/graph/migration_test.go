@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBackend refuses the edges and records its closing
+type failingBackend struct {
+	*MemoryBackend
+	closed bool
+}
+
+func (f *failingBackend) AddEdge(e *Edge) bool {
+	return false
+}
+
+func (f *failingBackend) Close() error {
+	f.closed = true
+	return nil
+}
+
+func waitMigration(t *testing.T, m *Migrator) *MigrationStatus {
+	for i := 0; i < 100; i++ {
+		if status := m.Status(); status.Ended != 0 {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Migration not ended")
+	return nil
+}
+
+func TestBackendMigration(t *testing.T) {
+	g := newGraph(t)
+
+	g.Lock()
+	var previous *Node
+	for i := 0; i < 50; i++ {
+		n := g.NewNode(GenID(), Metadata{"Name": fmt.Sprintf("n%d", i)})
+		if previous != nil {
+			g.NewEdge(GenID(), previous, n, Metadata{"RelationType": "layer2"})
+		}
+		previous = n
+	}
+	g.Unlock()
+
+	l := &recordingListener{}
+	g.AddEventListener(l)
+
+	target, _ := NewMemoryBackend()
+	m := NewMigrator(g, "gremlin", 5, []string{"ws://127.0.0.1:8182"})
+	m.NewBackend = func(backend string, endpoint string) (GraphBackend, error) {
+		// connected without holding the lock of the migrator
+		m.Status()
+		return target, nil
+	}
+
+	if _, err := m.Migrate("gremlin", ""); err == nil {
+		t.Error("Expected an error when migrating to the current backend")
+	}
+	if _, err := m.Migrate("titangraph", "ws://10.0.0.1:8182"); err != ErrEndpointNotAllowed {
+		t.Errorf("Expected the endpoints not configured to be refused, got %v", err)
+	}
+
+	if _, err := m.Migrate("memory", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writers go on while copying
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			g.Lock()
+			n := g.NewNode(GenID(), Metadata{"Name": fmt.Sprintf("w%d", i)})
+			g.AddMetadata(n, "MTU", 1500)
+			g.Unlock()
+		}
+	}()
+
+	status := waitMigration(t, m)
+	wg.Wait()
+
+	if status.State != MigrationDone || status.Nodes < 50 || status.NodesCopied != status.Nodes || status.EdgesCopied != 49 {
+		t.Fatalf("Wrong migration status: %+v", status)
+	}
+	if g.backend != target || m.Backend != "memory" {
+		t.Fatal("The graph should be stored by the target backend")
+	}
+
+	g.RLock()
+	if len(g.GetNodes()) != 70 || len(g.GetEdges()) != 49 {
+		t.Errorf("Wrong graph once migrated: %d nodes, %d edges", len(g.GetNodes()), len(g.GetEdges()))
+	}
+	if n := g.LookupFirstNode(Metadata{"Name": "w19"}); n == nil || n.Metadata()["MTU"] != 1500 {
+		t.Errorf("The writes made while copying should be kept: %v", n)
+	}
+	g.RUnlock()
+
+	// only the events of the writer
+	if len(l.events) != 40 {
+		t.Errorf("No event expected from the migration, got %d events", len(l.events))
+	}
+
+	// rolled back on failure
+	empty, _ := NewMemoryBackend()
+	failing := &failingBackend{MemoryBackend: empty}
+	m.NewBackend = func(backend string, endpoint string) (GraphBackend, error) {
+		if endpoint != "ws://127.0.0.1:8182" {
+			t.Errorf("Expected the default endpoint, got %s", endpoint)
+		}
+		return failing, nil
+	}
+
+	if _, err := m.Migrate("titangraph", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitMigration(t, m)
+	if status.State != MigrationFailed || status.Error == "" {
+		t.Fatalf("Migration expected to fail: %+v", status)
+	}
+	if g.backend != target || m.Backend != "memory" || !failing.closed {
+		t.Error("The graph should be kept on its backend and the target closed")
+	}
+}
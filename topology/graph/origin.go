@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"strings"
+
+	"github.com/redhat-cip/skydive/config"
+)
+
+// OriginRules tells which metadata a client may write. The keys of an
+// origin are the origin itself or prefixed by it, ie. CMDB.Owner for the
+// CMDB origin, the other keys being the core metadata set by the agents.
+// The publishers, identified by their authenticated user, may only write
+// their origins, the clients not listed being unrestricted.
+type OriginRules struct {
+	Publishers map[string][]string
+}
+
+// origin returns the origin of a metadata key, empty for the core ones
+func (r *OriginRules) origin(key string) string {
+	for _, origins := range r.Publishers {
+		for _, o := range origins {
+			if key == o || strings.HasPrefix(key, o+".") {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// Restricted returns whether the writes of the user are restricted
+func (r *OriginRules) Restricted(user string) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.Publishers[user]
+	return ok
+}
+
+// owns returns whether the key belongs to the user, the unrestricted users
+// owning the core metadata.
+func (r *OriginRules) owns(user string, key string) bool {
+	origin := r.origin(key)
+	if !r.Restricted(user) {
+		return origin == ""
+	}
+
+	for _, o := range r.Publishers[user] {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Create returns the metadata of an element created by the user, the keys
+// of the origins of other publishers being dropped.
+func (r *OriginRules) Create(user string, m Metadata) Metadata {
+	if !r.Restricted(user) {
+		return m
+	}
+
+	created := Metadata{}
+	for k, v := range m {
+		if r.origin(k) == "" || r.owns(user, k) {
+			created[k] = v
+		}
+	}
+	return created
+}
+
+// Merge returns the metadata of an existing element upserted by the user.
+// The keys the user owns are replaced by the ones of the update, the other
+// ones are kept, so that an agent resync doesn't drop the metadata of the
+// publishers and the reverse.
+func (r *OriginRules) Merge(user string, current Metadata, update Metadata) Metadata {
+	if r == nil {
+		return update
+	}
+
+	merged := Metadata{}
+	for k, v := range current {
+		if !r.owns(user, k) {
+			merged[k] = v
+		}
+	}
+	for k, v := range update {
+		if r.owns(user, k) || !r.Restricted(user) {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// NewOriginRulesFromConfig returns the rules of the publishers of
+// graph.publishers, nil if none.
+func NewOriginRulesFromConfig() *OriginRules {
+	publishers := config.GetConfig().GetStringMapStringSlice("graph.publishers")
+	if len(publishers) == 0 {
+		return nil
+	}
+
+	return &OriginRules{Publishers: publishers}
+}
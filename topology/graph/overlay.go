@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// OverlayBackend is a copy-on-write layer over a backend, the nodes and the
+// edges being read from the backend until the overlay adds, updates or
+// deletes them. The backend is never written, the elements updated being
+// copies, so that an overlay is cheap to create and to throw away. The
+// backend mustn't change while the overlay is used, ie. its graph has to
+// stay locked.
+type OverlayBackend struct {
+	base         GraphBackend
+	nodes        map[Identifier]*Node
+	edges        map[Identifier]*Edge
+	deletedNodes map[Identifier]bool
+	deletedEdges map[Identifier]bool
+}
+
+// current returns the copy of the element in the overlay, the one of the
+// backend if not changed, the element given being possibly outdated
+func (o *OverlayBackend) current(i interface{}) interface{} {
+	switch e := i.(type) {
+	case *Node:
+		if n := o.GetNode(e.ID); n != nil {
+			return n
+		}
+	case *Edge:
+		if e := o.GetEdge(e.ID); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (o *OverlayBackend) setMetadata(i interface{}, m Metadata) {
+	switch e := i.(type) {
+	case *Node:
+		o.nodes[e.ID] = &Node{graphElement: graphElement{ID: e.ID, metadata: m, host: e.host}}
+	case *Edge:
+		o.edges[e.ID] = &Edge{graphElement: graphElement{ID: e.ID, metadata: m, host: e.host}, parent: e.parent, child: e.child}
+	}
+}
+
+func (o *OverlayBackend) SetMetadata(i interface{}, m Metadata) bool {
+	e := o.current(i)
+	if e == nil {
+		return false
+	}
+	o.setMetadata(e, m)
+
+	return true
+}
+
+func (o *OverlayBackend) AddMetadata(i interface{}, k string, v interface{}) bool {
+	e := o.current(i)
+	if e == nil {
+		return false
+	}
+
+	m := elementMetadata(e)
+	if old, ok := m[k]; ok && reflect.DeepEqual(old, v) {
+		return false
+	}
+	m = copyMetadata(m)
+	m[k] = v
+	o.setMetadata(e, m)
+
+	return true
+}
+
+func (o *OverlayBackend) AddNode(n *Node) bool {
+	delete(o.deletedNodes, n.ID)
+	o.nodes[n.ID] = n
+
+	return true
+}
+
+func (o *OverlayBackend) DelNode(n *Node) bool {
+	if o.GetNode(n.ID) == nil {
+		return false
+	}
+	delete(o.nodes, n.ID)
+	o.deletedNodes[n.ID] = true
+
+	return true
+}
+
+func (o *OverlayBackend) GetNode(i Identifier) *Node {
+	if n, ok := o.nodes[i]; ok {
+		return n
+	}
+	if o.deletedNodes[i] {
+		return nil
+	}
+	return o.base.GetNode(i)
+}
+
+func (o *OverlayBackend) GetNodeEdges(n *Node) []*Edge {
+	edges := []*Edge{}
+	if o.GetNode(n.ID) == nil {
+		return edges
+	}
+
+	seen := make(map[Identifier]bool)
+	if !o.deletedNodes[n.ID] {
+		for _, e := range o.base.GetNodeEdges(n) {
+			seen[e.ID] = true
+			if e = o.GetEdge(e.ID); e != nil {
+				edges = append(edges, e)
+			}
+		}
+	}
+	for id, e := range o.edges {
+		if !seen[id] && (e.parent == n.ID || e.child == n.ID) {
+			edges = append(edges, e)
+		}
+	}
+
+	return edges
+}
+
+func (o *OverlayBackend) AddEdge(e *Edge) bool {
+	if o.GetNode(e.parent) == nil || o.GetNode(e.child) == nil {
+		return false
+	}
+	delete(o.deletedEdges, e.ID)
+	o.edges[e.ID] = e
+
+	return true
+}
+
+func (o *OverlayBackend) DelEdge(e *Edge) bool {
+	if o.GetEdge(e.ID) == nil {
+		return false
+	}
+	delete(o.edges, e.ID)
+	o.deletedEdges[e.ID] = true
+
+	return true
+}
+
+func (o *OverlayBackend) GetEdge(i Identifier) *Edge {
+	if e, ok := o.edges[i]; ok {
+		return e
+	}
+	if o.deletedEdges[i] {
+		return nil
+	}
+	return o.base.GetEdge(i)
+}
+
+func (o *OverlayBackend) GetEdgeNodes(e *Edge) (*Node, *Node) {
+	if e = o.GetEdge(e.ID); e == nil {
+		return nil, nil
+	}
+
+	parent, child := o.GetNode(e.parent), o.GetNode(e.child)
+	if parent == nil || child == nil {
+		return nil, nil
+	}
+	return parent, child
+}
+
+func (o *OverlayBackend) GetNodes() []*Node {
+	nodes := []*Node{}
+
+	for _, n := range o.base.GetNodes() {
+		if _, ok := o.nodes[n.ID]; !ok && !o.deletedNodes[n.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	for _, n := range o.nodes {
+		nodes = append(nodes, n)
+	}
+
+	return nodes
+}
+
+func (o *OverlayBackend) GetNodesBatch(filters []Metadata) [][]*Node {
+	return groupNodes(o.GetNodes(), filters)
+}
+
+func (o *OverlayBackend) GetEdges() []*Edge {
+	edges := []*Edge{}
+
+	for _, e := range o.base.GetEdges() {
+		if _, ok := o.edges[e.ID]; !ok && !o.deletedEdges[e.ID] {
+			edges = append(edges, e)
+		}
+	}
+	for _, e := range o.edges {
+		edges = append(edges, e)
+	}
+
+	return edges
+}
+
+// Changes returns the number of nodes and edges added, updated or deleted
+// in the overlay
+func (o *OverlayBackend) Changes() (int, int) {
+	return len(o.nodes) + len(o.deletedNodes), len(o.edges) + len(o.deletedEdges)
+}
+
+func NewOverlayBackend(base GraphBackend) *OverlayBackend {
+	return &OverlayBackend{
+		base:         base,
+		nodes:        make(map[Identifier]*Node),
+		edges:        make(map[Identifier]*Edge),
+		deletedNodes: make(map[Identifier]bool),
+		deletedEdges: make(map[Identifier]bool),
+	}
+}
+
+// NewView returns a graph whose changes are kept in an overlay of the
+// backend of the graph, to simulate changes without touching the graph.
+// The view has no listener, no tombstone and no limit. The graph has to be
+// locked, at least for reading, as long as the view is used.
+func (g *Graph) NewView() *Graph {
+	return &Graph{
+		revision:     atomic.LoadUint64(&g.revision),
+		backend:      NewOverlayBackend(g.backend),
+		host:         g.host,
+		clock:        g.clock,
+		inherited:    g.inherited,
+		strictSchema: g.strictSchema,
+	}
+}
+
+// ViewChanges returns the number of nodes and edges added, updated or
+// deleted in a view, none if the graph isn't a view
+func (g *Graph) ViewChanges() (int, int) {
+	if o, ok := g.backend.(*OverlayBackend); ok {
+		return o.Changes()
+	}
+	return 0, 0
+}
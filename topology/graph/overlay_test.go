@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+)
+
+func TestGraphView(t *testing.T) {
+	g := newGraph(t)
+
+	bond := g.NewNode(GenID(), Metadata{"Name": "bond0", "Type": "bond", "MTU": 9000})
+	eth0 := g.NewNode(GenID(), Metadata{"Name": "eth0", "Type": "device"})
+	eth1 := g.NewNode(GenID(), Metadata{"Name": "eth1", "Type": "device"})
+	g.Link(bond, eth0)
+	g.Link(bond, eth1)
+	revision := g.Revision()
+
+	v := g.NewView()
+	v.DelNode(v.GetNode(bond.ID))
+	v.AddMetadata(v.GetNode(eth0.ID), "MTU", 1500)
+	v.SetMetadata(v.GetNode(eth1.ID), Metadata{"Name": "eth1", "Type": "device", "State": "DOWN"})
+	eth2 := v.NewNode(GenID(), Metadata{"Name": "eth2", "Type": "device"})
+	v.Link(v.GetNode(eth0.ID), eth2)
+
+	if v.GetNode(bond.ID) != nil || len(v.GetNodes()) != 3 || len(v.GetEdges()) != 1 {
+		t.Errorf("Changes not seen by the view: %s", v.String())
+	}
+	if !v.AreLinked(v.GetNode(eth0.ID), eth2) || v.AreLinked(v.GetNode(eth0.ID), v.GetNode(eth1.ID)) {
+		t.Error("Wrong links in the view")
+	}
+	if mtu, _ := v.GetNode(eth0.ID).Metadata()["MTU"].(int); mtu != 1500 {
+		t.Errorf("Metadata not added in the view: %v", v.GetNode(eth0.ID).Metadata())
+	}
+	if len(v.LookupNodes(Metadata{"State": "DOWN"})) != 1 {
+		t.Error("Metadata not set in the view")
+	}
+	if nodes, edges := v.ViewChanges(); nodes != 4 || edges != 3 {
+		t.Errorf("Expected 4 nodes and 3 edges changed, got %d and %d", nodes, edges)
+	}
+
+	// the graph is left untouched
+	if g.Revision() != revision || len(g.GetNodes()) != 3 || len(g.GetEdges()) != 2 {
+		t.Errorf("Graph changed by its view: %s", g.String())
+	}
+	if !g.AreLinked(bond, eth0) || !g.AreLinked(bond, eth1) || g.GetNode(eth2.ID) != nil {
+		t.Error("Links of the graph changed by its view")
+	}
+	if _, ok := eth0.Metadata()["MTU"]; ok || eth1.Metadata()["State"] != nil {
+		t.Errorf("Metadata of the graph changed by its view: %v %v", eth0.Metadata(), eth1.Metadata())
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+)
+
+// PersistenceClass tells how long a metadata key is worth keeping. Classes
+// are declared by the writers of the keys, the probes at init and the users
+// through the configuration, the undeclared keys being normal ones. A class
+// declared for a key applies to the keys prefixed by it, ie. CMDB.Owner for
+// CMDB.
+type PersistenceClass int
+
+const (
+	// NormalPersistence keys are stored and journaled as any change
+	NormalPersistence PersistenceClass = iota
+	// VolatilePersistence keys, ie. the counters, change all the time, they
+	// are neither stored by the persistent backends nor kept in the journal,
+	// the full syncs only include them if requested
+	VolatilePersistence
+	// DurablePersistence keys, ie. the user annotations, outlive their node,
+	// they are re-attached when a node with the same ID comes back
+	DurablePersistence
+)
+
+var persistenceClasses = map[string]PersistenceClass{
+	"normal":   NormalPersistence,
+	"volatile": VolatilePersistence,
+	"durable":  DurablePersistence,
+}
+
+var persistence = struct {
+	sync.RWMutex
+	classes map[string]PersistenceClass
+}{
+	classes: make(map[string]PersistenceClass),
+}
+
+func (c PersistenceClass) String() string {
+	for name, class := range persistenceClasses {
+		if class == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("PersistenceClass(%d)", int(c))
+}
+
+func ParsePersistenceClass(s string) (PersistenceClass, error) {
+	if class, ok := persistenceClasses[strings.ToLower(s)]; ok {
+		return class, nil
+	}
+	return NormalPersistence, fmt.Errorf("Unknown persistence class: %s", s)
+}
+
+func RegisterMetadataPersistence(class PersistenceClass, keys ...string) {
+	persistence.Lock()
+	for _, k := range keys {
+		persistence.classes[k] = class
+	}
+	persistence.Unlock()
+}
+
+// registerMetadataPersistenceFromConfig declares the classes of the keys
+// written by the users, listed per class in the configuration.
+func registerMetadataPersistenceFromConfig() error {
+	for name, keys := range config.GetConfig().GetStringMapStringSlice("graph.metadata.persistence") {
+		class, err := ParsePersistenceClass(name)
+		if err != nil {
+			return err
+		}
+		RegisterMetadataPersistence(class, keys...)
+	}
+	return nil
+}
+
+// MetadataPersistence returns the class of a key, the one of the longest
+// declared prefix.
+func MetadataPersistence(key string) PersistenceClass {
+	persistence.RLock()
+	defer persistence.RUnlock()
+
+	for {
+		if class, ok := persistence.classes[key]; ok {
+			return class
+		}
+
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			return NormalPersistence
+		}
+		key = key[:i]
+	}
+}
+
+// MetadataPersistenceKeys returns the keys declared with the given class,
+// sorted
+func MetadataPersistenceKeys(class PersistenceClass) []string {
+	persistence.RLock()
+	defer persistence.RUnlock()
+
+	var keys []string
+	for k, c := range persistence.classes {
+		if c == class {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func hasPersistence(m Metadata, class PersistenceClass) bool {
+	for k := range m {
+		if MetadataPersistence(k) == class {
+			return true
+		}
+	}
+	return false
+}
+
+// withPersistence returns the keys of the metadata of the given class
+func withPersistence(m Metadata, class PersistenceClass) Metadata {
+	selected := make(Metadata)
+	for k, v := range m {
+		if MetadataPersistence(k) == class {
+			selected[k] = v
+		}
+	}
+	return selected
+}
+
+// withoutVolatile returns the metadata without the volatile keys, the
+// metadata themselves if there are none.
+func withoutVolatile(m Metadata) Metadata {
+	if !hasPersistence(m, VolatilePersistence) {
+		return m
+	}
+
+	persistent := make(Metadata, len(m))
+	for k, v := range m {
+		if MetadataPersistence(k) != VolatilePersistence {
+			persistent[k] = v
+		}
+	}
+	return persistent
+}
+
+type durableEntry struct {
+	id   Identifier
+	time time.Time
+}
+
+// durables keeps the durable metadata of the deleted nodes for a retention
+// period, they are re-attached to a node added again with the same ID.
+type durables struct {
+	retention time.Duration
+	metadata  map[Identifier]Metadata
+	// deletion order, for the expiration
+	entries []durableEntry
+	deleted map[Identifier]time.Time
+}
+
+func newDurables(retention time.Duration) *durables {
+	return &durables{
+		retention: retention,
+		metadata:  make(map[Identifier]Metadata),
+		deleted:   make(map[Identifier]time.Time),
+	}
+}
+
+func (d *durables) expire(now time.Time) {
+	limit := now.Add(-d.retention)
+
+	i := 0
+	for ; i < len(d.entries) && d.entries[i].time.Before(limit); i++ {
+		// a node deleted again later has a newer entry
+		if e := d.entries[i]; d.deleted[e.id].Equal(e.time) {
+			delete(d.metadata, e.id)
+			delete(d.deleted, e.id)
+		}
+	}
+	d.entries = d.entries[i:]
+}
+
+func (d *durables) keep(n *Node, now time.Time) {
+	d.expire(now)
+
+	m := withPersistence(n.metadata, DurablePersistence)
+	if len(m) == 0 {
+		return
+	}
+
+	d.metadata[n.ID] = m
+	d.deleted[n.ID] = now
+	d.entries = append(d.entries, durableEntry{id: n.ID, time: now})
+}
+
+// reattach adds the durable metadata kept for the node, the ones of the
+// node taking precedence
+func (d *durables) reattach(n *Node, now time.Time) {
+	d.expire(now)
+
+	m, ok := d.metadata[n.ID]
+	if !ok {
+		return
+	}
+	delete(d.metadata, n.ID)
+	delete(d.deleted, n.ID)
+
+	merged := make(Metadata, len(n.metadata)+len(m))
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range n.metadata {
+		merged[k] = v
+	}
+	n.metadata = merged
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+func init() {
+	RegisterMetadataPersistence(VolatilePersistence, "Counters")
+	RegisterMetadataPersistence(DurablePersistence, "Notes")
+}
+
+func TestMetadataPersistence(t *testing.T) {
+	for key, class := range map[string]PersistenceClass{
+		"Name":         NormalPersistence,
+		"Counters":     VolatilePersistence,
+		"Counters.Rx":  VolatilePersistence,
+		"CountersRx":   NormalPersistence,
+		"Notes.Owner":  DurablePersistence,
+		"Notes.Owner.": DurablePersistence,
+	} {
+		if c := MetadataPersistence(key); c != class {
+			t.Errorf("Wrong class of %s: %s", key, c)
+		}
+	}
+
+	if c, err := ParsePersistenceClass("Durable"); err != nil || c != DurablePersistence {
+		t.Errorf("Wrong parsed class: %s, %v", c, err)
+	}
+	if _, err := ParsePersistenceClass("forever"); err == nil {
+		t.Error("Error expected for an unknown class")
+	}
+
+	if _, ok := withoutVolatileObj(&Node{graphElement: graphElement{metadata: Metadata{"Name": "eth0"}}}); ok {
+		t.Error("Nothing to remove expected")
+	}
+	obj, ok := withoutVolatileObj(&Node{graphElement: graphElement{metadata: Metadata{"Name": "eth0", "Counters": 1}}})
+	if n := obj.(*Node); !ok || len(n.metadata) != 1 || n.metadata["Name"] != "eth0" {
+		t.Errorf("Volatile metadata expected to be removed: %v", n.metadata)
+	}
+}
+
+func TestDurableMetadata(t *testing.T) {
+	clock := common.NewFakeClock(time.Now())
+
+	g := newGraph(t)
+	g.clock = clock
+	g.durables = newDurables(time.Hour)
+	g.SetTombstoneGracePeriod(time.Minute)
+
+	id := GenIDFrom("host", "eth0")
+	n := g.NewNode(id, Metadata{"Name": "eth0", "Notes": "uplink", "Counters": 1})
+
+	// tombstoned then purged
+	g.TombstoneNode(n)
+	g.DelNode(n)
+	if g.GetNode(id) != nil {
+		t.Fatal("Node expected to be purged")
+	}
+
+	n = g.NewNode(id, Metadata{"Name": "eth0"})
+	if m := n.Metadata(); m["Notes"] != "uplink" || m["Counters"] != nil {
+		t.Errorf("Durable metadata expected to be re-attached: %v", m)
+	}
+
+	// the ones of the node take precedence, then expired
+	g.TombstoneNode(n)
+	g.DelNode(n)
+	n = g.NewNode(id, Metadata{"Name": "eth0", "Notes": "spare"})
+	if m := n.Metadata(); m["Notes"] != "spare" {
+		t.Errorf("Metadata of the node expected: %v", m)
+	}
+
+	g.TombstoneNode(n)
+	g.DelNode(n)
+	clock.Advance(2 * time.Hour)
+	n = g.NewNode(id, Metadata{"Name": "eth0"})
+	if m := n.Metadata(); m["Notes"] != nil {
+		t.Errorf("Durable metadata expected to be expired: %v", m)
+	}
+}
+
+func TestVolatileSync(t *testing.T) {
+	g := newGraph(t)
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0", "Counters": 1})
+
+	s := &GraphServer{Graph: g, journal: NewJournal(10, time.Minute), digests: make(map[Identifier]string)}
+
+	if s.volatileUpdate(n) {
+		t.Error("A new node is not a volatile update")
+	}
+	g.AddMetadata(n, "Counters", 2)
+	if !s.volatileUpdate(n) {
+		t.Error("Volatile update expected")
+	}
+	g.AddMetadata(n, "MTU", 1500)
+	if s.volatileUpdate(n) {
+		t.Error("Persistent update expected")
+	}
+
+	replies := s.syncReply("", wsMessage(t, "SyncRequest", nil))
+	if sync := replies[0].Obj.(*filteredGraph); sync.Nodes[0].metadata["Counters"] != nil {
+		t.Errorf("Volatile metadata not expected: %v", sync.Nodes[0].metadata)
+	}
+
+	replies = s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"Volatile": true}))
+	if sync, ok := replies[0].Obj.(*Graph); !ok || sync.GetNodes()[0].metadata["Counters"] != 2 {
+		t.Errorf("Volatile metadata requested: %+v", replies[0].Obj)
+	}
+}
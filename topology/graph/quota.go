@@ -0,0 +1,315 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// QuarantinedKey flags the nodes of a quarantined host, alerts can select
+// them, ie. G.V().Has('Quarantined', true)
+const QuarantinedKey = "Quarantined"
+
+// AgentQuota is the maximum rate, per second, of the messages, of their
+// bytes and of the graph mutations of a connection. A zero rate means no
+// limit.
+type AgentQuota struct {
+	Messages  float64
+	Bytes     float64
+	Mutations float64
+}
+
+// AgentQuarantine describes a host whose messages are dropped, its
+// connections having exceeded their quota.
+type AgentQuarantine struct {
+	Host         string
+	Reason       string
+	Since        time.Time
+	Dropped      int64
+	DroppedBytes int64
+}
+
+// AgentQuarantineEvent is published on the bus when a host gets quarantined,
+// as AgentQuarantined, or released, as AgentReleased.
+type AgentQuarantineEvent struct {
+	Host   string
+	Reason string
+}
+
+// connQuota counts the traffic of a connection over the quota window
+type connQuota struct {
+	grace     int64
+	messages  *common.RateWindow
+	bytes     *common.RateWindow
+	mutations *common.RateWindow
+}
+
+// QuotaEnforcer quarantines the hosts whose connections exceed their quota,
+// the default one or the one given for the host. The first Grace messages of
+// a connection are exempted so that the initial sync of an agent doesn't
+// count. The messages of a quarantined host are dropped until the
+// quarantine is lifted, its nodes being flagged with the Quarantined
+// metadata. Methods not documented as taking the graph lock expect it held.
+type QuotaEnforcer struct {
+	Graph       *Graph
+	Default     AgentQuota
+	Window      time.Duration
+	Grace       int64
+	overrides   map[string]AgentQuota
+	conns       map[*shttp.WSClient]*connQuota
+	quarantines map[string]*AgentQuarantine
+}
+
+type quarantinesByHost []AgentQuarantine
+
+func (s quarantinesByHost) Len() int           { return len(s) }
+func (s quarantinesByHost) Less(i, j int) bool { return s[i].Host < s[j].Host }
+func (s quarantinesByHost) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func isMutation(msgType string) bool {
+	switch msgType {
+	case "SubGraphDeleted", "NodeUpdated", "NodeDeleted", "NodeAdded", "NodeUpserted",
+		"EdgeUpdated", "EdgeDeleted", "EdgeAdded", "EdgeUpserted":
+		return true
+	}
+	return false
+}
+
+func perSecond(r *common.RateWindow, now time.Time) float64 {
+	return float64(r.Count(now)) / r.Window.Seconds()
+}
+
+func (q *QuotaEnforcer) quota(host string) AgentQuota {
+	if quota, ok := q.overrides[host]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func (q *QuotaEnforcer) conn(c *shttp.WSClient) *connQuota {
+	cq, ok := q.conns[c]
+	if !ok {
+		cq = &connQuota{
+			grace:     q.Grace,
+			messages:  common.NewRateWindow(q.Window, 10),
+			bytes:     common.NewRateWindow(q.Window, 10),
+			mutations: common.NewRateWindow(q.Window, 10),
+		}
+		q.conns[c] = cq
+	}
+	return cq
+}
+
+// exceeded returns why the connection exceeds its quota, an empty string if
+// it doesn't.
+func (q *QuotaEnforcer) exceeded(host string, cq *connQuota, now time.Time) string {
+	quota := q.quota(host)
+
+	if rate := perSecond(cq.messages, now); quota.Messages > 0 && rate > quota.Messages {
+		return fmt.Sprintf("%.0f messages/s exceeding %.0f", rate, quota.Messages)
+	}
+	if rate := perSecond(cq.bytes, now); quota.Bytes > 0 && rate > quota.Bytes {
+		return fmt.Sprintf("%.0f bytes/s exceeding %.0f", rate, quota.Bytes)
+	}
+	if rate := perSecond(cq.mutations, now); quota.Mutations > 0 && rate > quota.Mutations {
+		return fmt.Sprintf("%.0f mutations/s exceeding %.0f", rate, quota.Mutations)
+	}
+	return ""
+}
+
+// admit counts a message of a connection, returns false if the message has
+// to be dropped, the host of the connection being quarantined.
+func (q *QuotaEnforcer) admit(c *shttp.WSClient, msg shttp.WSMessage) bool {
+	if q == nil {
+		return true
+	}
+
+	host := c.GetHost()
+	size := int64(len(msg.Marshal()))
+
+	if quarantine, ok := q.quarantines[host]; ok {
+		quarantine.Dropped++
+		quarantine.DroppedBytes += size
+		return false
+	}
+
+	cq := q.conn(c)
+	if cq.grace > 0 {
+		cq.grace--
+		return true
+	}
+
+	now := q.Graph.Now()
+	cq.messages.Add(now, 1)
+	cq.bytes.Add(now, size)
+	if isMutation(msg.Type) {
+		cq.mutations.Add(now, 1)
+	}
+
+	if reason := q.exceeded(host, cq, now); reason != "" {
+		q.quarantine(host, reason)
+		q.quarantines[host].Dropped++
+		q.quarantines[host].DroppedBytes += size
+		return false
+	}
+	return true
+}
+
+// flag sets or removes the Quarantined metadata of the nodes of the host
+func (q *QuotaEnforcer) flag(host string, quarantined bool) {
+	for _, n := range q.Graph.GetNodes() {
+		if n.Host() != host {
+			continue
+		}
+
+		m := make(Metadata)
+		for k, v := range n.Metadata() {
+			if k != QuarantinedKey {
+				m[k] = v
+			}
+		}
+		if quarantined {
+			m[QuarantinedKey] = true
+		}
+
+		if !reflect.DeepEqual(m, n.Metadata()) {
+			q.Graph.SetMetadata(n, m)
+		}
+	}
+}
+
+func (q *QuotaEnforcer) quarantine(host string, reason string) {
+	logging.GetLogger().Errorf("Graph: agent %s quarantined, %s", host, reason)
+
+	q.quarantines[host] = &AgentQuarantine{Host: host, Reason: reason, Since: q.Graph.Now()}
+	q.flag(host, true)
+
+	common.DefaultBus.Publish(common.AgentTopic, "AgentQuarantined", &AgentQuarantineEvent{Host: host, Reason: reason})
+}
+
+// forget drops the counters of a connection, the quarantine of its host
+// being kept until lifted.
+func (q *QuotaEnforcer) forget(c *shttp.WSClient) {
+	if q != nil {
+		delete(q.conns, c)
+	}
+}
+
+// Lift releases a quarantined host, its nodes are unflagged and its
+// connections, exempted again for their grace messages, asked to resync
+// the messages dropped. It takes the graph lock and returns false if the
+// host wasn't quarantined.
+func (q *QuotaEnforcer) Lift(host string) bool {
+	q.Graph.Lock()
+	defer q.Graph.Unlock()
+
+	if _, ok := q.quarantines[host]; !ok {
+		return false
+	}
+	delete(q.quarantines, host)
+
+	logging.GetLogger().Infof("Graph: quarantine of the agent %s lifted", host)
+
+	q.flag(host, false)
+
+	for c := range q.conns {
+		if c.GetHost() == host {
+			delete(q.conns, c)
+			c.SendWSMessage(shttp.WSMessage{
+				Namespace: Namespace,
+				Type:      "ResyncRequest",
+			})
+		}
+	}
+
+	common.DefaultBus.Publish(common.AgentTopic, "AgentReleased", &AgentQuarantineEvent{Host: host})
+	return true
+}
+
+// Quarantines returns the quarantined hosts sorted by name, it takes the
+// graph lock.
+func (q *QuotaEnforcer) Quarantines() []AgentQuarantine {
+	q.Graph.RLock()
+	defer q.Graph.RUnlock()
+
+	quarantines := make([]AgentQuarantine, 0, len(q.quarantines))
+	for _, quarantine := range q.quarantines {
+		quarantines = append(quarantines, *quarantine)
+	}
+	sort.Sort(quarantinesByHost(quarantines))
+
+	return quarantines
+}
+
+// SetOverride replaces the default quota of a host, it takes the graph lock.
+func (q *QuotaEnforcer) SetOverride(host string, quota AgentQuota) {
+	q.Graph.Lock()
+	q.overrides[host] = quota
+	q.Graph.Unlock()
+}
+
+// DelOverride restores the default quota of a host, it takes the graph lock.
+func (q *QuotaEnforcer) DelOverride(host string) {
+	q.Graph.Lock()
+	delete(q.overrides, host)
+	q.Graph.Unlock()
+}
+
+func NewQuotaEnforcer(g *Graph, quota AgentQuota, window time.Duration, grace int64) *QuotaEnforcer {
+	return &QuotaEnforcer{
+		Graph:       g,
+		Default:     quota,
+		Window:      window,
+		Grace:       grace,
+		overrides:   make(map[string]AgentQuota),
+		conns:       make(map[*shttp.WSClient]*connQuota),
+		quarantines: make(map[string]*AgentQuarantine),
+	}
+}
+
+// NewQuotaEnforcerFromConfig returns the quota enforcer of the analyzer,
+// nil if the rate window is 0.
+func NewQuotaEnforcerFromConfig(g *Graph) *QuotaEnforcer {
+	cfg := config.GetConfig()
+
+	window := time.Duration(cfg.GetInt("analyzer.agent_quota.window")) * time.Second
+	if window <= 0 {
+		return nil
+	}
+
+	quota := AgentQuota{
+		Messages:  cfg.GetFloat64("analyzer.agent_quota.messages"),
+		Bytes:     cfg.GetFloat64("analyzer.agent_quota.bytes"),
+		Mutations: cfg.GetFloat64("analyzer.agent_quota.mutations"),
+	}
+
+	return NewQuotaEnforcer(g, quota, window, int64(cfg.GetInt("analyzer.agent_quota.grace_messages")))
+}
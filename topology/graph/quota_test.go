@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// syntheticAgent generates the messages of an agent of a host having a
+// number of interfaces, its initial sync then updates of the statistics.
+type syntheticAgent struct {
+	t       *testing.T
+	nodes   []*Node
+	updates int64
+}
+
+func (a *syntheticAgent) sync() []shttp.WSMessage {
+	var msgs []shttp.WSMessage
+	for _, n := range a.nodes {
+		msgs = append(msgs, wsMessage(a.t, "NodeAdded", n))
+	}
+	return msgs
+}
+
+func (a *syntheticAgent) update(count int) []shttp.WSMessage {
+	var msgs []shttp.WSMessage
+	for i := 0; i < count; i++ {
+		a.updates++
+		n := a.nodes[i%len(a.nodes)]
+		n.metadata["Statistics"] = map[string]interface{}{"RxPackets": a.updates}
+		msgs = append(msgs, wsMessage(a.t, "NodeUpdated", n))
+	}
+	return msgs
+}
+
+func newSyntheticAgent(t *testing.T, host string, interfaces int) *syntheticAgent {
+	a := &syntheticAgent{t: t}
+	for i := 0; i < interfaces; i++ {
+		n := &Node{graphElement: graphElement{
+			ID:       GenID(),
+			host:     host,
+			metadata: Metadata{"Name": fmt.Sprintf("eth%d", i), "Type": "device"},
+		}}
+		a.nodes = append(a.nodes, n)
+	}
+	return a
+}
+
+type quarantineListener struct {
+	events []string
+}
+
+func (l *quarantineListener) OnBusEvent(e *common.BusEvent) {
+	l.events = append(l.events, e.Type)
+}
+
+func newQuotaServer(t *testing.T, quota AgentQuota, grace int64) (*GraphServer, *common.FakeClock) {
+	g := newGraph(t)
+	clock := common.NewFakeClock(time.Unix(1468400000, 0))
+	g.SetClock(clock)
+
+	return &GraphServer{
+		Graph:           g,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+		Quotas:          NewQuotaEnforcer(g, quota, 10*time.Second, grace),
+	}, clock
+}
+
+func TestAgentQuarantine(t *testing.T) {
+	s, clock := newQuotaServer(t, AgentQuota{Messages: 10}, 50)
+	c := &shttp.WSClient{}
+
+	listener := &quarantineListener{}
+	subscription := common.DefaultBus.Subscribe("quarantine_test", 100, listener, common.AgentTopic)
+	defer common.DefaultBus.Unsubscribe(subscription)
+
+	agent := newSyntheticAgent(t, c.GetHost(), 50)
+
+	// the initial sync is exempted
+	for _, msg := range agent.sync() {
+		s.OnMessage(c, msg)
+	}
+	if len(s.Quotas.Quarantines()) != 0 {
+		t.Fatal("Initial sync shouldn't be quarantined")
+	}
+
+	// 10 messages per second are allowed
+	for i := 0; i < 10; i++ {
+		for _, msg := range agent.update(10) {
+			s.OnMessage(c, msg)
+		}
+		clock.Advance(time.Second)
+	}
+	if len(s.Quotas.Quarantines()) != 0 {
+		t.Fatal("Agent within its quota shouldn't be quarantined")
+	}
+
+	for _, msg := range agent.update(200) {
+		s.OnMessage(c, msg)
+	}
+
+	quarantines := s.Quotas.Quarantines()
+	if len(quarantines) != 1 || quarantines[0].Dropped == 0 || quarantines[0].DroppedBytes == 0 {
+		t.Fatalf("Agent exceeding its quota should be quarantined: %+v", quarantines)
+	}
+	dropped := quarantines[0].Dropped
+
+	for _, n := range s.Graph.GetNodes() {
+		if q, _ := n.Metadata()[QuarantinedKey].(bool); !q {
+			t.Errorf("Node %s should be flagged as quarantined", n.ID)
+		}
+	}
+
+	subscription.Flush()
+	if len(listener.events) != 1 || listener.events[0] != "AgentQuarantined" {
+		t.Errorf("Expected an AgentQuarantined event, got %v", listener.events)
+	}
+
+	// messages are dropped even after the window
+	clock.Advance(time.Minute)
+	for _, msg := range agent.update(1) {
+		s.OnMessage(c, msg)
+	}
+	if s.Quotas.Quarantines()[0].Dropped != dropped+1 {
+		t.Error("Messages of a quarantined agent should be dropped")
+	}
+
+	s.OnUnregisterClient(c)
+
+	if !s.Quotas.Lift(c.GetHost()) || len(s.Quotas.Quarantines()) != 0 {
+		t.Fatal("Quarantine should be lifted")
+	}
+	for _, n := range s.Graph.GetNodes() {
+		if _, ok := n.Metadata()[QuarantinedKey]; ok {
+			t.Errorf("Node %s shouldn't be flagged anymore", n.ID)
+		}
+	}
+
+	subscription.Flush()
+	if len(listener.events) != 2 || listener.events[1] != "AgentReleased" {
+		t.Errorf("Expected an AgentReleased event, got %v", listener.events)
+	}
+
+	// a new connection gets its grace budget
+	c = &shttp.WSClient{}
+	for _, msg := range agent.update(50) {
+		s.OnMessage(c, msg)
+	}
+	if len(s.Quotas.Quarantines()) != 0 {
+		t.Error("New connection should be exempted during its grace budget")
+	}
+
+	s.OnUnregisterClient(c)
+}
+
+func TestAgentQuotaOverride(t *testing.T) {
+	s, _ := newQuotaServer(t, AgentQuota{Mutations: 10}, 0)
+	c := &shttp.WSClient{}
+
+	s.Quotas.SetOverride(c.GetHost(), AgentQuota{Mutations: 1000})
+
+	agent := newSyntheticAgent(t, c.GetHost(), 10)
+	for _, msg := range append(agent.sync(), agent.update(500)...) {
+		s.OnMessage(c, msg)
+	}
+	if len(s.Quotas.Quarantines()) != 0 {
+		t.Fatal("Agent within its quota override shouldn't be quarantined")
+	}
+
+	s.Quotas.DelOverride(c.GetHost())
+
+	for _, msg := range agent.update(1) {
+		s.OnMessage(c, msg)
+	}
+	quarantines := s.Quotas.Quarantines()
+	if len(quarantines) != 1 || quarantines[0].Reason != "51 mutations/s exceeding 10" {
+		t.Errorf("Agent exceeding the default quota should be quarantined: %+v", quarantines)
+	}
+
+	s.OnUnregisterClient(c)
+}
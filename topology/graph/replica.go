@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"reflect"
+
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+type wsSender interface {
+	SendWSMessage(m shttp.WSMessage)
+}
+
+// ReplicaStats are the state of the replication
+type ReplicaStats struct {
+	Synced  bool
+	Seq     uint64
+	Resyncs int64
+}
+
+// Replicator keeps a replica of the graph of another analyzer, the primary,
+// received through its websocket as any client would: the whole graph
+// first, then its events. After a reconnection or a gap in the sequence
+// numbers of the events, the missed events are asked to the journal of the
+// primary. If they are not available anymore the primary only sends the
+// hosts whose digests differ from the ones of the replica, or the whole
+// graph if the digests are not supported. The replica should be given an
+// unrestricted user so that it gets all the events.
+type Replicator struct {
+	shttp.DefaultWSClientEventHandler
+	Client wsSender
+	Graph  *Graph
+	// digests of the replica, nil to always get the whole graph
+	Digests   *HostDigests
+	stats     ReplicaStats
+	resyncing bool
+}
+
+func (r *Replicator) requestSync() {
+	// a replica mirrors the whole graph
+	obj := map[string]interface{}{"Volatile": true}
+	if r.stats.Synced && r.stats.Seq != 0 {
+		obj["From"] = r.stats.Seq
+	}
+	if r.stats.Synced && r.Digests != nil {
+		obj["Digests"] = r.Digests.Digests()
+	}
+
+	r.resyncing = true
+	r.stats.Resyncs++
+
+	r.Client.SendWSMessage(shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      "SyncRequest",
+		Obj:       obj,
+	})
+}
+
+func (r *Replicator) OnConnected() {
+	r.Graph.Lock()
+	defer r.Graph.Unlock()
+
+	r.requestSync()
+}
+
+// upsert adds or updates in place the elements of the snapshot and returns
+// their IDs
+func (r *Replicator) upsert(s *Snapshot) (map[Identifier]bool, map[Identifier]bool) {
+	nodes := make(map[Identifier]bool)
+	for _, sn := range s.Nodes {
+		nodes[sn.ID] = true
+		if n := r.Graph.GetNode(sn.ID); n != nil {
+			if !reflect.DeepEqual(n.metadata, sn.Metadata) {
+				r.Graph.SetMetadata(n, copyMetadata(sn.Metadata))
+			}
+			continue
+		}
+		r.Graph.AddNode(&Node{graphElement: graphElement{ID: sn.ID, host: sn.Host, metadata: copyMetadata(sn.Metadata)}})
+	}
+
+	edges := make(map[Identifier]bool)
+	for _, se := range s.Edges {
+		edges[se.ID] = true
+		if e := r.Graph.GetEdge(se.ID); e != nil {
+			if !reflect.DeepEqual(e.metadata, se.Metadata) {
+				r.Graph.SetMetadata(e, copyMetadata(se.Metadata))
+			}
+			continue
+		}
+		r.Graph.AddEdge(&Edge{parent: se.Parent, child: se.Child, graphElement: graphElement{ID: se.ID, host: se.Host, metadata: copyMetadata(se.Metadata)}})
+	}
+
+	return nodes, edges
+}
+
+// replace makes the replica identical to the snapshot, the elements kept
+// being updated in place
+func (r *Replicator) replace(s *Snapshot) {
+	nodes, edges := r.upsert(s)
+
+	for _, e := range r.Graph.GetEdges() {
+		if !edges[e.ID] {
+			r.Graph.DelEdge(e)
+		}
+	}
+	for _, n := range r.Graph.GetNodes() {
+		if !nodes[n.ID] {
+			r.Graph.DelNode(n)
+		}
+	}
+}
+
+// patch makes the hosts of the delta identical to the ones of the primary,
+// the elements of these hosts not sent being gone
+func (r *Replicator) patch(d *SyncDelta) {
+	nodes, edges := r.upsert(&d.Snapshot)
+
+	edgeHosts := make(map[string]bool)
+	for _, host := range d.EdgeHosts {
+		edgeHosts[host] = true
+	}
+	for _, e := range r.Graph.GetEdges() {
+		if edgeHosts[e.host] && !edges[e.ID] {
+			r.Graph.DelEdge(e)
+		}
+	}
+
+	nodeHosts := make(map[string]bool)
+	for _, host := range d.NodeHosts {
+		nodeHosts[host] = true
+	}
+	for _, n := range r.Graph.GetNodes() {
+		if nodeHosts[n.host] && !nodes[n.ID] {
+			r.Graph.DelNode(n)
+		}
+	}
+}
+
+// apply applies an event of the primary, returns false if it references
+// an element unknown to the replica
+func (r *Replicator) apply(msg shttp.WSMessage) bool {
+	switch msg.Type {
+	case "NodeAdded", "NodeUpdated":
+		n := msg.Obj.(*Node)
+		if node := r.Graph.GetNode(n.ID); node != nil {
+			r.Graph.SetMetadata(node, n.metadata)
+		} else if msg.Type == "NodeAdded" {
+			r.Graph.AddNode(n)
+		} else {
+			return false
+		}
+	case "NodeDeleted":
+		if node := r.Graph.GetNode(msg.Obj.(*Node).ID); node != nil {
+			r.Graph.DelNode(node)
+		}
+	case "EdgeAdded", "EdgeUpdated":
+		e := msg.Obj.(*Edge)
+		if edge := r.Graph.GetEdge(e.ID); edge != nil {
+			r.Graph.SetMetadata(edge, e.metadata)
+		} else if msg.Type == "EdgeAdded" && r.Graph.GetNode(e.parent) != nil && r.Graph.GetNode(e.child) != nil {
+			r.Graph.AddEdge(e)
+		} else {
+			return false
+		}
+	case "EdgeDeleted":
+		if edge := r.Graph.GetEdge(msg.Obj.(*Edge).ID); edge != nil {
+			r.Graph.DelEdge(edge)
+		}
+	}
+
+	return true
+}
+
+func (r *Replicator) OnMessage(msg shttp.WSMessage) {
+	if msg.Namespace != Namespace {
+		return
+	}
+
+	r.Graph.Lock()
+	defer r.Graph.Unlock()
+
+	if msg.Type == "SyncReply" {
+		var s Snapshot
+		if err := msg.DecodeObj(&s); err != nil {
+			logging.GetLogger().Errorf("Replica: unable to decode the graph of the primary: %s", err.Error())
+			return
+		}
+
+		r.replace(&s)
+		r.stats.Synced, r.stats.Seq, r.resyncing = true, msg.Seq, false
+
+		logging.GetLogger().Infof("Replica: synced with the primary, %d nodes at %d", len(s.Nodes), msg.Seq)
+		return
+	}
+
+	if msg.Type == "SyncDeltaReply" {
+		var d SyncDelta
+		if err := msg.DecodeObj(&d); err != nil {
+			logging.GetLogger().Errorf("Replica: unable to decode the delta of the primary: %s", err.Error())
+			return
+		}
+
+		r.patch(&d)
+		r.stats.Synced, r.stats.Seq, r.resyncing = true, msg.Seq, false
+
+		logging.GetLogger().Infof("Replica: synced with the primary, %d hosts sent again at %d", len(d.NodeHosts), msg.Seq)
+		return
+	}
+
+	if !r.stats.Synced {
+		return
+	}
+
+	if msg.Type == "BulkChange" || msg.Type == "ResyncRequired" {
+		if !r.resyncing {
+			logging.GetLogger().Infof("Replica: %s from the primary, resyncing", msg.Type)
+			r.requestSync()
+		}
+		return
+	}
+
+	// events not kept in the journal, ie. statistics, have no sequence
+	// number, the other ones have to follow the last one applied
+	if msg.Seq != 0 && r.stats.Seq != 0 {
+		if msg.Seq <= r.stats.Seq {
+			return
+		}
+		if msg.Seq != r.stats.Seq+1 {
+			if !r.resyncing {
+				logging.GetLogger().Warningf("Replica: missed the events %d to %d, resyncing", r.stats.Seq+1, msg.Seq-1)
+				r.requestSync()
+			}
+			return
+		}
+	}
+
+	msg, err := UnmarshalWSMessage(msg)
+	if err != nil {
+		logging.GetLogger().Errorf("Replica: unable to parse the event %s: %s", msg, err.Error())
+		return
+	}
+
+	if !r.apply(msg) {
+		if !r.resyncing {
+			logging.GetLogger().Warningf("Replica: %s referencing an unknown element, resyncing", msg.Type)
+			r.requestSync()
+		}
+		return
+	}
+
+	if msg.Seq != 0 {
+		r.stats.Seq, r.resyncing = msg.Seq, false
+	}
+}
+
+func (r *Replicator) Stats() ReplicaStats {
+	r.Graph.RLock()
+	defer r.Graph.RUnlock()
+
+	return r.stats
+}
+
+func NewReplicator(c *shttp.WSAsyncClient, g *Graph) *Replicator {
+	r := &Replicator{
+		Client: c,
+		Graph:  g,
+	}
+
+	if config.GetConfig().GetBool("graph.sync_digests") {
+		r.Digests = NewHostDigests(g)
+		r.Digests.Start()
+	}
+
+	c.AddEventHandler(r)
+
+	return r
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+type sentMessages struct {
+	messages []shttp.WSMessage
+}
+
+func (s *sentMessages) SendWSMessage(m shttp.WSMessage) {
+	s.messages = append(s.messages, roundTrip(nil, m))
+}
+
+// roundTrip gives the message as received on the other side of a websocket
+func roundTrip(t *testing.T, m shttp.WSMessage) shttp.WSMessage {
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var msg shttp.WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	return msg
+}
+
+// primaryEvent changes the graph of the primary and returns the event
+// broadcast to the replicas
+func primaryEvent(t *testing.T, primary *GraphServer, msgType string, obj interface{}) shttp.WSMessage {
+	return roundTrip(t, primary.journal.Append(shttp.WSMessage{Namespace: Namespace, Type: msgType, Obj: obj}))
+}
+
+func TestReplicator(t *testing.T) {
+	primary := &GraphServer{Graph: newGraph(t), journal: NewJournal(100, time.Hour)}
+	n1 := primary.Graph.NewNode(GenID(), Metadata{"Name": "eth0", "MTU": 1500})
+	n2 := primary.Graph.NewNode(GenID(), Metadata{"Name": "eth1"})
+	primary.Graph.Link(n1, n2, Metadata{"RelationType": "layer2"})
+
+	sent := &sentMessages{}
+	replica := &Replicator{Client: sent, Graph: newGraph(t)}
+	stale := replica.Graph.NewNode(GenID(), Metadata{"Name": "stale"})
+
+	replica.OnConnected()
+	if len(sent.messages) != 1 || sent.messages[0].Type != "SyncRequest" {
+		t.Fatalf("Sync request expected, got %v", sent.messages)
+	}
+
+	for _, reply := range primary.syncReply("", sent.messages[0]) {
+		replica.OnMessage(roundTrip(t, reply))
+	}
+
+	if len(replica.Graph.GetNodes()) != 2 || len(replica.Graph.GetEdges()) != 1 || replica.Graph.GetNode(stale.ID) != nil {
+		t.Fatalf("Replica should be the graph of the primary: %v", replica.Graph.GetNodes())
+	}
+
+	n3 := primary.Graph.NewNode(GenID(), Metadata{"Name": "eth2"})
+	replica.OnMessage(primaryEvent(t, primary, "NodeAdded", n3))
+	if replica.Graph.GetNode(n3.ID) == nil {
+		t.Fatal("Node added on the primary should have been replicated")
+	}
+
+	// the first event is missed, the replica asks for it to the journal
+	seq := replica.Stats().Seq
+	primary.Graph.AddMetadata(n1, "MTU", 9000)
+	primaryEvent(t, primary, "NodeUpdated", n1)
+	primary.Graph.DelNode(n2)
+	replica.OnMessage(primaryEvent(t, primary, "NodeDeleted", n2))
+
+	if replica.Graph.GetNode(n2.ID) == nil {
+		t.Error("Event following a gap shouldn't be applied")
+	}
+
+	request := sent.messages[len(sent.messages)-1]
+	if request.Type != "SyncRequest" || request.Obj.(map[string]interface{})["From"] != float64(seq) {
+		t.Fatalf("Sync request from the last event applied expected, got %v", request)
+	}
+
+	for _, reply := range primary.syncReply("", request) {
+		replica.OnMessage(roundTrip(t, reply))
+	}
+
+	if d := DiffSnapshots(primary.Graph.Snapshot(), replica.Graph.Snapshot(), nil); !d.Empty() {
+		t.Errorf("Replica should be the graph of the primary: %+v", d)
+	}
+	if stats := replica.Stats(); !stats.Synced || stats.Seq != seq+2 || stats.Resyncs != 2 {
+		t.Errorf("Wrong replica stats: %+v", stats)
+	}
+}
+
+func TestReadOnlyServer(t *testing.T) {
+	s := &GraphServer{Graph: newGraph(t), ReadOnly: true}
+
+	n := newGraph(t).NewNode(GenID(), Metadata{"Name": "eth0"})
+	s.OnMessage(&shttp.WSClient{}, wsMessage(t, "NodeAdded", n))
+
+	if len(s.Graph.GetNodes()) != 0 {
+		t.Error("Read-only server shouldn't change its graph")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// revisions reserved at once in a persistent backend, the backend being
+// written once per block rather than on every change
+const revisionBlock = 1000
+
+// GraphBackendRevisioner is implemented by the persistent backends keeping
+// the revision of the graph, so that the revisions keep increasing across
+// the restarts. The revision stored is the highest one reserved.
+type GraphBackendRevisioner interface {
+	GetRevision() (uint64, error)
+	SetRevision(revision uint64) error
+}
+
+// Revision returns the revision of the graph, incremented on every change,
+// the graph lock is not needed. The state of the graph read under the graph
+// lock is the one of the revision read along.
+func (g *Graph) Revision() uint64 {
+	return atomic.LoadUint64(&g.revision)
+}
+
+// nextRevision increments the revision on a change, a new block of
+// revisions being reserved in the backend once the previous one is used.
+// The graph lock has to be held.
+func (g *Graph) nextRevision() {
+	revision := atomic.AddUint64(&g.revision, 1)
+	if g.revisioner == nil || revision < g.reservedRevision {
+		return
+	}
+
+	g.reservedRevision = revision + revisionBlock
+	if err := g.revisioner.SetRevision(g.reservedRevision); err != nil {
+		logging.GetLogger().Errorf("Unable to store the graph revision %d: %s", g.reservedRevision, err.Error())
+	}
+}
+
+// initRevision starts the revisions after the ones of the previous runs:
+// after the ones reserved in the backend if persistent, otherwise at the
+// current time in microseconds, as the journal sequence numbers.
+func (g *Graph) initRevision() {
+	revision := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+
+	if r, ok := g.backend.(GraphBackendRevisioner); ok {
+		g.revisioner = r
+
+		stored, err := r.GetRevision()
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to read the graph revision: %s", err.Error())
+		} else if stored > revision {
+			revision = stored
+		}
+	}
+
+	g.revision, g.reservedRevision = revision, revision
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// The node types and the relation types of the edges are registered, by
+// the topology package and the probes at init, so that a typo doesn't
+// silently create nodes no filter matches. Unknown types are reported once
+// or, with a strict schema, make NewNode and NewEdge panic. The edges created
+// by Link are also checked against the constraints of their relation type.
+var schema = struct {
+	sync.RWMutex
+	nodeTypes     map[string]bool
+	relationTypes map[string]bool
+	constraints   map[string]RelationConstraints
+	reported      map[string]bool
+}{
+	nodeTypes:     make(map[string]bool),
+	relationTypes: make(map[string]bool),
+	constraints:   make(map[string]RelationConstraints),
+	reported:      make(map[string]bool),
+}
+
+// RelationConstraints are the rules the edges of a relation type follow
+type RelationConstraints struct {
+	// the edges form a tree, a node having at most one parent and not
+	// being the parent of its ancestors, ie. ownership
+	Tree bool `json:",omitempty"`
+	// the edges have no direction, the reverse of an edge being a
+	// duplicate, ie. layer2
+	Symmetric bool `json:",omitempty"`
+}
+
+func RegisterNodeTypes(types ...string) {
+	schema.Lock()
+	for _, t := range types {
+		schema.nodeTypes[t] = true
+	}
+	schema.Unlock()
+}
+
+func RegisterRelationTypes(types ...string) {
+	schema.Lock()
+	for _, t := range types {
+		schema.relationTypes[t] = true
+	}
+	schema.Unlock()
+}
+
+// RegisterRelationType registers a relation type whose edges follow the
+// given constraints.
+func RegisterRelationType(t string, c RelationConstraints) {
+	schema.Lock()
+	schema.relationTypes[t] = true
+	schema.constraints[t] = c
+	schema.Unlock()
+}
+
+func sortedTypes(types map[string]bool) []string {
+	result := make([]string, 0, len(types))
+	for t := range types {
+		result = append(result, t)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// NodeTypes returns the registered node types, sorted
+func NodeTypes() []string {
+	schema.RLock()
+	defer schema.RUnlock()
+
+	return sortedTypes(schema.nodeTypes)
+}
+
+// RelationTypes returns the registered relation types, sorted
+func RelationTypes() []string {
+	schema.RLock()
+	defer schema.RUnlock()
+
+	return sortedTypes(schema.relationTypes)
+}
+
+// RelationTypeConstraints returns the constraints of the relation types
+// registered with some.
+func RelationTypeConstraints() map[string]RelationConstraints {
+	schema.RLock()
+	defer schema.RUnlock()
+
+	constraints := make(map[string]RelationConstraints)
+	for t, c := range schema.constraints {
+		if c.Tree || c.Symmetric {
+			constraints[t] = c
+		}
+	}
+
+	return constraints
+}
+
+// validateType checks the value of the given metadata key, elements without
+// the key or with a non string value are not validated.
+func (g *Graph) validateType(m Metadata, key string, known map[string]bool) {
+	t, ok := m[key].(string)
+	if !ok {
+		return
+	}
+
+	schema.RLock()
+	registered := known[t]
+	schema.RUnlock()
+
+	if registered {
+		return
+	}
+
+	g.reportSchemaError(key+"/"+t, fmt.Sprintf("%s %s not registered in the graph schema", key, t))
+}
+
+// reportSchemaError panics with a strict schema, otherwise logs the error,
+// once per kind of error.
+func (g *Graph) reportSchemaError(kind string, err string) {
+	if g.strictSchema {
+		panic(err)
+	}
+
+	schema.Lock()
+	reported := schema.reported[kind]
+	schema.reported[kind] = true
+	schema.Unlock()
+
+	if !reported {
+		logging.GetLogger().Warning(err)
+	}
+}
+
+// hasRelation returns whether an edge of the relation type links the parent
+// to the child.
+func (g *Graph) hasRelation(parent *Node, child *Node, relationType string) bool {
+	for _, e := range g.backend.GetNodeEdges(parent) {
+		if e.parent == parent.ID && e.child == child.ID && e.metadata["RelationType"] == relationType {
+			return true
+		}
+	}
+	return false
+}
+
+// relationParents returns the parents of the node by the edges of the
+// relation type.
+func (g *Graph) relationParents(n *Node, relationType string) []*Node {
+	var parents []*Node
+	for _, e := range g.backend.GetNodeEdges(n) {
+		if e.child != n.ID || e.metadata["RelationType"] != relationType {
+			continue
+		}
+		if parent := g.backend.GetNode(e.parent); parent != nil {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// validateRelation checks the link of the parent to the child against the
+// constraints of the relation type, the violations being reported as the
+// unknown types. The edge is created anyway.
+func (g *Graph) validateRelation(parent *Node, child *Node, relationType string) {
+	schema.RLock()
+	c := schema.constraints[relationType]
+	schema.RUnlock()
+
+	if c.Symmetric && g.hasRelation(child, parent, relationType) {
+		g.reportSchemaError(relationType+"/symmetric", fmt.Sprintf("%s edge from %s to %s duplicates the reverse edge", relationType, parent.ID, child.ID))
+	}
+
+	if !c.Tree {
+		return
+	}
+
+	for _, p := range g.relationParents(child, relationType) {
+		if p.ID != parent.ID {
+			g.reportSchemaError(relationType+"/parents", fmt.Sprintf("%s edge from %s gives %s a second parent %s", relationType, parent.ID, child.ID, p.ID))
+			break
+		}
+	}
+
+	visited := map[Identifier]bool{parent.ID: true}
+	for ancestors := []*Node{parent}; len(ancestors) > 0; {
+		n := ancestors[0]
+		ancestors = ancestors[1:]
+
+		if n.ID == child.ID {
+			g.reportSchemaError(relationType+"/cycle", fmt.Sprintf("%s edge from %s to %s creates a cycle", relationType, parent.ID, child.ID))
+			return
+		}
+
+		for _, p := range g.relationParents(n, relationType) {
+			if !visited[p.ID] {
+				visited[p.ID] = true
+				ancestors = append(ancestors, p)
+			}
+		}
+	}
+}
+
+// SetStrictSchema makes the creation of nodes and edges of unknown types
+// panic instead of being reported, for the tests.
+func (g *Graph) SetStrictSchema(strict bool) {
+	g.strictSchema = strict
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	RegisterNodeTypes("schema-device", "schema-bridge")
+	RegisterRelationTypes("schema-ownership")
+
+	types := NodeTypes()
+	for i := 1; i < len(types); i++ {
+		if types[i-1] > types[i] {
+			t.Fatalf("Node types not sorted: %v", types)
+		}
+	}
+
+	g := newGraph(t)
+	g.SetStrictSchema(true)
+
+	n1 := g.NewNode(GenID(), Metadata{"Type": "schema-bridge"})
+	n2 := g.NewNode(GenID(), Metadata{"Type": "schema-device"})
+	g.Link(n1, n2, Metadata{"RelationType": "schema-ownership"})
+
+	// nodes without type are not validated
+	g.NewNode(GenID(), Metadata{"Name": "untyped"})
+
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected a panic with a strict schema for %s", name)
+			}
+		}()
+		f()
+	}
+	expectPanic("a node type typo", func() { g.NewNode(GenID(), Metadata{"Type": "schema-devcie"}) })
+	expectPanic("a relation type typo", func() { g.Link(n1, n2, Metadata{"RelationType": "schema-owner"}) })
+
+	// only reported otherwise
+	g.SetStrictSchema(false)
+	if n := g.NewNode(GenID(), Metadata{"Type": "schema-devcie"}); n == nil {
+		t.Error("Node of an unknown type not created without a strict schema")
+	}
+}
+
+func TestRelationConstraints(t *testing.T) {
+	RegisterNodeTypes("schema-node")
+	RegisterRelationType("schema-tree", RelationConstraints{Tree: true})
+	RegisterRelationType("schema-symmetric", RelationConstraints{Symmetric: true})
+
+	if c := RelationTypeConstraints()["schema-tree"]; !c.Tree || c.Symmetric {
+		t.Errorf("Wrong constraints of the tree relation: %+v", c)
+	}
+
+	g := newGraph(t)
+	g.SetStrictSchema(true)
+
+	n1 := g.NewNode(GenID(), Metadata{"Type": "schema-node"})
+	n2 := g.NewNode(GenID(), Metadata{"Type": "schema-node"})
+	n3 := g.NewNode(GenID(), Metadata{"Type": "schema-node"})
+
+	g.Link(n1, n2, Metadata{"RelationType": "schema-tree"})
+	g.Link(n2, n3, Metadata{"RelationType": "schema-tree"})
+	g.Link(n1, n2, Metadata{"RelationType": "schema-symmetric"})
+
+	// linking again is not a violation
+	g.Link(n1, n2, Metadata{"RelationType": "schema-tree"})
+	g.Link(n1, n2, Metadata{"RelationType": "schema-symmetric"})
+
+	// other relation types are not constrained
+	g.Link(n3, n1, Metadata{"RelationType": "schema-ownership"})
+
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected a panic with a strict schema for %s", name)
+			}
+		}()
+		f()
+	}
+	expectPanic("a second parent", func() { g.Link(n1, n3, Metadata{"RelationType": "schema-tree"}) })
+	expectPanic("a cycle", func() { g.Link(n3, n1, Metadata{"RelationType": "schema-tree"}) })
+	expectPanic("a reverse symmetric edge", func() { g.Link(n2, n1, Metadata{"RelationType": "schema-symmetric"}) })
+
+	// the edge is created anyway otherwise
+	g.SetStrictSchema(false)
+	g.Link(n3, n1, Metadata{"RelationType": "schema-tree"})
+	if !g.hasRelation(n3, n1, "schema-tree") {
+		t.Error("Edge violating the constraints not created without a strict schema")
+	}
+}
@@ -23,6 +23,13 @@
 package graph
 
 import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
 	shttp "github.com/redhat-cip/skydive/http"
 	"github.com/redhat-cip/skydive/logging"
 )
@@ -35,32 +42,104 @@ type GraphServer struct {
 	shttp.DefaultWSServerEventHandler
 	WSServer *shttp.WSServer
 	Graph    *Graph
+	Filter   *MetadataFilter
+	// messages referencing nodes or edges not received yet, per client
+	deferred        map[*shttp.WSClient]*deferredQueue
+	deferredMax     int
+	deferredTimeout time.Duration
+	// expiry of the deferred messages, driven by the clock of the graph
+	wheel   *common.TimerWheel
+	journal *Journal
+	// metadata origins the publishers may write
+	Origins *OriginRules
+	// time series of the statistics metadata, nil if disabled
+	Statistics *StatisticsStore
+	// read scopes of the clients, nil if unrestricted
+	Authorizer Authorizer
+	// graph events, taken from the bus
+	subscription *common.BusSubscription
+	// host syncs in progress, per client
+	hostSyncs map[*shttp.WSClient]*hostSync
+	// a read-only server only answers the sync requests, the graph being
+	// a replica of another analyzer
+	ReadOnly bool
+	// digests of the persistent metadata of the nodes, to tell the volatile
+	// only updates
+	digests map[Identifier]string
+	// quarantines the agents exceeding their quota, nil if disabled
+	Quotas *QuotaEnforcer
+	// digests of the hosts, sending only the hosts a client is missing,
+	// nil if disabled
+	HostDigests *HostDigests
+	// last traces of the mutations applied, nil if disabled
+	Traces *common.TraceRecorder
 }
 
-func (s *GraphServer) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
-	if msg.Namespace != Namespace {
-		return
-	}
+// hostSync records the elements sent by an agent during a resync of its
+// host, the ones of the host not sent again being gone.
+type hostSync struct {
+	host string
+	seen map[Identifier]bool
+}
 
-	s.Graph.Lock()
-	defer s.Graph.Unlock()
+type deferredMessage struct {
+	msg  shttp.WSMessage
+	time time.Time
+}
 
-	msg, err := UnmarshalWSMessage(msg)
-	if err != nil {
-		logging.GetLogger().Errorf("Graph: Unable to parse the event %s: %s", msg, err.Error())
-		return
+type deferredQueue struct {
+	messages  []deferredMessage
+	scheduled bool
+	stats     DeferredStats
+}
+
+type DeferredStats struct {
+	Pending  int
+	Deferred int64
+	Expired  int64
+	Resyncs  int64
+}
+
+// upsert merges the metadata of an element already known following the
+// origin rules, messages being replayable without changing the graph. The
+// updates of every writer are merged, an agent replacing only the core
+// metadata, not the ones of the publishers.
+func (s *GraphServer) upsert(e interface{}, current Metadata, update Metadata, user string) {
+	if m := s.Origins.Merge(user, current, update); !reflect.DeepEqual(m, current) {
+		s.Graph.SetMetadata(e, m)
 	}
+}
 
+// apply applies a message of a user to the graph, returns false if the
+// message is referencing a node or an edge unknown so far. Added and
+// upserted elements already known are merged, the publishers restricted to
+// some origins can't delete.
+func (s *GraphServer) apply(msg shttp.WSMessage, user string) bool {
 	switch msg.Type {
-	case "SyncRequest":
-		reply := shttp.WSMessage{
-			Namespace: Namespace,
-			Type:      "SyncReply",
-			Obj:       s.Graph,
+	case "SubGraphDeleted", "NodeDeleted", "EdgeDeleted":
+		if s.Origins.Restricted(user) {
+			logging.GetLogger().Warningf("Graph: %s from %s refused, publishers can't delete", msg.Type, user)
+			return true
 		}
+	}
 
-		c.SendWSMessage(reply)
+	// the writes of the publishers exceeding the metadata limits are
+	// rejected as a whole, only the ones of the probes get truncated
+	if s.Origins.Restricted(user) {
+		var m Metadata
+		switch obj := msg.Obj.(type) {
+		case *Node:
+			m = obj.metadata
+		case *Edge:
+			m = obj.metadata
+		}
+		if err := s.Graph.limits.Check(m); err != nil {
+			logging.GetLogger().Warningf("Graph: %s from %s refused, %s", msg.Type, user, err.Error())
+			return true
+		}
+	}
 
+	switch msg.Type {
 	case "SubGraphDeleted":
 		n := msg.Obj.(*Node)
 
@@ -73,87 +152,758 @@ func (s *GraphServer) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
 	case "NodeUpdated":
 		n := msg.Obj.(*Node)
 		node := s.Graph.GetNode(n.ID)
-		if node != nil {
-			s.Graph.SetMetadata(node, n.metadata)
+		if node == nil {
+			return false
 		}
+		s.upsert(node, node.metadata, n.metadata, user)
 	case "NodeDeleted":
 		s.Graph.DelNode(msg.Obj.(*Node))
-	case "NodeAdded":
+	case "NodeAdded", "NodeUpserted":
 		n := msg.Obj.(*Node)
-		if s.Graph.GetNode(n.ID) == nil {
+		if node := s.Graph.GetNode(n.ID); node != nil {
+			s.upsert(node, node.metadata, n.metadata, user)
+		} else {
+			n.metadata = s.Origins.Create(user, n.metadata)
 			s.Graph.AddNode(n)
 		}
 	case "EdgeUpdated":
 		e := msg.Obj.(*Edge)
 		edge := s.Graph.GetEdge(e.ID)
-		if edge != nil {
-			s.Graph.SetMetadata(edge, e.metadata)
+		if edge == nil {
+			return false
 		}
+		s.upsert(edge, edge.metadata, e.metadata, user)
 	case "EdgeDeleted":
 		s.Graph.DelEdge(msg.Obj.(*Edge))
-	case "EdgeAdded":
+	case "EdgeAdded", "EdgeUpserted":
 		e := msg.Obj.(*Edge)
-		if s.Graph.GetEdge(e.ID) == nil {
+		if edge := s.Graph.GetEdge(e.ID); edge != nil {
+			s.upsert(edge, edge.metadata, e.metadata, user)
+		} else {
+			if s.Graph.GetNode(e.parent) == nil || s.Graph.GetNode(e.child) == nil {
+				return false
+			}
+			e.metadata = s.Origins.Create(user, e.metadata)
 			s.Graph.AddEdge(e)
 		}
 	}
+
+	return true
 }
 
-func (s *GraphServer) OnNodeUpdated(n *Node) {
-	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
+// see records the elements of the messages received during a host sync
+func (h *hostSync) see(msg shttp.WSMessage) {
+	switch obj := msg.Obj.(type) {
+	case *Node:
+		h.seen[obj.ID] = true
+	case *Edge:
+		h.seen[obj.ID] = true
+	}
+}
+
+// reconcileHost deletes the nodes and edges of the host not sent again
+// during the sync, the other ones having been upserted in place, so that a
+// restarting agent doesn't delete and recreate its whole graph.
+func (s *GraphServer) reconcileHost(h *hostSync) {
+	for _, e := range s.Graph.GetEdges() {
+		if e.Host() == h.host && !h.seen[e.ID] {
+			s.Graph.DelEdge(e)
+		}
+	}
+
+	for _, n := range s.Graph.GetNodes() {
+		if n.Host() == h.host && !h.seen[n.ID] {
+			s.Graph.DelNode(n)
+		}
+	}
+}
+
+// onHostSync handles the beginning and the end of the resync of a client
+func (s *GraphServer) onHostSync(c *shttp.WSClient, msg shttp.WSMessage) {
+	if s.Origins.Restricted(c.GetUsername()) {
+		logging.GetLogger().Warningf("Graph: %s from %s refused, publishers can't sync hosts", msg.Type, c.GetUsername())
+		return
+	}
+
+	host := msg.Obj.(*Node).Host()
+
+	switch msg.Type {
+	case "HostSyncBegin":
+		s.hostSyncs[c] = &hostSync{host: host, seen: make(map[Identifier]bool)}
+	case "HostSyncEnd":
+		h, ok := s.hostSyncs[c]
+		if !ok || h.host != host {
+			logging.GetLogger().Warningf("Graph: %s from %s without a sync of the host %s in progress", msg.Type, c.GetHost(), host)
+			return
+		}
+		delete(s.hostSyncs, c)
+
+		s.reconcileHost(h)
+		s.onIdentitySync(c)
+	}
+}
+
+func (s *GraphServer) deferMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+	q, ok := s.deferred[c]
+	if !ok {
+		q = &deferredQueue{}
+		s.deferred[c] = q
+	}
+
+	if len(q.messages) >= s.deferredMax {
+		logging.GetLogger().Warningf("Graph: too many deferred messages from %s", c.GetHost())
+
+		q.stats.Expired += int64(len(q.messages))
+		s.requestResync(c, q)
+		return
+	}
+
+	q.messages = append(q.messages, deferredMessage{msg: msg, time: s.Graph.Now()})
+	q.stats.Deferred++
+
+	if !q.scheduled {
+		s.scheduleExpiry(c, q, s.Graph.Now().Add(s.deferredTimeout))
+	}
+}
+
+func deferredKey(c *shttp.WSClient) string {
+	return fmt.Sprintf("deferred/%p", c)
+}
+
+// scheduleExpiry checks the deferred messages of the client at the given
+// time, the messages not expiring when the server has no timer wheel.
+func (s *GraphServer) scheduleExpiry(c *shttp.WSClient, q *deferredQueue, at time.Time) {
+	if s.wheel == nil {
+		return
+	}
+	q.scheduled = true
+	s.wheel.Schedule(deferredKey(c), at, func() { s.expireDeferred(c) })
+}
+
+func (s *GraphServer) cancelExpiry(c *shttp.WSClient, q *deferredQueue) {
+	if q.scheduled {
+		s.wheel.Cancel(deferredKey(c))
+		q.scheduled = false
+	}
+}
+
+// deferredReferences returns whether a deferred message references a
+// deleted node or edge
+func deferredReferences(msg shttp.WSMessage, deleted Identifier) bool {
+	switch obj := msg.Obj.(type) {
+	case *Node:
+		return obj.ID == deleted
+	case *Edge:
+		return obj.ID == deleted || obj.parent == deleted || obj.child == deleted
+	}
+	return false
+}
+
+// purgeDeferred drops the deferred messages of the client referencing a
+// node or an edge it deleted, so that they aren't applied once their
+// references are received, undoing the deletion.
+func (s *GraphServer) purgeDeferred(c *shttp.WSClient, msg shttp.WSMessage) {
+	q, ok := s.deferred[c]
+	if !ok || len(q.messages) == 0 {
+		return
+	}
+
+	var deleted Identifier
+	switch obj := msg.Obj.(type) {
+	case *Node:
+		deleted = obj.ID
+	case *Edge:
+		deleted = obj.ID
+	default:
+		return
+	}
+
+	var pending []deferredMessage
+	for _, d := range q.messages {
+		if !deferredReferences(d.msg, deleted) {
+			pending = append(pending, d)
+		}
+	}
+	q.messages = pending
+}
+
+// retryDeferred applies the deferred messages until no more can be applied
+func (s *GraphServer) retryDeferred(c *shttp.WSClient) {
+	q, ok := s.deferred[c]
+	if !ok {
+		return
+	}
+
+	for applied := true; applied && len(q.messages) > 0; {
+		applied = false
+
+		var pending []deferredMessage
+		for _, d := range q.messages {
+			if s.apply(d.msg, c.GetUsername()) {
+				applied = true
+			} else {
+				pending = append(pending, d)
+			}
+		}
+		q.messages = pending
+	}
+}
+
+func (s *GraphServer) expireDeferred(c *shttp.WSClient) {
+	s.Graph.Lock()
+	defer s.Graph.Unlock()
+
+	q, ok := s.deferred[c]
+	if !ok {
+		return
+	}
+	q.scheduled = false
+
+	now := s.Graph.Now()
+
+	var pending []deferredMessage
+	for _, d := range q.messages {
+		if now.Sub(d.time) < s.deferredTimeout {
+			pending = append(pending, d)
+		}
+	}
+
+	if expired := len(q.messages) - len(pending); expired > 0 {
+		logging.GetLogger().Warningf("Graph: %d deferred messages from %s expired", expired, c.GetHost())
+
+		q.stats.Expired += int64(expired)
+		s.requestResync(c, q)
+		return
+	}
+
+	if len(pending) > 0 {
+		s.scheduleExpiry(c, q, pending[0].time.Add(s.deferredTimeout))
+	}
+}
+
+// requestResync drops the deferred messages and asks the client to send
+// its whole graph again
+func (s *GraphServer) requestResync(c *shttp.WSClient, q *deferredQueue) {
+	q.messages = nil
+	s.cancelExpiry(c, q)
+	q.stats.Resyncs++
+
+	c.SendWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
-		Type:      "NodeUpdated",
-		Obj:       n,
+		Type:      "ResyncRequest",
 	})
 }
 
-func (s *GraphServer) OnNodeAdded(n *Node) {
-	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
+func (s *GraphServer) deferredMetrics() interface{} {
+	s.Graph.RLock()
+	defer s.Graph.RUnlock()
+
+	metrics := make(map[string]DeferredStats)
+	for c, q := range s.deferred {
+		stats := q.stats
+		stats.Pending = len(q.messages)
+		metrics[fmt.Sprintf("%s/%d", c.GetHost(), c.GetID())] = stats
+	}
+
+	return metrics
+}
+
+func (s *GraphServer) OnUnregisterClient(c *shttp.WSClient) {
+	s.Graph.Lock()
+	defer s.Graph.Unlock()
+
+	if q, ok := s.deferred[c]; ok {
+		s.cancelExpiry(c, q)
+		delete(s.deferred, c)
+	}
+
+	delete(s.hostSyncs, c)
+	s.Quotas.forget(c)
+}
+
+// deltaReply returns the SyncDeltaReply answering a SyncRequest with the
+// digests of the graph of the client, false if the client has to get the
+// whole graph: the digests are of another version or the client doesn't
+// get the graph as it is, filtered, without the volatile metadata or out of
+// its read scope.
+func (s *GraphServer) deltaReply(user string, msg shttp.WSMessage, obj map[string]interface{}) (shttp.WSMessage, bool) {
+	if s.HostDigests == nil || obj["Digests"] == nil || s.Filter != nil || obj["Volatile"] != true || obj["MaxValueSize"] != nil || Restricted(s.Authorizer, user) {
+		return shttp.WSMessage{}, false
+	}
+
+	var request struct{ Digests *SyncDigests }
+	if err := msg.DecodeObj(&request); err != nil {
+		logging.GetLogger().Warningf("Graph: invalid digests from %s: %s", user, err.Error())
+		return shttp.WSMessage{}, false
+	}
+
+	delta, ok := s.HostDigests.Delta(request.Digests)
+	if !ok {
+		return shttp.WSMessage{}, false
+	}
+
+	reply := shttp.WSMessage{
 		Namespace: Namespace,
-		Type:      "NodeAdded",
-		Obj:       n,
-	})
+		Type:      "SyncDeltaReply",
+		Obj:       delta,
+		Revision:  s.Graph.Revision(),
+	}
+	if s.journal != nil {
+		reply.Seq = s.journal.Seq()
+	}
+
+	return reply, true
 }
 
-func (s *GraphServer) OnNodeDeleted(n *Node) {
-	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
+// revisionReply returns the events following the revision of the graph a
+// client read through the API, or a ResyncRequired message if some of them
+// are not in the journal anymore or the revision is not one of the graph,
+// ie. of a previous run without persistent backend. The client then reads
+// the graph again or asks for the whole graph.
+func (s *GraphServer) revisionReply(user string, revision uint64) []shttp.WSMessage {
+	if s.journal != nil && revision <= s.Graph.Revision() {
+		if msgs, ok := s.journal.SinceRevisionFor(revision, user); ok {
+			return msgs
+		}
+	}
+
+	return []shttp.WSMessage{{
 		Namespace: Namespace,
-		Type:      "NodeDeleted",
-		Obj:       n,
-	})
+		Type:      "ResyncRequired",
+		Revision:  s.Graph.Revision(),
+	}}
 }
 
-func (s *GraphServer) OnEdgeUpdated(e *Edge) {
-	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
+// syncReply returns the messages answering a SyncRequest. A client giving
+// the revision of the graph it read through the API, in the FromRevision
+// field, gets the events which followed, see revisionReply. A client giving
+// the sequence number of the last event it got, in the From field, only
+// gets the events it missed if they are still in the journal. Otherwise a
+// client giving the digests of its graph, in the Digests field, only gets
+// the hosts whose digests differ, when it gets the graph unfiltered.
+// Otherwise the whole graph is sent with the current sequence number, with
+// the volatile metadata if the Volatile field is set. All are limited to
+// the read scope of the client.
+func (s *GraphServer) syncReply(user string, msg shttp.WSMessage) []shttp.WSMessage {
+	// the graph being locked, the journal gets up to date with it
+	if s.subscription != nil {
+		s.subscription.Flush()
+	}
+
+	if obj, ok := msg.Obj.(map[string]interface{}); ok {
+		if revision, ok := obj["FromRevision"].(float64); ok {
+			return s.revisionReply(user, uint64(revision))
+		}
+	}
+
+	if s.journal != nil {
+		if obj, ok := msg.Obj.(map[string]interface{}); ok {
+			if from, ok := obj["From"].(float64); ok {
+				if msgs, ok := s.journal.SinceFor(uint64(from), user); ok {
+					return msgs
+				}
+			}
+		}
+	}
+
+	obj, _ := msg.Obj.(map[string]interface{})
+	if reply, ok := s.deltaReply(user, msg, obj); ok {
+		return []shttp.WSMessage{reply}
+	}
+
+	// the volatile metadata are only sent if requested, the clients get them
+	// with the next updates anyway, the values bigger than MaxValueSize are
+	// left out if requested, ie. {"MaxValueSize": 4096}
+	filter := s.Filter
+	if obj["Volatile"] != true {
+		filter = filter.WithoutVolatile()
+	}
+	if size, ok := obj["MaxValueSize"].(float64); ok {
+		filter = filter.WithMaxValueSize(int(size))
+	}
+
+	reply := shttp.WSMessage{
 		Namespace: Namespace,
-		Type:      "EdgeUpdated",
-		Obj:       e,
-	})
+		Type:      "SyncReply",
+		Obj:       AuthorizeGraph(s.Authorizer, user, s.Graph, filter),
+		Revision:  s.Graph.Revision(),
+	}
+	if s.journal != nil {
+		reply.Seq = s.journal.Seq()
+	}
+
+	return []shttp.WSMessage{reply}
+}
+
+// readers returns the filter of the users allowed to read the given nodes,
+// evaluated against copies of their metadata taken now, nil if the reads
+// are not restricted. A missing node is only readable by the unrestricted
+// users.
+func (s *GraphServer) readers(nodes ...*Node) func(user string) bool {
+	if s.Authorizer == nil {
+		return nil
+	}
+
+	copies := make([]*Node, len(nodes))
+	for i, n := range nodes {
+		if n != nil {
+			m := make(Metadata, len(n.metadata))
+			for k, v := range n.metadata {
+				m[k] = v
+			}
+			copies[i] = &Node{graphElement: graphElement{ID: n.ID, host: n.host, metadata: m}}
+		}
+	}
+
+	return func(user string) bool {
+		if !s.Authorizer.Restricted(user) {
+			return true
+		}
+
+		for _, n := range copies {
+			if n == nil || !s.Authorizer.CanReadNode(user, n) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// broadcast sends the event to the clients allowed to read it, numbered and
+// kept in the journal if enabled, the volatile metadata being only sent live
+func (s *GraphServer) broadcast(msg shttp.WSMessage, acked bool, readers func(user string) bool) {
+	if s.journal != nil {
+		if obj, ok := withoutVolatileObj(msg.Obj); ok {
+			journaled := msg
+			journaled.Obj = obj
+			msg.Seq = s.journal.AppendFiltered(journaled, readers).Seq
+		} else {
+			// serialized once for the journal and the broadcast
+			msg = s.journal.AppendFiltered(msg, readers)
+		}
+	}
+
+	s.WSServer.BroadcastFilteredWSMessage(msg, acked, clientFilter(readers))
+}
+
+// withoutVolatileObj returns a copy of a node or an edge without its
+// volatile metadata, false if it has none.
+func withoutVolatileObj(obj interface{}) (interface{}, bool) {
+	var f *MetadataFilter
+	switch obj := obj.(type) {
+	case *Node:
+		if hasPersistence(obj.metadata, VolatilePersistence) {
+			return f.WithoutVolatile().FilterNode(obj), true
+		}
+	case *Edge:
+		if hasPersistence(obj.metadata, VolatilePersistence) {
+			return f.WithoutVolatile().FilterEdge(obj), true
+		}
+	}
+	return obj, false
+}
+
+// volatileUpdate returns whether only the volatile metadata of the node
+// changed since its previous revision, the journal being the only one
+// making a difference
+func (s *GraphServer) volatileUpdate(n *Node) bool {
+	if s.journal == nil {
+		return false
+	}
+
+	digest, _ := json.Marshal(withoutVolatile(n.metadata))
+	previous, ok := s.digests[n.ID]
+	s.digests[n.ID] = string(digest)
+
+	return ok && previous == string(digest)
+}
+
+func clientFilter(readers func(user string) bool) func(c *shttp.WSClient) bool {
+	if readers == nil {
+		return nil
+	}
+	return func(c *shttp.WSClient) bool { return readers(c.GetUsername()) }
+}
+
+func (s *GraphServer) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+	if msg.Namespace != Namespace {
+		return
+	}
+
+	received := time.Now()
+	s.Graph.Lock()
+	defer s.Graph.Unlock()
+
+	msg, err := UnmarshalWSMessage(msg)
+	if err != nil {
+		logging.GetLogger().Errorf("Graph: Unable to parse the event %s: %s", msg, err.Error())
+		return
+	}
+
+	if msg.Type == "SyncRequest" {
+		// the events broadcasted meanwhile are held then sent after the
+		// replies, through the server loop, those already replied left out
+		s.WSServer.HoldWSMessages(c)
+		s.WSServer.QueueWSMessages(c, s.syncReply(c.GetUsername(), msg))
+		return
+	}
+
+	if s.ReadOnly {
+		logging.GetLogger().Debugf("Graph: %s from %s refused, the graph is a read-only replica", msg.Type, c.GetHost())
+		return
+	}
+
+	if !s.Quotas.admit(c, msg) {
+		return
+	}
+
+	switch msg.Type {
+	case "HostSyncBegin", "HostSyncEnd":
+		s.onHostSync(c, msg)
+		return
+	}
+
+	if h, ok := s.hostSyncs[c]; ok {
+		h.see(msg)
+	}
+
+	names := s.hostNames(msg)
+
+	var span *common.Span
+	if msg.Tracing != nil && s.Traces != nil {
+		span = s.startTrace(c, msg, received)
+	}
+
+	applied := s.apply(msg, c.GetUsername())
+	if span != nil {
+		s.endTrace(msg.Tracing, span, applied)
+	}
+
+	if !applied {
+		s.deferMessage(c, msg)
+		return
+	}
+
+	if len(names) > 0 {
+		s.disambiguateHosts(names...)
+	}
+
+	switch msg.Type {
+	case "NodeAdded", "NodeUpserted", "EdgeAdded", "EdgeUpserted":
+		s.retryDeferred(c)
+	case "NodeDeleted", "EdgeDeleted", "SubGraphDeleted":
+		s.purgeDeferred(c, msg)
+	}
 }
 
-func (s *GraphServer) OnEdgeAdded(e *Edge) {
+// startTrace adds the spans of the transport of a traced message and of the
+// wait for the graph lock, returning the span of its apply whose children
+// are the backend writes. The transport span starts on the clock of the
+// agent and ends on the one of the analyzer.
+func (s *GraphServer) startTrace(c *shttp.WSClient, msg shttp.WSMessage, received time.Time) *common.Span {
+	tracer := s.Graph.Tracer()
+	locked := tracer.Now()
+
+	if last := msg.Tracing.Last(); last != nil {
+		tracer.AddSpan(msg.Tracing, "transport", time.Unix(0, last.End), received).SetTag("from", c.GetHost())
+	}
+	tracer.AddSpan(msg.Tracing, "lock_wait", received, locked)
+
+	span := tracer.AddSpan(msg.Tracing, "apply", locked, locked)
+	span.SetTag("type", msg.Type)
+	s.Graph.StartApply(msg.Tracing, span)
+
+	return span
+}
+
+// endTrace ends the apply span of a traced message and records its trace
+func (s *GraphServer) endTrace(t *common.Trace, span *common.Span, applied bool) {
+	s.Graph.EndApply()
+	span.Finish(s.Graph.Tracer().Now())
+	if !applied {
+		span.SetTag("deferred", "true")
+	}
+
+	s.Traces.Record(t)
+}
+
+// OnBusEvent broadcasts the events of the graph, taken from the bus in the
+// order they occurred, the elements being copies the graph lock isn't needed.
+func (s *GraphServer) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*GraphEvent)
+	if !ok || ev.Graph != s.Graph {
+		return
+	}
+
+	switch e.Type {
+	case "NodeUpdated":
+		s.onNodeUpdated(ev.Node, ev.Revision)
+	case "NodeAdded":
+		s.onNodeAdded(ev.Node, ev.Revision)
+	case "NodeDeleted":
+		s.onNodeDeleted(ev.Node, ev.Revision)
+	case "EdgeUpdated", "EdgeAdded":
+		s.broadcast(shttp.WSMessage{
+			Namespace: Namespace,
+			Type:      e.Type,
+			Obj:       s.Filter.FilterEdge(ev.Edge),
+			Revision:  ev.Revision,
+		}, false, s.readers(ev.Parent, ev.Child))
+	case "EdgeDeleted":
+		s.broadcast(shttp.WSMessage{
+			Namespace: Namespace,
+			Type:      e.Type,
+			Obj:       s.Filter.FilterEdge(ev.Edge),
+			Revision:  ev.Revision,
+		}, true, s.readers(ev.Parent, ev.Child))
+	case "BulkChange":
+		s.onBulkChange(ev.Revision)
+	}
+}
+
+// onBulkChange asks the clients to sync again, the journal missing the
+// events of the bulk change
+func (s *GraphServer) onBulkChange(revision uint64) {
+	if s.journal != nil {
+		s.journal.Skip(revision)
+	}
+
 	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
-		Type:      "EdgeAdded",
-		Obj:       e,
+		Type:      "BulkChange",
+		Revision:  revision,
 	})
 }
 
-func (s *GraphServer) OnEdgeDeleted(e *Edge) {
+// OnBusEventsDropped asks the clients to sync again, they missed the dropped
+// events, the journal missing them too. The graph events can't wait for the
+// server instead, they are published under the graph lock which the
+// WebSocket server may be waiting for.
+func (s *GraphServer) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Errorf("Graph: %d events dropped, asking the clients to sync again", count)
+
+	revision := s.Graph.Revision()
+	if s.journal != nil {
+		s.journal.Skip(revision)
+	}
+
 	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
 		Namespace: Namespace,
-		Type:      "EdgeDeleted",
-		Obj:       e,
+		Type:      "ResyncRequired",
+		Revision:  revision,
 	})
 }
 
+func (s *GraphServer) onNodeUpdated(n *Node, revision uint64) {
+	msg := shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      "NodeUpdated",
+		Obj:       s.Filter.FilterNode(n),
+		Revision:  revision,
+	}
+
+	if s.Statistics != nil {
+		s.Statistics.Update(n)
+	}
+
+	// volatile only updates, ie. the statistics, are not kept in the
+	// journal, they would evict the topology changes, clients get the next
+	// ones
+	if s.volatileUpdate(n) {
+		s.WSServer.BroadcastFilteredWSMessage(msg, false, clientFilter(s.readers(n)))
+		return
+	}
+
+	s.broadcast(msg, false, s.readers(n))
+}
+
+func (s *GraphServer) onNodeAdded(n *Node, revision uint64) {
+	if s.Statistics != nil {
+		s.Statistics.Update(n)
+	}
+	s.volatileUpdate(n)
+
+	s.broadcast(shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      "NodeAdded",
+		Obj:       s.Filter.FilterNode(n),
+		Revision:  revision,
+	}, false, s.readers(n))
+}
+
+func (s *GraphServer) onNodeDeleted(n *Node, revision uint64) {
+	if s.Statistics != nil {
+		s.Statistics.Forget(n.ID)
+	}
+	delete(s.digests, n.ID)
+
+	s.broadcast(shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      "NodeDeleted",
+		Obj:       s.Filter.FilterNode(n),
+		Revision:  revision,
+	}, true, s.readers(n))
+}
+
+// Stop broadcasts the pending events then stops consuming the bus, it has
+// to be called before stopping the WebSocket server.
+func (s *GraphServer) Stop() {
+	s.subscription.Flush()
+	common.DefaultBus.Unsubscribe(s.subscription)
+	s.wheel.Stop()
+
+	if s.HostDigests != nil {
+		s.HostDigests.Stop()
+	}
+}
+
 func NewServer(g *Graph, server *shttp.WSServer) *GraphServer {
+	cfg := config.GetConfig()
+
 	s := &GraphServer{
-		Graph:    g,
-		WSServer: server,
+		Graph:           g,
+		WSServer:        server,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		hostSyncs:       make(map[*shttp.WSClient]*hostSync),
+		digests:         make(map[Identifier]string),
+		deferredMax:     cfg.GetInt("graph.deferred_max"),
+		deferredTimeout: time.Duration(cfg.GetInt("graph.deferred_timeout")) * time.Second,
+		wheel:           common.NewTimerWheel(time.Second, 60, g),
+		Origins:         NewOriginRulesFromConfig(),
+		Statistics:      NewStatisticsStoreFromConfig(g),
+		Authorizer:      NewAuthorizerFromConfig(),
+		Quotas:          NewQuotaEnforcerFromConfig(g),
+	}
+
+	if keep, log := cfg.GetInt("graph.trace.keep"), cfg.GetBool("graph.trace.log"); keep > 0 || log {
+		s.Traces = common.NewTraceRecorder(keep, log)
+		if g.Tracer() == nil {
+			g.SetTracer(common.NewTracer("analyzer", g.host, 0))
+		}
+	}
+
+	if cfg.GetBool("graph.sync_digests") {
+		s.HostDigests = NewHostDigests(g)
+		s.HostDigests.Start()
+	}
+
+	if size := cfg.GetInt("graph.journal.size"); size > 0 {
+		s.journal = NewJournal(size, time.Duration(cfg.GetInt("graph.journal.max_age"))*time.Second)
+		s.journal.Clock = g
+		// the events preceding the journal are not in it
+		s.journal.Skip(g.Revision())
+		common.RegisterMetrics("graph_journal", func() interface{} { return s.journal.Stats() })
 	}
-	s.Graph.AddEventListener(s)
+
+	s.wheel.Start()
+
+	s.subscription = common.DefaultBus.Subscribe("graph_server", cfg.GetInt("graph.bus.queue_size"), s, common.GraphTopic)
 	server.AddEventHandler(s)
 
+	common.RegisterMetrics("graph_deferred", s.deferredMetrics)
+	if s.Quotas != nil {
+		common.RegisterMetrics("graph_quarantines", func() interface{} { return s.Quotas.Quarantines() })
+	}
+
 	return s
 }
@@ -0,0 +1,642 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+func wsMessage(t *testing.T, msgType string, obj interface{}) shttp.WSMessage {
+	data, err := json.Marshal(shttp.WSMessage{Namespace: Namespace, Type: msgType, Obj: obj})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var msg shttp.WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	return msg
+}
+
+func TestDeferredMessages(t *testing.T) {
+	agent := newGraph(t)
+	analyzer := newGraph(t)
+
+	s := &GraphServer{
+		Graph:           analyzer,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+	}
+	c := &shttp.WSClient{}
+
+	n1 := agent.NewNode(GenID(), Metadata{"Name": "n1"})
+	n2 := agent.NewNode(GenID(), Metadata{"Name": "n2"})
+	e := agent.NewEdge(GenID(), n1, n2, nil)
+
+	// edge received before its child
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n1))
+	s.OnMessage(c, wsMessage(t, "EdgeAdded", e))
+
+	if analyzer.GetEdge(e.ID) != nil {
+		t.Fatal("Edge shouldn't be added without its child")
+	}
+
+	stats := s.deferredMetrics().(map[string]DeferredStats)["/0"]
+	if stats.Pending != 1 || stats.Deferred != 1 {
+		t.Errorf("Wrong deferred stats: %+v", stats)
+	}
+
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n2))
+
+	if analyzer.GetEdge(e.ID) == nil {
+		t.Error("Deferred edge should have been added")
+	}
+
+	stats = s.deferredMetrics().(map[string]DeferredStats)["/0"]
+	if stats.Pending != 0 {
+		t.Errorf("Wrong deferred stats: %+v", stats)
+	}
+
+	s.OnUnregisterClient(c)
+}
+
+func TestDeferredExpiry(t *testing.T) {
+	agent := newGraph(t)
+	analyzer := newGraph(t)
+
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+	analyzer.SetClock(clock)
+
+	s := &GraphServer{
+		Graph:           analyzer,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+		wheel:           common.NewTimerWheel(time.Second, 60, analyzer),
+	}
+	c := shttp.NewFakeWSClient("agent1", 10)
+
+	advance := func(d time.Duration) DeferredStats {
+		clock.Advance(d)
+		s.wheel.Advance(clock.Now())
+		return s.deferredMetrics().(map[string]DeferredStats)["agent1/0"]
+	}
+
+	n1 := agent.NewNode(GenID(), Metadata{"Name": "n1"})
+	n2 := agent.NewNode(GenID(), Metadata{"Name": "n2"})
+	n3 := agent.NewNode(GenID(), Metadata{"Name": "n3"})
+	e1 := agent.NewEdge(GenID(), n1, n2, nil)
+	e2 := agent.NewEdge(GenID(), n1, n3, nil)
+
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n1))
+	s.OnMessage(c, wsMessage(t, "EdgeAdded", e1))
+
+	clock.Advance(30 * time.Second)
+	s.OnMessage(c, wsMessage(t, "EdgeAdded", e2))
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n3))
+
+	// e2 applied, e1 still within its timeout
+	if stats := advance(29 * time.Second); stats.Pending != 1 || stats.Expired != 0 {
+		t.Fatalf("Nothing should expire yet: %+v", stats)
+	}
+
+	if stats := advance(time.Second); stats.Pending != 0 || stats.Expired != 1 || stats.Resyncs != 1 {
+		t.Errorf("Deferred edge should have expired: %+v", stats)
+	}
+
+	if s.wheel.Pending() != 0 {
+		t.Errorf("No expiry should be pending, got %d", s.wheel.Pending())
+	}
+
+	s.OnUnregisterClient(c)
+}
+
+func TestDeferredPurgedOnDelete(t *testing.T) {
+	agent := newGraph(t)
+	analyzer := newGraph(t)
+
+	s := &GraphServer{
+		Graph:           analyzer,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+	}
+	c := &shttp.WSClient{}
+
+	n1 := agent.NewNode(GenID(), Metadata{"Name": "n1"})
+	n2 := agent.NewNode(GenID(), Metadata{"Name": "n2"})
+	n3 := agent.NewNode(GenID(), Metadata{"Name": "n3"})
+	e1 := agent.NewEdge(GenID(), n1, n2, nil)
+	e2 := agent.NewEdge(GenID(), n1, n3, nil)
+
+	// the edges are parked, then deleted before their child shows up
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n1))
+	s.OnMessage(c, wsMessage(t, "EdgeAdded", e1))
+	s.OnMessage(c, wsMessage(t, "EdgeAdded", e2))
+	s.OnMessage(c, wsMessage(t, "EdgeDeleted", e1))
+	s.OnMessage(c, wsMessage(t, "NodeDeleted", n3))
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n2))
+	s.OnMessage(c, wsMessage(t, "NodeAdded", n3))
+
+	if analyzer.GetEdge(e1.ID) != nil || analyzer.GetEdge(e2.ID) != nil {
+		t.Error("Deleted edges shouldn't be added once their child is received")
+	}
+
+	if stats := s.deferredMetrics().(map[string]DeferredStats)["/0"]; stats.Pending != 0 {
+		t.Errorf("Deferred messages should have been purged: %+v", stats)
+	}
+
+	s.OnUnregisterClient(c)
+}
+
+// publishedMessage is a message of a stream sent by a user
+type publishedMessage struct {
+	user    string
+	msgType string
+	obj     interface{}
+}
+
+func applyStream(t *testing.T, s *GraphServer, stream []publishedMessage) {
+	for _, p := range stream {
+		msg, err := UnmarshalWSMessage(wsMessage(t, p.msgType, p.obj))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !s.apply(msg, p.user) {
+			t.Fatalf("Message %s of %s not applied", p.msgType, p.user)
+		}
+	}
+}
+
+func TestUpsertReplay(t *testing.T) {
+	publisher := newGraph(t)
+	n1 := publisher.NewNode(Identifier("n1"), Metadata{"Name": "eth0", "Type": "device"})
+	n2 := publisher.NewNode(Identifier("n2"), Metadata{"Name": "vm1", "Type": "vm", "CMDB.Owner": "alice", "IPAM.Subnet": "10.0.0.0/24"})
+	e := publisher.NewEdge(Identifier("e"), n2, n1, Metadata{"RelationType": "layer2", "CMDB.Link": "uplink"})
+
+	cmdb := &Node{graphElement: graphElement{ID: n1.ID, metadata: Metadata{"Name": "renamed", "CMDB.Owner": "bob"}}}
+	stream := []publishedMessage{
+		{"", "NodeAdded", n1},
+		{"cmdb", "NodeUpserted", n2},
+		{"cmdb", "NodeUpserted", cmdb},
+		{"cmdb", "EdgeUpserted", e},
+		{"cmdb", "NodeDeleted", n1},
+		{"", "NodeAdded", n1},
+	}
+
+	newServer := func() *GraphServer {
+		return &GraphServer{
+			Graph:   newGraph(t),
+			Origins: &OriginRules{Publishers: map[string][]string{"cmdb": {"CMDB"}, "ipam": {"IPAM"}}},
+		}
+	}
+
+	once := newServer()
+	applyStream(t, once, stream)
+
+	twice := newServer()
+	applyStream(t, twice, stream)
+	applyStream(t, twice, stream)
+
+	if len(once.Graph.GetNodes()) != 2 || len(twice.Graph.GetNodes()) != 2 || len(twice.Graph.GetEdges()) != 1 {
+		t.Fatalf("Replaying the stream shouldn't create duplicates: %v", twice.Graph.GetNodes())
+	}
+	for _, n := range once.Graph.GetNodes() {
+		if m := twice.Graph.GetNode(n.ID).Metadata(); !reflect.DeepEqual(m, n.Metadata()) {
+			t.Errorf("Node %s differs after a replay: %v != %v", n.ID, m, n.Metadata())
+		}
+	}
+	if m := twice.Graph.GetEdge(e.ID).Metadata(); !reflect.DeepEqual(m, once.Graph.GetEdge(e.ID).Metadata()) {
+		t.Errorf("Edge differs after a replay: %v", m)
+	}
+
+	// the agent keeps the core metadata, the publisher its origin
+	m := once.Graph.GetNode(n1.ID).Metadata()
+	if m["Name"] != "eth0" || m["CMDB.Owner"] != "bob" {
+		t.Errorf("Wrong merge of the agent and publisher metadata: %v", m)
+	}
+
+	// origins of other publishers are dropped on creation
+	if m := once.Graph.GetNode(n2.ID).Metadata(); m["Name"] != "vm1" || m["CMDB.Owner"] != "alice" || m["IPAM.Subnet"] != nil {
+		t.Errorf("Wrong metadata of a node created by a publisher: %v", m)
+	}
+}
+
+type deleteCounter struct {
+	graph   *Graph
+	deletes []string
+}
+
+func (d *deleteCounter) OnBusEvent(e *common.BusEvent) {
+	if ev := e.Obj.(*GraphEvent); ev.Graph == d.graph && (e.Type == "NodeDeleted" || e.Type == "EdgeDeleted") {
+		d.deletes = append(d.deletes, e.Type)
+	}
+}
+
+// newAgentGraph returns the graph of an agent process, the IDs of its
+// nodes being derived from the interfaces
+func newAgentGraph(t *testing.T, interfaces ...string) (*Graph, *Node) {
+	g := newGraph(t)
+	g.host = "agent1"
+
+	root := g.NewNode(Identifier("agent1"), Metadata{"Name": "agent1", "Type": "host"})
+	for i, name := range interfaces {
+		n := g.NewNode(g.NewIDFrom(string(root.ID), "IfIndex", fmt.Sprint(i+1)), Metadata{"Name": name, "Type": "device"})
+		g.Link(root, n, Metadata{"RelationType": "ownership"})
+	}
+	return g, root
+}
+
+func sendAll(t *testing.T, s *GraphServer, c *shttp.WSClient, msgs []shttp.WSMessage) {
+	for _, msg := range msgs {
+		s.OnMessage(c, wsMessage(t, msg.Type, msg.Obj))
+	}
+}
+
+func TestAgentRestart(t *testing.T) {
+	analyzer := newGraph(t)
+	s := &GraphServer{
+		Graph:     analyzer,
+		deferred:  make(map[*shttp.WSClient]*deferredQueue),
+		hostSyncs: make(map[*shttp.WSClient]*hostSync),
+	}
+
+	counter := &deleteCounter{graph: analyzer}
+	subscription := common.DefaultBus.Subscribe("test", 1000, counter, common.GraphTopic)
+	defer common.DefaultBus.Unsubscribe(subscription)
+
+	agent, root := newAgentGraph(t, "eth0", "eth1", "eth2")
+	first := &shttp.WSClient{}
+	sendAll(t, s, first, (&Forwarder{Graph: agent}).syncMessages(root))
+
+	if len(analyzer.GetNodes()) != 4 || len(analyzer.GetEdges()) != 3 {
+		t.Fatalf("Wrong analyzer graph: %v", analyzer.GetNodes())
+	}
+
+	// drained then restarted, the new process syncs the same graph
+	agent.AddMetadata(root, "Draining", true)
+	sendAll(t, s, first, []shttp.WSMessage{{Namespace: Namespace, Type: "NodeUpdated", Obj: root}})
+	s.OnUnregisterClient(first)
+
+	agent, root = newAgentGraph(t, "eth0", "eth1", "eth2")
+	second := &shttp.WSClient{}
+	sendAll(t, s, second, (&Forwarder{Graph: agent}).syncMessages(root))
+
+	subscription.Flush()
+	if len(counter.deletes) != 0 {
+		t.Errorf("No delete expected when restarting, got %v", counter.deletes)
+	}
+	if len(analyzer.GetNodes()) != 4 || len(analyzer.GetEdges()) != 3 {
+		t.Errorf("Wrong analyzer graph after the restart: %v", analyzer.GetNodes())
+	}
+	if _, ok := analyzer.GetNode(root.ID).Metadata()["Draining"]; ok {
+		t.Error("Draining flag should have been removed by the new process")
+	}
+
+	// an interface gone while the agent was down is deleted
+	agent, root = newAgentGraph(t, "eth0", "eth1")
+	third := &shttp.WSClient{}
+	sendAll(t, s, third, (&Forwarder{Graph: agent}).syncMessages(root))
+
+	subscription.Flush()
+	if len(counter.deletes) != 2 || len(analyzer.GetNodes()) != 3 {
+		t.Errorf("Only the interface gone and its edge should be deleted, got %v", counter.deletes)
+	}
+}
+
+func hostNode(id Identifier, host string, m Metadata) *Node {
+	return &Node{graphElement: graphElement{ID: id, host: host, metadata: m}}
+}
+
+func TestUpdateKeepsPublisherMetadata(t *testing.T) {
+	agent := newGraph(t)
+	s := &GraphServer{
+		Graph:   newGraph(t),
+		Origins: &OriginRules{Publishers: map[string][]string{"cmdb": {"CMDB"}}},
+	}
+
+	n1 := agent.NewNode(Identifier("n1"), Metadata{"Name": "eth0", "MTU": 1500})
+	n2 := agent.NewNode(Identifier("n2"), Metadata{"Name": "eth1"})
+	e := agent.NewEdge(Identifier("e"), n1, n2, Metadata{"RelationType": "layer2"})
+	applyStream(t, s, []publishedMessage{
+		{"", "NodeAdded", n1},
+		{"", "NodeAdded", n2},
+		{"", "EdgeAdded", e},
+		{"cmdb", "NodeUpserted", &Node{graphElement: graphElement{ID: n1.ID, metadata: Metadata{"CMDB.Owner": "alice"}}}},
+		{"cmdb", "EdgeUpserted", &Edge{graphElement: graphElement{ID: e.ID, metadata: Metadata{"CMDB.Link": "uplink"}}, parent: n1.ID, child: n2.ID}},
+	})
+
+	agent.SetMetadata(n1, Metadata{"Name": "eth0", "MTU": 9000})
+	agent.SetMetadata(e, Metadata{"RelationType": "layer2", "State": "UP"})
+	applyStream(t, s, []publishedMessage{
+		{"", "NodeUpdated", n1},
+		{"", "EdgeUpdated", e},
+	})
+
+	if m := s.Graph.GetNode(n1.ID).metadata; m["MTU"] != float64(9000) || m["CMDB.Owner"] != "alice" {
+		t.Errorf("Agent update should keep the metadata of the publisher: %v", m)
+	}
+	if m := s.Graph.GetEdge(e.ID).metadata; m["State"] != "UP" || m["CMDB.Link"] != "uplink" {
+		t.Errorf("Agent update should keep the metadata of the publisher: %v", m)
+	}
+}
+
+func TestHostIdentities(t *testing.T) {
+	analyzer := newGraph(t)
+	s := &GraphServer{
+		Graph:           analyzer,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+		Origins:         &OriginRules{Publishers: map[string][]string{"cmdb": {"CMDB"}}},
+	}
+	c := &shttp.WSClient{}
+
+	// the nodes of an agent of a former version, keyed by its hostname
+	legacy := hostNode(Identifier("vm1"), "vm1", Metadata{"Name": "vm1", "Type": "host", "CMDB.Owner": "alice"})
+	legacyIntf := hostNode(GenID(), "vm1", Metadata{"Name": "eth0", "Type": "device", "CMDB.Rack": "r1", "MTU": 1500})
+	s.OnMessage(c, wsMessage(t, "NodeAdded", legacy))
+	s.OnMessage(c, wsMessage(t, "NodeAdded", legacyIntf))
+
+	// the same agent once upgraded, and a clone of it
+	root := hostNode(Identifier("3f2a9c41-0000"), "3f2a9c41-0000", Metadata{"Name": "vm1", "Type": "host"})
+	intf := hostNode(GenID(), "3f2a9c41-0000", Metadata{"Name": "eth0", "Type": "device", "MTU": 9000})
+	clone := hostNode(Identifier("77b01e5d-0000"), "77b01e5d-0000", Metadata{"Name": "vm1", "Type": "host"})
+	for _, n := range []*Node{root, intf, clone} {
+		s.OnMessage(c, wsMessage(t, "NodeAdded", n))
+	}
+
+	for id, display := range map[Identifier]string{"vm1": "vm1 (vm1)", root.ID: "vm1 (3f2a9c41)", clone.ID: "vm1 (77b01e5d)"} {
+		if n := analyzer.GetNode(id); n.metadata["DisplayName"] != display {
+			t.Errorf("Wrong display name of %s: %v", id, n.metadata)
+		}
+	}
+
+	s.migrateHost(string(root.ID), "vm1")
+
+	if analyzer.GetNode(legacy.ID) != nil || analyzer.GetNode(legacyIntf.ID) != nil {
+		t.Error("Nodes of the hostname should be deleted")
+	}
+	if m := analyzer.GetNode(root.ID).metadata; m["CMDB.Owner"] != "alice" {
+		t.Errorf("Annotations of the host should be migrated: %v", m)
+	}
+	if m := analyzer.GetNode(intf.ID).metadata; m["CMDB.Rack"] != "r1" || m["MTU"] != float64(9000) {
+		t.Errorf("Only the annotations of the interface should be migrated: %v", m)
+	}
+
+	// the clone renamed, the name isn't ambiguous anymore
+	renamed := hostNode(clone.ID, string(clone.ID), Metadata{"Name": "vm2", "Type": "host"})
+	s.OnMessage(c, wsMessage(t, "NodeUpdated", renamed))
+
+	for _, id := range []Identifier{root.ID, clone.ID} {
+		if m := analyzer.GetNode(id).metadata; m["DisplayName"] != nil {
+			t.Errorf("Display name of %s should be removed: %v", id, m)
+		}
+	}
+}
+
+func TestOversizedMetadata(t *testing.T) {
+	limits := func() *MetadataLimits {
+		return &MetadataLimits{MaxValueSize: 64, MaxSize: 512, Truncate: true}
+	}
+
+	agent := newGraph(t)
+	agent.SetMetadataLimits(limits())
+
+	// a probe dumping the rules of a bridge
+	rules := strings.Repeat("table=0,priority=1,actions=NORMAL\n", 100)
+	n := agent.NewNode(GenID(), Metadata{"Name": "br-int", "Type": "ovsbridge", "FlowRules": rules, "Ports": []string{rules}})
+
+	if !reflect.DeepEqual(n.Metadata()[TruncatedKey], []string{"FlowRules", "Ports"}) {
+		t.Errorf("Expected the truncated keys to be marked: %v", n.Metadata())
+	}
+	if _, ok := n.Metadata()["Ports"]; ok || valueSize(n.Metadata()["FlowRules"]) > 64 {
+		t.Errorf("Expected the rules to be truncated and the ports dropped: %v", n.Metadata())
+	}
+
+	analyzer := newGraph(t)
+	analyzer.SetMetadataLimits(limits())
+	s := &GraphServer{
+		Graph:   analyzer,
+		Origins: &OriginRules{Publishers: map[string][]string{"cmdb": {"CMDB"}}},
+	}
+	applyStream(t, s, []publishedMessage{{"", "NodeAdded", n}})
+
+	node := analyzer.GetNode(n.ID)
+	if node == nil || node.Metadata()["Name"] != "br-int" || node.Metadata()["FlowRules"] != n.Metadata()["FlowRules"] {
+		t.Fatalf("Expected the analyzer to get the truncated node: %v", node)
+	}
+	if !reflect.DeepEqual(truncatedKeys(node.Metadata()), []string{"FlowRules", "Ports"}) {
+		t.Errorf("Expected the analyzer to get the marker: %v", node.Metadata())
+	}
+
+	// the rules fitting again are no longer marked
+	agent.AddMetadata(n, "FlowRules", "actions=NORMAL")
+	if !reflect.DeepEqual(n.Metadata()[TruncatedKey], []string{"Ports"}) {
+		t.Errorf("Expected only the ports to be marked: %v", n.Metadata())
+	}
+	agent.AddMetadata(n, "Ports", []string{"eth0"})
+	if _, ok := n.Metadata()[TruncatedKey]; ok {
+		t.Errorf("Expected the marker to be removed: %v", n.Metadata())
+	}
+
+	// the oversized writes of the publishers are rejected
+	applyStream(t, s, []publishedMessage{{"cmdb", "NodeUpserted", &Node{graphElement: graphElement{ID: n.ID, metadata: Metadata{"CMDB.Notes": rules}}}}})
+	if _, ok := node.Metadata()["CMDB.Notes"]; ok {
+		t.Errorf("Expected the annotation to be rejected: %v", node.Metadata())
+	}
+
+	m := analyzer.Metrics().(GraphMetrics).MetadataLimits
+	if m == nil || m.MaxValueSize != 64 || m.Rejected != 1 {
+		t.Errorf("Wrong metadata limits metrics: %+v", m)
+	}
+	if m := agent.Metrics().(GraphMetrics).MetadataLimits; m.Truncated != 1 || m.Dropped != 1 {
+		t.Errorf("Wrong metadata limits metrics: %+v", m)
+	}
+
+	// the oversized values are left out of the syncs asking for it
+	sync := s.syncReply("", wsMessage(t, "SyncRequest", map[string]interface{}{"MaxValueSize": 32}))[0].Obj.(*filteredGraph)
+	if _, ok := sync.Nodes[0].metadata["FlowRules"]; ok || sync.Nodes[0].metadata["Name"] != "br-int" {
+		t.Errorf("Expected the oversized rules to be left out: %v", sync.Nodes[0].metadata)
+	}
+}
+
+// blockingAuthorizer doesn't restrict the users, it blocks the WebSocket
+// server filtering the broadcasts while locked.
+type blockingAuthorizer struct {
+	sync.Mutex
+}
+
+func (a *blockingAuthorizer) Restricted(user string) bool {
+	a.Lock()
+	a.Unlock()
+	return false
+}
+
+func (a *blockingAuthorizer) CanReadNode(user string, n *Node) bool {
+	return true
+}
+
+func TestEventsDropped(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("graph.bus.queue_size", 10)
+	defer cfg.Set("graph.bus.queue_size", 10000)
+
+	g := newGraph(t)
+	httpServer := shttp.NewServer("test", "127.0.0.1", 0, shttp.NewNoAuthenticationBackend())
+	wsServer := shttp.NewWSServer(httpServer, 5*time.Second, "/ws")
+	authorizer := &blockingAuthorizer{}
+
+	s := NewServer(g, wsServer)
+	s.Authorizer = authorizer
+	go wsServer.ListenAndServe()
+	defer wsServer.Stop()
+	defer s.Stop()
+
+	ts := httptest.NewServer(httpServer.Router)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	var nodes []*Node
+	g.Lock()
+	for i := 0; i != 10; i++ {
+		nodes = append(nodes, g.NewNode(GenID(), Metadata{"Name": fmt.Sprintf("eth%d", i)}))
+	}
+	g.Unlock()
+
+	// the graph of the client, updated from the messages received
+	received := make(map[Identifier]bool)
+	sync := func() {
+		conn.WriteMessage(websocket.TextMessage, []byte(shttp.WSMessage{Namespace: Namespace, Type: "SyncRequest", Obj: map[string]interface{}{}}.String()))
+	}
+	converged := func() bool {
+		g.RLock()
+		defer g.RUnlock()
+
+		if len(received) != len(g.GetNodes()) {
+			return false
+		}
+		for _, n := range g.GetNodes() {
+			if !received[n.ID] {
+				return false
+			}
+		}
+		return true
+	}
+	messages := make(chan []byte, 1000)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- data
+		}
+	}()
+
+	// read applies the messages until the graph of the client is the one
+	// of the server, without message received for a while
+	read := func() bool {
+		deadline := time.After(10 * time.Second)
+		for {
+			var data []byte
+			select {
+			case data = <-messages:
+			case <-time.After(200 * time.Millisecond):
+				if converged() {
+					return true
+				}
+				continue
+			case <-deadline:
+				return false
+			}
+
+			msg, err := shttp.UnmarshalWSMessage(data)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			obj, _ := msg.Obj.(map[string]interface{})
+
+			switch msg.Type {
+			case "SyncReply":
+				received = make(map[Identifier]bool)
+				list, _ := obj["Nodes"].([]interface{})
+				for _, n := range list {
+					received[Identifier(n.(map[string]interface{})["ID"].(string))] = true
+				}
+			case "NodeAdded":
+				received[Identifier(obj["ID"].(string))] = true
+			case "NodeDeleted":
+				delete(received, Identifier(obj["ID"].(string)))
+			case "ResyncRequired":
+				sync()
+			}
+		}
+	}
+
+	sync()
+	if !read() {
+		t.Fatalf("Client not synced: %v", received)
+	}
+
+	// the server blocked, the events overflow the queue of its subscription
+	authorizer.Lock()
+	g.Lock()
+	for i := 0; i != 1000; i++ {
+		nodes = append(nodes, g.NewNode(GenID(), Metadata{"Name": fmt.Sprintf("veth%d", i)}))
+	}
+	for _, n := range nodes[:500] {
+		g.DelNode(n)
+	}
+	g.Unlock()
+	authorizer.Unlock()
+
+	if !read() {
+		t.Errorf("Client should have converged after the dropped events: %d nodes received, %d expected", len(received), len(g.GetNodes()))
+	}
+
+	if dropped := s.subscription.Stats().Dropped; dropped == 0 {
+		t.Error("Events should have been dropped")
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"sync/atomic"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// GraphLimitReachedKey flags the root node of a graph refusing new nodes or
+// edges, alerts can select it, ie. G.V().Has('GraphLimitReached', true)
+const GraphLimitReachedKey = "GraphLimitReached"
+
+// NodePriority orders the nodes refused once the size limits are
+// approached, the lowest priority first.
+type NodePriority int
+
+// Priorities of the nodes, the derived or heuristic nodes being the first
+// refused, the structure of the host the last.
+const (
+	LowPriority NodePriority = iota
+	NormalPriority
+	HighPriority
+)
+
+// ratios of the maximum number of nodes above which the nodes of a
+// priority are refused, the headroom being kept for the higher priorities
+var priorityRatios = map[NodePriority]float64{
+	LowPriority:    0.8,
+	NormalPriority: 0.95,
+	HighPriority:   1,
+}
+
+// SizeLimits bounds the number of nodes and edges created by a graph,
+// tombstones included. Once a limit is approached the new nodes are
+// refused by priority, the lowest first, the new edges being refused at
+// the maximum. Deletions always proceed, the root node being flagged with
+// GraphLimitReached until the graph is back under the limits of the lowest
+// priority. A zero maximum means no limit.
+type SizeLimits struct {
+	// refusals counters, first for the 64 bits alignment
+	refusedNodes int64
+	refusedEdges int64
+	MaxNodes     int
+	MaxEdges     int
+	// Priority returns the priority of a node from its metadata, all the
+	// nodes having the normal priority if nil
+	Priority func(m Metadata) NodePriority
+	// Root is the node flagged when the limits are reached
+	Root    Identifier
+	nodes   int
+	edges   int
+	reached bool
+}
+
+// SizeLimitsMetrics are the limits along with the number of nodes and edges
+// and of the ones refused.
+type SizeLimitsMetrics struct {
+	MaxNodes     int
+	MaxEdges     int
+	Nodes        int
+	Edges        int
+	RefusedNodes int64
+	RefusedEdges int64
+	Reached      bool
+}
+
+// GraphLimitEvent is published on the agent topic of the bus when the size
+// limits of the graph of a host are reached, as GraphLimitReached, or when
+// the graph gets back under them, as GraphLimitCleared.
+type GraphLimitEvent struct {
+	Host     string
+	Nodes    int
+	Edges    int
+	MaxNodes int
+	MaxEdges int
+}
+
+func (l *SizeLimits) priority(m Metadata) NodePriority {
+	if l.Priority == nil {
+		return NormalPriority
+	}
+	return l.Priority(m)
+}
+
+func (l *SizeLimits) threshold(max int, p NodePriority) int {
+	return int(float64(max) * priorityRatios[p])
+}
+
+func (l *SizeLimits) allowNode(m Metadata) bool {
+	return l == nil || l.MaxNodes <= 0 || l.nodes < l.threshold(l.MaxNodes, l.priority(m))
+}
+
+func (l *SizeLimits) allowEdge() bool {
+	return l == nil || l.MaxEdges <= 0 || l.edges < l.MaxEdges
+}
+
+// cleared returns whether the graph is back under the limits of the lowest
+// priority, so that the flag doesn't flap at the limit.
+func (l *SizeLimits) cleared() bool {
+	return (l.MaxNodes <= 0 || l.nodes < l.threshold(l.MaxNodes, LowPriority)) &&
+		(l.MaxEdges <= 0 || l.edges < l.threshold(l.MaxEdges, LowPriority))
+}
+
+func (l *SizeLimits) countNodes(delta int) {
+	if l != nil {
+		l.nodes += delta
+	}
+}
+
+func (l *SizeLimits) countEdges(delta int) {
+	if l != nil {
+		l.edges += delta
+	}
+}
+
+// Metrics returns the limits, the counts and the refusals, nil without
+// limits.
+func (l *SizeLimits) Metrics() *SizeLimitsMetrics {
+	if l == nil {
+		return nil
+	}
+
+	return &SizeLimitsMetrics{
+		MaxNodes:     l.MaxNodes,
+		MaxEdges:     l.MaxEdges,
+		Nodes:        l.nodes,
+		Edges:        l.edges,
+		RefusedNodes: atomic.LoadInt64(&l.refusedNodes),
+		RefusedEdges: atomic.LoadInt64(&l.refusedEdges),
+		Reached:      l.reached,
+	}
+}
+
+// SetSizeLimits sets the size limits of the graph, the nodes and the edges
+// already there being counted. It expects the graph lock held.
+func (g *Graph) SetSizeLimits(l *SizeLimits) {
+	if l != nil {
+		l.nodes, l.edges = len(g.backend.GetNodes()), len(g.backend.GetEdges())
+	}
+	g.sizes = l
+}
+
+// SizeLimitsMetrics returns the size limits of the graph along with its
+// counts, nil without limits. It takes the graph lock.
+func (g *Graph) SizeLimitsMetrics() *SizeLimitsMetrics {
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.sizes.Metrics()
+}
+
+// refuseNode returns whether a new node has to be refused, the limits
+// being flagged as reached.
+func (g *Graph) refuseNode(i Identifier, m Metadata) bool {
+	if g.sizes.allowNode(m) {
+		return false
+	}
+
+	atomic.AddInt64(&g.sizes.refusedNodes, 1)
+	logging.GetLogger().Debugf("Node %s refused, %d nodes for a maximum of %d", i, g.sizes.nodes, g.sizes.MaxNodes)
+	g.setLimitReached(true)
+	return true
+}
+
+// refuseEdge returns whether a new edge has to be refused, the limits
+// being flagged as reached.
+func (g *Graph) refuseEdge(i Identifier) bool {
+	if g.sizes.allowEdge() {
+		return false
+	}
+
+	atomic.AddInt64(&g.sizes.refusedEdges, 1)
+	logging.GetLogger().Debugf("Edge %s refused, %d edges for a maximum of %d", i, g.sizes.edges, g.sizes.MaxEdges)
+	g.setLimitReached(true)
+	return true
+}
+
+// checkLimitCleared clears the limits reached once the graph is back
+// under them, called after the deletions.
+func (g *Graph) checkLimitCleared() {
+	if g.sizes != nil && g.sizes.reached && g.sizes.cleared() {
+		g.setLimitReached(false)
+	}
+}
+
+func (g *Graph) setLimitReached(reached bool) {
+	l := g.sizes
+	if l.reached == reached {
+		return
+	}
+	l.reached = reached
+
+	event := &GraphLimitEvent{Host: g.host, Nodes: l.nodes, Edges: l.edges, MaxNodes: l.MaxNodes, MaxEdges: l.MaxEdges}
+	if reached {
+		logging.GetLogger().Errorf("Graph limits reached, %d/%d nodes, %d/%d edges, new nodes and edges refused", l.nodes, l.MaxNodes, l.edges, l.MaxEdges)
+	} else {
+		logging.GetLogger().Infof("Graph back under its limits, %d/%d nodes, %d/%d edges", l.nodes, l.MaxNodes, l.edges, l.MaxEdges)
+	}
+
+	if root := g.backend.GetNode(l.Root); root != nil {
+		m := make(Metadata, len(root.metadata)+1)
+		for k, v := range root.metadata {
+			if k != GraphLimitReachedKey {
+				m[k] = v
+			}
+		}
+		if reached {
+			m[GraphLimitReachedKey] = true
+		}
+		g.SetMetadata(root, m)
+	}
+
+	eventType := "GraphLimitCleared"
+	if reached {
+		eventType = "GraphLimitReached"
+	}
+	common.DefaultBus.Publish(common.AgentTopic, eventType, event)
+}
+
+// NewSizeLimitsFromConfig returns the size limits of the agent graph, nil
+// without limit.
+func NewSizeLimitsFromConfig() *SizeLimits {
+	cfg := config.GetConfig()
+
+	l := &SizeLimits{
+		MaxNodes: cfg.GetInt("agent.topology.limits.max_nodes"),
+		MaxEdges: cfg.GetInt("agent.topology.limits.max_edges"),
+	}
+	if l.MaxNodes <= 0 && l.MaxEdges <= 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+)
+
+// StatisticsPoint is a sample of the statistics of a node, values being
+// keyed by their dotted path, ie. Statistics.RxBytes. Downsampled points
+// average the Samples raw ones of their period, starting at Timestamp.
+type StatisticsPoint struct {
+	Timestamp int64
+	Samples   int
+	Values    map[string]float64
+}
+
+type statisticsBucket struct {
+	start  int64
+	sums   map[string]float64
+	counts map[string]int
+	count  int
+}
+
+func (b *statisticsBucket) add(p StatisticsPoint) {
+	for k, v := range p.Values {
+		b.sums[k] += v
+		b.counts[k]++
+	}
+	b.count++
+}
+
+func (b *statisticsBucket) point() StatisticsPoint {
+	p := StatisticsPoint{Timestamp: b.start, Samples: b.count, Values: make(map[string]float64)}
+	for k, sum := range b.sums {
+		p.Values[k] = sum / float64(b.counts[k])
+	}
+	return p
+}
+
+type statisticsSeries struct {
+	raw     []StatisticsPoint
+	buckets []*statisticsBucket
+	// other metadata of the node, to tell the statistics only updates
+	digest string
+}
+
+// StatisticsStore keeps the statistics metadata of the nodes, ie. the
+// interface counters, as time series rather than as node revisions. Samples
+// are kept raw for RawRetention then averaged per Downsampling period, the
+// averages being kept for Retention.
+type StatisticsStore struct {
+	sync.RWMutex
+	Keys         []string
+	RawRetention time.Duration
+	Downsampling time.Duration
+	Retention    time.Duration
+	Clock        common.Clock
+	series       map[Identifier]*statisticsSeries
+}
+
+func msTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// split returns the numeric statistics of the metadata and a digest of the
+// other keys
+func (s *StatisticsStore) split(m Metadata) (map[string]float64, string) {
+	others := make(Metadata)
+	stats := make(Metadata)
+	for k, v := range m {
+		others[k] = v
+	}
+	for _, k := range s.Keys {
+		if v, ok := m[k]; ok {
+			stats[k] = v
+			delete(others, k)
+		}
+	}
+
+	values := make(map[string]float64)
+	for k, v := range flattenMetadata(stats) {
+		if f, ok := v.(float64); ok {
+			values[k] = f
+		}
+	}
+
+	// keys of maps are sorted by the JSON encoding
+	digest, _ := json.Marshal(others)
+
+	return values, string(digest)
+}
+
+func (s *StatisticsStore) expire(series *statisticsSeries, now time.Time) {
+	rawLimit := msTime(now.Add(-s.RawRetention))
+	period := int64(s.Downsampling / time.Millisecond)
+
+	i := 0
+	for ; i < len(series.raw) && series.raw[i].Timestamp < rawLimit; i++ {
+		p := series.raw[i]
+		if period <= 0 {
+			continue
+		}
+
+		start := p.Timestamp - p.Timestamp%period
+		if n := len(series.buckets); n == 0 || series.buckets[n-1].start != start {
+			series.buckets = append(series.buckets, &statisticsBucket{
+				start:  start,
+				sums:   make(map[string]float64),
+				counts: make(map[string]int),
+			})
+		}
+		series.buckets[len(series.buckets)-1].add(p)
+	}
+	series.raw = series.raw[i:]
+
+	limit := msTime(now.Add(-s.Retention))
+	j := 0
+	for j < len(series.buckets) && series.buckets[j].start+period <= limit {
+		j++
+	}
+	series.buckets = series.buckets[j:]
+}
+
+// Update records the statistics of the node and returns whether they are
+// the only metadata changed since the previous update.
+func (s *StatisticsStore) Update(n *Node) bool {
+	values, digest := s.split(n.Metadata())
+
+	s.Lock()
+	defer s.Unlock()
+
+	series, ok := s.series[n.ID]
+	if !ok {
+		series = &statisticsSeries{}
+		s.series[n.ID] = series
+	}
+	statsOnly := ok && series.digest == digest
+	series.digest = digest
+
+	// other metadata updates don't give a new sample
+	now := s.Clock.Now()
+	if n := len(series.raw); len(values) > 0 && (n == 0 || !reflect.DeepEqual(series.raw[n-1].Values, values)) {
+		series.raw = append(series.raw, StatisticsPoint{Timestamp: msTime(now), Samples: 1, Values: values})
+	}
+	s.expire(series, now)
+
+	return statsOnly
+}
+
+// Forget drops the statistics of a deleted node
+func (s *StatisticsStore) Forget(id Identifier) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.series, id)
+}
+
+// Series returns the points of the node within the window, the downsampled
+// ones followed by the raw ones. False is returned for an unknown node.
+func (s *StatisticsStore) Series(id Identifier, window time.Duration) ([]StatisticsPoint, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	series, ok := s.series[id]
+	if !ok {
+		return nil, false
+	}
+
+	now := s.Clock.Now()
+	s.expire(series, now)
+
+	from := msTime(now.Add(-window))
+	points := []StatisticsPoint{}
+	for _, b := range series.buckets {
+		if b.start >= from {
+			points = append(points, b.point())
+		}
+	}
+	for _, p := range series.raw {
+		if p.Timestamp >= from {
+			points = append(points, p)
+		}
+	}
+
+	return points, true
+}
+
+func NewStatisticsStore(keys []string, rawRetention, downsampling, retention time.Duration) *StatisticsStore {
+	return &StatisticsStore{
+		Keys:         keys,
+		RawRetention: rawRetention,
+		Downsampling: downsampling,
+		Retention:    retention,
+		Clock:        common.RealClock{},
+		series:       make(map[Identifier]*statisticsSeries),
+	}
+}
+
+// NewStatisticsStoreFromConfig returns nil if no statistics key is set
+func NewStatisticsStoreFromConfig(g *Graph) *StatisticsStore {
+	cfg := config.GetConfig()
+
+	keys := cfg.GetStringSlice("graph.statistics.keys")
+	if len(keys) == 0 {
+		return nil
+	}
+
+	s := NewStatisticsStore(keys,
+		time.Duration(cfg.GetInt("graph.statistics.raw_retention"))*time.Second,
+		time.Duration(cfg.GetInt("graph.statistics.downsampling"))*time.Second,
+		time.Duration(cfg.GetInt("graph.statistics.retention"))*time.Second)
+	s.Clock = g
+
+	return s
+}
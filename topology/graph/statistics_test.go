@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+func TestStatisticsStore(t *testing.T) {
+	g := newGraph(t)
+
+	// start on a downsampling period
+	clock := common.NewFakeClock(time.Unix(1468400000, 0).Truncate(5 * time.Minute))
+
+	s := NewStatisticsStore([]string{"Statistics"}, 10*time.Minute, 5*time.Minute, time.Hour)
+	s.Clock = clock
+
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0", "Statistics": map[string]interface{}{"RxBytes": int64(0)}})
+	if s.Update(n) {
+		t.Error("First update isn't a statistics only one")
+	}
+
+	for i := 1; i <= 20; i++ {
+		clock.Advance(time.Minute)
+		g.AddMetadata(n, "Statistics", map[string]interface{}{"RxBytes": int64(i)})
+		if !s.Update(n) {
+			t.Errorf("Statistics only update expected: %v", n.Metadata())
+		}
+	}
+
+	g.AddMetadata(n, "MTU", int64(9000))
+	if s.Update(n) {
+		t.Error("MTU change isn't a statistics only update")
+	}
+
+	// samples older than 10 minutes averaged per 5 minutes
+	points, ok := s.Series(n.ID, time.Hour)
+	if !ok || len(points) != 2+11 {
+		t.Fatalf("Wrong number of points: %+v", points)
+	}
+
+	if points[0].Samples != 5 || points[0].Values["Statistics.RxBytes"] != 2 {
+		t.Errorf("Wrong first downsampled point: %+v", points[0])
+	}
+	if points[1].Samples != 5 || points[1].Values["Statistics.RxBytes"] != 7 {
+		t.Errorf("Wrong second downsampled point: %+v", points[1])
+	}
+	if last := points[len(points)-1]; last.Samples != 1 || last.Values["Statistics.RxBytes"] != 20 {
+		t.Errorf("Wrong last raw point: %+v", last)
+	}
+
+	if points, _ := s.Series(n.ID, 5*time.Minute); len(points) != 6 {
+		t.Errorf("Only the raw points of the window expected: %+v", points)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if points, ok := s.Series(n.ID, time.Hour); !ok || len(points) != 0 {
+		t.Errorf("Points should have expired: %+v", points)
+	}
+
+	s.Forget(n.ID)
+	if _, ok := s.Series(n.ID, time.Hour); ok {
+		t.Error("Forgotten node shouldn't have a series")
+	}
+}
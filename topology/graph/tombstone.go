@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+// Metadata set on the nodes kept as tombstones, so that clients can tell
+// them apart from the live ones.
+const (
+	TombstoneKey     = "Tombstone"
+	TombstoneTimeKey = "TombstoneTime"
+)
+
+type tombstone struct {
+	node   *Node
+	owners []Identifier
+}
+
+// tombstones keeps the deleted nodes during a grace period so that a node
+// coming back, ie. a flapping interface, gets its ID and metadata back. The
+// purges are scheduled on a wheel driven by the clock of the graph.
+type tombstones struct {
+	grace time.Duration
+	nodes map[Identifier]*tombstone
+	wheel *common.TimerWheel
+}
+
+type GraphMetrics struct {
+	Nodes          int
+	Edges          int
+	Tombstones     int
+	MetadataLimits *MetadataLimitsMetrics `json:",omitempty"`
+	SizeLimits     *SizeLimitsMetrics     `json:",omitempty"`
+}
+
+func IsTombstone(n *Node) bool {
+	t, ok := n.metadata[TombstoneKey].(bool)
+	return ok && t
+}
+
+// SetTombstoneGracePeriod enables the tombstones, TombstoneNode then only
+// removes the edges of the node and flags it for the given period. A zero
+// period disables the tombstones. It has to be called before using the
+// graph, after SetClock.
+func (g *Graph) SetTombstoneGracePeriod(grace time.Duration) {
+	if g.tombstones != nil {
+		g.tombstones.wheel.Stop()
+		g.tombstones = nil
+	}
+	if grace <= 0 {
+		return
+	}
+
+	g.tombstones = &tombstones{
+		grace: grace,
+		nodes: make(map[Identifier]*tombstone),
+		wheel: common.NewTimerWheel(time.Second, 60, g),
+	}
+	g.tombstones.wheel.Start()
+}
+
+// TombstoneNode keeps the node as a tombstone for the grace period, the
+// node being deleted if the tombstones are disabled. Deleting a node with
+// DelNode, tombstone or not, deletes it right away.
+func (g *Graph) TombstoneNode(n *Node) {
+	if g.tombstones == nil {
+		g.DelNode(n)
+		return
+	}
+
+	// tombstoning a tombstone purges it
+	if _, ok := g.tombstones.nodes[n.ID]; ok {
+		g.DelNode(n)
+		return
+	}
+
+	g.tombstone(n)
+}
+
+func (g *Graph) tombstone(n *Node) {
+	var owners []Identifier
+	for _, e := range g.backend.GetNodeEdges(n) {
+		parent, child := g.backend.GetEdgeNodes(e)
+		if parent != nil && child != nil && child.ID == n.ID && e.metadata["RelationType"] == "ownership" {
+			owners = append(owners, parent.ID)
+		}
+		g.DelEdge(e)
+	}
+
+	m := make(Metadata, len(n.metadata)+2)
+	for k, v := range n.metadata {
+		m[k] = v
+	}
+	m[TombstoneKey] = true
+	m[TombstoneTimeKey] = g.Now().Unix()
+
+	if !g.backend.SetMetadata(n, m) {
+		return
+	}
+
+	ts := &tombstone{node: n, owners: owners}
+	tombstones := g.tombstones
+	tombstones.wheel.Schedule(string(n.ID), g.Now().Add(tombstones.grace), func() {
+		g.Lock()
+		defer g.Unlock()
+
+		if g.tombstones == tombstones && tombstones.nodes[n.ID] == ts {
+			g.DelNode(n)
+		}
+	})
+	tombstones.nodes[n.ID] = ts
+
+	g.NotifyNodeUpdated(n)
+}
+
+// forgetTombstone drops the tombstone of the node, if any, and its purge
+func (g *Graph) forgetTombstone(id Identifier) bool {
+	if g.tombstones == nil {
+		return false
+	}
+	if _, ok := g.tombstones.nodes[id]; !ok {
+		return false
+	}
+
+	g.tombstones.wheel.Cancel(string(id))
+	delete(g.tombstones.nodes, id)
+	return true
+}
+
+// withoutTombstones filters out the tombstones of the nodes
+func (g *Graph) withoutTombstones(nodes []*Node) []*Node {
+	if g.tombstones == nil || len(g.tombstones.nodes) == 0 {
+		return nodes
+	}
+
+	live := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if _, ok := g.tombstones.nodes[n.ID]; !ok {
+			live = append(live, n)
+		}
+	}
+	return live
+}
+
+// LookupTombstone returns a node deleted during the grace period which was
+// owned by the given node and matches the given metadata.
+func (g *Graph) LookupTombstone(owner *Node, m Metadata) *Node {
+	if g.tombstones == nil {
+		return nil
+	}
+
+	for _, ts := range g.tombstones.nodes {
+		for _, id := range ts.owners {
+			if id == owner.ID && ts.node.matchMetadata(m) {
+				return ts.node
+			}
+		}
+	}
+
+	return nil
+}
+
+// Resurrect brings a tombstone back to life, the given metadata are merged
+// into the previous ones so that user annotations are kept.
+func (g *Graph) Resurrect(n *Node, m Metadata) {
+	if g.tombstones == nil {
+		return
+	}
+
+	if !g.forgetTombstone(n.ID) {
+		return
+	}
+
+	merged := make(Metadata, len(n.metadata)+len(m))
+	for k, v := range n.metadata {
+		merged[k] = v
+	}
+	delete(merged, TombstoneKey)
+	delete(merged, TombstoneTimeKey)
+	for k, v := range m {
+		merged[k] = v
+	}
+
+	g.SetMetadata(n, merged)
+}
+
+// Metrics returns the number of nodes and edges, tombstones excluded from
+// the nodes, the metadata limits with their violations and the size limits
+// with their refusals.
+func (g *Graph) Metrics() interface{} {
+	g.RLock()
+	defer g.RUnlock()
+
+	m := GraphMetrics{Edges: len(g.backend.GetEdges()), MetadataLimits: g.limits.Metrics(), SizeLimits: g.sizes.Metrics()}
+	for _, n := range g.backend.GetNodes() {
+		if IsTombstone(n) {
+			m.Tombstones++
+		} else {
+			m.Nodes++
+		}
+	}
+
+	return m
+}
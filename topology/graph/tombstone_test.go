@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+func TestTombstoneResurrect(t *testing.T) {
+	g := newGraph(t)
+	g.SetTombstoneGracePeriod(time.Minute)
+
+	root := g.NewNode(GenID(), Metadata{"Name": "host"})
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0", "IfIndex": 2, "Comment": "uplink"})
+	g.Link(root, n, Metadata{"RelationType": "ownership"})
+
+	g.TombstoneNode(n)
+
+	if g.GetNode(n.ID) == nil || !IsTombstone(n) {
+		t.Fatal("Node should have been kept as a tombstone")
+	}
+	if _, ok := n.Metadata()[TombstoneTimeKey]; !ok {
+		t.Errorf("Tombstone time expected: %v", n.Metadata())
+	}
+	if g.AreLinked(root, n) || len(g.GetEdges()) != 0 {
+		t.Error("Edges of a tombstone should have been removed")
+	}
+	if g.LookupFirstNode(Metadata{"Name": "eth0"}) != nil {
+		t.Error("Tombstones shouldn't be returned by lookups")
+	}
+	if nodes := g.GetNodes(); len(nodes) != 1 || nodes[0].ID != root.ID {
+		t.Errorf("Tombstones shouldn't be returned with the nodes: %v", nodes)
+	}
+
+	m := g.Metrics().(GraphMetrics)
+	if m.Nodes != 1 || m.Tombstones != 1 {
+		t.Errorf("Tombstones should be excluded from the node count: %+v", m)
+	}
+
+	if g.LookupTombstone(n, Metadata{"Name": "eth0"}) != nil {
+		t.Error("Tombstone shouldn't be found under another owner")
+	}
+
+	ts := g.LookupTombstone(root, Metadata{"Name": "eth0"})
+	if ts == nil || ts.ID != n.ID {
+		t.Fatalf("Tombstone not found: %v", ts)
+	}
+
+	g.Resurrect(ts, Metadata{"Name": "eth0", "IfIndex": 3})
+	if IsTombstone(n) || n.Metadata()["IfIndex"] != 3 || n.Metadata()["Comment"] != "uplink" {
+		t.Errorf("Node should have been resurrected with its annotations: %v", n.Metadata())
+	}
+	if _, ok := n.Metadata()[TombstoneTimeKey]; ok {
+		t.Errorf("Tombstone time should have been removed: %v", n.Metadata())
+	}
+}
+
+func TestTombstonePurge(t *testing.T) {
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+
+	g := newGraph(t)
+	g.SetClock(clock)
+	g.SetTombstoneGracePeriod(time.Minute)
+	defer g.Close()
+
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0"})
+
+	g.Lock()
+	g.TombstoneNode(n)
+	g.Unlock()
+
+	advance := func(d time.Duration) *Node {
+		clock.Advance(d)
+		g.tombstones.wheel.Advance(clock.Now())
+
+		g.RLock()
+		defer g.RUnlock()
+		return g.GetNode(n.ID)
+	}
+
+	if advance(59*time.Second) == nil {
+		t.Fatal("Tombstone shouldn't be purged before the end of the grace period")
+	}
+	if advance(time.Second) != nil {
+		t.Error("Tombstone should have been purged after the grace period")
+	}
+	if g.tombstones.wheel.Pending() != 0 {
+		t.Errorf("No purge should be pending, got %d", g.tombstones.wheel.Pending())
+	}
+}
+
+func TestDelNodeWithTombstones(t *testing.T) {
+	g := newGraph(t)
+	g.SetTombstoneGracePeriod(time.Minute)
+	defer g.Close()
+
+	n := g.NewNode(GenID(), Metadata{"Name": "eth0"})
+	g.DelNode(n)
+
+	if g.GetNode(n.ID) != nil {
+		t.Error("DelNode should delete the node even with the tombstones enabled")
+	}
+
+	n = g.NewNode(GenID(), Metadata{"Name": "eth1"})
+	g.TombstoneNode(n)
+	g.DelNode(n)
+
+	if g.GetNode(n.ID) != nil || g.tombstones.wheel.Pending() != 0 {
+		t.Error("Deleting a tombstone should purge it")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+)
+
+// mutationTrace is the trace of a sampled mutation being notified
+type mutationTrace struct {
+	trace *common.Trace
+	start time.Time
+	event string
+	id    Identifier
+}
+
+// applyTrace is the trace of a message being applied, the backend writes
+// being children of its span
+type applyTrace struct {
+	trace *common.Trace
+	span  *common.Span
+}
+
+// SetTracer sets the tracer sampling the mutations notified to the
+// listeners and timing the backend writes of the traced messages applied
+func (g *Graph) SetTracer(t *common.Tracer) {
+	g.tracer = t
+}
+
+// Tracer returns the tracer of the graph, nil if not traced
+func (g *Graph) Tracer() *common.Tracer {
+	return g.tracer
+}
+
+// traceMutation samples the mutation about to be notified, returning the
+// mutation previously traced to be restored once notified, the listeners
+// possibly mutating the graph themselves
+func (g *Graph) traceMutation(event string, id Identifier) *mutationTrace {
+	prev := g.mutation
+	if g.tracer == nil {
+		return prev
+	}
+
+	if t := g.tracer.Sample(); t != nil {
+		g.mutation = &mutationTrace{trace: t, start: g.tracer.Now(), event: event, id: id}
+	} else {
+		g.mutation = nil
+	}
+	return prev
+}
+
+// CurrentTrace returns the trace of the mutation being notified, with the
+// time spent notifying it so far, nil if the mutation is not sampled. The
+// listeners forwarding the mutation attach it to their messages.
+func (g *Graph) CurrentTrace() *common.Trace {
+	m := g.mutation
+	if m == nil {
+		return nil
+	}
+
+	t := m.trace.Copy()
+	span := g.tracer.AddSpan(t, "notify", m.start, g.tracer.Now())
+	span.SetTag("event", m.event)
+	span.SetTag("id", string(m.id))
+	return t
+}
+
+// StartApply makes the backend writes, until EndApply, spans of the given
+// trace, children of span
+func (g *Graph) StartApply(t *common.Trace, span *common.Span) {
+	if g.tracer != nil {
+		g.applying = &applyTrace{trace: t, span: span}
+	}
+}
+
+// EndApply stops tracing the backend writes
+func (g *Graph) EndApply() {
+	g.applying = nil
+}
+
+// traceStart returns the start of a backend write, zero if not traced
+func (g *Graph) traceStart() time.Time {
+	if g.applying == nil {
+		return time.Time{}
+	}
+	return g.tracer.Now()
+}
+
+// traceBackend adds the span of a backend write started at start to the
+// trace of the message being applied
+func (g *Graph) traceBackend(op string, start time.Time) {
+	if g.applying != nil {
+		g.tracer.AddChildSpan(g.applying.trace, g.applying.span, "backend."+op, start, g.tracer.Now())
+	}
+}
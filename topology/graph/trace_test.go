@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+// tracedForwarder captures the messages the forwarder would send
+type tracedForwarder struct {
+	DefaultGraphListener
+	t    *testing.T
+	g    *Graph
+	msgs []shttp.WSMessage
+}
+
+func (f *tracedForwarder) OnNodeAdded(n *Node) {
+	data, err := json.Marshal(shttp.WSMessage{Namespace: Namespace, Type: "NodeAdded", Obj: n, Tracing: f.g.CurrentTrace()})
+	if err != nil {
+		f.t.Fatal(err.Error())
+	}
+
+	var msg shttp.WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		f.t.Fatal(err.Error())
+	}
+	f.msgs = append(f.msgs, msg)
+}
+
+func TestMutationTrace(t *testing.T) {
+	agent := newGraph(t)
+	forwarder := &tracedForwarder{t: t, g: agent}
+	agent.AddEventListener(forwarder)
+
+	// not sampled
+	agent.NewNode(GenID(), Metadata{"Name": "n1"})
+	if forwarder.msgs[0].Tracing != nil {
+		t.Fatal("Mutations shouldn't be traced without tracer")
+	}
+
+	agent.SetTracer(common.NewTracer("agent", "host1", 1))
+	n2 := agent.NewNode(GenID(), Metadata{"Name": "n2"})
+
+	msg := forwarder.msgs[1]
+	if msg.Tracing == nil || len(msg.Tracing.Spans) != 1 {
+		t.Fatalf("Mutation should be traced: %+v", msg.Tracing)
+	}
+	if notify := msg.Tracing.Spans[0]; notify.Name != "notify" || notify.Service != "agent" || notify.Host != "host1" || notify.Tags["id"] != string(n2.ID) {
+		t.Errorf("Wrong notify span: %+v", notify)
+	}
+
+	analyzer := newGraph(t)
+	analyzer.SetTracer(common.NewTracer("analyzer", "analyzer1", 0))
+	s := &GraphServer{
+		Graph:           analyzer,
+		deferred:        make(map[*shttp.WSClient]*deferredQueue),
+		deferredMax:     10,
+		deferredTimeout: time.Minute,
+		Traces:          common.NewTraceRecorder(10, false),
+	}
+	c := &shttp.WSClient{}
+
+	s.OnMessage(c, forwarder.msgs[0])
+	s.OnMessage(c, msg)
+
+	traces := s.Traces.Traces()
+	if len(traces) != 1 || traces[0].ID != msg.Tracing.ID {
+		t.Fatalf("Trace of the mutation should be recorded: %+v", traces)
+	}
+
+	var names []string
+	spans := make(map[string]*common.Span)
+	for _, span := range traces[0].Spans {
+		names = append(names, span.Name)
+		spans[span.Name] = span
+	}
+
+	expected := []string{"notify", "transport", "lock_wait", "apply", "backend.AddNode"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected the spans %v, got %v", expected, names)
+	}
+	for i, name := range expected {
+		if names[i] != name {
+			t.Fatalf("Expected the spans %v, got %v", expected, names)
+		}
+	}
+
+	// each hop is the child of the previous one, the backend writes being
+	// children of the apply
+	if spans["transport"].ParentID != spans["notify"].SpanID || spans["apply"].ParentID != spans["lock_wait"].SpanID {
+		t.Errorf("Wrong parents of the hops: %v", traces[0].Spans)
+	}
+	if backend := spans["backend.AddNode"]; backend.ParentID != spans["apply"].SpanID || backend.Service != "analyzer" || backend.End < backend.Start {
+		t.Errorf("Wrong backend span: %+v", backend)
+	}
+	if apply := spans["apply"]; apply.End < spans["backend.AddNode"].End || apply.Tags["type"] != "NodeAdded" {
+		t.Errorf("Wrong apply span: %+v", apply)
+	}
+
+	if s.Traces.Get(msg.Tracing.ID) == nil {
+		t.Error("Trace should be found by its ID")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// NodeWaiter receives on C the nodes matching its filter, the ones already
+// matching first then the ones starting to match. C is closed if the waiter
+// doesn't keep up.
+type NodeWaiter struct {
+	C      chan *Node
+	filter *watchedFilter
+}
+
+type watchedFilter struct {
+	key      string
+	filter   Metadata
+	matching map[Identifier]bool
+	waiters  map[*NodeWaiter]bool
+}
+
+// NodeWatcher notifies the waiters of the nodes matching metadata filters.
+// The waiters of the same filter share it, a filter being evaluated once
+// per node event, the nodes already matching being looked up when its
+// first waiter registers.
+type NodeWatcher struct {
+	sync.Mutex
+	DefaultGraphListener
+	Graph   *Graph
+	filters map[string]*watchedFilter
+}
+
+// filterKey returns the same key for the equal filters
+func filterKey(filter Metadata) string {
+	keys := make([]string, 0, len(filter))
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%#v", k, filter[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// notify sends the node to a waiter, the waiter being dropped if its
+// channel is full
+func (w *NodeWatcher) notify(waiter *NodeWaiter, n *Node) {
+	select {
+	case waiter.C <- n:
+	default:
+		logging.GetLogger().Warningf("Node waiter of %s too slow, dropped", waiter.filter.key)
+		w.drop(waiter)
+	}
+}
+
+func (w *NodeWatcher) drop(waiter *NodeWaiter) {
+	f := waiter.filter
+	if !f.waiters[waiter] {
+		return
+	}
+
+	delete(f.waiters, waiter)
+	close(waiter.C)
+
+	if len(f.waiters) == 0 {
+		delete(w.filters, f.key)
+	}
+}
+
+// Watch registers a waiter of the nodes matching the filter, size being
+// the number of nodes it may have pending
+func (w *NodeWatcher) Watch(filter Metadata, size int) *NodeWaiter {
+	w.Graph.RLock()
+	defer w.Graph.RUnlock()
+
+	w.Lock()
+	defer w.Unlock()
+
+	key := filterKey(filter)
+	f, ok := w.filters[key]
+	if !ok {
+		f = &watchedFilter{
+			key:      key,
+			filter:   filter,
+			matching: make(map[Identifier]bool),
+			waiters:  make(map[*NodeWaiter]bool),
+		}
+		for _, n := range w.Graph.LookupNodes(filter) {
+			f.matching[n.ID] = true
+		}
+		w.filters[key] = f
+	}
+
+	waiter := &NodeWaiter{C: make(chan *Node, size), filter: f}
+	f.waiters[waiter] = true
+
+	for id := range f.matching {
+		if n := w.Graph.GetNode(id); n != nil && f.waiters[waiter] {
+			w.notify(waiter, copyNode(n))
+		}
+	}
+
+	return waiter
+}
+
+// Unwatch unregisters a waiter, its channel being closed
+func (w *NodeWatcher) Unwatch(waiter *NodeWaiter) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.drop(waiter)
+}
+
+func (w *NodeWatcher) onNodeChanged(n *Node) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, f := range w.filters {
+		if IsTombstone(n) || !n.matchMetadata(f.filter) {
+			delete(f.matching, n.ID)
+			continue
+		}
+		if f.matching[n.ID] {
+			continue
+		}
+		f.matching[n.ID] = true
+
+		c := copyNode(n)
+		for waiter := range f.waiters {
+			w.notify(waiter, c)
+		}
+	}
+}
+
+func (w *NodeWatcher) OnNodeAdded(n *Node) {
+	w.onNodeChanged(n)
+}
+
+func (w *NodeWatcher) OnNodeUpdated(n *Node) {
+	w.onNodeChanged(n)
+}
+
+func (w *NodeWatcher) OnNodeDeleted(n *Node) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, f := range w.filters {
+		delete(f.matching, n.ID)
+	}
+}
+
+func (w *NodeWatcher) Start() {
+	w.Graph.AddEventListener(w)
+}
+
+func (w *NodeWatcher) Stop() {
+	w.Graph.RemoveEventListener(w)
+}
+
+func NewNodeWatcher(g *Graph) *NodeWatcher {
+	return &NodeWatcher{
+		Graph:   g,
+		filters: make(map[string]*watchedFilter),
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+func nextNode(t *testing.T, waiter *NodeWaiter) *Node {
+	select {
+	case n := <-waiter.C:
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("No node received")
+	}
+	return nil
+}
+
+func TestNodeWatcher(t *testing.T) {
+	g := newGraph(t)
+	w := NewNodeWatcher(g)
+	w.Start()
+	defer w.Stop()
+
+	g.Lock()
+	g.NewNode(Identifier("n1"), Metadata{"Name": "eth0", "Type": "veth"})
+	g.Unlock()
+
+	// the node already matching is sent first
+	w1 := w.Watch(Metadata{"Type": "veth", "Name": "eth0"}, 10)
+	if n := nextNode(t, w1); n.ID != "n1" {
+		t.Errorf("Expected n1, got %s", n.ID)
+	}
+
+	// the waiters of the same filter share it
+	w2 := w.Watch(Metadata{"Name": "eth0", "Type": "veth"}, 10)
+	nextNode(t, w2)
+	if len(w.filters) != 1 {
+		t.Errorf("Expected a single filter, got %d", len(w.filters))
+	}
+
+	g.Lock()
+	n2 := g.NewNode(Identifier("n2"), Metadata{"Name": "eth1", "Type": "veth"})
+	g.AddMetadata(n2, "Name", "eth0")
+	// still matching, not sent again
+	g.AddMetadata(n2, "MTU", 1500)
+	g.Unlock()
+
+	for _, waiter := range []*NodeWaiter{w1, w2} {
+		if n := nextNode(t, waiter); n.ID != "n2" {
+			t.Errorf("Expected n2, got %s", n.ID)
+		}
+		if len(waiter.C) != 0 {
+			t.Errorf("Unexpected pending nodes: %d", len(waiter.C))
+		}
+	}
+
+	w.Unwatch(w1)
+	w.Unwatch(w2)
+	if len(w.filters) != 0 {
+		t.Errorf("The filter should be dropped without waiter, got %d", len(w.filters))
+	}
+	if _, ok := <-w1.C; ok {
+		t.Error("The channel of an unregistered waiter should be closed")
+	}
+}
+
+func TestNodeWatcherSlowWaiter(t *testing.T) {
+	g := newGraph(t)
+	w := NewNodeWatcher(g)
+	w.Start()
+	defer w.Stop()
+
+	waiter := w.Watch(Metadata{"Type": "veth"}, 1)
+
+	g.Lock()
+	g.NewNode(GenID(), Metadata{"Type": "veth"})
+	g.NewNode(GenID(), Metadata{"Type": "veth"})
+	g.Unlock()
+
+	<-waiter.C
+	if _, ok := <-waiter.C; ok {
+		t.Error("A waiter not keeping up should be dropped")
+	}
+	if len(w.filters) != 0 {
+		t.Errorf("Expected no filter left, got %d", len(w.filters))
+	}
+}
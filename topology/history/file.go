@@ -0,0 +1,868 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const (
+	segmentExt = ".log"
+	indexExt   = ".idx"
+	baseName   = "base.json"
+	// length and CRC32 of the record
+	recordHeaderSize = 8
+	// records bigger than this are taken as garbage
+	maxRecordSize = 64 * 1024 * 1024
+	// time and offset of the record
+	indexEntrySize = 16
+	// bytes of records between two entries of the index
+	indexInterval = 4096
+)
+
+var errCorruptRecord = errors.New("Corrupt history record")
+
+// SyncPolicy tells when the appended changes are flushed to the disk
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes on every append
+	SyncAlways SyncPolicy = iota
+	// SyncInterval flushes the changes appended every interval
+	SyncInterval
+	// SyncNever leaves the flushes to the system
+	SyncNever
+)
+
+var syncPolicies = map[string]SyncPolicy{
+	"always":   SyncAlways,
+	"interval": SyncInterval,
+	"never":    SyncNever,
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	if policy, ok := syncPolicies[strings.ToLower(s)]; ok {
+		return policy, nil
+	}
+	return SyncAlways, fmt.Errorf("Unknown fsync policy: %s", s)
+}
+
+// FileStorageOptions are the options of a file storage, a MaxAge or a
+// MaxSize of 0 disabling the pruning by age or by size.
+type FileStorageOptions struct {
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	MaxAge       time.Duration
+	MaxSize      int64
+}
+
+type indexEntry struct {
+	time   int64
+	offset int64
+}
+
+// segment is a file of records, the index giving the offset of a record
+// every indexInterval bytes along with its time
+type segment struct {
+	seq   uint64
+	first int64
+	last  int64
+	size  int64
+	index []indexEntry
+}
+
+// base is the state folded from the pruned segments, up to and including
+// the segment Seq
+type base struct {
+	Time     time.Time
+	Seq      uint64
+	Snapshot *graph.Snapshot
+}
+
+// FileStorage stores the history in append-only segment files in a
+// directory. A record is the length and the CRC32 of the change as JSON
+// followed by the JSON, the records in the order of their times. Every
+// segment has an index file giving the offset of a record every few KB
+// along with its time, so that the changes of a time range are read from
+// the closest record. The segment being written is rotated once its size
+// reached SegmentSize. The pruned segments are folded into a base snapshot,
+// replaced atomically, the states from its time on being still known.
+//
+// A crash may leave a partial record at the end of the last segment, the
+// segment is truncated after its last valid record when opened and its
+// index is rebuilt.
+type FileStorage struct {
+	sync.Mutex
+	path     string
+	opts     FileStorageOptions
+	base     *base
+	segments []*segment
+	file     *os.File
+	index    *os.File
+	last     int64
+	dirty    bool
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+func (s *FileStorage) segmentPath(seg *segment, ext string) string {
+	return filepath.Join(s.path, fmt.Sprintf("%016d%s", seg.seq, ext))
+}
+
+// active returns the segment being written
+func (s *FileStorage) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+func encodeRecord(buf *bytes.Buffer, c *Change) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+	buf.Write(header[:])
+	buf.Write(data)
+
+	return nil
+}
+
+// readRecord reads the record at the current position, io.EOF being
+// returned at the end of the records and errCorruptRecord for a partial or
+// an invalid record.
+func readRecord(r *bufio.Reader) (*Change, int64, error) {
+	var header [recordHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorruptRecord
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, 0, errCorruptRecord
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	var c Change
+	if err := json.Unmarshal(data, &c); err != nil || c.Element == nil {
+		return nil, 0, errCorruptRecord
+	}
+
+	return &c, int64(recordHeaderSize + size), nil
+}
+
+// scan reads the records of a segment from the offset until fn returns
+// false, fn being given the offset of the record and the one of the next
+// record. The offset after the last record read is returned.
+func (s *FileStorage) scan(seg *segment, offset int64, fn func(c *Change, offset int64, next int64) bool) (int64, error) {
+	f, err := os.Open(s.segmentPath(seg, segmentExt))
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		c, size, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		if !fn(c, offset, offset+size) {
+			return offset, nil
+		}
+		offset += size
+	}
+}
+
+// seek returns the offset of a record older than the time from which the
+// records of the segment are to be read
+func (seg *segment) seek(t int64) int64 {
+	i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].time >= t })
+	if i == 0 {
+		return 0
+	}
+	return seg.index[i-1].offset
+}
+
+// add adds a record to the segment, to its index if far enough from the
+// last record indexed
+func (seg *segment) add(t int64, offset int64, next int64) {
+	if len(seg.index) == 0 || offset-seg.index[len(seg.index)-1].offset >= indexInterval {
+		seg.index = append(seg.index, indexEntry{time: t, offset: offset})
+	}
+	if offset == 0 {
+		seg.first = t
+	}
+	seg.last, seg.size = t, next
+}
+
+func encodeIndex(entries []indexEntry) []byte {
+	data := make([]byte, 0, len(entries)*indexEntrySize)
+	for _, e := range entries {
+		var entry [indexEntrySize]byte
+		binary.BigEndian.PutUint64(entry[0:8], uint64(e.time))
+		binary.BigEndian.PutUint64(entry[8:16], uint64(e.offset))
+		data = append(data, entry[:]...)
+	}
+	return data
+}
+
+// loadIndex reads the index of a segment, false if the index is missing or
+// doesn't match the segment of the given size
+func (s *FileStorage) loadIndex(seg *segment, size int64) bool {
+	data, err := ioutil.ReadFile(s.segmentPath(seg, indexExt))
+	if err != nil || len(data) == 0 || len(data)%indexEntrySize != 0 {
+		return false
+	}
+
+	var index []indexEntry
+	for i := 0; i < len(data); i += indexEntrySize {
+		e := indexEntry{
+			time:   int64(binary.BigEndian.Uint64(data[i : i+8])),
+			offset: int64(binary.BigEndian.Uint64(data[i+8 : i+16])),
+		}
+		if e.offset >= size || (len(index) == 0 && e.offset != 0) {
+			return false
+		}
+		if len(index) > 0 && (e.offset <= index[len(index)-1].offset || e.time < index[len(index)-1].time) {
+			return false
+		}
+		index = append(index, e)
+	}
+
+	seg.index = index
+	return true
+}
+
+// load reads the index of a segment, rebuilding it if needed, and the time
+// of its last record, the records after the last one indexed being read.
+// The segment is truncated after its last valid record, if any, the
+// records being written in the last segment only, and its index rewritten.
+func (s *FileStorage) load(seg *segment, active bool) error {
+	path := s.segmentPath(seg, segmentExt)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	var offset int64
+	if !active && s.loadIndex(seg, size) {
+		last := seg.index[len(seg.index)-1]
+		seg.first, seg.last, offset = seg.index[0].time, last.time, last.offset
+	} else {
+		seg.index = nil
+	}
+	seg.size = offset
+
+	end, err := s.scan(seg, offset, func(c *Change, offset int64, next int64) bool {
+		seg.add(c.Time.UnixNano(), offset, next)
+		return true
+	})
+	if err != nil && err != errCorruptRecord {
+		return err
+	}
+
+	if end < size {
+		logging.GetLogger().Warningf("Truncating %s after its last valid record, at %d bytes instead of %d", path, end, size)
+		if err := os.Truncate(path, end); err != nil {
+			return err
+		}
+		// the index is rebuilt from the records left
+		return s.load(seg, true)
+	}
+
+	if !active && offset > 0 {
+		return nil
+	}
+
+	return ioutil.WriteFile(s.segmentPath(seg, indexExt), encodeIndex(seg.index), 0644)
+}
+
+// open opens the segment being written for appending
+func (s *FileStorage) open() (err error) {
+	seg := s.active()
+	if s.file, err = os.OpenFile(s.segmentPath(seg, segmentExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	if s.index, err = os.OpenFile(s.segmentPath(seg, indexExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		s.file.Close()
+		return err
+	}
+	return nil
+}
+
+// closeFiles flushes and closes the segment being written
+func (s *FileStorage) closeFiles() error {
+	err := s.file.Sync()
+	if e := s.index.Sync(); err == nil {
+		err = e
+	}
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	if e := s.index.Close(); err == nil {
+		err = e
+	}
+	s.dirty = false
+	return err
+}
+
+// rotate closes the segment being written and starts a new one
+func (s *FileStorage) rotate() error {
+	if err := s.closeFiles(); err != nil {
+		return err
+	}
+
+	s.segments = append(s.segments, &segment{seq: s.active().seq + 1})
+	return s.open()
+}
+
+// Append writes the changes at the end of the segment being written, the
+// index being updated, the segment rotated once big enough and the oldest
+// segments pruned.
+func (s *FileStorage) Append(changes []*Change) error {
+	s.Lock()
+	defer s.Unlock()
+
+	seg := s.active()
+	size, entries := seg.size, len(seg.index)
+
+	var buf bytes.Buffer
+	for _, c := range changes {
+		t := c.Time.UnixNano()
+		if t < s.last {
+			t = s.last
+		}
+		record := *c
+		record.Time = time.Unix(0, t).UTC()
+
+		offset := size + int64(buf.Len())
+		if err := encodeRecord(&buf, &record); err != nil {
+			return err
+		}
+		seg.add(t, offset, size+int64(buf.Len()))
+		s.last = t
+	}
+
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		// the partial write is dropped, the index was not written yet
+		s.file.Truncate(size)
+		seg.size, seg.index = size, seg.index[:entries]
+		return err
+	}
+	if _, err := s.index.Write(encodeIndex(seg.index[entries:])); err != nil {
+		return err
+	}
+
+	switch s.opts.Sync {
+	case SyncAlways:
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	case SyncInterval:
+		s.dirty = true
+	}
+
+	if s.opts.SegmentSize > 0 && seg.size >= s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		return s.retain()
+	}
+
+	return nil
+}
+
+// Changes returns the changes between from and to, the pruned ones being
+// left out, the records being read from the closest one indexed.
+func (s *FileStorage) Changes(from time.Time, to time.Time) ([]*Change, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, t := from.UnixNano(), to.UnixNano()
+
+	changes := []*Change{}
+	for _, seg := range s.segments {
+		if seg.size == 0 || seg.last < f || seg.first > t {
+			continue
+		}
+
+		_, err := s.scan(seg, seg.seek(f), func(c *Change, offset int64, next int64) bool {
+			if offset >= seg.size {
+				return false
+			}
+			if ct := c.Time.UnixNano(); ct > t {
+				return false
+			} else if ct >= f {
+				changes = append(changes, c)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// StateAt returns the nodes and the edges at the given time, the changes
+// up to this time being applied to the base snapshot, ErrPruned being
+// returned for a time before the one of the base snapshot.
+func (s *FileStorage) StateAt(at time.Time) (*graph.Snapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	state := NewState(nil)
+	if s.base != nil {
+		if at.Before(s.base.Time) {
+			return nil, ErrPruned
+		}
+		state = NewState(s.base.Snapshot)
+	}
+
+	t := at.UnixNano()
+	for _, seg := range s.segments {
+		if seg.size == 0 || seg.first > t {
+			break
+		}
+
+		if err := s.apply(state, seg, t); err != nil {
+			return nil, err
+		}
+	}
+
+	return state.Snapshot(), nil
+}
+
+// apply applies to the state the changes of the segment up to the time
+func (s *FileStorage) apply(state *State, seg *segment, t int64) error {
+	_, err := s.scan(seg, 0, func(c *Change, offset int64, next int64) bool {
+		if offset >= seg.size || c.Time.UnixNano() > t {
+			return false
+		}
+		state.Apply(c)
+		return true
+	})
+	return err
+}
+
+// fold folds the first segments into the base snapshot, replaced
+// atomically before the segments are removed, a crash in between leaving
+// segments already folded removed when opened.
+func (s *FileStorage) fold(count int) error {
+	if count <= 0 {
+		return nil
+	}
+
+	state, folded := NewState(nil), &base{}
+	if s.base != nil {
+		state, folded.Time = NewState(s.base.Snapshot), s.base.Time
+	}
+
+	for _, seg := range s.segments[:count] {
+		if err := s.apply(state, seg, seg.last); err != nil {
+			return err
+		}
+		if seg.size > 0 {
+			folded.Time = time.Unix(0, seg.last).UTC()
+		}
+		folded.Seq = seg.seq
+	}
+	folded.Snapshot = state.Snapshot()
+
+	if err := s.writeBase(folded); err != nil {
+		return err
+	}
+	s.base = folded
+
+	for _, seg := range s.segments[:count] {
+		s.remove(seg)
+	}
+	s.segments = append([]*segment{}, s.segments[count:]...)
+
+	return nil
+}
+
+func (s *FileStorage) remove(seg *segment) {
+	for _, ext := range []string{segmentExt, indexExt} {
+		if err := os.Remove(s.segmentPath(seg, ext)); err != nil && !os.IsNotExist(err) {
+			logging.GetLogger().Errorf("Unable to remove history segment: %s", err.Error())
+		}
+	}
+}
+
+func (s *FileStorage) writeBase(b *base) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.path, baseName+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.path, baseName))
+}
+
+// Prune drops the segments whose changes are all before the given time,
+// the segment being written being kept.
+func (s *FileStorage) Prune(before time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.prune(before.UnixNano())
+}
+
+func (s *FileStorage) prune(before int64) error {
+	count := 0
+	for count < len(s.segments)-1 && s.segments[count].last < before {
+		count++
+	}
+	return s.fold(count)
+}
+
+// retain prunes the segments older than MaxAge and the oldest ones as long
+// as the segments are bigger than MaxSize
+func (s *FileStorage) retain() error {
+	if s.opts.MaxAge > 0 {
+		if err := s.prune(time.Now().Add(-s.opts.MaxAge).UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.MaxSize > 0 {
+		var size int64
+		for _, seg := range s.segments {
+			size += seg.size
+		}
+
+		count := 0
+		for ; count < len(s.segments)-1 && size > s.opts.MaxSize; count++ {
+			size -= s.segments[count].size
+		}
+		return s.fold(count)
+	}
+
+	return nil
+}
+
+func (s *FileStorage) syncLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Lock()
+			if s.dirty {
+				if err := s.file.Sync(); err != nil {
+					logging.GetLogger().Errorf("Unable to sync the history: %s", err.Error())
+				}
+				s.dirty = false
+			}
+			s.Unlock()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *FileStorage) Close() error {
+	if s.quit != nil {
+		close(s.quit)
+		s.wg.Wait()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.closeFiles()
+}
+
+// rewriteSegment rewrites the records of a segment through fn into a new
+// file replacing the segment atomically, its index being rebuilt. The
+// number of elements changed is returned, the segment being left as is if
+// none.
+func (s *FileStorage) rewriteSegment(seg *segment, fn func(e *graph.SnapshotElement) bool) (int, error) {
+	var buf bytes.Buffer
+	var changed int
+	var encodeErr error
+	_, err := s.scan(seg, 0, func(c *Change, offset int64, next int64) bool {
+		if fn(c.Element) {
+			changed++
+		}
+		encodeErr = encodeRecord(&buf, c)
+		return encodeErr == nil
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err != nil || changed == 0 {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(s.path, filepath.Base(s.segmentPath(seg, segmentExt))+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), s.segmentPath(seg, segmentExt)); err != nil {
+		return 0, err
+	}
+
+	// the sizes of the records changed, the index is rebuilt
+	seg.index = nil
+	return changed, s.load(seg, true)
+}
+
+// Rewrite rewrites the elements of the base snapshot and of the segments
+// through fn, each file being replaced atomically so that an interrupted
+// rewrite can be run again, the elements already rewritten being left as
+// they are by fn.
+func (s *FileStorage) Rewrite(fn func(e *graph.SnapshotElement) bool) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var changed int
+	if s.base != nil && s.base.Snapshot != nil {
+		var baseChanged int
+		for _, e := range append(append([]*graph.SnapshotElement{}, s.base.Snapshot.Nodes...), s.base.Snapshot.Edges...) {
+			if fn(e) {
+				baseChanged++
+			}
+		}
+		if baseChanged > 0 {
+			if err := s.writeBase(s.base); err != nil {
+				return changed, err
+			}
+			changed += baseChanged
+		}
+	}
+
+	// the segment being written is closed for the time of its rewrite
+	if err := s.closeFiles(); err != nil {
+		return changed, err
+	}
+
+	for _, seg := range s.segments {
+		n, err := s.rewriteSegment(seg, fn)
+		changed += n
+		if err != nil {
+			s.open()
+			return changed, err
+		}
+	}
+
+	return changed, s.open()
+}
+
+// readBase reads the base snapshot, if any
+func (s *FileStorage) readBase() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.path, baseName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var b base
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("Unable to read the history base snapshot: %s", err.Error())
+	}
+	s.base = &b
+
+	return nil
+}
+
+// readSegments lists the segments, the ones already folded into the base
+// snapshot being removed
+func (s *FileStorage) readSegments() error {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seg := &segment{seq: seq}
+		if s.base != nil && seq <= s.base.Seq {
+			s.remove(seg)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	for i, seg := range s.segments {
+		if err := s.load(seg, i == len(s.segments)-1); err != nil {
+			return err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		seg := &segment{seq: 1}
+		if s.base != nil {
+			seg.seq = s.base.Seq + 1
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	return nil
+}
+
+// NewFileStorage opens the history stored in the directory, created if
+// needed, recovering the segment being written at the time of a crash
+func NewFileStorage(path string, opts FileStorageOptions) (*FileStorage, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileStorage{path: path, opts: opts}
+	if err := s.readBase(); err != nil {
+		return nil, err
+	}
+	if err := s.readSegments(); err != nil {
+		return nil, err
+	}
+
+	if s.base != nil {
+		s.last = s.base.Time.UnixNano()
+	}
+	for _, seg := range s.segments {
+		if seg.size > 0 {
+			s.last = seg.last
+		}
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	if err := s.retain(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval && opts.SyncInterval > 0 {
+		s.quit = make(chan bool)
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+
+	return s, nil
+}
+
+func NewFileStorageFromConfig() (*FileStorage, error) {
+	cfg := config.GetConfig()
+
+	policy, err := ParseSyncPolicy(cfg.GetString("analyzer.history.file.fsync"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := FileStorageOptions{
+		SegmentSize:  int64(cfg.GetInt("analyzer.history.file.segment_size")) * 1024 * 1024,
+		Sync:         policy,
+		SyncInterval: time.Duration(cfg.GetInt("analyzer.history.file.fsync_interval")) * time.Second,
+		MaxAge:       time.Duration(cfg.GetInt("analyzer.history.file.max_age")) * time.Second,
+		MaxSize:      int64(cfg.GetInt("analyzer.history.file.max_size")) * 1024 * 1024,
+	}
+
+	return NewFileStorage(cfg.GetString("analyzer.history.file.path"), opts)
+}
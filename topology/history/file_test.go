@@ -0,0 +1,308 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func openFileStorage(dir string) (Storage, error) {
+	return NewFileStorage(dir, FileStorageOptions{SegmentSize: 1024, Sync: SyncInterval, SyncInterval: time.Second})
+}
+
+func TestFileStorage(t *testing.T) {
+	testStorageConformance(t, openFileStorage)
+}
+
+// withHistory runs the test on a file storage holding the test changes
+// appended one by one, closed before the test
+func withHistory(t *testing.T, opts FileStorageOptions, test func(dir string, s *FileStorage)) {
+	dir, err := ioutil.TempDir("", "skydive-history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(dir, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	changes, _ := testChanges()
+	for _, c := range changes {
+		if err := s.Append([]*Change{c}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	test(dir, s)
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No segment: %v", err)
+	}
+	return files[len(files)-1]
+}
+
+// checkRecovered reopens the storage, expecting the changes up to the given
+// one, and appends the next changes again
+func checkRecovered(t *testing.T, dir string, opts FileStorageOptions, last int) {
+	s, err := NewFileStorage(dir, opts)
+	if err != nil {
+		t.Fatalf("Recovery failed: %s", err.Error())
+	}
+
+	changes, states := testChanges()
+	if got, err := s.Changes(t0, at(99)); err != nil || !sameChanges(got, changes[:last+1]) {
+		t.Fatalf("Expected the changes up to %d, got %d changes: %v", last, len(got), err)
+	}
+	checkState(t, s, last, states[last])
+
+	if err := s.Append(changes[last+1:]); err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Close()
+
+	// the records appended after the recovery are read again
+	if s, err = NewFileStorage(dir, opts); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+
+	if got, _ := s.Changes(t0, at(99)); !sameChanges(got, changes) {
+		t.Errorf("Expected all the changes once appended again, got %d", len(got))
+	}
+	checkState(t, s, 99, states[99])
+}
+
+func TestFileStorageTruncatedRecord(t *testing.T) {
+	opts := FileStorageOptions{Sync: SyncAlways}
+
+	// the last record cut in the middle of its JSON
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		path := lastSegment(t, dir)
+		fi, _ := os.Stat(path)
+		if err := os.Truncate(path, fi.Size()-5); err != nil {
+			t.Fatal(err.Error())
+		}
+		checkRecovered(t, dir, opts, 98)
+	})
+
+	// the header of a record partially written
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		f, _ := os.OpenFile(lastSegment(t, dir), os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write([]byte{0, 0, 1})
+		f.Close()
+		checkRecovered(t, dir, opts, 99)
+	})
+}
+
+func TestFileStorageCorruptRecord(t *testing.T) {
+	opts := FileStorageOptions{Sync: SyncAlways}
+
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		path := lastSegment(t, dir)
+		data, _ := ioutil.ReadFile(path)
+		data[len(data)-2] ^= 0xff
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		checkRecovered(t, dir, opts, 98)
+	})
+}
+
+func TestFileStorageIndex(t *testing.T) {
+	opts := FileStorageOptions{SegmentSize: 8192, Sync: SyncNever}
+
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		if len(s.segments) < 2 || len(s.segments[0].index) < 2 {
+			t.Fatalf("Expected several segments with several index entries: %d segments", len(s.segments))
+		}
+
+		// the index of a closed segment lost or cut is rebuilt
+		first := s.segmentPath(s.segments[0], indexExt)
+		if err := os.Truncate(first, indexEntrySize+3); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// the last segment cut before a record indexed
+		last := s.active()
+		if len(last.index) > 1 {
+			if err := os.Truncate(s.segmentPath(last, segmentExt), last.index[1].offset+3); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		reopened, err := NewFileStorage(dir, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer reopened.Close()
+
+		if len(reopened.segments[0].index) != len(s.segments[0].index) {
+			t.Errorf("Index not rebuilt: %d entries instead of %d", len(reopened.segments[0].index), len(s.segments[0].index))
+		}
+
+		changes, _ := testChanges()
+		got, err := reopened.Changes(at(30), at(40))
+		if err != nil || !sameChanges(got, changes[30:41]) {
+			t.Errorf("Wrong changes between 30 and 40: %d, %v", len(got), err)
+		}
+	})
+}
+
+// TestFileStorageInterruptedPrune crashes after the base snapshot was
+// written, the segments folded into it being still there
+func TestFileStorageInterruptedPrune(t *testing.T) {
+	opts := FileStorageOptions{SegmentSize: 1024, Sync: SyncAlways}
+
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		saved := make(map[string][]byte)
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, file := range files {
+			saved[file], _ = ioutil.ReadFile(file)
+		}
+
+		pruned, err := NewFileStorage(dir, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := pruned.Prune(at(50)); err != nil {
+			t.Fatal(err.Error())
+		}
+		pruned.Close()
+
+		for file, data := range saved {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				ioutil.WriteFile(file, data, 0644)
+			}
+		}
+
+		reopened, err := NewFileStorage(dir, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer reopened.Close()
+
+		_, states := testChanges()
+		for _, i := range []int{50, 70, 99} {
+			checkState(t, reopened, i, states[i])
+		}
+		if reopened.segments[0].seq <= reopened.base.Seq {
+			t.Errorf("Segments folded should be removed: %d, base %d", reopened.segments[0].seq, reopened.base.Seq)
+		}
+	})
+}
+
+func TestFileStorageRetention(t *testing.T) {
+	opts := FileStorageOptions{SegmentSize: 1024, Sync: SyncNever, MaxSize: 4096}
+
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		var size int64
+		for _, seg := range s.segments[:len(s.segments)-1] {
+			size += seg.size
+		}
+		if size > opts.MaxSize {
+			t.Errorf("Segments should be pruned to %d bytes, got %d", opts.MaxSize, size)
+		}
+
+		_, states := testChanges()
+		checkState(t, s, 99, states[99])
+	})
+}
+
+func TestFileStorageRewrite(t *testing.T) {
+	opts := FileStorageOptions{SegmentSize: 1024, Sync: SyncAlways}
+
+	withHistory(t, opts, func(dir string, s *FileStorage) {
+		rewritten, err := NewFileStorage(dir, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// the oldest segments are folded into the base snapshot
+		if err := rewritten.Prune(at(30)); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		rename := func(e *graph.SnapshotElement) bool {
+			if e.ID == "eth1" {
+				e.ID = "intf1"
+				return true
+			}
+			return false
+		}
+		changed, err := rewritten.Rewrite(rename)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if changed == 0 {
+			t.Fatal("Elements of eth1 should be rewritten")
+		}
+
+		// the storage is still appended to after a rewrite
+		c := nodeChange(100, NodeAdded, "eth100", graph.Metadata{"Name": "eth100", "Type": "device", "MTU": 1600})
+		if err := rewritten.Append([]*Change{c}); err != nil {
+			t.Fatal(err.Error())
+		}
+		rewritten.Close()
+
+		reopened, err := NewFileStorage(dir, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer reopened.Close()
+
+		if again, err := reopened.Rewrite(rename); err != nil || again != 0 {
+			t.Errorf("Rewrite run again shouldn't change anything: %d, %v", again, err)
+		}
+
+		_, states := testChanges()
+		for _, i := range []int{30, 61, 99} {
+			expected := make(map[string]int)
+			for id, mtu := range states[i] {
+				if id == "eth1" {
+					id = "intf1"
+				}
+				expected[id] = mtu
+			}
+			checkState(t, reopened, i, expected)
+		}
+
+		changes, err := reopened.Changes(at(100), at(100))
+		if err != nil || len(changes) != 1 || changes[0].Element.ID != "eth100" {
+			t.Errorf("Change appended after the rewrite not found: %v", err)
+		}
+	})
+}
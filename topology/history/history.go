@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package history
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ChangeType is the kind of change of a node or an edge
+type ChangeType string
+
+const (
+	NodeAdded   ChangeType = "NodeAdded"
+	NodeUpdated ChangeType = "NodeUpdated"
+	NodeDeleted ChangeType = "NodeDeleted"
+	EdgeAdded   ChangeType = "EdgeAdded"
+	EdgeUpdated ChangeType = "EdgeUpdated"
+	EdgeDeleted ChangeType = "EdgeDeleted"
+)
+
+// Change is a change of the topology, the element being the node or the
+// edge as it is after the change, or as it was before being deleted.
+type Change struct {
+	Time     time.Time
+	Revision uint64
+	Type     ChangeType
+	Element  *graph.SnapshotElement
+}
+
+// ErrPruned is returned for the state at a time the history was pruned of
+var ErrPruned = errors.New("History pruned, state unknown at this time")
+
+// Storage keeps the history of the topology as the sequence of its changes,
+// in the order of their times, so that the topology at a time in the past
+// can be given back. The changes are appended with increasing times, a
+// change older than the last one appended being stored at the time of the
+// last one.
+type Storage interface {
+	// Append stores the changes after the ones already stored
+	Append(changes []*Change) error
+	// StateAt returns the nodes and the edges at the given time
+	StateAt(t time.Time) (*graph.Snapshot, error)
+	// Changes returns the changes between from and to, both included
+	Changes(from time.Time, to time.Time) ([]*Change, error)
+	// Prune drops the changes before the given time, the states from this
+	// time on still being known
+	Prune(before time.Time) error
+	Close() error
+}
+
+// Rewriter is implemented by the storages whose changes can be rewritten
+// in place, ie. to migrate the identifiers of the elements. fn is given
+// every element stored, returning whether it changed it, the number of
+// elements changed being returned.
+type Rewriter interface {
+	Rewrite(fn func(e *graph.SnapshotElement) bool) (int, error)
+}
+
+// State is the topology built by applying changes, the state a storage
+// gives back.
+type State struct {
+	nodes map[graph.Identifier]*graph.SnapshotElement
+	edges map[graph.Identifier]*graph.SnapshotElement
+}
+
+// Apply applies a change to the state
+func (s *State) Apply(c *Change) {
+	switch c.Type {
+	case NodeAdded, NodeUpdated:
+		s.nodes[c.Element.ID] = c.Element
+	case NodeDeleted:
+		delete(s.nodes, c.Element.ID)
+	case EdgeAdded, EdgeUpdated:
+		s.edges[c.Element.ID] = c.Element
+	case EdgeDeleted:
+		delete(s.edges, c.Element.ID)
+	}
+}
+
+// Snapshot returns the nodes and the edges of the state sorted by ID, the
+// edges whose nodes are missing being left out as in the graph snapshots.
+func (s *State) Snapshot() *graph.Snapshot {
+	snapshot := &graph.Snapshot{}
+	for _, n := range s.nodes {
+		snapshot.Nodes = append(snapshot.Nodes, n)
+	}
+	for _, e := range s.edges {
+		if s.nodes[e.Parent] != nil && s.nodes[e.Child] != nil {
+			snapshot.Edges = append(snapshot.Edges, e)
+		}
+	}
+
+	sort.Slice(snapshot.Nodes, func(i, j int) bool { return snapshot.Nodes[i].ID < snapshot.Nodes[j].ID })
+	sort.Slice(snapshot.Edges, func(i, j int) bool { return snapshot.Edges[i].ID < snapshot.Edges[j].ID })
+
+	return snapshot
+}
+
+// NewState returns the state of a snapshot, empty if nil
+func NewState(snapshot *graph.Snapshot) *State {
+	s := &State{
+		nodes: make(map[graph.Identifier]*graph.SnapshotElement),
+		edges: make(map[graph.Identifier]*graph.SnapshotElement),
+	}
+	if snapshot != nil {
+		for _, n := range snapshot.Nodes {
+			s.nodes[n.ID] = n
+		}
+		for _, e := range snapshot.Edges {
+			s.edges[e.ID] = e
+		}
+	}
+	return s
+}
+
+// NewStorageFromConfig returns the storage selected by the configuration,
+// nil if the history is disabled.
+func NewStorageFromConfig() (Storage, error) {
+	cfg := config.GetConfig()
+
+	switch backend := cfg.GetString("analyzer.history.backend"); backend {
+	case "":
+		return nil, nil
+	case "file":
+		return NewFileStorageFromConfig()
+	default:
+		return nil, errors.New("Config file is misconfigured, history backend unknown: " + backend)
+	}
+}
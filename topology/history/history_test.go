@@ -0,0 +1,250 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+var t0 = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns the time of the i-th change of the tests
+func at(i int) time.Time {
+	return t0.Add(time.Duration(i) * time.Second)
+}
+
+func nodeChange(i int, t ChangeType, id string, m graph.Metadata) *Change {
+	return &Change{Time: at(i), Revision: uint64(i), Type: t, Element: &graph.SnapshotElement{ID: graph.Identifier(id), Metadata: m, Host: "host1"}}
+}
+
+func edgeChange(i int, t ChangeType, id string, parent string, child string) *Change {
+	return &Change{Time: at(i), Revision: uint64(i), Type: t, Element: &graph.SnapshotElement{ID: graph.Identifier(id), Parent: graph.Identifier(parent), Child: graph.Identifier(child), Host: "host1"}}
+}
+
+// testChanges are the changes of a host whose interfaces come and go, from
+// 0 to 99 seconds after t0, along with the MTU of the nodes at every time
+func testChanges() ([]*Change, []map[string]int) {
+	changes := []*Change{nodeChange(0, NodeAdded, "host", graph.Metadata{"Name": "host1", "Type": "host"})}
+	states := []map[string]int{{"host": 0}}
+
+	for i := 1; i < 100; i++ {
+		state := make(map[string]int)
+		for k, v := range states[i-1] {
+			state[k] = v
+		}
+
+		id := fmt.Sprintf("eth%d", i%10)
+		switch _, ok := state[id]; {
+		case !ok:
+			changes = append(changes, nodeChange(i, NodeAdded, id, graph.Metadata{"Name": id, "Type": "device", "MTU": 1500}))
+			state[id] = 1500
+		case i%3 == 0:
+			changes = append(changes, nodeChange(i, NodeDeleted, id, nil))
+			delete(state, id)
+		default:
+			changes = append(changes, nodeChange(i, NodeUpdated, id, graph.Metadata{"Name": id, "Type": "device", "MTU": 1500 + i}))
+			state[id] = 1500 + i
+		}
+		states = append(states, state)
+	}
+
+	return changes, states
+}
+
+// sameChanges compares the changes as stored, the numbers of the metadata
+// being decoded as float64
+func sameChanges(a []*Change, b []*Change) bool {
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	return string(da) == string(db)
+}
+
+func checkState(t *testing.T, s Storage, i int, expected map[string]int) {
+	snapshot, err := s.StateAt(at(i))
+	if err != nil {
+		t.Fatalf("State at %d: %s", i, err.Error())
+	}
+
+	nodes := make(map[string]int)
+	for _, n := range snapshot.Nodes {
+		mtu, _ := n.Metadata["MTU"].(float64)
+		nodes[string(n.ID)] = int(mtu)
+	}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("State at %d: wrong nodes %v, expected %v", i, nodes, expected)
+	}
+}
+
+// testStorageConformance checks the behavior expected from every storage,
+// open opening the storage kept in the directory, with segments small
+// enough for the changes of the tests to be pruned.
+func testStorageConformance(t *testing.T, open func(dir string) (Storage, error)) {
+	dir, err := ioutil.TempDir("", "skydive-history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := open(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	changes, states := testChanges()
+	for i := 0; i < len(changes); i += 7 {
+		end := i + 7
+		if end > len(changes) {
+			end = len(changes)
+		}
+		if err := s.Append(changes[i:end]); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the state before the first change is empty
+	if snapshot, err := s.StateAt(t0.Add(-time.Second)); err != nil || len(snapshot.Nodes) != 0 {
+		t.Errorf("No node expected before the first change: %v, %v", snapshot, err)
+	}
+	for _, i := range []int{0, 1, 9, 10, 42, 99} {
+		checkState(t, s, i, states[i])
+	}
+
+	// the range is inclusive
+	got, err := s.Changes(at(10), at(19))
+	if err != nil || !sameChanges(got, changes[10:20]) {
+		t.Errorf("Wrong changes between 10 and 19: %v, %v", got, err)
+	}
+	if got, _ := s.Changes(at(200), at(300)); len(got) != 0 {
+		t.Errorf("No change expected after the last one: %v", got)
+	}
+
+	// a change older than the last one is stored at the time of the last one
+	if err := s.Append([]*Change{nodeChange(50, NodeDeleted, "eth0", nil)}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, _ := s.Changes(at(99), at(99)); len(got) != 2 || got[1].Element.ID != "eth0" {
+		t.Errorf("The late change should be at the time of the last one: %v", got)
+	}
+	delete(states[99], "eth0")
+
+	// reopened, the history is the same
+	if err := s.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s, err = open(dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+
+	checkState(t, s, 42, states[42])
+	checkState(t, s, 99, states[99])
+
+	// the states from the time pruned on are still known, not the ones before
+	if err := s.Prune(at(60)); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, i := range []int{60, 75, 99} {
+		checkState(t, s, i, states[i])
+	}
+	if _, err := s.StateAt(at(5)); err != ErrPruned {
+		t.Errorf("The state before the pruning shouldn't be known: %v", err)
+	}
+	if got, _ := s.Changes(at(0), at(59)); len(got) >= 60 {
+		t.Errorf("The changes before 60 should be pruned: %d left", len(got))
+	}
+	if got, _ := s.Changes(at(60), at(98)); !sameChanges(got, changes[60:99]) {
+		t.Errorf("The changes from 60 on should be kept: %v", got)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	graph.RegisterMetadataPersistence(graph.VolatilePersistence, "Statistics")
+
+	b, _ := graph.NewMemoryBackend()
+	g, _ := graph.NewGraph(b)
+
+	open := func() *Recorder {
+		s, err := NewFileStorage(dir, FileStorageOptions{Sync: SyncAlways})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		r := NewRecorder(g, s)
+		r.Start()
+		return r
+	}
+
+	r := open()
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	g.Link(host, eth0, graph.Metadata{"RelationType": "ownership"})
+	g.AddMetadata(eth0, "MTU", 9000)
+	g.AddMetadata(eth0, "Statistics", map[string]interface{}{"RxBytes": 42})
+	g.Unlock()
+
+	r.Stop()
+
+	s, _ := NewFileStorage(dir, FileStorageOptions{Sync: SyncAlways})
+	changes, _ := s.Changes(t0, time.Now())
+	var types []ChangeType
+	for _, c := range changes {
+		types = append(types, c.Type)
+	}
+	if expected := []ChangeType{NodeAdded, NodeAdded, EdgeAdded, NodeUpdated}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("Wrong changes recorded %v, expected %v", types, expected)
+	}
+	if m := changes[3].Element.Metadata; m["MTU"] != float64(9000) || m["Statistics"] != nil {
+		t.Errorf("Wrong metadata recorded: %v", m)
+	}
+	s.Close()
+
+	// the node deleted while not recording is recorded as deleted
+	g.Lock()
+	g.DelNode(eth0)
+	g.Unlock()
+
+	open().Stop()
+
+	s, _ = NewFileStorage(dir, FileStorageOptions{Sync: SyncAlways})
+	defer s.Close()
+
+	snapshot, err := s.StateAt(time.Now())
+	if err != nil || len(snapshot.Nodes) != 1 || snapshot.Nodes[0].ID != host.ID || len(snapshot.Edges) != 0 {
+		t.Errorf("Only the host should be left: %v, %v", snapshot, err)
+	}
+}
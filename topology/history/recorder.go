@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package history
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type recordedElement struct {
+	edge bool
+	host string
+	hash uint64
+}
+
+// Recorder appends the changes of the graph to a storage. The changes are
+// written by a goroutine, outside of the graph lock. The volatile metadata
+// are left out, the updates of only these metadata not being recorded. When
+// started, or after a bulk change, the graph is compared with the state
+// recorded, the differences being recorded, ie. the nodes gone while the
+// analyzer was stopped.
+type Recorder struct {
+	sync.Mutex
+	graph.DefaultGraphListener
+	Graph   *graph.Graph
+	Storage Storage
+	// the elements recorded, protected by the graph lock
+	recorded map[graph.Identifier]*recordedElement
+	pending  []*Change
+	signal   chan bool
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+func elementHash(e *graph.SnapshotElement) uint64 {
+	data, _ := json.Marshal(e)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// snapshotElement returns the node or the edge without its volatile
+// metadata, as stored
+func snapshotElement(e interface{}) *graph.SnapshotElement {
+	var f *graph.MetadataFilter
+	filtered := e
+	switch e := e.(type) {
+	case *graph.Node:
+		filtered = f.WithoutVolatile().FilterNode(e)
+	case *graph.Edge:
+		filtered = f.WithoutVolatile().FilterEdge(e)
+	}
+
+	var element graph.SnapshotElement
+	data, _ := json.Marshal(filtered)
+	json.Unmarshal(data, &element)
+
+	return &element
+}
+
+// record queues the change of an element, unless the element is already
+// recorded as it is or, for a deletion, not recorded
+func (r *Recorder) record(element *graph.SnapshotElement, edge bool, deleted bool) {
+	var t ChangeType
+	prev, ok := r.recorded[element.ID]
+
+	if deleted {
+		if !ok {
+			return
+		}
+		delete(r.recorded, element.ID)
+		t = NodeDeleted
+	} else {
+		hash := elementHash(element)
+		if ok && prev.hash == hash {
+			return
+		}
+		r.recorded[element.ID] = &recordedElement{edge: edge, host: element.Host, hash: hash}
+		if t = NodeAdded; ok {
+			t = NodeUpdated
+		}
+	}
+
+	if edge {
+		t = map[ChangeType]ChangeType{NodeAdded: EdgeAdded, NodeUpdated: EdgeUpdated, NodeDeleted: EdgeDeleted}[t]
+	}
+
+	r.Lock()
+	r.pending = append(r.pending, &Change{Time: time.Now().UTC(), Revision: r.Graph.Revision(), Type: t, Element: element})
+	r.Unlock()
+
+	select {
+	case r.signal <- true:
+	default:
+	}
+}
+
+func (r *Recorder) OnNodeAdded(n *graph.Node) {
+	r.record(snapshotElement(n), false, graph.IsTombstone(n))
+}
+
+func (r *Recorder) OnNodeUpdated(n *graph.Node) {
+	r.OnNodeAdded(n)
+}
+
+func (r *Recorder) OnNodeDeleted(n *graph.Node) {
+	r.record(&graph.SnapshotElement{ID: n.ID, Host: n.Host()}, false, true)
+}
+
+func (r *Recorder) OnEdgeAdded(e *graph.Edge) {
+	r.record(snapshotElement(e), true, false)
+}
+
+func (r *Recorder) OnEdgeUpdated(e *graph.Edge) {
+	r.OnEdgeAdded(e)
+}
+
+func (r *Recorder) OnEdgeDeleted(e *graph.Edge) {
+	r.record(&graph.SnapshotElement{ID: e.ID, Host: e.Host()}, true, true)
+}
+
+// OnBulkChange records the differences between the graph and the state
+// recorded, the graph lock being held
+func (r *Recorder) OnBulkChange() {
+	present := make(map[graph.Identifier]bool)
+	for _, n := range r.Graph.GetNodes() {
+		if !graph.IsTombstone(n) {
+			present[n.ID] = true
+			r.record(snapshotElement(n), false, false)
+		}
+	}
+	for _, e := range r.Graph.GetEdges() {
+		present[e.ID] = true
+		r.record(snapshotElement(e), true, false)
+	}
+
+	// the edges first, as when nodes are deleted
+	for _, edges := range []bool{true, false} {
+		for id, e := range r.recorded {
+			if e.edge == edges && !present[id] {
+				r.record(&graph.SnapshotElement{ID: id, Host: e.host}, e.edge, true)
+			}
+		}
+	}
+}
+
+func (r *Recorder) flush() {
+	r.Lock()
+	changes := r.pending
+	r.pending = nil
+	r.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	if err := r.Storage.Append(changes); err != nil {
+		logging.GetLogger().Errorf("Unable to record %d topology changes: %s", len(changes), err.Error())
+	}
+}
+
+func (r *Recorder) run() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.signal:
+			r.flush()
+		case <-r.quit:
+			r.flush()
+			return
+		}
+	}
+}
+
+// Start reads the state recorded last, records the differences with the
+// graph then the changes of the graph
+func (r *Recorder) Start() {
+	if state, err := r.Storage.StateAt(time.Now()); err != nil {
+		logging.GetLogger().Errorf("Unable to read the topology history: %s", err.Error())
+	} else {
+		for _, n := range state.Nodes {
+			r.recorded[n.ID] = &recordedElement{host: n.Host, hash: elementHash(n)}
+		}
+		for _, e := range state.Edges {
+			r.recorded[e.ID] = &recordedElement{edge: true, host: e.Host, hash: elementHash(e)}
+		}
+	}
+
+	r.Graph.AddEventListener(r)
+
+	r.Graph.Lock()
+	r.OnBulkChange()
+	r.Graph.Unlock()
+
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Stop stops recording, the pending changes being written, and closes the
+// storage
+func (r *Recorder) Stop() {
+	r.Graph.RemoveEventListener(r)
+	close(r.quit)
+	r.wg.Wait()
+
+	if err := r.Storage.Close(); err != nil {
+		logging.GetLogger().Errorf("Unable to close the topology history: %s", err.Error())
+	}
+}
+
+func NewRecorder(g *graph.Graph, s Storage) *Recorder {
+	return &Recorder{
+		Graph:    g,
+		Storage:  s,
+		recorded: make(map[graph.Identifier]*recordedElement),
+		signal:   make(chan bool, 1),
+		quit:     make(chan bool),
+	}
+}
@@ -0,0 +1,736 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// BroadcastDomainKey holds the identifier of the broadcast domain of an
+// interface, the ID of the broadcastdomain node
+const BroadcastDomainKey = "BroadcastDomain"
+
+// types of the nodes not being part of a broadcast domain
+var broadcastExcludedTypes = map[string]bool{
+	topology.HostType:            true,
+	topology.NetNSType:           true,
+	topology.ContainerType:       true,
+	topology.LagType:             true,
+	topology.VFType:              true,
+	topology.BroadcastDomainType: true,
+}
+
+// types of the OVS tunnel interfaces
+var ovsTunnelTypes = map[string]bool{"gre": true, "vxlan": true, "geneve": true}
+
+// l2State is an interface carrying the frames of a VLAN, the empty one
+// being the untagged frames. The frames of an OVS bridge are tagged by its
+// access ports, a bridge being part of a broadcast domain per VLAN.
+type l2State struct {
+	node graph.Identifier
+	vlan string
+}
+
+func (s l2State) String() string {
+	return string(s.node) + "/" + s.vlan
+}
+
+type broadcastDomain struct {
+	states []l2State
+}
+
+// l2Keys are the keys under which the interface is indexed
+type l2Keys struct {
+	fingerprint string
+	tunnel      string
+	peer        string
+	vni         string
+}
+
+type BroadcastDomainStats struct {
+	Domains        int
+	Recomputations int64
+	LastVisited    int
+}
+
+// BroadcastDomainManager computes the layer2 broadcast domains of the
+// interfaces of all the hosts. The interfaces are flooded over the layer2
+// edges, the OVS access ports tagging the frames of their VLAN on their
+// bridge, and joined across the hosts by the OVS tunnels having matching
+// endpoints and key, and by the VXLANs having the same VNI. Each domain
+// gets a node of type broadcastdomain listing its members, the member
+// interfaces holding its ID in their BroadcastDomain metadata, ie. the
+// interfaces in the domain of a VM interface:
+//
+//	G.V().Has('Type', 'broadcastdomain', 'Members', '<ID>')
+//
+// The graph events mark the interfaces as dirty, only the domains of the
+// dirty interfaces being computed again.
+type BroadcastDomainManager struct {
+	sync.RWMutex
+	Graph        *graph.Graph
+	Delay        time.Duration
+	subscription *common.BusSubscription
+	quit         chan bool
+	// interfaces changed since the last computation, true if an edge of
+	// the interface changed
+	dirty map[graph.Identifier]bool
+	all   bool
+	stats BroadcastDomainStats
+	// the following are only used with the graph lock held
+	keys        map[graph.Identifier]l2Keys
+	tunnels     map[string]map[graph.Identifier]bool
+	vnis        map[string]map[graph.Identifier]bool
+	domains     map[graph.Identifier]*broadcastDomain
+	stateDomain map[l2State]graph.Identifier
+	nodeDomains map[graph.Identifier]map[graph.Identifier]bool
+}
+
+func broadcastExcluded(n *graph.Node) bool {
+	if topology.IsOvsDatapath(n) {
+		return true
+	}
+	t, _ := n.Metadata()["Type"].(string)
+	return broadcastExcludedTypes[t]
+}
+
+// accessTag returns the VLAN tagged by an OVS access port
+func accessTag(n *graph.Node) (string, bool) {
+	if n.Metadata()["Type"] != topology.OvsPortType {
+		return "", false
+	}
+	switch v := n.Metadata()["Vlans"].(type) {
+	case nil:
+		return "", false
+	case []interface{}:
+		if len(v) != 1 {
+			return "", false
+		}
+		return fmt.Sprint(v[0]), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// vlanStep returns the VLAN of the frames going from an interface to one
+// of its layer2 neighbors, false if the frames don't go through, ie. the
+// frames of another VLAN than the tag of an access port.
+func vlanStep(from, to *graph.Node, vlan string) (string, bool) {
+	fromType, toType := from.Metadata()["Type"], to.Metadata()["Type"]
+
+	if fromType == topology.OvsBridgeType && toType == topology.OvsPortType {
+		if tag, ok := accessTag(to); ok {
+			return "", vlan == tag
+		}
+	}
+	if fromType == topology.OvsPortType && toType == topology.OvsBridgeType {
+		if tag, ok := accessTag(from); ok {
+			return tag, vlan == ""
+		}
+	}
+	return vlan, true
+}
+
+// tunnelKeys returns the key of an OVS tunnel and the one of its peer, the
+// tunnels without both endpoints being left aside
+func tunnelKeys(n *graph.Node) (string, string) {
+	m := n.Metadata()
+	t, _ := m["Type"].(string)
+	local, _ := m["LocalIP"].(string)
+	remote, _ := m["RemoteIP"].(string)
+	if !ovsTunnelTypes[t] || local == "" || remote == "" {
+		return "", ""
+	}
+	key, _ := m["TunnelKey"].(string)
+	if key == "" {
+		key = "0"
+	}
+	return strings.Join([]string{t, local, remote, key}, "|"), strings.Join([]string{t, remote, local, key}, "|")
+}
+
+func l2Fingerprint(n *graph.Node) string {
+	m := n.Metadata()
+	return fmt.Sprint(m["Type"], m["Name"], m["Vlans"], m["LocalIP"], m["RemoteIP"], m["TunnelKey"], m["VNI"], m["MAC"], m["IPV4"])
+}
+
+func addKey(index map[string]map[graph.Identifier]bool, key string, id graph.Identifier) {
+	if key == "" {
+		return
+	}
+	ids, ok := index[key]
+	if !ok {
+		ids = make(map[graph.Identifier]bool)
+		index[key] = ids
+	}
+	ids[id] = true
+}
+
+func delKey(index map[string]map[graph.Identifier]bool, key string, id graph.Identifier) {
+	if ids, ok := index[key]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// index updates the tunnel and VNI indexes of an interface, returns false
+// if the interface didn't change
+func (m *BroadcastDomainManager) index(id graph.Identifier, n *graph.Node) bool {
+	old, known := m.keys[id]
+
+	if n == nil || broadcastExcluded(n) {
+		if !known {
+			return false
+		}
+		delKey(m.tunnels, old.tunnel, id)
+		delKey(m.vnis, old.vni, id)
+		delete(m.keys, id)
+		return true
+	}
+
+	keys := l2Keys{fingerprint: l2Fingerprint(n)}
+	if known && keys.fingerprint == old.fingerprint {
+		return false
+	}
+
+	keys.tunnel, keys.peer = tunnelKeys(n)
+	if vni := n.Metadata()["VNI"]; vni != nil {
+		keys.vni = fmt.Sprint(vni)
+	}
+
+	delKey(m.tunnels, old.tunnel, id)
+	delKey(m.vnis, old.vni, id)
+	addKey(m.tunnels, keys.tunnel, id)
+	addKey(m.vnis, keys.vni, id)
+	m.keys[id] = keys
+
+	return true
+}
+
+// neighbors returns the states the frames of a state go to
+func (m *BroadcastDomainManager) neighbors(s l2State) []l2State {
+	n := m.Graph.GetNode(s.node)
+	if n == nil || broadcastExcluded(n) {
+		return nil
+	}
+
+	var states []l2State
+	for _, e := range m.Graph.GetNodeEdges(n) {
+		em := e.Metadata()
+		if em["RelationType"] != topology.Layer2Relation || em["Type"] == topology.VrfType {
+			continue
+		}
+
+		parent, child := m.Graph.GetEdgeNodes(e)
+		other := parent
+		if parent != nil && parent.ID == n.ID {
+			other = child
+		}
+		if other == nil || other.ID == n.ID || broadcastExcluded(other) {
+			continue
+		}
+
+		if vlan, ok := vlanStep(n, other, s.vlan); ok {
+			states = append(states, l2State{node: other.ID, vlan: vlan})
+		}
+	}
+
+	keys := m.keys[s.node]
+	for id := range m.tunnels[keys.peer] {
+		states = append(states, l2State{node: id, vlan: s.vlan})
+	}
+	for id := range m.vnis[keys.vni] {
+		if id != s.node {
+			states = append(states, l2State{node: id, vlan: s.vlan})
+		}
+	}
+
+	return states
+}
+
+// hostName returns the host and the name of an interface, the same
+// interface being possibly seen by several probes
+func hostName(n *graph.Node) string {
+	name, _ := n.Metadata()["Name"].(string)
+	return n.Host() + "/" + name
+}
+
+// duplicates returns the values held by several interfaces of a domain,
+// the interfaces of the same host and name being the same one. Two linked
+// interfaces sharing a MAC are not reported, ie. a bridge takes the MAC of
+// one of its ports.
+func (m *BroadcastDomainManager) duplicates(members []*graph.Node, values func(n *graph.Node) []string) []string {
+	holders := make(map[string]map[string]*graph.Node)
+	for _, n := range members {
+		for _, v := range values(n) {
+			if _, ok := holders[v]; !ok {
+				holders[v] = make(map[string]*graph.Node)
+			}
+			holders[v][hostName(n)] = n
+		}
+	}
+
+	var dups []string
+	for v, nodes := range holders {
+		if len(nodes) < 2 {
+			continue
+		}
+		if len(nodes) == 2 {
+			var pair []*graph.Node
+			for _, n := range nodes {
+				pair = append(pair, n)
+			}
+			if m.Graph.AreLinked(pair[0], pair[1]) || m.Graph.AreLinked(pair[1], pair[0]) {
+				continue
+			}
+		}
+		dups = append(dups, v)
+	}
+	sort.Strings(dups)
+
+	return dups
+}
+
+func nodeMACs(n *graph.Node) []string {
+	mac, _ := n.Metadata()["MAC"].(string)
+	if mac == "" || mac == "00:00:00:00:00:00" {
+		return nil
+	}
+	return []string{mac}
+}
+
+func nodeIPs(n *graph.Node) []string {
+	var ips []string
+	ipv4, _ := n.Metadata()["IPV4"].(string)
+	for _, cidr := range strings.Split(ipv4, ",") {
+		if ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+func (m *BroadcastDomainManager) domainMetadata(d *broadcastDomain) graph.Metadata {
+	var members []*graph.Node
+	var ids []string
+	seen := make(map[graph.Identifier]bool)
+	hosts := make(map[string]bool)
+	vlans := make(map[string]bool)
+	vnis := make(map[string]bool)
+
+	for _, s := range d.states {
+		if s.vlan != "" {
+			vlans[s.vlan] = true
+		}
+		if seen[s.node] {
+			continue
+		}
+		seen[s.node] = true
+
+		n := m.Graph.GetNode(s.node)
+		if n == nil {
+			continue
+		}
+		members = append(members, n)
+		ids = append(ids, string(n.ID))
+		hosts[n.Host()] = true
+		if vni := m.keys[n.ID].vni; vni != "" {
+			vnis[vni] = true
+		}
+	}
+	sort.Strings(ids)
+
+	sorted := func(set map[string]bool) []string {
+		l := make([]string, 0, len(set))
+		for k := range set {
+			l = append(l, k)
+		}
+		sort.Strings(l)
+		return l
+	}
+
+	md := graph.Metadata{
+		"Type":         topology.BroadcastDomainType,
+		"Name":         "bd-" + string(d.id())[:8],
+		"Members":      ids,
+		"MembersCount": int64(len(ids)),
+		"Hosts":        sorted(hosts),
+	}
+	if len(vlans) > 0 {
+		md["VLANs"] = sorted(vlans)
+	}
+	if len(vnis) > 0 {
+		md["VNIs"] = sorted(vnis)
+	}
+	if dups := m.duplicates(members, nodeMACs); len(dups) > 0 {
+		md["DuplicateMACs"] = dups
+	}
+	if dups := m.duplicates(members, nodeIPs); len(dups) > 0 {
+		md["DuplicateIPs"] = dups
+	}
+
+	return md
+}
+
+// id returns the identifier of a domain, derived from its lowest state
+// so that a domain keeps its identifier as long as this state is part of
+// it
+func (d *broadcastDomain) id() graph.Identifier {
+	lowest := d.states[0].String()
+	for _, s := range d.states[1:] {
+		if str := s.String(); str < lowest {
+			lowest = str
+		}
+	}
+	return graph.GenIDFrom(topology.BroadcastDomainType, lowest)
+}
+
+// setBroadcastDomain sets the BroadcastDomain metadata of an interface,
+// removed if the interface isn't part of a domain anymore
+func (m *BroadcastDomainManager) setBroadcastDomain(n *graph.Node) {
+	current, found := n.Metadata()[BroadcastDomainKey]
+
+	id, ok := m.stateDomain[l2State{node: n.ID}]
+	if ok {
+		if current != string(id) {
+			m.Graph.AddMetadata(n, BroadcastDomainKey, string(id))
+		}
+		return
+	}
+
+	if found {
+		md := make(graph.Metadata)
+		for k, v := range n.Metadata() {
+			if k != BroadcastDomainKey {
+				md[k] = v
+			}
+		}
+		m.Graph.SetMetadata(n, md)
+	}
+}
+
+// recompute computes the domains of the dirty interfaces again, the graph
+// lock being held. The domains the dirty interfaces were part of are
+// flooded from all their states, a domain reached by the flooding being
+// merged.
+func (m *BroadcastDomainManager) recompute(dirty map[graph.Identifier]bool, all bool) int {
+	var seeds []l2State
+	removed := make(map[graph.Identifier]bool)
+	touched := make(map[graph.Identifier]bool)
+
+	for id, forced := range dirty {
+		n := m.Graph.GetNode(id)
+		if !m.index(id, n) && !forced {
+			// the metadata may have been replaced by the agent
+			if n != nil && !broadcastExcluded(n) {
+				m.setBroadcastDomain(n)
+			}
+			continue
+		}
+
+		touched[id] = true
+		for d := range m.nodeDomains[id] {
+			removed[d] = true
+		}
+		if n != nil && !broadcastExcluded(n) {
+			seeds = append(seeds, l2State{node: id})
+		}
+	}
+	for d := range removed {
+		seeds = append(seeds, m.domains[d].states...)
+	}
+
+	visited := make(map[l2State]bool)
+	var components [][]l2State
+	for len(seeds) > 0 {
+		s := seeds[len(seeds)-1]
+		seeds = seeds[:len(seeds)-1]
+		if visited[s] {
+			continue
+		}
+		visited[s] = true
+
+		component := []l2State{s}
+		for i := 0; i < len(component); i++ {
+			current := component[i]
+			touched[current.node] = true
+
+			if d, ok := m.stateDomain[current]; ok && !removed[d] {
+				removed[d] = true
+			}
+			if current.vlan != "" {
+				seeds = append(seeds, l2State{node: current.node})
+			}
+
+			for _, next := range m.neighbors(current) {
+				if !visited[next] {
+					visited[next] = true
+					component = append(component, next)
+				}
+			}
+		}
+		components = append(components, component)
+	}
+
+	for d := range removed {
+		for _, s := range m.domains[d].states {
+			touched[s.node] = true
+			delete(m.stateDomain, s)
+			if domains, ok := m.nodeDomains[s.node]; ok {
+				delete(domains, d)
+				if len(domains) == 0 {
+					delete(m.nodeDomains, s.node)
+				}
+			}
+		}
+		delete(m.domains, d)
+	}
+
+	created := make(map[graph.Identifier]*broadcastDomain)
+	for _, states := range components {
+		nodes := make(map[graph.Identifier]bool)
+		untagged := false
+		for _, s := range states {
+			nodes[s.node] = true
+			untagged = untagged || s.vlan == ""
+		}
+		// an interface alone isn't a domain, nor a VLAN without access
+		// port left
+		if len(nodes) < 2 || !untagged {
+			continue
+		}
+
+		d := &broadcastDomain{states: states}
+		id := d.id()
+		m.domains[id] = d
+		created[id] = d
+		for _, s := range states {
+			m.stateDomain[s] = id
+			if _, ok := m.nodeDomains[s.node]; !ok {
+				m.nodeDomains[s.node] = make(map[graph.Identifier]bool)
+			}
+			m.nodeDomains[s.node][id] = true
+		}
+	}
+
+	for id := range removed {
+		if _, ok := created[id]; ok {
+			continue
+		}
+		if n := m.Graph.GetNode(id); n != nil {
+			m.Graph.DelNode(n)
+		}
+	}
+	if all {
+		for _, n := range m.Graph.LookupNodes(graph.Metadata{"Type": topology.BroadcastDomainType}) {
+			if _, ok := m.domains[n.ID]; !ok {
+				m.Graph.DelNode(n)
+			}
+		}
+	}
+
+	for id, d := range created {
+		md := m.domainMetadata(d)
+		if n := m.Graph.GetNode(id); n == nil {
+			m.Graph.NewNode(id, md)
+		} else if !reflect.DeepEqual(n.Metadata(), md) {
+			m.Graph.SetMetadata(n, md)
+		}
+	}
+
+	for id := range touched {
+		if n := m.Graph.GetNode(id); n != nil && !broadcastExcluded(n) {
+			m.setBroadcastDomain(n)
+		}
+	}
+
+	return len(visited)
+}
+
+// compute computes the domains of the interfaces marked as dirty
+func (m *BroadcastDomainManager) compute() {
+	m.Lock()
+	dirty, all := m.dirty, m.all
+	m.dirty, m.all = make(map[graph.Identifier]bool), false
+	m.Unlock()
+
+	if len(dirty) == 0 && !all {
+		return
+	}
+
+	m.Graph.Lock()
+	if all {
+		for _, n := range m.Graph.GetNodes() {
+			dirty[n.ID] = true
+		}
+		for id := range m.keys {
+			dirty[id] = true
+		}
+	}
+	visited := m.recompute(dirty, all)
+	domains := len(m.domains)
+	m.Graph.Unlock()
+
+	m.Lock()
+	m.stats.Domains = domains
+	m.stats.Recomputations++
+	m.stats.LastVisited = visited
+	m.Unlock()
+}
+
+func (m *BroadcastDomainManager) markDirty(n *graph.Node, forced bool) {
+	if n == nil {
+		return
+	}
+
+	m.Lock()
+	if !m.dirty[n.ID] {
+		m.dirty[n.ID] = forced
+	}
+	m.Unlock()
+}
+
+func (m *BroadcastDomainManager) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != m.Graph {
+		return
+	}
+
+	switch e.Type {
+	case "BulkChange":
+		m.Lock()
+		m.all = true
+		m.Unlock()
+	case "NodeAdded", "NodeUpdated":
+		m.markDirty(ev.Node, false)
+	case "NodeDeleted":
+		m.markDirty(ev.Node, true)
+	default:
+		if ev.Edge == nil || ev.Edge.Metadata()["RelationType"] != topology.Layer2Relation {
+			return
+		}
+		m.markDirty(ev.Parent, true)
+		m.markDirty(ev.Child, true)
+	}
+}
+
+// OnBusEventsDropped computes all the domains again as the missed events
+// may have changed any of them
+func (m *BroadcastDomainManager) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("Broadcast domains missed %d graph events, computing all the domains", count)
+
+	m.Lock()
+	m.all = true
+	m.Unlock()
+}
+
+// Flush waits for the queued graph events and computes the domains of the
+// dirty interfaces
+func (m *BroadcastDomainManager) Flush() {
+	if m.subscription != nil {
+		m.subscription.Flush()
+	}
+	m.compute()
+}
+
+func (m *BroadcastDomainManager) Metrics() interface{} {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.stats
+}
+
+func (m *BroadcastDomainManager) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(m.Delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.compute()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *BroadcastDomainManager) Start() {
+	m.Lock()
+	m.all = true
+	m.Unlock()
+
+	m.subscription = common.DefaultBus.Subscribe("broadcast_domains", config.GetConfig().GetInt("graph.bus.queue_size"), m, common.GraphTopic)
+	common.RegisterMetrics("broadcast_domains", m.Metrics)
+
+	go m.run()
+}
+
+func (m *BroadcastDomainManager) Stop() {
+	close(m.quit)
+	common.UnregisterMetrics("broadcast_domains")
+	common.DefaultBus.Unsubscribe(m.subscription)
+}
+
+func NewBroadcastDomainManager(g *graph.Graph, delay time.Duration) *BroadcastDomainManager {
+	return &BroadcastDomainManager{
+		Graph:       g,
+		Delay:       delay,
+		quit:        make(chan bool),
+		dirty:       make(map[graph.Identifier]bool),
+		keys:        make(map[graph.Identifier]l2Keys),
+		tunnels:     make(map[string]map[graph.Identifier]bool),
+		vnis:        make(map[string]map[graph.Identifier]bool),
+		domains:     make(map[graph.Identifier]*broadcastDomain),
+		stateDomain: make(map[l2State]graph.Identifier),
+		nodeDomains: make(map[graph.Identifier]map[graph.Identifier]bool),
+	}
+}
+
+// NewBroadcastDomainManagerFromConfig returns nil if the computation is
+// disabled
+func NewBroadcastDomainManagerFromConfig(g *graph.Graph) *BroadcastDomainManager {
+	if !config.GetConfig().GetBool("analyzer.broadcast_domains.enabled") {
+		return nil
+	}
+
+	delay := time.Duration(config.GetConfig().GetInt("analyzer.broadcast_domains.delay")) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return NewBroadcastDomainManager(g, delay)
+}
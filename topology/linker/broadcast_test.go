@@ -0,0 +1,268 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newBroadcastGraph(t *testing.T) (*graph.Graph, *BroadcastDomainManager) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewBroadcastDomainManager(g, time.Hour)
+	m.Start()
+
+	return g, m
+}
+
+func broadcastDomainOf(g *graph.Graph, n *graph.Node) *graph.Node {
+	g.RLock()
+	defer g.RUnlock()
+
+	id, _ := n.Metadata()[BroadcastDomainKey].(string)
+	if id == "" {
+		return nil
+	}
+	return g.GetNode(graph.Identifier(id))
+}
+
+// ovsAccessPort adds an OVS port tagged with a VLAN and its interface
+func ovsAccessPort(g *graph.Graph, bridge *graph.Node, name string, vlan int, m graph.Metadata) *graph.Node {
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	port := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.OvsPortType, "Name": name, "Vlans": vlan})
+	m["Name"] = name
+	intf := g.NewNode(graph.GenID(), m)
+	g.Link(bridge, port, l2)
+	g.Link(port, intf, l2)
+
+	return intf
+}
+
+func TestBroadcastDomainsAcrossHosts(t *testing.T) {
+	g, m := newBroadcastGraph(t)
+	defer m.Stop()
+
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	g.Lock()
+	// two hosts whose integration bridges are meshed by a vxlan tunnel
+	var bridges []*graph.Node
+	var tunnels []*graph.Node
+	for i, ips := range [][]string{{"192.168.0.1", "192.168.0.2"}, {"192.168.0.2", "192.168.0.1"}} {
+		bridge := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.OvsBridgeType, "Name": "br-int"})
+		port := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.OvsPortType, "Name": fmt.Sprintf("vxlan-%d", i)})
+		tunnel := g.NewNode(graph.GenID(), graph.Metadata{"Type": "vxlan", "Name": fmt.Sprintf("vxlan-%d", i), "LocalIP": ips[0], "RemoteIP": ips[1], "TunnelKey": "flow"})
+		g.Link(bridge, port, l2)
+		g.Link(port, tunnel, l2)
+		bridges = append(bridges, bridge)
+		tunnels = append(tunnels, tunnel)
+	}
+
+	// the VMs of both hosts using the same addresses in the VLAN 1
+	vm1 := ovsAccessPort(g, bridges[0], "tap1", 1, graph.Metadata{"Type": "tap", "MAC": "fa:16:3e:00:00:01", "IPV4": "10.0.0.1/24"})
+	vm2 := ovsAccessPort(g, bridges[0], "tap2", 2, graph.Metadata{"Type": "tap", "MAC": "fa:16:3e:00:00:02"})
+	vm3 := ovsAccessPort(g, bridges[1], "tap3", 1, graph.Metadata{"Type": "tap", "MAC": "fa:16:3e:00:00:01", "IPV4": "10.0.0.1/24"})
+	g.Unlock()
+
+	m.Flush()
+
+	d1, d2, d3 := broadcastDomainOf(g, vm1), broadcastDomainOf(g, vm2), broadcastDomainOf(g, vm3)
+	if d1 == nil || d2 == nil {
+		t.Fatalf("Expected the VMs to be part of a domain: %v, %v", vm1.Metadata(), vm2.Metadata())
+	}
+	if d1 == d2 {
+		t.Errorf("The VLANs 1 and 2 shouldn't share a domain")
+	}
+	if d1 != d3 {
+		t.Fatalf("The VLAN 1 of both hosts should be a single domain: %v, %v", d1, d3)
+	}
+
+	g.RLock()
+	md := d1.Metadata()
+	// the bridges, the tunnels and their ports being part of the VLAN
+	if md["MembersCount"] != int64(10) || !reflect.DeepEqual(md["VLANs"], []string{"1"}) {
+		t.Errorf("Wrong domain: %v", md)
+	}
+	if !reflect.DeepEqual(md["DuplicateMACs"], []string{"fa:16:3e:00:00:01"}) || !reflect.DeepEqual(md["DuplicateIPs"], []string{"10.0.0.1"}) {
+		t.Errorf("Expected the duplicates of the VMs: %v", md)
+	}
+	if _, ok := d2.Metadata()["DuplicateMACs"]; ok {
+		t.Errorf("Unexpected duplicates: %v", d2.Metadata())
+	}
+	g.RUnlock()
+
+	// the VM moves into the VLAN 2, leaving the duplicates behind
+	g.Lock()
+	port := g.LookupFirstNode(graph.Metadata{"Type": topology.OvsPortType, "Name": "tap3"})
+	g.AddMetadata(port, "Vlans", 2)
+	g.Unlock()
+
+	m.Flush()
+
+	if d := broadcastDomainOf(g, vm3); d == nil || d.ID != broadcastDomainOf(g, vm2).ID {
+		t.Errorf("Expected the VM to join the VLAN 2 domain: %v", vm3.Metadata())
+	}
+	g.RLock()
+	if d := g.GetNode(d1.ID); d != nil {
+		if _, ok := d.Metadata()["DuplicateMACs"]; ok {
+			t.Errorf("Unexpected duplicates: %v", d.Metadata())
+		}
+	}
+	g.RUnlock()
+
+	// the tunnel goes down, the domains are split per host
+	g.Lock()
+	g.DelNode(tunnels[1])
+	g.Unlock()
+
+	m.Flush()
+
+	if d2, d3 := broadcastDomainOf(g, vm2), broadcastDomainOf(g, vm3); d2 == nil || d3 == nil || d2.ID == d3.ID {
+		t.Errorf("Expected a domain per host: %v, %v", vm2.Metadata(), vm3.Metadata())
+	}
+	g.RLock()
+	// the VLANs 1 and 2 and the native VLAN of the first host, the VLAN 2
+	// and the native VLAN of the second one
+	if n := len(g.LookupNodes(graph.Metadata{"Type": topology.BroadcastDomainType})); n != 5 {
+		t.Errorf("Expected 5 domains, got %d", n)
+	}
+	g.RUnlock()
+}
+
+func TestBroadcastDomainsVNI(t *testing.T) {
+	g, m := newBroadcastGraph(t)
+	defer m.Stop()
+
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	g.Lock()
+	var veths []*graph.Node
+	for i := 0; i < 2; i++ {
+		bridge := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.BridgeType, "Name": "br0"})
+		vxlan := g.NewNode(graph.GenID(), graph.Metadata{"Type": "vxlan", "Name": "vxlan42", "VNI": int64(42)})
+		veth := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.VethType, "Name": fmt.Sprintf("veth%d", i)})
+		g.Link(bridge, vxlan, l2)
+		g.Link(bridge, veth, l2)
+		veths = append(veths, veth)
+	}
+	// the vxlan of OVS, without VNI
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "vxlan", "Name": "vxlan_sys_4789"})
+	g.Unlock()
+
+	m.Flush()
+
+	d := broadcastDomainOf(g, veths[0])
+	if d == nil || broadcastDomainOf(g, veths[1]) != d {
+		t.Fatalf("Expected the bridges to share a domain through the VNI: %v, %v", veths[0].Metadata(), veths[1].Metadata())
+	}
+
+	g.RLock()
+	if md := d.Metadata(); md["MembersCount"] != int64(6) || !reflect.DeepEqual(md["VNIs"], []string{"42"}) {
+		t.Errorf("Wrong domain: %v", md)
+	}
+	g.RUnlock()
+
+	// the metadata replaced by the agent are set again
+	g.Lock()
+	g.SetMetadata(veths[0], graph.Metadata{"Type": topology.VethType, "Name": "veth0"})
+	g.Unlock()
+
+	m.Flush()
+
+	if broadcastDomainOf(g, veths[0]) != d {
+		t.Errorf("Expected the domain to be set again: %v", veths[0].Metadata())
+	}
+}
+
+func TestBroadcastDomainsLocality(t *testing.T) {
+	// the events of the 10k interfaces fit in the queue, a drop would make
+	// the manager compute all the domains again
+	cfg := config.GetConfig()
+	cfg.Set("graph.bus.queue_size", 100000)
+	defer cfg.Set("graph.bus.queue_size", 10000)
+
+	g, m := newBroadcastGraph(t)
+	defer m.Stop()
+
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	// 10k interfaces in 1000 bridges
+	g.Lock()
+	var first []*graph.Node
+	for i := 0; i < 1000; i++ {
+		bridge := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.BridgeType, "Name": fmt.Sprintf("br%d", i)})
+		for j := 0; j < 9; j++ {
+			veth := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.VethType, "Name": fmt.Sprintf("veth%d-%d", i, j)})
+			g.Link(bridge, veth, l2)
+			if i == 0 {
+				first = append(first, veth)
+			}
+		}
+	}
+	g.Unlock()
+
+	m.Flush()
+
+	g.RLock()
+	if n := len(g.LookupNodes(graph.Metadata{"Type": topology.BroadcastDomainType})); n != 1000 {
+		t.Errorf("Expected 1000 domains, got %d", n)
+	}
+	g.RUnlock()
+
+	if dropped := m.subscription.Stats().Dropped; dropped != 0 {
+		t.Fatalf("No event should have been dropped, got %d", dropped)
+	}
+
+	g.Lock()
+	g.DelNode(first[0])
+	g.Unlock()
+
+	m.Flush()
+
+	// the 9 interfaces left and the deleted one
+	if visited := m.Metrics().(BroadcastDomainStats).LastVisited; visited != 10 {
+		t.Errorf("Only the domain of the interface should be computed again, %d interfaces visited", visited)
+	}
+
+	g.RLock()
+	if d := g.GetNode(graph.Identifier(first[1].Metadata()[BroadcastDomainKey].(string))); d == nil || d.Metadata()["MembersCount"] != int64(9) {
+		t.Errorf("Wrong domain: %v", d)
+	}
+	g.RUnlock()
+}
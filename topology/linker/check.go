@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"sort"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// DuplicateAddresses are the MAC and IP addresses held by several members
+// of a broadcast domain
+type DuplicateAddresses struct {
+	MACs []string `json:",omitempty"`
+	IPs  []string `json:",omitempty"`
+}
+
+// CheckReport holds the violations found by the checkers over a graph
+type CheckReport struct {
+	// per layer2 segment
+	MTU            map[string]interface{}         `json:",omitempty"`
+	LinkMismatches []interface{}                  `json:",omitempty"`
+	Duplicates     map[string]*DuplicateAddresses `json:",omitempty"`
+	SkewedClocks   []string                       `json:",omitempty"`
+}
+
+// Authorize returns the violations the user may read, the ones of the
+// nodes, checked against g, out of the user scope being removed
+func (r *CheckReport) Authorize(a graph.Authorizer, user string, g *graph.Graph) *CheckReport {
+	if !graph.Restricted(a, user) {
+		return r
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	ar := &CheckReport{}
+	for id, m := range r.MTU {
+		if _, ok := graph.AuthorizeValue(a, user, g, m); ok {
+			if ar.MTU == nil {
+				ar.MTU = make(map[string]interface{})
+			}
+			ar.MTU[id] = m
+		}
+	}
+	for _, m := range r.LinkMismatches {
+		if _, ok := graph.AuthorizeValue(a, user, g, m); ok {
+			ar.LinkMismatches = append(ar.LinkMismatches, m)
+		}
+	}
+	for id, d := range r.Duplicates {
+		if n := g.GetNode(graph.Identifier(id)); n != nil && a.CanReadNode(user, n) {
+			if ar.Duplicates == nil {
+				ar.Duplicates = make(map[string]*DuplicateAddresses)
+			}
+			ar.Duplicates[id] = d
+		}
+	}
+
+	skewed := make(map[string]bool)
+	for _, n := range g.LookupNodes(graph.Metadata{ClockSkewedKey: true}) {
+		if a.CanReadNode(user, n) {
+			skewed[n.Host()] = true
+		}
+	}
+	for _, host := range r.SkewedClocks {
+		if skewed[host] {
+			ar.SkewedClocks = append(ar.SkewedClocks, host)
+		}
+	}
+
+	return ar
+}
+
+// Violations returns the number of violations of the report
+func (r *CheckReport) Violations() int {
+	return len(r.MTU) + len(r.LinkMismatches) + len(r.Duplicates) + len(r.SkewedClocks)
+}
+
+// Check computes the broadcast domains and the layer3 edges, then runs the
+// checkers, the ones enabled by the configuration, over all the graph,
+// ie. a view of the graph of the analyzer as the computations and the
+// checkers update the graph. The checkers being new instances, the ones
+// of the analyzer are left untouched.
+func Check(g *graph.Graph) *CheckReport {
+	report := &CheckReport{}
+
+	if m := NewBroadcastDomainManagerFromConfig(g); m != nil {
+		m.all = true
+		m.compute()
+	}
+	if m := NewLayer3ManagerFromConfig(g); m != nil {
+		m.all = true
+		m.compute()
+	}
+
+	if c := NewMTUCheckerFromConfig(g); c != nil {
+		c.all = true
+		c.compute()
+		if reports := c.MTUReports(); len(reports) > 0 {
+			report.MTU = reports
+		}
+	}
+	if c := NewLinkStateCheckerFromConfig(g); c != nil {
+		c.all = true
+		c.compute()
+		if mismatches := c.LinkMismatches(); len(mismatches) > 0 {
+			report.LinkMismatches = mismatches
+		}
+	}
+	if c := NewClockSkewCheckerFromConfig(g); c != nil {
+		c.checkAll()
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	for _, n := range g.LookupNodes(graph.Metadata{"Type": topology.BroadcastDomainType}) {
+		macs, _ := n.Metadata()["DuplicateMACs"].([]string)
+		ips, _ := n.Metadata()["DuplicateIPs"].([]string)
+		if len(macs) > 0 || len(ips) > 0 {
+			if report.Duplicates == nil {
+				report.Duplicates = make(map[string]*DuplicateAddresses)
+			}
+			report.Duplicates[string(n.ID)] = &DuplicateAddresses{MACs: macs, IPs: ips}
+		}
+	}
+
+	for _, n := range g.LookupNodes(graph.Metadata{ClockSkewedKey: true}) {
+		report.SkewedClocks = append(report.SkewedClocks, n.Host())
+	}
+	sort.Strings(report.SkewedClocks)
+
+	return report
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ClockSkewedKey flags the hosts whose clock is off by more than the
+// maximum offset, or not synchronized at all
+const ClockSkewedKey = "ClockSkewed"
+
+type ClockSkewCheckerStats struct {
+	Skewed int
+	Checks int64
+}
+
+// ClockSkewChecker flags the hosts whose clock, as reported by the clock
+// probe of their agent, is not synchronized or is off by more than the
+// maximum offset, the flag being removed once their clock is back in sync:
+//
+//	G.V().Has('ClockSkewed', true)
+//
+// The timestamps of the flows and of the history of these hosts can't be
+// compared with the ones of the other hosts.
+type ClockSkewChecker struct {
+	sync.RWMutex
+	Graph        *graph.Graph
+	MaxOffset    time.Duration
+	subscription *common.BusSubscription
+	stats        ClockSkewCheckerStats
+	skewed       map[graph.Identifier]bool
+}
+
+// clockSkewed returns whether the clock reported by a host is skewed and
+// whether the host reports its clock at all
+func (c *ClockSkewChecker) clockSkewed(m graph.Metadata) (bool, bool) {
+	clock, ok := m[topology.ClockKey].(map[string]interface{})
+	if !ok {
+		return false, false
+	}
+
+	if synchronized, ok := clock["Synchronized"].(bool); ok && !synchronized {
+		return true, true
+	}
+
+	offset, ok := clock["Offset"].(float64)
+	if !ok {
+		return false, true
+	}
+	return math.Abs(offset) > c.MaxOffset.Seconds(), true
+}
+
+// check flags or unflags a host according to its clock, with the graph
+// locked
+func (c *ClockSkewChecker) check(n *graph.Node) {
+	skewed, reported := c.clockSkewed(n.Metadata())
+	if !reported {
+		return
+	}
+
+	c.Lock()
+	c.stats.Checks++
+	if skewed {
+		c.skewed[n.ID] = true
+	} else {
+		delete(c.skewed, n.ID)
+	}
+	c.stats.Skewed = len(c.skewed)
+	c.Unlock()
+
+	flagged, _ := n.Metadata()[ClockSkewedKey].(bool)
+	if flagged == skewed {
+		return
+	}
+
+	if skewed {
+		logging.GetLogger().Warningf("Clock of the host %s skewed: %v", n.Host(), n.Metadata()[topology.ClockKey])
+		c.Graph.AddMetadata(n, ClockSkewedKey, true)
+		return
+	}
+
+	m := make(graph.Metadata)
+	for k, v := range n.Metadata() {
+		if k != ClockSkewedKey {
+			m[k] = v
+		}
+	}
+	c.Graph.SetMetadata(n, m)
+}
+
+// OnBusEvent checks the hosts whose clock is added or updated, the copy of
+// the event telling whether the node has to be looked up
+func (c *ClockSkewChecker) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != c.Graph || ev.Node == nil {
+		return
+	}
+
+	switch e.Type {
+	case "NodeAdded", "NodeUpdated":
+	case "NodeDeleted":
+		c.Lock()
+		delete(c.skewed, ev.Node.ID)
+		c.stats.Skewed = len(c.skewed)
+		c.Unlock()
+		return
+	default:
+		return
+	}
+
+	if _, ok := ev.Node.Metadata()[topology.ClockKey]; !ok {
+		return
+	}
+
+	c.Graph.Lock()
+	defer c.Graph.Unlock()
+
+	if n := c.Graph.GetNode(ev.Node.ID); n != nil {
+		c.check(n)
+	}
+}
+
+// OnBusEventsDropped checks all the hosts again as the missed events may
+// have changed any of them
+func (c *ClockSkewChecker) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("Clock skew checker missed %d graph events, checking all the hosts", count)
+	c.checkAll()
+}
+
+func (c *ClockSkewChecker) checkAll() {
+	c.Graph.Lock()
+	defer c.Graph.Unlock()
+
+	for _, n := range c.Graph.LookupNodes(graph.Metadata{"Type": topology.HostType}) {
+		c.check(n)
+	}
+}
+
+// Flush waits for the queued graph events to be checked
+func (c *ClockSkewChecker) Flush() {
+	if c.subscription != nil {
+		c.subscription.Flush()
+	}
+}
+
+func (c *ClockSkewChecker) Metrics() interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.stats
+}
+
+func (c *ClockSkewChecker) Start() {
+	c.subscription = common.DefaultBus.Subscribe("clock_skew_checker", config.GetConfig().GetInt("graph.bus.queue_size"), c, common.GraphTopic)
+	common.RegisterMetrics("clock_skew_checker", c.Metrics)
+
+	c.checkAll()
+}
+
+func (c *ClockSkewChecker) Stop() {
+	common.UnregisterMetrics("clock_skew_checker")
+	common.DefaultBus.Unsubscribe(c.subscription)
+}
+
+func NewClockSkewChecker(g *graph.Graph, maxOffset time.Duration) *ClockSkewChecker {
+	return &ClockSkewChecker{
+		Graph:     g,
+		MaxOffset: maxOffset,
+		skewed:    make(map[graph.Identifier]bool),
+	}
+}
+
+// NewClockSkewCheckerFromConfig returns nil if the check is disabled
+func NewClockSkewCheckerFromConfig(g *graph.Graph) *ClockSkewChecker {
+	maxOffset := time.Duration(config.GetConfig().GetInt("analyzer.clock_skew.max_offset")) * time.Millisecond
+	if maxOffset <= 0 {
+		return nil
+	}
+	return NewClockSkewChecker(g, maxOffset)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func clockSkewed(g *graph.Graph, id graph.Identifier) bool {
+	g.RLock()
+	defer g.RUnlock()
+
+	skewed, _ := g.GetNode(id).Metadata()[ClockSkewedKey].(bool)
+	return skewed
+}
+
+func setClock(g *graph.Graph, id graph.Identifier, synchronized bool, offset float64) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.AddMetadata(g.GetNode(id), topology.ClockKey, map[string]interface{}{
+		"Synchronized": synchronized,
+		"Offset":       offset,
+		"Source":       "chrony",
+	})
+}
+
+func TestClockSkew(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	g.NewNode("host1", graph.Metadata{"Type": "host", "Name": "host1"})
+	g.NewNode("host2", graph.Metadata{"Type": "host", "Name": "host2"})
+	g.NewNode("host3", graph.Metadata{"Type": "host", "Name": "host3"})
+	g.Unlock()
+
+	// the clock of host1 reported before the checker starts
+	setClock(g, "host1", true, 0.8)
+
+	c := NewClockSkewChecker(g, 500*time.Millisecond)
+	c.Start()
+	defer c.Stop()
+
+	setClock(g, "host2", true, -0.002)
+	setClock(g, "host3", false, 0)
+	c.Flush()
+
+	if !clockSkewed(g, "host1") {
+		t.Error("Host with an offset above the maximum should be flagged")
+	}
+	if clockSkewed(g, "host2") {
+		t.Error("Host in sync shouldn't be flagged")
+	}
+	if !clockSkewed(g, "host3") {
+		t.Error("Host not synchronized should be flagged")
+	}
+	if stats := c.Metrics().(ClockSkewCheckerStats); stats.Skewed != 2 {
+		t.Errorf("Wrong number of skewed hosts: %+v", stats)
+	}
+
+	// back in sync
+	setClock(g, "host1", true, 0.001)
+	setClock(g, "host2", true, -0.6)
+	c.Flush()
+
+	if clockSkewed(g, "host1") {
+		t.Error("Flag should be removed once the clock is back in sync")
+	}
+	if !clockSkewed(g, "host2") {
+		t.Error("Negative offset above the maximum should be flagged")
+	}
+}
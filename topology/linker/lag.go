@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// types of the netlink interfaces aggregating other interfaces
+var lagNetlinkTypes = []string{"bond", "team"}
+
+// metadata of the LAG nodes set by the linker
+var lagMetadataKeys = []string{
+	"Type", "Name", "BondMode", "LACP", "ActiveMember", "Members",
+	"MemberStates", "MembersCount", "HealthyMembers",
+}
+
+// LagLinker creates a logical node per LAG of a host, grouping the netlink
+// bond and the OVS bond port having the same name. The LAG node is linked
+// to its representations and to the member interfaces, and carries the
+// merged metadata so that a LAG can be queried without knowing where it
+// is implemented, ie. the LAGs with only one healthy member:
+//
+//	G.V().Has('Type', 'lag', 'HealthyMembers', 1)
+type LagLinker struct {
+	sync.RWMutex
+	// representations and members of the LAGs per host
+	nodes map[string]map[graph.Identifier]bool
+	// LAG nodes per host and name
+	lags map[string]map[string]graph.Identifier
+}
+
+func (l *LagLinker) Relevant(n *graph.Node) bool {
+	switch t, _ := n.Metadata()["Type"].(string); t {
+	case topology.LagType:
+		return false
+	case topology.OvsPortType:
+		return true
+	default:
+		for _, lt := range lagNetlinkTypes {
+			if t == lt {
+				return true
+			}
+		}
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.nodes[n.Host()][n.ID]
+}
+
+// isOvsBond returns whether the port aggregates several interfaces
+func isOvsBond(g *graph.Graph, port *graph.Node) bool {
+	if mode, _ := port.Metadata()["BondMode"].(string); mode != "" {
+		return true
+	}
+	return len(g.LookupChildren(port, nil)) > 1
+}
+
+func hostNodes(g *graph.Graph, host string, m graph.Metadata) []*graph.Node {
+	var nodes []*graph.Node
+	for _, n := range g.LookupNodes(m) {
+		if n.Host() == host {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// representations returns the netlink and OVS nodes of the LAGs of the host
+// per name, an OVS port being a representation of a LAG if it's a bond or
+// if it has the name of a netlink bond.
+func representations(g *graph.Graph, host string) map[string][]*graph.Node {
+	reps := make(map[string][]*graph.Node)
+
+	for _, t := range lagNetlinkTypes {
+		for _, n := range hostNodes(g, host, graph.Metadata{"Type": t}) {
+			if name, _ := n.Metadata()["Name"].(string); name != "" {
+				reps[name] = append(reps[name], n)
+			}
+		}
+	}
+
+	for _, port := range hostNodes(g, host, graph.Metadata{"Type": topology.OvsPortType}) {
+		name, _ := port.Metadata()["Name"].(string)
+		if name == "" {
+			continue
+		}
+		if _, ok := reps[name]; ok || isOvsBond(g, port) {
+			reps[name] = append(reps[name], port)
+		}
+	}
+
+	return reps
+}
+
+// lagMetadata merges the metadata of the representations and of the members
+// of a LAG, the member states being merged per member name as a member may
+// be seen by both netlink and OVS.
+func lagMetadata(name string, reps []*graph.Node, members []*graph.Node) graph.Metadata {
+	m := graph.Metadata{"Type": topology.LagType, "Name": name}
+
+	for _, rep := range reps {
+		for _, k := range []string{"BondMode", "LACP"} {
+			if v, ok := rep.Metadata()[k].(string); ok && v != "" {
+				if _, found := m[k]; !found {
+					m[k] = v
+				}
+			}
+		}
+	}
+
+	states := make(map[string]interface{})
+	for _, member := range members {
+		mm := member.Metadata()
+		mname, _ := mm["Name"].(string)
+		if mname == "" {
+			continue
+		}
+
+		state, ok := mm["State"].(string)
+		if !ok {
+			if _, found := states[mname]; !found {
+				states[mname] = "UNKNOWN"
+			}
+			continue
+		}
+		if states[mname] != "UP" {
+			states[mname] = state
+		}
+
+		for _, rep := range reps {
+			if active, ok := rep.Metadata()["BondActiveSlave"]; ok && common.CrossTypeEqual(active, mm["IfIndex"]) {
+				m["ActiveMember"] = mname
+			}
+		}
+	}
+
+	names := make([]string, 0, len(states))
+	var healthy int64
+	for mname, state := range states {
+		names = append(names, mname)
+		if state == "UP" {
+			healthy++
+		}
+	}
+	sort.Strings(names)
+
+	m["Members"] = names
+	m["MemberStates"] = states
+	m["MembersCount"] = int64(len(names))
+	m["HealthyMembers"] = healthy
+
+	return m
+}
+
+// lagMembers returns the interfaces aggregated by the representations, the
+// OVS interface having the name of the LAG being the netlink bond itself.
+func lagMembers(g *graph.Graph, name string, reps []*graph.Node) []*graph.Node {
+	var nodes []*graph.Node
+	seen := make(map[graph.Identifier]bool)
+
+	for _, rep := range reps {
+		seen[rep.ID] = true
+	}
+
+	for _, rep := range reps {
+		for _, child := range g.LookupChildren(rep, nil) {
+			if seen[child.ID] || child.Metadata()["Name"] == name || child.Metadata()["Type"] == topology.LagType {
+				continue
+			}
+			seen[child.ID] = true
+			nodes = append(nodes, child)
+		}
+	}
+
+	return nodes
+}
+
+// syncChildren links the LAG node to its representations and members and
+// unlinks the nodes not being part of the LAG anymore.
+func syncChildren(g *graph.Graph, lag *graph.Node, reps []*graph.Node, members []*graph.Node) {
+	wanted := make(map[graph.Identifier]string)
+	for _, n := range reps {
+		wanted[n.ID] = topology.RepresentationRelation
+	}
+	for _, n := range members {
+		wanted[n.ID] = topology.MembershipRelation
+	}
+
+	for _, child := range g.LookupChildren(lag, nil) {
+		if _, ok := wanted[child.ID]; ok {
+			delete(wanted, child.ID)
+		} else {
+			g.Unlink(lag, child)
+		}
+	}
+
+	for _, n := range append(reps, members...) {
+		if relationType, ok := wanted[n.ID]; ok {
+			g.Link(lag, n, graph.Metadata{"RelationType": relationType})
+		}
+	}
+}
+
+// setLagMetadata replaces the LAG metadata of the node, the other ones, ie.
+// set by the alerts, being kept.
+func setLagMetadata(g *graph.Graph, lag *graph.Node, m graph.Metadata) {
+	merged := make(graph.Metadata)
+	for k, v := range lag.Metadata() {
+		merged[k] = v
+	}
+	for _, k := range lagMetadataKeys {
+		delete(merged, k)
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+
+	if !reflect.DeepEqual(merged, lag.Metadata()) {
+		g.SetMetadata(lag, merged)
+	}
+}
+
+func (l *LagLinker) Link(g *graph.Graph, host string) {
+	l.Lock()
+	defer l.Unlock()
+
+	old := l.lags[host]
+	lags := make(map[string]graph.Identifier)
+	nodes := make(map[graph.Identifier]bool)
+
+	var root *graph.Node
+	if roots := hostNodes(g, host, graph.Metadata{"Type": topology.HostType}); len(roots) > 0 {
+		root = roots[0]
+	}
+
+	for name, reps := range representations(g, host) {
+		members := lagMembers(g, name, reps)
+		m := lagMetadata(name, reps, members)
+
+		id := graph.GenIDFrom(host, topology.LagType, name)
+		lag := g.GetNode(id)
+		if lag == nil {
+			if lag = g.NewNode(id, m); lag == nil {
+				continue
+			}
+		} else {
+			setLagMetadata(g, lag, m)
+		}
+		lags[name] = lag.ID
+
+		if root != nil && !g.AreLinked(root, lag) {
+			g.Link(root, lag, graph.Metadata{"RelationType": topology.OwnershipRelation})
+		}
+
+		syncChildren(g, lag, reps, members)
+
+		for _, n := range append(reps, members...) {
+			nodes[n.ID] = true
+		}
+	}
+
+	for name, id := range old {
+		if _, ok := lags[name]; ok {
+			continue
+		}
+		if lag := g.GetNode(id); lag != nil {
+			g.DelNode(lag)
+		}
+	}
+
+	if len(lags) > 0 {
+		l.lags[host] = lags
+		l.nodes[host] = nodes
+	} else {
+		delete(l.lags, host)
+		delete(l.nodes, host)
+	}
+}
+
+func NewLagLinker() *LagLinker {
+	return &LagLinker{
+		nodes: make(map[string]map[graph.Identifier]bool),
+		lags:  make(map[string]map[string]graph.Identifier),
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func lagNodes(t *testing.T, g *graph.Graph, query string) []*graph.Node {
+	g.RLock()
+	defer g.RUnlock()
+
+	ts, err := graph.NewGremlinTraversalParser(strings.NewReader(query), g).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nodes []*graph.Node
+	for _, v := range res.Values() {
+		nodes = append(nodes, v.(*graph.Node))
+	}
+	return nodes
+}
+
+func TestLagLinker(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewLinkerManager(g, NewLagLinker())
+	m.Start()
+	defer m.Stop()
+
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1"})
+
+	// linux bond plugged into OVS
+	bond := g.NewNode(graph.GenID(), graph.Metadata{"Type": "bond", "Name": "bond0", "BondMode": "active-backup", "BondActiveSlave": int64(3)})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth0", "IfIndex": int64(3), "State": "UP"})
+	eth1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth1", "IfIndex": int64(4), "State": "UP"})
+	g.Link(host, bond, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	g.Link(bond, eth0, l2)
+	g.Link(bond, eth1, l2)
+
+	port0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "ovsport", "Name": "bond0"})
+	intf0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "system", "Name": "bond0"})
+	g.Link(port0, intf0, l2)
+
+	// OVS bond
+	port1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "ovsport", "Name": "bond1", "BondMode": "balance-slb", "LACP": "active"})
+	intf1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "tap", "Name": "intf1", "State": "UP"})
+	intf2 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "tap", "Name": "intf2", "State": "DOWN"})
+	g.Link(port1, intf1, l2)
+	g.Link(port1, intf2, l2)
+
+	// not a LAG
+	port2 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "ovsport", "Name": "tap0"})
+	g.Link(port2, g.NewNode(graph.GenID(), graph.Metadata{"Type": "tap", "Name": "tap0"}), l2)
+	g.Unlock()
+
+	m.Flush()
+
+	lags := lagNodes(t, g, `G.V().Has('Type', 'lag')`)
+	if len(lags) != 2 {
+		t.Fatalf("Expected 2 LAG nodes, got: %v", lags)
+	}
+
+	g.RLock()
+	lag0 := g.LookupFirstNode(graph.Metadata{"Type": "lag", "Name": "bond0"})
+	if lag0 == nil {
+		t.Fatal("LAG node of bond0 not found")
+	}
+	lm := lag0.Metadata()
+	if lm["BondMode"] != "active-backup" || lm["ActiveMember"] != "eth0" || lm["MembersCount"] != int64(2) || lm["HealthyMembers"] != int64(2) {
+		t.Errorf("Wrong metadata of the bond0 LAG: %v", lm)
+	}
+	if !reflect.DeepEqual(lm["Members"], []string{"eth0", "eth1"}) {
+		t.Errorf("Wrong members of the bond0 LAG: %v", lm["Members"])
+	}
+	for _, n := range []*graph.Node{host, bond, port0, eth0, eth1} {
+		if !g.AreLinked(lag0, n) {
+			t.Errorf("LAG node of bond0 not linked to %s", n.Metadata()["Name"])
+		}
+	}
+	if g.AreLinked(lag0, intf0) {
+		t.Error("The OVS interface of the bond shouldn't be a member")
+	}
+	g.RUnlock()
+
+	lags = lagNodes(t, g, `G.V().Has('Type', 'lag', 'HealthyMembers', 1)`)
+	if len(lags) != 1 || lags[0].Metadata()["Name"] != "bond1" || lags[0].Metadata()["LACP"] != "active" {
+		t.Fatalf("Expected only bond1 to have one healthy member, got: %v", lags)
+	}
+
+	// the member states are followed
+	g.Lock()
+	g.AddMetadata(eth1, "State", "DOWN")
+	g.Unlock()
+
+	m.Flush()
+
+	if lags = lagNodes(t, g, `G.V().Has('Type', 'lag', 'HealthyMembers', 1)`); len(lags) != 2 {
+		t.Fatalf("Expected 2 LAGs with one healthy member, got: %v", lags)
+	}
+
+	// removing a slave and the bond
+	g.Lock()
+	g.Unlink(bond, eth1)
+	g.Unlock()
+
+	m.Flush()
+
+	g.RLock()
+	if lm := lag0.Metadata(); lm["MembersCount"] != int64(1) || g.AreLinked(lag0, eth1) {
+		t.Errorf("eth1 should have been removed from the bond0 LAG: %v", lm)
+	}
+	g.RUnlock()
+
+	g.Lock()
+	g.DelNode(port1)
+	g.Unlock()
+
+	m.Flush()
+
+	if lags = lagNodes(t, g, `G.V().Has('Type', 'lag')`); len(lags) != 1 {
+		t.Errorf("The LAG node of bond1 should have been removed: %v", lags)
+	}
+}
@@ -0,0 +1,663 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// l3Interface is an interface holding addresses, indexed by its broadcast
+// domain and its addresses
+type l3Interface struct {
+	fingerprint string
+	domain      string
+	prefixes    []*net.IPNet
+	ips         []string
+}
+
+type Layer3Stats struct {
+	Interfaces     int
+	Recomputations int64
+	LastChanged    int
+}
+
+// Layer3Manager links with layer3 edges the interfaces which can talk
+// without a router: the interfaces of the same broadcast domain whose
+// prefixes overlap, and an interface and the interface holding the
+// gateway of the default route going through it, the route being found in
+// the Routes of the host or the namespace owning the interface. The edges
+// carry the shared Prefix, and the Gateway for the default routes, the
+// edge going from the interface to its gateway. The paths can mix the
+// layer2 and layer3 edges, ie.:
+//
+//	G.V('<ID>').ShortestPathTo(Metadata('Name', 'eth1'), Metadata('RelationType', Within('layer2', 'layer3')))
+//
+// The broadcast domains have to be computed. The graph events mark the
+// interfaces and the owners of the routes as dirty, only the edges of the
+// dirty interfaces being computed again.
+type Layer3Manager struct {
+	sync.RWMutex
+	Graph        *graph.Graph
+	Delay        time.Duration
+	subscription *common.BusSubscription
+	quit         chan bool
+	dirty        map[graph.Identifier]bool
+	all          bool
+	stats        Layer3Stats
+	// the following are only used with the graph lock held
+	interfaces map[graph.Identifier]*l3Interface
+	domains    map[string]map[graph.Identifier]bool
+	addresses  map[string]map[graph.Identifier]bool
+	// gateways of the default routes per interface, the interfaces routed
+	// per owner and the interfaces routed through an address
+	gateways map[graph.Identifier][]string
+	routed   map[graph.Identifier]map[graph.Identifier]bool
+	waiting  map[string]map[graph.Identifier]bool
+}
+
+// l3Prefixes returns the prefixes of the addresses of an interface, the
+// loopback and link local addresses being left aside
+func l3Prefixes(n *graph.Node) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, key := range []string{"IPV4", "IPV6"} {
+		value, _ := n.Metadata()[key].(string)
+		for _, cidr := range strings.Split(value, ",") {
+			ip, prefix, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				continue
+			}
+			prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: prefix.Mask})
+		}
+	}
+	return prefixes
+}
+
+// sharedPrefix returns the prefix shared by two addresses, the narrowest
+// of their overlapping prefixes, false if they don't overlap
+func sharedPrefix(a, b *net.IPNet) (string, bool) {
+	na := &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+	nb := &net.IPNet{IP: b.IP.Mask(b.Mask), Mask: b.Mask}
+	if !na.Contains(nb.IP) && !nb.Contains(na.IP) {
+		return "", false
+	}
+
+	onesA, _ := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	if onesA >= onesB {
+		return na.String(), true
+	}
+	return nb.String(), true
+}
+
+// defaultGateways returns the gateways of the default routes per interface
+// name
+func defaultGateways(n *graph.Node) map[string][]string {
+	routes, _ := n.Metadata()["Routes"].([]interface{})
+
+	gateways := make(map[string][]string)
+	for _, r := range routes {
+		route, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch route["Destination"] {
+		case "default", "0.0.0.0/0", "::/0":
+		default:
+			continue
+		}
+		name, _ := route["Interface"].(string)
+		gateway, _ := route["Gateway"].(string)
+		if ip := net.ParseIP(gateway); name != "" && ip != nil {
+			gateways[name] = append(gateways[name], ip.String())
+		}
+	}
+	return gateways
+}
+
+func l3Fingerprint(n *graph.Node) string {
+	m := n.Metadata()
+	return fmt.Sprint(m["Type"], m["IPV4"], m["IPV6"], m[BroadcastDomainKey])
+}
+
+// ownedInterfaces returns the interfaces owned by a node per name
+func (m *Layer3Manager) ownedInterfaces(owner *graph.Node) map[string]*graph.Node {
+	interfaces := make(map[string]*graph.Node)
+	for _, e := range m.Graph.GetNodeEdges(owner) {
+		if e.Metadata()["RelationType"] != topology.OwnershipRelation {
+			continue
+		}
+		parent, child := m.Graph.GetEdgeNodes(e)
+		if parent == nil || child == nil || parent.ID != owner.ID || broadcastExcluded(child) {
+			continue
+		}
+		if name, _ := child.Metadata()["Name"].(string); name != "" {
+			interfaces[name] = child
+		}
+	}
+	return interfaces
+}
+
+func (m *Layer3Manager) setGateways(id graph.Identifier, gateways []string, changed map[graph.Identifier]bool) {
+	old := m.gateways[id]
+	if reflect.DeepEqual(old, gateways) {
+		return
+	}
+
+	for _, ip := range old {
+		delKey(m.waiting, ip, id)
+	}
+	for _, ip := range gateways {
+		addKey(m.waiting, ip, id)
+	}
+	if len(gateways) > 0 {
+		m.gateways[id] = gateways
+	} else {
+		delete(m.gateways, id)
+	}
+	changed[id] = true
+}
+
+// indexRoutes updates the gateways of the interfaces owned by a node from
+// its default routes
+func (m *Layer3Manager) indexRoutes(id graph.Identifier, n *graph.Node, changed map[graph.Identifier]bool) {
+	var gateways map[string][]string
+	if n != nil {
+		gateways = defaultGateways(n)
+	}
+	if len(gateways) == 0 && m.routed[id] == nil {
+		return
+	}
+
+	routed := make(map[graph.Identifier]bool)
+	if len(gateways) > 0 {
+		for name, intf := range m.ownedInterfaces(n) {
+			if ips, ok := gateways[name]; ok {
+				sort.Strings(ips)
+				routed[intf.ID] = true
+				m.setGateways(intf.ID, ips, changed)
+			}
+		}
+	}
+
+	for intf := range m.routed[id] {
+		if !routed[intf] {
+			m.setGateways(intf, nil, changed)
+		}
+	}
+	if len(routed) > 0 {
+		m.routed[id] = routed
+	} else {
+		delete(m.routed, id)
+	}
+}
+
+// index updates the domain and address indexes of an interface, the
+// interfaces routed through its old and new addresses being changed too
+func (m *Layer3Manager) index(id graph.Identifier, n *graph.Node, changed map[graph.Identifier]bool) {
+	old, known := m.interfaces[id]
+
+	var intf *l3Interface
+	if n != nil && !broadcastExcluded(n) {
+		intf = &l3Interface{fingerprint: l3Fingerprint(n)}
+		if known && intf.fingerprint == old.fingerprint {
+			return
+		}
+		intf.prefixes = l3Prefixes(n)
+		intf.domain, _ = n.Metadata()[BroadcastDomainKey].(string)
+		for _, p := range intf.prefixes {
+			intf.ips = append(intf.ips, p.IP.String())
+		}
+	}
+
+	if known {
+		delKey(m.domains, old.domain, id)
+		for _, ip := range old.ips {
+			delKey(m.addresses, ip, id)
+			for routed := range m.waiting[ip] {
+				changed[routed] = true
+			}
+		}
+		delete(m.interfaces, id)
+	}
+
+	if known || intf != nil {
+		changed[id] = true
+	}
+
+	if intf == nil {
+		if n == nil {
+			m.setGateways(id, nil, changed)
+		}
+		return
+	}
+
+	m.interfaces[id] = intf
+	if len(intf.prefixes) == 0 {
+		return
+	}
+
+	addKey(m.domains, intf.domain, id)
+	for _, ip := range intf.ips {
+		addKey(m.addresses, ip, id)
+		for routed := range m.waiting[ip] {
+			changed[routed] = true
+		}
+	}
+}
+
+// gatewaysOf returns the interfaces holding the gateways of an interface,
+// the ones of its broadcast domain being preferred, an address held by
+// several interfaces elsewhere being ambiguous
+func (m *Layer3Manager) gatewaysOf(id graph.Identifier) map[graph.Identifier]string {
+	gateways := make(map[graph.Identifier]string)
+
+	var domain string
+	if intf, ok := m.interfaces[id]; ok {
+		domain = intf.domain
+	}
+
+	for _, ip := range m.gateways[id] {
+		var local, others []graph.Identifier
+		for holder := range m.addresses[ip] {
+			if holder == id {
+				continue
+			}
+			if domain != "" && m.interfaces[holder].domain == domain {
+				local = append(local, holder)
+			} else {
+				others = append(others, holder)
+			}
+		}
+
+		if len(local) == 0 && len(others) == 1 {
+			local = others
+		}
+		for _, holder := range local {
+			gateways[holder] = ip
+		}
+	}
+	return gateways
+}
+
+// peers returns the layer3 edges of an interface per peer, an edge going
+// from the interface routed through the other
+func (m *Layer3Manager) peers(id graph.Identifier) map[graph.Identifier]*l3Edge {
+	peers := make(map[graph.Identifier]*l3Edge)
+	edge := func(peer graph.Identifier) *l3Edge {
+		e, ok := peers[peer]
+		if !ok {
+			e = &l3Edge{}
+			peers[peer] = e
+		}
+		return e
+	}
+
+	intf, ok := m.interfaces[id]
+	if ok && intf.domain != "" {
+		for peer := range m.domains[intf.domain] {
+			if peer == id {
+				continue
+			}
+			for _, shared := range sharedPrefixes(intf.prefixes, m.interfaces[peer].prefixes) {
+				edge(peer).addPrefix(shared)
+			}
+		}
+	}
+
+	for peer, ip := range m.gatewaysOf(id) {
+		e := edge(peer)
+		e.parent, e.gateway = id, ip
+	}
+
+	if ok {
+		for _, ip := range intf.ips {
+			for routed := range m.waiting[ip] {
+				if routed == id {
+					continue
+				}
+				if _, found := m.gatewaysOf(routed)[id]; found {
+					// interfaces routed through each other, the lowest
+					// being the parent
+					e := edge(routed)
+					if e.parent == "" || routed < id {
+						e.parent, e.gateway = routed, ip
+					}
+				}
+			}
+		}
+	}
+
+	// the gateways outside of the prefixes of the interface are reached
+	// through the host route to the gateway
+	for peer, e := range peers {
+		if len(e.prefixes) > 0 {
+			continue
+		}
+		if e.gateway == "" {
+			delete(peers, peer)
+			continue
+		}
+		bits := 32
+		if net.ParseIP(e.gateway).To4() == nil {
+			bits = 128
+		}
+		e.addPrefix(fmt.Sprintf("%s/%d", e.gateway, bits))
+	}
+
+	return peers
+}
+
+// l3Edge is the layer3 edge between two interfaces
+type l3Edge struct {
+	parent   graph.Identifier
+	gateway  string
+	prefixes []string
+}
+
+func (e *l3Edge) addPrefix(prefix string) {
+	for _, p := range e.prefixes {
+		if p == prefix {
+			return
+		}
+	}
+	e.prefixes = append(e.prefixes, prefix)
+	sort.Strings(e.prefixes)
+}
+
+func (e *l3Edge) metadata() graph.Metadata {
+	m := graph.Metadata{
+		"RelationType": topology.Layer3Relation,
+		"Prefix":       e.prefixes[0],
+	}
+	if len(e.prefixes) > 1 {
+		m["Prefixes"] = e.prefixes
+	}
+	if e.gateway != "" {
+		m["Gateway"] = e.gateway
+	}
+	return m
+}
+
+func sharedPrefixes(a, b []*net.IPNet) []string {
+	var shared []string
+	for _, pa := range a {
+		for _, pb := range b {
+			if prefix, ok := sharedPrefix(pa, pb); ok {
+				shared = append(shared, prefix)
+			}
+		}
+	}
+	return shared
+}
+
+// link creates, updates or deletes the layer3 edges of an interface
+func (m *Layer3Manager) link(id graph.Identifier) {
+	n := m.Graph.GetNode(id)
+	if n == nil {
+		return
+	}
+
+	peers := m.peers(id)
+
+	for _, e := range m.Graph.GetNodeEdges(n) {
+		if e.Metadata()["RelationType"] != topology.Layer3Relation {
+			continue
+		}
+
+		parent, child := m.Graph.GetEdgeNodes(e)
+		if parent == nil || child == nil {
+			continue
+		}
+		other := parent
+		if parent.ID == id {
+			other = child
+		}
+
+		wanted, ok := peers[other.ID]
+		if !ok {
+			m.Graph.DelEdge(e)
+			continue
+		}
+
+		if wanted.parent != "" && wanted.parent != parent.ID {
+			m.Graph.DelEdge(e)
+			continue
+		}
+
+		if md := wanted.metadata(); !reflect.DeepEqual(e.Metadata(), md) {
+			m.Graph.SetMetadata(e, md)
+		}
+		delete(peers, other.ID)
+	}
+
+	for peer, wanted := range peers {
+		other := m.Graph.GetNode(peer)
+		if other == nil {
+			continue
+		}
+
+		parent, child := n, other
+		if wanted.parent == peer || (wanted.parent == "" && peer < id) {
+			parent, child = other, n
+		}
+		m.Graph.Link(parent, child, wanted.metadata())
+	}
+}
+
+// recompute indexes the dirty nodes and links the interfaces whose edges
+// may have changed, the graph lock being held
+func (m *Layer3Manager) recompute(dirty map[graph.Identifier]bool) int {
+	changed := make(map[graph.Identifier]bool)
+	for id := range dirty {
+		n := m.Graph.GetNode(id)
+		m.indexRoutes(id, n, changed)
+		m.index(id, n, changed)
+	}
+
+	count := 0
+	for id, ok := range changed {
+		if ok {
+			m.link(id)
+			count++
+		}
+	}
+	return count
+}
+
+// compute computes the edges of the interfaces marked as dirty
+func (m *Layer3Manager) compute() {
+	m.Lock()
+	dirty, all := m.dirty, m.all
+	m.dirty, m.all = make(map[graph.Identifier]bool), false
+	m.Unlock()
+
+	if len(dirty) == 0 && !all {
+		return
+	}
+
+	m.Graph.Lock()
+	if all {
+		for _, n := range m.Graph.GetNodes() {
+			dirty[n.ID] = true
+		}
+		for id := range m.interfaces {
+			dirty[id] = true
+		}
+		for id := range m.routed {
+			dirty[id] = true
+		}
+		for _, e := range m.Graph.GetEdges() {
+			if e.Metadata()["RelationType"] == topology.Layer3Relation {
+				parent, child := m.Graph.GetEdgeNodes(e)
+				if parent != nil && child != nil && (m.interfaces[parent.ID] == nil || m.interfaces[child.ID] == nil) {
+					m.Graph.DelEdge(e)
+				}
+			}
+		}
+	}
+	changed := m.recompute(dirty)
+	interfaces := len(m.interfaces)
+	m.Graph.Unlock()
+
+	m.Lock()
+	m.stats.Interfaces = interfaces
+	m.stats.Recomputations++
+	m.stats.LastChanged = changed
+	m.Unlock()
+}
+
+func (m *Layer3Manager) markDirty(n *graph.Node) {
+	if n == nil {
+		return
+	}
+
+	m.Lock()
+	m.dirty[n.ID] = true
+	m.Unlock()
+}
+
+func (m *Layer3Manager) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != m.Graph {
+		return
+	}
+
+	switch e.Type {
+	case "BulkChange":
+		m.Lock()
+		m.all = true
+		m.Unlock()
+	case "NodeAdded", "NodeUpdated", "NodeDeleted":
+		m.markDirty(ev.Node)
+	default:
+		// the owners of the routes find their interfaces by the ownership
+		if ev.Edge == nil || ev.Edge.Metadata()["RelationType"] != topology.OwnershipRelation {
+			return
+		}
+		m.markDirty(ev.Parent)
+	}
+}
+
+// OnBusEventsDropped computes all the edges again as the missed events may
+// have changed any of them
+func (m *Layer3Manager) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("Layer3 edges missed %d graph events, computing all the edges", count)
+
+	m.Lock()
+	m.all = true
+	m.Unlock()
+}
+
+// Flush waits for the queued graph events and computes the edges of the
+// dirty interfaces
+func (m *Layer3Manager) Flush() {
+	if m.subscription != nil {
+		m.subscription.Flush()
+	}
+	m.compute()
+}
+
+func (m *Layer3Manager) Metrics() interface{} {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.stats
+}
+
+func (m *Layer3Manager) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(m.Delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.compute()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *Layer3Manager) Start() {
+	m.Lock()
+	m.all = true
+	m.Unlock()
+
+	m.subscription = common.DefaultBus.Subscribe("layer3", config.GetConfig().GetInt("graph.bus.queue_size"), m, common.GraphTopic)
+	common.RegisterMetrics("layer3", m.Metrics)
+
+	go m.run()
+}
+
+func (m *Layer3Manager) Stop() {
+	close(m.quit)
+	common.UnregisterMetrics("layer3")
+	common.DefaultBus.Unsubscribe(m.subscription)
+}
+
+func NewLayer3Manager(g *graph.Graph, delay time.Duration) *Layer3Manager {
+	return &Layer3Manager{
+		Graph:      g,
+		Delay:      delay,
+		quit:       make(chan bool),
+		dirty:      make(map[graph.Identifier]bool),
+		interfaces: make(map[graph.Identifier]*l3Interface),
+		domains:    make(map[string]map[graph.Identifier]bool),
+		addresses:  make(map[string]map[graph.Identifier]bool),
+		gateways:   make(map[graph.Identifier][]string),
+		routed:     make(map[graph.Identifier]map[graph.Identifier]bool),
+		waiting:    make(map[string]map[graph.Identifier]bool),
+	}
+}
+
+// NewLayer3ManagerFromConfig returns nil if the computation is disabled,
+// the layer3 edges of the shared prefixes needing the broadcast domains
+func NewLayer3ManagerFromConfig(g *graph.Graph) *Layer3Manager {
+	if !config.GetConfig().GetBool("analyzer.layer3.enabled") {
+		return nil
+	}
+
+	if !config.GetConfig().GetBool("analyzer.broadcast_domains.enabled") {
+		logging.GetLogger().Warning("Broadcast domains disabled, only the layer3 edges of the default routes will be computed")
+	}
+
+	delay := time.Duration(config.GetConfig().GetInt("analyzer.layer3.delay")) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return NewLayer3Manager(g, delay)
+}
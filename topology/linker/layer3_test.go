@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newLayer3Graph(t *testing.T) (*graph.Graph, *Layer3Manager) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewLayer3Manager(g, time.Hour)
+	m.Start()
+
+	return g, m
+}
+
+// layer3Edges returns the layer3 edges of an interface per peer name
+func layer3Edges(g *graph.Graph, n *graph.Node) map[string]*graph.Edge {
+	g.RLock()
+	defer g.RUnlock()
+
+	edges := make(map[string]*graph.Edge)
+	for _, e := range g.GetNodeEdges(n) {
+		if e.Metadata()["RelationType"] != topology.Layer3Relation {
+			continue
+		}
+		parent, child := g.GetEdgeNodes(e)
+		other := parent
+		if parent.ID == n.ID {
+			other = child
+		}
+		edges[other.Metadata()["Name"].(string)] = e
+	}
+	return edges
+}
+
+func TestLayer3SharedPrefixes(t *testing.T) {
+	g, m := newLayer3Graph(t)
+	defer m.Stop()
+
+	g.Lock()
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth0", "IPV4": "10.0.0.1/24", BroadcastDomainKey: "bd1"})
+	eth1 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth1", "IPV4": "10.0.0.2/16,192.168.1.2/24", BroadcastDomainKey: "bd1"})
+	eth2 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth2", "IPV4": "192.168.2.1/24", BroadcastDomainKey: "bd1"})
+	// same prefix in another domain
+	eth3 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth3", "IPV4": "10.0.0.3/24", BroadcastDomainKey: "bd2"})
+	lo := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "lo", "IPV4": "127.0.0.1/8", BroadcastDomainKey: "bd1"})
+	g.Unlock()
+	m.Flush()
+
+	edges := layer3Edges(g, eth0)
+	if len(edges) != 1 || edges["eth1"] == nil {
+		t.Fatalf("eth0 should only be linked to eth1: %v", edges)
+	}
+	if prefix := edges["eth1"].Metadata()["Prefix"]; prefix != "10.0.0.0/24" {
+		t.Errorf("Wrong shared prefix: %v", prefix)
+	}
+	for _, n := range []*graph.Node{eth2, eth3, lo} {
+		if edges := layer3Edges(g, n); len(edges) != 0 {
+			t.Errorf("%s shouldn't be linked: %v", n.Metadata()["Name"], edges)
+		}
+	}
+
+	// recomputed on the address changes
+	g.Lock()
+	g.AddMetadata(eth2, "IPV4", "192.168.1.1/24")
+	g.AddMetadata(eth0, "IPV4", "172.16.0.1/24")
+	g.Unlock()
+	m.Flush()
+
+	if edges := layer3Edges(g, eth0); len(edges) != 0 {
+		t.Errorf("eth0 shouldn't be linked anymore: %v", edges)
+	}
+	edges = layer3Edges(g, eth2)
+	if len(edges) != 1 || edges["eth1"] == nil || edges["eth1"].Metadata()["Prefix"] != "192.168.1.0/24" {
+		t.Errorf("eth2 should be linked to eth1: %v", edges)
+	}
+
+	// and on the changes of broadcast domain
+	g.Lock()
+	g.AddMetadata(eth2, BroadcastDomainKey, "bd2")
+	g.Unlock()
+	m.Flush()
+
+	if edges := layer3Edges(g, eth1); len(edges) != 0 {
+		t.Errorf("eth1 shouldn't be linked anymore: %v", edges)
+	}
+}
+
+func TestLayer3DefaultRoute(t *testing.T) {
+	g, m := newLayer3Graph(t)
+	defer m.Stop()
+
+	ownership := graph.Metadata{"RelationType": topology.OwnershipRelation}
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.HostType, "Name": "host1"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth0", "IPV4": "10.0.0.1/24", BroadcastDomainKey: "bd1"})
+	g.Link(host, eth0, ownership)
+	router := g.NewNode(graph.GenID(), graph.Metadata{"Type": topology.HostType, "Name": "router"})
+	gw := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "gw0", "IPV4": "10.0.0.254/24", BroadcastDomainKey: "bd1"})
+	uplink := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "uplink", "IPV4": "203.0.113.2/30"})
+	g.Link(router, gw, ownership)
+	g.Link(router, uplink, ownership)
+	g.Link(gw, uplink, l2)
+	g.AddMetadata(host, "Routes", []interface{}{
+		map[string]interface{}{"Destination": "10.0.0.0/24", "Interface": "eth0", "Family": "IPv4"},
+		map[string]interface{}{"Destination": "default", "Interface": "eth0", "Gateway": "10.0.0.254", "Family": "IPv4"},
+	})
+	g.Unlock()
+	m.Flush()
+
+	edges := layer3Edges(g, eth0)
+	e := edges["gw0"]
+	if len(edges) != 1 || e == nil {
+		t.Fatalf("eth0 should be linked to its gateway: %v", edges)
+	}
+	if e.Metadata()["Gateway"] != "10.0.0.254" || e.Metadata()["Prefix"] != "10.0.0.0/24" {
+		t.Errorf("Wrong gateway edge: %v", e.Metadata())
+	}
+	g.RLock()
+	if parent, _ := g.GetEdgeNodes(e); parent.ID != eth0.ID {
+		t.Error("Gateway edge should go from the interface to its gateway")
+	}
+
+	// the uplink of the router is reached through the layer3 then the
+	// layer2 edges
+	path := g.LookupShortestPath(eth0, graph.Metadata{"Name": "uplink"}, graph.Metadata{"RelationType": graph.Within(topology.Layer2Relation, topology.Layer3Relation)})
+	g.RUnlock()
+	if len(path) != 3 || path[1].ID != gw.ID {
+		t.Errorf("Path mixing layer2 and layer3 edges expected: %v", path)
+	}
+
+	// gateway outside of the domain, reached by its host route
+	g.Lock()
+	g.AddMetadata(gw, BroadcastDomainKey, "bd2")
+	g.Unlock()
+	m.Flush()
+
+	if e := layer3Edges(g, eth0)["gw0"]; e == nil || e.Metadata()["Prefix"] != "10.0.0.254/32" {
+		t.Errorf("eth0 should be linked to its gateway by its host route: %v", e)
+	}
+
+	// route removed
+	g.Lock()
+	g.AddMetadata(host, "Routes", []interface{}{
+		map[string]interface{}{"Destination": "10.0.0.0/24", "Interface": "eth0", "Family": "IPv4"},
+	})
+	g.Unlock()
+	m.Flush()
+
+	if edges := layer3Edges(g, eth0); len(edges) != 0 {
+		t.Errorf("eth0 shouldn't be linked anymore: %v", edges)
+	}
+
+	// gateway address known once the gateway interface shows up
+	g.Lock()
+	g.DelNode(gw)
+	g.AddMetadata(host, "Routes", []interface{}{
+		map[string]interface{}{"Destination": "default", "Interface": "eth0", "Gateway": "10.0.0.254", "Family": "IPv4"},
+	})
+	g.Unlock()
+	m.Flush()
+
+	if edges := layer3Edges(g, eth0); len(edges) != 0 {
+		t.Errorf("Unknown gateway shouldn't be linked: %v", edges)
+	}
+
+	g.Lock()
+	g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "gw1", "IPV4": "10.0.0.254/24", BroadcastDomainKey: "bd1"})
+	g.Unlock()
+	m.Flush()
+
+	if e := layer3Edges(g, eth0)["gw1"]; e == nil || e.Metadata()["Gateway"] != "10.0.0.254" {
+		t.Errorf("eth0 should be linked to its new gateway: %v", layer3Edges(g, eth0))
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Linker derives logical nodes and edges from the nodes of a host, ie. a
+// node grouping several interfaces. The derived nodes belong to the host
+// of the analyzer.
+type Linker interface {
+	// Relevant returns whether the node, or an edge from or to the node,
+	// may change the derived nodes of its host
+	Relevant(n *graph.Node) bool
+	// Link creates, updates or deletes the derived nodes of the host, the
+	// graph lock being held
+	Link(g *graph.Graph, host string)
+}
+
+// LinkerManager runs the linkers for the hosts of the nodes and edges of
+// the graph events. The events are consumed from the bus, the changes made
+// by the linkers being made outside of the graph listeners.
+type LinkerManager struct {
+	Graph        *graph.Graph
+	linkers      []Linker
+	subscription *common.BusSubscription
+}
+
+// link calls the linkers to which the node is relevant
+func (m *LinkerManager) link(n *graph.Node) {
+	if n == nil || n.Host() == "" {
+		return
+	}
+
+	var linkers []Linker
+	for _, l := range m.linkers {
+		if l.Relevant(n) {
+			linkers = append(linkers, l)
+		}
+	}
+
+	if len(linkers) == 0 {
+		return
+	}
+
+	m.Graph.Lock()
+	defer m.Graph.Unlock()
+
+	for _, l := range linkers {
+		l.Link(m.Graph, n.Host())
+	}
+}
+
+func (m *LinkerManager) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != m.Graph {
+		return
+	}
+
+	if e.Type == "BulkChange" {
+		m.linkAll()
+		return
+	}
+
+	if ev.Node != nil {
+		m.link(ev.Node)
+		return
+	}
+
+	m.link(ev.Parent)
+	if ev.Child != nil && (ev.Parent == nil || ev.Child.Host() != ev.Parent.Host()) {
+		m.link(ev.Child)
+	}
+}
+
+// OnBusEventsDropped links all the hosts again as the missed events may
+// have changed any of them
+func (m *LinkerManager) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("Linkers missed %d graph events, linking all the hosts", count)
+	m.linkAll()
+}
+
+// linkAll links all the hosts, the events of a bulk change being replaced
+// by a single one
+func (m *LinkerManager) linkAll() {
+	m.Graph.Lock()
+	defer m.Graph.Unlock()
+
+	hosts := make(map[string]bool)
+	for _, n := range m.Graph.GetNodes() {
+		hosts[n.Host()] = true
+	}
+	delete(hosts, "")
+
+	for host := range hosts {
+		for _, l := range m.linkers {
+			l.Link(m.Graph, host)
+		}
+	}
+}
+
+// Flush waits for the queued graph events to be handled by the linkers
+func (m *LinkerManager) Flush() {
+	if m.subscription != nil {
+		m.subscription.Flush()
+	}
+}
+
+func (m *LinkerManager) Start() {
+	m.subscription = common.DefaultBus.Subscribe("linker", config.GetConfig().GetInt("graph.bus.queue_size"), m, common.GraphTopic)
+}
+
+func (m *LinkerManager) Stop() {
+	common.DefaultBus.Unsubscribe(m.subscription)
+}
+
+func NewLinkerManager(g *graph.Graph, linkers ...Linker) *LinkerManager {
+	return &LinkerManager{
+		Graph:   g,
+		linkers: linkers,
+	}
+}
+
+// NewLinkerManagerFromConfig returns nil if no linker is enabled
+func NewLinkerManagerFromConfig(g *graph.Graph) *LinkerManager {
+	var linkers []Linker
+	for _, name := range config.GetConfig().GetStringSlice("analyzer.linkers") {
+		switch name {
+		case "lag":
+			linkers = append(linkers, NewLagLinker())
+		case "sriov":
+			linkers = append(linkers, NewSRIOVLinker())
+		default:
+			logging.GetLogger().Errorf("Unknown linker: %s", name)
+		}
+	}
+
+	if len(linkers) == 0 {
+		return nil
+	}
+	return NewLinkerManager(g, linkers...)
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Metadata set on the layer2 edges whose interfaces disagree, the list of
+// the metadata they disagree on along with a flag, as MTUMismatch
+const (
+	LinkMismatchKey = "LinkMismatch"
+	MismatchKey     = "Mismatch"
+)
+
+// linkStateKeys are the metadata compared, the administrative and the
+// operational states, the speed and the duplex
+var linkStateKeys = []string{"State", "OperState", "Speed", "Duplex"}
+
+// speedlessTypes are the types of the nodes whose speed and duplex aren't
+// the ones of a link, ie. an OVS port or the bond aggregating its slaves
+var speedlessTypes = map[string]bool{
+	topology.BridgeType:      true,
+	topology.OpenvswitchType: true,
+	topology.OvsBridgeType:   true,
+	topology.OvsPortType:     true,
+	topology.LagType:         true,
+	"bond":                   true,
+}
+
+// LinkMismatch is a layer2 edge whose interfaces disagree on their state,
+// their speed or their duplex, with the values of both sides
+type LinkMismatch struct {
+	Edge     graph.Identifier
+	Host     string
+	Parent   graph.Identifier
+	Child    graph.Identifier
+	Mismatch []string
+	Values   map[string][]interface{}
+}
+
+// ReferredNodes returns the interfaces at both ends of the edge
+func (m *LinkMismatch) ReferredNodes() []graph.Identifier {
+	return []graph.Identifier{m.Parent, m.Child}
+}
+
+type LinkStateCheckerStats struct {
+	Mismatches int
+	Checks     int64
+}
+
+// LinkStateChecker compares the interfaces at both ends of the layer2
+// edges, ie. the peers of a veth or a bridge and its ports. The edges whose
+// interfaces disagree, one being down while the other is up or with
+// different speeds or duplexes, are flagged with LinkMismatch and the list
+// of the metadata they disagree on, the flags being removed once they
+// agree:
+//
+//	G.E().Has('LinkMismatch', true)
+//
+// The metadata missing on one side aren't compared, nor the speed and
+// duplex of the bridges, the OVS ports and the bonds, an unknown
+// operational state being the one of the interfaces not reporting it. The
+// graph events mark the interfaces and the edges as dirty, only the edges
+// changed and the ones of the interfaces changed being checked again.
+type LinkStateChecker struct {
+	sync.RWMutex
+	Graph        *graph.Graph
+	Delay        time.Duration
+	subscription *common.BusSubscription
+	quit         chan bool
+	dirtyNodes   map[graph.Identifier]bool
+	dirtyEdges   map[graph.Identifier]bool
+	all          bool
+	stats        LinkStateCheckerStats
+	mismatches   map[graph.Identifier]*LinkMismatch
+}
+
+// compareLinkState returns the metadata two interfaces disagree on and the
+// values of both sides
+func compareLinkState(parent, child *graph.Node) ([]string, map[string][]interface{}) {
+	pm, cm := parent.Metadata(), child.Metadata()
+	pt, _ := pm["Type"].(string)
+	ct, _ := cm["Type"].(string)
+
+	var keys []string
+	values := make(map[string][]interface{})
+	for _, key := range linkStateKeys {
+		pv, cv := pm[key], cm[key]
+		if pv == nil || cv == nil {
+			continue
+		}
+
+		switch key {
+		case "OperState":
+			if pv == "unknown" || cv == "unknown" {
+				continue
+			}
+		case "Speed", "Duplex":
+			if speedlessTypes[pt] || speedlessTypes[ct] {
+				continue
+			}
+		}
+
+		if key == "Speed" {
+			ps, _ := metadataInt(pm, key)
+			cs, _ := metadataInt(cm, key)
+			if ps == cs {
+				continue
+			}
+		} else if reflect.DeepEqual(pv, cv) {
+			continue
+		}
+
+		keys = append(keys, key)
+		values[key] = []interface{}{pv, cv}
+	}
+
+	return keys, values
+}
+
+// isLinkStateEdge returns whether the interfaces of an edge are compared
+func isLinkStateEdge(e *graph.Edge) bool {
+	return e.Metadata()["RelationType"] == topology.Layer2Relation && e.Metadata()["Type"] != topology.VrfType
+}
+
+// check compares the interfaces of an edge and flags it, the graph lock
+// being held
+func (c *LinkStateChecker) check(e *graph.Edge, mismatches map[graph.Identifier]*LinkMismatch) {
+	var keys []string
+	var values map[string][]interface{}
+
+	parent, child := c.Graph.GetEdgeNodes(e)
+	if parent != nil && child != nil && isLinkStateEdge(e) {
+		keys, values = compareLinkState(parent, child)
+	}
+
+	m := make(graph.Metadata)
+	for k, v := range e.Metadata() {
+		if k != LinkMismatchKey && k != MismatchKey {
+			m[k] = v
+		}
+	}
+
+	if len(keys) > 0 {
+		list := make([]interface{}, len(keys))
+		for i, key := range keys {
+			list[i] = key
+		}
+		m[LinkMismatchKey], m[MismatchKey] = true, list
+
+		mismatches[e.ID] = &LinkMismatch{Edge: e.ID, Host: e.Host(), Parent: parent.ID, Child: child.ID, Mismatch: keys, Values: values}
+	} else {
+		delete(mismatches, e.ID)
+	}
+
+	if !reflect.DeepEqual(m, e.Metadata()) {
+		c.Graph.SetMetadata(e, m)
+	}
+}
+
+// compute checks the edges marked as dirty and the ones of the interfaces
+// marked as dirty
+func (c *LinkStateChecker) compute() {
+	c.Lock()
+	nodes, edges, all := c.dirtyNodes, c.dirtyEdges, c.all
+	c.dirtyNodes, c.dirtyEdges, c.all = make(map[graph.Identifier]bool), make(map[graph.Identifier]bool), false
+	mismatches := make(map[graph.Identifier]*LinkMismatch, len(c.mismatches))
+	for id, m := range c.mismatches {
+		mismatches[id] = m
+	}
+	c.Unlock()
+
+	if len(nodes) == 0 && len(edges) == 0 && !all {
+		return
+	}
+
+	c.Graph.Lock()
+	if all {
+		for _, e := range c.Graph.GetEdges() {
+			edges[e.ID] = true
+		}
+		for id := range mismatches {
+			edges[id] = true
+		}
+	}
+	for id := range nodes {
+		if n := c.Graph.GetNode(id); n != nil {
+			for _, e := range c.Graph.GetNodeEdges(n) {
+				edges[e.ID] = true
+			}
+		}
+	}
+	for id := range edges {
+		if e := c.Graph.GetEdge(id); e != nil {
+			c.check(e, mismatches)
+		} else {
+			delete(mismatches, id)
+		}
+	}
+	c.Graph.Unlock()
+
+	c.Lock()
+	c.mismatches = mismatches
+	c.stats.Mismatches = len(mismatches)
+	c.stats.Checks += int64(len(edges))
+	c.Unlock()
+}
+
+func (c *LinkStateChecker) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != c.Graph {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch e.Type {
+	case "BulkChange":
+		c.all = true
+	case "NodeUpdated":
+		if ev.Node != nil {
+			c.dirtyNodes[ev.Node.ID] = true
+		}
+	case "EdgeAdded", "EdgeDeleted":
+		// the updates of the edges are left aside, ie. the flags set by
+		// the checker itself
+		if ev.Edge != nil {
+			c.dirtyEdges[ev.Edge.ID] = true
+		}
+	}
+}
+
+// OnBusEventsDropped checks all the edges again as the missed events may
+// have changed any of them
+func (c *LinkStateChecker) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("Link state checker missed %d graph events, checking all the edges", count)
+
+	c.Lock()
+	c.all = true
+	c.Unlock()
+}
+
+// Flush waits for the queued graph events and checks the dirty edges
+func (c *LinkStateChecker) Flush() {
+	if c.subscription != nil {
+		c.subscription.Flush()
+	}
+	c.compute()
+}
+
+// LinkMismatches returns the edges whose interfaces disagree, sorted by
+// edge
+func (c *LinkStateChecker) LinkMismatches() []interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	ids := make([]string, 0, len(c.mismatches))
+	for id := range c.mismatches {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+
+	mismatches := make([]interface{}, len(ids))
+	for i, id := range ids {
+		mismatches[i] = c.mismatches[graph.Identifier(id)]
+	}
+	return mismatches
+}
+
+func (c *LinkStateChecker) Metrics() interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.stats
+}
+
+func (c *LinkStateChecker) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(c.Delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.compute()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *LinkStateChecker) Start() {
+	c.Lock()
+	c.all = true
+	c.Unlock()
+
+	c.subscription = common.DefaultBus.Subscribe("link_state_checker", config.GetConfig().GetInt("graph.bus.queue_size"), c, common.GraphTopic)
+	common.RegisterMetrics("link_state_checker", c.Metrics)
+
+	go c.run()
+}
+
+func (c *LinkStateChecker) Stop() {
+	close(c.quit)
+	common.UnregisterMetrics("link_state_checker")
+	common.DefaultBus.Unsubscribe(c.subscription)
+}
+
+func NewLinkStateChecker(g *graph.Graph, delay time.Duration) *LinkStateChecker {
+	return &LinkStateChecker{
+		Graph:      g,
+		Delay:      delay,
+		quit:       make(chan bool),
+		dirtyNodes: make(map[graph.Identifier]bool),
+		dirtyEdges: make(map[graph.Identifier]bool),
+		mismatches: make(map[graph.Identifier]*LinkMismatch),
+	}
+}
+
+// NewLinkStateCheckerFromConfig returns nil if the check is disabled
+func NewLinkStateCheckerFromConfig(g *graph.Graph) *LinkStateChecker {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("analyzer.link_state.enabled") {
+		return nil
+	}
+
+	delay := time.Duration(cfg.GetInt("analyzer.link_state.delay")) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return NewLinkStateChecker(g, delay)
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func newLinkStateGraph(t *testing.T) (*graph.Graph, *LinkStateChecker) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewLinkStateChecker(g, time.Hour)
+	c.Start()
+
+	l2 := graph.Metadata{"RelationType": topology.Layer2Relation}
+
+	g.Lock()
+	veth0 := g.NewNode("veth0", graph.Metadata{"Type": "veth", "State": "UP", "OperState": "up", "Speed": int64(10000), "Duplex": "full"})
+	veth1 := g.NewNode("veth1", graph.Metadata{"Type": "veth", "State": "UP", "OperState": "up", "Speed": int64(10000), "Duplex": "full"})
+	g.NewEdge("veth0-veth1", veth0, veth1, graph.Metadata{"RelationType": topology.Layer2Relation, "Type": "veth"})
+
+	br0 := g.NewNode("br0", graph.Metadata{"Type": "bridge", "State": "UP", "OperState": "up"})
+	eth0 := g.NewNode("eth0", graph.Metadata{"Type": "device", "State": "UP", "OperState": "up", "Speed": int64(1000), "Duplex": "full"})
+	g.NewEdge("br0-eth0", br0, eth0, l2)
+
+	ovsbr := g.NewNode("ovsbr", graph.Metadata{"Type": "ovsbridge"})
+	port := g.NewNode("port", graph.Metadata{"Type": "ovsport"})
+	tap := g.NewNode("tap", graph.Metadata{"Type": "tun", "State": "UP", "OperState": "unknown", "Speed": int64(10), "Duplex": "full"})
+	g.NewEdge("ovsbr-port", ovsbr, port, l2)
+	g.NewEdge("port-tap", port, tap, l2)
+	g.Unlock()
+
+	c.Flush()
+
+	return g, c
+}
+
+func edgeMismatch(g *graph.Graph, id graph.Identifier) interface{} {
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.GetEdge(id).Metadata()[MismatchKey]
+}
+
+func TestLinkStateMismatch(t *testing.T) {
+	g, c := newLinkStateGraph(t)
+	defer c.Stop()
+
+	if mismatches := c.LinkMismatches(); len(mismatches) != 0 {
+		t.Fatalf("No mismatch expected: %v", mismatches)
+	}
+
+	// the peer of the veth down and renegotiated
+	g.Lock()
+	g.AddMetadata(g.GetNode("veth1"), "State", "DOWN")
+	g.AddMetadata(g.GetNode("veth1"), "Speed", float64(1000))
+	g.AddMetadata(g.GetNode("tap"), "Duplex", "half")
+	g.Unlock()
+
+	c.Flush()
+
+	if m := edgeMismatch(g, "veth0-veth1"); !reflect.DeepEqual(m, []interface{}{"State", "Speed"}) {
+		t.Errorf("Veth should mismatch on its state and its speed: %v", m)
+	}
+	if m := edgeMismatch(g, "port-tap"); m != nil {
+		t.Errorf("An OVS port has no speed nor duplex: %v", m)
+	}
+
+	// the bridge down
+	g.Lock()
+	g.AddMetadata(g.GetNode("br0"), "State", "DOWN")
+	g.AddMetadata(g.GetNode("br0"), "OperState", "down")
+	g.Unlock()
+
+	c.Flush()
+
+	mismatches := c.LinkMismatches()
+	if len(mismatches) != 2 {
+		t.Fatalf("Expected the veth and the bridge port edges: %v", mismatches)
+	}
+	if m := mismatches[0].(*LinkMismatch); m.Edge != "br0-eth0" || !reflect.DeepEqual(m.Mismatch, []string{"State", "OperState"}) || !reflect.DeepEqual(m.Values["State"], []interface{}{"DOWN", "UP"}) {
+		t.Errorf("Wrong bridge port mismatch: %+v", m)
+	}
+
+	g.RLock()
+	if e := g.GetEdge("br0-eth0"); e.Metadata()[LinkMismatchKey] != true {
+		t.Errorf("Edge should be flagged: %v", e.Metadata())
+	}
+	g.RUnlock()
+
+	// converged
+	g.Lock()
+	g.AddMetadata(g.GetNode("veth1"), "State", "UP")
+	g.AddMetadata(g.GetNode("veth1"), "Speed", int64(10000))
+	g.AddMetadata(g.GetNode("br0"), "State", "UP")
+	g.AddMetadata(g.GetNode("br0"), "OperState", "up")
+	g.Unlock()
+
+	c.Flush()
+
+	if mismatches := c.LinkMismatches(); len(mismatches) != 0 {
+		t.Errorf("No mismatch expected anymore: %v", mismatches)
+	}
+
+	g.RLock()
+	for _, e := range g.GetEdges() {
+		if _, ok := e.Metadata()[LinkMismatchKey]; ok {
+			t.Errorf("Flags should have been removed: %v", e)
+		}
+	}
+	g.RUnlock()
+}
+
+func TestLinkStateIncremental(t *testing.T) {
+	g, c := newLinkStateGraph(t)
+	defer c.Stop()
+
+	before := c.Metrics().(LinkStateCheckerStats).Checks
+
+	g.Lock()
+	g.AddMetadata(g.GetNode("eth0"), "Duplex", "half")
+	g.Unlock()
+
+	c.Flush()
+
+	// only the edge of the interface changed
+	if stats := c.Metrics().(LinkStateCheckerStats); stats.Checks-before != 1 || stats.Mismatches != 0 {
+		t.Errorf("Expected a single edge checked, without mismatch as a bridge has no duplex: %+v", stats)
+	}
+
+	// the edge deleted is not reported anymore
+	g.Lock()
+	g.AddMetadata(g.GetNode("veth0"), "State", "DOWN")
+	g.Unlock()
+	c.Flush()
+
+	g.Lock()
+	g.DelEdge(g.GetEdge("veth0-veth1"))
+	g.Unlock()
+	c.Flush()
+
+	if mismatches := c.LinkMismatches(); len(mismatches) != 0 {
+		t.Errorf("Mismatch of the edge deleted should be dropped: %v", mismatches)
+	}
+}
@@ -0,0 +1,688 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Metadata set on the interfaces unable to carry the frames emitted in
+// their segment, along with the MTU expected and the one they carry, and
+// on the layer2 edges between interfaces of different MTUs
+const (
+	MTUMismatchKey  = "MTUMismatch"
+	MTUExpectedKey  = "MTUExpected"
+	MTUEffectiveKey = "MTUEffective"
+)
+
+// DefaultEncapOverheads are the bytes added by the encapsulation of the
+// tunnel types, on top of the frames they carry
+var DefaultEncapOverheads = map[string]int64{
+	"vxlan":  50,
+	"geneve": 50,
+	"gre":    24,
+	"gretap": 38,
+	"ip6gre": 44,
+}
+
+// MTUViolation is an interface carrying smaller frames than the ones
+// emitted in its segment. The effective MTU of a tunnel is lowered by the
+// MTU of its underlay interface minus the encapsulation overhead.
+type MTUViolation struct {
+	Node      graph.Identifier
+	Host      string
+	Name      string
+	Type      string
+	MTU       int64
+	Effective int64
+	Expected  int64
+	Underlay  graph.Identifier `json:",omitempty"`
+	Overhead  int64            `json:",omitempty"`
+}
+
+// MTUReport is the MTU check of a layer2 segment: the largest frames
+// emitted by its interfaces, the largest frames carried end to end and the
+// interfaces dropping the frames in between.
+type MTUReport struct {
+	Segment    string
+	Members    int
+	Hosts      []string
+	EmittedMTU int64
+	PathMTU    int64
+	Violations []MTUViolation
+	members    []graph.Identifier
+}
+
+// ReferredNodes returns the interfaces of the segment
+func (r *MTUReport) ReferredNodes() []graph.Identifier {
+	return r.members
+}
+
+type MTUCheckerStats struct {
+	Segments       int
+	Violations     int
+	Recomputations int64
+	LastVisited    int
+}
+
+// mtuKeys are the keys under which the interface is indexed
+type mtuKeys struct {
+	fingerprint string
+	tunnel      string
+	peer        string
+	vni         string
+	local       string
+	addresses   []string
+}
+
+type mtuSegment struct {
+	members []graph.Identifier
+	edges   []graph.Identifier
+	report  *MTUReport
+}
+
+// MTUChecker checks the MTUs along the layer2 segments spanning the hosts,
+// flooded over the layer2 edges and joined by the tunnels the same way as
+// the broadcast domains. The frames emitted by an interface of a segment
+// may go through any other one, the interfaces whose MTU, or whose
+// underlay MTU minus the encapsulation overhead for a tunnel, is lower
+// than the largest MTU of the segment are flagged with MTUMismatch, ie.
+// the VXLANs dropping the frames of their bridge:
+//
+//	G.V().Has('MTUMismatch', true)
+//
+// The underlay of a tunnel is the interface of its host holding its
+// LocalIP. The graph events mark the interfaces as dirty, only the
+// segments of the dirty interfaces and of the tunnels they are the
+// underlay of being checked again.
+type MTUChecker struct {
+	sync.RWMutex
+	Graph        *graph.Graph
+	Delay        time.Duration
+	Overheads    map[string]int64
+	subscription *common.BusSubscription
+	quit         chan bool
+	// interfaces changed since the last check, true if an edge of the
+	// interface changed
+	dirty map[graph.Identifier]bool
+	all   bool
+	stats MTUCheckerStats
+	// reports of the segments having violations, per segment
+	reports map[string]*MTUReport
+	// the following are only used with the graph lock held
+	keys      map[graph.Identifier]mtuKeys
+	tunnels   map[string]map[graph.Identifier]bool
+	vnis      map[string]map[graph.Identifier]bool
+	locals    map[string]map[graph.Identifier]bool
+	addresses map[string]map[graph.Identifier]bool
+	segments  map[string]*mtuSegment
+	segmentOf map[graph.Identifier]string
+}
+
+// metadataInt returns an integer of the metadata, the numbers decoded from
+// JSON being floats
+func metadataInt(m graph.Metadata, key string) (int64, bool) {
+	switch v := m[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func hostKey(host, value string) string {
+	return host + "|" + value
+}
+
+func mtuFingerprint(n *graph.Node) string {
+	m := n.Metadata()
+	return fmt.Sprint(m["Type"], m["MTU"], m["LocalIP"], m["RemoteIP"], m["TunnelKey"], m["VNI"], m["IPV4"])
+}
+
+// index updates the indexes of an interface, returns the addresses it had
+// or has, their tunnels being checked again, and false if the interface
+// didn't change
+func (c *MTUChecker) index(id graph.Identifier, n *graph.Node) ([]string, bool) {
+	old, known := c.keys[id]
+
+	if n == nil || broadcastExcluded(n) {
+		if !known {
+			return nil, false
+		}
+		c.unindex(id, old)
+		delete(c.keys, id)
+		return old.addresses, true
+	}
+
+	keys := mtuKeys{fingerprint: mtuFingerprint(n)}
+	if known && keys.fingerprint == old.fingerprint {
+		return nil, false
+	}
+
+	keys.tunnel, keys.peer = tunnelKeys(n)
+	if vni := n.Metadata()["VNI"]; vni != nil {
+		keys.vni = fmt.Sprint(vni)
+	}
+	if local, _ := n.Metadata()["LocalIP"].(string); local != "" {
+		keys.local = hostKey(n.Host(), local)
+	}
+	for _, ip := range nodeIPs(n) {
+		keys.addresses = append(keys.addresses, hostKey(n.Host(), ip))
+	}
+
+	c.unindex(id, old)
+	addKey(c.tunnels, keys.tunnel, id)
+	addKey(c.vnis, keys.vni, id)
+	addKey(c.locals, keys.local, id)
+	for _, address := range keys.addresses {
+		addKey(c.addresses, address, id)
+	}
+	c.keys[id] = keys
+
+	return append(old.addresses, keys.addresses...), true
+}
+
+func (c *MTUChecker) unindex(id graph.Identifier, keys mtuKeys) {
+	delKey(c.tunnels, keys.tunnel, id)
+	delKey(c.vnis, keys.vni, id)
+	delKey(c.locals, keys.local, id)
+	for _, address := range keys.addresses {
+		delKey(c.addresses, address, id)
+	}
+}
+
+// neighbors returns the interfaces the frames of an interface go to
+func (c *MTUChecker) neighbors(n *graph.Node) []graph.Identifier {
+	var ids []graph.Identifier
+	for _, e := range c.Graph.GetNodeEdges(n) {
+		if e.Metadata()["RelationType"] != topology.Layer2Relation || e.Metadata()["Type"] == topology.VrfType {
+			continue
+		}
+
+		parent, child := c.Graph.GetEdgeNodes(e)
+		other := parent
+		if parent != nil && parent.ID == n.ID {
+			other = child
+		}
+		if other != nil && other.ID != n.ID && !broadcastExcluded(other) {
+			ids = append(ids, other.ID)
+		}
+	}
+
+	keys := c.keys[n.ID]
+	for id := range c.tunnels[keys.peer] {
+		ids = append(ids, id)
+	}
+	for id := range c.vnis[keys.vni] {
+		if id != n.ID {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// underlay returns the interface carrying the packets of a tunnel, the
+// one of its host holding its LocalIP
+func (c *MTUChecker) underlay(n *graph.Node) *graph.Node {
+	var found *graph.Node
+	for id := range c.addresses[c.keys[n.ID].local] {
+		if id == n.ID {
+			continue
+		}
+		if u := c.Graph.GetNode(id); u != nil && (found == nil || u.ID < found.ID) {
+			found = u
+		}
+	}
+	return found
+}
+
+// check returns the report of a segment and the flags of its interfaces
+// and of its edges
+func (c *MTUChecker) check(members []*graph.Node) (*MTUReport, map[graph.Identifier]graph.Metadata, []graph.Identifier) {
+	report := &MTUReport{Members: len(members)}
+	flags := make(map[graph.Identifier]graph.Metadata)
+
+	lowest := members[0].ID
+	hosts := make(map[string]bool)
+	mtus := make(map[graph.Identifier]int64)
+	for _, n := range members {
+		if n.ID < lowest {
+			lowest = n.ID
+		}
+		hosts[n.Host()] = true
+		report.members = append(report.members, n.ID)
+		if mtu, ok := metadataInt(n.Metadata(), "MTU"); ok && mtu > 0 {
+			mtus[n.ID] = mtu
+			if mtu > report.EmittedMTU {
+				report.EmittedMTU = mtu
+			}
+		}
+	}
+	report.Segment = string(lowest)
+	for host := range hosts {
+		report.Hosts = append(report.Hosts, host)
+	}
+	sort.Strings(report.Hosts)
+
+	for _, n := range members {
+		mtu, ok := mtus[n.ID]
+		if !ok {
+			continue
+		}
+
+		v := MTUViolation{Node: n.ID, Host: n.Host(), MTU: mtu, Effective: mtu, Expected: report.EmittedMTU}
+		v.Name, _ = n.Metadata()["Name"].(string)
+		v.Type, _ = n.Metadata()["Type"].(string)
+
+		if overhead, ok := c.Overheads[v.Type]; ok {
+			if u := c.underlay(n); u != nil {
+				if umtu, ok := metadataInt(u.Metadata(), "MTU"); ok && umtu-overhead < v.Effective {
+					v.Effective, v.Underlay, v.Overhead = umtu-overhead, u.ID, overhead
+				}
+			}
+		}
+
+		if report.PathMTU == 0 || v.Effective < report.PathMTU {
+			report.PathMTU = v.Effective
+		}
+
+		if v.Effective < v.Expected {
+			report.Violations = append(report.Violations, v)
+			flags[n.ID] = graph.Metadata{MTUMismatchKey: true, MTUExpectedKey: v.Expected, MTUEffectiveKey: v.Effective}
+		}
+	}
+	sort.Slice(report.Violations, func(i, j int) bool { return report.Violations[i].Node < report.Violations[j].Node })
+
+	var edges []graph.Identifier
+	for _, n := range members {
+		for _, e := range c.Graph.GetNodeEdges(n) {
+			if e.Metadata()["RelationType"] != topology.Layer2Relation {
+				continue
+			}
+			parent, child := c.Graph.GetEdgeNodes(e)
+			if parent == nil || child == nil || parent.ID != n.ID {
+				continue
+			}
+			if pmtu, ok := mtus[parent.ID]; ok {
+				if cmtu, ok := mtus[child.ID]; ok && pmtu != cmtu {
+					edges = append(edges, e.ID)
+				}
+			}
+		}
+	}
+
+	return report, flags, edges
+}
+
+// setFlags replaces the MTU metadata of a node or an edge
+func (c *MTUChecker) setFlags(e interface{}, current graph.Metadata, flags graph.Metadata) {
+	m := make(graph.Metadata)
+	for k, v := range current {
+		if k != MTUMismatchKey && k != MTUExpectedKey && k != MTUEffectiveKey {
+			m[k] = v
+		}
+	}
+	for k, v := range flags {
+		m[k] = v
+	}
+
+	if !reflect.DeepEqual(m, current) {
+		c.Graph.SetMetadata(e, m)
+	}
+}
+
+// recompute checks the segments of the dirty interfaces again, the graph
+// lock being held. The segments the dirty interfaces were part of, and the
+// ones of the tunnels whose underlay may have changed, are flooded again.
+func (c *MTUChecker) recompute(dirty map[graph.Identifier]bool) int {
+	var seeds []graph.Identifier
+	removed := make(map[string]bool)
+
+	for id, forced := range dirty {
+		n := c.Graph.GetNode(id)
+		addresses, changed := c.index(id, n)
+		if !changed && !forced {
+			continue
+		}
+
+		seeds = append(seeds, id)
+		for _, address := range addresses {
+			for tunnel := range c.locals[address] {
+				seeds = append(seeds, tunnel)
+			}
+		}
+	}
+
+	visited := make(map[graph.Identifier]bool)
+	var components [][]*graph.Node
+	for len(seeds) > 0 {
+		id := seeds[len(seeds)-1]
+		seeds = seeds[:len(seeds)-1]
+
+		if segment, ok := c.segmentOf[id]; ok && !removed[segment] {
+			removed[segment] = true
+			seeds = append(seeds, c.segments[segment].members...)
+		}
+
+		n := c.Graph.GetNode(id)
+		if visited[id] || n == nil || broadcastExcluded(n) {
+			continue
+		}
+		visited[id] = true
+
+		component := []*graph.Node{n}
+		for i := 0; i < len(component); i++ {
+			current := component[i]
+			if segment, ok := c.segmentOf[current.ID]; ok && !removed[segment] {
+				removed[segment] = true
+				seeds = append(seeds, c.segments[segment].members...)
+			}
+
+			for _, next := range c.neighbors(current) {
+				if visited[next] {
+					continue
+				}
+				if nn := c.Graph.GetNode(next); nn != nil {
+					visited[next] = true
+					component = append(component, nn)
+				}
+			}
+		}
+		components = append(components, component)
+	}
+
+	// the flags of the segments checked again are replaced
+	stale := make(map[graph.Identifier]bool)
+	staleEdges := make(map[graph.Identifier]bool)
+	for id := range removed {
+		s := c.segments[id]
+		for _, member := range s.members {
+			stale[member] = true
+			delete(c.segmentOf, member)
+		}
+		for _, edge := range s.edges {
+			staleEdges[edge] = true
+		}
+		delete(c.segments, id)
+	}
+
+	allFlags := make(map[graph.Identifier]graph.Metadata)
+	mismatches := make(map[graph.Identifier]bool)
+	for _, members := range components {
+		report, flags, edges := c.check(members)
+
+		s := &mtuSegment{edges: edges}
+		if len(report.Violations) > 0 {
+			s.report = report
+			logging.GetLogger().Debugf("MTU mismatch in the segment %s, %d interfaces can't carry %d bytes", report.Segment, len(report.Violations), report.EmittedMTU)
+		}
+		for _, n := range members {
+			s.members = append(s.members, n.ID)
+			c.segmentOf[n.ID] = report.Segment
+			stale[n.ID] = true
+		}
+		c.segments[report.Segment] = s
+
+		for id, m := range flags {
+			allFlags[id] = m
+		}
+		for _, edge := range edges {
+			staleEdges[edge] = true
+			mismatches[edge] = true
+		}
+	}
+
+	for id := range stale {
+		if n := c.Graph.GetNode(id); n != nil {
+			c.setFlags(n, n.Metadata(), allFlags[id])
+		}
+	}
+	for id := range staleEdges {
+		if e := c.Graph.GetEdge(id); e != nil {
+			var flags graph.Metadata
+			if mismatches[id] {
+				flags = graph.Metadata{MTUMismatchKey: true}
+			}
+			c.setFlags(e, e.Metadata(), flags)
+		}
+	}
+
+	return len(visited)
+}
+
+// compute checks the segments of the interfaces marked as dirty
+func (c *MTUChecker) compute() {
+	c.Lock()
+	dirty, all := c.dirty, c.all
+	c.dirty, c.all = make(map[graph.Identifier]bool), false
+	c.Unlock()
+
+	if len(dirty) == 0 && !all {
+		return
+	}
+
+	c.Graph.Lock()
+	if all {
+		for _, n := range c.Graph.GetNodes() {
+			dirty[n.ID] = true
+		}
+		for id := range c.keys {
+			dirty[id] = true
+		}
+	}
+	visited := c.recompute(dirty)
+
+	reports := make(map[string]*MTUReport)
+	violations := 0
+	for id, s := range c.segments {
+		if s.report != nil {
+			reports[id] = s.report
+			violations += len(s.report.Violations)
+		}
+	}
+	segments := len(c.segments)
+	c.Graph.Unlock()
+
+	c.Lock()
+	c.reports = reports
+	c.stats.Segments = segments
+	c.stats.Violations = violations
+	c.stats.Recomputations++
+	c.stats.LastVisited = visited
+	c.Unlock()
+}
+
+func (c *MTUChecker) markDirty(n *graph.Node, forced bool) {
+	if n == nil {
+		return
+	}
+
+	c.Lock()
+	if !c.dirty[n.ID] {
+		c.dirty[n.ID] = forced
+	}
+	c.Unlock()
+}
+
+func (c *MTUChecker) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != c.Graph {
+		return
+	}
+
+	switch e.Type {
+	case "BulkChange":
+		c.Lock()
+		c.all = true
+		c.Unlock()
+	case "NodeAdded", "NodeUpdated":
+		c.markDirty(ev.Node, false)
+	case "NodeDeleted":
+		c.markDirty(ev.Node, true)
+	case "EdgeAdded", "EdgeDeleted":
+		// the updates of the edges are left aside, ie. the MTUMismatch
+		// flags set by the checker itself
+		if ev.Edge == nil || ev.Edge.Metadata()["RelationType"] != topology.Layer2Relation {
+			return
+		}
+		c.markDirty(ev.Parent, true)
+		c.markDirty(ev.Child, true)
+	}
+}
+
+// OnBusEventsDropped checks all the segments again as the missed events
+// may have changed any of them
+func (c *MTUChecker) OnBusEventsDropped(count int64) {
+	logging.GetLogger().Warningf("MTU checker missed %d graph events, checking all the segments", count)
+
+	c.Lock()
+	c.all = true
+	c.Unlock()
+}
+
+// Flush waits for the queued graph events and checks the segments of the
+// dirty interfaces
+func (c *MTUChecker) Flush() {
+	if c.subscription != nil {
+		c.subscription.Flush()
+	}
+	c.compute()
+}
+
+// MTUReports returns the reports of the segments having violations
+func (c *MTUChecker) MTUReports() map[string]interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	reports := make(map[string]interface{})
+	for id, r := range c.reports {
+		reports[id] = r
+	}
+	return reports
+}
+
+func (c *MTUChecker) Metrics() interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.stats
+}
+
+func (c *MTUChecker) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(c.Delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.compute()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *MTUChecker) Start() {
+	c.Lock()
+	c.all = true
+	c.Unlock()
+
+	c.subscription = common.DefaultBus.Subscribe("mtu_checker", config.GetConfig().GetInt("graph.bus.queue_size"), c, common.GraphTopic)
+	common.RegisterMetrics("mtu_checker", c.Metrics)
+
+	go c.run()
+}
+
+func (c *MTUChecker) Stop() {
+	close(c.quit)
+	common.UnregisterMetrics("mtu_checker")
+	common.DefaultBus.Unsubscribe(c.subscription)
+}
+
+func NewMTUChecker(g *graph.Graph, delay time.Duration, overheads map[string]int64) *MTUChecker {
+	return &MTUChecker{
+		Graph:     g,
+		Delay:     delay,
+		Overheads: overheads,
+		quit:      make(chan bool),
+		dirty:     make(map[graph.Identifier]bool),
+		reports:   make(map[string]*MTUReport),
+		keys:      make(map[graph.Identifier]mtuKeys),
+		tunnels:   make(map[string]map[graph.Identifier]bool),
+		vnis:      make(map[string]map[graph.Identifier]bool),
+		locals:    make(map[string]map[graph.Identifier]bool),
+		addresses: make(map[string]map[graph.Identifier]bool),
+		segments:  make(map[string]*mtuSegment),
+		segmentOf: make(map[graph.Identifier]string),
+	}
+}
+
+// NewMTUCheckerFromConfig returns nil if the check is disabled, the
+// configured overheads replacing the default ones of their tunnel types
+func NewMTUCheckerFromConfig(g *graph.Graph) *MTUChecker {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("analyzer.mtu.enabled") {
+		return nil
+	}
+
+	overheads := make(map[string]int64)
+	for t, o := range DefaultEncapOverheads {
+		overheads[t] = o
+	}
+	for t, o := range cfg.GetStringMap("analyzer.mtu.overheads") {
+		overhead, ok := metadataInt(graph.Metadata{"Overhead": o}, "Overhead")
+		if !ok {
+			logging.GetLogger().Errorf("Invalid MTU overhead of %s: %v", t, o)
+			continue
+		}
+		overheads[t] = overhead
+	}
+
+	delay := time.Duration(cfg.GetInt("analyzer.mtu.delay")) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return NewMTUChecker(g, delay, overheads)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// newMTUGraph loads a fixture, a snapshot in the format of the topology
+// API export
+func newMTUGraph(t *testing.T, fixture string) (*graph.Graph, *MTUChecker) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s graph.Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewMTUChecker(g, time.Hour, DefaultEncapOverheads)
+	c.Start()
+
+	g.Lock()
+	g.MergeSnapshot(&s)
+	g.Unlock()
+
+	c.Flush()
+
+	return g, c
+}
+
+func mismatches(g *graph.Graph) map[graph.Identifier]graph.Metadata {
+	g.RLock()
+	defer g.RUnlock()
+
+	flagged := make(map[graph.Identifier]graph.Metadata)
+	for _, n := range g.LookupNodes(graph.Metadata{MTUMismatchKey: true}) {
+		flagged[n.ID] = graph.Metadata{MTUExpectedKey: n.Metadata()[MTUExpectedKey], MTUEffectiveKey: n.Metadata()[MTUEffectiveKey]}
+	}
+	return flagged
+}
+
+func setMTU(g *graph.Graph, c *MTUChecker, mtu int64, ids ...graph.Identifier) {
+	g.Lock()
+	for _, id := range ids {
+		g.AddMetadata(g.GetNode(id), "MTU", mtu)
+	}
+	g.Unlock()
+
+	c.Flush()
+}
+
+func TestMTUVxlanOverhead(t *testing.T) {
+	g, c := newMTUGraph(t, "vxlan-mtu.json")
+	defer c.Stop()
+
+	// the VXLANs carry 1450 bytes over their 1500 bytes underlay while
+	// their bridge emits 1500 bytes frames
+	flagged := mismatches(g)
+	for _, id := range []graph.Identifier{"host1-vxlan42", "host2-vxlan42"} {
+		if m, ok := flagged[id]; !ok || m[MTUExpectedKey] != int64(1500) || m[MTUEffectiveKey] != int64(1450) {
+			t.Errorf("%s should be flagged, expecting 1500 bytes and carrying 1450: %v", id, m)
+		}
+	}
+	if len(flagged) != 2 {
+		t.Errorf("Only the VXLANs should be flagged: %v", flagged)
+	}
+
+	reports := c.MTUReports()
+	if len(reports) != 1 {
+		t.Fatalf("Expected a single segment with violations: %v", reports)
+	}
+	for _, r := range reports {
+		report := r.(*MTUReport)
+		if report.Members != 8 || report.EmittedMTU != 1500 || report.PathMTU != 1450 || len(report.Violations) != 2 {
+			t.Errorf("Wrong report: %+v", report)
+		}
+		if v := report.Violations[0]; v.Underlay != "host1-eth0" || v.Overhead != 50 || v.MTU != 1500 {
+			t.Errorf("Wrong violation: %+v", v)
+		}
+	}
+
+	// jumbo frames on the underlay of host1
+	setMTU(g, c, 9000, "host1-eth0")
+	if flagged = mismatches(g); len(flagged) != 1 || flagged["host2-vxlan42"] == nil {
+		t.Errorf("Only the VXLAN of host2 should be flagged: %v", flagged)
+	}
+
+	// the VXLAN of host2 lowered, dropping the frames of its bridge
+	setMTU(g, c, 1450, "host2-vxlan42")
+	if flagged = mismatches(g); len(flagged) != 1 || flagged["host2-vxlan42"][MTUEffectiveKey] != int64(1450) {
+		t.Errorf("The VXLAN of host2 should still be flagged: %v", flagged)
+	}
+
+	g.RLock()
+	if e := g.GetEdge("host2-br0-host2-vxlan42"); e.Metadata()[MTUMismatchKey] != true {
+		t.Errorf("The edge between the bridge and the VXLAN should be flagged: %v", e.Metadata())
+	}
+	g.RUnlock()
+
+	// the whole segment lowered
+	setMTU(g, c, 1450, "host1-vxlan42", "host1-br0", "host1-veth0", "host1-ns1-eth0", "host2-br0", "host2-veth0", "host2-ns1-eth0")
+	if flagged = mismatches(g); len(flagged) != 0 {
+		t.Errorf("No interface should be flagged anymore: %v", flagged)
+	}
+	if reports = c.MTUReports(); len(reports) != 0 {
+		t.Errorf("No segment should have violations anymore: %v", reports)
+	}
+
+	g.RLock()
+	if e := g.GetEdge("host2-br0-host2-vxlan42"); e.Metadata()[MTUMismatchKey] != nil {
+		t.Errorf("The flag of the edge should have been removed: %v", e.Metadata())
+	}
+	g.RUnlock()
+}
+
+func TestMTUIncremental(t *testing.T) {
+	g, c := newMTUGraph(t, "vxlan-mtu.json")
+	defer c.Stop()
+
+	// a large bridge elsewhere
+	g.Lock()
+	bridge := g.NewNode(graph.GenID(), graph.Metadata{"Type": "bridge", "Name": "br1", "MTU": int64(1500)})
+	for i := 0; i < 100; i++ {
+		tap := g.NewNode(graph.GenID(), graph.Metadata{"Type": "tap", "Name": fmt.Sprintf("tap%d", i), "MTU": int64(1500)})
+		g.Link(bridge, tap, graph.Metadata{"RelationType": topology.Layer2Relation})
+	}
+	g.Unlock()
+
+	c.Flush()
+
+	// only the segment of the VXLANs is checked again
+	setMTU(g, c, 1400, "host1-ns1-eth0")
+	if stats := c.Metrics().(MTUCheckerStats); stats.LastVisited != 8 {
+		t.Errorf("Expected only the 8 interfaces of the segment to be visited, got %d", stats.LastVisited)
+	}
+	if flagged := mismatches(g); len(flagged) != 3 || flagged["host1-ns1-eth0"][MTUEffectiveKey] != int64(1400) {
+		t.Errorf("The container interface should be flagged: %v", flagged)
+	}
+
+	// the underlay of a tunnel checks the segment of the tunnel again
+	setMTU(g, c, 9000, "host2-eth0")
+	if stats := c.Metrics().(MTUCheckerStats); stats.LastVisited != 9 {
+		t.Errorf("Expected the underlay and the segment of its tunnel to be visited, got %d", stats.LastVisited)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// SRIOVLinker links the SR-IOV physical functions of a host to their
+// virtual functions with sriov edges. The VFs are found by their PCI
+// address wherever they are, in the host namespace or moved into the
+// namespace of a container, the sriov edge coexisting with the ownership
+// edge of the namespace. A VF without interface, ie. passed through to a VM
+// with vfio-pci, gets a node of type vf owned by the host, so that the
+// passthrough VFs can be queried:
+//
+//	G.V().Has('Type', 'vf', 'Driver', 'vfio-pci')
+type SRIOVLinker struct {
+	sync.RWMutex
+	// PFs and VFs per host
+	nodes map[string]map[graph.Identifier]bool
+	// VF nodes per host and PCI address
+	vfs map[string]map[string]graph.Identifier
+}
+
+func (l *SRIOVLinker) Relevant(n *graph.Node) bool {
+	m := n.Metadata()
+	if m["Type"] == topology.VFType {
+		return false
+	}
+	if _, ok := m["SRIOV"]; ok {
+		return true
+	}
+	if _, ok := m["PCIAddress"]; ok {
+		return true
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.nodes[n.Host()][n.ID]
+}
+
+// virtualFunctions returns the VFs listed in the SR-IOV metadata of a PF
+func virtualFunctions(pf *graph.Node) []map[string]interface{} {
+	sriov, ok := pf.Metadata()["SRIOV"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	list, _ := sriov["VFs"].([]interface{})
+
+	var vfs []map[string]interface{}
+	for _, vf := range list {
+		if vf, ok := vf.(map[string]interface{}); ok {
+			if address, _ := vf["PCIAddress"].(string); address != "" {
+				vfs = append(vfs, vf)
+			}
+		}
+	}
+	return vfs
+}
+
+// vfMetadata returns the metadata of the node of a VF without interface
+func vfMetadata(pf *graph.Node, vf map[string]interface{}) graph.Metadata {
+	pfName, _ := pf.Metadata()["Name"].(string)
+
+	m := graph.Metadata{
+		"Type":             topology.VFType,
+		"Name":             fmt.Sprintf("%s-vf%v", pfName, vf["Index"]),
+		"PCIAddress":       vf["PCIAddress"],
+		"PhysicalFunction": pfName,
+		"VFIndex":          vf["Index"],
+	}
+	if driver, ok := vf["Driver"].(string); ok {
+		m["Driver"] = driver
+	}
+	return m
+}
+
+// syncVFs links the PF to the VFs by sriov edges and unlinks the nodes not
+// being one of its VFs anymore
+func syncVFs(g *graph.Graph, pf *graph.Node, vfs []*graph.Node) {
+	wanted := make(map[graph.Identifier]bool)
+	for _, vf := range vfs {
+		wanted[vf.ID] = true
+	}
+
+	for _, e := range g.GetNodeEdges(pf) {
+		if e.Metadata()["RelationType"] != topology.SRIOVRelation {
+			continue
+		}
+
+		parent, child := g.GetEdgeNodes(e)
+		if parent == nil || child == nil || parent.ID != pf.ID {
+			continue
+		}
+
+		if wanted[child.ID] {
+			delete(wanted, child.ID)
+		} else {
+			g.DelEdge(e)
+		}
+	}
+
+	for _, vf := range vfs {
+		if wanted[vf.ID] {
+			g.Link(pf, vf, graph.Metadata{"RelationType": topology.SRIOVRelation})
+		}
+	}
+}
+
+func (l *SRIOVLinker) Link(g *graph.Graph, host string) {
+	l.Lock()
+	defer l.Unlock()
+
+	old := l.vfs[host]
+	vfNodes := make(map[string]graph.Identifier)
+	nodes := make(map[graph.Identifier]bool)
+
+	var root *graph.Node
+	if roots := hostNodes(g, host, graph.Metadata{"Type": topology.HostType}); len(roots) > 0 {
+		root = roots[0]
+	}
+
+	// the interfaces of all the namespaces of the host by PCI address
+	interfaces := make(map[string][]*graph.Node)
+	for _, n := range g.LookupNodesFromKey("PCIAddress") {
+		if address, _ := n.Metadata()["PCIAddress"].(string); n.Host() == host && n.Metadata()["Type"] != topology.VFType {
+			interfaces[address] = append(interfaces[address], n)
+			nodes[n.ID] = true
+		}
+	}
+
+	for _, pf := range g.LookupNodesFromKey("SRIOV") {
+		if pf.Host() != host {
+			continue
+		}
+		nodes[pf.ID] = true
+
+		var linked []*graph.Node
+		for _, vf := range virtualFunctions(pf) {
+			address := vf["PCIAddress"].(string)
+
+			if intfs := interfaces[address]; len(intfs) > 0 {
+				linked = append(linked, intfs...)
+				continue
+			}
+
+			m := vfMetadata(pf, vf)
+			id := graph.GenIDFrom(host, topology.VFType, address)
+			n := g.GetNode(id)
+			if n == nil {
+				if n = g.NewNode(id, m); n == nil {
+					continue
+				}
+			} else if !reflect.DeepEqual(n.Metadata(), m) {
+				g.SetMetadata(n, m)
+			}
+			vfNodes[address] = n.ID
+
+			if root != nil && !g.AreLinked(root, n) {
+				g.Link(root, n, graph.Metadata{"RelationType": topology.OwnershipRelation})
+			}
+			linked = append(linked, n)
+		}
+
+		syncVFs(g, pf, linked)
+	}
+
+	for address, id := range old {
+		if _, ok := vfNodes[address]; ok {
+			continue
+		}
+		if n := g.GetNode(id); n != nil {
+			g.DelNode(n)
+		}
+	}
+
+	if len(nodes) > 0 {
+		l.nodes[host] = nodes
+	} else {
+		delete(l.nodes, host)
+	}
+	if len(vfNodes) > 0 {
+		l.vfs[host] = vfNodes
+	} else {
+		delete(l.vfs, host)
+	}
+}
+
+func NewSRIOVLinker() *SRIOVLinker {
+	return &SRIOVLinker{
+		nodes: make(map[string]map[graph.Identifier]bool),
+		vfs:   make(map[string]map[string]graph.Identifier),
+	}
+}
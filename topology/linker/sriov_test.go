@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package linker
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func sriovVFs(vfs ...map[string]interface{}) map[string]interface{} {
+	list := []interface{}{}
+	for _, vf := range vfs {
+		list = append(list, vf)
+	}
+	return map[string]interface{}{"TotalVFs": int64(8), "NumVFs": int64(len(vfs)), "VFs": list}
+}
+
+func TestSRIOVLinker(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewLinkerManager(g, NewSRIOVLinker())
+	m.Start()
+	defer m.Stop()
+
+	ownership := graph.Metadata{"RelationType": topology.OwnershipRelation}
+	vf0 := map[string]interface{}{"Index": int64(0), "PCIAddress": "0000:03:02.0", "Driver": "ixgbevf", "Name": "eth2"}
+	vf1 := map[string]interface{}{"Index": int64(1), "PCIAddress": "0000:03:02.2", "Driver": "vfio-pci"}
+
+	g.Lock()
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Type": "host", "Name": "compute-1"})
+	pf := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth1", "PCIAddress": "0000:03:00.0", "SRIOV": sriovVFs(vf0, vf1)})
+	g.Link(host, pf, ownership)
+
+	// VF moved into the namespace of a container
+	netns := g.NewNode(graph.GenID(), graph.Metadata{"Type": "netns", "Name": "container-1"})
+	eth2 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth2", "PCIAddress": "0000:03:02.0"})
+	g.Link(host, netns, ownership)
+	g.Link(netns, eth2, ownership)
+	g.Unlock()
+
+	m.Flush()
+
+	g.RLock()
+	if !g.AreLinked(pf, eth2) || !g.AreLinked(netns, eth2) {
+		t.Error("The VF eth2 should be linked to its PF and still owned by its namespace")
+	}
+
+	vfs := g.LookupNodes(graph.Metadata{"Type": "vf"})
+	if len(vfs) != 1 {
+		t.Fatalf("Expected a node for the passthrough VF, got: %v", vfs)
+	}
+	vm := vfs[0].Metadata()
+	if vm["Name"] != "eth1-vf1" || vm["Driver"] != "vfio-pci" || vm["PhysicalFunction"] != "eth1" || vm["PCIAddress"] != "0000:03:02.2" {
+		t.Errorf("Wrong metadata of the passthrough VF: %v", vm)
+	}
+	if !g.AreLinked(pf, vfs[0]) || !g.AreLinked(host, vfs[0]) {
+		t.Error("The passthrough VF should be linked to its PF and owned by the host")
+	}
+	g.RUnlock()
+
+	// the passthrough VF gets back an interface
+	g.Lock()
+	eth3 := g.NewNode(graph.GenID(), graph.Metadata{"Type": "device", "Name": "eth3", "PCIAddress": "0000:03:02.2"})
+	g.Link(host, eth3, ownership)
+	vf1 = map[string]interface{}{"Index": int64(1), "PCIAddress": "0000:03:02.2", "Driver": "ixgbevf", "Name": "eth3"}
+	g.AddMetadata(pf, "SRIOV", sriovVFs(vf0, vf1))
+	g.Unlock()
+
+	m.Flush()
+
+	g.RLock()
+	if vfs := g.LookupNodes(graph.Metadata{"Type": "vf"}); len(vfs) != 0 {
+		t.Errorf("The node of the passthrough VF should have been removed: %v", vfs)
+	}
+	if !g.AreLinked(pf, eth3) {
+		t.Error("The VF eth3 should be linked to its PF")
+	}
+	g.RUnlock()
+
+	// SR-IOV disabled
+	g.Lock()
+	g.AddMetadata(pf, "SRIOV", sriovVFs())
+	g.Unlock()
+
+	m.Flush()
+
+	g.RLock()
+	if g.AreLinked(pf, eth2) || g.AreLinked(pf, eth3) {
+		t.Error("The VFs should have been unlinked from their PF")
+	}
+	if !g.AreLinked(netns, eth2) {
+		t.Error("The VF eth2 should still be owned by its namespace")
+	}
+	g.RUnlock()
+}
@@ -0,0 +1,448 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package migration
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/history"
+)
+
+// Mapping is the new identifier of a node or an edge
+type Mapping struct {
+	OldID graph.Identifier
+	NewID graph.Identifier
+	Host  string `json:",omitempty"`
+	Type  string `json:",omitempty"`
+	Name  string `json:",omitempty"`
+}
+
+// Unmigrated is a node whose identifier couldn't be derived, left as is
+// for a manual handling
+type Unmigrated struct {
+	ID     graph.Identifier
+	Host   string `json:",omitempty"`
+	Type   string `json:",omitempty"`
+	Name   string `json:",omitempty"`
+	Reason string
+}
+
+// Report gives the identifiers migrated, the nodes left as they are and the
+// number of elements of the history rewritten
+type Report struct {
+	Nodes      []Mapping
+	Edges      []Mapping
+	Unmigrated []Unmigrated
+	Changes    int
+}
+
+// Lookup returns the new identifier of a node or an edge migrated
+func (r *Report) Lookup(id graph.Identifier) (graph.Identifier, bool) {
+	for _, mappings := range [][]Mapping{r.Nodes, r.Edges} {
+		for _, m := range mappings {
+			if m.OldID == id {
+				return m.NewID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Merge keeps the mappings of a previous migration, so that the report of
+// a migration run again still gives the identifiers migrated the first
+// time, the ones migrated again being followed.
+func (r *Report) Merge(previous *Report) {
+	merge := func(current, previous []Mapping) []Mapping {
+		next := make(map[graph.Identifier]graph.Identifier)
+		known := make(map[graph.Identifier]bool)
+		for _, m := range current {
+			next[m.OldID] = m.NewID
+			known[m.OldID] = true
+		}
+
+		var merged []Mapping
+		for _, m := range previous {
+			if known[m.OldID] {
+				continue
+			}
+			if id, ok := next[m.NewID]; ok {
+				m.NewID = id
+			}
+			merged = append(merged, m)
+		}
+		return append(merged, current...)
+	}
+
+	r.Nodes = merge(r.Nodes, previous.Nodes)
+	r.Edges = merge(r.Edges, previous.Edges)
+}
+
+// ReadReport reads the report of a previous migration, nil if none
+func ReadReport(path string) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// WriteReport writes the report as JSON
+func WriteReport(path string, r *Report) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Migrator migrates the nodes keyed by the hostnames of the agents, the ID
+// of the host node being the hostname and the ones of the other nodes
+// random, to the identifiers the agents derive from their identity and the
+// natural keys of the nodes:
+//
+//	host             the identity of the agent
+//	netns            the host node and the Path
+//	OVS bridges,     the host node and the UUID
+//	ports and
+//	interfaces
+//	interfaces       the owner, host or netns node, and the permanent MAC or
+//	                 the PCI address of the physical NICs, the IfIndex of the
+//	                 others
+//
+// the edges whose nodes are migrated being given the IDs derived from their
+// nodes and their relation type. Identities gives the identity of the agent
+// of a hostname, its hostname by default as for the agents without data
+// directory. The nodes whose ID can't be derived, ie. the containers or the
+// nodes of the analyzer, are left as they are and listed in the report.
+//
+// The history is rewritten first, then the nodes migrated are added with
+// their new ID, their edges moved and the old nodes removed, so that a
+// migration interrupted can be run again, the elements already migrated
+// being left as they are. The nodes of the Previous report still in the
+// graph, whose edges were moved before the interruption, are given the IDs
+// of the report. The elements of the history no longer in the graph keep
+// their IDs.
+type Migrator struct {
+	Graph      *graph.Graph
+	History    history.Storage
+	Identities map[string]string
+	Previous   *Report
+	DryRun     bool
+	previous   map[graph.Identifier]graph.Identifier
+	owners     map[graph.Identifier]graph.Identifier
+	nodes      map[graph.Identifier]graph.Identifier
+	reasons    map[graph.Identifier]string
+}
+
+var errNoKey = errors.New("no metadata to derive its ID from")
+
+// identity returns the identity of the agent of a hostname
+func (m *Migrator) identity(host string) string {
+	if id, ok := m.Identities[host]; ok && id != "" {
+		return id
+	}
+	return host
+}
+
+// ifIndex returns the index of an interface, the numbers of the backends
+// decoding JSON being floats
+func ifIndex(m graph.Metadata) (int64, bool) {
+	switch v := m["IfIndex"].(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// derive returns the ID of a node derived from its metadata, the one of
+// its owner being derived first
+func (m *Migrator) derive(n *graph.Node) (graph.Identifier, error) {
+	md := n.Metadata()
+	typ, _ := md["Type"].(string)
+
+	if typ == topology.HostType {
+		if string(n.ID) != n.Host() {
+			return "", errors.New("host node not keyed by its hostname")
+		}
+		return graph.Identifier(m.identity(n.Host())), nil
+	}
+
+	owner := m.Graph.GetNode(m.owners[n.ID])
+	if owner == nil {
+		return "", errors.New("no owner to derive its ID from")
+	}
+	ownerID, err := m.nodeID(owner)
+	if err != nil {
+		return "", errors.New("owner not migrated: " + err.Error())
+	}
+
+	ownerType, _ := owner.Metadata()["Type"].(string)
+	if uuid, ok := md["UUID"].(string); ok && uuid != "" && ownerType == topology.HostType {
+		return graph.GenIDFrom(string(ownerID), uuid), nil
+	}
+
+	switch typ {
+	case topology.NetNSType:
+		if path, ok := md["Path"].(string); ok && path != "" && ownerType == topology.HostType {
+			return graph.GenIDFrom(string(ownerID), path), nil
+		}
+	case topology.LagType, topology.VFType, topology.BroadcastDomainType:
+		return "", errors.New("derived by the analyzer, rebuilt by its linkers")
+	default:
+		if ownerType != topology.HostType && ownerType != topology.NetNSType {
+			break
+		}
+		if key, value := topology.HardwareIdentity(md); key != "" {
+			return graph.GenIDFrom(string(ownerID), key, value), nil
+		}
+		if index, ok := ifIndex(md); ok {
+			return graph.GenIDFrom(string(ownerID), "IfIndex", strconv.FormatInt(index, 10)), nil
+		}
+	}
+
+	return "", errNoKey
+}
+
+// nodeID returns the new ID of a node, memoized
+func (m *Migrator) nodeID(n *graph.Node) (graph.Identifier, error) {
+	if id, ok := m.nodes[n.ID]; ok {
+		return id, nil
+	}
+	if reason, ok := m.reasons[n.ID]; ok {
+		return "", errors.New(reason)
+	}
+
+	// guard against the ownership cycles
+	m.reasons[n.ID] = "ownership cycle"
+
+	id, err := m.derive(n)
+	if previous, ok := m.previous[n.ID]; ok && m.Graph.GetNode(previous) != nil {
+		id, err = previous, nil
+	}
+	if err != nil {
+		m.reasons[n.ID] = err.Error()
+		return "", err
+	}
+
+	delete(m.reasons, n.ID)
+	m.nodes[n.ID] = id
+	return id, nil
+}
+
+func edgeID(parent, child graph.Identifier, m graph.Metadata) graph.Identifier {
+	if relationType, ok := m["RelationType"].(string); ok && relationType != "" {
+		return graph.GenIDFrom(string(parent), string(child), relationType)
+	}
+	return graph.GenIDFrom(string(parent), string(child))
+}
+
+func elementName(m graph.Metadata) (string, string) {
+	typ, _ := m["Type"].(string)
+	name, _ := m["Name"].(string)
+	return typ, name
+}
+
+// plan computes the new IDs of the nodes and of their edges
+func (m *Migrator) plan() (*Report, map[graph.Identifier]*graph.SnapshotElement) {
+	m.owners = make(map[graph.Identifier]graph.Identifier)
+	m.nodes = make(map[graph.Identifier]graph.Identifier)
+	m.reasons = make(map[graph.Identifier]string)
+	m.previous = make(map[graph.Identifier]graph.Identifier)
+	if m.Previous != nil {
+		for _, mapping := range m.Previous.Nodes {
+			m.previous[mapping.OldID] = mapping.NewID
+		}
+	}
+
+	for _, e := range m.Graph.GetEdges() {
+		if e.Metadata()["RelationType"] == topology.OwnershipRelation {
+			parent, child := m.Graph.GetEdgeNodes(e)
+			if parent != nil && child != nil {
+				m.owners[child.ID] = parent.ID
+			}
+		}
+	}
+
+	nodes := m.Graph.GetNodes()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	report := &Report{}
+	targets := make(map[graph.Identifier]graph.Identifier)
+	for _, n := range nodes {
+		m.nodeID(n)
+	}
+
+	for _, n := range nodes {
+		typ, name := elementName(n.Metadata())
+
+		id, ok := m.nodes[n.ID]
+		if !ok {
+			report.Unmigrated = append(report.Unmigrated, Unmigrated{ID: n.ID, Host: n.Host(), Type: typ, Name: name, Reason: m.reasons[n.ID]})
+			continue
+		}
+		if id == n.ID {
+			continue
+		}
+
+		// two nodes may give the same ID, ie. an interface and the
+		// tombstone of its former incarnation
+		if other, ok := targets[id]; ok || (m.Graph.GetNode(id) != nil && m.nodes[id] != id) {
+			if !ok {
+				other = id
+			}
+			delete(m.nodes, n.ID)
+			report.Unmigrated = append(report.Unmigrated, Unmigrated{ID: n.ID, Host: n.Host(), Type: typ, Name: name, Reason: "duplicate of " + string(other)})
+			continue
+		}
+		targets[id] = n.ID
+
+		report.Nodes = append(report.Nodes, Mapping{OldID: n.ID, NewID: id, Host: m.identity(n.Host()), Type: typ, Name: name})
+	}
+
+	edges := make(map[graph.Identifier]*graph.SnapshotElement)
+	for _, e := range m.Graph.GetEdges() {
+		p, c := m.Graph.GetEdgeNodes(e)
+		if p == nil || c == nil {
+			continue
+		}
+		parent, child := p.ID, c.ID
+		newParent, pok := m.nodes[parent]
+		newChild, cok := m.nodes[child]
+		if (!pok || newParent == parent) && (!cok || newChild == child) {
+			continue
+		}
+		if !pok {
+			newParent = parent
+		}
+		if !cok {
+			newChild = child
+		}
+
+		id := edgeID(newParent, newChild, e.Metadata())
+		edges[e.ID] = &graph.SnapshotElement{ID: id, Metadata: e.Metadata(), Parent: newParent, Child: newChild, Host: m.identity(e.Host())}
+
+		typ, name := elementName(e.Metadata())
+		if typ == "" {
+			typ, _ = e.Metadata()["RelationType"].(string)
+		}
+		report.Edges = append(report.Edges, Mapping{OldID: e.ID, NewID: id, Host: m.identity(e.Host()), Type: typ, Name: name})
+	}
+	sort.Slice(report.Edges, func(i, j int) bool { return report.Edges[i].OldID < report.Edges[j].OldID })
+
+	return report, edges
+}
+
+// rewrite rewrites the elements of the history with their new IDs
+func (m *Migrator) rewrite(report *Report) (int, error) {
+	rewriter, ok := m.History.(history.Rewriter)
+	if !ok {
+		return 0, errors.New("History storage can't be rewritten")
+	}
+
+	ids := make(map[graph.Identifier]graph.Identifier)
+	for _, mappings := range [][]Mapping{report.Nodes, report.Edges} {
+		for _, mapping := range mappings {
+			ids[mapping.OldID] = mapping.NewID
+		}
+	}
+
+	return rewriter.Rewrite(func(e *graph.SnapshotElement) bool {
+		changed := false
+		for _, id := range []*graph.Identifier{&e.ID, &e.Parent, &e.Child} {
+			if newID, ok := ids[*id]; ok && *id != "" {
+				*id, changed = newID, true
+			}
+		}
+		if host := m.identity(e.Host); host != e.Host {
+			e.Host, changed = host, true
+		}
+		return changed
+	})
+}
+
+// Migrate migrates the graph and the history, returning the report of the
+// migration, the graph and the history being left untouched with DryRun.
+func (m *Migrator) Migrate() (*Report, error) {
+	m.Graph.Lock()
+	defer m.Graph.Unlock()
+
+	report, edges := m.plan()
+	if m.DryRun {
+		return report, nil
+	}
+
+	if m.History != nil {
+		changes, err := m.rewrite(report)
+		if err != nil {
+			return report, err
+		}
+		report.Changes = changes
+	}
+
+	snapshot := &graph.Snapshot{}
+	for _, mapping := range report.Nodes {
+		n := m.Graph.GetNode(mapping.OldID)
+		snapshot.Nodes = append(snapshot.Nodes, &graph.SnapshotElement{ID: mapping.NewID, Metadata: n.Metadata(), Host: m.identity(n.Host())})
+	}
+	m.Graph.MergeSnapshot(snapshot)
+
+	ids := make([]string, 0, len(edges))
+	for id := range edges {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+
+	snapshot = &graph.Snapshot{}
+	for _, id := range ids {
+		if e := m.Graph.GetEdge(graph.Identifier(id)); e != nil {
+			m.Graph.DelEdge(e)
+		}
+		snapshot.Edges = append(snapshot.Edges, edges[graph.Identifier(id)])
+	}
+	m.Graph.MergeSnapshot(snapshot)
+
+	for _, mapping := range report.Nodes {
+		if n := m.Graph.GetNode(mapping.OldID); n != nil {
+			m.Graph.DelNode(n)
+		}
+	}
+
+	return report, nil
+}
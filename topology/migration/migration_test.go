@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package migration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/history"
+)
+
+const (
+	eth0      = "5f0b3c1e-0c5a-4b51-9a61-3e0f3b6a8e01"
+	lo        = "0b6e51a4-0bd2-4f6c-8a35-1e7d9d1cb202"
+	brInt     = "b7a3f8f0-2b8e-4a36-bc58-5d6c2f19c103"
+	ns1       = "c4d9a3e2-7d0e-4c47-9c1f-4d1e7b1aa104"
+	veth0     = "e1f2a3b4-1c2d-4e5f-8a9b-0c1d2e3f4a05"
+	container = "f6e5d4c3-b2a1-4098-8765-43210fedc106"
+	ens3      = "9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c07"
+)
+
+var t0 = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newFixture returns a graph and a history holding the hostname keyed
+// topology of the fixture, the nodes and the edges being added one by one
+func newFixture(t *testing.T, dir string) (*graph.Graph, *history.FileStorage) {
+	data, err := ioutil.ReadFile("testdata/hostname-keyed.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var snapshot graph.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.Lock()
+	g.MergeSnapshot(&snapshot)
+	g.Unlock()
+
+	s, err := history.NewFileStorage(dir, history.FileStorageOptions{SegmentSize: 1024, Sync: history.SyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var changes []*history.Change
+	for _, n := range snapshot.Nodes {
+		changes = append(changes, &history.Change{Time: t0.Add(time.Duration(len(changes)) * time.Second), Type: history.NodeAdded, Element: n})
+	}
+	for _, e := range snapshot.Edges {
+		changes = append(changes, &history.Change{Time: t0.Add(time.Duration(len(changes)) * time.Second), Type: history.EdgeAdded, Element: e})
+	}
+	if err := s.Append(changes); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return g, s
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-migration")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	g, s := newFixture(t, filepath.Join(dir, "history"))
+	defer s.Close()
+
+	identities := map[string]string{"node2": "0d4ab9cc-3f5c-4c2a-9d64-9a1c4e5f7d21"}
+	m := &Migrator{Graph: g, History: s, Identities: identities}
+
+	dryRun := &Migrator{Graph: g, History: s, Identities: identities, DryRun: true}
+	planned, err := dryRun.Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if g.GetNode(eth0) == nil {
+		t.Fatal("Graph shouldn't be migrated by a dry run")
+	}
+
+	report, err := m.Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(planned.Nodes, report.Nodes) {
+		t.Errorf("Dry run should give the mappings of the migration: %v, %v", planned.Nodes, report.Nodes)
+	}
+
+	node2 := graph.Identifier(identities["node2"])
+	netns := graph.GenIDFrom("node1", "/var/run/netns/ns1")
+	expected := map[graph.Identifier]graph.Identifier{
+		eth0:    graph.GenIDFrom("node1", "PermanentMAC", "52:54:00:12:34:56"),
+		lo:      graph.GenIDFrom("node1", "IfIndex", "1"),
+		brInt:   graph.GenIDFrom("node1", "8d7c2a53-8a0e-4bbc-b0bd-34fa3d7fe1a1"),
+		ns1:     netns,
+		veth0:   graph.GenIDFrom(string(netns), "IfIndex", "7"),
+		"node2": node2,
+		ens3:    graph.GenIDFrom(string(node2), "PCIAddress", "0000:00:03.0"),
+	}
+
+	g.RLock()
+	for old, id := range expected {
+		if mapped, ok := report.Lookup(old); !ok || mapped != id {
+			t.Errorf("Wrong mapping of %s: %s, expected %s", old, mapped, id)
+		}
+		if g.GetNode(old) != nil {
+			t.Errorf("Node %s should be removed", old)
+		}
+		if g.GetNode(id) == nil {
+			t.Errorf("Node %s not found by its new ID %s", old, id)
+		}
+	}
+
+	if n := g.GetNode(node2); n == nil || n.Host() != string(node2) {
+		t.Errorf("Host node should be keyed by the identity of the agent: %v", n)
+	}
+	if n := g.GetNode(expected[ens3]); n == nil || n.Host() != string(node2) {
+		t.Errorf("Nodes should be given the identity of their agent as host: %v", n)
+	}
+
+	// the edges are moved to the new IDs
+	if len(g.GetEdges()) != 8 {
+		t.Errorf("Edges should be kept, got %d", len(g.GetEdges()))
+	}
+	layer2 := g.GetEdge(graph.GenIDFrom(string(expected[brInt]), string(expected[eth0]), "layer2"))
+	if layer2 == nil {
+		t.Error("Layer2 edge not found by its new ID")
+	}
+
+	// the container is left as is, still owned by its host
+	if len(report.Unmigrated) != 1 || report.Unmigrated[0].ID != container || report.Unmigrated[0].Reason != errNoKey.Error() {
+		t.Errorf("Container should be listed as unmigrated: %+v", report.Unmigrated)
+	}
+	if n := g.GetNode(container); n == nil || len(g.LookupParentNodes(n, graph.Metadata{"Type": "host"})) != 1 {
+		t.Error("Container should be kept along with its edge")
+	}
+	g.RUnlock()
+
+	// the history gives the states with the new IDs
+	state, err := s.StateAt(t0.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(state.Nodes) != 9 || len(state.Edges) != 8 {
+		t.Errorf("Wrong state of the history: %d nodes, %d edges", len(state.Nodes), len(state.Edges))
+	}
+	for _, n := range state.Nodes {
+		if _, ok := expected[n.ID]; ok {
+			t.Errorf("Node %s of the history should be migrated", n.ID)
+		}
+		if n.ID == expected[ens3] && n.Host != string(node2) {
+			t.Errorf("Host of the history should be migrated: %s", n.Host)
+		}
+	}
+	if report.Changes == 0 {
+		t.Error("History changes should be rewritten")
+	}
+
+	// the migration run again leaves everything as is, the report of the
+	// first run being kept
+	path := filepath.Join(dir, "report.json")
+	if err := WriteReport(path, report); err != nil {
+		t.Fatal(err.Error())
+	}
+	previous, err := ReadReport(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.RLock()
+	before := g.Snapshot()
+	g.RUnlock()
+
+	again, err := (&Migrator{Graph: g, History: s, Identities: identities, Previous: previous}).Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(again.Nodes) != 0 || len(again.Edges) != 0 || again.Changes != 0 {
+		t.Errorf("Migration run again shouldn't change anything: %+v", again)
+	}
+
+	g.RLock()
+	after := g.Snapshot()
+	g.RUnlock()
+	if len(before.Nodes) != len(after.Nodes) || len(before.Edges) != len(after.Edges) {
+		t.Error("Graph shouldn't be changed by a migration run again")
+	}
+
+	again.Merge(previous)
+	for old, id := range expected {
+		if mapped, ok := again.Lookup(old); !ok || mapped != id {
+			t.Errorf("Merged report should keep the mapping of %s", old)
+		}
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-migration")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	g, s := newFixture(t, dir)
+	defer s.Close()
+
+	report, err := (&Migrator{Graph: g, History: s}).Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the old node left after its edges were moved
+	g.Lock()
+	g.MergeSnapshot(&graph.Snapshot{Nodes: []*graph.SnapshotElement{
+		{ID: eth0, Metadata: graph.Metadata{"Name": "eth0", "Type": "device", "PermanentMAC": "52:54:00:12:34:56"}, Host: "node1"},
+	}})
+	g.Unlock()
+
+	again, err := (&Migrator{Graph: g, History: s, Previous: report}).Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, ok := again.Lookup(eth0); !ok || id != graph.GenIDFrom("node1", "PermanentMAC", "52:54:00:12:34:56") {
+		t.Errorf("Old node should be given the ID of the previous report: %s", id)
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+	if g.GetNode(eth0) != nil {
+		t.Error("Old node should be removed")
+	}
+}
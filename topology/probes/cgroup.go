@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// cgroupReader reads the resource limits and usage of the processes from
+// the cgroup filesystem, v1 with a hierarchy per controller or v2 unified.
+type cgroupReader struct {
+	proc     string
+	root     string
+	interval time.Duration
+}
+
+// cgroupPaths returns the cgroup of a process per controller, the unified
+// hierarchy of cgroup v2 being given with an empty controller.
+func (c *cgroupReader) cgroupPaths(pid int) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(c.proc, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+
+	return paths, scanner.Err()
+}
+
+func (c *cgroupReader) readValue(dir string, file string) (string, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+func (c *cgroupReader) readInt(dir string, file string) (int64, bool) {
+	value, ok := c.readValue(dir, file)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	return i, err == nil
+}
+
+// readV1 reads the limits and the usage from the memory, cpu and cpuacct
+// hierarchies, the limits not set being skipped.
+func (c *cgroupReader) readV1(paths map[string]string, limits graph.Metadata, usage graph.Metadata) {
+	if path, ok := paths["memory"]; ok {
+		dir := filepath.Join(c.root, "memory", path)
+		// the unlimited memory is given as a huge page aligned value
+		if limit, ok := c.readInt(dir, "memory.limit_in_bytes"); ok && limit > 0 && limit < 1<<62 {
+			limits["MemoryLimit"] = limit
+		}
+		if used, ok := c.readInt(dir, "memory.usage_in_bytes"); ok {
+			usage["Memory"] = used
+		}
+	}
+
+	if path, ok := paths["cpu"]; ok {
+		dir := filepath.Join(c.root, "cpu", path)
+		if !c.exists(dir) {
+			dir = filepath.Join(c.root, "cpu,cpuacct", path)
+		}
+		quota, qok := c.readInt(dir, "cpu.cfs_quota_us")
+		period, pok := c.readInt(dir, "cpu.cfs_period_us")
+		if qok && pok && quota > 0 && period > 0 {
+			limits["CPULimit"] = float64(quota) / float64(period)
+		}
+		if shares, ok := c.readInt(dir, "cpu.shares"); ok {
+			limits["CPUShares"] = shares
+		}
+	}
+
+	if path, ok := paths["cpuacct"]; ok {
+		dir := filepath.Join(c.root, "cpuacct", path)
+		if !c.exists(dir) {
+			dir = filepath.Join(c.root, "cpu,cpuacct", path)
+		}
+		if used, ok := c.readInt(dir, "cpuacct.usage"); ok {
+			usage["CPUTime"] = used
+		}
+	}
+}
+
+// readV2 reads the limits and the usage from the unified hierarchy
+func (c *cgroupReader) readV2(path string, limits graph.Metadata, usage graph.Metadata) {
+	dir := filepath.Join(c.root, path)
+
+	if limit, ok := c.readInt(dir, "memory.max"); ok {
+		limits["MemoryLimit"] = limit
+	}
+	if used, ok := c.readInt(dir, "memory.current"); ok {
+		usage["Memory"] = used
+	}
+
+	// quota and period, the quota being max if unlimited
+	if value, ok := c.readValue(dir, "cpu.max"); ok {
+		fields := strings.Fields(value)
+		if len(fields) == 2 {
+			quota, qerr := strconv.ParseInt(fields[0], 10, 64)
+			period, perr := strconv.ParseInt(fields[1], 10, 64)
+			if qerr == nil && perr == nil && period > 0 {
+				limits["CPULimit"] = float64(quota) / float64(period)
+			}
+		}
+	}
+	if weight, ok := c.readInt(dir, "cpu.weight"); ok {
+		limits["CPUWeight"] = weight
+	}
+
+	if value, ok := c.readValue(dir, "cpu.stat"); ok {
+		for _, line := range strings.Split(value, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				if used, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					usage["CPUTime"] = used * 1000
+				}
+			}
+		}
+	}
+}
+
+func (c *cgroupReader) exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// read returns the resource limits of a process and its usage, the memory
+// in bytes, the CPU limit in CPUs and the CPU time in nanoseconds.
+func (c *cgroupReader) read(pid int) (graph.Metadata, graph.Metadata, error) {
+	paths, err := c.cgroupPaths(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limits, usage := graph.Metadata{}, graph.Metadata{}
+
+	if _, ok := paths["memory"]; ok {
+		c.readV1(paths, limits, usage)
+	} else if path, ok := paths[""]; ok {
+		c.readV2(path, limits, usage)
+	} else {
+		return nil, nil, fmt.Errorf("no memory nor unified cgroup for the process %d", pid)
+	}
+
+	return limits, usage, nil
+}
+
+// updateCgroups records the resource limits and usage of the containers on
+// their nodes, the usage being volatile its updates are only sent live.
+func (probe *DockerProbe) updateCgroups() {
+	probe.RLock()
+	containers := make([]ContainerInfo, 0, len(probe.containerMap))
+	for _, info := range probe.containerMap {
+		containers = append(containers, info)
+	}
+	probe.RUnlock()
+
+	for _, info := range containers {
+		limits, usage, err := probe.cgroups.read(info.Pid)
+		if err != nil {
+			logging.GetLogger().Debugf("Unable to read the cgroups of the container %s: %s", info.Node.ID, err.Error())
+			continue
+		}
+
+		probe.Graph.Lock()
+		if probe.Graph.GetNode(info.Node.ID) != nil {
+			tr := probe.Graph.StartMetadataTransaction(info.Node)
+			tr.AddMetadata(topology.CgroupKey, map[string]interface{}(limits))
+			tr.AddMetadata(topology.CgroupUsageKey, map[string]interface{}(usage))
+			tr.Commit()
+		}
+		probe.Graph.Unlock()
+	}
+}
+
+// newCgroupReader returns nil if the interval is 0
+func newCgroupReader(root string, interval time.Duration) *cgroupReader {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &cgroupReader{
+		proc:     "/proc",
+		root:     root,
+		interval: interval,
+	}
+}
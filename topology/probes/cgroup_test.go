@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func newCgroupTestReader(t *testing.T) (*cgroupReader, string) {
+	tmp, err := ioutil.TempDir("", "skydive_cgroup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return &cgroupReader{
+		proc:     filepath.Join(tmp, "proc"),
+		root:     filepath.Join(tmp, "cgroup"),
+		interval: time.Second,
+	}, tmp
+}
+
+func TestCgroupReaderV1(t *testing.T) {
+	c, tmp := newCgroupTestReader(t)
+	defer os.RemoveAll(tmp)
+
+	writeCgroupFiles(t, filepath.Join(c.proc, "42"), map[string]string{
+		"cgroup": "5:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n1:name=systemd:/docker/abc\n",
+	})
+	writeCgroupFiles(t, filepath.Join(c.root, "memory/docker/abc"), map[string]string{
+		"memory.limit_in_bytes": "268435456\n",
+		"memory.usage_in_bytes": "1048576\n",
+	})
+	writeCgroupFiles(t, filepath.Join(c.root, "cpu,cpuacct/docker/abc"), map[string]string{
+		"cpu.cfs_quota_us":  "50000\n",
+		"cpu.cfs_period_us": "100000\n",
+		"cpu.shares":        "512\n",
+		"cpuacct.usage":     "123456789\n",
+	})
+
+	limits, usage, err := c.read(42)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if limits["MemoryLimit"] != int64(268435456) || limits["CPULimit"] != 0.5 || limits["CPUShares"] != int64(512) {
+		t.Errorf("Wrong cgroup v1 limits: %v", limits)
+	}
+	if usage["Memory"] != int64(1048576) || usage["CPUTime"] != int64(123456789) {
+		t.Errorf("Wrong cgroup v1 usage: %v", usage)
+	}
+
+	// the unlimited memory isn't reported
+	writeCgroupFiles(t, filepath.Join(c.root, "memory/docker/abc"), map[string]string{
+		"memory.limit_in_bytes": "9223372036854771712\n",
+	})
+	if limits, _, _ = c.read(42); limits["MemoryLimit"] != nil {
+		t.Errorf("Unlimited memory shouldn't be reported: %v", limits)
+	}
+}
+
+func TestCgroupReaderV2(t *testing.T) {
+	c, tmp := newCgroupTestReader(t)
+	defer os.RemoveAll(tmp)
+
+	writeCgroupFiles(t, filepath.Join(c.proc, "42"), map[string]string{
+		"cgroup": "0::/system.slice/docker-abc.scope\n",
+	})
+	writeCgroupFiles(t, filepath.Join(c.root, "system.slice/docker-abc.scope"), map[string]string{
+		"memory.max":     "max\n",
+		"memory.current": "2097152\n",
+		"cpu.max":        "200000 100000\n",
+		"cpu.weight":     "100\n",
+		"cpu.stat":       "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n",
+	})
+
+	limits, usage, err := c.read(42)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(limits) != 2 || limits["CPULimit"] != 2.0 || limits["CPUWeight"] != int64(100) {
+		t.Errorf("Wrong cgroup v2 limits: %v", limits)
+	}
+	if usage["Memory"] != int64(2097152) || usage["CPUTime"] != int64(1500000) {
+		t.Errorf("Wrong cgroup v2 usage: %v", usage)
+	}
+
+	if _, _, err := c.read(43); err == nil {
+		t.Error("Missing process should report an error")
+	}
+}
+
+func TestCgroupUsageVolatile(t *testing.T) {
+	if graph.MetadataPersistence(topology.CgroupUsageKey) != graph.VolatilePersistence {
+		t.Error("Cgroup usage updates should be volatile")
+	}
+	if graph.MetadataPersistence(topology.CgroupKey) == graph.VolatilePersistence {
+		t.Error("Cgroup limits should be persisted")
+	}
+}
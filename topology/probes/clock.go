@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// bits of the status of the kernel clock, see adjtimex(2)
+const (
+	staUnsync = 0x0040
+	staNano   = 0x2000
+	timeError = 5
+)
+
+// clockStatus is the synchronization status of the clock of the host, its
+// offset, in seconds, being positive when the clock is ahead of its source
+type clockStatus struct {
+	Synchronized bool
+	Offset       float64
+	Source       string
+	Server       string
+	Stratum      int64
+}
+
+func (s *clockStatus) metadata() map[string]interface{} {
+	m := map[string]interface{}{
+		"Synchronized": s.Synchronized,
+		"Offset":       s.Offset,
+		"Source":       s.Source,
+	}
+	if s.Server != "" {
+		m["Server"] = s.Server
+	}
+	if s.Stratum > 0 {
+		m["Stratum"] = s.Stratum
+	}
+	return m
+}
+
+// clockSource reads the status of the clock from a synchronization daemon
+// or from the kernel
+type clockSource struct {
+	name string
+	read func() (*clockStatus, error)
+}
+
+// parseChronyTracking parses the output of chronyc -c tracking, its
+// fields being the reference ID, the server, the stratum, the reference
+// time, the correction of the system time, positive when the clock is
+// slow, then the other statistics and the leap status.
+func parseChronyTracking(output []byte) (*clockStatus, error) {
+	fields := strings.Split(strings.TrimSpace(string(output)), ",")
+	if len(fields) < 14 {
+		return nil, fmt.Errorf("unexpected chrony tracking output: %s", output)
+	}
+
+	correction, err := strconv.ParseFloat(fields[4], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chrony system time correction: %s", fields[4])
+	}
+	stratum, _ := strconv.ParseInt(fields[2], 10, 64)
+
+	return &clockStatus{
+		Synchronized: fields[len(fields)-1] != "Not synchronised" && stratum > 0,
+		Offset:       -correction,
+		Source:       "chrony",
+		Server:       fields[1],
+		Stratum:      stratum,
+	}, nil
+}
+
+// parseNtpqVariables parses the system variables given by ntpq -c rv, the
+// offset being in milliseconds and the synchronization source in the
+// status, ie. "sync_ntp", unsynchronized being "sync_unspec".
+func parseNtpqVariables(output []byte) (*clockStatus, error) {
+	variables := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		for _, field := range strings.Split(scanner.Text(), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 {
+				variables[kv[0]] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+
+	offset, err := strconv.ParseFloat(variables["offset"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("no offset in the ntpq output: %s", output)
+	}
+	stratum, _ := strconv.ParseInt(variables["stratum"], 10, 64)
+
+	status := &clockStatus{
+		Synchronized: !strings.Contains(variables["status"], "sync_unspec") && !strings.Contains(variables["status"], "leap_alarm"),
+		Offset:       offset / 1000,
+		Source:       "ntpd",
+		Server:       variables["refid"],
+		Stratum:      stratum,
+	}
+	if stratum >= 16 {
+		status.Synchronized = false
+	}
+	return status, nil
+}
+
+func readChronyTracking() (*clockStatus, error) {
+	output, err := exec.Command("chronyc", "-c", "tracking").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseChronyTracking(output)
+}
+
+func readNtpqVariables() (*clockStatus, error) {
+	output, err := exec.Command("ntpq", "-c", "rv 0 status,offset,refid,stratum").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseNtpqVariables(output)
+}
+
+// kernelClockStatus returns the status of the kernel clock, the one given by
+// timedatectl, the source being unknown.
+func kernelClockStatus(tx *syscall.Timex, state int) *clockStatus {
+	offset := float64(tx.Offset) / float64(time.Second/time.Microsecond)
+	if tx.Status&staNano != 0 {
+		offset = float64(tx.Offset) / float64(time.Second)
+	}
+
+	return &clockStatus{
+		Synchronized: tx.Status&staUnsync == 0 && state != timeError,
+		Offset:       offset,
+		Source:       "kernel",
+	}
+}
+
+func readKernelClock() (*clockStatus, error) {
+	tx := &syscall.Timex{}
+	state, err := syscall.Adjtimex(tx)
+	if err != nil {
+		return nil, err
+	}
+	return kernelClockStatus(tx, state), nil
+}
+
+// defaultClockSources are the sources read in order, the kernel one
+// always answering
+var defaultClockSources = []clockSource{
+	{name: "chrony", read: readChronyTracking},
+	{name: "ntpd", read: readNtpqVariables},
+	{name: "kernel", read: readKernelClock},
+}
+
+// ClockProbe records the synchronization status of the clock of the host
+// as the Clock metadata of the host node, every interval: whether it is
+// synchronized, its offset in seconds, its source and its server, so that
+// the skewed hosts can be flagged and alerted on, ie.
+//
+//	G.V().Has('Type', 'host', 'Clock.Synchronized', false)
+//
+// chrony then ntpd are queried through their control programs, the kernel
+// clock being read otherwise.
+type ClockProbe struct {
+	Graph    *graph.Graph
+	Root     *graph.Node
+	interval time.Duration
+	sources  []clockSource
+	quit     chan bool
+}
+
+// read returns the status given by the first source answering
+func (c *ClockProbe) read() (*clockStatus, error) {
+	for _, source := range c.sources {
+		status, err := source.read()
+		if err == nil {
+			return status, nil
+		}
+		logging.GetLogger().Debugf("Unable to read the clock status from %s: %s", source.name, err.Error())
+	}
+	return nil, errors.New("no clock source available")
+}
+
+func (c *ClockProbe) update() {
+	status, err := c.read()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to read the clock status: %s", err.Error())
+		return
+	}
+
+	c.Graph.Lock()
+	defer c.Graph.Unlock()
+
+	if m := status.metadata(); !reflect.DeepEqual(c.Root.Metadata()[topology.ClockKey], m) {
+		c.Graph.AddMetadata(c.Root, topology.ClockKey, m)
+	}
+}
+
+func (c *ClockProbe) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.update()
+
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *ClockProbe) Start() {
+	go c.run()
+}
+
+func (c *ClockProbe) Stop() {
+	close(c.quit)
+}
+
+// Check verifies that the status of the clock can be read
+func (c *ClockProbe) Check() []probe.CheckResult {
+	_, err := c.read()
+	return []probe.CheckResult{
+		probe.NewCheckResult("clock status", err, "install chrony or ntpd, or allow the adjtimex system call"),
+	}
+}
+
+// NewClockProbe returns a probe reading the status of the clock every
+// interval.
+func NewClockProbe(g *graph.Graph, n *graph.Node, interval time.Duration) *ClockProbe {
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	return &ClockProbe{
+		Graph:    g,
+		Root:     n,
+		interval: interval,
+		sources:  defaultClockSources,
+		quit:     make(chan bool),
+	}
+}
+
+func NewClockProbeFromConfig(g *graph.Graph, n *graph.Node) *ClockProbe {
+	interval := time.Duration(config.GetConfig().GetInt("agent.topology.clock.interval")) * time.Second
+	return NewClockProbe(g, n, interval)
+}
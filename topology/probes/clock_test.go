@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestParseChronyTracking(t *testing.T) {
+	status, err := parseChronyTracking([]byte("A9FEA97B,169.254.169.123,4,1573484520.662893240,0.000007519,-0.000001235,0.000010231,-17.271,-0.001,0.018,0.000388413,0.000169627,16.3,Normal\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the clock is slow, behind its source
+	expected := &clockStatus{Synchronized: true, Offset: -0.000007519, Source: "chrony", Server: "169.254.169.123", Stratum: 4}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Wrong chrony status: %+v", status)
+	}
+
+	status, err = parseChronyTracking([]byte("7F7F0101,,10,0.000000000,0.000000000,0.000000000,0.000000000,0.000,0.000,0.000,0.000000000,0.000000000,0.0,Not synchronised\n"))
+	if err != nil || status.Synchronized {
+		t.Errorf("Chrony not synchronised: %+v, %v", status, err)
+	}
+
+	if _, err := parseChronyTracking([]byte("506 Cannot talk to daemon\n")); err == nil {
+		t.Error("Error expected without chronyd")
+	}
+}
+
+func TestParseNtpqVariables(t *testing.T) {
+	status, err := parseNtpqVariables([]byte("status=0615 leap_none, sync_ntp, 1 event, clock_sync,\noffset=-12.345, refid=192.168.1.1, stratum=3\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := &clockStatus{Synchronized: true, Offset: -0.012345, Source: "ntpd", Server: "192.168.1.1", Stratum: 3}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Wrong ntpd status: %+v", status)
+	}
+
+	status, err = parseNtpqVariables([]byte("status=c016 leap_alarm, sync_unspec, 1 event, restart,\noffset=0.000, refid=INIT, stratum=16\n"))
+	if err != nil || status.Synchronized {
+		t.Errorf("ntpd not synchronized: %+v, %v", status, err)
+	}
+}
+
+func TestKernelClockStatus(t *testing.T) {
+	status := kernelClockStatus(&syscall.Timex{Offset: -1500, Status: 0x0001}, 0)
+	if !status.Synchronized || status.Offset != -0.0015 || status.Source != "kernel" {
+		t.Errorf("Wrong kernel status: %+v", status)
+	}
+
+	status = kernelClockStatus(&syscall.Timex{Offset: 2000000, Status: staNano}, 0)
+	if !status.Synchronized || status.Offset != 0.002 {
+		t.Errorf("Wrong kernel status in nanoseconds: %+v", status)
+	}
+
+	if status := kernelClockStatus(&syscall.Timex{Status: staUnsync}, timeError); status.Synchronized {
+		t.Errorf("Kernel clock not synchronized: %+v", status)
+	}
+}
+
+func TestClockProbe(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	c := NewClockProbe(g, root, 0)
+	c.sources = []clockSource{
+		{name: "chrony", read: func() (*clockStatus, error) { return nil, errors.New("chronyc not found") }},
+		{name: "ntpd", read: func() (*clockStatus, error) {
+			return &clockStatus{Synchronized: true, Offset: 0.25, Source: "ntpd", Server: "10.0.0.1", Stratum: 2}, nil
+		}},
+	}
+	c.update()
+
+	clock, _ := root.Metadata()[topology.ClockKey].(map[string]interface{})
+	expected := map[string]interface{}{"Synchronized": true, "Offset": 0.25, "Source": "ntpd", "Server": "10.0.0.1", "Stratum": int64(2)}
+	if !reflect.DeepEqual(clock, expected) {
+		t.Errorf("Wrong clock metadata: %v", root.Metadata()[topology.ClockKey])
+	}
+
+	if checks := c.Check(); len(checks) != 1 || !checks[0].Passed() {
+		t.Errorf("Clock check should pass: %+v", checks)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type dhcpLease struct {
+	client    string
+	address   string
+	server    string
+	leaseTime int64
+	expire    time.Time
+}
+
+// dhcpLeaseReader looks up the leases of the DHCP clients, dhclient lease
+// files are matched by interface name and systemd-networkd ones by index.
+// The files are read again every interval, not on each lookup.
+type dhcpLeaseReader struct {
+	sync.RWMutex
+	dhclientLeases []string
+	networkdLeases string
+	interval       time.Duration
+	last           time.Time
+	logger         Logger
+	// leases of the last read, by interface name and index
+	dhclient map[string][]*dhcpLease
+	networkd map[int64]*dhcpLease
+}
+
+// dhcpMetadata returns the lease metadata, Dynamic telling whether the
+// address of the lease is one of the current addresses of the interface.
+func dhcpMetadata(l *dhcpLease, ipv4 string) map[string]interface{} {
+	m := map[string]interface{}{
+		"Client":  l.client,
+		"Address": l.address,
+	}
+	if l.server != "" {
+		m["Server"] = l.server
+	}
+	if l.leaseTime > 0 {
+		m["LeaseTime"] = l.leaseTime
+	}
+	if !l.expire.IsZero() {
+		m["Expire"] = l.expire.Unix()
+	}
+
+	dynamic := false
+	for _, addr := range strings.Split(ipv4, ", ") {
+		if strings.SplitN(addr, "/", 2)[0] == l.address {
+			dynamic = true
+		}
+	}
+	m["Dynamic"] = dynamic
+
+	return m
+}
+
+// parseDhclientDate parses the "expire 2 2016/07/12 20:00:00" and the
+// "expire epoch 1468353600" formats, dates are in UTC.
+func parseDhclientDate(fields []string) time.Time {
+	if len(fields) == 2 && fields[0] == "epoch" {
+		if s, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(s, 0)
+		}
+	}
+	if len(fields) == 3 {
+		if t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseDhclientLeases returns the last lease of each interface, dhclient
+// appending the new leases at the end of the file.
+func parseDhclientLeases(r io.Reader) map[string]*dhcpLease {
+	leases := make(map[string]*dhcpLease)
+
+	var lease *dhcpLease
+	var intf string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// drop trailing comments and semicolons
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		line = strings.TrimSuffix(line, ";")
+
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "lease":
+			lease, intf = &dhcpLease{client: "dhclient"}, ""
+		case fields[0] == "}":
+			if lease != nil && intf != "" && lease.address != "" {
+				leases[intf] = lease
+			}
+			lease = nil
+		case lease == nil:
+		case fields[0] == "interface" && len(fields) == 2:
+			intf = strings.Trim(fields[1], `"`)
+		case fields[0] == "fixed-address" && len(fields) == 2:
+			lease.address = fields[1]
+		case fields[0] == "expire":
+			lease.expire = parseDhclientDate(fields[1:])
+		case fields[0] == "option" && len(fields) == 3:
+			switch fields[1] {
+			case "dhcp-server-identifier":
+				lease.server = fields[2]
+			case "dhcp-lease-time":
+				lease.leaseTime, _ = strconv.ParseInt(fields[2], 10, 64)
+			}
+		}
+	}
+
+	return leases
+}
+
+// parseNetworkdLease parses the KEY=value lease files of systemd-networkd
+func parseNetworkdLease(r io.Reader) *dhcpLease {
+	lease := &dhcpLease{client: "systemd-networkd"}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "ADDRESS":
+			lease.address = kv[1]
+		case "SERVER_ADDRESS":
+			lease.server = kv[1]
+		case "LIFETIME":
+			lease.leaseTime, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+
+	if lease.address == "" {
+		return nil
+	}
+	return lease
+}
+
+// readDhclient returns the leases of every dhclient lease file by interface
+func (d *dhcpLeaseReader) readDhclient() map[string][]*dhcpLease {
+	leases := make(map[string][]*dhcpLease)
+
+	for _, pattern := range d.dhclientLeases {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				d.logger.Debugf("Unable to read DHCP lease file %s: %s", file, err.Error())
+				continue
+			}
+			for name, l := range parseDhclientLeases(f) {
+				leases[name] = append(leases[name], l)
+			}
+			f.Close()
+		}
+	}
+
+	return leases
+}
+
+// readNetworkd returns the leases of systemd-networkd by interface index
+func (d *dhcpLeaseReader) readNetworkd() map[int64]*dhcpLease {
+	leases := make(map[int64]*dhcpLease)
+	if d.networkdLeases == "" {
+		return leases
+	}
+
+	files, _ := ioutil.ReadDir(d.networkdLeases)
+	for _, file := range files {
+		index, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(d.networkdLeases, file.Name()))
+		if err != nil {
+			continue
+		}
+		if l := parseNetworkdLease(f); l != nil {
+			leases[index] = l
+		}
+		f.Close()
+	}
+
+	return leases
+}
+
+// due returns whether the lease files have to be read again
+func (d *dhcpLeaseReader) due(now time.Time) bool {
+	return d != nil && now.Sub(d.last) >= d.interval
+}
+
+// refresh reads the lease files again
+func (d *dhcpLeaseReader) refresh(now time.Time) {
+	if d == nil {
+		return
+	}
+
+	dhclient, networkd := d.readDhclient(), d.readNetworkd()
+
+	d.Lock()
+	d.dhclient, d.networkd, d.last = dhclient, networkd, now
+	d.Unlock()
+}
+
+func (d *dhcpLeaseReader) lookupDhclient(name string, now time.Time) *dhcpLease {
+	d.RLock()
+	defer d.RUnlock()
+
+	var lease *dhcpLease
+	for _, l := range d.dhclient[name] {
+		if !l.expire.IsZero() && l.expire.Before(now) {
+			continue
+		}
+		if lease == nil || l.expire.After(lease.expire) {
+			lease = l
+		}
+	}
+
+	return lease
+}
+
+func (d *dhcpLeaseReader) lookupNetworkd(index int64) *dhcpLease {
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.networkd[index]
+}
+
+// lookup returns the current lease of an interface, nil if the interface is
+// not configured through DHCP or if no supported client is in use.
+func (d *dhcpLeaseReader) lookup(name string, index int64) *dhcpLease {
+	if d == nil {
+		return nil
+	}
+
+	if lease := d.lookupNetworkd(index); lease != nil {
+		return lease
+	}
+	return d.lookupDhclient(name, time.Now())
+}
+
+// updateDHCPLeases reads the lease files again once per interval and
+// updates the DHCP metadata of the interfaces, the leases being renewed or
+// expiring without any link event. It has to be called without holding
+// the graph lock.
+func (u *NetLinkProbe) updateDHCPLeases() {
+	now := time.Now()
+	if !u.dhcpLeases.due(now) {
+		return
+	}
+	u.dhcpLeases.refresh(now)
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for _, intf := range u.Graph.LookupChildren(u.Root, graph.Metadata{}) {
+		name, _ := intf.Metadata()["Name"].(string)
+		index, ok := intf.Metadata()["IfIndex"].(int64)
+		if !ok {
+			continue
+		}
+
+		m := make(graph.Metadata)
+		for k, v := range intf.Metadata() {
+			if k != "DHCP" {
+				m[k] = v
+			}
+		}
+		if lease := u.dhcpLeases.lookup(name, index); lease != nil {
+			ipv4, _ := m["IPV4"].(string)
+			m["DHCP"] = dhcpMetadata(lease, ipv4)
+		}
+
+		if !reflect.DeepEqual(m, intf.Metadata()) {
+			u.Graph.SetMetadata(intf, m)
+		}
+	}
+}
+
+// newDHCPLeaseReader returns nil if no lease file location is given.
+func newDHCPLeaseReader(dhclientLeases []string, networkdLeases string, interval time.Duration, logger Logger) *dhcpLeaseReader {
+	if len(dhclientLeases) == 0 && networkdLeases == "" {
+		return nil
+	}
+
+	return &dhcpLeaseReader{
+		dhclientLeases: dhclientLeases,
+		networkdLeases: networkdLeases,
+		interval:       interval,
+		logger:         logger,
+	}
+}
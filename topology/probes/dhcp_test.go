@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const dhclientLeases = `lease {
+  interface "eth0";
+  fixed-address 192.168.0.10;
+  option dhcp-lease-time 600;
+  option dhcp-server-identifier 192.168.0.1;
+  expire 2 2016/07/12 10:00:00;
+}
+lease {
+  interface "eth0";
+  fixed-address 192.168.0.11;
+  option subnet-mask 255.255.255.0;
+  option dhcp-lease-time 86400;
+  option dhcp-server-identifier 192.168.0.1;
+  renew 3 2016/07/13 08:00:00;
+  expire epoch 1468411200; # Wed Jul 13 12:00:00 2016
+}
+`
+
+func TestParseDhclientLeases(t *testing.T) {
+	leases := parseDhclientLeases(strings.NewReader(dhclientLeases))
+
+	l, ok := leases["eth0"]
+	if !ok {
+		t.Fatal("Lease of eth0 expected")
+	}
+
+	if l.address != "192.168.0.11" || l.server != "192.168.0.1" || l.leaseTime != 86400 || l.expire.Unix() != 1468411200 {
+		t.Errorf("Last lease expected: %+v", l)
+	}
+
+	m := dhcpMetadata(l, "10.0.0.1/8, 192.168.0.11/24")
+	if m["Dynamic"] != true || m["Client"] != "dhclient" {
+		t.Errorf("Dynamic address expected: %v", m)
+	}
+
+	if m = dhcpMetadata(l, "192.168.0.12/24"); m["Dynamic"] != false {
+		t.Errorf("Static address expected: %v", m)
+	}
+}
+
+func TestDHCPLeaseLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "dhclient.eth0.leases"), []byte(dhclientLeases), 0644)
+	os.Mkdir(filepath.Join(dir, "netif"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "netif", "3"), []byte("# This is private data. Do not parse.\nADDRESS=10.1.0.5\nSERVER_ADDRESS=10.1.0.1\nLIFETIME=3600\n"), 0644)
+
+	d := newDHCPLeaseReader([]string{filepath.Join(dir, "dhclient*.leases")}, filepath.Join(dir, "netif"), time.Minute, defaultLogger(nil))
+	if !d.due(time.Now()) {
+		t.Fatal("Leases should be read first")
+	}
+	d.refresh(time.Now())
+	if d.due(time.Now()) {
+		t.Error("Leases should only be read again after the interval")
+	}
+
+	if l := d.lookup("eth1", 3); l == nil || l.client != "systemd-networkd" || l.address != "10.1.0.5" || l.leaseTime != 3600 {
+		t.Errorf("systemd-networkd lease expected: %+v", l)
+	}
+
+	// the dhclient lease has expired since
+	if l := d.lookupDhclient("eth0", time.Now()); l != nil {
+		t.Errorf("Expired lease returned: %+v", l)
+	}
+
+	if l := d.lookupDhclient("eth0", time.Unix(1468400000, 0)); l == nil || l.address != "192.168.0.11" {
+		t.Errorf("dhclient lease expected: %+v", l)
+	}
+
+	var none *dhcpLeaseReader
+	if l := none.lookup("eth0", 2); l != nil {
+		t.Errorf("No lease expected without DHCP client: %+v", l)
+	}
+}
+
+func TestDHCPLeaseRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "dhcp", "Type": topology.HostType})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": topology.DeviceType, "IfIndex": int64(3), "IPV4": "10.1.0.5/24"})
+	g.Link(root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	g.Unlock()
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{NetworkdLeases: dir, DHCPInterval: time.Nanosecond})
+
+	lease := func() map[string]interface{} {
+		g.RLock()
+		defer g.RUnlock()
+		m, _ := intf.Metadata()["DHCP"].(map[string]interface{})
+		return m
+	}
+
+	// renewed with another address without any link event
+	for _, address := range []string{"10.1.0.5", "10.1.0.6"} {
+		ioutil.WriteFile(filepath.Join(dir, "3"), []byte("ADDRESS="+address+"\nLIFETIME=3600\n"), 0644)
+		u.updateDHCPLeases()
+		if m := lease(); m == nil || m["Address"] != address || m["Dynamic"] != (address == "10.1.0.5") {
+			t.Errorf("Lease of %s expected: %v", address, m)
+		}
+	}
+
+	// released
+	os.Remove(filepath.Join(dir, "3"))
+	u.updateDHCPLeases()
+	if m := lease(); m != nil {
+		t.Errorf("Lease released expected to be removed: %v", m)
+	}
+}
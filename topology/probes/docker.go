@@ -24,6 +24,9 @@ package probes
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,8 +34,11 @@ import (
 	"github.com/lebauce/dockerclient"
 	"github.com/vishvananda/netns"
 
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
@@ -49,7 +55,7 @@ type ContainerInfo struct {
 
 type DockerProbe struct {
 	sync.RWMutex
-	NetNSProbe
+	*NetNSProbe
 	url          string
 	client       *dockerclient.DockerClient
 	state        int64
@@ -58,6 +64,7 @@ type DockerProbe struct {
 	wg           sync.WaitGroup
 	hostNs       netns.NsHandle
 	containerMap map[string]ContainerInfo
+	cgroups      *cgroupReader
 }
 
 func (probe *DockerProbe) containerNamespace(pid int) string {
@@ -91,19 +98,25 @@ func (probe *DockerProbe) registerContainer(id string) {
 		n = probe.Root
 	} else {
 		n = probe.Register(namespace, graph.Metadata{"Name": info.Name[1:], "Manager": "docker"})
-
+		if n == nil {
+			return
+		}
 	}
 
 	probe.Graph.Lock()
 	metadata := graph.Metadata{
-		"Type":                 "container",
+		"Type":                 topology.ContainerType,
 		"Name":                 info.Name[1:],
 		"Docker.ContainerID":   info.Id,
 		"Docker.ContainerName": info.Name,
 		"Docker.ContainerPID":  info.State.Pid,
 	}
 	containerNode := probe.Graph.NewNode(graph.GenID(), metadata)
-	probe.Graph.Link(n, containerNode, graph.Metadata{"RelationType": "membership"})
+	if containerNode == nil {
+		probe.Graph.Unlock()
+		return
+	}
+	probe.Graph.Link(n, containerNode, graph.Metadata{"RelationType": topology.MembershipRelation})
 	probe.Graph.Unlock()
 
 	probe.containerMap[info.Id] = ContainerInfo{
@@ -147,7 +160,7 @@ func (probe *DockerProbe) connect() error {
 	}
 
 	logging.GetLogger().Debugf("Connecting to Docker daemon: %s", probe.url)
-	probe.client, err = dockerclient.NewDockerClient(probe.url, nil)
+	probe.client, err = probe.newClient()
 	if err != nil {
 		logging.GetLogger().Errorf("Failed to connect to Docker daemon: %s", err.Error())
 		return err
@@ -165,14 +178,23 @@ func (probe *DockerProbe) connect() error {
 		return err
 	}
 
+	// refreshed on each reconnection
+	probe.updateVersions()
+
 	probe.wg.Add(2)
 	probe.quit = make(chan bool)
 
+	if probe.cgroups != nil {
+		probe.wg.Add(1)
+		go probe.refreshCgroups(probe.quit)
+	}
+
 	probe.connected.Store(true)
 	defer probe.connected.Store(false)
 
 	go func() {
 		defer probe.wg.Done()
+		defer common.RecoverAndPanic()
 
 		containers, err := probe.client.ListContainers(false, false, "")
 		if err != nil {
@@ -189,17 +211,44 @@ func (probe *DockerProbe) connect() error {
 	}()
 
 	defer probe.wg.Done()
+	defer common.RecoverAndPanic()
+
+	heartbeat := common.NewHeartbeat("docker")
+	common.RegisterHeartbeat(heartbeat)
+	defer common.UnregisterHeartbeat(heartbeat)
 
 	for {
+		heartbeat.Idle()
+
 		select {
 		case <-probe.quit:
 			return nil
 		case e := <-eventErrChan:
+			heartbeat.Beat()
 			if e.Error != nil {
 				logging.GetLogger().Errorf("Got error while waiting for Docker event: %s", e.Error.Error())
 				return e.Error
 			}
 			probe.handleDockerEvent(&e.Event)
+			heartbeat.Updated()
+		}
+	}
+}
+
+// refreshCgroups updates the cgroup metadata of the containers on the
+// interval until the connection to the daemon is closed
+func (probe *DockerProbe) refreshCgroups(quit chan bool) {
+	defer probe.wg.Done()
+
+	ticker := time.NewTicker(probe.cgroups.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			probe.updateCgroups()
 		}
 	}
 }
@@ -223,6 +272,61 @@ func (probe *DockerProbe) Start() {
 	}()
 }
 
+func (probe *DockerProbe) newClient() (*dockerclient.DockerClient, error) {
+	return dockerclient.NewDockerClient(probe.url, nil)
+}
+
+// apiVersionAtLeast returns whether the version of the Docker API, ie. 1.24,
+// is the minimum one or a later one
+func apiVersionAtLeast(version, minimum string) bool {
+	parse := func(v string) (major, minor int) {
+		fmt.Sscanf(strings.TrimPrefix(v, "v"), "%d.%d", &major, &minor)
+		return
+	}
+
+	major, minor := parse(version)
+	minMajor, minMinor := parse(minimum)
+	return major > minMajor || (major == minMajor && minor >= minMinor)
+}
+
+// checkDocker checks the access to the socket of the Docker daemon, when
+// given as unix://path, then the version of its API
+func checkDocker(daemonURL string, client *dockerclient.DockerClient, err error) []probe.CheckResult {
+	var results []probe.CheckResult
+
+	if u, e := url.Parse(daemonURL); e == nil && u.Scheme == "unix" {
+		conn, e := net.Dial("unix", u.Path)
+		if e == nil {
+			conn.Close()
+		} else {
+			e = fmt.Errorf("unable to connect to the Docker socket %s: %s", u.Path, e.Error())
+		}
+		results = append(results, probe.NewCheckResult("Docker socket access", e,
+			fmt.Sprintf("run the agent as root or as a member of the docker group, bind mounting %s if it runs in a container", u.Path)))
+	}
+
+	if err == nil {
+		var version *dockerclient.Version
+		if version, err = client.Version(); err != nil {
+			err = fmt.Errorf("unable to reach the Docker daemon %s: %s", daemonURL, err.Error())
+		} else if !apiVersionAtLeast(version.ApiVersion, dockerclient.APIVersion) {
+			err = fmt.Errorf("Docker API version %s older than %s", version.ApiVersion, strings.TrimPrefix(dockerclient.APIVersion, "v"))
+		}
+	} else {
+		err = fmt.Errorf("unable to connect to the Docker daemon %s: %s", daemonURL, err.Error())
+	}
+
+	return append(results, probe.NewCheckResult("Docker API version", err,
+		fmt.Sprintf("check that the Docker daemon runs and listens on %s, or set docker.url to its address", daemonURL)))
+}
+
+// Check connects to the Docker daemon and asks its version, on top of the
+// namespace checks
+func (probe *DockerProbe) Check() []probe.CheckResult {
+	client, err := probe.newClient()
+	return append(probe.NetNSProbe.Check(), checkDocker(probe.url, client, err)...)
+}
+
 func (probe *DockerProbe) Stop() {
 	if !atomic.CompareAndSwapInt64(&probe.state, RunningState, StoppingState) {
 		return
@@ -236,17 +340,32 @@ func (probe *DockerProbe) Stop() {
 	atomic.StoreInt64(&probe.state, StoppedState)
 }
 
-func NewDockerProbe(g *graph.Graph, n *graph.Node, dockerURL string) (probe *DockerProbe) {
-	probe = &DockerProbe{
-		NetNSProbe:   *NewNetNSProbe(g, n),
+func NewDockerProbe(g *graph.Graph, n *graph.Node, dockerURL string, nsOptions NetNSOptions) (*DockerProbe, error) {
+	nsProbe, err := NewNetNSProbe(g, n, nsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &DockerProbe{
+		NetNSProbe:   nsProbe,
 		url:          dockerURL,
 		containerMap: make(map[string]ContainerInfo),
 		state:        StoppedState,
 	}
-	return
+	return probe, nil
 }
 
 func NewDockerProbeFromConfig(g *graph.Graph, n *graph.Node) *DockerProbe {
-	dockerURL := config.GetConfig().GetString("docker.url")
-	return NewDockerProbe(g, n, dockerURL)
+	cfg := config.GetConfig()
+	dockerURL := cfg.GetString("docker.url")
+
+	probe, err := NewDockerProbe(g, n, dockerURL, NetNSOptionsFromConfig())
+	if err != nil {
+		logging.GetLogger().Fatal(err.Error())
+	}
+
+	interval := time.Duration(cfg.GetInt("docker.cgroup.interval")) * time.Second
+	probe.cgroups = newCgroupReader(cfg.GetString("docker.cgroup.root"), interval)
+
+	return probe
 }
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lebauce/dockerclient"
+)
+
+func TestAPIVersionAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		ok      bool
+	}{
+		{"1.15", true},
+		{"1.24", true},
+		{"2.0", true},
+		{"1.9", false},
+		{"", false},
+	} {
+		if ok := apiVersionAtLeast(tc.version, "v1.15"); ok != tc.ok {
+			t.Errorf("Wrong comparison of %s to 1.15: %v", tc.version, ok)
+		}
+	}
+}
+
+// serveDocker answers the version requests on a unix socket as a Docker
+// daemon of the given API version
+func serveDocker(t *testing.T, path string, apiVersion string) net.Listener {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"ApiVersion": "%s", "Version": "1.12.0"}`, apiVersion)
+	}))
+
+	return l
+}
+
+func TestCheckDocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-docker")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	check := func(path string) (passed []bool) {
+		daemonURL := "unix://" + path
+		client, err := dockerclient.NewDockerClient(daemonURL, nil)
+		for _, c := range checkDocker(daemonURL, client, err) {
+			passed = append(passed, c.Passed())
+			if !c.Passed() && c.Hint == "" {
+				t.Errorf("Hint expected for %s", c.Name)
+			}
+		}
+		return
+	}
+
+	if passed := check(filepath.Join(dir, "missing.sock")); len(passed) != 2 || passed[0] || passed[1] {
+		t.Errorf("Socket and version checks expected to fail: %v", passed)
+	}
+
+	path := filepath.Join(dir, "docker.sock")
+	l := serveDocker(t, path, "1.24")
+	if passed := check(path); len(passed) != 2 || !passed[0] || !passed[1] {
+		t.Errorf("Socket and version checks expected to pass: %v", passed)
+	}
+	l.Close()
+
+	path = filepath.Join(dir, "old.sock")
+	l = serveDocker(t, path, "1.12")
+	defer l.Close()
+	if passed := check(path); len(passed) != 2 || !passed[0] || passed[1] {
+		t.Errorf("Version check expected to fail: %v", passed)
+	}
+}
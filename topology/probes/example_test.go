@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes_test
+
+import (
+	"log"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/probes"
+)
+
+// stdLogger sends the probe logs to the standard logger
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{})   {}
+func (stdLogger) Infof(format string, args ...interface{})    { log.Printf(format, args...) }
+func (stdLogger) Warningf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{})   { log.Printf(format, args...) }
+
+// Discovers the interfaces of the host and of its namespaces into a memory
+// graph, without any agent configuration.
+func ExampleNewNetLinkProbe() {
+	backend, err := graph.NewMemoryBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	g, err := graph.NewGraphWithOptions(backend, graph.GraphOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	nlOptions := probes.NetLinkOptions{
+		InterfaceTypes: []string{"device", "bridge", "veth", "openvswitch"},
+		SysctlKeys:     []string{"net.ipv4.ip_forward"},
+		Logger:         stdLogger{},
+	}
+
+	nlProbe := probes.NewNetLinkProbe(g, root, nlOptions)
+	nlProbe.Start()
+	defer nlProbe.Stop()
+
+	nsProbe, err := probes.NewNetNSProbe(g, root, probes.NetNSOptions{NetLink: nlOptions, Logger: stdLogger{}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	nsProbe.Start()
+	defer nsProbe.Stop()
+
+	time.Sleep(time.Second)
+
+	g.RLock()
+	for _, intf := range g.LookupChildren(root, graph.Metadata{}) {
+		log.Printf("%s: %v", intf.Metadata()["Name"], intf.Metadata()["Type"])
+	}
+	g.RUnlock()
+}
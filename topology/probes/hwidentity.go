@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"syscall"
+	"unsafe"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const ETHTOOL_GPERMADDR = 0x00000020
+
+// maximum number of names kept in the PreviousNames of an interface
+const maxPreviousNames = 8
+
+// Naming policies of the physical NICs, given by their name
+const (
+	// eth0, the names given by the kernel in the probe order
+	KernelNaming = "kernel"
+	// ens3, enp0s3, the predictable names of systemd/udev
+	PredictableNaming = "predictable"
+	// em1, p1p1, the names of biosdevname
+	BiosDevNaming = "biosdevname"
+	// any other name, ie. set by a udev rule
+	CustomNaming = "custom"
+)
+
+var (
+	kernelNameRegexp      = regexp.MustCompile(`^(eth|wlan|wwan|ib|usb)[0-9]+$`)
+	predictableNameRegexp = regexp.MustCompile(`^(en|ib|sl|wl|ww)(b[0-9]+|c[0-9a-f]+|a[0-9a-z]+i[0-9]+|o[0-9]+|s[0-9]+|x[0-9a-f]{12}|P[0-9]+p[0-9]+s[0-9]+|p[0-9]+s[0-9]+|v[0-9]+|i[0-9]+)`)
+	biosDevNameRegexp     = regexp.MustCompile(`^(em[0-9]+|p[0-9]+p[0-9]+)(_[0-9]+)?$`)
+)
+
+// ethtoolPermAddr is the struct ethtool_perm_addr of ETHTOOL_GPERMADDR
+// with room for the largest address
+type ethtoolPermAddr struct {
+	Cmd  uint32
+	Size uint32
+	Data [32]byte
+}
+
+// getPermanentMAC returns the permanent MAC of the device of an interface
+// of the namespace of the thread, the one burnt in the NIC, which isn't
+// changed when the MAC of the interface is, ie. by a bond. Empty for the
+// devices without one.
+func getPermanentMAC(name string) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return ""
+	}
+	defer syscall.Close(fd)
+
+	addr := &ethtoolPermAddr{Cmd: ETHTOOL_GPERMADDR, Size: 32}
+
+	var ifr ethtoolIfreq
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	ifr.data = uintptr(unsafe.Pointer(addr))
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return ""
+	}
+
+	if addr.Size > 32 || len(bytes.Trim(addr.Data[:addr.Size], "\x00")) == 0 {
+		return ""
+	}
+	return net.HardwareAddr(addr.Data[:addr.Size]).String()
+}
+
+// permanentMAC returns the permanent MAC of a link, given by the link
+// message on the recent kernels, read through ethtool otherwise
+func permanentMAC(name string, info *linkInfo) string {
+	if info != nil && len(info.PermAddress) > 0 {
+		return info.PermAddress.String()
+	}
+	return getPermanentMAC(name)
+}
+
+// pciAddress returns the PCI address of the device of a link, its parent
+// device on the pci bus given by the link message on the recent kernels,
+// read through ethtool otherwise
+func pciAddress(name string, info *linkInfo) string {
+	if info != nil && info.ParentBus == "pci" && pciAddressRegexp.MatchString(info.ParentDev) {
+		return info.ParentDev
+	}
+	return getPCIAddress(name)
+}
+
+// namingPolicy returns the naming policy the name of a physical NIC
+// follows
+func namingPolicy(name string) string {
+	switch {
+	case kernelNameRegexp.MatchString(name):
+		return KernelNaming
+	case predictableNameRegexp.MatchString(name):
+		return PredictableNaming
+	case biosDevNameRegexp.MatchString(name):
+		return BiosDevNaming
+	}
+	return CustomNaming
+}
+
+// previousNames returns the PreviousNames of a renamed interface, the
+// former name being added last
+func previousNames(m graph.Metadata, name string) []interface{} {
+	names := []interface{}{}
+	if previous, ok := m["PreviousNames"].([]interface{}); ok {
+		names = append(names, previous...)
+	}
+	names = append(names, name)
+
+	if len(names) > maxPreviousNames {
+		names = names[len(names)-maxPreviousNames:]
+	}
+	return names
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestNamingPolicy(t *testing.T) {
+	for name, policy := range map[string]string{
+		"eth0":            KernelNaming,
+		"wlan1":           KernelNaming,
+		"ens3":            PredictableNaming,
+		"enp0s3":          PredictableNaming,
+		"enp5s0f1":        PredictableNaming,
+		"eno1":            PredictableNaming,
+		"enx525400123456": PredictableNaming,
+		"wlp2s0":          PredictableNaming,
+		"em1":             BiosDevNaming,
+		"p1p2":            BiosDevNaming,
+		"uplink":          CustomNaming,
+		"ethernet":        CustomNaming,
+	} {
+		if p := namingPolicy(name); p != policy {
+			t.Errorf("Wrong naming policy of %s: %s, expected %s", name, p, policy)
+		}
+	}
+}
+
+func TestHardwareIdentity(t *testing.T) {
+	for _, test := range []struct {
+		metadata graph.Metadata
+		key      string
+	}{
+		{graph.Metadata{"PermanentMAC": "52:54:00:12:34:56", "PCIAddress": "0000:00:03.0"}, "PermanentMAC"},
+		{graph.Metadata{"PCIAddress": "0000:00:03.0"}, "PCIAddress"},
+		{graph.Metadata{"PermanentMAC": "52:54:00:12:34:56", "InfoKind": "bond"}, ""},
+		{graph.Metadata{"Name": "lo"}, ""},
+	} {
+		if key, _ := topology.HardwareIdentity(test.metadata); key != test.key {
+			t.Errorf("Wrong hardware identity of %v: %s, expected %s", test.metadata, key, test.key)
+		}
+	}
+}
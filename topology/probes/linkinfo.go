@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// not defined by the vendored netlink
+const (
+	IFLA_INFO_SLAVE_KIND = 4
+
+	IFLA_VRF_TABLE = 1
+
+	IFLA_XFRM_LINK  = 1
+	IFLA_XFRM_IF_ID = 2
+
+	IFLA_GTP_ROLE = 4
+
+	IFLA_PERM_ADDRESS        = 54
+	IFLA_PARENT_DEV_NAME     = 56
+	IFLA_PARENT_DEV_BUS_NAME = 57
+)
+
+// operStates are the RFC 2863 operational states of IFLA_OPERSTATE
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+// linkInfo holds the IFLA_LINKINFO attributes, the vendored netlink only
+// parses the data of the kinds it knows about, the operational state of
+// the link, and the attributes of the device of the link, given by the
+// recent kernels only: its permanent MAC and its parent device, ie. its PCI
+// address on the pci bus.
+type linkInfo struct {
+	Kind        string
+	SlaveKind   string
+	Data        map[string]interface{}
+	OperState   string
+	PermAddress net.HardwareAddr
+	ParentBus   string
+	ParentDev   string
+}
+
+func attrString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func attrUint32(b []byte) (int64, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+	return int64(nl.NativeEndian().Uint32(b[0:4])), true
+}
+
+func parseLinkInfoData(kind string, attrs []syscall.NetlinkRouteAttr) map[string]interface{} {
+	data := make(map[string]interface{})
+
+	for _, attr := range attrs {
+		switch kind {
+		case "vrf":
+			if attr.Attr.Type == IFLA_VRF_TABLE {
+				if v, ok := attrUint32(attr.Value); ok {
+					data["Table"] = v
+				}
+			}
+		case "xfrm":
+			switch attr.Attr.Type {
+			case IFLA_XFRM_LINK:
+				if v, ok := attrUint32(attr.Value); ok {
+					data["Link"] = v
+				}
+			case IFLA_XFRM_IF_ID:
+				if v, ok := attrUint32(attr.Value); ok {
+					data["IfID"] = v
+				}
+			}
+		case "bridge":
+			if attr.Attr.Type == IFLA_BR_MCAST_SNOOPING && len(attr.Value) > 0 {
+				data["MulticastSnooping"] = attr.Value[0] == 1
+			}
+		case "gtp":
+			if attr.Attr.Type == IFLA_GTP_ROLE {
+				if v, ok := attrUint32(attr.Value); ok {
+					if v == 0 {
+						data["Role"] = "ggsn"
+					} else {
+						data["Role"] = "sgsn"
+					}
+				}
+			}
+		}
+	}
+
+	return data
+}
+
+// parseLinkInfoAttr parses the nested attributes of IFLA_LINKINFO
+func parseLinkInfoAttr(info *linkInfo, value []byte) error {
+	infos, err := nl.ParseRouteAttr(value)
+	if err != nil {
+		return err
+	}
+
+	var data []syscall.NetlinkRouteAttr
+	for _, i := range infos {
+		switch i.Attr.Type {
+		case nl.IFLA_INFO_KIND:
+			info.Kind = attrString(i.Value)
+		case IFLA_INFO_SLAVE_KIND:
+			info.SlaveKind = attrString(i.Value)
+		case nl.IFLA_INFO_DATA:
+			if data, err = nl.ParseRouteAttr(i.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// kind always comes before data but don't rely on it
+	if len(data) > 0 {
+		info.Data = parseLinkInfoData(info.Kind, data)
+	}
+
+	return nil
+}
+
+func parseLinkInfo(m []byte) (*linkInfo, error) {
+	msg := nl.DeserializeIfInfomsg(m)
+
+	attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+	if err != nil {
+		return nil, err
+	}
+
+	info := &linkInfo{}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFLA_LINKINFO:
+			if err := parseLinkInfoAttr(info, attr.Value); err != nil {
+				return nil, err
+			}
+		case syscall.IFLA_OPERSTATE:
+			if len(attr.Value) > 0 && int(attr.Value[0]) < len(operStates) {
+				info.OperState = operStates[attr.Value[0]]
+			}
+		case IFLA_PERM_ADDRESS:
+			// only sent when set but don't rely on it
+			if len(bytes.Trim(attr.Value, "\x00")) > 0 {
+				info.PermAddress = net.HardwareAddr(attr.Value)
+			}
+		case IFLA_PARENT_DEV_NAME:
+			info.ParentDev = attrString(attr.Value)
+		case IFLA_PARENT_DEV_BUS_NAME:
+			info.ParentBus = attrString(attr.Value)
+		}
+	}
+
+	return info, nil
+}
+
+// messageLinkInfo returns the info of a link message, nil for the messages
+// of the bridge family which don't carry it
+func messageLinkInfo(m []byte) *linkInfo {
+	if nl.DeserializeIfInfomsg(m).Family == syscall.AF_BRIDGE {
+		return nil
+	}
+
+	info, err := parseLinkInfo(m)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// listLinks returns the links with their infos, by index, parsed from a
+// single dump instead of being requested for each link
+func listLinks() ([]netlink.Link, map[int]*linkInfo, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infos := make(map[int]*linkInfo)
+	if msgs, err := dumpLinks(); err == nil {
+		for _, m := range msgs {
+			if info := messageLinkInfo(m); info != nil {
+				infos[int(nl.DeserializeIfInfomsg(m).Index)] = info
+			}
+		}
+	}
+
+	return links, infos, nil
+}
+
+func getLinkInfo(index int) (*linkInfo, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) != 1 {
+		return nil, errors.New("Link not found")
+	}
+
+	return parseLinkInfo(msgs[0])
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestParseLinkInfo(t *testing.T) {
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.ZeroTerminated("vrf"))
+	nl.NewRtAttrChild(linkInfo, IFLA_INFO_SLAVE_KIND, nl.ZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, IFLA_VRF_TABLE, nl.Uint32Attr(10))
+
+	b := append(msg.Serialize(), linkInfo.Serialize()...)
+
+	info, err := parseLinkInfo(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if info.Kind != "vrf" || info.SlaveKind != "bridge" {
+		t.Errorf("Wrong kinds: %+v", info)
+	}
+
+	if info.Data["Table"] != int64(10) {
+		t.Errorf("Wrong VRF table: %+v", info.Data)
+	}
+}
+
+func TestMessageLinkInfo(t *testing.T) {
+	if info := messageLinkInfo(linkMessage(syscall.AF_UNSPEC, 3, "veth0", "veth", 0)); info == nil || info.Kind != "veth" {
+		t.Errorf("Info of the link message expected: %+v", info)
+	}
+
+	// the bridge port messages don't carry the kind, looked up instead
+	if info := messageLinkInfo(linkMessage(syscall.AF_BRIDGE, 3, "veth0", "", 2)); info != nil {
+		t.Errorf("No info expected from a bridge family message: %+v", info)
+	}
+}
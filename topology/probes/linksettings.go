@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// not defined by the vendored ethtool
+const (
+	SIOCETHTOOL  = 0x8946
+	ETHTOOL_GSET = 0x00000001
+
+	ethtoolSpeedUnknown  = 0xffff
+	ethtoolDuplexHalf    = 0x00
+	ethtoolDuplexFull    = 0x01
+	ethtoolAutonegEnable = 0x01
+)
+
+// ethtoolCmd is the struct ethtool_cmd of the legacy ETHTOOL_GSET command,
+// still supported by all the drivers implementing the link settings.
+type ethtoolCmd struct {
+	Cmd           uint32
+	Supported     uint32
+	Advertising   uint32
+	Speed         uint16
+	Duplex        uint8
+	Port          uint8
+	PhyAddress    uint8
+	Transceiver   uint8
+	Autoneg       uint8
+	MdioSupport   uint8
+	Maxtxpkt      uint32
+	Maxrxpkt      uint32
+	SpeedHi       uint16
+	EthTpMdix     uint8
+	EthTpMdixCtrl uint8
+	LpAdvertising uint32
+	Reserved      [2]uint32
+}
+
+type ethtoolIfreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+}
+
+// link modes of the ADVERTISED_* bits, the other bits being the port types
+// and the pause frames
+var ethtoolLinkModes = map[uint]string{
+	0:  "10baseT/Half",
+	1:  "10baseT/Full",
+	2:  "100baseT/Half",
+	3:  "100baseT/Full",
+	4:  "1000baseT/Half",
+	5:  "1000baseT/Full",
+	12: "10000baseT/Full",
+	15: "2500baseX/Full",
+	17: "1000baseKX/Full",
+	18: "10000baseKX4/Full",
+	19: "10000baseKR/Full",
+	21: "20000baseMLD2/Full",
+	22: "20000baseKR2/Full",
+	23: "40000baseKR4/Full",
+	24: "40000baseCR4/Full",
+	25: "40000baseSR4/Full",
+	26: "40000baseLR4/Full",
+	27: "56000baseKR4/Full",
+	28: "56000baseCR4/Full",
+	29: "56000baseSR4/Full",
+	30: "56000baseLR4/Full",
+}
+
+// linkSettingsKeys are the metadata set from the link settings, removed
+// when the settings are not available anymore, ie. the speed of a link down
+var linkSettingsKeys = []string{"Speed", "Duplex", "AutoNegotiation", "AdvertisedLinkModes", "PeerAdvertisedLinkModes"}
+
+func getEthtoolCmd(name string) (*ethtoolCmd, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	cmd := &ethtoolCmd{Cmd: ETHTOOL_GSET}
+
+	var ifr ethtoolIfreq
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	ifr.data = uintptr(unsafe.Pointer(cmd))
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return nil, errno
+	}
+
+	return cmd, nil
+}
+
+func linkModes(mask uint32) []string {
+	var modes []string
+	for bit := uint(0); bit < 32; bit++ {
+		if name, ok := ethtoolLinkModes[bit]; ok && mask&(1<<bit) != 0 {
+			modes = append(modes, name)
+		}
+	}
+	return modes
+}
+
+// linkSettingsMetadata returns the speed, in Mbps, and the duplex negotiated
+// or forced, whether the auto-negotiation is enabled and the link modes
+// advertised by the interface and its link partner. The interfaces without
+// supported link mode, the virtual ones, have no link settings.
+func linkSettingsMetadata(cmd *ethtoolCmd) graph.Metadata {
+	if len(linkModes(cmd.Supported)) == 0 {
+		return nil
+	}
+
+	m := graph.Metadata{
+		"AutoNegotiation": cmd.Autoneg == ethtoolAutonegEnable,
+	}
+
+	speed := uint32(cmd.SpeedHi)<<16 | uint32(cmd.Speed)
+	if speed != 0 && speed != ethtoolSpeedUnknown && speed != 0xffffffff {
+		m["Speed"] = int64(speed)
+
+		switch cmd.Duplex {
+		case ethtoolDuplexHalf:
+			m["Duplex"] = "half"
+		case ethtoolDuplexFull:
+			m["Duplex"] = "full"
+		}
+	}
+
+	if modes := linkModes(cmd.Advertising); len(modes) > 0 {
+		m["AdvertisedLinkModes"] = modes
+	}
+	if modes := linkModes(cmd.LpAdvertising); len(modes) > 0 {
+		m["PeerAdvertisedLinkModes"] = modes
+	}
+
+	return m
+}
+
+// getLinkSettings returns the link settings metadata of an interface, nil
+// if they are not available.
+func getLinkSettings(name string) graph.Metadata {
+	cmd, err := getEthtoolCmd(name)
+	if err != nil {
+		return nil
+	}
+	return linkSettingsMetadata(cmd)
+}
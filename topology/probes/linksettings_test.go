@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLinkSettingsMetadata(t *testing.T) {
+	// 1000baseT/Full negotiated with a peer only advertising 100baseT
+	cmd := &ethtoolCmd{
+		Supported:     0x2f,
+		Advertising:   0x2f,
+		Speed:         100,
+		Duplex:        ethtoolDuplexFull,
+		Autoneg:       ethtoolAutonegEnable,
+		LpAdvertising: 0x0c,
+	}
+
+	m := linkSettingsMetadata(cmd)
+	if m["Speed"] != int64(100) || m["Duplex"] != "full" || m["AutoNegotiation"] != true {
+		t.Errorf("Wrong link settings: %v", m)
+	}
+
+	expected := []string{"10baseT/Half", "10baseT/Full", "100baseT/Half", "100baseT/Full", "1000baseT/Full"}
+	if !reflect.DeepEqual(m["AdvertisedLinkModes"], expected) {
+		t.Errorf("Expected advertised link modes %v, got: %v", expected, m["AdvertisedLinkModes"])
+	}
+
+	expected = []string{"100baseT/Half", "100baseT/Full"}
+	if !reflect.DeepEqual(m["PeerAdvertisedLinkModes"], expected) {
+		t.Errorf("Expected peer link modes %v, got: %v", expected, m["PeerAdvertisedLinkModes"])
+	}
+
+	// link down, no speed nor duplex
+	cmd = &ethtoolCmd{Supported: 0x20, Speed: ethtoolSpeedUnknown, Duplex: 0xff}
+	m = linkSettingsMetadata(cmd)
+	if _, ok := m["Speed"]; ok || m["Duplex"] != nil || m["AutoNegotiation"] != false {
+		t.Errorf("Wrong link settings of a link down: %v", m)
+	}
+
+	// virtual interfaces report a speed but no supported link mode
+	if m := linkSettingsMetadata(&ethtoolCmd{Speed: 10000, Duplex: ethtoolDuplexFull}); m != nil {
+		t.Errorf("Virtual interfaces should have no link settings: %v", m)
+	}
+}
@@ -0,0 +1,455 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ListeningPortsKey holds the sockets listening on the host, or on the
+// addresses of an interface for the sockets bound to one of them.
+const ListeningPortsKey = "ListeningPorts"
+
+// socket states of /proc/net, TCP_LISTEN for TCP and TCP_CLOSE for the
+// unconnected UDP sockets
+const (
+	tcpListen = 0x0a
+	tcpClose  = 0x07
+)
+
+type listeningSocket struct {
+	Protocol string
+	Address  net.IP
+	Port     int64
+	inode    string
+	Process  string
+	PID      int64
+}
+
+type listeningSockets []listeningSocket
+
+func (s listeningSockets) Len() int      { return len(s) }
+func (s listeningSockets) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s listeningSockets) Less(i, j int) bool {
+	if s[i].Port != s[j].Port {
+		return s[i].Port < s[j].Port
+	}
+	if s[i].Protocol != s[j].Protocol {
+		return s[i].Protocol < s[j].Protocol
+	}
+	return s[i].Address.String() < s[j].Address.String()
+}
+
+// portRange is a range of watched ports, both included
+type portRange struct {
+	min, max int64
+}
+
+// parsePortRanges parses the watched ports, ie. 22 or 8000-8100, the
+// invalid ones being skipped with an error.
+func parsePortRanges(ports []string) []portRange {
+	var ranges []portRange
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+
+		min, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+		max := min
+		if err == nil && len(bounds) == 2 {
+			max, err = strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64)
+		}
+		if err != nil || min < 0 || max > 65535 || min > max {
+			logging.GetLogger().Errorf("Invalid listening port %s", p)
+			continue
+		}
+		ranges = append(ranges, portRange{min: min, max: max})
+	}
+	return ranges
+}
+
+// parseProcNetAddress parses an address of /proc/net, ie. 0100007F:0016,
+// the address being printed as 32 bits words in host byte order.
+func parseProcNetAddress(s string) (net.IP, int64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		word := uint32(b[i])<<24 | uint32(b[i+1])<<16 | uint32(b[i+2])<<8 | uint32(b[i+3])
+		nl.NativeEndian().PutUint32(ip[i:i+4], word)
+	}
+
+	port, err := strconv.ParseInt(parts[1], 16, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %s", s)
+	}
+
+	return ip, port, nil
+}
+
+// parseProcNet returns the listening sockets of a /proc/net table, tcp,
+// tcp6, udp or udp6, the UDP sockets being listening when unconnected.
+func parseProcNet(r io.Reader, protocol string) []listeningSocket {
+	var sockets []listeningSocket
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[0] == "sl" {
+			continue
+		}
+
+		state, err := strconv.ParseInt(fields[3], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		switch protocol {
+		case "tcp":
+			if state != tcpListen {
+				continue
+			}
+		case "udp":
+			if state != tcpClose {
+				continue
+			}
+			if _, port, err := parseProcNetAddress(fields[2]); err != nil || port != 0 {
+				continue
+			}
+		}
+
+		ip, port, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+
+		sockets = append(sockets, listeningSocket{
+			Protocol: protocol,
+			Address:  ip,
+			Port:     port,
+			inode:    fields[9],
+		})
+	}
+
+	return sockets
+}
+
+// listeningReader reads the listening sockets of the namespace of the
+// agent from /proc, once per interval, only the sockets of the watched
+// ports, all of them if none, being kept.
+type listeningReader struct {
+	proc     string
+	ports    []portRange
+	interval time.Duration
+}
+
+func (l *listeningReader) watched(port int64) bool {
+	if len(l.ports) == 0 {
+		return true
+	}
+	for _, r := range l.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// processes returns the processes owning the given socket inodes, the
+// lowest PID of the processes sharing a socket, ie. the workers of a
+// server, being kept.
+func (l *listeningReader) processes(inodes map[string]bool) map[string]listeningSocket {
+	owners := make(map[string]listeningSocket)
+
+	pids, _ := ioutil.ReadDir(l.proc)
+	for _, p := range pids {
+		pid, err := strconv.ParseInt(p.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Join(l.proc, p.Name())
+		fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		var comm string
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+
+			inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+			if !inodes[inode] {
+				continue
+			}
+			if owner, ok := owners[inode]; ok && owner.PID < pid {
+				continue
+			}
+
+			if comm == "" {
+				data, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+				comm = strings.TrimSpace(string(data))
+			}
+			owners[inode] = listeningSocket{Process: comm, PID: pid}
+		}
+	}
+
+	return owners
+}
+
+// read returns the listening sockets of the watched ports with their
+// process, the tables that can't be read, ie. without IPv6, being skipped.
+func (l *listeningReader) read() []listeningSocket {
+	var sockets []listeningSocket
+	inodes := make(map[string]bool)
+
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open(filepath.Join(l.proc, "net", table))
+		if err != nil {
+			continue
+		}
+
+		for _, s := range parseProcNet(f, strings.TrimSuffix(table, "6")) {
+			if l.watched(s.Port) {
+				sockets = append(sockets, s)
+				inodes[s.inode] = true
+			}
+		}
+		f.Close()
+	}
+
+	if len(sockets) == 0 {
+		return nil
+	}
+
+	owners := l.processes(inodes)
+	for i, s := range sockets {
+		if owner, ok := owners[s.inode]; ok {
+			sockets[i].Process, sockets[i].PID = owner.Process, owner.PID
+		}
+	}
+	sort.Sort(listeningSockets(sockets))
+
+	return sockets
+}
+
+// listeningMetadata returns the ListeningPorts metadata of sockets
+func listeningMetadata(sockets []listeningSocket) []interface{} {
+	ports := []interface{}{}
+	for _, s := range sockets {
+		m := map[string]interface{}{
+			"Port":     s.Port,
+			"Protocol": s.Protocol,
+			"Address":  s.Address.String(),
+		}
+		if s.Process != "" {
+			m["Process"] = s.Process
+			m["PID"] = s.PID
+		}
+		ports = append(ports, m)
+	}
+	return ports
+}
+
+// interfaceAddresses returns the IPv4 addresses of the interfaces of the
+// root node
+func interfaceAddresses(g *graph.Graph, root *graph.Node) map[string]graph.Identifier {
+	addresses := make(map[string]graph.Identifier)
+	for _, n := range g.LookupChildren(root, graph.Metadata{}) {
+		ipv4, _ := n.Metadata()["IPV4"].(string)
+		for _, cidr := range strings.Split(ipv4, ",") {
+			if ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil {
+				addresses[ip.String()] = n.ID
+			}
+		}
+	}
+	return addresses
+}
+
+// ListeningProbe records the listening sockets of the host as the
+// ListeningPorts metadata of the host node, the sockets bound to the
+// address of an interface being recorded on the interface node instead.
+type ListeningProbe struct {
+	Graph  *graph.Graph
+	Root   *graph.Node
+	reader *listeningReader
+	// the interfaces holding listening sockets
+	interfaces map[graph.Identifier]bool
+	quit       chan bool
+}
+
+// setListeningPorts updates the ListeningPorts metadata of a node, removed
+// when there is no socket anymore.
+func (l *ListeningProbe) setListeningPorts(n *graph.Node, sockets []listeningSocket) {
+	if len(sockets) > 0 {
+		if ports := listeningMetadata(sockets); !reflect.DeepEqual(n.Metadata()[ListeningPortsKey], ports) {
+			l.Graph.AddMetadata(n, ListeningPortsKey, ports)
+		}
+		return
+	}
+
+	if _, ok := n.Metadata()[ListeningPortsKey]; !ok {
+		return
+	}
+
+	metadata := make(graph.Metadata)
+	for k, v := range n.Metadata() {
+		if k != ListeningPortsKey {
+			metadata[k] = v
+		}
+	}
+	l.Graph.SetMetadata(n, metadata)
+}
+
+func (l *ListeningProbe) update() {
+	sockets := l.reader.read()
+
+	l.Graph.Lock()
+	defer l.Graph.Unlock()
+
+	addresses := interfaceAddresses(l.Graph, l.Root)
+
+	var host []listeningSocket
+	bound := make(map[graph.Identifier][]listeningSocket)
+	for _, s := range sockets {
+		if id, ok := addresses[s.Address.String()]; ok {
+			bound[id] = append(bound[id], s)
+		} else {
+			host = append(host, s)
+		}
+	}
+
+	l.setListeningPorts(l.Root, host)
+
+	for id := range l.interfaces {
+		if _, ok := bound[id]; !ok {
+			if n := l.Graph.GetNode(id); n != nil {
+				l.setListeningPorts(n, nil)
+			}
+		}
+	}
+
+	interfaces := make(map[graph.Identifier]bool)
+	for id, sockets := range bound {
+		if n := l.Graph.GetNode(id); n != nil {
+			l.setListeningPorts(n, sockets)
+			interfaces[id] = true
+		}
+	}
+	l.interfaces = interfaces
+}
+
+func (l *ListeningProbe) run() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(l.reader.interval)
+	defer ticker.Stop()
+
+	for {
+		l.update()
+
+		select {
+		case <-ticker.C:
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *ListeningProbe) Start() {
+	go l.run()
+}
+
+func (l *ListeningProbe) Stop() {
+	close(l.quit)
+}
+
+// Check verifies that the TCP sockets can be read
+func (l *ListeningProbe) Check() []probe.CheckResult {
+	path := filepath.Join(l.reader.proc, "net", "tcp")
+
+	_, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("unable to read the listening sockets from %s: %s", path, err.Error())
+	}
+	return []probe.CheckResult{
+		probe.NewCheckResult("listening sockets", err, "run the agent in the network namespace of the host with /proc mounted"),
+	}
+}
+
+// NewListeningProbe returns a probe reading the sockets listening on the
+// watched ports, all of them if none, every interval.
+func NewListeningProbe(g *graph.Graph, n *graph.Node, ports []string, interval time.Duration) *ListeningProbe {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &ListeningProbe{
+		Graph: g,
+		Root:  n,
+		reader: &listeningReader{
+			proc:     "/proc",
+			ports:    parsePortRanges(ports),
+			interval: interval,
+		},
+		interfaces: make(map[graph.Identifier]bool),
+		quit:       make(chan bool),
+	}
+}
+
+func NewListeningProbeFromConfig(g *graph.Graph, n *graph.Node) *ListeningProbe {
+	cfg := config.GetConfig()
+
+	ports := cfg.GetStringSlice("agent.topology.listening.ports")
+	interval := time.Duration(cfg.GetInt("agent.topology.listening.interval")) * time.Second
+
+	return NewListeningProbe(g, n, ports, interval)
+}
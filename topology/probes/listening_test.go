@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// procNetAddress formats an address as the kernel does in /proc/net
+func procNetAddress(ip net.IP, port int) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	s := ""
+	for i := 0; i < len(ip); i += 4 {
+		s += fmt.Sprintf("%08X", nl.NativeEndian().Uint32(ip[i:i+4]))
+	}
+	return fmt.Sprintf("%s:%04X", s, port)
+}
+
+func procNetLine(local string, localPort int, remote string, remotePort int, state int, inode int) string {
+	return fmt.Sprintf("   0: %s %s %02X 00000000:00000000 00:00000000 00000000     0        0 %d 1 0000000000000000 100 0 0 10 0\n",
+		procNetAddress(net.ParseIP(local), localPort), procNetAddress(net.ParseIP(remote), remotePort), state, inode)
+}
+
+const procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+func writeProcFiles(t *testing.T, proc string) {
+	files := map[string]string{
+		"net/tcp": procNetHeader +
+			procNetLine("0.0.0.0", 22, "0.0.0.0", 0, tcpListen, 100) +
+			procNetLine("10.0.0.1", 8080, "0.0.0.0", 0, tcpListen, 101) +
+			procNetLine("10.0.0.1", 8080, "10.0.0.2", 40000, 0x01, 102) +
+			procNetLine("127.0.0.1", 9999, "0.0.0.0", 0, tcpListen, 103),
+		"net/tcp6": procNetHeader +
+			procNetLine("::", 22, "::", 0, tcpListen, 104),
+		"net/udp": procNetHeader +
+			procNetLine("0.0.0.0", 53, "0.0.0.0", 0, tcpClose, 105) +
+			procNetLine("10.0.0.1", 5000, "10.0.0.2", 53, tcpClose, 106),
+		"10/comm":  "sshd\n",
+		"20/comm":  "httpd\n",
+		"21/comm":  "httpd\n",
+		"notapid/": "",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(proc, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if content == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	fds := map[string]string{
+		"10/fd/3": "socket:[100]",
+		"10/fd/4": "socket:[104]",
+		"10/fd/5": "/dev/null",
+		"21/fd/3": "socket:[101]",
+		"20/fd/7": "socket:[101]",
+	}
+	for name, target := range fds {
+		path := filepath.Join(proc, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges := parsePortRanges([]string{"22", "8000-8100", "abc", "90-80", "70000"})
+	if len(ranges) != 2 || ranges[0] != (portRange{22, 22}) || ranges[1] != (portRange{8000, 8100}) {
+		t.Errorf("Wrong port ranges: %+v", ranges)
+	}
+}
+
+func TestListeningProbe(t *testing.T) {
+	proc, err := ioutil.TempDir("", "skydive_listening")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(proc)
+
+	writeProcFiles(t, proc)
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device", "IPV4": "10.0.0.1/24"})
+	g.Link(root, eth0, graph.Metadata{"RelationType": "ownership"})
+
+	l := NewListeningProbe(g, root, []string{"22", "53", "8000-9000"}, time.Minute)
+	l.reader.proc = proc
+	l.update()
+
+	ports, _ := root.Metadata()[ListeningPortsKey].([]interface{})
+	if len(ports) != 3 {
+		t.Fatalf("Expected 3 sockets on the host, got %v", ports)
+	}
+	if p := ports[0].(map[string]interface{}); p["Port"] != int64(22) || p["Protocol"] != "tcp" || p["Address"] != "0.0.0.0" || p["Process"] != "sshd" || p["PID"] != int64(10) {
+		t.Errorf("Wrong socket: %v", p)
+	}
+	if p := ports[1].(map[string]interface{}); p["Address"] != "::" || p["Process"] != "sshd" {
+		t.Errorf("Wrong socket: %v", p)
+	}
+	if p := ports[2].(map[string]interface{}); p["Port"] != int64(53) || p["Protocol"] != "udp" || p["Process"] != nil {
+		t.Errorf("Wrong socket: %v", p)
+	}
+
+	ports, _ = eth0.Metadata()[ListeningPortsKey].([]interface{})
+	if len(ports) != 1 {
+		t.Fatalf("Expected 1 socket on eth0, got %v", ports)
+	}
+	if p := ports[0].(map[string]interface{}); p["Port"] != int64(8080) || p["Process"] != "httpd" || p["PID"] != int64(20) {
+		t.Errorf("Wrong socket: %v", p)
+	}
+
+	// the service stops, the interface loses its sockets
+	if err := ioutil.WriteFile(filepath.Join(proc, "net/tcp"), []byte(procNetHeader+procNetLine("0.0.0.0", 22, "0.0.0.0", 0, tcpListen, 100)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	l.update()
+
+	if _, ok := eth0.Metadata()[ListeningPortsKey]; ok {
+		t.Errorf("eth0 shouldn't have listening sockets anymore: %v", eth0.Metadata())
+	}
+	if ports, _ := root.Metadata()[ListeningPortsKey].([]interface{}); len(ports) != 3 {
+		t.Errorf("Expected 3 sockets on the host, got %v", ports)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"encoding/binary"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// not defined by the vendored netlink
+const (
+	RTM_NEWMDB = 84
+	RTM_GETMDB = 86
+
+	MDBA_MDB            = 1
+	MDBA_MDB_ENTRY      = 1
+	MDBA_MDB_ENTRY_INFO = 1
+
+	IFLA_BR_MCAST_SNOOPING = 23
+
+	// netlink attribute types without the nested and byte order flags
+	nlaTypeMask = 0x3fff
+
+	ethPIP   = 0x0800
+	ethPIPv6 = 0x86dd
+)
+
+// multicastEntry is an entry of the multicast database of a bridge, the
+// mdb of a Linux bridge or the snooping table of an OVS one.
+type multicastEntry struct {
+	Group net.IP
+	Port  string
+	Vlan  int64
+	// Linux bridges only, temp or permanent
+	State string
+	// OVS bridges only, in seconds
+	Age int64
+}
+
+type multicastEntries []multicastEntry
+
+func (e multicastEntries) Len() int      { return len(e) }
+func (e multicastEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e multicastEntries) Less(i, j int) bool {
+	if g1, g2 := e[i].Group.String(), e[j].Group.String(); g1 != g2 {
+		return g1 < g2
+	}
+	if e[i].Port != e[j].Port {
+		return e[i].Port < e[j].Port
+	}
+	return e[i].Vlan < e[j].Vlan
+}
+
+// multicastReader summarizes the multicast databases of the bridges once
+// per interval. All the groups are counted, only the entries of the watched
+// groups, all of them if none, are detailed up to maxEntries.
+type multicastReader struct {
+	interval   time.Duration
+	groups     []*net.IPNet
+	maxEntries int
+	last       time.Time
+	logger     Logger
+}
+
+// parseMulticastGroups parses the watched groups, addresses or CIDRs, the
+// invalid ones being skipped with an error.
+func parseMulticastGroups(groups []string, logger Logger) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, g := range groups {
+		cidr := g
+		if !strings.Contains(g, "/") {
+			if ip := net.ParseIP(g); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Errorf("Invalid multicast group %s", g)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// due returns whether the multicast state has to be refreshed
+func (r *multicastReader) due(now time.Time) bool {
+	if now.Sub(r.last) < r.interval {
+		return false
+	}
+	r.last = now
+
+	return true
+}
+
+func (r *multicastReader) watched(ip net.IP) bool {
+	if len(r.groups) == 0 {
+		return true
+	}
+	for _, n := range r.groups {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns the Multicast metadata of a bridge, in a stable order so
+// that an unchanged database doesn't trigger updates.
+func (r *multicastReader) summary(entries []multicastEntry) map[string]interface{} {
+	sort.Sort(multicastEntries(entries))
+
+	groups := make(map[string]bool)
+	detailed := []interface{}{}
+	truncated := false
+	for _, e := range entries {
+		groups[e.Group.String()] = true
+
+		if !r.watched(e.Group) {
+			continue
+		}
+		if len(detailed) >= r.maxEntries {
+			truncated = true
+			continue
+		}
+
+		m := map[string]interface{}{
+			"Group": e.Group.String(),
+			"Port":  e.Port,
+			"Vlan":  e.Vlan,
+		}
+		if e.State != "" {
+			m["State"] = e.State
+		} else {
+			m["Age"] = e.Age
+		}
+		detailed = append(detailed, m)
+	}
+
+	summary := map[string]interface{}{
+		"Groups":  int64(len(groups)),
+		"Entries": detailed,
+	}
+	if truncated {
+		summary["Truncated"] = true
+	}
+
+	return summary
+}
+
+// newMulticastReader returns nil if the multicast state is not collected
+func newMulticastReader(interval time.Duration, groups []string, maxEntries int, logger Logger) *multicastReader {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &multicastReader{
+		interval:   interval,
+		groups:     parseMulticastGroups(groups, logger),
+		maxEntries: maxEntries,
+		logger:     logger,
+	}
+}
+
+// brPortMsg is the header of the mdb messages, struct br_port_msg
+type brPortMsg struct {
+	family  uint8
+	ifindex uint32
+}
+
+func (m *brPortMsg) Len() int {
+	return 8
+}
+
+func (m *brPortMsg) Serialize() []byte {
+	b := make([]byte, m.Len())
+	b[0] = m.family
+	nl.NativeEndian().PutUint32(b[4:8], m.ifindex)
+	return b
+}
+
+func dumpMdb() ([][]byte, error) {
+	req := nl.NewNetlinkRequest(RTM_GETMDB, syscall.NLM_F_DUMP)
+	req.AddData(&brPortMsg{family: syscall.AF_BRIDGE})
+
+	return req.Execute(syscall.NETLINK_ROUTE, RTM_NEWMDB)
+}
+
+// parseMdbEntry parses a struct br_mdb_entry, the non IP entries being
+// skipped
+func parseMdbEntry(b []byte, names map[int64]string) (multicastEntry, bool) {
+	if len(b) < 26 {
+		return multicastEntry{}, false
+	}
+
+	native := nl.NativeEndian()
+	port := int64(native.Uint32(b[0:4]))
+
+	e := multicastEntry{Port: names[port], Vlan: int64(native.Uint16(b[6:8])), State: "temp"}
+	if e.Port == "" {
+		e.Port = strconv.FormatInt(port, 10)
+	}
+	if b[4] == 1 {
+		e.State = "permanent"
+	}
+
+	switch binary.BigEndian.Uint16(b[24:26]) {
+	case ethPIP:
+		e.Group = net.IP(append([]byte(nil), b[8:12]...))
+	case ethPIPv6:
+		e.Group = net.IP(append([]byte(nil), b[8:24]...))
+	default:
+		return e, false
+	}
+
+	return e, true
+}
+
+// parseMdb returns the entries of the mdb messages per bridge index, the
+// ports being named after the given names.
+func parseMdb(msgs [][]byte, names map[int64]string) map[int64][]multicastEntry {
+	entries := make(map[int64][]multicastEntry)
+
+	for _, msg := range msgs {
+		if len(msg) < 8 {
+			continue
+		}
+		bridge := int64(nl.NativeEndian().Uint32(msg[4:8]))
+
+		attrs, err := nl.ParseRouteAttr(msg[8:])
+		if err != nil {
+			continue
+		}
+		for _, mdb := range attrs {
+			if mdb.Attr.Type&nlaTypeMask != MDBA_MDB {
+				continue
+			}
+			groups, err := nl.ParseRouteAttr(mdb.Value)
+			if err != nil {
+				continue
+			}
+			for _, group := range groups {
+				if group.Attr.Type&nlaTypeMask != MDBA_MDB_ENTRY {
+					continue
+				}
+				infos, err := nl.ParseRouteAttr(group.Value)
+				if err != nil {
+					continue
+				}
+				for _, info := range infos {
+					if info.Attr.Type&nlaTypeMask != MDBA_MDB_ENTRY_INFO {
+						continue
+					}
+					if e, ok := parseMdbEntry(info.Value, names); ok {
+						entries[bridge] = append(entries[bridge], e)
+					}
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+// updateMulticast records the snooping setting and the mdb of the Linux
+// bridges, as MulticastSnooping and Multicast, once per interval. It has to
+// be called from the thread of the namespace without holding the graph
+// lock.
+func (u *NetLinkProbe) updateMulticast() {
+	if u.multicast == nil || !u.multicast.due(time.Now()) {
+		return
+	}
+
+	bridges := make(map[int64]*graph.Node)
+	names := make(map[int64]string)
+
+	u.Graph.RLock()
+	for _, n := range u.Graph.LookupChildren(u.Root, graph.Metadata{}) {
+		index, ok := n.Metadata()["IfIndex"].(int64)
+		if !ok {
+			continue
+		}
+		if name, ok := n.Metadata()["Name"].(string); ok {
+			names[index] = name
+		}
+		if n.Metadata()["Type"] == topology.BridgeType {
+			bridges[index] = n
+		}
+	}
+	u.Graph.RUnlock()
+
+	if len(bridges) == 0 {
+		return
+	}
+
+	msgs, err := dumpMdb()
+	if err != nil {
+		u.logger.Debugf("Unable to dump the multicast database of %s: %s", u.Root.ID, err.Error())
+	}
+	entries := parseMdb(msgs, names)
+
+	snooping := make(map[int64]bool)
+	for index := range bridges {
+		if info, err := u.links.LinkInfo(int(index)); err == nil {
+			if s, ok := info.Data["MulticastSnooping"].(bool); ok {
+				snooping[index] = s
+			}
+		}
+	}
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for index, bridge := range bridges {
+		if u.Graph.GetNode(bridge.ID) == nil {
+			continue
+		}
+
+		tr := u.Graph.StartMetadataTransaction(bridge)
+		if s, ok := snooping[index]; ok {
+			tr.AddMetadata("MulticastSnooping", s)
+		}
+		tr.AddMetadata("Multicast", u.multicast.summary(entries[index]))
+		tr.Commit()
+	}
+}
+
+// parseMdbShow parses the snooping table given by ovs-appctl mdb/show, the
+// querier lines being skipped.
+func parseMdbShow(output []byte) []multicastEntry {
+	var entries []multicastEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] == "port" {
+			continue
+		}
+
+		group := net.ParseIP(fields[2])
+		if group == nil {
+			continue
+		}
+		vlan, _ := strconv.ParseInt(fields[1], 10, 64)
+		age, _ := strconv.ParseInt(fields[3], 10, 64)
+
+		entries = append(entries, multicastEntry{Group: group, Port: fields[0], Vlan: vlan, Age: age})
+	}
+	return entries
+}
+
+func dumpOvsMdb(bridge string) ([]byte, error) {
+	return exec.Command("ovs-appctl", "mdb/show", bridge).Output()
+}
+
+// updateMulticast records the snooping table of the OVS bridges as their
+// Multicast metadata, MulticastSnooping coming from ovsdb.
+func (o *OvsdbProbe) updateMulticast() {
+	o.Graph.Lock()
+	bridges := make(map[string]*graph.Node)
+	for _, bridge := range o.Graph.LookupChildren(o.Root, graph.Metadata{"Type": topology.OvsBridgeType}) {
+		if name, ok := bridge.Metadata()["Name"].(string); ok {
+			bridges[name] = bridge
+		}
+	}
+	o.Graph.Unlock()
+
+	for name, bridge := range bridges {
+		output, err := o.dumpMdb(name)
+		if err != nil {
+			o.multicast.logger.Debugf("Unable to dump the snooping table of %s: %s", name, err.Error())
+			continue
+		}
+		summary := o.multicast.summary(parseMdbShow(output))
+
+		o.Graph.Lock()
+		if o.Graph.GetNode(bridge.ID) != nil {
+			o.Graph.AddMetadata(bridge, "Multicast", summary)
+		}
+		o.Graph.Unlock()
+	}
+}
+
+func (o *OvsdbProbe) multicastLoop() {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(o.multicast.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			o.updateMulticast()
+		case <-o.quit:
+			return
+		}
+	}
+}
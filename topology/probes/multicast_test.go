@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func mdbEntryInfo(port uint32, state uint8, vid uint16, group net.IP) []byte {
+	b := make([]byte, 26)
+	nl.NativeEndian().PutUint32(b[0:4], port)
+	b[4] = state
+	nl.NativeEndian().PutUint16(b[6:8], vid)
+	if ip := group.To4(); ip != nil {
+		copy(b[8:12], ip)
+		binary.BigEndian.PutUint16(b[24:26], ethPIP)
+	} else {
+		copy(b[8:24], group)
+		binary.BigEndian.PutUint16(b[24:26], ethPIPv6)
+	}
+	return b
+}
+
+func TestParseMdb(t *testing.T) {
+	// nested flag set as by the recent kernels
+	mdb := nl.NewRtAttr(MDBA_MDB|0x8000, nil)
+	entry := nl.NewRtAttrChild(mdb, MDBA_MDB_ENTRY|0x8000, nil)
+	nl.NewRtAttrChild(entry, MDBA_MDB_ENTRY_INFO, mdbEntryInfo(5, 0, 10, net.ParseIP("239.1.1.1")))
+	nl.NewRtAttrChild(entry, MDBA_MDB_ENTRY_INFO, mdbEntryInfo(6, 1, 0, net.ParseIP("ff0e::1")))
+
+	header := (&brPortMsg{ifindex: 3}).Serialize()
+	msg := append(header, mdb.Serialize()...)
+
+	entries := parseMdb([][]byte{msg}, map[int64]string{5: "eth0"})[3]
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+
+	if e := entries[0]; e.Port != "eth0" || e.Vlan != 10 || e.State != "temp" || !e.Group.Equal(net.ParseIP("239.1.1.1")) {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+	if e := entries[1]; e.Port != "6" || e.State != "permanent" || !e.Group.Equal(net.ParseIP("ff0e::1")) {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+}
+
+const ovsMdbShow = ` port  VLAN  GROUP                Age
+    1     0  239.1.1.2             12
+    2     0  239.1.1.1             3
+    3     0  224.0.0.251           40
+    2     0  querier               28
+`
+
+func TestMulticastSummary(t *testing.T) {
+	entries := parseMdbShow([]byte(ovsMdbShow))
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, querier skipped, got %+v", entries)
+	}
+
+	r := newMulticastReader(time.Minute, []string{"239.1.0.0/16", "bogus"}, 1, defaultLogger(nil))
+	summary := r.summary(entries)
+
+	if summary["Groups"] != int64(3) || summary["Truncated"] != true {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+
+	// sorted, only the watched groups detailed
+	detailed := summary["Entries"].([]interface{})
+	if e := detailed[0].(map[string]interface{}); len(detailed) != 1 || e["Group"] != "239.1.1.1" || e["Port"] != "2" || e["Age"] != int64(3) {
+		t.Errorf("Wrong entries: %+v", detailed)
+	}
+
+	r = newMulticastReader(time.Minute, nil, 100, defaultLogger(nil))
+	if detailed := r.summary(entries)["Entries"].([]interface{}); len(detailed) != 3 {
+		t.Errorf("All the groups expected: %+v", detailed)
+	}
+}
+
+func TestBridgeMulticastSnooping(t *testing.T) {
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.ZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, IFLA_BR_MCAST_SNOOPING, []byte{0})
+
+	info, err := parseLinkInfo(append(nl.NewIfInfomsg(syscall.AF_UNSPEC).Serialize(), linkInfo.Serialize()...))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if info.Data["MulticastSnooping"] != false {
+		t.Errorf("Snooping expected to be disabled: %+v", info.Data)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+var neighStates = []struct {
+	state int
+	name  string
+}{
+	{netlink.NUD_INCOMPLETE, "INCOMPLETE"},
+	{netlink.NUD_REACHABLE, "REACHABLE"},
+	{netlink.NUD_STALE, "STALE"},
+	{netlink.NUD_DELAY, "DELAY"},
+	{netlink.NUD_PROBE, "PROBE"},
+	{netlink.NUD_FAILED, "FAILED"},
+	{netlink.NUD_NOARP, "NOARP"},
+	{netlink.NUD_PERMANENT, "PERMANENT"},
+}
+
+func neighStateString(state int) string {
+	var states []string
+	for _, s := range neighStates {
+		if state&s.state != 0 {
+			states = append(states, s.name)
+		}
+	}
+
+	if len(states) == 0 {
+		return "NONE"
+	}
+	return strings.Join(states, "|")
+}
+
+func neighFamilyString(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// neighKey returns the key of a neighbor entry, the family is part of the key
+// so that ARP and NDP entries never collide.
+func neighKey(neigh *netlink.Neigh) string {
+	return neighFamilyString(neigh.Family) + "/" + neigh.IP.String()
+}
+
+func neighMetadata(neigh *netlink.Neigh) map[string]interface{} {
+	return map[string]interface{}{
+		"Family":   neighFamilyString(neigh.Family),
+		"IP":       neigh.IP.String(),
+		"MAC":      neigh.HardwareAddr.String(),
+		"State":    neighStateString(neigh.State),
+		"IsRouter": neigh.Flags&netlink.NTF_ROUTER != 0,
+	}
+}
+
+// getLinkNeighbors returns both the ARP (IPv4) and the NDP (IPv6) entries
+// of the given interface.
+func (u *NetLinkProbe) getLinkNeighbors(link netlink.Link) map[string]interface{} {
+	neighbors := make(map[string]interface{})
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		neighs, err := u.links.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			u.logger.Debugf("Unable to list %s neighbors of %s: %s", neighFamilyString(family), link.Attrs().Name, err.Error())
+			continue
+		}
+
+		for i := range neighs {
+			if neighs[i].IP == nil {
+				continue
+			}
+			neighbors[neighKey(&neighs[i])] = neighMetadata(&neighs[i])
+		}
+	}
+
+	return neighbors
+}
+
+// neighborUpdates coalesces the neighbor changes of the interfaces, applied
+// at most once per interval so that a burst of ARP or NDP messages makes a
+// single update of the neighbors of each interface. Only used from the
+// thread of the probe.
+type neighborUpdates struct {
+	interval time.Duration
+	last     time.Time
+	// changed entries per interface index, nil for the deleted ones
+	pending map[int64]map[string]interface{}
+}
+
+func newNeighborUpdates(interval time.Duration) *neighborUpdates {
+	return &neighborUpdates{interval: interval, pending: make(map[int64]map[string]interface{})}
+}
+
+func (u *NetLinkProbe) onNeighUpdated(neigh *netlink.Neigh, deleted bool) {
+	if neigh.IP == nil {
+		return
+	}
+
+	index := int64(neigh.LinkIndex)
+	changes, ok := u.neighbors.pending[index]
+	if !ok {
+		changes = make(map[string]interface{})
+		u.neighbors.pending[index] = changes
+	}
+
+	if deleted {
+		changes[neighKey(neigh)] = nil
+	} else {
+		changes[neighKey(neigh)] = neighMetadata(neigh)
+	}
+}
+
+// flushNeighbors applies the pending neighbor changes if the interval
+// elapsed since the last time they were.
+func (u *NetLinkProbe) flushNeighbors(now time.Time) {
+	if len(u.neighbors.pending) == 0 || now.Sub(u.neighbors.last) < u.neighbors.interval {
+		return
+	}
+	u.neighbors.last = now
+
+	u.applyNeighbors()
+}
+
+// applyNeighbors updates the neighbors of the interfaces with the pending
+// changes, an interface being updated only if one of its entries changed.
+func (u *NetLinkProbe) applyNeighbors() {
+	pending := u.neighbors.pending
+	u.neighbors.pending = make(map[int64]map[string]interface{})
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for index, changes := range pending {
+		intf := u.Graph.LookupFirstChild(u.Root, graph.Metadata{"IfIndex": index})
+		if intf == nil {
+			continue
+		}
+
+		old, _ := intf.Metadata()["Neighbors"].(map[string]interface{})
+		if neighbors, updated := mergeNeighbors(old, changes); updated {
+			u.Graph.AddMetadata(intf, "Neighbors", neighbors)
+		}
+	}
+}
+
+// mergeNeighbors returns a copy of the neighbors with the changes applied
+// and whether any entry changed.
+func mergeNeighbors(old map[string]interface{}, changes map[string]interface{}) (map[string]interface{}, bool) {
+	updated := false
+	for key, entry := range changes {
+		current, ok := old[key]
+		if entry == nil && ok || entry != nil && !reflect.DeepEqual(current, entry) {
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		return old, false
+	}
+
+	// a new map so that the graph detects the change
+	neighbors := make(map[string]interface{}, len(old)+len(changes))
+	for key, entry := range old {
+		neighbors[key] = entry
+	}
+	for key, entry := range changes {
+		if entry == nil {
+			delete(neighbors, key)
+		} else {
+			neighbors[key] = entry
+		}
+	}
+
+	return neighbors, true
+}
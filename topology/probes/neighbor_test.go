@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func neighMessage(family int, index int, ip string, mac string, state int, flags int) []byte {
+	msg := &netlink.Ndmsg{Family: uint8(family), Index: uint32(index), State: uint16(state), Flags: uint8(flags)}
+
+	addr := net.ParseIP(ip)
+	if family == netlink.FAMILY_V4 {
+		addr = addr.To4()
+	}
+
+	b := msg.Serialize()
+	b = append(b, nl.NewRtAttr(netlink.NDA_DST, addr).Serialize()...)
+	if mac != "" {
+		hw, _ := net.ParseMAC(mac)
+		b = append(b, nl.NewRtAttr(netlink.NDA_LLADDR, hw).Serialize()...)
+	}
+
+	return b
+}
+
+func TestNeighborParsing(t *testing.T) {
+	for _, test := range []struct {
+		data     []byte
+		key      string
+		metadata map[string]interface{}
+	}{
+		{
+			neighMessage(netlink.FAMILY_V4, 2, "10.0.0.1", "52:54:00:00:00:01", netlink.NUD_STALE, 0),
+			"IPv4/10.0.0.1",
+			map[string]interface{}{"Family": "IPv4", "IP": "10.0.0.1", "MAC": "52:54:00:00:00:01", "State": "STALE", "IsRouter": false},
+		},
+		{
+			neighMessage(netlink.FAMILY_V6, 2, "fe80::1", "52:54:00:00:00:02", netlink.NUD_REACHABLE, netlink.NTF_ROUTER),
+			"IPv6/fe80::1",
+			map[string]interface{}{"Family": "IPv6", "IP": "fe80::1", "MAC": "52:54:00:00:00:02", "State": "REACHABLE", "IsRouter": true},
+		},
+		{
+			neighMessage(netlink.FAMILY_V6, 2, "fe80::2", "", netlink.NUD_INCOMPLETE|netlink.NUD_FAILED, 0),
+			"IPv6/fe80::2",
+			map[string]interface{}{"Family": "IPv6", "IP": "fe80::2", "MAC": "", "State": "INCOMPLETE|FAILED", "IsRouter": false},
+		},
+	} {
+		neigh, err := netlink.NeighDeserialize(test.data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if key := neighKey(neigh); key != test.key {
+			t.Errorf("Expected key %s, got %s", test.key, key)
+		}
+
+		m := neighMetadata(neigh)
+		for k, v := range test.metadata {
+			if m[k] != v {
+				t.Errorf("Expected %s %v for %s, got: %v", k, v, test.key, m)
+			}
+		}
+	}
+}
+
+type neighborListener struct {
+	graph.DefaultGraphListener
+	updated int
+}
+
+func (l *neighborListener) OnNodeUpdated(n *graph.Node) {
+	l.updated++
+}
+
+func TestNeighborUpdates(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "neighbors", "Type": topology.HostType})
+	intf := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": topology.DeviceType, "IfIndex": int64(2)})
+	g.Link(root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	g.Unlock()
+
+	listener := &neighborListener{}
+	g.AddEventListener(listener)
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{NeighborInterval: time.Minute})
+
+	update := func(data []byte, deleted bool) {
+		neigh, err := netlink.NeighDeserialize(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		u.onNeighUpdated(neigh, deleted)
+	}
+
+	neighbors := func() map[string]interface{} {
+		g.RLock()
+		defer g.RUnlock()
+
+		neighbors, _ := intf.Metadata()["Neighbors"].(map[string]interface{})
+		return neighbors
+	}
+
+	// a burst of changes makes a single update
+	now := time.Now()
+	update(neighMessage(netlink.FAMILY_V4, 2, "10.0.0.1", "52:54:00:00:00:01", netlink.NUD_INCOMPLETE, 0), false)
+	update(neighMessage(netlink.FAMILY_V4, 2, "10.0.0.1", "52:54:00:00:00:01", netlink.NUD_REACHABLE, 0), false)
+	update(neighMessage(netlink.FAMILY_V6, 2, "fe80::1", "52:54:00:00:00:02", netlink.NUD_REACHABLE, netlink.NTF_ROUTER), false)
+	update(neighMessage(netlink.FAMILY_V4, 3, "10.0.1.1", "52:54:00:00:00:03", netlink.NUD_REACHABLE, 0), false)
+	u.flushNeighbors(now)
+
+	if listener.updated != 1 || len(neighbors()) != 2 {
+		t.Fatalf("Expected one update of both neighbors, got %d: %v", listener.updated, neighbors())
+	}
+	if state := neighbors()["IPv4/10.0.0.1"].(map[string]interface{})["State"]; state != "REACHABLE" {
+		t.Errorf("Last state expected: %s", state)
+	}
+
+	// applied once the interval elapsed
+	update(neighMessage(netlink.FAMILY_V4, 2, "10.0.0.1", "52:54:00:00:00:01", netlink.NUD_STALE, 0), true)
+	u.flushNeighbors(now.Add(time.Second))
+	if listener.updated != 1 {
+		t.Errorf("Changes shouldn't be applied before the interval: %v", neighbors())
+	}
+
+	u.flushNeighbors(now.Add(time.Minute))
+	if _, ok := neighbors()["IPv4/10.0.0.1"]; ok || listener.updated != 2 {
+		t.Errorf("Neighbor should have been deleted: %v", neighbors())
+	}
+
+	// nothing changed, nothing sent
+	update(neighMessage(netlink.FAMILY_V6, 2, "fe80::1", "52:54:00:00:00:02", netlink.NUD_REACHABLE, netlink.NTF_ROUTER), false)
+	update(neighMessage(netlink.FAMILY_V4, 2, "10.0.0.9", "", netlink.NUD_FAILED, 0), true)
+	u.flushNeighbors(now.Add(2 * time.Minute))
+	if listener.updated != 2 {
+		t.Errorf("Unchanged neighbors shouldn't be updated: %d", listener.updated)
+	}
+}
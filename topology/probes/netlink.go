@@ -23,7 +23,10 @@
 package probes
 
 import (
+	"fmt"
 	"net"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,7 +38,10 @@ import (
 
 	"github.com/safchain/ethtool"
 
-	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/faults"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
@@ -48,45 +54,187 @@ type NetLinkProbe struct {
 	Root                 *graph.Node
 	nlSocket             *nl.NetlinkSocket
 	state                int64
-	indexToChildrenQueue map[int64][]*graph.Node
+	indexToChildrenQueue *common.BoundedCache
+	pendingVeths         map[graph.Identifier]*pendingVeth
+	pendingVethsCount    int64
+	vethResolverInterval time.Duration
+	vethResolverRetries  int
+	dhcpLeases           *dhcpLeaseReader
+	sysctls              *sysctlReader
+	sriov                *sriovReader
+	interfaceTypes       map[string]bool
+	links                linkSource
+	recordDir            string
+	recorder             *netlinkRecorder
+	initialScanDelay     time.Duration
+	statistics           *statisticsReader
+	multicast            *multicastReader
+	logger               Logger
 	wg                   sync.WaitGroup
+	paused               int32
+	resync               int32
+	limiter              *tokenBucket
+	neighbors            *neighborUpdates
+	initialized          chan struct{}
+	renameWindow         time.Duration
+	// physical NICs whose link was deleted, kept for the rename window,
+	// protected by the graph lock
+	departed map[graph.Identifier]*time.Timer
+}
+
+type pendingVeth struct {
+	intf      *graph.Node
+	peerIndex int64
+	tries     int
+}
+
+// masterLinkMetadata returns the metadata of the edge between a master
+// interface, ie. a bridge or a VRF, and one of its slaves.
+func masterLinkMetadata(master *graph.Node) graph.Metadata {
+	m := graph.Metadata{"RelationType": topology.Layer2Relation}
+	if master.Metadata()["Type"] == topology.VrfType {
+		m["Type"] = topology.VrfType
+	}
+	return m
+}
+
+// isOvsDatapath returns whether a link is the datapath device of the OVS
+// kernel module, ie. ovs-system, whatever its name. Its kind is openvswitch
+// like the one of the OVS internal ports but it has no master, the ports
+// being the slaves of the datapath.
+func isOvsDatapath(kind, driver string, masterIndex int) bool {
+	if kind == "" {
+		kind = driver
+	}
+	return kind == topology.OpenvswitchType && masterIndex == 0
+}
+
+// lookupOvsLink returns the OVS interface of a name, the datapath device
+// only if requested so that an interface is never mistaken for it
+func lookupOvsLink(g *graph.Graph, name string, datapath bool) *graph.Node {
+	for _, n := range g.LookupNodes(graph.Metadata{"Name": name, "Driver": "openvswitch"}) {
+		if topology.IsOvsDatapath(n) == datapath {
+			return n
+		}
+	}
+	return nil
 }
 
 func (u *NetLinkProbe) linkMasterChildren(intf *graph.Node, index int64) {
 	// add children of this interface that haven previously added
-	if children, ok := u.indexToChildrenQueue[index]; ok {
-		for _, child := range children {
-			u.Graph.Link(intf, child, graph.Metadata{"RelationType": "layer2"})
+	if children, ok := u.indexToChildrenQueue.Get(index); ok {
+		// linking the ports to the OVS datapath doesn't make any sense
+		// according to the following thread:
+		// http://openvswitch.org/pipermail/discuss/2013-October/011657.html
+		if topology.IsOvsDatapath(intf) {
+			u.indexToChildrenQueue.Del(index)
+			return
+		}
+
+		for _, child := range children.([]*graph.Node) {
+			// the child could have been deleted meanwhile
+			if u.Graph.GetNode(child.ID) != nil && !u.Graph.AreLinked(intf, child) {
+				u.Graph.Link(intf, child, masterLinkMetadata(intf))
+			}
+		}
+		u.indexToChildrenQueue.Del(index)
+	}
+}
+
+func (u *NetLinkProbe) enqueueChild(index int64, intf *graph.Node) {
+	var children []*graph.Node
+	if c, ok := u.indexToChildrenQueue.Get(index); ok {
+		children = c.([]*graph.Node)
+	}
+
+	for _, child := range children {
+		if child.ID == intf.ID {
+			return
+		}
+	}
+
+	u.indexToChildrenQueue.Set(index, append(children, intf))
+}
+
+func (u *NetLinkProbe) onChildrenEvicted(key interface{}, value interface{}, reason string) {
+	for _, child := range value.([]*graph.Node) {
+		u.logger.Debugf("Dropping queued layer2 link between master interface %d and %s(%s), evicted on %s",
+			key.(int64), child.Metadata()["Name"], child.ID, reason)
+	}
+}
+
+// linkTypeAllowed returns whether the interfaces of the type of the link
+// are tracked, the type being the kind of the link info when known.
+func (u *NetLinkProbe) linkTypeAllowed(link netlink.Link, info *linkInfo) bool {
+	if u.interfaceTypes == nil {
+		return true
+	}
+
+	t := link.Type()
+	if info != nil && info.Kind != "" {
+		t = info.Kind
+	}
+
+	return u.interfaceTypes[t]
+}
+
+// interfaceTypesSet returns the set of the tracked interface types, nil
+// meaning all.
+func interfaceTypesSet(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+
+	types := make(map[string]bool)
+	for _, t := range list {
+		types[t] = true
+	}
+
+	return types
+}
+
+// unlinkFormerVrfs unlinks an interface from the VRFs it is not enslaved to
+// anymore. Unlike a bridge port, a VRF slave released or moved to another
+// VRF only gets a link update without the former master.
+func (u *NetLinkProbe) unlinkFormerVrfs(intf *graph.Node, masterIndex int64) {
+	for _, vrf := range u.Graph.LookupParentNodes(intf, graph.Metadata{"Type": topology.VrfType}) {
+		if vrf.Metadata()["IfIndex"] != masterIndex {
+			u.Graph.Unlink(vrf, intf)
 		}
-		delete(u.indexToChildrenQueue, index)
 	}
 }
 
 func (u *NetLinkProbe) handleIntfIsChild(intf *graph.Node, link netlink.Link) {
 	u.linkMasterChildren(intf, int64(link.Attrs().Index))
+	u.unlinkFormerVrfs(intf, int64(link.Attrs().MasterIndex))
 
-	// interface being a part of a bridge
-	if link.Attrs().MasterIndex != 0 {
+	// interface being a part of a bridge, the ports of the OVS datapath
+	// are not linked to it
+	if link.Attrs().MasterIndex != 0 && intf.Metadata()["InfoSlaveKind"] != topology.OpenvswitchType {
 		index := int64(link.Attrs().MasterIndex)
 
 		// assuming we have only one parent with this index
 		parent := u.Graph.LookupFirstChild(u.Root, graph.Metadata{"IfIndex": index})
 		if parent == nil {
+			// the bridge will never be added if its type is not tracked
+			if master, err := u.links.LinkByIndex(int(index)); err == nil {
+				info, _ := u.links.LinkInfo(int(index))
+				if !u.linkTypeAllowed(master, info) {
+					return
+				}
+			}
+
+			// not yet the bridge so, enqueue for a later add
+			u.enqueueChild(index, intf)
 			return
 		}
 
-		// ignore ovs-system interface as it doesn't make any sense according to
-		// the following thread:
-		// http://openvswitch.org/pipermail/discuss/2013-October/011657.html
-		if parent.Metadata()["Name"] == "ovs-system" {
+		if topology.IsOvsDatapath(parent) {
 			return
 		}
 
-		if parent != nil && !u.Graph.AreLinked(parent, intf) {
-			u.Graph.Link(parent, intf, graph.Metadata{"RelationType": "layer2"})
-		} else {
-			// not yet the bridge so, enqueue for a later add
-			u.indexToChildrenQueue[index] = append(u.indexToChildrenQueue[index], intf)
+		if !u.Graph.AreLinked(parent, intf) {
+			u.Graph.Link(parent, intf, masterLinkMetadata(parent))
 		}
 	}
 }
@@ -98,48 +246,64 @@ func (u *NetLinkProbe) handleIntfIsVeth(intf *graph.Node, link netlink.Link) {
 
 	stats, err := ethtool.Stats(link.Attrs().Name)
 	if err != nil {
-		logging.GetLogger().Errorf("Unable get stats from ethtool: %s", err.Error())
+		u.logger.Errorf("Unable get stats from ethtool: %s", err.Error())
 		return
 	}
 
 	if index, ok := stats["peer_ifindex"]; ok {
-		peerResolver := func() bool {
-			// re get the interface from the graph since the interface could have been deleted
-			if u.Graph.GetNode(intf.ID) == nil {
-				return false
-			}
+		peerIndex := int64(index)
+		if peerIndex > intf.Metadata()["IfIndex"].(int64) && !u.resolveVethPeer(intf, peerIndex) {
+			// retry later since the right peer can be inserted later
+			u.pendingVeths[intf.ID] = &pendingVeth{intf: intf, peerIndex: peerIndex}
+			atomic.StoreInt64(&u.pendingVethsCount, int64(len(u.pendingVeths)))
+		}
+	}
+}
 
-			// got more than 1 peer, unable to find the right one, wait for the other to discover
-			peer := u.Graph.LookupFirstNode(graph.Metadata{"IfIndex": int64(index), "Type": "veth"})
-			if peer != nil && !u.Graph.AreLinked(peer, intf) {
-				u.Graph.Link(peer, intf, graph.Metadata{"RelationType": "layer2", "Type": "veth"})
-				return true
-			}
-			return false
-		}
-
-		if int64(index) > intf.Metadata()["IfIndex"].(int64) {
-			ok := peerResolver()
-			if !ok {
-				// retry few seconds later since the right peer can be insert later
-				go func() {
-					ok := false
-					try := 0
-
-					for {
-						if ok || try > 10 {
-							return
-						}
-						time.Sleep(time.Millisecond * 200)
-
-						u.Graph.Lock()
-						ok = peerResolver()
-						u.Graph.Unlock()
-
-						try++
-					}
-				}()
-			}
+func (u *NetLinkProbe) resolveVethPeer(intf *graph.Node, peerIndex int64) bool {
+	// got more than 1 peer, unable to find the right one, wait for the other to discover
+	peer := u.Graph.LookupFirstNode(graph.Metadata{"IfIndex": peerIndex, "Type": topology.VethType})
+	if peer != nil && !u.Graph.AreLinked(peer, intf) {
+		u.Graph.Link(peer, intf, graph.Metadata{"RelationType": topology.Layer2Relation, "Type": topology.VethType})
+		return true
+	}
+	return false
+}
+
+// sweepPendingVeths tries to link all the veths whose peer was not found yet,
+// veths are given up after vethResolverRetries tries.
+func (u *NetLinkProbe) sweepPendingVeths() {
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for id, pending := range u.pendingVeths {
+		// re get the interface from the graph since the interface could have been deleted
+		if u.Graph.GetNode(id) == nil || u.resolveVethPeer(pending.intf, pending.peerIndex) {
+			delete(u.pendingVeths, id)
+			continue
+		}
+
+		pending.tries++
+		if pending.tries >= u.vethResolverRetries {
+			u.logger.Debugf("Unable to find the veth peer %d of %s(%s)", pending.peerIndex, pending.intf.Metadata()["Name"], id)
+			delete(u.pendingVeths, id)
+		}
+	}
+
+	atomic.StoreInt64(&u.pendingVethsCount, int64(len(u.pendingVeths)))
+}
+
+func (u *NetLinkProbe) vethResolver() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(u.vethResolverInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&u.state) == RunningState {
+		<-ticker.C
+
+		if atomic.LoadInt64(&u.pendingVethsCount) > 0 && !u.IsPaused() {
+			u.sweepPendingVeths()
 		}
 	}
 }
@@ -152,17 +316,69 @@ func (u *NetLinkProbe) handleIntfIsBond(intf *graph.Node, link netlink.Link) {
 	bond := link.(*netlink.Bond)
 	u.Graph.AddMetadata(intf, "BondMode", bond.Mode.String())
 
+	// IfIndex of the active slave, only known in the active-backup mode
+	if bond.ActiveSlave > 0 {
+		u.Graph.AddMetadata(intf, "BondActiveSlave", int64(bond.ActiveSlave))
+	}
+
 	// TODO(safchain) Add more info there like xmit_hash_policy
 }
 
+// newLinkNode creates the node of an interface, unless an interface with the
+// same name, or the same hardware identity for a physical NIC, was deleted
+// during the tombstone grace period. In that case the node comes back with
+// its ID and annotations so that a flapping interface doesn't churn the
+// topology.
+func (u *NetLinkProbe) newLinkNode(name string, m graph.Metadata) *graph.Node {
+	filter := graph.Metadata{"Name": name}
+	if key, value := topology.HardwareIdentity(m); key != "" {
+		filter = graph.Metadata{key: value}
+	}
+
+	if intf := u.Graph.LookupTombstone(u.Root, filter); intf != nil {
+		u.logger.Debugf("Interface %s came back during its grace period: %s", name, intf.ID)
+		u.Graph.Resurrect(intf, m)
+		return intf
+	}
+
+	return u.Graph.NewNode(u.linkNodeID(m), m)
+}
+
+// linkNodeID returns the ID of a new interface node, derived from its
+// index so that it is kept across the agent restarts, or for a physical NIC
+// from its hardware identity so that it is also kept when the NIC gets
+// another name and index, ie. when migrating to the predictable names.
+func (u *NetLinkProbe) linkNodeID(m graph.Metadata) graph.Identifier {
+	if key, value := topology.HardwareIdentity(m); key != "" {
+		return u.Graph.NewIDFrom(string(u.Root.ID), key, value)
+	}
+	if index, ok := m["IfIndex"].(int64); ok {
+		return u.Graph.NewIDFrom(string(u.Root.ID), "IfIndex", strconv.FormatInt(index, 10))
+	}
+	return graph.GenID()
+}
+
 func (u *NetLinkProbe) addGenericLinkToTopology(link netlink.Link, m graph.Metadata) *graph.Node {
 	name := link.Attrs().Name
 	index := int64(link.Attrs().Index)
 
 	var intf *graph.Node
-	intf = u.Graph.LookupFirstChild(u.Root, graph.Metadata{
-		"IfIndex": index,
-	})
+
+	// a physical NIC is the same whatever its name and index
+	if key, value := topology.HardwareIdentity(m); key != "" {
+		intf = u.Graph.LookupFirstChild(u.Root, graph.Metadata{key: value})
+	}
+
+	if intf == nil {
+		intf = u.Graph.LookupFirstChild(u.Root, graph.Metadata{
+			"IfIndex": index,
+		})
+
+		// the index of a departed NIC may be given to another link
+		if intf != nil && u.departed[intf.ID] != nil {
+			intf = nil
+		}
+	}
 
 	// could be a member of ovs
 	intfs := u.Graph.LookupNodes(graph.Metadata{
@@ -177,22 +393,21 @@ func (u *NetLinkProbe) addGenericLinkToTopology(link netlink.Link, m graph.Metad
 	}
 
 	if intf == nil {
-		intf = u.Graph.NewNode(graph.GenID(), m)
+		intf = u.newLinkNode(name, m)
 	}
 
 	if intf == nil {
 		return nil
 	}
 
-	if !u.Graph.AreLinked(u.Root, intf) {
-		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": "ownership"})
+	if timer, ok := u.departed[intf.ID]; ok {
+		u.logger.Infof("Interface %s(%s) came back as %s(%d)", intf.Metadata()["Name"], intf.ID, name, index)
+		timer.Stop()
+		delete(u.departed, intf.ID)
 	}
 
-	// ignore ovs-system interface as it doesn't make any sense according to
-	// the following thread:
-	// http://openvswitch.org/pipermail/discuss/2013-October/011657.html
-	if name == "ovs-system" {
-		return intf
+	if !u.Graph.AreLinked(u.Root, intf) {
+		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
 	}
 
 	u.handleIntfIsChild(intf, link)
@@ -212,11 +427,13 @@ func (u *NetLinkProbe) addBridgeLinkToTopology(link netlink.Link, m graph.Metada
 	})
 
 	if intf == nil {
-		intf = u.Graph.NewNode(graph.GenID(), m)
+		if intf = u.newLinkNode(name, m); intf == nil {
+			return nil
+		}
 	}
 
 	if !u.Graph.AreLinked(u.Root, intf) {
-		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": "ownership"})
+		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
 	}
 
 	u.linkMasterChildren(intf, index)
@@ -227,13 +444,15 @@ func (u *NetLinkProbe) addBridgeLinkToTopology(link netlink.Link, m graph.Metada
 func (u *NetLinkProbe) addOvsLinkToTopology(link netlink.Link, m graph.Metadata) *graph.Node {
 	name := link.Attrs().Name
 
-	intf := u.Graph.LookupFirstNode(graph.Metadata{"Name": name, "Driver": "openvswitch"})
+	intf := lookupOvsLink(u.Graph, name, m[topology.OvsDatapathKey] == true)
 	if intf == nil {
-		intf = u.Graph.NewNode(graph.GenID(), m)
+		if intf = u.Graph.NewNode(u.linkNodeID(m), m); intf == nil {
+			return nil
+		}
 	}
 
 	if !u.Graph.AreLinked(u.Root, intf) {
-		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": "ownership"})
+		u.Graph.Link(u.Root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
 	}
 
 	return intf
@@ -242,7 +461,7 @@ func (u *NetLinkProbe) addOvsLinkToTopology(link netlink.Link, m graph.Metadata)
 func (u *NetLinkProbe) getLinkIPV4Addr(link netlink.Link) string {
 	var ipv4 []string
 
-	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	addrs, err := u.links.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		return ""
 	}
@@ -254,11 +473,34 @@ func (u *NetLinkProbe) getLinkIPV4Addr(link netlink.Link) string {
 	return strings.Join(ipv4, ", ")
 }
 
-func (u *NetLinkProbe) addLinkToTopology(link netlink.Link) {
-	logging.GetLogger().Debugf("Link \"%s(%d)\" added", link.Attrs().Name, link.Attrs().Index)
+// linkUpdate is the metadata of a link read from the kernel, before
+// locking the graph
+type linkUpdate struct {
+	link     netlink.Link
+	driver   string
+	metadata graph.Metadata
+}
 
-	u.Graph.Lock()
-	defer u.Graph.Unlock()
+// readLink reads the metadata of a link, nil if the link isn't tracked.
+// The info is the one of the link message received, looked up if nil. The
+// graph lock isn't held, the kernel being queried.
+func (u *NetLinkProbe) readLink(link netlink.Link, info *linkInfo) *linkUpdate {
+	u.logger.Debugf("Link \"%s(%d)\" added", link.Attrs().Name, link.Attrs().Index)
+
+	if info == nil {
+		var err error
+		if info, err = u.links.LinkInfo(link.Attrs().Index); err != nil {
+			u.logger.Debugf("Unable to get link info of %s: %s", link.Attrs().Name, err.Error())
+		}
+	}
+
+	if !u.linkTypeAllowed(link, info) {
+		u.logger.Debugf("Link \"%s(%d)\" of type %s not tracked", link.Attrs().Name, link.Attrs().Index, link.Type())
+		return nil
+	}
+
+	lease := u.dhcpLeases.lookup(link.Attrs().Name, int64(link.Attrs().Index))
+	sriov := u.sriov.read(link.Attrs().Name)
 
 	driver, _ := ethtool.DriverName(link.Attrs().Name)
 	if driver == "" && link.Type() == "bridge" {
@@ -274,30 +516,116 @@ func (u *NetLinkProbe) addLinkToTopology(link netlink.Link) {
 		"Driver":  driver,
 	}
 
+	// ifalias, ie. set with ip link set dev eth0 alias "uplink"
+	if alias := link.Attrs().Alias; alias != "" {
+		metadata["Alias"] = alias
+	}
+
 	ipv4 := u.getLinkIPV4Addr(link)
 	if len(ipv4) > 0 {
 		metadata["IPV4"] = ipv4
 	}
 
+	if lease != nil {
+		metadata["DHCP"] = dhcpMetadata(lease, ipv4)
+	}
+
+	var kind string
+	if info != nil {
+		kind = info.Kind
+		if info.Kind != "" {
+			metadata["InfoKind"] = info.Kind
+
+			// the kind is more specific than the type returned for the
+			// links not known by netlink
+			if info.Kind != link.Type() {
+				metadata["Type"] = info.Kind
+			}
+		}
+		if info.SlaveKind != "" {
+			metadata["InfoSlaveKind"] = info.SlaveKind
+		}
+		if info.OperState != "" {
+			metadata["OperState"] = info.OperState
+		}
+		if len(info.Data) > 0 {
+			metadata["InfoData"] = info.Data
+		}
+		if table, ok := info.Data["Table"]; ok && info.Kind == topology.VrfType {
+			metadata["VRFTable"] = table
+		}
+	}
+
+	if isOvsDatapath(kind, driver, link.Attrs().MasterIndex) {
+		metadata[topology.OvsDatapathKey] = true
+	}
+
+	if neighbors := u.getLinkNeighbors(link); len(neighbors) > 0 {
+		metadata["Neighbors"] = neighbors
+	}
+
 	if vlan, ok := link.(*netlink.Vlan); ok {
 		metadata["Vlan"] = vlan.VlanId
 	}
 
+	if vxlan, ok := link.(*netlink.Vxlan); ok {
+		// the VXLANs in external mode, ie. the one of OVS, have no VNI
+		if vxlan.VxlanId > 0 {
+			metadata["VNI"] = int64(vxlan.VxlanId)
+		}
+		if vxlan.SrcAddr != nil {
+			metadata["LocalIP"] = vxlan.SrcAddr.String()
+		}
+	}
+
+	for k, v := range getLinkSettings(link.Attrs().Name) {
+		metadata[k] = v
+	}
+
+	if address := pciAddress(link.Attrs().Name, info); address != "" {
+		metadata["PCIAddress"] = address
+	}
+	if mac := permanentMAC(link.Attrs().Name, info); mac != "" {
+		metadata["PermanentMAC"] = mac
+	}
+	if key, _ := topology.HardwareIdentity(metadata); key != "" {
+		metadata["NamingPolicy"] = namingPolicy(link.Attrs().Name)
+	}
+	if sriov != nil {
+		metadata[SRIOVKey] = sriov
+	}
+
 	if (link.Attrs().Flags & net.FlagUp) > 0 {
 		metadata["State"] = "UP"
 	} else {
 		metadata["State"] = "DOWN"
 	}
 
+	return &linkUpdate{link: link, driver: driver, metadata: metadata}
+}
+
+// applyLink adds the interface of a link or updates it, the graph lock
+// being held
+func (u *NetLinkProbe) applyLink(update *linkUpdate) {
+	link, driver, metadata := update.link, update.driver, update.metadata
+
+	// the lookups of the interface by the add functions below in one call
+	u.Graph.Prefetch(
+		graph.Metadata{"Name": link.Attrs().Name, "IfIndex": int64(link.Attrs().Index)},
+		graph.Metadata{"Name": link.Attrs().Name, "Driver": "openvswitch"},
+	)
+	defer u.Graph.EndPrefetch()
+
 	var intf *graph.Node
 
 	switch driver {
 	case "bridge":
 		intf = u.addBridgeLinkToTopology(link, metadata)
 	case "openvswitch":
-		intf = u.addOvsLinkToTopology(link, metadata)
 		// always prefer Type from ovs
-		metadata["Type"] = intf.Metadata()["Type"]
+		if intf = u.addOvsLinkToTopology(link, metadata); intf != nil {
+			metadata["Type"] = intf.Metadata()["Type"]
+		}
 	default:
 		intf = u.addGenericLinkToTopology(link, metadata)
 	}
@@ -306,33 +634,83 @@ func (u *NetLinkProbe) addLinkToTopology(link netlink.Link) {
 	if intf != nil {
 		m := intf.Metadata()
 
+		// a physical NIC renamed keeps its node, its former names being
+		// recorded
+		if name, _ := m["Name"].(string); name != "" && name != metadata["Name"] {
+			if key, _ := topology.HardwareIdentity(metadata); key != "" {
+				u.logger.Infof("Interface %s(%s) renamed %s", name, intf.ID, metadata["Name"])
+				metadata["PreviousNames"] = previousNames(m, name)
+			}
+		}
+
 		updated := false
 		for k, nv := range metadata {
-			if ov, ok := m[k]; ok && nv == ov {
+			if ov, ok := m[k]; ok && reflect.DeepEqual(nv, ov) {
 				continue
 			}
 			m[k] = nv
 			updated = true
 		}
 
+		// the alias can be unset, the link settings become unavailable
+		for _, k := range append([]string{"Alias", SRIOVKey}, linkSettingsKeys...) {
+			if _, ok := m[k]; ok && metadata[k] == nil {
+				delete(m, k)
+				updated = true
+			}
+		}
+
 		if updated {
 			u.Graph.SetMetadata(intf, m)
 		}
 	}
 }
 
-func (u *NetLinkProbe) onLinkAdded(index int) {
-	link, err := netlink.LinkByIndex(index)
+func (u *NetLinkProbe) addLinkToTopology(link netlink.Link, info *linkInfo) {
+	update := u.readLink(link, info)
+	if update == nil {
+		return
+	}
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	u.applyLink(update)
+}
+
+// addLinksToTopology adds the links of a scan with the infos of the dump,
+// all of them being read first then added in a single hold of the graph
+// lock
+func (u *NetLinkProbe) addLinksToTopology(links []netlink.Link, infos map[int]*linkInfo) {
+	var updates []*linkUpdate
+	for _, link := range links {
+		if update := u.readLink(link, infos[link.Attrs().Index]); update != nil {
+			updates = append(updates, update)
+		}
+	}
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for _, update := range updates {
+		u.applyLink(update)
+	}
+}
+
+// onLinkAdded handles a link message, info being the one of the message,
+// nil if the message has none, ie. of the bridge family.
+func (u *NetLinkProbe) onLinkAdded(index int, info *linkInfo) {
+	link, err := u.links.LinkByIndex(index)
 	if err != nil {
-		logging.GetLogger().Warningf("Failed to find interface %d: %s", index, err.Error())
+		u.logger.Warningf("Failed to find interface %d: %s", index, err.Error())
 		return
 	}
 
-	u.addLinkToTopology(link)
+	u.addLinkToTopology(link, info)
 }
 
 func (u *NetLinkProbe) onLinkDeleted(index int) {
-	logging.GetLogger().Debugf("Link %d deleted", index)
+	u.logger.Debugf("Link %d deleted", index)
 
 	u.Graph.Lock()
 	defer u.Graph.Unlock()
@@ -340,6 +718,7 @@ func (u *NetLinkProbe) onLinkDeleted(index int) {
 	var intf *graph.Node
 
 	intfs := u.Graph.LookupNodes(graph.Metadata{"IfIndex": int64(index)})
+	intfs = u.withoutDeparted(intfs)
 	switch l := len(intfs); {
 	case l == 1:
 		intf = intfs[0]
@@ -358,7 +737,7 @@ func (u *NetLinkProbe) onLinkDeleted(index int) {
 
 	// case of removing the interface from a bridge
 	if intf != nil {
-		parents := u.Graph.LookupParentNodes(intf, graph.Metadata{"Type": "bridge"})
+		parents := u.Graph.LookupParentNodes(intf, graph.Metadata{"Type": topology.BridgeType})
 		for _, parent := range parents {
 			u.Graph.Unlink(parent, intf)
 		}
@@ -366,75 +745,249 @@ func (u *NetLinkProbe) onLinkDeleted(index int) {
 
 	// check whether the interface has been deleted or not
 	// we get a delete event when an interace is removed from a bridge
-	_, err := netlink.LinkByIndex(index)
+	_, err := u.links.LinkByIndex(index)
+	if err != nil {
+		// the neighbors of a deleted link aren't the ones of a new link
+		// reusing its index
+		delete(u.neighbors.pending, int64(index))
+	}
 	if err != nil && intf != nil {
+		key, _ := topology.HardwareIdentity(intf.Metadata())
+
 		// if openvswitch do not remove let's do the job by ovs piece of code
 		if intf.Metadata()["Driver"] == "openvswitch" {
 			u.Graph.Unlink(u.Root, intf)
+		} else if key != "" && u.renameWindow > 0 {
+			u.depart(intf)
 		} else {
-			u.Graph.DelNode(intf)
+			u.Graph.TombstoneNode(intf)
 		}
 	}
 
-	delete(u.indexToChildrenQueue, int64(index))
+	u.indexToChildrenQueue.Del(int64(index))
+}
+
+// depart keeps the node of a physical NIC whose link was deleted for the
+// rename window, the link of a NIC unbound from its driver, ie. to get a
+// predictable name, coming back with another name and index. The node is
+// deleted if the NIC doesn't come back.
+func (u *NetLinkProbe) depart(intf *graph.Node) {
+	if _, ok := u.departed[intf.ID]; ok {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(u.renameWindow, func() {
+		u.Graph.Lock()
+		defer u.Graph.Unlock()
+
+		if u.departed[intf.ID] != timer {
+			return
+		}
+		delete(u.departed, intf.ID)
+
+		if u.Graph.GetNode(intf.ID) != nil {
+			u.Graph.TombstoneNode(intf)
+		}
+	})
+	u.departed[intf.ID] = timer
+}
+
+// withoutDeparted filters out the departed NICs, the graph lock being held
+func (u *NetLinkProbe) withoutDeparted(intfs []*graph.Node) []*graph.Node {
+	if len(u.departed) == 0 {
+		return intfs
+	}
+
+	var result []*graph.Node
+	for _, intf := range intfs {
+		if _, ok := u.departed[intf.ID]; !ok {
+			result = append(result, intf)
+		}
+	}
+	return result
+}
+
+func (u *NetLinkProbe) recordInitialLinks() {
+	msgs, err := dumpLinks()
+	if err != nil {
+		u.logger.Errorf("Unable to dump the links to record: %s", err.Error())
+		return
+	}
+
+	for _, msg := range msgs {
+		u.recordMessage(syscall.RTM_NEWLINK, msg)
+	}
+}
+
+func (u *NetLinkProbe) recordMessage(msgType uint16, data []byte) {
+	if err := u.recorder.record(msgType, data); err != nil {
+		u.logger.Errorf("Unable to record a netlink message: %s", err.Error())
+	}
+}
+
+// suspendEvents suspends the graph events during a scan of all the links,
+// the returned function resuming them
+func (u *NetLinkProbe) suspendEvents() func() {
+	u.Graph.Lock()
+	u.Graph.SuspendEvents()
+	u.Graph.Unlock()
+
+	return func() {
+		u.Graph.Lock()
+		u.Graph.ResumeEvents()
+		u.Graph.Unlock()
+	}
 }
 
 func (u *NetLinkProbe) initialize() {
-	links, err := netlink.LinkList()
+	if u.recorder != nil {
+		u.recordInitialLinks()
+	}
+
+	defer u.suspendEvents()()
+
+	links, infos, err := listLinks()
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to list interfaces: %s", err.Error())
+		u.logger.Errorf("Unable to list interfaces: %s", err.Error())
 		return
 	}
 
+	u.dhcpLeases.refresh(time.Now())
+	u.addLinksToTopology(links, infos)
+	u.updateRoutes()
+	u.updateSysctls()
+}
+
+// reconcile catches up with the changes missed while paused or lost with
+// the socket overflowing, the current links are added again and the
+// interfaces gone are deleted.
+func (u *NetLinkProbe) reconcile() {
+	links, infos, err := listLinks()
+	if err != nil {
+		u.logger.Errorf("Unable to list interfaces: %s", err.Error())
+		return
+	}
+
+	defer u.suspendEvents()()
+
+	// the neighbors are read again with the links
+	u.neighbors.pending = make(map[int64]map[string]interface{})
+
+	indexes := make(map[int64]bool)
 	for _, link := range links {
-		u.addLinkToTopology(link)
+		indexes[int64(link.Attrs().Index)] = true
 	}
+	u.addLinksToTopology(links, infos)
+
+	var gone []int
+	u.Graph.RLock()
+	for _, n := range u.Graph.LookupChildren(u.Root, graph.Metadata{}) {
+		if index, ok := n.Metadata()["IfIndex"].(int64); ok && !indexes[index] {
+			gone = append(gone, int(index))
+		}
+	}
+	u.Graph.RUnlock()
+
+	for _, index := range gone {
+		u.onLinkDeleted(index)
+	}
+
+	u.updateRoutes()
+	u.updateSysctls()
 }
 
 func (u *NetLinkProbe) start() {
-	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK)
+	defer u.wg.Done()
+	defer common.RecoverAndPanic()
+
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK, syscall.RTNLGRP_NEIGH, syscall.RTNLGRP_IPV4_ROUTE, syscall.RTNLGRP_IPV6_ROUTE)
 	if err != nil {
-		logging.GetLogger().Errorf("Failed to subscribe to netlink RTNLGRP_LINK messages: %s", err.Error())
+		u.logger.Errorf("Failed to subscribe to netlink RTNLGRP_LINK/RTNLGRP_NEIGH/RTNLGRP_IPV*_ROUTE messages: %s", err.Error())
 		return
 	}
 	u.nlSocket = s
 	defer u.nlSocket.Close()
 
+	if u.recordDir != "" {
+		if u.recorder, err = openNetlinkRecorder(u.recordDir, string(u.Root.ID)); err != nil {
+			u.logger.Errorf("Unable to record the netlink messages: %s", err.Error())
+		} else {
+			defer u.recorder.close()
+		}
+	}
+
+	common.RegisterCache(u.indexToChildrenQueue)
+	defer common.UnregisterCache(u.indexToChildrenQueue)
+
 	fd := u.nlSocket.GetFd()
 
 	err = syscall.SetNonblock(fd, true)
 	if err != nil {
-		logging.GetLogger().Errorf("Failed to set the netlink fd as non-blocking: %s", err.Error())
+		u.logger.Errorf("Failed to set the netlink fd as non-blocking: %s", err.Error())
 		return
 	}
 
 	epfd, e := syscall.EpollCreate1(0)
 	if e != nil {
-		logging.GetLogger().Errorf("Failed to create epoll: %s", err.Error())
+		u.logger.Errorf("Failed to create epoll: %s", err.Error())
 		return
 	}
 	defer syscall.Close(epfd)
 
+	// already subscribed, the messages received during the delay are
+	// processed after the initial scan
+	if u.initialScanDelay > 0 {
+		time.Sleep(u.initialScanDelay)
+	}
+
 	u.initialize()
+	close(u.initialized)
 
 	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
 	if e = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); e != nil {
-		logging.GetLogger().Errorf("Failed to control epoll: %s", err.Error())
+		u.logger.Errorf("Failed to control epoll: %s", err.Error())
 		return
 	}
 
 	events := make([]syscall.EpollEvent, maxEpollEvents)
 
+	// stopped while initializing
+	if !atomic.CompareAndSwapInt64(&u.state, StoppedState, RunningState) {
+		return
+	}
+
 	u.wg.Add(1)
-	defer u.wg.Done()
+	go u.vethResolver()
+
+	// the epoll timeout makes the loop beat at least every second
+	heartbeat := common.NewHeartbeat("netlink/" + string(u.Root.ID))
+	common.RegisterHeartbeat(heartbeat)
+	defer common.UnregisterHeartbeat(heartbeat)
 
-	atomic.StoreInt64(&u.state, RunningState)
 	for atomic.LoadInt64(&u.state) == RunningState {
+		heartbeat.Beat()
+
+		// run from this thread, the one of the namespace
+		if atomic.CompareAndSwapInt32(&u.resync, 1, 0) {
+			u.logger.Infof("Netlink probe of %s resumed, reconciling", u.Root.ID)
+			u.reconcile()
+		}
+
+		paused := u.IsPaused()
+		if !paused {
+			u.updateSysctls()
+			u.updateStatistics()
+			u.updateMulticast()
+			u.updateDHCPLeases()
+			u.flushNeighbors(time.Now())
+		}
+
 		n, err := syscall.EpollWait(epfd, events[:], 1000)
 		if err != nil {
 			errno, ok := err.(syscall.Errno)
 			if ok && errno != syscall.EINTR {
-				logging.GetLogger().Errorf("Failed to receive from events from netlink: %s", err.Error())
+				u.logger.Errorf("Failed to receive from events from netlink: %s", err.Error())
 			}
 			continue
 		}
@@ -442,47 +995,207 @@ func (u *NetLinkProbe) start() {
 			continue
 		}
 
-		msgs, err := s.Receive()
+		msgs, err := receive(s)
+		if err == syscall.ENOBUFS {
+			// the socket overflowed, the messages lost are recovered by
+			// reconciling the graph with the links
+			u.logger.Warningf("Netlink messages lost, reconciling")
+			atomic.StoreInt32(&u.resync, 1)
+			continue
+		}
 		if err != nil {
-			logging.GetLogger().Errorf("Failed to receive from netlink messages: %s", err.Error())
+			u.logger.Errorf("Failed to receive from netlink messages: %s", err.Error())
 
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
+		// the messages are drained but dropped, the graph being reconciled
+		// on resume
+		if paused {
+			continue
+		}
+
+		if len(msgs) > 0 {
+			heartbeat.Updated()
+		}
+
+		routesUpdated := false
 		for _, msg := range msgs {
+			if u.recorder != nil {
+				u.recordMessage(msg.Header.Type, msg.Data)
+			}
+
+			switch msg.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWNEIGH, syscall.RTM_DELNEIGH:
+				u.throttle()
+			}
+
 			switch msg.Header.Type {
 			case syscall.RTM_NEWLINK:
 				ifmsg := nl.DeserializeIfInfomsg(msg.Data)
-				u.onLinkAdded(int(ifmsg.Index))
+				u.onLinkAdded(int(ifmsg.Index), messageLinkInfo(msg.Data))
+				u.refreshPhysicalFunctions()
 			case syscall.RTM_DELLINK:
 				ifmsg := nl.DeserializeIfInfomsg(msg.Data)
 				u.onLinkDeleted(int(ifmsg.Index))
+				u.refreshPhysicalFunctions()
+			case syscall.RTM_NEWNEIGH, syscall.RTM_DELNEIGH:
+				neigh, err := netlink.NeighDeserialize(msg.Data)
+				if err != nil {
+					u.logger.Errorf("Failed to parse netlink neighbor message: %s", err.Error())
+					continue
+				}
+				u.onNeighUpdated(neigh, msg.Header.Type == syscall.RTM_DELNEIGH)
+			case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+				routesUpdated = true
 			}
 		}
+
+		// the whole table is read once per batch of route messages
+		if routesUpdated {
+			u.updateRoutes()
+		}
+		u.flushNeighbors(time.Now())
 	}
 }
 
+// throttle waits for the rate limit of the updates of the probe, the
+// messages waiting in the netlink socket meanwhile
+func (u *NetLinkProbe) throttle() {
+	if d := u.limiter.take(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Initialized is closed once the initial scan of the interfaces is done
+func (u *NetLinkProbe) Initialized() <-chan struct{} {
+	return u.initialized
+}
+
 func (u *NetLinkProbe) Start() {
+	u.wg.Add(1)
 	go u.start()
 }
 
+// receive receives the netlink messages, dropped with ENOBUFS by the
+// netlink.enobufs fault
+func receive(s *nl.NetlinkSocket) ([]syscall.NetlinkMessage, error) {
+	msgs, err := s.Receive()
+	if err == nil && faults.Fire(faults.NetlinkENOBUFS) {
+		return nil, syscall.ENOBUFS
+	}
+	return msgs, err
+}
+
 func (u *NetLinkProbe) Run() {
+	u.wg.Add(1)
 	u.start()
 }
 
-func (u *NetLinkProbe) Stop() {
-	if atomic.CompareAndSwapInt64(&u.state, RunningState, StoppingState) {
-		u.wg.Wait()
+// Pause stops the updates of the graph, the nodes being kept
+func (u *NetLinkProbe) Pause() {
+	atomic.StoreInt32(&u.paused, 1)
+}
+
+// Resume restarts the updates of the graph after a reconciliation
+func (u *NetLinkProbe) Resume() {
+	if atomic.CompareAndSwapInt32(&u.paused, 1, 0) {
+		atomic.StoreInt32(&u.resync, 1)
+	}
+}
+
+func (u *NetLinkProbe) IsPaused() bool {
+	return atomic.LoadInt32(&u.paused) == 1
+}
+
+// checkEthtool reads the driver of the interfaces through ethtool, the
+// check passing once one of them answers, the loopback having no driver.
+func checkEthtool(links []netlink.Link) error {
+	var err error
+	for _, link := range links {
+		if link.Attrs().Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err = ethtool.DriverName(link.Attrs().Name); err == nil {
+			return nil
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read the drivers of the interfaces: %s", err.Error())
 	}
+	return nil
 }
 
-func NewNetLinkProbe(g *graph.Graph, n *graph.Node) *NetLinkProbe {
+// Check subscribes to the netlink messages the probe listens to, the
+// subscription being closed right away, then lists the interfaces and
+// reads their drivers through ethtool.
+func (u *NetLinkProbe) Check() []probe.CheckResult {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK, syscall.RTNLGRP_NEIGH, syscall.RTNLGRP_IPV4_ROUTE, syscall.RTNLGRP_IPV6_ROUTE)
+	if err == nil {
+		s.Close()
+	} else {
+		err = fmt.Errorf("unable to subscribe to the netlink messages: %s", err.Error())
+	}
+
+	results := []probe.CheckResult{
+		probe.NewCheckResult("netlink subscription", err, "run the agent as root or with the CAP_NET_ADMIN capability"),
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		err = fmt.Errorf("unable to list the interfaces: %s", err.Error())
+	}
+	results = append(results, probe.NewCheckResult("interfaces listing", err, "run the agent as root or with the CAP_NET_ADMIN capability"))
+
+	if err == nil {
+		results = append(results, probe.NewCheckResult("ethtool", checkEthtool(links),
+			"the drivers and the statistics of the interfaces are read with the SIOCETHTOOL ioctl, check that no seccomp profile denies it"))
+	}
+
+	return results
+}
+
+// Stop waits for the probe to release its netlink socket, a probe still
+// initializing giving up before running.
+func (u *NetLinkProbe) Stop() {
+	atomic.StoreInt64(&u.state, StoppingState)
+	u.wg.Wait()
+}
+
+// NewNetLinkProbe returns a probe tracking the interfaces of the namespace
+// it is started in, as children of the given root node.
+func NewNetLinkProbe(g *graph.Graph, n *graph.Node, opts NetLinkOptions) *NetLinkProbe {
+	opts = opts.withDefaults()
+
 	np := &NetLinkProbe{
 		Graph:                g,
 		Root:                 n,
-		indexToChildrenQueue: make(map[int64][]*graph.Node),
+		indexToChildrenQueue: common.NewBoundedCache("netlink/"+string(n.ID)+"/indexToChildrenQueue", opts.CacheMaxSize, opts.CacheMaxAge),
+		pendingVeths:         make(map[graph.Identifier]*pendingVeth),
+		vethResolverInterval: opts.VethResolverInterval,
+		vethResolverRetries:  opts.VethResolverRetries,
+		dhcpLeases:           newDHCPLeaseReader(opts.DHCPClientLeases, opts.NetworkdLeases, opts.DHCPInterval, opts.Logger),
+		sysctls:              newSysctlReader(opts.SysctlKeys, opts.SysctlInterval),
+		sriov:                newSRIOVReader(opts.SRIOVSysfs),
+		interfaceTypes:       interfaceTypesSet(opts.InterfaceTypes),
+		links:                kernelLinks{},
+		recordDir:            opts.RecordDir,
+		initialScanDelay:     opts.InitialScanDelay,
+		statistics:           newStatisticsReader(opts.StatisticsInterval, opts.ErrorsWindow, opts.ErrorsThreshold),
+		multicast:            newMulticastReader(opts.MulticastInterval, opts.MulticastGroups, opts.MulticastMaxEntries, opts.Logger),
+		logger:               opts.Logger,
 		state:                StoppedState,
+		limiter:              newTokenBucket(opts.RateLimit, opts.RateBurst),
+		neighbors:            newNeighborUpdates(opts.NeighborInterval),
+		initialized:          make(chan struct{}),
+		renameWindow:         opts.RenameWindow,
+		departed:             make(map[graph.Identifier]*time.Timer),
+	}
+	np.indexToChildrenQueue.OnEvict = np.onChildrenEvicted
+	np.indexToChildrenQueue.Formatter = func(v interface{}) interface{} {
+		return nodeIDs(v.([]*graph.Node))
 	}
 	return np
 }
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestInterfaceTypes(t *testing.T) {
+	cfg := config.GetConfig()
+	defer cfg.Set("agent.topology.interface_types", []string{})
+	defer cfg.Set("agent.topology.netns.interface_types", []string{})
+
+	if types := interfaceTypesSet(NetLinkOptionsFromConfig("netlink").InterfaceTypes); types != nil {
+		t.Errorf("All the types should be tracked by default: %v", types)
+	}
+
+	cfg.Set("agent.topology.interface_types", []string{"bridge", "veth"})
+	cfg.Set("agent.topology.netns.interface_types", []string{"veth"})
+
+	// the link info looked up in memory instead of the kernel, the kind of
+	// link 4 being only given by its info
+	links := replayedLinks{
+		1: {link: &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Index: 1}}, info: &linkInfo{Kind: "bridge"}},
+		2: {link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: 2}}, info: &linkInfo{Kind: "dummy"}},
+		3: {link: &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 3}}, info: &linkInfo{Kind: "veth"}},
+		4: {link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: 4}}, info: &linkInfo{Kind: "veth"}},
+	}
+	u := &NetLinkProbe{links: links, interfaceTypes: interfaceTypesSet(NetLinkOptionsFromConfig("netlink").InterfaceTypes)}
+	allowed := func(index int) bool {
+		link, _ := u.links.LinkByIndex(index)
+		info, _ := u.links.LinkInfo(index)
+		return u.linkTypeAllowed(link, info)
+	}
+
+	if !allowed(1) || allowed(2) || !allowed(4) {
+		t.Errorf("Wrong global interface types: %v", u.interfaceTypes)
+	}
+
+	u.interfaceTypes = interfaceTypesSet(NetNSOptionsFromConfig().NetLink.InterfaceTypes)
+	if allowed(1) || !allowed(3) || !allowed(4) {
+		t.Errorf("Probe interface types should take precedence: %v", u.interfaceTypes)
+	}
+
+	if u.linkTypeAllowed(&netlink.Device{}, nil) {
+		t.Errorf("Link type should be used without link info: %v", u.interfaceTypes)
+	}
+}
+
+func TestReconcileOnResume(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "reconcile", "Type": topology.HostType})
+	// deleted while paused
+	gone := g.NewNode(graph.GenID(), graph.Metadata{"Name": "gone", "Type": topology.DeviceType, "IfIndex": int64(99999)})
+	g.Link(root, gone, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	g.Unlock()
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{})
+	u.Pause()
+	if !u.IsPaused() {
+		t.Fatal("Probe should be paused")
+	}
+
+	u.Resume()
+	if u.IsPaused() || u.resync != 1 {
+		t.Fatal("Probe should be resumed with a reconciliation pending")
+	}
+	u.reconcile()
+
+	g.RLock()
+	defer g.RUnlock()
+
+	if g.GetNode(gone.ID) != nil {
+		t.Error("Interface gone while paused should be deleted")
+	}
+	if g.LookupFirstChild(root, graph.Metadata{"Name": "lo"}) == nil {
+		t.Errorf("Current interfaces should be added, got: %v", g)
+	}
+}
+
+func TestSweepPendingVeths(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "sweep", "Type": topology.HostType})
+	u := NewNetLinkProbe(g, root, NetLinkOptions{VethResolverRetries: 2})
+
+	newVeth := func(name string, index int64, peerIndex int64) *graph.Node {
+		veth := g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": topology.VethType, "IfIndex": index})
+		u.pendingVeths[veth.ID] = &pendingVeth{intf: veth, peerIndex: peerIndex}
+		return veth
+	}
+
+	late := newVeth("late", 10, 11)
+	lost := newVeth("lost", 20, 21)
+	gone := newVeth("gone", 30, 31)
+	g.DelNode(gone)
+	g.Unlock()
+
+	// the sweep locks the graph
+	u.sweepPendingVeths()
+
+	if len(u.pendingVeths) != 2 || u.pendingVeths[gone.ID] != nil {
+		t.Fatalf("Deleted veth should be forgotten, the others kept: %v", u.pendingVeths)
+	}
+	if atomic.LoadInt64(&u.pendingVethsCount) != 2 {
+		t.Errorf("Wrong pending veths count: %d", u.pendingVethsCount)
+	}
+
+	// the peer showing up within the retries
+	g.Lock()
+	peer := g.NewNode(graph.GenID(), graph.Metadata{"Name": "peer", "Type": topology.VethType, "IfIndex": int64(11)})
+	g.Unlock()
+
+	u.sweepPendingVeths()
+
+	g.RLock()
+	defer g.RUnlock()
+
+	if !g.AreLinked(peer, late) || u.pendingVeths[late.ID] != nil {
+		t.Errorf("Veth should be linked to its late peer: %v", g)
+	}
+	if len(u.pendingVeths) != 0 || atomic.LoadInt64(&u.pendingVethsCount) != 0 {
+		t.Errorf("Veth without peer should be given up after the retries: %v", u.pendingVeths)
+	}
+	if g.GetNode(lost.ID) == nil {
+		t.Error("Veth given up should be kept")
+	}
+}
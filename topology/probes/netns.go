@@ -23,20 +23,24 @@
 package probes
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/vishvananda/netns"
 	"golang.org/x/exp/inotify"
 
-	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
@@ -48,6 +52,16 @@ type NetNSProbe struct {
 	nsnlProbes  map[string]*NetNsNetLinkTopoUpdater
 	pathToNetNS map[string]*NetNs
 	runPath     string
+	nlOptions   NetLinkOptions
+	logger      Logger
+	paused      int32
+	resync      chan struct{}
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	// the namespaces being scanned, at most the number of workers
+	workers chan struct{}
+	// the namespace of the probe, kept for the life of the probe
+	rootNs netns.NsHandle
 }
 
 type NetNs struct {
@@ -58,10 +72,18 @@ type NetNs struct {
 
 type NetNsNetLinkTopoUpdater struct {
 	sync.RWMutex
-	Graph    *graph.Graph
-	Root     *graph.Node
-	nlProbe  *NetLinkProbe
-	useCount int
+	Graph     *graph.Graph
+	Root      *graph.Node
+	nlProbe   *NetLinkProbe
+	nlOptions NetLinkOptions
+	useCount  int
+	paused    bool
+	stopped   bool
+	quit      chan struct{}
+	// the namespace opened when registered, closed once the updater ends
+	handle  netns.NsHandle
+	rootNs  netns.NsHandle
+	workers chan struct{}
 }
 
 func getNetNSName(path string) string {
@@ -73,112 +95,231 @@ func (ns *NetNs) String() string {
 	return fmt.Sprintf("%d,%d", ns.dev, ns.ino)
 }
 
+// acquireWorker waits for a worker to scan the namespace, false if the
+// updater was stopped meanwhile, ie. the namespace is gone
+func (nu *NetNsNetLinkTopoUpdater) acquireWorker() bool {
+	if nu.workers == nil {
+		return true
+	}
+
+	select {
+	case nu.workers <- struct{}{}:
+		return true
+	case <-nu.quit:
+		return false
+	}
+}
+
+func (nu *NetNsNetLinkTopoUpdater) releaseWorker() {
+	if nu.workers != nil {
+		<-nu.workers
+	}
+}
+
 func (nu *NetNsNetLinkTopoUpdater) Start(ns *NetNs) {
-	logging.GetLogger().Debugf("Starting NetLinkTopoUpdater for NetNS: %s", ns.path)
+	nu.nlOptions.Logger.Debugf("Starting NetLinkTopoUpdater for NetNS: %s", ns.path)
 
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	defer func() {
+		if nu.handle.IsOpen() {
+			nu.handle.Close()
+		}
+	}()
 
-	origns, err := netns.Get()
-	if err != nil {
-		logging.GetLogger().Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
+	// the namespace is given some time to be set up, ie. by the container
+	// runtime
+	select {
+	case <-nu.quit:
+		nu.nlOptions.Logger.Debugf("NetNS %s gone before being scanned", ns.path)
 		return
+	case <-time.After(1 * time.Second):
 	}
-	defer origns.Close()
 
-	time.Sleep(1 * time.Second)
-
-	newns, err := netns.GetFromPath(ns.path)
-	if err != nil {
-		logging.GetLogger().Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
+	if !nu.acquireWorker() {
+		nu.nlOptions.Logger.Debugf("NetNS %s gone before being scanned", ns.path)
 		return
 	}
-	defer newns.Close()
 
-	err = netns.Set(newns)
-	if err != nil {
-		logging.GetLogger().Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(nu.releaseWorker) }
+	defer release()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	rootNs := nu.rootNs
+	if !rootNs.IsOpen() {
+		var err error
+		if rootNs, err = netns.Get(); err != nil {
+			nu.nlOptions.Logger.Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
+			return
+		}
+		defer rootNs.Close()
+	}
+
+	if !nu.handle.IsOpen() {
+		var err error
+		if nu.handle, err = netns.GetFromPath(ns.path); err != nil {
+			nu.nlOptions.Logger.Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
+			return
+		}
+	}
+
+	/* NOTE: the graph lock must never be held while switching namespaces,
+	 * the probe only takes it once the netlink data have been read
+	 */
+	if err := netns.Set(nu.handle); err != nil {
+		nu.nlOptions.Logger.Errorf("Error while switching from root ns to %s: %s", ns.path, err.Error())
 		return
 	}
+	defer netns.Set(rootNs)
 
 	/* start a netlinks updater inside this namespace */
 	nu.Lock()
-	nu.nlProbe = NewNetLinkProbe(nu.Graph, nu.Root)
+	if nu.stopped {
+		nu.Unlock()
+		return
+	}
+	nu.nlProbe = NewNetLinkProbe(nu.Graph, nu.Root, nu.nlOptions)
+	if nu.paused {
+		nu.nlProbe.Pause()
+	}
+	probe := nu.nlProbe
 	nu.Unlock()
 
+	// the worker scans another namespace once the initial scan is done
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-probe.Initialized():
+		case <-done:
+		}
+		release()
+	}()
+
 	/* NOTE(safchain) don't Start just Run, need to keep it alive for the time life of the netns
 	 * and there is no need to have a new goroutine here
 	 */
-	nu.nlProbe.Run()
+	probe.Run()
+	close(done)
 
 	nu.Lock()
 	nu.nlProbe = nil
 	nu.Unlock()
 
-	logging.GetLogger().Debugf("NetLinkTopoUpdater stopped for NetNS: %s", ns.path)
-
-	netns.Set(origns)
+	nu.nlOptions.Logger.Debugf("NetLinkTopoUpdater stopped for NetNS: %s", ns.path)
 }
 
 func (nu *NetNsNetLinkTopoUpdater) Stop() {
 	nu.Lock()
+	if !nu.stopped {
+		close(nu.quit)
+	}
+	nu.stopped = true
 	if nu.nlProbe != nil {
 		nu.nlProbe.Stop()
 	}
 	nu.Unlock()
 }
 
-func NewNetNsNetLinkTopoUpdater(g *graph.Graph, n *graph.Node) *NetNsNetLinkTopoUpdater {
+func (nu *NetNsNetLinkTopoUpdater) Pause() {
+	nu.Lock()
+	nu.paused = true
+	if nu.nlProbe != nil {
+		nu.nlProbe.Pause()
+	}
+	nu.Unlock()
+}
+
+func (nu *NetNsNetLinkTopoUpdater) Resume() {
+	nu.Lock()
+	nu.paused = false
+	if nu.nlProbe != nil {
+		nu.nlProbe.Resume()
+	}
+	nu.Unlock()
+}
+
+func NewNetNsNetLinkTopoUpdater(g *graph.Graph, n *graph.Node, opts NetLinkOptions) *NetNsNetLinkTopoUpdater {
 	return &NetNsNetLinkTopoUpdater{
-		Graph:    g,
-		Root:     n,
-		useCount: 1,
+		Graph:     g,
+		Root:      n,
+		nlOptions: opts.withDefaults(),
+		useCount:  1,
+		quit:      make(chan struct{}),
+		handle:    netns.None(),
+		rootNs:    netns.None(),
 	}
 }
 
+// Register adds a namespace and starts its netlink probe, the namespace
+// being opened once, its handle being given to the probe.
 func (u *NetNSProbe) Register(path string, extraMetadata graph.Metadata) *graph.Node {
+	u.Lock()
+	defer u.Unlock()
+
+	handle := netns.None()
+	defer func() {
+		if handle.IsOpen() {
+			handle.Close()
+		}
+	}()
+
+	open := func() bool {
+		var err error
+		if handle, err = netns.GetFromPath(path); err != nil {
+			u.logger.Errorf("Error registering namespace %s: %s", path, err.Error())
+			return false
+		}
+		return true
+	}
+
 	ns, ok := u.pathToNetNS[path]
 	if !ok {
-		var s syscall.Stat_t
-		fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
-		if err != nil {
-			logging.GetLogger().Errorf("Error registering namespace %s: %s", path, err.Error())
+		if !open() {
 			return nil
 		}
-		defer syscall.Close(fd)
-		if err := syscall.Fstat(fd, &s); err != nil {
-			logging.GetLogger().Errorf("Error reading namespace %s: %s", path, err.Error())
+
+		var s syscall.Stat_t
+		if err := syscall.Fstat(int(handle), &s); err != nil {
+			u.logger.Errorf("Error reading namespace %s: %s", path, err.Error())
 			return nil
 		}
 		ns = &NetNs{path: path, dev: s.Dev, ino: s.Ino}
 		u.pathToNetNS[path] = ns
 	}
 
-	u.Lock()
-	defer u.Unlock()
-
 	nsString := ns.String()
 	probe, ok := u.nsnlProbes[nsString]
 	if ok {
 		probe.useCount++
-		logging.GetLogger().Debugf("Increasing counter for namespace %s to %d", nsString, probe.useCount)
+		u.logger.Debugf("Increasing counter for namespace %s to %d", nsString, probe.useCount)
 		return probe.Root
 	}
 
+	if !handle.IsOpen() && !open() {
+		return nil
+	}
+
 	u.Graph.Lock()
 	defer u.Graph.Unlock()
 
-	logging.GetLogger().Debugf("Network Namespace added: %s", nsString)
-	metadata := graph.Metadata{"Name": getNetNSName(path), "Type": "netns"}
+	u.logger.Debugf("Network Namespace added: %s", nsString)
+	metadata := graph.Metadata{"Name": getNetNSName(path), "Type": topology.NetNSType, "Path": path}
 	if extraMetadata != nil {
 		for k, v := range extraMetadata {
 			metadata[k] = v
 		}
 	}
-	n := u.Graph.NewNode(graph.GenID(), metadata)
-	u.Graph.Link(u.Root, n, graph.Metadata{"RelationType": "ownership"})
+	n := u.Graph.NewNode(u.Graph.NewIDFrom(string(u.Root.ID), path), metadata)
+	if n == nil {
+		return nil
+	}
+	u.Graph.Link(u.Root, n, graph.Metadata{"RelationType": topology.OwnershipRelation})
 
-	nu := NewNetNsNetLinkTopoUpdater(u.Graph, n)
+	nu := NewNetNsNetLinkTopoUpdater(u.Graph, n, u.nlOptions)
+	nu.paused = u.IsPaused()
+	nu.handle, nu.rootNs, nu.workers = handle, u.rootNs, u.workers
+	handle = netns.None()
 	go nu.Start(ns)
 
 	u.nsnlProbes[nsString] = nu
@@ -187,32 +328,32 @@ func (u *NetNSProbe) Register(path string, extraMetadata graph.Metadata) *graph.
 }
 
 func (u *NetNSProbe) Unregister(path string) {
-	logging.GetLogger().Debugf("Unregister Network Namespace: %s", path)
+	u.logger.Debugf("Unregister Network Namespace: %s", path)
+
+	u.Lock()
+	defer u.Unlock()
 
 	ns, ok := u.pathToNetNS[path]
 	if !ok {
 		return
 	}
 
-	u.Lock()
-	defer u.Unlock()
-
 	delete(u.pathToNetNS, path)
 	nsString := ns.String()
 	nu, ok := u.nsnlProbes[nsString]
 	if !ok {
-		logging.GetLogger().Debugf("No existing Network Namespace found: %s (%s)", nsString)
+		u.logger.Debugf("No existing Network Namespace found: %s (%s)", nsString)
 		return
 	}
 
 	if nu.useCount > 1 {
 		nu.useCount--
-		logging.GetLogger().Debugf("Decremented counter for namespace %s to %d", nsString, nu.useCount)
+		u.logger.Debugf("Decremented counter for namespace %s to %d", nsString, nu.useCount)
 		return
 	}
 
 	nu.Stop()
-	logging.GetLogger().Debugf("Network Namespace deleted: %s", nsString)
+	u.logger.Debugf("Network Namespace deleted: %s", nsString)
 
 	u.Graph.Lock()
 	defer u.Graph.Unlock()
@@ -233,7 +374,40 @@ func (u *NetNSProbe) initialize() {
 	}
 }
 
+// reconcile catches up with the namespaces of the run path created or
+// deleted while paused.
+func (u *NetNSProbe) reconcile() {
+	present := make(map[string]bool)
+
+	u.RLock()
+	known := make(map[string]bool)
+	for path := range u.pathToNetNS {
+		known[path] = true
+	}
+	u.RUnlock()
+
+	files, _ := ioutil.ReadDir(u.runPath)
+	for _, f := range files {
+		path := u.runPath + "/" + f.Name()
+		present[path] = true
+
+		if !known[path] {
+			u.Register(path, nil)
+		}
+	}
+
+	// only the namespaces of the run path, not the ones of the containers
+	for path := range known {
+		if strings.HasPrefix(path, u.runPath+"/") && !present[path] {
+			u.Unregister(path)
+		}
+	}
+}
+
 func (u *NetNSProbe) start() {
+	defer u.wg.Done()
+	defer common.RecoverAndPanic()
+
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
@@ -243,43 +417,148 @@ func (u *NetNSProbe) start() {
 		if err == nil {
 			break
 		}
-		time.Sleep(5 * time.Second)
+
+		select {
+		case <-u.quit:
+			return
+		case <-time.After(5 * time.Second):
+		}
 	}
 
 	watcher, err := inotify.NewWatcher()
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to create a new Watcher: %s", err.Error())
+		u.logger.Errorf("Unable to create a new Watcher: %s", err.Error())
+		return
 	}
+	defer watcher.Close()
 
 	err = watcher.Watch(u.runPath)
 	if err != nil {
-		logging.GetLogger().Errorf("Unable to Watch %s: %s", u.runPath, err.Error())
+		u.logger.Errorf("Unable to Watch %s: %s", u.runPath, err.Error())
 		return
 	}
 
 	u.initialize()
 
+	heartbeat := common.NewHeartbeat("netns")
+	common.RegisterHeartbeat(heartbeat)
+	defer common.UnregisterHeartbeat(heartbeat)
+
 	for {
+		heartbeat.Idle()
+
 		select {
+		case <-u.quit:
+			return
+
+		case <-u.resync:
+			heartbeat.Beat()
+			u.reconcile()
+			heartbeat.Updated()
+
 		case ev := <-watcher.Event:
+			heartbeat.Beat()
+
+			// dropped, the namespaces being reconciled on resume
+			if u.IsPaused() {
+				continue
+			}
 			if ev.Mask&inotify.IN_CREATE > 0 {
 				u.Register(ev.Name, nil)
 			}
 			if ev.Mask&inotify.IN_DELETE > 0 {
 				u.Unregister(ev.Name)
 			}
+			heartbeat.Updated()
 
 		case err := <-watcher.Error:
-			logging.GetLogger().Errorf("Error while watching network namespace: %s", err.Error())
+			u.logger.Errorf("Error while watching network namespace: %s", err.Error())
 		}
 	}
 }
 
 func (u *NetNSProbe) Start() {
+	u.wg.Add(1)
 	go u.start()
 }
 
+// Pause stops the updates of the graph by the probe and the netlink probes
+// of the namespaces, the nodes being kept.
+func (u *NetNSProbe) Pause() {
+	atomic.StoreInt32(&u.paused, 1)
+
+	u.RLock()
+	defer u.RUnlock()
+
+	for _, probe := range u.nsnlProbes {
+		probe.Pause()
+	}
+}
+
+// Resume restarts the updates of the graph after a reconciliation
+func (u *NetNSProbe) Resume() {
+	if !atomic.CompareAndSwapInt32(&u.paused, 1, 0) {
+		return
+	}
+
+	select {
+	case u.resync <- struct{}{}:
+	default:
+	}
+
+	u.RLock()
+	defer u.RUnlock()
+
+	for _, probe := range u.nsnlProbes {
+		probe.Resume()
+	}
+}
+
+func (u *NetNSProbe) IsPaused() bool {
+	return atomic.LoadInt32(&u.paused) == 1
+}
+
+// Check opens the current namespace and reads the namespace directory if it
+// exists already, the probe waiting for its creation otherwise.
+func (u *NetNSProbe) Check() []probe.CheckResult {
+	ns, err := netns.Get()
+	if err == nil {
+		ns.Close()
+	} else {
+		err = fmt.Errorf("unable to get the current namespace: %s", err.Error())
+	}
+
+	results := []probe.CheckResult{
+		probe.NewCheckResult("network namespace", err, "run the agent as root, in the PID namespace of the host"),
+	}
+
+	if _, err = os.Stat(u.runPath); err == nil {
+		if _, err = ioutil.ReadDir(u.runPath); err != nil {
+			err = fmt.Errorf("unable to read %s: %s", u.runPath, err.Error())
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	results = append(results, probe.NewCheckResult(u.runPath+" readability", err,
+		fmt.Sprintf("run the agent as root, bind mounting %s of the host if it runs in a container", u.runPath)))
+
+	return results
+}
+
+// Stop stops watching the namespaces then the netlink probes of the
+// namespaces, their sockets being closed once stopped.
 func (u *NetNSProbe) Stop() {
+	u.Lock()
+	select {
+	case <-u.quit:
+	default:
+		close(u.quit)
+	}
+	u.Unlock()
+
+	// the watcher may be registering a namespace
+	u.wg.Wait()
+
 	u.Lock()
 	defer u.Unlock()
 
@@ -288,14 +567,17 @@ func (u *NetNSProbe) Stop() {
 	}
 }
 
-func NewNetNSProbe(g *graph.Graph, n *graph.Node, runPath ...string) *NetNSProbe {
+// NewNetNSProbe returns a probe starting a netlink probe in each namespace
+// of the run path, the namespaces being children of the given root node.
+func NewNetNSProbe(g *graph.Graph, n *graph.Node, opts NetNSOptions) (*NetNSProbe, error) {
 	if uid := os.Geteuid(); uid != 0 {
-		logging.GetLogger().Fatalf("NetNS probe has to be run as root")
+		return nil, errors.New("NetNS probe has to be run as root")
 	}
+	opts = opts.withDefaults()
 
-	path := "/var/run/netns"
-	if len(runPath) > 0 && runPath[0] != "" {
-		path = runPath[0]
+	rootNs, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the current namespace: %s", err.Error())
 	}
 
 	return &NetNSProbe{
@@ -303,11 +585,20 @@ func NewNetNSProbe(g *graph.Graph, n *graph.Node, runPath ...string) *NetNSProbe
 		Root:        n,
 		nsnlProbes:  make(map[string]*NetNsNetLinkTopoUpdater),
 		pathToNetNS: make(map[string]*NetNs),
-		runPath:     path,
-	}
+		runPath:     opts.RunPath,
+		nlOptions:   opts.NetLink,
+		logger:      opts.Logger,
+		resync:      make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		workers:     make(chan struct{}, opts.Workers),
+		rootNs:      rootNs,
+	}, nil
 }
 
 func NewNetNSProbeFromConfig(g *graph.Graph, n *graph.Node) *NetNSProbe {
-	path := config.GetConfig().GetString("netns.run_path")
-	return NewNetNSProbe(g, n, path)
+	probe, err := NewNetNSProbe(g, n, NetNSOptionsFromConfig())
+	if err != nil {
+		logging.GetLogger().Fatal(err.Error())
+	}
+	return probe
 }
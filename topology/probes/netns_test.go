@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestNetNSQueuedGone(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Name": "ns1", "Type": "netns"})
+	g.Unlock()
+
+	// all the workers busy, the namespace is queued
+	workers := make(chan struct{}, 1)
+	workers <- struct{}{}
+
+	nu := NewNetNsNetLinkTopoUpdater(g, n, NetLinkOptions{})
+	nu.workers = workers
+
+	done := make(chan struct{})
+	go func() {
+		nu.Start(&NetNs{path: "/var/run/netns/gone"})
+		close(done)
+	}()
+
+	nu.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The updater of a namespace gone should end")
+	}
+
+	if len(workers) != 1 {
+		t.Error("The worker of the queued namespace shouldn't be released")
+	}
+	if nu.nlProbe != nil {
+		t.Error("No netlink probe should be started")
+	}
+}
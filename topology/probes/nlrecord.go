@@ -0,0 +1,304 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// linkSource gives the current state of the links, the one of the kernel
+// or, when replaying, the one built from the recorded messages.
+type linkSource interface {
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkInfo(index int) (*linkInfo, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	NeighList(index int, family int) ([]netlink.Neigh, error)
+}
+
+type kernelLinks struct{}
+
+func (kernelLinks) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (kernelLinks) LinkInfo(index int) (*linkInfo, error) {
+	return getLinkInfo(index)
+}
+
+func (kernelLinks) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (kernelLinks) NeighList(index int, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(index, family)
+}
+
+// netlinkRecord is a recorded netlink message, recordings holding one JSON
+// object per line. Data is the raw message without the netlink header, Time
+// the reception time in nanoseconds, missing in the former recordings, and
+// Index the interface index of the link messages.
+type netlinkRecord struct {
+	Type  uint16
+	Time  int64 `json:",omitempty"`
+	Index int32 `json:",omitempty"`
+	Data  []byte
+}
+
+type netlinkRecorder struct {
+	file    *os.File
+	encoder *json.Encoder
+	now     func() time.Time
+}
+
+func newNetlinkRecorder(w io.Writer) *netlinkRecorder {
+	return &netlinkRecorder{encoder: json.NewEncoder(w), now: time.Now}
+}
+
+// openNetlinkRecorder appends the messages to a file of the directory named
+// after the root node, a probe being started for each namespace.
+func openNetlinkRecorder(dir string, root string) (*netlinkRecorder, error) {
+	path := filepath.Join(dir, "netlink-"+root+".jsonl")
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newNetlinkRecorder(file)
+	r.file = file
+
+	return r, nil
+}
+
+// record saves a message processed by the probe with its reception time
+func (r *netlinkRecorder) record(msgType uint16, data []byte) error {
+	record := &netlinkRecord{Type: msgType, Time: r.now().UnixNano(), Data: data}
+	if msgType == syscall.RTM_NEWLINK || msgType == syscall.RTM_DELLINK {
+		record.Index = nl.DeserializeIfInfomsg(data).Index
+	}
+
+	return r.encoder.Encode(record)
+}
+
+func (r *netlinkRecorder) close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// dumpLinks returns the raw messages of all the links, recorded as link
+// additions so that a replay starts from the initial state.
+func dumpLinks() ([][]byte, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+
+	return req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+}
+
+// replayedLink is the state of a link as described by its last message
+type replayedLink struct {
+	link netlink.Link
+	info *linkInfo
+}
+
+// replayedLinks is the link state built from a recording, replacing the
+// kernel one while replaying.
+type replayedLinks map[int]*replayedLink
+
+func (r replayedLinks) LinkByIndex(index int) (netlink.Link, error) {
+	if l, ok := r[index]; ok {
+		return l.link, nil
+	}
+	return nil, fmt.Errorf("Link %d not found", index)
+}
+
+func (r replayedLinks) LinkInfo(index int) (*linkInfo, error) {
+	if l, ok := r[index]; ok {
+		return l.info, nil
+	}
+	return nil, errors.New("Link not found")
+}
+
+// AddrList returns no address, the addresses not being recorded, rather
+// than the ones of the kernel link having the same index
+func (r replayedLinks) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return nil, nil
+}
+
+// NeighList returns no neighbor, the neighbors being the ones of the
+// recorded neighbor messages
+func (r replayedLinks) NeighList(index int, family int) ([]netlink.Neigh, error) {
+	return nil, nil
+}
+
+// deserializeLink builds a link from the attributes of a link message,
+// those used by the probe.
+func deserializeLink(data []byte) (netlink.Link, *linkInfo, error) {
+	ifmsg := nl.DeserializeIfInfomsg(data)
+
+	info, err := parseLinkInfo(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attrs, err := nl.ParseRouteAttr(data[ifmsg.Len():])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := netlink.LinkAttrs{Index: int(ifmsg.Index)}
+	if ifmsg.Flags&syscall.IFF_UP != 0 {
+		base.Flags |= net.FlagUp
+	}
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFLA_IFNAME:
+			base.Name = attrString(attr.Value)
+		case syscall.IFLA_IFALIAS:
+			base.Alias = attrString(attr.Value)
+		case syscall.IFLA_ADDRESS:
+			base.HardwareAddr = net.HardwareAddr(attr.Value)
+		case syscall.IFLA_MTU:
+			if v, ok := attrUint32(attr.Value); ok {
+				base.MTU = int(v)
+			}
+		case syscall.IFLA_MASTER:
+			if v, ok := attrUint32(attr.Value); ok {
+				base.MasterIndex = int(v)
+			}
+		}
+	}
+
+	var link netlink.Link
+	switch info.Kind {
+	case "":
+		link = &netlink.Device{LinkAttrs: base}
+	case "dummy":
+		link = &netlink.Dummy{LinkAttrs: base}
+	case "bridge":
+		link = &netlink.Bridge{LinkAttrs: base}
+	case "veth":
+		link = &netlink.Veth{LinkAttrs: base}
+	case "vlan":
+		link = &netlink.Vlan{LinkAttrs: base}
+	case "bond":
+		link = &netlink.Bond{LinkAttrs: base}
+	default:
+		link = &netlink.GenericLink{LinkAttrs: base, LinkType: info.Kind}
+	}
+
+	return link, info, nil
+}
+
+// replayOptions tells how a recording is replayed, as fast as possible by
+// default or, when Timed, with the delays the messages were received with,
+// Sleep waiting for them, time.Sleep if not set.
+type replayOptions struct {
+	Timed bool
+	Sleep func(time.Duration)
+}
+
+// replay feeds the recorded link and neighbor messages to the probe, the
+// link state being the one of the recording instead of the kernel one. A
+// deletion message of the bridge family only removes the link from its
+// bridge. The route messages are skipped, the routes being read from the
+// kernel.
+func (u *NetLinkProbe) replay(r io.Reader, opts replayOptions) error {
+	links := make(replayedLinks)
+	u.links = links
+
+	sleep := opts.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	var last int64
+	scanner := bufio.NewScanner(r)
+	// the messages of the links with many attributes exceed the default
+	// line size once encoded
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record netlinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+
+		if opts.Timed && record.Time != 0 {
+			if last != 0 && record.Time > last {
+				sleep(time.Duration(record.Time - last))
+			}
+			last = record.Time
+		}
+
+		switch record.Type {
+		case syscall.RTM_NEWLINK:
+			link, info, err := deserializeLink(record.Data)
+			if err != nil {
+				return err
+			}
+			links[int(record.Index)] = &replayedLink{link: link, info: info}
+
+			u.onLinkAdded(int(record.Index), info)
+		case syscall.RTM_DELLINK:
+			if nl.DeserializeIfInfomsg(record.Data).Family != syscall.AF_BRIDGE {
+				delete(links, int(record.Index))
+			}
+
+			u.onLinkDeleted(int(record.Index))
+		case syscall.RTM_NEWNEIGH, syscall.RTM_DELNEIGH:
+			neigh, err := netlink.NeighDeserialize(record.Data)
+			if err != nil {
+				return err
+			}
+			u.onNeighUpdated(neigh, record.Type == syscall.RTM_DELNEIGH)
+			u.applyNeighbors()
+		}
+	}
+
+	return scanner.Err()
+}
+
+// replayFile replays a recording, ie. netlink-<root node id>.jsonl of the
+// record directory of an agent.
+func (u *NetLinkProbe) replayFile(path string, opts replayOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return u.replay(f, opts)
+}
@@ -0,0 +1,533 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/history"
+)
+
+// indexes not used by the host so that the probe doesn't find anything
+// when looking up the addresses or the neighbors
+const (
+	replayBridgeIndex = 100001
+	replayChildIndex  = 100002
+)
+
+func linkMessage(family int, index int32, name string, kind string, master uint32) []byte {
+	msg := nl.NewIfInfomsg(family)
+	msg.Index = index
+	msg.Flags = syscall.IFF_UP
+
+	b := msg.Serialize()
+	b = append(b, nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)).Serialize()...)
+	if master != 0 {
+		b = append(b, nl.NewRtAttr(syscall.IFLA_MASTER, nl.Uint32Attr(master)).Serialize()...)
+	}
+	if kind != "" {
+		linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+		nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.ZeroTerminated(kind))
+		b = append(b, linkInfo.Serialize()...)
+	}
+
+	return b
+}
+
+type replayMessage struct {
+	msgType uint16
+	data    []byte
+}
+
+// newReplayGraph returns a fresh graph with the root node of the replays
+func newReplayGraph(t *testing.T) (*graph.Graph, *graph.Node) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.SetStrictSchema(true)
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "replay", "Type": "host"})
+	g.Unlock()
+
+	return g, root
+}
+
+// replayMessages records the messages and replays them against a fresh graph
+func replayMessages(t *testing.T, msgs []replayMessage) (*graph.Graph, *graph.Node) {
+	var buf bytes.Buffer
+
+	recorder := newNetlinkRecorder(&buf)
+	for _, msg := range msgs {
+		if err := recorder.record(msg.msgType, msg.data); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	g, root := newReplayGraph(t)
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{})
+	if err := u.replay(&buf, replayOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return g, root
+}
+
+func TestReplayBridgeMembership(t *testing.T) {
+	g, _ := replayMessages(t, []replayMessage{
+		// the child shows up before its bridge
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayBridgeIndex)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayBridgeIndex, "replay-br", "bridge", 0)},
+	})
+
+	bridge := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayBridgeIndex)})
+	child := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if bridge == nil || child == nil || !g.AreLinked(bridge, child) {
+		t.Fatalf("Child should be linked to its bridge: %v", g)
+	}
+
+	g, _ = replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayBridgeIndex, "replay-br", "bridge", 0)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayBridgeIndex)},
+		// removal from the bridge, the interface still exists
+		{syscall.RTM_DELLINK, linkMessage(syscall.AF_BRIDGE, replayChildIndex, "replay-eth", "", replayBridgeIndex)},
+	})
+
+	bridge = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayBridgeIndex)})
+	child = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if child == nil {
+		t.Fatal("Interface removed from a bridge should be kept")
+	}
+	if bridge == nil || g.AreLinked(bridge, child) {
+		t.Errorf("Interface should be unlinked from its bridge: %v", g)
+	}
+}
+
+func TestReplayIfIndexReuse(t *testing.T) {
+	g, root := replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-old", "dummy", 0)},
+		{syscall.RTM_DELLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-old", "dummy", 0)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-new", "dummy", 0)},
+	})
+
+	intfs := g.LookupNodes(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if len(intfs) != 1 || intfs[0].Metadata()["Name"] != "replay-new" {
+		t.Fatalf("Only the new interface expected: %v", intfs)
+	}
+
+	if !g.AreLinked(root, intfs[0]) {
+		t.Errorf("New interface should be owned by the root node: %v", g)
+	}
+}
+
+func TestReplayAlias(t *testing.T) {
+	aliased := append(linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", 0),
+		nl.NewRtAttr(syscall.IFLA_IFALIAS, nl.ZeroTerminated("uplink to core")).Serialize()...)
+
+	g, _ := replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, aliased},
+	})
+
+	intf := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if intf == nil || intf.Metadata()["Alias"] != "uplink to core" {
+		t.Fatalf("Alias expected: %v", intf)
+	}
+
+	g, _ = replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, aliased},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", 0)},
+	})
+
+	intf = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if _, ok := intf.Metadata()["Alias"]; ok {
+		t.Errorf("Alias should have been removed: %v", intf.Metadata())
+	}
+}
+
+func TestReplayOvsDatapath(t *testing.T) {
+	const replayPortIndex = 100003
+
+	// a bridge named as the datapath is a bridge as any other
+	g, _ := replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayBridgeIndex, "ovs-system", "bridge", 0)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayBridgeIndex)},
+	})
+
+	bridge := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayBridgeIndex)})
+	child := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if bridge == nil || topology.IsOvsDatapath(bridge) {
+		t.Fatalf("Bridge named ovs-system shouldn't be flagged as the datapath: %v", bridge)
+	}
+	if child == nil || !g.AreLinked(bridge, child) {
+		t.Errorf("Child should be linked to the bridge named ovs-system: %v", g)
+	}
+
+	// the datapath is identified by its kind whatever its name, its ports
+	// showing up before or after it
+	g, root := replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayBridgeIndex)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayBridgeIndex, "replay-dp", "openvswitch", 0)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayPortIndex, "replay-br", "openvswitch", replayBridgeIndex)},
+	})
+
+	datapath := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayBridgeIndex)})
+	if datapath == nil || !topology.IsOvsDatapath(datapath) || !g.AreLinked(root, datapath) {
+		t.Fatalf("Datapath should be kept and flagged: %v", g)
+	}
+
+	for _, index := range []int64{replayChildIndex, replayPortIndex} {
+		port := g.LookupFirstNode(graph.Metadata{"IfIndex": index})
+		if port == nil || topology.IsOvsDatapath(port) {
+			t.Fatalf("Port %d shouldn't be flagged as the datapath: %v", index, port)
+		}
+		if g.AreLinked(datapath, port) {
+			t.Errorf("Port %d shouldn't be linked to the datapath: %v", index, g)
+		}
+	}
+}
+
+// vrfMessage returns the message of a VRF device of the given table
+func vrfMessage(index int32, name string, table uint32) []byte {
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = index
+	msg.Flags = syscall.IFF_UP
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.ZeroTerminated("vrf"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, IFLA_VRF_TABLE, nl.Uint32Attr(table))
+
+	b := msg.Serialize()
+	b = append(b, nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)).Serialize()...)
+	return append(b, linkInfo.Serialize()...)
+}
+
+func TestReplayVrfMembership(t *testing.T) {
+	const (
+		replayVrfIndex   = 100004
+		replayOtherIndex = 100005
+	)
+
+	// the slave shows up before its VRF
+	g, _ := replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayVrfIndex)},
+		{syscall.RTM_NEWLINK, vrfMessage(replayVrfIndex, "replay-vrf", 10)},
+	})
+
+	vrf := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayVrfIndex)})
+	child := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if vrf == nil || vrf.Metadata()["Type"] != topology.VrfType || vrf.Metadata()["VRFTable"] != int64(10) {
+		t.Fatalf("VRF with its table expected: %v", vrf)
+	}
+
+	edges := g.LookupEdges(graph.Metadata{"RelationType": topology.Layer2Relation, "Type": topology.VrfType})
+	if child == nil || len(edges) != 1 {
+		t.Fatalf("Slave should be linked to its VRF: %v", g)
+	}
+	if parent, slave := g.GetEdgeNodes(edges[0]); parent.ID != vrf.ID || slave.ID != child.ID {
+		t.Errorf("Wrong VRF edge between %v and %v", parent, slave)
+	}
+
+	// moved to another VRF then released, the slave staying up
+	g, _ = replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, vrfMessage(replayVrfIndex, "replay-vrf", 10)},
+		{syscall.RTM_NEWLINK, vrfMessage(replayOtherIndex, "replay-vrf2", 20)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayVrfIndex)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayOtherIndex)},
+	})
+
+	vrf = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayVrfIndex)})
+	other := g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayOtherIndex)})
+	child = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if g.AreLinked(vrf, child) || !g.AreLinked(other, child) {
+		t.Errorf("Slave should only be linked to its new VRF: %v", g)
+	}
+
+	g, _ = replayMessages(t, []replayMessage{
+		{syscall.RTM_NEWLINK, vrfMessage(replayVrfIndex, "replay-vrf", 10)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", replayVrfIndex)},
+		{syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", 0)},
+	})
+
+	vrf = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayVrfIndex)})
+	child = g.LookupFirstNode(graph.Metadata{"IfIndex": int64(replayChildIndex)})
+	if child == nil || g.AreLinked(vrf, child) {
+		t.Errorf("Slave released should be unlinked from its VRF: %v", g)
+	}
+}
+
+func TestRecordAllMessages(t *testing.T) {
+	var buf bytes.Buffer
+
+	now := time.Unix(1475000000, 0)
+	recorder := newNetlinkRecorder(&buf)
+	recorder.now = func() time.Time { return now }
+
+	recorder.record(syscall.RTM_NEWROUTE, []byte{})
+	now = now.Add(time.Second)
+	recorder.record(syscall.RTM_NEWLINK, linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "dummy", 0))
+
+	var records []netlinkRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record netlinkRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err.Error())
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 || records[0].Type != syscall.RTM_NEWROUTE || records[0].Index != 0 {
+		t.Fatalf("All the messages should be recorded: %+v", records)
+	}
+	if records[1].Index != replayChildIndex || records[1].Time-records[0].Time != int64(time.Second) {
+		t.Errorf("Wrong link record: %+v", records[1])
+	}
+}
+
+// replayFixture replays a recording of testdata/netlink against a fresh
+// graph, a recording of an agent, see record_dir, being committed there to
+// turn a netlink issue into a regression test.
+func replayFixture(t *testing.T, name string, opts replayOptions) (*graph.Graph, *graph.Node) {
+	g, root := newReplayGraph(t)
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{})
+	if err := u.replayFile(filepath.Join("testdata", "netlink", name+".jsonl"), opts); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return g, root
+}
+
+// fixtureInterface returns the interface of the given name, failing if there
+// isn't exactly one
+func fixtureInterface(t *testing.T, g *graph.Graph, name string) *graph.Node {
+	intfs := g.LookupNodes(graph.Metadata{"Name": name})
+	if len(intfs) != 1 {
+		t.Fatalf("Expected one %s interface, got %v", name, intfs)
+	}
+	return intfs[0]
+}
+
+func TestReplayBridgeCreation(t *testing.T) {
+	g, root := replayFixture(t, "bridge-creation", replayOptions{})
+
+	bridge := fixtureInterface(t, g, "replay-br0")
+	for _, name := range []string{"replay-tap0", "replay-tap1"} {
+		tap := fixtureInterface(t, g, name)
+		if !g.AreLinked(bridge, tap) || !g.AreLinked(root, tap) {
+			t.Errorf("%s should be owned by the host and linked to its bridge: %v", name, g)
+		}
+	}
+
+	if neighbors, _ := bridge.Metadata()["Neighbors"].(map[string]interface{}); len(neighbors) != 1 {
+		t.Errorf("Expected the neighbor of the bridge: %v", bridge.Metadata())
+	}
+}
+
+func TestReplayVethChurn(t *testing.T) {
+	g, root := replayFixture(t, "veth-churn", replayOptions{})
+
+	for name, index := range map[string]int64{"replay-veth0": 9, "replay-veth1": 8} {
+		veth := fixtureInterface(t, g, name)
+		if veth.Metadata()["IfIndex"] != index || !g.AreLinked(root, veth) {
+			t.Errorf("Wrong %s interface: %v", name, veth.Metadata())
+		}
+		if _, ok := veth.Metadata()["Neighbors"]; ok {
+			t.Errorf("Neighbors of the deleted veths shouldn't be kept: %v", veth.Metadata())
+		}
+	}
+
+	// the loopback, recorded with the initial links, and the last pair
+	if len(g.LookupChildren(root, graph.Metadata{})) != 3 {
+		t.Errorf("Only the last veth pair expected: %v", g)
+	}
+}
+
+func TestReplayNetNSMove(t *testing.T) {
+	g, _ := replayFixture(t, "netns-move", replayOptions{})
+
+	bridge := fixtureInterface(t, g, "replay-br0")
+	veth := fixtureInterface(t, g, "replay-veth0")
+
+	if veth.Metadata()["IfIndex"] != int64(4) || g.AreLinked(bridge, veth) {
+		t.Errorf("Veth back in the namespace shouldn't be in its former bridge: %v", g)
+	}
+	if _, ok := veth.Metadata()["Neighbors"]; ok {
+		t.Errorf("Neighbors of the former interface shouldn't be kept: %v", veth.Metadata())
+	}
+}
+
+func TestReplayTimed(t *testing.T) {
+	var slept time.Duration
+	sleep := func(d time.Duration) { slept += d }
+
+	replayFixture(t, "bridge-creation", replayOptions{Sleep: sleep})
+	if slept != 0 {
+		t.Errorf("Replay shouldn't wait by default: %s", slept)
+	}
+
+	replayFixture(t, "bridge-creation", replayOptions{Timed: true, Sleep: sleep})
+	if slept != 1781960819*time.Nanosecond {
+		t.Errorf("Replay should wait the delays of the recording: %s", slept)
+	}
+}
+
+func TestReplayPredictableRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-netlink-history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := history.NewFileStorage(dir, history.FileStorageOptions{Sync: history.SyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, root := newReplayGraph(t)
+	recorder := history.NewRecorder(g, s)
+	recorder.Start()
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{RenameWindow: time.Minute})
+	if err := u.replayFile(filepath.Join("testdata", "netlink", "predictable-rename.jsonl"), replayOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	start := time.Now()
+	recorder.Stop()
+
+	for _, nic := range []struct {
+		name     string
+		previous string
+		mac      string
+	}{
+		{"enp97s0", "eth97", "52:54:00:9a:00:01"},
+		{"enp98s0", "eth98", "52:54:00:9a:00:02"},
+	} {
+		intf := fixtureInterface(t, g, nic.name)
+		m := intf.Metadata()
+		if m["PermanentMAC"] != nic.mac || m["NamingPolicy"] != PredictableNaming || !g.AreLinked(root, intf) {
+			t.Errorf("Wrong %s interface: %v", nic.name, m)
+		}
+		if previous, _ := m["PreviousNames"].([]interface{}); len(previous) != 1 || previous[0] != nic.previous {
+			t.Errorf("%s should have been named %s: %v", nic.name, nic.previous, m)
+		}
+	}
+	if intf := fixtureInterface(t, g, "enp98s0"); intf.Metadata()["IfIndex"] != int64(100034) {
+		t.Errorf("NIC rebound should have its new index: %v", intf.Metadata())
+	}
+	fixtureInterface(t, g, "replay-dummy1")
+
+	if s, err = history.NewFileStorage(dir, history.FileStorageOptions{Sync: history.SyncAlways}); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+
+	changes, err := s.Changes(time.Time{}, start)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the changes of the interfaces per name they had
+	added, deleted := make(map[graph.Identifier]int), make(map[graph.Identifier]int)
+	names := make(map[graph.Identifier][]string)
+	for _, c := range changes {
+		switch c.Type {
+		case history.NodeAdded:
+			added[c.Element.ID]++
+		case history.NodeDeleted:
+			deleted[c.Element.ID]++
+		}
+		if name, ok := c.Element.Metadata["Name"].(string); ok {
+			if n := names[c.Element.ID]; len(n) == 0 || n[len(n)-1] != name {
+				names[c.Element.ID] = append(n, name)
+			}
+		}
+	}
+
+	for _, name := range []string{"enp97s0", "enp98s0"} {
+		id := fixtureInterface(t, g, name).ID
+		if added[id] != 1 || deleted[id] != 0 || len(names[id]) != 2 {
+			t.Errorf("%s should be a single continuous node in the history: %d added, %d deleted, names %v", name, added[id], deleted[id], names[id])
+		}
+	}
+
+	// the virtual devices keep being identified by their index
+	dummy := fixtureInterface(t, g, "replay-dummy1")
+	for id, n := range names {
+		if n[0] == "replay-dummy0" && (id == dummy.ID || deleted[id] != 1) {
+			t.Errorf("Dummy recreated should be another node: %v", names)
+		}
+	}
+}
+
+func TestRenameWindow(t *testing.T) {
+	g, root := newReplayGraph(t)
+	u := NewNetLinkProbe(g, root, NetLinkOptions{RenameWindow: 10 * time.Millisecond})
+
+	nic := append(linkMessage(syscall.AF_UNSPEC, replayChildIndex, "replay-eth", "", 0),
+		nl.NewRtAttr(IFLA_PERM_ADDRESS, []byte{0x52, 0x54, 0, 0x9a, 0, 0x03}).Serialize()...)
+
+	var buf bytes.Buffer
+	recorder := newNetlinkRecorder(&buf)
+	recorder.record(syscall.RTM_NEWLINK, nic)
+	recorder.record(syscall.RTM_DELLINK, nic)
+	if err := u.replay(&buf, replayOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.RLock()
+	intf := g.LookupFirstChild(root, graph.Metadata{"PermanentMAC": "52:54:00:9a:00:03"})
+	g.RUnlock()
+	if intf == nil {
+		t.Fatal("NIC should be kept during the rename window")
+	}
+
+	// not back in time
+	time.Sleep(100 * time.Millisecond)
+
+	g.RLock()
+	defer g.RUnlock()
+	if g.GetNode(intf.ID) != nil {
+		t.Errorf("NIC not back should have been deleted: %v", g)
+	}
+}
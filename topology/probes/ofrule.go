@@ -0,0 +1,281 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// ofRule is an OpenFlow rule as reported by ovs-ofctl dump-flows
+type ofRule struct {
+	Cookie   string
+	Table    int64
+	Priority int64
+	Match    string
+	Actions  string
+	Duration float64
+	Packets  int64
+	Bytes    int64
+}
+
+// key identifies a rule across two dumps, the counters being reset when a
+// rule with the same key is re-added.
+func (r *ofRule) key() string {
+	return fmt.Sprintf("%s/%d/%d/%s", r.Cookie, r.Table, r.Priority, r.Match)
+}
+
+// parseOfRule parses a line of ovs-ofctl dump-flows, ie.
+// cookie=0x0, duration=12.5s, table=0, n_packets=10, n_bytes=840, idle_age=3, priority=1,in_port=1 actions=output:2
+func parseOfRule(line string) (*ofRule, error) {
+	line = strings.TrimSpace(line)
+
+	i := strings.Index(line, " actions=")
+	if i == -1 {
+		return nil, fmt.Errorf("no actions in rule: %s", line)
+	}
+	rule := &ofRule{Actions: line[i+len(" actions="):]}
+
+	var match []string
+	for _, field := range strings.Split(strings.Replace(line[:i], ", ", ",", -1), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			if kv[0] != "" {
+				match = append(match, kv[0])
+			}
+			continue
+		}
+
+		var err error
+		switch kv[0] {
+		case "cookie":
+			rule.Cookie = kv[1]
+		case "duration":
+			rule.Duration, err = strconv.ParseFloat(strings.TrimSuffix(kv[1], "s"), 64)
+		case "table":
+			rule.Table, err = strconv.ParseInt(kv[1], 10, 64)
+		case "n_packets":
+			rule.Packets, err = strconv.ParseInt(kv[1], 10, 64)
+		case "n_bytes":
+			rule.Bytes, err = strconv.ParseInt(kv[1], 10, 64)
+		case "priority":
+			rule.Priority, err = strconv.ParseInt(kv[1], 10, 64)
+		case "idle_age", "hard_age", "idle_timeout", "hard_timeout", "reset_counts", "send_flow_rem":
+		default:
+			match = append(match, kv[0]+"="+kv[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in rule: %s", kv[0], line)
+		}
+	}
+	rule.Match = strings.Join(match, ",")
+
+	return rule, nil
+}
+
+// parseOfRules parses the output of ovs-ofctl dump-flows, skipping the
+// reply header.
+func parseOfRules(output []byte) []*ofRule {
+	var rules []*ofRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "actions=") {
+			continue
+		}
+
+		rule, err := parseOfRule(line)
+		if err != nil {
+			logging.GetLogger().Debugf("Unable to parse OpenFlow rule: %s", err.Error())
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+type ofRulesByTable []*ofRule
+
+func (r ofRulesByTable) Len() int      { return len(r) }
+func (r ofRulesByTable) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r ofRulesByTable) Less(i, j int) bool {
+	if r[i].Table != r[j].Table {
+		return r[i].Table < r[j].Table
+	}
+	if r[i].Priority != r[j].Priority {
+		return r[i].Priority > r[j].Priority
+	}
+	return r[i].Match < r[j].Match
+}
+
+// ofRuleStats keeps the previous dump of the rules of the bridges so that
+// the packet and byte rates can be derived.
+type ofRuleStats struct {
+	rules map[string]map[string]*ofRule
+}
+
+// ruleRates returns the rates of a rule, computed against the previous dump
+// using the durations reported by OVS. A rule which has been re-added, its
+// duration or counters having decreased, gets the average rates since its
+// creation so that the reset doesn't show up as a spike.
+func ruleRates(rule *ofRule, previous *ofRule) (packetRate float64, byteRate float64) {
+	switch {
+	case previous != nil && rule.Duration > previous.Duration &&
+		rule.Packets >= previous.Packets && rule.Bytes >= previous.Bytes:
+		elapsed := rule.Duration - previous.Duration
+		packetRate = float64(rule.Packets-previous.Packets) / elapsed
+		byteRate = float64(rule.Bytes-previous.Bytes) / elapsed
+	case rule.Duration > 0:
+		packetRate = float64(rule.Packets) / rule.Duration
+		byteRate = float64(rule.Bytes) / rule.Duration
+	}
+
+	return
+}
+
+// update returns the summary of the rules of a bridge and keeps them for
+// the next rate derivation. The rules themselves are not recorded, only
+// their count, their totals and a digest of their matches and actions
+// changing whenever the rule set changes.
+func (s *ofRuleStats) update(bridge string, rules []*ofRule) map[string]interface{} {
+	sort.Sort(ofRulesByTable(rules))
+
+	previous := s.rules[bridge]
+	current := make(map[string]*ofRule)
+
+	digest := sha1.New()
+	var packets, bytes int64
+	var packetRate, byteRate float64
+	for _, rule := range rules {
+		key := rule.key()
+		fmt.Fprintf(digest, "%s actions=%s\n", key, rule.Actions)
+
+		packets += rule.Packets
+		bytes += rule.Bytes
+		p, b := ruleRates(rule, previous[key])
+		packetRate += p
+		byteRate += b
+
+		current[key] = rule
+	}
+	s.rules[bridge] = current
+
+	return map[string]interface{}{
+		"Count":      int64(len(rules)),
+		"Digest":     hex.EncodeToString(digest.Sum(nil)),
+		"Packets":    packets,
+		"Bytes":      bytes,
+		"PacketRate": packetRate,
+		"ByteRate":   byteRate,
+	}
+}
+
+// forget drops the rules of the bridges which are not part of the given
+// list anymore.
+func (s *ofRuleStats) forget(bridges map[string]*graph.Node) {
+	for name := range s.rules {
+		if _, ok := bridges[name]; !ok {
+			delete(s.rules, name)
+		}
+	}
+}
+
+// dumpOfRules dumps the rules of a bridge, protocols being the OpenFlow
+// versions enabled on the bridge, ie. OpenFlow13, ovs-ofctl using OpenFlow
+// 1.0 by default which is refused by the bridges not enabling it.
+func dumpOfRules(bridge string, protocols []string) ([]byte, error) {
+	var args []string
+	if len(protocols) > 0 {
+		args = append(args, "-O", strings.Join(protocols, ","))
+	}
+	args = append(args, "dump-flows", bridge)
+
+	return exec.Command("ovs-ofctl", args...).Output()
+}
+
+// updateFlowRules dumps the OpenFlow rules of the bridges and records their
+// summary on the bridge nodes as FlowRules.
+func (o *OvsdbProbe) updateFlowRules() {
+	o.Lock()
+	o.Graph.Lock()
+	bridges := make(map[string]*graph.Node)
+	protocols := make(map[string][]string)
+	for _, bridge := range o.Graph.LookupChildren(o.Root, graph.Metadata{"Type": topology.OvsBridgeType}) {
+		if name, ok := bridge.Metadata()["Name"].(string); ok {
+			bridges[name] = bridge
+			if uuid, ok := bridge.Metadata()["UUID"].(string); ok {
+				protocols[name] = o.bridgeProtocols[uuid]
+			}
+		}
+	}
+	o.Graph.Unlock()
+	o.Unlock()
+
+	o.ruleStats.forget(bridges)
+
+	for name, bridge := range bridges {
+		output, err := o.dumpOfRules(name, protocols[name])
+		if err != nil {
+			logging.GetLogger().Debugf("Unable to dump the OpenFlow rules of %s: %s", name, err.Error())
+			continue
+		}
+		summary := o.ruleStats.update(name, parseOfRules(output))
+
+		o.Graph.Lock()
+		if o.Graph.GetNode(bridge.ID) != nil {
+			o.Graph.AddMetadata(bridge, "FlowRules", summary)
+		}
+		o.Graph.Unlock()
+	}
+}
+
+func (o *OvsdbProbe) flowRulesLoop(interval time.Duration) {
+	defer common.RecoverAndPanic()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			o.updateFlowRules()
+		case <-o.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const ofctlDump = `NXST_FLOW reply (xid=0x4):
+ cookie=0x0, duration=10.5s, table=0, n_packets=100, n_bytes=8400, idle_age=3, priority=10,in_port=1 actions=output:2
+ cookie=0x0, duration=10.5s, table=0, n_packets=0, n_bytes=0, idle_age=10, priority=0 actions=NORMAL
+`
+
+func TestParseOfRules(t *testing.T) {
+	rules := parseOfRules([]byte(ofctlDump))
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+
+	r := rules[0]
+	if r.Cookie != "0x0" || r.Duration != 10.5 || r.Packets != 100 || r.Bytes != 8400 ||
+		r.Priority != 10 || r.Match != "in_port=1" || r.Actions != "output:2" {
+		t.Errorf("Wrong rule: %+v", r)
+	}
+
+	if rules[1].Match != "" || rules[1].Actions != "NORMAL" {
+		t.Errorf("Wrong rule: %+v", rules[1])
+	}
+}
+
+func TestOfRuleRates(t *testing.T) {
+	s := &ofRuleStats{rules: make(map[string]map[string]*ofRule)}
+
+	rule := func(duration float64, packets, bytes int64) *ofRule {
+		return &ofRule{Table: 0, Priority: 10, Match: "in_port=1", Duration: duration, Packets: packets, Bytes: bytes}
+	}
+
+	// first dump, average since creation
+	m := s.update("br0", []*ofRule{rule(10, 100, 1000)})
+	if m["PacketRate"] != 10.0 || m["ByteRate"] != 100.0 {
+		t.Errorf("Wrong rates on first dump: %v", m)
+	}
+
+	m = s.update("br0", []*ofRule{rule(20, 300, 5000)})
+	if m["PacketRate"] != 20.0 || m["ByteRate"] != 400.0 || m["Packets"] != int64(300) {
+		t.Errorf("Wrong rates: %v", m)
+	}
+
+	// rule re-added, the counters restart from zero
+	m = s.update("br0", []*ofRule{rule(2, 10, 100)})
+	if m["PacketRate"] != 5.0 || m["ByteRate"] != 50.0 {
+		t.Errorf("Counter reset should not produce a spike: %v", m)
+	}
+
+	s.forget(nil)
+	if len(s.rules) != 0 {
+		t.Errorf("Rules of removed bridges should be forgotten: %v", s.rules)
+	}
+}
+
+func TestOfRuleDigest(t *testing.T) {
+	s := &ofRuleStats{rules: make(map[string]map[string]*ofRule)}
+
+	first := s.update("br0", parseOfRules([]byte(ofctlDump)))
+	if first["Count"] != int64(2) || first["Packets"] != int64(100) {
+		t.Errorf("Wrong summary: %v", first)
+	}
+
+	// only the counters changed
+	dump := strings.Replace(ofctlDump, "n_packets=100", "n_packets=200", 1)
+	if m := s.update("br0", parseOfRules([]byte(dump))); m["Digest"] != first["Digest"] {
+		t.Errorf("Digest should only depend on the rules: %v %v", first, m)
+	}
+
+	dump = strings.Replace(ofctlDump, "actions=output:2", "actions=drop", 1)
+	if m := s.update("br0", parseOfRules([]byte(dump))); m["Digest"] == first["Digest"] {
+		t.Errorf("Digest should change with the actions: %v", m)
+	}
+}
+
+func TestOfRuleProtocols(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	o := NewOvsdbProbe(g, root, "127.0.0.1", 0)
+	dumped := make(map[string][]string)
+	o.dumpOfRules = func(bridge string, protocols []string) ([]byte, error) {
+		dumped[bridge] = protocols
+		return []byte(ofctlDump), nil
+	}
+
+	o.OnOvsBridgeAdd(nil, "br0-uuid", ovsRow(map[string]interface{}{
+		"name":      "br0",
+		"ports":     libovsdb.OvsSet{},
+		"protocols": "OpenFlow13",
+	}))
+	o.OnOvsBridgeAdd(nil, "br1-uuid", ovsRow(map[string]interface{}{
+		"name":      "br1",
+		"ports":     libovsdb.OvsSet{},
+		"protocols": libovsdb.OvsSet{GoSet: []interface{}{"OpenFlow13", "OpenFlow10"}},
+	}))
+
+	o.updateFlowRules()
+
+	if !reflect.DeepEqual(dumped["br0"], []string{"OpenFlow13"}) || !reflect.DeepEqual(dumped["br1"], []string{"OpenFlow10", "OpenFlow13"}) {
+		t.Errorf("Wrong protocols: %v", dumped)
+	}
+
+	g.RLock()
+	summary, _ := g.LookupFirstNode(graph.Metadata{"UUID": "br0-uuid"}).Metadata()["FlowRules"].(map[string]interface{})
+	g.RUnlock()
+	if summary["Count"] != int64(2) {
+		t.Errorf("Wrong rules summary: %v", summary)
+	}
+}
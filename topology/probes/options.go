@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"time"
+
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+)
+
+// Logger is the logging interface used by the netlink and netns probes, the
+// skydive logger being used when none is given.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NetLinkOptions configures a netlink probe, the zero value of a field
+// giving its default behaviour.
+type NetLinkOptions struct {
+	// VethResolverInterval is the delay between two attempts to find the
+	// peer of a veth, 200ms by default.
+	VethResolverInterval time.Duration
+	// VethResolverRetries is the number of attempts before giving up on a
+	// veth peer, 10 by default.
+	VethResolverRetries int
+	// InterfaceTypes restricts the tracked interfaces to the given types,
+	// all of them are tracked when empty.
+	InterfaceTypes []string
+	// SysctlKeys are the sysctls recorded on the root node, none when empty.
+	SysctlKeys []string
+	// SysctlInterval is the refresh interval of the sysctls, 30s by default.
+	SysctlInterval time.Duration
+	// SRIOVSysfs is the sysfs directory of the interfaces the virtual
+	// functions of the SR-IOV physical functions are read from, only valid
+	// for the namespace sysfs was mounted in. Not read when empty.
+	SRIOVSysfs string
+	// DHCPClientLeases are glob patterns of dhclient lease files and
+	// NetworkdLeases the lease directory of systemd-networkd, the leases
+	// are not looked up when both are empty. The lease files are read again
+	// every DHCPInterval, 30s by default.
+	DHCPClientLeases []string
+	NetworkdLeases   string
+	DHCPInterval     time.Duration
+	// CacheMaxSize and CacheMaxAge bound the queue of the interfaces
+	// waiting for their master, 1000 entries and 10 minutes by default.
+	CacheMaxSize int
+	CacheMaxAge  time.Duration
+	// RecordDir is the directory the received link messages are recorded
+	// into for a later replay, nothing is recorded when empty.
+	RecordDir string
+	Logger    Logger
+
+	// InitialScanDelay delays the initial scan of the interfaces, ie. for
+	// the interfaces of another probe to be registered first. The netlink
+	// messages received in the meantime are not lost.
+	InitialScanDelay time.Duration
+
+	// StatisticsInterval is the polling interval of the interface counters,
+	// not polled when zero. The rates of the error and drop counters are
+	// computed over ErrorsWindow, an interface whose rate per minute of one
+	// of them crosses ErrorsThreshold being flagged with ErrorsHigh.
+	StatisticsInterval time.Duration
+	ErrorsWindow       time.Duration
+	ErrorsThreshold    float64
+
+	// MulticastInterval is the refresh interval of the multicast snooping
+	// state and database of the bridges, not collected when zero. Only the
+	// entries of the MulticastGroups, addresses or CIDRs, all of them when
+	// empty, are detailed, up to MulticastMaxEntries, 100 by default.
+	MulticastInterval   time.Duration
+	MulticastGroups     []string
+	MulticastMaxEntries int
+
+	// RateLimit is the number of link and neighbor messages handled per
+	// second, up to RateBurst at once, one second of messages by default.
+	// The messages beyond wait in the netlink socket. Not limited when zero.
+	RateLimit float64
+	RateBurst int
+
+	// NeighborInterval is the minimum delay between two updates of the
+	// neighbors of the interfaces, the ARP and NDP changes received
+	// meanwhile being applied at once. Applied per batch of messages when
+	// zero.
+	NeighborInterval time.Duration
+
+	// RenameWindow keeps the node of a physical NIC whose link is deleted,
+	// ie. unbound from its driver to be renamed, until the NIC comes back
+	// with the same hardware identity, permanent MAC or PCI address. The
+	// node is deleted right away when zero.
+	RenameWindow time.Duration
+}
+
+// NetNSOptions configures a netns probe.
+type NetNSOptions struct {
+	// RunPath is the directory watched for namespaces, /var/run/netns by
+	// default.
+	RunPath string
+	// NetLink configures the netlink probes started in each namespace.
+	NetLink NetLinkOptions
+	Logger  Logger
+	// Workers is the number of namespaces scanned at once when they show
+	// up, 4 by default.
+	Workers int
+}
+
+func defaultLogger(logger Logger) Logger {
+	if logger == nil {
+		return logging.GetLogger()
+	}
+	return logger
+}
+
+func (o NetLinkOptions) withDefaults() NetLinkOptions {
+	if o.VethResolverInterval <= 0 {
+		o.VethResolverInterval = 200 * time.Millisecond
+	}
+	if o.VethResolverRetries <= 0 {
+		o.VethResolverRetries = 10
+	}
+	if o.SysctlInterval <= 0 {
+		o.SysctlInterval = 30 * time.Second
+	}
+	if o.DHCPInterval <= 0 {
+		o.DHCPInterval = 30 * time.Second
+	}
+	if o.ErrorsWindow <= 0 {
+		o.ErrorsWindow = 5 * time.Minute
+	}
+	if o.MulticastMaxEntries <= 0 {
+		o.MulticastMaxEntries = 100
+	}
+	if o.CacheMaxSize <= 0 {
+		o.CacheMaxSize = 1000
+	}
+	if o.CacheMaxAge <= 0 {
+		o.CacheMaxAge = 10 * time.Minute
+	}
+	o.Logger = defaultLogger(o.Logger)
+
+	return o
+}
+
+func (o NetNSOptions) withDefaults() NetNSOptions {
+	if o.RunPath == "" {
+		o.RunPath = "/var/run/netns"
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	o.Logger = defaultLogger(o.Logger)
+	if o.NetLink.Logger == nil {
+		o.NetLink.Logger = o.Logger
+	}
+
+	return o
+}
+
+// NetLinkOptionsFromConfig returns the options of the given probe, netlink
+// or netns, the interface types of the probe taking precedence over the
+// global ones.
+func NetLinkOptionsFromConfig(probe string) NetLinkOptions {
+	cfg := config.GetConfig()
+
+	types := cfg.GetStringSlice("agent.topology." + probe + ".interface_types")
+	if len(types) == 0 {
+		types = cfg.GetStringSlice("agent.topology.interface_types")
+	}
+
+	return NetLinkOptions{
+		VethResolverInterval: time.Duration(cfg.GetInt("agent.topology.netlink.veth_resolver_interval")) * time.Millisecond,
+		VethResolverRetries:  cfg.GetInt("agent.topology.netlink.veth_resolver_retries"),
+		InterfaceTypes:       types,
+		SysctlKeys:           cfg.GetStringSlice("agent.topology.sysctl.keys"),
+		SysctlInterval:       time.Duration(cfg.GetInt("agent.topology.sysctl.interval")) * time.Second,
+		SRIOVSysfs:           "/sys/class/net",
+		DHCPClientLeases:     cfg.GetStringSlice("agent.topology.dhcp.dhclient_leases"),
+		NetworkdLeases:       cfg.GetString("agent.topology.dhcp.networkd_leases"),
+		DHCPInterval:         time.Duration(cfg.GetInt("agent.topology.dhcp.interval")) * time.Second,
+		CacheMaxSize:         cfg.GetInt("agent.topology.cache.max_size"),
+		CacheMaxAge:          time.Duration(cfg.GetInt("agent.topology.cache.max_age")) * time.Second,
+		RecordDir:            cfg.GetString("agent.topology.netlink.record_dir"),
+		InitialScanDelay:     time.Duration(cfg.GetInt("agent.topology."+probe+".initial_scan_delay")) * time.Millisecond,
+		StatisticsInterval:   time.Duration(cfg.GetInt("agent.topology.statistics.interval")) * time.Second,
+		ErrorsWindow:         time.Duration(cfg.GetInt("agent.topology.statistics.errors_window")) * time.Second,
+		ErrorsThreshold:      cfg.GetFloat64("agent.topology.statistics.errors_threshold"),
+		MulticastInterval:    time.Duration(cfg.GetInt("agent.topology.multicast.interval")) * time.Second,
+		MulticastGroups:      cfg.GetStringSlice("agent.topology.multicast.groups"),
+		MulticastMaxEntries:  cfg.GetInt("agent.topology.multicast.max_entries"),
+		RenameWindow:         time.Duration(cfg.GetInt("agent.topology.netlink.rename_window")) * time.Millisecond,
+		NeighborInterval:     time.Duration(cfg.GetInt("agent.topology.netlink.neighbor_interval")) * time.Millisecond,
+	}
+}
+
+func NetNSOptionsFromConfig() NetNSOptions {
+	opts := NetLinkOptionsFromConfig("netns")
+	// the lease files and sysfs are the ones of the host namespace
+	// interfaces
+	opts.DHCPClientLeases, opts.NetworkdLeases = nil, ""
+	opts.SRIOVSysfs = ""
+
+	cfg := config.GetConfig()
+	opts.RateLimit = cfg.GetFloat64("netns.rate_limit")
+	opts.RateBurst = cfg.GetInt("netns.rate_burst")
+
+	return NetNSOptions{
+		RunPath: cfg.GetString("netns.run_path"),
+		NetLink: opts,
+		Workers: cfg.GetInt("netns.workers"),
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"reflect"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// defaults of OVS for the bonds, the columns being empty unless set
+const (
+	ovsDefaultBondMode = "active-backup"
+	ovsDefaultLACP     = "off"
+)
+
+// metadata of the bond ports set from the port rows
+var ovsBondKeys = []string{"BondMode", "LACP", "LACPTime", "BondActiveSlaveMAC"}
+
+// rowBool returns the value of an optional boolean column and whether it
+// is set, an unset column being an empty set
+func rowBool(field interface{}) (bool, bool) {
+	b, ok := field.(bool)
+	return b, ok
+}
+
+// portBondMetadata returns the bond metadata of a port row, nil if the port
+// isn't a bond, ie. has a single interface and no bond configuration.
+func portBondMetadata(row *libovsdb.RowUpdate) graph.Metadata {
+	mode := rowString(row.New.Fields["bond_mode"])
+	lacp := rowString(row.New.Fields["lacp"])
+	if mode == "" && lacp == "" && len(rowUUIDs(row.New.Fields["interfaces"])) < 2 {
+		return nil
+	}
+
+	if mode == "" {
+		mode = ovsDefaultBondMode
+	}
+	if lacp == "" {
+		lacp = ovsDefaultLACP
+	}
+	m := graph.Metadata{"BondMode": mode, "LACP": lacp}
+
+	if config, ok := row.New.Fields["other_config"].(libovsdb.OvsMap); ok {
+		if t, ok := config.GoMap["lacp-time"].(string); ok {
+			m["LACPTime"] = t
+		}
+	}
+
+	// MAC of the active slave, in the active-backup mode
+	if mac := rowString(row.New.Fields["bond_active_slave"]); mac != "" {
+		m["BondActiveSlaveMAC"] = mac
+	}
+
+	return m
+}
+
+// updatePortBond sets the bond metadata of a port, removed once the port
+// isn't a bond anymore, called with the probe and the graph locked
+func (o *OvsdbProbe) updatePortBond(port *graph.Node, row *libovsdb.RowUpdate) {
+	m := make(graph.Metadata)
+	for k, v := range port.Metadata() {
+		m[k] = v
+	}
+	for _, k := range ovsBondKeys {
+		delete(m, k)
+	}
+	for k, v := range portBondMetadata(row) {
+		m[k] = v
+	}
+
+	if !reflect.DeepEqual(m, port.Metadata()) {
+		o.Graph.SetMetadata(port, m)
+	}
+}
+
+// delInterfaceLACP removes the LACP status of an interface not being the
+// slave of a bond with LACP anymore, called with the graph locked
+func (o *OvsdbProbe) delInterfaceLACP(intf *graph.Node) {
+	if _, ok := intf.Metadata()["LACPCurrent"]; !ok {
+		return
+	}
+
+	m := make(graph.Metadata)
+	for k, v := range intf.Metadata() {
+		if k != "LACPCurrent" {
+			m[k] = v
+		}
+	}
+	o.Graph.SetMetadata(intf, m)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func interfaceRow(name string, ofport float64, lacpCurrent interface{}) *libovsdb.RowUpdate {
+	return ovsRow(map[string]interface{}{
+		"name":         name,
+		"ofport":       ofport,
+		"status":       libovsdb.OvsMap{GoMap: map[interface{}]interface{}{}},
+		"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{}},
+		"lacp_current": lacpCurrent,
+	})
+}
+
+func portRow(fields map[string]interface{}, interfaces ...string) *libovsdb.RowUpdate {
+	set := libovsdb.OvsSet{}
+	for _, u := range interfaces {
+		set.GoSet = append(set.GoSet, libovsdb.UUID{GoUuid: u})
+	}
+	fields["name"] = "bond0"
+	fields["interfaces"] = set
+	return ovsRow(fields)
+}
+
+func TestOvsBond(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.SetStrictSchema(true)
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	o := NewOvsdbProbe(g, root, "127.0.0.1", 0)
+
+	metadata := func(uuid string) graph.Metadata {
+		g.RLock()
+		defer g.RUnlock()
+
+		return g.LookupFirstNode(graph.Metadata{"UUID": uuid}).Metadata()
+	}
+
+	o.OnOvsInterfaceAdd(nil, "intf1-uuid", interfaceRow("intf1", 1, true))
+	o.OnOvsInterfaceAdd(nil, "intf2-uuid", interfaceRow("intf2", 2, false))
+
+	// bond created with the defaults, ie. by ovs-vsctl add-bond
+	o.OnOvsPortAdd(nil, "bond-uuid", portRow(map[string]interface{}{
+		"bond_mode":         libovsdb.OvsSet{},
+		"lacp":              libovsdb.OvsSet{},
+		"bond_active_slave": "00:11:22:33:44:55",
+	}, "intf1-uuid", "intf2-uuid"))
+
+	m := metadata("bond-uuid")
+	if m["BondMode"] != "active-backup" || m["LACP"] != "off" || m["BondActiveSlaveMAC"] != "00:11:22:33:44:55" {
+		t.Errorf("Wrong metadata of a default bond: %v", m)
+	}
+
+	o.OnOvsPortUpdate(nil, "bond-uuid", portRow(map[string]interface{}{
+		"bond_mode":    "balance-tcp",
+		"lacp":         "active",
+		"other_config": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{"lacp-time": "fast"}},
+	}, "intf1-uuid", "intf2-uuid"))
+
+	m = metadata("bond-uuid")
+	if m["BondMode"] != "balance-tcp" || m["LACP"] != "active" || m["LACPTime"] != "fast" {
+		t.Errorf("Wrong metadata of a LACP bond: %v", m)
+	}
+	if _, ok := m["BondActiveSlaveMAC"]; ok {
+		t.Errorf("Active slave not removed: %v", m)
+	}
+
+	if m := metadata("intf1-uuid"); m["LACPCurrent"] != true {
+		t.Errorf("Wrong LACP status of intf1: %v", m)
+	}
+	if m := metadata("intf2-uuid"); m["LACPCurrent"] != false {
+		t.Errorf("Wrong LACP status of intf2: %v", m)
+	}
+
+	// the slave status is updated live
+	o.OnOvsInterfaceUpdate(nil, "intf2-uuid", interfaceRow("intf2", 2, true))
+	if m := metadata("intf2-uuid"); m["LACPCurrent"] != true {
+		t.Errorf("LACP status of intf2 not updated: %v", m)
+	}
+
+	// back to a single interface port
+	o.OnOvsInterfaceUpdate(nil, "intf2-uuid", interfaceRow("intf2", 2, libovsdb.OvsSet{}))
+	o.OnOvsPortUpdate(nil, "bond-uuid", portRow(map[string]interface{}{
+		"bond_mode": libovsdb.OvsSet{},
+		"lacp":      libovsdb.OvsSet{},
+	}, "intf1-uuid"))
+
+	m = metadata("bond-uuid")
+	for _, k := range ovsBondKeys {
+		if _, ok := m[k]; ok {
+			t.Errorf("Bond metadata %s not removed: %v", k, m)
+		}
+	}
+	if m := metadata("intf2-uuid"); m["LACPCurrent"] != nil {
+		t.Errorf("LACP status of intf2 not removed: %v", m)
+	}
+}
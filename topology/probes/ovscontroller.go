@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/ovs"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// management of the OVS bridges, derived from their controllers
+const (
+	// at least one controller is connected
+	ManagementController = "controller"
+	// controllers are configured but none is connected, the bridge is
+	// then driven by its fail mode
+	ManagementControllerDisconnected = "controller-disconnected"
+	// no controller, the bridge is a learning switch or driven locally
+	// through ovs-ofctl
+	ManagementStandalone = "standalone"
+)
+
+type ovsController struct {
+	Target    string
+	Connected bool
+	Role      string
+}
+
+// localController returns whether the target is a local socket, ie.
+// punix:/var/run/openvswitch/br-int.mgmt, used by the local tools
+func localController(target string) bool {
+	return strings.HasPrefix(target, "unix:") || strings.HasPrefix(target, "punix:")
+}
+
+// rowUUIDs returns the UUIDs of a column holding one or a set of references
+func rowUUIDs(field interface{}) []string {
+	var uuids []string
+	switch field := field.(type) {
+	case libovsdb.OvsSet:
+		for _, i := range field.GoSet {
+			if u, ok := i.(libovsdb.UUID); ok {
+				uuids = append(uuids, u.GoUuid)
+			}
+		}
+	case libovsdb.UUID:
+		uuids = append(uuids, field.GoUuid)
+	}
+	return uuids
+}
+
+// rowString returns the value of an optional string column
+func rowString(field interface{}) string {
+	s, _ := field.(string)
+	return s
+}
+
+// rowStrings returns the sorted values of a set of strings column, a set of
+// a single value being given as the value itself
+func rowStrings(field interface{}) []string {
+	var values []string
+	switch field := field.(type) {
+	case libovsdb.OvsSet:
+		for _, i := range field.GoSet {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+	case string:
+		values = append(values, field)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// bridgeManagement returns the metadata describing the controllers of a
+// bridge and the derived management of the bridge
+func (o *OvsdbProbe) bridgeManagement(bridgeUUID string) (string, []interface{}) {
+	byTarget := make(map[string]*ovsController)
+	var targets []string
+	for _, u := range o.bridgeControllers[bridgeUUID] {
+		if c, ok := o.uuidToController[u]; ok && !localController(c.Target) {
+			byTarget[c.Target] = c
+			targets = append(targets, c.Target)
+		}
+	}
+	sort.Strings(targets)
+
+	var controllers []interface{}
+
+	management := ManagementStandalone
+	for _, target := range targets {
+		c := byTarget[target]
+
+		m := map[string]interface{}{"Target": c.Target, "Connected": c.Connected}
+		if c.Role != "" {
+			m["Role"] = c.Role
+		}
+		controllers = append(controllers, m)
+
+		if c.Connected {
+			management = ManagementController
+		} else if management == ManagementStandalone {
+			management = ManagementControllerDisconnected
+		}
+	}
+
+	return management, controllers
+}
+
+// updateBridgeManagement sets the controllers and the management of the
+// bridge, called with the probe and the graph locked
+func (o *OvsdbProbe) updateBridgeManagement(bridgeUUID string) {
+	bridge := o.Graph.LookupFirstNode(graph.Metadata{"UUID": bridgeUUID})
+	if bridge == nil {
+		return
+	}
+
+	management, controllers := o.bridgeManagement(bridgeUUID)
+
+	m := make(graph.Metadata)
+	for k, v := range bridge.Metadata() {
+		m[k] = v
+	}
+	m["Management"] = management
+	if len(controllers) > 0 {
+		m["Controllers"] = controllers
+	} else {
+		delete(m, "Controllers")
+	}
+	if failMode := o.bridgeFailModes[bridgeUUID]; failMode != "" {
+		m["FailMode"] = failMode
+	} else {
+		delete(m, "FailMode")
+	}
+
+	if !reflect.DeepEqual(m, bridge.Metadata()) {
+		o.Graph.SetMetadata(bridge, m)
+	}
+}
+
+// setBridgeControllers keeps the controllers of a bridge row, called with
+// the probe and the graph locked
+func (o *OvsdbProbe) setBridgeControllers(bridgeUUID string, row *libovsdb.RowUpdate) {
+	o.bridgeControllers[bridgeUUID] = rowUUIDs(row.New.Fields["controller"])
+	o.bridgeFailModes[bridgeUUID] = rowString(row.New.Fields["fail_mode"])
+
+	o.updateBridgeManagement(bridgeUUID)
+}
+
+func (o *OvsdbProbe) forgetBridgeControllers(bridgeUUID string) {
+	delete(o.bridgeControllers, bridgeUUID)
+	delete(o.bridgeFailModes, bridgeUUID)
+}
+
+// controllerChanged updates the bridges using the controller, called with
+// the probe and the graph locked
+func (o *OvsdbProbe) controllerChanged(controllerUUID string) {
+	for bridgeUUID, controllers := range o.bridgeControllers {
+		for _, u := range controllers {
+			if u == controllerUUID {
+				o.updateBridgeManagement(bridgeUUID)
+				break
+			}
+		}
+	}
+}
+
+func (o *OvsdbProbe) OnOvsControllerAdd(monitor *ovsdb.OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+	o.Lock()
+	defer o.Unlock()
+
+	connected, _ := row.New.Fields["is_connected"].(bool)
+	o.uuidToController[uuid] = &ovsController{
+		Target:    rowString(row.New.Fields["target"]),
+		Connected: connected,
+		Role:      rowString(row.New.Fields["role"]),
+	}
+
+	o.Graph.Lock()
+	defer o.Graph.Unlock()
+
+	o.controllerChanged(uuid)
+}
+
+func (o *OvsdbProbe) OnOvsControllerUpdate(monitor *ovsdb.OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+	o.OnOvsControllerAdd(monitor, uuid, row)
+}
+
+func (o *OvsdbProbe) OnOvsControllerDel(monitor *ovsdb.OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.uuidToController, uuid)
+
+	o.Graph.Lock()
+	defer o.Graph.Unlock()
+
+	o.controllerChanged(uuid)
+}
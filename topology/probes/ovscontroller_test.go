@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func ovsRow(fields map[string]interface{}) *libovsdb.RowUpdate {
+	return &libovsdb.RowUpdate{New: libovsdb.Row{Fields: fields}}
+}
+
+func controllerRow(target string, connected bool) *libovsdb.RowUpdate {
+	return ovsRow(map[string]interface{}{"target": target, "is_connected": connected, "role": "master"})
+}
+
+func TestBridgeManagement(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.SetStrictSchema(true)
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	o := NewOvsdbProbe(g, root, "127.0.0.1", 0)
+
+	management := func() (interface{}, interface{}) {
+		g.RLock()
+		defer g.RUnlock()
+
+		m := g.LookupFirstNode(graph.Metadata{"UUID": "br-uuid"}).Metadata()
+		return m["Management"], m["Controllers"]
+	}
+
+	// the controller reported before the bridge referencing it
+	o.OnOvsControllerAdd(nil, "ctrl-uuid", controllerRow("tcp:10.0.0.1:6653", false))
+	o.OnOvsControllerAdd(nil, "local-uuid", controllerRow("punix:/var/run/openvswitch/br0.mgmt", true))
+
+	o.OnOvsBridgeAdd(nil, "br-uuid", ovsRow(map[string]interface{}{
+		"name":       "br0",
+		"ports":      libovsdb.OvsSet{},
+		"fail_mode":  "secure",
+		"controller": libovsdb.OvsSet{GoSet: []interface{}{libovsdb.UUID{GoUuid: "ctrl-uuid"}, libovsdb.UUID{GoUuid: "local-uuid"}}},
+	}))
+
+	if m, c := management(); m != ManagementControllerDisconnected || len(c.([]interface{})) != 1 {
+		t.Errorf("Expected a disconnected remote controller, got %v %v", m, c)
+	}
+
+	o.OnOvsControllerUpdate(nil, "ctrl-uuid", controllerRow("tcp:10.0.0.1:6653", true))
+	if m, c := management(); m != ManagementController || c.([]interface{})[0].(map[string]interface{})["Connected"] != true {
+		t.Errorf("Expected a connected controller, got %v %v", m, c)
+	}
+
+	o.OnOvsControllerDel(nil, "ctrl-uuid", nil)
+	if m, c := management(); m != ManagementStandalone || c != nil {
+		t.Errorf("Expected a standalone bridge, got %v %v", m, c)
+	}
+
+	o.OnOvsBridgeDel(nil, "br-uuid", nil)
+	if len(o.bridgeControllers) != 0 {
+		t.Errorf("Controllers of a deleted bridge should be forgotten: %v", o.bridgeControllers)
+	}
+}
@@ -23,13 +23,18 @@
 package probes
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/socketplane/libovsdb"
 
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/ovs"
+	"github.com/redhat-cip/skydive/probe"
+	"github.com/redhat-cip/skydive/topology"
 	"github.com/redhat-cip/skydive/topology/graph"
 )
 
@@ -40,8 +45,24 @@ type OvsdbProbe struct {
 	OvsMon          *ovsdb.OvsMonitor
 	uuidToIntf      map[string]*graph.Node
 	uuidToPort      map[string]*graph.Node
-	intfPortQueue   map[string]*graph.Node
-	portBridgeQueue map[string]*graph.Node
+	intfPortQueue   *common.BoundedCache
+	portBridgeQueue *common.BoundedCache
+	// interval of the OpenFlow rules statistics, disabled when zero
+	flowRulesInterval time.Duration
+	ruleStats         *ofRuleStats
+	dumpOfRules       func(bridge string, protocols []string) ([]byte, error)
+	quit              chan bool
+	// controllers and their references from the bridges
+	uuidToController  map[string]*ovsController
+	bridgeControllers map[string][]string
+	bridgeFailModes   map[string]string
+	// OpenFlow versions enabled on the bridges, by bridge UUID
+	bridgeProtocols map[string][]string
+	// snooping tables, not collected when nil
+	multicast *multicastReader
+	dumpMdb   func(bridge string) ([]byte, error)
+	// directory of the sockets of the dpdkvhostuser interfaces
+	vhostUserSocketDir string
 }
 
 func (o *OvsdbProbe) OnOvsBridgeUpdate(monitor *ovsdb.OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
@@ -59,10 +80,25 @@ func (o *OvsdbProbe) OnOvsBridgeAdd(monitor *ovsdb.OvsMonitor, uuid string, row
 
 	bridge := o.Graph.LookupFirstNode(graph.Metadata{"UUID": uuid})
 	if bridge == nil {
-		bridge = o.Graph.NewNode(graph.GenID(), graph.Metadata{"Name": name, "UUID": uuid, "Type": "ovsbridge"})
-		o.Graph.Link(o.Root, bridge, graph.Metadata{"RelationType": "ownership"})
+		bridge = o.Graph.NewNode(o.Graph.NewIDFrom(string(o.Root.ID), uuid), graph.Metadata{"Name": name, "UUID": uuid, "Type": topology.OvsBridgeType})
+		if bridge == nil {
+			return
+		}
+		o.Graph.Link(o.Root, bridge, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	}
+
+	// netdev for the userspace datapath, ie. DPDK
+	if datapath := rowString(row.New.Fields["datapath_type"]); datapath != "" {
+		o.Graph.AddMetadata(bridge, "DatapathType", datapath)
 	}
 
+	if snooping, ok := row.New.Fields["mcast_snooping_enable"].(bool); ok {
+		o.Graph.AddMetadata(bridge, "MulticastSnooping", snooping)
+	}
+
+	o.setBridgeControllers(uuid, row)
+	o.bridgeProtocols[uuid] = rowStrings(row.New.Fields["protocols"])
+
 	switch row.New.Fields["ports"].(type) {
 	case libovsdb.OvsSet:
 		set := row.New.Fields["ports"].(libovsdb.OvsSet)
@@ -72,10 +108,10 @@ func (o *OvsdbProbe) OnOvsBridgeAdd(monitor *ovsdb.OvsMonitor, uuid string, row
 
 			port, ok := o.uuidToPort[u]
 			if ok && !o.Graph.AreLinked(bridge, port) {
-				o.Graph.Link(bridge, port, graph.Metadata{"RelationType": "layer2"})
+				o.Graph.Link(bridge, port, graph.Metadata{"RelationType": topology.Layer2Relation})
 			} else {
 				/* will be filled later when the port update for this port will be triggered */
-				o.portBridgeQueue[u] = bridge
+				o.portBridgeQueue.Set(u, bridge)
 			}
 		}
 
@@ -84,15 +120,21 @@ func (o *OvsdbProbe) OnOvsBridgeAdd(monitor *ovsdb.OvsMonitor, uuid string, row
 
 		port, ok := o.uuidToPort[u]
 		if ok && !o.Graph.AreLinked(bridge, port) {
-			o.Graph.Link(bridge, port, graph.Metadata{"RelationType": "layer2"})
+			o.Graph.Link(bridge, port, graph.Metadata{"RelationType": topology.Layer2Relation})
 		} else {
 			/* will be filled later when the port update for this port will be triggered */
-			o.portBridgeQueue[u] = bridge
+			o.portBridgeQueue.Set(u, bridge)
 		}
 	}
 }
 
 func (o *OvsdbProbe) OnOvsBridgeDel(monitor *ovsdb.OvsMonitor, uuid string, row *libovsdb.RowUpdate) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.forgetBridgeControllers(uuid)
+	delete(o.bridgeProtocols, uuid)
+
 	o.Graph.Lock()
 	defer o.Graph.Unlock()
 
@@ -107,8 +149,10 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 	defer o.Unlock()
 
 	// NOTE(safchain) is it a workaround ???, seems that the interface is not fully set
+	var ofport int64
 	switch row.New.Fields["ofport"].(type) {
 	case float64:
+		ofport = int64(row.New.Fields["ofport"].(float64))
 	default:
 		return
 	}
@@ -147,10 +191,13 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 	o.Graph.Lock()
 	defer o.Graph.Unlock()
 
+	o.Graph.Prefetch(graph.Metadata{"UUID": uuid}, graph.Metadata{"Name": name, "Driver": "openvswitch"})
+	defer o.Graph.EndPrefetch()
+
 	intf := o.Graph.LookupFirstNode(graph.Metadata{"UUID": uuid})
 	if intf == nil {
 		// added before by netlink ?
-		intf = o.Graph.LookupFirstNode(graph.Metadata{"Name": name, "Driver": "openvswitch"})
+		intf = lookupOvsLink(o.Graph, name, false)
 		if intf != nil {
 			o.Graph.AddMetadata(intf, "UUID", uuid)
 		}
@@ -175,7 +222,9 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 	}
 
 	if intf == nil {
-		intf = o.Graph.NewNode(graph.GenID(), graph.Metadata{"Name": name, "UUID": uuid})
+		if intf = o.Graph.NewNode(o.Graph.NewIDFrom(string(o.Root.ID), uuid), graph.Metadata{"Name": name, "UUID": uuid}); intf == nil {
+			return
+		}
 	} else if index > 0 {
 		// the index can be added after the interface creation, during an update so
 		// we need to check whether a interface with the same index exists at the first level
@@ -192,9 +241,21 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 		}
 	}
 
+	// LACP status of a bond slave
+	lacpCurrent, lacp := rowBool(row.New.Fields["lacp_current"])
+	if !lacp {
+		o.delInterfaceLACP(intf)
+	}
+
+	o.updateInterfaceUserspace(intf, name, itype, row)
+
 	tr := o.Graph.StartMetadataTransaction(intf)
 	defer tr.Commit()
 
+	if lacp {
+		tr.AddMetadata("LACPCurrent", lacpCurrent)
+	}
+
 	if index > 0 {
 		tr.AddMetadata("IfIndex", index)
 	}
@@ -203,6 +264,11 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 		tr.AddMetadata("MAC", mac)
 	}
 
+	// used to map the ports of the sFlow samples to the interfaces
+	if ofport > 0 {
+		tr.AddMetadata("OfPort", ofport)
+	}
+
 	if driver != "" {
 		tr.AddMetadata("Driver", driver)
 	}
@@ -229,6 +295,9 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 		if ip, ok := m.GoMap["remote_ip"]; ok {
 			tr.AddMetadata("RemoteIP", ip.(string))
 		}
+		if key, ok := m.GoMap["key"]; ok {
+			tr.AddMetadata("TunnelKey", key.(string))
+		}
 		m = row.New.Fields["status"].(libovsdb.OvsMap)
 		if iface, ok := m.GoMap["tunnel_egress_iface"]; ok {
 			tr.AddMetadata("TunEgressIface", iface.(string))
@@ -237,6 +306,10 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 			tr.AddMetadata("TunEgressIfaceCarrier", carrier.(string))
 		}
 
+	case "dpdk", "dpdkr", "dpdkvhostuser", "dpdkvhostuserclient", "dummy", "dummy-pmd":
+		// owned by OVS, the driver of the device being kept as DPDKDriver
+		tr.AddMetadata("Driver", "openvswitch")
+
 	case "patch":
 		// force the driver as it is not defined and we need it to delete properly
 		tr.AddMetadata("Driver", "openvswitch")
@@ -246,16 +319,16 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 
 			peerName := p.(string)
 
-			peer := o.Graph.LookupFirstNode(graph.Metadata{"Name": peerName, "Type": "patch"})
+			peer := o.Graph.LookupFirstNode(graph.Metadata{"Name": peerName, "Type": topology.PatchType})
 			if peer != nil {
 				if !o.Graph.AreLinked(intf, peer) {
-					o.Graph.Link(intf, peer, graph.Metadata{"RelationType": "layer2", "Type": "patch"})
+					o.Graph.Link(intf, peer, graph.Metadata{"RelationType": topology.Layer2Relation, "Type": topology.PatchType})
 				}
 			} else {
 				// lookup in the intf queue
 				for _, peer := range o.uuidToIntf {
 					if peer.Metadata()["Name"] == peerName && !o.Graph.AreLinked(intf, peer) {
-						o.Graph.Link(intf, peer, graph.Metadata{"RelationType": "layer2", "Type": "patch"})
+						o.Graph.Link(intf, peer, graph.Metadata{"RelationType": topology.Layer2Relation, "Type": topology.PatchType})
 					}
 				}
 			}
@@ -263,9 +336,9 @@ func (o *OvsdbProbe) OnOvsInterfaceAdd(monitor *ovsdb.OvsMonitor, uuid string, r
 	}
 
 	/* set pending interface for a port */
-	if port, ok := o.intfPortQueue[uuid]; ok {
-		o.Graph.Link(port, intf, graph.Metadata{"RelationType": "layer2"})
-		delete(o.intfPortQueue, uuid)
+	if port, ok := o.intfPortQueue.Get(uuid); ok {
+		o.Graph.Link(port.(*graph.Node), intf, graph.Metadata{"RelationType": topology.Layer2Relation})
+		o.intfPortQueue.Del(uuid)
 	}
 }
 
@@ -302,29 +375,19 @@ func (o *OvsdbProbe) OnOvsPortAdd(monitor *ovsdb.OvsMonitor, uuid string, row *l
 
 	port, ok := o.uuidToPort[uuid]
 	if !ok {
-		port = o.Graph.NewNode(graph.GenID(), graph.Metadata{
+		port = o.Graph.NewNode(o.Graph.NewIDFrom(string(o.Root.ID), uuid), graph.Metadata{
 			"UUID": uuid,
 			"Name": row.New.Fields["name"].(string),
-			"Type": "ovsport",
+			"Type": topology.OvsPortType,
 		})
-		o.uuidToPort[uuid] = port
-	}
-
-	// bond mode
-	if mode, ok := row.New.Fields["bond_mode"]; ok {
-		switch mode.(type) {
-		case string:
-			o.Graph.AddMetadata(port, "BondMode", mode.(string))
+		if port == nil {
+			return
 		}
+		o.uuidToPort[uuid] = port
 	}
 
-	// lacp
-	if lacp, ok := row.New.Fields["lacp"]; ok {
-		switch lacp.(type) {
-		case string:
-			o.Graph.AddMetadata(port, "LACP", lacp.(string))
-		}
-	}
+	// bond mode and lacp
+	o.updatePortBond(port, row)
 
 	// vlan tag
 	if tag, ok := row.New.Fields["tag"]; ok {
@@ -347,27 +410,27 @@ func (o *OvsdbProbe) OnOvsPortAdd(monitor *ovsdb.OvsMonitor, uuid string, row *l
 			u := i.(libovsdb.UUID).GoUuid
 			intf, ok := o.uuidToIntf[u]
 			if ok && !o.Graph.AreLinked(port, intf) {
-				o.Graph.Link(port, intf, graph.Metadata{"RelationType": "layer2"})
+				o.Graph.Link(port, intf, graph.Metadata{"RelationType": topology.Layer2Relation})
 			} else {
 				/* will be filled later when the interface update for this interface will be triggered */
-				o.intfPortQueue[u] = port
+				o.intfPortQueue.Set(u, port)
 			}
 		}
 	case libovsdb.UUID:
 		u := row.New.Fields["interfaces"].(libovsdb.UUID).GoUuid
 		intf, ok := o.uuidToIntf[u]
 		if ok && !o.Graph.AreLinked(port, intf) {
-			o.Graph.Link(port, intf, graph.Metadata{"RelationType": "layer2"})
+			o.Graph.Link(port, intf, graph.Metadata{"RelationType": topology.Layer2Relation})
 		} else {
 			/* will be filled later when the interface update for this interface will be triggered */
-			o.intfPortQueue[u] = port
+			o.intfPortQueue.Set(u, port)
 		}
 	}
 
 	/* set pending port of a container */
-	if bridge, ok := o.portBridgeQueue[uuid]; ok {
-		o.Graph.Link(bridge, port, graph.Metadata{"RelationType": "layer2"})
-		delete(o.portBridgeQueue, uuid)
+	if bridge, ok := o.portBridgeQueue.Get(uuid); ok {
+		o.Graph.Link(bridge.(*graph.Node), port, graph.Metadata{"RelationType": topology.Layer2Relation})
+		o.portBridgeQueue.Del(uuid)
 	}
 }
 
@@ -393,15 +456,52 @@ func (o *OvsdbProbe) OnOvsPortDel(monitor *ovsdb.OvsMonitor, uuid string, row *l
 }
 
 func (o *OvsdbProbe) Start() {
-	// TODO(safchain) add reconnection mechanism
+	common.RegisterCache(o.intfPortQueue)
+	common.RegisterCache(o.portBridgeQueue)
+
+	o.OvsMon.Heartbeat = common.NewHeartbeat("ovsdb")
+	o.OvsMon.Heartbeat.Idle()
+	common.RegisterHeartbeat(o.OvsMon.Heartbeat)
+
+	o.OvsMon.EchoHeartbeat = common.NewHeartbeat("ovsdb/echo")
+	o.OvsMon.EchoHeartbeat.Idle()
+	common.RegisterHeartbeat(o.OvsMon.EchoHeartbeat)
+
+	// versions may change across an OVS upgrade, refreshed on reconnection
+	o.OvsMon.OnConnected = o.updateVersions
+
 	err := o.OvsMon.StartMonitoring()
 	if err != nil {
 		logging.GetLogger().Errorf("Unable to start OVS monitoring: %s", err.Error())
+		return
+	}
+
+	if o.flowRulesInterval > 0 {
+		go o.flowRulesLoop(o.flowRulesInterval)
+	}
+
+	if o.multicast != nil {
+		go o.multicastLoop()
+	}
+}
+
+// Check connects to the OVSDB server and looks for the tables monitored, as
+// the monitoring does
+func (o *OvsdbProbe) Check() []probe.CheckResult {
+	hint := fmt.Sprintf("check that ovsdb-server listens on %s:%d, ie. ovs-appctl -t ovsdb-server ovsdb-server/add-remote ptcp:%d, or set ovs.ovsdb to its address", o.OvsMon.Addr, o.OvsMon.Port, o.OvsMon.Port)
+	return []probe.CheckResult{
+		probe.NewCheckResult("OVSDB reachability", o.OvsMon.Check(), hint),
 	}
 }
 
 func (o *OvsdbProbe) Stop() {
 	o.OvsMon.StopMonitoring()
+	close(o.quit)
+
+	common.UnregisterCache(o.intfPortQueue)
+	common.UnregisterCache(o.portBridgeQueue)
+	common.UnregisterHeartbeat(o.OvsMon.Heartbeat)
+	common.UnregisterHeartbeat(o.OvsMon.EchoHeartbeat)
 }
 
 func NewOvsdbProbe(g *graph.Graph, n *graph.Node, addr string, port int) *OvsdbProbe {
@@ -410,10 +510,33 @@ func NewOvsdbProbe(g *graph.Graph, n *graph.Node, addr string, port int) *OvsdbP
 		Root:            n,
 		uuidToIntf:      make(map[string]*graph.Node),
 		uuidToPort:      make(map[string]*graph.Node),
-		intfPortQueue:   make(map[string]*graph.Node),
-		portBridgeQueue: make(map[string]*graph.Node),
+		intfPortQueue:   newProbeCache("ovsdb/intfPortQueue"),
+		portBridgeQueue: newProbeCache("ovsdb/portBridgeQueue"),
 		OvsMon:          ovsdb.NewOvsMonitor(addr, port),
+		ruleStats:       &ofRuleStats{rules: make(map[string]map[string]*ofRule)},
+		dumpOfRules:     dumpOfRules,
+		dumpMdb:         dumpOvsMdb,
+		quit:            make(chan bool),
+
+		uuidToController:  make(map[string]*ovsController),
+		bridgeControllers: make(map[string][]string),
+		bridgeFailModes:   make(map[string]string),
+		bridgeProtocols:   make(map[string][]string),
+
+		vhostUserSocketDir: ovsDefaultVhostUserSocketDir,
+	}
+	o.intfPortQueue.OnEvict = func(key interface{}, value interface{}, reason string) {
+		logging.GetLogger().Debugf("Dropping pending layer2 link between port %s and interface %s, evicted on %s",
+			value.(*graph.Node).ID, key, reason)
 	}
+	o.intfPortQueue.Formatter = func(v interface{}) interface{} {
+		return v.(*graph.Node).ID
+	}
+	o.portBridgeQueue.OnEvict = func(key interface{}, value interface{}, reason string) {
+		logging.GetLogger().Debugf("Dropping pending layer2 link between bridge %s and port %s, evicted on %s",
+			value.(*graph.Node).ID, key, reason)
+	}
+	o.portBridgeQueue.Formatter = o.intfPortQueue.Formatter
 	o.OvsMon.AddMonitorHandler(o)
 
 	return o
@@ -426,5 +549,15 @@ func NewOvsdbProbeFromConfig(g *graph.Graph, n *graph.Node) *OvsdbProbe {
 		return nil
 	}
 
-	return NewOvsdbProbe(g, n, addr, port)
+	o := NewOvsdbProbe(g, n, addr, port)
+	o.flowRulesInterval = time.Duration(config.GetConfig().GetInt("ovs.flow_rules_interval")) * time.Second
+	o.OvsMon.EchoInterval = time.Duration(config.GetConfig().GetInt("ovs.echo_interval")) * time.Second
+	if dir := config.GetConfig().GetString("ovs.vhostuser_socket_dir"); dir != "" {
+		o.vhostUserSocketDir = dir
+	}
+
+	opts := NetLinkOptionsFromConfig("netlink").withDefaults()
+	o.multicast = newMulticastReader(opts.MulticastInterval, opts.MulticastGroups, opts.MulticastMaxEntries, opts.Logger)
+
+	return o
 }
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// interface types of the userspace datapath, never reported by netlink, the
+// dummy ones being the ports of the netdev datapath without DPDK
+var ovsUserspaceTypes = map[string]bool{
+	"dpdk":                true,
+	"dpdkr":               true,
+	"dpdkvhostuser":       true,
+	"dpdkvhostuserclient": true,
+	"dummy":               true,
+	"dummy-pmd":           true,
+}
+
+// metadata of the userspace interfaces set from the interface rows
+var ovsUserspaceKeys = []string{
+	"DPDKDevArgs", "PCIAddress", "VhostUserSocket", "VhostUserMode",
+	"RxQueues", "TxQueues", "RxQueueSize", "TxQueueSize", "PMDRxqAffinity",
+	"NumaID", "DPDKDriver", "State", "MTU", topology.StatisticsKey,
+}
+
+// counters of the statistics column of the interface rows, named as the
+// ones read from /proc/net/dev
+var ovsStatisticsCounters = map[string]string{
+	"rx_bytes":   "RxBytes",
+	"rx_packets": "RxPackets",
+	"rx_errors":  "RxErrors",
+	"rx_dropped": "RxDropped",
+	"tx_bytes":   "TxBytes",
+	"tx_packets": "TxPackets",
+	"tx_errors":  "TxErrors",
+	"tx_dropped": "TxDropped",
+}
+
+// directory of the sockets of the dpdkvhostuser interfaces, OVS being the
+// server, unless set by other_config:vhost-sock-dir
+const ovsDefaultVhostUserSocketDir = "/var/run/openvswitch"
+
+// rowMap returns the string values of a map column
+func rowMap(field interface{}) map[string]string {
+	m := make(map[string]string)
+	if field, ok := field.(libovsdb.OvsMap); ok {
+		for k, v := range field.GoMap {
+			key, kok := k.(string)
+			value, vok := v.(string)
+			if kok && vok {
+				m[key] = value
+			}
+		}
+	}
+	return m
+}
+
+// rowInt returns the value of an optional integer column and whether it is
+// set, an unset column being an empty set
+func rowInt(field interface{}) (int64, bool) {
+	switch field := field.(type) {
+	case float64:
+		return int64(field), true
+	case int64:
+		return field, true
+	case int:
+		return int64(field), true
+	}
+	return 0, false
+}
+
+// setInt sets the metadata from an integer option, ignored if not a number
+func setInt(m graph.Metadata, key string, value string) {
+	if value == "" {
+		return
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		m[key] = i
+	}
+}
+
+// interfaceUserspaceMetadata returns the metadata of an interface of the
+// userspace datapath from its row: its DPDK options, its PMD and queues
+// configuration, its link state and its counters, taken from the
+// statistics column as there are no netlink counters for such interfaces.
+func interfaceUserspaceMetadata(name string, itype string, row *libovsdb.RowUpdate, socketDir string) graph.Metadata {
+	options := rowMap(row.New.Fields["options"])
+	config := rowMap(row.New.Fields["other_config"])
+	status := rowMap(row.New.Fields["status"])
+
+	m := graph.Metadata{}
+
+	switch itype {
+	case "dpdk":
+		if devargs := options["dpdk-devargs"]; devargs != "" {
+			m["DPDKDevArgs"] = devargs
+			if pciAddressRegexp.MatchString(devargs) {
+				m["PCIAddress"] = devargs
+			}
+		}
+	case "dpdkvhostuser":
+		// the socket is created by OVS, QEMU connecting to it
+		m["VhostUserSocket"] = filepath.Join(socketDir, name)
+		m["VhostUserMode"] = "server"
+	case "dpdkvhostuserclient":
+		if path := options["vhost-server-path"]; path != "" {
+			m["VhostUserSocket"] = path
+		}
+		m["VhostUserMode"] = "client"
+	}
+
+	setInt(m, "RxQueues", options["n_rxq"])
+	setInt(m, "TxQueues", options["n_txq"])
+	setInt(m, "RxQueueSize", options["n_rxq_desc"])
+	setInt(m, "TxQueueSize", options["n_txq_desc"])
+	if affinity := config["pmd-rxq-affinity"]; affinity != "" {
+		m["PMDRxqAffinity"] = affinity
+	}
+
+	setInt(m, "NumaID", status["numa_id"])
+	if driver := status["driver_name"]; driver != "" {
+		m["DPDKDriver"] = driver
+	}
+
+	switch rowString(row.New.Fields["link_state"]) {
+	case "up":
+		m["State"] = "UP"
+	case "down":
+		m["State"] = "DOWN"
+	}
+	if mtu, ok := rowInt(row.New.Fields["mtu"]); ok {
+		m["MTU"] = mtu
+	}
+
+	if counters, ok := row.New.Fields["statistics"].(libovsdb.OvsMap); ok {
+		statistics := make(map[string]interface{})
+		for k, v := range counters.GoMap {
+			key, _ := k.(string)
+			if name, ok := ovsStatisticsCounters[key]; ok {
+				if value, ok := rowInt(v); ok {
+					statistics[name] = value
+				}
+			}
+		}
+		if len(statistics) > 0 {
+			m[topology.StatisticsKey] = statistics
+		}
+	}
+
+	return m
+}
+
+// updateInterfaceUserspace sets the metadata of an interface of the
+// userspace datapath and links it to the host, netlink not being aware of
+// it. The metadata are removed once the interface isn't a userspace one
+// anymore. Called with the probe and the graph locked.
+func (o *OvsdbProbe) updateInterfaceUserspace(intf *graph.Node, name string, itype string, row *libovsdb.RowUpdate) {
+	userspace := ovsUserspaceTypes[itype]
+
+	m := make(graph.Metadata)
+	for k, v := range intf.Metadata() {
+		m[k] = v
+	}
+	if userspace || ovsUserspaceTypes[rowString(m["Type"])] {
+		for _, k := range ovsUserspaceKeys {
+			delete(m, k)
+		}
+	}
+	if userspace {
+		for k, v := range interfaceUserspaceMetadata(name, itype, row, o.vhostUserSocketDir) {
+			m[k] = v
+		}
+	}
+
+	if !reflect.DeepEqual(m, intf.Metadata()) {
+		o.Graph.SetMetadata(intf, m)
+	}
+
+	if userspace && !o.Graph.AreLinked(o.Root, intf) {
+		o.Graph.Link(o.Root, intf, graph.Metadata{"RelationType": topology.OwnershipRelation})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func ovsMap(m map[string]interface{}) libovsdb.OvsMap {
+	goMap := make(map[interface{}]interface{})
+	for k, v := range m {
+		goMap[k] = v
+	}
+	return libovsdb.OvsMap{GoMap: goMap}
+}
+
+func userspaceRow(name string, itype string, options map[string]interface{}, statistics map[string]interface{}) *libovsdb.RowUpdate {
+	return ovsRow(map[string]interface{}{
+		"name":         name,
+		"type":         itype,
+		"ofport":       float64(1),
+		"mac_in_use":   "52:54:00:00:00:01",
+		"ifindex":      float64(0),
+		"link_state":   "up",
+		"mtu":          float64(1500),
+		"options":      ovsMap(options),
+		"other_config": ovsMap(map[string]interface{}{"pmd-rxq-affinity": "0:3,1:7"}),
+		"status":       ovsMap(map[string]interface{}{"driver_name": "net_ixgbe", "numa_id": "0"}),
+		"statistics":   ovsMap(statistics),
+		"external_ids": ovsMap(nil),
+	})
+}
+
+func TestOvsUserspaceInterfaces(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.SetStrictSchema(true)
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	g.Unlock()
+
+	o := NewOvsdbProbe(g, root, "127.0.0.1", 0)
+
+	node := func(uuid string) *graph.Node {
+		g.RLock()
+		defer g.RUnlock()
+
+		return g.LookupFirstNode(graph.Metadata{"UUID": uuid})
+	}
+
+	o.OnOvsInterfaceAdd(nil, "dpdk0-uuid", userspaceRow("dpdk0", "dpdk",
+		map[string]interface{}{"dpdk-devargs": "0000:01:00.0", "n_rxq": "2", "n_rxq_desc": "2048"},
+		map[string]interface{}{"rx_packets": float64(10), "rx_bytes": float64(1000), "tx_packets": float64(5), "rx_missed_errors": float64(1)}))
+	o.OnOvsInterfaceAdd(nil, "vhu0-uuid", userspaceRow("vhu0", "dpdkvhostuser", nil, nil))
+	o.OnOvsInterfaceAdd(nil, "vhuc0-uuid", userspaceRow("vhuc0", "dpdkvhostuserclient",
+		map[string]interface{}{"vhost-server-path": "/var/lib/libvirt/qemu/vhuc0.sock"}, nil))
+
+	dpdk0 := node("dpdk0-uuid")
+	m := dpdk0.Metadata()
+	if m["Type"] != "dpdk" || m["Driver"] != "openvswitch" || m["DPDKDriver"] != "net_ixgbe" || m["PCIAddress"] != "0000:01:00.0" {
+		t.Errorf("Wrong metadata of a DPDK port: %v", m)
+	}
+	if m["RxQueues"] != int64(2) || m["RxQueueSize"] != int64(2048) || m["PMDRxqAffinity"] != "0:3,1:7" || m["NumaID"] != int64(0) {
+		t.Errorf("Wrong queues configuration of a DPDK port: %v", m)
+	}
+	if m["State"] != "UP" || m["MTU"] != int64(1500) {
+		t.Errorf("Wrong link state of a DPDK port: %v", m)
+	}
+	statistics, _ := m["Statistics"].(map[string]interface{})
+	if len(statistics) != 3 || statistics["RxPackets"] != int64(10) || statistics["RxBytes"] != int64(1000) || statistics["TxPackets"] != int64(5) {
+		t.Errorf("Wrong statistics of a DPDK port: %v", m["Statistics"])
+	}
+
+	if m := node("vhu0-uuid").Metadata(); m["VhostUserSocket"] != "/var/run/openvswitch/vhu0" || m["VhostUserMode"] != "server" {
+		t.Errorf("Wrong metadata of a vhost-user port: %v", m)
+	}
+	if m := node("vhuc0-uuid").Metadata(); m["VhostUserSocket"] != "/var/lib/libvirt/qemu/vhuc0.sock" || m["VhostUserMode"] != "client" {
+		t.Errorf("Wrong metadata of a vhost-user client port: %v", m)
+	}
+
+	// owned by the host, netlink not reporting them
+	g.RLock()
+	for _, uuid := range []string{"dpdk0-uuid", "vhu0-uuid", "vhuc0-uuid"} {
+		if n := node(uuid); !g.AreLinked(root, n) {
+			t.Errorf("Interface %s not linked to the host", uuid)
+		}
+	}
+	g.RUnlock()
+
+	// the counters and the state are updated from the row
+	row := userspaceRow("dpdk0", "dpdk", map[string]interface{}{"dpdk-devargs": "0000:01:00.0"},
+		map[string]interface{}{"rx_packets": float64(20)})
+	row.New.Fields["link_state"] = "down"
+	o.OnOvsInterfaceUpdate(nil, "dpdk0-uuid", row)
+
+	m = dpdk0.Metadata()
+	if m["State"] != "DOWN" || m["RxQueues"] != nil {
+		t.Errorf("Metadata of a DPDK port not updated: %v", m)
+	}
+	if statistics, _ := m["Statistics"].(map[string]interface{}); statistics["RxPackets"] != int64(20) {
+		t.Errorf("Statistics of a DPDK port not updated: %v", m["Statistics"])
+	}
+
+	// removed with their row
+	o.OnOvsInterfaceDel(nil, "vhu0-uuid", nil)
+	if node("vhu0-uuid") != nil {
+		t.Error("vhost-user port not removed")
+	}
+}
@@ -23,6 +23,11 @@
 package probes
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redhat-cip/skydive/common"
 	"github.com/redhat-cip/skydive/config"
 	"github.com/redhat-cip/skydive/logging"
 	"github.com/redhat-cip/skydive/probe"
@@ -33,7 +38,8 @@ type TopologyProbeBundle struct {
 	probe.ProbeBundle
 }
 
-func NewTopologyProbeBundleFromConfig(g *graph.Graph, n *graph.Node) *TopologyProbeBundle {
+// topologyProbesFromConfig returns the types of the configured probes
+func topologyProbesFromConfig() []string {
 	list := config.GetConfig().GetStringSlice("agent.topology.probes")
 
 	// FIX(safchain) once viper setdefault on nested key will be fixed move this
@@ -42,6 +48,12 @@ func NewTopologyProbeBundleFromConfig(g *graph.Graph, n *graph.Node) *TopologyPr
 		list = []string{"netlink", "netns"}
 	}
 
+	return list
+}
+
+func NewTopologyProbeBundleFromConfig(g *graph.Graph, n *graph.Node) *TopologyProbeBundle {
+	list := topologyProbesFromConfig()
+
 	logging.GetLogger().Infof("Topology probes: %v", list)
 
 	probes := make(map[string]probe.Probe)
@@ -52,13 +64,17 @@ func NewTopologyProbeBundleFromConfig(g *graph.Graph, n *graph.Node) *TopologyPr
 
 		switch t {
 		case "netlink":
-			probes[t] = NewNetLinkProbe(g, n)
+			probes[t] = NewNetLinkProbe(g, n, NetLinkOptionsFromConfig("netlink"))
 		case "netns":
 			probes[t] = NewNetNSProbeFromConfig(g, n)
 		case "ovsdb":
 			probes[t] = NewOvsdbProbeFromConfig(g, n)
 		case "docker":
 			probes[t] = NewDockerProbeFromConfig(g, n)
+		case "listening":
+			probes[t] = NewListeningProbeFromConfig(g, n)
+		case "clock":
+			probes[t] = NewClockProbeFromConfig(g, n)
 		case "neutron":
 			neutron, err := NewNeutronMapperFromConfig(g)
 			if err != nil {
@@ -73,6 +89,77 @@ func NewTopologyProbeBundleFromConfig(g *graph.Graph, n *graph.Node) *TopologyPr
 	}
 
 	p := probe.NewProbeBundle(probes)
+	// the ovsdb probe gets the OVS interfaces in its start, before netlink
+	// correlates them
+	p.StartOrder = config.GetConfig().GetStringSlice("agent.topology.start_order")
 
 	return &TopologyProbeBundle{*p}
 }
+
+// CheckTopologyProbesFromConfig instantiates the configured probes, without
+// starting them, and runs their checks. The probes which can't be
+// instantiated report why, ie. the netns one when not run as root.
+func CheckTopologyProbesFromConfig(g *graph.Graph, n *graph.Node) map[string][]probe.CheckResult {
+	results := make(map[string][]probe.CheckResult)
+	probes := make(map[string]probe.Probe)
+
+	for _, t := range topologyProbesFromConfig() {
+		var p probe.Probe
+		var err error
+
+		switch t {
+		case "netlink":
+			p = NewNetLinkProbe(g, n, NetLinkOptionsFromConfig("netlink"))
+		case "netns":
+			p, err = NewNetNSProbe(g, n, NetNSOptionsFromConfig())
+		case "ovsdb":
+			if o := NewOvsdbProbeFromConfig(g, n); o != nil {
+				p = o
+			} else {
+				err = errors.New("invalid OVSDB address")
+			}
+		case "docker":
+			p, err = NewDockerProbe(g, n, config.GetConfig().GetString("docker.url"), NetNSOptionsFromConfig())
+		case "listening":
+			p = NewListeningProbeFromConfig(g, n)
+		case "clock":
+			p = NewClockProbeFromConfig(g, n)
+		case "neutron":
+			// the mapper authenticates against Keystone when created
+			p, err = NewNeutronMapperFromConfig(g)
+		default:
+			err = fmt.Errorf("unknown probe type %s", t)
+		}
+
+		if err != nil {
+			results[t] = []probe.CheckResult{probe.NewCheckResult("configuration", err, "check the probe settings of the configuration file")}
+		} else {
+			probes[t] = p
+		}
+	}
+
+	for name, checks := range probe.NewProbeBundle(probes).Check() {
+		results[name] = checks
+	}
+
+	return results
+}
+
+// newProbeCache returns a cache bounded according to the agent configuration,
+// it has to be registered to be exposed through the API.
+func newProbeCache(name string) *common.BoundedCache {
+	cfg := config.GetConfig()
+
+	maxSize := cfg.GetInt("agent.topology.cache.max_size")
+	maxAge := time.Duration(cfg.GetInt("agent.topology.cache.max_age")) * time.Second
+
+	return common.NewBoundedCache(name, maxSize, maxAge)
+}
+
+func nodeIDs(nodes []*graph.Node) []graph.Identifier {
+	ids := make([]graph.Identifier, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	return ids
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := newTokenBucket(0, 10); b != nil || b.take(time.Now()) != 0 {
+		t.Fatal("The rate shouldn't be limited")
+	}
+
+	b := newTokenBucket(10, 2)
+	now := time.Now()
+
+	if b.take(now) != 0 || b.take(now) != 0 {
+		t.Error("The burst should be taken without waiting")
+	}
+	if d := b.take(now); d != 100*time.Millisecond {
+		t.Errorf("Expected to wait for a token, got %s", d)
+	}
+
+	// the token owed is paid back first
+	if d := b.take(now.Add(100 * time.Millisecond)); d != 100*time.Millisecond {
+		t.Errorf("Expected to wait for a token, got %s", d)
+	}
+
+	// refilled up to the burst
+	now = now.Add(10 * time.Second)
+	if b.take(now) != 0 || b.take(now) != 0 || b.take(now) == 0 {
+		t.Error("The bucket should be refilled up to the burst")
+	}
+}
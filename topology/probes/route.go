@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+var routeScopes = map[netlink.Scope]string{
+	netlink.SCOPE_UNIVERSE: "universe",
+	netlink.SCOPE_SITE:     "site",
+	netlink.SCOPE_LINK:     "link",
+	netlink.SCOPE_HOST:     "host",
+	netlink.SCOPE_NOWHERE:  "nowhere",
+}
+
+type routesByDestination []interface{}
+
+func (r routesByDestination) Len() int      { return len(r) }
+func (r routesByDestination) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByDestination) Less(i, j int) bool {
+	ri, rj := r[i].(map[string]interface{}), r[j].(map[string]interface{})
+	if ri["Destination"] != rj["Destination"] {
+		return ri["Destination"].(string) < rj["Destination"].(string)
+	}
+	return ri["Priority"].(int) < rj["Priority"].(int)
+}
+
+// routeMetadata returns a route of the main table, interfaces being
+// referenced by name as indexes are meaningless outside of the namespace.
+func routeMetadata(route *netlink.Route, names map[int]string) map[string]interface{} {
+	m := map[string]interface{}{
+		"Family":      "IPv4",
+		"Destination": "default",
+		"Scope":       routeScopes[route.Scope],
+		"Protocol":    route.Protocol,
+		"Priority":    route.Priority,
+	}
+
+	if route.Dst != nil {
+		m["Destination"] = route.Dst.String()
+		if route.Dst.IP.To4() == nil {
+			m["Family"] = "IPv6"
+		}
+	}
+	if route.Gw != nil {
+		m["Gateway"] = route.Gw.String()
+		if route.Gw.To4() == nil {
+			m["Family"] = "IPv6"
+		}
+	}
+	if route.Src != nil {
+		m["Source"] = route.Src.String()
+	}
+	if name, ok := names[route.LinkIndex]; ok {
+		m["Interface"] = name
+	}
+
+	return m
+}
+
+// getRoutes returns the routes of the namespace the probe is running in, it
+// has to be called without holding the graph lock.
+func (u *NetLinkProbe) getRoutes() []interface{} {
+	names := make(map[int]string)
+	if links, err := netlink.LinkList(); err == nil {
+		for _, link := range links {
+			names[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+
+	routes := []interface{}{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlink.RouteList(nil, family)
+		if err != nil {
+			u.logger.Errorf("Unable to list routes of %s: %s", u.Root.ID, err.Error())
+			continue
+		}
+
+		for i := range list {
+			routes = append(routes, routeMetadata(&list[i], names))
+		}
+	}
+
+	// stable order so that unchanged tables don't trigger updates
+	sort.Sort(routesByDestination(routes))
+
+	return routes
+}
+
+// updateRoutes records the routing table on the root node of the probe, the
+// host or the namespace node.
+func (u *NetLinkProbe) updateRoutes() {
+	routes := u.getRoutes()
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	u.Graph.AddMetadata(u.Root, "Routes", routes)
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRouteMetadata(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/24")
+	names := map[int]string{2: "eth0"}
+
+	m := routeMetadata(&netlink.Route{LinkIndex: 2, Dst: dst, Scope: netlink.SCOPE_LINK, Src: net.ParseIP("10.0.0.1")}, names)
+	if m["Destination"] != "10.0.0.0/24" || m["Interface"] != "eth0" || m["Scope"] != "link" || m["Source"] != "10.0.0.1" || m["Family"] != "IPv4" {
+		t.Errorf("Wrong route metadata: %v", m)
+	}
+
+	m = routeMetadata(&netlink.Route{LinkIndex: 3, Gw: net.ParseIP("fe80::1")}, names)
+	if m["Destination"] != "default" || m["Gateway"] != "fe80::1" || m["Family"] != "IPv6" {
+		t.Errorf("Wrong default route metadata: %v", m)
+	}
+	if _, ok := m["Interface"]; ok {
+		t.Errorf("Unknown interface shouldn't be set: %v", m)
+	}
+
+	routes := []interface{}{
+		routeMetadata(&netlink.Route{Dst: dst, Priority: 10}, names),
+		routeMetadata(&netlink.Route{Gw: net.ParseIP("10.0.0.254")}, names),
+		routeMetadata(&netlink.Route{Dst: dst, Priority: 1}, names),
+	}
+	sort.Sort(routesByDestination(routes))
+
+	if routes[0].(map[string]interface{})["Priority"] != 1 || routes[2].(map[string]interface{})["Destination"] != "default" {
+		t.Errorf("Routes not sorted: %v", routes)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const ETHTOOL_GDRVINFO = 0x00000003
+
+// SRIOVKey holds the virtual functions of a physical function, the VFs
+// being matched by their PCIAddress wherever they are, ie. moved into the
+// namespace of a container or passed through to a VM.
+const SRIOVKey = "SRIOV"
+
+// ethtoolDrvInfo is the struct ethtool_drvinfo of ETHTOOL_GDRVINFO
+type ethtoolDrvInfo struct {
+	Cmd         uint32
+	Driver      [32]byte
+	Version     [32]byte
+	FwVersion   [32]byte
+	BusInfo     [32]byte
+	EromVersion [32]byte
+	Reserved2   [12]byte
+	NPrivFlags  uint32
+	NStats      uint32
+	TestinfoLen uint32
+	EedumpLen   uint32
+	RegdumpLen  uint32
+}
+
+var pciAddressRegexp = regexp.MustCompile(`^[0-9a-f]{4,}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// getPCIAddress returns the PCI address of the device of an interface of
+// the namespace of the thread, empty for the non PCI devices.
+func getPCIAddress(name string) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return ""
+	}
+	defer syscall.Close(fd)
+
+	info := &ethtoolDrvInfo{Cmd: ETHTOOL_GDRVINFO}
+
+	var ifr ethtoolIfreq
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	ifr.data = uintptr(unsafe.Pointer(info))
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return ""
+	}
+
+	if busInfo := string(bytes.Trim(info.BusInfo[:], "\x00")); pciAddressRegexp.MatchString(busInfo) {
+		return busInfo
+	}
+	return ""
+}
+
+// sriovReader reads the virtual functions of the physical functions from
+// sysfs, which only shows the devices of the namespace it was mounted in,
+// so only the probe of the host namespace reads them.
+type sriovReader struct {
+	sysfs string
+}
+
+type vfsByIndex []interface{}
+
+func (s vfsByIndex) Len() int      { return len(s) }
+func (s vfsByIndex) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s vfsByIndex) Less(i, j int) bool {
+	return s[i].(map[string]interface{})["Index"].(int64) < s[j].(map[string]interface{})["Index"].(int64)
+}
+
+func (s *sriovReader) readInt(path string) (int64, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return i, err == nil
+}
+
+// read returns the SR-IOV metadata of an interface, nil if it isn't a
+// physical function. A VF bound to vfio-pci, passed through to a VM, has no
+// interface anymore, its driver tells where it is.
+func (s *sriovReader) read(name string) map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+
+	dir := filepath.Join(s.sysfs, name, "device")
+
+	total, ok := s.readInt(filepath.Join(dir, "sriov_totalvfs"))
+	if !ok || total == 0 {
+		return nil
+	}
+	num, _ := s.readInt(filepath.Join(dir, "sriov_numvfs"))
+
+	links, _ := filepath.Glob(filepath.Join(dir, "virtfn*"))
+
+	vfs := []interface{}{}
+	for _, link := range links {
+		index, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(link), "virtfn"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+
+		vf := map[string]interface{}{
+			"Index":      index,
+			"PCIAddress": filepath.Base(target),
+		}
+		if driver, err := os.Readlink(filepath.Join(link, "driver")); err == nil {
+			vf["Driver"] = filepath.Base(driver)
+		}
+		if netdevs, err := ioutil.ReadDir(filepath.Join(link, "net")); err == nil && len(netdevs) == 1 {
+			vf["Name"] = netdevs[0].Name()
+		}
+
+		vfs = append(vfs, vf)
+	}
+	sort.Sort(vfsByIndex(vfs))
+
+	return map[string]interface{}{
+		"TotalVFs": total,
+		"NumVFs":   num,
+		"VFs":      vfs,
+	}
+}
+
+// refreshPhysicalFunctions updates the virtual functions of the physical
+// functions of the probe, the VFs changing without event on their PF, ie.
+// when bound to another driver or moved to another namespace.
+func (u *NetLinkProbe) refreshPhysicalFunctions() {
+	if u.sriov == nil {
+		return
+	}
+
+	u.Graph.RLock()
+	pfs := make(map[graph.Identifier]string)
+	for _, n := range u.Graph.LookupChildren(u.Root, nil) {
+		if name, ok := n.Metadata()["Name"].(string); ok && n.Metadata()[SRIOVKey] != nil {
+			pfs[n.ID] = name
+		}
+	}
+	u.Graph.RUnlock()
+
+	if len(pfs) == 0 {
+		return
+	}
+
+	sriov := make(map[graph.Identifier]map[string]interface{})
+	for id, name := range pfs {
+		sriov[id] = u.sriov.read(name)
+	}
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for id, m := range sriov {
+		n := u.Graph.GetNode(id)
+		if n == nil || reflect.DeepEqual(n.Metadata()[SRIOVKey], m) {
+			continue
+		}
+		if m != nil {
+			u.Graph.AddMetadata(n, SRIOVKey, m)
+			continue
+		}
+
+		metadata := make(graph.Metadata)
+		for k, v := range n.Metadata() {
+			if k != SRIOVKey {
+				metadata[k] = v
+			}
+		}
+		u.Graph.SetMetadata(n, metadata)
+	}
+}
+
+// newSRIOVReader returns nil if the sysfs directory isn't given
+func newSRIOVReader(sysfs string) *sriovReader {
+	if sysfs == "" {
+		return nil
+	}
+	return &sriovReader{sysfs: sysfs}
+}
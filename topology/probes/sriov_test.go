@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSRIOVReader(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "skydive_sriov")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tmp)
+
+	devices := filepath.Join(tmp, "devices")
+	sysfs := filepath.Join(tmp, "net")
+
+	// PF with a VF bound to ixgbevf and a VF passed through with vfio-pci
+	writeCgroupFiles(t, filepath.Join(devices, "0000:03:00.0"), map[string]string{
+		"sriov_totalvfs": "8\n",
+		"sriov_numvfs":   "2\n",
+	})
+	writeCgroupFiles(t, filepath.Join(devices, "0000:03:02.0", "net", "eth2"), nil)
+	writeCgroupFiles(t, filepath.Join(devices, "0000:03:02.2"), nil)
+	writeCgroupFiles(t, filepath.Join(tmp, "drivers", "ixgbevf"), nil)
+	writeCgroupFiles(t, filepath.Join(tmp, "drivers", "vfio-pci"), nil)
+	writeCgroupFiles(t, filepath.Join(sysfs, "eth1"), nil)
+	writeCgroupFiles(t, filepath.Join(sysfs, "lo"), nil)
+
+	links := map[string]string{
+		filepath.Join(sysfs, "eth1", "device"):            filepath.Join(devices, "0000:03:00.0"),
+		filepath.Join(devices, "0000:03:00.0", "virtfn0"): filepath.Join(devices, "0000:03:02.0"),
+		filepath.Join(devices, "0000:03:00.0", "virtfn1"): filepath.Join(devices, "0000:03:02.2"),
+		filepath.Join(devices, "0000:03:02.0", "driver"):  filepath.Join(tmp, "drivers", "ixgbevf"),
+		filepath.Join(devices, "0000:03:02.2", "driver"):  filepath.Join(tmp, "drivers", "vfio-pci"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	s := newSRIOVReader(sysfs)
+
+	expected := map[string]interface{}{
+		"TotalVFs": int64(8),
+		"NumVFs":   int64(2),
+		"VFs": []interface{}{
+			map[string]interface{}{"Index": int64(0), "PCIAddress": "0000:03:02.0", "Driver": "ixgbevf", "Name": "eth2"},
+			map[string]interface{}{"Index": int64(1), "PCIAddress": "0000:03:02.2", "Driver": "vfio-pci"},
+		},
+	}
+	if m := s.read("eth1"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Wrong SR-IOV metadata, expected %v, got %v", expected, m)
+	}
+
+	if m := s.read("lo"); m != nil {
+		t.Errorf("lo isn't a physical function: %v", m)
+	}
+
+	if s = newSRIOVReader(""); s.read("eth1") != nil {
+		t.Error("SR-IOV shouldn't be read without sysfs")
+	}
+}
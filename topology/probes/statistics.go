@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// counters of /proc/net/dev, in the order of the receive then transmit
+// columns, empty names being the skipped columns
+var procNetDevCounters = []string{
+	"RxBytes", "RxPackets", "RxErrors", "RxDropped", "", "", "", "",
+	"TxBytes", "TxPackets", "TxErrors", "TxDropped",
+}
+
+// counters whose rate is tracked to detect failing interfaces
+var errorCounters = []string{"RxErrors", "TxErrors", "RxDropped", "TxDropped"}
+
+type countersSample struct {
+	time     time.Time
+	counters map[string]int64
+}
+
+// statisticsReader reads the interface counters, /proc/thread-self/net/dev
+// giving the interfaces of the namespace of the calling thread, and keeps
+// the samples of the error window to compute the error rates.
+type statisticsReader struct {
+	path            string
+	interval        time.Duration
+	errorsWindow    time.Duration
+	errorsThreshold float64
+	last            time.Time
+	samples         map[string][]countersSample
+}
+
+// read returns the counters of the interfaces by name
+func (s *statisticsReader) read() (map[string]map[string]int64, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	interfaces := make(map[string]map[string]int64)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the header lines have no colon before the counters
+		i := strings.Index(scanner.Text(), ":")
+		if i < 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(scanner.Text()[:i])
+		fields := strings.Fields(scanner.Text()[i+1:])
+
+		counters := make(map[string]int64)
+		for j, key := range procNetDevCounters {
+			if key == "" || j >= len(fields) {
+				continue
+			}
+			if value, err := strconv.ParseInt(fields[j], 10, 64); err == nil {
+				counters[key] = value
+			}
+		}
+		interfaces[name] = counters
+	}
+
+	return interfaces, scanner.Err()
+}
+
+// due returns whether the counters have to be refreshed
+func (s *statisticsReader) due(now time.Time) bool {
+	if now.Sub(s.last) < s.interval {
+		return false
+	}
+	s.last = now
+
+	return true
+}
+
+// errorRates records a sample of the interface and returns the rates per
+// minute of the error counters over the window, nil until there are two
+// samples. A counter going backward, ie. after a driver reload, restarts
+// the window.
+func (s *statisticsReader) errorRates(name string, now time.Time, counters map[string]int64) map[string]float64 {
+	samples := s.samples[name]
+	if n := len(samples); n > 0 {
+		for _, key := range errorCounters {
+			if counters[key] < samples[n-1].counters[key] {
+				samples = nil
+				break
+			}
+		}
+	}
+
+	// the oldest sample within the window is the base of the rates
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].time) > s.errorsWindow {
+		i++
+	}
+	samples = append(samples[i:], countersSample{time: now, counters: counters})
+	s.samples[name] = samples
+
+	elapsed := now.Sub(samples[0].time)
+	if len(samples) < 2 || elapsed <= 0 {
+		return nil
+	}
+
+	rates := make(map[string]float64)
+	for _, key := range errorCounters {
+		rates[key] = float64(counters[key]-samples[0].counters[key]) * float64(time.Minute) / float64(elapsed)
+	}
+	return rates
+}
+
+// errorsHigh returns whether one of the error rates crosses the threshold,
+// a threshold of 0 disables the flag
+func (s *statisticsReader) errorsHigh(rates map[string]float64) bool {
+	if s.errorsThreshold <= 0 {
+		return false
+	}
+	for _, rate := range rates {
+		if rate >= s.errorsThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops the samples of the interfaces which are gone
+func (s *statisticsReader) forget(interfaces map[string]map[string]int64) {
+	for name := range s.samples {
+		if _, ok := interfaces[name]; !ok {
+			delete(s.samples, name)
+		}
+	}
+}
+
+// updateStatistics records the counters of the interfaces as their
+// Statistics metadata, along with the error rates, once per interval, and
+// flags the interfaces with a high error rate with ErrorsHigh. It has to be
+// called from the thread of the namespace without holding the graph lock.
+func (u *NetLinkProbe) updateStatistics() {
+	now := time.Now()
+	if u.statistics == nil || !u.statistics.due(now) {
+		return
+	}
+
+	interfaces, err := u.statistics.read()
+	if err != nil {
+		u.logger.Debugf("Unable to read the interface counters: %s", err.Error())
+		return
+	}
+	u.statistics.forget(interfaces)
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	for name, counters := range interfaces {
+		intf := u.Graph.LookupFirstChild(u.Root, graph.Metadata{"Name": name})
+		if intf == nil {
+			continue
+		}
+
+		statistics := make(map[string]interface{})
+		for k, v := range counters {
+			statistics[k] = v
+		}
+
+		rates := u.statistics.errorRates(name, now, counters)
+		if rates != nil {
+			statistics["ErrorRates"] = rates
+		}
+
+		m := make(graph.Metadata)
+		for k, v := range intf.Metadata() {
+			if k != "ErrorsHigh" {
+				m[k] = v
+			}
+		}
+		m[topology.StatisticsKey] = statistics
+		if u.statistics.errorsHigh(rates) {
+			m["ErrorsHigh"] = true
+		}
+
+		if !reflect.DeepEqual(m, intf.Metadata()) {
+			u.Graph.SetMetadata(intf, m)
+		}
+	}
+}
+
+// newStatisticsReader returns nil if the counters are not polled.
+func newStatisticsReader(interval, errorsWindow time.Duration, errorsThreshold float64) *statisticsReader {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &statisticsReader{
+		path:            "/proc/thread-self/net/dev",
+		interval:        interval,
+		errorsWindow:    errorsWindow,
+		errorsThreshold: errorsThreshold,
+		samples:         make(map[string][]countersSample),
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const procNetDevHeader = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+`
+
+func writeProcNetDev(t *testing.T, path string, rxErrors int) {
+	content := procNetDevHeader +
+		"    lo:  1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0\n" +
+		fmt.Sprintf("  eth0: 50000     400 %4d    3    0     0          0         0    20000     300    0    1    0     0       0          0\n", rxErrors)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestStatisticsErrorRates(t *testing.T) {
+	s := newStatisticsReader(time.Second, time.Minute, 10)
+
+	now := time.Now()
+	counters := map[string]int64{"RxErrors": 100}
+	if rates := s.errorRates("eth0", now, counters); rates != nil {
+		t.Errorf("Expected no rate with a single sample: %v", rates)
+	}
+
+	rates := s.errorRates("eth0", now.Add(30*time.Second), map[string]int64{"RxErrors": 104})
+	if rates["RxErrors"] != 8 || rates["TxErrors"] != 0 || s.errorsHigh(rates) {
+		t.Errorf("Expected 8 errors per minute, not high: %v", rates)
+	}
+
+	// the first sample left the window
+	rates = s.errorRates("eth0", now.Add(90*time.Second), map[string]int64{"RxErrors": 124})
+	if rates["RxErrors"] != 20 || !s.errorsHigh(rates) {
+		t.Errorf("Expected 20 errors per minute, high: %v", rates)
+	}
+
+	// counters reset
+	if rates = s.errorRates("eth0", now.Add(95*time.Second), map[string]int64{"RxErrors": 2}); rates != nil {
+		t.Errorf("Expected the window to restart on reset: %v", rates)
+	}
+
+	s.forget(map[string]map[string]int64{"lo": nil})
+	if _, ok := s.samples["eth0"]; ok {
+		t.Error("Samples of a removed interface not forgotten")
+	}
+}
+
+func TestUpdateStatistics(t *testing.T) {
+	f, err := ioutil.TempFile("", "skydive_net_dev")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g.SetStrictSchema(true)
+
+	g.Lock()
+	root := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host", "Type": "host"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	g.Link(root, eth0, graph.Metadata{"RelationType": "ownership"})
+	g.Unlock()
+
+	u := NewNetLinkProbe(g, root, NetLinkOptions{})
+	u.statistics = newStatisticsReader(time.Nanosecond, time.Minute, 10)
+	u.statistics.path = f.Name()
+
+	writeProcNetDev(t, f.Name(), 0)
+	u.updateStatistics()
+
+	stats, ok := eth0.Metadata()["Statistics"].(map[string]interface{})
+	if !ok || stats["RxBytes"] != int64(50000) || stats["TxDropped"] != int64(1) || stats["RxErrors"] != int64(0) {
+		t.Fatalf("Wrong statistics: %v", eth0.Metadata())
+	}
+	if _, ok := stats["ErrorRates"]; ok {
+		t.Error("Expected no error rate with a single sample")
+	}
+
+	writeProcNetDev(t, f.Name(), 1000)
+	u.updateStatistics()
+
+	if eth0.Metadata()["ErrorsHigh"] != true {
+		t.Errorf("Interface with errors not flagged: %v", eth0.Metadata())
+	}
+
+	// no new error, the interface is only flagged once the old sample left
+	// the window
+	u.statistics.errorsWindow = 0
+	u.updateStatistics()
+
+	if _, ok := eth0.Metadata()["ErrorsHigh"]; ok {
+		t.Errorf("Interface without new errors still flagged: %v", eth0.Metadata())
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sysctlReader reads a list of networking sysctls, /proc/sys/net giving
+// the values of the namespace of the calling thread.
+type sysctlReader struct {
+	root     string
+	keys     []string
+	interval time.Duration
+	last     time.Time
+}
+
+// sysctlPath returns the path of a sysctl, given either with dots, ie.
+// net.ipv4.ip_forward, or with slashes.
+func (s *sysctlReader) sysctlPath(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.Replace(key, ".", "/", -1)
+	}
+	return filepath.Join(s.root, key)
+}
+
+// read returns the values of the sysctls, the missing ones, ie. the
+// bridge ones when br_netfilter is not loaded, being skipped.
+func (s *sysctlReader) read() map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, key := range s.keys {
+		value, err := ioutil.ReadFile(s.sysctlPath(key))
+		if err != nil {
+			continue
+		}
+		m[key] = strings.Join(strings.Fields(string(value)), " ")
+	}
+
+	return m
+}
+
+// due returns whether the sysctls have to be refreshed
+func (s *sysctlReader) due(now time.Time) bool {
+	if now.Sub(s.last) < s.interval {
+		return false
+	}
+	s.last = now
+
+	return true
+}
+
+// updateSysctls records the sysctls on the root node of the probe, the host
+// or the namespace node, once per interval. It has to be called from the
+// thread of the namespace without holding the graph lock.
+func (u *NetLinkProbe) updateSysctls() {
+	if u.sysctls == nil || !u.sysctls.due(time.Now()) {
+		return
+	}
+	sysctls := u.sysctls.read()
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	u.Graph.AddMetadata(u.Root, "Sysctl", sysctls)
+}
+
+// newSysctlReader returns nil if there is no sysctl to record.
+func newSysctlReader(keys []string, interval time.Duration) *sysctlReader {
+	if len(keys) == 0 || interval <= 0 {
+		return nil
+	}
+
+	return &sysctlReader{
+		root:     "/proc/sys",
+		keys:     keys,
+		interval: interval,
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSysctlReader(t *testing.T) {
+	root, err := ioutil.TempDir("", "skydive_sysctl")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "net/ipv4/conf/all"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "net/ipv4/ip_forward"), []byte("1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "net/ipv4/conf/all/rp_filter"), []byte("2\n"), 0644)
+
+	s := &sysctlReader{
+		root:     root,
+		keys:     []string{"net.ipv4.ip_forward", "net/ipv4/conf/all/rp_filter", "net.bridge.bridge-nf-call-iptables"},
+		interval: 30 * time.Second,
+	}
+
+	m := s.read()
+	if len(m) != 2 || m["net.ipv4.ip_forward"] != "1" || m["net/ipv4/conf/all/rp_filter"] != "2" {
+		t.Errorf("Wrong sysctls, missing ones should be skipped: %v", m)
+	}
+
+	now := time.Now()
+	if !s.due(now) || s.due(now.Add(time.Second)) || !s.due(now.Add(30*time.Second)) {
+		t.Error("Sysctls should be refreshed once per interval")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/socketplane/libovsdb"
+
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+const ovsKernelModuleVersionPath = "/sys/module/openvswitch/version"
+
+// setRootVersions records the versions of a component on the host node, the
+// versions that couldn't be determined are omitted.
+func setRootVersions(g *graph.Graph, root *graph.Node, component string, versions map[string]interface{}) {
+	for k, v := range versions {
+		if v == "" {
+			delete(versions, k)
+		}
+	}
+
+	if len(versions) == 0 {
+		return
+	}
+
+	g.Lock()
+	g.AddMetadata(root, component, versions)
+	g.Unlock()
+}
+
+func getOvsKernelModuleVersion() string {
+	version, err := ioutil.ReadFile(ovsKernelModuleVersionPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// ovsdbString returns the value of a string column, optional columns being
+// represented as empty sets when not set.
+func ovsdbString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// updateVersions records the versions of OVS, the ones of Open vSwitch and
+// of its database schema being read from the Open_vSwitch table, so that
+// they're the ones of the server monitored, not of the binaries of the
+// agent host.
+func (o *OvsdbProbe) updateVersions() {
+	versions := map[string]interface{}{
+		"KernelModuleVersion": getOvsKernelModuleVersion(),
+	}
+
+	/* see retrieveSFlowProbeUUID, no way to send a null condition */
+	condition := libovsdb.NewCondition("_uuid", "!=", libovsdb.UUID{GoUuid: "abc"})
+	selectOp := libovsdb.Operation{
+		Op:      "select",
+		Table:   "Open_vSwitch",
+		Columns: []string{"ovs_version", "db_version"},
+		Where:   []interface{}{condition},
+	}
+
+	result, err := o.OvsMon.OvsClient.Exec(selectOp)
+	if err != nil {
+		logging.GetLogger().Debugf("Unable to get the Open vSwitch version: %s", err.Error())
+	} else {
+		for _, r := range result {
+			for _, row := range r.Rows {
+				versions["Version"] = ovsdbString(row["ovs_version"])
+				versions["DBVersion"] = ovsdbString(row["db_version"])
+			}
+		}
+	}
+
+	setRootVersions(o.Graph, o.Root, "OVS", versions)
+}
+
+func (probe *DockerProbe) updateVersions() {
+	version, err := probe.client.Version()
+	if err != nil {
+		logging.GetLogger().Debugf("Unable to get the Docker version: %s", err.Error())
+		return
+	}
+
+	setRootVersions(probe.Graph, probe.Root, "Docker", map[string]interface{}{
+		"Version":    version.Version,
+		"APIVersion": version.ApiVersion,
+	})
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package probes
+
+import (
+	"testing"
+)
+
+func TestOvsdbString(t *testing.T) {
+	if v := ovsdbString("2.4.1"); v != "2.4.1" {
+		t.Errorf("Wrong version: %s", v)
+	}
+
+	// unset optional column
+	if v := ovsdbString([]interface{}{"set", []interface{}{}}); v != "" {
+		t.Errorf("No version expected: %s", v)
+	}
+}
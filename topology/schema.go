@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package topology
+
+import (
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// Types of the nodes created by the probes and the analyzer linkers, other
+// netlink and OVS interface types are registered below.
+const (
+	HostType        = "host"
+	NetNSType       = "netns"
+	ContainerType   = "container"
+	DeviceType      = "device"
+	BridgeType      = "bridge"
+	VethType        = "veth"
+	VrfType         = "vrf"
+	OpenvswitchType = "openvswitch"
+	OvsBridgeType   = "ovsbridge"
+	OvsPortType     = "ovsport"
+	PatchType       = "patch"
+	LagType         = "lag"
+	VFType          = "vf"
+	// virtual node of a layer2 broadcast domain, computed by the analyzer
+	BroadcastDomainType = "broadcastdomain"
+)
+
+// StatisticsKey holds the interface counters, updated all the time
+const StatisticsKey = "Statistics"
+
+// OvsDatapathKey flags the datapath device of the OVS kernel module, ie.
+// ovs-system, kept in the graph for its statistics but not linked to the
+// OVS ports and hidden by default
+const OvsDatapathKey = "OvsDatapath"
+
+// IsOvsDatapath returns whether a node is the OVS datapath device
+func IsOvsDatapath(n *graph.Node) bool {
+	return n.Metadata()[OvsDatapathKey] == true
+}
+
+// ClockKey holds the synchronization status of the clock of a host, its
+// offset being refreshed on an interval
+const ClockKey = "Clock"
+
+// DowntimeKey holds the downtime of an interface, the seconds since it went
+// DOWN as Current and the seconds it was DOWN during the last 24 hours as
+// Total24h, refreshed on an interval
+const DowntimeKey = "Downtime"
+
+// CgroupKey holds the resource limits of a container, CgroupUsageKey its
+// resource usage, refreshed on an interval
+const (
+	CgroupKey      = "Cgroup"
+	CgroupUsageKey = "CgroupUsage"
+)
+
+// Relation types of the edges
+const (
+	OwnershipRelation      = "ownership"
+	Layer2Relation         = "layer2"
+	MembershipRelation     = "membership"
+	RepresentationRelation = "representation"
+	SRIOVRelation          = "sriov"
+	Layer3Relation         = "layer3"
+)
+
+// interface types reported by netlink, the link types and kinds
+var netlinkTypes = []string{
+	DeviceType, BridgeType, VethType, VrfType, OpenvswitchType,
+	"bond", "team", "vlan", "vxlan", "geneve", "macvlan", "macvtap", "ipvlan",
+	"dummy", "ifb", "tun", "tap", "tuntap", "gre", "gretap", "ip6gre",
+	"ip6gretap", "ipip", "ip6tnl", "sit", "vti", "vti6", "gtp", "nlmon",
+	"can", "vcan", "ipoib", "wireguard",
+}
+
+// interface types reported by OVS
+var ovsInterfaceTypes = []string{
+	PatchType, "internal", "system", "gre", "vxlan", "geneve", "stt", "lisp",
+	"erspan", "ip6erspan", "tap", "dpdk", "dpdkr", "dpdkvhostuser",
+	"dpdkvhostuserclient", "dummy", "dummy-pmd",
+}
+
+func init() {
+	graph.RegisterNodeTypes(HostType, NetNSType, ContainerType, OvsBridgeType, OvsPortType, LagType, VFType, BroadcastDomainType)
+	graph.RegisterNodeTypes(netlinkTypes...)
+	graph.RegisterNodeTypes(ovsInterfaceTypes...)
+
+	graph.RegisterRelationType(OwnershipRelation, graph.RelationConstraints{Tree: true})
+	graph.RegisterRelationType(Layer2Relation, graph.RelationConstraints{Symmetric: true})
+	graph.RegisterRelationType(Layer3Relation, graph.RelationConstraints{Symmetric: true})
+	graph.RegisterRelationTypes(MembershipRelation, RepresentationRelation, SRIOVRelation)
+
+	graph.RegisterMetadataPersistence(graph.VolatilePersistence, StatisticsKey, CgroupUsageKey, ClockKey, DowntimeKey)
+}
+
+// NodePriority gives the priority of the nodes of an agent once its graph
+// limits are approached. The derived or heuristic nodes, and the nodes
+// without type only known from their statistics or the OVS database, are
+// the first refused. The host, its namespaces, containers and bridges, the
+// structure the other nodes hang on, are the last.
+func NodePriority(m graph.Metadata) graph.NodePriority {
+	switch t, _ := m["Type"].(string); t {
+	case "", LagType, VFType, BroadcastDomainType:
+		return graph.LowPriority
+	case HostType, NetNSType, ContainerType, OvsBridgeType:
+		return graph.HighPriority
+	}
+	return graph.NormalPriority
+}
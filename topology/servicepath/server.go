@@ -0,0 +1,55 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package servicepath
+
+import (
+	shttp "github.com/redhat-cip/skydive/http"
+)
+
+const (
+	Namespace = "Path"
+)
+
+// PathServer broadcasts the path events to the websocket clients
+type PathServer struct {
+	WSServer    *shttp.WSServer
+	PathTracker *PathTracker
+}
+
+func (s *PathServer) OnPathEvent(eventType string, e *PathEvent) {
+	s.WSServer.BroadcastWSMessage(shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      eventType,
+		Obj:       e,
+	})
+}
+
+func NewServer(t *PathTracker, server *shttp.WSServer) *PathServer {
+	s := &PathServer{
+		PathTracker: t,
+		WSServer:    server,
+	}
+	t.AddEventListener(s)
+
+	return s
+}
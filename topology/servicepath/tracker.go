@@ -0,0 +1,576 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package servicepath
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/logging"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+// States of a tracked path, a path is broken when one of its endpoints
+// can't be found or when they aren't connected anymore.
+const (
+	PathConnected = "connected"
+	PathBroken    = "broken"
+)
+
+// Hop is a node of a path
+type Hop struct {
+	ID   graph.Identifier
+	Host string
+	Name string `json:",omitempty"`
+	Type string `json:",omitempty"`
+}
+
+// PathState is the current state of a tracked path, Since being the time of
+// its last change.
+type PathState struct {
+	UUID    string
+	Name    string
+	State   string
+	Reason  string `json:",omitempty"`
+	Hops    []Hop
+	Since   time.Time
+	Changes int
+}
+
+// ReferredNodes returns the hops of the path
+func (s *PathState) ReferredNodes() []graph.Identifier {
+	ids := make([]graph.Identifier, len(s.Hops))
+	for i, h := range s.Hops {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+// PathEvent is sent, as PathChanged or PathBroken, when the hops or the
+// state of a path change, with the hops added and removed.
+type PathEvent struct {
+	UUID     string
+	Name     string
+	State    string
+	Previous string
+	Reason   string `json:",omitempty"`
+	Hops     []Hop
+	Added    []Hop
+	Removed  []Hop
+}
+
+// EventVariables gives the event to the tests of the alerts selecting it
+func (e *PathEvent) EventVariables() map[string]interface{} {
+	return map[string]interface{}{
+		"UUID":     e.UUID,
+		"Name":     e.Name,
+		"State":    e.State,
+		"Previous": e.Previous,
+		"Reason":   e.Reason,
+		"Hops":     len(e.Hops),
+		"Added":    len(e.Added),
+		"Removed":  len(e.Removed),
+	}
+}
+
+type PathEventListener interface {
+	OnPathEvent(eventType string, e *PathEvent)
+}
+
+type trackedPath struct {
+	spec    *api.TrackedPath
+	state   *PathState
+	members map[graph.Identifier]bool
+}
+
+// PathTracker keeps the shortest paths between the endpoints of the tracked
+// paths up to date. A path is recomputed when one of its nodes or of their
+// edges changes, a broken one on each addition, and all of them every
+// interval to catch the shortcuts appearing away from the paths.
+type PathTracker struct {
+	Graph          *graph.Graph
+	PathHandler    api.ApiHandler
+	Relations      []string
+	MaxHops        int
+	Interval       time.Duration
+	watcher        api.StoppableWatcher
+	subscription   *common.BusSubscription
+	paths          map[string]*trackedPath
+	pathsLock      sync.RWMutex
+	eventListeners map[PathEventListener]PathEventListener
+	quit           chan bool
+	wg             sync.WaitGroup
+}
+
+type nodesByID []*graph.Node
+
+func (s nodesByID) Len() int           { return len(s) }
+func (s nodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s nodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (t *PathTracker) AddEventListener(l PathEventListener) {
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	t.eventListeners[l] = l
+}
+
+func (t *PathTracker) DelEventListener(l PathEventListener) {
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	delete(t.eventListeners, l)
+}
+
+// selectNode returns the single node returned by the query
+func (t *PathTracker) selectNode(query string) (*graph.Node, error) {
+	tr := graph.NewGremlinTraversalParser(strings.NewReader(query), t.Graph)
+	tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
+
+	ts, err := tr.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*graph.Node
+	for _, v := range res.Values() {
+		if n, ok := v.(*graph.Node); ok && !graph.IsTombstone(n) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) != 1 {
+		return nil, fmt.Errorf("%s returned %d nodes", query, len(nodes))
+	}
+	return nodes[0], nil
+}
+
+func (t *PathTracker) edgeFilter(p *api.TrackedPath) graph.Metadata {
+	relations := p.Relations
+	if len(relations) == 0 {
+		relations = t.Relations
+	}
+
+	within := make([]interface{}, len(relations))
+	for i, r := range relations {
+		within[i] = r
+	}
+	return graph.Metadata{"RelationType": graph.Within(within...)}
+}
+
+// neighbors returns the nodes linked to the node by the edges matching the
+// filter, sorted by ID so that the same path is returned among the shortest
+// ones.
+func (t *PathTracker) neighbors(n *graph.Node, em graph.Metadata) []*graph.Node {
+	var neighbors []*graph.Node
+	for _, e := range t.Graph.GetNodeEdges(n) {
+		if !e.MatchMetadata(em) {
+			continue
+		}
+
+		parent, child := t.Graph.GetEdgeNodes(e)
+		if parent == nil || child == nil {
+			continue
+		}
+
+		neighbor := parent
+		if parent.ID == n.ID {
+			neighbor = child
+		}
+		if !graph.IsTombstone(neighbor) {
+			neighbors = append(neighbors, neighbor)
+		}
+	}
+	sort.Sort(nodesByID(neighbors))
+
+	return neighbors
+}
+
+// shortestPath does a breadth-first search from the source, returns nil if
+// the destination is more than MaxHops away.
+func (t *PathTracker) shortestPath(src *graph.Node, dst *graph.Node, em graph.Metadata) []*graph.Node {
+	prev := map[graph.Identifier]*graph.Node{src.ID: nil}
+	frontier := []*graph.Node{src}
+
+	for depth := 0; src.ID != dst.ID && len(frontier) > 0; depth++ {
+		if depth >= t.MaxHops {
+			return nil
+		}
+
+		var next []*graph.Node
+		for _, n := range frontier {
+			for _, neighbor := range t.neighbors(n, em) {
+				if _, ok := prev[neighbor.ID]; ok {
+					continue
+				}
+				prev[neighbor.ID] = n
+				next = append(next, neighbor)
+			}
+		}
+		if _, ok := prev[dst.ID]; ok {
+			break
+		}
+		frontier = next
+	}
+
+	if _, ok := prev[dst.ID]; !ok {
+		return nil
+	}
+
+	var path []*graph.Node
+	for n := dst; n != nil; n = prev[n.ID] {
+		path = append([]*graph.Node{n}, path...)
+	}
+	return path
+}
+
+// stillValid returns whether the hops are still linked by edges matching the
+// filter
+func (t *PathTracker) stillValid(hops []Hop, em graph.Metadata) bool {
+	for i := 0; i < len(hops)-1; i++ {
+		n := t.Graph.GetNode(hops[i].ID)
+		if n == nil || graph.IsTombstone(n) {
+			return false
+		}
+
+		linked := false
+		for _, neighbor := range t.neighbors(n, em) {
+			if neighbor.ID == hops[i+1].ID {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			return false
+		}
+	}
+	return true
+}
+
+func hopOf(n *graph.Node) Hop {
+	m := n.Metadata()
+	name, _ := m["Name"].(string)
+	typ, _ := m["Type"].(string)
+
+	return Hop{ID: n.ID, Host: n.Host(), Name: name, Type: typ}
+}
+
+// diffHops returns the hops of b not in a and the ones of a not in b
+func diffHops(a []Hop, b []Hop) (added []Hop, removed []Hop) {
+	ids := func(hops []Hop) map[graph.Identifier]bool {
+		m := make(map[graph.Identifier]bool)
+		for _, h := range hops {
+			m[h.ID] = true
+		}
+		return m
+	}
+
+	in, out := ids(a), ids(b)
+	for _, h := range b {
+		if !in[h.ID] {
+			added = append(added, h)
+		}
+	}
+	for _, h := range a {
+		if !out[h.ID] {
+			removed = append(removed, h)
+		}
+	}
+	return
+}
+
+func sameHops(a []Hop, b []Hop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// compute returns the current state and hops of the path
+func (t *PathTracker) compute(p *trackedPath) (string, string, []Hop) {
+	src, err := t.selectNode(p.spec.Src)
+	if err != nil {
+		return PathBroken, "source: " + err.Error(), nil
+	}
+
+	dst, err := t.selectNode(p.spec.Dst)
+	if err != nil {
+		return PathBroken, "destination: " + err.Error(), nil
+	}
+
+	em := t.edgeFilter(p.spec)
+
+	nodes := t.shortestPath(src, dst, em)
+	if nodes == nil {
+		return PathBroken, fmt.Sprintf("no path within %d hops", t.MaxHops), nil
+	}
+
+	hops := make([]Hop, len(nodes))
+	for i, n := range nodes {
+		hops[i] = hopOf(n)
+	}
+
+	// among the shortest paths the current one is kept
+	current := p.state.Hops
+	if p.state.State == PathConnected && len(current) == len(hops) &&
+		current[0].ID == src.ID && current[len(current)-1].ID == dst.ID && t.stillValid(current, em) {
+		return PathConnected, "", current
+	}
+
+	return PathConnected, "", hops
+}
+
+// update recomputes the path and notifies its change, if not initial. The
+// graph lock and the paths lock have to be held.
+func (t *PathTracker) update(p *trackedPath, initial bool) {
+	state, reason, hops := t.compute(p)
+
+	old := p.state
+	p.state = &PathState{
+		UUID:    p.spec.UUID,
+		Name:    p.spec.Name,
+		State:   state,
+		Reason:  reason,
+		Hops:    hops,
+		Since:   old.Since,
+		Changes: old.Changes,
+	}
+
+	p.members = make(map[graph.Identifier]bool)
+	for _, h := range hops {
+		p.members[h.ID] = true
+	}
+
+	var eventType string
+	switch {
+	case initial:
+		p.state.Since = t.Graph.Now()
+		return
+	case state == PathBroken && old.State != PathBroken:
+		eventType = "PathBroken"
+	case state == PathConnected && (old.State != PathConnected || !sameHops(old.Hops, hops)):
+		eventType = "PathChanged"
+	default:
+		return
+	}
+
+	p.state.Since = t.Graph.Now()
+	p.state.Changes++
+
+	added, removed := diffHops(old.Hops, hops)
+	event := &PathEvent{
+		UUID:     p.spec.UUID,
+		Name:     p.spec.Name,
+		State:    state,
+		Previous: old.State,
+		Reason:   reason,
+		Hops:     hops,
+		Added:    added,
+		Removed:  removed,
+	}
+
+	logging.GetLogger().Infof("Path %s (%s) %s, %d hops added, %d removed", p.spec.UUID, p.spec.Name, state, len(added), len(removed))
+
+	for _, l := range t.eventListeners {
+		l.OnPathEvent(eventType, event)
+	}
+	common.DefaultBus.Publish(common.PathTopic, eventType, event)
+}
+
+// endpoint returns whether the node is one of the ends of the path
+func (p *trackedPath) endpoint(id graph.Identifier) bool {
+	hops := p.state.Hops
+	return len(hops) > 0 && (hops[0].ID == id || hops[len(hops)-1].ID == id)
+}
+
+// OnBusEvent recomputes the paths touched by the graph event, the updates
+// of a node only mattering for the endpoints, which may not match their
+// query anymore, and for the nodes being deleted, ie. tombstoned.
+func (t *PathTracker) OnBusEvent(e *common.BusEvent) {
+	ev, ok := e.Obj.(*graph.GraphEvent)
+	if !ok || ev.Graph != t.Graph {
+		return
+	}
+
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	for _, p := range t.paths {
+		var touched bool
+
+		switch e.Type {
+		case "BulkChange":
+			touched = true
+		case "NodeAdded":
+			touched = p.state.State == PathBroken
+		case "NodeUpdated":
+			touched = p.endpoint(ev.Node.ID) || (p.members[ev.Node.ID] && graph.IsTombstone(ev.Node))
+		case "NodeDeleted":
+			touched = p.members[ev.Node.ID]
+		case "EdgeAdded", "EdgeUpdated", "EdgeDeleted":
+			touched = e.Type == "EdgeAdded" && p.state.State == PathBroken
+			for _, n := range []*graph.Node{ev.Parent, ev.Child} {
+				if n != nil && p.members[n.ID] {
+					touched = true
+				}
+			}
+		}
+
+		if touched {
+			t.update(p, false)
+		}
+	}
+}
+
+// Resync recomputes all the paths
+func (t *PathTracker) Resync() {
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	for _, p := range t.paths {
+		t.update(p, false)
+	}
+}
+
+// SetPath starts tracking a path, or restarts it if its endpoints changed
+func (t *PathTracker) SetPath(spec *api.TrackedPath) {
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	p := &trackedPath{spec: spec, state: &PathState{}}
+	t.update(p, true)
+	t.paths[spec.UUID] = p
+
+	logging.GetLogger().Debugf("Path %s (%s) tracked, %s", spec.UUID, spec.Name, p.state.State)
+}
+
+func (t *PathTracker) DeletePath(id string) {
+	t.pathsLock.Lock()
+	defer t.pathsLock.Unlock()
+
+	delete(t.paths, id)
+}
+
+func (t *PathTracker) PathStates() map[string]interface{} {
+	t.pathsLock.RLock()
+	defer t.pathsLock.RUnlock()
+
+	states := make(map[string]interface{})
+	for id, p := range t.paths {
+		states[id] = p.state
+	}
+	return states
+}
+
+func (t *PathTracker) onApiWatcherEvent(action string, id string, resource api.ApiResource) {
+	switch action {
+	case "init", "create", "set", "update":
+		t.SetPath(resource.(*api.TrackedPath))
+	case "expire", "delete":
+		t.DeletePath(id)
+	}
+}
+
+func (t *PathTracker) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.Resync()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+func (t *PathTracker) Start() {
+	t.watcher = t.PathHandler.AsyncWatch(t.onApiWatcherEvent)
+	t.subscription = common.DefaultBus.Subscribe("paths", config.GetConfig().GetInt("graph.bus.queue_size"), t, common.GraphTopic)
+
+	if t.Interval > 0 {
+		t.wg.Add(1)
+		go t.run()
+	}
+}
+
+func (t *PathTracker) Stop() {
+	if t.watcher != nil {
+		t.watcher.Stop()
+	}
+	if t.subscription != nil {
+		common.DefaultBus.Unsubscribe(t.subscription)
+	}
+	close(t.quit)
+	t.wg.Wait()
+}
+
+func NewPathTracker(g *graph.Graph, ph api.ApiHandler, relations []string, maxHops int, interval time.Duration) *PathTracker {
+	return &PathTracker{
+		Graph:          g,
+		PathHandler:    ph,
+		Relations:      relations,
+		MaxHops:        maxHops,
+		Interval:       interval,
+		paths:          make(map[string]*trackedPath),
+		eventListeners: make(map[PathEventListener]PathEventListener),
+		quit:           make(chan bool),
+	}
+}
+
+func NewPathTrackerFromConfig(g *graph.Graph, ph api.ApiHandler) *PathTracker {
+	cfg := config.GetConfig()
+
+	interval := time.Duration(cfg.GetInt("analyzer.path.interval")) * time.Second
+
+	return NewPathTracker(g, ph, cfg.GetStringSlice("analyzer.path.relations"), cfg.GetInt("analyzer.path.max_hops"), interval)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package servicepath
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redhat-cip/skydive/api"
+	apiclient "github.com/redhat-cip/skydive/api/client"
+	"github.com/redhat-cip/skydive/common"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+type pathEvents struct {
+	types  []string
+	events []*PathEvent
+}
+
+func (p *pathEvents) OnPathEvent(eventType string, e *PathEvent) {
+	p.types = append(p.types, eventType)
+	p.events = append(p.events, e)
+}
+
+func hopNames(hops []Hop) []string {
+	var names []string
+	for _, h := range hops {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func sameNames(hops []Hop, names ...string) bool {
+	got := hopNames(hops)
+	if len(got) != len(names) {
+		return false
+	}
+	for i := range names {
+		if got[i] != names[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPathTracker(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tracker := NewPathTracker(g, nil, []string{"layer2", "ownership"}, 32, time.Minute)
+	listener := &pathEvents{}
+	tracker.AddEventListener(listener)
+
+	node := func(name string) *graph.Node {
+		return g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "device"})
+	}
+	link := func(parent, child *graph.Node) *graph.Edge {
+		e := g.NewEdge(graph.GenID(), parent, child, graph.Metadata{"RelationType": "layer2"})
+		tracker.OnBusEvent(&common.BusEvent{Type: "EdgeAdded", Obj: &graph.GraphEvent{Graph: g, Edge: e, Parent: parent, Child: child}})
+		return e
+	}
+	unlink := func(e *graph.Edge, parent, child *graph.Node) {
+		g.DelEdge(e)
+		tracker.OnBusEvent(&common.BusEvent{Type: "EdgeDeleted", Obj: &graph.GraphEvent{Graph: g, Edge: e, Parent: parent, Child: child}})
+	}
+
+	c1, veth1, br, veth2, c2 := node("c1"), node("veth1"), node("br"), node("veth2"), node("c2")
+	link(c1, veth1)
+	e := link(veth1, br)
+	link(br, veth2)
+	link(veth2, c2)
+
+	spec := &api.TrackedPath{UUID: "path1", Name: "c1-c2", Src: `G.V().Has("Name", "c1")`, Dst: `G.V().Has("Name", "c2")`}
+	tracker.SetPath(spec)
+
+	state := tracker.PathStates()["path1"].(*PathState)
+	if state.State != PathConnected || !sameNames(state.Hops, "c1", "veth1", "br", "veth2", "c2") {
+		t.Fatalf("Wrong initial path: %+v", state)
+	}
+
+	// a path of the same length doesn't replace the current one
+	x, y, z := node("x"), node("y"), node("z")
+	link(c1, x)
+	link(x, y)
+	link(y, z)
+	link(z, c2)
+	if len(listener.types) != 0 {
+		t.Fatalf("Path shouldn't have changed: %v", listener.types)
+	}
+
+	unlink(e, veth1, br)
+	if len(listener.types) != 1 || listener.types[0] != "PathChanged" {
+		t.Fatalf("Expected a PathChanged event, got %v", listener.types)
+	}
+	ev := listener.events[0]
+	if !sameNames(ev.Added, "x", "y", "z") || !sameNames(ev.Removed, "veth1", "br", "veth2") || ev.Previous != PathConnected {
+		t.Errorf("Wrong path diff: %+v", ev)
+	}
+
+	// the edges of other relation types aren't followed
+	g.NewEdge(graph.GenID(), c1, c2, graph.Metadata{"RelationType": "membership"})
+	tracker.Resync()
+	if len(listener.types) != 1 {
+		t.Errorf("Membership edge shouldn't be followed: %v", listener.types)
+	}
+
+	// endpoint gone, the path is broken but kept
+	g.DelNode(c2)
+	tracker.OnBusEvent(&common.BusEvent{Type: "NodeDeleted", Obj: &graph.GraphEvent{Graph: g, Node: c2}})
+	if len(listener.types) != 2 || listener.types[1] != "PathBroken" {
+		t.Fatalf("Expected a PathBroken event, got %v", listener.types)
+	}
+	state = tracker.PathStates()["path1"].(*PathState)
+	if state.State != PathBroken || len(state.Hops) != 0 || state.Changes != 2 {
+		t.Errorf("Path should be broken: %+v", state)
+	}
+	if vars := listener.events[1].EventVariables(); vars["State"] != PathBroken || vars["Removed"] != 5 {
+		t.Errorf("Wrong event variables: %v", vars)
+	}
+
+	// back, shortcut taken
+	c2 = node("c2")
+	tracker.OnBusEvent(&common.BusEvent{Type: "NodeAdded", Obj: &graph.GraphEvent{Graph: g, Node: c2}})
+	link(veth1, c2)
+	if len(listener.types) != 3 || listener.types[2] != "PathChanged" || listener.events[2].Previous != PathBroken {
+		t.Fatalf("Expected a PathChanged event from broken, got %v", listener.types)
+	}
+	if !sameNames(listener.events[2].Hops, "c1", "veth1", "c2") {
+		t.Errorf("Wrong restored path: %v", hopNames(listener.events[2].Hops))
+	}
+
+	tracker.DeletePath("path1")
+	if len(tracker.PathStates()) != 0 {
+		t.Error("Path should be removed")
+	}
+}
+
+// TestClientPathState checks that the path states of the client package
+// give the same JSON
+func TestClientPathState(t *testing.T) {
+	state := &PathState{
+		UUID:    "uuid",
+		Name:    "name",
+		State:   "broken",
+		Reason:  "no path",
+		Hops:    []Hop{{ID: "eth0", Host: "host1", Name: "eth0", Type: "device"}},
+		Since:   time.Now().UTC(),
+		Changes: 3,
+	}
+
+	data, _ := json.Marshal(state)
+	var clientState apiclient.PathState
+	if err := json.Unmarshal(data, &clientState); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var expected, got map[string]interface{}
+	json.Unmarshal(data, &expected)
+	data, _ = json.Marshal(&clientState)
+	json.Unmarshal(data, &got)
+
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Client path state should be the same: %v, expected %v", got, expected)
+	}
+}
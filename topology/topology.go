@@ -82,7 +82,7 @@ func LookupNodeFromNodePathString(g *graph.Graph, s string) *graph.Node {
 		return nil
 	}
 
-	node := g.LookupFirstNode(m)
+	node := lookupByNameOrAlias(g.LookupFirstNode, m)
 	if node == nil {
 		return nil
 	}
@@ -93,7 +93,10 @@ func LookupNodeFromNodePathString(g *graph.Graph, s string) *graph.Node {
 			return nil
 		}
 
-		node = g.LookupFirstChild(node, m)
+		parent := node
+		node = lookupByNameOrAlias(func(m graph.Metadata) *graph.Node {
+			return g.LookupFirstChild(parent, m)
+		}, m)
 		if node == nil {
 			return nil
 		}
@@ -102,10 +105,36 @@ func LookupNodeFromNodePathString(g *graph.Graph, s string) *graph.Node {
 	return node
 }
 
+// lookupByNameOrAlias looks up a node by name, then by interface alias
+func lookupByNameOrAlias(lookup func(m graph.Metadata) *graph.Node, m graph.Metadata) *graph.Node {
+	if node := lookup(m); node != nil {
+		return node
+	}
+
+	return lookup(graph.Metadata{"Alias": m["Name"], "Type": m["Type"]})
+}
+
 func GraphPath(g *graph.Graph, n *graph.Node) string {
-	nodes := g.LookupShortestPath(n, graph.Metadata{"Type": "host"}, graph.Metadata{"RelationType": "ownership"})
+	nodes := g.LookupShortestPath(n, graph.Metadata{"Type": HostType}, graph.Metadata{"RelationType": OwnershipRelation})
 	if len(nodes) > 0 {
 		return NodePath(nodes).Marshal()
 	}
 	return ""
 }
+
+// HardwareIdentity returns the metadata key and value identifying the
+// device of a physical NIC whatever its name and index: its permanent MAC
+// or else its PCI address. Empty for the virtual devices, the ones with a
+// kind, and the devices with none of them, ie. the loopback.
+func HardwareIdentity(m graph.Metadata) (string, string) {
+	if _, ok := m["InfoKind"]; ok {
+		return "", ""
+	}
+	if mac, _ := m["PermanentMAC"].(string); mac != "" {
+		return "PermanentMAC", mac
+	}
+	if address, _ := m["PCIAddress"].(string); address != "" {
+		return "PCIAddress", address
+	}
+	return "", ""
+}
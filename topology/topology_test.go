@@ -72,3 +72,25 @@ func TestMarshal(t *testing.T) {
 		t.Errorf("Shouldn't have any nodes returned")
 	}
 }
+
+func TestLookupByAlias(t *testing.T) {
+	g := newGraph(t)
+
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	eth0 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Alias": "uplink to core", "Type": "device"})
+	g.Link(host, eth0)
+
+	node := LookupNodeFromNodePathString(g, "host1[Type=host]/uplink to core[Type=device]")
+	if node == nil || node.ID != eth0.ID {
+		t.Errorf("Interface should be found by its alias: %v", node)
+	}
+
+	// the name takes precedence
+	eth1 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Alias": "eth0", "Type": "device"})
+	g.Link(host, eth1)
+
+	node = LookupNodeFromNodePathString(g, "host1[Type=host]/eth0[Type=device]")
+	if node == nil || node.ID != eth0.ID {
+		t.Errorf("Interface should be found by its name first: %v", node)
+	}
+}
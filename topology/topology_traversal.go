@@ -79,7 +79,7 @@ func (s *GraphPathGremlinTraversalStep) Exec(last graph.GraphTraversalStep) (gra
 		for _, i := range tv.Values() {
 			node := i.(*graph.Node)
 
-			nodes := tv.GraphTraversal.Graph.LookupShortestPath(node, graph.Metadata{"Type": "host"}, graph.Metadata{"RelationType": "ownership"})
+			nodes := tv.GraphTraversal.Graph.LookupShortestPath(node, graph.Metadata{"Type": HostType}, graph.Metadata{"RelationType": OwnershipRelation})
 			if len(nodes) > 0 {
 				paths = append(paths, NodePath(nodes))
 			}
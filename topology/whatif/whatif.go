@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package whatif
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/graph"
+	"github.com/redhat-cip/skydive/topology/linker"
+)
+
+// AlertChange is an alert starting, or stopping, to pass its test on a
+// node once the mutations applied
+type AlertChange struct {
+	UUID  string
+	Name  string
+	Node  graph.Identifier
+	State string
+}
+
+// WhatIfReport is the outcome of mutations simulated on a view of the
+// graph, the violations found before them being given for comparison
+type WhatIfReport struct {
+	Mutations    int
+	NodesChanged int
+	EdgesChanged int
+	Baseline     *linker.CheckReport
+	Violations   *linker.CheckReport
+	Alerts       []AlertChange `json:",omitempty"`
+}
+
+// Simulator applies mutations to copy-on-write views of the graph, never
+// to the graph itself, then computes the broadcast domains and the layer3
+// edges, runs the checkers and evaluates the alerts of the nodes on the
+// views. The graph is locked for reading during a simulation, so the
+// simulations are run one at a time.
+type Simulator struct {
+	sync.Mutex
+	Graph        *graph.Graph
+	Alerts       *alert.AlertManager
+	MaxMutations int
+}
+
+// hidden returns whether the mutation refers to a node, or to an edge, of
+// the view out of the scope of a restricted user, the mutation being
+// refused the same way as the ones of unknown elements
+func hidden(v *graph.Graph, m *api.WhatIfMutation, a graph.Authorizer, user string) (string, bool) {
+	if !graph.Restricted(a, user) {
+		return "", false
+	}
+
+	for _, id := range []string{m.ID, m.Parent, m.Child} {
+		if n := v.GetNode(graph.Identifier(id)); n != nil && !a.CanReadNode(user, n) {
+			return id, true
+		}
+		if e := v.GetEdge(graph.Identifier(id)); e != nil && !graph.CanReadEdge(a, user, v, e) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (s *Simulator) node(v *graph.Graph, id string) (*graph.Node, error) {
+	if n := v.GetNode(graph.Identifier(id)); n != nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("Node %s not found", id)
+}
+
+// element returns the node, or the edge, of the view having the ID
+func (s *Simulator) element(v *graph.Graph, id string) (interface{}, graph.Metadata, error) {
+	if n := v.GetNode(graph.Identifier(id)); n != nil {
+		return n, n.Metadata(), nil
+	}
+	if e := v.GetEdge(graph.Identifier(id)); e != nil {
+		return e, e.Metadata(), nil
+	}
+	return nil, nil, fmt.Errorf("Node or edge %s not found", id)
+}
+
+func newID(id string) graph.Identifier {
+	if id == "" {
+		return graph.GenID()
+	}
+	return graph.Identifier(id)
+}
+
+func (s *Simulator) apply(v *graph.Graph, m *api.WhatIfMutation) error {
+	switch m.Op {
+	case "AddNode":
+		if v.NewNode(newID(m.ID), graph.Metadata(m.Metadata)) == nil {
+			return fmt.Errorf("Node %s refused", m.ID)
+		}
+	case "DelNode":
+		n, err := s.node(v, m.ID)
+		if err != nil {
+			return err
+		}
+		v.DelNode(n)
+	case "AddEdge":
+		parent, err := s.node(v, m.Parent)
+		if err != nil {
+			return err
+		}
+		child, err := s.node(v, m.Child)
+		if err != nil {
+			return err
+		}
+		if v.NewEdge(newID(m.ID), parent, child, graph.Metadata(m.Metadata)) == nil {
+			return fmt.Errorf("Edge %s refused", m.ID)
+		}
+	case "DelEdge":
+		e := v.GetEdge(graph.Identifier(m.ID))
+		if e == nil {
+			return fmt.Errorf("Edge %s not found", m.ID)
+		}
+		v.DelEdge(e)
+	case "SetMetadata":
+		e, _, err := s.element(v, m.ID)
+		if err != nil {
+			return err
+		}
+		v.SetMetadata(e, graph.Metadata(m.Metadata))
+	case "AddMetadata":
+		e, _, err := s.element(v, m.ID)
+		if err != nil {
+			return err
+		}
+		v.AddMetadata(e, m.Key, m.Value)
+	case "DelMetadata":
+		e, md, err := s.element(v, m.ID)
+		if err != nil {
+			return err
+		}
+		if _, ok := md[m.Key]; !ok {
+			return nil
+		}
+		kept := make(graph.Metadata, len(md))
+		for k, value := range md {
+			if k != m.Key {
+				kept[k] = value
+			}
+		}
+		v.SetMetadata(e, kept)
+	default:
+		return fmt.Errorf("Unknown mutation: %s", m.Op)
+	}
+
+	return nil
+}
+
+type alertKey struct {
+	uuid string
+	node graph.Identifier
+}
+
+func (s *Simulator) alertMatches(v *graph.Graph) map[alertKey]alert.AlertMatch {
+	matches := make(map[alertKey]alert.AlertMatch)
+	if s.Alerts == nil {
+		return matches
+	}
+
+	v.RLock()
+	defer v.RUnlock()
+
+	for _, m := range s.Alerts.Matches(v) {
+		matches[alertKey{uuid: m.UUID, node: m.Node}] = m
+	}
+	return matches
+}
+
+// alertChanges returns the alerts passing their tests on nodes only before
+// or only after the mutations, sorted by alert and node
+func alertChanges(before, after map[alertKey]alert.AlertMatch) []AlertChange {
+	var changes []AlertChange
+	for k, m := range after {
+		if _, ok := before[k]; !ok {
+			changes = append(changes, AlertChange{UUID: m.UUID, Name: m.Name, Node: m.Node, State: "firing"})
+		}
+	}
+	for k, m := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, AlertChange{UUID: m.UUID, Name: m.Name, Node: m.Node, State: "cleared"})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].UUID != changes[j].UUID {
+			return changes[i].UUID < changes[j].UUID
+		}
+		return changes[i].Node < changes[j].Node
+	})
+	return changes
+}
+
+// Simulate applies the mutations, in order, to a view of the graph,
+// failing on the first one which can't be applied. The baseline is
+// computed the same way on a view without the mutations, so that the
+// checkers of both views start from the same state.
+func (s *Simulator) Simulate(mutations []api.WhatIfMutation) (*WhatIfReport, error) {
+	return s.SimulateAs(mutations, nil, "")
+}
+
+// SimulateAs is Simulate for a user whose reads may be restricted, the
+// mutations of the elements out of the user scope being refused and the
+// violations and alerts out of it removed from the report.
+func (s *Simulator) SimulateAs(mutations []api.WhatIfMutation, a graph.Authorizer, user string) (*WhatIfReport, error) {
+	if s.MaxMutations > 0 && len(mutations) > s.MaxMutations {
+		return nil, fmt.Errorf("Too many mutations, %d for a maximum of %d", len(mutations), s.MaxMutations)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Graph.RLock()
+	defer s.Graph.RUnlock()
+
+	view := s.Graph.NewView()
+	view.Lock()
+	for i := range mutations {
+		if id, ok := hidden(view, &mutations[i], a, user); ok {
+			view.Unlock()
+			return nil, fmt.Errorf("Mutation %d: Node or edge %s not found", i, id)
+		}
+		if err := s.apply(view, &mutations[i]); err != nil {
+			view.Unlock()
+			return nil, fmt.Errorf("Mutation %d: %s", i, err.Error())
+		}
+	}
+	nodes, edges := view.ViewChanges()
+	view.Unlock()
+
+	base := s.Graph.NewView()
+	report := &WhatIfReport{
+		Mutations:    len(mutations),
+		NodesChanged: nodes,
+		EdgesChanged: edges,
+		Baseline:     linker.Check(base).Authorize(a, user, base),
+		Violations:   linker.Check(view).Authorize(a, user, view),
+	}
+	report.Alerts = authorizeAlerts(alertChanges(s.alertMatches(base), s.alertMatches(view)), a, user, base, view)
+
+	return report, nil
+}
+
+// authorizeAlerts returns the alert changes of the nodes the user may read,
+// the cleared ones being checked against the baseline as their node may
+// have been removed by the mutations
+func authorizeAlerts(changes []AlertChange, a graph.Authorizer, user string, base, view *graph.Graph) []AlertChange {
+	if !graph.Restricted(a, user) {
+		return changes
+	}
+
+	var readable []AlertChange
+	for _, c := range changes {
+		v := view
+		if c.State == "cleared" {
+			v = base
+		}
+
+		v.RLock()
+		n := v.GetNode(c.Node)
+		ok := n != nil && a.CanReadNode(user, n)
+		v.RUnlock()
+
+		if ok {
+			readable = append(readable, c)
+		}
+	}
+	return readable
+}
+
+// WhatIf implements the what-if API
+func (s *Simulator) WhatIf(mutations []api.WhatIfMutation, a graph.Authorizer, user string) (interface{}, error) {
+	return s.SimulateAs(mutations, a, user)
+}
+
+func NewSimulator(g *graph.Graph, alerts *alert.AlertManager, maxMutations int) *Simulator {
+	return &Simulator{
+		Graph:        g,
+		Alerts:       alerts,
+		MaxMutations: maxMutations,
+	}
+}
+
+// NewSimulatorFromConfig returns nil if the simulations are disabled
+func NewSimulatorFromConfig(g *graph.Graph, alerts *alert.AlertManager) *Simulator {
+	cfg := config.GetConfig()
+	if !cfg.GetBool("analyzer.whatif.enabled") {
+		return nil
+	}
+	return NewSimulator(g, alerts, cfg.GetInt("analyzer.whatif.max_mutations"))
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package whatif
+
+import (
+	"testing"
+
+	"github.com/redhat-cip/skydive/api"
+	"github.com/redhat-cip/skydive/config"
+	"github.com/redhat-cip/skydive/topology"
+	"github.com/redhat-cip/skydive/topology/alert"
+	"github.com/redhat-cip/skydive/topology/graph"
+)
+
+func TestSimulate(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("analyzer.link_state.enabled", true)
+	defer cfg.Set("analyzer.link_state.enabled", false)
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	veth0 := g.NewNode("veth0", graph.Metadata{"Type": "veth", "Name": "veth0", "State": "UP", "MAC": "aa:bb:cc:dd:ee:00"})
+	veth1 := g.NewNode("veth1", graph.Metadata{"Type": "veth", "Name": "veth1", "State": "UP", "MAC": "aa:bb:cc:dd:ee:01"})
+	g.Link(veth0, veth1, graph.Metadata{"RelationType": topology.Layer2Relation})
+	g.Unlock()
+
+	am := alert.NewAlertManager(g, nil)
+	am.SetAlert(&api.Alert{UUID: "down", Name: "interface down", Select: "State", Test: `State == "DOWN"`})
+
+	s := NewSimulator(g, am, 3)
+	if _, err := s.Simulate(make([]api.WhatIfMutation, 4)); err == nil {
+		t.Error("The number of mutations should be limited")
+	}
+	if _, err := s.Simulate([]api.WhatIfMutation{{Op: "DelNode", ID: "bond0"}}); err == nil {
+		t.Error("Mutating an unknown node should fail")
+	}
+
+	report, err := s.Simulate([]api.WhatIfMutation{
+		{Op: "AddMetadata", ID: "veth1", Key: "State", Value: "DOWN"},
+		{Op: "AddNode", ID: "veth2", Metadata: map[string]interface{}{"Type": "veth", "Name": "veth2", "State": "UP", "MAC": "aa:bb:cc:dd:ee:00"}},
+		{Op: "AddEdge", Parent: "veth1", Child: "veth2", Metadata: map[string]interface{}{"RelationType": topology.Layer2Relation}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Baseline.Violations() != 0 {
+		t.Errorf("No violation expected before the mutations: %+v", report.Baseline)
+	}
+	if len(report.Violations.LinkMismatches) != 2 {
+		t.Errorf("Link state mismatches expected: %+v", report.Violations)
+	}
+	if len(report.Violations.Duplicates) != 1 {
+		t.Errorf("Duplicate MAC expected: %+v", report.Violations)
+	}
+	if report.NodesChanged != 2 || report.EdgesChanged != 1 {
+		t.Errorf("Expected 2 nodes and 1 edge changed, got %d and %d", report.NodesChanged, report.EdgesChanged)
+	}
+	if len(report.Alerts) != 1 || report.Alerts[0].Node != "veth1" || report.Alerts[0].State != "firing" {
+		t.Errorf("Alert expected to fire on veth1: %+v", report.Alerts)
+	}
+
+	// the graph is left untouched
+	if len(g.GetNodes()) != 2 || veth1.Metadata()["State"] != "UP" || len(g.LookupNodes(graph.Metadata{"Type": topology.BroadcastDomainType})) != 0 {
+		t.Errorf("Graph changed by the simulation: %s", g.String())
+	}
+	for _, e := range g.GetEdges() {
+		if _, ok := e.Metadata()["LinkMismatch"]; ok {
+			t.Errorf("Edge of the graph flagged by the simulation: %v", e.Metadata())
+		}
+	}
+}
+
+func TestSimulateAs(t *testing.T) {
+	cfg := config.GetConfig()
+	cfg.Set("analyzer.link_state.enabled", true)
+	defer cfg.Set("analyzer.link_state.enabled", false)
+
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := graph.NewGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	veth0 := g.NewNode("veth0", graph.Metadata{"Type": "veth", "Name": "veth0", "State": "UP"})
+	veth1 := g.NewNode("veth1", graph.Metadata{"Type": "veth", "Name": "veth1", "State": "UP"})
+	g.Link(veth0, veth1, graph.Metadata{"RelationType": topology.Layer2Relation})
+	dev0 := g.NewNode("dev0", graph.Metadata{"Type": "device", "Name": "dev0", "State": "UP"})
+	dev1 := g.NewNode("dev1", graph.Metadata{"Type": "device", "Name": "dev1", "State": "UP"})
+	g.Link(dev0, dev1, graph.Metadata{"RelationType": topology.Layer2Relation})
+	g.Unlock()
+
+	a := &graph.ScopeAuthorizer{Scopes: map[string]graph.ReadScope{"tenant": {Types: []string{"veth"}}}}
+
+	s := NewSimulator(g, nil, 0)
+	if _, err := s.SimulateAs([]api.WhatIfMutation{{Op: "DelNode", ID: "dev0"}}, a, "tenant"); err == nil {
+		t.Error("Mutating a node out of the user scope should fail")
+	}
+
+	mutations := []api.WhatIfMutation{
+		{Op: "AddMetadata", ID: "veth1", Key: "State", Value: "DOWN"},
+		{Op: "AddMetadata", ID: "dev1", Key: "State", Value: "DOWN"},
+	}
+	report, err := s.SimulateAs(mutations[:1], a, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations.LinkMismatches) != 1 {
+		t.Errorf("Link state mismatch of the veths expected: %+v", report.Violations)
+	}
+
+	report, err = s.Simulate(mutations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations.LinkMismatches) != 2 {
+		t.Errorf("Link state mismatches of the veths and the devices expected: %+v", report.Violations)
+	}
+	if violations := report.Violations.Authorize(a, "tenant", g); len(violations.LinkMismatches) != 1 {
+		t.Errorf("Only the mismatch of the veths should be readable: %+v", violations)
+	}
+}